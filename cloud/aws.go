@@ -0,0 +1,1229 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cloud
+
+// This file contains a provideri implementation for Amazon Web Services (EC2),
+// talking to its Query API directly.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/inconshreveable/log15"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	awsName         = "aws"
+	awsAPIVersion   = "2016-11-15"
+	awsService      = "ec2"
+	awsInstanceUp   = "running"
+	awsInstanceGone = "terminated"
+	awsDefaultDisk  = 8
+
+	// awsSpotTermination is the reason EC2 gives for stopping a spot instance
+	// because it took it back.
+	awsSpotTermination = "Server.SpotInstanceTermination"
+)
+
+// awsEndpointFormat is the URL of the EC2 API, with a %s for the region. It is
+// a variable only for testing purposes.
+var awsEndpointFormat = "https://ec2.%s.amazonaws.com/"
+
+// awsPoll is how often we check on the state of the servers we spawn and
+// destroy, and awsTimeout is how long we wait for them to get in to the state
+// we want. They are variables only for testing purposes.
+var (
+	awsPoll    = 1 * time.Second
+	awsTimeout = 10 * time.Minute
+)
+
+// awsValidResourceNameRegexp matches the names we allow for the key pairs and
+// security groups we create.
+var awsValidResourceNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// awsSpotReclaimCodes are the spot request status codes that mean EC2 has
+// taken back, or has given notice it is about to take back, a spot instance.
+var awsSpotReclaimCodes = map[string]bool{
+	"marked-for-termination":                      true,
+	"marked-for-stop":                             true,
+	"marked-for-hibernation":                      true,
+	"instance-terminated-by-price":                true,
+	"instance-terminated-no-capacity":             true,
+	"instance-terminated-capacity-oversubscribed": true,
+	"instance-terminated-launch-group-constraint": true,
+	"instance-stopped-by-price":                   true,
+	"instance-stopped-no-capacity":                true,
+	"instance-stopped-capacity-oversubscribed":    true,
+}
+
+// awsReqEnvs contains the environment variable names we need to use AWS.
+// AWS_SUBNET_ID is the id of an existing subnet to use instead of creating a
+// VPC, setting AWS_SPOT to "true" makes servers spawned without an external IP
+// spot instances, and AWS_SPOT_MAX_PRICE is the most you're willing to pay per
+// hour for them (defaulting to the on-demand price).
+var awsReqEnvs = [...]string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_REGION"}
+var awsMaybeEnvs = [...]string{"AWS_SESSION_TOKEN", "AWS_SUBNET_ID", "AWS_SPOT", "AWS_SPOT_MAX_PRICE"}
+
+// awsp is our implementer of provideri
+type awsp struct {
+	lastFlavorCache time.Time
+	accessKey       string
+	secretKey       string
+	sessionToken    string
+	region          string
+	vpcID           string
+	subnetID        string
+	securityGroup   string
+	spotMaxPrice    string
+	ownName         string
+	log15.Logger
+	client      *http.Client
+	fmap        map[string]*Flavor
+	imap        map[string]*awsImage
+	preempted   map[string]bool
+	ownInstance *awsInstance
+	fmapMutex   sync.RWMutex
+	imapMutex   sync.RWMutex
+	pMutex      sync.RWMutex // protects preempted
+	spot        bool
+}
+
+// awsError is an error returned by the EC2 API.
+type awsError struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *awsError) Error() string {
+	return fmt.Sprintf("aws error %s: %s", e.Code, e.Message)
+}
+
+// awsTag is a key value pair attached to an EC2 resource.
+type awsTag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+// awsImage is an AMI that servers can boot from.
+type awsImage struct {
+	ID             string `xml:"imageId"`
+	Name           string `xml:"name"`
+	CreationDate   string `xml:"creationDate"`
+	RootDeviceName string `xml:"rootDeviceName"`
+	BlockDevices   []struct {
+		DeviceName string `xml:"deviceName"`
+		VolumeSize int    `xml:"ebs>volumeSize"`
+	} `xml:"blockDeviceMapping>item"`
+}
+
+// rootSize returns the size in GB of the image's root volume, or 0 if not
+// known.
+func (i *awsImage) rootSize() int {
+	for _, bd := range i.BlockDevices {
+		if bd.DeviceName == i.RootDeviceName {
+			return bd.VolumeSize
+		}
+	}
+	return 0
+}
+
+// awsInstance is an EC2 server.
+type awsInstance struct {
+	ID               string   `xml:"instanceId"`
+	State            string   `xml:"instanceState>name"`
+	StateReason      string   `xml:"stateReason>code"`
+	InstanceType     string   `xml:"instanceType"`
+	PrivateDNSName   string   `xml:"privateDnsName"`
+	PrivateIP        string   `xml:"privateIpAddress"`
+	PublicIP         string   `xml:"ipAddress"`
+	SubnetID         string   `xml:"subnetId"`
+	VpcID            string   `xml:"vpcId"`
+	Lifecycle        string   `xml:"instanceLifecycle"`
+	SpotRequestID    string   `xml:"spotInstanceRequestId"`
+	Tags             []awsTag `xml:"tagSet>item"`
+	AvailabilityZone string   `xml:"placement>availabilityZone"`
+}
+
+// name returns the value of the instance's Name tag.
+func (i *awsInstance) name() string {
+	for _, tag := range i.Tags {
+		if tag.Key == "Name" {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+// ip returns the private ip of the instance, or its public one if external is
+// true.
+func (i *awsInstance) ip(external bool) string {
+	if external {
+		return i.PublicIP
+	}
+	return i.PrivateIP
+}
+
+// requiredEnv returns envs that are definitely required.
+func (p *awsp) requiredEnv() []string {
+	return awsReqEnvs[:]
+}
+
+// maybeEnv returns envs that might be required.
+func (p *awsp) maybeEnv() []string {
+	return awsMaybeEnvs[:]
+}
+
+// initialize uses our required environment variables to set up the
+// credentials we will use to sign our requests in the other methods.
+func (p *awsp) initialize(logger log15.Logger) error {
+	p.Logger = logger.New("cloud", awsName)
+
+	p.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	p.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	p.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	p.region = os.Getenv("AWS_REGION")
+	p.subnetID = os.Getenv("AWS_SUBNET_ID")
+	p.spot, _ = strconv.ParseBool(os.Getenv("AWS_SPOT")) // #nosec anything not true means false
+	p.spotMaxPrice = os.Getenv("AWS_SPOT_MAX_PRICE")
+	if p.accessKey == "" || p.secretKey == "" || p.region == "" {
+		return errors.New("AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION must all be set")
+	}
+
+	if p.client == nil {
+		p.client = &http.Client{Timeout: 1 * time.Minute}
+	}
+
+	// flavors and images are retrieved on-demand via caching methods that store
+	// in these maps
+	p.fmap = make(map[string]*Flavor)
+	p.imap = make(map[string]*awsImage)
+
+	// we remember which of our spot instances got taken back
+	p.preempted = make(map[string]bool)
+
+	return nil
+}
+
+// awsSignV4 signs the given request, which will send the given body, with AWS
+// signature version 4, signing the Host and all the headers already set on the
+// request.
+func awsSignV4(req *http.Request, body []byte, accessKey, secretKey, region, service string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, vals := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(vals, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part)) // #nosec hash writes never fail
+		key = mac.Sum(nil)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// request makes an EC2 API call with the given action and parameters, decoding
+// the XML response in to result if it is not nil.
+func (p *awsp) request(action string, params url.Values, result interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("Action", action)
+	params.Set("Version", awsAPIVersion)
+	body := []byte(params.Encode())
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(awsEndpointFormat, p.region), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if p.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.sessionToken)
+	}
+	awsSignV4(req, body, p.accessKey, p.secretKey, p.region, awsService, time.Now())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // #nosec nothing useful to do if closing fails
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		errResp := struct {
+			Errors []*awsError `xml:"Errors>Error"`
+		}{}
+		if xml.Unmarshal(content, &errResp) == nil && len(errResp.Errors) > 0 {
+			return errResp.Errors[0]
+		}
+		return &awsError{Code: strconv.Itoa(resp.StatusCode), Message: resp.Status}
+	}
+
+	if result != nil {
+		return xml.Unmarshal(content, result)
+	}
+	return nil
+}
+
+// isNotFound tells you if the given error is the API telling you that the
+// thing you asked about doesn't exist.
+func (p *awsp) isNotFound(err error) bool {
+	var aerr *awsError
+	return errors.As(err, &aerr) && strings.HasSuffix(aerr.Code, "NotFound")
+}
+
+// awsFilter adds a Filter.n parameter to params, for the given filter name and
+// values.
+func awsFilter(params url.Values, n int, name string, values ...string) {
+	prefix := "Filter." + strconv.Itoa(n) + "."
+	params.Set(prefix+"Name", name)
+	for i, val := range values {
+		params.Set(prefix+"Value."+strconv.Itoa(i+1), val)
+	}
+}
+
+// awsTagParams returns parameters for the CreateTags action that give the
+// resource with the given id the given Name tag.
+func awsTagParams(id, name string) url.Values {
+	return url.Values{
+		"ResourceId.1": {id},
+		"Tag.1.Key":    {"Name"},
+		"Tag.1.Value":  {name},
+	}
+}
+
+// describeInstances returns the instances matching the given parameters,
+// following pages.
+func (p *awsp) describeInstances(params url.Values) ([]*awsInstance, error) {
+	var instances []*awsInstance
+	for {
+		page := struct {
+			Reservations []struct {
+				Instances []*awsInstance `xml:"instancesSet>item"`
+			} `xml:"reservationSet>item"`
+			NextToken string `xml:"nextToken"`
+		}{}
+		err := p.request("DescribeInstances", params, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page.Reservations {
+			instances = append(instances, r.Instances...)
+		}
+		if page.NextToken == "" {
+			return instances, nil
+		}
+		params.Set("NextToken", page.NextToken)
+	}
+}
+
+// listInstances returns our pending and running instances whose Name tags
+// start with the given prefix.
+func (p *awsp) listInstances(prefix string) ([]*awsInstance, error) {
+	params := url.Values{}
+	awsFilter(params, 1, "tag:Name", prefix+"*")
+	awsFilter(params, 2, "instance-state-name", "pending", awsInstanceUp)
+	return p.describeInstances(params)
+}
+
+// getInstance gets the details of the server with the given ID.
+func (p *awsp) getInstance(serverID string) (*awsInstance, error) {
+	instances, err := p.describeInstances(url.Values{"InstanceId.1": {serverID}})
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, &awsError{Code: "InvalidInstanceID.NotFound", Message: "server " + serverID + " does not exist"}
+	}
+	return instances[0], nil
+}
+
+// cacheFlavors retrieves the current list of x86_64 instance types and caches
+// them in p. Old no-longer existent flavors are kept forever, so we can still
+// see what resources old instances are using. Most instance types have no disk
+// of their own; servers get a root volume of the size requested during
+// spawn().
+func (p *awsp) cacheFlavors() error {
+	p.fmapMutex.Lock()
+	defer func() {
+		p.lastFlavorCache = time.Now()
+		p.fmapMutex.Unlock()
+	}()
+
+	params := url.Values{"MaxResults": {"100"}}
+	awsFilter(params, 1, "processor-info.supported-architecture", "x86_64")
+	for {
+		page := struct {
+			Types []struct {
+				Name  string `xml:"instanceType"`
+				Cores int    `xml:"vCpuInfo>defaultVCpus"`
+				RAM   int    `xml:"memoryInfo>sizeInMiB"`
+				Disk  int    `xml:"instanceStorageInfo>totalSizeInGB"`
+			} `xml:"instanceTypeSet>item"`
+			NextToken string `xml:"nextToken"`
+		}{}
+		err := p.request("DescribeInstanceTypes", params, &page)
+		if err != nil {
+			return err
+		}
+		for _, it := range page.Types {
+			p.fmap[it.Name] = &Flavor{
+				ID:    it.Name,
+				Name:  it.Name,
+				Cores: it.Cores,
+				RAM:   it.RAM,
+				Disk:  it.Disk,
+			}
+		}
+		if page.NextToken == "" {
+			return nil
+		}
+		params.Set("NextToken", page.NextToken)
+	}
+}
+
+// getFlavor retrieves the desired flavor by id from the cache. If it's not in
+// the cache, will call cacheFlavors() to get any newly added flavors. If still
+// not in the cache, returns nil and an error.
+func (p *awsp) getFlavor(flavorID string) (*Flavor, error) {
+	p.fmapMutex.RLock()
+	flavor, found := p.fmap[flavorID]
+	p.fmapMutex.RUnlock()
+	if !found {
+		err := p.cacheFlavors()
+		if err != nil {
+			return nil, err
+		}
+
+		p.fmapMutex.RLock()
+		flavor, found = p.fmap[flavorID]
+		p.fmapMutex.RUnlock()
+		if !found {
+			return nil, errors.New(invalidFlavorIDMsg + ": " + flavorID)
+		}
+	}
+	return flavor, nil
+}
+
+// getImage retrieves the desired AMI, by id (eg. "ami-0abcdef1234567890") or
+// by name prefix, picking the newest available image whose name starts with
+// the prefix. By default only your own images are considered; to use someone
+// else's, prefix with their account id or alias and a colon, eg.
+// "099720109477:ubuntu/images/hvm-ssd/ubuntu-focal-20.04-amd64-server".
+// Images are cached.
+func (p *awsp) getImage(osPrefix string) (*awsImage, error) {
+	p.imapMutex.RLock()
+	image, found := p.imap[osPrefix]
+	p.imapMutex.RUnlock()
+	if found {
+		return image, nil
+	}
+
+	params := url.Values{}
+	if strings.HasPrefix(osPrefix, "ami-") {
+		params.Set("ImageId.1", osPrefix)
+	} else {
+		owner, prefix := "self", osPrefix
+		if parts := strings.SplitN(osPrefix, ":", 2); len(parts) == 2 {
+			owner, prefix = parts[0], parts[1]
+		}
+		params.Set("Owner.1", owner)
+		awsFilter(params, 1, "name", prefix+"*")
+		awsFilter(params, 2, "state", "available")
+	}
+
+	images := struct {
+		Images []*awsImage `xml:"imagesSet>item"`
+	}{}
+	err := p.request("DescribeImages", params, &images)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range images.Images {
+		if image == nil || i.CreationDate > image.CreationDate {
+			image = i
+		}
+	}
+	if image == nil {
+		return nil, errors.New("no OS image with prefix [" + osPrefix + "] was found")
+	}
+
+	p.imapMutex.Lock()
+	p.imap[osPrefix] = image
+	p.imapMutex.Unlock()
+	return image, nil
+}
+
+// deploy achieves the aims of Deploy(). AWS provides DNS and a gateway to
+// servers itself, so gatewayIP and dnsNameServers are ignored, and we don't
+// need a config drive.
+func (p *awsp) deploy(resources *Resources, requiredPorts []int, useConfigDrive bool, gatewayIP, cidr string, dnsNameServers []string) error {
+	// the resource name can only contain letters, numbers, underscores,
+	// hyphens and periods
+	if !awsValidResourceNameRegexp.MatchString(resources.ResourceName) {
+		return Error{awsName, "deploy", ErrBadResourceName}
+	}
+
+	// we find or create a subnet with the given CIDR for spawn() to use
+	_, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	err = p.deployKeyPair(resources)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case p.inCloud():
+		// use the subnet we're on
+		p.subnetID = p.ownInstance.SubnetID
+		fallthrough
+	case p.subnetID != "":
+		subnets, errs := p.describeSubnets(url.Values{"SubnetId.1": {p.subnetID}})
+		if errs != nil {
+			return errs
+		}
+		if len(subnets) == 0 || subnets[0].CIDR != cidr {
+			return Error{awsName, "deploy", ErrBadCIDR}
+		}
+		p.vpcID = subnets[0].VpcID
+	default:
+		err = p.deployNetwork(resources, cidr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.deploySecurityGroup(resources, requiredPorts)
+}
+
+// deployKeyPair gets or creates a key pair named after our resource name.
+func (p *awsp) deployKeyPair(resources *Resources) error {
+	name := resources.ResourceName
+	err := p.request("DescribeKeyPairs", url.Values{"KeyName.1": {name}}, nil)
+	if err == nil {
+		resources.Details["keypair"] = name
+		return nil
+	}
+	if !p.isNotFound(err) {
+		return err
+	}
+
+	// we create the key ourselves and import the public part, so that it is in
+	// the same form as for our other providers
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	err = p.request("ImportKeyPair", url.Values{
+		"KeyName":           {name},
+		"PublicKeyMaterial": {base64.StdEncoding.EncodeToString(ssh.MarshalAuthorizedKey(pub))},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	resources.PrivateKey = string(pem.EncodeToMemory(privateKeyPEM))
+	resources.Details["keypair"] = name
+	return nil
+}
+
+// awsSubnet is a subnet of a VPC.
+type awsSubnet struct {
+	ID               string `xml:"subnetId"`
+	VpcID            string `xml:"vpcId"`
+	CIDR             string `xml:"cidrBlock"`
+	AvailabilityZone string `xml:"availabilityZone"`
+}
+
+// describeSubnets returns the subnets matching the given parameters.
+func (p *awsp) describeSubnets(params url.Values) ([]*awsSubnet, error) {
+	subnets := struct {
+		Subnets []*awsSubnet `xml:"subnetSet>item"`
+	}{}
+	err := p.request("DescribeSubnets", params, &subnets)
+	return subnets.Subnets, err
+}
+
+// deployNetwork gets or creates a VPC named after our resource name, with a
+// subnet using the given CIDR that has an internet gateway.
+func (p *awsp) deployNetwork(resources *Resources, cidr string) error {
+	name := resources.ResourceName
+
+	// get/create vpc
+	params := url.Values{}
+	awsFilter(params, 1, "tag:Name", name)
+	vpcs := struct {
+		IDs []string `xml:"vpcSet>item>vpcId"`
+	}{}
+	err := p.request("DescribeVpcs", params, &vpcs)
+	if err != nil {
+		return err
+	}
+	if len(vpcs.IDs) > 0 {
+		p.vpcID = vpcs.IDs[0]
+	} else {
+		vpc := struct {
+			ID string `xml:"vpc>vpcId"`
+		}{}
+		err = p.request("CreateVpc", url.Values{"CidrBlock": {cidr}}, &vpc)
+		if err != nil {
+			return err
+		}
+		p.vpcID = vpc.ID
+		err = p.request("CreateTags", awsTagParams(p.vpcID, name), nil)
+		if err != nil {
+			return err
+		}
+
+		// our servers need hostnames so they can tell that they're in the
+		// cloud
+		err = p.request("ModifyVpcAttribute", url.Values{"VpcId": {p.vpcID}, "EnableDnsHostnames.Value": {"true"}}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	resources.Details["vpc"] = p.vpcID
+
+	// get/create subnet
+	params = url.Values{}
+	awsFilter(params, 1, "vpc-id", p.vpcID)
+	awsFilter(params, 2, "cidr-block", cidr)
+	subnets, err := p.describeSubnets(params)
+	if err != nil {
+		return err
+	}
+	if len(subnets) > 0 {
+		p.subnetID = subnets[0].ID
+	} else {
+		subnet := struct {
+			ID string `xml:"subnet>subnetId"`
+		}{}
+		err = p.request("CreateSubnet", url.Values{"VpcId": {p.vpcID}, "CidrBlock": {cidr}}, &subnet)
+		if err != nil {
+			return err
+		}
+		p.subnetID = subnet.ID
+		err = p.request("CreateTags", awsTagParams(p.subnetID, name), nil)
+		if err != nil {
+			return err
+		}
+	}
+	resources.Details["subnet"] = p.subnetID
+
+	// get/create an internet gateway, and route to it
+	params = url.Values{}
+	awsFilter(params, 1, "attachment.vpc-id", p.vpcID)
+	gateways := struct {
+		IDs []string `xml:"internetGatewaySet>item>internetGatewayId"`
+	}{}
+	err = p.request("DescribeInternetGateways", params, &gateways)
+	if err != nil {
+		return err
+	}
+	if len(gateways.IDs) > 0 {
+		resources.Details["gateway"] = gateways.IDs[0]
+		return nil
+	}
+
+	gateway := struct {
+		ID string `xml:"internetGateway>internetGatewayId"`
+	}{}
+	err = p.request("CreateInternetGateway", nil, &gateway)
+	if err != nil {
+		return err
+	}
+	resources.Details["gateway"] = gateway.ID
+	err = p.request("AttachInternetGateway", url.Values{"InternetGatewayId": {gateway.ID}, "VpcId": {p.vpcID}}, nil)
+	if err != nil {
+		return err
+	}
+
+	params = url.Values{}
+	awsFilter(params, 1, "vpc-id", p.vpcID)
+	awsFilter(params, 2, "association.main", "true")
+	tables := struct {
+		IDs []string `xml:"routeTableSet>item>routeTableId"`
+	}{}
+	err = p.request("DescribeRouteTables", params, &tables)
+	if err != nil {
+		return err
+	}
+	if len(tables.IDs) == 0 {
+		return fmt.Errorf("vpc %s has no main route table", p.vpcID)
+	}
+	err = p.request("CreateRoute", url.Values{
+		"RouteTableId":         {tables.IDs[0]},
+		"DestinationCidrBlock": {"0.0.0.0/0"},
+		"GatewayId":            {gateway.ID},
+	}, nil)
+	var aerr *awsError
+	if errors.As(err, &aerr) && aerr.Code == "RouteAlreadyExists" {
+		return nil
+	}
+	return err
+}
+
+// deploySecurityGroup gets or creates a security group that opens the given
+// ports (and ICMP) to the world, and everything to its other members.
+func (p *awsp) deploySecurityGroup(resources *Resources, requiredPorts []int) error {
+	if len(requiredPorts) == 0 {
+		return nil
+	}
+
+	params := url.Values{}
+	awsFilter(params, 1, "group-name", resources.ResourceName)
+	awsFilter(params, 2, "vpc-id", p.vpcID)
+	groups := struct {
+		IDs []string `xml:"securityGroupInfo>item>groupId"`
+	}{}
+	err := p.request("DescribeSecurityGroups", params, &groups)
+	if err != nil {
+		return err
+	}
+	if len(groups.IDs) > 0 {
+		p.securityGroup = groups.IDs[0]
+		resources.Details["secgroup"] = p.securityGroup
+		return nil
+	}
+
+	group := struct {
+		ID string `xml:"groupId"`
+	}{}
+	err = p.request("CreateSecurityGroup", url.Values{
+		"GroupName":        {resources.ResourceName},
+		"GroupDescription": {"access amongst wr-spawned nodes"},
+		"VpcId":            {p.vpcID},
+	}, &group)
+	if err != nil {
+		return err
+	}
+	p.securityGroup = group.ID
+	resources.Details["secgroup"] = p.securityGroup
+
+	params = url.Values{"GroupId": {p.securityGroup}}
+	permission := func(n int, protocol string, from, to int, fromGroup string) {
+		prefix := "IpPermissions." + strconv.Itoa(n) + "."
+		params.Set(prefix+"IpProtocol", protocol)
+		if protocol != "-1" {
+			params.Set(prefix+"FromPort", strconv.Itoa(from))
+			params.Set(prefix+"ToPort", strconv.Itoa(to))
+		}
+		if fromGroup != "" {
+			params.Set(prefix+"Groups.1.GroupId", fromGroup)
+		} else {
+			params.Set(prefix+"IpRanges.1.CidrIp", "0.0.0.0/0")
+		}
+	}
+	for i, port := range requiredPorts {
+		permission(i+1, "tcp", port, port, "")
+	}
+	permission(len(requiredPorts)+1, "icmp", -1, -1, "")
+	permission(len(requiredPorts)+2, "-1", 0, 0, p.securityGroup)
+	return p.request("AuthorizeSecurityGroupIngress", params, nil)
+}
+
+// getCurrentServers returns details of other servers with the given resource
+// name prefix.
+func (p *awsp) getCurrentServers(resources *Resources) ([][]string, error) {
+	instances, err := p.listInstances(resources.ResourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var sdetails [][]string
+	for _, instance := range instances {
+		if p.ownName != instance.name() {
+			sdetails = append(sdetails, []string{instance.ID, instance.PrivateIP, instance.name(), ""})
+		}
+	}
+	return sdetails, nil
+}
+
+// inCloud checks if we're currently running on an EC2 server based on our
+// hostname matching the private DNS name of an instance in our region.
+func (p *awsp) inCloud() bool {
+	if p.ownInstance != nil {
+		return true
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return false
+	}
+	// (EC2 hostnames are like ip-10-0-0-1 or ip-10-0-0-1.ec2.internal)
+	hostname = strings.Split(hostname, ".")[0]
+
+	params := url.Values{}
+	awsFilter(params, 1, "private-dns-name", hostname+".*")
+	awsFilter(params, 2, "instance-state-name", awsInstanceUp)
+	instances, err := p.describeInstances(params)
+	if err != nil {
+		p.Warn("listing instances failed", "err", err)
+		return false
+	}
+	if len(instances) == 0 {
+		return false
+	}
+	p.ownInstance = instances[0]
+	p.ownName = p.ownInstance.name()
+	return true
+}
+
+// flavors returns all our flavors.
+func (p *awsp) flavors() map[string]*Flavor {
+	// update the cached flavors at most once every half hour
+	p.fmapMutex.RLock()
+	if time.Since(p.lastFlavorCache) > 30*time.Minute {
+		p.fmapMutex.RUnlock()
+		err := p.cacheFlavors()
+		if err != nil {
+			p.Warn("failed to cache available flavors", "err", err)
+		}
+		p.fmapMutex.RLock()
+	}
+	fmap := make(map[string]*Flavor)
+	for key, val := range p.fmap {
+		fmap[key] = val
+	}
+	p.fmapMutex.RUnlock()
+	return fmap
+}
+
+// getQuota achieves the aims of GetQuota(). The EC2 API only tells us the
+// maximum number of instances we can have; the vCPU limits AWS actually
+// applies are only available from the separate Service Quotas API, so MaxCores
+// and MaxRAM will be 0 (unlimited) and we'll find out we've run out when spawn
+// fails. The used values are worked out from our running instances.
+func (p *awsp) getQuota() (*Quota, error) {
+	attrs := struct {
+		Values []string `xml:"accountAttributeSet>item>attributeValueSet>item>attributeValue"`
+	}{}
+	err := p.request("DescribeAccountAttributes", url.Values{"AttributeName.1": {"max-instances"}}, &attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	quota := &Quota{}
+	if len(attrs.Values) > 0 {
+		quota.MaxInstances, err = strconv.Atoi(attrs.Values[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params := url.Values{}
+	awsFilter(params, 1, "instance-state-name", "pending", awsInstanceUp)
+	instances, err := p.describeInstances(params)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		quota.UsedInstances++
+		f, errf := p.getFlavor(instance.InstanceType)
+		if errf != nil {
+			p.Warn("an instance has an instance type we don't know about; our remaining quota estimation will be off", "server", instance.ID, "flavor", instance.InstanceType)
+			continue
+		}
+		quota.UsedCores += f.Cores
+		quota.UsedRAM += f.RAM
+	}
+
+	return quota, nil
+}
+
+// spawn achieves the aims of Spawn(). All servers get a public IP so that they
+// can reach the internet, but the returned serverIP is only the public one if
+// externalIP is true. Servers with an external IP are never spot instances;
+// others are if AWS_SPOT is true. If a zone is supplied, the server is put in
+// the subnet of our VPC in that availability zone. osUser is ignored, since
+// AMIs come with their own user that gets our key.
+func (p *awsp) spawn(resources *Resources, osPrefix string, osUser string, flavorID string, diskGB int, zone string, externalIP bool, usingQuotaCh chan bool) (serverID, serverIP, serverName, adminPass string, err error) {
+	image, err := p.getImage(osPrefix)
+	if err != nil {
+		usingQuotaCh <- false
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	_, err = p.getFlavor(flavorID)
+	if err != nil {
+		usingQuotaCh <- false
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	subnetID := p.subnetID
+	if zone != "" {
+		params := url.Values{}
+		awsFilter(params, 1, "vpc-id", p.vpcID)
+		awsFilter(params, 2, "availability-zone", zone)
+		subnets, errs := p.describeSubnets(params)
+		if errs == nil && len(subnets) == 0 {
+			errs = fmt.Errorf("there is no subnet in availability zone %s", zone)
+		}
+		if errs != nil {
+			usingQuotaCh <- false
+			return serverID, serverIP, serverName, adminPass, errs
+		}
+		subnetID = subnets[0].ID
+	}
+
+	// if the OS image itself specifies a minimum disk size and it's higher than
+	// requested disk, increase our requested disk
+	if imageDisk := image.rootSize(); imageDisk > diskGB {
+		diskGB = imageDisk
+	}
+	if diskGB < awsDefaultDisk {
+		diskGB = awsDefaultDisk
+	}
+
+	serverName = uniqueResourceName(resources.ResourceName)
+	params := url.Values{
+		"ImageId":                        {image.ID},
+		"InstanceType":                   {flavorID},
+		"MinCount":                       {"1"},
+		"MaxCount":                       {"1"},
+		"KeyName":                        {resources.Details["keypair"]},
+		"UserData":                       {base64.StdEncoding.EncodeToString(sentinelInitScript)},
+		"NetworkInterface.1.DeviceIndex": {"0"},
+		"NetworkInterface.1.SubnetId":    {subnetID},
+		"NetworkInterface.1.AssociatePublicIpAddress":  {"true"},
+		"NetworkInterface.1.DeleteOnTermination":       {"true"},
+		"BlockDeviceMapping.1.DeviceName":              {image.RootDeviceName},
+		"BlockDeviceMapping.1.Ebs.VolumeSize":          {strconv.Itoa(diskGB)},
+		"BlockDeviceMapping.1.Ebs.VolumeType":          {"gp2"},
+		"BlockDeviceMapping.1.Ebs.DeleteOnTermination": {"true"},
+		"TagSpecification.1.ResourceType":              {"instance"},
+		"TagSpecification.1.Tag.1.Key":                 {"Name"},
+		"TagSpecification.1.Tag.1.Value":               {serverName},
+	}
+	if p.securityGroup != "" {
+		params.Set("NetworkInterface.1.SecurityGroupId.1", p.securityGroup)
+	}
+	if !externalIP && p.spot {
+		params.Set("InstanceMarketOptions.MarketType", "spot")
+		params.Set("InstanceMarketOptions.SpotOptions.SpotInstanceType", "one-time")
+		params.Set("InstanceMarketOptions.SpotOptions.InstanceInterruptionBehavior", "terminate")
+		if p.spotMaxPrice != "" {
+			params.Set("InstanceMarketOptions.SpotOptions.MaxPrice", p.spotMaxPrice)
+		}
+	}
+
+	reservation := struct {
+		Instances []*awsInstance `xml:"instancesSet>item"`
+	}{}
+	err = p.request("RunInstances", params, &reservation)
+	usingQuotaCh <- true
+	if err == nil && len(reservation.Instances) == 0 {
+		err = fmt.Errorf("no server was created")
+	}
+	if err != nil {
+		return serverID, serverIP, serverName, adminPass, err
+	}
+	serverID = reservation.Instances[0].ID
+
+	// wait for it to come up; if that fails we delete it, since we're going to
+	// return an error that we failed to spawn
+	current, err := p.waitForState(serverID, awsInstanceUp)
+	if err != nil {
+		delerr := p.destroyServer(serverID)
+		if delerr != nil && !p.isNotFound(delerr) {
+			err = fmt.Errorf("%s\nadditionally, there was an error deleting the bad server: %s", err, delerr)
+		}
+		return "", serverIP, serverName, adminPass, err
+	}
+
+	serverIP = current.ip(externalIP)
+	if serverIP == "" {
+		errd := p.destroyServer(serverID)
+		if errd != nil {
+			p.Warn("server destruction after not finding ip", "server", serverID, "err", errd)
+		}
+		return serverID, serverIP, serverName, adminPass, fmt.Errorf("server %s has no ip address", serverID)
+	}
+
+	return serverID, serverIP, serverName, adminPass, err
+}
+
+// waitForState waits for the server with the given ID to be in the given
+// state, returning an error if it ends up in some other final state.
+func (p *awsp) waitForState(serverID, state string) (*awsInstance, error) {
+	timeout := time.After(awsTimeout)
+	ticker := time.NewTicker(awsPoll)
+	defer ticker.Stop()
+	for {
+		current, err := p.getInstance(serverID)
+		if err != nil {
+			return nil, err
+		}
+		switch current.State {
+		case state:
+			return current, nil
+		case "stopped", awsInstanceGone:
+			return nil, fmt.Errorf("server %s is %s (%s)", serverID, current.State, current.StateReason)
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-timeout:
+			return nil, fmt.Errorf("server %s is %s after %s, timing out on it ever becoming %s", serverID, current.State, awsTimeout, state)
+		}
+	}
+}
+
+// errIsNoHardware returns true if error says the availability zone has run out
+// of the instance type needed for a new server.
+func (p *awsp) errIsNoHardware(err error) bool {
+	return strings.Contains(err.Error(), "InsufficientInstanceCapacity")
+}
+
+// checkServer achieves the aims of CheckServer(). A spot instance that EC2 has
+// given notice it is going to take back is not considered to be working, and
+// we note that it was preempted, for wasPreempted().
+func (p *awsp) checkServer(serverID string) (bool, error) {
+	instance, err := p.getInstance(serverID)
+	if err != nil {
+		if p.isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if instance.StateReason == awsSpotTermination {
+		p.markPreempted(serverID)
+		return false, nil
+	}
+
+	if instance.State == awsInstanceUp && instance.Lifecycle == "spot" && instance.SpotRequestID != "" {
+		requests := struct {
+			Codes []string `xml:"spotInstanceRequestSet>item>status>code"`
+		}{}
+		errs := p.request("DescribeSpotInstanceRequests", url.Values{"SpotInstanceRequestId.1": {instance.SpotRequestID}}, &requests)
+		if errs != nil {
+			p.Warn("failed to check on spot request", "server", serverID, "err", errs)
+		} else if len(requests.Codes) > 0 && awsSpotReclaimCodes[requests.Codes[0]] {
+			p.Debug("spot instance is being taken back", "server", serverID, "status", requests.Codes[0])
+			p.markPreempted(serverID)
+			return false, nil
+		}
+	}
+
+	return instance.State == awsInstanceUp, nil
+}
+
+// markPreempted notes that the server with the given ID was preempted.
+func (p *awsp) markPreempted(serverID string) {
+	p.pMutex.Lock()
+	defer p.pMutex.Unlock()
+	p.preempted[serverID] = true
+}
+
+// wasPreempted tells you if checkServer() found that the server with the given
+// ID had been, or was about to be, taken back by EC2.
+func (p *awsp) wasPreempted(serverID string) bool {
+	p.pMutex.RLock()
+	defer p.pMutex.RUnlock()
+	return p.preempted[serverID]
+}
+
+// destroyServer achieves the aims of DestroyServer()
+func (p *awsp) destroyServer(serverID string) error {
+	err := p.request("TerminateInstances", url.Values{"InstanceId.1": {serverID}}, nil)
+	if err != nil {
+		return err
+	}
+
+	p.pMutex.Lock()
+	delete(p.preempted, serverID)
+	p.pMutex.Unlock()
+	return nil
+}
+
+// rebootServer achieves the aims of RebootServer(). A server that has stopped
+// is started again instead.
+func (p *awsp) rebootServer(serverID string) error {
+	instance, err := p.getInstance(serverID)
+	if err != nil {
+		return err
+	}
+
+	action := "RebootInstances"
+	if instance.State == "stopped" {
+		action = "StartInstances"
+	}
+	return p.request(action, url.Values{"InstanceId.1": {serverID}}, nil)
+}
+
+// tearDown achieves the aims of TearDown()
+func (p *awsp) tearDown(resources *Resources) error {
+	// throughout we'll ignore errors because we want to try and delete
+	// as much as possible; we'll end up returning a concatenation of all of
+	// them though
+	var merr *multierror.Error
+
+	// delete servers, except for ourselves
+	instances, err := p.listInstances(resources.ResourceName)
+	merr = p.combineError(merr, err)
+	var destroyed []string
+	for _, instance := range instances {
+		if p.ownName == instance.name() {
+			continue
+		}
+		t := time.Now()
+		errd := p.destroyServer(instance.ID)
+		p.Debug("delete server", "time", time.Since(t), "id", instance.ID)
+		if errd != nil {
+			// ignore errors, just try to delete others
+			p.Warn("server destruction during teardown failed", "server", instance.ID, "err", errd)
+			continue
+		}
+		destroyed = append(destroyed, instance.ID)
+	}
+
+	if p.ownName != "" {
+		return merr.ErrorOrNil()
+	}
+
+	// the network can't be deleted until the servers on it are gone
+	for _, id := range destroyed {
+		_, err = p.waitForState(id, awsInstanceGone)
+		merr = p.combineError(merr, err)
+	}
+
+	if id := resources.Details["secgroup"]; id != "" {
+		t := time.Now()
+		err = p.request("DeleteSecurityGroup", url.Values{"GroupId": {id}}, nil)
+		p.Debug("delete security group", "time", time.Since(t), "id", id, "err", err)
+		merr = p.combineError(merr, err)
+	}
+
+	if name := resources.Details["keypair"]; name != "" {
+		t := time.Now()
+		err = p.request("DeleteKeyPair", url.Values{"KeyName": {name}}, nil)
+		p.Debug("delete keypair", "time", time.Since(t), "id", name, "err", err)
+		merr = p.combineError(merr, err)
+	}
+
+	if id := resources.Details["gateway"]; id != "" {
+		t := time.Now()
+		err = p.request("DetachInternetGateway", url.Values{"InternetGatewayId": {id}, "VpcId": {resources.Details["vpc"]}}, nil)
+		merr = p.combineError(merr, err)
+		err = p.request("DeleteInternetGateway", url.Values{"InternetGatewayId": {id}}, nil)
+		p.Debug("delete internet gateway", "time", time.Since(t), "id", id, "err", err)
+		merr = p.combineError(merr, err)
+	}
+
+	if id := resources.Details["subnet"]; id != "" {
+		t := time.Now()
+		err = p.request("DeleteSubnet", url.Values{"SubnetId": {id}}, nil)
+		p.Debug("delete subnet", "time", time.Since(t), "id", id, "err", err)
+		merr = p.combineError(merr, err)
+	}
+
+	if id := resources.Details["vpc"]; id != "" {
+		t := time.Now()
+		err = p.request("DeleteVpc", url.Values{"VpcId": {id}}, nil)
+		p.Debug("delete vpc", "time", time.Since(t), "id", id, "err", err)
+		merr = p.combineError(merr, err)
+	}
+
+	// our servers can't be used without our key, so forget it
+	resources.PrivateKey = ""
+
+	return merr.ErrorOrNil()
+}
+
+// combineError Append()s the given err on merr, but ignores err if it is
+// a not found error.
+func (p *awsp) combineError(merr *multierror.Error, err error) *multierror.Error {
+	if err != nil && !p.isNotFound(err) {
+		merr = multierror.Append(merr, err)
+	}
+	return merr
+}
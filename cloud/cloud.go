@@ -21,7 +21,8 @@ Package cloud provides functions to interact with cloud providers, used to
 create cloud resources so that you can spawn servers, then delete those
 resources when you're done.
 
-Currently implemented providers are OpenStack, with AWS planned for the future.
+Currently implemented providers are OpenStack, Google Cloud Platform (GCP) and
+Amazon Web Services (AWS).
 The implementation of each supported provider is in its own .go file.
 
 It's a pseudo plug-in system in that it is designed so that you can easily add a
@@ -142,6 +143,11 @@ var hostNameRegex = regexp.MustCompile(`[^a-z0-9\-]+`)
 
 const openstackName = "openstack"
 
+// PreemptedProblem is the permanent problem a server is marked as having (see
+// Server.GoneBad()) if it stops working because the cloud took it back. See
+// Server.Preempted().
+const PreemptedProblem = "preempted by the cloud provider"
+
 // Error records an error and the operation and provider caused it.
 type Error struct {
 	Provider string // the provider's Name
@@ -196,21 +202,32 @@ type provideri interface {
 	getQuota() (*Quota, error)
 	// return a map of all server flavors, with their flavor ids as keys
 	flavors() map[string]*Flavor
-	// achieve the aims of Spawn(). Must send on the supplied usingQuotaCh as
-	// soon as the new server has been requested and is counted as using up
-	// quota (or the request fails), then create sentinelFilePath once the new
-	// server is in powered up (but not necessarily fully booted up).
-	spawn(resources *Resources, os string, flavor string, diskGB int, externalIP bool, usingQuotaCh chan bool) (serverID, serverIP, serverName, adminPass string, err error)
+	// achieve the aims of Spawn() and SpawnInZone(). Must send on the
+	// supplied usingQuotaCh as soon as the new server has been requested and
+	// is counted as using up quota (or the request fails), then create
+	// sentinelFilePath once the new server is in powered up (but not
+	// necessarily fully booted up). A blank zone means any zone.
+	spawn(resources *Resources, os string, osUser string, flavor string, diskGB int, zone string, externalIP bool, usingQuotaCh chan bool) (serverID, serverIP, serverName, adminPass string, err error)
 	// achieve the aims of ErrIsNoHardware()
 	errIsNoHardware(err error) bool
 	// achieve the aims of CheckServer()
 	checkServer(serverID string) (bool, error)
 	// achieve the aims of DestroyServer()
 	destroyServer(serverID string) error
+	// achieve the aims of RebootServer()
+	rebootServer(serverID string) error
 	// achieve the aims of TearDown()
 	tearDown(resources *Resources) error
 }
 
+// preemptionChecker can be satisfied by provideri implementations that can
+// spawn servers that the cloud may take back at any time.
+type preemptionChecker interface {
+	// return true if checkServer() found that the given server stopped working
+	// because it was preempted
+	wasPreempted(serverID string) bool
+}
+
 // Provider gives you access to all of the methods you'll need to interact with
 // a cloud provider.
 type Provider struct {
@@ -263,6 +280,10 @@ func RequiredEnv(providerName string) ([]string, error) {
 	switch providerName {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case gcpName:
+		p = &Provider{impl: new(gcpp)}
+	case awsName:
+		p = &Provider{impl: new(awsp)}
 	default:
 		return nil, Error{providerName, "RequiredEnv", ErrBadProvider}
 	}
@@ -277,6 +298,10 @@ func MaybeEnv(providerName string) ([]string, error) {
 	switch providerName {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case gcpName:
+		p = &Provider{impl: new(gcpp)}
+	case awsName:
+		p = &Provider{impl: new(awsp)}
 	default:
 		return nil, Error{providerName, "MaybeEnv", ErrBadProvider}
 	}
@@ -290,6 +315,10 @@ func AllEnv(providerName string) ([]string, error) {
 	switch providerName {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case gcpName:
+		p = &Provider{impl: new(gcpp)}
+	case awsName:
+		p = &Provider{impl: new(awsp)}
 	default:
 		return nil, Error{providerName, "MaybeEnv", ErrBadProvider}
 	}
@@ -301,7 +330,7 @@ func AllEnv(providerName string) ([]string, error) {
 }
 
 // New creates a new Provider to interact with the given cloud provider.
-// Possible names so far are "openstack" ("aws" is planned). You must provide a
+// Possible names so far are "openstack", "gcp" and "aws". You must provide a
 // resource name that will be used to name any created cloud resources. You must
 // also provide a file path prefix to save details of created resources to (the
 // actual file created will be suffixed with your resourceName).
@@ -317,6 +346,10 @@ func New(name string, resourceName string, savePath string, logger ...log15.Logg
 	switch name {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case gcpName:
+		p = &Provider{impl: new(gcpp)}
+	case awsName:
+		p = &Provider{impl: new(awsp)}
 	default:
 		return nil, Error{name, "New", ErrBadProvider}
 	}
@@ -642,6 +675,13 @@ type SpawnUsingQuotaCallback func()
 // boot up; call server.WaitUntilReady() before trying to use the server for
 // anything.
 func (p *Provider) Spawn(os string, osUser string, flavorID string, diskGB int, ttd time.Duration, externalIP bool, usingQuotaCB ...SpawnUsingQuotaCallback) (*Server, error) {
+	return p.SpawnInZone("", os, osUser, flavorID, diskGB, ttd, externalIP, usingQuotaCB...)
+}
+
+// SpawnInZone is like Spawn(), but creates the server in the given
+// availability zone. A blank zone lets the provider choose, just like Spawn().
+// The returned Server's Zone will be set to the given zone.
+func (p *Provider) SpawnInZone(zone string, os string, osUser string, flavorID string, diskGB int, ttd time.Duration, externalIP bool, usingQuotaCB ...SpawnUsingQuotaCallback) (*Server, error) {
 	f, found := p.impl.flavors()[flavorID]
 	if !found {
 		return nil, Error{"cloud", "Spawn", ErrBadFlavor}
@@ -655,7 +695,7 @@ func (p *Provider) Spawn(os string, osUser string, flavorID string, diskGB int,
 			usingQuotaCB[0]()
 		}
 	}()
-	serverID, serverIP, serverName, adminPass, err := p.impl.spawn(p.resources, os, flavorID, diskGB, externalIP, usingQuota)
+	serverID, serverIP, serverName, adminPass, err := p.impl.spawn(p.resources, os, osUser, flavorID, diskGB, zone, externalIP, usingQuota)
 
 	if err != nil && serverID == "" {
 		return nil, err
@@ -671,6 +711,7 @@ func (p *Provider) Spawn(os string, osUser string, flavorID string, diskGB int,
 		Name:         serverName,
 		IP:           serverIP,
 		OS:           os,
+		Zone:         zone,
 		AdminPass:    adminPass,
 		UserName:     osUser,
 		Flavor:       f,
@@ -731,6 +772,17 @@ func (p *Provider) CheckServer(serverID string) (working bool, err error) {
 	return working, err
 }
 
+// Preempted tells you if the given server (id retrieved via Spawn() or
+// Servers()) was found by CheckServer() to not be working because the cloud
+// took it back. Only some providers can spawn servers that can be preempted;
+// for others this always returns false.
+func (p *Provider) Preempted(serverID string) bool {
+	if pc, ok := p.impl.(preemptionChecker); ok {
+		return pc.wasPreempted(serverID)
+	}
+	return false
+}
+
 // DestroyServer destroys a server given its id, that you would have gotten from
 // the ID property of Spawn()'s return value.
 func (p *Provider) DestroyServer(serverID string) error {
@@ -746,6 +798,13 @@ func (p *Provider) DestroyServer(serverID string) error {
 	return p.saveResources()
 }
 
+// RebootServer hard reboots a server given its id, that you would have gotten
+// from the ID property of Spawn()'s return value. This is for trying to recover
+// a server that has stopped responding.
+func (p *Provider) RebootServer(serverID string) error {
+	return p.impl.rebootServer(serverID)
+}
+
 // Servers returns a mapping of serverID => *Server for all servers that were
 // Spawn()ed with an external IP (including those spawned in past sessions where
 // the same arguments to New() were used). You should use s.Alive() before
@@ -20,13 +20,18 @@ package cloud
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -47,6 +52,605 @@ func TestUtility(t *testing.T) {
 		So(nameToHostName("test_123-one"), ShouldEqual, "test-123-one")
 		So(nameToHostName("test_123*ONE"), ShouldEqual, "test-123-one")
 	})
+
+	Convey("parseUname works", t, func() {
+		goos, goarch, err := parseUname("Linux x86_64\n")
+		So(err, ShouldBeNil)
+		So(goos, ShouldEqual, "linux")
+		So(goarch, ShouldEqual, "amd64")
+
+		goos, goarch, err = parseUname("Darwin arm64")
+		So(err, ShouldBeNil)
+		So(goos, ShouldEqual, "darwin")
+		So(goarch, ShouldEqual, "arm64")
+
+		goos, goarch, err = parseUname("Linux aarch64")
+		So(err, ShouldBeNil)
+		So(goos, ShouldEqual, "linux")
+		So(goarch, ShouldEqual, "arm64")
+
+		_, _, err = parseUname("Plan9 x86_64")
+		So(err, ShouldNotBeNil)
+		_, _, err = parseUname("Linux")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("ExeForPlatform finds exes built for other platforms", t, func() {
+		tmpdir, err := ioutil.TempDir("", "wr_cloud_test_exes_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		localExe := filepath.Join(tmpdir, "wr")
+
+		path, err := ExeForPlatform(localExe, runtime.GOOS, runtime.GOARCH, "", "")
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, localExe)
+
+		_, err = ExeForPlatform(localExe, "plan9", "mips", "", "")
+		So(err, ShouldNotBeNil)
+
+		other := filepath.Join(tmpdir, "wr-plan9-mips")
+		err = ioutil.WriteFile(other, []byte("exe"), 0755)
+		So(err, ShouldBeNil)
+		path, err = ExeForPlatform(localExe, "plan9", "mips", "", "")
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, other)
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/wr-plan9-arm" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, "downloaded exe")
+		}))
+		defer srv.Close()
+
+		exeDir := filepath.Join(tmpdir, "exes")
+		err = os.Mkdir(exeDir, 0700)
+		So(err, ShouldBeNil)
+		path, err = ExeForPlatform(localExe, "plan9", "arm", exeDir, srv.URL+"/wr-{os}-{arch}")
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, filepath.Join(exeDir, "wr-plan9-arm"))
+		content, err := ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "downloaded exe")
+		info, err := os.Stat(path)
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm()&0100, ShouldNotEqual, 0)
+
+		_, err = ExeForPlatform(localExe, "plan9", "386", exeDir, srv.URL+"/wr-{os}-{arch}")
+		So(err, ShouldNotBeNil)
+		_, err = os.Stat(filepath.Join(exeDir, "wr-plan9-386"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
+
+func TestGCP(t *testing.T) {
+	Convey("The gcp provider works with the Compute Engine API", t, func() {
+		var mu sync.Mutex
+		created := make(map[string]bool)
+		instances := make(map[string]map[string]interface{})
+		var deleted []string
+		var spawnBody map[string]interface{}
+		opPolls := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			path := strings.TrimPrefix(r.URL.Path, "/proj/")
+			reply := func(v interface{}) {
+				errj := json.NewEncoder(w).Encode(v)
+				if errj != nil {
+					http.Error(w, errj.Error(), http.StatusInternalServerError)
+				}
+			}
+			notFound := func() {
+				w.WriteHeader(http.StatusNotFound)
+				reply(map[string]interface{}{"error": map[string]interface{}{"code": 404, "message": "not found"}})
+			}
+			op := func(name string) {
+				reply(map[string]interface{}{"name": name, "status": "PENDING", "selfLink": "http://" + r.Host + "/ops/" + name})
+			}
+
+			switch {
+			case r.URL.Path == "/ops/bad":
+				reply(map[string]interface{}{"name": "bad", "status": "DONE", "error": map[string]interface{}{"errors": []map[string]string{{"code": "ZONE_RESOURCE_POOL_EXHAUSTED", "message": "no hardware"}}}})
+			case strings.HasPrefix(r.URL.Path, "/ops/"):
+				opPolls++
+				reply(map[string]interface{}{"name": "op", "status": "DONE"})
+			case r.URL.Path == "/ubuntu-os-cloud/global/images":
+				reply(map[string]interface{}{"items": []map[string]interface{}{
+					{"name": "ubuntu-2004-focal-v1", "family": "ubuntu-2004-lts", "status": "READY", "diskSizeGb": "12", "selfLink": "images/v1"},
+					{"name": "ubuntu-2004-focal-v2", "family": "ubuntu-2004-lts", "status": "READY", "diskSizeGb": "10", "selfLink": "images/v2"},
+					{"name": "ubuntu-2004-focal-v0", "family": "ubuntu-2004-lts", "status": "READY", "selfLink": "images/v0", "deprecated": map[string]string{"state": "DEPRECATED"}},
+				}})
+			case path == "zones/europe-west1-b/machineTypes":
+				if r.URL.Query().Get("pageToken") == "" {
+					reply(map[string]interface{}{"items": []map[string]interface{}{{"name": "n1-standard-1", "guestCpus": 1, "memoryMb": 3840}}, "nextPageToken": "next"})
+				} else {
+					reply(map[string]interface{}{"items": []map[string]interface{}{{"name": "n1-standard-2", "guestCpus": 2, "memoryMb": 7680}}})
+				}
+			case path == "regions/europe-west1":
+				reply(map[string]interface{}{"quotas": []map[string]interface{}{
+					{"metric": "CPUS", "limit": 24, "usage": 2},
+					{"metric": "PREEMPTIBLE_CPUS", "limit": 100, "usage": 0},
+					{"metric": "INSTANCES", "limit": 50, "usage": 1},
+				}})
+			case path == "regions/europe-west1/subnetworks" && r.Method == http.MethodGet:
+				var items []map[string]interface{}
+				if created["subnetwork"] {
+					items = append(items, map[string]interface{}{"network": "global/networks/wr-dev-test", "ipCidrRange": "192.168.0.0/18", "selfLink": "subnet"})
+				}
+				reply(map[string]interface{}{"items": items})
+			case path == "zones/europe-west1-b/instances" && r.Method == http.MethodGet:
+				var items []map[string]interface{}
+				for _, i := range instances {
+					items = append(items, i)
+				}
+				reply(map[string]interface{}{"items": items})
+			case path == "zones/europe-west1-b/instances" && r.Method == http.MethodPost:
+				body := make(map[string]interface{})
+				errj := json.NewDecoder(r.Body).Decode(&body)
+				if errj != nil {
+					http.Error(w, errj.Error(), http.StatusBadRequest)
+					return
+				}
+				spawnBody = body
+				name := body["name"].(string)
+				_, preemptible := body["scheduling"]
+				instances[name] = map[string]interface{}{
+					"name":              name,
+					"status":            "RUNNING",
+					"machineType":       body["machineType"],
+					"scheduling":        map[string]bool{"preemptible": preemptible},
+					"networkInterfaces": []map[string]interface{}{{"networkIP": "192.168.0.2", "accessConfigs": []map[string]string{{"natIP": "1.2.3.4"}}}},
+				}
+				if strings.HasSuffix(body["machineType"].(string), "n1-standard-2") {
+					op("bad")
+					return
+				}
+				op("insert")
+			case strings.HasPrefix(path, "zones/europe-west1-b/instances/"):
+				name := strings.TrimPrefix(path, "zones/europe-west1-b/instances/")
+				i, exists := instances[name]
+				if !exists {
+					notFound()
+					return
+				}
+				if r.Method == http.MethodDelete {
+					delete(instances, name)
+					op("delete")
+					return
+				}
+				reply(i)
+			case r.Method == http.MethodPost:
+				created[path[strings.LastIndex(path, "/")+1:]] = true
+				op("create")
+			case r.Method == http.MethodDelete:
+				deleted = append(deleted, path)
+				op("delete")
+			default:
+				if !created[path[strings.LastIndex(path, "/")+1:]] && !created[strings.Split(path, "/")[1]] {
+					notFound()
+					return
+				}
+				reply(map[string]interface{}{})
+			}
+		}))
+		defer srv.Close()
+
+		origURL, origPoll := gcpAPIURL, gcpOperationPoll
+		defer func() {
+			gcpAPIURL, gcpOperationPoll = origURL, origPoll
+		}()
+		gcpAPIURL = srv.URL + "/"
+		gcpOperationPoll = 1 * time.Millisecond
+
+		for key, val := range map[string]string{"GCP_PROJECT": "proj", "GCP_ZONE": "europe-west1-b", "GCP_PREEMPTIBLE": "true"} {
+			os.Setenv(key, val)
+			defer os.Unsetenv(key)
+		}
+
+		p := &gcpp{client: srv.Client()}
+		err := p.initialize(testLogger)
+		So(err, ShouldBeNil)
+		So(p.region, ShouldEqual, "europe-west1")
+		So(p.preemptible, ShouldBeTrue)
+		So(p.inCloud(), ShouldBeFalse)
+
+		flavors := p.flavors()
+		So(len(flavors), ShouldEqual, 2)
+		So(flavors["n1-standard-2"].Cores, ShouldEqual, 2)
+		So(flavors["n1-standard-2"].RAM, ShouldEqual, 7680)
+
+		quota, err := p.getQuota()
+		So(err, ShouldBeNil)
+		So(quota.MaxCores, ShouldEqual, 100)
+		So(quota.MaxInstances, ShouldEqual, 50)
+		So(quota.UsedInstances, ShouldEqual, 1)
+		So(quota.MaxRAM, ShouldEqual, 0)
+
+		image, err := p.getImage("ubuntu-os-cloud/ubuntu-2004-lts")
+		So(err, ShouldBeNil)
+		So(image.Name, ShouldEqual, "ubuntu-2004-focal-v2")
+		image, err = p.getImage("ubuntu-os-cloud/ubuntu-2004-focal-v1")
+		So(err, ShouldBeNil)
+		So(image.DiskSizeGb, ShouldEqual, "12")
+		_, err = p.getImage("ubuntu-os-cloud/ubuntu-2004-focal-v0")
+		So(err, ShouldNotBeNil)
+
+		resources := &Resources{ResourceName: "WR_bad", Details: make(map[string]string), Servers: make(map[string]*Server)}
+		err = p.deploy(resources, []int{22}, false, defaultGateWayIP, defaultCIDR, nil)
+		So(err, ShouldNotBeNil)
+		So(err.(Error).Err, ShouldEqual, ErrBadResourceName)
+
+		resources.ResourceName = "wr-dev-test"
+		err = p.deploy(resources, []int{22, 1234}, false, defaultGateWayIP, defaultCIDR, nil)
+		So(err, ShouldBeNil)
+		So(resources.PrivateKey, ShouldNotBeBlank)
+		So(resources.Details["network"], ShouldEqual, "wr-dev-test")
+		So(resources.Details["subnetwork"], ShouldEqual, "wr-dev-test")
+		So(resources.Details["firewall"], ShouldEqual, "wr-dev-test")
+		So(created["networks"], ShouldBeTrue)
+		So(created["subnetworks"], ShouldBeTrue)
+		So(created["firewalls"], ShouldBeTrue)
+		So(opPolls, ShouldEqual, 3)
+		So(p.publicKey, ShouldStartWith, "ssh-rsa ")
+
+		Convey("You can spawn preemptible servers, which are noticed when preempted", func() {
+			usingQuota := make(chan bool, 1)
+			id, ip, name, _, err := p.spawn(resources, "ubuntu-os-cloud/ubuntu-2004-lts", "ubuntu", "n1-standard-1", 5, "", false, usingQuota)
+			So(err, ShouldBeNil)
+			So(<-usingQuota, ShouldBeTrue)
+			So(id, ShouldEqual, name)
+			So(name, ShouldStartWith, "wr-dev-test-")
+			So(ip, ShouldEqual, "192.168.0.2")
+			So(spawnBody["scheduling"], ShouldNotBeNil)
+			So(spawnBody["serviceAccounts"], ShouldBeNil)
+			disk := spawnBody["disks"].([]interface{})[0].(map[string]interface{})["initializeParams"].(map[string]interface{})
+			So(disk["diskSizeGb"], ShouldEqual, "10")
+			So(disk["sourceImage"], ShouldEqual, "images/v2")
+			metadata := fmt.Sprintf("%v", spawnBody["metadata"])
+			So(metadata, ShouldContainSubstring, "ubuntu:"+p.publicKey)
+
+			servers, err := p.getCurrentServers(resources)
+			So(err, ShouldBeNil)
+			So(len(servers), ShouldEqual, 1)
+			So(servers[0][0], ShouldEqual, id)
+
+			ok, err := p.checkServer(id)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			provider := &Provider{impl: p, resources: resources}
+			So(provider.Preempted(id), ShouldBeFalse)
+
+			mu.Lock()
+			instances[id]["status"] = "TERMINATED"
+			mu.Unlock()
+			ok, err = p.checkServer(id)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			So(provider.Preempted(id), ShouldBeTrue)
+
+			err = p.destroyServer(id)
+			So(err, ShouldBeNil)
+			So(provider.Preempted(id), ShouldBeFalse)
+			ok, err = p.checkServer(id)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Servers with an external ip are not preemptible", func() {
+			usingQuota := make(chan bool, 1)
+			_, ip, _, _, err := p.spawn(resources, "ubuntu-os-cloud/ubuntu-2004-focal-v1", "ubuntu", "n1-standard-1", 20, "", true, usingQuota)
+			So(err, ShouldBeNil)
+			So(ip, ShouldEqual, "1.2.3.4")
+			So(spawnBody["scheduling"], ShouldBeNil)
+			So(spawnBody["serviceAccounts"], ShouldNotBeNil)
+			disk := spawnBody["disks"].([]interface{})[0].(map[string]interface{})["initializeParams"].(map[string]interface{})
+			So(disk["diskSizeGb"], ShouldEqual, "20")
+		})
+
+		Convey("Failing to spawn for lack of hardware is recognised, and the server is deleted", func() {
+			usingQuota := make(chan bool, 1)
+			id, _, _, _, err := p.spawn(resources, "ubuntu-os-cloud/ubuntu-2004-lts", "ubuntu", "n1-standard-2", 0, "", false, usingQuota)
+			So(err, ShouldNotBeNil)
+			So(id, ShouldBeBlank)
+			So(p.errIsNoHardware(err), ShouldBeTrue)
+			mu.Lock()
+			So(len(instances), ShouldEqual, 0)
+			mu.Unlock()
+		})
+
+		Convey("TearDown deletes the servers and everything deploy made", func() {
+			usingQuota := make(chan bool, 1)
+			_, _, _, _, err := p.spawn(resources, "ubuntu-os-cloud/ubuntu-2004-lts", "ubuntu", "n1-standard-1", 0, "", false, usingQuota)
+			So(err, ShouldBeNil)
+
+			err = p.tearDown(resources)
+			So(err, ShouldBeNil)
+			mu.Lock()
+			So(len(instances), ShouldEqual, 0)
+			So(deleted, ShouldResemble, []string{"global/firewalls/wr-dev-test", "regions/europe-west1/subnetworks/wr-dev-test", "global/networks/wr-dev-test"})
+			mu.Unlock()
+			So(resources.PrivateKey, ShouldBeBlank)
+		})
+	})
+}
+
+func TestAWS(t *testing.T) {
+	Convey("Requests to AWS are signed correctly", t, func() {
+		req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+		So(err, ShouldBeNil)
+		awsSignV4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+		So(req.Header.Get("X-Amz-Date"), ShouldEqual, "20150830T123600Z")
+		So(req.Header.Get("Authorization"), ShouldEqual, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31")
+	})
+
+	Convey("The aws provider works with the EC2 API", t, func() {
+		type fakeInstance struct {
+			id, name, state, reason, lifecycle, spotRequest string
+		}
+		var mu sync.Mutex
+		instances := make(map[string]*fakeInstance)
+		spotCodes := make(map[string]string)
+		var actions []string
+		var runParams url.Values
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") || r.URL.Path != "/eu-west-2/" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			err := r.ParseForm()
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			action := r.PostForm.Get("Action")
+			actions = append(actions, action)
+			fail := func(code string) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "<Response><Errors><Error><Code>%s</Code><Message>failed</Message></Error></Errors></Response>", code)
+			}
+			instanceXML := func(i *fakeInstance) string {
+				return fmt.Sprintf("<item><instanceId>%s</instanceId><instanceState><name>%s</name></instanceState><stateReason><code>%s</code></stateReason><instanceType>m5.large</instanceType><privateIpAddress>10.0.0.5</privateIpAddress><ipAddress>3.3.3.3</ipAddress><instanceLifecycle>%s</instanceLifecycle><spotInstanceRequestId>%s</spotInstanceRequestId><tagSet><item><key>Name</key><value>%s</value></item></tagSet></item>",
+					i.id, i.state, i.reason, i.lifecycle, i.spotRequest, i.name)
+			}
+
+			switch action {
+			case "DescribeInstanceTypes":
+				if r.PostForm.Get("NextToken") == "" {
+					fmt.Fprint(w, "<R><instanceTypeSet><item><instanceType>t3.micro</instanceType><vCpuInfo><defaultVCpus>2</defaultVCpus></vCpuInfo><memoryInfo><sizeInMiB>1024</sizeInMiB></memoryInfo></item></instanceTypeSet><nextToken>next</nextToken></R>")
+				} else {
+					fmt.Fprint(w, "<R><instanceTypeSet><item><instanceType>m5.large</instanceType><vCpuInfo><defaultVCpus>2</defaultVCpus></vCpuInfo><memoryInfo><sizeInMiB>8192</sizeInMiB></memoryInfo></item></instanceTypeSet></R>")
+				}
+			case "DescribeAccountAttributes":
+				fmt.Fprint(w, "<R><accountAttributeSet><item><attributeName>max-instances</attributeName><attributeValueSet><item><attributeValue>20</attributeValue></item></attributeValueSet></item></accountAttributeSet></R>")
+			case "DescribeImages":
+				if r.PostForm.Get("Owner.1") != "099720109477" {
+					fmt.Fprint(w, "<R><imagesSet/></R>")
+					return
+				}
+				fmt.Fprint(w, "<R><imagesSet>")
+				for _, date := range []string{"2020-01-01", "2020-03-01", "2020-02-01"} {
+					fmt.Fprintf(w, "<item><imageId>ami-%s</imageId><creationDate>%s</creationDate><rootDeviceName>/dev/sda1</rootDeviceName><blockDeviceMapping><item><deviceName>/dev/sda1</deviceName><ebs><volumeSize>12</volumeSize></ebs></item></blockDeviceMapping></item>", date, date)
+				}
+				fmt.Fprint(w, "</imagesSet></R>")
+			case "DescribeKeyPairs", "DescribeVpcs", "DescribeInternetGateways", "DescribeSecurityGroups":
+				if action == "DescribeKeyPairs" {
+					fail("InvalidKeyPair.NotFound")
+					return
+				}
+				fmt.Fprint(w, "<R/>")
+			case "DescribeSubnets":
+				if r.PostForm.Get("Filter.2.Name") == "availability-zone" {
+					fmt.Fprint(w, "<R><subnetSet><item><subnetId>subnet-b</subnetId></item></subnetSet></R>")
+					return
+				}
+				fmt.Fprint(w, "<R/>")
+			case "CreateVpc":
+				fmt.Fprint(w, "<R><vpc><vpcId>vpc-1</vpcId></vpc></R>")
+			case "CreateSubnet":
+				fmt.Fprint(w, "<R><subnet><subnetId>subnet-1</subnetId></subnet></R>")
+			case "CreateInternetGateway":
+				fmt.Fprint(w, "<R><internetGateway><internetGatewayId>igw-1</internetGatewayId></internetGateway></R>")
+			case "DescribeRouteTables":
+				fmt.Fprint(w, "<R><routeTableSet><item><routeTableId>rtb-1</routeTableId></item></routeTableSet></R>")
+			case "CreateSecurityGroup":
+				fmt.Fprint(w, "<R><groupId>sg-1</groupId></R>")
+			case "RunInstances":
+				runParams = r.PostForm
+				if r.PostForm.Get("InstanceType") == "t3.micro" {
+					fail("InsufficientInstanceCapacity")
+					return
+				}
+				i := &fakeInstance{id: fmt.Sprintf("i-%d", len(instances)+1), name: r.PostForm.Get("TagSpecification.1.Tag.1.Value"), state: "pending"}
+				if r.PostForm.Get("InstanceMarketOptions.MarketType") == "spot" {
+					i.lifecycle = "spot"
+					i.spotRequest = "sir-" + i.id
+					spotCodes[i.spotRequest] = "fulfilled"
+				}
+				instances[i.id] = i
+				fmt.Fprintf(w, "<R><instancesSet>%s</instancesSet></R>", instanceXML(i))
+			case "DescribeInstances":
+				fmt.Fprint(w, "<R><reservationSet><item><instancesSet>")
+				for _, i := range instances {
+					if id := r.PostForm.Get("InstanceId.1"); id != "" && id != i.id {
+						continue
+					}
+					if r.PostForm.Get("Filter.1.Name") == "private-dns-name" || (r.PostForm.Get("Filter.2.Name") == "instance-state-name" && i.state == "terminated") {
+						continue
+					}
+					fmt.Fprint(w, instanceXML(i))
+					// spawned instances come up after being looked at once
+					if i.state == "pending" {
+						i.state = "running"
+					}
+				}
+				fmt.Fprint(w, "</instancesSet></item></reservationSet></R>")
+			case "DescribeSpotInstanceRequests":
+				fmt.Fprintf(w, "<R><spotInstanceRequestSet><item><status><code>%s</code></status></item></spotInstanceRequestSet></R>", spotCodes[r.PostForm.Get("SpotInstanceRequestId.1")])
+			case "TerminateInstances":
+				i, exists := instances[r.PostForm.Get("InstanceId.1")]
+				if !exists {
+					fail("InvalidInstanceID.NotFound")
+					return
+				}
+				i.state = "terminated"
+				fmt.Fprint(w, "<R/>")
+			default:
+				fmt.Fprint(w, "<R/>")
+			}
+		}))
+		defer srv.Close()
+
+		origEndpoint, origPoll := awsEndpointFormat, awsPoll
+		defer func() {
+			awsEndpointFormat, awsPoll = origEndpoint, origPoll
+		}()
+		awsEndpointFormat = srv.URL + "/%s/"
+		awsPoll = 1 * time.Millisecond
+
+		for key, val := range map[string]string{"AWS_ACCESS_KEY_ID": "key", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_REGION": "eu-west-2", "AWS_SPOT": "true", "AWS_SPOT_MAX_PRICE": "0.05"} {
+			os.Setenv(key, val)
+			defer os.Unsetenv(key)
+		}
+
+		p := &awsp{client: srv.Client()}
+		err := p.initialize(testLogger)
+		So(err, ShouldBeNil)
+		So(p.spot, ShouldBeTrue)
+		So(p.inCloud(), ShouldBeFalse)
+
+		flavors := p.flavors()
+		So(len(flavors), ShouldEqual, 2)
+		So(flavors["m5.large"].Cores, ShouldEqual, 2)
+		So(flavors["m5.large"].RAM, ShouldEqual, 8192)
+
+		image, err := p.getImage("099720109477:ubuntu/images/hvm-ssd/ubuntu-focal")
+		So(err, ShouldBeNil)
+		So(image.ID, ShouldEqual, "ami-2020-03-01")
+		So(image.rootSize(), ShouldEqual, 12)
+		_, err = p.getImage("my-image")
+		So(err, ShouldNotBeNil)
+
+		resources := &Resources{ResourceName: "wr bad", Details: make(map[string]string), Servers: make(map[string]*Server)}
+		err = p.deploy(resources, []int{22}, false, defaultGateWayIP, defaultCIDR, nil)
+		So(err, ShouldNotBeNil)
+		So(err.(Error).Err, ShouldEqual, ErrBadResourceName)
+
+		resources.ResourceName = "wr-dev-test"
+		err = p.deploy(resources, []int{22, 1234}, false, defaultGateWayIP, defaultCIDR, nil)
+		So(err, ShouldBeNil)
+		So(resources.PrivateKey, ShouldNotBeBlank)
+		So(resources.Details["keypair"], ShouldEqual, "wr-dev-test")
+		So(resources.Details["vpc"], ShouldEqual, "vpc-1")
+		So(resources.Details["subnet"], ShouldEqual, "subnet-1")
+		So(resources.Details["gateway"], ShouldEqual, "igw-1")
+		So(resources.Details["secgroup"], ShouldEqual, "sg-1")
+		So(actions, ShouldContain, "ImportKeyPair")
+		So(actions, ShouldContain, "AttachInternetGateway")
+		So(actions, ShouldContain, "CreateRoute")
+		So(actions, ShouldContain, "AuthorizeSecurityGroupIngress")
+
+		quota, err := p.getQuota()
+		So(err, ShouldBeNil)
+		So(quota.MaxInstances, ShouldEqual, 20)
+		So(quota.MaxCores, ShouldEqual, 0)
+		So(quota.UsedInstances, ShouldEqual, 0)
+
+		Convey("You can spawn spot instances, which are noticed when they're being taken back", func() {
+			usingQuota := make(chan bool, 1)
+			id, ip, name, _, err := p.spawn(resources, "099720109477:ubuntu/images/hvm-ssd/ubuntu-focal", "ubuntu", "m5.large", 5, "", false, usingQuota)
+			So(err, ShouldBeNil)
+			So(<-usingQuota, ShouldBeTrue)
+			So(id, ShouldEqual, "i-1")
+			So(name, ShouldStartWith, "wr-dev-test-")
+			So(ip, ShouldEqual, "10.0.0.5")
+			So(runParams.Get("InstanceMarketOptions.MarketType"), ShouldEqual, "spot")
+			So(runParams.Get("InstanceMarketOptions.SpotOptions.MaxPrice"), ShouldEqual, "0.05")
+			So(runParams.Get("BlockDeviceMapping.1.Ebs.VolumeSize"), ShouldEqual, "12")
+			So(runParams.Get("NetworkInterface.1.SubnetId"), ShouldEqual, "subnet-1")
+			So(runParams.Get("NetworkInterface.1.SecurityGroupId.1"), ShouldEqual, "sg-1")
+			So(runParams.Get("KeyName"), ShouldEqual, "wr-dev-test")
+
+			servers, err := p.getCurrentServers(resources)
+			So(err, ShouldBeNil)
+			So(len(servers), ShouldEqual, 1)
+			So(servers[0][0], ShouldEqual, id)
+
+			quota, err = p.getQuota()
+			So(err, ShouldBeNil)
+			So(quota.UsedInstances, ShouldEqual, 1)
+			So(quota.UsedCores, ShouldEqual, 2)
+			So(quota.UsedRAM, ShouldEqual, 8192)
+
+			provider := &Provider{impl: p, resources: resources}
+			ok, err := p.checkServer(id)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(provider.Preempted(id), ShouldBeFalse)
+
+			mu.Lock()
+			spotCodes["sir-"+id] = "marked-for-termination"
+			mu.Unlock()
+			ok, err = p.checkServer(id)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			So(provider.Preempted(id), ShouldBeTrue)
+
+			err = p.destroyServer(id)
+			So(err, ShouldBeNil)
+			So(provider.Preempted(id), ShouldBeFalse)
+
+			mu.Lock()
+			instances[id].reason = awsSpotTermination
+			mu.Unlock()
+			ok, err = p.checkServer(id)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			So(provider.Preempted(id), ShouldBeTrue)
+
+			ok, err = p.checkServer("i-foo")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Servers with an external ip are not spot instances, and can be put in a particular zone", func() {
+			usingQuota := make(chan bool, 1)
+			_, ip, _, _, err := p.spawn(resources, "099720109477:ubuntu/images/hvm-ssd/ubuntu-focal", "ubuntu", "m5.large", 20, "eu-west-2b", true, usingQuota)
+			So(err, ShouldBeNil)
+			So(ip, ShouldEqual, "3.3.3.3")
+			So(runParams.Get("InstanceMarketOptions.MarketType"), ShouldBeBlank)
+			So(runParams.Get("BlockDeviceMapping.1.Ebs.VolumeSize"), ShouldEqual, "20")
+			So(runParams.Get("NetworkInterface.1.SubnetId"), ShouldEqual, "subnet-b")
+		})
+
+		Convey("Failing to spawn for lack of hardware is recognised", func() {
+			usingQuota := make(chan bool, 1)
+			id, _, _, _, err := p.spawn(resources, "099720109477:ubuntu/images/hvm-ssd/ubuntu-focal", "ubuntu", "t3.micro", 0, "", false, usingQuota)
+			So(err, ShouldNotBeNil)
+			So(id, ShouldBeBlank)
+			So(p.errIsNoHardware(err), ShouldBeTrue)
+		})
+
+		Convey("TearDown deletes the servers and everything deploy made", func() {
+			usingQuota := make(chan bool, 1)
+			id, _, _, _, err := p.spawn(resources, "099720109477:ubuntu/images/hvm-ssd/ubuntu-focal", "ubuntu", "m5.large", 0, "", false, usingQuota)
+			So(err, ShouldBeNil)
+
+			mu.Lock()
+			actions = nil
+			mu.Unlock()
+			err = p.tearDown(resources)
+			So(err, ShouldBeNil)
+			mu.Lock()
+			So(instances[id].state, ShouldEqual, "terminated")
+			So(actions, ShouldResemble, []string{"DescribeInstances", "TerminateInstances", "DescribeInstances", "DeleteSecurityGroup", "DeleteKeyPair", "DetachInternetGateway", "DeleteInternetGateway", "DeleteSubnet", "DeleteVpc"})
+			mu.Unlock()
+			So(resources.PrivateKey, ShouldBeBlank)
+		})
+	})
 }
 
 func TestOpenStack(t *testing.T) {
@@ -244,6 +848,10 @@ func TestOpenStack(t *testing.T) {
 					So(worked, ShouldEqual, false)
 					worked = server.Allocate(float64(flavor.Cores), 100, 0)
 					So(worked, ShouldEqual, true)
+					usedCores, usedRAM, usedDisk := server.Usage()
+					So(usedCores, ShouldEqual, float64(flavor.Cores))
+					So(usedRAM, ShouldEqual, 100)
+					So(usedDisk, ShouldEqual, 0)
 					n = server.HasSpaceFor(1, 0, 0)
 					So(n, ShouldEqual, 0)
 					worked = server.Allocate(1, 0, 0)
@@ -252,6 +860,9 @@ func TestOpenStack(t *testing.T) {
 					server.Release(float64(flavor.Cores), 100, 0)
 					n = server.HasSpaceFor(1, 0, 0)
 					So(n, ShouldEqual, flavor.Cores)
+					usedCores, usedRAM, _ = server.Usage()
+					So(usedCores, ShouldEqual, 0)
+					So(usedRAM, ShouldEqual, 0)
 
 					n = server.HasSpaceFor(1, flavor.RAM, 0)
 					So(n, ShouldEqual, 1)
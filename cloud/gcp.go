@@ -0,0 +1,1074 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cloud
+
+// This file contains a provideri implementation for Google Cloud Platform
+// (Compute Engine), talking to its REST API directly.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/inconshreveable/log15"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcpName        = "gcp"
+	gcpScope       = "https://www.googleapis.com/auth/cloud-platform"
+	gcpInstanceUp  = "RUNNING"
+	gcpOpDone      = "DONE"
+	gcpDefaultDisk = 10
+)
+
+// gcpAPIURL is the base URL of the Compute Engine API. It is a variable only
+// for testing purposes.
+var gcpAPIURL = "https://compute.googleapis.com/compute/v1/projects/"
+
+// gcpOperationPoll is how often we check on the progress of the operations we
+// start, and gcpOperationTimeout is how long we wait for them to finish. They
+// are variables only for testing purposes.
+var (
+	gcpOperationPoll    = 1 * time.Second
+	gcpOperationTimeout = 10 * time.Minute
+)
+
+// gcpValidResourceNameRegexp matches the names GCP allows for its resources.
+var gcpValidResourceNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+// gcpReqEnvs contains the environment variable names we need to use GCP. We
+// authenticate using Google's "application default credentials", so locally
+// you'll also need GOOGLE_APPLICATION_CREDENTIALS set to the path of a service
+// account key file (or to have used `gcloud auth application-default login`);
+// on servers we spawn with an external IP we use their default service account
+// instead. GCP_NETWORK is the name of an existing network to use instead of
+// creating one, and setting GCP_PREEMPTIBLE to "true" makes servers spawned
+// without an external IP preemptible.
+var gcpReqEnvs = [...]string{"GCP_PROJECT", "GCP_ZONE"}
+var gcpMaybeEnvs = [...]string{"GCP_NETWORK", "GCP_PREEMPTIBLE"}
+
+// gcpp is our implementer of provideri
+type gcpp struct {
+	lastFlavorCache time.Time
+	project         string
+	zone            string
+	region          string
+	networkName     string
+	subnetwork      string
+	ownName         string
+	tag             string
+	publicKey       string
+	log15.Logger
+	client      *http.Client
+	fmap        map[string]*Flavor
+	imap        map[string]*gcpImage
+	zones       map[string]string
+	preempted   map[string]bool
+	ownInstance *gcpInstance
+	fmapMutex   sync.RWMutex
+	imapMutex   sync.RWMutex
+	zMutex      sync.RWMutex // protects zones and preempted
+	preemptible bool
+}
+
+// gcpError is the error returned by the Compute Engine API.
+type gcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Errors  []struct {
+		Reason string `json:"reason"`
+	} `json:"errors"`
+}
+
+func (e *gcpError) Error() string {
+	return fmt.Sprintf("gcp error %d: %s", e.Code, e.Message)
+}
+
+// gcpOperation is the result of Compute Engine API calls that change things.
+type gcpOperation struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	SelfLink string `json:"selfLink"`
+	Error    *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error,omitempty"`
+}
+
+// err returns the errors of a finished operation as a single error, or nil.
+func (o *gcpOperation) err() error {
+	if o.Error == nil || len(o.Error.Errors) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(o.Error.Errors))
+	for i, e := range o.Error.Errors {
+		msgs[i] = e.Code + ": " + e.Message
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// gcpImage is an image that servers can boot from.
+type gcpImage struct {
+	Name       string `json:"name"`
+	Family     string `json:"family"`
+	SelfLink   string `json:"selfLink"`
+	Status     string `json:"status"`
+	DiskSizeGb string `json:"diskSizeGb"`
+	Deprecated *struct {
+		State string `json:"state"`
+	} `json:"deprecated,omitempty"`
+}
+
+// gcpInstance is a Compute Engine server.
+type gcpInstance struct {
+	Name              string `json:"name"`
+	Status            string `json:"status"`
+	MachineType       string `json:"machineType"`
+	NetworkInterfaces []struct {
+		Network       string `json:"network"`
+		Subnetwork    string `json:"subnetwork"`
+		NetworkIP     string `json:"networkIP"`
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+	} `json:"networkInterfaces"`
+	Scheduling struct {
+		Preemptible bool `json:"preemptible"`
+	} `json:"scheduling"`
+}
+
+// ip returns the internal ip of the instance, or its external one if
+// external is true.
+func (i *gcpInstance) ip(external bool) string {
+	if len(i.NetworkInterfaces) == 0 {
+		return ""
+	}
+	ni := i.NetworkInterfaces[0]
+	if external {
+		if len(ni.AccessConfigs) == 0 {
+			return ""
+		}
+		return ni.AccessConfigs[0].NatIP
+	}
+	return ni.NetworkIP
+}
+
+// requiredEnv returns envs that are definitely required.
+func (p *gcpp) requiredEnv() []string {
+	return gcpReqEnvs[:]
+}
+
+// maybeEnv returns envs that might be required.
+func (p *gcpp) maybeEnv() []string {
+	return gcpMaybeEnvs[:]
+}
+
+// initialize uses our required environment variables and Google's default
+// credentials to create an authenticated client we will use in the other
+// methods.
+func (p *gcpp) initialize(logger log15.Logger) error {
+	p.Logger = logger.New("cloud", gcpName)
+
+	p.project = os.Getenv("GCP_PROJECT")
+	p.zone = os.Getenv("GCP_ZONE")
+	p.region = gcpZoneToRegion(p.zone)
+	p.networkName = os.Getenv("GCP_NETWORK")
+	p.preemptible, _ = strconv.ParseBool(os.Getenv("GCP_PREEMPTIBLE")) // #nosec anything not true means false
+
+	if p.client == nil {
+		client, err := google.DefaultClient(context.Background(), gcpScope)
+		if err != nil {
+			return err
+		}
+		p.client = client
+	}
+
+	// flavors and images are retrieved on-demand via caching methods that store
+	// in these maps
+	p.fmap = make(map[string]*Flavor)
+	p.imap = make(map[string]*gcpImage)
+
+	// we remember which zones our servers are in, and which of them got
+	// preempted
+	p.zones = make(map[string]string)
+	p.preempted = make(map[string]bool)
+
+	return nil
+}
+
+// gcpZoneToRegion returns the region a zone is in, eg. us-central1 for
+// us-central1-a.
+func gcpZoneToRegion(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// gcpLastPathElement returns the part of the given url or path after the
+// final slash, which for GCP resource URLs is the resource's name.
+func gcpLastPathElement(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// request makes a Compute Engine API call. path is relative to our project's
+// API URL, unless it is a complete URL. If body is not nil it is sent as JSON,
+// and if result is not nil the response is decoded in to it.
+func (p *gcpp) request(method, path string, body, result interface{}) error {
+	if !strings.HasPrefix(path, "http") {
+		path = gcpAPIURL + p.project + "/" + path
+	}
+
+	var reqBody *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	} else {
+		reqBody = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // #nosec nothing useful to do if closing fails
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		errResp := struct {
+			Error *gcpError `json:"error"`
+		}{}
+		if json.Unmarshal(content, &errResp) == nil && errResp.Error != nil {
+			return errResp.Error
+		}
+		return &gcpError{Code: resp.StatusCode, Message: resp.Status}
+	}
+
+	if result != nil {
+		return json.Unmarshal(content, result)
+	}
+	return nil
+}
+
+// operate makes an API call that starts an operation, and waits for the
+// operation to finish.
+func (p *gcpp) operate(method, path string, body interface{}) error {
+	op := &gcpOperation{}
+	err := p.request(method, path, body, op)
+	if err != nil {
+		return err
+	}
+	return p.waitForOperation(op)
+}
+
+// waitForOperation waits until the given operation is done, returning any
+// error it had.
+func (p *gcpp) waitForOperation(op *gcpOperation) error {
+	timeout := time.After(gcpOperationTimeout)
+	ticker := time.NewTicker(gcpOperationPoll)
+	defer ticker.Stop()
+	for op.Status != gcpOpDone {
+		select {
+		case <-ticker.C:
+			err := p.request(http.MethodGet, op.SelfLink, nil, op)
+			if err != nil {
+				return err
+			}
+		case <-timeout:
+			return fmt.Errorf("gcp operation %s did not finish after %s", op.Name, gcpOperationTimeout)
+		}
+	}
+	return op.err()
+}
+
+// isNotFound tells you if the given error is the API telling you that the
+// thing you asked about doesn't exist.
+func (p *gcpp) isNotFound(err error) bool {
+	var gerr *gcpError
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+// list makes GET API calls to the given path, following pages, and passes the
+// raw JSON of each item to the given callback.
+func (p *gcpp) list(path string, cb func(item json.RawMessage) error) error {
+	pageToken := ""
+	for {
+		page := struct {
+			Items         []json.RawMessage `json:"items"`
+			NextPageToken string            `json:"nextPageToken"`
+		}{}
+		pagePath := path
+		if pageToken != "" {
+			sep := "?"
+			if strings.Contains(path, "?") {
+				sep = "&"
+			}
+			pagePath += sep + "pageToken=" + url.QueryEscape(pageToken)
+		}
+		err := p.request(http.MethodGet, pagePath, nil, &page)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			err = cb(item)
+			if err != nil {
+				return err
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// listInstances returns all the instances in our zone.
+func (p *gcpp) listInstances() ([]*gcpInstance, error) {
+	var instances []*gcpInstance
+	err := p.list("zones/"+p.zone+"/instances", func(item json.RawMessage) error {
+		i := &gcpInstance{}
+		err := json.Unmarshal(item, i)
+		if err == nil {
+			instances = append(instances, i)
+		}
+		return err
+	})
+	return instances, err
+}
+
+// zoneOf returns the zone we spawned the server with the given ID (instance
+// name) in.
+func (p *gcpp) zoneOf(serverID string) string {
+	p.zMutex.RLock()
+	defer p.zMutex.RUnlock()
+	if zone, found := p.zones[serverID]; found {
+		return zone
+	}
+	return p.zone
+}
+
+// getInstance gets the details of the server with the given ID.
+func (p *gcpp) getInstance(serverID string) (*gcpInstance, error) {
+	instance := &gcpInstance{}
+	err := p.request(http.MethodGet, "zones/"+p.zoneOf(serverID)+"/instances/"+serverID, nil, instance)
+	return instance, err
+}
+
+// cacheFlavors retrieves the current list of machine types in our zone and
+// caches them in p. Old no-longer existent flavors are kept forever, so we can
+// still see what resources old instances are using. Machine types have no disk
+// of their own; servers get a boot disk of the size requested during spawn().
+func (p *gcpp) cacheFlavors() error {
+	p.fmapMutex.Lock()
+	defer func() {
+		p.lastFlavorCache = time.Now()
+		p.fmapMutex.Unlock()
+	}()
+
+	return p.list("zones/"+p.zone+"/machineTypes", func(item json.RawMessage) error {
+		mt := struct {
+			Name      string `json:"name"`
+			GuestCpus int    `json:"guestCpus"`
+			MemoryMb  int    `json:"memoryMb"`
+		}{}
+		err := json.Unmarshal(item, &mt)
+		if err != nil {
+			return err
+		}
+		p.fmap[mt.Name] = &Flavor{
+			ID:    mt.Name,
+			Name:  mt.Name,
+			Cores: mt.GuestCpus,
+			RAM:   mt.MemoryMb,
+		}
+		return nil
+	})
+}
+
+// getFlavor retrieves the desired flavor by id from the cache. If it's not in
+// the cache, will call cacheFlavors() to get any newly added flavors. If still
+// not in the cache, returns nil and an error.
+func (p *gcpp) getFlavor(flavorID string) (*Flavor, error) {
+	p.fmapMutex.RLock()
+	flavor, found := p.fmap[flavorID]
+	p.fmapMutex.RUnlock()
+	if !found {
+		err := p.cacheFlavors()
+		if err != nil {
+			return nil, err
+		}
+
+		p.fmapMutex.RLock()
+		flavor, found = p.fmap[flavorID]
+		p.fmapMutex.RUnlock()
+		if !found {
+			return nil, errors.New(invalidFlavorIDMsg + ": " + flavorID)
+		}
+	}
+	return flavor, nil
+}
+
+// getImage retrieves the desired image, by exact name, family or name prefix.
+// To use a public image, prefix with the project it is in, eg.
+// "ubuntu-os-cloud/ubuntu-2004-lts". Deprecated images are ignored. Images are
+// cached, and if not found the cache is updated before trying again.
+func (p *gcpp) getImage(osPrefix string) (*gcpImage, error) {
+	project, prefix := p.project, osPrefix
+	if parts := strings.SplitN(osPrefix, "/", 2); len(parts) == 2 {
+		project, prefix = parts[0], parts[1]
+	}
+
+	image := p.getImageFromCache(project, prefix)
+	if image != nil {
+		return image, nil
+	}
+
+	err := p.cacheImages(project)
+	if err != nil {
+		return nil, err
+	}
+
+	image = p.getImageFromCache(project, prefix)
+	if image != nil {
+		return image, nil
+	}
+
+	return nil, errors.New("no OS image with prefix [" + osPrefix + "] was found")
+}
+
+// cacheImages retrieves the current list of usable images in the given project
+// and caches them in p.
+func (p *gcpp) cacheImages(project string) error {
+	p.imapMutex.Lock()
+	defer p.imapMutex.Unlock()
+	return p.list(gcpAPIURL+project+"/global/images", func(item json.RawMessage) error {
+		i := &gcpImage{}
+		err := json.Unmarshal(item, i)
+		if err != nil {
+			return err
+		}
+		if i.Status == "READY" && (i.Deprecated == nil || i.Deprecated.State == "") {
+			p.imap[project+"/"+i.Name] = i
+		}
+		return nil
+	})
+}
+
+// getImageFromCache is used by getImage(); don't call this directly.
+func (p *gcpp) getImageFromCache(project, prefix string) *gcpImage {
+	p.imapMutex.RLock()
+	defer p.imapMutex.RUnlock()
+
+	// find an exact match
+	if i, found := p.imap[project+"/"+prefix]; found {
+		return i
+	}
+
+	// failing that, the newest in a family, or a random prefix match
+	var match *gcpImage
+	for key, i := range p.imap {
+		if !strings.HasPrefix(key, project+"/") {
+			continue
+		}
+		if i.Family == prefix {
+			if match == nil || match.Family != prefix || i.Name > match.Name {
+				match = i
+			}
+			continue
+		}
+		if match == nil && strings.HasPrefix(i.Name, prefix) {
+			match = i
+		}
+	}
+	return match
+}
+
+// deploy achieves the aims of Deploy(). GCP provides DNS and a gateway to
+// servers itself, so gatewayIP and dnsNameServers are ignored, and we don't
+// need a config drive.
+func (p *gcpp) deploy(resources *Resources, requiredPorts []int, useConfigDrive bool, gatewayIP, cidr string, dnsNameServers []string) error {
+	// the resource name can only contain lower case letters, numbers and
+	// hyphens
+	if !gcpValidResourceNameRegexp.MatchString(resources.ResourceName) {
+		return Error{gcpName, "deploy", ErrBadResourceName}
+	}
+
+	// we find or create a subnetwork with the given CIDR for spawn() to use
+	_, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	// GCP has no key pair resource; instead we put the public key of our own
+	// key in the metadata of the servers we spawn
+	if resources.PrivateKey == "" {
+		privateKey, errk := rsa.GenerateKey(rand.Reader, 2048)
+		if errk != nil {
+			return errk
+		}
+		privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+		resources.PrivateKey = string(pem.EncodeToMemory(privateKeyPEM))
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(resources.PrivateKey))
+	if err != nil {
+		return err
+	}
+	p.publicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	resources.Details["keypair"] = resources.ResourceName
+
+	// servers we spawn are tagged, so that our firewall rule applies to them
+	p.tag = resources.ResourceName
+
+	// if we're already running in GCP, use the network we're on
+	if p.inCloud() {
+		if len(p.ownInstance.NetworkInterfaces) == 0 {
+			return Error{gcpName, "deploy", ErrBadCIDR}
+		}
+		ni := p.ownInstance.NetworkInterfaces[0]
+		subnet := struct {
+			IPCidrRange string `json:"ipCidrRange"`
+		}{}
+		err = p.request(http.MethodGet, ni.Subnetwork, nil, &subnet)
+		if err != nil {
+			return err
+		}
+		if subnet.IPCidrRange != cidr {
+			return Error{gcpName, "deploy", ErrBadCIDR}
+		}
+		p.networkName = gcpLastPathElement(ni.Network)
+		p.subnetwork = ni.Subnetwork
+		return p.deployFirewall(resources, requiredPorts)
+	}
+
+	// get/create network
+	if p.networkName == "" {
+		p.networkName = resources.ResourceName
+		err = p.request(http.MethodGet, "global/networks/"+p.networkName, nil, nil)
+		if p.isNotFound(err) {
+			err = p.operate(http.MethodPost, "global/networks", map[string]interface{}{
+				"name":                  p.networkName,
+				"autoCreateSubnetworks": false,
+			})
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		resources.Details["network"] = p.networkName
+	}
+
+	// get/create a subnetwork in our region with our CIDR
+	err = p.list("regions/"+p.region+"/subnetworks", func(item json.RawMessage) error {
+		subnet := struct {
+			Network     string `json:"network"`
+			IPCidrRange string `json:"ipCidrRange"`
+			SelfLink    string `json:"selfLink"`
+		}{}
+		errj := json.Unmarshal(item, &subnet)
+		if errj != nil {
+			return errj
+		}
+		if gcpLastPathElement(subnet.Network) == p.networkName && subnet.IPCidrRange == cidr {
+			p.subnetwork = subnet.SelfLink
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if p.subnetwork == "" {
+		err = p.operate(http.MethodPost, "regions/"+p.region+"/subnetworks", map[string]interface{}{
+			"name":        resources.ResourceName,
+			"network":     "global/networks/" + p.networkName,
+			"ipCidrRange": cidr,
+		})
+		if err != nil {
+			return err
+		}
+		p.subnetwork = "regions/" + p.region + "/subnetworks/" + resources.ResourceName
+		resources.Details["subnetwork"] = resources.ResourceName
+	}
+
+	return p.deployFirewall(resources, requiredPorts)
+}
+
+// deployFirewall gets or creates a firewall rule that opens the given ports
+// (and ICMP) to servers tagged with our resource name.
+func (p *gcpp) deployFirewall(resources *Resources, requiredPorts []int) error {
+	if len(requiredPorts) == 0 {
+		return nil
+	}
+
+	name := resources.ResourceName
+	err := p.request(http.MethodGet, "global/firewalls/"+name, nil, nil)
+	if err == nil {
+		resources.Details["firewall"] = name
+		return nil
+	}
+	if !p.isNotFound(err) {
+		return err
+	}
+
+	ports := make([]string, len(requiredPorts))
+	for i, port := range requiredPorts {
+		ports[i] = strconv.Itoa(port)
+	}
+	err = p.operate(http.MethodPost, "global/firewalls", map[string]interface{}{
+		"name":         name,
+		"description":  "access amongst wr-spawned nodes",
+		"network":      "global/networks/" + p.networkName,
+		"sourceRanges": []string{"0.0.0.0/0"},
+		"targetTags":   []string{p.tag},
+		"allowed": []map[string]interface{}{
+			{"IPProtocol": "tcp", "ports": ports},
+			{"IPProtocol": "icmp"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	resources.Details["firewall"] = name
+	return nil
+}
+
+// getCurrentServers returns details of other servers with the given resource
+// name prefix.
+func (p *gcpp) getCurrentServers(resources *Resources) ([][]string, error) {
+	instances, err := p.listInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	var sdetails [][]string
+	for _, instance := range instances {
+		if p.ownName != instance.Name && strings.HasPrefix(instance.Name, resources.ResourceName) {
+			sdetails = append(sdetails, []string{instance.Name, instance.ip(false), instance.Name, ""})
+		}
+	}
+	return sdetails, nil
+}
+
+// inCloud checks if we're currently running on a GCP server based on our
+// hostname matching an instance in our zone.
+func (p *gcpp) inCloud() bool {
+	if p.ownInstance != nil {
+		return true
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return false
+	}
+	// (GCP hostnames can be fully qualified)
+	hostname = strings.Split(hostname, ".")[0]
+
+	instances, err := p.listInstances()
+	if err != nil {
+		p.Warn("listing instances failed", "err", err)
+		return false
+	}
+	for _, instance := range instances {
+		if nameToHostName(instance.Name) == hostname {
+			p.ownName = instance.Name
+			p.ownInstance = instance
+			return true
+		}
+	}
+	return false
+}
+
+// flavors returns all our flavors.
+func (p *gcpp) flavors() map[string]*Flavor {
+	// update the cached flavors at most once every half hour
+	p.fmapMutex.RLock()
+	if time.Since(p.lastFlavorCache) > 30*time.Minute {
+		p.fmapMutex.RUnlock()
+		err := p.cacheFlavors()
+		if err != nil {
+			p.Warn("failed to cache available flavors", "err", err)
+		}
+		p.fmapMutex.RLock()
+	}
+	fmap := make(map[string]*Flavor)
+	for key, val := range p.fmap {
+		fmap[key] = val
+	}
+	p.fmapMutex.RUnlock()
+	return fmap
+}
+
+// getQuota achieves the aims of GetQuota(). GCP has quotas per region on CPUs,
+// instances and disk, but not on RAM, so MaxRAM will be 0 (unlimited); UsedRAM
+// is worked out from the flavors of the instances in our zone.
+func (p *gcpp) getQuota() (*Quota, error) {
+	region := struct {
+		Quotas []struct {
+			Metric string  `json:"metric"`
+			Limit  float64 `json:"limit"`
+			Usage  float64 `json:"usage"`
+		} `json:"quotas"`
+	}{}
+	err := p.request(http.MethodGet, "regions/"+p.region, nil, &region)
+	if err != nil {
+		return nil, err
+	}
+
+	cpuMetric := "CPUS"
+	if p.preemptible {
+		cpuMetric = "PREEMPTIBLE_CPUS"
+	}
+	quota := &Quota{}
+	for _, q := range region.Quotas {
+		switch q.Metric {
+		case cpuMetric:
+			quota.MaxCores = int(q.Limit)
+			quota.UsedCores = int(q.Usage)
+		case "INSTANCES":
+			quota.MaxInstances = int(q.Limit)
+			quota.UsedInstances = int(q.Usage)
+		case "DISKS_TOTAL_GB":
+			quota.MaxVolume = int(q.Limit)
+			quota.UsedVolume = int(q.Usage)
+		}
+	}
+
+	instances, err := p.listInstances()
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		f, errf := p.getFlavor(gcpLastPathElement(instance.MachineType))
+		if errf != nil {
+			p.Warn("an instance has a machine type we don't know about; our remaining quota estimation will be off", "server", instance.Name, "flavor", instance.MachineType)
+			continue
+		}
+		quota.UsedRAM += f.RAM
+	}
+
+	return quota, nil
+}
+
+// spawn achieves the aims of Spawn(). All servers get an ephemeral external IP
+// so that they can reach the internet, but the returned serverIP is only the
+// external one if externalIP is true. Servers with an external IP can use the
+// GCP API with their default service account (so that a manager running on
+// one can spawn more servers), and are never preemptible; others are if
+// GCP_PREEMPTIBLE is true.
+func (p *gcpp) spawn(resources *Resources, osPrefix string, osUser string, flavorID string, diskGB int, zone string, externalIP bool, usingQuotaCh chan bool) (serverID, serverIP, serverName, adminPass string, err error) {
+	image, err := p.getImage(osPrefix)
+	if err != nil {
+		usingQuotaCh <- false
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	_, err = p.getFlavor(flavorID)
+	if err != nil {
+		usingQuotaCh <- false
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	// if the OS image itself specifies a minimum disk size and it's higher than
+	// requested disk, increase our requested disk
+	if imageDisk, errc := strconv.Atoi(image.DiskSizeGb); errc == nil && imageDisk > diskGB {
+		diskGB = imageDisk
+	}
+	if diskGB < gcpDefaultDisk {
+		diskGB = gcpDefaultDisk
+	}
+
+	if zone == "" {
+		zone = p.zone
+	}
+
+	serverName = uniqueResourceName(resources.ResourceName)
+	instance := map[string]interface{}{
+		"name":        serverName,
+		"machineType": "zones/" + zone + "/machineTypes/" + flavorID,
+		"tags":        map[string]interface{}{"items": []string{p.tag}},
+		"disks": []map[string]interface{}{{
+			"boot":       true,
+			"autoDelete": true,
+			"initializeParams": map[string]interface{}{
+				"sourceImage": image.SelfLink,
+				"diskSizeGb":  strconv.Itoa(diskGB),
+			},
+		}},
+		"networkInterfaces": []map[string]interface{}{{
+			"subnetwork": p.subnetwork,
+			"accessConfigs": []map[string]interface{}{{
+				"type": "ONE_TO_ONE_NAT",
+				"name": "External NAT",
+			}},
+		}},
+		"metadata": map[string]interface{}{
+			"items": []map[string]interface{}{
+				{"key": "ssh-keys", "value": osUser + ":" + p.publicKey},
+				{"key": "startup-script", "value": string(sentinelInitScript)},
+			},
+		},
+	}
+	if externalIP {
+		instance["serviceAccounts"] = []map[string]interface{}{{
+			"email":  "default",
+			"scopes": []string{gcpScope},
+		}}
+	} else if p.preemptible {
+		instance["scheduling"] = map[string]interface{}{
+			"preemptible":       true,
+			"automaticRestart":  false,
+			"onHostMaintenance": "TERMINATE",
+		}
+	}
+
+	op := &gcpOperation{}
+	err = p.request(http.MethodPost, "zones/"+zone+"/instances", instance, op)
+	usingQuotaCh <- true
+	if err != nil {
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	serverID = serverName
+	p.zMutex.Lock()
+	p.zones[serverID] = zone
+	p.zMutex.Unlock()
+
+	// wait for it to be created and come up; if that fails we delete it, since
+	// we're going to return an error that we failed to spawn
+	err = p.waitForOperation(op)
+	var current *gcpInstance
+	if err == nil {
+		current, err = p.waitForRunning(serverID)
+	}
+	if err != nil {
+		delerr := p.destroyServer(serverID)
+		if delerr != nil && !p.isNotFound(delerr) {
+			err = fmt.Errorf("%s\nadditionally, there was an error deleting the bad server: %s", err, delerr)
+		}
+		return "", serverIP, serverName, adminPass, err
+	}
+
+	serverIP = current.ip(externalIP)
+	if serverIP == "" {
+		errd := p.destroyServer(serverID)
+		if errd != nil {
+			p.Warn("server destruction after not finding ip", "server", serverID, "err", errd)
+		}
+		return serverID, serverIP, serverName, adminPass, fmt.Errorf("server %s has no ip address", serverID)
+	}
+
+	return serverID, serverIP, serverName, adminPass, err
+}
+
+// waitForRunning waits for the server with the given ID to be RUNNING.
+func (p *gcpp) waitForRunning(serverID string) (*gcpInstance, error) {
+	timeout := time.After(gcpOperationTimeout)
+	ticker := time.NewTicker(gcpOperationPoll)
+	defer ticker.Stop()
+	for {
+		current, err := p.getInstance(serverID)
+		if err != nil {
+			return nil, err
+		}
+		switch current.Status {
+		case gcpInstanceUp:
+			return current, nil
+		case "STOPPING", "STOPPED", "TERMINATED":
+			return nil, fmt.Errorf("server %s is %s", serverID, current.Status)
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-timeout:
+			return nil, fmt.Errorf("server %s is %s after %s, timing out on it ever becoming %s", serverID, current.Status, gcpOperationTimeout, gcpInstanceUp)
+		}
+	}
+}
+
+// errIsNoHardware returns true if error says the zone has run out of the
+// resources needed for a new server.
+func (p *gcpp) errIsNoHardware(err error) bool {
+	return strings.Contains(err.Error(), "ZONE_RESOURCE_POOL_EXHAUSTED")
+}
+
+// checkServer achieves the aims of CheckServer(). If a preemptible server has
+// stopped, we note that it was preempted, for wasPreempted().
+func (p *gcpp) checkServer(serverID string) (bool, error) {
+	instance, err := p.getInstance(serverID)
+	if err != nil {
+		if p.isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if instance.Scheduling.Preemptible {
+		switch instance.Status {
+		case "STOPPING", "STOPPED", "TERMINATED":
+			p.zMutex.Lock()
+			p.preempted[serverID] = true
+			p.zMutex.Unlock()
+		}
+	}
+
+	return instance.Status == gcpInstanceUp, nil
+}
+
+// wasPreempted tells you if checkServer() found that the server with the given
+// ID had been preempted.
+func (p *gcpp) wasPreempted(serverID string) bool {
+	p.zMutex.RLock()
+	defer p.zMutex.RUnlock()
+	return p.preempted[serverID]
+}
+
+// destroyServer achieves the aims of DestroyServer()
+func (p *gcpp) destroyServer(serverID string) error {
+	err := p.operate(http.MethodDelete, "zones/"+p.zoneOf(serverID)+"/instances/"+serverID, nil)
+	if err != nil {
+		return err
+	}
+
+	p.zMutex.Lock()
+	delete(p.zones, serverID)
+	delete(p.preempted, serverID)
+	p.zMutex.Unlock()
+	return nil
+}
+
+// rebootServer achieves the aims of RebootServer(). A server that has stopped
+// is started again instead.
+func (p *gcpp) rebootServer(serverID string) error {
+	instance, err := p.getInstance(serverID)
+	if err != nil {
+		return err
+	}
+
+	action := "reset"
+	if instance.Status == "TERMINATED" || instance.Status == "STOPPED" {
+		action = "start"
+	}
+	err = p.operate(http.MethodPost, "zones/"+p.zoneOf(serverID)+"/instances/"+serverID+"/"+action, nil)
+	if err != nil {
+		return err
+	}
+
+	p.zMutex.Lock()
+	delete(p.preempted, serverID)
+	p.zMutex.Unlock()
+	return nil
+}
+
+// tearDown achieves the aims of TearDown()
+func (p *gcpp) tearDown(resources *Resources) error {
+	// throughout we'll ignore errors because we want to try and delete
+	// as much as possible; we'll end up returning a concatenation of all of
+	// them though
+	var merr *multierror.Error
+
+	// delete servers, except for ourselves
+	instances, err := p.listInstances()
+	merr = p.combineError(merr, err)
+	for _, instance := range instances {
+		if p.ownName != instance.Name && strings.HasPrefix(instance.Name, resources.ResourceName) {
+			t := time.Now()
+			errd := p.destroyServer(instance.Name)
+			p.Debug("delete server", "time", time.Since(t), "id", instance.Name)
+			if errd != nil {
+				// ignore errors, just try to delete others
+				p.Warn("server destruction during teardown failed", "server", instance.Name, "err", errd)
+			}
+		}
+	}
+
+	if p.ownName == "" {
+		if name := resources.Details["firewall"]; name != "" {
+			t := time.Now()
+			err = p.operate(http.MethodDelete, "global/firewalls/"+name, nil)
+			p.Debug("delete firewall", "time", time.Since(t), "id", name, "err", err)
+			merr = p.combineError(merr, err)
+		}
+
+		if name := resources.Details["subnetwork"]; name != "" {
+			t := time.Now()
+			err = p.operate(http.MethodDelete, "regions/"+p.region+"/subnetworks/"+name, nil)
+			p.Debug("delete subnetwork", "time", time.Since(t), "id", name, "err", err)
+			merr = p.combineError(merr, err)
+		}
+
+		if name := resources.Details["network"]; name != "" {
+			t := time.Now()
+			err = p.operate(http.MethodDelete, "global/networks/"+name, nil)
+			p.Debug("delete network", "time", time.Since(t), "id", name, "err", err)
+			merr = p.combineError(merr, err)
+		}
+
+		// our servers can't be used without our key, so forget it
+		resources.PrivateKey = ""
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// combineError Append()s the given err on merr, but ignores err if it is
+// a not found error.
+func (p *gcpp) combineError(merr *multierror.Error, err error) *multierror.Error {
+	if err != nil && !p.isNotFound(err) {
+		merr = multierror.Append(merr, err)
+	}
+	return merr
+}
@@ -728,7 +728,7 @@ func (p *openstackp) getQuota() (*Quota, error) {
 }
 
 // spawn achieves the aims of Spawn()
-func (p *openstackp) spawn(resources *Resources, osPrefix string, flavorID string, diskGB int, externalIP bool, usingQuotaCh chan bool) (serverID, serverIP, serverName, adminPass string, err error) {
+func (p *openstackp) spawn(resources *Resources, osPrefix string, osUser string, flavorID string, diskGB int, zone string, externalIP bool, usingQuotaCh chan bool) (serverID, serverIP, serverName, adminPass string, err error) {
 	// get the image that matches desired OS
 	image, err := p.getImage(osPrefix)
 	if err != nil {
@@ -769,13 +769,14 @@ func (p *openstackp) spawn(resources *Resources, osPrefix string, flavorID strin
 	var server *servers.Server
 	serverName = uniqueResourceName(resources.ResourceName)
 	createOpts := servers.CreateOpts{
-		Name:           serverName,
-		FlavorRef:      flavorID,
-		ImageRef:       image.ID,
-		SecurityGroups: secGroups,
-		Networks:       []servers.Network{{UUID: p.networkUUID}},
-		ConfigDrive:    &p.useConfigDrive,
-		UserData:       sentinelInitScript,
+		Name:             serverName,
+		FlavorRef:        flavorID,
+		ImageRef:         image.ID,
+		SecurityGroups:   secGroups,
+		Networks:         []servers.Network{{UUID: p.networkUUID}},
+		ConfigDrive:      &p.useConfigDrive,
+		UserData:         sentinelInitScript,
+		AvailabilityZone: zone,
 	}
 	var createdVolume bool
 	if diskGB > flavor.Disk {
@@ -1010,6 +1011,11 @@ func (p *openstackp) destroyServer(serverID string) error {
 	return err
 }
 
+// rebootServer achieves the aims of RebootServer()
+func (p *openstackp) rebootServer(serverID string) error {
+	return servers.Reboot(p.computeClient, serverID, servers.RebootOpts{Type: servers.HardReboot}).ExtractErr()
+}
+
 // tearDown achieves the aims of TearDown()
 func (p *openstackp) tearDown(resources *Resources) error {
 	// throughout we'll ignore errors because we want to try and delete
@@ -0,0 +1,158 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cloud
+
+// This file contains the code for working out what Operating System and
+// architecture a Server runs, and finding an executable built for it.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// exeDownloadTimeout is how long we'll wait for an executable to download.
+const exeDownloadTimeout = 5 * time.Minute
+
+// unamePlatforms converts the output of `uname -s` and `uname -m` to Go's names
+// for operating systems and architectures.
+var unamePlatforms = map[string]string{
+	"Linux":   "linux",
+	"Darwin":  "darwin",
+	"FreeBSD": "freebsd",
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv7l":  "arm",
+	"armv6l":  "arm",
+	"i386":    "386",
+	"i686":    "386",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// Platform returns the Operating System and architecture of this server, in the
+// form of Go's GOOS and GOARCH values (eg. "linux" and "arm64").
+func (s *Server) Platform(ctx context.Context) (goos, goarch string, err error) {
+	s.mutex.RLock()
+	goos, goarch = s.goos, s.goarch
+	s.mutex.RUnlock()
+	if goos != "" && goarch != "" {
+		return goos, goarch, nil
+	}
+
+	stdout, _, err := s.RunCmd(ctx, "uname -sm", false)
+	if err != nil {
+		return "", "", err
+	}
+	goos, goarch, err = parseUname(stdout)
+	if err != nil {
+		return "", "", err
+	}
+
+	s.mutex.Lock()
+	s.goos, s.goarch = goos, goarch
+	s.mutex.Unlock()
+	return goos, goarch, nil
+}
+
+// parseUname parses the output of `uname -sm` in to GOOS and GOARCH values.
+func parseUname(output string) (goos, goarch string, err error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected uname output [%s]", strings.TrimSpace(output))
+	}
+	var ok bool
+	if goos, ok = unamePlatforms[fields[0]]; !ok {
+		return "", "", fmt.Errorf("unsupported operating system [%s]", fields[0])
+	}
+	if goarch, ok = unamePlatforms[fields[1]]; !ok {
+		return "", "", fmt.Errorf("unsupported architecture [%s]", fields[1])
+	}
+	return goos, goarch, nil
+}
+
+// ExeForPlatform returns the path to a local copy of the given executable that
+// was built for the given GOOS and GOARCH.
+//
+// If the platform matches our own, that is just localExe. Otherwise dir is
+// checked for a file named after localExe's basename suffixed with
+// -[goos]-[goarch] (eg. wr-linux-arm64). If there isn't one and url is not
+// blank, url (in which {os} and {arch} are replaced with goos and goarch) is
+// downloaded to that file in dir, and that is returned. dir defaults to the
+// directory of localExe.
+func ExeForPlatform(localExe, goos, goarch, dir, url string) (string, error) {
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		return localExe, nil
+	}
+
+	if dir == "" {
+		dir = filepath.Dir(localExe)
+	}
+	path := filepath.Join(dir, filepath.Base(localExe)+"-"+goos+"-"+goarch)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if url == "" {
+		return "", fmt.Errorf("no %s executable for %s/%s found at %s, and no url to download one from was configured", filepath.Base(localExe), goos, goarch, path)
+	}
+	url = strings.NewReplacer("{os}", goos, "{arch}", goarch).Replace(url)
+	if err := downloadExe(url, path); err != nil {
+		return "", fmt.Errorf("could not download %s executable for %s/%s from %s: %s", filepath.Base(localExe), goos, goarch, url, err)
+	}
+	return path, nil
+}
+
+// downloadExe downloads the given url to the given path, making it executable.
+// The file only appears at path once fully downloaded.
+func downloadExe(url, path string) error {
+	client := &http.Client{Timeout: exeDownloadTimeout}
+	resp, err := client.Get(url) // #nosec the url is from the user's own config
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // #nosec nothing useful to do if closing fails
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+
+	tmp := path + ".download"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755) // #nosec it needs to be executable
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	errc := f.Close()
+	if err == nil {
+		err = errc
+	}
+	if err != nil {
+		os.Remove(tmp) // #nosec the copy error is more useful
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -115,15 +115,19 @@ type Server struct {
 	IP                string // ip address that you could SSH to
 	Name              string // ought to correspond to the hostname
 	OS                string // the name of the Operating System image
+	Zone              string // the availability zone the server was spawned in, if one was requested
 	ConfigFiles       string // files that you will CopyOver() and require to be on this Server, in CopyOver() format
 	UserName          string // the username needed to log in to the server
 	permanentProblem  string
 	homeDir           string
+	goos              string // set by Platform()
+	goarch            string // set by Platform()
 	logger            log15.Logger
 	Flavor            *Flavor
 	Disk              int           // GB of available disk space
 	TTD               time.Duration // amount of idle time allowed before destruction
 	goneBad           time.Time
+	failedProbes      int
 	cancelDestruction chan bool
 	cancelID          int
 	cancelRunCmd      map[int]chan bool
@@ -144,6 +148,7 @@ type Server struct {
 	toBeDestroyed     bool
 	destroyed         bool
 	onDeathrow        bool
+	draining          bool
 	sshStarted        bool
 	createdShare      bool
 	used              bool
@@ -276,11 +281,11 @@ func (s *Server) Matches(os string, script []byte, configFiles string, flavor *F
 // Allocate considers the current usage (according to prior calls)
 // and records the given resources have now been used up on this server, if
 // there was enough space. Returns true if there was enough space and the
-// allocation occurred.
+// allocation occurred. Nothing can be allocated on a Draining() server.
 func (s *Server) Allocate(cores float64, ramMB, diskGB int) bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if s.checkSpace(cores, ramMB, diskGB) == 0 {
+	if s.draining || s.checkSpace(cores, ramMB, diskGB) == 0 {
 		return false
 	}
 
@@ -388,6 +393,47 @@ func (s *Server) Release(cores float64, ramMB, diskGB int) {
 	}
 }
 
+// Drain stops any further Allocate() calls from succeeding, so that the server
+// can be destroyed once the things already allocated on it have been
+// Release()d. Returns false if the server was already draining.
+func (s *Server) Drain() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.draining {
+		return false
+	}
+	s.draining = true
+	return true
+}
+
+// Undrain lets you change your mind about a server you called Drain() on,
+// allowing Allocate() to succeed again. Returns false if the server wasn't
+// draining, or has been destroyed.
+func (s *Server) Undrain() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.draining || s.destroyed {
+		return false
+	}
+	s.draining = false
+	return true
+}
+
+// Draining tells you if Drain() has been called (more recently than
+// Undrain()).
+func (s *Server) Draining() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.draining
+}
+
+// Idle tells you if nothing is currently allocated on this server.
+func (s *Server) Idle() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.usedCores <= 0 && s.usedZeroCores <= 0 && s.usedRAM <= 0
+}
+
 // HasSpaceFor considers the current usage (according to prior Allocation calls)
 // and tells you how many of a cmd needing the given resources can run on this
 // server.
@@ -397,6 +443,14 @@ func (s *Server) HasSpaceFor(cores float64, ramMB, diskGB int) int {
 	return s.checkSpace(cores, ramMB, diskGB)
 }
 
+// Usage tells you how much of this server's cores, memory (in MB) and disk
+// (in GB) are currently in use, according to prior Allocation calls.
+func (s *Server) Usage() (cores float64, ramMB, diskGB int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.usedCores, s.usedRAM, s.usedDisk
+}
+
 // checkSpace does the work of HasSpaceFor. You must hold a read lock on mutex!
 func (s *Server) checkSpace(cores float64, ramMB, diskGB int) int {
 	if internal.FloatLessThan(float64(s.Flavor.Cores)-s.usedCores, cores) || (s.Flavor.RAM-s.usedRAM < ramMB) || (s.Disk-s.usedDisk < diskGB) {
@@ -1233,6 +1287,57 @@ func (s *Server) Destroy() error {
 	return err
 }
 
+// Reboot hard reboots the server, for trying to recover a server that has
+// stopped responding. It doesn't change whether the server IsBad(); call
+// NotBad() once it is Alive() again.
+func (s *Server) Reboot() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.destroyed || s.toBeDestroyed {
+		return fmt.Errorf("server %s has been destroyed", s.ID)
+	}
+
+	// for testing purposes, we anticipate that provider isn't set
+	if s.provider == nil {
+		return fmt.Errorf("provider not set")
+	}
+
+	err := s.provider.RebootServer(s.ID)
+	s.logger.Debug("server rebooted", "err", err)
+	if err != nil {
+		return err
+	}
+
+	// our existing ssh clients won't survive the reboot, so make sure new ones
+	// get made
+	for i := range s.sshClientSessions {
+		s.sshClientSessions[i] = maxSSHSessions
+	}
+	s.failedProbes = 0
+
+	return nil
+}
+
+// FailedProbes tells you how many Alive() calls in a row have found the server
+// not to be usable.
+func (s *Server) FailedProbes() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.failedProbes
+}
+
+// Preempted tells you if the server stopped working (ie. Alive() returned
+// false) because the cloud took it back. Only servers that were spawned as
+// preemptible by providers that support that can be preempted.
+func (s *Server) Preempted() bool {
+	// for testing purposes, we anticipate that provider isn't set
+	if s.provider == nil {
+		return false
+	}
+	return s.provider.Preempted(s.ID)
+}
+
 // Destroyed tells you if a server was destroyed using Destroy() or the
 // automatic destruction due to being idle. It is NOT the opposite of Alive(),
 // since it does not check if the server is still usable.
@@ -1244,7 +1349,8 @@ func (s *Server) Destroyed() bool {
 
 // Alive tells you if a server is usable. It first does the same check as
 // Destroyed() before calling out to the provider. Supplying an optional boolean
-// will double check the server to make sure it can be ssh'd to.
+// will double check the server to make sure it can be ssh'd to. The number of
+// failed checks in a row is available from FailedProbes().
 func (s *Server) Alive(checkSSH ...bool) bool {
 	s.mutex.Lock()
 	if s.destroyed || s.toBeDestroyed {
@@ -1253,6 +1359,7 @@ func (s *Server) Alive(checkSSH ...bool) bool {
 	}
 	ok, errc := s.provider.CheckServer(s.ID)
 	if !ok || errc != nil {
+		s.failedProbes++
 		s.mutex.Unlock()
 		return false
 	}
@@ -1263,10 +1370,16 @@ func (s *Server) Alive(checkSSH ...bool) bool {
 		// usable; confirm we can still ssh to it
 		session, clientIndex, err := s.SSHSession(context.Background())
 		if err != nil {
+			s.mutex.Lock()
+			s.failedProbes++
+			s.mutex.Unlock()
 			return false
 		}
 		s.CloseSSHSession(session, clientIndex)
 	}
 
+	s.mutex.Lock()
+	s.failedProbes = 0
+	s.mutex.Unlock()
 	return true
 }
@@ -23,6 +23,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 	"time"
@@ -53,13 +54,20 @@ var cmdChangeHome bool
 var cmdRepGroup string
 var cmdLimitGroups string
 var cmdDepGroups string
+var cmdTags string
 var cmdCmdDeps string
 var cmdGroupDeps string
 var cmdOnFailure string
 var cmdOnSuccess string
 var cmdOnExit string
+var cmdOnExitCode string
+var cmdOnFailReason string
 var cmdEnv string
-var cmdReRun bool
+var cmdEnvCapture string
+var cmdEnvVars string
+var cmdEnvModules string
+var cmdEnvSecrets string
+var cmdReRun string
 var cmdOsPrefix string
 var cmdOsUsername string
 var cmdOsRAM int
@@ -71,8 +79,28 @@ var cmdFlavor string
 var cmdQueue string
 var cmdMisc string
 var cmdMonitorDocker string
+var cmdContainer string
+var cmdContainerRuntime string
+var cmdNetwork int
+var cmdNetworkCap bool
+var cmdLostAfter string
+var cmdLostCloudGone bool
+var cmdHeartbeat string
+var cmdLostThreshold string
+var cmdRetryBackoff string
+var cmdRetryBackoffMax string
+var cmdRetryJitter float64
+var cmdRetryMax string
+var cmdNoRetryExitcodes string
+var cmdPolicy string
+var cmdNotifyComplete string
+var cmdNotifyFailure string
 var rtimeoutint int
 var simpleOutput bool
+var cmdEstimate bool
+var cmdArray int
+var cmdManifest string
+var cmdSync bool
 
 // addCmd represents the add command
 var addCmd = &cobra.Command{
@@ -86,10 +114,16 @@ specific options using a JSON object in (tab separated) column 2, or
 alternatively have only a JSON object in column 1 that also specifies the
 command as one of the name:value pairs. The possible options are:
 
-cmd cwd cwd_matters change_home on_failure on_success on_exit mounts req_grp
-memory time override cpus disk queue misc priority retries rep_grp dep_grps deps
-cmd_deps monitor_docker cloud_os cloud_username cloud_ram cloud_script
-cloud_config_files cloud_flavor cloud_shared env bsub_mode
+cmd name metadata steps cwd cwd_matters change_home on_failure on_success
+on_exit on_exit_code on_failreason mounts req_grp memory time override cpus
+disk queue misc priority
+retries rep_grp dep_grps deps cmd_deps name_deps monitor_docker container
+container_runtime cloud_os cloud_username cloud_ram cloud_script
+cloud_config_files cloud_flavor cloud_shared env env_modules env_secrets
+bsub_mode outputs verify_outputs expected_outputs inputs ram_retry_mult
+ram_retry_max network network_cap lost_after lost_cloud_gone heartbeat
+lost_threshold retry_backoff retry_backoff_max retry_jitter retry_max
+no_retry_exitcodes policy schedule notify_complete notify_failure tags
 
 If any of these will be the same for all your commands, you can instead specify
 them as flags (which are treated as defaults in the case that they are
@@ -105,6 +139,16 @@ enclosed in square brackets. For example (on one line): {"cmd":"myexe -f input >
 output","cwd":"/path/to/cwd","priority":1,"dep_grps":["dg2","dg3"],"deps":
 ["dg1"]}
 
+"steps" can be given instead of "cmd" (so only in a JSON object in column 1) to
+make a multi-step command: an array of command lines that will be run one after
+the other in the same working directory and environment, stopping at the first
+that fails. Unlike chaining them together with &&, the exit code and timings of
+each step are recorded (see "wr status"), and if the command is retried, it
+resumes from the step that failed. Since earlier steps won't be run again, their
+outputs need to survive a failure, eg. by using "cwd_matters" or not using
+cleanup behaviours on failure. Eg. {"steps":["align in.fq > out.bam","index
+out.bam"],"cwd":"/path/to/cwd","cwd_matters":true}
+
 "cwd" determines the directory to cd to before running the command (the 'command
 working directory'). If none is specified, the default will be your current
 directory right now. (If adding to a remote cloud-deployed manager, then cwd
@@ -137,11 +181,45 @@ and if true will completely delete the actual working directory created when
 cwd_matters is false (no effect when cwd_matters is true); "cleanup", which is
 like cleanup_all except that it doesn't delete files that have been specified as
 inputs or outputs [since you can't currently specify this, the current behaviour
-is identical to cleanup_all]; and "run", which takes a string command to run
-after the main cmd runs. For example [{"run":"cp error.log
-/shared/logs/this.log"},{"cleanup":true}] would copy a log file that your cmd
-generated to describe its problems to some shared location and then delete all
-files created by your cmd.
+is identical to cleanup_all]; "run", which takes a string command to run
+after the main cmd runs; "upload_cwd", which takes an object with a "dest"
+directory (relative paths are relative to the actual working directory) that
+files in the actual working directory should be copied to, in a sub-directory
+named after the command's internal id, optionally limited to those matching
+"include" and not matching "exclude" glob patterns, up to a total of "max_mb"
+megabytes (default 100); "record_outputs", which takes an array of paths or
+glob patterns (relative to the actual working directory) of files to record as
+outputs of your cmd (see "outputs", below), in addition to any given with
+"outputs" (put it before any cleanup behaviour that would delete them);
+"checksum", which takes an object with an array of "files" glob patterns whose
+checksums should be recorded along with them as outputs, an optional
+"algorithm" of "md5" (the default) or "sha256", and an optional "manifest" file
+to also write the checksums to in the format of md5sum or sha256sum; "archive",
+which takes an object with a "dest" bucket (and optional path, eg.
+"mybucket/results") that files should be uploaded to (in a sub-directory named
+after the command's internal id), an optional "profile" and "backend" as per
+mount targets (default is S3; see 'wr mount -h'), and optional "files" glob
+patterns, defaulting to the files recorded by earlier record_outputs and
+checksum behaviours; and "http_post", which takes an object with a "url" to
+POST JSON to, and an optional "payload" JSON value to send, defaulting to a
+description of your cmd, how it exited, and the files recorded by earlier
+record_outputs, checksum and archive behaviours. Behaviours trigger in the
+order you give them, so you can chain these, eg.
+[{"checksum":{"files":["*.bam"]}},{"archive":{"dest":"mybucket/bams"}},
+{"http_post":{"url":"https://my.lims/bams"}}] would upload your bam files and
+tell your LIMS where they are and what their checksums were. For
+example [{"run":"cp error.log /shared/logs/this.log"},{"cleanup":true}] would
+copy a log file that your cmd generated to describe its problems to some shared
+location and then delete all files created by your cmd. If you specify a
+writable mount (see "mounts", below) then
+[{"upload_cwd":{"dest":"failures","include":["*.log"]}}] would upload your
+cmd's log files to your remote file system if it failed, letting you
+investigate the failure even if the machine it ran on no longer exists.
+Any behaviour object can also have a "retries" key with a number value, which
+is how many times the behaviour will be retried if it fails, without your cmd
+being run again. Eg. [{"run":"upload_results.sh","retries":3}] in on_success
+would retry a failed upload up to 3 times, instead of you having to rerun a cmd
+that may have taken hours to complete.
 
 "on_success" is exactly like on_failure, except that the behaviours trigger when
 your cmd exits 0.
@@ -150,6 +228,19 @@ your cmd exits 0.
 your cmd exits, regardless of exit code. These behaviours will trigger after any
 behaviours defined in on_failure or on_success.
 
+"on_exit_code" and "on_failreason" let behaviours trigger conditionally. They
+take an object where the keys are exit codes or fail reasons (as shown by 'wr
+status', eg. "ran out of time"), and the values are behaviours as for
+on_failure. Eg. {"137":[{"run":"collect_core.sh"}]} would run a script only if
+your cmd exited with code 137. These behaviours trigger after those in
+on_failure or on_success, but before those in on_exit.
+
+If you don't specify on_failure, on_success or on_exit, your cmd gets the
+corresponding default behaviours of the manager, configured with its
+managerjobonfailure, managerjobonsuccess and managerjobonexit settings (by
+default, on_exit is [{"cleanup":true}]). To opt out of a default, specify
+[{"nothing":true}].
+
 "mounts" (or the --mount_json option) describes the remote file systems or
 object stores you would like to be fuse mounted locally before running your
 command. See the help text for 'wr mount' for an explanation of how to formulate
@@ -221,7 +312,8 @@ value; do NOT use single quotes within the value. Eg. --misc '-R "foo bar"'.
 "priority" defines how urgent a particular command is; those with higher
 priorities will start running before those with lower priorities. The range of
 possible values is 0 (default, for lowest priority) to 255 (highest priority).
-Commands with the same priority will be started in the order they were added.
+Commands with the same priority will be started in the order they were added,
+unless the manager is sharing capacity between users (see 'wr fairshare').
 (Note, however, that order of starting is only guaranteed to hold true amongst
 jobs with similar resource requirements, since your chosen job scheduler may,
 for example, run your highest priority job on a machine where it takes up 90% of
@@ -235,6 +327,31 @@ more memory/time reserved). Once this number of retries is reached, the command
 will be 'buried' until you take manual action to fix the problem and press the
 retry button in the web interface.
 
+"ram_retry_mult" and "ram_retry_max" override the manager's managerramretrymult
+and managerramretrymax settings for a command: if ram_retry_mult is greater
+than 1, each time the command runs out of memory it will be retried with its
+memory multiplied by this amount, without that counting towards its retries,
+until it would need more than ram_retry_max (eg. 64G). Set ram_retry_mult to 1
+to turn this off for the command.
+
+"policy" is the name of a policy that has been set up with the manager (using
+its API) to assign to the command's rep_grp. Policies centrally manage the
+retries, retry backoff and ram retry settings of all the commands in the
+rep_grps they are assigned to (taking precedence over the values of those
+options for the commands), along with URLs to notify when commands get buried
+or all the commands in a rep_grp complete, and whether to keep the output of
+commands that complete successfully.
+
+"notify_complete" and "notify_failure" are arrays of places to send a summary
+of the command's rep_grp (counts of its commands in each state, and the reasons
+any failed) once all of its commands have finished: the former if they all
+completed, the latter if any were buried. Each is either an http(s) URL that
+will be POSTed the summary as JSON, a Slack incoming webhook URL prefixed with
+"slack:", or an email address prefixed with "mailto:" (which requires the
+manager to have been configured with managersmtpserver). As flags, they are
+comma separated lists. The manager can also be configured to send these
+notifications for every rep_grp, with managernotifyok and managernotifyfail.
+
 "rep_grp" is an arbitrary group you can give your commands so you can query
 their status later. This is only used for reporting and presentation purposes
 when viewing status.
@@ -244,7 +361,9 @@ that can be used to limit the number of jobs that run at once in the same group.
 You can optionally suffix a group name with :n where n is a integer new limit
 for that group. 0 prevents jobs in that group running at all. -1 makes jobs in
 that group unlimited. If no limit number is suffixed, groups will be unlimited
-until a limit is set with the "wr limit" command.
+until a limit is set with the "wr limit" command. If a command uses more than one
+of a limited resource (eg. 2 software licences), suffix the group name with *n
+where n is the number used, before any :n limit, eg. "gatk*2:20".
 
 "dep_grps" is an array of arbitrary names you can associate with a command, so
 that you can then refer to this job (and others with the same dep_grp) in
@@ -260,6 +379,39 @@ name:value pairs (if cwd doesn't matter for a cmd, provide it as an empty
 string). These are static dependencies; once resolved they do not get re-
 evaluated.
 
+"name" is an optional human-friendly name for this command, unique amongst all
+the commands you add, that can be used in place of its internal job id anywhere
+an id is accepted (eg. "wr status -y -i name"). Names may only contain letters,
+numbers and the symbols _ . : @ + -, and can't look like an internal job id.
+Adding a different command with a name that is already in use is an error.
+
+"schedule" makes the command recurring: it is a cron expression (eg. "0 2 * *
+*" for 2am every night) that says when the manager should run the command.
+Instead of being run now, the command is stored, and at each time the schedule
+triggers, it is added to the queue again (unless it is still incomplete from
+the previous time). The fields are minute, hour, day of month, month and day of
+week, and the aliases @hourly, @daily, @weekly, @monthly and @yearly are also
+understood. Use "wr schedule" to see, pause, resume or cancel your recurring
+commands.
+
+"name_deps" is an array of the names of other commands that must complete
+before this command will start. Like "cmd_deps", these are static dependencies.
+
+"metadata" is an optional JSON object of your choosing (eg. {"sample":"s42",
+"pipeline":"v1.2"}) that is stored with the command, so that its provenance
+lives with it. It can be no larger than 16KB. It is shown in the web interface
+and by "wr status", and you can use "wr status --meta" to only get the status
+of commands with particular metadata values.
+
+"tags" is an optional JSON object of key:value strings (eg. {"sample":"s42",
+"stage":"align"}) that lets you group commands by something other than their
+report group. --tags sample=s42,stage=align gives tags to all your commands, in
+addition to any of their own. Keys may only contain letters, numbers,
+underscores, dots, colons, at signs, pluses and dashes, and values can't
+contain commas. The web interface can group and filter commands by their tags,
+and you can use "wr status --tag" to get the status of commands with
+particular tags.
+
 "monitor_docker" turns on monitoring of a docker container identified by the
 given string, which could be the container's --name or path to its --cidfile. If
 the string contains ? or * symbols and doesn't match a name or file name
@@ -277,6 +429,68 @@ NB: does not handle monitoring of multiple docker containers run by a single
 command. A side effect of monitoring a container is that if you use wr to kill
 the job for this command, wr will also kill the container.
 
+"container" makes the command run inside a container created from the given
+image, using the "container_runtime", which can be "docker" (the default) or
+"singularity". For docker, the image is something like "ubuntu:20.04"; for
+singularity it can be the path to a .sif file, or a URI like
+"docker://ubuntu:20.04". The image is pulled before the command starts if it
+isn't already on the machine the command runs on; if that fails the command is
+buried with the reason "container image could not be pulled". The command is
+run by the same shell as usual (which must exist in the image), from the same
+working directory, which is bind-mounted into the container along with any
+"mounts". With docker, the container runs as you, is limited to the memory and
+cpus of the command, only sees the environment variables you set with "env" (as
+well as those wr sets), and is monitored as if you'd used "monitor_docker". With
+singularity, the container sees your whole environment and is monitored like any
+other command. Requires that the container runtime is installed on the machine
+where the command will run.
+
+"network" is the number of megabits per second of network bandwidth you expect
+the command to use, eg. when transferring data to or from S3. On its own it is
+just recorded and shown by "wr status". If you also set "network_cap" to true,
+the runner will try to cap the command's outgoing bandwidth at that rate, so
+that a few transfer-heavy commands can't starve other commands running on the
+same machine of throughput. Capping requires the runner to be able to use tc
+and create net_cls cgroups (eg. by running as root); if it can't, the command
+runs uncapped and a warning is logged.
+
+"lost_after" and "lost_cloud_gone" say what should happen if the command is
+lost (the manager stops hearing from the runner running it, eg. because the
+host it was running on died), overriding the manager's managerlostafter and
+managerlostcloudgone config options. Normally lost commands wait for you to
+confirm them dead with "wr kill". Setting lost_after to a duration such as 30m
+confirms the command dead automatically if it is still lost after that long,
+and setting lost_cloud_gone to true does so as soon as the cloud provider
+reports that the server it was running on is gone. Either way the command is
+then treated as having failed and retried if it has retries left, and the
+decision is recorded in its history, as shown by the status web page.
+
+"heartbeat" and "lost_threshold" say how quickly the command is considered
+lost, overriding the manager's managerheartbeat and managerlostthreshold config
+options. heartbeat is how often (eg. 30s) the runner tells the manager the
+command is still running, and lost_threshold is how long (eg. 5m) the manager
+goes without hearing from the runner before considering the command lost; it
+must be longer than the heartbeat. A lost_threshold several times the heartbeat
+lets the command ride out short network problems: its runner keeps it running
+and tells the manager what happened once it can. Lost commands say why they
+were lost in "wr status" and the status web page, distinguishing hosts that
+could still be reached from ones the cloud provider says are gone.
+
+"retry_backoff", "retry_backoff_max", "retry_jitter", "retry_max" and
+"no_retry_exitcodes" give the command its own policy on being retried after it
+fails, beyond its number of "retries". retry_backoff is how long (eg. 30s) it
+waits before being retried after it first fails, doubling with each subsequent
+failure up to retry_backoff_max (eg. 1h), overriding the backoff of any policy
+assigned to its rep_grp. retry_jitter (between 0 and 1) randomly lengthens or
+shortens each wait by up to that fraction, so that many commands that failed
+together don't all retry together. retry_max is an object that limits retries
+by the reason the command failed, eg. {"lost contact with runner":10,"command
+exited non-zero":2}; failures with these reasons count against these limits
+instead of against retries. no_retry_exitcodes is an array of exit codes (or as
+a flag, a comma-separated list) that mean the command should be buried
+immediately instead of being retried. These can be changed for incomplete
+(including buried) commands with "wr mod".
+
 The "cloud_*" related options let you override the defaults of your cloud
 deployment. For example, if you do 'wr cloud deploy --os "Ubuntu 16" --os_ram
 2048 -u ubuntu -s ~/my_ubuntu_post_creation_script.sh', any commands you add
@@ -313,10 +527,121 @@ prior to calling 'wr add'. In the remote case the command will use base
 variables as they were on the machine where the command is executed when that
 machine was started.
 
+You can change what happens in the local case with --env_capture:
+  "full" (the default) captures all your environment variables as described
+    above.
+  "minimal" only captures the variables you name with --env_vars (eg.
+    --env_vars PATH,PERL5LIB), which override or add to the base variables of
+    the machine where the command is executed, as in the remote case. Unlike
+    "full", this also applies in the remote case.
+  "none" captures nothing, so commands use the base variables of the machine
+    where they are executed, as in the remote case.
+  "module" is like "none", but before running each command, does a
+    "module load" of the environment modules given by --env_modules or the
+    "env_modules" option.
+The latter modes make for smaller, quicker to add jobs, and avoid paths that
+only make sense on your machine leaking in to commands run elsewhere, such as
+in the cloud.
+
+"env_modules" is an array of environment modules (eg. "samtools/1.9") that will
+be loaded with "module load" before the command is run, exiting with an error if
+that fails. Though intended for use with --env_capture module, it works with
+any mode.
+
+"env_secrets" is an array of "ENV_VAR=secret_name" pairs: the environment
+variable is set, only in the environment the command runs in, to the value of
+the named secret stored in the manager with 'wr secret --set'. The secrets must
+exist when you add the commands. Their values are not stored with the command,
+are never displayed by wr, and are replaced with <redacted> in the command's
+STDOUT and STDERR.
+
 "bsub_mode" is a boolean that results in the job being assigned a unique (for
 this manager session) job id, and turns on bsub emulation, which means that if
 your Cmd calls bsub, it will instead result in a command being added to wr. The
-new job will have this job's mount and cloud_* options.`,
+new job will have this job's mount and cloud_* options.
+
+"outputs" is an array of paths or glob patterns (relative to the directory the
+command runs in, unless absolute) of files the command is expected to create.
+When the command exits successfully, the size and md5 checksum of each matching
+file is recorded, and if the file was written to a writable mount, where it was
+uploaded to. Your command can also record outputs it only learns about while
+running by writing their paths (or glob patterns), one per line, to the file
+named by the $WR_OUTPUTS_FILE environment variable. These artifacts can then be
+viewed and downloaded via the web interface, or with "wr status --outputs". If
+an output matches no files, the runner reports this as an error, but the job is
+still considered to have completed.
+
+"verify_outputs" is a boolean that, if true, makes --rerun of a command that
+previously completed safe and quick: before running it again, the runner checks
+that the files recorded for its "outputs" last time still exist with the same
+size and md5 checksum, and if so, the command is not run again (and its
+behaviours are not triggered), but is immediately considered complete.
+
+"expected_outputs" is an array of paths or glob patterns (relative to the
+directory the command runs in, unless absolute) that must each match at least
+one non-empty file once the command exits 0. If any don't, the command is
+treated as having failed, with a reason of "missing output", and is retried or
+buried as if it had exited non-zero. Use this for tools that can exit 0 without
+having written their results.
+
+"inputs" is an array of objects describing files in S3 (or GCS or Azure) that
+the command reads, such as large reference files. Before running the command,
+the runner downloads each to a cache directory shared by all the runners on its
+host (see the runnerinputcachedir config option), and makes it available in the
+command's working directory, so that commands using the same files only
+download them once per host. Each object has a "Source" (the bucket name
+followed by the path of the file, eg. "mybucket/refs/hs38.fa"), and optionally
+a "Dest" (where to make it available, relative to the command's working
+directory unless absolute; defaults to the file's basename), an "MD5" checksum
+that the file must match, and a "Backend" and "Profile" as for mounts (see 'wr
+mount -h'). The command must not alter these files. If any can't be staged, the
+command is buried with a reason of "input files could not be staged". How many
+were already cached is shown on the status web page.
+
+To add a large number of commands that differ only by an index (eg. a
+parameter sweep), supply a single command containing the placeholder {{.Index}}
+and say how many you want with --array. The manager expands it in to that many
+commands, replacing {{.Index}} with 1, 2, 3 and so on. The placeholder can also
+be used in the cwd, rep_grp, name and dep_grps options. Unless you put it in the
+rep_grp, all the commands share one rep_grp, so they appear as a single row with
+aggregate state counts on the status web page.
+
+To instead add a command per sample (or other set of parameters), supply a
+single template command and say where your TSV or CSV of parameters is with
+--manifest. The file's first line must name its columns (it's read as TSV if
+that line contains a tab), and each following row becomes a command, with
+{{column}} placeholders in the template replaced with that row's values and
+{{.Index}} with the row number. These placeholders can be used in the same
+options as for --array. Columns named memory, time, cpus, disk and rep_grp
+also override those options for that row's command (blank values use the
+template's setting), so that each sample can have its own requirements, eg.:
+sample	memory	time
+s1	4G	1h
+s2	16G	6h
+The manager normally does the expansion, but with --sync, --estimate, --simple
+or --rerun if-changed it is done by wr add instead, since it needs the
+individual commands.
+
+Commands that you add that had previously been added and have since completed
+are, by default, skipped and counted as duplicates (--rerun skip). With --rerun
+force (or just --rerun) they are run again. With --rerun if-changed they are
+only run again if their cmd, mounts or environment variables differ from when
+they last completed; note that with the default --env_capture full, any change
+to your own environment counts, so you may want to use --env_capture minimal.
+
+With --sync, wr doesn't exit after adding your commands, but waits for them all
+to finish, in the same way as 'wr wait' (see its help for details). A JSON
+summary of how many completed, were buried or were deleted is output on STDOUT,
+and wr exits non-zero if any didn't complete.
+
+Before adding a large number of commands, you can use --estimate to find out
+what they would need, without adding them. Their memory and time requirements
+are adjusted by what has been learned from previous commands in the same
+req_grp and rep_grp, just as they would be if added, and then the total
+core-hours they would use is reported. If the manager's scheduler knows about
+its hosts, how long it would take to complete them all on those hosts (ignoring
+any other commands in the queue) is also reported, and if the manager was
+configured with a cloudcostpercorehour, so is their predicted cost.`,
 	Run: func(combraCmd *cobra.Command, args []string) {
 		// check the command line options
 		if cmdFile == "" {
@@ -334,16 +659,102 @@ new job will have this job's mount and cloud_* options.`,
 		}()
 
 		jobs, isLocal, defaultedRepG := parseCmdFile(jq, combraCmd.Flags().Changed("disk"))
+		if cmdArray > 0 {
+			if len(jobs) != 1 {
+				die("--array requires exactly 1 command")
+			}
+			if simpleOutput || cmdEstimate {
+				die("--array can't be used with --simple or --estimate")
+			}
+		}
+
+		rerunMode, err := jobqueue.ParseRerunMode(cmdReRun)
+		if err != nil {
+			die("%s", err)
+		}
+
+		var manifest []byte
+		if cmdManifest != "" {
+			if len(jobs) != 1 {
+				die("--manifest requires exactly 1 command")
+			}
+			if cmdArray > 0 {
+				die("--manifest can't be used with --array")
+			}
+			manifest, err = ioutil.ReadFile(cmdManifest)
+			if err != nil {
+				die("could not read the manifest file: %s", err)
+			}
+
+			// when we need the individual jobs, we expand the manifest
+			// ourselves instead of leaving it to the server
+			if cmdSync || cmdEstimate || simpleOutput || rerunMode == jobqueue.RerunIfChanged {
+				jobs, err = jobqueue.ExpandManifest(jobs[0], manifest)
+				if err != nil {
+					die("%s", err)
+				}
+				manifest = nil
+			}
+		}
+
+		if cmdEstimate {
+			estimate(jq, jobs)
+			return
+		}
+		if cmdSync && (simpleOutput || cmdEstimate) {
+			die("--sync can't be used with --simple or --estimate")
+		}
+		if cmdSync && cmdArray > 0 && strings.Contains(jobs[0].RepGroup, "{{") {
+			die("--sync can't be used with --array if the rep_grp contains a placeholder")
+		}
+		if rerunMode == jobqueue.RerunIfChanged && (cmdArray > 0 || simpleOutput) {
+			die("--rerun if-changed can't be used with --array or --simple")
+		}
 
+		envMode, err := jobqueue.ParseEnvCaptureMode(cmdEnvCapture)
+		if err != nil {
+			die("%s", err)
+		}
 		var envVars []string
-		if isLocal {
-			envVars = os.Environ()
+		switch envMode {
+		case jobqueue.EnvCaptureFull:
+			if isLocal {
+				envVars = jobqueue.CaptureEnv(envMode, nil)
+			}
+		case jobqueue.EnvCaptureMinimal:
+			if cmdEnvVars == "" {
+				die("--env_capture minimal requires --env_vars")
+			}
+			minimal := jobqueue.CaptureEnv(envMode, strings.Split(cmdEnvVars, ","))
+			for _, job := range jobs {
+				if err = job.EnvAddDefaults(minimal); err != nil {
+					die("%s", err)
+				}
+			}
+		case jobqueue.EnvCaptureModule:
+			for _, job := range jobs {
+				if len(job.EnvModules) == 0 {
+					die("--env_capture module requires --env_modules or every command to have env_modules")
+				}
+			}
 		}
 
 		// add the jobs to the queue *** should add at most 1,000,000 jobs at a
 		// time to avoid time out issues...
-		if simpleOutput {
-			ids, err := jq.AddAndReturnIDs(jobs, envVars, !cmdReRun)
+		if cmdArray > 0 {
+			inserts, dups, err := jq.AddArray(jobs[0], cmdArray, envVars, rerunMode == jobqueue.RerunSkip)
+			if err != nil {
+				die("%s", err)
+			}
+			info("Added %d new commands (%d were duplicates) to the queue", inserts, dups)
+		} else if manifest != nil {
+			inserts, dups, err := jq.AddFromManifest(jobs[0], manifest, envVars, rerunMode == jobqueue.RerunSkip)
+			if err != nil {
+				die("%s", err)
+			}
+			info("Added %d new commands (%d were duplicates) to the queue", inserts, dups)
+		} else if simpleOutput {
+			ids, err := jq.AddAndReturnIDs(jobs, envVars, rerunMode == jobqueue.RerunSkip)
 			if err != nil {
 				die("%s", err)
 			}
@@ -354,20 +765,66 @@ new job will have this job's mount and cloud_* options.`,
 				fmt.Printf("%s\n", id)
 			}
 		} else {
-			inserts, dups, err := jq.Add(jobs, envVars, !cmdReRun)
+			inserts, dups, skipped, err := jq.AddWithRerunMode(jobs, envVars, rerunMode)
 			if err != nil {
 				die("%s", err)
 			}
 
 			if defaultedRepG {
-				info("Added %d new commands (%d were duplicates) to the queue using default identifier '%s'", inserts, dups, cmdRepGroup)
+				info("Added %d new commands (%d were duplicates, of which %d had already completed) to the queue using default identifier '%s'", inserts, dups, skipped, cmdRepGroup)
 			} else {
-				info("Added %d new commands (%d were duplicates) to the queue", inserts, dups)
+				info("Added %d new commands (%d were duplicates, of which %d had already completed) to the queue", inserts, dups, skipped)
 			}
 		}
+
+		if cmdSync {
+			syncAdded(jq, jobs)
+		}
 	},
 }
 
+// retryPolicyFromFlags makes a RetryPolicy from the --retry_* and
+// --no_retry_exitcodes options, returning nil if none were supplied.
+func retryPolicyFromFlags() (*jobqueue.RetryPolicy, error) {
+	if cmdRetryBackoff == "" && cmdRetryBackoffMax == "" && cmdRetryJitter == 0 && cmdRetryMax == "" && cmdNoRetryExitcodes == "" {
+		return nil, nil
+	}
+	codes, err := jobqueue.ParseExitcodes(cmdNoRetryExitcodes)
+	if err != nil {
+		return nil, fmt.Errorf("--no_retry_exitcodes was not specified correctly: %s", err)
+	}
+	var maxRetries map[string]int
+	if cmdRetryMax != "" {
+		if err = json.Unmarshal([]byte(cmdRetryMax), &maxRetries); err != nil {
+			return nil, fmt.Errorf("--retry_max was not specified correctly: %s", err)
+		}
+	}
+	return jobqueue.NewRetryPolicy(cmdRetryBackoff, cmdRetryBackoffMax, cmdRetryJitter, maxRetries, codes)
+}
+
+// syncAdded waits for the given just-added jobs to finish, then reports on
+// them with reportWaitSummary(). If they were added with --array, waits on
+// their RepGroup instead.
+func syncAdded(jq *jobqueue.Client, jobs []*jobqueue.Job) {
+	var ws *jobqueue.WaitSummary
+	var err error
+	if cmdArray > 0 {
+		ws, err = jq.Wait(jobs[0].RepGroup)
+	} else {
+		jes := make([]*jobqueue.JobEssence, len(jobs))
+		for i, job := range jobs {
+			jes[i] = job.ToEssense()
+		}
+		var outcomes []*jobqueue.JobOutcome
+		outcomes, err = jq.WaitForJobs(jes)
+		ws = jobqueue.NewWaitSummary(outcomes)
+	}
+	if err != nil {
+		die("failed to wait on the commands: %s", err)
+	}
+	reportWaitSummary(jq, ws)
+}
+
 func init() {
 	RootCmd.AddCommand(addCmd)
 
@@ -376,6 +833,7 @@ func init() {
 	addCmd.Flags().StringVarP(&cmdRepGroup, "rep_grp", "i", "manually_added", "reporting group for your commands")
 	addCmd.Flags().StringVarP(&cmdLimitGroups, "limit_grps", "l", "", "comma-separated list of limit groups")
 	addCmd.Flags().StringVarP(&cmdDepGroups, "dep_grps", "e", "", "comma-separated list of dependency groups")
+	addCmd.Flags().StringVar(&cmdTags, "tags", "", "comma-separated list of key=value tags to give the commands")
 	addCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "base for the command's working dir")
 	addCmd.Flags().BoolVar(&cmdCwdMatters, "cwd_matters", false, "--cwd should be used as the actual working directory")
 	addCmd.Flags().BoolVar(&cmdChangeHome, "change_home", false, "when not --cwd_matters, set $HOME to the actual working directory")
@@ -390,9 +848,27 @@ func init() {
 	addCmd.Flags().StringVar(&cmdCmdDeps, "cmd_deps", "", "dependencies of your commands, in the form \"command1,cwd1,command2,cwd2...\"")
 	addCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2...\"")
 	addCmd.Flags().StringVar(&cmdMonitorDocker, "monitor_docker", "", "monitor resource usage of docker container with given --name or --cidfile path")
+	addCmd.Flags().StringVar(&cmdContainer, "container", "", "run commands inside a container created from this image")
+	addCmd.Flags().StringVar(&cmdContainerRuntime, "container_runtime", "", "[docker|singularity] program to run --container with (default docker)")
+	addCmd.Flags().IntVar(&cmdNetwork, "network", 0, "network bandwidth (megabits/s) expected to be used by each command")
+	addCmd.Flags().BoolVar(&cmdNetworkCap, "network_cap", false, "cap the outgoing bandwidth of each command at --network")
+	addCmd.Flags().StringVar(&cmdLostAfter, "lost_after", "", "confirm lost commands dead after this long [specify units such as m for minutes]")
+	addCmd.Flags().BoolVar(&cmdLostCloudGone, "lost_cloud_gone", false, "confirm lost commands dead when their cloud server is gone")
+	addCmd.Flags().StringVar(&cmdHeartbeat, "heartbeat", "", "how often runners should report commands as still running [specify units such as s for seconds]")
+	addCmd.Flags().StringVar(&cmdLostThreshold, "lost_threshold", "", "consider commands lost after not hearing from their runner for this long [specify units such as m for minutes]")
+	addCmd.Flags().StringVar(&cmdRetryBackoff, "retry_backoff", "", "wait this long before retrying failed commands, doubling each time [specify units such as s for seconds]")
+	addCmd.Flags().StringVar(&cmdRetryBackoffMax, "retry_backoff_max", "", "maximum wait before retrying failed commands [specify units such as m for minutes]")
+	addCmd.Flags().Float64Var(&cmdRetryJitter, "retry_jitter", 0, "[0-1] randomly vary the wait before retrying by up to this fraction of it")
+	addCmd.Flags().StringVar(&cmdRetryMax, "retry_max", "", "maximum retries per failure reason, in JSON format, eg. '{\"lost contact with runner\":10}'")
+	addCmd.Flags().StringVar(&cmdNoRetryExitcodes, "no_retry_exitcodes", "", "comma-separated exit codes that bury commands immediately instead of retrying them")
+	addCmd.Flags().StringVar(&cmdPolicy, "policy", "", "name of a policy to assign to --rep_grp")
+	addCmd.Flags().StringVar(&cmdNotifyComplete, "notify_complete", "", "comma separated URLs, slack:URLs or mailto:addresses to send a summary to when all the commands in --rep_grp complete")
+	addCmd.Flags().StringVar(&cmdNotifyFailure, "notify_failure", "", "comma separated URLs, slack:URLs or mailto:addresses to send a summary to when all the commands in --rep_grp finish, some having been buried")
 	addCmd.Flags().StringVar(&cmdOnFailure, "on_failure", "", "behaviours to carry out when cmds fails, in JSON format")
 	addCmd.Flags().StringVar(&cmdOnSuccess, "on_success", "", "behaviours to carry out when cmds succeed, in JSON format")
-	addCmd.Flags().StringVar(&cmdOnExit, "on_exit", `[{"cleanup":true}]`, "behaviours to carry out when cmds finish running, in JSON format")
+	addCmd.Flags().StringVar(&cmdOnExit, "on_exit", "", "behaviours to carry out when cmds finish running, in JSON format (defaults to managerjobonexit)")
+	addCmd.Flags().StringVar(&cmdOnExitCode, "on_exit_code", "", "behaviours to carry out when cmds exit with certain codes, in JSON format keyed on exit code")
+	addCmd.Flags().StringVar(&cmdOnFailReason, "on_failreason", "", "behaviours to carry out when cmds fail for certain reasons, in JSON format keyed on fail reason")
 	addCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "remote file systems to mount, in JSON format; see 'wr mount -h'")
 	addCmd.Flags().StringVar(&mountSimple, "mounts", "", "remote file systems to mount, as a ,-separated list of [c|u][r|w]:bucket[/path]; see 'wr mount -h'")
 	addCmd.Flags().StringVar(&cmdOsPrefix, "cloud_os", "", "in the cloud, prefix name of the OS image servers that run the commands must use")
@@ -405,12 +881,21 @@ func init() {
 	addCmd.Flags().StringVar(&cmdQueue, "queue", "", "name of queue to submit to, for schedulers with queues")
 	addCmd.Flags().StringVar(&cmdMisc, "misc", "", "miscellaneous options to pass through to scheduler when submitting")
 	addCmd.Flags().StringVar(&cmdEnv, "env", "", "comma-separated list of key=value environment variables to set before running the commands")
-	addCmd.Flags().BoolVar(&cmdReRun, "rerun", false, "re-run any commands that you add that had been previously added and have since completed")
+	addCmd.Flags().StringVar(&cmdEnvCapture, "env_capture", string(jobqueue.EnvCaptureFull), "['full','minimal','none','module'] how much of your environment the commands should run with")
+	addCmd.Flags().StringVar(&cmdEnvVars, "env_vars", "", "for --env_capture minimal, comma-separated names of the environment variables to capture")
+	addCmd.Flags().StringVar(&cmdEnvModules, "env_modules", "", "comma-separated environment modules to load before running the commands")
+	addCmd.Flags().StringVar(&cmdEnvSecrets, "env_secrets", "", "comma-separated list of ENV_VAR=secret_name environment variables to set to the values of secrets")
+	addCmd.Flags().StringVar(&cmdReRun, "rerun", string(jobqueue.RerunSkip), "['skip','force','if-changed'] what to do with commands that you add that had been previously added and have since completed")
+	addCmd.Flags().Lookup("rerun").NoOptDefVal = string(jobqueue.RerunForce)
 	addCmd.Flags().BoolVar(&cmdBsubMode, "bsub", false, "enable bsub emulation mode")
 
 	addCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 	addCmd.Flags().IntVar(&rtimeoutint, "reserve_timeout", 1, "how long (seconds) to wait before a runner exits when there is no more work'")
 	addCmd.Flags().BoolVarP(&simpleOutput, "simple", "s", false, "simplify output to only queued job ids")
+	addCmd.Flags().IntVar(&cmdArray, "array", 0, "expand your single command in to this many, replacing {{.Index}} with 1..array")
+	addCmd.Flags().StringVar(&cmdManifest, "manifest", "", "TSV or CSV file with a header line; expand your single command in to one per row, replacing {{column}} placeholders")
+	addCmd.Flags().BoolVar(&cmdSync, "sync", false, "wait for the commands to finish, output a JSON summary, and exit non-zero if any were buried or deleted")
+	addCmd.Flags().BoolVar(&cmdEstimate, "estimate", false, "instead of adding the commands, report an estimate of the resources they would use")
 
 	err := addCmd.Flags().MarkHidden("reserve_timeout")
 	if err != nil {
@@ -418,6 +903,28 @@ func init() {
 	}
 }
 
+// estimate reports the server's estimate of the resources the given jobs would
+// use.
+func estimate(jq *jobqueue.Client, jobs []*jobqueue.Job) {
+	est, err := jq.Estimate(jobs)
+	if err != nil {
+		die("failed to estimate: %s", err)
+	}
+
+	info("%d commands would use an estimated %.2f core-hours", est.Jobs, est.CoreHours)
+	if est.CapacityKnown {
+		info("On the current hosts they would complete in %s", est.Completion.Round(time.Second))
+		if est.Unschedulable > 0 {
+			warn("%d commands could not run on any of the current hosts", est.Unschedulable)
+		}
+	} else {
+		info("The scheduler does not know its capacity, so completion time can't be estimated")
+	}
+	if est.Cost > 0 {
+		info("They would cost an estimated %.2f", est.Cost)
+	}
+}
+
 // convert cmd,cwd columns in to Dependency.
 func colsToDeps(cols []string) (deps jobqueue.Dependencies) {
 	for i := 0; i < len(cols); i += 2 {
@@ -434,6 +941,17 @@ func groupsToDeps(groups string) (deps jobqueue.Dependencies) {
 	return
 }
 
+// convert url1,slack:url2,mailto:address,... in to notification targets.
+func splitNotifyTargets(targets string) (split []string) {
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimSpace(target)
+		if target != "" {
+			split = append(split, target)
+		}
+	}
+	return
+}
+
 // parseCmdFile reads the given cmd file to get desired jobs, modified by
 // defaults specified in other command line args. Returns job slice, bool for if
 // the manager is on the same host as us, and bool for if any job defaulted to
@@ -463,6 +981,19 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 	if cmdCPUs < 0 {
 		die("--cpus can't be negative")
 	}
+	if cmdNetwork < 0 {
+		die("--network can't be negative")
+	}
+
+	var envModules []string
+	if cmdEnvModules != "" {
+		envModules = strings.Split(cmdEnvModules, ",")
+	}
+
+	var envSecrets []string
+	if cmdEnvSecrets != "" {
+		envSecrets = strings.Split(cmdEnvSecrets, ",")
+	}
 
 	jd := &jobqueue.JobDefaults{
 		RepGrp:           cmdRepGroup,
@@ -477,7 +1008,16 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 		Priority:         cmdPri,
 		Retries:          cmdRet,
 		Env:              cmdEnv,
+		EnvModules:       envModules,
+		EnvSecrets:       envSecrets,
 		MonitorDocker:    cmdMonitorDocker,
+		Container:        cmdContainer,
+		ContainerRuntime: cmdContainerRuntime,
+		Network:          cmdNetwork,
+		NetworkCap:       cmdNetworkCap,
+		Policy:           cmdPolicy,
+		NotifyComplete:   splitNotifyTargets(cmdNotifyComplete),
+		NotifyFailure:    splitNotifyTargets(cmdNotifyFailure),
 		CloudOS:          cmdOsPrefix,
 		CloudUser:        cmdOsUsername,
 		CloudScript:      cmdPostCreationScript,
@@ -514,6 +1054,33 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 		}
 	}
 
+	if cmdLostAfter != "" || cmdLostCloudGone || cmdHeartbeat != "" || cmdLostThreshold != "" {
+		jd.LostPolicy = &jobqueue.LostJobPolicy{CloudGone: cmdLostCloudGone}
+		if cmdLostAfter != "" {
+			jd.LostPolicy.After, err = time.ParseDuration(cmdLostAfter)
+			if err != nil || jd.LostPolicy.After < 0 {
+				die("--lost_after was not specified correctly: %s", err)
+			}
+		}
+		if cmdHeartbeat != "" {
+			jd.LostPolicy.Heartbeat, err = time.ParseDuration(cmdHeartbeat)
+			if err != nil || jd.LostPolicy.Heartbeat < 0 {
+				die("--heartbeat was not specified correctly: %s", err)
+			}
+		}
+		if cmdLostThreshold != "" {
+			jd.LostPolicy.Threshold, err = time.ParseDuration(cmdLostThreshold)
+			if err != nil || jd.LostPolicy.Threshold < 0 {
+				die("--lost_threshold was not specified correctly: %s", err)
+			}
+		}
+	}
+
+	jd.RetryPolicy, err = retryPolicyFromFlags()
+	if err != nil {
+		die("%s", err)
+	}
+
 	if cmdLimitGroups != "" {
 		jd.LimitGroups = strings.Split(cmdLimitGroups, ",")
 	}
@@ -522,6 +1089,13 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 		jd.DepGroups = strings.Split(cmdDepGroups, ",")
 	}
 
+	if cmdTags != "" {
+		jd.Tags, err = jobqueue.ParseTags(cmdTags)
+		if err != nil {
+			die("--tags was not specified correctly: %s", err)
+		}
+	}
+
 	if cmdCmdDeps != "" {
 		cols := strings.Split(cmdCmdDeps, ",")
 		if len(cols)%2 != 0 {
@@ -557,6 +1131,22 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 		}
 		jd.OnExit = bjs.Behaviours(jobqueue.OnExit)
 	}
+	if cmdOnExitCode != "" {
+		var ecbjs jobqueue.ExitCodeBehavioursViaJSON
+		err = json.Unmarshal([]byte(cmdOnExitCode), &ecbjs)
+		if err != nil {
+			die("bad --on_exit_code: %s", err)
+		}
+		jd.OnExitCode = ecbjs.Behaviours()
+	}
+	if cmdOnFailReason != "" {
+		var frbjs jobqueue.FailReasonBehavioursViaJSON
+		err = json.Unmarshal([]byte(cmdOnFailReason), &frbjs)
+		if err != nil {
+			die("bad --on_failreason: %s", err)
+		}
+		jd.OnFailReason = frbjs.Behaviours()
+	}
 
 	if mountJSON != "" || mountSimple != "" {
 		jd.MountConfigs = mountParse(mountJSON, mountSimple)
@@ -0,0 +1,200 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var applyFile string
+var applyPrune bool
+var applyDiff bool
+var applyReRun bool
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Make the queue match a pipeline manifest",
+	Long: `Manage a long-lived pipeline by describing all its commands in a file.
+
+Instead of adding commands with "wr add" and removing them with "wr remove",
+you can describe everything a pipeline should consist of in a YAML manifest,
+and have the manager work out what needs to change. This suits pipelines that
+are kept under version control and re-applied whenever they change, or that
+recur (eg. nightly).
+
+The manifest looks like:
+
+pipeline: nightly
+defaults:
+  cwd: /data/nightly
+  memory: 1G
+jobs:
+  - cmd: fetch.sh
+    rep_grp: nightly.fetch
+    dep_grps: [fetched]
+  - cmd: process.sh
+    rep_grp: nightly.process
+    deps: [fetched]
+
+"pipeline" names the pipeline. The commands that belong to it are those whose
+report group is the pipeline's name, or starts with the name and a dot, so
+every rep_grp in the manifest must be like that (it defaults to the pipeline's
+name).
+
+Each entry in "jobs" takes the same options as the JSON objects that "wr add"
+understands (see "wr add -h"), and "defaults" supplies options for every entry
+that doesn't specify them itself. If no cwd is given, it defaults to your
+current directory (or /tmp if the manager is remote).
+
+When you apply a manifest, commands that aren't in the queue yet are added,
+while those already in the queue (including running ones) are left alone. As
+with "wr add", commands that already completed are not added again unless you
+use --rerun. Incomplete commands in the pipeline's report groups that are no
+longer in the manifest are reported as orphans; with --prune they are removed,
+except for those that are running or that other commands depend on.
+
+Use --diff to see what would change without changing anything.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if applyFile == "" {
+			die("--file is required")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		var isLocal bool
+		currentIP, errc := internal.CurrentIP("")
+		if errc != nil {
+			warn("Could not get current IP: %s", errc)
+		}
+		if currentIP+":"+config.ManagerPort == jq.ServerInfo.Addr {
+			isLocal = true
+		}
+
+		jd := &jobqueue.JobDefaults{Cwd: "/tmp"}
+		if isLocal {
+			jd.Cwd, err = os.Getwd()
+			if err != nil {
+				die("%s", err)
+			}
+		}
+
+		var reader io.Reader
+		if applyFile == "-" {
+			reader = os.Stdin
+		} else {
+			reader, err = os.Open(applyFile)
+			if err != nil {
+				die("could not open file '%s': %s", applyFile, err)
+			}
+			defer internal.LogClose(appLogger, reader.(*os.File), "pipeline manifest", "path", applyFile)
+		}
+
+		name, jobs, err := jobqueue.ParsePipelineManifest(reader, jd)
+		if err != nil {
+			die("%s", err)
+		}
+
+		var envVars []string
+		if isLocal {
+			envVars = jobqueue.CaptureEnv(jobqueue.EnvCaptureFull, nil)
+		}
+
+		diff, err := jq.ApplyPipeline(name, jobs, envVars, !applyReRun, applyPrune, applyDiff)
+		if err != nil {
+			die("failed to apply pipeline %s: %s", name, err)
+		}
+
+		if applyDiff {
+			printPipelineDiff(jq, jobs, diff)
+			info("Applying pipeline %s would add %d commands, leave %d existing commands alone, and find %d orphaned commands (%d would be removed with --prune)",
+				name, len(diff.Added), len(diff.Existing), len(diff.Orphaned), len(diff.Removed))
+			return
+		}
+
+		info("Applied pipeline %s: added %d commands, left %d existing commands alone, found %d orphaned commands and removed %d",
+			name, len(diff.Added), len(diff.Existing), len(diff.Orphaned), len(diff.Removed))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(applyCmd)
+
+	// flags specific to this sub-command
+	applyCmd.Flags().StringVarP(&applyFile, "file", "f", "", "pipeline manifest file (- means read from STDIN)")
+	applyCmd.Flags().BoolVar(&applyPrune, "prune", false, "remove orphaned commands that are no longer in the manifest")
+	applyCmd.Flags().BoolVar(&applyDiff, "diff", false, "only show what would change")
+	applyCmd.Flags().BoolVar(&applyReRun, "rerun", false, "re-run commands that already completed")
+
+	applyCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// printPipelineDiff prints out the commands that applying a pipeline would add
+// and those that are orphaned, for the user.
+func printPipelineDiff(jq *jobqueue.Client, jobs []*jobqueue.Job, diff *jobqueue.PipelineDiff) {
+	// the server gave us keys of jobs in our namespace
+	cmds := make(map[string]string, len(jobs))
+	for _, job := range jobs {
+		job.Namespace = config.ManagerNamespace
+		cmds[job.Key()] = job.Cmd
+	}
+	for _, key := range diff.Added {
+		fmt.Printf("+ %s\n", cmds[key])
+	}
+
+	if len(diff.Orphaned) == 0 {
+		return
+	}
+	removed := make(map[string]bool, len(diff.Removed))
+	for _, key := range diff.Removed {
+		removed[key] = true
+	}
+	jes := make([]*jobqueue.JobEssence, len(diff.Orphaned))
+	for i, key := range diff.Orphaned {
+		jes[i] = &jobqueue.JobEssence{JobKey: key}
+	}
+	orphans, err := jq.GetByEssences(jes)
+	if err != nil {
+		warn("could not get the orphaned commands: %s", err)
+		return
+	}
+	for _, job := range orphans {
+		prefix := "?"
+		if removed[job.Key()] {
+			prefix = "-"
+		}
+		fmt.Printf("%s %s\n", prefix, job.Cmd)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var archiveRepGroup string
+var archiveOutput string
+var archiveRemove bool
+var archiveRestore string
+var archiveList bool
+var archiveShow string
+
+// archiveCmd represents the archive command
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Archive and restore report groups",
+	Long: `Archive the completed commands of a report group to a file, and restore them.
+
+To keep long-term records of finished projects without the manager's database
+growing forever, you can archive a report group whose commands have all
+completed in to a single portable file:
+
+wr archive -i my_rep_grp -o my_rep_grp.wrarchive --remove
+
+The file holds the details of every command, their resource usage, any STDOUT
+and STDERR the manager kept, and their histories. With --remove, the commands
+are then removed from the manager's database. (What was learned about their
+memory and time usage is kept, so future commands are still given good
+estimates.)
+
+Later, you can restore the file to the same or another manager:
+
+wr archive --restore my_rep_grp.wrarchive
+
+Restored commands are read-only: they are not put back in the queue, and adding
+the same commands again will run them again. List the restored report groups
+with --list, and see the commands of one of them with --show my_rep_grp, which
+prints each command's key, exit code, walltime, host and command line.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		set := 0
+		for _, given := range []bool{archiveRepGroup != "", archiveRestore != "", archiveList, archiveShow != ""} {
+			if given {
+				set++
+			}
+		}
+		if set != 1 {
+			die("exactly 1 of -i, --restore, --list or --show is required")
+		}
+		if archiveRepGroup != "" && archiveOutput == "" {
+			die("-o is required with -i")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		switch {
+		case archiveRepGroup != "":
+			// write the file before anything can be removed, so we can't lose
+			// the jobs if we fail to write it
+			data, errg := jq.ArchiveRepGroup(archiveRepGroup, false)
+			if errg != nil {
+				die("failed to archive: %s", errg)
+			}
+			err = ioutil.WriteFile(archiveOutput, data, 0600)
+			if err != nil {
+				die("failed to write to %s: %s", archiveOutput, err)
+			}
+			a, errd := jobqueue.DecodeRepGroupArchive(data)
+			if errd != nil {
+				die("%s", errd)
+			}
+			if archiveRemove {
+				_, err = jq.ArchiveRepGroup(archiveRepGroup, true)
+				if err != nil {
+					die("archived to %s, but failed to remove from the manager: %s", archiveOutput, err)
+				}
+				info("Archived %d commands to %s and removed them from the manager", len(a.Jobs), archiveOutput)
+			} else {
+				info("Archived %d commands to %s", len(a.Jobs), archiveOutput)
+			}
+		case archiveRestore != "":
+			data, errr := ioutil.ReadFile(archiveRestore)
+			if errr != nil {
+				die("failed to read %s: %s", archiveRestore, errr)
+			}
+			rg, errr := jq.RestoreRepGroup(data)
+			if errr != nil {
+				die("failed to restore: %s", errr)
+			}
+			info("Restored report group %s", rg)
+		case archiveList:
+			rgs, errg := jq.GetRestoredRepGroups()
+			if errg != nil {
+				die("%s", errg)
+			}
+			for _, rg := range rgs {
+				fmt.Println(rg)
+			}
+		default:
+			a, errg := jq.GetRestoredRepGroup(archiveShow)
+			if errg != nil {
+				die("%s", errg)
+			}
+			if a == nil {
+				die("report group %s has not been restored", archiveShow)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 2, 2, 3, ' ', 0)
+			for _, job := range a.Jobs {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", job.Key(), job.Exitcode, job.WallTime().Truncate(time.Second), job.Host, job.Cmd)
+			}
+			if err = w.Flush(); err != nil {
+				die("%s", err)
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(archiveCmd)
+
+	// flags specific to this sub-command
+	archiveCmd.Flags().StringVarP(&archiveRepGroup, "identifier", "i", "", "report group to archive")
+	archiveCmd.Flags().StringVarP(&archiveOutput, "output", "o", "", "path of the archive file to create")
+	archiveCmd.Flags().BoolVar(&archiveRemove, "remove", false, "remove the archived commands from the manager")
+	archiveCmd.Flags().StringVar(&archiveRestore, "restore", "", "path of an archive file to restore")
+	archiveCmd.Flags().BoolVar(&archiveList, "list", false, "list the restored report groups")
+	archiveCmd.Flags().StringVar(&archiveShow, "show", "", "show the commands of this restored report group")
+
+	archiveCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
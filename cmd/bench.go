@@ -0,0 +1,382 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/inconshreveable/log15"
+	"github.com/kardianos/osext"
+	sync "github.com/sasha-s/go-deadlock"
+	"github.com/sb10/waitgroup"
+	"github.com/spf13/cobra"
+)
+
+const (
+	benchDistFixed       = "fixed"
+	benchDistUniform     = "uniform"
+	benchDistExponential = "exponential"
+	benchRepGroup        = "wr_bench"
+	benchPollInterval    = 250 * time.Millisecond
+)
+
+// options for this cmd
+var benchJobs int
+var benchFanOut int
+var benchRuntime float64
+var benchDist string
+var benchCores float64
+var benchMaxCores int
+var benchSeed int64
+var benchMaxMins int
+
+// benchCmd represents the bench command
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Benchmark the performance of wr",
+	Long: `Benchmark the performance of wr on this machine.
+
+A temporary manager is started (using the local scheduler, and separate from
+any manager you might already have running), a synthetic workload of jobs is
+added to it, and once all the jobs have completed, the following is reported:
+
+submission rate: how many jobs per second could be added to the queue.
+scheduling latency: how long jobs took to start running after they became
+  ready to run (that is, after being added, or after the job they depend on
+  completed).
+completion throughput: how many jobs per second were completed, from the start
+  of submission to the completion of the last job.
+
+The workload consists of --jobs jobs. With --fan_out 0 they are independent of
+each other. Otherwise they are arranged in to families of one parent job and
+--fan_out child jobs that depend on the parent.
+
+Each job just sleeps. How long for is determined by --runtime (the mean number
+of seconds) and --distribution, which can be one of:
+fixed: every job sleeps for exactly --runtime seconds.
+uniform: jobs sleep for between 0 and twice --runtime seconds.
+exponential: job runtimes are exponentially distributed.
+The --seed option makes the runtimes reproducible.
+
+Run the same benchmark before and after upgrading wr to quantify any change in
+performance. Note that timings depend on the machine and what else it is
+doing.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if benchJobs < 1 {
+			die("--jobs must be at least 1")
+		}
+		if benchFanOut < 0 {
+			die("--fan_out can't be negative")
+		}
+		switch benchDist {
+		case benchDistFixed, benchDistUniform, benchDistExponential:
+		default:
+			die("--distribution must be one of %s, %s or %s", benchDistFixed, benchDistUniform, benchDistExponential)
+		}
+
+		dir, err := ioutil.TempDir("", "wr_bench_")
+		if err != nil {
+			die("could not create a temporary directory: %s", err)
+		}
+		defer func() {
+			err = os.RemoveAll(dir)
+			if err != nil {
+				warn("could not remove temporary directory %s: %s", dir, err)
+			}
+		}()
+
+		timeout := time.Duration(timeoutint) * time.Second
+		server, jq := benchStartManager(dir, timeout)
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+			server.Stop(true)
+		}()
+
+		jobs := benchWorkload(dir)
+
+		info("adding %d jobs", len(jobs))
+		submitStart := time.Now()
+		_, _, err = jq.Add(jobs, os.Environ(), true)
+		if err != nil {
+			die("failed to add jobs: %s", err)
+		}
+		submitEnd := time.Now()
+
+		info("waiting for jobs to complete")
+		buried := benchWait(jq, time.Duration(benchMaxMins)*time.Minute)
+
+		completed, err := jq.GetByRepGroup(benchRepGroup, false, 0, jobqueue.JobStateComplete, false, false)
+		if err != nil {
+			die("failed to get completed jobs: %s", err)
+		}
+
+		benchReport(len(jobs), buried, completed, submitStart, submitEnd)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(benchCmd)
+
+	// flags specific to this sub-command
+	benchCmd.Flags().IntVarP(&benchJobs, "jobs", "n", 1000, "number of jobs to run")
+	benchCmd.Flags().IntVarP(&benchFanOut, "fan_out", "f", 0, "number of child jobs that depend on each parent job")
+	benchCmd.Flags().Float64VarP(&benchRuntime, "runtime", "r", 0, "mean job runtime in seconds")
+	benchCmd.Flags().StringVarP(&benchDist, "distribution", "d", benchDistFixed, "distribution of job runtimes ["+benchDistFixed+"|"+benchDistUniform+"|"+benchDistExponential+"]")
+	benchCmd.Flags().Float64VarP(&benchCores, "cpus", "c", 1, "number of CPU cores each job is said to use")
+	benchCmd.Flags().IntVar(&benchMaxCores, "max_cores", 0, "maximum number of CPU cores to run jobs on (defaults to all of them)")
+	benchCmd.Flags().Int64Var(&benchSeed, "seed", 1, "seed for generating job runtimes")
+	benchCmd.Flags().IntVarP(&benchMaxMins, "max_mins", "m", 60, "give up waiting for jobs to complete after this many minutes")
+	benchCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from the manager")
+}
+
+// benchStartManager starts a temporary manager using files in the given
+// directory, and returns it along with a client connected to it. Runners
+// spawned by the manager will find its token and CA through environment
+// variables.
+func benchStartManager(dir string, timeout time.Duration) (*jobqueue.Server, *jobqueue.Client) {
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	tokenFile := filepath.Join(dir, "client.token")
+	domain := "localhost"
+	err := internal.GenerateCerts(caFile, certFile, keyFile, domain)
+	if err != nil {
+		die("could not generate certificates: %s", err)
+	}
+
+	for key, val := range map[string]string{
+		"WR_MANAGERCAFILE":    caFile,
+		"WR_MANAGERTOKENFILE": tokenFile,
+	} {
+		err = os.Setenv(key, val)
+		if err != nil {
+			die("could not set %s: %s", key, err)
+		}
+	}
+
+	exe, err := osext.Executable()
+	if err != nil {
+		die("could not get the path to wr: %s", err)
+	}
+
+	// we want to measure wr's own performance, without deadlock detection
+	sync.Opts.Disable = true
+	waitgroup.Opts.Disable = true
+
+	serverLogger := log15.New()
+	serverLogger.SetHandler(log15.DiscardHandler())
+
+	server, msg, token, err := jobqueue.Serve(jobqueue.ServerConfig{
+		Port:            benchFreePort(),
+		WebPort:         benchFreePort(),
+		SchedulerName:   "local",
+		SchedulerConfig: &jqs.ConfigLocal{Shell: config.RunnerExecShell, MaxCores: benchMaxCores},
+		RunnerCmd:       exe + " runner -s '%s' --deployment %s --server '%s' --domain %s -r %d -m %d",
+		DBFile:          filepath.Join(dir, "db"),
+		DBFileBackup:    filepath.Join(dir, "db_bk"),
+		TokenFile:       tokenFile,
+		UploadDir:       filepath.Join(dir, "uploads"),
+		CAFile:          caFile,
+		CertFile:        certFile,
+		KeyFile:         keyFile,
+		CertDomain:      domain,
+		Deployment:      config.Deployment,
+		Logger:          serverLogger,
+	})
+	if msg != "" {
+		info("temporary manager: %s", msg)
+	}
+	if err != nil {
+		die("temporary manager failed to start: %s", err)
+	}
+
+	jq, err := jobqueue.Connect(server.ServerInfo.Addr, caFile, domain, token, timeout)
+	if err != nil {
+		server.Stop(true)
+		die("could not connect to the temporary manager: %s", err)
+	}
+	return server, jq
+}
+
+// benchFreePort returns a port that nothing is currently listening on.
+func benchFreePort() string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		die("could not find a free port: %s", err)
+	}
+	defer func() {
+		err = l.Close()
+		if err != nil {
+			warn("could not close listener: %s", err)
+		}
+	}()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+// benchWorkload generates the jobs to add according to the user's options,
+// running in the given directory.
+func benchWorkload(dir string) []*jobqueue.Job {
+	r := rand.New(rand.NewSource(benchSeed)) // #nosec
+	runtimes := make([]float64, benchJobs)
+	var longest float64
+	for i := range runtimes {
+		switch benchDist {
+		case benchDistUniform:
+			runtimes[i] = r.Float64() * 2 * benchRuntime
+		case benchDistExponential:
+			runtimes[i] = r.ExpFloat64() * benchRuntime
+		default:
+			runtimes[i] = benchRuntime
+		}
+		if runtimes[i] > longest {
+			longest = runtimes[i]
+		}
+	}
+
+	// all jobs get the same requirements so they end up in the same scheduler
+	// group, regardless of their individual runtimes
+	req := &jqs.Requirements{
+		RAM:   1,
+		Time:  time.Duration(math.Ceil(longest)+1) * time.Second,
+		Cores: benchCores,
+	}
+
+	jobs := make([]*jobqueue.Job, benchJobs)
+	var parent string
+	for i, secs := range runtimes {
+		job := &jobqueue.Job{
+			Cmd:          fmt.Sprintf("sleep %.3f; echo %d", secs, i),
+			Cwd:          dir,
+			ReqGroup:     benchRepGroup,
+			Requirements: req,
+			Override:     2,
+			RepGroup:     benchRepGroup,
+		}
+		if benchFanOut > 0 {
+			if i%(benchFanOut+1) == 0 {
+				parent = fmt.Sprintf("%s.%d", benchRepGroup, i)
+				job.DepGroups = []string{parent}
+			} else {
+				job.Dependencies = jobqueue.Dependencies{jobqueue.NewDepGroupDependency(parent)}
+			}
+		}
+		jobs[i] = job
+	}
+	return jobs
+}
+
+// benchWait waits until all our jobs have completed or are buried, or until
+// the given time limit is up. Returns the number of buried jobs.
+func benchWait(jq *jobqueue.Client, limit time.Duration) int {
+	deadline := time.After(limit)
+	ticker := time.NewTicker(benchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			jobs, err := jq.GetIncomplete(1, "", false, false)
+			if err != nil {
+				die("failed to get incomplete jobs: %s", err)
+			}
+			var incomplete, buried int
+			for _, job := range jobs {
+				incomplete += job.Similar + 1
+				if job.State == jobqueue.JobStateBuried {
+					buried += job.Similar + 1
+				}
+			}
+			if incomplete == buried {
+				return buried
+			}
+		case <-deadline:
+			die("jobs did not complete within %s", limit)
+		}
+	}
+}
+
+// benchReport prints the results of the benchmark.
+func benchReport(added, buried int, completed []*jobqueue.Job, submitStart, submitEnd time.Time) {
+	submitTime := submitEnd.Sub(submitStart)
+	fmt.Printf("jobs: %d", added)
+	if benchFanOut > 0 {
+		fmt.Printf(" (families of 1 parent and %d children)", benchFanOut)
+	}
+	fmt.Printf("\nsubmission: %.1f jobs/s (%s)\n", float64(added)/submitTime.Seconds(), submitTime)
+
+	if buried > 0 {
+		warn("%d jobs failed", buried)
+	}
+	if len(completed) == 0 {
+		return
+	}
+
+	// a job became ready to run when it was added, or when its parent
+	// completed
+	parentEnds := make(map[string]time.Time)
+	var lastEnd time.Time
+	for _, job := range completed {
+		for _, dg := range job.DepGroups {
+			parentEnds[dg] = job.EndTime
+		}
+		if job.EndTime.After(lastEnd) {
+			lastEnd = job.EndTime
+		}
+	}
+	latencies := make([]time.Duration, 0, len(completed))
+	for _, job := range completed {
+		readyAt := submitEnd
+		for _, dg := range job.Dependencies.DepGroups() {
+			if end, exists := parentEnds[dg]; exists && end.After(readyAt) {
+				readyAt = end
+			}
+		}
+		latency := job.StartTime.Sub(readyAt)
+		if latency < 0 {
+			// it started while we were still adding jobs
+			latency = 0
+		}
+		latencies = append(latencies, latency)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	n := len(latencies)
+	fmt.Printf("scheduling latency: mean %s, median %s, 95th percentile %s, max %s\n",
+		total/time.Duration(n), latencies[n/2], latencies[(n*95)/100], latencies[n-1])
+
+	elapsed := lastEnd.Sub(submitStart)
+	fmt.Printf("completion: %.1f jobs/s (%d jobs complete after %s)\n", float64(len(completed))/elapsed.Seconds(), len(completed), elapsed)
+}
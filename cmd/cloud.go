@@ -26,6 +26,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
@@ -208,7 +209,51 @@ http:// urls, this is most likely to succeed if you use an IP address instead of
 a domain name. For https:// urls you'll need a domain name, and will have to
 ask your administrator for the appropriate --network_dns settings (or clouddns
 config option) to use; the DNS must be able to resolve the domain name from
-within OpenStack.`,
+within OpenStack.
+
+The gcp provider (Google Cloud Platform) needs these environment variables to
+be set:
+GCP_PROJECT and GCP_ZONE.
+You also need Google "application default credentials": either set
+GOOGLE_APPLICATION_CREDENTIALS to the path of the JSON key file of a service
+account that can manage Compute Engine, or run 'gcloud auth application-default
+login'. (The server running the manager uses its own service account, so your
+credentials aren't copied to it.) --os can be the name, family or name prefix
+of an image in your project, or of a public image if prefixed with its project,
+eg. "ubuntu-os-cloud/ubuntu-2004-lts". --username can be any name you like; it
+will be created on each server. --flavor matches machine type names, eg.
+"^n1-standard". A network and subnetwork (using --network_cidr) are created for
+you, unless you set GCP_NETWORK to the name of an existing network; DNS and
+the gateway are provided by GCP, so --network_dns and --network_gateway_ip are
+ignored.
+If you set GCP_PREEMPTIBLE to "true", the servers the manager spawns to run
+your commands (but not the server the manager runs on) will be preemptible,
+which is much cheaper, but GCP can take them back at any time. Preempted
+servers are treated as bad servers with a permanent problem, so with a
+cloudbadserverpolicy of "destroy" or "reboot" they are destroyed straight away,
+killing the commands that were running on them (which will be retried on new
+servers if they have retries left).
+
+The aws provider (Amazon Web Services) needs these environment variables to be
+set:
+AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION.
+You may also need AWS_SESSION_TOKEN if you're using temporary credentials.
+(These are copied to the server running the manager, so it can spawn more
+servers.) --os can be the id of an AMI, or the start of the name of one of your
+own AMIs, or of someone else's if prefixed with their account id and a colon,
+eg. "099720109477:ubuntu/images/hvm-ssd/ubuntu-focal-20.04-amd64-server"; the
+newest matching AMI is used. --username must be the user the AMI is set up for,
+eg. "ubuntu". --flavor matches instance type names, eg. "^m5\.". A VPC with a
+subnet (using --network_cidr) and an internet gateway are created for you,
+unless you set AWS_SUBNET_ID to the id of an existing subnet; DNS and the
+gateway are provided by AWS, so --network_dns and --network_gateway_ip are
+ignored.
+If you set AWS_SPOT to "true", the servers the manager spawns to run your
+commands (but not the server the manager runs on) will be spot instances, which
+are much cheaper, but AWS can take them back at any time, giving 2 minutes
+notice. You can set AWS_SPOT_MAX_PRICE to the most you're willing to pay per
+hour (it defaults to the on-demand price). Spot instances that are being taken
+back are treated like preempted GCP servers, above.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if providerName == "" {
 			die("--provider is required")
@@ -637,7 +682,11 @@ likely would have reached "lost contact" status) will be killed or confirmed
 dead, so that they will either become buried or retry according to their
 configured number of retries. If jobs hadn't yet reached  "lost contact" status,
 they will have a status of running until the time they would normally become
-lost, at which point they will automatically be confirmed dead.`,
+lost, at which point they will automatically be confirmed dead.
+
+Instead of always waiting for you to confirm servers dead, the manager can
+deal with them itself according to the cloudbadserverpolicy config option, in
+which case this command also shows what was done to each server.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if cloudServersConfirmDead && (!cloudServersAll && cloudServerID == "") {
 			die("in --confirmdead mode, either --all or --identifier must be specified")
@@ -682,11 +731,14 @@ lost, at which point they will automatically be confirmed dead.`,
 			if !server.IsBad {
 				continue
 			}
-			var problem string
+			var problem, action string
 			if server.Problem != "" {
 				problem = "; " + server.Problem
 			}
-			fmt.Printf(" ID: %s; IP: %s; Name: %s%s\n", server.ID, server.IP, server.Name, problem)
+			if server.Action != "" {
+				action = "; automatically " + server.Action
+			}
+			fmt.Printf(" ID: %s; IP: %s; Name: %s%s%s\n", server.ID, server.IP, server.Name, problem, action)
 		}
 
 		if cloudServersConfirmDead {
@@ -720,7 +772,7 @@ func init() {
 
 	// flags specific to these sub-commands
 	defaultConfig := internal.DefaultConfig(appLogger)
-	cloudDeployCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack'] cloud provider")
+	cloudDeployCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack','gcp','aws'] cloud provider")
 	cloudDeployCmd.Flags().StringVar(&cloudResourceNameUniquer, "resource_name", realUsername(), fmt.Sprintf("name to be included when naming cloud resources (should be unique to you, max length %d)", maxCloudResourceUsernameLength))
 	cloudDeployCmd.Flags().StringVarP(&osPrefix, "os", "o", defaultConfig.CloudOS, "prefix of name, or ID, of the OS image your servers should use")
 	cloudDeployCmd.Flags().StringVarP(&osUsername, "username", "u", defaultConfig.CloudUser, "username needed to log in to the OS image specified by --os")
@@ -749,7 +801,7 @@ func init() {
 	cloudDeployCmd.Flags().BoolVar(&setDomainIP, "set_domain_ip", defaultConfig.ManagerSetDomainIP, "on success, use infoblox to set your domain's IP")
 	cloudDeployCmd.Flags().BoolVar(&cloudDebug, "debug", false, "include extra debugging information in the logs, and have runners log to syslog on their machines")
 
-	cloudTearDownCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack'] cloud provider")
+	cloudTearDownCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack','gcp','aws'] cloud provider")
 	cloudTearDownCmd.Flags().StringVar(&cloudResourceNameUniquer, "resource_name", realUsername(), "name you set during deploy")
 	cloudTearDownCmd.Flags().BoolVarP(&forceTearDown, "force", "f", false, "force teardown even when the remote manager cannot be accessed")
 	cloudTearDownCmd.Flags().BoolVar(&cloudDebug, "debug", false, "show details of the teardown process")
@@ -763,13 +815,33 @@ func init() {
 func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe string, mp int, wp int, keyPath string, wrMayHaveStarted bool, domainMatchesIP bool) {
 	ctx := context.Background()
 
-	// upload ourselves to /tmp
+	// upload ourselves (or a copy of wr built for the server's platform) to
+	// /tmp
+	goos, goarch, err := server.Platform(ctx)
+	if err != nil {
+		teardown(provider)
+		die("failed to find out the platform of the server at %s: %s", server.IP, err)
+	}
+	sourceExe, err := cloud.ExeForPlatform(exe, goos, goarch, config.CloudRunnerDir, cloudRunnerURL())
+	if err != nil {
+		teardown(provider)
+		die("failed to find a wr executable for the server at %s: %s", server.IP, err)
+	}
 	remoteExe := filepath.Join(cloudBinDir, "wr")
-	err := server.UploadFile(ctx, exe, remoteExe)
+	err = server.UploadFile(ctx, sourceExe, remoteExe)
 	if err != nil && !wrMayHaveStarted {
 		teardown(provider)
 		die("failed to upload wr to the server at %s: %s", server.IP, err)
 	}
+	if sourceExe != exe {
+		// also upload ourselves, so that the remote manager can use us for
+		// servers it spawns that are our platform
+		err = server.UploadFile(ctx, exe, remoteExe+"-"+runtime.GOOS+"-"+runtime.GOARCH)
+		if err != nil && !wrMayHaveStarted {
+			teardown(provider)
+			die("failed to upload wr to the server at %s: %s", server.IP, err)
+		}
+	}
 
 	// create a config file on the remote to have the remote wr work on the same
 	// ports that we'd use locally, use the right domain, and have it use an S3
@@ -791,7 +863,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 			die("failed to access the local database: %s", errf)
 		}
 	}
-	if err = server.CreateFile(ctx, fmt.Sprintf("managerport: \"%d\"\nmanagerweb: \"%d\"\nmanagerdbbkfile: \"%s\"\nmanagercertdomain: \"%s\"\nmanagerumask: %d\n", mp, wp, dbBk, config.ManagerCertDomain, config.ManagerUmask), wrConfigFileName); err != nil {
+	if err = server.CreateFile(ctx, fmt.Sprintf("managerport: \"%d\"\nmanagerweb: \"%d\"\nmanagerdbbkfile: \"%s\"\nmanagerdbbksnapshot: %d\nmanagercertdomain: \"%s\"\nmanagerumask: %d\ncloudrunnerurl: \"%s\"\n", mp, wp, dbBk, config.ManagerDbBkSnapshot, config.ManagerCertDomain, config.ManagerUmask, config.CloudRunnerURL), wrConfigFileName); err != nil {
 		teardown(provider)
 		die("failed to create our config file on the server at %s: %s", server.IP, err)
 	}
@@ -0,0 +1,180 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/kardianos/osext"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var debugHost string
+var debugLogin string
+
+// debugCmd represents the debug command
+var debugCmd = &cobra.Command{
+	Use:   "debug <job key>",
+	Short: "Get a shell in the environment of a failed command",
+	Long: `Get an interactive shell in the environment a command ran in, to find
+out why it failed.
+
+Give the key of the command you want to debug (as shown by 'wr status'); it
+would normally be one that got buried, but can be any that isn't currently
+running. The manager is asked for everything about the command, and its working
+directory is recreated, just as it would be for a run of the command: a new
+unique directory is created in its cwd (unless cwd_matters), any mounts are
+mounted and any inputs are staged. You are then given a shell in that directory
+with the command's environment variables set (and any env_modules loaded). The
+command line is in $WR_DEBUG_CMD, so you can run it with: eval "$WR_DEBUG_CMD"
+(for commands with steps, this holds the steps that didn't complete yet).
+
+Secrets the command uses are not available in the shell. Writable mounts are
+mounted as normal, so take care not to overwrite real outputs; files written to
+cached writable mounts are not uploaded.
+
+When you exit the shell, everything is unmounted and the unique working
+directory is deleted, along with anything you created in it.
+
+By default the environment is recreated on this host. To recreate it on another
+host (eg. the one the command failed on, shown by 'wr status'), say which with
+--host. wr will then use the --login command (ssh by default) to run 'wr runner'
+in a special debug mode on that host, which must be able to run the same wr
+executable and read the same config as here.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		key := args[0]
+		login := strings.Fields(debugLogin)
+		if debugHost != "" && len(login) == 0 {
+			die("--login must be specified")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		job, err := jq.GetByEssence(&jobqueue.JobEssence{JobKey: key}, false, false)
+		if err != nil {
+			die("%s", err)
+		}
+		if job == nil {
+			die("no command with key %s was found", key)
+		}
+		switch job.State {
+		case jobqueue.JobStateRunning, jobqueue.JobStateReserved:
+			die("that command is currently running, so can't be debugged")
+		case jobqueue.JobStateBuried:
+			if job.FailReason != "" {
+				info("the command was buried because: %s", job.FailReason)
+			}
+		default:
+			warn("the command is %s, not buried", job.State)
+		}
+
+		host, err := os.Hostname()
+		if debugHost == "" || (err == nil && debugHost == host) {
+			debugShell(jq, key)
+			return
+		}
+
+		exe, err := osext.Executable()
+		if err != nil {
+			die("could not find the wr executable: %s", err)
+		}
+		remote := []string{exe, "runner", "--deployment", deployment, "--server", addr, "--domain", config.ManagerCertDomain, "--debug_job", key}
+		if config.ManagerNamespace != "" {
+			remote = append(remote, "--project", config.ManagerNamespace)
+		}
+		info("recreating the command's environment on %s", debugHost)
+		args = append(login, debugHost, strings.Join(remote, " "))
+
+		// ignore ctrl-c while the user is in their shell; it's for them
+		signal.Ignore(os.Interrupt)
+		sh := exec.Command(args[0], args[1:]...) // #nosec our purpose is to get the user a shell
+		sh.Stdin = os.Stdin
+		sh.Stdout = os.Stdout
+		sh.Stderr = os.Stderr
+		err = sh.Run()
+		if _, isExit := err.(*exec.ExitError); err != nil && !isExit {
+			die("%s", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(debugCmd)
+
+	// flags specific to this sub-command
+	debugCmd.Flags().StringVar(&debugHost, "host", "", "host to recreate the command's environment on (default this host)")
+	debugCmd.Flags().StringVar(&debugLogin, "login", "ssh -t", "command to get a shell on a remote --host, which will be given the host and the wr runner command line as its final arguments")
+	debugCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// debugShell recreates the environment of the job with the given key on this
+// host, gives the user a shell in it, and cleans up once they exit the shell.
+// This is used by both `wr debug` and `wr runner --debug_job`.
+func debugShell(jq *jobqueue.Client, key string) {
+	ds, err := jq.DebugJob(key)
+	if err != nil {
+		die("could not recreate the command's environment: %s", err)
+	}
+	defer func() {
+		if errc := ds.Cleanup(); errc != nil {
+			warn("failed to clean up: %s", errc)
+		} else {
+			info("cleaned up")
+		}
+	}()
+
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = config.RunnerExecShell
+	}
+	info("working directory: %s", ds.Dir)
+	info("command (in $WR_DEBUG_CMD): %s", ds.Cmd)
+	info("exit the shell when you're done")
+
+	// ignore ctrl-c while the user is in their shell; it's for them
+	signal.Ignore(os.Interrupt)
+	defer signal.Reset(os.Interrupt)
+
+	args := ds.ShellArgs(shell)
+	sh := exec.Command(args[0], args[1:]...) // #nosec our purpose is to run the user's shell
+	sh.Dir = ds.Dir
+	sh.Env = ds.Env
+	sh.Stdin = os.Stdin
+	sh.Stdout = os.Stdout
+	sh.Stderr = os.Stderr
+	err = sh.Run()
+	if _, isExit := err.(*exec.ExitError); err != nil && !isExit {
+		warn("the shell failed: %s", err)
+	}
+}
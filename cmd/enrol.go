@@ -0,0 +1,202 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var enrolTTL int
+var enrolManager string
+var enrolToken string
+var enrolName string
+var enrolRevoke string
+
+// enrolCmd represents the enrol command
+var enrolCmd = &cobra.Command{
+	Use:   "enrol",
+	Short: "Enrol hosts with the manager",
+	Long: `Securely set up new hosts to use the manager.
+
+When the manager has managerenrolment enabled in its config, clients (including
+runners) must be on hosts that have enrolled with it. This lets you run the
+manager and its runners across untrusted networks, such as the public internet.
+
+To enrol a new host, first create a one-time token on a host that can already
+use the manager:
+
+wr enrol token
+
+Then on the new host run:
+
+wr enrol join --manager manager.host:webport --token [the token]
+
+The new host will be given its own client certificate and token, along with
+the manager's CA certificate, over an encrypted connection. The enrolment token
+includes the fingerprint of the manager's certificate, so nothing else needs to
+be trusted first.
+
+See the list and revoke sub-commands to manage enrolled hosts.`,
+}
+
+// token sub-command creates an enrolment token
+var enrolTokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Create a one-time enrolment token",
+	Long: `Create a one-time token for a new host to enrol with.
+
+The token can only be used once, and expires after --ttl seconds, or when the
+manager is restarted.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer func() {
+			err := jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		token, err := jq.CreateEnrolmentToken(time.Duration(enrolTTL) * time.Second)
+		if err != nil {
+			die("could not create an enrolment token: %s", err)
+		}
+		fmt.Println(token)
+	},
+}
+
+// join sub-command enrols this host
+var enrolJoinCmd = &cobra.Command{
+	Use:   "join",
+	Short: "Enrol this host",
+	Long: `Enrol this host with the manager, using a token from "wr enrol token".
+
+--manager is the host name and web interface port of the manager. It defaults
+to your managerhost and managerweb config options.
+
+The manager's CA certificate and this host's token are stored at the paths of
+your managercafile and managertokenfile config options, and this host's client
+certificate is stored alongside the CA certificate, so that wr commands run on
+this host will be able to use the manager.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if enrolToken == "" {
+			die("--token is required")
+		}
+		if enrolManager == "" {
+			enrolManager = config.ManagerHost + ":" + config.ManagerWeb
+		}
+		if enrolName == "" {
+			var err error
+			enrolName, err = os.Hostname()
+			if err != nil {
+				die("could not get the host name; use --name: %s", err)
+			}
+		}
+
+		reply, err := jobqueue.Enrol(enrolManager, enrolToken, enrolName, config.ManagerCAFile, config.ManagerTokenFile)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Enrolled as %s; the manager listens for clients on port %s of %s", enrolName, reply.Port, reply.CertDomain)
+	},
+}
+
+// list sub-command lists enrolled hosts
+var enrolListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List enrolled hosts",
+	Long: `List the hosts that have enrolled with the manager.
+
+Shows the host name, the serial number of its client certificate, the address
+it enrolled from, when it enrolled, and if its enrolment has been revoked.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer func() {
+			err := jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		hosts, err := jq.GetEnrolledHosts()
+		if err != nil {
+			die("%s", err)
+		}
+		for _, h := range hosts {
+			state := "enrolled"
+			if h.Revoked {
+				state = "revoked"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", h.Name, h.Serial, h.IP, h.Enrolled.Format(time.RFC3339), state)
+		}
+	},
+}
+
+// revoke sub-command revokes enrolments
+var enrolRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Stop trusting an enrolled host",
+	Long: `Revoke the enrolment of a host, given its name or certificate serial
+number (as shown by "wr enrol list").
+
+Clients on the host will no longer be able to use the manager, and its token
+will no longer work with the REST API or web interface, until it enrols again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if enrolRevoke == "" {
+			die("--host is required")
+		}
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer func() {
+			err := jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		revoked, err := jq.RevokeEnrolment(enrolRevoke)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Revoked %d enrolments", revoked)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(enrolCmd)
+	enrolCmd.AddCommand(enrolTokenCmd)
+	enrolCmd.AddCommand(enrolJoinCmd)
+	enrolCmd.AddCommand(enrolListCmd)
+	enrolCmd.AddCommand(enrolRevokeCmd)
+
+	// flags specific to these sub-commands
+	enrolTokenCmd.Flags().IntVar(&enrolTTL, "ttl", 3600, "how long (seconds) the token can be used for")
+	enrolJoinCmd.Flags().StringVarP(&enrolManager, "manager", "m", "", "host:port of the manager's web interface")
+	enrolJoinCmd.Flags().StringVarP(&enrolToken, "token", "t", "", "one-time token from 'wr enrol token'")
+	enrolJoinCmd.Flags().StringVarP(&enrolName, "name", "n", "", "name to enrol this host as (defaults to its host name)")
+	enrolRevokeCmd.Flags().StringVar(&enrolRevoke, "host", "", "name or certificate serial of the host to revoke")
+
+	enrolTokenCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	enrolListCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	enrolRevokeCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
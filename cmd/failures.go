@@ -0,0 +1,148 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var failuresRetry []int
+var failuresSummary bool
+
+// failuresCmd represents the failures command
+var failuresCmd = &cobra.Command{
+	Use:   "failures",
+	Short: "Analyse and retry buried commands",
+	Long: `You can see how your buried commands failed using this command.
+
+Commands that fail more times than their retries allow become "buried". This
+command groups all buried commands (or just those in the report group given to
+-i; combine with -z to treat it as a substring) in to numbered clusters of
+commands that failed in the same way: with the same failure reason and exit
+code, and with similar final lines of STDERR (after replacing paths, long hex
+strings and numbers, which typically differ between otherwise identical
+failures).
+
+Clusters whose STDERR is merely similar (eg. sharing most of their words) are
+also merged, and for long STDERR that got truncated, only the end is used.
+
+Clusters are listed largest first, showing an example command and the end of
+its STDERR. With --summary you instead get just one line per cluster, eg.
+"8214 jobs failed with: No space left on device", which is quicker when there
+are very many buried commands.
+
+Once you've fixed the cause of a failure, you can retry all the commands in
+particular clusters by giving their numbers to --retry, eg.
+"wr failures --retry 1 --retry 3". The numbers refer to the listing you get
+with the same -i and -z options, so check the listing again first if commands
+may have been buried since you last looked.
+
+If the manager was configured with managerburiedexport, the full details of
+each buried command can also be found in that directory for offline debugging.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cmdIDIsSubStr && cmdIDStatus == "" {
+			die("-z only makes sense in combination with -i")
+		}
+		if failuresSummary && len(failuresRetry) > 0 {
+			die("--summary and --retry are mutually exclusive")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		var clusters []*jobqueue.FailureCluster
+		if failuresSummary {
+			clusters, err = jq.GetFailureSummaries(cmdIDStatus, cmdIDIsSubStr)
+		} else {
+			clusters, err = jq.GetFailureClusters(cmdIDStatus, cmdIDIsSubStr)
+		}
+		if err != nil {
+			die("failed to get buried commands: %s", err)
+		}
+		if len(clusters) == 0 {
+			die("No buried commands found")
+		}
+
+		if failuresSummary {
+			for i, cluster := range clusters {
+				fmt.Printf("%d. %s\n", i+1, cluster.Summary)
+			}
+			return
+		}
+
+		if len(failuresRetry) == 0 {
+			for i, cluster := range clusters {
+				printFailureCluster(i+1, cluster)
+			}
+			return
+		}
+
+		var jes []*jobqueue.JobEssence
+		for _, num := range failuresRetry {
+			if num < 1 || num > len(clusters) {
+				die("there is no cluster %d; there are %d clusters", num, len(clusters))
+			}
+			for _, key := range clusters[num-1].Keys {
+				jes = append(jes, &jobqueue.JobEssence{JobKey: key})
+			}
+		}
+
+		kicked, err := jq.Kick(jes)
+		if err != nil {
+			die("failed to retry desired jobs: %s", err)
+		}
+		info("Initiated retry of %d buried commands (out of %d eligible)", kicked, len(jes))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(failuresCmd)
+
+	// flags specific to this sub-command
+	failuresCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to analyse")
+	failuresCmd.Flags().BoolVarP(&cmdIDIsSubStr, "search", "z", false, "treat -i as a substring to match against all report groups")
+	failuresCmd.Flags().BoolVar(&failuresSummary, "summary", false, "only print a one line summary of each cluster")
+	failuresCmd.Flags().IntSliceVar(&failuresRetry, "retry", nil, "number of a listed cluster whose commands you want to retry (can be repeated)")
+
+	failuresCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// printFailureCluster prints out the details of a FailureCluster for the user.
+func printFailureCluster(num int, cluster *jobqueue.FailureCluster) {
+	fmt.Printf("\n# Cluster %d: %d commands\n", num, cluster.Count)
+	fmt.Printf("Failed because: %s (exit code %d)\n", cluster.FailReason, cluster.Exitcode)
+	fmt.Printf("Report groups: %s\n", strings.Join(cluster.RepGroups, ", "))
+	fmt.Printf("Example command: %s\n", cluster.ExampleCmd)
+	if cluster.ExampleStdErr != "" {
+		fmt.Printf("Example end of StdErr:\n%s\n", cluster.ExampleStdErr)
+	}
+}
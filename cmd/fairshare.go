@@ -0,0 +1,88 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var fairShareMode string
+
+// fairShareCmd represents the fairshare command
+var fairShareCmd = &cobra.Command{
+	Use:   "fairshare",
+	Short: "View or change how capacity is shared between users",
+	Long: `View or change how the manager shares capacity between users.
+
+By default, commands are started in priority order, and then in the order they
+were added, so one user adding many commands can keep everyone else waiting.
+
+In "user" mode, when several users have commands ready to run, runners prefer
+to run the commands of whichever user has the fewest commands running, so that
+users take turns. "repgroup" mode does the same between report groups. Either
+way, a runner will still run anyone's commands rather than sit idle, and each
+command's priority still decides the order of each user's (or report group's)
+commands.
+
+Without --set, the current mode is displayed ("off" if capacity isn't being
+shared). With --set user, --set repgroup or --set off, the mode is changed
+immediately. The change lasts until the manager is next reloaded or restarted,
+at which point the managerfairshare config option (or the --fair_share option
+of 'wr manager start') applies again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		if fairShareMode != "" {
+			err = jq.SetFairShare(fairShareMode)
+			if err != nil {
+				die("%s", err)
+			}
+		}
+
+		mode, err := jq.GetFairShare()
+		if err != nil {
+			die("%s", err)
+		}
+		if mode == jobqueue.FairShareOff {
+			mode = "off"
+		}
+		fmt.Println(mode)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(fairShareCmd)
+
+	// flags specific to this sub-command
+	fairShareCmd.Flags().StringVar(&fairShareMode, "set", "", "['user','repgroup','off'] change the mode")
+	fairShareCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -0,0 +1,113 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var hostsExclude string
+var hostsInclude string
+var hostsStalled bool
+
+// hostsCmd represents the hosts command
+var hostsCmd = &cobra.Command{
+	Use:   "hosts",
+	Short: "Exclude hosts from running commands",
+	Long: `You can stop commands from running on particular hosts, such as
+faulty LSF execution hosts or cloud servers, using this command.
+
+Provide a comma separated list of host names (as reported by "wr status") to -x
+to exclude them. The manager will no longer count the capacity of excluded hosts
+when scheduling runners, runners on them will not start any more commands, and
+commands currently running on them will be killed and become ready to run again
+elsewhere, without counting against their retries.
+
+Provide a comma separated list of host names to -i to stop excluding them.
+
+With neither option, the currently excluded hosts are listed.
+
+With --stalled, the hosts whose runners reserved commands but failed to start
+them within the manager's managerrestimeout are instead listed, along with how
+many commands this happened to, and when and to which command it last
+happened. You might want to exclude such hosts.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		if hostsExclude != "" {
+			err = jq.ExcludeHosts(strings.Split(hostsExclude, ",")...)
+			if err != nil {
+				die(err.Error())
+			}
+		}
+
+		if hostsInclude != "" {
+			err = jq.IncludeHosts(strings.Split(hostsInclude, ",")...)
+			if err != nil {
+				die(err.Error())
+			}
+		}
+
+		if hostsStalled {
+			rts, errr := jq.GetReservationTimeouts()
+			if errr != nil {
+				die(errr.Error())
+			}
+			for _, rt := range rts {
+				host := rt.Host
+				if host == "" {
+					host = "(unknown)"
+				}
+				fmt.Printf("%s\t%d\t%s\t%s\n", host, rt.Count, rt.Last.Format(time.RFC3339), rt.LastKey)
+			}
+			return
+		}
+
+		hosts, err := jq.GetExcludedHosts()
+		if err != nil {
+			die(err.Error())
+		}
+		for _, host := range hosts {
+			fmt.Println(host)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(hostsCmd)
+
+	// flags specific to this sub-command
+	hostsCmd.Flags().StringVarP(&hostsExclude, "exclude", "x", "", "comma separated host names to exclude")
+	hostsCmd.Flags().StringVarP(&hostsInclude, "include", "i", "", "comma separated host names to stop excluding")
+	hostsCmd.Flags().BoolVarP(&hostsStalled, "stalled", "s", false, "list hosts that failed to start reserved commands in time")
+	hostsCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -0,0 +1,279 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/spf13/cobra"
+)
+
+const (
+	interactiveRepGroup     = "wr_interactive"
+	interactivePollInterval = 1 * time.Second
+	interactiveEndTimeout   = 2 * time.Minute
+)
+
+// options for this cmd
+var interactiveMem string
+var interactiveTime string
+var interactiveCPUs float64
+var interactiveDisk int
+var interactivePriority int
+var interactiveLogin string
+
+// interactiveCmd represents the interactive command
+var interactiveCmd = &cobra.Command{
+	Use:   "interactive",
+	Short: "Get a shell with resources allocated by the scheduler",
+	Long: `Get an interactive shell on a host with resources allocated to you by
+the scheduler, like "salloc" or "bsub -Is", but for whatever scheduler the
+manager is using.
+
+A placeholder command is added that reserves the memory (-m), cpus (-c), disk
+(--disk) and time (-t) you ask for. Once the scheduler starts running it, you
+are given a shell on the host it is running on: your $SHELL if that is the host
+you're on, otherwise via the --login command (ssh by default; for cloud
+deployments you will need to specify the key and username to use, eg.
+--login "ssh -t -i ~/.wr_production/cloud_resources.openstack.key -l ubuntu").
+
+The resources stay allocated to you until you exit the shell, at which point
+the placeholder command is killed and removed. If you don't exit before the -t
+time is up, the placeholder command ends and the resources are released,
+though your shell will continue.
+
+While waiting for the resources, you can see the placeholder command (and why
+it isn't running yet) with "wr status -i wr_interactive", and you can give up
+waiting with ctrl-c.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		mb, err := bytefmt.ToMegabytes(interactiveMem)
+		if err != nil {
+			die("--memory was not specified correctly: %s", err)
+		}
+		dur, err := time.ParseDuration(interactiveTime)
+		if err != nil {
+			die("--time was not specified correctly: %s", err)
+		}
+		if interactiveCPUs < 0 {
+			die("--cpus can't be negative")
+		}
+		if interactivePriority < 0 || interactivePriority > 255 {
+			die("--priority must be in the range 0..255")
+		}
+		login := strings.Fields(interactiveLogin)
+		if len(login) == 0 {
+			die("--login must be specified")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		key := interactiveAdd(jq, int(mb), dur)
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+
+		job := interactiveWait(jq, key, sigs)
+		if job == nil {
+			interactiveEnd(jq, key)
+			die("gave up waiting for resources")
+		}
+
+		// ignore ctrl-c while the user is in their shell; it's for them
+		signal.Ignore(os.Interrupt)
+		err = interactiveShell(job, login)
+		interactiveEnd(jq, key)
+		if err != nil {
+			die("%s", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(interactiveCmd)
+
+	// flags specific to this sub-command
+	interactiveCmd.Flags().StringVarP(&interactiveMem, "memory", "m", "1G", "memory to reserve [specify units such as M for Megabytes or G for Gigabytes]")
+	interactiveCmd.Flags().Float64VarP(&interactiveCPUs, "cpus", "c", 1, "cpu cores to reserve")
+	interactiveCmd.Flags().StringVarP(&interactiveTime, "time", "t", "8h", "maximum time to hold the resources for [specify units such as m for minutes or h for hours]")
+	interactiveCmd.Flags().IntVar(&interactiveDisk, "disk", 0, "number of GB of disk space to reserve")
+	interactiveCmd.Flags().IntVarP(&interactivePriority, "priority", "p", 0, "[0-255] priority of getting the resources compared to other commands")
+	interactiveCmd.Flags().StringVar(&interactiveLogin, "login", "ssh -t", "command to get a shell on a remote host, which will be given the host as its final argument")
+	interactiveCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// interactiveAdd adds the placeholder job that holds the resources for an
+// interactive session, returning its key.
+func interactiveAdd(jq *jobqueue.Client, mb int, dur time.Duration) string {
+	// the placeholder ends by itself when its time is up, and has a unique
+	// command line so that simultaneous sessions don't clash
+	job := &jobqueue.Job{
+		Cmd:        fmt.Sprintf("sleep %d # wr interactive session for %s started %d", int(dur.Seconds()), realUsername(), time.Now().UnixNano()),
+		Cwd:        os.TempDir(),
+		CwdMatters: true,
+		ReqGroup:   interactiveRepGroup,
+		RepGroup:   interactiveRepGroup,
+		Requirements: &jqs.Requirements{
+			RAM:   mb,
+			Time:  dur,
+			Cores: interactiveCPUs,
+			Disk:  interactiveDisk,
+		},
+		Override: 2,
+		Priority: uint8(interactivePriority),
+		Retries:  0,
+	}
+
+	ids, err := jq.AddAndReturnIDs([]*jobqueue.Job{job}, os.Environ(), true)
+	if err != nil {
+		die("failed to add the placeholder command: %s", err)
+	}
+	if len(ids) != 1 {
+		die("failed to add the placeholder command")
+	}
+	return ids[0]
+}
+
+// interactiveWait waits for the placeholder job with the given key to start
+// running and returns it, or returns nil if we were signalled while waiting.
+// Dies if the job fails to start.
+func interactiveWait(jq *jobqueue.Client, key string, sigs chan os.Signal) *jobqueue.Job {
+	ticker := time.NewTicker(interactivePollInterval)
+	defer ticker.Stop()
+	informed := false
+	for {
+		select {
+		case <-ticker.C:
+			job, err := jq.GetByEssence(&jobqueue.JobEssence{JobKey: key}, false, false)
+			if err != nil {
+				warn("failed to get the status of the placeholder command: %s", err)
+				continue
+			}
+			if job == nil {
+				die("the placeholder command was removed")
+			}
+
+			switch job.State {
+			case jobqueue.JobStateRunning:
+				return job
+			case jobqueue.JobStateBuried, jobqueue.JobStateComplete:
+				interactiveEnd(jq, key)
+				die("the placeholder command stopped running before you got your shell (%s)", job.FailReason)
+			}
+
+			if !informed {
+				info("waiting for resources; see `wr status -i %s` for details", interactiveRepGroup)
+				informed = true
+			}
+		case <-sigs:
+			return nil
+		}
+	}
+}
+
+// interactiveShell gives the user a shell on the host the given job is running
+// on, returning once they exit it.
+func interactiveShell(job *jobqueue.Job, login []string) error {
+	var args []string
+	host, err := os.Hostname()
+	if err != nil || host != job.Host {
+		addr := job.Host
+		if job.HostIP != "" {
+			addr = job.HostIP
+		}
+		info("resources allocated on %s", job.Host)
+		args = append(login, addr)
+	} else {
+		info("resources allocated on this host")
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = config.RunnerExecShell
+		}
+		args = []string{shell}
+	}
+
+	sh := exec.Command(args[0], args[1:]...) // #nosec our purpose is to run the user's shell
+	sh.Stdin = os.Stdin
+	sh.Stdout = os.Stdout
+	sh.Stderr = os.Stderr
+	sh.Env = append(os.Environ(), "WR_INTERACTIVE_JOB="+job.Key())
+	err = sh.Run()
+	if _, isExit := err.(*exec.ExitError); isExit {
+		// the user's last command failing is not our problem
+		return nil
+	}
+	return err
+}
+
+// interactiveEnd releases the resources held by the placeholder job with the
+// given key, by killing it if necessary and then removing it.
+func interactiveEnd(jq *jobqueue.Client, key string) {
+	jes := []*jobqueue.JobEssence{{JobKey: key}}
+	deadline := time.Now().Add(interactiveEndTimeout)
+	for {
+		job, err := jq.GetByEssence(jes[0], false, false)
+		if err != nil {
+			warn("failed to get the status of the placeholder command: %s", err)
+			return
+		}
+		if job == nil || job.State == jobqueue.JobStateComplete {
+			return
+		}
+
+		switch job.State {
+		case jobqueue.JobStateRunning, jobqueue.JobStateLost:
+			// killing happens the next time the runner touches the job, after
+			// which it will be buried and we can remove it
+			_, err = jq.Kill(jes)
+		default:
+			var removed int
+			removed, err = jq.Delete(jes)
+			if err == nil && removed == 1 {
+				info("resources released")
+				return
+			}
+		}
+		if err != nil {
+			warn("failed to end the placeholder command: %s", err)
+			return
+		}
+
+		if time.Now().After(deadline) {
+			warn("gave up waiting for the placeholder command to end; remove it with `wr kill -i %s -y` and `wr remove -i %s -y`", key, key)
+			return
+		}
+		<-time.After(interactivePollInterval)
+	}
+}
@@ -47,7 +47,12 @@ option is specified, only "lost contact" jobs will be affected.
 you want to now kill. Combining with -z lets you kill jobs in multiple report
 groups, assuming you have arranged that related groups share some substring.
 Alternatively -y lets you specify -i as the internal job id reported during
-"wr status".
+"wr status", or as the name you gave the job when adding it.
+
+--match glob or --match regex instead treats -i as a glob pattern (eg.
+"myproj.*.align") or regular expression (eg. "^myproj\.\d+\.align$") that
+report groups must match, letting you work with any set of related groups at
+once.
 
 The file to provide -f is in the format taken by "wr add".
 
@@ -102,7 +107,8 @@ func init() {
 	killCmd.Flags().StringVarP(&cmdFileStatus, "file", "f", "", "file containing commands you want to kill; - means read from STDIN")
 	killCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to kill")
 	killCmd.Flags().BoolVarP(&cmdIDIsSubStr, "search", "z", false, "treat -i as a substring to match against all report groups")
-	killCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id")
+	killCmd.Flags().StringVar(&cmdIDMatch, "match", "", "['glob','regex'] treat -i as a pattern to match against all report groups")
+	killCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id or job name")
 	killCmd.Flags().StringVarP(&cmdLine, "cmdline", "l", "", "a command line you want to kill")
 	killCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "working dir that the command(s) specified by -l or -f were set to run in")
 	killCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mounts that the command(s) specified by -l or -f were set to use (JSON format)")
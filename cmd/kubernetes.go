@@ -333,7 +333,7 @@ pointed to by the $KUBECONFIG variable, else ~/.kube/config.`,
 				warn("failed to remove temporary config file: %s", errr)
 			}
 		}()
-		_, errt = tmpConfigFile.Write([]byte(fmt.Sprintf("managerport: \"%d\"\nmanagerweb: \"%d\"\nmanagerdbbkfile: \"%s\"\n", mp, wp, config.ManagerDbBkFile)))
+		_, errt = tmpConfigFile.Write([]byte(fmt.Sprintf("managerport: \"%d\"\nmanagerweb: \"%d\"\nmanagerdbbkfile: \"%s\"\nmanagerdbbksnapshot: %d\n", mp, wp, config.ManagerDbBkFile, config.ManagerDbBkSnapshot)))
 		if errt != nil {
 			die("failed to write to temporary config file: %s", errt)
 		}
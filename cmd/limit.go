@@ -45,13 +45,21 @@ same time. This limit command can be used to change the limit afterwards.
 
 Passing just a group name to -g will display the current limit of that limit
 group. Groups that are not known about will report -1. Limit group names should
-not contain commas or colons.
+not contain commas, colons or asterisks.
 
 Suffixing the name with :n, where n is an integer, will set the group's limit to
 that number.
 
 Setting a limit of 0 stops any more jobs in that group from running. Setting a
-limit of -1 makes that group unlimited.`,
+limit of -1 makes that group unlimited.
+
+A limit can also be thought of as a pool of consumable tokens, such as software
+licences or database connections. Jobs added with a group suffixed with *n (eg.
+"gatk*2") use n of that group's tokens each, so with a limit of 20 at most 10 of
+those jobs would run at once. Changing the limit here takes effect immediately.
+
+The limits of all limit groups, and how much of each is in use, can also be
+viewed and changed on the status web page.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if limitGroup == "" {
 			die("--group required")
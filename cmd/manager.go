@@ -21,9 +21,11 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -33,6 +35,7 @@ import (
 
 	sync "github.com/sasha-s/go-deadlock"
 
+	"code.cloudfoundry.org/bytefmt"
 	"github.com/VertebrateResequencing/wr/cloud"
 	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/VertebrateResequencing/wr/jobqueue"
@@ -53,6 +56,7 @@ var localUsername string
 var backupPath string
 var managerTimeoutSeconds int
 var managerDebug bool
+var managerFairShare string
 var maxServers int
 var maxLocalCores int
 var maxLocalRAM int
@@ -60,6 +64,9 @@ var cloudNoSecurityGroups bool
 var cloudUseConfigDrive bool
 var useCertDomain bool
 var runnerDebug bool
+var drainUntil string
+var drainStart string
+var restoreAt string
 
 const kubernetes = "kubernetes"
 const deadlockTimeout = 5 * time.Minute
@@ -113,6 +120,11 @@ deploy -h' for the details of which environment variables you need to use the
 OpenStack scheduler. That help also explains some of the --cloud* options in
 further detail.
 
+The gcp and aws schedulers work in the same way as the openstack one, but on
+Google Cloud Platform and Amazon Web Services respectively; use 'wr cloud
+deploy -p gcp' or 'wr cloud deploy -p aws' (see its help for the environment
+variables they need).
+
 Similarly, If using the Kubernetes scheduler you must already be running in a
 pod. Be sure to pass a namespace for wr to use that will not have another wr
 user attempting to use it.
@@ -130,7 +142,27 @@ you've created yourself, note that --local_username will need to be globally
 unique, since it is used to name the private key that will be created in
 OpenStack, and if a key with that name already exists, the manager will not be
 able to create a new one (or get the existing one), and so will not function
-fully.`,
+fully.
+
+To run the manager as a systemd service, use --foreground in a Type=notify unit.
+The manager will tell systemd when it is ready to accept commands and when it
+is stopping, and if you set WatchdogSec it will ping systemd's watchdog so that
+a hung manager gets restarted. Stopping the unit (which sends SIGTERM) saves the
+manager's state as with 'wr manager stop'. You can also use socket activation
+by giving the unit a .socket unit that listens on the manager and web interface
+ports (ListenStream=[port] for each); the manager will then serve on those
+sockets instead of opening the ports itself. Sending the manager a SIGHUP (eg.
+with ExecReload=/bin/kill -HUP $MAINPID) makes it reload its config, as with
+'wr manager reload'.
+
+To upgrade wr without stopping your running commands, replace the wr executable
+and then use 'wr manager handover'.
+
+For high availability, you can start a second manager on another machine as the
+standby of the first by setting managerstandbyof in its config (see
+managerstandbyof, managertakeovercmd and managerserviceaddr in the example
+config file). It copies the first manager's database, and if the first manager
+stops responding, it takes over, carrying on with the first manager's commands.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// first we need our working directory to exist
 		createWorkingDir()
@@ -138,9 +170,12 @@ fully.`,
 		// check to see if the manager is already running (regardless of the
 		// state of the pid file), giving us a meaningful error message in the
 		// most obvious case of failure to start
-		jq := connect(1*time.Second, true)
-		if jq != nil {
-			die("wr manager on port %s is already running (pid %d)", config.ManagerPort, jq.ServerInfo.PID)
+		// (unless it is handing over to us)
+		if !jobqueue.IsHandover() {
+			jq := connect(1*time.Second, true)
+			if jq != nil {
+				die("wr manager on port %s is already running (pid %d)", config.ManagerPort, jq.ServerInfo.PID)
+			}
 		}
 
 		var postCreation []byte
@@ -199,6 +234,11 @@ fully.`,
 				// parent; wait a while for our child to bring up the manager
 				// before exiting
 				mTimeout := time.Duration(managerTimeoutSeconds) * time.Second
+				if config.ManagerStandbyOf != "" {
+					// it won't be connectable until its primary fails
+					info("wr manager is standing by for %s, and will serve on port %s if that fails", config.ManagerStandbyOf, config.ManagerPort)
+					return
+				}
 				internal.WaitForFile(config.ManagerTokenFile, preStart, mTimeout)
 				jq := connect(mTimeout, true)
 				if jq == nil {
@@ -338,8 +378,25 @@ completes.
 NB: if using 'wr cloud deploy --deployment production', do not use drain without
 also configuring an S3 location for your database backup, as otherwise any
 changes to the database between calling drain and the manager finally shutting
-down will be lost.`,
+down will be lost.
+
+Alternatively, to drain ahead of cluster maintenance without stopping the
+manager, supply --until with the time the maintenance will be over. Jobs that
+are not expected (going by their --time) to complete before --start (default
+now) will not be started, no jobs will start between --start and --until, and
+normal operation resumes automatically afterwards. Times can be given as
+durations from now (eg. 2h30m), clock times today or tomorrow (eg. 18:00),
+"2006-01-02 15:04" style dates, or RFC 3339 timestamps. Use "resume" to cancel
+the maintenance early.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if drainUntil != "" {
+			drainForMaintenance()
+			return
+		}
+		if drainStart != "" {
+			die("--start can only be used with --until")
+		}
+
 		// first try and connect
 		jq := connect(5*time.Second, true)
 		if jq == nil {
@@ -372,6 +429,68 @@ down will be lost.`,
 	},
 }
 
+// drainForMaintenance is used by the drain command when --until is supplied,
+// to drain the manager ahead of maintenance without stopping it.
+func drainForMaintenance() {
+	now := time.Now()
+	until, err := parseMaintenanceTime(drainUntil, now)
+	if err != nil {
+		die("bad --until: %s", err)
+	}
+	var start time.Time
+	if drainStart != "" {
+		start, err = parseMaintenanceTime(drainStart, now)
+		if err != nil {
+			die("bad --start: %s", err)
+		}
+	}
+
+	jq := connect(5*time.Second, true)
+	if jq == nil {
+		die("could not connect to the manager on port %s, so could not initiate a drain", config.ManagerPort)
+	}
+
+	numLeft, etc, err := jq.DrainServerUntil(start, until)
+	if err != nil {
+		die("even though I was able to connect to the manager, it failed to drain for maintenance: %s", err)
+	}
+
+	from := "now"
+	if !start.IsZero() {
+		from = start.Format(time.RFC1123)
+	}
+	info("wr manager running on port %s is draining for maintenance from %s until %s; there are %d jobs still running, and they should complete in less than %s", config.ManagerPort, from, until.Format(time.RFC1123), numLeft, etc)
+
+	err = jq.Disconnect()
+	if err != nil {
+		warn("disconnecting from the server failed: %s", err)
+	}
+}
+
+// parseMaintenanceTime parses the --start and --until options of drain, which
+// can be a duration from now, a clock time (today, or tomorrow if that time has
+// passed), a date and time, or an RFC 3339 timestamp.
+func parseMaintenanceTime(spec string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(spec); err == nil {
+		return now.Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", spec, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("15:04", spec, time.Local); err == nil {
+		y, m, d := now.Date()
+		t = time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, time.Local)
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("[%s] is not a duration, clock time, date or timestamp", spec)
+}
+
 // pause sub-command makes the server stop spawning new runners and stops it
 // letting existing runners reserve jobs. It's like drain, but you can resume.
 var managerPauseCmd = &cobra.Command{
@@ -421,7 +540,8 @@ var managerResumeCmd = &cobra.Command{
 	Long: `Resume starts running queued jobs following a pause.
 
 If you have used the "pause" command, running this will resume normal operation
-of the manager.`,
+of the manager. If you have used "drain --until" and have not paused, this
+cancels the maintenance.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// first try and connect
 		jq := connect(5*time.Second, true)
@@ -444,6 +564,115 @@ of the manager.`,
 	},
 }
 
+// reload sub-command makes the server re-read the config files and apply the
+// settings that can be changed while it is running.
+var managerReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the workflow manager's config",
+	Long: `Make the workflow manager re-read its config files.
+
+After editing your config file(s), run this to have the running manager pick
+up your changes to those settings that can be changed without a restart (see
+the managerloglevel section of the example wr_config.yml for a list). The settings
+that changed are listed, along with any changed settings that will only take
+effect after the manager is restarted.
+
+If the new config is not valid, nothing is changed; see the manager's log for
+the reason.
+
+(The manager also reloads its config when it receives a SIGHUP.)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(5*time.Second, true)
+		if jq == nil {
+			die("could not connect to the manager on port %s, so could not reload its config", config.ManagerPort)
+		}
+
+		report, err := jq.ReloadServerConfig()
+		if err != nil {
+			die("even though I was able to connect to the manager, it failed to reload its config: %s", err)
+		}
+
+		if len(report.Changed) == 0 {
+			info("wr manager running on port %s reloaded its config; nothing that can be changed while running was changed", config.ManagerPort)
+		} else {
+			info("wr manager running on port %s reloaded its config; these settings were changed: %s", config.ManagerPort, strings.Join(report.Changed, ", "))
+		}
+		if len(report.RestartRequired) > 0 {
+			warn("these changed settings will only take effect after the manager is restarted: %s", strings.Join(report.RestartRequired, ", "))
+		}
+
+		err = jq.Disconnect()
+		if err != nil {
+			warn("disconnecting from the server failed: %s", err)
+		}
+	},
+}
+
+// handover sub-command makes the server hand over to a new manager process
+var managerHandoverCmd = &cobra.Command{
+	Use:   "handover",
+	Short: "Restart the workflow manager without stopping running commands",
+	Long: `Make the workflow manager hand over to a new manager process.
+
+This is intended for upgrading wr: replace the wr executable with the new
+version, then run this. The running manager starts a new manager using the
+current executable and the same options it was started with, passes it its
+listening ports, and then stops without killing the runners of your running
+commands. The new manager loads the database, takes over the running commands
+and starts accepting commands on the same ports, so clients and runners only see
+a brief pause.
+
+This waits until the new manager is answering on port, and tells you its pid.
+If the new manager fails to start, the running commands will continue to run,
+and you can start the manager again as normal to take them over.
+
+(This is not for managers run as systemd services; use 'systemctl restart'
+instead.)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(5*time.Second, true)
+		if jq == nil {
+			die("could not connect to the manager on port %s, so could not hand it over", config.ManagerPort)
+		}
+		oldPID := jq.ServerInfo.PID
+
+		err := jq.HandoverServer()
+		if err != nil {
+			die("even though I was able to connect to the manager, it failed to hand over: %s", err)
+		}
+		err = jq.Disconnect()
+		if err != nil {
+			warn("disconnecting from the server failed: %s", err)
+		}
+
+		info("wr manager running on port %s (pid %d) is handing over to a new manager...", config.ManagerPort, oldPID)
+
+		mTimeout := time.Duration(managerTimeoutSeconds) * time.Second
+		limit := time.After(mTimeout)
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				jq = connect(1*time.Second, true)
+				if jq == nil {
+					continue
+				}
+				newPID := jq.ServerInfo.PID
+				errd := jq.Disconnect()
+				if errd != nil {
+					warn("disconnecting from the server failed: %s", errd)
+				}
+				if newPID != oldPID {
+					info("wr manager on port %s has been handed over to pid %d", config.ManagerPort, newPID)
+					return
+				}
+			case <-limit:
+				die("wr manager on port %s was not handed over to a new manager after %ds; check the log file %s", config.ManagerPort, managerTimeoutSeconds, config.ManagerLogFile)
+			}
+		}
+	},
+}
+
 // status sub-command tells if the manger is up or down
 var managerStatusCmd = &cobra.Command{
 	Use:   "status",
@@ -508,6 +737,76 @@ somewhere.)`,
 	},
 }
 
+// restore sub-command recreates the database from incremental backups.
+var managerRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore wr's database to a point in time",
+	Long: `Restore wr's job database to how it was at a point in time.
+
+If managerdbbksnapshot is set in your config, the manager backs up its database
+incrementally, keeping snapshots and a log of every change made since the oldest
+of them. After corruption or a mistake (eg. removing the wrong jobs), you can
+use this command to recreate the database as it was at any time since the oldest
+snapshot.
+
+The manager must be stopped first. Specify the time with --at as a duration ago
+(eg. 30m), a clock time earlier today (eg. 14:05, or yesterday if that is later
+than now), a date and time (eg. "2020-06-01 14:05") or an RFC3339 timestamp.
+
+The current database file is replaced, and the backups used are set aside, with
+a new snapshot of the restored database becoming the start of its history. The
+next time you start the manager it will use the restored database.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if restoreAt == "" {
+			die("--at is required")
+		}
+		if config.ManagerDbURL != "" {
+			die("the database is stored at managerdburl, which you must restore yourself")
+		}
+		at, err := parseRestoreTime(restoreAt, time.Now())
+		if err != nil {
+			die("%s", err)
+		}
+
+		if _, errp := daemon.ReadPidFile(config.ManagerPidFile); errp == nil {
+			die("wr manager seems to be running (pid file %s exists); stop it first", config.ManagerPidFile)
+		}
+		if jq := connect(1*time.Second, true); jq != nil {
+			die("wr manager is running on port %s; stop it first", config.ManagerPort)
+		}
+
+		msg, err := jobqueue.RestoreDB(config.ManagerDbFile, config.ManagerDbBkFile, config.Deployment, at, appLogger)
+		if err != nil {
+			die("failed to restore the database: %s", err)
+		}
+		info(msg)
+	},
+}
+
+// parseRestoreTime parses the --at option of the restore sub-command, which is
+// like parseMaintenanceTime() but for times in the past: a duration means that
+// long ago, and a clock time means the most recent time it was that time.
+func parseRestoreTime(spec string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(spec); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", spec, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("15:04", spec, time.Local); err == nil {
+		y, m, d := now.Date()
+		t = time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, time.Local)
+		if t.After(now) {
+			t = t.AddDate(0, 0, -1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("[%s] is not a duration, clock time, date or timestamp", spec)
+}
+
 // reportLiveStatus is used by the status command on a working connection to
 // distinguish between the server being in a normal 'started' state or the
 // 'drain' state.
@@ -527,13 +826,18 @@ func init() {
 	managerCmd.AddCommand(managerResumeCmd)
 	managerCmd.AddCommand(managerDrainCmd)
 	managerCmd.AddCommand(managerStopCmd)
+	managerCmd.AddCommand(managerReloadCmd)
+	managerCmd.AddCommand(managerHandoverCmd)
 	managerCmd.AddCommand(managerStatusCmd)
 	managerCmd.AddCommand(managerBackupCmd)
+	managerCmd.AddCommand(managerRestoreCmd)
 
 	// flags specific to these sub-commands
 	defaultConfig := internal.DefaultConfig(appLogger)
+	managerDrainCmd.Flags().StringVar(&drainUntil, "until", "", "drain for maintenance until this time, instead of stopping")
+	managerDrainCmd.Flags().StringVar(&drainStart, "start", "", "with --until, when the maintenance starts (default now)")
 	managerStartCmd.Flags().BoolVarP(&foreground, "foreground", "f", false, "do not daemonize")
-	managerStartCmd.Flags().StringVarP(&scheduler, "scheduler", "s", defaultConfig.ManagerScheduler, "['local','lsf','openstack'] job scheduler")
+	managerStartCmd.Flags().StringVarP(&scheduler, "scheduler", "s", defaultConfig.ManagerScheduler, "['local','lsf','openstack','gcp','aws'] job scheduler")
 	managerStartCmd.Flags().IntVarP(&managerTimeoutSeconds, "timeout", "t", 10, "how long to wait in seconds for the manager to start up")
 	managerStartCmd.Flags().IntVar(&maxLocalCores, "max_cores", runtime.NumCPU(), "maximum number of local cores to use to run cmds; -1 means unlimited")
 	managerStartCmd.Flags().IntVar(&maxLocalRAM, "max_ram", defaultMaxRAM, "maximum MB of local memory to use to run cmds; -1 means unlimited")
@@ -558,9 +862,11 @@ func init() {
 	managerStartCmd.Flags().BoolVar(&setDomainIP, "set_domain_ip", defaultConfig.ManagerSetDomainIP, "on success, use infoblox to set your domain's IP")
 	managerStartCmd.Flags().BoolVar(&useCertDomain, "use_cert_domain", false, "if cert domain is configured, provide it to spawned clients instead of our IP address")
 	managerStartCmd.Flags().BoolVar(&managerDebug, "debug", false, "include extra debugging information in the logs")
+	managerStartCmd.Flags().StringVar(&managerFairShare, "fair_share", "", "['user','repgroup','off'] share capacity fairly between users or report groups (overrides managerfairshare)")
 	managerStartCmd.Flags().BoolVar(&runnerDebug, "runner_debug", false, "have runners log to syslog on their machines")
 
 	managerBackupCmd.Flags().StringVarP(&backupPath, "path", "p", "", "backup file path")
+	managerRestoreCmd.Flags().StringVar(&restoreAt, "at", "", "restore the database to how it was at this time")
 }
 
 func logStarted(s *jobqueue.ServerInfo, token []byte) {
@@ -570,6 +876,12 @@ func logStarted(s *jobqueue.ServerInfo, token []byte) {
 	// server logging)
 	appLogger.SetHandler(log15.LvlFilterHandler(log15.LvlInfo, log15.StderrHandler))
 	info("wr's web interface can be reached at https://%s:%s/?token=%s", s.Host, s.WebPort, string(token))
+	if s.PublicPort != "" {
+		info("wr's public status view can be reached at https://%s:%s/", s.Host, s.PublicPort)
+	}
+	if s.GRPCPort != "" {
+		info("wr's gRPC interface can be reached at %s:%s", s.Host, s.GRPCPort)
+	}
 
 	if setDomainIP {
 		ip, err := internal.CurrentIP("")
@@ -602,12 +914,9 @@ func startJQ(postCreation []byte) {
 	} else {
 		l15h.AddHandler(appLogger, fh)
 
-		// have the server logger output to file, levelled with caller info
-		logLevel := log15.LvlWarn
-		if managerDebug {
-			logLevel = log15.LvlDebug
-		}
-		serverLogger.SetHandler(log15.LvlFilterHandler(logLevel, l15h.CallerInfoHandler(fh)))
+		// have the server logger output to file with caller info; the server
+		// filters by our configured log level itself
+		serverLogger.SetHandler(l15h.CallerInfoHandler(fh))
 	}
 
 	// we will spawn runners, which means we need to know the path to ourselves
@@ -617,6 +926,16 @@ func startJQ(postCreation []byte) {
 		die("wr manager failed to start : %s\n", err)
 	}
 
+	packing, err := jqs.ParsePackingStrategy(config.ManagerPacking)
+	if err != nil {
+		die("wr manager failed to start : managerpacking: %s\n", err)
+	}
+
+	scaleDown, err := cloudScaleDownPolicy(config)
+	if err != nil {
+		die("wr manager failed to start : %s\n", err)
+	}
+
 	var schedulerConfig interface{}
 	serverCIDR := ""
 	switch scheduler {
@@ -625,10 +944,11 @@ func startJQ(postCreation []byte) {
 			Shell:    config.RunnerExecShell,
 			MaxCores: maxLocalCores,
 			MaxRAM:   maxLocalRAM,
+			Packing:  packing,
 		}
 	case "lsf":
 		schedulerConfig = &jqs.ConfigLSF{Deployment: config.Deployment, Shell: config.RunnerExecShell}
-	case "openstack":
+	case "openstack", "gcp", "aws":
 		mport, errf := strconv.Atoi(config.ManagerPort)
 		if errf != nil {
 			die("wr manager failed to start : %s\n", errf)
@@ -640,8 +960,9 @@ func startJQ(postCreation []byte) {
 		}
 
 		schedulerConfig = &jqs.ConfigOpenStack{
+			Provider:             scheduler,
 			ResourceName:         cloudResourceName(localUsername),
-			SavePath:             filepath.Join(config.ManagerDir, "cloud_resources.openstack"),
+			SavePath:             filepath.Join(config.ManagerDir, "cloud_resources."+scheduler),
 			ServerPorts:          serverPorts,
 			UseConfigDrive:       cloudUseConfigDrive,
 			OSPrefix:             osPrefix,
@@ -661,6 +982,10 @@ func startJQ(postCreation []byte) {
 			Shell:                config.RunnerExecShell,
 			CIDR:                 cloudCIDR,
 			Umask:                config.ManagerUmask,
+			RunnerExeDir:         config.CloudRunnerDir,
+			RunnerExeURL:         cloudRunnerURL(),
+			Packing:              packing,
+			ScaleDown:            scaleDown,
 		}
 		serverCIDR = cloudCIDR
 	case kubernetes:
@@ -686,6 +1011,13 @@ func startJQ(postCreation []byte) {
 		cloudConfig.AddConfigFile(config.ManagerTokenFile + ":~/.wr_" + config.Deployment + "/client.token")
 		if config.ManagerCAFile != "" {
 			cloudConfig.AddConfigFile(config.ManagerCAFile + ":~/.wr_" + config.Deployment + "/ca.pem")
+
+			// and our own enrolment, so the servers' runners are trusted
+			if config.ManagerEnrolment {
+				dir := filepath.Dir(config.ManagerCAFile)
+				cloudConfig.AddConfigFile(filepath.Join(dir, jobqueue.EnrolCertFile) + ":~/.wr_" + config.Deployment + "/" + jobqueue.EnrolCertFile)
+				cloudConfig.AddConfigFile(filepath.Join(dir, jobqueue.EnrolKeyFile) + ":~/.wr_" + config.Deployment + "/" + jobqueue.EnrolKeyFile)
+			}
 		}
 
 		if scheduler != kubernetes {
@@ -721,26 +1053,54 @@ func startJQ(postCreation []byte) {
 	waitgroup.Opts.Disable = true
 
 	// start the jobqueue server
-	server, msg, token, err := jobqueue.Serve(jobqueue.ServerConfig{
-		Port:            config.ManagerPort,
-		WebPort:         config.ManagerWeb,
+	base := jobqueue.ServerConfig{
 		SchedulerName:   scheduler,
 		SchedulerConfig: schedulerConfig,
 		RunnerCmd:       runnerCmd,
-		DBFile:          config.ManagerDbFile,
-		DBFileBackup:    config.ManagerDbBkFile,
-		TokenFile:       config.ManagerTokenFile,
-		UploadDir:       config.ManagerUploadDir,
-		CAFile:          config.ManagerCAFile,
-		CertFile:        config.ManagerCertFile,
-		KeyFile:         config.ManagerKeyFile,
-		CertDomain:      config.ManagerCertDomain,
 		DomainMatchesIP: useCertDomain,
 		AutoConfirmDead: time.Duration(cloudServersAutoConfirmDead) * time.Minute,
-		Deployment:      config.Deployment,
 		CIDR:            serverCIDR,
 		Logger:          serverLogger,
-	})
+	}
+	if config.ManagerRunnerUpdate {
+		base.RunnerUpdateExe = exe
+		base.RunnerUpdateExeDir = config.CloudRunnerDir
+		base.RunnerUpdateExeURL = cloudRunnerURL()
+	}
+	serverConfig, err := managerServerConfig(config, base)
+	if err != nil {
+		die("wr manager failed to start : %s", err)
+	}
+	deployment := config.Deployment
+	serverConfig.Reload = func() (jobqueue.ServerConfig, error) {
+		c, errr := internal.ConfigReload(deployment, false, appLogger)
+		if errr != nil {
+			return jobqueue.ServerConfig{}, errr
+		}
+		return managerServerConfig(c, base)
+	}
+
+	serverConfig.Handover = func() *exec.Cmd {
+		hoCmd := exec.Command(exe, append(os.Args[1:], "--foreground")...) // #nosec we're re-running ourselves
+		for _, env := range os.Environ() {
+			if !strings.HasPrefix(env, daemon.MARK_NAME+"=") {
+				hoCmd.Env = append(hoCmd.Env, env)
+			}
+		}
+		hoCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		return hoCmd
+	}
+
+	// if we're taking over from a daemonized manager, we'll also need to take
+	// over its pid file once it has exited
+	handingOverPID := 0
+	if jobqueue.IsHandover() {
+		if pid, errp := daemon.ReadPidFile(config.ManagerPidFile); errp == nil && pid == os.Getppid() {
+			handingOverPID = pid
+		}
+	}
+
+	server, msg, token, err := jobqueue.Serve(serverConfig)
 
 	if msg != "" {
 		info("wr manager : %s", msg)
@@ -753,6 +1113,23 @@ func startJQ(postCreation []byte) {
 	logStarted(server.ServerInfo, token)
 	l15h.AddHandler(appLogger, fh) // logStarted disabled logging to file; reenable to get final message below
 
+	if handingOverPID != 0 {
+		pidFile := make(chan *daemon.LockFile, 1)
+		go takeOverPidFile(handingOverPID, pidFile)
+		defer func() {
+			select {
+			case lf := <-pidFile:
+				if lf != nil {
+					errr := lf.Remove()
+					if errr != nil {
+						warn("failed to remove pid file: %s", errr)
+					}
+				}
+			default:
+			}
+		}()
+	}
+
 	// block forever while the jobqueue does its work
 	err = server.Block()
 	if err != nil {
@@ -765,12 +1142,213 @@ func startJQ(postCreation []byte) {
 			info("wr manager on %s gracefully stopped (received SIGINT)", saddr)
 		case ok && jqerr.Err == jobqueue.ErrClosedStop:
 			info("wr manager on %s gracefully stopped (following a drain)", saddr)
+		case ok && jqerr.Err == jobqueue.ErrClosedHandover:
+			info("wr manager on %s handed over to a new manager", saddr)
 		default:
 			warn("wr manager on %s exited unexpectedly: %s", saddr, err)
 		}
 	}
 }
 
+// takeOverPidFile waits for the daemonized manager with the given pid, that is
+// handing over to us, to exit (releasing its pid file), then creates the pid
+// file for ourselves, sending it down the given channel (nil if it couldn't be
+// created).
+func takeOverPidFile(oldPID int, pidFile chan *daemon.LockFile) {
+	for os.Getppid() == oldPID {
+		<-time.After(100 * time.Millisecond)
+	}
+	lf, err := daemon.CreatePidFile(config.ManagerPidFile, 0644)
+	if err != nil {
+		warn("failed to take over pid file %s: %s", config.ManagerPidFile, err)
+	}
+	pidFile <- lf
+}
+
+// cloudScaleDownPolicy returns the ScaleDownPolicy described by the
+// cloudscaledown* options in the given config, or nil if idle servers should
+// only be destroyed after cloudkeepalive seconds.
+func cloudScaleDownPolicy(c internal.Config) (*jqs.ScaleDownPolicy, error) {
+	switch c.CloudScaleDown {
+	case "", "idle":
+		return nil, nil
+	case "predict":
+	default:
+		return nil, fmt.Errorf("cloudscaledown must be idle or predict, not '%s'", c.CloudScaleDown)
+	}
+	if c.CloudScaleDownAhead < 0 || c.CloudScaleDownKeep < 0 || c.CloudScaleDownMax < 0 {
+		return nil, fmt.Errorf("cloudscaledownahead, cloudscaledownkeep and cloudscaledownmax can't be negative")
+	}
+	return &jqs.ScaleDownPolicy{
+		Horizon:     time.Duration(c.CloudScaleDownAhead) * time.Minute,
+		KeepIdle:    c.CloudScaleDownKeep,
+		MaxDestroys: c.CloudScaleDownMax,
+	}, nil
+}
+
+// managerServerConfig returns the given base ServerConfig with the settings
+// that come from our config file filled in. It is used both when starting the
+// manager and when reloading its config.
+func managerServerConfig(c internal.Config, base jobqueue.ServerConfig) (jobqueue.ServerConfig, error) {
+	sc := base
+	sc.Port = c.ManagerPort
+	sc.WebPort = c.ManagerWeb
+	sc.PublicPort = c.ManagerWebPublic
+	sc.GRPCPort = c.ManagerGRPC
+	sc.DBFile = c.ManagerDbFile
+	sc.DBFileBackup = c.ManagerDbBkFile
+	sc.DBSnapshotInterval = time.Duration(c.ManagerDbBkSnapshot) * time.Hour
+	sc.DBURL = c.ManagerDbURL
+	sc.TokenFile = c.ManagerTokenFile
+	sc.UploadDir = c.ManagerUploadDir
+	sc.CAFile = c.ManagerCAFile
+	sc.CertFile = c.ManagerCertFile
+	sc.KeyFile = c.ManagerKeyFile
+	sc.CertDomain = c.ManagerCertDomain
+	sc.Deployment = c.Deployment
+	sc.SecretKeyFile = c.ManagerSecretKeyFile
+	sc.StandbyOf = c.ManagerStandbyOf
+	sc.TakeoverCmd = c.ManagerTakeoverCmd
+	sc.ServiceAddr = c.ManagerServiceAddr
+
+	if c.ManagerEnrolment {
+		sc.EnrolCAFile = c.ManagerEnrolCAFile
+		sc.EnrolCAKeyFile = c.ManagerEnrolCAKey
+		sc.Authenticator = jobqueue.AllOf(jobqueue.RequireToken, jobqueue.RequireEnrolledClients)
+	}
+
+	if c.ManagerPreemption != "" {
+		if c.ManagerPreemptGap < 0 || c.ManagerPreemptGap > 255 {
+			return sc, fmt.Errorf("managerpreemptgap must be between 0 and 255")
+		}
+		sc.Preemption = &jobqueue.PreemptionPolicy{
+			Mode:           c.ManagerPreemption,
+			Wait:           time.Duration(c.ManagerPreemptWait) * time.Second,
+			Grace:          time.Duration(c.ManagerPreemptGrace) * time.Second,
+			MinPriorityGap: uint8(c.ManagerPreemptGap),
+		}
+	}
+
+	sc.BadServerPolicy = &jobqueue.BadServerPolicy{
+		Action:     c.CloudBadServerPolicy,
+		Probes:     c.CloudBadServerProbes,
+		RebootWait: time.Duration(c.CloudBadServerReboot) * time.Minute,
+	}
+
+	var err error
+	sc.HostJobLimits, err = jobqueue.ParseHostJobLimits(c.ManagerHostJobLimits)
+	if err != nil {
+		return sc, fmt.Errorf("managerhostjoblimits is not valid: %s", err)
+	}
+	sc.MaxJobsPerHost = c.ManagerHostMaxJobs
+
+	sc.NamespaceWeights, err = jobqueue.ParseNamespaceWeights(c.ManagerNSWeights)
+	if err != nil {
+		return sc, fmt.Errorf("managernsweights is not valid: %s", err)
+	}
+
+	fairShare := c.ManagerFairShare
+	if managerFairShare != "" {
+		fairShare = managerFairShare
+	}
+	sc.FairShare, err = jobqueue.ParseFairShare(fairShare)
+	if err != nil {
+		return sc, fmt.Errorf("managerfairshare is not valid: %s", err)
+	}
+
+	sc.MaxStartsPerMinute = c.ManagerStartRate
+
+	sc.RAMRetryMultiplier, err = strconv.ParseFloat(c.ManagerRAMRetryMult, 64)
+	if err != nil {
+		return sc, fmt.Errorf("managerramretrymult is not valid: %s", err)
+	}
+
+	if c.ManagerRAMRetryMax != "" {
+		ramRetryMax, errb := bytefmt.ToMegabytes(c.ManagerRAMRetryMax)
+		if errb != nil {
+			return sc, fmt.Errorf("managerramretrymax is not valid: %s", errb)
+		}
+		sc.RAMRetryMax = int(ramRetryMax)
+	}
+
+	sc.TimeRetryMultiplier, err = strconv.ParseFloat(c.ManagerTimeRetryMult, 64)
+	if err != nil {
+		return sc, fmt.Errorf("managertimeretrymult is not valid: %s", err)
+	}
+
+	sc.BuriedExportDir = c.ManagerBuriedExport
+
+	sc.CostPerCoreHour, err = strconv.ParseFloat(c.CloudCostPerCoreHour, 64)
+	if err != nil {
+		return sc, fmt.Errorf("cloudcostpercorehour is not valid: %s", err)
+	}
+
+	sc.StorageZones, err = jobqueue.ParseStorageZones(c.CloudStorageZones)
+	if err != nil {
+		return sc, fmt.Errorf("cloudstoragezones is not valid: %s", err)
+	}
+
+	sc.RunnerReuse, err = strconv.ParseFloat(c.ManagerRunnerReuse, 64)
+	if err != nil {
+		return sc, fmt.Errorf("managerrunnerreuse is not valid: %s", err)
+	}
+
+	sc.Backfill = c.ManagerBackfill
+
+	sc.ReservationTimeout = time.Duration(c.ManagerResTimeout) * time.Second
+
+	sc.TrashPeriod = time.Duration(c.ManagerTrashPeriod) * time.Minute
+	if c.ManagerLostAfter > 0 || c.ManagerLostCloudGone || c.ManagerHeartbeat > 0 || c.ManagerLostThreshold > 0 {
+		sc.LostJobPolicy = &jobqueue.LostJobPolicy{
+			After:     time.Duration(c.ManagerLostAfter) * time.Minute,
+			CloudGone: c.ManagerLostCloudGone,
+			Heartbeat: time.Duration(c.ManagerHeartbeat) * time.Second,
+			Threshold: time.Duration(c.ManagerLostThreshold) * time.Second,
+		}
+	}
+	sc.NotifyComplete = splitNotifyTargets(c.ManagerNotifyOK)
+	sc.NotifyFailure = splitNotifyTargets(c.ManagerNotifyFail)
+	sc.SMTPServer = c.ManagerSMTPServer
+	sc.SMTPFrom = c.ManagerSMTPFrom
+
+	for _, jb := range []struct {
+		name string
+		json string
+		when jobqueue.BehaviourTrigger
+	}{
+		{"managerjobonfailure", c.ManagerJobOnFailure, jobqueue.OnFailure},
+		{"managerjobonsuccess", c.ManagerJobOnSuccess, jobqueue.OnSuccess},
+		{"managerjobonexit", c.ManagerJobOnExit, jobqueue.OnExit},
+	} {
+		if jb.json == "" {
+			continue
+		}
+		var bjs jobqueue.BehavioursViaJSON
+		err = json.Unmarshal([]byte(jb.json), &bjs)
+		if err != nil {
+			return sc, fmt.Errorf("%s is not valid: %s", jb.name, err)
+		}
+		sc.DefaultBehaviours = append(sc.DefaultBehaviours, bjs.Behaviours(jb.when)...)
+	}
+
+	sc.WebPrefix = c.ManagerWebPrefix
+	sc.WebCORSOrigins = strings.Split(c.ManagerWebCORS, ",")
+	sc.TrustedProxies = strings.Split(c.ManagerWebProxies, ",")
+	sc.WebSocketSendLimit = c.ManagerWSSendLimit
+	sc.WebSocketOverflow = c.ManagerWSOverflow
+
+	if c.ManagerAdmitHook != "" {
+		sc.AdmissionHook = jobqueue.AdmissionWebhook(c.ManagerAdmitHook, time.Duration(c.ManagerAdmitTimeout)*time.Second)
+	}
+
+	sc.LogLevel = c.ManagerLogLevel
+	if managerDebug {
+		sc.LogLevel = "debug"
+	}
+
+	return sc, nil
+}
+
 // deleteToken should be called on successful, known clean stop of the manager,
 // so that the next time the manager is started it will create a new token.
 // For un-clean exits of the manager, we should keep the token so the manager
@@ -36,6 +36,9 @@ import (
 var cmdCwdMattersUnset bool
 var cmdChangeHomeUnset bool
 var cmdCloudSharedDiskUnset bool
+var modState string
+var modExitcode string
+var modRetry bool
 
 const nothingBehaviour = `[{"Nothing":true}]`
 
@@ -70,7 +73,12 @@ affected.
 command(s) you want to now modify. Combining with -z lets you modify commands in
 multiple report groups, assuming you have arranged that related groups share
 some substring. Alternatively -y lets you specify -i as the internal job id
-reported during "wr status".
+reported during "wr status", or as the name you gave the job when adding it.
+
+--match glob or --match regex instead treats -i as a glob pattern (eg.
+"myproj.*.align") or regular expression (eg. "^myproj\.\d+\.align$") that
+report groups must match, letting you work with any set of related groups at
+once.
 
 Having identified the command(s) to modify, provide any of "wr add"'s options
 (except for -f, -i, --rerun, --dep_grps and --bsub) to change that aspect of the
@@ -81,12 +89,28 @@ To turn off other options, supply an empty string as the value.
 
 To turn off a behaviour, supply an empty string, eg. --on_exit "".
 
+The --retry_backoff, --retry_backoff_max, --retry_jitter, --retry_max and
+--no_retry_exitcodes options together replace the whole retry policy of the
+commands, so supply all of the ones you want the commands to have (or just
+--no_retry_exitcodes "" to remove their retry policy). Buried commands can have
+their retry policy changed this way before being retried with --retry.
+
 To change the command line of a command, you must have selected only a single
 command (eg. by specifying an internal job id with -i -y). You can then use
 --cmdline to specify the new command. You can't specify the command of another
 command in the queue or that has previously completed; those mod requests will
 be silently ignored.
 
+Amongst the selected commands, --state limits modification to those in the
+given state (one of buried, ready, delayed or dependent), and --exitcode to
+those that last exited with the given code, or a code in the given range (eg.
+1-127). For example, to give more memory to all the buried commands of a report
+group that were killed for using too much:
+$ wr mod -i mygroup --state buried --exitcode 137 -m 8G --retry
+
+--retry retries the modified commands that were buried, as per "wr retry",
+saving you having to run that separately.
+
 Because modifying a command may change its internal id, a mapping of old to
 new internal ids is printed.`,
 	Run: func(cobraCmd *cobra.Command, args []string) {
@@ -97,12 +121,28 @@ new internal ids is printed.`,
 		if cmdAll && cmdLine != "" {
 			die("-a is not compatible with --cmdline")
 		}
-		if cmdIDStatus == "" && (cmdIDIsSubStr || cmdIDIsInternal) {
-			die("-z and -y require -i")
+		if cmdIDStatus == "" && (cmdIDIsSubStr || cmdIDIsInternal || cmdIDMatch != "") {
+			die("-z, -y and --match require -i")
 		}
 		if !cmdAll && cmdIDStatus == "" {
 			die("one of -i or -a is required")
 		}
+		var wantedState jobqueue.JobState
+		switch modState {
+		case "":
+		case "buried", "ready", "delayed", "dependent":
+			wantedState = jobqueue.JobState(modState)
+		default:
+			die("--state must be one of buried, ready, delayed or dependent")
+		}
+		var minCode, maxCode int
+		if modExitcode != "" {
+			var errp error
+			minCode, maxCode, errp = parseExitcodeRange(modExitcode)
+			if errp != nil {
+				die("bad --exitcode: %s", errp)
+			}
+		}
 
 		// we call getJobs() later, which finds jobs based on -f and -l, but
 		// we don't want that
@@ -125,6 +165,9 @@ new internal ids is printed.`,
 
 		// get the job(s) user wishes to modify
 		jobs := getJobs(jq, jobqueue.JobStateDeletable, cmdAll, 0, false, false)
+		if wantedState != "" || modExitcode != "" {
+			jobs = filterModJobs(jobs, wantedState, modExitcode != "", minCode, maxCode)
+		}
 
 		if len(jobs) == 0 {
 			die("No matching jobs found")
@@ -278,6 +321,10 @@ new internal ids is printed.`,
 			jm.SetMonitorDocker(cmdMonitorDocker)
 		}
 
+		if cobraCmd.Flags().Changed("container") || cobraCmd.Flags().Changed("container_runtime") {
+			jm.SetContainer(cmdContainer, cmdContainerRuntime)
+		}
+
 		var behaviours jobqueue.Behaviours
 		var behavioursSet bool
 		if cobraCmd.Flags().Changed("on_failure") {
@@ -342,6 +389,16 @@ new internal ids is printed.`,
 		// 	jm.SetBsubMode(deployment)
 		// }
 
+		if cobraCmd.Flags().Changed("retry_backoff") || cobraCmd.Flags().Changed("retry_backoff_max") ||
+			cobraCmd.Flags().Changed("retry_jitter") || cobraCmd.Flags().Changed("retry_max") ||
+			cobraCmd.Flags().Changed("no_retry_exitcodes") {
+			rp, errr := retryPolicyFromFlags()
+			if errr != nil {
+				die("%s", errr)
+			}
+			jm.SetRetryPolicy(rp)
+		}
+
 		// make the modifications
 		jes := jobsToJobEssenses(jobs)
 		modified, err := jq.Modify(jes, jm)
@@ -352,9 +409,40 @@ new internal ids is printed.`,
 		for to, from := range modified {
 			fmt.Printf(" %s => %s\n", from, to)
 		}
+
+		if modRetry && len(modified) > 0 {
+			// Kick only affects buried jobs, so we can just supply all of the
+			// modified ones
+			retry := make([]*jobqueue.JobEssence, 0, len(modified))
+			for to := range modified {
+				retry = append(retry, &jobqueue.JobEssence{JobKey: to})
+			}
+			kicked, errk := jq.Kick(retry)
+			if errk != nil {
+				die("failed to retry the modified jobs: %s", errk)
+			}
+			info("Initiated retry of %d modified buried commands", kicked)
+		}
 	},
 }
 
+// filterModJobs returns the subset of the given jobs that are in the given
+// state (if not blank), and that exited with a code in the given range (if
+// checkExit).
+func filterModJobs(jobs []*jobqueue.Job, state jobqueue.JobState, checkExit bool, minCode, maxCode int) []*jobqueue.Job {
+	var filtered []*jobqueue.Job
+	for _, job := range jobs {
+		if state != "" && job.State != state {
+			continue
+		}
+		if checkExit && (!job.Exited || job.Exitcode < minCode || job.Exitcode > maxCode) {
+			continue
+		}
+		filtered = append(filtered, job)
+	}
+	return filtered
+}
+
 func init() {
 	RootCmd.AddCommand(modCmd)
 
@@ -362,7 +450,12 @@ func init() {
 	modCmd.Flags().BoolVarP(&cmdAll, "all", "a", false, "modify all incomplete, non-running jobs")
 	modCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to modify")
 	modCmd.Flags().BoolVarP(&cmdIDIsSubStr, "search", "z", false, "treat -i as a substring to match against all report groups")
-	modCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id")
+	modCmd.Flags().StringVar(&cmdIDMatch, "match", "", "['glob','regex'] treat -i as a pattern to match against all report groups")
+	modCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id or job name")
+
+	modCmd.Flags().StringVar(&modState, "state", "", "['buried','ready','delayed','dependent'] only modify commands in this state")
+	modCmd.Flags().StringVar(&modExitcode, "exitcode", "", "only modify commands that exited with this code, or a code in this range (eg. 1-127)")
+	modCmd.Flags().BoolVar(&modRetry, "retry", false, "retry the modified commands that were buried")
 
 	modCmd.Flags().StringVar(&cmdLine, "cmdline", "", "new command line")
 	modCmd.Flags().StringVarP(&cmdLimitGroups, "limit_grps", "l", "", "comma-separated list of limit groups")
@@ -382,7 +475,14 @@ func init() {
 	modCmd.Flags().IntVarP(&cmdRet, "retries", "r", 3, "[0-255] number of automatic retries for failed commands")
 	modCmd.Flags().StringVar(&cmdCmdDeps, "cmd_deps", "", "dependencies of your commands, in the form \"command1,cwd1,command2,cwd2...\"")
 	modCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2...\"")
+	modCmd.Flags().StringVar(&cmdRetryBackoff, "retry_backoff", "", "wait this long before retrying failed commands, doubling each time [specify units such as s for seconds]")
+	modCmd.Flags().StringVar(&cmdRetryBackoffMax, "retry_backoff_max", "", "maximum wait before retrying failed commands [specify units such as m for minutes]")
+	modCmd.Flags().Float64Var(&cmdRetryJitter, "retry_jitter", 0, "[0-1] randomly vary the wait before retrying by up to this fraction of it")
+	modCmd.Flags().StringVar(&cmdRetryMax, "retry_max", "", "maximum retries per failure reason, in JSON format, eg. '{\"lost contact with runner\":10}'")
+	modCmd.Flags().StringVar(&cmdNoRetryExitcodes, "no_retry_exitcodes", "", "comma-separated exit codes that bury commands immediately instead of retrying them")
 	modCmd.Flags().StringVar(&cmdMonitorDocker, "monitor_docker", "", "monitor resource usage of docker container with given --name or --cidfile path")
+	modCmd.Flags().StringVar(&cmdContainer, "container", "", "run commands inside a container created from this image (blank to stop)")
+	modCmd.Flags().StringVar(&cmdContainerRuntime, "container_runtime", "", "[docker|singularity] program to run --container with (default docker)")
 	modCmd.Flags().StringVar(&cmdOnFailure, "on_failure", "", "behaviours to carry out when cmds fails, in JSON format")
 	modCmd.Flags().StringVar(&cmdOnSuccess, "on_success", "", "behaviours to carry out when cmds succeed, in JSON format")
 	modCmd.Flags().StringVar(&cmdOnExit, "on_exit", `[{"cleanup":true}]`, "behaviours to carry out when cmds finish running, in JSON format")
@@ -40,15 +40,15 @@ var mountVerbose bool
 // mountCmd represents the mount command
 var mountCmd = &cobra.Command{
 	Use:   "mount",
-	Short: "Mount an S3 bucket",
-	Long: `Test mounting of S3 buckets.
+	Short: "Mount an S3, Google Cloud Storage or Azure Blob bucket",
+	Long: `Test mounting of S3, Google Cloud Storage (GCS) or Azure Blob buckets.
 
 'wr add' can take mount options if your commands need to read from/ write to
-S3 buckets. Before supplying these mount options to 'wr add', you can use this
+object store buckets. Before supplying these mount options to 'wr add', you can use this
 command to test that your mount options work.
 
-You can also use this as a quick, easy and high performance way of mounting an
-S3 bucket for general use, but note that it is only designed as a temporary
+You can also use this as a quick, easy and high performance way of mounting a
+bucket for general use, but note that it is only designed as a temporary
 mount since it won't notice externally altered or added files in directories you
 already accessed. It also only allows yourself access to the files.
 
@@ -76,13 +76,14 @@ case that you wish the contents of 1 or more remote directories to be accessible
 from a single local directory ('mnt' when using this command, the command
 working directory when using 'wr add'). For anything more complicated you'll
 need to use --mount_json. You can't use both --mounts and --mount_json at once.
-The format is a comma-separated list of [c|u][r|w]:[profile@]bucket[/path]
-strings. The first character as 'c' means to turn on caching, while 'u' means
-uncached. The second character as 'r' means read-only, while 'w' means writeable
-(only one of them can have w). After the colon you can optionally specify the
-profile name followed by the @ symbol, followed by the required remote bucket
-name and ideally the path to the deepest subdirectory that contains the data you
-wish to access.
+The format is a comma-separated list of
+[c|u][r|w]:[backend:][profile@]bucket[/path] strings. The first character as 'c'
+means to turn on caching, while 'u' means uncached. The second character as 'r'
+means read-only, while 'w' means writeable (only one of them can have w). After
+the colon you can optionally specify the Backend (see below) followed by another
+colon, then optionally the profile name followed by the @ symbol, followed by
+the required remote bucket name and ideally the path to the deepest subdirectory
+that contains the data you wish to access. Eg. cr:gcs:mybucket/data
 
 
 --mount_json is the JSON string for an array of Config objects describing all
@@ -114,7 +115,7 @@ undefined, the cache directories will be made in the current working directory
 directories will be in a sister directory of the actual working directory).
 
 Retries is the number of retries wr should attempt when it encounters errors in
-trying to access your remote S3 bucket. At least 3 is recommended. It defaults
+trying to access your remote bucket. At least 3 is recommended. It defaults
 to 10 if not provided.
 
 Verbose is a boolean, which if true, would make wr store timing information on
@@ -132,6 +133,25 @@ multiplex but instead want multiple different mount points, you specify a single
 Target in this array, and have multiple Config objects in your top level array.)
 The remaining paragraphs describe the possible parameters for Target objects.
 
+Backend is the kind of object store your bucket is in: "s3" (the default),
+"gcs" for Google Cloud Storage or "azure" for Azure Blob storage. The Profile
+and Path parameters are described below for the S3 case; for the others:
+  "gcs" accesses GCS via its S3-compatible API, so requires an HMAC key (see
+    https://cloud.google.com/storage/docs/authentication/hmackeys). This is
+    taken from the gs_access_key_id and gs_secret_access_key options of the
+    Profile section (default "Credentials") of gsutil's config file, found at
+    $BOTO_CONFIG or ~/.boto; its gs_host option can specify a non-standard
+    domain. The environment variables $GS_ACCESS_KEY_ID and
+    $GS_SECRET_ACCESS_KEY override the config file. Path is your GCS bucket
+    name, optionally followed by subdirectories.
+  "azure" uses Profile as your storage account name, defaulting to
+    $AZURE_STORAGE_ACCOUNT. Access is authorised with the account key in
+    $AZURE_STORAGE_KEY, or a SAS token in $AZURE_STORAGE_SAS_TOKEN. All of
+    these can instead come from $AZURE_STORAGE_CONNECTION_STRING, which can also
+    specify a non-standard BlobEndpoint. Path is your container name, optionally
+    followed by subdirectories.
+Without credentials, only public buckets and containers can be read.
+
 Profile is the S3 configuration profile name to use. If not supplied, the value
 of the $AWS_DEFAULT_PROFILE or $AWS_PROFILE environment variables is used, and
 if those are unset it defaults to "default".
@@ -191,13 +211,9 @@ not cached, only serial writes are possible.`,
 		for _, mc := range mountParse(mountJSON, mountSimple) {
 			var rcs []*muxfys.RemoteConfig
 			for _, mt := range mc.Targets {
-				accessorConfig, err := muxfys.S3ConfigFromEnvironment(mt.Profile, mt.Path)
-				if err != nil {
-					die("had a problem reading S3 config values from the environment: %s", err)
-				}
-				accessor, err := muxfys.NewS3Accessor(accessorConfig)
+				accessor, err := mt.Accessor()
 				if err != nil {
-					die("had a problem creating an S3 accessor: %s", err)
+					die("had a problem accessing %s: %s", mt.Path, err)
 				}
 
 				rc := &muxfys.RemoteConfig{
@@ -258,7 +274,7 @@ func init() {
 
 	// flags specific to this sub-command
 	mountCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mount parameters JSON (see --help)")
-	mountCmd.Flags().StringVarP(&mountSimple, "mounts", "m", "", "comma-separated list of [c|u][r|w]:bucket[/path] (see --help)")
+	mountCmd.Flags().StringVarP(&mountSimple, "mounts", "m", "", "comma-separated list of [c|u][r|w]:[backend:]bucket[/path] (see --help)")
 	mountCmd.Flags().BoolVarP(&mountVerbose, "verbose", "v", false, "print timing info on all remote calls")
 }
 
@@ -289,17 +305,22 @@ func mountParseJSON(jsonString string) jobqueue.MountConfigs {
 	return mcs
 }
 
-// mountParseSimple takes a comma-separated list of [c|u][r|w]:bucket[/path] and
-// parses it to a MountConfig in a MountConfigs (to match the output type of
-// mountParseJSON).
+// mountParseSimple takes a comma-separated list of
+// [c|u][r|w]:[backend:][profile@]bucket[/path] and parses it to a MountConfig in
+// a MountConfigs (to match the output type of mountParseJSON).
 func mountParseSimple(simpleString string) jobqueue.MountConfigs {
 	ss := strings.Split(simpleString, ",")
 	targets := make([]jobqueue.MountTarget, 0, len(ss))
 	for _, simple := range ss {
 		parts := strings.Split(simple, ":")
-		if len(parts) != 2 || len(parts[0]) != 2 {
+		if len(parts) < 2 || len(parts) > 3 || len(parts[0]) != 2 {
 			die("'%s' was not in the right format", simple)
 		}
+		var backend string
+		if len(parts) == 3 {
+			backend = parts[1]
+			parts = []string{parts[0], parts[2]}
+		}
 
 		var cache, write bool
 		switch parts[0][0] {
@@ -328,9 +349,10 @@ func mountParseSimple(simpleString string) jobqueue.MountConfigs {
 		}
 
 		mt := jobqueue.MountTarget{
-			Path:  path,
-			Cache: cache,
-			Write: write,
+			Backend: backend,
+			Path:    path,
+			Cache:   cache,
+			Write:   write,
 		}
 		if profile != "" {
 			mt.Profile = profile
@@ -0,0 +1,101 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var provenanceOutput string
+
+// provenanceCmd represents the provenance command
+var provenanceCmd = &cobra.Command{
+	Use:   "provenance",
+	Short: "Export the provenance of commands",
+	Long: `Export how the commands in a report group were run, in a standard format.
+
+So that analyses you run with wr can be published with machine-readable
+provenance, this outputs an RO-Crate (https://w3id.org/ro/crate) metadata
+document describing the commands in the report group given to -i (combine with
+-z to treat it as a substring) that have been run.
+
+Each command is described with its command line, the host it ran on, when it
+started and ended, whether it completed or failed, the files it created
+(if you specified them with the "outputs" option of "wr add"), the files created
+by the commands it depended on, and the software it used (its cloud_os image,
+monitored docker container and env_modules).
+
+The document is written to STDOUT, or to the file given to --output. To make a
+complete RO-Crate, save it as ro-crate-metadata.json in the directory holding
+your results.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cmdIDStatus == "" {
+			die("-i is required")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		jobs, err := jq.GetByRepGroup(cmdIDStatus, cmdIDIsSubStr, 0, "", false, false)
+		if err != nil {
+			die("failed to get commands: %s", err)
+		}
+		if len(jobs) == 0 {
+			die("No matching commands found")
+		}
+
+		crate, err := jobqueue.ProvenanceCrate(cmdIDStatus, jobs)
+		if err != nil {
+			die("failed to create the provenance document: %s", err)
+		}
+
+		if provenanceOutput == "" {
+			fmt.Println(string(crate))
+			return
+		}
+		err = ioutil.WriteFile(provenanceOutput, append(crate, '\n'), 0600)
+		if err != nil {
+			die("failed to write to %s: %s", provenanceOutput, err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(provenanceCmd)
+
+	// flags specific to this sub-command
+	provenanceCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want the provenance of")
+	provenanceCmd.Flags().BoolVarP(&cmdIDIsSubStr, "search", "z", false, "treat -i as a substring to match against all report groups")
+	provenanceCmd.Flags().StringVarP(&provenanceOutput, "output", "o", "", "path of the file to write to, instead of STDOUT")
+
+	provenanceCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
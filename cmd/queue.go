@@ -0,0 +1,132 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var queueSet string
+var queueDelete string
+var queueLimit int
+var queueOptions []string
+
+// queueCmd represents the queue command
+var queueCmd = &cobra.Command{
+	Use:   "queue",
+	Short: "View or configure the named queues of projects",
+	Long: `View or configure the named queues that isolate the commands of different
+projects.
+
+Every wr command takes a --project option (which overrides the managernamespace
+config option). Commands added with eg. 'wr add --project projectX' go in the
+"projectX" queue, and other wr commands given the same --project only see and
+act on the commands in that queue, so unrelated projects can't interfere with
+each other.
+
+Without options, the queues that have been configured or currently have commands
+ready to run or running are listed, along with their settings and those counts.
+(With --project, only that project's queue is listed.)
+
+--set configures the named queue, replacing any previous configuration of it:
+--limit sets the maximum number of its commands that may run at once (0, the
+default, means unlimited), and --option (which can be given multiple times)
+supplies a scheduler option in key=value form (eg. cloud_flavor=m1.large) that
+commands subsequently added to the queue will get, unless they specified a value
+for that key themselves (eg. with 'wr add --cloud_flavor').
+
+Limits apply to the commands that were added to the queue after it was first
+configured; changing the limit of a configured queue takes effect immediately.
+
+--delete forgets the configuration of the named queue. Its commands are not
+affected, except that they are no longer limited.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if queueSet != "" && queueDelete != "" {
+			die("--set and --delete are mutually exclusive")
+		}
+		if queueSet == "" && (queueLimit != 0 || len(queueOptions) > 0) {
+			die("--limit and --option can only be used with --set")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		switch {
+		case queueSet != "":
+			err = jq.SetQueueConfig(&jobqueue.QueueConfig{
+				Name:             queueSet,
+				Limit:            queueLimit,
+				SchedulerOptions: queueOptions,
+			})
+			if err != nil {
+				die("%s", err)
+			}
+			info("queue %s configured", queueSet)
+		case queueDelete != "":
+			err = jq.DeleteQueueConfig(queueDelete)
+			if err != nil {
+				die("%s", err)
+			}
+			info("queue %s configuration deleted", queueDelete)
+		default:
+			queues, errg := jq.GetQueues()
+			if errg != nil {
+				die("%s", errg)
+			}
+			for _, q := range queues {
+				limit := "unlimited"
+				if q.Limit > 0 {
+					limit = fmt.Sprintf("limit %d", q.Limit)
+				}
+				if !q.Configured {
+					limit = "not configured"
+				}
+				fmt.Printf("%s (%s): %d ready, %d running", q.Name, limit, q.Ready, q.Running)
+				if len(q.SchedulerOptions) > 0 {
+					fmt.Printf("; options %s", strings.Join(q.SchedulerOptions, " "))
+				}
+				fmt.Println()
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(queueCmd)
+
+	// flags specific to this sub-command
+	queueCmd.Flags().StringVar(&queueSet, "set", "", "name of a queue to configure")
+	queueCmd.Flags().IntVar(&queueLimit, "limit", 0, "with --set, the maximum number of the queue's commands that may run at once (0 means unlimited)")
+	queueCmd.Flags().StringArrayVar(&queueOptions, "option", nil, "with --set, a key=value scheduler option for the queue's commands (repeatable)")
+	queueCmd.Flags().StringVar(&queueDelete, "delete", "", "name of a queue to stop configuring")
+	queueCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -19,12 +19,25 @@
 package cmd
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/jobqueue"
 	"github.com/spf13/cobra"
 )
 
+const (
+	removePollInterval   = 1 * time.Second
+	removeReportInterval = 10 * time.Second
+)
+
+// options for this cmd
+var removeBackground bool
+var removeProgress bool
+var removeCancel string
+var removeUndo bool
+
 // removeCmd represents the remove command
 var removeCmd = &cobra.Command{
 	Use:   "remove",
@@ -44,7 +57,12 @@ affected.
 you want to now remove. Combining with -z lets you remove jobs in multiple
 report groups, assuming you have arranged that related groups share some
 substring. Alternatively -y lets you specify -i as the internal job id reported
-during "wr status".
+during "wr status", or as the name you gave the job when adding it.
+
+--match glob or --match regex instead treats -i as a glob pattern (eg.
+"myproj.*.align") or regular expression (eg. "^myproj\.\d+\.align$") that
+report groups must match, letting you work with any set of related groups at
+once.
 
 The file to provide -f is in the format taken by "wr add".
 
@@ -62,14 +80,39 @@ command line of a job with dependants, you can either:
    all the jobs back again with the corrected -f file
 -or-
 2) use the "wr mod" command to modify the command line of the bad job while
-   leaving those jobs that are dependant upon it intact.`,
+   leaving those jobs that are dependant upon it intact.
+
+The manager removes the jobs in the background, in batches, so that removing
+very many jobs doesn't hold anything else up. This command waits for the
+removal to finish, reporting on its progress, but if you interrupt it, or use
+--background to not wait at all, the manager carries on. If the manager is
+restarted part way through, it carries on with the removal once it starts
+again.
+
+--progress shows you the progress of removals that are still going on, along
+with those that finished in the last hour, and --cancel stops the removal with
+the given id (as reported by --progress) after its current batch; jobs that
+were already removed stay removed.
+
+If the manager has been configured with a managertrashperiod, removed commands
+are kept in a trash for that long, where you can see them with
+"wr status --trashed". If you removed the wrong commands, use --undo along with
+the same -f, -i, -l or -a option you used to remove them (-a restores
+everything in the trash) to put them back in the queue as they were. (Commands
+that were buried when removed become ready to run again.)`,
 	Run: func(cmd *cobra.Command, args []string) {
 		set := countGetJobArgs()
-		if set > 1 {
-			die("-f, -i, -l and -a are mutually exclusive; only specify one of them")
-		}
-		if set == 0 {
-			die("1 of -f, -i, -l or -a is required")
+		if removeProgress || removeCancel != "" {
+			if set > 0 || (removeProgress && removeCancel != "") {
+				die("--progress and --cancel can't be used with each other or with -f, -i, -l or -a")
+			}
+		} else {
+			if set > 1 {
+				die("-f, -i, -l and -a are mutually exclusive; only specify one of them")
+			}
+			if set == 0 {
+				die("1 of -f, -i, -l or -a is required")
+			}
 		}
 
 		timeout := time.Duration(timeoutint) * time.Second
@@ -82,6 +125,22 @@ command line of a job with dependants, you can either:
 			}
 		}()
 
+		switch {
+		case removeProgress:
+			showBulkRemovals(jq)
+			return
+		case removeUndo:
+			undoRemove(jq)
+			return
+		case removeCancel != "":
+			err = jq.CancelBulkRemoval(removeCancel)
+			if err != nil {
+				die("failed to cancel removal %s: %s", removeCancel, err)
+			}
+			info("Removal %s will stop after its current batch", removeCancel)
+			return
+		}
+
 		jobs := getJobs(jq, jobqueue.JobStateDeletable, cmdAll, 0, false, false)
 
 		if len(jobs) == 0 {
@@ -89,14 +148,135 @@ command line of a job with dependants, you can either:
 		}
 
 		jes := jobsToJobEssenses(jobs)
-		removed, err := jq.Delete(jes)
+		br, err := jq.DeleteInBackground(jes)
 		if err != nil {
 			die("failed to remove desired jobs: %s", err)
 		}
-		info("Removed %d incomplete, non-running commands (out of %d eligible)", removed, len(jobs))
+
+		if removeBackground {
+			info("Removing %d eligible commands in the background; follow progress with: wr remove --progress (id %s)", len(jobs), br.ID)
+			return
+		}
+
+		br = waitForBulkRemoval(jq, br)
+		switch br.State {
+		case jobqueue.BulkRemovalCancelled:
+			info("Removal was cancelled after removing %d incomplete, non-running commands (out of %d eligible)", br.Removed, len(jobs))
+		default:
+			info("Removed %d incomplete, non-running commands (out of %d eligible)", br.Removed, len(jobs))
+		}
 	},
 }
 
+// undoRemove restores the trashed jobs selected by the user's -f, -i, -l or -a
+// option.
+func undoRemove(jq *jobqueue.Client) {
+	var jes []*jobqueue.JobEssence
+	switch {
+	case cmdAll || (cmdIDStatus != "" && !cmdIDIsInternal):
+		if cmdIDMatch != "" {
+			die("--match can't be used with --undo")
+		}
+		repGroup := cmdIDStatus
+		if cmdIDIsSubStr {
+			repGroup = ""
+		}
+		jobs, err := jq.GetTrashed(repGroup)
+		if err != nil {
+			die("failed to get the trashed commands: %s", err)
+		}
+		for _, job := range jobs {
+			if cmdIDIsSubStr && !strings.Contains(job.RepGroup, cmdIDStatus) {
+				continue
+			}
+			jes = append(jes, &jobqueue.JobEssence{JobKey: job.Key()})
+		}
+	case cmdIDStatus != "":
+		jes = []*jobqueue.JobEssence{{JobKey: cmdIDStatus}}
+	case cmdFileStatus != "":
+		parsedJobs, _, _ := parseCmdFile(jq, false)
+		jes = jobsToJobEssenses(parsedJobs)
+	default:
+		var defaultMounts jobqueue.MountConfigs
+		if mountJSON != "" || mountSimple != "" {
+			defaultMounts = mountParse(mountJSON, mountSimple)
+		}
+		jes = []*jobqueue.JobEssence{{Cmd: cmdLine, Cwd: cmdCwd, MountConfigs: defaultMounts}}
+	}
+
+	if len(jes) == 0 {
+		die("No matching trashed jobs found")
+	}
+
+	restored, err := jq.RestoreTrashed(jes)
+	if err != nil {
+		die("failed to restore desired jobs: %s", err)
+	}
+	info("Restored %d trashed commands", restored)
+}
+
+// waitForBulkRemoval polls the server until the given BulkRemoval is no longer
+// running, reporting on its progress every now and then, and returns its final
+// state.
+func waitForBulkRemoval(jq *jobqueue.Client, br *jobqueue.BulkRemoval) *jobqueue.BulkRemoval {
+	ticker := time.NewTicker(removePollInterval)
+	defer ticker.Stop()
+	lastReport := time.Now()
+	for range ticker.C {
+		brs, err := jq.GetBulkRemovals()
+		if err != nil {
+			die("failed to get the progress of the removal (which continues in the background; see --progress): %s", err)
+		}
+
+		found := false
+		for _, current := range brs {
+			if current.ID == br.ID {
+				br = current
+				found = true
+				break
+			}
+		}
+		if !found {
+			die("the manager no longer knows about removal %s", br.ID)
+		}
+
+		if br.State != jobqueue.BulkRemovalRunning {
+			return br
+		}
+
+		if time.Since(lastReport) >= removeReportInterval {
+			info("Removed %d of %d commands so far...", br.Removed, br.Total)
+			lastReport = time.Now()
+		}
+	}
+	return br
+}
+
+// showBulkRemovals prints the progress of the manager's recent bulk removals.
+func showBulkRemovals(jq *jobqueue.Client) {
+	brs, err := jq.GetBulkRemovals()
+	if err != nil {
+		die("failed to get removals: %s", err)
+	}
+	if len(brs) == 0 {
+		info("There are no current or recent removals")
+		return
+	}
+	for _, br := range brs {
+		var resumed string
+		if br.Resumed > 0 {
+			resumed = fmt.Sprintf("; resumed %d times after manager restarts", br.Resumed)
+		}
+		var ended string
+		if !br.Finished.IsZero() {
+			ended = fmt.Sprintf("; finished %s", br.Finished.Format(time.RFC3339))
+		}
+		fmt.Printf("%s: %s, removed %d of %d (pass %d: %d of %d considered); started %s%s%s\n",
+			br.ID, br.State, br.Removed, br.Total, br.Pass, br.Done, br.PassJobs,
+			br.Started.Format(time.RFC3339), ended, resumed)
+	}
+}
+
 func init() {
 	RootCmd.AddCommand(removeCmd)
 
@@ -105,11 +285,17 @@ func init() {
 	removeCmd.Flags().StringVarP(&cmdFileStatus, "file", "f", "", "file containing commands you want to remove; - means read from STDIN")
 	removeCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to remove")
 	removeCmd.Flags().BoolVarP(&cmdIDIsSubStr, "search", "z", false, "treat -i as a substring to match against all report groups")
-	removeCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id")
+	removeCmd.Flags().StringVar(&cmdIDMatch, "match", "", "['glob','regex'] treat -i as a pattern to match against all report groups")
+	removeCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id or job name")
 	removeCmd.Flags().StringVarP(&cmdLine, "cmdline", "l", "", "a command line you want to remove")
 	removeCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "working dir that the command(s) specified by -l or -f were set to run in")
 	removeCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mounts that the command(s) specified by -l or -f were set to use (JSON format)")
 	removeCmd.Flags().StringVar(&mountSimple, "mounts", "", "mounts that the command(s) specified by -l or -f were set to use (simple format)")
 
+	removeCmd.Flags().BoolVarP(&removeBackground, "background", "b", false, "don't wait for the removal to finish")
+	removeCmd.Flags().BoolVarP(&removeProgress, "progress", "p", false, "show the progress of current and recent removals")
+	removeCmd.Flags().StringVar(&removeCancel, "cancel", "", "id of a removal to cancel")
+	removeCmd.Flags().BoolVar(&removeUndo, "undo", false, "restore previously removed commands from the trash")
+
 	removeCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 }
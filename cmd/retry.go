@@ -19,6 +19,7 @@
 package cmd
 
 import (
+	"strings"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/jobqueue"
@@ -27,6 +28,8 @@ import (
 
 // options for this cmd
 var cmdAll bool
+var retryCwd string
+var retryArgs string
 
 // retryCmd represents the retry command
 var retryCmd = &cobra.Command{
@@ -42,7 +45,12 @@ retry. Amongst those, only currently buried jobs will be affected.
 you want to now retry. Combining with -z lets you retry jobs in multiple report
 groups, assuming you have arranged that related groups share some substring.
 Alternatively -y lets you specify -i as the internal job id reported during
-"wr status".
+"wr status", or as the name you gave the job when adding it.
+
+--match glob or --match regex instead treats -i as a glob pattern (eg.
+"myproj.*.align") or regular expression (eg. "^myproj\.\d+\.align$") that
+report groups must match, letting you work with any set of related groups at
+once.
 
 The file to provide -f is in the format taken by "wr add".
 
@@ -50,7 +58,16 @@ In -f and -l mode you must provide the cwd the commands were set to run in, if
 CwdMatters (and must NOT be provided otherwise). Likewise provide the mounts
 options that was used when the command was added, if any. You can do this by
 using the -c and --mounts/--mounts_json options in -l mode, or by providing the
-same file you gave to "wr add" in -f mode.`,
+same file you gave to "wr add" in -f mode.
+
+To change how the commands run when retried, without removing and re-adding
+them, use --env to set extra environment variables (eg. --env DEBUG=1),
+--new_cwd to run them in a different directory, or --append to add arguments to
+the end of their command lines (this doesn't work for commands added with
+steps). The commands themselves are not changed (so they keep their internal
+job ids, and you still identify them by their original command line and cwd),
+but these changes apply to every attempt after this retry. A later retry
+without any of these options goes back to running them as originally added.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		set := countGetJobArgs()
 		if set > 1 {
@@ -76,8 +93,16 @@ same file you gave to "wr add" in -f mode.`,
 			die("No matching jobs found")
 		}
 
+		var overrides *jobqueue.RetryOverrides
+		if cmdEnv != "" || retryCwd != "" || retryArgs != "" {
+			overrides = &jobqueue.RetryOverrides{Cwd: retryCwd, Args: retryArgs}
+			if cmdEnv != "" {
+				overrides.Env = strings.Split(cmdEnv, ",")
+			}
+		}
+
 		jes := jobsToJobEssenses(jobs)
-		kicked, err := jq.Kick(jes)
+		kicked, err := jq.KickWithOverrides(jes, overrides)
 		if err != nil {
 			die("failed to retry desired jobs: %s", err)
 		}
@@ -93,11 +118,15 @@ func init() {
 	retryCmd.Flags().StringVarP(&cmdFileStatus, "file", "f", "", "file containing commands you want to retry; - means read from STDIN")
 	retryCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to retry")
 	retryCmd.Flags().BoolVarP(&cmdIDIsSubStr, "search", "z", false, "treat -i as a substring to match against all report groups")
-	retryCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id")
+	retryCmd.Flags().StringVar(&cmdIDMatch, "match", "", "['glob','regex'] treat -i as a pattern to match against all report groups")
+	retryCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id or job name")
 	retryCmd.Flags().StringVarP(&cmdLine, "cmdline", "l", "", "a command line you want to retry")
 	retryCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "working dir that the command(s) specified by -l or -f were set to run in")
 	retryCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mounts that the command(s) specified by -l or -f were set to use (JSON format)")
 	retryCmd.Flags().StringVar(&mountSimple, "mounts", "", "mounts that the command(s) specified by -l or -f were set to use (simple format)")
+	retryCmd.Flags().StringVar(&cmdEnv, "env", "", "comma-separated list of key=value environment variables to set when running the retried commands")
+	retryCmd.Flags().StringVar(&retryCwd, "new_cwd", "", "absolute path of a different working dir to run the retried commands in")
+	retryCmd.Flags().StringVar(&retryArgs, "append", "", "arguments to append to the retried command lines")
 
 	retryCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 }
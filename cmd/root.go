@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
@@ -47,6 +48,7 @@ var appLogger = log15.New()
 
 // these variables are accessible by all subcommands.
 var deployment string
+var project string
 var config internal.Config
 
 // these are shared by some of the subcommands.
@@ -105,6 +107,7 @@ func init() {
 
 	// global flags
 	RootCmd.PersistentFlags().StringVar(&deployment, "deployment", internal.DefaultDeployment(appLogger), "use production or development config")
+	RootCmd.PersistentFlags().StringVar(&project, "project", "", "work with the named queue of this project (overrides the managernamespace config option)")
 
 	cobra.OnInitialize(initConfig)
 }
@@ -112,6 +115,9 @@ func init() {
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	config = internal.ConfigLoad(deployment, false, appLogger)
+	if project != "" {
+		config.ManagerNamespace = project
+	}
 	addr = config.ManagerHost + ":" + config.ManagerPort
 	caFile = config.ManagerCAFile
 }
@@ -151,6 +157,12 @@ func cloudResourceName(username string) string {
 	return "wr-" + dep + "-" + username
 }
 
+// cloudRunnerURL returns the configured cloudrunnerurl, with {version} replaced
+// by our own version.
+func cloudRunnerURL() string {
+	return strings.Replace(config.CloudRunnerURL, "{version}", jobqueue.ServerVersion, -1)
+}
+
 // info is a convenience to log a message at the Info level.
 func info(msg string, a ...interface{}) {
 	appLogger.Info(fmt.Sprintf(msg, a...))
@@ -298,6 +310,11 @@ func connect(wait time.Duration, expectedToBeDown ...bool) *jobqueue.Client {
 	if err != nil && !(len(expectedToBeDown) == 1 && expectedToBeDown[0]) {
 		die("%s", err)
 	}
+	if jq != nil && config.ManagerNamespace != "" {
+		if err = jq.SetNamespace(config.ManagerNamespace); err != nil {
+			die("%s", err)
+		}
+	}
 	return jq
 }
 
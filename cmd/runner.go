@@ -19,11 +19,15 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log/syslog"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/internal"
@@ -33,6 +37,11 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// runnerUpdatedEnvVar is set to the path of the executable a runner replaced
+// itself with, so that the new runner can clean it up and won't try to update
+// itself again.
+const runnerUpdatedEnvVar = "WR_RUNNER_UPDATED_EXE"
+
 // options for this cmd
 var schedgrp string
 var timeoutintRunner int
@@ -41,6 +50,7 @@ var rserver string
 var rdomain string
 var maxtime int
 var logToSyslog bool
+var debugJobKey string
 
 // runnerCmd represents the runner command
 var runnerCmd = &cobra.Command{
@@ -56,7 +66,16 @@ runner will pick up another and so on. Once max_time has been used (or would be
 used based on the expected time to complete of the next queued command), the
 runner stops picking up new commands and exits instead; max_time does not cause
 the runner to kill itself if the cmd it is running takes longer than max_time to
-complete.`,
+complete.
+
+If the manager has been upgraded since the runner started, and the manager is
+configured with managerrunnerupdate, then when the runner next tries to pick up
+a command it will instead get the manager's version of wr and replace itself
+with that.
+
+With --debug_job, the runner doesn't run any queued commands, but instead
+recreates the environment of the command with the given key and gives you a
+shell in it; 'wr debug' uses this to debug commands on other hosts.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if runtime.NumCPU() == 1 {
 			// we might lock up with only 1 proc if we mount
@@ -72,7 +91,9 @@ complete.`,
 			}
 		}
 
-		info("wr runner started for scheduler group '%s'", schedgrp)
+		if debugJobKey == "" {
+			info("wr runner started for scheduler group '%s'", schedgrp)
+		}
 
 		// the server receive timeout must be greater than the time we'll wait
 		// to Reserve()
@@ -88,7 +109,15 @@ complete.`,
 		if err != nil {
 			die("%s", err)
 		}
-		jq, err := jobqueue.Connect(rserver, caFile, rdomain, token, timeout)
+		// we may have been given the addresses of a primary manager and its
+		// standby, in which case we fail over to the standby when it takes over
+		servers := strings.Split(rserver, ",")
+		var jq *jobqueue.Client
+		if len(servers) > 1 {
+			jq, err = jobqueue.ConnectFailover(servers, caFile, rdomain, token, timeout)
+		} else {
+			jq, err = jobqueue.Connect(rserver, caFile, rdomain, token, timeout)
+		}
 		if err != nil {
 			die("%s", err)
 		}
@@ -103,12 +132,36 @@ complete.`,
 			jq.SetLogger(appLogger)
 		}
 
+		if debugJobKey != "" {
+			if config.ManagerNamespace != "" {
+				if err = jq.SetNamespace(config.ManagerNamespace); err != nil {
+					die("%s", err)
+				}
+			}
+			debugShell(jq, debugJobKey)
+			return
+		}
+
+		// we only ever update ourselves once, in case the manager gives us an
+		// exe that doesn't report the version it expects
+		if updatedExe := os.Getenv(runnerUpdatedEnvVar); updatedExe != "" {
+			info("wr runner updated itself to version %s", jobqueue.ServerVersion)
+			err = os.Remove(updatedExe)
+			if err != nil {
+				warn("failed to remove our updated exe: %s", err)
+			}
+		} else if jobqueue.ServerVersion != "" {
+			jq.SetRunnerVersion(jobqueue.ServerVersion)
+		}
+
+		jq.SetInputCache(config.RunnerInputCacheDir, int64(config.RunnerInputCacheSize)*1024*1024*1024)
+
 		// in case any job we execute has a Cmd that calls `wr add`, we will
 		// override their environment to make that call work
 		var envOverrides []string
 		var exePath string
 		if rserver != "" {
-			hostPort := strings.Split(rserver, ":")
+			hostPort := strings.Split(servers[0], ":")
 			if len(hostPort) == 2 {
 				envOverrides = append(envOverrides, "WR_MANAGERHOST="+hostPort[0])
 				envOverrides = append(envOverrides, "WR_MANAGERPORT="+hostPort[1])
@@ -153,6 +206,9 @@ complete.`,
 			}
 
 			if err != nil {
+				if errors.Is(err, jobqueue.ErrorRunnerUpdate) {
+					updateRunner(jq)
+				}
 				die("%s", err)
 			}
 			if job == nil {
@@ -219,6 +275,14 @@ complete.`,
 					} else if strings.Contains(jqerr.Err, jobqueue.ErrStopReserving) {
 						exitReason = "we reconnected to a new server"
 						break
+					} else if jqerr.Err == jobqueue.FailReasonPreempt {
+						// exit so that our resources can be used to run the
+						// job that preempted us
+						exitReason = "we were preempted by a higher priority job"
+						break
+					} else if jqerr.Err == jobqueue.FailReasonExclude {
+						exitReason = "our host was excluded"
+						break
 					}
 				}
 			} else {
@@ -230,6 +294,52 @@ complete.`,
 	},
 }
 
+// updateRunner gets the manager's version of our exe and replaces this process
+// with it, running it with the same arguments. It only returns if that fails.
+func updateRunner(jq *jobqueue.Client) {
+	exe, err := jq.GetRunnerExe()
+	if err != nil {
+		warn("failed to get the manager's runner exe: %s", err)
+		return
+	}
+
+	ourExe, err := osext.Executable()
+	if err != nil {
+		warn("failed to find our own exe: %s", err)
+		return
+	}
+
+	// we write the new exe next to our own (where it is most likely that we
+	// can execute things), or to the temp dir if we can't
+	name := fmt.Sprintf("%s.update.%d", filepath.Base(ourExe), os.Getpid())
+	var path string
+	for _, dir := range []string{filepath.Dir(ourExe), os.TempDir()} {
+		path = filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, exe, 0700) // #nosec it needs to be executable
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		warn("failed to write the manager's runner exe: %s", err)
+		return
+	}
+
+	err = jq.Disconnect()
+	if err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+
+	info("wr runner replacing itself with the manager's version")
+	args := append([]string{path}, os.Args[1:]...)
+	err = syscall.Exec(path, args, append(os.Environ(), runnerUpdatedEnvVar+"="+path)) // #nosec the exe is from our own manager
+	warn("failed to run the manager's runner exe: %s", err)
+	errr := os.Remove(path)
+	if errr != nil {
+		warn("failed to remove the manager's runner exe: %s", errr)
+	}
+}
+
 func init() {
 	RootCmd.AddCommand(runnerCmd)
 
@@ -238,7 +348,8 @@ func init() {
 	runnerCmd.Flags().IntVar(&timeoutintRunner, "timeout", 30, "how long (seconds) to wait to get a reply from 'wr manager'")
 	runnerCmd.Flags().IntVarP(&reserveint, "reserve_timeout", "r", 2, "how long (seconds) to wait for there to be a command in the queue, before exiting")
 	runnerCmd.Flags().IntVarP(&maxtime, "max_time", "m", 0, "maximum time (minutes) to run for before exiting; 0 means unlimited")
-	runnerCmd.Flags().StringVar(&rserver, "server", internal.DefaultServer(appLogger), "ip:port of wr manager")
+	runnerCmd.Flags().StringVar(&rserver, "server", internal.DefaultServer(appLogger), "ip:port of wr manager (or a comma separated list of those of a manager and its standby)")
 	runnerCmd.Flags().StringVar(&rdomain, "domain", internal.DefaultConfig(appLogger).ManagerCertDomain, "domain the manager's cert is valid for")
 	runnerCmd.Flags().BoolVar(&logToSyslog, "debug", false, "enable logging to syslog")
+	runnerCmd.Flags().StringVar(&debugJobKey, "debug_job", "", "instead of running commands, get a shell in the environment of the command with this key")
 }
@@ -0,0 +1,156 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var schedulePause string
+var scheduleResume string
+var scheduleCancel string
+
+// scheduleCmd represents the schedule command
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "See and control recurring commands",
+	Long: `See and control the recurring commands you added with a "schedule".
+
+Commands added with "wr add" that have a "schedule" option (a cron expression)
+are not run straight away, but are stored by the manager, which adds them to the
+queue each time their schedule triggers.
+
+With no options, this lists the recurring commands, showing their internal job
+id, schedule, report group, when they will next be added and when they were last
+added, how many times they have been added, and how many times they were
+skipped because the previous instance was still incomplete. The instances share
+the report group of the recurring command, so you can follow them with eg. "wr
+status -i [rep_grp]".
+
+--pause [id] stops the recurring command with that id from being added until you
+--resume [id] it (triggers missed while paused are not caught up).
+
+--cancel [id] permanently deletes the recurring command with that id. Instances
+that were already added are not affected; use "wr remove" on them if desired.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		set := 0
+		for _, key := range []string{schedulePause, scheduleResume, scheduleCancel} {
+			if key != "" {
+				set++
+			}
+		}
+		if set > 1 {
+			die("only one of --pause, --resume and --cancel can be used at once")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		switch {
+		case schedulePause != "":
+			err = jq.PauseSchedule(schedulePause)
+			if err != nil {
+				die("failed to pause the recurring command: %s", err)
+			}
+			info("Paused recurring command %s", schedulePause)
+			return
+		case scheduleResume != "":
+			err = jq.ResumeSchedule(scheduleResume)
+			if err != nil {
+				die("failed to resume the recurring command: %s", err)
+			}
+			info("Resumed recurring command %s", scheduleResume)
+			return
+		case scheduleCancel != "":
+			err = jq.CancelSchedule(scheduleCancel)
+			if err != nil {
+				die("failed to cancel the recurring command: %s", err)
+			}
+			info("Cancelled recurring command %s", scheduleCancel)
+			return
+		}
+
+		scheds, err := jq.GetSchedules()
+		if err != nil {
+			die("failed to get recurring commands: %s", err)
+		}
+		printSchedules(os.Stdout, scheds)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(scheduleCmd)
+
+	// flags specific to this sub-command
+	scheduleCmd.Flags().StringVar(&schedulePause, "pause", "", "id of a recurring command to pause")
+	scheduleCmd.Flags().StringVar(&scheduleResume, "resume", "", "id of a paused recurring command to resume")
+	scheduleCmd.Flags().StringVar(&scheduleCancel, "cancel", "", "id of a recurring command to permanently delete")
+	scheduleCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// printSchedules writes a table of the given recurring commands to w, followed
+// by their command lines.
+func printSchedules(w io.Writer, scheds []*jobqueue.Schedule) {
+	if len(scheds) == 0 {
+		fmt.Fprintln(w, "there are no recurring commands")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 2, 2, 3, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSCHEDULE\tREPGROUP\tNEXT\tLAST\tRUNS\tSKIPPED")
+	for _, sched := range scheds {
+		next := "paused"
+		if !sched.Paused {
+			next = formatScheduleTime(sched.Next)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", sched.Key, sched.Job.Schedule, sched.Job.RepGroup, next, formatScheduleTime(sched.Last), sched.Runs, sched.Skipped)
+	}
+	if err := tw.Flush(); err != nil {
+		warn("failed to write: %s", err)
+	}
+
+	fmt.Fprintln(w)
+	for _, sched := range scheds {
+		fmt.Fprintf(w, "%s: %s\n", sched.Key, sched.Job.Cmd)
+	}
+}
+
+// formatScheduleTime formats the given time for printSchedules(), with zero
+// times shown as "-".
+func formatScheduleTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
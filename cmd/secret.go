@@ -0,0 +1,123 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var secretSet string
+var secretDelete string
+
+// secretCmd represents the secret command
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Store secrets that commands can use",
+	Long: `Store secrets, such as database passwords, that commands can use.
+
+Secrets are stored in the manager's database, encrypted with the key in the
+managersecretkeyfile config option (which is created for you if it doesn't
+exist; keep it safe, since secrets can't be recovered without it).
+
+--set stores a secret with the given name, replacing any existing one. The
+value is read from STDIN (so that it doesn't end up in your shell history or
+process list), eg:
+echo -n "my password" | wr secret --set db_pass
+
+Commands use secrets by being added with eg.
+'wr add --env_secrets DB_PASS=db_pass', which sets the DB_PASS environment
+variable of the command to the secret's value. The value is only ever given to
+the runner running the command, is never displayed by wr, and is replaced with
+<redacted> in the command's STDOUT and STDERR.
+
+Secrets belong to the user that stored them: only that user's commands can use
+them, and only that user (or an admin) can replace or delete them.
+
+--delete forgets the named secret. Commands that use it and haven't run yet
+will be buried when they try to run.
+
+Without options, the names of the stored secrets you can use are listed (their
+values can never be retrieved).`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if secretSet != "" && secretDelete != "" {
+			die("--set and --delete are mutually exclusive")
+		}
+
+		var value string
+		if secretSet != "" {
+			b, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				die("failed to read the secret value from STDIN: %s", err)
+			}
+			value = strings.TrimSuffix(string(b), "\n")
+			if value == "" {
+				die("no secret value was supplied on STDIN")
+			}
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		switch {
+		case secretSet != "":
+			err = jq.SetSecret(secretSet, value)
+			if err != nil {
+				die("%s", err)
+			}
+			info("secret %s stored", secretSet)
+		case secretDelete != "":
+			err = jq.DeleteSecret(secretDelete)
+			if err != nil {
+				die("%s", err)
+			}
+			info("secret %s deleted", secretDelete)
+		default:
+			names, errg := jq.GetSecrets()
+			if errg != nil {
+				die("%s", errg)
+			}
+			for _, name := range names {
+				fmt.Println(name)
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(secretCmd)
+
+	// flags specific to this sub-command
+	secretCmd.Flags().StringVar(&secretSet, "set", "", "name of a secret to store, with its value read from STDIN")
+	secretCmd.Flags().StringVar(&secretDelete, "delete", "", "name of a secret to forget")
+	secretCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -0,0 +1,191 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var simHosts int
+var simCores float64
+var simMem string
+var simStartup string
+var simCost float64
+var simLimits string
+
+// simulateCmd represents the simulate command
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Predict how long commands would take with different settings",
+	Long: `Predict how long a workload would take to run, and what it would cost,
+given some hypothetical hardware and limit group settings, so that you can
+evaluate changes before making them for real.
+
+The workload is either the commands currently in the queue (-a), or the commands
+in a report group (-i, which can be combined with -z or --match as in
+"wr status"). In the latter case, completed commands are included, so you can
+replay a workload you ran previously. Completed commands are taken to run for as
+long as they actually did; other commands are taken to run for as long as they
+are expected to, which is what "wr status" reports as their "Expected time".
+Likewise, they are taken to need the memory and cpus that "wr status" reports.
+
+Commands are "run" in priority order as soon as their dependencies are complete
+and there is space for them on a host and within their limit groups. Hosts each
+have --cores cpus and --memory memory, take --startup time to become usable
+after being started, and are stopped as soon as they become idle. There can be
+at most --hosts running at once (0 means unlimited).
+
+--limits lets you try out different limits for limit groups, eg.
+"gatk:10,irods:5". A limit of -1 makes the group unlimited. Groups you don't
+specify get their current limit.
+
+The predicted time until all the commands complete (the makespan) is reported,
+along with the number of hosts needed and, if you specify the --cost per hour of
+having a host running, the predicted cost. Commands that could never run with
+the given settings (eg. because they need more memory than a host has) are
+reported as unschedulable.
+
+Note that the prediction ignores things like disk space, the time taken to
+transfer data and failed commands being retried, so treat the results as a
+rough guide to the relative merits of different settings.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cmdAll == (cmdIDStatus != "") {
+			die("1 of -i or -a is required")
+		}
+		if simCores <= 0 {
+			die("--cores must be specified")
+		}
+		if simMem == "" {
+			die("--memory must be specified")
+		}
+		mb, err := bytefmt.ToMegabytes(simMem)
+		if err != nil {
+			die("--memory was not specified correctly: %s", err)
+		}
+		startup, err := time.ParseDuration(simStartup)
+		if err != nil {
+			die("--startup was not specified correctly: %s", err)
+		}
+		if simHosts < 0 {
+			die("--hosts can't be negative")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		jobs := getJobs(jq, "", cmdAll, 0, false, false)
+		if len(jobs) == 0 {
+			die("No matching jobs found")
+		}
+
+		result, err := jobqueue.Simulate(jobs, jobqueue.SimulationConfig{
+			Hosts:           simHosts,
+			HostCores:       simCores,
+			HostRAM:         int(mb),
+			HostStartup:     startup,
+			CostPerHostHour: simCost,
+			Limits:          simulationLimits(jq, jobs),
+		})
+		if err != nil {
+			die("simulation failed: %s", err)
+		}
+
+		fmt.Printf("Commands: %d", result.Jobs)
+		if result.Unschedulable > 0 {
+			fmt.Printf(" (+%d unschedulable)", result.Unschedulable)
+		}
+		fmt.Printf("\nMakespan: %s\nPeak hosts: %d\nHost hours: %.2f\nCore hours: %.2f\n",
+			result.Makespan.Round(time.Second), result.PeakHosts, result.HostHours, result.CoreHours)
+		if simCost > 0 {
+			fmt.Printf("Cost: %.2f\n", result.Cost)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(simulateCmd)
+
+	// flags specific to this sub-command
+	simulateCmd.Flags().BoolVarP(&cmdAll, "all", "a", false, "simulate all commands currently in the queue")
+	simulateCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to simulate")
+	simulateCmd.Flags().BoolVarP(&cmdIDIsSubStr, "search", "z", false, "treat -i as a substring to match against all report groups")
+	simulateCmd.Flags().StringVar(&cmdIDMatch, "match", "", "['glob','regex'] treat -i as a pattern to match against all report groups")
+	simulateCmd.Flags().IntVar(&simHosts, "hosts", 0, "maximum number of hosts running at once (0 means unlimited)")
+	simulateCmd.Flags().Float64Var(&simCores, "cores", 0, "number of cpu cores each host has")
+	simulateCmd.Flags().StringVar(&simMem, "memory", "", "memory each host has [specify units such as M for Megabytes or G for Gigabytes]")
+	simulateCmd.Flags().StringVar(&simStartup, "startup", "0s", "time it takes for a new host to become usable [specify units such as s for seconds or m for minutes]")
+	simulateCmd.Flags().Float64Var(&simCost, "cost", 0, "cost of having a host running for an hour")
+	simulateCmd.Flags().StringVar(&simLimits, "limits", "", "comma separated group:limit limits to use for limit groups")
+
+	simulateCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// simulationLimits returns the limits of the limit groups of the given jobs,
+// using those specified by --limits, or else the current limits.
+func simulationLimits(jq *jobqueue.Client, jobs []*jobqueue.Job) map[string]int {
+	limits := make(map[string]int)
+	if simLimits != "" {
+		for _, spec := range strings.Split(simLimits, ",") {
+			parts := strings.Split(strings.TrimSpace(spec), ":")
+			if len(parts) != 2 || parts[0] == "" {
+				die("--limits was not specified correctly: %s is not in the form group:limit", spec)
+			}
+			limit, err := strconv.Atoi(parts[1])
+			if err != nil {
+				die("--limits was not specified correctly: %s", err)
+			}
+			limits[parts[0]] = limit
+		}
+	}
+
+	for _, job := range jobs {
+		for _, group := range job.LimitGroups {
+			name := strings.Split(group, "*")[0]
+			if _, done := limits[name]; done {
+				continue
+			}
+			limit, err := jq.GetOrSetLimitGroup(name)
+			if err != nil {
+				die("failed to get the limit of group %s: %s", name, err)
+			}
+			limits[name] = limit
+		}
+	}
+
+	for name, limit := range limits {
+		if limit < 0 {
+			delete(limits, name)
+		}
+	}
+	return limits
+}
@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -39,13 +40,30 @@ const allRepGrps = "all above"
 var cmdFileStatus string
 var cmdIDStatus string
 var cmdIDIsSubStr bool
+var cmdIDMatch string
 var cmdIDIsInternal bool
 var cmdLine string
 var showBuried bool
+var showTrashed bool
 var showStd bool
 var showEnv bool
 var outputFormat string
 var statusLimit int
+var statusMeta []string
+var statusTags []string
+var statusGroupByTag string
+var statusOffset int
+var statusHost string
+var statusExitcode string
+var statusContains string
+var statusSince time.Duration
+var statusUntil time.Duration
+var statusTail string
+var statusOutputs string
+var statusFetch string
+var statusHosts bool
+var statusExport string
+var statusExportBy string
 
 // statusCmd represents the status command
 var statusCmd = &cobra.Command{
@@ -62,7 +80,74 @@ incomplete commands.
 you want the status of now. Combining with -z lets you get the status of jobs
 in multiple report groups, assuming you have arranged that related groups share
 some substring. Alternatively -y lets you specify -i as the internal job id
-reported when using this command.
+reported when using this command, or as the name you gave the job when adding
+it.
+
+--match glob or --match regex instead treats -i as a glob pattern (eg.
+"myproj.*.align") or regular expression (eg. "^myproj\.\d+\.align$") that
+report groups must match, letting you work with any set of related groups at
+once.
+
+--meta field=value (which you can supply multiple times) only shows the status
+of commands whose metadata (the "metadata" option of "wr add") has the given
+value for the given field. Use dots to refer to fields of nested objects, eg.
+--meta sample.id=42. This is in addition to your choice of -f, -l or -i.
+
+--tag key=value (which you can supply multiple times) only shows the status of
+commands that have the given tag (the "tags" option of "wr add"). It works in
+default or -i mode; in default mode you get the status of all the commands with
+those tags, including complete ones, not just the incomplete ones. In -o s
+mode, --group_by_tag key summarises commands by their value of the given tag
+key, instead of by report group.
+
+--trashed instead shows the commands you removed with "wr remove" that are
+still in the manager's trash (see the managertrashperiod config option), and so
+can be restored with "wr remove --undo". It can be combined with -i (and -z or
+-y); without -i you see everything in the trash.
+
+In default or -i mode (but not with --match) you can also narrow down the
+commands with --host (only those that ran on that host), --exitcode (only those
+that exited with that code, or with a code in a range like 1-127), --contains
+(only those whose command line contains that text) and --since and --until
+(only those that ended, or if still running started, between those durations
+ago, eg. --since 2h --until 30m). When there are thousands of failed commands,
+--offset lets you page through them: in -o d mode it skips that many commands
+in each group before showing --limit of them, so that eg. --limit 20 --offset
+20 shows the second page of 20.
+
+--outputs instead lists the output files recorded for the complete commands
+in the given report group (or with -y, for the command with the given internal
+job id or name; -z and --match also work as for -i): those matching the
+"outputs" option of "wr add", those the command listed in the file named by
+$WR_OUTPUTS_FILE while running, those found by a "record_outputs" behaviour,
+and any registered after the command completed. Each is shown with its size,
+MD5 checksum and, if it was written to a writable mount, the remote location it
+was uploaded to. Adding --fetch <dir> also downloads them in to <dir>/<internal
+job id>/<original path>: files that were uploaded to S3 are fetched from there
+(using the credentials of the mount they were written to), and others are
+fetched via the manager, which only works if they are readable from the
+manager's host.
+
+--hosts instead shows the utilisation of the hosts that are running commands
+(and of idle hosts the manager knows about, such as cloud servers): for each,
+its cloud flavor, how many commands it is running, the cores and memory those
+commands reserved out of the host's capacity, and its load and memory use as
+recently reported by its runners, followed by the totals and the number of
+hosts of each flavor. See "wr top" for a live view that includes the commands.
+
+--export csv or --export json instead outputs a report of the resources
+consumed by the complete commands of each user, report group and requirements
+group, eg. for accounting: the number of commands, their total CPU hours and
+wall-clock hours, the peak memory (MB) used by any of them, the core hours they
+reserved and the wall-clock hours of those that ran on cloud instances. Only
+commands that completed in the current month are included, unless you specify
+--since and --until (eg. --since 720h for the last 30 days). --export_by lets
+you group by only some of user, repgroup and reqgroup, eg. --export_by user.
+
+--tail instead follows the output of the running command with the given
+internal job id (or name), printing its STDOUT and STDERR as it arrives (after
+a short delay) until it stops running, so you can watch long-running commands
+live.
 
 The file to provide -f is in the format taken by "wr add".
 
@@ -78,9 +163,11 @@ name to just the first letter, eg. -o c):
   "summary" shows the counts broken down by report group, along with the mean
     (and standard deviation) resource usage of completed jobs in each report
     group, and the internal identifiers of any buried jobs, broken down by exit
-    code+failure reason.
+    code+failure reason. Report groups with incomplete jobs also show how many
+    jobs per hour have recently been completing, and when the rest are
+    expected to finish at that rate.
   "details" groups jobs with the same state, reason for failure and exitcode
-    together and shows the complete details of --limit random jobs in each group
+    together and shows the complete details of --limit jobs in each group
     (and you are told how many are not being displayed). A limit of 0 turns off
     grouping and shows all your desired commands individually, but you could hit
     a timeout if retrieving the details of very many (tens of thousands+)
@@ -111,17 +198,67 @@ name to just the first letter, eg. -o c):
 			}
 		}()
 
+		if statusTail != "" {
+			tailJob(jq, statusTail)
+			return
+		}
+
+		if statusHosts {
+			showResources(jq)
+			return
+		}
+
+		if statusExport != "" {
+			exportUsage(jq, statusExport, statusExportBy)
+			return
+		}
+
+		if statusOutputs != "" {
+			if set > 0 {
+				die("--outputs can't be combined with -f, -i or -l")
+			}
+			cmdIDStatus = statusOutputs
+			showOutputs(jq, getJobs(jq, jobqueue.JobStateComplete, false, 0, false, false), statusFetch)
+			return
+		} else if statusFetch != "" {
+			die("--fetch only works with --outputs")
+		}
+
 		if outputFormat != "details" && outputFormat != "d" {
 			statusLimit = 0
 			showStd = false
 			showEnv = false
 		}
-		jobs := getJobs(jq, cmdState, set == 0, statusLimit, showStd, showEnv)
+		metaFilters := parseMetaFilters(statusMeta)
+		if len(metaFilters) > 0 {
+			// we filter client-side, so can't let the server group jobs
+			statusLimit = 0
+		}
+		var jobs []*jobqueue.Job
+		if showTrashed {
+			jobs = getTrashedJobs(jq)
+		} else {
+			filter := statusJobFilter()
+			if filter != nil {
+				jobs = getFilteredJobs(jq, cmdState, set == 0, statusLimit, filter, showStd, showEnv)
+			} else {
+				jobs = getJobs(jq, cmdState, set == 0, statusLimit, showStd, showEnv)
+			}
+		}
+		if len(metaFilters) > 0 {
+			var matching []*jobqueue.Job
+			for _, job := range jobs {
+				if job.MetadataMatches(metaFilters) {
+					matching = append(matching, job)
+				}
+			}
+			jobs = matching
+		}
 		showextra := cmdFileStatus == ""
 
 		switch outputFormat {
 		case "counts", "c":
-			var d, re, b, ru, l, c, dep int
+			var d, re, b, ru, l, c, dep, t int
 			for _, job := range jobs {
 				switch job.State {
 				case jobqueue.JobStateDelayed:
@@ -138,9 +275,14 @@ name to just the first letter, eg. -o c):
 					c += 1 + job.Similar
 				case jobqueue.JobStateDependent:
 					dep += 1 + job.Similar
+				case jobqueue.JobStateTrashed:
+					t += 1 + job.Similar
 				}
 			}
 			fmt.Printf("complete: %d\nrunning: %d\nready: %d\ndependent: %d\nlost contact: %d\ndelayed: %d\nburied: %d\n", c, ru, re, dep, l, d, b)
+			if showTrashed {
+				fmt.Printf("trashed: %d\n", t)
+			}
 		case "plain", "p":
 			buried := false
 			for _, job := range jobs {
@@ -163,39 +305,40 @@ name to just the first letter, eg. -o c):
 			startends := make(map[string][]time.Time)
 			counts[allRepGrps] = make(map[jobqueue.JobState]int)
 			for _, job := range jobs {
-				if _, exists := counts[job.RepGroup]; !exists {
-					counts[job.RepGroup] = make(map[jobqueue.JobState]int)
+				rg := summaryGroup(job)
+				if _, exists := counts[rg]; !exists {
+					counts[rg] = make(map[jobqueue.JobState]int)
 				}
 				state := job.State
 				if state == jobqueue.JobStateReserved {
 					state = jobqueue.JobStateRunning
 				}
-				counts[job.RepGroup][job.State]++
+				counts[rg][job.State]++
 				counts[allRepGrps][job.State]++
 
 				if state == jobqueue.JobStateBuried {
-					if _, exists := buried[job.RepGroup]; !exists {
-						buried[job.RepGroup] = make(map[string][]string)
+					if _, exists := buried[rg]; !exists {
+						buried[rg] = make(map[string][]string)
 					}
 					group := fmt.Sprintf("exitcode.%d,\"%s\"", job.Exitcode, job.FailReason)
-					buried[job.RepGroup][group] = append(buried[job.RepGroup][group], job.Key())
+					buried[rg][group] = append(buried[rg][group], job.Key())
 				} else if state == jobqueue.JobStateComplete {
-					if _, exists := memory[job.RepGroup]; !exists {
-						memory[job.RepGroup] = runningvariance.NewRunningStat()
-						disk[job.RepGroup] = runningvariance.NewRunningStat()
-						walltime[job.RepGroup] = runningvariance.NewRunningStat()
-						cputime[job.RepGroup] = runningvariance.NewRunningStat()
-						startends[job.RepGroup] = []time.Time{job.StartTime, job.EndTime}
+					if _, exists := memory[rg]; !exists {
+						memory[rg] = runningvariance.NewRunningStat()
+						disk[rg] = runningvariance.NewRunningStat()
+						walltime[rg] = runningvariance.NewRunningStat()
+						cputime[rg] = runningvariance.NewRunningStat()
+						startends[rg] = []time.Time{job.StartTime, job.EndTime}
 					}
-					memory[job.RepGroup].Push(float64(job.PeakRAM))
-					disk[job.RepGroup].Push(float64(job.PeakDisk))
-					walltime[job.RepGroup].Push(float64(job.WallTime()))
-					cputime[job.RepGroup].Push(float64(job.CPUtime))
-					if job.StartTime.Before(startends[job.RepGroup][0]) {
-						startends[job.RepGroup][0] = job.StartTime
+					memory[rg].Push(float64(job.PeakRAM))
+					disk[rg].Push(float64(job.PeakDisk))
+					walltime[rg].Push(float64(job.WallTime()))
+					cputime[rg].Push(float64(job.CPUtime))
+					if job.StartTime.Before(startends[rg][0]) {
+						startends[rg][0] = job.StartTime
 					}
-					if job.EndTime.After(startends[job.RepGroup][1]) {
-						startends[job.RepGroup][1] = job.EndTime
+					if job.EndTime.After(startends[rg][1]) {
+						startends[rg][1] = job.EndTime
 					}
 
 					if _, exists := memory[allRepGrps]; !exists {
@@ -227,6 +370,30 @@ name to just the first letter, eg. -o c):
 			}
 			sort.Strings(rgs)
 
+			// get the throughput and ETA of the report groups with jobs
+			// still to complete
+			progress := make(map[string]*jobqueue.RepGroupProgress)
+			if statusGroupByTag == "" && !showTrashed {
+				var active []string
+				for _, rg := range rgs {
+					for state, count := range counts[rg] {
+						if state != jobqueue.JobStateComplete && count > 0 {
+							active = append(active, rg)
+							break
+						}
+					}
+				}
+				if len(active) > 0 {
+					rgps, errp := jq.GetRepGroupProgress(active)
+					if errp != nil {
+						warn("could not get the progress of report groups: %s", errp)
+					}
+					for _, rgp := range rgps {
+						progress[rgp.RepGroup] = rgp
+					}
+				}
+			}
+
 			if len(rgs) > 1 {
 				rgs = append(rgs, allRepGrps)
 				counts[allRepGrps] = all
@@ -243,6 +410,13 @@ name to just the first letter, eg. -o c):
 					}
 				}
 
+				if rgp, exists := progress[rg]; exists && rgp.Throughput > 0 {
+					usage += fmt.Sprintf(" throughput=%.1f/h", rgp.Throughput)
+					if !rgp.ETA.IsZero() {
+						usage += fmt.Sprintf(" eta=%s(in %s)", rgp.ETA.Format(shortTimeFormat), time.Until(rgp.ETA).Round(time.Second))
+					}
+				}
+
 				var dead string
 				if counts[rg][jobqueue.JobStateBuried] > 0 {
 					// sort the bury groups
@@ -263,6 +437,22 @@ name to just the first letter, eg. -o c):
 			// print out status information for each job
 			for _, job := range jobs {
 				cwd := job.Cwd
+				var name string
+				if job.Name != "" {
+					name = fmt.Sprintf("Name: %s\n", job.Name)
+				}
+				var metadata string
+				if len(job.Metadata) > 0 {
+					metadata = fmt.Sprintf("Metadata: %s\n", job.Metadata)
+				}
+				if len(job.Tags) > 0 {
+					tags := make([]string, 0, len(job.Tags))
+					for key, val := range job.Tags {
+						tags = append(tags, key+"="+val)
+					}
+					sort.Strings(tags)
+					metadata += fmt.Sprintf("Tags: %s\n", strings.Join(tags, ","))
+				}
 				var mounts string
 				if len(job.MountConfigs) > 0 {
 					mounts = fmt.Sprintf("Mounts: %s\n", job.MountConfigs)
@@ -286,9 +476,28 @@ name to just the first letter, eg. -o c):
 					}
 					dockerMonitored = fmt.Sprintf("Docker container monitoring turned on for: %s\n", dockerID)
 				}
+				if job.ContainerImage != "" {
+					runtime := job.ContainerRuntime
+					if runtime == "" {
+						runtime = jobqueue.ContainerRuntimeDocker
+					}
+					dockerMonitored += fmt.Sprintf("Runs in %s container: %s\n", runtime, job.ContainerImage)
+				}
+				var network string
+				if job.Network > 0 {
+					capped := ""
+					if job.NetworkCap {
+						capped = " (outgoing capped)"
+					}
+					network = fmt.Sprintf("Expected network bandwidth: %dMbit/s%s\n", job.Network, capped)
+				}
 				var behaviours string
 				if len(job.Behaviours) > 0 {
-					behaviours = fmt.Sprintf("Behaviours: %s\n", job.Behaviours)
+					var tries string
+					if job.BehaviourTries > 0 {
+						tries = fmt.Sprintf(" (%d tries when last triggered)", job.BehaviourTries)
+					}
+					behaviours = fmt.Sprintf("Behaviours: %s%s\n", job.Behaviours, tries)
 				}
 				var other string
 				if len(job.Requirements.Other) > 0 {
@@ -298,11 +507,16 @@ name to just the first letter, eg. -o c):
 					}
 					other = fmt.Sprintf("Resource requirements: %s\n", strings.Join(others, ", "))
 				}
-				fmt.Printf("\n# %s\nCwd: %s\n%s%s%s%s%sId: %s (%s); Requirements group: %s; %sPriority: %d; Attempts: %d\nExpected requirements: { memory: %dMB; time: %s; cpus: %s disk: %dGB }\n", job.Cmd, cwd, mounts, homeChanged, dockerMonitored, behaviours, other, job.RepGroup, job.Key(), job.ReqGroup, limitGroups, job.Priority, job.Attempts, job.Requirements.RAM, job.Requirements.Time, strconv.FormatFloat(job.Requirements.Cores, 'f', -1, 64), job.Requirements.Disk)
+				fmt.Printf("\n# %s\nCwd: %s\n%s%s%s%s%s%s%s%sId: %s (%s); Requirements group: %s; %sPriority: %d; Attempts: %d\nExpected requirements: { memory: %dMB; time: %s; cpus: %s disk: %dGB }\n", job.Cmd, cwd, name, metadata, mounts, homeChanged, dockerMonitored, network, behaviours, other, job.RepGroup, job.Key(), job.ReqGroup, limitGroups, job.Priority, job.Attempts, job.Requirements.RAM, job.Requirements.Time, strconv.FormatFloat(job.Requirements.Cores, 'f', -1, 64), job.Requirements.Disk)
 
 				switch job.State {
 				case jobqueue.JobStateDelayed:
-					fmt.Printf("Status: delayed following a temporary problem, will become ready soon (attempted at %s)\n", job.StartTime.Format(shortTimeFormat))
+					if len(job.PendingReasons) > 0 {
+						// (the reasons explain why it was delayed)
+						fmt.Println("Status: delayed")
+					} else {
+						fmt.Printf("Status: delayed following a temporary problem, will become ready soon (attempted at %s)\n", job.StartTime.Format(shortTimeFormat))
+					}
 				case jobqueue.JobStateReady:
 					fmt.Println("Status: ready to be picked up by a `wr runner`")
 				case jobqueue.JobStateDependent:
@@ -321,6 +535,10 @@ name to just the first letter, eg. -o c):
 					fmt.Printf("Previous problem: %s\n", job.FailReason)
 				}
 
+				for _, reason := range job.PendingReasons {
+					fmt.Printf("Pending because: %s\n", reason)
+				}
+
 				var hostID string
 				if job.HostID != "" {
 					hostID = ", ID: " + job.HostID
@@ -356,6 +574,12 @@ name to just the first letter, eg. -o c):
 					// Peak memory during a run... but is that possible/ too
 					// expensive? Maybe we could communicate directly with the
 					// runner?...
+					if job.LostReason != "" {
+						fmt.Printf("Lost: %s\n", job.LostReason)
+					}
+					if job.LostReport != nil {
+						printLostReport(job.LostReport)
+					}
 				} else if showextra && showStd {
 					// it's possible for jobs that got buried before they even
 					// ran to have details of the bury in their stderr
@@ -365,6 +589,19 @@ name to just the first letter, eg. -o c):
 					}
 				}
 
+				for i, step := range job.Steps {
+					stepStatus := "not yet run"
+					if i < len(job.StepResults) {
+						result := job.StepResults[i]
+						if result.Exited {
+							stepStatus = fmt.Sprintf("Exit code: %d; Wall time: %s", result.Exitcode, result.WallTime())
+						} else {
+							stepStatus = "did not exit"
+						}
+					}
+					fmt.Printf("Step %d: %s { %s }\n", i+1, step, stepStatus)
+				}
+
 				if showextra && showEnv {
 					env, erre := job.Env()
 					if erre != nil {
@@ -420,16 +657,33 @@ func init() {
 	statusCmd.Flags().StringVarP(&cmdFileStatus, "file", "f", "", "file containing commands you want the status of; - means read from STDIN")
 	statusCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want the status of")
 	statusCmd.Flags().BoolVarP(&cmdIDIsSubStr, "search", "z", false, "treat -i as a substring to match against all report groups")
-	statusCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id")
+	statusCmd.Flags().StringVar(&cmdIDMatch, "match", "", "['glob','regex'] treat -i as a pattern to match against all report groups")
+	statusCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id or job name")
 	statusCmd.Flags().StringVarP(&cmdLine, "cmdline", "l", "", "a command line you want the status of")
 	statusCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "working dir that the command(s) specified by -l or -f were set to run in")
 	statusCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mounts that the command(s) specified by -l or -f were set to use (JSON format)")
 	statusCmd.Flags().StringVar(&mountSimple, "mounts", "", "mounts that the command(s) specified by -l or -f were set to use (simple format)")
 	statusCmd.Flags().BoolVarP(&showBuried, "buried", "b", false, "in default or -i mode only, only show the status of buried commands")
+	statusCmd.Flags().BoolVar(&showTrashed, "trashed", false, "show removed commands that are still in the trash, instead of queued ones")
 	statusCmd.Flags().BoolVarP(&showStd, "std", "s", false, "in -o d mode, except in -f mode, also show the most recent STDOUT and STDERR of incomplete commands")
 	statusCmd.Flags().BoolVarP(&showEnv, "env", "e", false, "in -o d mode, except in -f mode, also show the environment variables the command(s) ran with")
 	statusCmd.Flags().StringVarP(&outputFormat, "output", "o", "details", "['counts','summary','details','json'] output format")
 	statusCmd.Flags().IntVar(&statusLimit, "limit", 1, "in -o d mode, number of commands that share the same properties to display; 0 displays all")
+	statusCmd.Flags().IntVar(&statusOffset, "offset", 0, "in default or -i mode, skip this many commands (in each group in -o d mode)")
+	statusCmd.Flags().StringVar(&statusHost, "host", "", "in default or -i mode, only show commands that ran on this host")
+	statusCmd.Flags().StringVar(&statusExitcode, "exitcode", "", "in default or -i mode, only show commands that exited with this code, or a code in this range (eg. 1-127)")
+	statusCmd.Flags().StringVar(&statusContains, "contains", "", "in default or -i mode, only show commands whose command line contains this")
+	statusCmd.Flags().DurationVar(&statusSince, "since", 0, "in default or -i mode, only show commands that ended (or started) less than this long ago")
+	statusCmd.Flags().DurationVar(&statusUntil, "until", 0, "in default or -i mode, only show commands that ended (or started) more than this long ago")
+	statusCmd.Flags().StringVar(&statusTail, "tail", "", "internal job id or name of a running command to follow the output of")
+	statusCmd.Flags().BoolVar(&statusHosts, "hosts", false, "show the utilisation of the hosts running commands instead")
+	statusCmd.Flags().StringVar(&statusExport, "export", "", "['csv','json'] output a report of the resources used by complete commands instead")
+	statusCmd.Flags().StringVar(&statusExportBy, "export_by", "user,repgroup,reqgroup", "with --export, comma separated properties to group commands by")
+	statusCmd.Flags().StringVar(&statusOutputs, "outputs", "", "report group (or with -y, internal job id or name) of complete commands to list the output files of")
+	statusCmd.Flags().StringVar(&statusFetch, "fetch", "", "with --outputs, download the output files in to this directory")
+	statusCmd.Flags().StringArrayVar(&statusMeta, "meta", nil, "field=value that the metadata of commands must have (can be repeated)")
+	statusCmd.Flags().StringArrayVar(&statusTags, "tag", nil, "in default or -i mode, key=value tag that commands must have (can be repeated)")
+	statusCmd.Flags().StringVar(&statusGroupByTag, "group_by_tag", "", "in -o s mode, group commands by their value of this tag key instead of by report group")
 
 	statusCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 }
@@ -451,6 +705,206 @@ func countGetJobArgs() int {
 	return set
 }
 
+// tailJob prints the output of the running job with the given key (or name)
+// as it arrives, until it stops running.
+func tailJob(jq *jobqueue.Client, key string) {
+	notRunning := func() {
+		die("%s is not running; see its final output with: wr status -i %s -y -s", key, key)
+	}
+
+	var outOffset, errOffset int64
+	for first := true; ; first = false {
+		tail, err := jq.GetTail(key, outOffset, errOffset)
+		if err != nil {
+			if jqerr, ok := err.(jobqueue.Error); ok && jqerr.Err == jobqueue.ErrBadJob {
+				notRunning()
+			}
+			die("failed to get the output of %s: %s", key, err)
+		}
+		if first && !tail.Running {
+			notRunning()
+		}
+
+		_, err = os.Stdout.Write(tail.StdOut)
+		if err == nil {
+			_, err = os.Stderr.Write(tail.StdErr)
+		}
+		if err != nil {
+			die("failed to write output: %s", err)
+		}
+		outOffset, errOffset = tail.StdOutOffset, tail.StdErrOffset
+
+		if !tail.Running {
+			info("%s is no longer running", key)
+			return
+		}
+		<-time.After(jobqueue.ServerTailInterval)
+	}
+}
+
+// showOutputs prints the Artifacts of the given complete jobs, and if fetchDir
+// isn't blank, downloads them in to it.
+func showOutputs(jq *jobqueue.Client, jobs []*jobqueue.Job, fetchDir string) {
+	if len(jobs) == 0 {
+		die("no complete commands were found")
+	}
+
+	var failed int
+	for _, job := range jobs {
+		fmt.Printf("# %s (%s)\n", job.Cmd, job.Key())
+		if len(job.Artifacts) == 0 {
+			fmt.Println("[no outputs recorded]")
+			continue
+		}
+
+		for _, a := range job.Artifacts {
+			var remote string
+			if a.Remote != "" {
+				remote = "\t" + a.Remote
+			}
+			fmt.Printf("%s\t%d\t%s%s\n", a.Path, a.Size, a.MD5, remote)
+
+			if fetchDir == "" {
+				continue
+			}
+			if err := fetchOutput(jq, job, a, filepath.Join(fetchDir, job.Key(), a.Path)); err != nil {
+				warn("failed to fetch %s: %s", a.Path, err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		die("%d output files could not be fetched", failed)
+	}
+}
+
+// fetchOutput downloads the given Artifact of the given job to the given local
+// path, from S3 if it was uploaded there, otherwise via the manager.
+func fetchOutput(jq *jobqueue.Client, job *jobqueue.Job, a *jobqueue.Artifact, local string) error {
+	if err := os.MkdirAll(filepath.Dir(local), os.ModePerm); err != nil {
+		return err
+	}
+
+	if a.Remote != "" {
+		err := job.DownloadRemoteArtifact(a, local)
+		if err == nil {
+			return nil
+		}
+		warn("fetching %s from %s failed (%s); will try via the manager", a.Path, a.Remote, err)
+	}
+	return jq.DownloadArtifact(job.Key(), a.Path, local)
+}
+
+// statusJobFilter returns a JobFilter made from the user's filtering options,
+// or nil if they didn't supply any.
+func statusJobFilter() *jobqueue.JobFilter {
+	filter := &jobqueue.JobFilter{
+		Offset: statusOffset,
+		Host:   statusHost,
+		Cmd:    statusContains,
+	}
+
+	if statusExitcode != "" {
+		minCode, maxCode, err := parseExitcodeRange(statusExitcode)
+		if err != nil {
+			die("bad --exitcode: %s", err)
+		}
+		filter.MinExitcode, filter.MaxExitcode = &minCode, &maxCode
+	}
+
+	now := time.Now()
+	if statusSince > 0 {
+		filter.After = now.Add(-statusSince)
+	}
+	if statusUntil > 0 {
+		filter.Before = now.Add(-statusUntil)
+	}
+
+	if len(statusTags) > 0 {
+		filter.Tags = parseKeyValues("--tag", statusTags)
+	}
+
+	if filter.IsEmpty() {
+		return nil
+	}
+	return filter
+}
+
+// parseExitcodeRange parses an exit code like "1", or a range like "1-127",
+// returning the inclusive minimum and maximum of the range.
+func parseExitcodeRange(codes string) (int, int, error) {
+	minStr, maxStr := codes, codes
+	if i := strings.Index(codes[1:], "-"); i != -1 {
+		minStr, maxStr = codes[:i+1], codes[i+2:]
+	}
+	min, err := strconv.Atoi(minStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.Atoi(maxStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if max < min {
+		return 0, 0, fmt.Errorf("%d is less than %d", max, min)
+	}
+	return min, max, nil
+}
+
+// getFilteredJobs is like getJobs(), but only gets jobs that pass the given
+// filter, which only works in default or -i mode.
+func getFilteredJobs(jq *jobqueue.Client, cmdState jobqueue.JobState, all bool, statusLimit int, filter *jobqueue.JobFilter, showStd, showEnv bool) []*jobqueue.Job {
+	if !all && (cmdIDStatus == "" || cmdIDIsInternal || cmdIDMatch != "") {
+		die("--offset, --host, --exitcode, --contains, --since, --until and --tag only work in default or -i mode, without -y or --match")
+	}
+
+	var jobs []*jobqueue.Job
+	var err error
+	switch {
+	case all && len(filter.Tags) > 0:
+		jobs, err = jq.GetByTags(filter.Tags, statusLimit, cmdState, filter, showStd, showEnv)
+	case all:
+		jobs, err = jq.GetIncompleteFiltered(statusLimit, cmdState, filter, showStd, showEnv)
+	default:
+		jobs, err = jq.GetByRepGroupFiltered(cmdIDStatus, cmdIDIsSubStr, statusLimit, cmdState, filter, showStd, showEnv)
+	}
+	if err != nil {
+		die("failed to get jobs corresponding to your settings: %s", err)
+	}
+	return jobs
+}
+
+// getTrashedJobs gets the jobs in the manager's trash, limited to those
+// matching the user's -i option, if supplied.
+func getTrashedJobs(jq *jobqueue.Client) []*jobqueue.Job {
+	if cmdFileStatus != "" || cmdLine != "" || cmdIDMatch != "" {
+		die("--trashed can only be combined with -i (and -z or -y)")
+	}
+	repGroup := cmdIDStatus
+	if cmdIDIsSubStr || cmdIDIsInternal {
+		repGroup = ""
+	}
+	jobs, err := jq.GetTrashed(repGroup)
+	if err != nil {
+		die("failed to get the trashed commands: %s", err)
+	}
+	if cmdIDStatus == "" || repGroup != "" {
+		return jobs
+	}
+
+	var matching []*jobqueue.Job
+	for _, job := range jobs {
+		switch {
+		case cmdIDIsInternal && (job.Key() == cmdIDStatus || job.Name == cmdIDStatus):
+			matching = append(matching, job)
+		case cmdIDIsSubStr && strings.Contains(job.RepGroup, cmdIDStatus):
+			matching = append(matching, job)
+		}
+	}
+	return matching
+}
+
 func getJobs(jq *jobqueue.Client, cmdState jobqueue.JobState, all bool, statusLimit int, showStd, showEnv bool) []*jobqueue.Job {
 	var jobs []*jobqueue.Job
 	var err error
@@ -469,6 +923,12 @@ func getJobs(jq *jobqueue.Client, cmdState jobqueue.JobState, all bool, statusLi
 			if job != nil {
 				jobs = append(jobs, job)
 			}
+		} else if cmdIDMatch != "" {
+			// get all jobs with a repgroup matching this pattern
+			if cmdIDIsSubStr {
+				die("-z and --match are mutually exclusive")
+			}
+			jobs, err = jq.GetByRepGroupMatching(cmdIDStatus, jobqueue.RepGroupMatch(cmdIDMatch), statusLimit, cmdState, showStd, showEnv)
 		} else {
 			// get all jobs with this identifier (repgroup)
 			jobs, err = jq.GetByRepGroup(cmdIDStatus, cmdIDIsSubStr, statusLimit, cmdState, showStd, showEnv)
@@ -511,3 +971,112 @@ func jobsToJobEssenses(jobs []*jobqueue.Job) []*jobqueue.JobEssence {
 	}
 	return jes
 }
+
+// printLostReport prints what the manager found out from the host of a lost
+// job.
+func printLostReport(report *jobqueue.LostReport) {
+	fmt.Printf("Lost report (collected from %s at %s):\n", report.Host, report.Collected.Format(time.RFC3339))
+	if report.Err != "" {
+		fmt.Printf(" Error: %s\n", report.Err)
+	}
+	for _, section := range []struct{ name, text string }{
+		{"Process", report.Process},
+		{"Runner log", report.RunnerLog},
+		{"Dmesg", report.Dmesg},
+		{"Working directory", report.Cwd},
+	} {
+		text := strings.TrimSpace(section.text)
+		if text == "" {
+			text = "[none]"
+		}
+		fmt.Printf(" %s:\n%s\n", section.name, text)
+	}
+}
+
+// parseMetaFilters converts --meta field=value options to the form that
+// Job.MetadataMatches() takes, dying if any are malformed.
+func parseMetaFilters(metas []string) map[string]string {
+	return parseKeyValues("--meta", metas)
+}
+
+// parseKeyValues converts the key=value options given to the named flag in to
+// a map, dying if any are malformed.
+func parseKeyValues(flag string, options []string) map[string]string {
+	kvs := make(map[string]string, len(options))
+	for _, option := range options {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			die("%s must be specified as key=value, not [%s]", flag, option)
+		}
+		kvs[parts[0]] = parts[1]
+	}
+	return kvs
+}
+
+// summaryGroup returns the group the given job should be summarised in: its
+// RepGroup, or its value of the --group_by_tag tag key.
+func summaryGroup(job *jobqueue.Job) string {
+	if statusGroupByTag == "" {
+		return job.RepGroup
+	}
+	if val, exists := job.Tags[statusGroupByTag]; exists {
+		return statusGroupByTag + "=" + val
+	}
+	return "[no " + statusGroupByTag + " tag]"
+}
+
+// showResources prints the utilisation of the hosts, as per wr top, along with
+// the totals and the number of hosts of each cloud flavor.
+func showResources(jq *jobqueue.Client) {
+	ru, err := jq.GetResources()
+	if err != nil {
+		die("%s", err)
+	}
+
+	printHostUsage(os.Stdout, ru.Hosts, false)
+	if len(ru.Hosts) == 0 {
+		return
+	}
+
+	cores := fmt.Sprintf("%g", ru.Cores)
+	if ru.MaxCores > 0 {
+		cores += fmt.Sprintf(" of %g", ru.MaxCores)
+	}
+	ram := fmt.Sprintf("%dMB", ru.RAM)
+	if ru.MaxRAM > 0 {
+		ram += fmt.Sprintf(" of %dMB", ru.MaxRAM)
+	}
+	fmt.Printf("\n%d commands running on %d hosts, using %s cores and %s of memory\n", ru.Running, len(ru.Hosts), cores, ram)
+	for _, fc := range ru.Flavors {
+		fmt.Printf("%s: %d hosts\n", fc.Flavor, fc.Hosts)
+	}
+}
+
+// exportUsage writes a report of the resources consumed by complete jobs to
+// STDOUT in the given format, for the jobs that completed in the current month
+// or between statusSince and statusUntil ago.
+func exportUsage(jq *jobqueue.Client, format, by string) {
+	if format != jobqueue.ExportFormatCSV && format != jobqueue.ExportFormatJSON {
+		die("--export must be 'csv' or 'json'")
+	}
+	props, err := jobqueue.ParseExportBy(by)
+	if err != nil {
+		die("bad --export_by: %s", err)
+	}
+
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if statusSince > 0 {
+		from = now.Add(-statusSince)
+	}
+	to := now.Add(-statusUntil)
+
+	records, err := jq.GetExport(from, to, props)
+	if err != nil {
+		die("failed to get export: %s", err)
+	}
+	err = jobqueue.WriteExport(os.Stdout, format, records)
+	if err != nil {
+		die("failed to write export: %s", err)
+	}
+}
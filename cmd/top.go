@@ -0,0 +1,163 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// topCmdMaxLen is how much of each command 'wr top' shows.
+const topCmdMaxLen = 60
+
+// options for this cmd
+var topInterval int
+var topOnce bool
+var topSummary bool
+
+// topCmd represents the top command
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Live view of what each host is running",
+	Long: `See what each host is running, updating live.
+
+Every host currently running commands, and every other host the manager's
+scheduler knows about (such as idle cloud servers), is listed along with:
+  the number of commands running on it
+  the cores and memory those commands requested, out of the host's capacity
+    (if known)
+  its 1 minute load average and the percentage of its memory in use, as last
+    reported by the runners on it (these are reported every 15s or so; hosts
+    that aren't running any commands don't report)
+After that, the commands running on each host are listed, oldest first, with
+how long they've been running, their rep_grp and their command line.
+
+Use this to spot overloaded hosts (eg. a load much higher than the cores they
+were given) or idle ones.
+
+The display is refreshed every --interval seconds until you press Ctrl-C. Use
+--once to just print it once, and --summary to leave out the commands.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if topInterval < 1 {
+			die("--interval must be at least 1")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		for {
+			usages, errg := jq.GetHostUsage()
+			if errg != nil {
+				die("%s", errg)
+			}
+
+			if !topOnce {
+				// clear the screen
+				fmt.Print("\033[H\033[2J")
+				fmt.Printf("wr top - %s\n\n", time.Now().Format("15:04:05"))
+			}
+			printHostUsage(os.Stdout, usages, !topSummary)
+
+			if topOnce {
+				return
+			}
+			<-time.After(time.Duration(topInterval) * time.Second)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(topCmd)
+
+	// flags specific to this sub-command
+	topCmd.Flags().IntVarP(&topInterval, "interval", "n", 2, "seconds between updates")
+	topCmd.Flags().BoolVar(&topOnce, "once", false, "print once instead of updating live")
+	topCmd.Flags().BoolVarP(&topSummary, "summary", "s", false, "only show the hosts, not the commands running on them")
+	topCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// printHostUsage writes a table of the given hosts to w, optionally with the
+// jobs running on each.
+func printHostUsage(w io.Writer, usages []*jobqueue.HostUsage, withJobs bool) {
+	if len(usages) == 0 {
+		fmt.Fprintln(w, "no hosts are running commands")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 2, 2, 3, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tFLAVOR\tCMDS\tCORES\tRAM\tLOAD\tMEM%")
+	for _, u := range usages {
+		cores := fmt.Sprintf("%g", u.Cores)
+		ram := fmt.Sprintf("%dMB", u.RAM)
+		if u.MaxCores > 0 {
+			cores += fmt.Sprintf("/%g", u.MaxCores)
+		}
+		if u.MaxRAM > 0 {
+			ram += fmt.Sprintf("/%dMB", u.MaxRAM)
+		}
+		load, mem := "-", "-"
+		if !u.Reported.IsZero() {
+			load = fmt.Sprintf("%.2f", u.Load)
+			mem = fmt.Sprintf("%.0f", u.RAMUsed)
+		}
+		flavor := u.Flavor
+		if flavor == "" {
+			flavor = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", u.Host, flavor, u.Running, cores, ram, load, mem)
+	}
+	if err := tw.Flush(); err != nil {
+		warn("failed to write: %s", err)
+		return
+	}
+
+	if !withJobs {
+		return
+	}
+	tw = tabwriter.NewWriter(w, 2, 2, 3, ' ', 0)
+	for _, u := range usages {
+		if len(u.Jobs) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "\n%s:\n", u.Host)
+		for _, job := range u.Jobs {
+			cmdLine := job.Cmd
+			if len(cmdLine) > topCmdMaxLen {
+				cmdLine = cmdLine[:topCmdMaxLen-3] + "..."
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", time.Since(job.Started).Truncate(time.Second), job.RepGroup, job.Key, cmdLine)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		warn("failed to write: %s", err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var triageFile string
+var triageClear bool
+
+// triageCmd represents the triage command
+var triageCmd = &cobra.Command{
+	Use:   "triage",
+	Short: "Automatically deal with buried commands",
+	Long: `Automatically deal with buried commands according to how they failed.
+
+Without options, the manager's triage rules are listed in the order they are
+checked, along with how many buried commands each has been applied to since the
+manager started.
+
+--file replaces the rules with those in the given YAML file (- means read from
+STDIN), which should be a list of rules like:
+
+- name: oom
+  fail_reason: "command used too much RAM"
+  action: retry_ram
+  ram_multiplier: 1.5
+  max_retries: 2
+- name: flaky node
+  stderr: "(?i)input/output error"
+  action: retry_host
+- name: bad input
+  exitcode: 3
+  action: fail
+  set_fail_reason: "bad input file"
+  webhook: https://example.com/wr-hook
+
+Whenever a command gets buried, the first rule that matches it is applied. A
+rule matches if the command's fail reason equals fail_reason, its exit code
+equals exitcode, and its STDERR matches the regular expression stderr (rules
+that leave any of these out match anything for them).
+
+The action of a rule is one of:
+retry_ram:  retry the command with its memory reservation multiplied by
+            ram_multiplier (default 2).
+retry_host: retry the command, but never on the host it was buried on.
+fail:       leave the command buried, but change its fail reason to
+            set_fail_reason (default "permanently failed"), so you know it
+            doesn't need investigating.
+webhook:    leave the command buried, and just tell the webhook.
+
+The retry actions only retry the same command max_retries (default 1) times;
+after that the rule stops matching it. Any rule that has a webhook POSTs JSON
+describing the command and what was done to it to that URL.
+
+--clear removes all the rules, so buried commands stay buried.
+
+The rules can also be seen on the status web page.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if triageFile != "" && triageClear {
+			die("--file and --clear are mutually exclusive")
+		}
+
+		var rules []*jobqueue.TriageRule
+		if triageFile != "" {
+			var reader io.Reader
+			if triageFile == "-" {
+				reader = os.Stdin
+			} else {
+				f, err := os.Open(triageFile)
+				if err != nil {
+					die("could not open file '%s': %s", triageFile, err)
+				}
+				defer internal.LogClose(appLogger, f, "triage rules", "path", triageFile)
+				reader = f
+			}
+
+			var err error
+			rules, err = jobqueue.ParseTriageRules(reader)
+			if err != nil {
+				die("bad triage rules: %s", err)
+			}
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		switch {
+		case triageFile != "" || triageClear:
+			err = jq.SetTriageRules(rules)
+			if err != nil {
+				die("%s", err)
+			}
+			info("%d triage rules set", len(rules))
+		default:
+			infos, errg := jq.GetTriageRules()
+			if errg != nil {
+				die("%s", errg)
+			}
+			for _, ri := range infos {
+				fmt.Printf("%s: %s buried commands%s; %d hits", ri.Rule.Name, ri.Rule.Action, triageMatchDesc(ri.Rule), ri.Hits)
+				if ri.Hits > 0 {
+					fmt.Printf(" (last at %s)", ri.LastHit.Format(time.RFC3339))
+				}
+				fmt.Println()
+			}
+		}
+	},
+}
+
+// triageMatchDesc describes what buried commands the given rule matches.
+func triageMatchDesc(rule *jobqueue.TriageRule) string {
+	var parts []string
+	if rule.FailReason != "" {
+		parts = append(parts, fmt.Sprintf("that failed due to '%s'", rule.FailReason))
+	}
+	if rule.Exitcode != 0 {
+		parts = append(parts, fmt.Sprintf("with exit code %d", rule.Exitcode))
+	}
+	if rule.StdErr != "" {
+		parts = append(parts, fmt.Sprintf("with STDERR matching /%s/", rule.StdErr))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " " + strings.Join(parts, " ")
+}
+
+func init() {
+	RootCmd.AddCommand(triageCmd)
+
+	// flags specific to this sub-command
+	triageCmd.Flags().StringVarP(&triageFile, "file", "f", "", "YAML file of triage rules to replace the current ones with (- means read from STDIN)")
+	triageCmd.Flags().BoolVar(&triageClear, "clear", false, "remove all the triage rules")
+	triageCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -0,0 +1,154 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var usageBy string
+var usageMonths int
+var usageJSON bool
+
+// usageCmd represents the usage command
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "See the resources consumed per user or report group",
+	Long: `See the resources consumed by the commands of each user or report group.
+
+Every time a command stops running (whether it completed or failed), the manager
+accounts the cores and RAM it reserved multiplied by how long it ran, for the
+user that added it and for its report group. These are kept as monthly totals,
+so you can see who used what, eg. to share the cost of a facility.
+
+--by user (the default) shows the usage of each user, while --by repgroup shows
+the usage of each report group. --months says how many calendar months (UTC) to
+show, counting the current one.
+
+For each month you see the number of times commands ran, core hours, RAM GB
+hours and, if the manager has been configured with a cloudcostpercorehour, the
+cost of those core hours.
+
+--json outputs the raw monthly records as an array of JSON objects instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if usageBy != "user" && usageBy != "repgroup" {
+			die("--by must be 'user' or 'repgroup'")
+		}
+		if usageMonths < 1 {
+			die("--months must be at least 1")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		now := time.Now().UTC()
+		from := time.Date(now.Year(), now.Month()-time.Month(usageMonths-1), 1, 0, 0, 0, 0, time.UTC)
+		records, err := jq.GetUsage(from, now)
+		if err != nil {
+			die("failed to get usage: %s", err)
+		}
+
+		var wanted []*jobqueue.UsageRecord
+		for _, record := range records {
+			if (usageBy == "user") == (record.User != "") {
+				wanted = append(wanted, record)
+			}
+		}
+
+		if usageJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetEscapeHTML(false)
+			err = encoder.Encode(wanted)
+			if err != nil {
+				die("failed to encode usage: %s", err)
+			}
+			return
+		}
+
+		printUsage(os.Stdout, wanted, usageBy == "user")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(usageCmd)
+
+	// flags specific to this sub-command
+	usageCmd.Flags().StringVar(&usageBy, "by", "user", "['user','repgroup'] whose usage to show")
+	usageCmd.Flags().IntVar(&usageMonths, "months", 3, "number of months to show usage for")
+	usageCmd.Flags().BoolVar(&usageJSON, "json", false, "output the usage records as JSON")
+	usageCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// printUsage writes a table of the given usage records to w. The Cost column
+// is only included if any of them have a cost.
+func printUsage(w io.Writer, records []*jobqueue.UsageRecord, byUser bool) {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "no usage has been recorded for that period")
+		return
+	}
+
+	withCost := false
+	for _, record := range records {
+		if record.Cost > 0 {
+			withCost = true
+			break
+		}
+	}
+
+	who := "REPGROUP"
+	if byUser {
+		who = "USER"
+	}
+	tw := tabwriter.NewWriter(w, 2, 2, 3, ' ', 0)
+	header := "MONTH\t" + who + "\tRUNS\tCORE HOURS\tRAM GB HOURS"
+	if withCost {
+		header += "\tCOST"
+	}
+	fmt.Fprintln(tw, header)
+	for _, record := range records {
+		name := record.RepGroup
+		if byUser {
+			name = record.User
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.2f\t%.2f", record.Month, name, record.Runs, record.CoreHours, record.RAMHours)
+		if withCost {
+			fmt.Fprintf(tw, "\t%.2f", record.Cost)
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		warn("failed to write: %s", err)
+	}
+}
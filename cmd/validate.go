@@ -0,0 +1,86 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/VertebrateResequencing/wr/jobqueue/validate"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var validateFile string
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check commands before adding them",
+	Long: `Check that the commands you would give to "wr add" are valid, without
+adding them (or needing the manager to be running).
+
+Provide a file (or STDIN) in the format taken by "wr add" (see "wr add -h").
+Each line is checked using the same rules that "wr add" and the manager use,
+including the parsing of memory and time requirements, and the JSON of mounts
+and behaviours. Checking is stricter than "wr add" in that JSON keys that are
+not recognised (typically typos that would otherwise be silently ignored) are
+reported, as are behaviours that don't specify exactly one action.
+
+The dependencies between the commands in the file are also checked: no command
+may depend on itself, directly or via a cycle of other commands, and no two
+commands may have the same name. Dependencies on commands not in the file can't
+be checked.
+
+Problems are reported along with their line numbers, and the exit code is non-0
+if there were any, making this suitable for checking the output of a pipeline
+generator before submission. (Go programs can do the same checks using the
+github.com/VertebrateResequencing/wr/jobqueue/validate package.)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var reader io.Reader
+		if validateFile == "-" {
+			reader = os.Stdin
+		} else {
+			f, err := os.Open(validateFile)
+			if err != nil {
+				die("could not open file '%s': %s", validateFile, err)
+			}
+			defer internal.LogClose(appLogger, f, "cmds file", "path", validateFile)
+			reader = f
+		}
+
+		jobs, problems := validate.Reader(reader, &jobqueue.JobDefaults{})
+		for _, problem := range problems {
+			warn("%s", problem)
+		}
+		if len(problems) > 0 {
+			die("%d problems found", len(problems))
+		}
+		info("all %d commands are valid", len(jobs))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(validateCmd)
+
+	// flags specific to this sub-command
+	validateCmd.Flags().StringVarP(&validateFile, "file", "f", "-", "file containing your commands; - means read from STDIN")
+}
@@ -0,0 +1,95 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// waitCmd represents the wait command
+var waitCmd = &cobra.Command{
+	Use:   "wait rep_grp",
+	Short: "Wait for commands to finish",
+	Long: `Wait for all the commands in a report group to finish.
+
+This blocks until every command in the given report group (the -i option of
+"wr add") is either complete or buried. The manager tells wr as soon as
+commands finish, so this does not poll.
+
+A JSON summary is then output on STDOUT, giving the number of commands that
+completed and were buried, along with the details of those that were buried.
+If any were buried, wr exits with a non-zero exit code, so this is suitable for
+use in scripts, eg:
+wr add -f cmds.txt -i mygroup && wr wait mygroup && echo all done
+
+(If you want to wait on the commands you are adding at the same time as adding
+them, use 'wr add --sync' instead, which will also notice if any are deleted.)`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		ws, err := jq.Wait(args[0])
+		if err != nil {
+			die("failed to wait on report group %s: %s", args[0], err)
+		}
+		if ws.Complete+ws.Buried == 0 {
+			die("there are no commands in report group %s", args[0])
+		}
+
+		reportWaitSummary(jq, ws)
+	},
+}
+
+// reportWaitSummary outputs the given WaitSummary as JSON on STDOUT. If any of
+// the commands waited on didn't complete, it then disconnects the given client
+// and exits non-zero.
+func reportWaitSummary(jq *jobqueue.Client, ws *jobqueue.WaitSummary) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(ws); err != nil {
+		die("failed to encode the summary: %s", err)
+	}
+
+	if !ws.OK() {
+		if err := jq.Disconnect(); err != nil {
+			warn("Disconnecting from the server failed: %s", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(waitCmd)
+
+	// flags specific to this sub-command
+	waitCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
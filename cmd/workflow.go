@@ -0,0 +1,248 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var workflowReRun bool
+
+// workflowCmd represents the workflow command
+var workflowCmd = &cobra.Command{
+	Use:   "workflow",
+	Short: "Add workflows and follow their progress",
+	Long: `Add a workflow of dependent commands described in a file.
+
+Instead of working out the order to add commands in and wiring up their
+dependencies yourself, you can describe the steps of a workflow in a YAML file,
+and have wr work out the dependencies between them:
+
+workflow: qc
+defaults:
+  cwd: /data/qc
+  memory: 1G
+steps:
+  - name: fetch
+    cmd: fetch.sh
+    outputs: [raw.fq]
+  - name: align
+    cmd: align.sh raw.fq
+    inputs: [raw.fq]
+    memory: 8G
+  - name: report
+    cmd: report.sh
+    after: [align]
+
+Each step needs a name that is unique within the workflow, and otherwise takes
+the same options as the JSON objects that "wr add" understands (see "wr add
+-h"), with "defaults" supplying options for every step that doesn't specify them
+itself. If no cwd is given, it defaults to your current directory (or /tmp if
+the manager is remote).
+
+A step runs after the steps named in its "after", and after any steps whose
+"outputs" match its "inputs" (relative paths are relative to each step's cwd).
+The steps must not depend on each other in a cycle. Each step's report group
+defaults to the workflow's name, a dot, and the step's name.
+
+Use the sub-commands to add a workflow and then follow its progress.`,
+}
+
+// workflowAddCmd represents the workflow add command
+var workflowAddCmd = &cobra.Command{
+	Use:   "add workflow.yml",
+	Short: "Add a workflow",
+	Long: `Add all the commands of a workflow.
+
+Give the path to the workflow's YAML file (or - to read it from STDIN). The
+commands are all added in one go, so if there is a problem with any of them,
+none are added. The manager remembers the workflow, so you can see its progress
+with "wr workflow status".
+
+Adding a workflow with the same name again replaces the manager's record of it.
+Steps that are already in the queue are left alone, and as with "wr add",
+commands that already completed are not added again unless you use --rerun.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := args[0]
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		var isLocal bool
+		currentIP, errc := internal.CurrentIP("")
+		if errc != nil {
+			warn("Could not get current IP: %s", errc)
+		}
+		if currentIP+":"+config.ManagerPort == jq.ServerInfo.Addr {
+			isLocal = true
+		}
+
+		jd := &jobqueue.JobDefaults{Cwd: "/tmp"}
+		if isLocal {
+			jd.Cwd, err = os.Getwd()
+			if err != nil {
+				die("%s", err)
+			}
+		}
+
+		var reader io.Reader
+		if path == "-" {
+			reader = os.Stdin
+		} else {
+			reader, err = os.Open(path)
+			if err != nil {
+				die("could not open file '%s': %s", path, err)
+			}
+			defer internal.LogClose(appLogger, reader.(*os.File), "workflow", "path", path)
+		}
+
+		wf, jobs, err := jobqueue.ParseWorkflow(reader, jd)
+		if err != nil {
+			die("%s", err)
+		}
+
+		var envVars []string
+		if isLocal {
+			envVars = jobqueue.CaptureEnv(jobqueue.EnvCaptureFull, nil)
+		}
+
+		added, existed, err := jq.AddWorkflow(wf, jobs, envVars, !workflowReRun)
+		if err != nil {
+			die("failed to add workflow %s: %s", wf.Name, err)
+		}
+		info("Added workflow %s: %d new commands, %d already existed", wf.Name, added, existed)
+	},
+}
+
+// workflowStatusCmd represents the workflow status command
+var workflowStatusCmd = &cobra.Command{
+	Use:   "status [name]",
+	Short: "See the progress of workflows",
+	Long: `See the progress of the workflows you have added.
+
+With no name, lists every workflow along with how many of its steps are
+complete. With the name of a workflow, shows the current state of each of its
+steps, along with the steps they run after and their report groups (for use with
+"wr status -i").`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := ""
+		if len(args) == 1 {
+			name = args[0]
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		wfs, err := jq.GetWorkflows(name)
+		if err != nil {
+			die("failed to get workflows: %s", err)
+		}
+		if len(wfs) == 0 {
+			if name != "" {
+				die("there is no workflow called %s", name)
+			}
+			info("there are no workflows")
+			return
+		}
+
+		if name != "" {
+			printWorkflowSteps(os.Stdout, wfs[0])
+			return
+		}
+		printWorkflows(os.Stdout, wfs)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(workflowCmd)
+	workflowCmd.AddCommand(workflowAddCmd)
+	workflowCmd.AddCommand(workflowStatusCmd)
+
+	// flags specific to these sub-commands
+	workflowAddCmd.Flags().BoolVar(&workflowReRun, "rerun", false, "re-run commands that already completed")
+
+	workflowAddCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	workflowStatusCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// printWorkflows writes a table summarising the given workflows to w.
+func printWorkflows(w io.Writer, wfs []*jobqueue.Workflow) {
+	tw := tabwriter.NewWriter(w, 2, 2, 3, ' ', 0)
+	fmt.Fprintln(tw, "WORKFLOW\tADDED\tUSER\tSTEPS\tCOMPLETE\tBURIED")
+	for _, wf := range wfs {
+		var complete, buried int
+		for _, step := range wf.Steps {
+			switch step.State {
+			case jobqueue.JobStateComplete:
+				complete++
+			case jobqueue.JobStateBuried:
+				buried++
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\n", wf.Name, wf.Added.Local().Format("2006-01-02 15:04"), wf.User, len(wf.Steps), complete, buried)
+	}
+	if err := tw.Flush(); err != nil {
+		warn("failed to write: %s", err)
+	}
+}
+
+// printWorkflowSteps writes a table of the steps of the given workflow to w.
+func printWorkflowSteps(w io.Writer, wf *jobqueue.Workflow) {
+	tw := tabwriter.NewWriter(w, 2, 2, 3, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tSTATE\tAFTER\tREPGROUP")
+	for _, step := range wf.Steps {
+		after := strings.Join(step.After, ",")
+		if after == "" {
+			after = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", step.Name, step.State, after, step.RepGroup)
+	}
+	if err := tw.Flush(); err != nil {
+		warn("failed to write: %s", err)
+	}
+	if wf.Complete() {
+		info("workflow %s is complete", wf.Name)
+	}
+}
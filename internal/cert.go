@@ -26,11 +26,15 @@ package internal
 import (
 	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
 	"os"
@@ -167,3 +171,85 @@ func createCert(template, parentCert *x509.Certificate, publicKey interface{}, p
 	err = certOut.Close()
 	return cert, err
 }
+
+// GenerateCA creates a self-signed CA certificate and its key, saved as PEM
+// files, for signing client certificates with SignClientCert(). An error is
+// generated if either file already exists.
+func GenerateCA(caFile, caKeyFile, domain string) error {
+	for _, path := range []string{caFile, caKeyFile} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("[%s] already exists", path)
+		}
+	}
+
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	tmpl, err := certTemplate(domain)
+	if err != nil {
+		return err
+	}
+	tmpl.IsCA = true
+	tmpl.KeyUsage |= x509.KeyUsageCertSign
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	_, err = createCert(tmpl, tmpl, &key.PublicKey, key, caFile)
+	if err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return ioutil.WriteFile(caKeyFile, keyPEM, 0600)
+}
+
+// SignClientCert creates a new key and a certificate for TLS client
+// authentication with the given common name, signed by the CA in the given
+// files (as created by GenerateCA()). It returns the certificate and key in PEM
+// format, along with the certificate's serial number in hex.
+func SignClientCert(caFile, caKeyFile, name string) (certPEM, keyPEM []byte, serial string, err error) {
+	caPair, err := tls.LoadX509KeyPair(caFile, caKeyFile)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	caCert, err := x509.ParseCertificate(caPair.Certificate[0])
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	tmpl, err := certTemplate(name)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	tmpl.Subject.CommonName = name
+	tmpl.IPAddresses = nil
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	certDER, err := x509.CreateCertificate(crand.Reader, tmpl, caCert, &key.PublicKey, caPair.PrivateKey)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, tmpl.SerialNumber.Text(16), nil
+}
+
+// CertFingerprint returns the hex encoded SHA-256 hash of the first
+// certificate in the given PEM file.
+func CertFingerprint(certFile string) (string, error) {
+	content, err := ioutil.ReadFile(certFile) // #nosec
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("no certificate found in [%s]", certFile)
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -21,6 +21,7 @@ package internal
 // this file implements the config system used by the cmd package
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -47,12 +48,16 @@ const (
 type Config struct {
 	ManagerPort          string `default:""`
 	ManagerWeb           string `default:""`
+	ManagerWebPublic     string `default:""`
+	ManagerGRPC          string `default:""`
 	ManagerHost          string `default:"localhost"`
 	ManagerDir           string `default:"~/.wr"`
 	ManagerPidFile       string `default:"pid"`
 	ManagerLogFile       string `default:"log"`
 	ManagerDbFile        string `default:"db"`
 	ManagerDbBkFile      string `default:"db_bk"`
+	ManagerDbBkSnapshot  int    `default:"0"`
+	ManagerDbURL         string `default:""`
 	ManagerTokenFile     string `default:"client.token"`
 	ManagerUploadDir     string `default:"uploads"`
 	ManagerUmask         int    `default:"007"`
@@ -62,12 +67,64 @@ type Config struct {
 	ManagerKeyFile       string `default:"key.pem"`
 	ManagerCertDomain    string `default:"localhost"`
 	ManagerSetDomainIP   bool   `default:"false"`
+	ManagerPreemption    string `default:""`
+	ManagerPreemptWait   int    `default:"300"`
+	ManagerPreemptGrace  int    `default:"60"`
+	ManagerPreemptGap    int    `default:"0"`
+	ManagerHostMaxJobs   int    `default:"0"`
+	ManagerHostJobLimits string `default:""`
+	ManagerStartRate     int    `default:"0"`
+	ManagerBuriedExport  string `default:""`
+	ManagerRAMRetryMult  string `default:"0"`
+	ManagerRAMRetryMax   string `default:""`
+	ManagerTimeRetryMult string `default:"0"`
+	ManagerNamespace     string `default:""`
+	ManagerNSWeights     string `default:""`
+	ManagerFairShare     string `default:""`
+	ManagerRunnerReuse   string `default:"0"`
+	ManagerResTimeout    int    `default:"0"`
+	ManagerTrashPeriod   int    `default:"0"`
+	ManagerLostAfter     int    `default:"0"`
+	ManagerLostCloudGone bool   `default:"false"`
+	ManagerHeartbeat     int    `default:"0"`
+	ManagerLostThreshold int    `default:"0"`
+	ManagerNotifyOK      string `default:""`
+	ManagerNotifyFail    string `default:""`
+	ManagerSMTPServer    string `default:""`
+	ManagerSMTPFrom      string `default:""`
+	ManagerBackfill      bool   `default:"false"`
+	ManagerRunnerUpdate  bool   `default:"false"`
+	ManagerPacking       string `default:""`
+	ManagerJobOnFailure  string `default:""`
+	ManagerJobOnSuccess  string `default:""`
+	ManagerJobOnExit     string `default:"'[{\"cleanup\":true}]'"`
+	ManagerWebPrefix     string `default:""`
+	ManagerWebProxies    string `default:""`
+	ManagerWebCORS       string `default:""`
+	ManagerWSSendLimit   int    `default:"1000"`
+	ManagerWSOverflow    string `default:"drop"`
+	ManagerAdmitHook     string `default:""`
+	ManagerAdmitTimeout  int    `default:"10"`
+	ManagerEnrolment     bool   `default:"false"`
+	ManagerEnrolCAFile   string `default:"enrol_ca.pem"`
+	ManagerEnrolCAKey    string `default:"enrol_ca.key"`
+	ManagerSecretKeyFile string `default:"secret.key"`
+	ManagerStandbyOf     string `default:""`
+	ManagerTakeoverCmd   string `default:""`
+	ManagerServiceAddr   string `default:""`
+	ManagerLogLevel      string `default:"warn"`
 	RunnerExecShell      string `default:"bash"`
+	RunnerInputCacheDir  string `default:""`
+	RunnerInputCacheSize int    `default:"100"`
 	Deployment           string `default:"production"`
 	CloudFlavor          string `default:""`
 	CloudFlavorManager   string `default:""`
 	CloudFlavorSets      string `default:""`
 	CloudKeepAlive       int    `default:"120"`
+	CloudScaleDown       string `default:"idle"`
+	CloudScaleDownAhead  int    `default:"10"`
+	CloudScaleDownKeep   int    `default:"0"`
+	CloudScaleDownMax    int    `default:"0"`
 	CloudServers         int    `default:"-1"`
 	CloudCIDR            string `default:"192.168.0.0/18"`
 	CloudGateway         string `default:"192.168.0.1"`
@@ -81,6 +138,13 @@ type Config struct {
 	CloudConfigFiles     string `default:"~/.s3cfg,~/.aws/credentials,~/.aws/config"`
 	CloudSpawns          int    `default:"10"`
 	CloudAutoConfirmDead int    `default:"30"`
+	CloudBadServerPolicy string `default:"confirm"`
+	CloudBadServerProbes int    `default:"3"`
+	CloudBadServerReboot int    `default:"5"`
+	CloudCostPerCoreHour string `default:"0"`
+	CloudStorageZones    string `default:""`
+	CloudRunnerDir       string `default:""`
+	CloudRunnerURL       string `default:""`
 	DeploySuccessScript  string `default:""`
 }
 
@@ -107,11 +171,23 @@ WR_<setting name in caps>, eg.
 export WR_MANAGER_PORT="11301"
 */
 func ConfigLoad(deployment string, useparentdir bool, logger log15.Logger) Config {
-	pwd, err := os.Getwd()
+	config, err := ConfigReload(deployment, useparentdir, logger)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
+	return config
+}
+
+// ConfigReload is like ConfigLoad(), but returns an error instead of exiting
+// if the configuration could not be read. It is for long-running processes
+// that want to pick up changes to the config files without risking exiting if
+// a change was bad.
+func ConfigReload(deployment string, useparentdir bool, logger log15.Logger) (Config, error) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return Config{}, err
+	}
 
 	if useparentdir {
 		pwd = filepath.Dir(pwd)
@@ -123,13 +199,11 @@ func ConfigLoad(deployment string, useparentdir bool, logger log15.Logger) Confi
 	}
 	err = os.Setenv("CONFIGOR_ENV", deployment)
 	if err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
+		return Config{}, err
 	}
 	err = os.Setenv("CONFIGOR_ENV_PREFIX", "WR")
 	if err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
+		return Config{}, err
 	}
 	ConfigDeploymentBasename := ".wr_config." + deployment + ".yml"
 
@@ -143,8 +217,7 @@ func ConfigLoad(deployment string, useparentdir bool, logger log15.Logger) Confi
 	}
 	home, herr := os.UserHomeDir()
 	if herr != nil || home == "" {
-		logger.Error("could not find home dir", "err", herr)
-		os.Exit(1)
+		return Config{}, fmt.Errorf("could not find home dir: %v", herr)
 	}
 	configFile = filepath.Join(home, configCommonBasename)
 	_, err = os.Stat(configFile)
@@ -162,8 +235,7 @@ func ConfigLoad(deployment string, useparentdir bool, logger log15.Logger) Confi
 	config := Config{}
 	err = configor.Load(&config, configFiles...)
 	if err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
+		return Config{}, err
 	}
 	config.Deployment = deployment
 
@@ -194,12 +266,24 @@ func ConfigLoad(deployment string, useparentdir bool, logger log15.Logger) Confi
 	if !filepath.IsAbs(config.ManagerKeyFile) {
 		config.ManagerKeyFile = filepath.Join(config.ManagerDir, config.ManagerKeyFile)
 	}
+	if !filepath.IsAbs(config.ManagerEnrolCAFile) {
+		config.ManagerEnrolCAFile = filepath.Join(config.ManagerDir, config.ManagerEnrolCAFile)
+	}
+	if !filepath.IsAbs(config.ManagerEnrolCAKey) {
+		config.ManagerEnrolCAKey = filepath.Join(config.ManagerDir, config.ManagerEnrolCAKey)
+	}
+	if !filepath.IsAbs(config.ManagerSecretKeyFile) {
+		config.ManagerSecretKeyFile = filepath.Join(config.ManagerDir, config.ManagerSecretKeyFile)
+	}
 	if !filepath.IsAbs(config.ManagerTokenFile) {
 		config.ManagerTokenFile = filepath.Join(config.ManagerDir, config.ManagerTokenFile)
 	}
 	if !filepath.IsAbs(config.ManagerUploadDir) {
 		config.ManagerUploadDir = filepath.Join(config.ManagerDir, config.ManagerUploadDir)
 	}
+	if config.ManagerBuriedExport != "" && !filepath.IsAbs(config.ManagerBuriedExport) {
+		config.ManagerBuriedExport = filepath.Join(config.ManagerDir, config.ManagerBuriedExport)
+	}
 
 	// if not explicitly set, calculate ports that no one else would be
 	// assigned by us (and hope no other software is using it...)
@@ -210,7 +294,7 @@ func ConfigLoad(deployment string, useparentdir bool, logger log15.Logger) Confi
 		config.ManagerWeb = calculatePort(config.Deployment, "webi", logger)
 	}
 
-	return config
+	return config, nil
 }
 
 // IsProduction tells you if we're in the production deployment.
@@ -42,6 +42,7 @@ import (
 	infoblox "github.com/fanatic/go-infoblox"
 	"github.com/inconshreveable/log15"
 	"github.com/ricochet2200/go-disk-usage/du"
+	"github.com/shirou/gopsutil/load"
 	"github.com/shirou/gopsutil/mem"
 )
 
@@ -201,6 +202,20 @@ func ProcMeminfoMBs() (int, error) {
 	return int((v.Total / 1024) / 1024), err
 }
 
+// HostLoad uses gopsutil to find the 1 minute load average of the current
+// system, and the percentage of its physical memory that is in use.
+func HostLoad() (float64, float64, error) {
+	avg, err := load.Avg()
+	if err != nil {
+		return 0, 0, err
+	}
+	v, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, 0, err
+	}
+	return avg.Load1, v.UsedPercent, err
+}
+
 // DiskSize returns the size of the disk (mounted at the given directory, "."
 // for current) in GB.
 func DiskSize(dir string) int {
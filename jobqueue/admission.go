@@ -0,0 +1,222 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for admission hooks, which let sites check and
+// alter jobs as they are added, by supplying an AdmissionHook in ServerConfig.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// admissionWebhookMaxReply is the most bytes we'll read from an admission
+// webhook's reply.
+const admissionWebhookMaxReply = 16 * 1024 * 1024
+
+// AdmissionRequest describes a batch of jobs being added, for an
+// AdmissionHook to check.
+type AdmissionRequest struct {
+	// Jobs are the jobs being added. They are not in the queue yet, so hooks
+	// may alter them directly (eg. to add MountConfigs or cap Requirements).
+	// Their RepGroups, DepGroups and similar are already qualified by their
+	// Namespace, if any.
+	Jobs []*Job
+}
+
+// AdmissionHook is the interface sites can implement to enforce policy on the
+// jobs that get added to the queue, eg. to insist on naming conventions,
+// inject mounts or cap resource requirements. Admit is called with every batch
+// of jobs being added (by Client.Add(), the REST API or Client.ApplyPipeline()),
+// before they are validated and queued. It should return nil to let the jobs
+// be added (after altering them if desired), or an error explaining why they
+// were rejected, in which case none of them are added.
+type AdmissionHook interface {
+	Admit(req *AdmissionRequest) error
+}
+
+// AdmissionHookFunc lets you use an ordinary function as an AdmissionHook.
+type AdmissionHookFunc func(req *AdmissionRequest) error
+
+// Admit calls f(req).
+func (f AdmissionHookFunc) Admit(req *AdmissionRequest) error {
+	return f(req)
+}
+
+// AdmissionJob is the view of a Job that AdmissionWebhook() sends to, and
+// accepts back from, a webhook.
+type AdmissionJob struct {
+	Cmd          string            `json:"cmd"`
+	Cwd          string            `json:"cwd"`
+	RepGroup     string            `json:"rep_grp"`
+	ReqGroup     string            `json:"req_grp"`
+	Namespace    string            `json:"namespace,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Metadata     json.RawMessage   `json:"metadata,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Memory       int               `json:"memory"`
+	Time         int               `json:"time"`
+	CPUs         float64           `json:"cpus"`
+	Disk         int               `json:"disk"`
+	Other        map[string]string `json:"other,omitempty"`
+	Priority     uint8             `json:"priority"`
+	Retries      uint8             `json:"retries"`
+	LimitGroups  []string          `json:"limit_grps,omitempty"`
+	DepGroups    []string          `json:"dep_grps,omitempty"`
+	MountConfigs MountConfigs      `json:"mounts,omitempty"`
+}
+
+// AdmissionReply is what an AdmissionWebhook() webhook should reply with.
+type AdmissionReply struct {
+	// Allowed must be true for the jobs to be added.
+	Allowed bool `json:"allowed"`
+
+	// Reason explains why the jobs were not Allowed.
+	Reason string `json:"reason,omitempty"`
+
+	// Jobs, if supplied, must have one entry per job sent, in the same order,
+	// and their values replace those of the jobs being added. (Namespace can't
+	// be changed.)
+	Jobs []*AdmissionJob `json:"jobs,omitempty"`
+}
+
+// newAdmissionJob creates an AdmissionJob from the given Job.
+func newAdmissionJob(job *Job) *AdmissionJob {
+	job.RLock()
+	defer job.RUnlock()
+	aj := &AdmissionJob{
+		Cmd:          job.Cmd,
+		Cwd:          job.Cwd,
+		RepGroup:     job.RepGroup,
+		ReqGroup:     job.ReqGroup,
+		Namespace:    job.Namespace,
+		Name:         job.Name,
+		Metadata:     job.Metadata,
+		Tags:         job.Tags,
+		Priority:     job.Priority,
+		Retries:      job.Retries,
+		LimitGroups:  job.LimitGroups,
+		DepGroups:    job.DepGroups,
+		MountConfigs: job.MountConfigs,
+	}
+	if job.Requirements != nil {
+		aj.Memory = job.Requirements.RAM
+		aj.Time = int(job.Requirements.Time.Seconds())
+		aj.CPUs = job.Requirements.Cores
+		aj.Disk = job.Requirements.Disk
+		aj.Other = job.Requirements.Other
+	}
+	return aj
+}
+
+// applyTo sets the given Job's values to ours.
+func (aj *AdmissionJob) applyTo(job *Job) {
+	job.Lock()
+	defer job.Unlock()
+	job.Cmd = aj.Cmd
+	job.Cwd = aj.Cwd
+	job.RepGroup = aj.RepGroup
+	job.ReqGroup = aj.ReqGroup
+	job.Name = aj.Name
+	job.Metadata = aj.Metadata
+	job.Tags = aj.Tags
+	job.Priority = aj.Priority
+	job.Retries = aj.Retries
+	job.LimitGroups = aj.LimitGroups
+	job.DepGroups = aj.DepGroups
+	job.MountConfigs = aj.MountConfigs
+	if job.Requirements != nil {
+		job.Requirements.RAM = aj.Memory
+		job.Requirements.Time = time.Duration(aj.Time) * time.Second
+		job.Requirements.Cores = aj.CPUs
+		job.Requirements.Disk = aj.Disk
+		job.Requirements.Other = aj.Other
+		job.Requirements.OtherSet = len(aj.Other) > 0
+	}
+}
+
+// AdmissionWebhook returns an AdmissionHook that POSTs the jobs being added
+// to the given URL as a JSON array of AdmissionJob, and expects an
+// AdmissionReply in return, eg.
+//
+//	{"allowed": false, "reason": "rep_grp must start with your team name"}
+//
+// Jobs are rejected if the webhook can't be reached within the given timeout,
+// or doesn't reply with a 200 status.
+func AdmissionWebhook(url string, timeout time.Duration) AdmissionHook {
+	client := &http.Client{Timeout: timeout}
+	return AdmissionHookFunc(func(req *AdmissionRequest) error {
+		ajs := make([]*AdmissionJob, len(req.Jobs))
+		for i, job := range req.Jobs {
+			ajs[i] = newAdmissionJob(job)
+		}
+		body, err := json.Marshal(ajs)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("admission webhook failed: %s", err)
+		}
+		defer resp.Body.Close() // #nosec nothing useful to do if closing fails
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("admission webhook replied %s", resp.Status)
+		}
+
+		var reply AdmissionReply
+		err = json.NewDecoder(io.LimitReader(resp.Body, admissionWebhookMaxReply)).Decode(&reply)
+		if err != nil {
+			return fmt.Errorf("admission webhook reply could not be decoded: %s", err)
+		}
+		if !reply.Allowed {
+			if reply.Reason == "" {
+				return errors.New("rejected by admission webhook")
+			}
+			return errors.New(reply.Reason)
+		}
+
+		if reply.Jobs == nil {
+			return nil
+		}
+		if len(reply.Jobs) != len(req.Jobs) {
+			return fmt.Errorf("admission webhook replied with %d jobs instead of %d", len(reply.Jobs), len(req.Jobs))
+		}
+		for i, aj := range reply.Jobs {
+			if aj == nil {
+				return fmt.Errorf("admission webhook replied with no job %d", i+1)
+			}
+			aj.applyTo(req.Jobs[i])
+		}
+		return nil
+	})
+}
+
+// admitJobs passes the given jobs to our AdmissionHook, if any.
+func (s *Server) admitJobs(jobs []*Job) error {
+	if s.admission == nil || len(jobs) == 0 {
+		return nil
+	}
+	return s.admission.Admit(&AdmissionRequest{Jobs: jobs})
+}
@@ -0,0 +1,226 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions that honour Job.SameHostAs,
+// Job.AvoidRepGroup and Job.AvoidHosts.
+
+import (
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// these are the keys of the scheduler.Requirements.Other values we use to pass
+// a job's affinity constraints on to the scheduler
+const (
+	reqSameHostAs    = "same_host_as"
+	reqAvoidRepGroup = "avoid_rep_grp"
+	reqAvoidHosts    = "avoid_hosts"
+)
+
+// affinityJob describes a job that has started running on a host, for the
+// purposes of checking affinity constraints.
+type affinityJob struct {
+	host     string
+	repGroup string
+	avoid    string
+}
+
+// hostRepGroup is used to count the jobs running on a host by RepGroup.
+type hostRepGroup struct {
+	host     string
+	repGroup string
+}
+
+// affinityReq returns the given req, or if the job has affinity constraints, a
+// clone of it with those constraints added to Other. This puts jobs with
+// different constraints in different scheduler groups, and lets our host check
+// callback see the constraints.
+func (j *Job) affinityReq(req *scheduler.Requirements) *scheduler.Requirements {
+	j.RLock()
+	sameHostAs, avoid, avoidHosts := j.SameHostAs, j.AvoidRepGroup, strings.Join(j.AvoidHosts, ",")
+	j.RUnlock()
+	if sameHostAs == "" && avoid == "" && avoidHosts == "" {
+		return req
+	}
+
+	req = req.Clone()
+	if req.Other == nil {
+		req.Other = make(map[string]string)
+	}
+	if sameHostAs != "" {
+		req.Other[reqSameHostAs] = sameHostAs
+	}
+	if avoid != "" {
+		req.Other[reqAvoidRepGroup] = avoid
+	}
+	if avoidHosts != "" {
+		req.Other[reqAvoidHosts] = avoidHosts
+	}
+	return req
+}
+
+// affinityJobStarted notes that the given job has started running on its host.
+// (This also counts the jobs running on each host for hostFull().)
+func (s *Server) affinityJobStarted(job *Job) {
+	key := job.Key()
+	job.RLock()
+	aj := &affinityJob{host: job.Host, repGroup: job.RepGroup, avoid: job.AvoidRepGroup}
+	job.RUnlock()
+	if aj.host == "" {
+		return
+	}
+
+	s.afmutex.Lock()
+	defer s.afmutex.Unlock()
+	if prev, existed := s.affinityJobs[key]; existed {
+		s.affinityUncount(prev)
+	}
+	s.affinityJobs[key] = aj
+	s.hostJobs[aj.host]++
+	s.hostRepGroups[hostRepGroup{aj.host, aj.repGroup}]++
+	if aj.avoid != "" {
+		s.hostAvoids[hostRepGroup{aj.host, aj.avoid}]++
+	}
+}
+
+// affinityJobStopped notes that the given job is no longer running. If it
+// completed, the host it ran on becomes the host for jobs that want to run on
+// the same host as its DepGroups.
+func (s *Server) affinityJobStopped(job *Job) {
+	key := job.Key()
+	job.RLock()
+	complete := job.State == JobStateComplete
+	host, depGroups := job.Host, job.DepGroups
+	job.RUnlock()
+
+	s.afmutex.Lock()
+	defer s.afmutex.Unlock()
+	if aj, existed := s.affinityJobs[key]; existed {
+		s.affinityUncount(aj)
+		delete(s.affinityJobs, key)
+	}
+	if complete && host != "" {
+		for _, dg := range depGroups {
+			s.depGroupHosts[dg] = host
+		}
+	}
+}
+
+// affinityUncount undoes the counts made for the given job by
+// affinityJobStarted(). You must hold the afmutex lock when calling this.
+func (s *Server) affinityUncount(aj *affinityJob) {
+	decrement := func(counts map[hostRepGroup]int, key hostRepGroup) {
+		counts[key]--
+		if counts[key] <= 0 {
+			delete(counts, key)
+		}
+	}
+	s.hostJobs[aj.host]--
+	if s.hostJobs[aj.host] <= 0 {
+		delete(s.hostJobs, aj.host)
+	}
+	decrement(s.hostRepGroups, hostRepGroup{aj.host, aj.repGroup})
+	if aj.avoid != "" {
+		decrement(s.hostAvoids, hostRepGroup{aj.host, aj.avoid})
+	}
+}
+
+// sameHost returns the host that jobs wanting to run on the same host as the
+// given DepGroup must run on. This is blank if no job in the DepGroup has
+// completed since we started, or if the host it ran on is not a cloud server
+// that still exists (on other schedulers we can't choose hosts, except for the
+// local scheduler, where there is only one host anyway).
+func (s *Server) sameHost(depGroup string) string {
+	s.afmutex.RLock()
+	host := s.depGroupHosts[depGroup]
+	s.afmutex.RUnlock()
+	if host == "" || s.scheduler.HostToID(host) == "" {
+		return ""
+	}
+	return host
+}
+
+// hostAllowsAffinity tells you if a job with the given RepGroup and affinity
+// constraints can start running on the given host (blank meaning a new host)
+// right now. A job can't run on a host running jobs in its AvoidRepGroup, nor on
+// a host running jobs that have its RepGroup as their AvoidRepGroup.
+func (s *Server) hostAllowsAffinity(host, repGroup, sameHostAs, avoid string) bool {
+	if sameHostAs != "" {
+		if same := s.sameHost(sameHostAs); same != "" && same != host {
+			return false
+		}
+	}
+	if host == "" {
+		return true
+	}
+
+	s.afmutex.RLock()
+	defer s.afmutex.RUnlock()
+	if avoid != "" && s.hostRepGroups[hostRepGroup{host, avoid}] > 0 {
+		return false
+	}
+	return repGroup == "" || s.hostAvoids[hostRepGroup{host, repGroup}] == 0
+}
+
+// affinityHostCheck is used by our scheduler.HostCheckCallBack, hostCheck(), to
+// stop the scheduler running runners for jobs with affinity constraints on
+// hosts that don't satisfy them.
+func (s *Server) affinityHostCheck(host string, req *scheduler.Requirements) bool {
+	sameHostAs, avoid, avoidHosts := req.Other[reqSameHostAs], req.Other[reqAvoidRepGroup], req.Other[reqAvoidHosts]
+	if sameHostAs == "" && avoid == "" && avoidHosts == "" {
+		return true
+	}
+	if avoidHosts != "" && hostIn(host, strings.Split(avoidHosts, ",")) {
+		return false
+	}
+	return s.hostAllowsAffinity(host, "", sameHostAs, avoid)
+}
+
+// affinityMatch returns a queue.Match for reserving jobs on the given host,
+// which rejects jobs whose affinity constraints that host does not satisfy. It
+// returns nil if host is blank.
+func (s *Server) affinityMatch(host string) queue.Match {
+	if host == "" {
+		return nil
+	}
+	return func(item *queue.Item) bool {
+		job, ok := item.Data().(*Job)
+		if !ok {
+			return true
+		}
+		job.RLock()
+		repGroup, sameHostAs, avoid := job.RepGroup, job.SameHostAs, job.AvoidRepGroup
+		avoided := hostIn(host, job.AvoidHosts)
+		job.RUnlock()
+		return !avoided && s.hostAllowsAffinity(host, repGroup, sameHostAs, avoid)
+	}
+}
+
+// hostIn tells you if the given host is one of the given hosts.
+func hostIn(host string, hosts []string) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the implementation of the ArchiveOutputs behaviour.
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// ArchiveSpec describes what an ArchiveOutputs Behaviour should upload, and
+// where.
+type ArchiveSpec struct {
+	// Dest is the bucket, optionally followed by a path within it, that files
+	// should be uploaded to, eg. "mybucket/results". Files will be placed in a
+	// sub-directory named after the Job's key, so that multiple Jobs can share
+	// the same Dest.
+	Dest string `json:"dest"`
+
+	// Profile and Backend say how to access Dest, as per the same fields of a
+	// MountTarget. By default Dest is in S3, accessed with credentials from
+	// your default profile.
+	Profile string `json:"profile,omitempty"`
+	Backend string `json:"backend,omitempty"`
+
+	// Files are glob patterns (relative to the Job's actual cwd if not
+	// absolute) of the files to upload. If none are supplied, the files
+	// recorded by earlier RecordOutputs and Checksum Behaviours are uploaded.
+	Files []string `json:"files,omitempty"`
+}
+
+// String converts the spec to the string form needed for the Arg of an
+// ArchiveOutputs Behaviour.
+func (a *ArchiveSpec) String() string {
+	return specString(a)
+}
+
+// archiveSpecFromArg converts the Arg of an ArchiveOutputs Behaviour back to an
+// ArchiveSpec.
+func archiveSpecFromArg(arg interface{}) (*ArchiveSpec, error) {
+	spec := &ArchiveSpec{}
+	if err := jsonSpecArg(arg, spec); err != nil {
+		return nil, err
+	}
+	if spec.Dest == "" {
+		return nil, fmt.Errorf("arg %s has no dest", arg)
+	}
+	if !validMountBackend(spec.Backend) {
+		return nil, fmt.Errorf("arg %s has an unknown backend", arg)
+	}
+	return spec, nil
+}
+
+// archiveOutputs uploads the files described by our ArchiveSpec Arg, and
+// records them as Artifacts of the Job with their Remote location.
+func (b *Behaviour) archiveOutputs(j *Job) error {
+	spec, err := archiveSpecFromArg(b.Arg)
+	if err != nil {
+		return err
+	}
+
+	var artifacts []*Artifact
+	var merr *multierror.Error
+	if len(spec.Files) > 0 {
+		artifacts, err = j.artifactsMatching(spec.Files)
+		if err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	} else {
+		j.RLock()
+		artifacts = j.behaviourArtifacts
+		j.RUnlock()
+	}
+	if len(artifacts) == 0 {
+		merr = multierror.Append(merr, fmt.Errorf("archive behaviour had no files to upload"))
+		return merr.ErrorOrNil()
+	}
+
+	accessor, err := MountTarget{Path: spec.Dest, Profile: spec.Profile, Backend: spec.Backend}.Accessor()
+	if err != nil {
+		return err
+	}
+
+	j.RLock()
+	cwd := j.ranIn()
+	j.RUnlock()
+	key := j.Key()
+
+	archived := make([]*Artifact, 0, len(artifacts))
+	for _, a := range artifacts {
+		rel, errr := filepath.Rel(cwd, a.Path)
+		if errr != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			rel = filepath.Base(a.Path)
+		}
+		remote := path.Join(key, filepath.ToSlash(rel))
+
+		if erru := accessor.UploadFile(a.Path, accessor.RemotePath(remote), ""); erru != nil {
+			merr = multierror.Append(merr, fmt.Errorf("archiving [%s] failed: %w", a.Path, erru))
+			continue
+		}
+
+		copied := *a
+		copied.Remote = path.Join(spec.Dest, remote)
+		archived = append(archived, &copied)
+	}
+
+	j.Lock()
+	j.behaviourArtifacts = mergeArtifacts(j.behaviourArtifacts, archived)
+	j.Unlock()
+	return merr.ErrorOrNil()
+}
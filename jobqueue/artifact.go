@@ -0,0 +1,486 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for recording the output files that jobs
+// declared in their Outputs (or registered while running or afterwards), for
+// letting people list and download them, for verifying them when jobs are
+// rerun, and for checking jobs created their ExpectedOutputs.
+
+import (
+	"crypto/md5" // #nosec only used to let users verify their files
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/muxfys/v4"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// Artifact describes an output file of a Job that was recorded after the Job's
+// Cmd exited successfully.
+type Artifact struct {
+	// Path is the absolute path of the file on the Job's Host.
+	Path string
+
+	// Size is the size of the file in bytes.
+	Size int64
+
+	// MD5 is the hex encoded MD5 checksum of the file's contents.
+	MD5 string
+
+	// SHA256 is the hex encoded SHA256 checksum of the file's contents, if it
+	// was recorded by a Checksum Behaviour asked to compute it.
+	SHA256 string `json:",omitempty"`
+
+	// Remote is set if the file was created within a writable mount (see
+	// MountConfigs), in which case it is the remote location (bucket name and
+	// path) that the file was uploaded to when the mount was unmounted.
+	Remote string `json:",omitempty"`
+}
+
+// missingOutputs returns those of our ExpectedOutputs that did not match any
+// non-empty regular file. Relative ExpectedOutputs are relative to the
+// directory the Cmd ran in.
+func (j *Job) missingOutputs() []string {
+	j.RLock()
+	defer j.RUnlock()
+
+	cwd := j.ranIn()
+
+	var missing []string
+	for _, output := range j.ExpectedOutputs {
+		pattern := output
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(cwd, pattern)
+		}
+
+		// an invalid pattern matches nothing, so counts as missing
+		paths, _ := filepath.Glob(pattern)
+
+		found := false
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, output)
+		}
+	}
+
+	return missing
+}
+
+// recordArtifacts finds the files matching our Outputs, along with the given
+// extra patterns (that the Cmd registered while running), and returns Artifacts
+// describing them. Relative Outputs are relative to the directory the Cmd ran
+// in. An error is returned if any of the Outputs matched no files or could not
+// be read, but Artifacts are still returned for the files that could.
+func (j *Job) recordArtifacts(extra []string) ([]*Artifact, error) {
+	j.RLock()
+	patterns := append(append([]string{}, j.Outputs...), extra...)
+	j.RUnlock()
+	return j.artifactsMatching(patterns)
+}
+
+// artifactsMatching is like recordArtifacts(), but only considers the given
+// patterns.
+func (j *Job) artifactsMatching(patterns []string) ([]*Artifact, error) {
+	j.RLock()
+	defer j.RUnlock()
+
+	cwd := j.ranIn()
+
+	var artifacts []*Artifact
+	var merr *multierror.Error
+	seen := make(map[string]bool)
+	for _, output := range patterns {
+		pattern := output
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(cwd, pattern)
+		}
+
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("output [%s] is not a valid pattern: %w", output, err))
+			continue
+		}
+
+		found := false
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				merr = multierror.Append(merr, err)
+				continue
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			found = true
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+
+			sum, err := fileMD5(path)
+			if err != nil {
+				merr = multierror.Append(merr, err)
+				continue
+			}
+
+			artifacts = append(artifacts, &Artifact{
+				Path:   path,
+				Size:   info.Size(),
+				MD5:    sum,
+				Remote: j.remoteLocation(path, cwd),
+			})
+		}
+
+		if !found {
+			merr = multierror.Append(merr, fmt.Errorf("output [%s] matched no files", output))
+		}
+	}
+
+	return artifacts, merr.ErrorOrNil()
+}
+
+// readOutputsFile returns the non-blank lines of the file at the given path,
+// which a Cmd can write the paths (or glob patterns) of its output files to,
+// one per line, via the WR_OUTPUTS_FILE environment variable. A file that was
+// never written to results in no paths and no error.
+func readOutputsFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path) // #nosec we created this file
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var paths []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// mergeArtifacts returns the given existing Artifacts with the given new ones
+// added, where a new Artifact with the same Path as an existing one replaces
+// it.
+func mergeArtifacts(existing, additional []*Artifact) []*Artifact {
+	if len(additional) == 0 {
+		return existing
+	}
+
+	index := make(map[string]int, len(existing)+len(additional))
+	merged := make([]*Artifact, 0, len(existing)+len(additional))
+	for _, a := range append(append([]*Artifact{}, existing...), additional...) {
+		if i, seen := index[a.Path]; seen {
+			merged[i] = a
+			continue
+		}
+		index[a.Path] = len(merged)
+		merged = append(merged, a)
+	}
+	return merged
+}
+
+// validateArtifacts checks that the given Artifacts, that someone wants to
+// register against a complete job, have absolute Paths and sensible Sizes.
+func validateArtifacts(artifacts []*Artifact) error {
+	if len(artifacts) == 0 {
+		return fmt.Errorf("no artifacts supplied")
+	}
+	for _, a := range artifacts {
+		switch {
+		case a == nil:
+			return fmt.Errorf("nil artifact supplied")
+		case !filepath.IsAbs(a.Path):
+			return fmt.Errorf("artifact path [%s] is not absolute", a.Path)
+		case a.Size < 0:
+			return fmt.Errorf("artifact [%s] has a negative size", a.Path)
+		}
+	}
+	return nil
+}
+
+// remoteLocation returns the remote location that the file at the given path
+// will be uploaded to, if it is within one of our writable mounts. Otherwise
+// returns a blank string. You must hold at least a read lock on the Job.
+func (j *Job) remoteLocation(path, cwd string) string {
+	for _, mc := range j.MountConfigs {
+		var target string
+		for _, mt := range mc.Targets {
+			if mt.Write {
+				target = mt.Path
+				break
+			}
+		}
+		if target == "" {
+			continue
+		}
+
+		// (this matches how Mount() determines the mount point)
+		mount := mc.Mount
+		switch {
+		case mount == "" && j.ActualCwd != "":
+			mount = j.ActualCwd
+		case mount == "":
+			mount = filepath.Join(j.Cwd, "mnt")
+		case !filepath.IsAbs(mount):
+			mount = filepath.Join(cwd, mount)
+		}
+
+		rel, err := filepath.Rel(mount, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return strings.TrimSuffix(target, "/") + "/" + filepath.ToSlash(rel)
+	}
+	return ""
+}
+
+// DownloadRemoteArtifact downloads the given Artifact of ours, which must have
+// a Remote location, from S3 to the given local path. The credentials used are
+// those of the Profile of the writable mount target the Artifact was uploaded
+// to (taken from the current environment, as with Mount()).
+func (j *Job) DownloadRemoteArtifact(a *Artifact, local string) error {
+	if a.Remote == "" {
+		return fmt.Errorf("artifact [%s] was not uploaded anywhere", a.Path)
+	}
+	bucketAndKey := strings.SplitN(a.Remote, "/", 2)
+	if len(bucketAndKey) != 2 || bucketAndKey[1] == "" {
+		return fmt.Errorf("artifact [%s] has invalid remote location [%s]", a.Path, a.Remote)
+	}
+
+	var profile string
+	j.RLock()
+	for _, mc := range j.MountConfigs {
+		for _, mt := range mc.Targets {
+			if mt.Write && strings.HasPrefix(a.Remote, strings.TrimSuffix(mt.Path, "/")+"/") {
+				profile = mt.Profile
+			}
+		}
+	}
+	j.RUnlock()
+
+	accessorConfig, err := muxfys.S3ConfigFromEnvironment(profile, bucketAndKey[0])
+	if err != nil {
+		return err
+	}
+	accessor, err := muxfys.NewS3Accessor(accessorConfig)
+	if err != nil {
+		return err
+	}
+	return accessor.DownloadFile(bucketAndKey[1], local)
+}
+
+// fileMD5 returns the hex encoded MD5 checksum of the given file's contents.
+func fileMD5(path string) (sum string, err error) {
+	f, err := os.Open(path) // #nosec
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if errc := f.Close(); errc != nil && err == nil {
+			err = errc
+		}
+	}()
+
+	h := md5.New() // #nosec
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyPriorArtifacts checks that the files recorded in our PriorArtifacts
+// still exist with the same size and MD5 checksum, returning an error about
+// the first that doesn't.
+func (j *Job) verifyPriorArtifacts() error {
+	j.RLock()
+	defer j.RUnlock()
+	for _, artifact := range j.PriorArtifacts {
+		info, err := os.Stat(artifact.Path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() != artifact.Size {
+			return fmt.Errorf("output %s has changed size", artifact.Path)
+		}
+		sum, err := fileMD5(artifact.Path)
+		if err != nil {
+			return err
+		}
+		if sum != artifact.MD5 {
+			return fmt.Errorf("output %s has changed checksum", artifact.Path)
+		}
+	}
+	return nil
+}
+
+// completeVerified is used by Execute() instead of running a Job's Cmd when
+// the Job has VerifyOutputs and verifyPriorArtifacts() found that the outputs
+// of its previous run are still intact. It archives the Job as if its Cmd had
+// run successfully and recorded its PriorArtifacts, without triggering any
+// Behaviours.
+func (c *Client) completeVerified(job *Job, actualCwd string, stopTouching chan bool) error {
+	stopTouching <- true
+
+	_, err := job.Unmount()
+	if err != nil {
+		return fmt.Errorf("outputs of command [%s] were verified, but unmounting failed: %w", job.Cmd, err)
+	}
+
+	err = c.Started(job, os.Getpid())
+	if err != nil {
+		// it will auto-Release
+		return fmt.Errorf("outputs of command [%s] were verified, but a jobqueue server error stopped it being completed: %w", job.Cmd, err)
+	}
+
+	job.RLock()
+	artifacts := job.PriorArtifacts
+	job.RUnlock()
+	return c.Archive(job, &JobEndState{
+		Cwd:       actualCwd,
+		EndTime:   time.Now(),
+		Stdout:    []byte(fmt.Sprintf("wr: not run, since its %d previously recorded outputs were verified to be unchanged", len(artifacts))),
+		Artifacts: artifacts,
+		Exited:    true,
+	})
+}
+
+// attachPriorArtifacts sets the PriorArtifacts of those of the given new jobs
+// that have VerifyOutputs and previously completed, so that runners can check
+// if their outputs are still intact and avoid running them again.
+func (s *Server) attachPriorArtifacts(jobs []*Job) error {
+	var keys []string
+	byKey := make(map[string]*Job)
+	for _, job := range jobs {
+		job.RLock()
+		verify := job.VerifyOutputs
+		job.RUnlock()
+		if !verify {
+			continue
+		}
+		key := job.Key()
+		keys = append(keys, key)
+		byKey[key] = job
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	complete, err := s.db.retrieveCompleteJobsByKeys(keys)
+	if err != nil {
+		return err
+	}
+	for _, cjob := range complete {
+		job, found := byKey[cjob.Key()]
+		if !found {
+			continue
+		}
+		job.Lock()
+		job.PriorArtifacts = cjob.Artifacts
+		job.Unlock()
+	}
+	return nil
+}
+
+// registerArtifacts merges the given Artifacts in to those recorded for the
+// complete job with the given key, so that outputs created or uploaded after
+// the job finished (eg. by a separate post-processing tool) can be found in the
+// same way as the ones recorded by the runner. Returns the job's resulting
+// Artifacts.
+func (s *Server) registerArtifacts(key string, artifacts []*Artifact) ([]*Artifact, string, string) {
+	if err := validateArtifacts(artifacts); err != nil {
+		return nil, ErrBadArtifact, err.Error()
+	}
+
+	// a job that is being run again will have its Artifacts replaced when it
+	// completes, so we don't let people register against it in the meantime
+	if item, err := s.q.Get(key); err == nil && item != nil {
+		return nil, ErrNotComplete, ""
+	}
+
+	merged, err := s.db.addCompleteJobArtifacts(key, artifacts)
+	if err != nil {
+		return nil, ErrDBError, err.Error()
+	}
+	if merged == nil {
+		return nil, ErrMissingJob, ""
+	}
+	return merged, "", ""
+}
+
+// jobArtifact returns the Artifacts of the job with the given key (which may
+// be live or complete), and the one of those with the given path, if any. The
+// bool is false if there is no such job.
+func (s *Server) jobArtifact(key, path string) ([]*Artifact, *Artifact, bool) {
+	jobs, _, qerr := s.getJobsByKeys([]string{key}, false, false)
+	if qerr != "" || len(jobs) == 0 {
+		return nil, nil, false
+	}
+	job := jobs[0]
+	job.RLock()
+	artifacts := job.Artifacts
+	job.RUnlock()
+
+	for _, a := range artifacts {
+		if a.Path == path {
+			return artifacts, a, true
+		}
+	}
+	return artifacts, nil, true
+}
+
+// readArtifact returns the compressed content of the given path, which must be
+// one of the Artifacts of the job with the given key, and readable from the
+// machine we're running on.
+func (s *Server) readArtifact(key, path string) ([]byte, string, string) {
+	_, artifact, found := s.jobArtifact(key, path)
+	if !found {
+		return nil, ErrMissingJob, ""
+	}
+	if artifact == nil {
+		return nil, ErrNoArtifact, "not an artifact of this job"
+	}
+
+	compressed, err := compressFile(artifact.Path)
+	if err != nil {
+		msg := "artifact is not available from the manager's host"
+		if artifact.Remote != "" {
+			msg += "; it was uploaded to " + artifact.Remote
+		}
+		return nil, ErrNoArtifact, msg
+	}
+	return compressed, "", ""
+}
@@ -0,0 +1,271 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for authenticating and authorising connections
+// to the server, which sites can customise by supplying their own
+// Authenticator in ServerConfig.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"nanomsg.org/go-mangos"
+)
+
+// AuthKind* describe the kind of connection an AuthRequest is for.
+const (
+	// AuthKindClient is for requests from Clients, including runners, over
+	// the client/server protocol.
+	AuthKindClient = "client"
+
+	// AuthKindREST is for requests to the REST API.
+	AuthKindREST = "rest"
+
+	// AuthKindWeb is for requests for the status web interface and its
+	// websocket.
+	AuthKindWeb = "web"
+
+	// AuthKindGRPC is for calls to the gRPC service.
+	AuthKindGRPC = "grpc"
+)
+
+// AuthRequest describes an incoming request that needs to be authenticated.
+type AuthRequest struct {
+	// Kind is one of the AuthKind* constants.
+	Kind string
+
+	// Method is, for AuthKindClient requests, the name of the Client request
+	// (eg. "add" or "reserve"), for AuthKindGRPC requests the full name of the
+	// gRPC method (eg. "/jobqueuepb.Manager/AddJobs"), and otherwise the HTTP
+	// method.
+	Method string
+
+	// Namespace is the namespace a Client is working in, if any.
+	Namespace string
+
+	// RemoteIP is the IP address the request came from, if known.
+	RemoteIP net.IP
+
+	// Token is the token the request presented, if any.
+	Token []byte
+
+	// TokenValid is true if Token is the server's own token, as known by
+	// runners it spawns and users with access to the token file, or the token
+	// given to an enrolled host (see Enrol()) that hasn't been revoked. Host
+	// tokens are only valid for AuthKindClient requests that also present that
+	// host's ClientCert.
+	TokenValid bool
+
+	// ClientCert is the verified client certificate that an AuthKindClient
+	// request's connection presented, if any.
+	ClientCert *x509.Certificate
+
+	// EnrolledHost is the name of the enrolled host (see Enrol()) whose
+	// unrevoked client certificate was presented as ClientCert, if any.
+	EnrolledHost string
+
+	// HTTP is the request for AuthKindREST and AuthKindWeb requests, letting
+	// you inspect its headers and cookies (eg. for OIDC). It is nil for
+	// AuthKindClient requests.
+	HTTP *http.Request
+
+	// User is who is making the request, which Authenticators that can tell
+	// (eg. from an OIDC session, or the subject of a ClientCert) should set
+	// when allowing a request. Clients identified this way add jobs as this
+	// User (instead of the user they claim to be), and status web interface
+	// users only get to see and act on their own jobs, unless they are an
+	// Admin. Leaving it blank means the request is not limited in this way.
+	User string
+
+	// Admin can be set true by Authenticators to let an identified User see
+	// and act on everyone's jobs. (Users in ServerConfig.Admins are also
+	// admins.)
+	Admin bool
+}
+
+// Authenticator is the interface sites can implement to decide who is allowed
+// to use the server, eg. by checking LDAP group membership or an OIDC session.
+// Authenticate should return nil if the request is allowed, or an error
+// explaining why it is not.
+//
+// Runners spawned by the server authenticate with the server's token, so
+// Authenticators should normally allow AuthKindClient requests with a
+// TokenValid.
+type Authenticator interface {
+	Authenticate(req *AuthRequest) error
+}
+
+// AuthenticatorFunc lets you use an ordinary function as an Authenticator.
+type AuthenticatorFunc func(req *AuthRequest) error
+
+// Authenticate calls f(req).
+func (f AuthenticatorFunc) Authenticate(req *AuthRequest) error {
+	return f(req)
+}
+
+var (
+	errAuthNoToken      = errors.New("token required")
+	errAuthInvalidToken = errors.New("invalid token")
+)
+
+// RequireToken is the default Authenticator, which only allows requests that
+// present the server's token.
+var RequireToken Authenticator = AuthenticatorFunc(func(req *AuthRequest) error {
+	if len(req.Token) == 0 {
+		return errAuthNoToken
+	}
+	if !req.TokenValid {
+		return errAuthInvalidToken
+	}
+	return nil
+})
+
+// AllOf returns an Authenticator that only allows requests that all of the
+// given Authenticators allow, eg. AllOf(RequireToken, ipAllowList).
+func AllOf(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(req *AuthRequest) error {
+		for _, auth := range auths {
+			if err := auth.Authenticate(req); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AnyOf returns an Authenticator that allows requests that any of the given
+// Authenticators allow, eg. AnyOf(RequireToken, oidc) to let runners use the
+// token while people log in. If none allow it, the first error is returned.
+func AnyOf(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(req *AuthRequest) error {
+		var first error
+		for _, auth := range auths {
+			err := auth.Authenticate(req)
+			if err == nil {
+				return nil
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first == nil {
+			first = errors.New("no authenticators")
+		}
+		return first
+	})
+}
+
+// AllowCIDRs returns an Authenticator that only allows requests from IP
+// addresses within the given CIDRs (eg. "192.168.0.0/16"). Requests whose IP
+// address is not known are not allowed.
+func AllowCIDRs(cidrs ...string) (Authenticator, error) {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets[i] = ipnet
+	}
+
+	return AuthenticatorFunc(func(req *AuthRequest) error {
+		if req.RemoteIP == nil {
+			return errors.New("remote IP address unknown")
+		}
+		for _, ipnet := range nets {
+			if ipnet.Contains(req.RemoteIP) {
+				return nil
+			}
+		}
+		return fmt.Errorf("IP address %s not allowed", req.RemoteIP)
+	}), nil
+}
+
+// authenticate checks the given request against our Authenticator, filling in
+// its TokenValid first.
+func (s *Server) authenticate(req *AuthRequest) error {
+	req.TokenValid = len(req.Token) == tokenLength && tokenMatches(req.Token, s.token)
+	if s.enrol != nil {
+		var certSerial string
+		if req.ClientCert != nil {
+			certSerial = req.ClientCert.SerialNumber.Text(16)
+			req.EnrolledHost = s.enrol.hostFor(certSerial)
+		}
+		if !req.TokenValid && len(req.Token) == tokenLength {
+			serial := s.enrol.serialForToken(req.Token)
+			req.TokenValid = serial != "" && (req.Kind != AuthKindClient || serial == certSerial)
+		}
+	}
+	return s.auth.Authenticate(req)
+}
+
+// clientAuthRequest creates an AuthRequest for the given client request, which
+// arrived in the given message.
+func clientAuthRequest(cr *clientRequest, m *mangos.Message) *AuthRequest {
+	req := &AuthRequest{
+		Kind:      AuthKindClient,
+		Method:    cr.Method,
+		Namespace: cr.Namespace,
+		Token:     cr.Token,
+	}
+	if m.Port != nil {
+		if addr, err := m.Port.GetProp(mangos.PropRemoteAddr); err == nil {
+			if a, ok := addr.(net.Addr); ok {
+				req.RemoteIP = addrIP(a.String())
+			}
+		}
+		if state, err := m.Port.GetProp(mangos.PropTLSConnState); err == nil {
+			if cs, ok := state.(tls.ConnectionState); ok && len(cs.PeerCertificates) > 0 {
+				req.ClientCert = cs.PeerCertificates[0]
+			}
+		}
+	}
+	return req
+}
+
+// httpAuthRequest creates an AuthRequest for the given HTTP request, which
+// presented the given token.
+func httpAuthRequest(r *http.Request, token string) *AuthRequest {
+	kind := AuthKindWeb
+	if strings.HasPrefix(r.URL.Path, "/rest/") {
+		kind = AuthKindREST
+	}
+	return &AuthRequest{
+		Kind:     kind,
+		Method:   r.Method,
+		RemoteIP: addrIP(r.RemoteAddr),
+		Token:    []byte(token),
+		HTTP:     r,
+	}
+}
+
+// addrIP returns the IP address part of the given host:port address, or nil.
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
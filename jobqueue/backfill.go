@@ -0,0 +1,126 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets runners kept around for jobs that
+// aren't ready yet run short jobs from other scheduler groups in the meantime.
+
+import (
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// reqsFitGap tells you if a job with the given Requirements could be run by a
+// runner that was scheduled for the given runner Requirements, and would be
+// expected to finish within the given gap.
+func reqsFitGap(runner, job *scheduler.Requirements, gap time.Duration) bool {
+	if job.Time <= 0 || job.Time > gap {
+		return false
+	}
+	return reqsFitRunner(runner, job, 1)
+}
+
+// groupReadyIn returns how long it will be until the next of the delayed jobs
+// (eg. those waiting for a run window to open, or to be retried) of the given
+// scheduler group becomes ready. Returns false if the group has no delayed
+// jobs.
+func (s *Server) groupReadyIn(group string) (time.Duration, bool) {
+	var gap time.Duration
+	found := false
+	s.q.Each(func(item *queue.Item) bool {
+		if item.State() != queue.ItemStateDelay {
+			return true
+		}
+		job, ok := item.Data().(*Job)
+		if !ok || job.getSchedulerGroup() != group {
+			return true
+		}
+		remaining := time.Until(item.ReadyAt())
+		if !found || remaining < gap {
+			gap = remaining
+			found = true
+		}
+		return true
+	})
+	return gap, found
+}
+
+// backfillGroups returns the scheduler groups with jobs that need running
+// whose Requirements fit within those of the given runner's scheduler group,
+// and which are expected to complete within the given gap, best fitting first.
+func (s *Server) backfillGroups(runnerGroup string, gap time.Duration) []string {
+	s.sgcmutex.Lock()
+	defer s.sgcmutex.Unlock()
+	runnerReq, known := s.sgtr[runnerGroup]
+	if !known {
+		return nil
+	}
+
+	var groups []string
+	for group, count := range s.sgroupcounts {
+		if group == runnerGroup || count <= 0 {
+			continue
+		}
+		req, known := s.sgtr[group]
+		if !known || !reqsFitGap(runnerReq, req, gap) {
+			continue
+		}
+		groups = append(groups, group)
+	}
+
+	s.sortGroupsByFit(groups)
+	return groups
+}
+
+// reserveBackfill is used when a runner for the given scheduler group found
+// nothing to reserve, not even with runner reuse. If backfill has been
+// configured and the group has jobs that will become ready later, it tries to
+// reserve a ready job from another group that fits in to what the runner was
+// scheduled for and whose expected run time (its Requirements.Time) ends
+// before the group's next job is ready, so that the runner's resources aren't
+// idle in the meantime. Returns a nil item if there was nothing suitable.
+func (s *Server) reserveBackfill(runnerGroup string, match queue.Match) (*queue.Item, error) {
+	s.tmutex.RLock()
+	backfill := s.backfill
+	s.tmutex.RUnlock()
+	if !backfill {
+		return nil, nil
+	}
+
+	gap, delayed := s.groupReadyIn(runnerGroup)
+	if !delayed || gap <= 0 {
+		return nil, nil
+	}
+
+	groups := s.backfillGroups(runnerGroup, gap)
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	item, err := s.reserveFromGroupsWithLimits(groups, 0, nil, match)
+	if err != nil {
+		if qerr, ok := err.(queue.Error); ok && qerr.Err == queue.ErrNothingReady {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s.Debug("idle runner backfilled", "runner", runnerGroup, "group", item.ReserveGroup, "gap", gap)
+	return item, nil
+}
@@ -0,0 +1,275 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for dealing with cloud servers that go bad.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// BadServer* are the possible BadServerPolicy Actions.
+const (
+	// BadServerConfirm waits for a user to confirm that a bad server is dead
+	// (or for ServerConfig.AutoConfirmDead to pass) before destroying it.
+	BadServerConfirm = "confirm"
+
+	// BadServerDestroy destroys a bad server (letting the scheduler spawn a
+	// replacement if one is still needed) as soon as it has failed Probes
+	// checks in a row, or straight away if it has a permanent problem.
+	BadServerDestroy = "destroy"
+
+	// BadServerQuarantine never uses a bad server again, even if it starts
+	// working, and never destroys it automatically, so that it can be
+	// manually inspected before a user confirms it is dead.
+	BadServerQuarantine = "quarantine"
+
+	// BadServerReboot reboots a bad server once it has failed Probes checks in
+	// a row, then destroys it if it hasn't started working again within
+	// RebootWait. Servers with a permanent problem are destroyed straight
+	// away, since a reboot won't fix them.
+	BadServerReboot = "reboot"
+)
+
+// these are the BadServer.Actions reported for what has been done to a bad
+// server
+const (
+	badServerRebooted    = "rebooted"
+	badServerQuarantined = "quarantined"
+	badServerDestroyed   = "destroyed"
+)
+
+// BadServerPolicy describes what to do about cloud servers that go bad.
+type BadServerPolicy struct {
+	// Action is one of the BadServer* constants. The default of "" is treated
+	// as BadServerConfirm.
+	Action string
+
+	// Probes is the number of checks in a row a server must fail before it is
+	// destroyed or rebooted. The default of 0 is treated as 1.
+	Probes int
+
+	// RebootWait is how long to give a rebooted server to start working again
+	// before destroying it. The default of 0 is treated as 5 minutes.
+	RebootWait time.Duration
+}
+
+// validate checks the policy makes sense.
+func (p *BadServerPolicy) validate() error {
+	switch p.Action {
+	case "", BadServerConfirm, BadServerDestroy, BadServerQuarantine, BadServerReboot:
+	default:
+		return fmt.Errorf("BadServerPolicy Action must be one of %s, %s, %s or %s", BadServerConfirm, BadServerDestroy, BadServerQuarantine, BadServerReboot)
+	}
+	if p.Probes < 0 {
+		return fmt.Errorf("BadServerPolicy Probes can't be negative")
+	}
+	if p.RebootWait < 0 {
+		return fmt.Errorf("BadServerPolicy RebootWait can't be negative")
+	}
+	return nil
+}
+
+// badServerPolicy returns a copy of our current BadServerPolicy with defaults
+// filled in.
+func (s *Server) badServerPolicy() BadServerPolicy {
+	s.tmutex.RLock()
+	var policy BadServerPolicy
+	if s.bsPolicy != nil {
+		policy = *s.bsPolicy
+	}
+	s.tmutex.RUnlock()
+
+	if policy.Action == "" {
+		policy.Action = BadServerConfirm
+	}
+	if policy.Probes == 0 {
+		policy.Probes = 1
+	}
+	if policy.RebootWait == 0 {
+		policy.RebootWait = 5 * time.Minute
+	}
+	return policy
+}
+
+// badServerReported is our scheduler's BadServerCallBack. It keeps track of bad
+// servers, deals with them according to our BadServerPolicy, and tells the
+// status webpage about them.
+func (s *Server) badServerReported(server *cloud.Server) {
+	if !server.IsBad() {
+		s.bsmutex.Lock()
+		delete(s.badServers, server.ID)
+		action := s.badServerActions[server.ID]
+		delete(s.badServerActions, server.ID)
+		s.bsmutex.Unlock()
+		if action == badServerRebooted {
+			s.Warn("bad server started working again after being rebooted", "server", server.ID)
+		}
+		s.sendBadServer(server, "")
+		return
+	}
+
+	// double check that due to timing issues this server hasn't been
+	// destroyed, which is not something to warn anyone about
+	if server.Destroyed() {
+		return
+	}
+
+	s.bsmutex.Lock()
+	_, known := s.badServers[server.ID]
+	s.badServers[server.ID] = server
+	action := s.badServerActions[server.ID]
+	s.bsmutex.Unlock()
+
+	policy := s.badServerPolicy()
+	switch policy.Action {
+	case BadServerDestroy:
+		if server.PermanentProblem() != "" || server.FailedProbes() >= policy.Probes {
+			s.destroyBadServer(server, "bad server destroyed due to policy")
+			return
+		}
+	case BadServerReboot:
+		switch {
+		case server.PermanentProblem() != "":
+			s.destroyBadServer(server, "bad server with a permanent problem destroyed due to policy")
+			return
+		case action == "" && server.FailedProbes() >= policy.Probes:
+			s.rebootBadServer(server, policy.RebootWait)
+			return
+		}
+	case BadServerQuarantine:
+		if action == "" {
+			if server.PermanentProblem() == "" {
+				server.GoneBad("quarantined after it stopped responding")
+			}
+			s.setBadServerAction(server, badServerQuarantined)
+			s.Warn("bad server quarantined due to policy", "server", server.ID, "problem", server.PermanentProblem())
+			s.sendBadServer(server, badServerQuarantined)
+		}
+		return
+	}
+
+	if known {
+		return
+	}
+
+	if policy.Action == BadServerConfirm {
+		s.autoConfirmDeadLater(server)
+	}
+	s.sendBadServer(server, action)
+}
+
+// autoConfirmDeadLater arranges to destroy the given bad server if it is still
+// bad after our configured AutoConfirmDead time.
+func (s *Server) autoConfirmDeadLater(server *cloud.Server) {
+	s.tmutex.RLock()
+	autoConfirmDead := s.autoConfirmDead
+	s.tmutex.RUnlock()
+	if autoConfirmDead <= 0 {
+		return
+	}
+
+	go func() {
+		defer internal.LogPanic(s.Logger, "autoConfirmDeadLater", false)
+		<-time.After(autoConfirmDead)
+		s.bsmutex.RLock()
+		badServer, exists := s.badServers[server.ID]
+		s.bsmutex.RUnlock()
+		if exists && badServer.BadDuration() >= autoConfirmDead {
+			s.destroyBadServer(badServer, "server destroyed after remaining bad for some time")
+		}
+	}()
+}
+
+// rebootBadServer reboots the given bad server, and arranges to destroy it if
+// it is still bad after the given wait.
+func (s *Server) rebootBadServer(server *cloud.Server, wait time.Duration) {
+	s.setBadServerAction(server, badServerRebooted)
+	err := server.Reboot()
+	s.Warn("bad server rebooted due to policy", "server", server.ID, "probes", server.FailedProbes(), "err", err)
+	if err != nil {
+		s.destroyBadServer(server, "bad server destroyed after failing to reboot")
+		return
+	}
+	s.sendBadServer(server, badServerRebooted)
+
+	go func() {
+		defer internal.LogPanic(s.Logger, "rebootBadServer", false)
+		<-time.After(wait)
+		s.bsmutex.RLock()
+		_, stillBad := s.badServers[server.ID]
+		s.bsmutex.RUnlock()
+		if stillBad && server.IsBad() && !server.Destroyed() {
+			s.destroyBadServer(server, "rebooted bad server destroyed after failing to start working again")
+		}
+	}()
+}
+
+// destroyBadServer destroys the given bad server, kills the jobs that were
+// running on it, and tells the status webpage it is gone. The given msg is
+// logged.
+func (s *Server) destroyBadServer(server *cloud.Server, msg string) {
+	s.bsmutex.Lock()
+	delete(s.badServers, server.ID)
+	delete(s.badServerActions, server.ID)
+	s.bsmutex.Unlock()
+
+	waited := server.BadDuration()
+	errd := server.Destroy()
+	s.Warn(msg, "server", server.ID, "waited", waited, "err", errd)
+	s.killJobsOnServers(map[string]bool{server.ID: true})
+
+	if errd == nil {
+		// make the message in the web interface about this server go away
+		s.badServerCaster.Send(&BadServer{
+			ID:      server.ID,
+			Name:    server.Name,
+			IP:      server.IP,
+			Date:    time.Now().Unix(),
+			IsBad:   false,
+			Problem: server.PermanentProblem(),
+			Action:  badServerDestroyed,
+		})
+	}
+}
+
+// setBadServerAction records what we've done about a bad server.
+func (s *Server) setBadServerAction(server *cloud.Server, action string) {
+	s.bsmutex.Lock()
+	defer s.bsmutex.Unlock()
+	s.badServerActions[server.ID] = action
+}
+
+// sendBadServer tells the status webpage about the given server, which may no
+// longer be bad, and what we've done about it.
+func (s *Server) sendBadServer(server *cloud.Server, action string) {
+	s.badServerCaster.Send(&BadServer{
+		ID:      server.ID,
+		Name:    server.Name,
+		IP:      server.IP,
+		Date:    time.Now().Unix(),
+		IsBad:   server.IsBad(),
+		Problem: server.PermanentProblem(),
+		Action:  action,
+	})
+}
@@ -25,10 +25,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 )
@@ -51,6 +54,18 @@ const (
 	// OnFailure is a BehaviourTrigger for Behaviours that should trigger when a
 	// Job's Cmd is executed and exits non-0.
 	OnFailure
+
+	// OnExitCode is a BehaviourTrigger for Behaviours that should trigger when a
+	// Job's Cmd is executed and exits with the Behaviour's ExitCode. These
+	// behaviours trigger after OnSuccess and OnFailure ones, but before OnExit
+	// ones.
+	OnExitCode
+
+	// OnFailReason is a BehaviourTrigger for Behaviours that should trigger
+	// when a Job's Cmd is executed and fails with the Behaviour's FailReason
+	// (one of the FailReason* strings). These behaviours trigger alongside
+	// OnExitCode ones.
+	OnFailReason
 )
 
 // BehaviourAction is supplied to a Behaviour to define what should happen when
@@ -88,6 +103,46 @@ const (
 	// for situations where you want to store a desire to change another
 	// Behaviour to turn it off.
 	Nothing
+
+	// UploadCwd is a BehaviourAction that copies (some of) the contents of the
+	// Job's actual cwd to a destination directory, typically a writable mount,
+	// so that they get uploaded when the Job's mounts are unmounted. It is
+	// intended to be triggered OnFailure, so that failures on ephemeral hosts
+	// can be debugged after the host is gone. It takes an UploadCwdSpec
+	// converted to a string with its String() method as its Arg.
+	UploadCwd
+
+	// RecordOutputs is a BehaviourAction that records the files matching the
+	// given glob patterns (specified as a slice of string Arg to the
+	// Behaviour, relative to the Job's actual cwd if not absolute) as
+	// Artifacts of the Job, in addition to those matching its Outputs. Files
+	// are recorded at the time the Behaviour triggers, so put it before any
+	// Behaviour that would delete them.
+	RecordOutputs
+)
+
+// The bits of a BehaviourAction were used up by the actions above, so these
+// have plain sequential values.
+const (
+	// ArchiveOutputs is a BehaviourAction that uploads files to an object
+	// store (S3 by default), without needing a writable mount. It takes an
+	// ArchiveSpec converted to a string with its String() method as its Arg.
+	// If the spec names no files, those recorded by earlier RecordOutputs and
+	// Checksum Behaviours are uploaded, so you can chain them together.
+	ArchiveOutputs BehaviourAction = 128 + iota
+
+	// Checksum is a BehaviourAction that computes the checksums of files and
+	// records them as Artifacts of the Job, optionally also writing them to a
+	// manifest file. It takes a ChecksumSpec converted to a string with its
+	// String() method as its Arg.
+	Checksum
+
+	// HTTPPost is a BehaviourAction that POSTs a JSON payload to a URL, by
+	// default a BehaviourPost describing the Job and the files recorded by
+	// earlier RecordOutputs, Checksum and ArchiveOutputs Behaviours. It takes
+	// an HTTPPostSpec converted to a string with its String() method as its
+	// Arg.
+	HTTPPost
 )
 
 // Behaviour describes something that should happen in response to a Job's Cmd
@@ -96,12 +151,41 @@ type Behaviour struct {
 	When BehaviourTrigger
 	Do   BehaviourAction
 	Arg  interface{} // the arg needed by your chosen action
+
+	// Retries is the number of times the action will be retried (after
+	// waiting ClientBehaviourRetryWait) if it fails, without the Job's Cmd
+	// being run again. This lets eg. an OnSuccess upload that failed due to a
+	// temporary network problem be retried without having to repeat an
+	// expensive Cmd.
+	Retries uint8
+
+	// ExitCode is the exit code that an OnExitCode Behaviour triggers on.
+	ExitCode int `codec:",omitempty"`
+
+	// FailReason is the FailReason* string that an OnFailReason Behaviour
+	// triggers on.
+	FailReason string `codec:",omitempty"`
+}
+
+// triggers tells you if the supplied status matches our BehaviourTrigger, and
+// if we're conditional, that the Job exited with our ExitCode or failed with
+// our FailReason.
+func (b *Behaviour) triggers(status BehaviourTrigger, j *Job) bool {
+	matched := b.When & status
+	if matched&OnExitCode != 0 && j.Exitcode != b.ExitCode {
+		matched &^= OnExitCode
+	}
+	if matched&OnFailReason != 0 && (j.FailReason == "" || j.FailReason != b.FailReason) {
+		matched &^= OnFailReason
+	}
+	return matched != 0
 }
 
 // Trigger will carry out our BehaviourAction if the supplied status matches our
-// BehaviourTrigger.
+// BehaviourTrigger (and for OnExitCode and OnFailReason, the Job's Exitcode or
+// FailReason matches ours).
 func (b *Behaviour) Trigger(status BehaviourTrigger, j *Job) error {
-	if b.When&status == 0 {
+	if !b.triggers(status, j) {
 		return nil
 	}
 
@@ -114,6 +198,16 @@ func (b *Behaviour) Trigger(status BehaviourTrigger, j *Job) error {
 		return b.run(j)
 	case CopyToManager:
 		return b.copyToManager(j)
+	case UploadCwd:
+		return b.uploadCwd(j)
+	case RecordOutputs:
+		return b.recordOutputs(j)
+	case ArchiveOutputs:
+		return b.archiveOutputs(j)
+	case Checksum:
+		return b.checksum(j)
+	case HTTPPost:
+		return b.httpPost(j)
 	case Nothing:
 		return nil
 	}
@@ -141,6 +235,38 @@ func (b *Behaviour) fillBVJM(bvjm *bvjMapping) {
 			arg = []string{"!invalid!"}
 		}
 		bvj = BehaviourViaJSON{CopyToManager: arg}
+	case UploadCwd:
+		spec, err := uploadCwdSpecFromArg(b.Arg)
+		if err != nil {
+			spec = &UploadCwdSpec{Dest: "!invalid!"}
+		}
+		bvj = BehaviourViaJSON{UploadCwd: spec}
+	case RecordOutputs:
+		var arg []string
+		if patterns, wasStrSlice := stringSliceArg(b.Arg); wasStrSlice {
+			arg = patterns
+		} else {
+			arg = []string{"!invalid!"}
+		}
+		bvj = BehaviourViaJSON{RecordOutputs: arg}
+	case ArchiveOutputs:
+		spec, err := archiveSpecFromArg(b.Arg)
+		if err != nil {
+			spec = &ArchiveSpec{Dest: "!invalid!"}
+		}
+		bvj = BehaviourViaJSON{Archive: spec}
+	case Checksum:
+		spec, err := checksumSpecFromArg(b.Arg)
+		if err != nil {
+			spec = &ChecksumSpec{Files: []string{"!invalid!"}}
+		}
+		bvj = BehaviourViaJSON{Checksum: spec}
+	case HTTPPost:
+		spec, err := httpPostSpecFromArg(b.Arg)
+		if err != nil {
+			spec = &HTTPPostSpec{URL: "!invalid!"}
+		}
+		bvj = BehaviourViaJSON{HTTPPost: spec}
 	case Cleanup:
 		bvj = BehaviourViaJSON{Cleanup: true}
 	case CleanupAll:
@@ -150,6 +276,7 @@ func (b *Behaviour) fillBVJM(bvjm *bvjMapping) {
 	default:
 		return
 	}
+	bvj.Retries = int(b.Retries)
 
 	switch b.When {
 	case OnFailure:
@@ -158,6 +285,16 @@ func (b *Behaviour) fillBVJM(bvjm *bvjMapping) {
 		bvjm.OnSuccess = append(bvjm.OnSuccess, bvj)
 	case OnFailure | OnSuccess:
 		bvjm.OnFS = append(bvjm.OnFS, bvj)
+	case OnExitCode:
+		if bvjm.OnExitCode == nil {
+			bvjm.OnExitCode = make(ExitCodeBehavioursViaJSON)
+		}
+		bvjm.OnExitCode[b.ExitCode] = append(bvjm.OnExitCode[b.ExitCode], bvj)
+	case OnFailReason:
+		if bvjm.OnFailReason == nil {
+			bvjm.OnFailReason = make(FailReasonBehavioursViaJSON)
+		}
+		bvjm.OnFailReason[b.FailReason] = append(bvjm.OnFailReason[b.FailReason], bvj)
 	case OnExit:
 		bvjm.OnExit = append(bvjm.OnExit, bvj)
 	default:
@@ -300,12 +437,103 @@ func (b *Behaviour) copyToManager(j *Job) error {
 	return nil
 }
 
+// recordOutputs records the files matching the patterns specified in the Arg
+// slice as Artifacts of the Job, to be sent to the server along with the rest
+// of the Job's end state.
+func (b *Behaviour) recordOutputs(j *Job) error {
+	patterns, wasStrSlice := stringSliceArg(b.Arg)
+	if !wasStrSlice {
+		return fmt.Errorf("arg %s is type %T, not []string", b.Arg, b.Arg)
+	}
+
+	artifacts, err := j.artifactsMatching(patterns)
+	j.Lock()
+	j.behaviourArtifacts = mergeArtifacts(j.behaviourArtifacts, artifacts)
+	j.Unlock()
+	return err
+}
+
+// stringSliceArg returns the given Arg as a []string. Behaviours that went
+// over the wire have such Args decoded as []interface{}, so those are converted
+// as long as they only contain strings.
+func stringSliceArg(arg interface{}) ([]string, bool) {
+	switch v := arg.(type) {
+	case []string:
+		return v, true
+	case []interface{}:
+		strs := make([]string, len(v))
+		for i, e := range v {
+			str, isStr := e.(string)
+			if !isStr {
+				return nil, false
+			}
+			strs[i] = str
+		}
+		return strs, true
+	}
+	return nil, false
+}
+
+// jsonSpecArg decodes the given Arg, which should be the String() of a spec
+// like an ArchiveSpec, in to the given spec.
+func jsonSpecArg(arg interface{}, spec interface{}) error {
+	str, wasStr := arg.(string)
+	if !wasStr {
+		return fmt.Errorf("arg %s is type %T, not string", arg, arg)
+	}
+	if err := json.Unmarshal([]byte(str), spec); err != nil {
+		return fmt.Errorf("arg %s is not a %T: %w", str, spec, err)
+	}
+	return nil
+}
+
+// specString converts the given spec to the string form needed for the Arg
+// of a Behaviour.
+func specString(spec interface{}) string {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(spec); err != nil {
+		panic(fmt.Sprintf("Encoding a %T failed: %s", spec, err))
+	}
+	return strings.TrimSpace(buffer.String())
+}
+
+// triggerWithRetries is like Trigger(), but if our action fails, it is retried
+// up to Retries times. Returns the number of times the action was tried, which
+// is 0 if we weren't triggered.
+func (b *Behaviour) triggerWithRetries(status BehaviourTrigger, j *Job) (int, error) {
+	if !b.triggers(status, j) {
+		return 0, nil
+	}
+
+	var err error
+	tries := 0
+	for {
+		tries++
+		err = b.Trigger(status, j)
+		if err == nil || tries > int(b.Retries) {
+			break
+		}
+		<-time.After(ClientBehaviourRetryWait)
+	}
+	if err != nil && tries > 1 {
+		err = fmt.Errorf("%w (failed %d times)", err, tries)
+	}
+	return tries, err
+}
+
 // Behaviours are a slice of Behaviour.
 type Behaviours []*Behaviour
 
 // Trigger calls Trigger on each constituent Behaviour, first all those for
-// OnSuccess if success = true or OnFailure otherwise, then those for OnExit.
+// OnSuccess if success = true or OnFailure otherwise, then those for
+// OnExitCode and OnFailReason that match the Job's Exitcode and FailReason,
+// then those for OnExit. Behaviours that fail are retried according to their
+// Retries, and the total number of tries is recorded in the Job's
+// BehaviourTries.
 func (bs Behaviours) Trigger(success bool, j *Job) error {
+	j.BehaviourTries = 0
 	if len(bs) == 0 {
 		return nil
 	}
@@ -318,28 +546,61 @@ func (bs Behaviours) Trigger(success bool, j *Job) error {
 	}
 
 	var merr *multierror.Error
-	for _, b := range bs {
-		err := b.Trigger(status, j)
-		if err != nil {
-			merr = multierror.Append(merr, err)
+	for _, status := range []BehaviourTrigger{status, OnExitCode | OnFailReason, OnExit} {
+		for _, b := range bs {
+			tries, err := b.triggerWithRetries(status, j)
+			j.BehaviourTries += tries
+			if err != nil {
+				merr = multierror.Append(merr, err)
+			}
 		}
 	}
 
-	status = OnExit
+	return merr.ErrorOrNil()
+}
+
+// withDefaults returns these Behaviours with copies of those defaults appended
+// whose trigger isn't already covered by one of these. Having a Behaviour that
+// does Nothing is therefore a way of opting out of a default.
+func (bs Behaviours) withDefaults(defaults Behaviours) Behaviours {
+	var covered BehaviourTrigger
 	for _, b := range bs {
-		err := b.Trigger(status, j)
-		if err != nil {
-			merr = multierror.Append(merr, err)
+		covered |= b.When
+	}
+
+	for _, d := range defaults {
+		if d.When&covered != 0 {
+			continue
 		}
+		b := *d
+		bs = append(bs, &b)
 	}
+	return bs
+}
 
-	return merr.ErrorOrNil()
+// validateDefaults checks that these Behaviours are suitable to be a
+// ServerConfig's DefaultBehaviours.
+func (bs Behaviours) validateDefaults() error {
+	for _, b := range bs {
+		if b == nil {
+			return fmt.Errorf("DefaultBehaviours can't contain nil")
+		}
+		switch b.When {
+		case OnExit, OnSuccess, OnFailure:
+		default:
+			return fmt.Errorf("DefaultBehaviours must each have a single trigger, not %d", b.When)
+		}
+	}
+	return nil
 }
 
 // String provides a nice string representation of Behaviours for user
 // interface display purposes. It takes the form of a JSON string that can
 // be converted back to Behaviours using a BehavioursViaJSON for each key. The
-// keys are "on_failure", "on_success", "on_failure|success" and "on_exit".
+// keys are "on_failure", "on_success", "on_failure|success", "on_exit_code",
+// "on_failreason" and "on_exit", where on_exit_code and on_failreason hold
+// objects keyed on exit code and fail reason, converted back using an
+// ExitCodeBehavioursViaJSON and a FailReasonBehavioursViaJSON.
 func (bs Behaviours) String() string {
 	if len(bs) == 0 {
 		return ""
@@ -361,13 +622,20 @@ func (bs Behaviours) String() string {
 }
 
 // BehaviourViaJSON makes up BehavioursViaJSON. Each of these should only
-// specify one of its properties.
+// specify one of its properties, other than Retries, which can be specified
+// alongside any of the others.
 type BehaviourViaJSON struct {
-	Run           string   `json:"run,omitempty"`
-	CopyToManager []string `json:"copy_to_manager,omitempty"`
-	Cleanup       bool     `json:"cleanup,omitempty"`
-	CleanupAll    bool     `json:"cleanup_all,omitempty"`
-	Nothing       bool     `json:"nothing,omitempty"`
+	Run           string         `json:"run,omitempty"`
+	CopyToManager []string       `json:"copy_to_manager,omitempty"`
+	UploadCwd     *UploadCwdSpec `json:"upload_cwd,omitempty"`
+	RecordOutputs []string       `json:"record_outputs,omitempty"`
+	Archive       *ArchiveSpec   `json:"archive,omitempty"`
+	Checksum      *ChecksumSpec  `json:"checksum,omitempty"`
+	HTTPPost      *HTTPPostSpec  `json:"http_post,omitempty"`
+	Cleanup       bool           `json:"cleanup,omitempty"`
+	CleanupAll    bool           `json:"cleanup_all,omitempty"`
+	Nothing       bool           `json:"nothing,omitempty"`
+	Retries       int            `json:"retries,omitempty"`
 }
 
 // Behaviour converts the friendly BehaviourViaJSON struct to real Behaviour.
@@ -382,6 +650,21 @@ func (bj BehaviourViaJSON) Behaviour(when BehaviourTrigger) *Behaviour {
 	case len(bj.CopyToManager) > 0:
 		do = CopyToManager
 		arg = bj.CopyToManager
+	case bj.UploadCwd != nil:
+		do = UploadCwd
+		arg = bj.UploadCwd.String()
+	case len(bj.RecordOutputs) > 0:
+		do = RecordOutputs
+		arg = bj.RecordOutputs
+	case bj.Archive != nil:
+		do = ArchiveOutputs
+		arg = bj.Archive.String()
+	case bj.Checksum != nil:
+		do = Checksum
+		arg = bj.Checksum.String()
+	case bj.HTTPPost != nil:
+		do = HTTPPost
+		arg = bj.HTTPPost.String()
 	case bj.Cleanup:
 		do = Cleanup
 	case bj.CleanupAll:
@@ -390,10 +673,18 @@ func (bj BehaviourViaJSON) Behaviour(when BehaviourTrigger) *Behaviour {
 		do = Nothing
 	}
 
+	retries := bj.Retries
+	if retries < 0 {
+		retries = 0
+	} else if retries > math.MaxUint8 {
+		retries = math.MaxUint8
+	}
+
 	return &Behaviour{
-		When: when,
-		Do:   do,
-		Arg:  arg,
+		When:    when,
+		Do:      do,
+		Arg:     arg,
+		Retries: uint8(retries),
 	}
 }
 
@@ -411,10 +702,59 @@ func (bjs BehavioursViaJSON) Behaviours(when BehaviourTrigger) Behaviours {
 	return bs
 }
 
+// ExitCodeBehavioursViaJSON maps exit codes to the BehavioursViaJSON that
+// should trigger when a Job's Cmd exits with them.
+type ExitCodeBehavioursViaJSON map[int]BehavioursViaJSON
+
+// Behaviours converts an ExitCodeBehavioursViaJSON to real OnExitCode
+// Behaviours, ordered by exit code.
+func (m ExitCodeBehavioursViaJSON) Behaviours() Behaviours {
+	codes := make([]int, 0, len(m))
+	for code := range m {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	var bs Behaviours
+	for _, code := range codes {
+		for _, b := range m[code].Behaviours(OnExitCode) {
+			b.ExitCode = code
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
+
+// FailReasonBehavioursViaJSON maps FailReason* strings to the
+// BehavioursViaJSON that should trigger when a Job's Cmd fails for that
+// reason.
+type FailReasonBehavioursViaJSON map[string]BehavioursViaJSON
+
+// Behaviours converts a FailReasonBehavioursViaJSON to real OnFailReason
+// Behaviours, ordered by fail reason.
+func (m FailReasonBehavioursViaJSON) Behaviours() Behaviours {
+	reasons := make([]string, 0, len(m))
+	for reason := range m {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	var bs Behaviours
+	for _, reason := range reasons {
+		for _, b := range m[reason].Behaviours(OnFailReason) {
+			b.FailReason = reason
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
+
 // bvjMapping struct is used by Behaviour*.String() to do its JSON conversion.
 type bvjMapping struct {
-	OnFailure BehavioursViaJSON `json:"on_failure,omitempty"`
-	OnSuccess BehavioursViaJSON `json:"on_success,omitempty"`
-	OnFS      BehavioursViaJSON `json:"on_failure|success,omitempty"`
-	OnExit    BehavioursViaJSON `json:"on_exit,omitempty"`
+	OnFailure    BehavioursViaJSON           `json:"on_failure,omitempty"`
+	OnSuccess    BehavioursViaJSON           `json:"on_success,omitempty"`
+	OnFS         BehavioursViaJSON           `json:"on_failure|success,omitempty"`
+	OnExitCode   ExitCodeBehavioursViaJSON   `json:"on_exit_code,omitempty"`
+	OnFailReason FailReasonBehavioursViaJSON `json:"on_failreason,omitempty"`
+	OnExit       BehavioursViaJSON           `json:"on_exit,omitempty"`
 }
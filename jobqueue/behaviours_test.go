@@ -22,10 +22,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -248,4 +251,289 @@ func TestBehaviours(t *testing.T) {
 			So(bs.String(), ShouldEqual, `{"on_failure":[{"run":"tar -czf my.tar.bz '--include=*.err'"},{"copy_to_manager":["my.tar.bz"]},{"cleanup_all":true}],"on_success":[{"cleanup":true}],"on_exit":[{"run":"true"}]}`)
 		})
 	})
+
+	Convey("UploadCwd Behaviours copy matching files from the cwd to their dest", t, func() {
+		cwd, err := ioutil.TempDir("", "wr_jobqueue_test_upload_cwd_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(cwd)
+		actualCwd := filepath.Join(cwd, "def", "cwd")
+		err = os.MkdirAll(filepath.Join(actualCwd, "logs"), os.ModePerm)
+		So(err, ShouldBeNil)
+		files := map[string]int{"a.err": 10, "b.out": 10, "logs/c.err": 10, "big.err": 2 * 1024 * 1024, "tmp.err": 10}
+		for name, size := range files {
+			err = ioutil.WriteFile(filepath.Join(actualCwd, name), make([]byte, size), 0600)
+			So(err, ShouldBeNil)
+		}
+		job := &Job{Cmd: "false", Cwd: cwd, ActualCwd: actualCwd}
+
+		jsonStr := `[{"upload_cwd":{"dest":"failed","max_mb":1,"include":["*.err"],"exclude":["tmp.*"]}}]`
+		var bjs BehavioursViaJSON
+		err = json.Unmarshal([]byte(jsonStr), &bjs)
+		So(err, ShouldBeNil)
+		bs := bjs.Behaviours(OnFailure)
+		So(bs[0].Do, ShouldEqual, UploadCwd)
+		So(bs.String(), ShouldEqual, `{"on_failure":[{"upload_cwd":{"dest":"failed","max_mb":1,"include":["*.err"],"exclude":["tmp.*"]}}]}`)
+
+		err = bs.Trigger(true, job)
+		So(err, ShouldBeNil)
+		dest := filepath.Join(actualCwd, "failed", job.Key())
+		_, err = os.Stat(dest)
+		So(err, ShouldNotBeNil)
+
+		err = bs.Trigger(false, job)
+		So(err, ShouldBeNil)
+		for _, name := range []string{"a.err", "logs/c.err", uploadCwdSkippedFile} {
+			_, err = os.Stat(filepath.Join(dest, name))
+			So(err, ShouldBeNil)
+		}
+		for _, name := range []string{"b.out", "big.err", "tmp.err"} {
+			_, err = os.Stat(filepath.Join(dest, name))
+			So(err, ShouldNotBeNil)
+		}
+		skipped, err := ioutil.ReadFile(filepath.Join(dest, uploadCwdSkippedFile))
+		So(err, ShouldBeNil)
+		So(string(skipped), ShouldContainSubstring, "big.err")
+
+		Convey("Invalid args are rejected", func() {
+			b := &Behaviour{When: OnFailure, Do: UploadCwd, Arg: `{"max_mb":1}`}
+			err = b.Trigger(OnFailure, job)
+			So(err, ShouldNotBeNil)
+			So(b.String(), ShouldEqual, `{"on_failure":[{"upload_cwd":{"dest":"!invalid!"}}]}`)
+		})
+	})
+
+	Convey("RecordOutputs Behaviours record matching files as Artifacts", t, func() {
+		cwd, err := ioutil.TempDir("", "wr_jobqueue_test_record_outputs_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(cwd)
+		for _, name := range []string{"a.bam", "b.bam", "c.log"} {
+			err = ioutil.WriteFile(filepath.Join(cwd, name), []byte(name), 0600)
+			So(err, ShouldBeNil)
+		}
+		job := &Job{Cmd: "true", Cwd: cwd, ActualCwd: cwd}
+
+		jsonStr := `[{"record_outputs":["*.bam","missing.txt"]}]`
+		var bjs BehavioursViaJSON
+		err = json.Unmarshal([]byte(jsonStr), &bjs)
+		So(err, ShouldBeNil)
+		bs := bjs.Behaviours(OnSuccess)
+		So(bs[0].Do, ShouldEqual, RecordOutputs)
+		So(bs.String(), ShouldEqual, `{"on_success":[{"record_outputs":["*.bam","missing.txt"]}]}`)
+
+		err = bs.Trigger(true, job)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "output [missing.txt] matched no files")
+		artifacts := job.takeBehaviourArtifacts()
+		So(len(artifacts), ShouldEqual, 2)
+		So(artifacts[0].Path, ShouldEqual, filepath.Join(cwd, "a.bam"))
+		So(artifacts[0].Size, ShouldEqual, 5)
+		So(artifacts[1].Path, ShouldEqual, filepath.Join(cwd, "b.bam"))
+		So(job.takeBehaviourArtifacts(), ShouldBeNil)
+
+		Convey("Invalid args are rejected", func() {
+			b := &Behaviour{When: OnSuccess, Do: RecordOutputs, Arg: "*.bam"}
+			err = b.Trigger(OnSuccess, job)
+			So(err, ShouldNotBeNil)
+			So(b.String(), ShouldEqual, `{"on_success":[{"record_outputs":["!invalid!"]}]}`)
+		})
+	})
+
+	Convey("Failed Behaviours can be retried without rerunning the cmd", t, func() {
+		origWait := ClientBehaviourRetryWait
+		ClientBehaviourRetryWait = 10 * time.Millisecond
+		defer func() {
+			ClientBehaviourRetryWait = origWait
+		}()
+
+		cwd, err := ioutil.TempDir("", "wr_jobqueue_test_behaviour_retries_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(cwd)
+		job := &Job{Cmd: "true", Cwd: cwd}
+
+		jsonStr := `[{"run":"echo x >> tries && test $(wc -l < tries) -ge 3","retries":2},{"run":"touch after"}]`
+		var bjs BehavioursViaJSON
+		err = json.Unmarshal([]byte(jsonStr), &bjs)
+		So(err, ShouldBeNil)
+		bs := bjs.Behaviours(OnSuccess)
+		So(bs[0].Retries, ShouldEqual, 2)
+		So(bs[1].Retries, ShouldEqual, 0)
+		So(bs.String(), ShouldEqual, `{"on_success":[{"run":"echo x >> tries && test $(wc -l < tries) -ge 3","retries":2},{"run":"touch after"}]}`)
+
+		err = bs.Trigger(true, job)
+		So(err, ShouldBeNil)
+		So(job.BehaviourTries, ShouldEqual, 4)
+		_, err = os.Stat(filepath.Join(cwd, "after"))
+		So(err, ShouldBeNil)
+
+		Convey("Behaviours that still fail after their retries report it", func() {
+			err = os.Remove(filepath.Join(cwd, "tries"))
+			So(err, ShouldBeNil)
+			bs[0].Retries = 1
+			err = bs.Trigger(true, job)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failed 2 times")
+			So(job.BehaviourTries, ShouldEqual, 3)
+		})
+	})
+
+	Convey("Behaviours can trigger on particular exit codes and fail reasons", t, func() {
+		cwd, err := ioutil.TempDir("", "wr_jobqueue_test_behaviour_conditions_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(cwd)
+		job := &Job{Cmd: "false", Cwd: cwd, Exitcode: 3, FailReason: FailReasonExit}
+
+		jsonStr := `{"3":[{"run":"touch three"}],"4":[{"run":"touch four"}]}`
+		var ecbjs ExitCodeBehavioursViaJSON
+		err = json.Unmarshal([]byte(jsonStr), &ecbjs)
+		So(err, ShouldBeNil)
+		bs := ecbjs.Behaviours()
+		So(len(bs), ShouldEqual, 2)
+		So(bs[0].When, ShouldEqual, OnExitCode)
+		So(bs[0].ExitCode, ShouldEqual, 3)
+		So(bs[1].ExitCode, ShouldEqual, 4)
+
+		jsonStr = `{"command exited non-zero":[{"run":"echo failed > reason"}],"ran out of time":[{"run":"touch time"}]}`
+		var frbjs FailReasonBehavioursViaJSON
+		err = json.Unmarshal([]byte(jsonStr), &frbjs)
+		So(err, ShouldBeNil)
+		bs = append(bs, frbjs.Behaviours()...)
+		So(bs[2].When, ShouldEqual, OnFailReason)
+		So(bs[2].FailReason, ShouldEqual, FailReasonExit)
+
+		bs = append(bs, &Behaviour{When: OnFailure, Do: Run, Arg: "touch reason"}, &Behaviour{When: OnExit, Do: Run, Arg: "cat reason > exit"})
+		So(bs.String(), ShouldEqual, `{"on_failure":[{"run":"touch reason"}],"on_exit_code":{"3":[{"run":"touch three"}],"4":[{"run":"touch four"}]},"on_failreason":{"command exited non-zero":[{"run":"echo failed > reason"}],"ran out of time":[{"run":"touch time"}]},"on_exit":[{"run":"cat reason > exit"}]}`)
+
+		err = bs.Trigger(false, job)
+		So(err, ShouldBeNil)
+		So(job.BehaviourTries, ShouldEqual, 4)
+		for _, name := range []string{"three", "reason", "exit"} {
+			_, err = os.Stat(filepath.Join(cwd, name))
+			So(err, ShouldBeNil)
+		}
+		for _, name := range []string{"four", "time"} {
+			_, err = os.Stat(filepath.Join(cwd, name))
+			So(err, ShouldNotBeNil)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(cwd, "exit"))
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "failed\n")
+
+		Convey("Conditional Behaviours don't trigger for other exits", func() {
+			job2 := &Job{Cmd: "true", Cwd: cwd}
+			So(bs[0].Trigger(OnExitCode, job2), ShouldBeNil)
+			_, err = os.Stat(filepath.Join(cwd, "four"))
+			So(err, ShouldNotBeNil)
+			err = bs.Trigger(true, job2)
+			So(err, ShouldBeNil)
+			So(job2.BehaviourTries, ShouldEqual, 1)
+		})
+	})
+
+	Convey("Checksum Behaviours record checksums and write manifests", t, func() {
+		cwd, err := ioutil.TempDir("", "wr_jobqueue_test_checksum_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(cwd)
+		for _, name := range []string{"a.bam", "b.bam"} {
+			err = ioutil.WriteFile(filepath.Join(cwd, name), []byte(name), 0600)
+			So(err, ShouldBeNil)
+		}
+		job := &Job{Cmd: "true", Cwd: cwd, ActualCwd: cwd}
+
+		jsonStr := `[{"checksum":{"files":["*.bam"],"algorithm":"sha256","manifest":"bams.sha256"}}]`
+		var bjs BehavioursViaJSON
+		err = json.Unmarshal([]byte(jsonStr), &bjs)
+		So(err, ShouldBeNil)
+		bs := bjs.Behaviours(OnSuccess)
+		So(bs[0].Do, ShouldEqual, Checksum)
+		So(bs.String(), ShouldEqual, `{"on_success":[{"checksum":{"files":["*.bam"],"algorithm":"sha256","manifest":"bams.sha256"}}]}`)
+
+		err = bs.Trigger(true, job)
+		So(err, ShouldBeNil)
+		artifacts := job.takeBehaviourArtifacts()
+		So(len(artifacts), ShouldEqual, 2)
+		So(artifacts[0].MD5, ShouldEqual, "2a51d78ab0ee62122dad5bcf7494eac1")
+		So(artifacts[0].SHA256, ShouldEqual, "2a9655138c607af55a7f27f379b11ef448f2310e06373f0fad265a130e68f2fe")
+
+		manifest, err := ioutil.ReadFile(filepath.Join(cwd, "bams.sha256"))
+		So(err, ShouldBeNil)
+		So(string(manifest), ShouldEqual, artifacts[0].SHA256+"  a.bam\n"+artifacts[1].SHA256+"  b.bam\n")
+
+		Convey("Invalid args are rejected", func() {
+			b := &Behaviour{When: OnSuccess, Do: Checksum, Arg: `{"files":["*.bam"],"algorithm":"crc"}`}
+			err = b.Trigger(OnSuccess, job)
+			So(err, ShouldNotBeNil)
+			So(b.String(), ShouldEqual, `{"on_success":[{"checksum":{"files":["!invalid!"]}}]}`)
+		})
+	})
+
+	Convey("HTTPPost Behaviours POST details of the job, chained after others", t, func() {
+		var posted []byte
+		status := http.StatusOK
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			posted, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(status)
+		}))
+		defer ts.Close()
+
+		cwd, err := ioutil.TempDir("", "wr_jobqueue_test_http_post_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(cwd)
+		err = ioutil.WriteFile(filepath.Join(cwd, "a.bam"), []byte("a.bam"), 0600)
+		So(err, ShouldBeNil)
+		job := &Job{Cmd: "true", Cwd: cwd, ActualCwd: cwd, RepGroup: "rg", Exitcode: 0}
+
+		jsonStr := `[{"checksum":{"files":["*.bam"]}},{"http_post":{"url":"` + ts.URL + `"}}]`
+		var bjs BehavioursViaJSON
+		err = json.Unmarshal([]byte(jsonStr), &bjs)
+		So(err, ShouldBeNil)
+		bs := bjs.Behaviours(OnSuccess)
+		So(bs[1].Do, ShouldEqual, HTTPPost)
+		So(bs.String(), ShouldEqual, `{"on_success":[{"checksum":{"files":["*.bam"]}},{"http_post":{"url":"`+ts.URL+`"}}]}`)
+
+		err = bs.Trigger(true, job)
+		So(err, ShouldBeNil)
+		bp := &BehaviourPost{}
+		err = json.Unmarshal(posted, bp)
+		So(err, ShouldBeNil)
+		So(bp.RepGroup, ShouldEqual, "rg")
+		So(bp.Cmd, ShouldEqual, "true")
+		So(len(bp.Artifacts), ShouldEqual, 1)
+		So(bp.Artifacts[0].MD5, ShouldEqual, "2a51d78ab0ee62122dad5bcf7494eac1")
+
+		Convey("Payloads can be supplied, and rejections are errors", func() {
+			b := &Behaviour{When: OnSuccess, Do: HTTPPost, Arg: (&HTTPPostSpec{URL: ts.URL, Payload: json.RawMessage(`{"done":true}`)}).String()}
+			So(b.String(), ShouldEqual, `{"on_success":[{"http_post":{"url":"`+ts.URL+`","payload":{"done":true}}}]}`)
+			err = b.Trigger(OnSuccess, job)
+			So(err, ShouldBeNil)
+			So(string(posted), ShouldEqual, `{"done":true}`)
+
+			status = http.StatusInternalServerError
+			err = b.Trigger(OnSuccess, job)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("ArchiveOutputs Behaviours need files to upload", t, func() {
+		cwd, err := ioutil.TempDir("", "wr_jobqueue_test_archive_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(cwd)
+		job := &Job{Cmd: "true", Cwd: cwd, ActualCwd: cwd}
+
+		jsonStr := `[{"archive":{"dest":"bucket/results"}}]`
+		var bjs BehavioursViaJSON
+		err = json.Unmarshal([]byte(jsonStr), &bjs)
+		So(err, ShouldBeNil)
+		bs := bjs.Behaviours(OnSuccess)
+		So(bs[0].Do, ShouldEqual, ArchiveOutputs)
+		So(bs.String(), ShouldEqual, `{"on_success":[{"archive":{"dest":"bucket/results"}}]}`)
+
+		err = bs.Trigger(true, job)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "no files to upload")
+
+		b := &Behaviour{When: OnSuccess, Do: ArchiveOutputs, Arg: `{"files":["*.bam"]}`}
+		err = b.Trigger(OnSuccess, job)
+		So(err, ShouldNotBeNil)
+		So(b.String(), ShouldEqual, `{"on_success":[{"archive":{"dest":"!invalid!"}}]}`)
+	})
 }
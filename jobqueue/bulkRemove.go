@@ -0,0 +1,251 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for removing large numbers of jobs in the
+// background, in a way that can be monitored, cancelled and resumed after a
+// restart of the server.
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// BulkRemoval* are the States a BulkRemoval can be in.
+const (
+	BulkRemovalRunning   = "running"
+	BulkRemovalCancelled = "cancelled"
+	BulkRemovalComplete  = "complete"
+)
+
+// BulkRemoval describes the progress of a removal of jobs that the server is
+// carrying out in the background, as started by Client.DeleteInBackground().
+//
+// Jobs are removed in batches of ServerBulkRemovalBatchSize, and the progress
+// is recorded after each batch, so that if the server is restarted the removal
+// carries on from where it left off, instead of being left half done.
+//
+// Like Client.Delete(), jobs that are running, or that have dependants that
+// are not also being removed, will not be removed. Since jobs with dependants
+// can only be removed once those dependants have been, removals can take more
+// than one pass through the jobs.
+type BulkRemoval struct {
+	ID       string
+	State    string
+	Started  time.Time
+	Finished time.Time // zero until State is no longer BulkRemovalRunning
+	Total    int       // the number of jobs that were asked to be removed
+	Removed  int       // the number of those that have been removed so far
+	Pass     int       // the current pass through the jobs, starting at 1
+	PassJobs int       // the number of jobs being considered in this pass
+	Done     int       // the number of those that have been considered so far
+	Resumed  int       // the number of times the removal was resumed after a server restart
+}
+
+// bulkRemoval is the server's record of a BulkRemoval. Only the exported
+// fields are stored in the database.
+type bulkRemoval struct {
+	Info        *BulkRemoval
+	PassRemoved int // how many jobs were removed in the current pass
+	keys        []string
+	cancel      chan struct{}
+}
+
+// startBulkRemoval starts removing the jobs with the given keys in the
+// background, returning a description of the removal.
+func (s *Server) startBulkRemoval(keys []string) (*BulkRemoval, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	br := &bulkRemoval{
+		Info: &BulkRemoval{
+			ID:       u.String(),
+			State:    BulkRemovalRunning,
+			Started:  time.Now(),
+			Total:    len(keys),
+			Pass:     1,
+			PassJobs: len(keys),
+		},
+		keys:   keys,
+		cancel: make(chan struct{}),
+	}
+
+	err = s.db.storeBulkRemoval(br, true)
+	if err != nil {
+		return nil, err
+	}
+
+	s.brmutex.Lock()
+	s.bulkRemovals[br.Info.ID] = br
+	info := *br.Info
+	s.brmutex.Unlock()
+
+	s.Debug("started bulk removal", "id", info.ID, "jobs", info.Total)
+	go s.runBulkRemoval(br)
+	return &info, nil
+}
+
+// resumeBulkRemovals carries on with any bulk removals that were running when
+// the server was last stopped.
+func (s *Server) resumeBulkRemovals() error {
+	brs, err := s.db.retrieveBulkRemovals()
+	if err != nil {
+		return err
+	}
+
+	for _, br := range brs {
+		br.Info.Resumed++
+		br.cancel = make(chan struct{})
+		s.brmutex.Lock()
+		s.bulkRemovals[br.Info.ID] = br
+		s.brmutex.Unlock()
+
+		s.Info("resuming bulk removal", "id", br.Info.ID, "removed", br.Info.Removed, "of", br.Info.Total)
+		go s.runBulkRemoval(br)
+	}
+	return nil
+}
+
+// runBulkRemoval removes the jobs of the given bulkRemoval in batches, until
+// they have all been dealt with, or it is cancelled, or the server stops.
+func (s *Server) runBulkRemoval(br *bulkRemoval) {
+	wgk := s.wg.Add(1)
+	defer s.wg.Done(wgk)
+
+	for {
+		s.brmutex.RLock()
+		done := br.Info.Done
+		s.brmutex.RUnlock()
+
+		for done < len(br.keys) {
+			select {
+			case <-s.stopClientHandling:
+				// we leave our progress in the db, to resume on restart
+				return
+			case <-br.cancel:
+				s.finishBulkRemoval(br, BulkRemovalCancelled)
+				return
+			default:
+			}
+
+			end := done + ServerBulkRemovalBatchSize
+			if end > len(br.keys) {
+				end = len(br.keys)
+			}
+			deleted := s.deleteJobs(br.keys[done:end])
+			done = end
+
+			s.brmutex.Lock()
+			br.Info.Done = done
+			br.Info.Removed += len(deleted)
+			br.PassRemoved += len(deleted)
+			err := s.db.storeBulkRemoval(br, false)
+			s.brmutex.Unlock()
+			if err != nil {
+				s.Warn("failed to store bulk removal progress", "id", br.Info.ID, "err", err)
+			}
+		}
+
+		// jobs with dependants that were in later batches will have been
+		// skipped, so we go round again while we're making progress
+		var remaining []string
+		for _, key := range br.keys {
+			if item, err := s.q.Get(key); err == nil && item != nil {
+				remaining = append(remaining, key)
+			}
+		}
+
+		s.brmutex.Lock()
+		if len(remaining) == 0 || br.PassRemoved == 0 {
+			s.brmutex.Unlock()
+			s.finishBulkRemoval(br, BulkRemovalComplete)
+			return
+		}
+		br.keys = remaining
+		br.PassRemoved = 0
+		br.Info.Pass++
+		br.Info.PassJobs = len(remaining)
+		br.Info.Done = 0
+		err := s.db.storeBulkRemoval(br, true)
+		s.brmutex.Unlock()
+		if err != nil {
+			s.Warn("failed to store bulk removal progress", "id", br.Info.ID, "err", err)
+		}
+	}
+}
+
+// finishBulkRemoval marks the given bulkRemoval as being in the given final
+// state, and forgets about it in the database.
+func (s *Server) finishBulkRemoval(br *bulkRemoval, state string) {
+	s.brmutex.Lock()
+	br.Info.State = state
+	br.Info.Finished = time.Now()
+	br.keys = nil
+	s.brmutex.Unlock()
+
+	err := s.db.deleteBulkRemoval(br.Info.ID)
+	if err != nil {
+		s.Warn("failed to forget bulk removal", "id", br.Info.ID, "err", err)
+	}
+	s.Debug("finished bulk removal", "id", br.Info.ID, "state", state, "removed", br.Info.Removed, "of", br.Info.Total)
+}
+
+// cancelBulkRemoval stops the bulk removal with the given id after its current
+// batch. Jobs that were already removed stay removed.
+func (s *Server) cancelBulkRemoval(id string) error {
+	s.brmutex.Lock()
+	defer s.brmutex.Unlock()
+	br, exists := s.bulkRemovals[id]
+	if !exists {
+		return Error{"CancelBulkRemoval", id, ErrNoBulkRemoval}
+	}
+	if br.Info.State != BulkRemovalRunning {
+		return nil
+	}
+	select {
+	case <-br.cancel:
+	default:
+		close(br.cancel)
+	}
+	return nil
+}
+
+// getBulkRemovals returns descriptions of our running bulk removals, and of
+// those that finished in the last ServerBulkRemovalExpiry, oldest first.
+func (s *Server) getBulkRemovals() []*BulkRemoval {
+	s.brmutex.Lock()
+	defer s.brmutex.Unlock()
+	brs := make([]*BulkRemoval, 0, len(s.bulkRemovals))
+	for id, br := range s.bulkRemovals {
+		if !br.Info.Finished.IsZero() && time.Since(br.Info.Finished) > ServerBulkRemovalExpiry {
+			delete(s.bulkRemovals, id)
+			continue
+		}
+		info := *br.Info
+		brs = append(brs, &info)
+	}
+	sort.Slice(brs, func(i, j int) bool {
+		return brs[i].Started.Before(brs[j].Started)
+	})
+	return brs
+}
@@ -0,0 +1,164 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the implementation of the Checksum behaviour.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// Checksum* constants are the algorithms a ChecksumSpec can use.
+const (
+	ChecksumMD5    = "md5"
+	ChecksumSHA256 = "sha256"
+)
+
+// ChecksumSpec describes which files a Checksum Behaviour should checksum, and
+// how.
+type ChecksumSpec struct {
+	// Files are glob patterns (relative to the Job's actual cwd if not
+	// absolute) of the files to checksum.
+	Files []string `json:"files"`
+
+	// Algorithm is one of the Checksum* constants, defaulting to ChecksumMD5.
+	// The MD5 of each file is always recorded in its Artifact; with
+	// ChecksumSHA256 its SHA256 is recorded as well.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// Manifest, if set, is the path (relative to the Job's actual cwd if not
+	// absolute) of a file to write the checksums to, in the format of md5sum
+	// or sha256sum, so that they can be checked with eg. `md5sum -c`.
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// String converts the spec to the string form needed for the Arg of a
+// Checksum Behaviour.
+func (c *ChecksumSpec) String() string {
+	return specString(c)
+}
+
+// checksumSpecFromArg converts the Arg of a Checksum Behaviour back to a
+// ChecksumSpec.
+func checksumSpecFromArg(arg interface{}) (*ChecksumSpec, error) {
+	spec := &ChecksumSpec{}
+	if err := jsonSpecArg(arg, spec); err != nil {
+		return nil, err
+	}
+	if len(spec.Files) == 0 {
+		return nil, fmt.Errorf("arg %s has no files", arg)
+	}
+	switch spec.Algorithm {
+	case "", ChecksumMD5, ChecksumSHA256:
+	default:
+		return nil, fmt.Errorf("arg %s has an unknown algorithm", arg)
+	}
+	return spec, nil
+}
+
+// checksum computes the checksums of the files described by our ChecksumSpec
+// Arg, records them as Artifacts of the Job, and writes the desired manifest.
+func (b *Behaviour) checksum(j *Job) error {
+	spec, err := checksumSpecFromArg(b.Arg)
+	if err != nil {
+		return err
+	}
+
+	var merr *multierror.Error
+	artifacts, err := j.artifactsMatching(spec.Files)
+	if err != nil {
+		merr = multierror.Append(merr, err)
+	}
+
+	if spec.Algorithm == ChecksumSHA256 {
+		for _, a := range artifacts {
+			a.SHA256, err = fileSHA256(a.Path)
+			if err != nil {
+				merr = multierror.Append(merr, err)
+			}
+		}
+	}
+
+	j.Lock()
+	j.behaviourArtifacts = mergeArtifacts(j.behaviourArtifacts, artifacts)
+	cwd := j.ranIn()
+	j.Unlock()
+
+	if spec.Manifest != "" {
+		if err = writeChecksumManifest(spec, artifacts, cwd); err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// writeChecksumManifest writes the checksums of the given Artifacts to the
+// Manifest of the given spec, with paths relative to the given cwd where
+// possible.
+func writeChecksumManifest(spec *ChecksumSpec, artifacts []*Artifact, cwd string) error {
+	manifest := spec.Manifest
+	if !filepath.IsAbs(manifest) {
+		manifest = filepath.Join(cwd, manifest)
+	}
+
+	var lines strings.Builder
+	for _, a := range artifacts {
+		sum := a.MD5
+		if spec.Algorithm == ChecksumSHA256 {
+			sum = a.SHA256
+		}
+		name := a.Path
+		if rel, err := filepath.Rel(cwd, a.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+		fmt.Fprintf(&lines, "%s  %s\n", sum, name)
+	}
+
+	return ioutil.WriteFile(manifest, []byte(lines.String()), 0644) // #nosec the manifest is meant to be readable
+}
+
+// fileSHA256 returns the hex encoded SHA256 checksum of the given file's
+// contents.
+func fileSHA256(path string) (sum string, err error) {
+	f, err := os.Open(path) // #nosec
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if errc := f.Close(); errc != nil && err == nil {
+			err = errc
+		}
+	}()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -22,6 +22,8 @@ package jobqueue
 
 import (
 	"bytes"
+	"container/heap"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -40,6 +42,7 @@ import (
 	"time"
 
 	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
 	"github.com/gofrs/uuid"
 	"github.com/inconshreveable/log15"
 	"github.com/ugorji/go/codec"
@@ -50,24 +53,33 @@ import (
 
 // FailReason* are the reasons for cmd line failure stored on Jobs
 const (
-	FailReasonEnv      = "failed to get environment variables"
-	FailReasonCwd      = "working directory does not exist"
-	FailReasonStart    = "command failed to start"
-	FailReasonCPerm    = "command permission problem"
-	FailReasonCFound   = "command not found"
-	FailReasonCExit    = "command invalid exit code"
-	FailReasonExit     = "command exited non-zero"
-	FailReasonRAM      = "command used too much RAM"
-	FailReasonDisk     = "ran out of disk space"
-	FailReasonTime     = "command used too much time"
-	FailReasonDocker   = "could not interact with docker"
-	FailReasonAbnormal = "command failed to complete normally"
-	FailReasonLost     = "lost contact with runner"
-	FailReasonSignal   = "runner received a signal to stop"
-	FailReasonResource = "resource requirements cannot be met"
-	FailReasonMount    = "mounting of remote file system(s) failed"
-	FailReasonUpload   = "failed to upload files to remote file system"
-	FailReasonKilled   = "killed by user request"
+	FailReasonEnv       = "failed to get environment variables"
+	FailReasonCwd       = "working directory does not exist"
+	FailReasonStart     = "command failed to start"
+	FailReasonCPerm     = "command permission problem"
+	FailReasonCFound    = "command not found"
+	FailReasonCExit     = "command invalid exit code"
+	FailReasonExit      = "command exited non-zero"
+	FailReasonRAM       = "command used too much RAM"
+	FailReasonDisk      = "ran out of disk space"
+	FailReasonDiskUse   = "command used too much disk space"
+	FailReasonTime      = "command used too much time"
+	FailReasonDocker    = "could not interact with docker"
+	FailReasonContainer = "container image could not be pulled"
+	FailReasonSecret    = "secrets could not be retrieved"
+	FailReasonInput     = "input files could not be staged"
+	FailReasonAbnormal  = "command failed to complete normally"
+	FailReasonLost      = "lost contact with runner"
+	FailReasonSignal    = "runner received a signal to stop"
+	FailReasonResource  = "resource requirements cannot be met"
+	FailReasonMount     = "mounting of remote file system(s) failed"
+	FailReasonUpload    = "failed to upload files to remote file system"
+	FailReasonKilled    = "killed by user request"
+	FailReasonPreempt   = "preempted by a higher priority job"
+	FailReasonExclude   = "host was excluded"
+	FailReasonMissing   = "missing output"
+	FailReasonNoStart   = "runner did not start the command in time"
+	FailReasonPermanent = "permanently failed"
 )
 
 // lsfEmulationDir is the name of the directory we store our LSF emulation
@@ -79,16 +91,24 @@ const localhost = "localhost"
 
 // these global variables are primarily exported for testing purposes; you
 // probably shouldn't change them (*** and they should probably be re-factored
-// as fields of a config struct...)
+// as fields of a config struct...) A ClientPercentDiskKill of 0 means jobs are
+// never killed for using more disk than they requested.
 var (
 	ClientTouchInterval                = 15 * time.Second
 	ClientReleaseDelay                 = 30 * time.Second
 	ClientPercentMemoryKill            = 90
+	ClientPercentDiskKill              = 120
 	ClientRetryWait                    = 15 * time.Second
 	ClientRetryTime                    = 24 * time.Hour
+	ClientBehaviourRetryWait           = 5 * time.Second
+	ClientBehaviourPostTimeout         = 10 * time.Second
 	ClientShutdownTimeout              = 120 * time.Second
 	ClientShutdownTestInterval         = 100 * time.Millisecond
 	ClientSuggestedPingTimeout         = 10 * time.Millisecond
+	ClientAddBatchSize                 = 10000
+	ClientHeartbeatInterval            = 10 * time.Second
+	ClientTailInterval                 = 1 * time.Second
+	ClientTailMax                      = 16384
 	RAMIncreaseMin             float64 = 1000
 	RAMIncreaseMultLow                 = 2.0
 	RAMIncreaseMultHigh                = 1.3
@@ -101,18 +121,33 @@ var (
 type clientRequest struct {
 	Env                     []byte // compressed binc encoding of []string
 	Jobs                    []*Job
+	JobsC                   []byte // compressed binc encoding of []*Job
 	Keys                    []string
+	Attempts                []uint32 // when modifying, the Attempts of each of Keys when they were read
+	RepGroups               []string
 	File                    []byte // compressed bytes of file content
 	Token                   []byte
 	LimitGroup              string
 	Method                  string
 	SchedulerGroup          string
+	SchedulerGroups         []string                // when reserving, any of these groups will do
+	Capacity                *scheduler.Requirements // when reserving, jobs must fit within this
 	State                   JobState
 	Path                    string // desired path File should be stored at, can be blank
 	CloudServerID           string
+	Host                    string   // when reserving, the host the client is running on
+	Hosts                   []string // host names to exclude or include
+	Namespace               string   // the namespace the client is working in
 	Job                     *Job
 	JobEndState             *JobEndState
 	Modifier                *JobModifier
+	FailRules               []*FailRule
+	HostFailurePolicy       *HostFailurePolicy
+	Policy                  *Policy
+	RetryOverrides          *RetryOverrides
+	BulkRemovalID           string
+	RunnerVersion           string // when reserving, the version of the runner, if it can update itself
+	RunnerPlatform          string // the GOOS/GOARCH of a runner, so we know what exe to give it
 	Limit                   int
 	Timeout                 time.Duration
 	ClientID                uuid.UUID
@@ -120,25 +155,78 @@ type clientRequest struct {
 	GetEnv                  bool
 	GetStd                  bool
 	IgnoreComplete          bool
+	Rerun                   RerunMode // when adding, what to do with jobs that previously completed (overrides IgnoreComplete)
 	Search                  bool
+	RepGroupMatch           RepGroupMatch
 	ConfirmDeadCloudServers bool
-	ReturnIDs               bool // when adding jobs, return the IDs of the added jobs
+	AutoApply               bool
+	ReturnIDs               bool          // when adding jobs, return the IDs of the added jobs
+	ArraySize               int           // when adding an array job, how many jobs to expand its template in to
+	Load                    float64       // when touching, the 1 minute load average of the job's host
+	RAMUsed                 float64       // when touching, the percentage of the job's host's memory in use
+	User                    string        // when adding or kicking, the user doing it, for fair sharing and the jobs' histories
+	Prune                   bool          // when applying a pipeline, remove its undesired jobs; when archiving a RepGroup, remove its jobs
+	DryRun                  bool          // when applying a pipeline, only report what would change
+	FairShare               string        // when setting the fair share mode, the new mode
+	Filter                  *JobFilter    // when getting jobs, only get those that pass this, from its Offset
+	Workflow                *Workflow     // when adding a workflow, its steps; when getting workflows, the Name of the one wanted
+	StdOutTail              []byte        // when touching or shipping output, the running job's latest STDOUT
+	StdErrTail              []byte        // when touching or shipping output, the running job's latest STDERR
+	StdOutOffset            int64         // when shipping output, the offset StdOutTail ends at; when tailing, the offset to get STDOUT from
+	StdErrOffset            int64         // when shipping output, the offset StdErrTail ends at; when tailing, the offset to get STDERR from
+	Replayed                bool          // when a runner couldn't contact us at the time, so is sending this update late
+	From                    time.Time     // when getting utilisation or usage, the start of the time range; when draining until, the start of the maintenance
+	To                      time.Time     // when getting utilisation or usage, the end of the time range; when draining until, the end of the maintenance
+	Step                    time.Duration // when getting utilisation, the time between snapshots
+	ExportBy                []string      // when exporting, the properties to group complete jobs by
+	Compressions            []string      // when pinging, the wire compression algorithms we support
+	Artifacts               []*Artifact   // when registering artifacts, the ones to add to the complete job
+	Queue                   *QueueConfig  // when configuring a named queue, its settings
+	Secret                  *Secret       // when setting or deleting a secret, its name and value
+	TriageRules             []*TriageRule // when setting triage rules, the rules in the order they are checked
+	DBTxID                  int           // when replicating, the id of the last db transaction the standby has
+	Epoch                   uint64        // when fencing, the epoch of the server that took over
+	ProtocolVersion         int           // the protocol version the client speaks (when pinging, the newest it speaks)
+	failoverSafe            bool          // (not sent) the request can be repeated on failover
+	failovers               int           // (not sent) how many times the request failed over
 }
 
 // Client represents the client side of the socket that the jobqueue server is
 // Serve()ing, specific to a particular queue.
+//
+// Most methods have a *Context() variant that lets you apply timeouts and
+// cancellation, so you don't block indefinitely on a hung server. Note that a
+// cancelled request may still be acted upon by the server, and that (unless
+// you used ConnectPersistent()) the Client can't send its next request until
+// the abandoned one gets a response or hits the timeout given to Connect().
 type Client struct {
 	ch          codec.Handle
 	clientid    uuid.UUID
 	hasReserved bool
+	subs        map[uint64]context.CancelFunc
+	subsID      uint64
+	subsMutex   sync.Mutex
+	addrs       []string // for ConnectFailover() clients
+	addrIndex   int
+	addrsMutex  sync.Mutex // to serialise failovers
 	sock        mangos.Socket
 	sync.Mutex
-	teMutex    sync.Mutex // to protect Touch() from other methods during Execute()
-	token      []byte
-	ServerInfo *ServerInfo
-	host       string
-	port       string
-	args       []string // allowing internal reconnects
+	teMutex     sync.Mutex // to protect Touch() from other methods during Execute()
+	token       []byte
+	ServerInfo  *ServerInfo
+	host        string
+	port        string
+	args        []string // allowing internal reconnects
+	timeout     time.Duration
+	pool        *clientPool // for ConnectPersistent() clients
+	poolMutex   sync.RWMutex
+	compression string // the wire compression algorithm agreed with the server
+	protocol    int    // the protocol version agreed with the server
+	namespace   string // see SetNamespace()
+	version     string // see SetRunnerVersion()
+
+	inputCacheDir  string // see SetInputCache()
+	inputCacheSize int64
 	log15.Logger
 }
 
@@ -166,36 +254,15 @@ type envStr struct {
 // Timeout determines how long to wait for a response from the server, not only
 // while connecting, but for all subsequent interactions with it using the
 // returned Client.
+//
+// While connecting, the client and server agree on an algorithm from
+// ClientWireCompression to compress large requests and responses with.
 func Connect(addr, caFile, certDomain string, token []byte, timeout time.Duration) (*Client, error) {
-	sock, err := req.NewSocket()
-	if err != nil {
-		return nil, err
-	}
-
-	if err = sock.SetOption(mangos.OptionMaxRecvSize, 0); err != nil {
-		return nil, err
-	}
-
-	err = sock.SetOption(mangos.OptionRecvDeadline, timeout)
+	sock, err := dialServer(addr, caFile, certDomain, timeout)
 	if err != nil {
 		return nil, err
 	}
 
-	sock.AddTransport(tlstcp.NewTransport())
-	tlsConfig := &tls.Config{ServerName: certDomain}
-	caCert, err := ioutil.ReadFile(caFile)
-	if err == nil {
-		certPool := x509.NewCertPool()
-		certPool.AppendCertsFromPEM(caCert)
-		tlsConfig.RootCAs = certPool
-	}
-
-	dialOpts := make(map[string]interface{})
-	dialOpts[mangos.OptionTLSConfig] = tlsConfig
-	if err = sock.DialOptions("tls+tcp://"+addr, dialOpts); err != nil {
-		return nil, err
-	}
-
 	// clients identify themselves (only for the purpose of calling methods that
 	// require the client has previously used Reserve()) with a UUID; v4 is used
 	// since speed doesn't matter: a typical client executable will only
@@ -214,33 +281,86 @@ func Connect(addr, caFile, certDomain string, token []byte, timeout time.Duratio
 		host:     addrParts[0],
 		port:     addrParts[1],
 		args:     []string{addr, caFile, certDomain},
+		timeout:  timeout,
 	}
 
 	c.Logger = log15.New()
 	c.Logger.SetHandler(log15.DiscardHandler())
 
 	// Dial succeeds even when there's no server up, so we test the connection
-	// works with a Ping()
-	si, err := c.Ping(timeout)
+	// works with a ping, which also negotiates compression and the protocol
+	// version
+	c.protocol = ProtocolVersion
+	resp, err := c.request(&clientRequest{Method: "ping", Timeout: timeout, Compressions: ClientWireCompression})
 	if err != nil {
 		errc := sock.Close()
 		if errc != nil {
 			return c, errc
 		}
 		msg := ErrNoServer
-		if jqerr, ok := err.(Error); ok && jqerr.Err == ErrPermissionDenied {
-			msg = ErrPermissionDenied
+		if jqerr, ok := err.(Error); ok && (jqerr.Err == ErrPermissionDenied || jqerr.Err == ErrProtocolVersion) {
+			msg = jqerr.Err
 		}
 		return nil, Error{"Connect", "", msg}
 	}
-	c.ServerInfo = si
+	c.protocol, err = negotiateProtocolVersion(resp.ProtocolMin, resp.Protocol)
+	if err != nil {
+		errc := sock.Close()
+		if errc != nil {
+			return nil, errc
+		}
+		return nil, Error{"Connect", err.Error(), ErrProtocolVersion}
+	}
+	c.ServerInfo = resp.SInfo
+	c.compression = resp.Compression
 
 	return c, err
 }
 
+// dialServer creates a socket connected to the jobqueue server at the given
+// address. See Connect() for the meaning of the args.
+func dialServer(addr, caFile, certDomain string, timeout time.Duration) (mangos.Socket, error) {
+	sock, err := req.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = sock.SetOption(mangos.OptionMaxRecvSize, 0); err != nil {
+		return nil, err
+	}
+
+	err = sock.SetOption(mangos.OptionRecvDeadline, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	sock.AddTransport(tlstcp.NewTransport())
+	tlsConfig := &tls.Config{ServerName: certDomain}
+	caCert, err := ioutil.ReadFile(caFile)
+	if err == nil {
+		certPool := x509.NewCertPool()
+		certPool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = certPool
+	}
+	if cert, enrolled := enrolledClientCert(caFile); enrolled {
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	dialOpts := make(map[string]interface{})
+	dialOpts[mangos.OptionTLSConfig] = tlsConfig
+	if err = sock.DialOptions("tls+tcp://"+addr, dialOpts); err != nil {
+		return nil, err
+	}
+	return sock, nil
+}
+
 // Disconnect closes the connection to the jobqueue server. It is CRITICAL that
 // you call Disconnect() before calling Connect() again in the same process.
 func (c *Client) Disconnect() error {
+	c.cancelSubscriptions()
+	if c.persistent() {
+		return c.disconnectPersistent()
+	}
 	c.Lock()
 	defer c.Unlock()
 	return c.sock.Close()
@@ -254,12 +374,37 @@ func (c *Client) SetLogger(logger log15.Logger) {
 	c.Logger = logger
 }
 
+// SetNamespace puts this client in the given namespace, so that several teams
+// can safely share one server. Jobs you add will be in this namespace, and you
+// will only be able to see and act on jobs in it. Your RepGroups, DepGroups,
+// LimitGroups and IdempotencyKeys are private to the namespace, so they won't
+// clash with other teams' groups of the same name, and nor will their limits,
+// run windows or resource recommendations. Adding the same Cmd in 2 namespaces
+// results in 2 separate jobs.
+//
+// Namespaces may only contain letters, numbers, underscores, dots and dashes.
+// The default blank namespace sees the jobs of all namespaces, with their group
+// names prefixed by their namespace and a forward slash.
+func (c *Client) SetNamespace(namespace string) error {
+	if namespace != "" && !validNamespace.MatchString(namespace) {
+		return Error{"SetNamespace", "", ErrBadNamespace}
+	}
+	c.namespace = namespace
+	return nil
+}
+
 // Ping tells you if your connection to the server is working, returning static
 // information about the server. If err is nil, it works. This is the only
 // command that interacts with the server that works if a blank or invalid
 // token had been supplied to Connect().
 func (c *Client) Ping(timeout time.Duration) (*ServerInfo, error) {
-	resp, err := c.request(&clientRequest{Method: "ping", Timeout: timeout})
+	return c.PingContext(context.Background(), timeout)
+}
+
+// PingContext is like Ping(), but stops waiting for the server and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) PingContext(ctx context.Context, timeout time.Duration) (*ServerInfo, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "ping", Timeout: timeout})
 	if err != nil {
 		return nil, err
 	}
@@ -271,12 +416,18 @@ func (c *Client) Ping(timeout time.Duration) (*ServerInfo, error) {
 // running. You get back a count of existing runners and and an estimated time
 // until completion for the last of those runners.
 func (c *Client) DrainServer() (running int, etc time.Duration, err error) {
-	return c.drainOrPauseServer("drain")
+	return c.DrainServerContext(context.Background())
+}
+
+// DrainServerContext is like DrainServer(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) DrainServerContext(ctx context.Context) (running int, etc time.Duration, err error) {
+	return c.drainOrPauseServer(ctx, "drain")
 }
 
 // drainOrPauseServer handles the response from drain or pause.
-func (c *Client) drainOrPauseServer(method string) (running int, etc time.Duration, err error) {
-	resp, err := c.request(&clientRequest{Method: method})
+func (c *Client) drainOrPauseServer(ctx context.Context, method string) (running int, etc time.Duration, err error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: method})
 	if err != nil {
 		return running, etc, err
 	}
@@ -291,14 +442,64 @@ func (c *Client) drainOrPauseServer(method string) (running int, etc time.Durati
 // stopping the server). You get back a count of existing runners and and an
 // estimated time until completion for the last of those runners.
 func (c *Client) PauseServer() (running int, etc time.Duration, err error) {
-	return c.drainOrPauseServer("pause")
+	return c.PauseServerContext(context.Background())
+}
+
+// PauseServerContext is like PauseServer(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) PauseServerContext(ctx context.Context) (running int, etc time.Duration, err error) {
+	return c.drainOrPauseServer(ctx, "pause")
 }
 
 // ResumeServer tells the server to start spawning new runners and start letting
 // existing runners reserve new jobs. Use this after a PauseServer() call to
 // resume normal operation.
 func (c *Client) ResumeServer() error {
-	_, err := c.request(&clientRequest{Method: "resume"})
+	return c.ResumeServerContext(context.Background())
+}
+
+// ResumeServerContext is like ResumeServer(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) ResumeServerContext(ctx context.Context) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "resume"})
+	return err
+}
+
+// ReloadServerConfig tells the server to reload its configuration, as if it
+// had been sent a SIGHUP. You get back a report of which settings changed, and
+// which will only change when the server is restarted. Fails if the server was
+// not started with a ServerConfig.Reload, or the new configuration is invalid.
+func (c *Client) ReloadServerConfig() (*ReloadReport, error) {
+	return c.ReloadServerConfigContext(context.Background())
+}
+
+// ReloadServerConfigContext is like ReloadServerConfig(), but stops waiting
+// for the server and returns ctx.Err() if ctx is cancelled or reaches its
+// deadline first.
+func (c *Client) ReloadServerConfigContext(ctx context.Context) (*ReloadReport, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "reload"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Reload, err
+}
+
+// HandoverServer tells the server to start a new server process (eg. one
+// running an upgraded wr) and hand over to it, without stopping running jobs.
+// See ServerConfig.Handover for the details. Fails if the server was not
+// started with a ServerConfig.Handover, or the new process couldn't be
+// started; otherwise the old server shuts down in the background, and the new
+// one will respond to requests once it has taken over, which you can tell by
+// the PID in its ServerInfo changing (you may need to reconnect to see that).
+func (c *Client) HandoverServer() error {
+	return c.HandoverServerContext(context.Background())
+}
+
+// HandoverServerContext is like HandoverServer(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) HandoverServerContext(ctx context.Context) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "handover"})
 	return err
 }
 
@@ -307,7 +508,14 @@ func (c *Client) ResumeServer() error {
 // Because the server gets shut down it can't respond with success/failure, so
 // we indirectly report if the server was shut down successfully.
 func (c *Client) ShutdownServer() bool {
-	_, err := c.request(&clientRequest{Method: "shutdown"})
+	return c.ShutdownServerContext(context.Background())
+}
+
+// ShutdownServerContext is like ShutdownServer(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) ShutdownServerContext(ctx context.Context) bool {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "shutdown"})
 	if err != nil {
 		return false
 	}
@@ -318,13 +526,16 @@ func (c *Client) ShutdownServer() bool {
 	for {
 		select {
 		case <-ticker.C:
-			_, err = c.Ping(ClientSuggestedPingTimeout)
-			if err != nil {
+			_, err = c.PingContext(ctx, ClientSuggestedPingTimeout)
+			if err != nil && ctx.Err() == nil {
 				ticker.Stop()
 				return true
 			}
 		case <-limit:
 			return false
+		case <-ctx.Done():
+			ticker.Stop()
+			return false
 		}
 	}
 }
@@ -332,7 +543,13 @@ func (c *Client) ShutdownServer() bool {
 // BackupDB backs up the server's database to the given path. Note that
 // automatic backups occur to the configured location without calling this.
 func (c *Client) BackupDB(path string) error {
-	resp, err := c.request(&clientRequest{Method: "backup"})
+	return c.BackupDBContext(context.Background(), path)
+}
+
+// BackupDBContext is like BackupDB(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) BackupDBContext(ctx context.Context, path string) error {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "backup"})
 	if err != nil {
 		return err
 	}
@@ -365,31 +582,408 @@ func (c *Client) BackupDB(path string) error {
 // The envVars argument is a slice of ("key=value") strings with the environment
 // variables you want to be set when the job's Cmd actually runs. Typically you
 // would pass in os.Environ().
+//
+// Large numbers of jobs are sent in batches of ClientAddBatchSize (jobs being
+// put in dependency order first, so each is sent no earlier than the jobs it
+// depends on). If a batch fails, the earlier batches stay added: you get back
+// the counts for those along with the error, which says how many jobs were
+// sent. Since jobs already in the queue aren't added again, you can retry
+// with all the jobs.
 func (c *Client) Add(jobs []*Job, envVars []string, ignoreComplete bool) (added, existed int, err error) {
-	compressed, err := c.CompressEnv(envVars)
+	return c.AddContext(context.Background(), jobs, envVars, ignoreComplete)
+}
+
+// AddContext is like Add(), but stops waiting for the server and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) AddContext(ctx context.Context, jobs []*Job, envVars []string, ignoreComplete bool) (added, existed int, err error) {
+	added, existed, _, _, err = c.addBatches(ctx, jobs, envVars, rerunModeFromIgnoreComplete(ignoreComplete), false)
+	return added, existed, err
+}
+
+// AddWithRerunMode is like Add(), but instead of ignoreComplete takes a
+// RerunMode that says what to do with jobs that were previously added and have
+// since completed. As well as the number of jobs added and the number that
+// already existed, returns how many of those that existed were previously
+// completed jobs that were skipped instead of being run again.
+//
+// With RerunIfChanged, a previously completed job is only run again if its Cmd,
+// mounts or environment (envVars combined with any of the job's own overrides)
+// are different to when it completed.
+func (c *Client) AddWithRerunMode(jobs []*Job, envVars []string, mode RerunMode) (added, existed, skipped int, err error) {
+	return c.AddWithRerunModeContext(context.Background(), jobs, envVars, mode)
+}
+
+// AddWithRerunModeContext is like AddWithRerunMode(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) AddWithRerunModeContext(ctx context.Context, jobs []*Job, envVars []string, mode RerunMode) (added, existed, skipped int, err error) {
+	added, existed, skipped, _, err = c.addBatches(ctx, jobs, envVars, mode, false)
+	return added, existed, skipped, err
+}
+
+// AddAndReturnIDs is like Add(), except that the internal IDs of jobs that are
+// now in the queue are returned (including dups, excluding complete jobs). This
+// is potentially expensive, so use Add() if you don't need these.
+func (c *Client) AddAndReturnIDs(jobs []*Job, envVars []string, ignoreComplete bool) ([]string, error) {
+	return c.AddAndReturnIDsContext(context.Background(), jobs, envVars, ignoreComplete)
+}
+
+// AddAndReturnIDsContext is like AddAndReturnIDs(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) AddAndReturnIDsContext(ctx context.Context, jobs []*Job, envVars []string, ignoreComplete bool) ([]string, error) {
+	_, _, _, ids, err := c.addBatches(ctx, jobs, envVars, rerunModeFromIgnoreComplete(ignoreComplete), true)
+	return ids, err
+}
+
+// AddFromManifest is like Add(), but instead of taking every job, takes a
+// single template job and a CSV or TSV manifest (TSV if its first line contains
+// a tab), which the server expands in to one job per row. This lets you add
+// very large numbers of parameterised commands without having to create and
+// send each of them.
+//
+// The first line of the manifest must be a header naming its columns. The
+// template's Cmd, Steps, Cwd, RepGroup, Name and DepGroups can contain
+// {{column}} placeholders, which are replaced with that column's value in each
+// row, and {{.Index}} placeholders, which are replaced with the row number
+// (which also becomes the job's ArrayIndex). The jobs otherwise share all the
+// template's properties, including its requirements and mounts, except that
+// non-blank values in memory, time, cpus, disk and rep_grp columns override
+// the template's requirements and RepGroup for that row (memory and time take
+// values like "2G" and "1h30m").
+//
+// Use ExpandManifest() if you need the jobs yourself.
+func (c *Client) AddFromManifest(template *Job, manifest []byte, envVars []string, ignoreComplete bool) (added, existed int, err error) {
+	return c.AddFromManifestContext(context.Background(), template, manifest, envVars, ignoreComplete)
+}
+
+// AddFromManifestContext is like AddFromManifest(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) AddFromManifestContext(ctx context.Context, template *Job, manifest []byte, envVars []string, ignoreComplete bool) (added, existed int, err error) {
+	compressedEnv, err := c.CompressEnv(envVars)
 	if err != nil {
-		return 0, 0, err
+		return added, existed, err
 	}
-	resp, err := c.request(&clientRequest{Method: "add", Jobs: jobs, Env: compressed, IgnoreComplete: ignoreComplete})
+	compressed, err := compressFast(manifest)
 	if err != nil {
-		return 0, 0, err
+		return added, existed, err
+	}
+	user, _ := internal.Username() // #nosec only used to share capacity fairly between users
+	cr := &clientRequest{Method: "addmanifest", Job: template, File: compressed, Env: compressedEnv, IgnoreComplete: ignoreComplete, User: user}
+	cr.failoverSafe = ignoreComplete
+	resp, err := c.requestContext(ctx, cr)
+	if err != nil {
+		return added, existed, err
 	}
 	return resp.Added, resp.Existed, err
 }
 
-// AddAndReturnIDs is like Add(), except that the internal IDs of jobs that are
-// now in the queue are returned (including dups, excluding complete jobs). This
-// is potentially expensive, so use Add() if you don't need these.
-func (c *Client) AddAndReturnIDs(jobs []*Job, envVars []string, ignoreComplete bool) ([]string, error) {
+// AddArray is like AddFromManifest(), but instead of a manifest, takes the
+// number of jobs the template should be expanded in to. Each job gets an index
+// from 1 to size (its ArrayIndex), which replaces the {{.Index}} placeholders
+// in the template's Cmd, Steps, Cwd, RepGroup, Name and DepGroups. The Cmd (or
+// Steps) must contain such a placeholder, so that the jobs differ.
+//
+// Only the template is sent to the server, so this is a quick way to add
+// very many near-identical commands, eg. a parameter sweep. Unless you give
+// the template a RepGroup with a placeholder, the jobs share its RepGroup, so
+// the status web page shows them as a single row with aggregate state counts,
+// that you can expand to see the individual jobs.
+//
+// (Use AddFromManifest() with a manifest that has a column of values to sweep
+// over different values instead of indexes; {{.Index}} works there too,
+// giving the row number.)
+func (c *Client) AddArray(template *Job, size int, envVars []string, ignoreComplete bool) (added, existed int, err error) {
+	return c.AddArrayContext(context.Background(), template, size, envVars, ignoreComplete)
+}
+
+// AddArrayContext is like AddArray(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) AddArrayContext(ctx context.Context, template *Job, size int, envVars []string, ignoreComplete bool) (added, existed int, err error) {
+	compressedEnv, err := c.CompressEnv(envVars)
+	if err != nil {
+		return added, existed, err
+	}
+	user, _ := internal.Username() // #nosec only used to share capacity fairly between users
+	cr := &clientRequest{Method: "addarray", Job: template, ArraySize: size, Env: compressedEnv, IgnoreComplete: ignoreComplete, User: user}
+	cr.failoverSafe = ignoreComplete
+	resp, err := c.requestContext(ctx, cr)
+	if err != nil {
+		return added, existed, err
+	}
+	return resp.Added, resp.Existed, err
+}
+
+// ApplyPipeline makes the queue match a declarative pipeline: the given jobs
+// (eg. from ParsePipelineManifest()) are everything the pipeline with the given
+// name should have. The server works out which of them are not yet in the
+// queue (or, if ignoreComplete, complete) and adds just those, leaving
+// existing and running jobs alone. Incomplete jobs in the pipeline's RepGroups
+// (the name, or the name followed by a dot and anything) that are not in the
+// given jobs are reported as orphans, and if prune is true, removed (unless
+// they're running or have dependents).
+//
+// With dryRun, nothing is changed, and you just get the diff of what would be.
+//
+// All the jobs must be in the pipeline's RepGroups.
+func (c *Client) ApplyPipeline(name string, jobs []*Job, envVars []string, ignoreComplete, prune, dryRun bool) (*PipelineDiff, error) {
+	return c.ApplyPipelineContext(context.Background(), name, jobs, envVars, ignoreComplete, prune, dryRun)
+}
+
+// ApplyPipelineContext is like ApplyPipeline(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) ApplyPipelineContext(ctx context.Context, name string, jobs []*Job, envVars []string, ignoreComplete, prune, dryRun bool) (*PipelineDiff, error) {
+	compressedEnv, err := c.CompressEnv(envVars)
+	if err != nil {
+		return nil, err
+	}
+	jobsc, err := c.compressJobs(jobs)
+	if err != nil {
+		return nil, err
+	}
+	user, _ := internal.Username() // #nosec only used to share capacity fairly between users
+	cr := &clientRequest{Method: "apply", Job: &Job{RepGroup: name}, JobsC: jobsc, Env: compressedEnv, IgnoreComplete: ignoreComplete, Prune: prune, DryRun: dryRun, User: user}
+	cr.failoverSafe = dryRun
+	resp, err := c.requestContext(ctx, cr)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Pipeline, err
+}
+
+// addBatches implements Add(), AddWithRerunMode() and AddAndReturnIDs(). The
+// jobs are sent to the server in compressed batches of ClientAddBatchSize,
+// which the server stores in a single database transaction per batch. If any
+// of the jobs have dependencies, they're first put in dependency order (see
+// orderByDependencies()), so that every job is sent in the same batch as, or a
+// later batch than, the jobs it depends on; only if that isn't possible are
+// they all sent in a single batch.
+//
+// If a batch fails, the batches before it stay added: the counts and ids
+// returned are those of the jobs in them, and the error says how many of the
+// jobs were sent.
+func (c *Client) addBatches(ctx context.Context, jobs []*Job, envVars []string, mode RerunMode, returnIDs bool) (added, existed, skipped int, ids []string, err error) {
 	compressed, err := c.CompressEnv(envVars)
+	if err != nil {
+		return added, existed, skipped, ids, err
+	}
+
+	user, _ := internal.Username() // #nosec only used to share capacity fairly between users
+
+	batchSize := ClientAddBatchSize
+	if batchSize < 1 {
+		batchSize = len(jobs)
+	}
+	if len(jobs) > batchSize && jobsHaveDependencies(jobs) {
+		ordered, ok := orderByDependencies(jobs)
+		if ok {
+			jobs = ordered
+		} else {
+			batchSize = len(jobs)
+		}
+	}
+
+	for start := 0; ; start += batchSize {
+		end := start + batchSize
+		if end > len(jobs) {
+			end = len(jobs)
+		}
+
+		jobsc, errc := c.compressJobs(jobs[start:end])
+		if errc != nil {
+			return added, existed, skipped, ids, partialAddError(start, len(jobs), errc)
+		}
+
+		cr := &clientRequest{Method: "add", JobsC: jobsc, Env: compressed, IgnoreComplete: mode == RerunSkip, Rerun: mode, ReturnIDs: returnIDs, User: user}
+		cr.failoverSafe = mode != RerunForce || jobsHaveIdempotencyKeys(jobs[start:end])
+		resp, errr := c.requestContext(ctx, cr)
+		if errr != nil {
+			return added, existed, skipped, ids, partialAddError(start, len(jobs), errr)
+		}
+		added += resp.Added
+		existed += resp.Existed
+		skipped += resp.Skipped
+		ids = append(ids, resp.AddedIDs...)
+
+		if end == len(jobs) {
+			break
+		}
+	}
+
+	return added, existed, skipped, ids, err
+}
+
+// Estimate predicts how many core-hours the given jobs would use, how long it
+// would take for them to complete on the scheduler's current hosts, and (if the
+// server has been configured with a CostPerCoreHour) what they would cost,
+// without adding them. The jobs' resource requirements are first adjusted
+// (according to their Override) by what has been learned from previous jobs in
+// the same ReqGroup and RepGroup, just like they would be if added.
+func (c *Client) Estimate(jobs []*Job) (*Estimate, error) {
+	return c.EstimateContext(context.Background(), jobs)
+}
+
+// EstimateContext is like Estimate(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) EstimateContext(ctx context.Context, jobs []*Job) (*Estimate, error) {
+	jobsc, err := c.compressJobs(jobs)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "estimate", JobsC: jobsc})
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.request(&clientRequest{Method: "add", Jobs: jobs, Env: compressed, IgnoreComplete: ignoreComplete, ReturnIDs: true})
+	return resp.Estimate, err
+}
+
+// compressJobs encodes the given jobs and then compresses that, so that large
+// numbers of jobs can be sent to the server efficiently.
+func (c *Client) compressJobs(jobs []*Job) ([]byte, error) {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, c.ch)
+	err := enc.Encode(jobs)
 	if err != nil {
 		return nil, err
 	}
-	return resp.AddedIDs, err
+	if len(encoded) > wireMaxDecodedSize {
+		return nil, fmt.Errorf("%d jobs encode to %d bytes, more than the server accepts (%d): %w", len(jobs), len(encoded), wireMaxDecodedSize, ErrorRequestTooLarge)
+	}
+	return compressFast(encoded)
+}
+
+// jobsHaveDependencies tells you if any of the given jobs have Dependencies.
+func jobsHaveDependencies(jobs []*Job) bool {
+	for _, job := range jobs {
+		if len(job.Dependencies) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// orderByDependencies returns the given jobs ordered so that each comes after
+// the jobs in the slice it depends on (those with its Dependencies' DepGroups
+// in their DepGroups, or with the Key() of its Dependencies' Essences). Returns
+// false if that isn't possible because their dependencies are circular. Jobs
+// that are already in such an order are returned in the same order.
+func orderByDependencies(jobs []*Job) ([]*Job, bool) {
+	// the nodes of our graph are the jobs, followed by their dep groups, so
+	// that a dep group's members and dependents needn't all be linked to each
+	// other
+	groups := make(map[string]int)
+	keys := make(map[string]int, len(jobs))
+	for i, job := range jobs {
+		keys[job.Key()] = i
+		for _, group := range job.DepGroups {
+			if _, exists := groups[group]; !exists {
+				groups[group] = len(jobs) + len(groups)
+			}
+		}
+	}
+
+	nodes := len(jobs) + len(groups)
+	next := make([][]int, nodes)
+	waiting := make([]int, nodes)
+	link := func(from, to int) {
+		next[from] = append(next[from], to)
+		waiting[to]++
+	}
+	for i, job := range jobs {
+		for _, group := range job.DepGroups {
+			link(i, groups[group])
+		}
+		for _, dep := range job.Dependencies {
+			switch {
+			case dep.DepGroup != "":
+				if g, exists := groups[dep.DepGroup]; exists {
+					link(g, i)
+				}
+			case dep.Essence != nil:
+				if d, exists := keys[dep.Essence.Key()]; exists && d != i {
+					link(d, i)
+				}
+			}
+		}
+	}
+
+	// jobs are taken in their original order whenever possible, so that jobs
+	// already in dependency order stay as they are; dep groups are resolved as
+	// soon as they're ready
+	var ready jobIndexHeap
+	var groupsReady []int
+	markReady := func(n int) {
+		if n < len(jobs) {
+			heap.Push(&ready, n)
+		} else {
+			groupsReady = append(groupsReady, n)
+		}
+	}
+	for n := 0; n < nodes; n++ {
+		if waiting[n] == 0 {
+			markReady(n)
+		}
+	}
+	resolve := func(n int) {
+		for _, m := range next[n] {
+			waiting[m]--
+			if waiting[m] == 0 {
+				markReady(m)
+			}
+		}
+	}
+	ordered := make([]*Job, 0, len(jobs))
+	for {
+		for len(groupsReady) > 0 {
+			g := groupsReady[len(groupsReady)-1]
+			groupsReady = groupsReady[:len(groupsReady)-1]
+			resolve(g)
+		}
+		if ready.Len() == 0 {
+			break
+		}
+		n := heap.Pop(&ready).(int)
+		ordered = append(ordered, jobs[n])
+		resolve(n)
+	}
+	return ordered, len(ordered) == len(jobs)
+}
+
+// jobIndexHeap is a min-heap of indexes in to a slice of jobs, used by
+// orderByDependencies().
+type jobIndexHeap []int
+
+func (h jobIndexHeap) Len() int            { return len(h) }
+func (h jobIndexHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h jobIndexHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobIndexHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+func (h *jobIndexHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// partialAddError wraps an error from adding the batch of jobs starting at
+// index sent, to say how many of them were sent before it.
+func partialAddError(sent, total int, err error) error {
+	if sent == 0 {
+		return err
+	}
+	return fmt.Errorf("only the first %d of %d jobs were sent: %w", sent, total, err)
+}
+
+// jobsHaveIdempotencyKeys tells you if every one of the given jobs has an
+// IdempotencyKey.
+func jobsHaveIdempotencyKeys(jobs []*Job) bool {
+	for _, job := range jobs {
+		if job.IdempotencyKey == "" {
+			return false
+		}
+	}
+	return true
 }
 
 // Modify modifies previously Add()ed jobs that are incomplete and not currently
@@ -405,11 +999,50 @@ func (c *Client) AddAndReturnIDs(jobs []*Job, envVars []string, ignoreComplete b
 // internal job id (which will typically be the same, unless something critical
 // like the command line was changed).
 func (c *Client) Modify(jes []*JobEssence, modifier *JobModifier) (modified map[string]string, err error) {
+	return c.ModifyContext(context.Background(), jes, modifier)
+}
+
+// ModifyContext is like Modify(), but stops waiting for the server and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) ModifyContext(ctx context.Context, jes []*JobEssence, modifier *JobModifier) (modified map[string]string, err error) {
 	keys := c.jesToKeys(jes)
-	resp, err := c.request(&clientRequest{Method: "jmod", Keys: keys, Modifier: modifier})
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "jmod", Keys: keys, Modifier: modifier})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Modified, err
+}
+
+// ModifyJobs is like Modify(), but takes Jobs you previously retrieved (eg.
+// with GetByRepGroup()) and detects conflicting changes: if any of the jobs
+// has started running since you retrieved it (or has been removed from the
+// queue, eg. because it completed), none of the jobs are modified and an Error
+// is returned with Err ErrModifyConflict and Item being the comma-separated
+// keys of the conflicting jobs. You could then retrieve the jobs again and
+// decide if you still want to modify them.
+//
+// Use the JobModifier's Set*() methods (eg. SetRequirements(), SetPriority(),
+// SetRetries(), SetBehaviours(), SetDependencies()) to say what should change.
+func (c *Client) ModifyJobs(jobs []*Job, modifier *JobModifier) (modified map[string]string, err error) {
+	return c.ModifyJobsContext(context.Background(), jobs, modifier)
+}
+
+// ModifyJobsContext is like ModifyJobs(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) ModifyJobsContext(ctx context.Context, jobs []*Job, modifier *JobModifier) (modified map[string]string, err error) {
+	keys := make([]string, len(jobs))
+	attempts := make([]uint32, len(jobs))
+	for i, job := range jobs {
+		keys[i] = job.Key()
+		attempts[i] = job.Attempts
+	}
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "jmod", Keys: keys, Attempts: attempts, Modifier: modifier})
 	if err != nil {
 		return nil, err
 	}
+	if len(resp.Conflicts) > 0 {
+		return nil, Error{"jmod", strings.Join(resp.Conflicts, ","), ErrModifyConflict}
+	}
 	return resp.Modified, err
 }
 
@@ -427,16 +1060,13 @@ func (c *Client) Modify(jes []*JobEssence, modifier *JobModifier) (modified map[
 // server configured with a RunnerCmd), this will most likely not return any
 // jobs; use ReserveScheduled() instead.
 func (c *Client) Reserve(timeout time.Duration) (*Job, error) {
-	fr := false
-	if !c.hasReserved {
-		fr = true
-		c.hasReserved = true
-	}
-	resp, err := c.request(&clientRequest{Method: "reserve", Timeout: timeout, FirstReserve: fr})
-	if err != nil {
-		return nil, err
-	}
-	return resp.Job, err
+	return c.ReserveContext(context.Background(), timeout)
+}
+
+// ReserveContext is like Reserve(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) ReserveContext(ctx context.Context, timeout time.Duration) (*Job, error) {
+	return c.reserveContext(ctx, &clientRequest{Method: "reserve", Timeout: timeout})
 }
 
 // ReserveScheduled is like Reserve(), except that it will only return jobs from
@@ -451,21 +1081,72 @@ func (c *Client) Reserve(timeout time.Duration) (*Job, error) {
 // does not make sense for you to call this yourself; it is only for use by
 // runners spawned by the server.
 func (c *Client) ReserveScheduled(timeout time.Duration, schedulerGroup string) (*Job, error) {
-	fr := false
-	if !c.hasReserved {
-		fr = true
-		c.hasReserved = true
-	}
-	resp, err := c.request(&clientRequest{Method: "reserve", Timeout: timeout, SchedulerGroup: schedulerGroup, FirstReserve: fr})
-	if err != nil {
-		return nil, err
-	}
-	return resp.Job, err
+	return c.ReserveScheduledContext(context.Background(), timeout, schedulerGroup)
 }
 
-// Execute runs the given Job's Cmd and blocks until it exits. Then any Job
-// Behaviours get triggered as appropriate for the exit status.
-//
+// ReserveScheduledContext is like ReserveScheduled(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) ReserveScheduledContext(ctx context.Context, timeout time.Duration, schedulerGroup string) (*Job, error) {
+	return c.reserveContext(ctx, &clientRequest{Method: "reserve", Timeout: timeout, SchedulerGroup: schedulerGroup})
+}
+
+// ReserveFromGroups is like ReserveScheduled(), except that it will return a
+// job from any of the given schedulerGroups, preferring groups earlier in the
+// slice. It waits up to timeout for a job in any of the groups to become
+// ready, so that runners that are able to run jobs from multiple groups don't
+// have to repeatedly try each group in turn.
+func (c *Client) ReserveFromGroups(timeout time.Duration, schedulerGroups []string) (*Job, error) {
+	return c.ReserveFromGroupsContext(context.Background(), timeout, schedulerGroups)
+}
+
+// ReserveFromGroupsContext is like ReserveFromGroups(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) ReserveFromGroupsContext(ctx context.Context, timeout time.Duration, schedulerGroups []string) (*Job, error) {
+	return c.reserveContext(ctx, &clientRequest{Method: "reserve", Timeout: timeout, SchedulerGroups: schedulerGroups})
+}
+
+// ReserveWithin is like Reserve(), except that it will only return a job whose
+// Requirements fit within the given capacity: no more RAM and Cores than it
+// has, no more Time and Disk than it has unless those are 0 (meaning
+// unlimited), and any Other requirements the job has must be present in the
+// capacity's Other. The server picks the job from the scheduler group with the
+// largest requirements that fit, so that you make the best use of the
+// capacity.
+func (c *Client) ReserveWithin(timeout time.Duration, capacity *scheduler.Requirements) (*Job, error) {
+	return c.ReserveWithinContext(context.Background(), timeout, capacity)
+}
+
+// ReserveWithinContext is like ReserveWithin(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) ReserveWithinContext(ctx context.Context, timeout time.Duration, capacity *scheduler.Requirements) (*Job, error) {
+	return c.reserveContext(ctx, &clientRequest{Method: "reserve", Timeout: timeout, Capacity: capacity})
+}
+
+// reserveContext fills in the details common to all reserve requests and sends
+// the given one.
+func (c *Client) reserveContext(ctx context.Context, cr *clientRequest) (*Job, error) {
+	if !c.hasReserved {
+		cr.FirstReserve = true
+		c.hasReserved = true
+	}
+	cr.Host, _ = os.Hostname()
+	if c.version != "" {
+		cr.RunnerVersion = c.version
+		cr.RunnerPlatform = runnerPlatform()
+	}
+	resp, err := c.requestContext(ctx, cr)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Job, err
+}
+
+// Execute runs the given Job's Cmd and blocks until it exits. Then any Job
+// Behaviours get triggered as appropriate for the exit status.
+//
 // The Cmd is run using the environment variables set when the Job was Add()ed,
 // or the current environment is used if none were set.
 //
@@ -516,49 +1197,108 @@ func (c *Client) Execute(job *Job, shell string) error {
 	}
 
 	// we support arbitrary shell commands that may include semi-colons,
-	// quoted stuff and pipes, so it's best if we just pass it to bash
-	jc := job.Cmd
-	if strings.Contains(jc, " | ") {
+	// quoted stuff and pipes, so it's best if we just pass it to bash. Multi-
+	// step jobs are run via a script that resumes from the first incomplete
+	// step and records the outcome of each step in a status file
+	jc := job.retryCmd()
+	var stepsFile string
+	var firstStep int
+	if len(job.Steps) > 0 {
+		sf, errt := ioutil.TempFile("", "wr_steps")
+		if errt != nil {
+			return fmt.Errorf("failed to create a status file for the steps of cmd [%s]: %w", jc, errt)
+		}
+		stepsFile = sf.Name()
+		if errc := sf.Close(); errc != nil {
+			return fmt.Errorf("failed to create a status file for the steps of cmd [%s]: %w", jc, errc)
+		}
+		defer func() {
+			errr := os.Remove(stepsFile)
+			if errr != nil && !os.IsNotExist(errr) {
+				logger.Warn("failed to remove steps status file", "err", errr)
+			}
+		}()
+		firstStep = job.firstStep()
+		jc = job.stepsScript(firstStep, stepsFile)
+	} else if strings.Contains(jc, " | ") {
 		jc = "set -o pipefail; " + jc
 	}
+	jc = job.moduleLoadCmd() + jc
+
+	// the cmd can register output files that it didn't know about when it was
+	// added by writing their paths to a file we tell it about
+	of, err := ioutil.TempFile("", "wr_outputs")
+	if err != nil {
+		return fmt.Errorf("failed to create an outputs file for cmd [%s]: %w", jc, err)
+	}
+	outputsFile := of.Name()
+	if errc := of.Close(); errc != nil {
+		return fmt.Errorf("failed to create an outputs file for cmd [%s]: %w", jc, errc)
+	}
+	defer func() {
+		errr := os.Remove(outputsFile)
+		if errr != nil && !os.IsNotExist(errr) {
+			logger.Warn("failed to remove outputs file", "err", errr)
+		}
+	}()
 	cmd := exec.Command(shell, "-c", jc) // #nosec Our whole purpose is to allow users to run arbitrary commands via us...
 
+	// get the values of any secrets the cmd needs, which the server only gave
+	// us for this run
+	secretEnv, secretValues, err := job.secretEnv()
+	if err != nil {
+		buryErr := fmt.Errorf("failed to get the secrets of cmd [%s]: %w", jc, err)
+		errb := c.Bury(job, nil, FailReasonSecret, buryErr)
+		if errb != nil {
+			buryErr = fmt.Errorf("%v (and burying the job failed: %w)", buryErr, errb)
+		}
+		return buryErr
+	}
+
 	// we'll filter STDERR/OUT of the cmd to keep only the first and last line
 	// of any contiguous block of \r terminated lines (to mostly eliminate
-	// progress bars), and  we'll store only up to 4kb of their head and tail
+	// progress bars), and  we'll store only up to 4kb of their head and tail.
+	// We also ship their tail to the server while the cmd runs, so that users
+	// can watch it live. The values of any secrets are redacted from all of
+	// that
+	tailShip := newTailShipper()
+	job.Lock()
+	job.tailShip = tailShip
+	job.Unlock()
 	errReader, err := cmd.StderrPipe()
 	if err != nil {
 		return fmt.Errorf("failed to create a pipe for STDERR from cmd [%s]: %w", jc, err)
 	}
 	stderr := &prefixSuffixSaver{N: 4096}
-	stderrWait := stdFilter(errReader, stderr)
+	stderrWait := stdFilter(errReader, newRedactWriter(io.MultiWriter(stderr, tailShip.err), secretValues))
 	outReader, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("failed to create a pipe for STDOUT from cmd [%s]: %w", jc, err)
 	}
 	stdout := &prefixSuffixSaver{N: 4096}
-	stdoutWait := stdFilter(outReader, stdout)
-
-	// we'll run the command from the desired directory, which must exist or
-	// it will fail
-	if fi, errf := os.Stat(job.Cwd); errf != nil || !fi.Mode().IsDir() {
-		errm := os.MkdirAll(job.Cwd, os.ModePerm)
-		if _, errs := os.Stat(job.Cwd); errs != nil {
+	stdoutWait := stdFilter(outReader, newRedactWriter(io.MultiWriter(stdout, tailShip.out), secretValues))
+
+	// we'll run the command from the desired directory (which can be changed
+	// when retrying), which must exist or it will fail
+	cwd := job.retryCwd()
+	if fi, errf := os.Stat(cwd); errf != nil || !fi.Mode().IsDir() {
+		errm := os.MkdirAll(cwd, os.ModePerm)
+		if _, errs := os.Stat(cwd); errs != nil {
 			errb := c.Bury(job, nil, FailReasonCwd)
 			extra := ""
 			if errb != nil {
 				extra = fmt.Sprintf(" (and burying the job failed: %s)", errb)
 			}
-			return fmt.Errorf("working directory [%s] does not exist%s: %w", job.Cwd, extra, errm)
+			return fmt.Errorf("working directory [%s] does not exist%s: %w", cwd, extra, errm)
 		}
 	}
 	var actualCwd, tmpDir string
 	var dirsToCheckDiskSpace []string
 	if job.CwdMatters {
-		cmd.Dir = job.Cwd
+		cmd.Dir = cwd
 	} else {
 		// we'll create a unique location to work in
-		actualCwd, tmpDir, err = mkHashedDir(job.Cwd, job.Key())
+		actualCwd, tmpDir, err = mkHashedDir(cwd, job.Key())
 		if err != nil {
 			buryErr := fmt.Errorf("could not create working directory: %w", err)
 			errb := c.Bury(job, nil, FailReasonCwd, buryErr)
@@ -577,18 +1317,73 @@ func (c *Client) Execute(job *Job, shell string) error {
 	// before doing any other pre-start tasks, which might take time, start
 	// touching the job, and keep doing so until after we've run the job and
 	// carried out post-exit tasks
-	touchTicker := time.NewTicker(ClientTouchInterval) //*** this should be less than the ServerItemTTR set when the server started, not a fixed value
+	heartbeat := ClientTouchInterval
+	job.RLock()
+	if job.LostPolicy != nil && job.LostPolicy.Heartbeat > 0 {
+		heartbeat = job.LostPolicy.Heartbeat
+	}
+	job.RUnlock()
+	touchTicker := time.NewTicker(heartbeat)
+
+	// state updates we can't send because we lost contact with the server are
+	// buffered and replayed when we can
+	updates := &updateBuffer{}
 
 	var wkbsMutex sync.RWMutex
 	whenKilledByServer := func() {}
 	stopTouching := make(chan bool, 2)
 	stopChecking := make(chan bool, 2)
+	preemptions := make(chan *serverResponse, 1)
 	go func() {
+		// while someone is watching the job's output, we ship it more often
+		// than we touch
+		var tailTicker *time.Ticker
+		var tailC <-chan time.Time
+		defer func() {
+			if tailTicker != nil {
+				tailTicker.Stop()
+			}
+		}()
+		tailing := func(resp *serverResponse) {
+			switch {
+			case resp.Tailing && tailTicker == nil:
+				tailTicker = time.NewTicker(ClientTailInterval)
+				tailC = tailTicker.C
+			case !resp.Tailing && tailTicker != nil:
+				tailTicker.Stop()
+				tailTicker, tailC = nil, nil
+			}
+		}
+
 		for {
 			select {
+			case <-tailC:
+				resp, errf := c.shipTail(context.Background(), job)
+				if errf == nil {
+					tailing(resp)
+				}
 			case <-touchTicker.C:
-				kc, errf := c.Touch(job)
-				if kc {
+				if updates.buffering() {
+					if errr := updates.replay(); errr != nil {
+						if lostContact(errr) {
+							logger.Warn("still could not contact the server", "err", errr)
+							continue
+						}
+						logger.Error("server rejected an update we had buffered", "err", errr)
+					} else {
+						logger.Info("regained contact with the server and replayed buffered updates")
+					}
+				}
+
+				resp, errf := c.touch(context.Background(), job)
+				if errf != nil {
+					// we may have lost contact with the manager; this is OK. We
+					// will keep trying to touch until it works
+					logger.Warn("could not touch", "err", errf)
+					continue
+				}
+				tailing(resp)
+				if resp.KillCalled {
 					wkbsMutex.RLock()
 					defer wkbsMutex.RUnlock()
 					whenKilledByServer()
@@ -597,11 +1392,12 @@ func (c *Client) Execute(job *Job, shell string) error {
 					stopChecking <- true
 					return
 				}
-				if errf != nil {
-					// we may have lost contact with the manager; this is OK. We
-					// will keep trying to touch until it works
-					logger.Warn("could not touch", "err", errf)
-					continue
+
+				// let the checking go routine deal with preemption (or the
+				// end of it), unless it's still dealing with the last touch
+				select {
+				case preemptions <- resp:
+				default:
 				}
 			case <-stopTouching:
 				touchTicker.Stop()
@@ -810,13 +1606,58 @@ func (c *Client) Execute(job *Job, shell string) error {
 			"LSF_BINDIR=" + prependPath,
 		})
 	}
+	env = envOverride(env, []string{"WR_OUTPUTS_FILE=" + outputsFile})
+	env = envOverride(env, secretEnv)
 	cmd.Env = env
 
+	// if the cmd should run in a container, make sure we have its image, then
+	// run the cmd inside it instead of directly. Docker containers are then
+	// monitored by the cidfile we have docker create
+	dockerName := job.MonitorDocker
+	if job.ContainerImage != "" {
+		errc := job.containerPull()
+		var path string
+		var args []string
+		if errc == nil {
+			cidFile := filepath.Join(os.TempDir(), fmt.Sprintf("wr_container_%s_%d.cid", job.Key(), os.Getpid()))
+			binds := append([]string{tmpDir, outputsFile, stepsFile}, uniqueMountedDirs...)
+			args, errc = job.containerArgs(shell, jc, cmd.Dir, binds, env, cidFile)
+			if errc == nil {
+				path, errc = exec.LookPath(args[0])
+			}
+			if errc == nil && job.containerRuntime() == ContainerRuntimeDocker {
+				if dockerName == "" {
+					dockerName = cidFile
+				}
+				defer func() {
+					errr := os.Remove(cidFile)
+					if errr != nil && !os.IsNotExist(errr) {
+						logger.Warn("failed to remove container id file", "err", errr)
+					}
+				}()
+			}
+		}
+		if errc != nil {
+			stopTouching <- true
+			buryErr := fmt.Errorf("failed to prepare container: %w", errc)
+			errb := c.Bury(job, nil, FailReasonContainer, buryErr)
+			if errb != nil {
+				buryErr = fmt.Errorf("%v (and burying the job failed: %w)", buryErr, errb)
+			}
+			_, erru := job.Unmount(true)
+			if erru != nil {
+				buryErr = fmt.Errorf("%v (and unmounting the job failed: %w)", buryErr, erru)
+			}
+			return buryErr
+		}
+		cmd.Path, cmd.Args = path, args
+	}
+
 	// if docker monitoring has been requested, try and get the docker client
 	// now and fail early if we can't
 	var dockerClient *internal.DockerClient
 	var monitorDocker, getFirstDockerContainer bool
-	if job.MonitorDocker != "" {
+	if dockerName != "" {
 		monitorDocker = true
 		dockerClient, err = internal.NewDockerClient()
 		if err != nil {
@@ -831,7 +1672,7 @@ func (c *Client) Execute(job *Job, shell string) error {
 
 		// if we've been asked to monitor the first container that appears,
 		// remember existing containers
-		if job.MonitorDocker == "?" {
+		if dockerName == "?" {
 			getFirstDockerContainer = true
 			errc := dockerClient.RememberCurrentContainerIDs()
 			if errc != nil {
@@ -846,6 +1687,32 @@ func (c *Client) Execute(job *Job, shell string) error {
 		}
 	}
 
+	// if this job is being rerun and the outputs it created last time are all
+	// still intact, we don't need to run its Cmd again
+	if job.VerifyOutputs && len(job.PriorArtifacts) > 0 && job.verifyPriorArtifacts() == nil {
+		return c.completeVerified(job, actualCwd, stopTouching)
+	}
+
+	// make any Inputs available in the working directory, via our cache
+	var inputStats *InputCacheStats
+	if len(job.Inputs) > 0 {
+		var errs error
+		inputStats, errs = c.inputCache().stage(job.Inputs, cmd.Dir)
+		if errs != nil {
+			stopTouching <- true
+			buryErr := fmt.Errorf("failed to stage inputs: %w", errs)
+			errb := c.Bury(job, nil, FailReasonInput, buryErr)
+			if errb != nil {
+				buryErr = fmt.Errorf("%v (and burying the job failed: %w)", buryErr, errb)
+			}
+			_, erru := job.Unmount(true)
+			if erru != nil {
+				buryErr = fmt.Errorf("%v (and unmounting the job failed: %w)", buryErr, erru)
+			}
+			return buryErr
+		}
+	}
+
 	// intercept certain signals (under LSF and SGE, SIGUSR2 may mean out-of-
 	// time, but there's no reliable way of knowing out-of-memory, so we will
 	// just treat them all the same)
@@ -871,8 +1738,18 @@ func (c *Client) Execute(job *Job, shell string) error {
 		return fmt.Errorf("could not start command [%s]: %w%s", jc, err, extra)
 	}
 
-	// update the server that we've started the job
-	err = c.Started(job, cmd.Process.Pid)
+	// update the server that we've started the job; if we can't contact it
+	// right now we carry on, and tell it once we can
+	err = c.prepareStarted(job, cmd.Process.Pid)
+	if err == nil {
+		var buffered bool
+		buffered, err = updates.send(func(replayed bool) error {
+			return c.sendStarted(context.Background(), job, replayed)
+		})
+		if buffered {
+			logger.Warn("could not tell the server the job started; will retry")
+		}
+	}
 	if err != nil {
 		// if we can't access the server, may as well bail out now - kill the
 		// command (and don't bother trying to Release(); it will auto-Release)
@@ -892,6 +1769,21 @@ func (c *Client) Execute(job *Job, shell string) error {
 		return fmt.Errorf("command [%s] started running, but I killed it due to a jobqueue server error: %w%s", job.Cmd, err, extra)
 	}
 
+	// cap the command's network bandwidth if desired; failing to do so isn't
+	// a reason not to run it
+	if job.NetworkCap && job.Network > 0 {
+		shaper, errs := shapeNetwork(cmd.Process.Pid, job.Network)
+		if errs != nil {
+			c.Warn("could not cap the network bandwidth of a command; it will run uncapped", "cmd", job.Cmd, "err", errs)
+		} else {
+			defer func() {
+				if errr := shaper.remove(); errr != nil {
+					c.Warn("could not remove the network bandwidth cap of a command", "cmd", job.Cmd, "err", errr)
+				}
+			}()
+		}
+	}
+
 	// update peak mem and disk used by command, and check if we use too much
 	// resources, every second. Also check for signals
 	peakmem := 0
@@ -902,8 +1794,12 @@ func (c *Client) Execute(job *Job, shell string) error {
 	ranoutMem := false
 	ranoutTime := false
 	ranoutDisk := false
+	ranoutDiskUse := false
 	signalled := false
 	killCalled := false
+	suspended := false
+	preempted := false
+	preemptReason := FailReasonPreempt
 	var killErr error
 	var closeErr error
 	var stateMutex sync.Mutex
@@ -967,6 +1863,10 @@ func (c *Client) Execute(job *Job, shell string) error {
 			return errk
 		}
 
+		signalCmd := func(sig syscall.Signal) error {
+			return signalProcessTree(cmd.Process.Pid, sig)
+		}
+
 		closeReaders := func() {
 			errc := errReader.Close()
 			if errc != nil {
@@ -988,9 +1888,41 @@ func (c *Client) Execute(job *Job, shell string) error {
 		}
 		wkbsMutex.Unlock()
 
+		var graceOver <-chan time.Time
+
 	CHECKING:
 		for {
 			select {
+			case resp := <-preemptions:
+				stateMutex.Lock()
+				if resp.Preempt != PreemptSuspend && suspended {
+					if errs := signalCmd(syscall.SIGCONT); errs != nil {
+						logger.Warn("failed to resume after preemption", "err", errs)
+					}
+					suspended = false
+				}
+				switch {
+				case resp.Preempt == PreemptSuspend && !suspended:
+					if errs := signalCmd(syscall.SIGSTOP); errs != nil {
+						logger.Warn("failed to suspend for preemption", "err", errs)
+					}
+					suspended = true
+				case (resp.Preempt == PreemptRequeue || resp.Preempt == preemptExclude) && !preempted:
+					// give the cmd a chance to checkpoint before we kill it
+					if errs := signalCmd(syscall.SIGTERM); errs != nil {
+						logger.Warn("failed to terminate for preemption", "err", errs)
+					}
+					preempted = true
+					if resp.Preempt == preemptExclude {
+						preemptReason = FailReasonExclude
+					}
+					graceOver = time.After(resp.Grace)
+				}
+				stateMutex.Unlock()
+			case <-graceOver:
+				killErr = killCmd()
+				closeReaders()
+				break CHECKING
 			case <-sigs:
 				killErr = killCmd()
 				stateMutex.Lock()
@@ -1006,7 +1938,7 @@ func (c *Client) Execute(job *Job, shell string) error {
 			case <-resourceTicker.C:
 				// always see if we've run out of disk space on the machine, in
 				// which case abort
-				if internal.NoDiskSpaceLeft(filepath.Dir(job.Cwd)) {
+				if internal.NoDiskSpaceLeft(filepath.Dir(cwd)) {
 					killErr = killCmd()
 					stateMutex.Lock()
 					ranoutDisk = true
@@ -1027,9 +1959,9 @@ func (c *Client) Execute(job *Job, shell string) error {
 							// look for a new container
 							dockerContainerID, errg = dockerClient.GetNewDockerContainerID()
 						} else {
-							// job.MonitorDocker might be a file path or name of
-							// a new container
-							dockerContainerID, errg = dockerClient.GetNewDockerContainerIDByName(job.MonitorDocker, cmd.Dir)
+							// dockerName might be a file path or name of a new
+							// container
+							dockerContainerID, errg = dockerClient.GetNewDockerContainerIDByName(dockerName, cmd.Dir)
 						}
 						if errg != nil {
 							if myerr == nil {
@@ -1085,6 +2017,16 @@ func (c *Client) Execute(job *Job, shell string) error {
 				}
 				if errd == nil && disk > peakdisk {
 					peakdisk = disk
+
+					// kill the cmd if it uses much more disk than it asked
+					// for, since it might fill up a volume shared with other
+					// jobs
+					if ClientPercentDiskKill > 0 && job.Requirements.Disk > 0 && peakdisk > int64(job.Requirements.Disk*1024*ClientPercentDiskKill/100) {
+						ranoutDiskUse = true
+						killErr = killCmd()
+						stateMutex.Unlock()
+						break CHECKING
+					}
 				}
 				stateMutex.Unlock()
 			case <-stopChecking:
@@ -1145,6 +2087,7 @@ func (c *Client) Execute(job *Job, shell string) error {
 	dorelease := false
 	doarchive := false
 	failreason := ""
+	var missing []string
 	var mayBeTemp string
 	if job.UntilBuried > 1 {
 		mayBeTemp = ", which may be a temporary issue, so it will be tried again"
@@ -1169,6 +2112,12 @@ func (c *Client) Execute(job *Job, shell string) error {
 			default:
 				dorelease = true
 				switch {
+				case preempted:
+					failreason = preemptReason
+					myerr = Error{"Execute", job.Key(), preemptReason}
+				case ranoutDiskUse:
+					failreason = FailReasonDiskUse
+					myerr = Error{"Execute", job.Key(), FailReasonDiskUse}
 				case ranoutMem:
 					failreason = FailReasonRAM
 					myerr = Error{"Execute", job.Key(), FailReasonRAM}
@@ -1199,6 +2148,19 @@ func (c *Client) Execute(job *Job, shell string) error {
 			failreason = FailReasonAbnormal
 			myerr = fmt.Errorf("command [%s] failed to complete normally (%w)%s", job.Cmd, err, mayBeTemp)
 		}
+	} else if preempted {
+		// the command exited cleanly after checkpointing, but didn't get to
+		// finish
+		exitcode = cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+		dorelease = true
+		failreason = preemptReason
+		myerr = Error{"Execute", job.Key(), preemptReason}
+	} else if missing = job.missingOutputs(); len(missing) > 0 {
+		// the command claimed to work, but didn't create what it should have
+		exitcode = cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+		dorelease = true
+		failreason = FailReasonMissing
+		myerr = fmt.Errorf("command [%s] exited 0 but did not create expected output(s) %s%s", job.Cmd, strings.Join(missing, ", "), mayBeTemp)
 	} else {
 		// the command worked fine
 		exitcode = cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
@@ -1224,7 +2186,30 @@ func (c *Client) Execute(job *Job, shell string) error {
 		}
 	}
 
-	// run behaviours
+	// record the files the job said it would create (or that the cmd
+	// registered in the outputs file), before behaviours or unmounting can
+	// remove them; a missing output doesn't stop the job from being archived,
+	// but we do report it
+	var artifacts []*Artifact
+	if doarchive {
+		registered, aerr := readOutputsFile(outputsFile)
+		if aerr == nil && (len(job.Outputs) > 0 || len(registered) > 0) {
+			artifacts, aerr = job.recordArtifacts(registered)
+		}
+		if aerr != nil {
+			if myerr != nil {
+				myerr = fmt.Errorf("%v; recording outputs also had problem(s): %w", myerr, aerr)
+			} else {
+				myerr = fmt.Errorf("recording outputs had problem(s): %w", aerr)
+			}
+		}
+	}
+
+	// run behaviours, letting conditional ones see how the cmd exited
+	job.Lock()
+	job.Exitcode = exitcode
+	job.FailReason = failreason
+	job.Unlock()
 	berr := job.TriggerBehaviours(myerr == nil)
 	if berr != nil {
 		if myerr != nil {
@@ -1233,6 +2218,7 @@ func (c *Client) Execute(job *Job, shell string) error {
 			myerr = berr
 		}
 	}
+	artifacts = mergeArtifacts(artifacts, job.takeBehaviourArtifacts())
 
 	// try and unmount now, because if we fail to upload files, we'll have to
 	// start over
@@ -1268,6 +2254,11 @@ func (c *Client) Execute(job *Job, shell string) error {
 		finalStdErr = append(finalStdErr, berr.Error()...)
 	}
 
+	if len(missing) > 0 {
+		finalStdErr = append(finalStdErr, "\n\nMissing expected outputs:\n"...)
+		finalStdErr = append(finalStdErr, strings.Join(missing, "\n")...)
+	}
+
 	if errsew != nil {
 		finalStdErr = append(finalStdErr, "\n\nSTDERR handling problems:\n"...)
 		finalStdErr = append(finalStdErr, errsew.Error()...)
@@ -1286,6 +2277,16 @@ func (c *Client) Execute(job *Job, shell string) error {
 		finalStdOut = append(finalStdOut, errsow.Error()...)
 	}
 
+	var stepResults []*JobStep
+	if stepsFile != "" {
+		var errp error
+		stepResults, errp = job.parseStepResults(firstStep, stepsFile)
+		if errp != nil {
+			finalStdErr = append(finalStdErr, "\n\nStep status problems:\n"...)
+			finalStdErr = append(finalStdErr, errp.Error()...)
+		}
+	}
+
 	// now we've done everything time-consuming so can stop touching the job
 	stopTouching <- true
 
@@ -1299,15 +2300,19 @@ func (c *Client) Execute(job *Job, shell string) error {
 	disconnected := false
 	hadProblems := false
 	jes := &JobEndState{
-		Cwd:      actualCwd,
-		Exitcode: exitcode,
-		PeakRAM:  peakmem,
-		PeakDisk: peakdisk,
-		CPUtime:  cmd.ProcessState.SystemTime() + cmd.ProcessState.UserTime() + time.Duration(dockerCPU)*time.Second,
-		EndTime:  endTime,
-		Stdout:   finalStdOut,
-		Stderr:   finalStdErr,
-		Exited:   true,
+		Cwd:            actualCwd,
+		Exitcode:       exitcode,
+		PeakRAM:        peakmem,
+		PeakDisk:       peakdisk,
+		CPUtime:        cmd.ProcessState.SystemTime() + cmd.ProcessState.UserTime() + time.Duration(dockerCPU)*time.Second,
+		EndTime:        endTime,
+		Stdout:         finalStdOut,
+		Stderr:         finalStdErr,
+		Artifacts:      artifacts,
+		StepResults:    stepResults,
+		InputStats:     inputStats,
+		Exited:         true,
+		BehaviourTries: job.BehaviourTries,
 	}
 	for {
 		if time.Now().After(retryEnd) {
@@ -1337,8 +2342,16 @@ func (c *Client) Execute(job *Job, shell string) error {
 			c.Unlock()
 		}
 
-		// update the database with our final state
+		// tell the server anything it missed while we couldn't contact it,
+		// then update the database with our final state
+		err = updates.replay()
+		if err != nil && !lostContact(err) {
+			logger.Error("server rejected an update we had buffered", "err", err)
+			err = nil
+		}
 		switch {
+		case err != nil:
+			// we still can't contact the server; retry below
 		case dobury:
 			err = c.Bury(job, jes, failreason)
 		case dorelease:
@@ -1446,6 +2459,21 @@ func (c *Client) createLSFSymlinks(prependPath string, job *Job) error {
 // about it (use one of the Get methods afterwards to get a new object with the
 // HostID set if necessary).
 func (c *Client) Started(job *Job, pid int) error {
+	return c.StartedContext(context.Background(), job, pid)
+}
+
+// StartedContext is like Started(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) StartedContext(ctx context.Context, job *Job, pid int) error {
+	if err := c.prepareStarted(job, pid); err != nil {
+		return err
+	}
+	return c.sendStarted(ctx, job, false)
+}
+
+// prepareStarted is the part of StartedContext() that fills in job's host
+// details, pid and start time.
+func (c *Client) prepareStarted(job *Job, pid int) error {
 	// host details
 	host, err := os.Hostname()
 	if err != nil {
@@ -1461,7 +2489,17 @@ func (c *Client) Started(job *Job, pid int) error {
 	job.Pid = pid
 	job.Attempts++             // not considered by server, which does this itself - just for benefit of this process
 	job.StartTime = time.Now() // ditto
-	_, err = c.request(&clientRequest{Method: "jstart", Job: job})
+	return nil
+}
+
+// sendStarted is the part of StartedContext() that tells the server about the
+// details filled in by prepareStarted(). replayed says that we're only managing
+// to do this late, after losing contact with the server, so the server should
+// take the job's StartTime as when it really started.
+func (c *Client) sendStarted(ctx context.Context, job *Job, replayed bool) error {
+	job.RLock()
+	defer job.RUnlock()
+	_, err := c.requestContext(ctx, &clientRequest{Method: "jstart", Job: job, Replayed: replayed})
 	return err
 }
 
@@ -1470,17 +2508,35 @@ func (c *Client) Started(job *Job, pid int) error {
 // is true, you stop doing what you're doing and bury the job, since this means
 // that Kill() has been called for this job.
 func (c *Client) Touch(job *Job) (bool, error) {
-	c.teMutex.Lock()
-	defer c.teMutex.Unlock()
-	job.RLock()
-	defer job.RUnlock()
-	resp, err := c.request(&clientRequest{Method: "jtouch", Job: job})
+	return c.TouchContext(context.Background(), job)
+}
+
+// TouchContext is like Touch(), but stops waiting for the server and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) TouchContext(ctx context.Context, job *Job) (bool, error) {
+	resp, err := c.touch(ctx, job)
 	if err != nil {
 		return false, err
 	}
 	return resp.KillCalled, err
 }
 
+// touch is the implementation of TouchContext(), returning the server's whole
+// response, which also tells Execute() if the job was preempted.
+func (c *Client) touch(ctx context.Context, job *Job) (*serverResponse, error) {
+	c.teMutex.Lock()
+	defer c.teMutex.Unlock()
+	load, ramUsed, err := internal.HostLoad()
+	if err != nil {
+		c.Debug("could not get host load", "err", err)
+	}
+	job.RLock()
+	defer job.RUnlock()
+	cr := &clientRequest{Method: "jtouch", Job: job, Load: load, RAMUsed: ramUsed}
+	job.tailShip.pending(cr)
+	return c.requestContext(ctx, cr)
+}
+
 // JobEndState is used to describe the state of a job after it has (tried to)
 // execute it's Cmd. You supply these to Client.Bury(), Release() and Archive().
 // The cwd you supply should be the actual working directory used, which may be
@@ -1489,15 +2545,19 @@ func (c *Client) Touch(job *Job) (bool, error) {
 // tried to execute the Cmd, in which case you would just provide a nil
 // JobEndState to the methods that need one.
 type JobEndState struct {
-	Cwd      string
-	Exitcode int
-	PeakRAM  int
-	PeakDisk int64
-	CPUtime  time.Duration
-	EndTime  time.Time
-	Stdout   []byte
-	Stderr   []byte
-	Exited   bool
+	Cwd            string
+	Exitcode       int
+	PeakRAM        int
+	PeakDisk       int64
+	CPUtime        time.Duration
+	EndTime        time.Time
+	Stdout         []byte
+	Stderr         []byte
+	Artifacts      []*Artifact
+	StepResults    []*JobStep
+	InputStats     *InputCacheStats
+	Exited         bool
+	BehaviourTries int
 }
 
 // ended updates a Job for the benefit of the client only; this has no effect on
@@ -1515,8 +2575,13 @@ func (c *Client) ended(job *Job, jes *JobEndState) error {
 	job.Exitcode = jes.Exitcode
 	job.PeakRAM = jes.PeakRAM
 	job.PeakDisk = jes.PeakDisk
+	job.InputStats = jes.InputStats
 	job.CPUtime = jes.CPUtime
 	job.EndTime = jes.EndTime
+	if len(job.Steps) > 0 {
+		job.StepResults = jes.StepResults
+	}
+	job.BehaviourTries = jes.BehaviourTries
 	if jes.Cwd != "" {
 		job.ActualCwd = jes.Cwd
 	}
@@ -1541,6 +2606,12 @@ func (c *Client) ended(job *Job, jes *JobEndState) error {
 // have been the one to Reserve() the supplied Job, and the Job must be marked
 // as having successfully run, or you will get an error.
 func (c *Client) Archive(job *Job, jes *JobEndState) error {
+	return c.ArchiveContext(context.Background(), job, jes)
+}
+
+// ArchiveContext is like Archive(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) ArchiveContext(ctx context.Context, job *Job, jes *JobEndState) error {
 	err := c.ended(job, jes)
 	if err != nil {
 		return err
@@ -1549,7 +2620,7 @@ func (c *Client) Archive(job *Job, jes *JobEndState) error {
 	defer c.teMutex.Unlock()
 	job.RLock()
 	defer job.RUnlock()
-	_, err = c.request(&clientRequest{Method: "jarchive", Job: job, JobEndState: jes})
+	_, err = c.requestContext(ctx, &clientRequest{Method: "jarchive", Job: job, JobEndState: jes})
 	if err != nil {
 		return err
 	}
@@ -1565,6 +2636,12 @@ func (c *Client) Archive(job *Job, jes *JobEndState) error {
 // in a Bury(). (If the job's Cmd was not run, you can Release() an unlimited
 // number of times.)
 func (c *Client) Release(job *Job, jes *JobEndState, failreason string) error {
+	return c.ReleaseContext(context.Background(), job, jes, failreason)
+}
+
+// ReleaseContext is like Release(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) ReleaseContext(ctx context.Context, job *Job, jes *JobEndState, failreason string) error {
 	err := c.ended(job, jes)
 	if err != nil {
 		return err
@@ -1574,7 +2651,7 @@ func (c *Client) Release(job *Job, jes *JobEndState, failreason string) error {
 	job.Lock()
 	defer job.Unlock()
 	job.FailReason = failreason
-	_, err = c.request(&clientRequest{Method: "jrelease", Job: job, JobEndState: jes})
+	_, err = c.requestContext(ctx, &clientRequest{Method: "jrelease", Job: job, JobEndState: jes})
 	if err != nil {
 		return err
 	}
@@ -1596,6 +2673,12 @@ func (c *Client) Release(job *Job, jes *JobEndState, failreason string) error {
 // reserve a job before you can bury it. Optionally supply an error that will
 // be be displayed as the Job's stderr.
 func (c *Client) Bury(job *Job, jes *JobEndState, failreason string, stderr ...error) error {
+	return c.BuryContext(context.Background(), job, jes, failreason, stderr...)
+}
+
+// BuryContext is like Bury(), but stops waiting for the server and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) BuryContext(ctx context.Context, job *Job, jes *JobEndState, failreason string, stderr ...error) error {
 	err := c.ended(job, jes)
 	if err != nil {
 		return err
@@ -1611,7 +2694,7 @@ func (c *Client) Bury(job *Job, jes *JobEndState, failreason string, stderr ...e
 			return err
 		}
 	}
-	_, err = c.request(&clientRequest{Method: "jbury", Job: job, JobEndState: jes})
+	_, err = c.requestContext(ctx, &clientRequest{Method: "jbury", Job: job, JobEndState: jes})
 	if err != nil {
 		return err
 	}
@@ -1621,10 +2704,34 @@ func (c *Client) Bury(job *Job, jes *JobEndState, failreason string, stderr ...e
 
 // Kick makes previously Bury()'d jobs runnable again (it can be Reserve()d in
 // the future). It returns a count of jobs that it actually kicked. Errors will
-// only be related to not being able to contact the server.
+// only be related to not being able to contact the server. Any RetryOverrides
+// the jobs had from an earlier KickWithOverrides() are removed.
 func (c *Client) Kick(jes []*JobEssence) (int, error) {
+	return c.KickContext(context.Background(), jes)
+}
+
+// KickContext is like Kick(), but stops waiting for the server and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) KickContext(ctx context.Context, jes []*JobEssence) (int, error) {
+	return c.KickWithOverridesContext(ctx, jes, nil)
+}
+
+// KickWithOverrides is like Kick(), but the retried jobs will be run with the
+// given RetryOverrides (eg. extra environment variables to turn on debugging),
+// on this and any subsequent attempt, until they are next Kick()ed. Nil
+// overrides are the same as Kick(). Errors can also be due to the overrides
+// being invalid.
+func (c *Client) KickWithOverrides(jes []*JobEssence, overrides *RetryOverrides) (int, error) {
+	return c.KickWithOverridesContext(context.Background(), jes, overrides)
+}
+
+// KickWithOverridesContext is like KickWithOverrides(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) KickWithOverridesContext(ctx context.Context, jes []*JobEssence, overrides *RetryOverrides) (int, error) {
 	keys := c.jesToKeys(jes)
-	resp, err := c.request(&clientRequest{Method: "jkick", Keys: keys})
+	user, _ := internal.Username() // #nosec only used to note who kicked the jobs in their histories
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "jkick", Keys: keys, RetryOverrides: overrides, User: user})
 	if err != nil {
 		return 0, err
 	}
@@ -1636,14 +2743,82 @@ func (c *Client) Kick(jes []*JobEssence) (int, error) {
 // can never be fixed. It returns a count of jobs that it actually removed.
 // Errors will only be related to not being able to contact the server.
 func (c *Client) Delete(jes []*JobEssence) (int, error) {
+	return c.DeleteContext(context.Background(), jes)
+}
+
+// DeleteContext is like Delete(), but stops waiting for the server and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) DeleteContext(ctx context.Context, jes []*JobEssence) (int, error) {
 	keys := c.jesToKeys(jes)
-	resp, err := c.request(&clientRequest{Method: "jdel", Keys: keys})
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "jdel", Keys: keys})
 	if err != nil {
 		return 0, err
 	}
 	return resp.Existed, err
 }
 
+// DeleteInBackground is like Delete(), but instead of waiting for the jobs to
+// be removed, the server removes them in the background, in batches, and you
+// get back a BulkRemoval describing the removal. Use its ID with
+// GetBulkRemovals() to follow its progress, or with CancelBulkRemoval() to stop
+// it. If the server is restarted before the removal is complete, it carries
+// on once the server is running again.
+//
+// This is better than Delete() for removing very many jobs, which could
+// otherwise take longer than you're willing to wait for a reply.
+func (c *Client) DeleteInBackground(jes []*JobEssence) (*BulkRemoval, error) {
+	return c.DeleteInBackgroundContext(context.Background(), jes)
+}
+
+// DeleteInBackgroundContext is like DeleteInBackground(), but stops waiting
+// for the server and returns ctx.Err() if ctx is cancelled or reaches its
+// deadline first.
+func (c *Client) DeleteInBackgroundContext(ctx context.Context, jes []*JobEssence) (*BulkRemoval, error) {
+	keys := c.jesToKeys(jes)
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "jdelbg", Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Removals) != 1 {
+		return nil, Error{"DeleteInBackground", "", ErrInternalError}
+	}
+	return resp.Removals[0], err
+}
+
+// GetBulkRemovals returns descriptions of the removals started by
+// DeleteInBackground() that are still running, along with those that finished
+// in the last hour (ServerBulkRemovalExpiry), oldest first.
+func (c *Client) GetBulkRemovals() ([]*BulkRemoval, error) {
+	return c.GetBulkRemovalsContext(context.Background())
+}
+
+// GetBulkRemovalsContext is like GetBulkRemovals(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetBulkRemovalsContext(ctx context.Context) ([]*BulkRemoval, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getbulkrm"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Removals, err
+}
+
+// CancelBulkRemoval stops the removal with the given ID, as started by
+// DeleteInBackground(), once it finishes removing its current batch of jobs.
+// Jobs that were already removed are not restored. Returns an error matching
+// ErrorNoBulkRemoval if the server doesn't know about a removal with that ID.
+func (c *Client) CancelBulkRemoval(id string) error {
+	return c.CancelBulkRemovalContext(context.Background(), id)
+}
+
+// CancelBulkRemovalContext is like CancelBulkRemoval(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) CancelBulkRemovalContext(ctx context.Context, id string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "cancelbulkrm", BulkRemovalID: id})
+	return err
+}
+
 // Kill will cause the next Touch() call for the job(s) described by the input
 // to return a kill signal. Touches happening as part of an Execute() will
 // respond to this signal by terminating their execution and burying the job. As
@@ -1655,8 +2830,14 @@ func (c *Client) Delete(jes []*JobEssence) (int, error) {
 // running state). Errors will only be related to not being able to contact the
 // server.
 func (c *Client) Kill(jes []*JobEssence) (int, error) {
+	return c.KillContext(context.Background(), jes)
+}
+
+// KillContext is like Kill(), but stops waiting for the server and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) KillContext(ctx context.Context, jes []*JobEssence) (int, error) {
 	keys := c.jesToKeys(jes)
-	resp, err := c.request(&clientRequest{Method: "jkill", Keys: keys})
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "jkill", Keys: keys})
 	if err != nil {
 		return 0, err
 	}
@@ -1668,7 +2849,13 @@ func (c *Client) Kill(jes []*JobEssence) (int, error) {
 // StdErr() will work on, and one of 2 ways that Env() will work (the other
 // being Reserve()).
 func (c *Client) GetByEssence(je *JobEssence, getstd bool, getenv bool) (*Job, error) {
-	resp, err := c.request(&clientRequest{Method: "getbc", Keys: []string{je.Key()}, GetStd: getstd, GetEnv: getenv})
+	return c.GetByEssenceContext(context.Background(), je, getstd, getenv)
+}
+
+// GetByEssenceContext is like GetByEssence(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetByEssenceContext(ctx context.Context, je *JobEssence, getstd bool, getenv bool) (*Job, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getbc", Keys: c.jesToKeys([]*JobEssence{je}), GetStd: getstd, GetEnv: getenv})
 	if err != nil {
 		return nil, err
 	}
@@ -1682,8 +2869,15 @@ func (c *Client) GetByEssence(je *JobEssence, getstd bool, getenv bool) (*Job, e
 // GetByEssences gets multiple Jobs at once given JobEssences that describe
 // them.
 func (c *Client) GetByEssences(jes []*JobEssence) ([]*Job, error) {
+	return c.GetByEssencesContext(context.Background(), jes)
+}
+
+// GetByEssencesContext is like GetByEssences(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetByEssencesContext(ctx context.Context, jes []*JobEssence) ([]*Job, error) {
 	keys := c.jesToKeys(jes)
-	resp, err := c.request(&clientRequest{Method: "getbc", Keys: keys})
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getbc", Keys: keys})
 	if err != nil {
 		return nil, err
 	}
@@ -1691,10 +2885,15 @@ func (c *Client) GetByEssences(jes []*JobEssence) ([]*Job, error) {
 }
 
 // jesToKeys deals with the jes arg that GetByEccences(), Kick() and Delete()
-// take.
+// take, giving the keys of the jobs in our namespace.
 func (c *Client) jesToKeys(jes []*JobEssence) []string {
 	keys := make([]string, 0, len(jes))
 	for _, je := range jes {
+		if c.namespace != "" && je.JobKey == "" && je.Namespace == "" {
+			nsje := *je
+			nsje.Namespace = c.namespace
+			je = &nsje
+		}
 		keys = append(keys, je.Key())
 	}
 	return keys
@@ -1715,76 +2914,888 @@ func (c *Client) jesToKeys(jes []*JobEssence) []string {
 // Providing 'state' only returns jobs in that State. 'getStd' and 'getEnv', if
 // true, retrieve the stdout, stderr and environement variables for the Jobs.
 func (c *Client) GetByRepGroup(repgroup string, subStr bool, limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
-	resp, err := c.request(&clientRequest{Method: "getbr", Job: &Job{RepGroup: repgroup}, Search: subStr, Limit: limit, State: state, GetStd: getStd, GetEnv: getEnv})
+	return c.GetByRepGroupContext(context.Background(), repgroup, subStr, limit, state, getStd, getEnv)
+}
+
+// GetByRepGroupContext is like GetByRepGroup(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetByRepGroupContext(ctx context.Context, repgroup string, subStr bool, limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getbr", Job: &Job{RepGroup: repgroup}, Search: subStr, Limit: limit, State: state, GetStd: getStd, GetEnv: getEnv})
 	if err != nil {
 		return nil, err
 	}
 	return resp.Jobs, err
 }
 
-// GetIncomplete gets all Jobs that are currently in the jobqueue, ie. excluding
-// those that are complete and have been Archive()d. The args are as in
-// GetByRepGroup().
-func (c *Client) GetIncomplete(limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
-	resp, err := c.request(&clientRequest{Method: "getin", Limit: limit, State: state, GetStd: getStd, GetEnv: getEnv})
+// GetByRepGroupMatching is like GetByRepGroup(), but gets Jobs in all the
+// RepGroups that the given pattern matches, treating it as a glob or regular
+// expression according to 'match'. Both current RepGroups and those of
+// complete Jobs are considered, and Jobs in more than one matching RepGroup are
+// only returned once.
+func (c *Client) GetByRepGroupMatching(pattern string, match RepGroupMatch, limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
+	return c.GetByRepGroupMatchingContext(context.Background(), pattern, match, limit, state, getStd, getEnv)
+}
+
+// GetByRepGroupMatchingContext is like GetByRepGroupMatching(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) GetByRepGroupMatchingContext(ctx context.Context, pattern string, match RepGroupMatch, limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getbr", Job: &Job{RepGroup: pattern}, RepGroupMatch: match, Limit: limit, State: state, GetStd: getStd, GetEnv: getEnv})
 	if err != nil {
 		return nil, err
 	}
 	return resp.Jobs, err
 }
 
-// GetOrSetLimitGroup takes the name of a limit group and returns the current
-// limit for that group. If the group isn't known about, returns -1.
+// GetFailureClusters gets the jobs that have been buried because they failed
+// more times than their Retries allowed, grouped in to clusters of jobs that
+// failed in the same way (same FailReason and exit code, and similar STDERR),
+// largest cluster first. If repgroup is supplied, only buried jobs in that
+// RepGroup are considered, with subStr behaving as for GetByRepGroup().
 //
-// If the name is suffixed with :n, where n is an integer, then the limit of
-// the group is set to n, and then n is returned. Setting n to -1 makes the
-// group forgotten about, effectively making it unlimited.
-func (c *Client) GetOrSetLimitGroup(group string) (int, error) {
-	resp, err := c.request(&clientRequest{Method: "getsetlg", LimitGroup: group})
-	if err != nil {
-		return -1, err
-	}
-	return resp.Limit, err
+// You can Kick() the Keys of a cluster to retry all its jobs, eg. after fixing
+// whatever caused the failure.
+func (c *Client) GetFailureClusters(repgroup string, subStr bool) ([]*FailureCluster, error) {
+	return c.GetFailureClustersContext(context.Background(), repgroup, subStr)
 }
 
-// UploadFile uploads a local file to the machine where the server is running,
-// so you can add cloud jobs that need a script or config file on your local
-// machine to be copied over to created cloud instances.
-//
-// If the remote path is supplied as a blank string, the remote path will be
-// chosen for you based on the MD5 checksum of your file data, rooted in the
-// server's configured UploadDir.
-//
-// The remote path can be supplied prefixed with ~/ to upload relative to the
-// remote's home directory. Otherwise it should be an absolute path.
-//
-// Returns the absolute path of the uploaded file on the server's machine.
-//
-// NB: This is only suitable for transferring small files!
-func (c *Client) UploadFile(local, remote string) (string, error) {
-	compressed, err := compressFile(local)
-	if err != nil {
-		return "", err
+// GetFailureClustersContext is like GetFailureClusters(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetFailureClustersContext(ctx context.Context, repgroup string, subStr bool) ([]*FailureCluster, error) {
+	cr := &clientRequest{Method: "getfails", Search: subStr}
+	if repgroup != "" {
+		cr.Job = &Job{RepGroup: repgroup}
 	}
-	resp, err := c.request(&clientRequest{Method: "upload", File: compressed, Path: remote})
+	resp, err := c.requestContext(ctx, cr)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return resp.Path, err
+	return resp.Clusters, err
 }
 
-// GetBadCloudServers (if the server is running with a cloud scheduler) returns
-// servers that are currently non-responsive and might be dead.
-func (c *Client) GetBadCloudServers() ([]*BadServer, error) {
-	resp, err := c.request(&clientRequest{Method: "getbcs"})
+// GetFailureSummaries is like GetFailureClusters(), but the returned clusters
+// don't have their Keys populated, so this is much cheaper when there are very
+// many buried jobs and you only want to triage them, eg. by printing each
+// cluster's Summary ("8214 jobs failed with: No space left on device") and
+// ExampleStdErr.
+func (c *Client) GetFailureSummaries(repgroup string, subStr bool) ([]*FailureCluster, error) {
+	return c.GetFailureSummariesContext(context.Background(), repgroup, subStr)
+}
+
+// GetFailureSummariesContext is like GetFailureSummaries(), but stops waiting
+// for the server and returns ctx.Err() if ctx is cancelled or reaches its
+// deadline first.
+func (c *Client) GetFailureSummariesContext(ctx context.Context, repgroup string, subStr bool) ([]*FailureCluster, error) {
+	cr := &clientRequest{Method: "getfailsum", Search: subStr}
+	if repgroup != "" {
+		cr.Job = &Job{RepGroup: repgroup}
+	}
+	resp, err := c.requestContext(ctx, cr)
 	if err != nil {
 		return nil, err
 	}
-	return resp.BadServers, err
+	return resp.Clusters, err
 }
 
-// ConfirmCloudServersDead will confirm that currently non-responsive cloud
-// servers (that would be returned by GetBadCloudServers()) are dead, triggering
+// CreateEnrolmentToken creates a one-time token, valid for the given duration,
+// that a new host can use to enrol with the server by calling Enrol() (or
+// running `wr enrol join`). The server must have enrolment enabled (see
+// ServerConfig.EnrolCAFile). Tokens are only remembered until the server
+// stops.
+func (c *Client) CreateEnrolmentToken(ttl time.Duration) (string, error) {
+	return c.CreateEnrolmentTokenContext(context.Background(), ttl)
+}
+
+// CreateEnrolmentTokenContext is like CreateEnrolmentToken(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) CreateEnrolmentTokenContext(ctx context.Context, ttl time.Duration) (string, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "enroltoken", Timeout: ttl})
+	if err != nil {
+		return "", err
+	}
+	return resp.EnrolToken, err
+}
+
+// GetEnrolledHosts gets the server's inventory of enrolled hosts, oldest
+// first, including those whose enrolment has been revoked.
+func (c *Client) GetEnrolledHosts() ([]*EnrolledHost, error) {
+	return c.GetEnrolledHostsContext(context.Background())
+}
+
+// GetEnrolledHostsContext is like GetEnrolledHosts(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetEnrolledHostsContext(ctx context.Context) ([]*EnrolledHost, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getenrolled"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Enrolled, err
+}
+
+// RevokeEnrolment makes the server stop accepting the client certificates of
+// enrolled hosts with the given name or certificate serial. It returns the
+// number of enrolments revoked.
+func (c *Client) RevokeEnrolment(nameOrSerial string) (int, error) {
+	return c.RevokeEnrolmentContext(context.Background(), nameOrSerial)
+}
+
+// RevokeEnrolmentContext is like RevokeEnrolment(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) RevokeEnrolmentContext(ctx context.Context, nameOrSerial string) (int, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "revokeenrol", Host: nameOrSerial})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
+
+// GetUtilisation gets the snapshots of queue depths, running jobs and
+// provisioned capacity that the server records every ServerUtilisationInterval
+// (keeping them for ServerUtilisationRetention), that were taken between from
+// and to, oldest first. A zero to means now. If step is greater than 0, only the
+// last snapshot in each step-long period is returned, so you can get a
+// manageable number of data points to chart over long time ranges.
+func (c *Client) GetUtilisation(from, to time.Time, step time.Duration) ([]*UtilisationSnapshot, error) {
+	return c.GetUtilisationContext(context.Background(), from, to, step)
+}
+
+// GetUtilisationContext is like GetUtilisation(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetUtilisationContext(ctx context.Context, from, to time.Time, step time.Duration) ([]*UtilisationSnapshot, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getutil", From: from, To: to, Step: step})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Utilisation, err
+}
+
+// SetPolicy creates the given Policy, or replaces the one with the same Name.
+// Changes apply immediately to the jobs of the RepGroups the policy is
+// assigned to, including those already added.
+//
+// An invalid policy (such as one without a Name) results in an Error with Err
+// ErrBadPolicy.
+func (c *Client) SetPolicy(policy *Policy) error {
+	return c.SetPolicyContext(context.Background(), policy)
+}
+
+// SetPolicyContext is like SetPolicy(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) SetPolicyContext(ctx context.Context, policy *Policy) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "setpolicy", Policy: policy})
+	return err
+}
+
+// DeletePolicy forgets the Policy with the given name, unassigning it from
+// any RepGroups it was assigned to. If there's no such policy, you get an Error
+// with Err ErrUnknownPolicy.
+func (c *Client) DeletePolicy(name string) error {
+	return c.DeletePolicyContext(context.Background(), name)
+}
+
+// DeletePolicyContext is like DeletePolicy(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) DeletePolicyContext(ctx context.Context, name string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "delpolicy", Policy: &Policy{Name: name}})
+	return err
+}
+
+// SetRepGroupPolicy assigns the Policy with the given name to the given
+// RepGroup, replacing any previously assigned. Supply a blank name to
+// unassign it. (You can also assign policies by setting the Policy of jobs you
+// Add().) If there's no such policy, you get an Error with Err
+// ErrUnknownPolicy.
+func (c *Client) SetRepGroupPolicy(repgroup, name string) error {
+	return c.SetRepGroupPolicyContext(context.Background(), repgroup, name)
+}
+
+// SetRepGroupPolicyContext is like SetRepGroupPolicy(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) SetRepGroupPolicyContext(ctx context.Context, repgroup, name string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "rgpolicy", Job: &Job{RepGroup: repgroup, Policy: name}})
+	return err
+}
+
+// GetPolicies gets all the Policies that have been set, along with the names
+// of the policies assigned to RepGroups, keyed on RepGroup.
+func (c *Client) GetPolicies() ([]*Policy, map[string]string, error) {
+	return c.GetPoliciesContext(context.Background())
+}
+
+// GetPoliciesContext is like GetPolicies(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetPoliciesContext(ctx context.Context) ([]*Policy, map[string]string, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getpolicies"})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Policies, resp.RGPolicies, err
+}
+
+// SetQueueConfig configures the named queue QueueConfig.Name (the namespace
+// that clients using SetNamespace() with that name add their jobs in),
+// replacing any previous configuration. Jobs added to the queue from now on
+// will be subject to its Limit and given its SchedulerOptions.
+//
+// An invalid config (such as one with a Name that isn't a valid namespace)
+// results in an Error with Err ErrBadQueue.
+func (c *Client) SetQueueConfig(qc *QueueConfig) error {
+	return c.SetQueueConfigContext(context.Background(), qc)
+}
+
+// SetQueueConfigContext is like SetQueueConfig(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) SetQueueConfigContext(ctx context.Context, qc *QueueConfig) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "setqueue", Queue: qc})
+	return err
+}
+
+// DeleteQueueConfig forgets the configuration of the named queue, removing its
+// Limit. Its jobs are not affected. If the queue was not configured, you get
+// an Error with Err ErrUnknownQueue.
+func (c *Client) DeleteQueueConfig(name string) error {
+	return c.DeleteQueueConfigContext(context.Background(), name)
+}
+
+// DeleteQueueConfigContext is like DeleteQueueConfig(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) DeleteQueueConfigContext(ctx context.Context, name string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "delqueue", Queue: &QueueConfig{Name: name}})
+	return err
+}
+
+// GetQueues returns details of every named queue that has been configured or
+// currently has jobs that are ready to run or running, sorted by name. If this
+// client has had SetNamespace() called, only details of that queue are
+// returned.
+func (c *Client) GetQueues() ([]*QueueInfo, error) {
+	return c.GetQueuesContext(context.Background())
+}
+
+// GetQueuesContext is like GetQueues(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetQueuesContext(ctx context.Context) ([]*QueueInfo, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getqueues"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Queues, err
+}
+
+// SetTriageRules replaces the server's TriageRules with the given ones, which
+// are checked in order against every job that gets buried from now on; the
+// first that matches is applied to the job. Supply no rules to stop triaging
+// buried jobs.
+//
+// Invalid rules (such as ones with an unknown Action, or that share a Name)
+// result in an Error with Err ErrBadTriageRule, and the existing rules are
+// kept.
+func (c *Client) SetTriageRules(rules []*TriageRule) error {
+	return c.SetTriageRulesContext(context.Background(), rules)
+}
+
+// SetTriageRulesContext is like SetTriageRules(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) SetTriageRulesContext(ctx context.Context, rules []*TriageRule) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "settriage", TriageRules: rules})
+	return err
+}
+
+// GetTriageRules returns the server's TriageRules in the order they are
+// checked, along with how many buried jobs each has been applied to since the
+// server started.
+func (c *Client) GetTriageRules() ([]*TriageRuleInfo, error) {
+	return c.GetTriageRulesContext(context.Background())
+}
+
+// GetTriageRulesContext is like GetTriageRules(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetTriageRulesContext(ctx context.Context) ([]*TriageRuleInfo, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "gettriage"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.TriageRules, err
+}
+
+// GetRepGroupStates gets, in a single request, the number of jobs in each
+// state for each of the given RepGroups, including complete jobs. The counting
+// is done by the server, so this is much faster than calling GetByRepGroup()
+// for each RepGroup if you only need the counts.
+//
+// Supplied RepGroups can contain glob wildcards as understood by
+// filepath.Match(), eg. "project1.*", in which case you get counts for all the
+// RepGroups that match.
+//
+// The returned map is keyed on RepGroup, with values keyed on JobState. Only
+// states with at least 1 job are present.
+func (c *Client) GetRepGroupStates(repGroups []string) (map[string]map[JobState]int, error) {
+	return c.GetRepGroupStatesContext(context.Background(), repGroups)
+}
+
+// GetRepGroupStatesContext is like GetRepGroupStates(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetRepGroupStatesContext(ctx context.Context, repGroups []string) (map[string]map[JobState]int, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getrgs", RepGroups: repGroups})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]map[JobState]int)
+	for _, rgs := range resp.RGStates {
+		states, exists := counts[rgs.RepGroup]
+		if !exists {
+			states = make(map[JobState]int)
+			counts[rgs.RepGroup] = states
+		}
+		if rgs.State != "" {
+			states[rgs.State] = rgs.Count
+		}
+	}
+	return counts, err
+}
+
+// GetRepGroupRecommendation tells you the resource requirements that have been
+// learned from previously run jobs with the given RepGroup, and whether these
+// are automatically applied to the RepGroup's incomplete jobs. (They are
+// applied according to each job's Override, so jobs with an Override of 2 are
+// never affected.)
+func (c *Client) GetRepGroupRecommendation(repgroup string) (*RepGroupRecommendation, error) {
+	return c.GetRepGroupRecommendationContext(context.Background(), repgroup)
+}
+
+// GetRepGroupRecommendationContext is like GetRepGroupRecommendation(), but
+// stops waiting for the server and returns ctx.Err() if ctx is cancelled or
+// reaches its deadline first.
+func (c *Client) GetRepGroupRecommendationContext(ctx context.Context, repgroup string) (*RepGroupRecommendation, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getrgrec", Job: &Job{RepGroup: repgroup}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.RGRec, err
+}
+
+// SetRepGroupAutoApply lets you opt the given RepGroup out of (or back in to)
+// having its learned resource recommendation automatically applied to its
+// incomplete jobs.
+func (c *Client) SetRepGroupAutoApply(repgroup string, apply bool) error {
+	return c.SetRepGroupAutoApplyContext(context.Background(), repgroup, apply)
+}
+
+// SetRepGroupAutoApplyContext is like SetRepGroupAutoApply(), but stops waiting
+// for the server and returns ctx.Err() if ctx is cancelled or reaches its
+// deadline first.
+func (c *Client) SetRepGroupAutoApplyContext(ctx context.Context, repgroup string, apply bool) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "rgauto", Job: &Job{RepGroup: repgroup}, AutoApply: apply})
+	return err
+}
+
+// SetRepGroupRunWindow restricts the times at which jobs with the given
+// RepGroup can start running (unless they have their own Job.RunWindow). Jobs
+// outside of their window are held in the delayed state, and no runners are
+// scheduled for them. Supply a blank window to remove the restriction.
+//
+// A window is made up of one or more periods separated by semi-colons. Each
+// period has days and/or a time range, separated by a space, eg. "weekdays
+// 18:00-08:00; weekends" to only run outside of office hours. Days are a comma
+// separated list of day names ("mon" or "monday" etc.) and ranges of them (like
+// "mon-fri"), or the words "weekdays" or "weekends"; if not given, the period
+// applies every day. The time range is in the form HH:MM-HH:MM, in the
+// server's local time zone; if the end is not after the start, the range
+// continues in to the next day. If not given, the period lasts all day.
+//
+// An invalid window results in an Error with Err ErrBadRunWindow.
+func (c *Client) SetRepGroupRunWindow(repgroup string, window string) error {
+	return c.SetRepGroupRunWindowContext(context.Background(), repgroup, window)
+}
+
+// SetRepGroupRunWindowContext is like SetRepGroupRunWindow(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) SetRepGroupRunWindowContext(ctx context.Context, repgroup string, window string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "rgwin", Job: &Job{RepGroup: repgroup, RunWindow: window}})
+	return err
+}
+
+// ExcludeHosts stops any more jobs from running on the hosts with the given
+// names (as reported by Job.Host, eg. LSF execution hosts or cloud servers).
+// The capacity of these hosts will no longer be used when scheduling runners,
+// runners on them will not be given any more jobs, and jobs currently running
+// on them will be killed (after being sent a SIGTERM, and given
+// ServerExcludedHostGrace to exit) and become ready to run again elsewhere,
+// without counting against their Retries. Exclusions are remembered until you
+// call IncludeHosts().
+func (c *Client) ExcludeHosts(hosts ...string) error {
+	return c.ExcludeHostsContext(context.Background(), hosts...)
+}
+
+// ExcludeHostsContext is like ExcludeHosts(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) ExcludeHostsContext(ctx context.Context, hosts ...string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "exhosts", Hosts: hosts})
+	return err
+}
+
+// IncludeHosts undoes ExcludeHosts() for the hosts with the given names, so
+// that they can be used to run jobs again.
+func (c *Client) IncludeHosts(hosts ...string) error {
+	return c.IncludeHostsContext(context.Background(), hosts...)
+}
+
+// IncludeHostsContext is like IncludeHosts(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) IncludeHostsContext(ctx context.Context, hosts ...string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "inhosts", Hosts: hosts})
+	return err
+}
+
+// GetExcludedHosts returns the sorted names of the hosts that have been
+// excluded with ExcludeHosts().
+func (c *Client) GetExcludedHosts() ([]string, error) {
+	return c.GetExcludedHostsContext(context.Background())
+}
+
+// GetExcludedHostsContext is like GetExcludedHosts(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetExcludedHostsContext(ctx context.Context) ([]string, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "gethosts"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Hosts, err
+}
+
+// GetReservationTimeouts returns details of the hosts whose runners reserved
+// jobs but failed to start running them within the server's
+// ServerConfig.ReservationTimeout, sorted by host name.
+func (c *Client) GetReservationTimeouts() ([]*ReservationTimeout, error) {
+	return c.GetReservationTimeoutsContext(context.Background())
+}
+
+// GetReservationTimeoutsContext is like GetReservationTimeouts(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) GetReservationTimeoutsContext(ctx context.Context) ([]*ReservationTimeout, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getrestimeouts"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.ResTimeouts, err
+}
+
+// SetRepGroupFailRules sets rules for how failed jobs with the given RepGroup
+// should be treated, based on their exit code and STDERR, replacing any rules
+// previously set for the RepGroup. Supply no rules to remove them.
+//
+// When a job fails (but not when it is buried immediately, eg. because its
+// command could not be found), the first rule that matches is applied: its
+// FailReason replaces the job's, so that failures of your own tools get grouped
+// meaningfully (eg. in the web interface), and its retry policy determines
+// whether the job is buried, retried without that counting against its
+// Retries, and/or retried with more RAM. For example, a rule with an Exitcode
+// of 137, a FailReason of "OOM" and a RAMMultiplier of 2 would retry jobs that
+// were killed for using too much memory with twice the RAM.
+//
+// An invalid rule (such as one with a StdErr that isn't a valid regular
+// expression) results in an Error with Err ErrBadFailRule.
+func (c *Client) SetRepGroupFailRules(repgroup string, rules ...*FailRule) error {
+	return c.SetRepGroupFailRulesContext(context.Background(), repgroup, rules...)
+}
+
+// SetRepGroupFailRulesContext is like SetRepGroupFailRules(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) SetRepGroupFailRulesContext(ctx context.Context, repgroup string, rules ...*FailRule) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "rgfail", Job: &Job{RepGroup: repgroup}, FailRules: rules})
+	return err
+}
+
+// SetRepGroupHostFailurePolicy sets what should happen to jobs with the given
+// RepGroup that were running on a host that failed, replacing any policy
+// previously set for the RepGroup. Supply a nil policy to remove it, reverting
+// to the default behaviour of treating the jobs like any other failure.
+//
+// The policy applies once the jobs are confirmed dead: when the cloud server
+// they were running on is confirmed bad (manually, or automatically after the
+// server's AutoConfirmDead time), or when you Kill() jobs that the server has
+// lost contact with because their runner's host died. Jobs can be requeued
+// immediately or after a delay without that counting against their Retries,
+// or held (buried) until you have checked it is safe to Kick() them.
+//
+// An invalid policy (such as a HostFailureDelay one without a Delay) results
+// in an Error with Err ErrBadHostFailure.
+func (c *Client) SetRepGroupHostFailurePolicy(repgroup string, policy *HostFailurePolicy) error {
+	return c.SetRepGroupHostFailurePolicyContext(context.Background(), repgroup, policy)
+}
+
+// SetRepGroupHostFailurePolicyContext is like SetRepGroupHostFailurePolicy(),
+// but stops waiting for the server and returns ctx.Err() if ctx is cancelled
+// or reaches its deadline first.
+func (c *Client) SetRepGroupHostFailurePolicyContext(ctx context.Context, repgroup string, policy *HostFailurePolicy) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "rghostfail", Job: &Job{RepGroup: repgroup}, HostFailurePolicy: policy})
+	return err
+}
+
+// SetRepGroupStartRate limits how many jobs with the given RepGroup can start
+// running per minute, on top of any overall limit the server was configured
+// with. Jobs that can't start yet are held in the delayed state, and no runners
+// are scheduled for them. Supply a max of 0 to remove the limit.
+func (c *Client) SetRepGroupStartRate(repgroup string, max int) error {
+	return c.SetRepGroupStartRateContext(context.Background(), repgroup, max)
+}
+
+// SetRepGroupStartRateContext is like SetRepGroupStartRate(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) SetRepGroupStartRateContext(ctx context.Context, repgroup string, max int) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "rgrate", Job: &Job{RepGroup: repgroup}, Limit: max})
+	return err
+}
+
+// GetIncomplete gets all Jobs that are currently in the jobqueue, ie. excluding
+// those that are complete and have been Archive()d. The args are as in
+// GetByRepGroup().
+func (c *Client) GetIncomplete(limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
+	return c.GetIncompleteContext(context.Background(), limit, state, getStd, getEnv)
+}
+
+// GetIncompleteContext is like GetIncomplete(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetIncompleteContext(ctx context.Context, limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getin", Limit: limit, State: state, GetStd: getStd, GetEnv: getEnv})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, err
+}
+
+// JobOutcome describes how a job that WaitForJobs() or WaitForRepGroup()
+// waited on ended up.
+type JobOutcome struct {
+	Key   string
+	State JobState // one of JobStateComplete, JobStateBuried or JobStateDeleted
+	Job   *Job     // nil if the job was deleted
+}
+
+// WaitForJobs blocks until all the jobs with the given essences are complete,
+// buried or deleted, then returns their outcomes in the same order as the
+// supplied essences.
+//
+// The server tells us as soon as jobs get buried or removed from the queue, so
+// this does not poll. To wait for less than forever, use WaitForJobsContext().
+func (c *Client) WaitForJobs(jes []*JobEssence) ([]*JobOutcome, error) {
+	return c.WaitForJobsContext(context.Background(), jes)
+}
+
+// WaitForJobsContext is like WaitForJobs(), but stops waiting and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) WaitForJobsContext(ctx context.Context, jes []*JobEssence) ([]*JobOutcome, error) {
+	keys := c.jesToKeys(jes)
+	return c.waitForJobs(ctx, &clientRequest{Method: "waitjobs", Keys: keys}, keys)
+}
+
+// WaitForRepGroup is like WaitForJobs(), but waits on all the jobs with the
+// given RepGroup. Since deleted jobs can't be found by RepGroup, the returned
+// outcomes will only be for complete and buried jobs.
+func (c *Client) WaitForRepGroup(repgroup string) ([]*JobOutcome, error) {
+	return c.WaitForRepGroupContext(context.Background(), repgroup)
+}
+
+// WaitForRepGroupContext is like WaitForRepGroup(), but stops waiting and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) WaitForRepGroupContext(ctx context.Context, repgroup string) ([]*JobOutcome, error) {
+	return c.waitForJobs(ctx, &clientRequest{Method: "waitjobs", Job: &Job{RepGroup: repgroup}}, nil)
+}
+
+// waitForJobs repeatedly sends the given "waitjobs" request until all the jobs
+// the server returns are in a terminal state. If keys are supplied, keys the
+// server didn't return jobs for are treated as deleted.
+func (c *Client) waitForJobs(ctx context.Context, cr *clientRequest, keys []string) ([]*JobOutcome, error) {
+	for {
+		// the server gives up waiting after cr.Timeout, which we keep well
+		// below the time we're prepared to wait for any response
+		cr.Timeout = c.timeout / 2
+		if deadline, ok := ctx.Deadline(); ok {
+			if until := time.Until(deadline); until < cr.Timeout {
+				cr.Timeout = until
+			}
+		}
+
+		resp, err := c.requestContext(ctx, cr)
+		if err != nil {
+			return nil, err
+		}
+
+		if outcomes, done := jobOutcomes(resp.Jobs, keys); done {
+			return outcomes, nil
+		}
+
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// jobOutcomes converts the given jobs to JobOutcomes, ordered as per keys if
+// supplied, and also says if all of them are complete, buried or deleted.
+func jobOutcomes(jobs []*Job, keys []string) ([]*JobOutcome, bool) {
+	done := true
+	outcome := func(key string, job *Job) *JobOutcome {
+		if job == nil {
+			return &JobOutcome{Key: key, State: JobStateDeleted}
+		}
+		if job.State != JobStateComplete && job.State != JobStateBuried {
+			done = false
+		}
+		return &JobOutcome{Key: key, State: job.State, Job: job}
+	}
+
+	if len(keys) == 0 {
+		outcomes := make([]*JobOutcome, 0, len(jobs))
+		for _, job := range jobs {
+			outcomes = append(outcomes, outcome(job.Key(), job))
+		}
+		return outcomes, done
+	}
+
+	byKey := make(map[string]*Job, len(jobs))
+	for _, job := range jobs {
+		byKey[job.Key()] = job
+	}
+	outcomes := make([]*JobOutcome, 0, len(keys))
+	for _, key := range keys {
+		outcomes = append(outcomes, outcome(key, byKey[key]))
+	}
+	return outcomes, done
+}
+
+// WaitSummary aggregates the JobOutcomes of jobs that were waited on, in a form
+// suitable for JSON encoding.
+type WaitSummary struct {
+	RepGroup string `json:",omitempty"` // set when the jobs were waited on by RepGroup
+	Complete int
+	Buried   int
+	Deleted  int
+
+	// Failed details the jobs that were buried or deleted.
+	Failed []*WaitFailure `json:",omitempty"`
+}
+
+// WaitFailure describes a job in a WaitSummary that did not complete.
+type WaitFailure struct {
+	Key        string
+	State      JobState
+	Cmd        string `json:",omitempty"` // blank if the job was deleted
+	Exitcode   int
+	FailReason string `json:",omitempty"`
+}
+
+// NewWaitSummary aggregates the given outcomes, as returned by WaitForJobs() or
+// WaitForRepGroup().
+func NewWaitSummary(outcomes []*JobOutcome) *WaitSummary {
+	ws := &WaitSummary{}
+	for _, outcome := range outcomes {
+		switch outcome.State {
+		case JobStateComplete:
+			ws.Complete++
+			continue
+		case JobStateBuried:
+			ws.Buried++
+		default:
+			ws.Deleted++
+		}
+		failure := &WaitFailure{Key: outcome.Key, State: outcome.State}
+		if outcome.Job != nil {
+			failure.Cmd = outcome.Job.Cmd
+			failure.Exitcode = outcome.Job.Exitcode
+			failure.FailReason = outcome.Job.FailReason
+		}
+		ws.Failed = append(ws.Failed, failure)
+	}
+	return ws
+}
+
+// OK returns true if none of the jobs were buried or deleted.
+func (ws *WaitSummary) OK() bool {
+	return ws.Buried == 0 && ws.Deleted == 0
+}
+
+// Wait is like WaitForRepGroup(), blocking until all the jobs with the given
+// RepGroup are complete or buried, but returns a summary of their outcomes.
+// Check the summary's OK() to see if they all completed.
+func (c *Client) Wait(repgroup string) (*WaitSummary, error) {
+	return c.WaitContext(context.Background(), repgroup)
+}
+
+// WaitContext is like Wait(), but stops waiting and returns ctx.Err() if ctx is
+// cancelled or reaches its deadline first.
+func (c *Client) WaitContext(ctx context.Context, repgroup string) (*WaitSummary, error) {
+	outcomes, err := c.WaitForRepGroupContext(ctx, repgroup)
+	if err != nil {
+		return nil, err
+	}
+	ws := NewWaitSummary(outcomes)
+	ws.RepGroup = repgroup
+	return ws, nil
+}
+
+// GetOrSetLimitGroup takes the name of a limit group and returns the current
+// limit for that group. If the group isn't known about, returns -1.
+//
+// If the name is suffixed with :n, where n is an integer, then the limit of
+// the group is set to n, and then n is returned. Setting n to -1 makes the
+// group forgotten about, effectively making it unlimited.
+func (c *Client) GetOrSetLimitGroup(group string) (int, error) {
+	return c.GetOrSetLimitGroupContext(context.Background(), group)
+}
+
+// GetOrSetLimitGroupContext is like GetOrSetLimitGroup(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetOrSetLimitGroupContext(ctx context.Context, group string) (int, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getsetlg", LimitGroup: group})
+	if err != nil {
+		return -1, err
+	}
+	return resp.Limit, err
+}
+
+// UploadFile uploads a local file to the machine where the server is running,
+// so you can add cloud jobs that need a script or config file on your local
+// machine to be copied over to created cloud instances.
+//
+// If the remote path is supplied as a blank string, the remote path will be
+// chosen for you based on the MD5 checksum of your file data, rooted in the
+// server's configured UploadDir.
+//
+// The remote path can be supplied prefixed with ~/ to upload relative to the
+// remote's home directory. Otherwise it should be an absolute path.
+//
+// Returns the absolute path of the uploaded file on the server's machine.
+//
+// NB: This is only suitable for transferring small files!
+func (c *Client) UploadFile(local, remote string) (string, error) {
+	return c.UploadFileContext(context.Background(), local, remote)
+}
+
+// UploadFileContext is like UploadFile(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) UploadFileContext(ctx context.Context, local, remote string) (string, error) {
+	compressed, err := compressFile(local)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "upload", File: compressed, Path: remote})
+	if err != nil {
+		return "", err
+	}
+	return resp.Path, err
+}
+
+// RegisterArtifacts adds the given Artifacts to those recorded for the
+// complete Job with the given key (or name), so that output files created or
+// uploaded after the Job finished can be found in the same way as those
+// recorded when it ran. Artifacts with the same Path as an already recorded
+// one replace it. Each Artifact must have an absolute Path. Returns all the
+// Job's Artifacts.
+//
+// Returns an error that errors.Is() ErrorNotComplete if the Job is still in
+// the queue, or ErrorMissingJob if there is no such Job.
+func (c *Client) RegisterArtifacts(key string, artifacts []*Artifact) ([]*Artifact, error) {
+	return c.RegisterArtifactsContext(context.Background(), key, artifacts)
+}
+
+// RegisterArtifactsContext is like RegisterArtifacts(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) RegisterArtifactsContext(ctx context.Context, key string, artifacts []*Artifact) ([]*Artifact, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "regartifacts", Keys: []string{key}, Artifacts: artifacts})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Artifacts, err
+}
+
+// DownloadArtifact downloads the file at the given path, which must be the
+// Path of one of the Artifacts of the Job with the given key (or name), from
+// the machine where the server is running to the given local path. This only
+// works if the file can be read from the server's machine, eg. because it's
+// on a shared disk; for Artifacts with a Remote location, see
+// Job.DownloadRemoteArtifact().
+//
+// NB: This is only suitable for transferring small files!
+func (c *Client) DownloadArtifact(key, path, local string) error {
+	return c.DownloadArtifactContext(context.Background(), key, path, local)
+}
+
+// DownloadArtifactContext is like DownloadArtifact(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) DownloadArtifactContext(ctx context.Context, key, path, local string) error {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getartifact", Keys: []string{key}, Path: path})
+	if err != nil {
+		return err
+	}
+	content, err := decompressUnlimited(resp.File)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(local, content, 0600)
+}
+
+// GetBadCloudServers (if the server is running with a cloud scheduler) returns
+// servers that are currently non-responsive and might be dead.
+func (c *Client) GetBadCloudServers() ([]*BadServer, error) {
+	return c.GetBadCloudServersContext(context.Background())
+}
+
+// GetBadCloudServersContext is like GetBadCloudServers(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetBadCloudServersContext(ctx context.Context) ([]*BadServer, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getbcs"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.BadServers, err
+}
+
+// GetSchedulerStatus returns the server's current view of its job scheduler:
+// the runners it has requested for each scheduler group (and how many ready
+// jobs aren't being scheduled due to limit groups), the hosts and flavors the
+// scheduler knows about, limit group usage, scheduler issues and bad servers,
+// along with any reasons why nothing is being scheduled at all.
+func (c *Client) GetSchedulerStatus() (*SchedulerStatus, error) {
+	return c.GetSchedulerStatusContext(context.Background())
+}
+
+// GetSchedulerStatusContext is like GetSchedulerStatus(), but stops waiting for
+// the server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetSchedulerStatusContext(ctx context.Context) (*SchedulerStatus, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getsched"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.SchedStatus, err
+}
+
+// ConfirmCloudServersDead will confirm that currently non-responsive cloud
+// servers (that would be returned by GetBadCloudServers()) are dead, triggering
 // their destruction. If id is an empty string, applies to all such servers. If
 // it is the ID of a server returned by GetBadCloudServers(), applies to just
 // that server. Returns the servers that were successfully confirmed dead.
@@ -1798,7 +3809,14 @@ func (c *Client) GetBadCloudServers() ([]*BadServer, error) {
 // UntilBuried is what it will be at that future time point, so if it is 0 you
 // know this currently running job will be buried.
 func (c *Client) ConfirmCloudServersDead(id string) ([]*BadServer, []*Job, error) {
-	resp, err := c.request(&clientRequest{Method: "getbcs", ConfirmDeadCloudServers: true, CloudServerID: id})
+	return c.ConfirmCloudServersDeadContext(context.Background(), id)
+}
+
+// ConfirmCloudServersDeadContext is like ConfirmCloudServersDead(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) ConfirmCloudServersDeadContext(ctx context.Context, id string) ([]*BadServer, []*Job, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getbcs", ConfirmDeadCloudServers: true, CloudServerID: id})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1806,28 +3824,68 @@ func (c *Client) ConfirmCloudServersDead(id string) ([]*BadServer, []*Job, error
 }
 
 // request the server do something and get back its response. We can only cope
-// with one request at a time per client, or we'll get replies back in the
-// wrong order, hence we lock.
+// with one request at a time per socket, or we'll get replies back in the
+// wrong order, hence sendRecv() locks, while ConnectPersistent() clients use a
+// pool of sockets.
 func (c *Client) request(cr *clientRequest) (*serverResponse, error) {
-	c.Lock()
-	defer c.Unlock()
+	return c.requestContext(context.Background(), cr)
+}
+
+// requestContext is like request(), but stops waiting for the server's
+// response if the given context is cancelled or reaches its deadline, in which
+// case the context's error is returned.
+//
+// Note that the request may still be acted upon by the server, and that
+// non-persistent clients can't send another request until the abandoned one
+// gets its response or hits the timeout given to Connect().
+func (c *Client) requestContext(ctx context.Context, cr *clientRequest) (*serverResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// encode and send the request
+	// encode the request
 	var encoded []byte
 	enc := codec.NewEncoderBytes(&encoded, c.ch)
 	cr.Token = c.token
 	cr.ClientID = c.clientid
+	cr.Namespace = c.namespace
+	cr.ProtocolVersion = c.protocol
 	err := enc.Encode(cr)
 	if err != nil {
 		return nil, err
 	}
-	err = c.sock.Send(encoded)
+	if len(encoded) > wireMaxDecodedSize {
+		key := ""
+		if cr.Job != nil {
+			key = cr.Job.Key()
+		}
+		return nil, Error{cr.Method, key, ErrRequestTooLarge}
+	}
+	encoded, err = frameWire(encoded, c.compression)
 	if err != nil {
 		return nil, err
 	}
 
-	// get the response and decode it
-	resp, err := c.sock.Recv()
+	// send it and get the response
+	var addr string
+	if c.failsOver() {
+		addr = c.currentAddr()
+	}
+	var resp []byte
+	if ctx.Done() == nil {
+		resp, err = c.send(encoded)
+	} else {
+		resp, err = c.sendContext(ctx, encoded)
+	}
+	if err != nil {
+		if addr != "" && ctx.Err() == nil {
+			return c.failoverRequest(ctx, cr, addr, err)
+		}
+		return nil, err
+	}
+
+	// decode the response
+	resp, _, err = unframeWire(resp, false)
 	if err != nil {
 		return nil, err
 	}
@@ -1844,11 +3902,57 @@ func (c *Client) request(cr *clientRequest) (*serverResponse, error) {
 		if cr.Job != nil {
 			key = cr.Job.Key()
 		}
+		if sr.Reason != "" {
+			return sr, fmt.Errorf("%w: %s", Error{cr.Method, key, sr.Err}, sr.Reason)
+		}
 		return sr, Error{cr.Method, key, sr.Err}
 	}
 	return sr, err
 }
 
+// send sends the given encoded request and returns the server's response,
+// using one of our pool of sockets if we have them, which lets us make many
+// requests at once.
+func (c *Client) send(encoded []byte) ([]byte, error) {
+	if c.persistent() {
+		return c.pooledSendRecv(encoded)
+	}
+	return c.sendRecv(encoded)
+}
+
+// sendContext is like send(), but returns the context's error as soon as the
+// context is done, leaving the send to complete in the background.
+func (c *Client) sendContext(ctx context.Context, encoded []byte) ([]byte, error) {
+	type result struct {
+		resp []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := c.send(encoded)
+		done <- result{resp, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sendRecv sends the given encoded request to the server over our single
+// socket and returns its response.
+func (c *Client) sendRecv(encoded []byte) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	err := c.sock.Send(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return c.sock.Recv()
+}
+
 // CompressEnv encodes the given environment variables (slice of "key=value"
 // strings) and then compresses that, so that for Add() the server can store it
 // on disc without holding it in memory, and pass the compressed bytes back to
@@ -0,0 +1,230 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for clients that know about more than one
+// server address, failing over between them when one becomes unreachable.
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// these global variables are primarily exported for testing purposes; you
+// probably shouldn't change them
+var (
+	ClientFailoverRounds  = 3
+	ClientFailoverBackoff = 1 * time.Second
+)
+
+// failoverSafeMethods are the request methods that can be sent again to a
+// different server without risk of them being acted on twice.
+var failoverSafeMethods = map[string]bool{
+	"ping":     true,
+	"backup":   true,
+	"upload":   true,
+	"jtouch":   true,
+	"getbc":    true,
+	"getbr":    true,
+	"getbt":    true,
+	"getin":    true,
+	"getrgs":   true,
+	"getbcs":   true,
+	"getsetlg": true,
+	"getsched": true,
+	"getrgrec": true,
+	"getfails": true,
+	"rgauto":   true,
+	"rgwin":    true,
+	"rgrate":   true,
+	"rgfail":   true,
+	"exhosts":  true,
+	"inhosts":  true,
+	"gethosts": true,
+	"waitjobs": true,
+
+	"getbulkrm":    true,
+	"cancelbulkrm": true,
+	"getrunnerexe": true,
+
+	"getrestimeouts": true,
+
+	"getfailsum": true,
+
+	"getutil": true,
+
+	"getenrolled": true,
+
+	"getpolicies": true,
+
+	"setqueue":  true,
+	"getqueues": true,
+
+	"getjobevents": true,
+
+	"gethostusage": true,
+	"getresources": true,
+
+	"getrestored": true,
+
+	"getfairshare": true,
+
+	"gettrashed": true,
+
+	"getusage": true,
+
+	"getexport": true,
+
+	"setsecret":  true,
+	"getsecrets": true,
+
+	"settriage": true,
+	"gettriage": true,
+
+	"getprogress": true,
+
+	"getschedules": true,
+
+	"getworkflows": true,
+
+	"getartifact":  true,
+	"regartifacts": true,
+}
+
+// ConnectFailover is like Connect(), but takes the addresses of multiple
+// servers that share the same token and certificates (such as the members of
+// a high-availability setup). The returned Client connects to the first of
+// them that responds.
+//
+// If a later request fails because the current server can't be reached, the
+// Client moves on to the next server that responds, trying them all
+// ClientFailoverRounds times, waiting ClientFailoverBackoff (doubling each
+// round) between rounds. Requests that are safe to repeat (those that only get
+// information, Touch(), UploadFile(), and Add()s that either ignore complete
+// jobs or where every Job has an IdempotencyKey) are then sent again, so you
+// won't notice the failover. Other requests return the original error, but
+// your next request will go to the new server.
+//
+// Only if no server can be reached will you get an Error with Err ErrNoServer.
+func ConnectFailover(addrs []string, caFile, certDomain string, token []byte, timeout time.Duration) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, Error{"Connect", "", ErrNoServer}
+	}
+
+	var lastErr error
+	for i, addr := range addrs {
+		c, err := Connect(addr, caFile, certDomain, token, timeout)
+		if err == nil {
+			c.addrs = addrs
+			c.addrIndex = i
+			return c, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// failsOver tells you if this Client was made with ConnectFailover() with more
+// than one address.
+func (c *Client) failsOver() bool {
+	return len(c.addrs) > 1 && !c.persistent()
+}
+
+// failoverRequest is called by requestContext() when sending the given request
+// failed with sendErr. It fails over to another server, then if the request is
+// safe to repeat, sends it again.
+func (c *Client) failoverRequest(ctx context.Context, cr *clientRequest, failedAddr string, sendErr error) (*serverResponse, error) {
+	c.Warn("request to server failed, will fail over", "method", cr.Method, "addr", failedAddr, "err", sendErr)
+	err := c.failover(ctx, cr.Method, failedAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	cr.failovers++
+	if (!cr.failoverSafe && !failoverSafeMethods[cr.Method]) || cr.failovers > len(c.addrs) {
+		return nil, sendErr
+	}
+	return c.requestContext(ctx, cr)
+}
+
+// failover replaces our connection with one to the next of our addrs that
+// responds, unless we're no longer connected to failedAddr (because another
+// request already failed over).
+func (c *Client) failover(ctx context.Context, method string, failedAddr string) error {
+	c.addrsMutex.Lock()
+	defer c.addrsMutex.Unlock()
+	if c.currentAddr() != failedAddr {
+		return nil
+	}
+
+	wait := ClientFailoverBackoff
+	for round := 0; round < ClientFailoverRounds; round++ {
+		for i := 1; i <= len(c.addrs); i++ {
+			index := (c.addrIndex + i) % len(c.addrs)
+			nc, err := Connect(c.addrs[index], c.args[1], c.args[2], c.token, c.timeout)
+			if err != nil {
+				c.Debug("failover connection failed", "addr", c.addrs[index], "err", err)
+				continue
+			}
+			c.adopt(nc, index)
+			c.Warn("failed over to new server", "addr", c.addrs[index])
+			return nil
+		}
+
+		if round == ClientFailoverRounds-1 {
+			break
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+	}
+
+	return Error{method, strings.Join(c.addrs, ","), ErrNoServer}
+}
+
+// adopt takes over the connection of the given newly connected Client, which
+// is connected to our addrs[index].
+func (c *Client) adopt(nc *Client, index int) {
+	c.Lock()
+	old := c.sock
+	c.sock = nc.sock
+	c.compression = nc.compression
+	c.ServerInfo = nc.ServerInfo
+	c.host = nc.host
+	c.port = nc.port
+	c.args = nc.args
+	c.addrIndex = index
+	c.Unlock()
+
+	errc := old.Close()
+	if errc != nil {
+		c.Debug("failed to close old socket", "err", errc)
+	}
+}
+
+// currentAddr returns the address of the server we're currently connected to.
+func (c *Client) currentAddr() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.args[0]
+}
@@ -0,0 +1,221 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for clients that stay connected to the server
+// for a long time, making many (possibly concurrent) requests.
+
+import (
+	"time"
+
+	"nanomsg.org/go-mangos"
+)
+
+// clientPool holds the sockets of a ConnectPersistent() Client. Each socket
+// can only handle one request at a time, so a request takes a socket from the
+// pool and puts it back when done.
+type clientPool struct {
+	socks   chan mangos.Socket
+	size    int
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// ConnectPersistent is like Connect(), but is intended for long-running
+// clients (eg. a workflow manager's sidecar process) that will make many
+// requests over time, perhaps from many goroutines at once.
+//
+// Instead of a single connection that can only be used for one request at a
+// time, the returned Client has a pool of conns connections to the server, so
+// up to that many requests can be in flight at once.
+//
+// The Client also pings the server every ClientHeartbeatInterval, and if that
+// fails (eg. because the server was restarted), transparently replaces its
+// connections. Individual requests that fail because a connection could not
+// be used are retried once on a new connection.
+//
+// You must still call Disconnect() when you're done with the Client.
+func ConnectPersistent(addr, caFile, certDomain string, token []byte, timeout time.Duration, conns int) (*Client, error) {
+	if conns < 1 {
+		conns = 1
+	}
+
+	c, err := Connect(addr, caFile, certDomain, token, timeout)
+	if err != nil {
+		return c, err
+	}
+
+	pool := &clientPool{
+		socks:   make(chan mangos.Socket, conns),
+		size:    conns,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	pool.socks <- c.sock
+	for i := 1; i < conns; i++ {
+		sock, errd := dialServer(addr, caFile, certDomain, timeout)
+		if errd != nil {
+			close(pool.socks)
+			for s := range pool.socks {
+				errc := s.Close()
+				if errc != nil {
+					c.Warn("failed to close socket", "err", errc)
+				}
+			}
+			return nil, errd
+		}
+		pool.socks <- sock
+	}
+
+	c.poolMutex.Lock()
+	c.pool = pool
+	c.poolMutex.Unlock()
+
+	go c.heartbeat(pool)
+
+	return c, nil
+}
+
+// persistent tells you if this Client was made with ConnectPersistent() and
+// hasn't been Disconnect()ed.
+func (c *Client) persistent() bool {
+	c.poolMutex.RLock()
+	defer c.poolMutex.RUnlock()
+	return c.pool != nil
+}
+
+// pooledSendRecv sends the given encoded request to the server using one of
+// the sockets in our pool, and returns the response. If the request could not
+// be sent, it is retried once using a new socket.
+func (c *Client) pooledSendRecv(encoded []byte) ([]byte, error) {
+	c.poolMutex.RLock()
+	pool := c.pool
+	c.poolMutex.RUnlock()
+	if pool == nil {
+		return c.sendRecv(encoded)
+	}
+
+	var sock mangos.Socket
+	select {
+	case sock = <-pool.socks:
+	case <-pool.stop:
+		return nil, mangos.ErrClosed
+	}
+
+	err := sock.Send(encoded)
+	if err != nil {
+		c.Warn("failed to send request to server, will retry on a new connection", "err", err)
+		sock = c.redial(sock)
+		err = sock.Send(encoded)
+	}
+	var resp []byte
+	if err == nil {
+		resp, err = sock.Recv()
+		if err != nil && err != mangos.ErrRecvTimeout {
+			// we can't know if the server acted on our request, so we don't
+			// retry it, but we won't use this socket again
+			sock = c.redial(sock)
+		}
+	}
+
+	pool.socks <- sock
+	return resp, err
+}
+
+// redial closes the given socket and returns a new one connected to the
+// server. If we fail to make a new one, the closed socket is returned, and
+// heartbeat() will try again later.
+func (c *Client) redial(old mangos.Socket) mangos.Socket {
+	errc := old.Close()
+	if errc != nil && errc != mangos.ErrClosed {
+		c.Warn("failed to close socket", "err", errc)
+	}
+	sock, err := dialServer(c.args[0], c.args[1], c.args[2], c.timeout)
+	if err != nil {
+		c.Warn("failed to reconnect to server", "err", err)
+		return old
+	}
+	return sock
+}
+
+// heartbeat pings the server every ClientHeartbeatInterval, replacing all the
+// sockets in the pool if that fails. It returns when the pool is stopped.
+func (c *Client) heartbeat(pool *clientPool) {
+	defer close(pool.stopped)
+	ticker := time.NewTicker(ClientHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, err := c.Ping(c.timeout)
+			if err != nil {
+				c.Warn("heartbeat to server failed, will reconnect", "err", err)
+				c.reconnectPool(pool)
+			}
+		case <-pool.stop:
+			return
+		}
+	}
+}
+
+// reconnectPool replaces every socket in the given pool with a new one,
+// waiting for any current requests to finish first.
+func (c *Client) reconnectPool(pool *clientPool) {
+	socks := make([]mangos.Socket, 0, pool.size)
+	for i := 0; i < pool.size; i++ {
+		select {
+		case sock := <-pool.socks:
+			socks = append(socks, sock)
+		case <-pool.stop:
+			for _, sock := range socks {
+				pool.socks <- sock
+			}
+			return
+		}
+	}
+	for _, sock := range socks {
+		pool.socks <- c.redial(sock)
+	}
+}
+
+// disconnectPersistent does the work of Disconnect() for ConnectPersistent()
+// clients, closing all the sockets in the pool once any current requests have
+// finished.
+func (c *Client) disconnectPersistent() error {
+	c.poolMutex.Lock()
+	pool := c.pool
+	c.pool = nil
+	c.poolMutex.Unlock()
+	if pool == nil {
+		return mangos.ErrClosed
+	}
+
+	close(pool.stop)
+	<-pool.stopped
+
+	var err error
+	for i := 0; i < pool.size; i++ {
+		sock := <-pool.socks
+		errc := sock.Close()
+		if errc != nil && err == nil {
+			err = errc
+		}
+	}
+	return err
+}
@@ -0,0 +1,212 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for running a Job's Cmd inside a docker or
+// singularity container, as specified by its ContainerImage.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ContainerRuntimeDocker is the default Job.ContainerRuntime, which runs
+	// the Cmd in a container using `docker run`.
+	ContainerRuntimeDocker = "docker"
+
+	// ContainerRuntimeSingularity is the Job.ContainerRuntime that runs the Cmd
+	// in a container using `singularity exec`.
+	ContainerRuntimeSingularity = "singularity"
+)
+
+// validContainerRuntime tells you if the given Job.ContainerRuntime is one we
+// support.
+func validContainerRuntime(runtime string) bool {
+	switch runtime {
+	case "", ContainerRuntimeDocker, ContainerRuntimeSingularity:
+		return true
+	}
+	return false
+}
+
+// containerRuntime returns the ContainerRuntime of the job, defaulting to
+// docker.
+func (j *Job) containerRuntime() string {
+	if j.ContainerRuntime == "" {
+		return ContainerRuntimeDocker
+	}
+	return j.ContainerRuntime
+}
+
+// containerDescription returns "runtime:image" for a job with a
+// ContainerImage, or blank otherwise.
+func (j *Job) containerDescription() string {
+	if j.ContainerImage == "" {
+		return ""
+	}
+	return j.containerRuntime() + ":" + j.ContainerImage
+}
+
+// containerPull makes sure that the job's ContainerImage is available on this
+// machine, pulling it if necessary. The returned error includes the output of
+// the runtime if it failed.
+func (j *Job) containerPull() error {
+	j.RLock()
+	image := j.ContainerImage
+	runtime := j.containerRuntime()
+	j.RUnlock()
+
+	var pull *exec.Cmd
+	switch runtime {
+	case ContainerRuntimeDocker:
+		if exec.Command("docker", "image", "inspect", image).Run() == nil { // #nosec
+			return nil
+		}
+		pull = exec.Command("docker", "pull", image) // #nosec
+	case ContainerRuntimeSingularity:
+		if _, err := os.Stat(image); err == nil {
+			return nil
+		}
+
+		// singularity caches images from remote URIs the first time it runs
+		// them, so we do a trivial run to get the pulling out of the way
+		pull = exec.Command("singularity", "exec", image, "true") // #nosec
+	default:
+		return fmt.Errorf("unknown container runtime [%s]", runtime)
+	}
+
+	out, err := pull.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s could not pull image [%s]: %w (%s)", runtime, image, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// containerArgs returns the command line (starting with the name of the
+// container runtime) that will run the given (already wrapped) cmd inside the
+// job's ContainerImage using the given shell, from the given working
+// directory.
+//
+// dir and binds (which should include any mount points and files the cmd needs
+// to access) are bind-mounted in at the same paths. For docker, env is the
+// environment the runtime will be run with, and the job's env overrides and our
+// own WR_* variables from it are passed through to the container, the
+// container's memory and cpus are limited to the job's Requirements, and the
+// container's ID is written to cidFile. Singularity containers see the whole
+// environment, and their processes are children of the runtime, so are
+// monitored and limited the same way as a Cmd not run in a container.
+func (j *Job) containerArgs(shell, cmd, dir string, binds, env []string, cidFile string) ([]string, error) {
+	j.RLock()
+	defer j.RUnlock()
+	runtime := j.containerRuntime()
+	binds = uniqueBinds(append([]string{dir}, binds...))
+
+	var args []string
+	switch runtime {
+	case ContainerRuntimeDocker:
+		args = []string{runtime, "run", "--rm", "--cidfile", cidFile,
+			"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+			"--workdir", dir, "--entrypoint", shell}
+		if j.Requirements != nil {
+			if j.Requirements.RAM > 0 {
+				args = append(args, "--memory", strconv.Itoa(j.Requirements.RAM)+"m")
+			}
+			if j.Requirements.Cores > 0 {
+				args = append(args, "--cpus", strconv.FormatFloat(j.Requirements.Cores, 'f', -1, 64))
+			}
+		}
+		for _, bind := range binds {
+			args = append(args, "--volume", bind+":"+bind)
+		}
+		keys, errc := j.containerEnvKeys(env)
+		if errc != nil {
+			return nil, errc
+		}
+		for _, key := range keys {
+			args = append(args, "--env", key)
+		}
+	case ContainerRuntimeSingularity:
+		args = []string{runtime, "exec", "--pwd", dir, "--bind", strings.Join(binds, ",")}
+	default:
+		return nil, fmt.Errorf("unknown container runtime [%s]", runtime)
+	}
+
+	return append(args, j.ContainerImage, shell, "-c", cmd), nil
+}
+
+// containerEnvKeys returns the names of the variables in the given env that
+// should be passed through to a docker container: those the job overrides,
+// those of its EnvSecrets and those we set ourselves (including TMPDIR and HOME
+// when they were set to the job's unique working directory). You must hold the
+// job's read lock.
+func (j *Job) containerEnvKeys(env []string) ([]string, error) {
+	overrides, err := j.envCurrentOverrides()
+	if err != nil {
+		return nil, err
+	}
+	if j.RetryOverrides != nil {
+		overrides = append(overrides, j.RetryOverrides.Env...)
+	}
+	overrides = append(overrides, j.EnvSecrets...)
+	wanted := make(map[string]bool)
+	for _, envvar := range overrides {
+		wanted[strings.SplitN(envvar, "=", 2)[0]] = true
+	}
+
+	var keys []string
+	for _, envvar := range env {
+		key := strings.SplitN(envvar, "=", 2)[0]
+		ours := strings.HasPrefix(key, "WR_") || (j.ActualCwd != "" && (key == "TMPDIR" || (key == "HOME" && j.ChangeHome)))
+		if wanted[key] || ours {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// uniqueBinds returns the given absolute paths, sorted, minus duplicates and
+// blanks and any that are inside another of the paths.
+func uniqueBinds(paths []string) []string {
+	cleaned := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if path != "" {
+			cleaned = append(cleaned, filepath.Clean(path))
+		}
+	}
+	sort.Strings(cleaned)
+
+	var binds []string
+PATHS:
+	for _, path := range cleaned {
+		for _, bind := range binds {
+			if path == bind || strings.HasPrefix(path, bind+string(filepath.Separator)) {
+				continue PATHS
+			}
+		}
+		binds = append(binds, path)
+	}
+	return binds
+}
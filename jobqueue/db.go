@@ -19,7 +19,8 @@
 package jobqueue
 
 // This file contains functions for interacting with our database, which is
-// boltdb, a simple key/val store with transactions and hot backup ability.
+// boltdb, a simple key/val store with transactions and hot backup ability, or
+// an external SQL database used in the same way (see dbBackend.go).
 // We don't use a generic ORM for boltdb like Storm, because we can do custom
 // queries that are multiple times faster than what Storm can do.
 
@@ -31,6 +32,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -43,7 +45,6 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/inconshreveable/log15"
 	"github.com/ugorji/go/codec"
-	bolt "go.etcd.io/bbolt"
 )
 
 const (
@@ -51,6 +52,10 @@ const (
 	jobStatWindowPercent      = float32(5)
 	dbFilePermission          = 0600
 	minimumTimeBetweenBackups = 30 * time.Second
+	dbMaxSingleTxnJobs        = 10000
+	dbCompressedJobPrefix     = "\x00z" // binc encoded Jobs never start with a nil byte
+	dbSharedCmdMinLength      = 128     // shorter Cmds aren't worth storing separately
+	dbCmdCacheSize            = 1000
 )
 
 var (
@@ -60,13 +65,42 @@ var (
 	bucketRGs          = []byte("repgroups")
 	bucketLGs          = []byte("limitgroups")
 	bucketDTK          = []byte("depgroupToKey")
+	bucketTTK          = []byte("tagToKey")
 	bucketRDTK         = []byte("reverseDepgroupToKey")
 	bucketEnvs         = []byte("envs")
+	bucketCmds         = []byte("cmds")
 	bucketStdO         = []byte("stdo")
 	bucketStdE         = []byte("stde")
 	bucketJobRAM       = []byte("jobRAM")
 	bucketJobDisk      = []byte("jobDisk")
 	bucketJobSecs      = []byte("jobSecs")
+	bucketIdemKeys     = []byte("idempotencyKeys")
+	bucketJobNames     = []byte("jobNames")
+	bucketRepGroupRAM  = []byte("repGroupRAM")
+	bucketRepGroupSecs = []byte("repGroupSecs")
+	bucketRepGroupAuto = []byte("repGroupNoAutoApply")
+	bucketRepGroupWin  = []byte("repGroupRunWindows")
+	bucketExcluded     = []byte("excludedHosts")
+	bucketRepGroupRate = []byte("repGroupStartRates")
+	bucketRepGroupFail = []byte("repGroupFailRules")
+	bucketRepGroupHost = []byte("repGroupHostFailurePolicies")
+	bucketBulkRemovals = []byte("bulkRemovals")
+	bucketBulkRmKeys   = []byte("bulkRemovalKeys")
+	bucketUtilisation  = []byte("utilisation")
+	bucketEnrolled     = []byte("enrolledHosts")
+	bucketPolicies     = []byte("policies")
+	bucketRepGroupPol  = []byte("repGroupPolicies")
+	bucketJobEvents    = []byte("jobEvents")
+	bucketRGArchives   = []byte("restoredRepGroupArchives")
+	bucketTrash        = []byte("trash")
+	bucketUsage        = []byte("usage")
+	bucketSchedules    = []byte("schedules")
+	bucketWorkflows    = []byte("workflows")
+	bucketQueueConfigs = []byte("queueConfigs")
+	bucketSecrets      = []byte("secrets")
+	bucketSecretOwner  = []byte("secretOwners")
+	bucketTriageRules  = []byte("triageRules")
+	triageRulesKey     = []byte("rules")
 	wipeDevDBOnInit    = true
 	forceBackups       = false
 )
@@ -103,12 +137,31 @@ type db struct {
 	backupPath string
 	ch         codec.Handle
 	log15.Logger
+	archiveJournal       *os.File
+	archivePending       []*archiveEntry
+	archivePendingKeys   map[string]*archiveEntry // buffered entries (including those being flushed) by job key
+	archiveWritten       uint64                   // how many entries have been written to archiveJournal
+	archiveSynced        uint64                   // how many of those are known to be synced to disk
+	archiveSyncing       bool
+	archiveSyncCond      *sync.Cond
+	archiveSyncMutex     sync.Mutex // protects archiveSynced and archiveSyncing
+	archiveFlushNow      chan bool
+	archiveStop          chan bool
+	archiveStopped       chan bool
+	archiveFlushTime     time.Duration
+	archiveMutex         sync.Mutex // protects archiveJournal, archivePending(Keys), archiveWritten and archiveFlushTime
+	archiveFlushMutex    sync.Mutex // ensures only one flushArchived() at a time
+	archiveStopOnce      sync.Once
 	backupStopWait       chan bool
 	backupMount          *muxfys.MuxFys
 	backupNotification   chan bool
 	backupWait           time.Duration
-	bolt                 *bolt.DB
+	backend              dbBackend
+	epochs               *epochBackend       // backend, as it checks our epoch before writing
+	incremental          *incrementalBackups // set by enableIncrementalBackups()
+	depIndex             *depIndex
 	envcache             *lru.ARCCache
+	cmdcache             *lru.ARCCache
 	updatingAfterJobExit int
 	wg                   *sync.WaitGroup
 	wgMutex              sync.Mutex // protects wg since we want to call Wait() while another goroutine might call Add()
@@ -129,64 +182,32 @@ type db struct {
 // which will cause that s3 path to be mounted in the same directory as dbFile
 // and backups will be written there.
 //
-// In development we delete any existing db and force a fresh start. Backups
-// are also not carried out, so dbBkFile is ignored.
-func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logger) (*db, string, error) {
+// If dbURL is supplied, the jobs etc. are stored in that external SQL database
+// (see openSQLBackend()) instead of in dbFile, and we leave backing it up to
+// you, so dbBkFile is ignored. dbFile is still used as the basis of the path
+// to our archive journal.
+//
+// In development we delete any existing db and force a fresh start (unless keep
+// is true). Backups are also not carried out, so dbBkFile is ignored.
+func initDB(dbFile string, dbBkFile string, dbURL string, deployment string, keep bool, logger log15.Logger) (*db, string, error) {
 	l := logger.New()
 
 	var backupsEnabled bool
 	bkPath := dbBkFile
 	var fs *muxfys.MuxFys
-	if deployment == internal.Production || forceBackups {
+	if (deployment == internal.Production || forceBackups) && dbURL == "" {
 		backupsEnabled = true
-		if internal.InS3(dbBkFile) {
-			if deployment == internal.Development {
-				dbBkFile += "." + deployment
-			}
-			path := strings.TrimPrefix(dbBkFile, internal.S3Prefix)
-			pp := strings.Split(path, "@")
-			profile := "default"
-			if len(pp) == 2 {
-				profile = pp[0]
-				path = pp[1]
-			}
-			base := filepath.Base(path)
-			path = filepath.Dir(path)
-
-			mnt := filepath.Join(filepath.Dir(dbFile), ".db_bk_mount", path)
-			bkPath = filepath.Join(mnt, base)
-
-			accessorConfig, err := muxfys.S3ConfigFromEnvironment(profile, path)
-			if err != nil {
-				return nil, "", err
-			}
-			accessor, err := muxfys.NewS3Accessor(accessorConfig)
-			if err != nil {
-				return nil, "", err
-			}
-			remoteConfig := &muxfys.RemoteConfig{
-				Accessor: accessor,
-				Write:    true,
-			}
-			muxfys.SetLogHandler(l.GetHandler())
-
-			cfg := &muxfys.Config{
-				Mount:   mnt,
-				Retries: 10,
-			}
-			fs, err = muxfys.New(cfg)
-			if err != nil {
-				return nil, "", err
-			}
-			err = fs.Mount(remoteConfig)
-			if err != nil {
-				return nil, "", err
-			}
-			fs.UnmountOnDeath()
+		var err error
+		bkPath, fs, err = mountDBBackup(dbFile, dbBkFile, deployment, l)
+		if err != nil {
+			return nil, "", err
 		}
 	}
 
-	if wipeDevDBOnInit && deployment == internal.Development {
+	// (a new server that we're handing over to, or a standby that replicated
+	// its primary's database, must keep that database, even in development)
+	wipe := wipeDevDBOnInit && deployment == internal.Development && !keep
+	if wipe {
 		errr := os.Remove(dbFile)
 		if errr != nil && !os.IsNotExist(errr) {
 			l.Warn("Failed to remove database file", "path", dbFile, "err", errr)
@@ -195,52 +216,30 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		if errr != nil && !os.IsNotExist(errr) {
 			l.Warn("Failed to remove database backup file", "path", bkPath, "err", errr)
 		}
+		errr = os.Remove(dbFile + dbArchiveJournalSuffix)
+		if errr != nil && !os.IsNotExist(errr) {
+			l.Warn("Failed to remove database archive journal", "path", dbFile+dbArchiveJournalSuffix, "err", errr)
+		}
+		errr = removeIncrementalBackups(dbFile, bkPath)
+		if errr != nil {
+			l.Warn("Failed to remove incremental database backups", "path", bkPath, "err", errr)
+		}
 	}
 
-	var boltdb *bolt.DB
+	var backend dbBackend
 	var msg string
 	var err error
-	if _, err = os.Stat(dbFile); os.IsNotExist(err) {
-		if _, err = os.Stat(bkPath); os.IsNotExist(err) {
-			boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
-			msg = "created new empty db file " + dbFile
-		} else {
-			err = copyFile(bkPath, dbFile)
-			if err != nil {
-				return nil, msg, err
-			}
-			boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
-			msg = "recreated missing db file " + dbFile + " from backup file " + dbBkFile
-		}
+	if dbURL != "" {
+		backend, msg, err = initSQLBackend(dbURL, wipe)
 	} else {
-		boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
-		if err != nil {
-			// try the backup
-			if _, errbk := os.Stat(dbBkFile); errbk == nil {
-				boltdb, errbk = bolt.Open(bkPath, dbFilePermission, nil)
-				if errbk == nil {
-					origerr := err
-					msg = fmt.Sprintf("tried to recreate corrupt (?) db file %s from backup file %s (error with original db file was: %s)", dbFile, dbBkFile, err)
-					err = os.Remove(dbFile)
-					if err != nil {
-						return nil, msg, err
-					}
-					err = copyFile(bkPath, dbFile)
-					if err != nil {
-						return nil, msg, err
-					}
-					boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
-					msg = fmt.Sprintf("recreated corrupt (?) db file %s from backup file %s (error with original db file was: %s)", dbFile, dbBkFile, origerr)
-				}
-			}
-		}
+		backend, msg, err = initBoltBackend(dbFile, dbBkFile, bkPath)
 	}
 	if err != nil {
 		return nil, msg, err
 	}
 
 	// ensure our buckets are in place
-	err = boltdb.Update(func(tx *bolt.Tx) error {
+	err = backend.Update(func(tx dbTx) error {
 		_, errf := tx.CreateBucketIfNotExists(bucketJobsLive)
 		if errf != nil {
 			return fmt.Errorf("create bucket %s: %s", bucketJobsLive, errf)
@@ -269,10 +268,18 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		if errf != nil {
 			return fmt.Errorf("create bucket %s: %s", bucketRDTK, errf)
 		}
+		_, errf = tx.CreateBucketIfNotExists(bucketTTK)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketTTK, errf)
+		}
 		_, errf = tx.CreateBucketIfNotExists(bucketEnvs)
 		if errf != nil {
 			return fmt.Errorf("create bucket %s: %s", bucketEnvs, errf)
 		}
+		_, errf = tx.CreateBucketIfNotExists(bucketCmds)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketCmds, errf)
+		}
 		_, errf = tx.CreateBucketIfNotExists(bucketStdO)
 		if errf != nil {
 			return fmt.Errorf("create bucket %s: %s", bucketStdO, errf)
@@ -293,21 +300,145 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		if errf != nil {
 			return fmt.Errorf("create bucket %s: %s", bucketJobSecs, errf)
 		}
+		_, errf = tx.CreateBucketIfNotExists(bucketIdemKeys)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketIdemKeys, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketJobNames)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketJobNames, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketRepGroupRAM)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRepGroupRAM, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketRepGroupSecs)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRepGroupSecs, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketRepGroupAuto)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRepGroupAuto, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketRepGroupWin)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRepGroupWin, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketExcluded)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketExcluded, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketRepGroupRate)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRepGroupRate, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketRepGroupFail)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRepGroupFail, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketRepGroupHost)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRepGroupHost, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketBulkRemovals)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketBulkRemovals, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketBulkRmKeys)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketBulkRmKeys, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketUtilisation)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketUtilisation, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketEnrolled)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketEnrolled, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketPolicies)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketPolicies, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketRepGroupPol)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRepGroupPol, errf)
+		}
+
+		_, errf = tx.CreateBucketIfNotExists(bucketJobEvents)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketJobEvents, errf)
+		}
+
+		_, errf = tx.CreateBucketIfNotExists(bucketRGArchives)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRGArchives, errf)
+		}
+
+		_, errf = tx.CreateBucketIfNotExists(bucketTrash)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketTrash, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketUsage)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketUsage, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketSchedules)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketSchedules, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketWorkflows)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketWorkflows, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketQueueConfigs)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketQueueConfigs, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketSecrets)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketSecrets, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketSecretOwner)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketSecretOwner, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketTriageRules)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketTriageRules, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketServer)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketServer, errf)
+		}
 		return nil
 	})
 	if err != nil {
 		return nil, msg, err
 	}
 
+	// we stop writing if a standby with a later epoch takes over from us
+	epochs, err := newEpochBackend(backend)
+	if err != nil {
+		return nil, msg, err
+	}
+
 	// we will cache frequently used things to avoid actual db (disk) access
 	envcache, err := lru.NewARC(12) // we don't expect that many different ENVs to be in use at once
 	if err != nil {
 		return nil, msg, err
 	}
+	cmdcache, err := lru.NewARC(dbCmdCacheSize)
+	if err != nil {
+		return nil, msg, err
+	}
 
 	dbstruct := &db{
-		bolt:               boltdb,
+		backend:            epochs,
+		epochs:             epochs,
+		depIndex:           newDepIndex(),
 		envcache:           envcache,
+		cmdcache:           cmdcache,
 		ch:                 new(codec.BincHandle),
 		backupsEnabled:     backupsEnabled,
 		backupPath:         bkPath,
@@ -315,15 +446,166 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		backupWait:         minimumTimeBetweenBackups,
 		backupStopWait:     make(chan bool),
 		wg:                 &sync.WaitGroup{},
+		archivePendingKeys: make(map[string]*archiveEntry),
+		archiveFlushNow:    make(chan bool, 1),
+		archiveStop:        make(chan bool),
+		archiveStopped:     make(chan bool),
 		Logger:             l,
 	}
 	if fs != nil {
 		dbstruct.backupMount = fs
 	}
+	if sb, ok := backend.(*sqlBackend); ok {
+		sb.decodeJob = dbstruct.decodeJob
+	}
+
+	// store any jobs that were archived but not flushed before we last
+	// stopped
+	entries, err := dbstruct.openArchiveJournal(dbFile)
+	if err != nil {
+		return nil, msg, err
+	}
+	dbstruct.archiveSyncCond = &sync.Cond{}
+	dbstruct.archiveSyncCond.L = &dbstruct.archiveSyncMutex
+	dbstruct.archivePending = entries
+	for _, e := range entries {
+		dbstruct.archivePendingKeys[e.key] = e
+	}
+	dbstruct.archiveMutex.Lock()
+	err = dbstruct.rewriteArchiveJournal()
+	dbstruct.archiveMutex.Unlock()
+	if err != nil {
+		return nil, msg, err
+	}
+	flushed, err := dbstruct.flushArchived()
+	if err != nil {
+		return nil, msg, err
+	}
+	if flushed > 0 {
+		msg += fmt.Sprintf("; stored %d completed jobs from the archive journal", flushed)
+	}
+	dbstruct.startArchiveFlusher()
 
 	return dbstruct, msg, err
 }
 
+// initBoltBackend is used by initDB() to open our boltdb file, recreating it
+// from the backup at bkPath if it is missing or corrupt.
+func initBoltBackend(dbFile, dbBkFile, bkPath string) (dbBackend, string, error) {
+	var boltdb *boltBackend
+	var msg string
+	var err error
+	if _, err = os.Stat(dbFile); os.IsNotExist(err) {
+		if _, err = os.Stat(bkPath); os.IsNotExist(err) && hasDBSnapshots(bkPath) {
+			msg, err = restoreDBFromIncremental(dbFile, bkPath, time.Now())
+			if err != nil {
+				return nil, msg, err
+			}
+			boltdb, err = openBoltBackend(dbFile)
+			msg = "recreated missing db file from incremental backups: " + msg
+		} else if os.IsNotExist(err) {
+			boltdb, err = openBoltBackend(dbFile)
+			msg = "created new empty db file " + dbFile
+		} else {
+			err = copyFile(bkPath, dbFile)
+			if err != nil {
+				return nil, msg, err
+			}
+			boltdb, err = openBoltBackend(dbFile)
+			msg = "recreated missing db file " + dbFile + " from backup file " + dbBkFile
+		}
+	} else {
+		boltdb, err = openBoltBackend(dbFile)
+		if err != nil {
+			// try the backup
+			if _, errbk := os.Stat(dbBkFile); errbk == nil {
+				boltdb, errbk = openBoltBackend(bkPath)
+				if errbk == nil {
+					origerr := err
+					msg = fmt.Sprintf("tried to recreate corrupt (?) db file %s from backup file %s (error with original db file was: %s)", dbFile, dbBkFile, err)
+					err = os.Remove(dbFile)
+					if err != nil {
+						return nil, msg, err
+					}
+					err = copyFile(bkPath, dbFile)
+					if err != nil {
+						return nil, msg, err
+					}
+					boltdb, err = openBoltBackend(dbFile)
+					msg = fmt.Sprintf("recreated corrupt (?) db file %s from backup file %s (error with original db file was: %s)", dbFile, dbBkFile, origerr)
+				}
+			} else if hasDBSnapshots(bkPath) {
+				origerr := err
+				msg, err = restoreDBFromIncremental(dbFile, bkPath, time.Now())
+				if err != nil {
+					return nil, msg, err
+				}
+				boltdb, err = openBoltBackend(dbFile)
+				msg = fmt.Sprintf("recreated corrupt (?) db file from incremental backups: %s (error with original db file was: %s)", msg, origerr)
+			}
+		}
+	}
+	if err != nil {
+		return nil, msg, err
+	}
+	return boltdb, msg, nil
+}
+
+// mountDBBackup is used by initDB() and RestoreDB() to mount dbBkFile if it is
+// an S3 url (specified like: s3://[profile@]bucket/path/file) in the same
+// directory as dbFile, returning the local path to the backup file within the
+// mount, and the mount itself. Otherwise, dbBkFile is returned as is, with a
+// nil mount.
+func mountDBBackup(dbFile, dbBkFile, deployment string, l log15.Logger) (string, *muxfys.MuxFys, error) {
+	if !internal.InS3(dbBkFile) {
+		return dbBkFile, nil, nil
+	}
+	if deployment == internal.Development {
+		dbBkFile += "." + deployment
+	}
+	path := strings.TrimPrefix(dbBkFile, internal.S3Prefix)
+	pp := strings.Split(path, "@")
+	profile := "default"
+	if len(pp) == 2 {
+		profile = pp[0]
+		path = pp[1]
+	}
+	base := filepath.Base(path)
+	path = filepath.Dir(path)
+
+	mnt := filepath.Join(filepath.Dir(dbFile), ".db_bk_mount", path)
+	bkPath := filepath.Join(mnt, base)
+
+	accessorConfig, err := muxfys.S3ConfigFromEnvironment(profile, path)
+	if err != nil {
+		return "", nil, err
+	}
+	accessor, err := muxfys.NewS3Accessor(accessorConfig)
+	if err != nil {
+		return "", nil, err
+	}
+	remoteConfig := &muxfys.RemoteConfig{
+		Accessor: accessor,
+		Write:    true,
+	}
+	muxfys.SetLogHandler(l.GetHandler())
+
+	cfg := &muxfys.Config{
+		Mount:   mnt,
+		Retries: 10,
+	}
+	fs, err := muxfys.New(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	err = fs.Mount(remoteConfig)
+	if err != nil {
+		return "", nil, err
+	}
+	fs.UnmountOnDeath()
+	return bkPath, fs, nil
+}
+
 // storeLimitGroups stores a mapping of group names to unsigned ints in a
 // dedicated bucket. If a group was already in the database, and it had a
 // different value, that group name will be returned in the changed slice. If
@@ -331,7 +613,7 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 // database; any existing entry is removed and the name is returned in the
 // removed slice.
 func (db *db) storeLimitGroups(limitGroups map[string]int) (changed []string, removed []string, err error) {
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
+	err = db.backend.Batch(func(tx dbTx) error {
 		b := tx.Bucket(bucketLGs)
 
 		for group, limit := range limitGroups {
@@ -379,6 +661,73 @@ func (db *db) retrieveLimitGroup(group string) int {
 	return int(binary.BigEndian.Uint64(v))
 }
 
+// retrieveLimitGroups gets all the groups and their limits that were stored
+// with storeLimitGroups().
+func (db *db) retrieveLimitGroups() (map[string]int, error) {
+	limitGroups := make(map[string]int)
+	err := db.backend.View(func(tx dbTx) error {
+		return tx.Bucket(bucketLGs).ForEach(func(k, v []byte) error {
+			limitGroups[string(k)] = int(binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+	return limitGroups, err
+}
+
+// claimIdempotencyKeys goes through the given jobs, and for those with an
+// IdempotencyKey that hasn't been claimed before (by an earlier call, or an
+// earlier job in the slice), records the IdempotencyKey as claimed. Returns the
+// jobs that either have no IdempotencyKey or that made a new claim, along with
+// the keys claimed and the number of jobs that were skipped because their
+// IdempotencyKey had already been claimed.
+func (db *db) claimIdempotencyKeys(jobs []*Job) (fresh []*Job, claimed []string, skipped int, err error) {
+	err = db.backend.Update(func(tx dbTx) error {
+		fresh, claimed, skipped = nil, nil, 0
+		b := tx.Bucket(bucketIdemKeys)
+		for _, job := range jobs {
+			job.RLock()
+			idemKey := job.IdempotencyKey
+			job.RUnlock()
+			if idemKey == "" {
+				fresh = append(fresh, job)
+				continue
+			}
+
+			if b.Get([]byte(idemKey)) != nil {
+				skipped++
+				continue
+			}
+
+			errp := b.Put([]byte(idemKey), []byte(job.Key()))
+			if errp != nil {
+				return errp
+			}
+			claimed = append(claimed, idemKey)
+			fresh = append(fresh, job)
+		}
+		return nil
+	})
+	return fresh, claimed, skipped, err
+}
+
+// releaseIdempotencyKeys undoes claimIdempotencyKeys() for the given keys, for
+// when the claiming jobs failed to be added after all.
+func (db *db) releaseIdempotencyKeys(idemKeys []string) error {
+	if len(idemKeys) == 0 {
+		return nil
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketIdemKeys)
+		for _, idemKey := range idemKeys {
+			errd := b.Delete([]byte(idemKey))
+			if errd != nil {
+				return errd
+			}
+		}
+		return nil
+	})
+}
+
 // storeNewJobs stores jobs in the live bucket, where they will only be used for
 // disaster recovery. It also stores a lookup from the Job.RepGroup to the Job's
 // key, and since this is independent, and we call this prior to checking for
@@ -398,6 +747,10 @@ func (db *db) retrieveLimitGroup(group string) int {
 // (currently queued), it will be returned in the jobsToUpdate slice: you should
 // use queue methods to update the job in the queue.
 //
+// Batches of up to dbMaxSingleTxnJobs jobs (such as those sent by Client.Add())
+// are stored in a single transaction; larger numbers are stored in parallel
+// batches.
+//
 // Finally, it triggers a background database backup.
 func (db *db) storeNewJobs(jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, jobsToUpdate []*Job, alreadyAdded int, err error) {
 	encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err := db.prepareNewJobs(jobs, ignoreAdded)
@@ -406,7 +759,37 @@ func (db *db) storeNewJobs(jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, j
 		return jobsToQueue, jobsToUpdate, alreadyAdded, err
 	}
 
-	if len(encodedJobs) > 0 {
+	if len(encodedJobs) > 0 && len(encodedJobs) <= dbMaxSingleTxnJobs {
+		sort.Sort(rgLookups)
+		sort.Sort(rgs)
+		sort.Sort(dgLookups)
+		sort.Sort(rdgLookups)
+		sort.Sort(encodedJobs)
+
+		err = db.backend.Batch(func(tx dbTx) error {
+			errs := db.putLookups(tx, bucketRTK, rgLookups)
+			if errs != nil {
+				return errs
+			}
+
+			errs = db.putLookups(tx, bucketRGs, rgs)
+			if errs != nil {
+				return errs
+			}
+
+			errs = db.putLookups(tx, bucketDTK, dgLookups)
+			if errs != nil {
+				return errs
+			}
+
+			errs = db.putLookups(tx, bucketRDTK, rdgLookups)
+			if errs != nil {
+				return errs
+			}
+
+			return db.putEncodedJobs(tx, bucketJobsLive, encodedJobs)
+		})
+	} else if len(encodedJobs) > 0 {
 		// now go ahead and store the lookups and jobs
 		numStores := 2
 		if len(rgs) > 0 {
@@ -490,20 +873,42 @@ func (db *db) storeNewJobs(jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, j
 	// non-existent jobs based on lookups that shouldn't be there, they are
 	// silently skipped)
 
-	if err == nil && alreadyAdded != len(jobs) {
-		db.backgroundBackup()
+	if err == nil {
+		err = db.storeTagLookups(jobsToQueue)
+	}
+
+	if err == nil {
+		db.indexStoredJobs(jobsToQueue, encodedJobs)
+		if alreadyAdded != len(jobs) {
+			db.backgroundBackup()
+		}
 	}
 
 	return jobsToQueue, jobsToUpdate, alreadyAdded, err
 }
 
+// indexStoredJobs adds those of the given jobs that were just stored in the
+// live bucket (ie. are in the given encodedJobs) to our depIndex.
+func (db *db) indexStoredJobs(jobs []*Job, encodedJobs sobsd) {
+	stored := make(map[string]bool, len(encodedJobs))
+	for _, bsd := range encodedJobs {
+		stored[string(bsd[0])] = true
+	}
+	for _, job := range jobs {
+		if stored[job.Key()] {
+			db.depIndex.addJob(job)
+		}
+	}
+}
+
 func (db *db) prepareNewJobs(jobs []*Job, ignoreAdded bool) (encodedJobs, rgLookups, dgLookups, rdgLookups, rgs sobsd, jobsToQueue []*Job, jobsToUpdate []*Job, alreadyAdded int, err error) {
+	db.flushArchivedBeforeAdding(jobs, ignoreAdded)
 	// turn the jobs in to sobsd and sort by their keys, likewise for the
 	// lookups
 	repGroups := make(map[string]bool)
 	depGroups := make(map[string]bool)
 	newJobKeys := make(map[string]bool)
-	var keptJobs []*Job
+	var keptJobs, jobsToEncode []*Job
 	for _, job := range jobs {
 		keyStr := job.Key()
 
@@ -539,15 +944,13 @@ func (db *db) prepareNewJobs(jobs []*Job, ignoreAdded bool) (encodedJobs, rgLook
 		}
 		job.RUnlock()
 
-		var encoded []byte
-		enc := codec.NewEncoderBytes(&encoded, db.ch)
-		job.RLock()
-		err = enc.Encode(job)
-		job.RUnlock()
-		if err != nil {
-			return encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
-		}
-		encodedJobs = append(encodedJobs, [2][]byte{key, encoded})
+		encodedJobs = append(encodedJobs, [2][]byte{key, nil})
+		jobsToEncode = append(jobsToEncode, job)
+	}
+
+	err = db.encodeJobs(jobsToEncode, encodedJobs)
+	if err != nil {
+		return encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
 	}
 
 	if len(encodedJobs) > 0 {
@@ -565,9 +968,8 @@ func (db *db) prepareNewJobs(jobs []*Job, ignoreAdded bool) (encodedJobs, rgLook
 			for _, job := range jobsToQueue {
 				key := []byte(job.Key())
 				var encoded []byte
-				enc := codec.NewEncoderBytes(&encoded, db.ch)
 				job.RLock()
-				err = enc.Encode(job)
+				encoded, err = db.encodeJob(job)
 				job.RUnlock()
 				if err != nil {
 					return encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
@@ -592,6 +994,100 @@ func (db *db) prepareNewJobs(jobs []*Job, ignoreAdded bool) (encodedJobs, rgLook
 	return encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
 }
 
+// encodeJobs encodes the given jobs with encodeJob(), storing the results in
+// the second element of the corresponding encoded entries. Since encoding is
+// the most expensive part of adding jobs, it is spread over all our CPUs.
+func (db *db) encodeJobs(jobs []*Job, encoded sobsd) error {
+	workers := runtime.NumCPU()
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(jobs); i += workers {
+				jobs[i].RLock()
+				enc, err := db.encodeJob(jobs[i])
+				jobs[i].RUnlock()
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				encoded[i][1] = enc
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dbStoredJob is how a Job is stored when its Cmd has been stored separately
+// by storeCmds(): our Cmd is shallower than the Job's own, so replaces it in the
+// encoding, and is left empty in favour of the key of the stored Cmd.
+type dbStoredJob struct {
+	*Job
+	Cmd    string `codec:",omitempty"`
+	CmdKey string `codec:",omitempty"`
+}
+
+// encodeJob encodes and compresses a job for storage in the live or complete
+// buckets. If the job's Cmd was stored by storeCmds(), only its key is stored
+// with the job, so that a Cmd shared by many jobs is only stored once, like
+// their Env. You must hold the job's read lock when calling this.
+func (db *db) encodeJob(job *Job) ([]byte, error) {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	var err error
+	if job.cmdKey != "" {
+		err = enc.Encode(&dbStoredJob{Job: job, CmdKey: job.cmdKey})
+	} else {
+		err = enc.Encode(job)
+	}
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compressFast(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(dbCompressedJobPrefix), compressed...), nil
+}
+
+// decodeJob decodes a job stored by encodeJob(). Uncompressed jobs stored by
+// older versions of wr are also handled. If you're calling this from within a
+// transaction, supply it, since we may need to look up the job's Cmd.
+func (db *db) decodeJob(tx dbTx, encoded []byte) (*Job, error) {
+	if bytes.HasPrefix(encoded, []byte(dbCompressedJobPrefix)) {
+		decompressed, err := decompress(encoded[len(dbCompressedJobPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		encoded = decompressed
+	}
+	dec := codec.NewDecoderBytes(encoded, db.ch)
+	job := &Job{}
+	stored := &dbStoredJob{Job: job}
+	err := dec.Decode(stored)
+	if err != nil {
+		return job, err
+	}
+	if stored.CmdKey == "" {
+		job.Cmd = stored.Cmd
+		return job, nil
+	}
+	job.Cmd, err = db.retrieveCmd(tx, stored.CmdKey)
+	job.cmdKey = stored.CmdKey
+	return job, err
+}
+
 // generateLookupKey creates a lookup key understood by the retrieval methods,
 // concatenating prefix with a delimiter and the job key.
 func (db *db) generateLookupKey(prefix string, jobKey []byte) []byte {
@@ -602,8 +1098,11 @@ func (db *db) generateLookupKey(prefix string, jobKey []byte) []byte {
 // checkIfLive tells you if a job with the given key is currently in the live
 // bucket.
 func (db *db) checkIfLive(key string) (bool, error) {
+	if db.archivedPending(key) != nil {
+		return false, nil
+	}
 	var isLive bool
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.backend.View(func(tx dbTx) error {
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		if newJobBucket.Get([]byte(key)) != nil {
 			isLive = true
@@ -616,8 +1115,11 @@ func (db *db) checkIfLive(key string) (bool, error) {
 // checkIfAdded tells you if a job with the given key is currently in the
 // complete bucket or the live bucket.
 func (db *db) checkIfAdded(key string) (bool, error) {
+	if db.archivedPending(key) != nil {
+		return true, nil
+	}
 	var isInDB bool
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.backend.View(func(tx dbTx) error {
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		completeJobBucket := tx.Bucket(bucketJobsComplete)
 		if newJobBucket.Get([]byte(key)) != nil || completeJobBucket.Get([]byte(key)) != nil {
@@ -634,60 +1136,24 @@ func (db *db) checkIfAdded(key string) (bool, error) {
 // Also does what updateJobAfterExit does, except for the storage of any new
 // stdout/err.
 //
+// The database changes are buffered and journalled, being stored in a single
+// transaction with other recently archived jobs by flushArchived(); this makes
+// bursts of completions much faster. A backgroundBackup() is triggered after
+// the flush.
+//
 // The key you supply must be the key of the job you supply, or bad things will
-// happen - no checking is done! A backgroundBackup() is triggered afterwards.
+// happen - no checking is done!
 func (db *db) archiveJob(key string, job *Job) error {
-	var encoded []byte
-	enc := codec.NewEncoderBytes(&encoded, db.ch)
 	job.RLock()
-	err := enc.Encode(job)
+	entry, err := db.newArchiveEntry(key, job)
 	job.RUnlock()
 	if err != nil {
 		return err
 	}
-
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
-		bo := tx.Bucket(bucketStdO)
-		be := tx.Bucket(bucketStdE)
-		key := []byte(key)
-		errf := bo.Delete(key)
-		if errf != nil {
-			return errf
-		}
-		errf = be.Delete(key)
-		if errf != nil {
-			return errf
-		}
-
-		b := tx.Bucket(bucketJobsLive)
-		errf = b.Delete(key)
-		if errf != nil {
-			return errf
-		}
-
-		b = tx.Bucket(bucketJobsComplete)
-		errf = b.Put(key, encoded)
-		if errf != nil {
-			return errf
-		}
-
-		b = tx.Bucket(bucketJobRAM)
-		errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, job.PeakRAM)), []byte(strconv.Itoa(job.PeakRAM)))
-		if errf != nil {
-			return errf
-		}
-		b = tx.Bucket(bucketJobDisk)
-		errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, job.PeakDisk)), []byte(strconv.Itoa(int(job.PeakDisk))))
-		if errf != nil {
-			return errf
-		}
-		b = tx.Bucket(bucketJobSecs)
-		secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
-		return b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, secs)), []byte(strconv.Itoa(secs)))
-	})
-
-	db.backgroundBackup()
-
+	err = db.bufferArchive(entry)
+	if err == nil {
+		db.depIndex.remove(key)
+	}
 	return err
 }
 
@@ -695,19 +1161,25 @@ func (db *db) archiveJob(key string, job *Job) error {
 // added in error.
 func (db *db) deleteLiveJob(key string) {
 	db.remove(bucketJobsLive, key)
+	db.depIndex.remove(key)
 	db.backgroundBackup()
 	//*** we're not removing the lookup entries from the bucket*TK buckets...
 }
 
 // deleteLiveJobs remove multiple jobs from the live bucket.
 func (db *db) deleteLiveJobs(keys []string) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
+	db.flushArchivedBeforeRead()
+	err := db.backend.Batch(func(tx dbTx) error {
 		b := tx.Bucket(bucketJobsLive)
 		for _, key := range keys {
 			errd := b.Delete([]byte(key))
 			if errd != nil {
 				return errd
 			}
+			errd = db.deleteJobEvents(tx, key)
+			if errd != nil {
+				return errd
+			}
 		}
 		return nil
 	})
@@ -716,12 +1188,114 @@ func (db *db) deleteLiveJobs(keys []string) error {
 		return err
 	}
 
+	for _, key := range keys {
+		db.depIndex.remove(key)
+	}
+
 	db.backgroundBackup()
 	//*** we're not removing the lookup entries from the bucket*TK buckets...
 
 	return nil
 }
 
+// trashLiveJobs moves the given jobs, which must have had their Trashed time
+// set, from the live bucket to the trash bucket, keeping their events, so
+// that they can be restored until they are deleted with deleteTrashedJobs().
+func (db *db) trashLiveJobs(jobs []*Job) error {
+	encodes := make(sobsd, 0, len(jobs))
+	for _, job := range jobs {
+		job.RLock()
+		encoded, err := db.encodeJob(job)
+		job.RUnlock()
+		if err != nil {
+			return err
+		}
+		encodes = append(encodes, [2][]byte{[]byte(job.Key()), encoded})
+	}
+
+	db.flushArchivedBeforeRead()
+	err := db.backend.Batch(func(tx dbTx) error {
+		bl := tx.Bucket(bucketJobsLive)
+		bt := tx.Bucket(bucketTrash)
+		for _, encode := range encodes {
+			if errd := bl.Delete(encode[0]); errd != nil {
+				return errd
+			}
+			if errp := bt.Put(encode[0], encode[1]); errp != nil {
+				return errp
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, encode := range encodes {
+		db.depIndex.remove(string(encode[0]))
+	}
+
+	db.backgroundBackup()
+	return nil
+}
+
+// retrieveTrashedJobs gets the jobs stored with trashLiveJobs() that have one
+// of the given keys, or all of them if no keys are supplied.
+func (db *db) retrieveTrashedJobs(keys ...string) ([]*Job, error) {
+	var jobs []*Job
+	err := db.backend.View(func(tx dbTx) error {
+		b := tx.Bucket(bucketTrash)
+		decode := func(encoded []byte) error {
+			job, errd := db.decodeJob(tx, encoded)
+			if errd != nil {
+				return errd
+			}
+			job.State = JobStateTrashed
+			jobs = append(jobs, job)
+			return nil
+		}
+
+		if len(keys) == 0 {
+			return b.ForEach(func(k, v []byte) error {
+				return decode(v)
+			})
+		}
+		for _, key := range keys {
+			if v := b.Get([]byte(key)); v != nil {
+				if errd := decode(v); errd != nil {
+					return errd
+				}
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// deleteTrashedJobs deletes the jobs with the given keys from the trash
+// bucket, along with their events if withEvents is true.
+func (db *db) deleteTrashedJobs(keys []string, withEvents bool) error {
+	err := db.backend.Batch(func(tx dbTx) error {
+		b := tx.Bucket(bucketTrash)
+		for _, key := range keys {
+			if errd := b.Delete([]byte(key)); errd != nil {
+				return errd
+			}
+			if withEvents {
+				if errd := db.deleteJobEvents(tx, key); errd != nil {
+					return errd
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.backgroundBackup()
+	return nil
+}
+
 // recoverIncompleteJobs returns all jobs in the live bucket, for use when
 // restarting the server, allowing you start working on any jobs that were
 // stored with storeNewJobs() but not yet archived with archiveJob().
@@ -730,17 +1304,17 @@ func (db *db) deleteLiveJobs(keys []string) error {
 // The state is recorded when a job starts to run, when it exits, and when it
 // is kicked.
 func (db *db) recoverIncompleteJobs() ([]*Job, error) {
+	db.flushArchivedBeforeRead()
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.backend.View(func(tx dbTx) error {
 		b := tx.Bucket(bucketJobsLive)
 		return b.ForEach(func(key, encoded []byte) error {
 			if encoded != nil {
-				dec := codec.NewDecoderBytes(encoded, db.ch)
-				job := &Job{}
-				errf := dec.Decode(job)
+				job, errf := db.decodeJob(tx, encoded)
 				if errf != nil {
 					return errf
 				}
+				db.depIndex.addJob(job)
 				jobs = append(jobs, job)
 			}
 			return nil
@@ -752,15 +1326,26 @@ func (db *db) recoverIncompleteJobs() ([]*Job, error) {
 // retrieveCompleteJobsByKeys gets jobs with the given keys from the completed
 // jobs bucket (ie. those that have gone through the queue and been Remove()d).
 func (db *db) retrieveCompleteJobsByKeys(keys []string) ([]*Job, error) {
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	pending := db.archivedPendingWhere(func(e *archiveEntry) bool {
+		return wanted[e.key]
+	})
+
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.backend.View(func(tx dbTx) error {
 		b := tx.Bucket(bucketJobsComplete)
 		for _, key := range keys {
-			encoded := b.Get([]byte(key))
+			var encoded []byte
+			if e, isPending := pending[key]; isPending {
+				encoded = e.encoded
+			} else {
+				encoded = b.Get([]byte(key))
+			}
 			if encoded != nil {
-				dec := codec.NewDecoderBytes(encoded, db.ch)
-				job := &Job{}
-				err := dec.Decode(job)
+				job, err := db.decodeJob(tx, encoded)
 				if err == nil {
 					jobs = append(jobs, job)
 				}
@@ -771,10 +1356,46 @@ func (db *db) retrieveCompleteJobsByKeys(keys []string) ([]*Job, error) {
 	return jobs, err
 }
 
+// addCompleteJobArtifacts merges the given Artifacts in to those of the job
+// with the given key in the completed jobs bucket, returning the job's
+// resulting Artifacts. Returns nil if there is no such complete job.
+func (db *db) addCompleteJobArtifacts(key string, artifacts []*Artifact) ([]*Artifact, error) {
+	db.flushArchivedBeforeRead()
+	var merged []*Artifact
+	err := db.backend.Batch(func(tx dbTx) error {
+		merged = nil
+		b := tx.Bucket(bucketJobsComplete)
+		encoded := b.Get([]byte(key))
+		if encoded == nil {
+			return nil
+		}
+		job, err := db.decodeJob(tx, encoded)
+		if err != nil {
+			return err
+		}
+		job.Artifacts = mergeArtifacts(job.Artifacts, artifacts)
+		encoded, err = db.encodeJob(job)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(key), encoded)
+		if err != nil {
+			return err
+		}
+		merged = job.Artifacts
+		return nil
+	})
+	if err != nil || merged == nil {
+		return nil, err
+	}
+	db.backgroundBackup()
+	return merged, nil
+}
+
 // retrieveRepGroups gets the rep groups of all jobs that have ever been added.
 func (db *db) retrieveRepGroups() ([]string, error) {
 	var rgs []string
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.backend.View(func(tx dbTx) error {
 		b := tx.Bucket(bucketRGs)
 		return b.ForEach(func(k, v []byte) error {
 			rgs = append(rgs, string(k))
@@ -789,19 +1410,18 @@ func (db *db) retrieveRepGroups() ([]string, error) {
 // Archive()d), but not those that are also currently live (ie. are being
 // re-run).
 func (db *db) retrieveCompleteJobsByRepGroup(repgroup string) ([]*Job, error) {
+	pending := db.archivedPendingWhere(nil)
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.backend.View(func(tx dbTx) error {
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		completeJobBucket := tx.Bucket(bucketJobsComplete)
 		lookupBucket := tx.Bucket(bucketRTK).Cursor()
 		prefix := []byte(repgroup + dbDelimiter)
 		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
 			key := bytes.TrimPrefix(k, prefix)
-			encoded := completeJobBucket.Get(key)
-			if len(encoded) > 0 && newJobBucket.Get(key) == nil {
-				dec := codec.NewDecoderBytes(encoded, db.ch)
-				job := &Job{}
-				err := dec.Decode(job)
+			encoded, isLive := completeAndLive(pending, newJobBucket, completeJobBucket, key)
+			if len(encoded) > 0 && !isLive {
+				job, err := db.decodeJob(tx, encoded)
 				if err != nil {
 					return err
 				}
@@ -813,12 +1433,149 @@ func (db *db) retrieveCompleteJobsByRepGroup(repgroup string) ([]*Job, error) {
 	return jobs, err
 }
 
+// storeTagLookups adds the Tags of the given jobs to our tag index, so that
+// complete jobs can be retrieved by their tags.
+func (db *db) storeTagLookups(jobs []*Job) error {
+	var lookups sobsd
+	for _, job := range jobs {
+		key := []byte(job.Key())
+		job.RLock()
+		for tagKey, tagVal := range job.Tags {
+			lookups = append(lookups, [2][]byte{db.generateLookupKey(tagLookup(tagKey, tagVal), key), nil})
+		}
+		job.RUnlock()
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
+	sort.Sort(lookups)
+	return db.storeBatched(bucketTTK, lookups, db.storeLookups)
+}
+
+// retrieveCompleteJobsByTags gets jobs with all the given tags from the
+// completed jobs bucket, but not those that are also currently live.
+func (db *db) retrieveCompleteJobsByTags(tags map[string]string) ([]*Job, error) {
+	// we look up the jobs with any one of the tags in our index, then check
+	// they have the rest
+	var prefix []byte
+	for tagKey, tagVal := range tags {
+		prefix = []byte(tagLookup(tagKey, tagVal) + dbDelimiter)
+		break
+	}
+
+	pending := db.archivedPendingWhere(nil)
+	var jobs []*Job
+	err := db.backend.View(func(tx dbTx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		completeJobBucket := tx.Bucket(bucketJobsComplete)
+		lookupBucket := tx.Bucket(bucketTTK).Cursor()
+		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
+			key := bytes.TrimPrefix(k, prefix)
+			encoded, isLive := completeAndLive(pending, newJobBucket, completeJobBucket, key)
+			if len(encoded) == 0 || isLive {
+				continue
+			}
+			job, err := db.decodeJob(tx, encoded)
+			if err != nil {
+				return err
+			}
+			if tagsMatch(job.Tags, tags) {
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// retrieveCompleteTagCounts counts the complete jobs that aren't also live in
+// our tag index, returning the counts keyed on tagLookup().
+func (db *db) retrieveCompleteTagCounts() (map[string]int, error) {
+	pending := db.archivedPendingWhere(nil)
+	counts := make(map[string]int)
+	err := db.backend.View(func(tx dbTx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		completeJobBucket := tx.Bucket(bucketJobsComplete)
+		return tx.Bucket(bucketTTK).ForEach(func(k, v []byte) error {
+			i := bytes.LastIndex(k, []byte(dbDelimiter))
+			if i == -1 {
+				return nil
+			}
+			key := k[i+len(dbDelimiter):]
+			encoded, isLive := completeAndLive(pending, newJobBucket, completeJobBucket, key)
+			if encoded == nil || isLive {
+				return nil
+			}
+			counts[string(k[:i])]++
+			return nil
+		})
+	})
+	return counts, err
+}
+
+// completeAndLive returns the encoded complete job with the given key (nil if
+// it isn't complete), and whether it is also live, treating the given buffered
+// entries as complete and not live.
+func completeAndLive(pending map[string]*archiveEntry, liveBucket, completeBucket dbBucket, key []byte) ([]byte, bool) {
+	if e, isPending := pending[string(key)]; isPending {
+		return e.encoded, false
+	}
+	return completeBucket.Get(key), liveBucket.Get(key) != nil
+}
+
+// walkCompleteJobs calls the given function on every job in the completed jobs
+// bucket, decoding them one at a time so that they don't all have to be held
+// in memory at once.
+func (db *db) walkCompleteJobs(fn func(*Job)) error {
+	pending := db.archivedPendingWhere(nil)
+	for _, e := range pending {
+		job, err := db.decodeJob(nil, e.encoded)
+		if err != nil {
+			return err
+		}
+		fn(job)
+	}
+
+	return db.backend.View(func(tx dbTx) error {
+		return tx.Bucket(bucketJobsComplete).ForEach(func(k, v []byte) error {
+			if _, isPending := pending[string(k)]; isPending {
+				return nil
+			}
+			job, err := db.decodeJob(tx, v)
+			if err != nil {
+				return err
+			}
+			fn(job)
+			return nil
+		})
+	})
+}
+
 // retrieveDependentJobs gets previously stored jobs that had a dependency on
 // one for the input depGroups. If the job is found in the live bucket, then it
 // is returned in the jobsToUpdate return value. If it is found in the complete
 // bucket, and is not true in the supplied newJobKeys map, then it is returned
 // in the jobsToQueue return value.
 func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[string]bool) (jobsToQueue []*Job, jobsToUpdate []*Job, err error) {
+	// we're going to store the jobs we find, so if any of them are buffered
+	// completed jobs they must be stored first, or the flush would undo us
+	for {
+		pending := db.archivedPendingWhere(nil)
+		jobsToQueue, jobsToUpdate, err = db.findDependentJobs(depGroups, newJobKeys, pending)
+		if err != errArchivedPending {
+			return jobsToQueue, jobsToUpdate, err
+		}
+		_, err = db.flushArchived()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// findDependentJobs is the implementation of retrieveDependentJobs(). It
+// returns errArchivedPending if a dependent job is one of the given buffered
+// entries.
+func (db *db) findDependentJobs(depGroups map[string]bool, newJobKeys map[string]bool, pending map[string]*archiveEntry) (jobsToQueue []*Job, jobsToUpdate []*Job, err error) {
 	// first convert the depGroups in to sorted prefixes, for linear searching
 	prefixes := make(sobsd, 0, len(depGroups))
 	for depGroup := range depGroups {
@@ -826,7 +1583,7 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 	}
 	sort.Sort(prefixes)
 
-	err = db.bolt.View(func(tx *bolt.Tx) error {
+	err = db.backend.View(func(tx dbTx) error {
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		completeJobBucket := tx.Bucket(bucketJobsComplete)
 		lookupBucket := tx.Bucket(bucketRDTK).Cursor()
@@ -840,6 +1597,9 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 					if doneKeys[keyStr] {
 						continue
 					}
+					if _, isPending := pending[keyStr]; isPending {
+						return errArchivedPending
+					}
 
 					encoded := newJobBucket.Get(key)
 					live := false
@@ -850,9 +1610,7 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 					}
 
 					if len(encoded) > 0 {
-						dec := codec.NewDecoderBytes(encoded, db.ch)
-						job := &Job{}
-						errf := dec.Decode(job)
+						job, errf := db.decodeJob(tx, encoded)
 						if errf != nil {
 							return errf
 						}
@@ -894,24 +1652,12 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 	return jobsToQueue, jobsToUpdate, err
 }
 
-// retrieveIncompleteJobKeysByDepGroup gets jobs with the given DepGroup from
-// the live bucket (ie. those that have been added to the queue and not yet
-// Archive()d - even if they've been added and archived in the past).
+// retrieveIncompleteJobKeysByDepGroup gets the keys of jobs with the given
+// DepGroup in the live bucket (ie. those that have been added to the queue and
+// not yet Archive()d - even if they've been added and archived in the past).
+// This uses our in-memory depIndex, so doesn't actually touch the database.
 func (db *db) retrieveIncompleteJobKeysByDepGroup(depgroup string) ([]string, error) {
-	var jobKeys []string
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		lookupBucket := tx.Bucket(bucketDTK).Cursor()
-		prefix := []byte(depgroup + dbDelimiter)
-		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
-			key := bytes.TrimPrefix(k, prefix)
-			if newJobBucket.Get(key) != nil {
-				jobKeys = append(jobKeys, string(key))
-			}
-		}
-		return nil
-	})
-	return jobKeys, err
+	return db.depIndex.incompleteKeys(depgroup), nil
 }
 
 // storeEnv stores a clientRequest.Env in db unless cached, which means it must
@@ -928,22 +1674,102 @@ func (db *db) storeEnv(env []byte) (string, error) {
 	return envkey, nil
 }
 
-// retrieveEnv gets a value from the db that was stored with storeEnv(). The
-// value may come from the cache, avoiding db access.
-func (db *db) retrieveEnv(envkey string) []byte {
-	cached, got := db.envcache.Get(envkey)
-	if got {
-		return cached.([]byte)
+// storeCmds stores the Cmds of the given jobs that are long enough to be worth
+// sharing in the db, keyed by their hash, unless cached (which means they must
+// already be there), so that jobs with the same Cmd only store it once. Their
+// Cmds are also replaced with the cached copy, so that they share it in memory
+// too. Like Envs, stored Cmds are never removed.
+func (db *db) storeCmds(jobs []*Job) error {
+	keys := make([]string, len(jobs))
+	toStore := make(map[string]string)
+	for i, job := range jobs {
+		job.RLock()
+		cmd := job.Cmd
+		job.RUnlock()
+		if len(cmd) < dbSharedCmdMinLength {
+			continue
+		}
+		keys[i] = byteKey([]byte(cmd))
+		if _, stored := toStore[keys[i]]; !stored && !db.cmdcache.Contains(keys[i]) {
+			toStore[keys[i]] = cmd
+		}
 	}
 
-	envc := db.retrieve(bucketEnvs, envkey)
-	db.envcache.Add(envkey, envc)
-	return envc
-}
+	if len(toStore) > 0 {
+		err := db.backend.Batch(func(tx dbTx) error {
+			b := tx.Bucket(bucketCmds)
+			for key, cmd := range toStore {
+				if errp := b.Put([]byte(key), []byte(cmd)); errp != nil {
+					return errp
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, cmd := range toStore {
+			db.cmdcache.Add(key, cmd)
+		}
+	}
 
-// updateJobAfterExit stores the Job's peak RAM usage and wall time against the
-// Job's ReqGroup, but only if the job failed for using too much RAM or time,
-// allowing recommendedReqGroup*(ReqGroup) to work.
+	for i, job := range jobs {
+		if keys[i] == "" {
+			continue
+		}
+		cmd, cached := toStore[keys[i]]
+		if !cached {
+			if c, got := db.cmdcache.Get(keys[i]); got {
+				cmd, cached = c.(string), true
+			}
+		}
+		job.Lock()
+		if cached {
+			job.Cmd = cmd
+		}
+		job.cmdKey = keys[i]
+		job.Unlock()
+	}
+	return nil
+}
+
+// retrieveCmd gets a Cmd that was stored by storeCmds(), from the cache if
+// possible. If you're in a transaction, supply it, or nil otherwise.
+func (db *db) retrieveCmd(tx dbTx, key string) (string, error) {
+	if cached, got := db.cmdcache.Get(key); got {
+		return cached.(string), nil
+	}
+
+	var stored []byte
+	if tx == nil {
+		stored = db.retrieve(bucketCmds, key)
+	} else if b := tx.Bucket(bucketCmds); b != nil {
+		stored = b.Get([]byte(key))
+	}
+	if stored == nil {
+		return "", fmt.Errorf("stored cmd %s not found", key)
+	}
+	cmd := string(stored)
+	db.cmdcache.Add(key, cmd)
+	return cmd, nil
+}
+
+// retrieveEnv gets a value from the db that was stored with storeEnv(). The
+// value may come from the cache, avoiding db access.
+func (db *db) retrieveEnv(envkey string) []byte {
+	cached, got := db.envcache.Get(envkey)
+	if got {
+		return cached.([]byte)
+	}
+
+	envc := db.retrieve(bucketEnvs, envkey)
+	db.envcache.Add(envkey, envc)
+	return envc
+}
+
+// updateJobAfterExit stores the Job's peak RAM usage and wall time against the
+// Job's ReqGroup, but only if the job failed for using too much RAM or time,
+// allowing recommendedReqGroup*(ReqGroup) to work.
 //
 // So that state can be restored if the server crashes and is restarted, the
 // job is rewritten in its current state in to the live bucket.
@@ -960,8 +1786,6 @@ func (db *db) retrieveEnv(envkey string) []byte {
 // jobs and workflows that this works 100% of the time, we ignore errors and
 // write to bolt in a goroutine, giving us a significant speed boost.
 func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorage bool) {
-	var encoded []byte
-	enc := codec.NewEncoderBytes(&encoded, db.ch)
 	db.RLock()
 	defer db.RUnlock()
 	if db.closed {
@@ -971,11 +1795,12 @@ func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorag
 	job.RLock()
 	secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
 	jrg := job.ReqGroup
+	jrp := job.RepGroup
 	jpr := job.PeakRAM
 	jpd := job.PeakDisk
 	jec := job.Exitcode
 	jfr := job.FailReason
-	err := enc.Encode(job)
+	encoded, err := db.encodeJob(job)
 	job.RUnlock()
 	if err != nil {
 		db.Error("Database operation updateJobAfterExit failed due to Encode failure", "err", err)
@@ -992,7 +1817,7 @@ func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorag
 		db.Lock()
 		db.updatingAfterJobExit++
 		db.Unlock()
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
+		err := db.backend.Batch(func(tx dbTx) error {
 			key := []byte(jobkey)
 
 			bjl := tx.Bucket(bucketJobsLive)
@@ -1030,12 +1855,18 @@ func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorag
 			case FailReasonRAM:
 				b := tx.Bucket(bucketJobRAM)
 				errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, jpr)), []byte(strconv.Itoa(jpr)))
-			case FailReasonDisk:
+				if errf == nil {
+					errf = putRepGroupStat(tx.Bucket(bucketRepGroupRAM), jrp, jobkey, jpr)
+				}
+			case FailReasonDisk, FailReasonDiskUse:
 				b := tx.Bucket(bucketJobDisk)
 				errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, jpd)), []byte(strconv.Itoa(int(jpd))))
 			case FailReasonTime:
 				b := tx.Bucket(bucketJobSecs)
 				errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, secs)), []byte(strconv.Itoa(secs)))
+				if errf == nil {
+					errf = putRepGroupStat(tx.Bucket(bucketRepGroupSecs), jrp, jobkey, secs)
+				}
 			}
 			return errf
 		})
@@ -1052,8 +1883,6 @@ func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorag
 // complete recovery after a crash. This happens in a goroutine, since it isn't
 // essential this happens, and we benefit from the speed.
 func (db *db) updateJobAfterChange(job *Job) {
-	var encoded []byte
-	enc := codec.NewEncoderBytes(&encoded, db.ch)
 	db.RLock()
 	defer db.RUnlock()
 	if db.closed {
@@ -1061,7 +1890,7 @@ func (db *db) updateJobAfterChange(job *Job) {
 	}
 	key := []byte(job.Key())
 	job.RLock()
-	err := enc.Encode(job)
+	encoded, err := db.encodeJob(job)
 	job.RUnlock()
 	if err != nil {
 		db.Error("Database operation updateJobAfterChange failed due to Encode failure", "err", err)
@@ -1075,7 +1904,7 @@ func (db *db) updateJobAfterChange(job *Job) {
 		defer internal.LogPanic(db.Logger, "updateJobAfterChange", true)
 		defer db.wg.Done()
 
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
+		err := db.backend.Batch(func(tx dbTx) error {
 			bjl := tx.Bucket(bucketJobsLive)
 			if bjl.Get(key) == nil {
 				// it's possible for these batches to be interleaved with
@@ -1106,7 +1935,8 @@ func (db *db) updateJobAfterChange(job *Job) {
 // the old Key() of jobs[0]. This is so that any stdout/err of old jobs is
 // associated with the new jobs.
 func (db *db) modifyLiveJobs(oldKeys []string, jobs []*Job) error {
-	encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, _, _, _, err := db.prepareNewJobs(jobs, false)
+	db.flushArchivedBeforeRead()
+	encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, _, _, err := db.prepareNewJobs(jobs, false)
 	if err != nil {
 		return err
 	}
@@ -1116,9 +1946,9 @@ func (db *db) modifyLiveJobs(oldKeys []string, jobs []*Job) error {
 	sort.Sort(rdgLookups)
 	sort.Sort(encodedJobs)
 
-	lookupBuckets := [][]byte{bucketRTK, bucketDTK, bucketRDTK}
+	lookupBuckets := [][]byte{bucketRTK, bucketDTK, bucketRDTK, bucketTTK}
 
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
+	err = db.backend.Batch(func(tx dbTx) error {
 		// delete old jobs and their lookups
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		bo := tx.Bucket(bucketStdO)
@@ -1174,152 +2004,998 @@ func (db *db) modifyLiveJobs(oldKeys []string, jobs []*Job) error {
 			}
 		}
 
-		if len(encodedJobs) > 0 {
-			// now go ahead and store the new lookups and jobs
-			errs := db.putLookups(tx, bucketRTK, rgLookups)
-			if errs != nil {
-				return errs
+		if len(encodedJobs) > 0 {
+			// now go ahead and store the new lookups and jobs
+			errs := db.putLookups(tx, bucketRTK, rgLookups)
+			if errs != nil {
+				return errs
+			}
+
+			if len(rgs) > 0 {
+				errs = db.putLookups(tx, bucketRGs, rgs)
+				if errs != nil {
+					return errs
+				}
+			}
+
+			if len(dgLookups) > 0 {
+				errs = db.putLookups(tx, bucketDTK, dgLookups)
+				if errs != nil {
+					return errs
+				}
+			}
+
+			if len(rdgLookups) > 0 {
+				errs = db.putLookups(tx, bucketRDTK, rdgLookups)
+				if errs != nil {
+					return errs
+				}
+			}
+
+			if hadStd {
+				for i, job := range jobs {
+					if os[i] != nil {
+						errs = bo.Put([]byte(job.Key()), os[i])
+						if errs != nil {
+							return errs
+						}
+					}
+					if es[i] != nil {
+						errs = be.Put([]byte(job.Key()), es[i])
+						if errs != nil {
+							return errs
+						}
+					}
+				}
+			}
+
+			return db.putEncodedJobs(tx, bucketJobsLive, encodedJobs)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Error("Database error during modify", "err", err)
+	} else {
+		for _, oldKey := range oldKeys {
+			db.depIndex.remove(oldKey)
+		}
+		db.indexStoredJobs(jobsToQueue, encodedJobs)
+		err = db.storeTagLookups(jobs)
+		if err != nil {
+			db.Error("Database error storing tags during modify", "err", err)
+		}
+	}
+
+	go db.backgroundBackup()
+
+	return err
+}
+
+// retrieveJobStd gets the values that were stored using updateJobStd() for the
+// given job.
+func (db *db) retrieveJobStd(jobkey string) (stdo []byte, stde []byte) {
+	if db.archivedPending(jobkey) != nil {
+		// archiving removes the stored std
+		return nil, nil
+	}
+	// first wait for any existing updateJobAfterExit() calls to complete
+	//*** this method of waiting seems really bad and should be improved, but in
+	//    practice we probably never wait
+	for {
+		db.RLock()
+		if db.updatingAfterJobExit == 0 {
+			db.RUnlock()
+			break
+		}
+		db.RUnlock()
+		<-time.After(10 * time.Millisecond)
+	}
+
+	err := db.backend.View(func(tx dbTx) error {
+		bo := tx.Bucket(bucketStdO)
+		be := tx.Bucket(bucketStdE)
+		key := []byte(jobkey)
+		o := bo.Get(key)
+		if o != nil {
+			stdo = make([]byte, len(o))
+			copy(stdo, o)
+		}
+		e := be.Get(key)
+		if e != nil {
+			stde = make([]byte, len(e))
+			copy(stde, e)
+		}
+		return nil
+	})
+	if err != nil {
+		// impossible, but to keep the linter happy and incase things change in
+		// the future
+		db.Error("Database retrieve failed", "err", err)
+	}
+	return stdo, stde
+}
+
+// recommendedReqGroupMemory returns the 95th percentile peak memory usage of
+// all jobs that previously ran with the given reqGroup. If there are too few
+// prior values to calculate a 95th percentile, or if the 95th percentile is
+// very close to the maximum value, returns the maximum value instead. In either
+// case, the true value is rounded up to the nearest 100 MB. Returns 0 if there
+// are no prior values.
+func (db *db) recommendedReqGroupMemory(reqGroup string) (int, error) {
+	return db.recommendedReqGroupStat(bucketJobRAM, reqGroup, RecMBRound)
+}
+
+// recommendedReqGroupDisk returns the 95th percentile peak disk usage of
+// all jobs that previously ran with the given reqGroup. If there are too few
+// prior values to calculate a 95th percentile, or if the 95th percentile is
+// very close to the maximum value, returns the maximum value instead. In either
+// case, the true value is rounded up to the nearest 100 MB. Returns 0 if there
+// are no prior values.
+func (db *db) recommendedReqGroupDisk(reqGroup string) (int, error) {
+	return db.recommendedReqGroupStat(bucketJobDisk, reqGroup, RecMBRound)
+}
+
+// recommendReqGroupTime returns the 95th percentile wall time taken of all jobs
+// that previously ran with the given reqGroup. If there are too few prior
+// values to calculate a 95th percentile, or if the 95th percentile is very
+// close to the maximum value, returns the maximum value instead. In either
+// case, the true value is rounded up to the nearest 30mins (but returned in
+// seconds). Returns 0 if there are no prior values.
+func (db *db) recommendedReqGroupTime(reqGroup string) (int, error) {
+	return db.recommendedReqGroupStat(bucketJobSecs, reqGroup, RecSecRound)
+}
+
+// recommendedReqGroupStat is the implementation for the other recommend*()
+// methods.
+func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, roundAmount int) (int, error) {
+	recommendation, _, err := db.recommendedStat(statBucket, []byte(reqGroup), roundAmount)
+	return recommendation, err
+}
+
+// recommendedRepGroupMemory is like recommendedReqGroupMemory(), but considers
+// the jobs that previously ran with the given repGroup. It also returns the
+// number of jobs the recommendation was based on.
+func (db *db) recommendedRepGroupMemory(repGroup string) (int, int, error) {
+	return db.recommendedStat(bucketRepGroupRAM, []byte(repGroup+dbDelimiter), RecMBRound)
+}
+
+// recommendedRepGroupTime is like recommendedReqGroupTime(), but considers the
+// jobs that previously ran with the given repGroup. It also returns the number
+// of jobs the recommendation was based on.
+func (db *db) recommendedRepGroupTime(repGroup string) (int, int, error) {
+	return db.recommendedStat(bucketRepGroupSecs, []byte(repGroup+dbDelimiter), RecSecRound)
+}
+
+// putRepGroupStat stores a stat value for a job in the given per-RepGroup stat
+// bucket. Unlike the per-ReqGroup buckets, the job key is part of the db key,
+// so that every job counts as a separate value.
+func putRepGroupStat(b dbBucket, repGroup, jobKey string, val int) error {
+	return b.Put(repGroupStatKey(repGroup, jobKey, val), []byte(strconv.Itoa(val)))
+}
+
+// repGroupStatKey returns the key putRepGroupStat() stores the given value
+// under.
+func repGroupStatKey(repGroup, jobKey string, val int) []byte {
+	return []byte(fmt.Sprintf("%s%s%20d%s%s", repGroup, dbDelimiter, val, dbDelimiter, jobKey))
+}
+
+// storeRepGroupAutoApply records if recommendations for the given repGroup
+// should be automatically applied to its jobs. (By default they are.)
+func (db *db) storeRepGroupAutoApply(repGroup string, apply bool) error {
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupAuto)
+		if apply {
+			return b.Delete([]byte(repGroup))
+		}
+		return b.Put([]byte(repGroup), []byte{1})
+	})
+}
+
+// retrieveRepGroupAutoApply tells you if recommendations for the given
+// repGroup should be automatically applied to its jobs.
+func (db *db) retrieveRepGroupAutoApply(repGroup string) bool {
+	return db.retrieve(bucketRepGroupAuto, repGroup) == nil
+}
+
+// storeRepGroupRunWindow records the run window spec for the given repGroup,
+// or removes it if spec is blank.
+func (db *db) storeRepGroupRunWindow(repGroup, spec string) error {
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupWin)
+		if spec == "" {
+			return b.Delete([]byte(repGroup))
+		}
+		return b.Put([]byte(repGroup), []byte(spec))
+	})
+}
+
+// retrieveRepGroupRunWindows gets all the run window specs stored with
+// storeRepGroupRunWindow(), keyed on repGroup.
+func (db *db) retrieveRepGroupRunWindows() (map[string]string, error) {
+	windows := make(map[string]string)
+	err := db.backend.View(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupWin)
+		return b.ForEach(func(k, v []byte) error {
+			windows[string(k)] = string(v)
+			return nil
+		})
+	})
+	return windows, err
+}
+
+// storeRepGroupStartRate records the maximum starts per minute for the given
+// repGroup, or removes it if max is 0.
+func (db *db) storeRepGroupStartRate(repGroup string, max int) error {
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupRate)
+		if max <= 0 {
+			return b.Delete([]byte(repGroup))
+		}
+		return b.Put([]byte(repGroup), []byte(strconv.Itoa(max)))
+	})
+}
+
+// retrieveRepGroupStartRates gets all the start rates stored with
+// storeRepGroupStartRate(), keyed on repGroup.
+func (db *db) retrieveRepGroupStartRates() (map[string]int, error) {
+	rates := make(map[string]int)
+	err := db.backend.View(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupRate)
+		return b.ForEach(func(k, v []byte) error {
+			max, err := strconv.Atoi(string(v))
+			if err != nil {
+				return err
+			}
+			rates[string(k)] = max
+			return nil
+		})
+	})
+	return rates, err
+}
+
+// storeRepGroupFailRules records the FailRules for the given repGroup, or
+// removes them if rules is empty.
+func (db *db) storeRepGroupFailRules(repGroup string, rules []*FailRule) error {
+	var encoded []byte
+	if len(rules) > 0 {
+		enc := codec.NewEncoderBytes(&encoded, db.ch)
+		if err := enc.Encode(rules); err != nil {
+			return err
+		}
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupFail)
+		if len(rules) == 0 {
+			return b.Delete([]byte(repGroup))
+		}
+		return b.Put([]byte(repGroup), encoded)
+	})
+}
+
+// retrieveRepGroupFailRules gets all the (compiled) FailRules stored with
+// storeRepGroupFailRules(), keyed on repGroup.
+func (db *db) retrieveRepGroupFailRules() (map[string][]*FailRule, error) {
+	rgRules := make(map[string][]*FailRule)
+	err := db.backend.View(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupFail)
+		return b.ForEach(func(k, v []byte) error {
+			var rules []*FailRule
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(&rules); err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				if err := rule.compile(); err != nil {
+					return err
+				}
+			}
+			rgRules[string(k)] = rules
+			return nil
+		})
+	})
+	return rgRules, err
+}
+
+// storeRepGroupHostFailurePolicy records the HostFailurePolicy for the given
+// repGroup, or removes it if policy is nil.
+func (db *db) storeRepGroupHostFailurePolicy(repGroup string, policy *HostFailurePolicy) error {
+	var encoded []byte
+	if policy != nil {
+		enc := codec.NewEncoderBytes(&encoded, db.ch)
+		if err := enc.Encode(policy); err != nil {
+			return err
+		}
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupHost)
+		if policy == nil {
+			return b.Delete([]byte(repGroup))
+		}
+		return b.Put([]byte(repGroup), encoded)
+	})
+}
+
+// retrieveRepGroupHostFailurePolicies gets all the HostFailurePolicies stored
+// with storeRepGroupHostFailurePolicy(), keyed on repGroup.
+func (db *db) retrieveRepGroupHostFailurePolicies() (map[string]*HostFailurePolicy, error) {
+	policies := make(map[string]*HostFailurePolicy)
+	err := db.backend.View(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupHost)
+		return b.ForEach(func(k, v []byte) error {
+			policy := &HostFailurePolicy{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(policy); err != nil {
+				return err
+			}
+			policies[string(k)] = policy
+			return nil
+		})
+	})
+	return policies, err
+}
+
+// storePolicy records the given Policy, replacing any with the same Name.
+func (db *db) storePolicy(policy *Policy) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	if err := enc.Encode(policy); err != nil {
+		return err
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		return tx.Bucket(bucketPolicies).Put([]byte(policy.Name), encoded)
+	})
+}
+
+// deletePolicy removes the named Policy stored with storePolicy(), along with
+// its assignment to the given repGroups.
+func (db *db) deletePolicy(name string, repGroups []string) error {
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupPol)
+		for _, rg := range repGroups {
+			if err := b.Delete([]byte(rg)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketPolicies).Delete([]byte(name))
+	})
+}
+
+// storeRepGroupPolicy records the name of the Policy assigned to the given
+// repGroup, or removes the assignment if name is blank.
+func (db *db) storeRepGroupPolicy(repGroup, name string) error {
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketRepGroupPol)
+		if name == "" {
+			return b.Delete([]byte(repGroup))
+		}
+		return b.Put([]byte(repGroup), []byte(name))
+	})
+}
+
+// retrievePolicies gets all the Policies stored with storePolicy(), keyed on
+// Name, along with the policy names stored with storeRepGroupPolicy(), keyed
+// on repGroup.
+func (db *db) retrievePolicies() (map[string]*Policy, map[string]string, error) {
+	policies := make(map[string]*Policy)
+	rgPolicies := make(map[string]string)
+	err := db.backend.View(func(tx dbTx) error {
+		errf := tx.Bucket(bucketPolicies).ForEach(func(k, v []byte) error {
+			policy := &Policy{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(policy); err != nil {
+				return err
+			}
+			policies[string(k)] = policy
+			return nil
+		})
+		if errf != nil {
+			return errf
+		}
+		return tx.Bucket(bucketRepGroupPol).ForEach(func(k, v []byte) error {
+			rgPolicies[string(k)] = string(v)
+			return nil
+		})
+	})
+	return policies, rgPolicies, err
+}
+
+// storeJobEvent stores the given event in the history of each of the jobs
+// with the given keys, in the background. Events are stored keyed on their
+// Time, so retrieveJobEvents() returns them in order even if they get stored
+// out of order.
+func (db *db) storeJobEvent(keys []string, event *JobEvent) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.closed || len(keys) == 0 {
+		return
+	}
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	if err := enc.Encode(event); err != nil {
+		db.Error("Database operation storeJobEvent failed due to Encode failure", "err", err)
+		return
+	}
+	when := make([]byte, 8)
+	binary.BigEndian.PutUint64(when, uint64(event.Time.UnixNano()))
+
+	db.wgMutex.Lock()
+	defer db.wgMutex.Unlock()
+	db.wg.Add(1)
+	go func() {
+		defer internal.LogPanic(db.Logger, "storeJobEvent", true)
+		defer db.wg.Done()
+
+		err := db.backend.Batch(func(tx dbTx) error {
+			b := tx.Bucket(bucketJobEvents)
+			for _, key := range keys {
+				seq, errs := b.NextSequence()
+				if errs != nil {
+					return errs
+				}
+				unique := make([]byte, 8)
+				binary.BigEndian.PutUint64(unique, seq)
+				errs = b.Put(db.generateLookupKey(key, append(append([]byte{}, when...), unique...)), encoded)
+				if errs != nil {
+					return errs
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Error("Database operation storeJobEvent failed", "err", err)
+		}
+	}()
+}
+
+// retrieveJobEvents gets the events stored with storeJobEvent() for the job
+// with the given key, oldest first.
+func (db *db) retrieveJobEvents(key string) ([]*JobEvent, error) {
+	var events []*JobEvent
+	prefix := []byte(key + dbDelimiter)
+	err := db.backend.View(func(tx dbTx) error {
+		c := tx.Bucket(bucketJobEvents).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			event := &JobEvent{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// deleteJobEvents deletes the events stored with storeJobEvent() for the job
+// with the given key, as part of the given transaction.
+func (db *db) deleteJobEvents(tx dbTx, key string) error {
+	prefix := []byte(key + dbDelimiter)
+	c := tx.Bucket(bucketJobEvents).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCompleteRepGroup removes the complete jobs with the given keys, which
+// must be all the jobs of the given RepGroup, from the database, along with
+// their STDOUT, STDERR and events, and the RepGroup itself. The stats learned
+// from them are kept.
+func (db *db) deleteCompleteRepGroup(repGroup string, keys []string) error {
+	db.flushArchivedBeforeRead()
+	err := db.backend.Batch(func(tx dbTx) error {
+		bjc := tx.Bucket(bucketJobsComplete)
+		bo := tx.Bucket(bucketStdO)
+		be := tx.Bucket(bucketStdE)
+		for _, key := range keys {
+			k := []byte(key)
+			for _, b := range []dbBucket{bjc, bo, be} {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			if err := db.deleteJobEvents(tx, key); err != nil {
+				return err
+			}
+		}
+
+		prefix := []byte(repGroup + dbDelimiter)
+		c := tx.Bucket(bucketRTK).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketRGs).Delete([]byte(repGroup))
+	})
+	if err != nil {
+		return err
+	}
+	db.backgroundBackup()
+	return nil
+}
+
+// storeRestoredRepGroup stores the given RepGroup archive file content, made
+// for the given RepGroup, replacing any previously stored for it.
+func (db *db) storeRestoredRepGroup(repGroup string, archive []byte) error {
+	return db.store(bucketRGArchives, repGroup, archive)
+}
+
+// retrieveRestoredRepGroup returns the archive file content stored with
+// storeRestoredRepGroup() for the given RepGroup, or nil if there isn't one.
+func (db *db) retrieveRestoredRepGroup(repGroup string) []byte {
+	return db.retrieve(bucketRGArchives, repGroup)
+}
+
+// retrieveRestoredRepGroups returns the names of the RepGroups stored with
+// storeRestoredRepGroup(), sorted.
+func (db *db) retrieveRestoredRepGroups() ([]string, error) {
+	var rgs []string
+	err := db.backend.View(func(tx dbTx) error {
+		return tx.Bucket(bucketRGArchives).ForEach(func(k, v []byte) error {
+			rgs = append(rgs, string(k))
+			return nil
+		})
+	})
+	return rgs, err
+}
+
+// storeBulkRemoval records the progress of the given bulkRemoval, along with
+// the keys of the jobs it is removing if withKeys is true. (Progress is stored
+// after every batch of removals, so we avoid re-storing the potentially very
+// many keys each time.)
+func (db *db) storeBulkRemoval(br *bulkRemoval, withKeys bool) error {
+	var encoded, encodedKeys []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	if err := enc.Encode(br); err != nil {
+		return err
+	}
+	if withKeys {
+		enc = codec.NewEncoderBytes(&encodedKeys, db.ch)
+		if err := enc.Encode(br.keys); err != nil {
+			return err
+		}
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		if withKeys {
+			if err := tx.Bucket(bucketBulkRmKeys).Put([]byte(br.Info.ID), encodedKeys); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketBulkRemovals).Put([]byte(br.Info.ID), encoded)
+	})
+}
+
+// deleteBulkRemoval removes the record made by storeBulkRemoval() for the
+// bulkRemoval with the given id.
+func (db *db) deleteBulkRemoval(id string) error {
+	return db.backend.Update(func(tx dbTx) error {
+		if err := tx.Bucket(bucketBulkRmKeys).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketBulkRemovals).Delete([]byte(id))
+	})
+}
+
+// retrieveBulkRemovals gets all the bulkRemovals stored with
+// storeBulkRemoval(), along with their keys, ie. those that were still running
+// when we last stopped.
+func (db *db) retrieveBulkRemovals() ([]*bulkRemoval, error) {
+	var brs []*bulkRemoval
+	err := db.backend.View(func(tx dbTx) error {
+		bk := tx.Bucket(bucketBulkRmKeys)
+		return tx.Bucket(bucketBulkRemovals).ForEach(func(k, v []byte) error {
+			br := &bulkRemoval{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(br); err != nil {
+				return err
+			}
+			if encodedKeys := bk.Get(k); encodedKeys != nil {
+				dec = codec.NewDecoderBytes(encodedKeys, db.ch)
+				if err := dec.Decode(&br.keys); err != nil {
+					return err
+				}
+			}
+			brs = append(brs, br)
+			return nil
+		})
+	})
+	return brs, err
+}
+
+// storeUtilisation records the given snapshot, keyed on its time.
+func (db *db) storeUtilisation(snap *UtilisationSnapshot) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	if err := enc.Encode(snap); err != nil {
+		return err
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		return tx.Bucket(bucketUtilisation).Put(utilisationKey(snap.Time), encoded)
+	})
+}
+
+// retrieveUtilisation gets the snapshots stored with storeUtilisation() that
+// were taken between from and to (inclusive, to the second), oldest first.
+func (db *db) retrieveUtilisation(from, to time.Time) ([]*UtilisationSnapshot, error) {
+	var snaps []*UtilisationSnapshot
+	last := utilisationKey(to)
+	err := db.backend.View(func(tx dbTx) error {
+		c := tx.Bucket(bucketUtilisation).Cursor()
+		for k, v := c.Seek(utilisationKey(from)); k != nil && bytes.Compare(k, last) <= 0; k, v = c.Next() {
+			snap := &UtilisationSnapshot{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(snap); err != nil {
+				return err
+			}
+			snaps = append(snaps, snap)
+		}
+		return nil
+	})
+	return snaps, err
+}
+
+// pruneUtilisation deletes the snapshots stored with storeUtilisation() that
+// were taken before the given time.
+func (db *db) pruneUtilisation(before time.Time) error {
+	first := utilisationKey(before)
+	return db.backend.Update(func(tx dbTx) error {
+		c := tx.Bucket(bucketUtilisation).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, first) < 0; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
 			}
+		}
+		return nil
+	})
+}
 
-			if len(rgs) > 0 {
-				errs = db.putLookups(tx, bucketRGs, rgs)
-				if errs != nil {
-					return errs
+// addUsage adds the consumption in the given records to the stored records
+// with the same Month and User or RepGroup, storing them if new.
+func (db *db) addUsage(records []*UsageRecord) error {
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketUsage)
+		for _, record := range records {
+			key := []byte(record.key())
+			total := &UsageRecord{Month: record.Month, User: record.User, RepGroup: record.RepGroup}
+			if v := b.Get(key); v != nil {
+				dec := codec.NewDecoderBytes(v, db.ch)
+				if err := dec.Decode(total); err != nil {
+					return err
 				}
 			}
+			total.add(record)
 
-			if len(dgLookups) > 0 {
-				errs = db.putLookups(tx, bucketDTK, dgLookups)
-				if errs != nil {
-					return errs
-				}
+			var encoded []byte
+			enc := codec.NewEncoderBytes(&encoded, db.ch)
+			if err := enc.Encode(total); err != nil {
+				return err
 			}
-
-			if len(rdgLookups) > 0 {
-				errs = db.putLookups(tx, bucketRDTK, rdgLookups)
-				if errs != nil {
-					return errs
-				}
+			if err := b.Put(key, encoded); err != nil {
+				return err
 			}
+		}
+		return nil
+	})
+}
 
-			if hadStd {
-				for i, job := range jobs {
-					if os[i] != nil {
-						errs = bo.Put([]byte(job.Key()), os[i])
-						if errs != nil {
-							return errs
-						}
-					}
-					if es[i] != nil {
-						errs = be.Put([]byte(job.Key()), es[i])
-						if errs != nil {
-							return errs
-						}
-					}
-				}
+// retrieveUsage gets the records stored with addUsage() for the months from
+// fromMonth to toMonth (inclusive), ordered by month.
+func (db *db) retrieveUsage(fromMonth, toMonth string) ([]*UsageRecord, error) {
+	var records []*UsageRecord
+	last := []byte(toMonth + "\x01") // after all the keys of toMonth
+	err := db.backend.View(func(tx dbTx) error {
+		c := tx.Bucket(bucketUsage).Cursor()
+		for k, v := c.Seek([]byte(fromMonth)); k != nil && bytes.Compare(k, last) < 0; k, v = c.Next() {
+			record := &UsageRecord{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(record); err != nil {
+				return err
 			}
-
-			return db.putEncodedJobs(tx, bucketJobsLive, encodedJobs)
+			records = append(records, record)
 		}
 		return nil
 	})
-	if err != nil {
-		db.Error("Database error during modify", "err", err)
+	return records, err
+}
+
+// storeSchedule records the given Schedule, keyed on its Key, replacing any
+// previous version of it.
+func (db *db) storeSchedule(sched *Schedule) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	if err := enc.Encode(sched); err != nil {
+		return err
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		return tx.Bucket(bucketSchedules).Put([]byte(sched.Key), encoded)
+	})
+}
+
+// retrieveSchedules gets all the schedules stored with storeSchedule(),
+// ordered by Key.
+func (db *db) retrieveSchedules() ([]*Schedule, error) {
+	var scheds []*Schedule
+	err := db.backend.View(func(tx dbTx) error {
+		return tx.Bucket(bucketSchedules).ForEach(func(k, v []byte) error {
+			sched := &Schedule{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(sched); err != nil {
+				return err
+			}
+			scheds = append(scheds, sched)
+			return nil
+		})
+	})
+	return scheds, err
+}
+
+// deleteSchedule deletes the schedule with the given key stored with
+// storeSchedule().
+func (db *db) deleteSchedule(key string) error {
+	return db.backend.Update(func(tx dbTx) error {
+		return tx.Bucket(bucketSchedules).Delete([]byte(key))
+	})
+}
+
+// storeWorkflow records the given Workflow, keyed on its Name, replacing any
+// previous workflow with that name.
+func (db *db) storeWorkflow(wf *Workflow) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	if err := enc.Encode(wf); err != nil {
+		return err
 	}
+	return db.backend.Update(func(tx dbTx) error {
+		return tx.Bucket(bucketWorkflows).Put([]byte(wf.Name), encoded)
+	})
+}
 
-	go db.backgroundBackup()
+// retrieveWorkflows gets all the workflows stored with storeWorkflow(),
+// ordered by Name.
+func (db *db) retrieveWorkflows() ([]*Workflow, error) {
+	var wfs []*Workflow
+	err := db.backend.View(func(tx dbTx) error {
+		return tx.Bucket(bucketWorkflows).ForEach(func(k, v []byte) error {
+			wf := &Workflow{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(wf); err != nil {
+				return err
+			}
+			wfs = append(wfs, wf)
+			return nil
+		})
+	})
+	return wfs, err
+}
 
-	return err
+// storeQueueConfig records the given QueueConfig, replacing any with the same
+// Name.
+func (db *db) storeQueueConfig(qc *QueueConfig) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	if err := enc.Encode(qc); err != nil {
+		return err
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		return tx.Bucket(bucketQueueConfigs).Put([]byte(qc.Name), encoded)
+	})
 }
 
-// retrieveJobStd gets the values that were stored using updateJobStd() for the
-// given job.
-func (db *db) retrieveJobStd(jobkey string) (stdo []byte, stde []byte) {
-	// first wait for any existing updateJobAfterExit() calls to complete
-	//*** this method of waiting seems really bad and should be improved, but in
-	//    practice we probably never wait
-	for {
-		db.RLock()
-		if db.updatingAfterJobExit == 0 {
-			db.RUnlock()
-			break
+// deleteQueueConfig removes the named QueueConfig stored with
+// storeQueueConfig().
+func (db *db) deleteQueueConfig(name string) error {
+	return db.backend.Update(func(tx dbTx) error {
+		return tx.Bucket(bucketQueueConfigs).Delete([]byte(name))
+	})
+}
+
+// retrieveQueueConfigs gets all the QueueConfigs stored with
+// storeQueueConfig(), keyed on Name.
+func (db *db) retrieveQueueConfigs() (map[string]*QueueConfig, error) {
+	qcs := make(map[string]*QueueConfig)
+	err := db.backend.View(func(tx dbTx) error {
+		return tx.Bucket(bucketQueueConfigs).ForEach(func(k, v []byte) error {
+			qc := &QueueConfig{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(qc); err != nil {
+				return err
+			}
+			qcs[string(k)] = qc
+			return nil
+		})
+	})
+	return qcs, err
+}
+
+// storeTriageRules records the given TriageRules, replacing any previously
+// stored.
+func (db *db) storeTriageRules(rules []*TriageRule) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	if err := enc.Encode(rules); err != nil {
+		return err
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		return tx.Bucket(bucketTriageRules).Put(triageRulesKey, encoded)
+	})
+}
+
+// retrieveTriageRules gets the TriageRules stored with storeTriageRules(),
+// compiled ready for use.
+func (db *db) retrieveTriageRules() ([]*TriageRule, error) {
+	var rules []*TriageRule
+	err := db.backend.View(func(tx dbTx) error {
+		v := tx.Bucket(bucketTriageRules).Get(triageRulesKey)
+		if v == nil {
+			return nil
+		}
+		dec := codec.NewDecoderBytes(v, db.ch)
+		return dec.Decode(&rules)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if err = rule.compile(); err != nil {
+			return nil, err
 		}
-		db.RUnlock()
-		<-time.After(10 * time.Millisecond)
 	}
+	return rules, nil
+}
 
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		bo := tx.Bucket(bucketStdO)
-		be := tx.Bucket(bucketStdE)
-		key := []byte(jobkey)
-		o := bo.Get(key)
-		if o != nil {
-			stdo = make([]byte, len(o))
-			copy(stdo, o)
+// storeSecret records the given encrypted secret value under the given name,
+// along with the user that owns it (which can be blank if no one does),
+// replacing any previous value and owner.
+func (db *db) storeSecret(name, owner string, encrypted []byte) error {
+	return db.backend.Update(func(tx dbTx) error {
+		if err := tx.Bucket(bucketSecrets).Put([]byte(name), encrypted); err != nil {
+			return err
 		}
-		e := be.Get(key)
-		if e != nil {
-			stde = make([]byte, len(e))
-			copy(stde, e)
+		if owner == "" {
+			return tx.Bucket(bucketSecretOwner).Delete([]byte(name))
+		}
+		return tx.Bucket(bucketSecretOwner).Put([]byte(name), []byte(owner))
+	})
+}
+
+// deleteSecret removes the named secret stored with storeSecret(), telling you
+// if it existed.
+func (db *db) deleteSecret(name string) (bool, error) {
+	var existed bool
+	err := db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketSecrets)
+		existed = b.Get([]byte(name)) != nil
+		if err := b.Delete([]byte(name)); err != nil {
+			return err
 		}
+		return tx.Bucket(bucketSecretOwner).Delete([]byte(name))
+	})
+	return existed, err
+}
+
+// retrieveSecret gets the encrypted value and owner of the named secret stored
+// with storeSecret(), returning an error if it doesn't exist.
+func (db *db) retrieveSecret(name string) ([]byte, string, error) {
+	var encrypted []byte
+	var owner string
+	err := db.backend.View(func(tx dbTx) error {
+		v := tx.Bucket(bucketSecrets).Get([]byte(name))
+		if v == nil {
+			return fmt.Errorf("secret [%s] does not exist", name)
+		}
+		encrypted = make([]byte, len(v))
+		copy(encrypted, v)
+		owner = string(tx.Bucket(bucketSecretOwner).Get([]byte(name)))
 		return nil
 	})
-	if err != nil {
-		// impossible, but to keep the linter happy and incase things change in
-		// the future
-		db.Error("Database retrieve failed", "err", err)
+	return encrypted, owner, err
+}
+
+// retrieveSecretNames gets the names of all the secrets stored with
+// storeSecret(), sorted. If owner is not blank, only the names of the secrets
+// that user can use (see secretUsableBy()) are returned.
+func (db *db) retrieveSecretNames(owner string) ([]string, error) {
+	var names []string
+	err := db.backend.View(func(tx dbTx) error {
+		owners := tx.Bucket(bucketSecretOwner)
+		return tx.Bucket(bucketSecrets).ForEach(func(k, v []byte) error {
+			if owner == "" || secretUsableBy(string(owners.Get(k)), owner) {
+				names = append(names, string(k))
+			}
+			return nil
+		})
+	})
+	return names, err
+}
+
+// storeEnrolledHost records the given EnrolledHost, keyed on its certificate
+// serial.
+func (db *db) storeEnrolledHost(h *EnrolledHost) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	if err := enc.Encode(h); err != nil {
+		return err
 	}
-	return stdo, stde
+	return db.backend.Update(func(tx dbTx) error {
+		return tx.Bucket(bucketEnrolled).Put([]byte(h.Serial), encoded)
+	})
 }
 
-// recommendedReqGroupMemory returns the 95th percentile peak memory usage of
-// all jobs that previously ran with the given reqGroup. If there are too few
-// prior values to calculate a 95th percentile, or if the 95th percentile is
-// very close to the maximum value, returns the maximum value instead. In either
-// case, the true value is rounded up to the nearest 100 MB. Returns 0 if there
-// are no prior values.
-func (db *db) recommendedReqGroupMemory(reqGroup string) (int, error) {
-	return db.recommendedReqGroupStat(bucketJobRAM, reqGroup, RecMBRound)
+// retrieveEnrolledHosts gets all the hosts stored with storeEnrolledHost().
+func (db *db) retrieveEnrolledHosts() ([]*EnrolledHost, error) {
+	var hosts []*EnrolledHost
+	err := db.backend.View(func(tx dbTx) error {
+		return tx.Bucket(bucketEnrolled).ForEach(func(k, v []byte) error {
+			h := &EnrolledHost{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			if err := dec.Decode(h); err != nil {
+				return err
+			}
+			hosts = append(hosts, h)
+			return nil
+		})
+	})
+	return hosts, err
 }
 
-// recommendedReqGroupDisk returns the 95th percentile peak disk usage of
-// all jobs that previously ran with the given reqGroup. If there are too few
-// prior values to calculate a 95th percentile, or if the 95th percentile is
-// very close to the maximum value, returns the maximum value instead. In either
-// case, the true value is rounded up to the nearest 100 MB. Returns 0 if there
-// are no prior values.
-func (db *db) recommendedReqGroupDisk(reqGroup string) (int, error) {
-	return db.recommendedReqGroupStat(bucketJobDisk, reqGroup, RecMBRound)
+// storeExcludedHosts records that the given hosts are excluded, or removes
+// that record if exclude is false.
+func (db *db) storeExcludedHosts(hosts []string, exclude bool) error {
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketExcluded)
+		for _, host := range hosts {
+			var err error
+			if exclude {
+				err = b.Put([]byte(host), []byte{})
+			} else {
+				err = b.Delete([]byte(host))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-// recommendReqGroupTime returns the 95th percentile wall time taken of all jobs
-// that previously ran with the given reqGroup. If there are too few prior
-// values to calculate a 95th percentile, or if the 95th percentile is very
-// close to the maximum value, returns the maximum value instead. In either
-// case, the true value is rounded up to the nearest 30mins (but returned in
-// seconds). Returns 0 if there are no prior values.
-func (db *db) recommendedReqGroupTime(reqGroup string) (int, error) {
-	return db.recommendedReqGroupStat(bucketJobSecs, reqGroup, RecSecRound)
+// retrieveExcludedHosts gets all the hosts stored with storeExcludedHosts().
+func (db *db) retrieveExcludedHosts() (map[string]bool, error) {
+	hosts := make(map[string]bool)
+	err := db.backend.View(func(tx dbTx) error {
+		b := tx.Bucket(bucketExcluded)
+		return b.ForEach(func(k, v []byte) error {
+			hosts[string(k)] = true
+			return nil
+		})
+	})
+	return hosts, err
 }
 
-// recommendedReqGroupStat is the implementation for the other recommend*()
-// methods.
-func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, roundAmount int) (int, error) {
-	prefix := []byte(reqGroup)
+// recommendedStat is the implementation for the recommended*Stat() methods,
+// considering the values in statBucket with keys that start with the given
+// prefix. It also returns the number of values considered.
+func (db *db) recommendedStat(statBucket []byte, prefix []byte, roundAmount int) (int, int, error) {
+	// values for buffered completed jobs aren't stored yet, so we merge them
+	// in to what we read in key order
+	pending := db.archivedPendingStats(statBucket, prefix)
 	max := 0
+	count := 0
 	var recommendation int
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.backend.View(func(tx dbTx) error {
 		c := tx.Bucket(statBucket).Cursor()
 
 		// we seek over the bucket, and to avoid having to do it twice (first to
 		// get the overall count, then to get the 95th percentile), we keep the
 		// previous 5%-sized window of values, updating recommendation as the
 		// window fills
-		count := 0
 		window := jobStatWindowPercent
 		var prev []int
-		var erra error
-		for k, v := c.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		consider := func(v []byte) error {
+			var erra error
 			max, erra = strconv.Atoi(string(v))
 			if erra != nil {
 				return erra
@@ -1334,17 +3010,37 @@ func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, roundA
 			if float32(len(prev)) > window {
 				recommendation, prev = prev[0], prev[1:]
 			}
+			return nil
+		}
+
+		for k, v := c.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			for len(pending) > 0 && bytes.Compare(pending[0][0], k) <= 0 {
+				if !bytes.Equal(pending[0][0], k) {
+					if erra := consider(pending[0][1]); erra != nil {
+						return erra
+					}
+				}
+				pending = pending[1:]
+			}
+			if erra := consider(v); erra != nil {
+				return erra
+			}
+		}
+		for _, kv := range pending {
+			if erra := consider(kv[1]); erra != nil {
+				return erra
+			}
 		}
 
 		return nil
 	})
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	if recommendation == 0 {
 		if max == 0 {
-			return recommendation, err
+			return recommendation, count, err
 		}
 		recommendation = max
 	}
@@ -1361,12 +3057,12 @@ func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, roundA
 		recommendation = int(math.Ceil(float64(recommendation)/float64(roundAmount))) * roundAmount
 	}
 
-	return recommendation, err
+	return recommendation, count, err
 }
 
 // store does a basic set of a key/val in a given bucket
 func (db *db) store(bucket []byte, key string, val []byte) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
+	err := db.backend.Batch(func(tx dbTx) error {
 		b := tx.Bucket(bucket)
 		err := b.Put([]byte(key), val)
 		return err
@@ -1378,7 +3074,7 @@ func (db *db) store(bucket []byte, key string, val []byte) error {
 // possible here.
 func (db *db) retrieve(bucket []byte, key string) []byte {
 	var val []byte
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.backend.View(func(tx dbTx) error {
 		b := tx.Bucket(bucket)
 		v := b.Get([]byte(key))
 		if v != nil {
@@ -1404,7 +3100,7 @@ func (db *db) remove(bucket []byte, key string) {
 	go func() {
 		defer internal.LogPanic(db.Logger, "jobqueue database remove", true)
 		defer db.wg.Done()
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
+		err := db.backend.Batch(func(tx dbTx) error {
 			b := tx.Bucket(bucket)
 			return b.Delete([]byte(key))
 		})
@@ -1458,15 +3154,15 @@ func (db *db) storeBatched(bucket []byte, data sobsd, storer sobsdStorer) error
 // storeLookups is a sobsdStorer for storing Job.[somevalue]->Job.Key() lookups
 // in the db.
 func (db *db) storeLookups(bucket []byte, lookups sobsd) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
+	err := db.backend.Batch(func(tx dbTx) error {
 		return db.putLookups(tx, bucket, lookups)
 	})
 	return err
 }
 
-// putLookups does the work of storeLookups(). You must be inside a bolt
+// putLookups does the work of storeLookups(). You must be inside a backend
 // transaction when calling this.
-func (db *db) putLookups(tx *bolt.Tx, bucket []byte, lookups sobsd) error {
+func (db *db) putLookups(tx dbTx, bucket []byte, lookups sobsd) error {
 	lookup := tx.Bucket(bucket)
 	for _, doublet := range lookups {
 		err := lookup.Put(doublet[0], nil)
@@ -1479,15 +3175,15 @@ func (db *db) putLookups(tx *bolt.Tx, bucket []byte, lookups sobsd) error {
 
 // storeEncodedJobs is a sobsdStorer for storing Jobs in the db.
 func (db *db) storeEncodedJobs(bucket []byte, encodes sobsd) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
+	err := db.backend.Batch(func(tx dbTx) error {
 		return db.putEncodedJobs(tx, bucket, encodes)
 	})
 	return err
 }
 
-// putEncodedJobs does the work of storeEncodedJobs(). You nust be inside a bolt
-// transaction when calling this.
-func (db *db) putEncodedJobs(tx *bolt.Tx, bucket []byte, encodes sobsd) error {
+// putEncodedJobs does the work of storeEncodedJobs(). You nust be inside a
+// backend transaction when calling this.
+func (db *db) putEncodedJobs(tx dbTx, bucket []byte, encodes sobsd) error {
 	bjobs := tx.Bucket(bucket)
 	for _, doublet := range encodes {
 		err := bjobs.Put(doublet[0], doublet[1])
@@ -1502,6 +3198,16 @@ func (db *db) putEncodedJobs(tx *bolt.Tx, bucket []byte, encodes sobsd) error {
 // ongoing backgroundBackup() completes first (but does not wait for backup() to
 // complete).
 func (db *db) close() error {
+	db.RLock()
+	closed := db.closed
+	db.RUnlock()
+	if !closed {
+		err := db.closeArchiveJournal()
+		if err != nil {
+			db.Error("Database operation closeArchiveJournal failed", "err", err)
+		}
+	}
+
 	db.Lock()
 	defer db.Unlock()
 	if !db.closed {
@@ -1532,7 +3238,13 @@ func (db *db) close() error {
 			db.backupToBackupFile(false)
 		}
 
-		err := db.bolt.Close()
+		err := db.backend.Close()
+		if db.incremental != nil {
+			errc := db.incremental.changes.close()
+			if errc != nil {
+				db.Warn("Failed to close database change journal", "err", errc)
+			}
+		}
 		if db.backupMount != nil {
 			erru := db.backupMount.Unmount()
 			if erru != nil {
@@ -1633,11 +3345,20 @@ func (db *db) backupToBackupFile(slowBackups bool) {
 	db.wgMutex.Unlock()
 	defer db.wg.Done()
 
+	bb, err := db.boltBackend()
+	if err != nil {
+		db.Error("Database backup failed", "err", err)
+		return
+	}
+
+	if db.incremental != nil {
+		db.backupIncrementally(bb)
+		return
+	}
+
 	// create the new backup file with temp name
 	tmpBackupPath := db.backupPath + ".tmp"
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		return tx.CopyFile(tmpBackupPath, dbFilePermission)
-	})
+	err = bb.copyFile(tmpBackupPath)
 
 	if slowBackups {
 		<-time.After(100 * time.Millisecond)
@@ -1660,11 +3381,33 @@ func (db *db) backupToBackupFile(slowBackups bool) {
 	}
 }
 
+// replicate is like backup(), but for a standby that already has a copy of the
+// database as of the transaction with the given id: only the changes since
+// then are written, if we still have them, or nothing if there weren't any.
+// Returns the id of the last transaction written, and whether the whole
+// database was written instead of changes.
+func (db *db) replicate(w io.Writer, txid int) (int, bool, error) {
+	db.flushArchivedBeforeRead()
+	db.RLock()
+	if db.closed {
+		db.RUnlock()
+		return txid, false, fmt.Errorf("database closed")
+	}
+	db.RUnlock()
+
+	bb, err := db.boltBackend()
+	if err != nil {
+		return txid, false, err
+	}
+	return bb.replicate(w, txid)
+}
+
 // backup backs up the database to the given writer. Can be called at the same
 // time as an active backgroundBackup() or even another backup(). You will get
 // a consistent view of the database at the time you call this. NB: this can be
 // interrupted by calling db.close().
 func (db *db) backup(w io.Writer) error {
+	db.flushArchivedBeforeRead()
 	db.RLock()
 	if db.closed {
 		db.RUnlock()
@@ -1672,8 +3415,19 @@ func (db *db) backup(w io.Writer) error {
 	}
 	db.RUnlock()
 
-	return db.bolt.View(func(tx *bolt.Tx) error {
-		_, txErr := tx.WriteTo(w)
-		return txErr
-	})
+	bb, err := db.boltBackend()
+	if err != nil {
+		return err
+	}
+	return bb.writeTo(w)
+}
+
+// boltBackend returns our backend if it is a boltdb file, which is the only
+// kind we can back up or replicate ourselves.
+func (db *db) boltBackend() (*boltBackend, error) {
+	bb, ok := db.epochs.dbBackend.(*boltBackend)
+	if !ok {
+		return nil, fmt.Errorf("the database is not a file; use the external database's own tools to back it up")
+	}
+	return bb, nil
 }
@@ -0,0 +1,487 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the write-behind buffer used when archiving completed
+// jobs. When thousands of short jobs complete per second, doing a bolt
+// transaction per job dominates, so instead we append each completion to a
+// journal file (which is cheap, and lets us recover if we crash) and then
+// periodically store all the buffered completions in a single transaction.
+// Concurrent completions share the journal fsyncs (group commit), and reads
+// of the jobs buckets see buffered completions without having to wait for
+// them to be stored.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+const dbArchiveJournalSuffix = ".archive_journal"
+
+// dbArchiveFlushInterval is how often buffered completed jobs get stored in the
+// database. It is a variable only for testing purposes.
+var dbArchiveFlushInterval = 100 * time.Millisecond
+
+// errArchivedPending is returned by methods that found they need a buffered
+// completed job to have been stored in the database first.
+var errArchivedPending = errors.New("completed job not yet stored")
+
+// archiveEntry holds everything we need to store about a completed job, and
+// what we need to answer reads about it while it is buffered.
+type archiveEntry struct {
+	key      string
+	encoded  []byte
+	reqGroup string
+	repGroup string
+	peakRAM  int
+	peakDisk int64
+	secs     int
+}
+
+// archiveStat is a value stored in one of the job stat buckets for an
+// archiveEntry.
+type archiveStat struct {
+	bucket []byte
+	key    []byte
+	value  []byte
+}
+
+// newArchiveEntry creates an archiveEntry for the given job, which must have
+// the given key. You must hold the job's read lock when calling this.
+func (db *db) newArchiveEntry(key string, job *Job) (*archiveEntry, error) {
+	encoded, err := db.encodeJob(job)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveEntry{
+		key:      key,
+		encoded:  encoded,
+		reqGroup: job.ReqGroup,
+		repGroup: job.RepGroup,
+		peakRAM:  job.PeakRAM,
+		peakDisk: job.PeakDisk,
+		secs:     int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds())),
+	}, nil
+}
+
+// stats returns the values we store in the job stat buckets for this entry.
+func (e *archiveEntry) stats() []archiveStat {
+	return []archiveStat{
+		{bucketJobRAM, []byte(fmt.Sprintf("%s%s%20d", e.reqGroup, dbDelimiter, e.peakRAM)), []byte(strconv.Itoa(e.peakRAM))},
+		{bucketJobDisk, []byte(fmt.Sprintf("%s%s%20d", e.reqGroup, dbDelimiter, e.peakDisk)), []byte(strconv.Itoa(int(e.peakDisk)))},
+		{bucketJobSecs, []byte(fmt.Sprintf("%s%s%20d", e.reqGroup, dbDelimiter, e.secs)), []byte(strconv.Itoa(e.secs))},
+		{bucketRepGroupRAM, repGroupStatKey(e.repGroup, e.key, e.peakRAM), []byte(strconv.Itoa(e.peakRAM))},
+		{bucketRepGroupSecs, repGroupStatKey(e.repGroup, e.key, e.secs), []byte(strconv.Itoa(e.secs))},
+	}
+}
+
+// journalRecord returns the bytes we write to the journal for this entry: the
+// length of the key, the key, the length of the encoded job and the encoded
+// job.
+func (e *archiveEntry) journalRecord() []byte {
+	var b bytes.Buffer
+	lens := make([]byte, 4)
+	binary.BigEndian.PutUint32(lens, uint32(len(e.key)))
+	b.Write(lens)
+	b.WriteString(e.key)
+	binary.BigEndian.PutUint32(lens, uint32(len(e.encoded)))
+	b.Write(lens)
+	b.Write(e.encoded)
+	return b.Bytes()
+}
+
+// openArchiveJournal opens (creating if necessary) the journal that goes with
+// the given database file, and returns entries for any completed jobs that
+// were journalled but not stored in the database before we last stopped. A
+// partially written final record (because we crashed while writing it) is
+// ignored, since we would not have told the client its job was archived.
+func (db *db) openArchiveJournal(dbFile string) ([]*archiveEntry, error) {
+	path := dbFile + dbArchiveJournalSuffix
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, dbFilePermission)
+	if err != nil {
+		return nil, err
+	}
+	db.archiveJournal = f
+
+	var entries []*archiveEntry
+	r := bufio.NewReader(f)
+	for {
+		key, errr := readJournalField(r)
+		if errr != nil {
+			break
+		}
+		encoded, errr := readJournalField(r)
+		if errr != nil {
+			break
+		}
+
+		job, errd := db.decodeJob(nil, encoded)
+		if errd != nil {
+			db.Warn("Ignoring bad entry in archive journal", "path", path, "err", errd)
+			continue
+		}
+		entry, errd := db.newArchiveEntry(string(key), job)
+		if errd != nil {
+			db.Warn("Ignoring bad entry in archive journal", "path", path, "err", errd)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// readJournalField reads a length-prefixed field from an archive journal.
+func readJournalField(r io.Reader) ([]byte, error) {
+	lens := make([]byte, 4)
+	_, err := io.ReadFull(r, lens)
+	if err != nil {
+		return nil, err
+	}
+	field := make([]byte, binary.BigEndian.Uint32(lens))
+	_, err = io.ReadFull(r, field)
+	return field, err
+}
+
+// bufferArchive journals the given entry and adds it to the buffer of entries
+// that will be stored in the database on the next flushArchived(). Once this
+// returns without error, the entry will survive a crash.
+func (db *db) bufferArchive(entry *archiveEntry) error {
+	db.archiveMutex.Lock()
+	if db.archiveJournal == nil {
+		db.archiveMutex.Unlock()
+		return fmt.Errorf("database closed")
+	}
+
+	_, err := db.archiveJournal.Write(entry.journalRecord())
+	if err != nil {
+		db.archiveMutex.Unlock()
+		return err
+	}
+	db.archiveWritten++
+	written := db.archiveWritten
+
+	db.archivePending = append(db.archivePending, entry)
+	db.archivePendingKeys[entry.key] = entry
+	if len(db.archivePending) >= dbMaxSingleTxnJobs {
+		select {
+		case db.archiveFlushNow <- true:
+		default:
+		}
+	}
+	db.archiveMutex.Unlock()
+
+	return db.syncArchiveJournal(written)
+}
+
+// syncArchiveJournal waits until at least the given number of journal writes
+// have been synced to disk. Concurrent callers share fsyncs: whoever finds no
+// sync in progress syncs everything written so far on behalf of everyone, and
+// the rest wait for that sync to finish, then only need their own if their
+// write came after it started.
+func (db *db) syncArchiveJournal(upTo uint64) error {
+	db.archiveSyncMutex.Lock()
+	defer db.archiveSyncMutex.Unlock()
+	for db.archiveSynced < upTo {
+		if db.archiveSyncing {
+			db.archiveSyncCond.Wait()
+			continue
+		}
+		db.archiveSyncing = true
+		db.archiveSyncMutex.Unlock()
+
+		db.archiveMutex.Lock()
+		written := db.archiveWritten
+		journal := db.archiveJournal
+		db.archiveMutex.Unlock()
+		var err error
+		if journal == nil {
+			err = fmt.Errorf("database closed")
+		} else {
+			err = journal.Sync()
+		}
+
+		db.archiveSyncMutex.Lock()
+		db.archiveSyncing = false
+		if err == nil && written > db.archiveSynced {
+			db.archiveSynced = written
+		}
+		db.archiveSyncCond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startArchiveFlusher starts a goroutine that calls flushArchived() every
+// dbArchiveFlushInterval, or sooner if lots of jobs have been buffered.
+func (db *db) startArchiveFlusher() {
+	go func() {
+		defer internal.LogPanic(db.Logger, "archive flusher", true)
+		ticker := time.NewTicker(dbArchiveFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-db.archiveFlushNow:
+			case <-db.archiveStop:
+				close(db.archiveStopped)
+				return
+			}
+
+			flushed, err := db.flushArchived()
+			if err != nil {
+				db.Error("Database operation flushArchived failed", "err", err)
+			}
+			if flushed > 0 {
+				db.backgroundBackup()
+			}
+		}
+	}()
+}
+
+// stopArchiveFlusher stops the goroutine started by startArchiveFlusher(),
+// waiting for any current flush to complete. It does nothing if the flusher
+// was already stopped.
+func (db *db) stopArchiveFlusher() {
+	db.archiveStopOnce.Do(func() {
+		close(db.archiveStop)
+		<-db.archiveStopped
+	})
+}
+
+// flushArchived stores all buffered completed jobs in the database in a single
+// transaction, and truncates the journal. Methods that change the jobs buckets
+// call this first, so that their changes don't get undone by a later flush,
+// but most reads answer from the buffer instead (see archivedPending()).
+// Returns the number of jobs flushed.
+func (db *db) flushArchived() (int, error) {
+	db.archiveFlushMutex.Lock()
+	defer db.archiveFlushMutex.Unlock()
+
+	// (entries stay in archivePendingKeys until they're stored, so reads can
+	// still see them in the meantime)
+	db.archiveMutex.Lock()
+	entries := db.archivePending
+	db.archivePending = nil
+	db.archiveMutex.Unlock()
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	start := time.Now()
+	err := db.backend.Update(func(tx dbTx) error {
+		bo := tx.Bucket(bucketStdO)
+		be := tx.Bucket(bucketStdE)
+		bl := tx.Bucket(bucketJobsLive)
+		bc := tx.Bucket(bucketJobsComplete)
+		statBuckets := make(map[string]dbBucket)
+		for _, name := range [][]byte{bucketJobRAM, bucketJobDisk, bucketJobSecs, bucketRepGroupRAM, bucketRepGroupSecs} {
+			statBuckets[string(name)] = tx.Bucket(name)
+		}
+		for _, e := range entries {
+			key := []byte(e.key)
+			for _, b := range []dbBucket{bo, be, bl} {
+				errf := b.Delete(key)
+				if errf != nil {
+					return errf
+				}
+			}
+
+			errf := bc.Put(key, e.encoded)
+			if errf != nil {
+				return errf
+			}
+
+			for _, stat := range e.stats() {
+				errf = statBuckets[string(stat.bucket)].Put(stat.key, stat.value)
+				if errf != nil {
+					return errf
+				}
+			}
+		}
+		return nil
+	})
+
+	db.archiveMutex.Lock()
+	defer db.archiveMutex.Unlock()
+	if err != nil {
+		// put them back so we try again next time
+		db.archivePending = append(entries, db.archivePending...)
+		return 0, err
+	}
+	db.archiveFlushTime = time.Since(start)
+	for _, e := range entries {
+		if db.archivePendingKeys[e.key] == e {
+			delete(db.archivePendingKeys, e.key)
+		}
+	}
+
+	// the journal now only needs to hold anything buffered during the flush
+	if db.archiveJournal != nil {
+		err = db.rewriteArchiveJournal()
+	}
+	return len(entries), err
+}
+
+// rewriteArchiveJournal replaces the contents of the journal with the current
+// buffered entries. You must hold the archiveMutex when calling this.
+func (db *db) rewriteArchiveJournal() error {
+	err := db.archiveJournal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = db.archiveJournal.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	for _, e := range db.archivePending {
+		_, err = db.archiveJournal.Write(e.journalRecord())
+		if err != nil {
+			return err
+		}
+	}
+	return db.archiveJournal.Sync()
+}
+
+// lastArchiveFlushTime tells you how long the most recent flushArchived() took
+// to store its jobs in the database.
+func (db *db) lastArchiveFlushTime() time.Duration {
+	db.archiveMutex.Lock()
+	defer db.archiveMutex.Unlock()
+	return db.archiveFlushTime
+}
+
+// closeArchiveJournal flushes any buffered jobs and closes the journal.
+func (db *db) closeArchiveJournal() error {
+	db.stopArchiveFlusher()
+	_, err := db.flushArchived()
+
+	// wait for any current sync of the journal before closing it
+	db.archiveSyncMutex.Lock()
+	defer db.archiveSyncMutex.Unlock()
+	for db.archiveSyncing {
+		db.archiveSyncCond.Wait()
+	}
+
+	db.archiveMutex.Lock()
+	defer db.archiveMutex.Unlock()
+	if err == nil {
+		// everything written is now stored in the database, so anyone still
+		// waiting for a sync no longer needs one
+		db.archiveSynced = db.archiveWritten
+		db.archiveSyncCond.Broadcast()
+	}
+	if db.archiveJournal == nil {
+		return err
+	}
+	errc := db.archiveJournal.Close()
+	db.archiveJournal = nil
+	if err == nil {
+		err = errc
+	}
+	return err
+}
+
+// flushArchivedBeforeRead calls flushArchived(), logging any error, so that
+// changes to (and whole-database reads of) the jobs buckets are consistent
+// with prior archiveJob() calls.
+func (db *db) flushArchivedBeforeRead() {
+	_, err := db.flushArchived()
+	if err != nil {
+		db.Error("Database operation flushArchived failed", "err", err)
+	}
+}
+
+// flushArchivedBeforeAdding calls flushArchivedBeforeRead() only if any of the
+// given new jobs are buffered completed jobs being added again (and we're not
+// ignoring already added jobs), since storing them as live would otherwise be
+// undone by the next flush. (Buffered jobs that depend on the new jobs are
+// dealt with by retrieveDependentJobs().)
+func (db *db) flushArchivedBeforeAdding(jobs []*Job, ignoreAdded bool) {
+	if ignoreAdded {
+		return
+	}
+	keys := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		keys[job.Key()] = true
+	}
+	conflicts := db.archivedPendingWhere(func(e *archiveEntry) bool {
+		return keys[e.key]
+	})
+	if len(conflicts) > 0 {
+		db.flushArchivedBeforeRead()
+	}
+}
+
+// archivedPending returns the buffered entry for the job with the given key,
+// or nil if it isn't buffered. A buffered job should be treated as complete,
+// and not live, even though it may not be stored as such yet.
+func (db *db) archivedPending(key string) *archiveEntry {
+	db.archiveMutex.Lock()
+	defer db.archiveMutex.Unlock()
+	return db.archivePendingKeys[key]
+}
+
+// archivedPendingWhere returns the buffered entries that the given function
+// returns true for (or all of them if it is nil), keyed on their job keys.
+// Since they may get stored while you're reading the database, you should get
+// these before starting to read, then ignore what you read for these keys.
+func (db *db) archivedPendingWhere(want func(*archiveEntry) bool) map[string]*archiveEntry {
+	db.archiveMutex.Lock()
+	defer db.archiveMutex.Unlock()
+	entries := make(map[string]*archiveEntry)
+	for key, e := range db.archivePendingKeys {
+		if want == nil || want(e) {
+			entries[key] = e
+		}
+	}
+	return entries
+}
+
+// archivedPendingStats returns the values that the buffered entries will store
+// in the given stat bucket under keys with the given prefix, as sorted
+// key/value pairs.
+func (db *db) archivedPendingStats(statBucket, prefix []byte) sobsd {
+	var stats sobsd
+	seen := make(map[string]bool)
+	for _, e := range db.archivedPendingWhere(nil) {
+		for _, stat := range e.stats() {
+			if !bytes.Equal(stat.bucket, statBucket) || !bytes.HasPrefix(stat.key, prefix) || seen[string(stat.key)] {
+				continue
+			}
+			seen[string(stat.key)] = true
+			stats = append(stats, [2][]byte{stat.key, stat.value})
+		}
+	}
+	sort.Sort(stats)
+	return stats
+}
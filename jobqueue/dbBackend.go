@@ -0,0 +1,234 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the interface our database code (db.go) uses to store
+// things, so that the actual storage can be either a boltdb file (the default)
+// or an external SQL database (see dbSQL.go). The interface is modelled on
+// boltdb's own API of transactions containing buckets of sorted keys and
+// values, since that's what db.go was originally written against.
+
+import (
+	"io"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// dbBackend is something that can store buckets of keys and values in
+// transactions.
+type dbBackend interface {
+	// Update runs fn in a read-write transaction, committing it if fn returns
+	// nil, or rolling it back otherwise.
+	Update(fn func(dbTx) error) error
+
+	// View runs fn in a read-only transaction that sees a consistent view of
+	// the database.
+	View(fn func(dbTx) error) error
+
+	// Batch is like Update(), but may combine concurrent calls in to a single
+	// transaction, so fn may be called more than once and should be
+	// idempotent.
+	Batch(fn func(dbTx) error) error
+
+	// Close closes the database.
+	Close() error
+}
+
+// dbTx is a transaction within a dbBackend.
+type dbTx interface {
+	// Bucket returns the bucket with the given name, or nil if it doesn't
+	// exist.
+	Bucket(name []byte) dbBucket
+
+	// CreateBucketIfNotExists returns the bucket with the given name, creating
+	// it first if necessary.
+	CreateBucketIfNotExists(name []byte) (dbBucket, error)
+}
+
+// dbBucket is a collection of keys and values, sorted by key, within a dbTx.
+// Keys and values returned are only valid for the life of the transaction.
+type dbBucket interface {
+	// Get returns the value of the given key, or nil if it isn't in the
+	// bucket.
+	Get(key []byte) []byte
+
+	// Put sets the value of the given key.
+	Put(key, value []byte) error
+
+	// Delete removes the given key, if it is in the bucket.
+	Delete(key []byte) error
+
+	// ForEach calls fn for every key and value in the bucket, in key order,
+	// stopping early if fn returns an error.
+	ForEach(fn func(k, v []byte) error) error
+
+	// Cursor returns a cursor for iterating over the bucket in key order.
+	Cursor() dbCursor
+
+	// NextSequence returns an auto-incrementing integer for the bucket.
+	NextSequence() (uint64, error)
+}
+
+// dbCursor iterates over the keys and values of a dbBucket in key order. The
+// methods return a nil key when there are no more keys.
+type dbCursor interface {
+	// First moves to the first key in the bucket.
+	First() (key, value []byte)
+
+	// Seek moves to the given key, or the next key after it if it isn't in the
+	// bucket.
+	Seek(seek []byte) (key, value []byte)
+
+	// Next moves to the next key.
+	Next() (key, value []byte)
+
+	// Delete removes the key the cursor is on.
+	Delete() error
+}
+
+// boltBackend is a dbBackend that stores everything in a boltdb file.
+type boltBackend struct {
+	bolt         *bolt.DB
+	changes      *changeLog       // if set, committed changes are journalled here
+	feed         *replicationFeed // if set, committed changes are kept here for standbys
+	feedMutex    sync.Mutex
+	logging      *loggingTx // the wrapper of the current writable transaction
+	loggingMutex sync.Mutex
+}
+
+// openBoltBackend opens (creating if necessary) the given boltdb file.
+func openBoltBackend(path string) (*boltBackend, error) {
+	b, err := bolt.Open(path, dbFilePermission, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackend{bolt: b}, nil
+}
+
+// Update implements dbBackend.
+func (bb *boltBackend) Update(fn func(dbTx) error) error {
+	return bb.bolt.Update(func(tx *bolt.Tx) error {
+		return fn(bb.writeTx(tx))
+	})
+}
+
+// View implements dbBackend.
+func (bb *boltBackend) View(fn func(dbTx) error) error {
+	return bb.bolt.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+// Batch implements dbBackend.
+func (bb *boltBackend) Batch(fn func(dbTx) error) error {
+	return bb.bolt.Batch(func(tx *bolt.Tx) error {
+		return fn(bb.writeTx(tx))
+	})
+}
+
+// writeTx wraps the given writable transaction as a dbTx, journalling its
+// changes if we're making incremental backups, and keeping them for standbys if
+// any are replicating us. (Since it is only called with bolt's writer lock
+// held, changes and feed can't change while it runs.)
+//
+// Batch() can call us more than once for the same transaction, and we return
+// the same loggingTx each time, so that all its changes are passed on together
+// once it is committed.
+func (bb *boltBackend) writeTx(tx *bolt.Tx) dbTx {
+	var sinks []dbChangeSink
+	if bb.changes != nil {
+		sinks = append(sinks, bb.changes)
+	}
+	if bb.feed != nil {
+		sinks = append(sinks, bb.feed)
+	}
+	if len(sinks) == 0 {
+		return boltTx{tx}
+	}
+
+	bb.loggingMutex.Lock()
+	defer bb.loggingMutex.Unlock()
+	if bb.logging != nil && bb.logging.tx == tx {
+		return bb.logging
+	}
+	lt := newLoggingTx(tx, sinks)
+	bb.logging = lt
+	tx.OnCommit(func() {
+		bb.loggingMutex.Lock()
+		defer bb.loggingMutex.Unlock()
+		if bb.logging == lt {
+			bb.logging = nil
+		}
+	})
+	return lt
+}
+
+// Close implements dbBackend.
+func (bb *boltBackend) Close() error {
+	return bb.bolt.Close()
+}
+
+// copyFile copies a consistent view of the database to the given path.
+func (bb *boltBackend) copyFile(path string) error {
+	return bb.bolt.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, dbFilePermission)
+	})
+}
+
+// writeTo writes a consistent view of the database to the given writer.
+func (bb *boltBackend) writeTo(w io.Writer) error {
+	return bb.bolt.View(func(tx *bolt.Tx) error {
+		_, txErr := tx.WriteTo(w)
+		return txErr
+	})
+}
+
+// boltTx is a dbTx for a boltBackend.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// Bucket implements dbTx.
+func (t boltTx) Bucket(name []byte) dbBucket {
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+// CreateBucketIfNotExists implements dbTx.
+func (t boltTx) CreateBucketIfNotExists(name []byte) (dbBucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+// boltBucket is a dbBucket for a boltBackend.
+type boltBucket struct {
+	*bolt.Bucket
+}
+
+// Cursor implements dbBucket.
+func (b boltBucket) Cursor() dbCursor {
+	return b.Bucket.Cursor()
+}
@@ -0,0 +1,160 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that stops a primary server from carrying on
+// once its standby has taken over from it. Every database has an epoch, which
+// a standby increments when it takes over. A server refuses to write to its
+// database once it has seen a later epoch than its own: either in the database
+// itself (when a standby shares its primary's DBURL), or because the server
+// that took over told it its epoch (see Client.Fence()).
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	bucketServer = []byte("server")
+	epochKey     = []byte("epoch")
+)
+
+// errFenced is returned by writes to the database of a server that has been
+// superseded by one with a later epoch.
+var errFenced = errors.New("a standby with a later epoch has taken over this database; refusing to write to it")
+
+// epochBackend is a dbBackend that checks the epoch stored in the database
+// before every write, refusing to write if it is later than ours.
+type epochBackend struct {
+	dbBackend
+	epoch      uint64 // accessed atomically
+	fenced     chan struct{}
+	fencedOnce sync.Once
+}
+
+// newEpochBackend wraps the given backend, reading the epoch stored in it as
+// our own.
+func newEpochBackend(backend dbBackend) (*epochBackend, error) {
+	eb := &epochBackend{dbBackend: backend, fenced: make(chan struct{})}
+	err := backend.View(func(tx dbTx) error {
+		eb.epoch = storedEpoch(tx)
+		return nil
+	})
+	return eb, err
+}
+
+// storedEpoch returns the epoch stored in the database, which is 0 if one was
+// never stored.
+func storedEpoch(tx dbTx) uint64 {
+	b := tx.Bucket(bucketServer)
+	if b == nil {
+		return 0
+	}
+	v := b.Get(epochKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// Update implements dbBackend, checking the epoch first.
+func (eb *epochBackend) Update(fn func(dbTx) error) error {
+	return eb.dbBackend.Update(func(tx dbTx) error {
+		if err := eb.check(tx); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// Batch implements dbBackend, checking the epoch first.
+func (eb *epochBackend) Batch(fn func(dbTx) error) error {
+	return eb.dbBackend.Batch(func(tx dbTx) error {
+		if err := eb.check(tx); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// check returns errFenced if we've been fenced, or if the given writable
+// transaction has a later epoch than ours, in which case we are now fenced.
+func (eb *epochBackend) check(tx dbTx) error {
+	if eb.isFenced() {
+		return errFenced
+	}
+	if storedEpoch(tx) > atomic.LoadUint64(&eb.epoch) {
+		eb.fence()
+		return errFenced
+	}
+	return nil
+}
+
+// increment increments the epoch stored in the database, and makes that our
+// epoch. A standby calls this when it takes over from its primary.
+func (eb *epochBackend) increment() (uint64, error) {
+	var epoch uint64
+	err := eb.dbBackend.Update(func(tx dbTx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketServer)
+		if err != nil {
+			return err
+		}
+		epoch = storedEpoch(tx) + 1
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, epoch)
+		return b.Put(epochKey, v)
+	})
+	if err == nil {
+		atomic.StoreUint64(&eb.epoch, epoch)
+	}
+	return epoch, err
+}
+
+// current returns our epoch.
+func (eb *epochBackend) current() uint64 {
+	return atomic.LoadUint64(&eb.epoch)
+}
+
+// supersededBy fences us if the given epoch (of another server of our
+// database) is later than ours. Returns true if we're now fenced.
+func (eb *epochBackend) supersededBy(epoch uint64) bool {
+	if epoch > eb.current() {
+		eb.fence()
+	}
+	return eb.isFenced()
+}
+
+// fence stops us writing to the database from now on.
+func (eb *epochBackend) fence() {
+	eb.fencedOnce.Do(func() {
+		close(eb.fenced)
+	})
+}
+
+// isFenced tells you if we've been fenced.
+func (eb *epochBackend) isFenced() bool {
+	select {
+	case <-eb.fenced:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,897 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for incremental backups of a boltdb database.
+// Instead of copying the whole database file every time it changes, we append
+// every committed change to a local change journal, and at backup time ship
+// the journal as a compressed segment alongside the backup path, only taking
+// a full (compressed) snapshot of the database every so often. Any point in
+// time covered by the snapshots and segments can then be restored by
+// replaying the changes made after the preceding snapshot up to that time.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	dbChangeJournalSuffix = ".change_journal"
+	dbSnapshotInfix       = ".snapshot."
+	dbChangesInfix        = ".changes."
+	dbAbandonedInfix      = ".abandoned."
+	dbIncrementalExt      = ".gz"
+	dbChangeHeaderLength  = 17
+)
+
+// dbSnapshotsKept is how many of the most recent snapshots (and the change
+// segments needed to restore to any time since the oldest of them) we keep
+// when making incremental backups. It is a variable only for testing purposes.
+var dbSnapshotsKept = 7
+
+// dbChangeOp is the kind of change a dbChange records.
+type dbChangeOp byte
+
+// dbChange* are the kinds of dbChange.
+const (
+	dbChangePut dbChangeOp = iota + 1
+	dbChangeDelete
+	dbChangeSequence
+)
+
+// dbChange is one change made to a bucket by a committed transaction.
+type dbChange struct {
+	txid   uint64
+	time   int64 // unix nanoseconds of the commit
+	op     dbChangeOp
+	bucket []byte
+	key    []byte
+	value  []byte // the value for puts, or the sequence for sequences
+}
+
+// journalRecord returns the bytes we write to the change journal for this
+// change: a header of the txid, time and op, followed by the length-prefixed
+// bucket, key and value.
+func (c *dbChange) journalRecord() []byte {
+	var b bytes.Buffer
+	header := make([]byte, dbChangeHeaderLength)
+	binary.BigEndian.PutUint64(header, c.txid)
+	binary.BigEndian.PutUint64(header[8:], uint64(c.time))
+	header[16] = byte(c.op)
+	b.Write(header)
+	lens := make([]byte, 4)
+	for _, field := range [][]byte{c.bucket, c.key, c.value} {
+		binary.BigEndian.PutUint32(lens, uint32(len(field)))
+		b.Write(lens)
+		b.Write(field)
+	}
+	return b.Bytes()
+}
+
+// readDBChange reads the next change from a change journal or segment. A
+// partially written final record (because we crashed while writing it)
+// results in an error, the same as reaching the end.
+func readDBChange(r io.Reader) (*dbChange, error) {
+	header := make([]byte, dbChangeHeaderLength)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	c := &dbChange{
+		txid: binary.BigEndian.Uint64(header),
+		time: int64(binary.BigEndian.Uint64(header[8:])),
+		op:   dbChangeOp(header[16]),
+	}
+	if c.bucket, err = readJournalField(r); err != nil {
+		return nil, err
+	}
+	if c.key, err = readJournalField(r); err != nil {
+		return nil, err
+	}
+	if c.value, err = readJournalField(r); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// apply makes this change to the given transaction.
+func (c *dbChange) apply(tx *bolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists(c.bucket)
+	if err != nil {
+		return err
+	}
+	switch c.op {
+	case dbChangePut:
+		return b.Put(c.key, c.value)
+	case dbChangeDelete:
+		return b.Delete(c.key)
+	case dbChangeSequence:
+		if len(c.value) != 8 {
+			return fmt.Errorf("bad sequence change in bucket %s", c.bucket)
+		}
+		return b.SetSequence(binary.BigEndian.Uint64(c.value))
+	}
+	return fmt.Errorf("unknown change op %d", c.op)
+}
+
+// changeLog is the local journal that the changes of every committed
+// transaction are appended to, until they are shipped as a segment.
+type changeLog struct {
+	path    string
+	f       *os.File
+	count   int
+	minTxid uint64
+	maxTxid uint64
+	minTime int64
+	maxTime int64
+	err     error
+	mutex   sync.Mutex
+}
+
+// note updates our record of the range of txids and times in the journal to
+// include the given change. (Since transactions are journalled after their
+// commit, they may not be journalled in txid order.)
+func (cl *changeLog) note(c *dbChange) {
+	if cl.count == 0 || c.txid < cl.minTxid {
+		cl.minTxid = c.txid
+	}
+	if c.txid > cl.maxTxid {
+		cl.maxTxid = c.txid
+	}
+	if cl.count == 0 || c.time < cl.minTime {
+		cl.minTime = c.time
+	}
+	if c.time > cl.maxTime {
+		cl.maxTime = c.time
+	}
+	cl.count++
+}
+
+// openChangeLog opens (creating if necessary) the change journal that goes
+// with the given database file, keeping any changes in it that were not
+// shipped before we last stopped.
+func openChangeLog(dbFile string) (*changeLog, error) {
+	cl := &changeLog{path: dbFile + dbChangeJournalSuffix}
+	f, err := os.OpenFile(cl.path, os.O_RDWR|os.O_CREATE, dbFilePermission)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		c, errr := readDBChange(r)
+		if errr != nil {
+			break
+		}
+		good += int64(len(c.journalRecord()))
+		cl.note(c)
+	}
+
+	// discard any partial final record, so we append after the good ones
+	if err = f.Truncate(good); err == nil {
+		_, err = f.Seek(good, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	cl.f = f
+	return cl, nil
+}
+
+// append implements dbChangeSink, writing the given changes to the journal.
+// Since it is called after the commit, errors can't undo anything; they are
+// remembered and returned by the next ship() instead.
+func (cl *changeLog) append(txid uint64, changes []*dbChange) {
+	if len(changes) == 0 {
+		return
+	}
+	var b bytes.Buffer
+	for _, c := range changes {
+		b.Write(c.journalRecord())
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if cl.f == nil {
+		return
+	}
+	if _, err := cl.f.Write(b.Bytes()); err != nil {
+		cl.err = err
+		return
+	}
+	for _, c := range changes {
+		cl.note(c)
+	}
+}
+
+// ship compresses the journalled changes to a new segment file next to the
+// given backup path, then empties the journal. Does nothing if there are no
+// changes.
+func (cl *changeLog) ship(bkPath string) error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if cl.err != nil {
+		err := cl.err
+		cl.err = nil
+		return fmt.Errorf("changes could not be journalled since the last backup, so a snapshot is needed: %s", err)
+	}
+	if cl.count == 0 {
+		return nil
+	}
+
+	segment := bkPath + dbChangesInfix + fmt.Sprintf("%020d-%020d.%020d-%020d", cl.minTxid, cl.maxTxid, cl.minTime, cl.maxTime) + dbIncrementalExt
+	_, err := cl.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = writeCompressed(segment, cl.f)
+	if err != nil {
+		// carry on appending to the end of the journal, to try again later
+		_, errs := cl.f.Seek(0, io.SeekEnd)
+		if errs != nil {
+			cl.err = errs
+		}
+		return err
+	}
+
+	if err = cl.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = cl.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cl.count, cl.minTxid, cl.maxTxid, cl.minTime, cl.maxTime = 0, 0, 0, 0, 0
+	return nil
+}
+
+// close closes the journal; changes after this are not journalled.
+func (cl *changeLog) close() error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if cl.f == nil {
+		return nil
+	}
+	err := cl.f.Close()
+	cl.f = nil
+	return err
+}
+
+// writeCompressed gzips everything in r to the given path, via a temporary
+// file so that a partial file is never left at path.
+func writeCompressed(path string, r io.Reader) error {
+	return writeCompressedWith(path, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// writeCompressedWith is like writeCompressed(), but gzips whatever the given
+// function writes.
+func writeCompressedWith(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, dbFilePermission)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	err = write(gz)
+	if err == nil {
+		err = gz.Close()
+	}
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// dbChangeSink is something that wants the changes made by every committed
+// transaction.
+type dbChangeSink interface {
+	// append is given the changes made by the committed transaction with the
+	// given id, which have already been stamped with that id and the time of
+	// the commit. It is called after the commit (so not necessarily in txid
+	// order), even if there were no changes.
+	append(txid uint64, changes []*dbChange)
+}
+
+// loggingTx is a dbTx that notes the changes made to its buckets.
+type loggingTx struct {
+	boltTx
+	changes []*dbChange
+}
+
+// newLoggingTx returns a loggingTx for the given bolt transaction that will
+// append its changes to the given sinks if (and only if) the transaction gets
+// committed.
+func newLoggingTx(tx *bolt.Tx, sinks []dbChangeSink) *loggingTx {
+	lt := &loggingTx{boltTx: boltTx{tx}}
+	txid := uint64(tx.ID()) // (the tx is closed by the time OnCommit calls us)
+	tx.OnCommit(func() {
+		now := time.Now().UnixNano()
+		for _, c := range lt.changes {
+			c.txid = txid
+			c.time = now
+		}
+		for _, sink := range sinks {
+			sink.append(txid, lt.changes)
+		}
+	})
+	return lt
+}
+
+// note records a change to the given bucket, copying the key and value since
+// they may not be valid after the transaction.
+func (t *loggingTx) note(op dbChangeOp, bucket, key, value []byte) {
+	t.changes = append(t.changes, &dbChange{
+		op:     op,
+		bucket: bucket,
+		key:    append([]byte(nil), key...),
+		value:  append([]byte(nil), value...),
+	})
+}
+
+// Bucket implements dbTx.
+func (t *loggingTx) Bucket(name []byte) dbBucket {
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return &loggingBucket{boltBucket{b}, append([]byte(nil), name...), t}
+}
+
+// CreateBucketIfNotExists implements dbTx.
+func (t *loggingTx) CreateBucketIfNotExists(name []byte) (dbBucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingBucket{boltBucket{b}, append([]byte(nil), name...), t}, nil
+}
+
+// loggingBucket is a dbBucket of a loggingTx.
+type loggingBucket struct {
+	boltBucket
+	name []byte
+	tx   *loggingTx
+}
+
+// Put implements dbBucket.
+func (b *loggingBucket) Put(key, value []byte) error {
+	err := b.boltBucket.Put(key, value)
+	if err == nil {
+		b.tx.note(dbChangePut, b.name, key, value)
+	}
+	return err
+}
+
+// Delete implements dbBucket.
+func (b *loggingBucket) Delete(key []byte) error {
+	err := b.boltBucket.Delete(key)
+	if err == nil {
+		b.tx.note(dbChangeDelete, b.name, key, nil)
+	}
+	return err
+}
+
+// NextSequence implements dbBucket.
+func (b *loggingBucket) NextSequence() (uint64, error) {
+	seq, err := b.boltBucket.NextSequence()
+	if err == nil {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, seq)
+		b.tx.note(dbChangeSequence, b.name, nil, value)
+	}
+	return seq, err
+}
+
+// Cursor implements dbBucket.
+func (b *loggingBucket) Cursor() dbCursor {
+	return &loggingCursor{b.Bucket.Cursor(), b, nil}
+}
+
+// loggingCursor is a dbCursor of a loggingBucket, which notes the keys it
+// deletes.
+type loggingCursor struct {
+	*bolt.Cursor
+	bucket *loggingBucket
+	key    []byte
+}
+
+// First implements dbCursor.
+func (c *loggingCursor) First() ([]byte, []byte) {
+	k, v := c.Cursor.First()
+	c.key = k
+	return k, v
+}
+
+// Seek implements dbCursor.
+func (c *loggingCursor) Seek(seek []byte) ([]byte, []byte) {
+	k, v := c.Cursor.Seek(seek)
+	c.key = k
+	return k, v
+}
+
+// Next implements dbCursor.
+func (c *loggingCursor) Next() ([]byte, []byte) {
+	k, v := c.Cursor.Next()
+	c.key = k
+	return k, v
+}
+
+// Delete implements dbCursor.
+func (c *loggingCursor) Delete() error {
+	key := append([]byte(nil), c.key...)
+	err := c.Cursor.Delete()
+	if err == nil {
+		c.bucket.tx.note(dbChangeDelete, c.bucket.name, key, nil)
+	}
+	return err
+}
+
+// incrementalBackups holds the state of a db that is being backed up
+// incrementally.
+type incrementalBackups struct {
+	changes      *changeLog
+	interval     time.Duration
+	lastSnapshot time.Time
+}
+
+// enableIncrementalBackups makes our backups incremental, if backups are
+// enabled and we are using a boltdb file: from now on, instead of copying the
+// whole database to our backup path each time, changes are journalled next to
+// dbFile and shipped as compressed segments next to the backup path, with a
+// compressed snapshot of the whole database taken every interval.
+//
+// If the database has changes that are in neither the latest snapshot nor the
+// change journal (eg. because it was just created, or recovered, or changed
+// by initDB()), a snapshot is taken immediately.
+func (db *db) enableIncrementalBackups(dbFile string, interval time.Duration) error {
+	if !db.backupsEnabled || interval <= 0 {
+		return nil
+	}
+	bb, err := db.boltBackend()
+	if err != nil {
+		return nil
+	}
+
+	cl, err := openChangeLog(dbFile)
+	if err != nil {
+		return err
+	}
+
+	inc := &incrementalBackups{changes: cl, interval: interval}
+	covered := cl.maxTxid
+	snapshots, err := listDBSnapshots(db.backupPath)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 {
+		latest := snapshots[len(snapshots)-1]
+		inc.lastSnapshot = time.Unix(0, latest.time)
+		if latest.firstTxid > covered {
+			covered = latest.firstTxid
+		}
+	}
+
+	var current uint64
+	err = bb.bolt.View(func(tx *bolt.Tx) error {
+		current = uint64(tx.ID())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if current > covered || len(snapshots) == 0 {
+		err = db.snapshot(bb)
+		if err != nil {
+			return err
+		}
+		inc.lastSnapshot = time.Now()
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	db.incremental = inc
+	bb.changes = cl
+	return nil
+}
+
+// backupIncrementally is used by backupToBackupFile() to do an incremental
+// backup: it ships the change journal, then takes a snapshot if one is due.
+func (db *db) backupIncrementally(bb *boltBackend) {
+	inc := db.incremental
+	err := inc.changes.ship(db.backupPath)
+	needSnapshot := err != nil
+	if err != nil {
+		db.Error("Database incremental backup failed to ship changes", "err", err)
+	}
+
+	if !needSnapshot && !inc.lastSnapshot.IsZero() && time.Since(inc.lastSnapshot) < inc.interval {
+		return
+	}
+
+	err = db.snapshot(bb)
+	if err != nil {
+		db.Error("Database incremental backup failed to take a snapshot", "err", err)
+		return
+	}
+	inc.lastSnapshot = time.Now()
+
+	err = pruneDBBackups(db.backupPath, dbSnapshotsKept)
+	if err != nil {
+		db.Warn("Database incremental backup failed to remove old backups", "err", err)
+	}
+}
+
+// snapshot writes a compressed snapshot of the database next to our backup
+// path.
+func (db *db) snapshot(bb *boltBackend) error {
+	return writeDBSnapshot(bb.bolt, db.backupPath)
+}
+
+// writeDBSnapshot writes a compressed snapshot of the given database next to
+// the given backup path, named for the id of the last transaction it includes
+// and the current time.
+func writeDBSnapshot(b *bolt.DB, bkPath string) error {
+	return b.View(func(tx *bolt.Tx) error {
+		path := bkPath + dbSnapshotInfix + fmt.Sprintf("%020d.%020d", tx.ID(), time.Now().UnixNano()) + dbIncrementalExt
+		return writeCompressedWith(path, func(w io.Writer) error {
+			_, err := tx.WriteTo(w)
+			return err
+		})
+	})
+}
+
+// dbBackupFile describes one of the snapshot or change segment files of an
+// incremental backup. For snapshots, firstTxid and lastTxid are the same, as
+// are time and lastTime.
+type dbBackupFile struct {
+	path      string
+	firstTxid uint64
+	lastTxid  uint64
+	time      int64 // of the snapshot, or of the earliest change in a segment
+	lastTime  int64
+}
+
+// listDBSnapshots returns the snapshots next to the given backup path, oldest
+// first.
+func listDBSnapshots(bkPath string) ([]*dbBackupFile, error) {
+	paths, err := filepath.Glob(bkPath + dbSnapshotInfix + "*" + dbIncrementalExt)
+	if err != nil {
+		return nil, err
+	}
+	var files []*dbBackupFile
+	for _, path := range paths {
+		f := &dbBackupFile{path: path}
+		if _, errs := fmt.Sscanf(path[len(bkPath+dbSnapshotInfix):], "%d.%d", &f.firstTxid, &f.time); errs != nil {
+			continue
+		}
+		f.lastTxid, f.lastTime = f.firstTxid, f.time
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].time < files[j].time
+	})
+	return files, nil
+}
+
+// listDBChangeSegments returns the change segments next to the given backup
+// path, oldest first.
+func listDBChangeSegments(bkPath string) ([]*dbBackupFile, error) {
+	paths, err := filepath.Glob(bkPath + dbChangesInfix + "*" + dbIncrementalExt)
+	if err != nil {
+		return nil, err
+	}
+	var files []*dbBackupFile
+	for _, path := range paths {
+		f := &dbBackupFile{path: path}
+		if _, errs := fmt.Sscanf(path[len(bkPath+dbChangesInfix):], "%d-%d.%d-%d", &f.firstTxid, &f.lastTxid, &f.time, &f.lastTime); errs != nil {
+			continue
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].firstTxid < files[j].firstTxid
+	})
+	return files, nil
+}
+
+// pruneDBBackups deletes all but the most recent keep snapshots next to the
+// given backup path, along with the change segments that only have changes
+// from before the oldest one kept.
+func pruneDBBackups(bkPath string, keep int) error {
+	snapshots, err := listDBSnapshots(bkPath)
+	if err != nil || len(snapshots) <= keep {
+		return err
+	}
+	for _, s := range snapshots[:len(snapshots)-keep] {
+		if err = os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+
+	oldest := snapshots[len(snapshots)-keep]
+	segments, err := listDBChangeSegments(bkPath)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s.lastTxid <= oldest.firstTxid {
+			if err = os.Remove(s.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readDBChanges reads all the changes in the given reader, which can be
+// gzipped.
+func readDBChanges(r io.Reader, compressed bool) ([]*dbChange, error) {
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close() // #nosec nothing useful to do if closing fails
+		r = gz
+	}
+	br := bufio.NewReader(r)
+	var changes []*dbChange
+	for {
+		c, err := readDBChange(br)
+		if err != nil {
+			break
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// restoreDBFromIncremental recreates dbFile as it was at the given time, from
+// the latest snapshot next to bkPath taken at or before then, followed by the
+// changes since that snapshot up to that time (including any not yet shipped
+// from the change journal of dbFile). Any existing dbFile is replaced. The
+// snapshots and segments that were used are then set aside as abandoned
+// (since changes made to the restored database would not follow on from
+// them), and a new snapshot of the restored database is taken. Returns a
+// description of what was restored.
+func restoreDBFromIncremental(dbFile, bkPath string, at time.Time) (string, error) {
+	snapshots, err := listDBSnapshots(bkPath)
+	if err != nil {
+		return "", err
+	}
+	var snap *dbBackupFile
+	for _, s := range snapshots {
+		if s.time <= at.UnixNano() {
+			snap = s
+		}
+	}
+	if snap == nil {
+		return "", fmt.Errorf("there is no incremental backup snapshot next to %s from before %s", bkPath, at.Format(time.RFC3339))
+	}
+
+	// gather the changes made after the snapshot, up to the given time
+	segments, err := listDBChangeSegments(bkPath)
+	if err != nil {
+		return "", err
+	}
+	var changes []*dbChange
+	keep := func(cs []*dbChange) {
+		for _, c := range cs {
+			if c.txid > snap.firstTxid && c.time <= at.UnixNano() {
+				changes = append(changes, c)
+			}
+		}
+	}
+	for _, s := range segments {
+		if s.lastTxid <= snap.firstTxid || s.time > at.UnixNano() {
+			continue
+		}
+		cs, errr := readDBChangesFromFile(s.path, true)
+		if errr != nil {
+			return "", errr
+		}
+		keep(cs)
+	}
+	if cs, errr := readDBChangesFromFile(dbFile+dbChangeJournalSuffix, false); errr == nil {
+		keep(cs)
+	} else if !os.IsNotExist(errr) {
+		return "", errr
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].txid < changes[j].txid
+	})
+
+	// recreate the database from the snapshot, then apply the changes
+	tmp := dbFile + ".restoring"
+	err = decompressFile(snap.path, tmp)
+	if err != nil {
+		return "", err
+	}
+	b, err := bolt.Open(tmp, dbFilePermission, nil)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	err = b.Update(func(tx *bolt.Tx) error {
+		for _, c := range changes {
+			if erra := c.apply(tx); erra != nil {
+				return erra
+			}
+		}
+		return nil
+	})
+	if errc := b.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Rename(tmp, dbFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+
+	// start a new history of the restored database
+	err = abandonDBBackups(dbFile, bkPath)
+	if err != nil {
+		return "", err
+	}
+	b, err = bolt.Open(dbFile, dbFilePermission, nil)
+	if err != nil {
+		return "", err
+	}
+	err = writeDBSnapshot(b, bkPath)
+	if errc := b.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("restored db file %s to %s from the snapshot taken at %s and %d later changes", dbFile, at.Format(time.RFC3339), time.Unix(0, snap.time).Format(time.RFC3339), len(changes)), nil
+}
+
+// readDBChangesFromFile is like readDBChanges(), but reads the file at the
+// given path.
+func readDBChangesFromFile(path string, compressed bool) ([]*dbChange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // #nosec nothing useful to do if closing fails
+	return readDBChanges(f, compressed)
+}
+
+// decompressFile gunzips the file at source to a new file at dest.
+func decompressFile(source, dest string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // #nosec nothing useful to do if closing fails
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gz.Close() // #nosec nothing useful to do if closing fails
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, dbFilePermission)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, gz)
+	if errc := out.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// abandonDBBackups renames all the snapshots and change segments next to
+// bkPath so that they are no longer used, and removes the change journal of
+// dbFile.
+func abandonDBBackups(dbFile, bkPath string) error {
+	prefix := bkPath + dbAbandonedInfix + fmt.Sprintf("%020d", time.Now().UnixNano())
+	for _, infix := range []string{dbSnapshotInfix, dbChangesInfix} {
+		paths, err := filepath.Glob(bkPath + infix + "*" + dbIncrementalExt)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			err = os.Rename(path, prefix+path[len(bkPath):])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := os.Remove(dbFile + dbChangeJournalSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeIncrementalBackups deletes the change journal of dbFile and all the
+// snapshots and change segments (including abandoned ones) next to bkPath.
+func removeIncrementalBackups(dbFile, bkPath string) error {
+	paths := []string{dbFile + dbChangeJournalSuffix}
+	for _, infix := range []string{dbSnapshotInfix, dbChangesInfix, dbAbandonedInfix} {
+		matches, err := filepath.Glob(bkPath + infix + "*")
+		if err != nil {
+			return err
+		}
+		paths = append(paths, matches...)
+	}
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasDBSnapshots tells you if there are any incremental backup snapshots next
+// to the given backup path.
+func hasDBSnapshots(bkPath string) bool {
+	snapshots, err := listDBSnapshots(bkPath)
+	return err == nil && len(snapshots) > 0
+}
+
+// RestoreDB recreates the database file of a server that was configured with
+// the given DBFile and DBFileBackup (which can be in S3, as per
+// ServerConfig.DBFileBackup) in the given deployment, as it was at the given
+// time, using the snapshots and change segments of its incremental backups
+// (see ServerConfig.DBSnapshotInterval). The server must not be running.
+// Returns a description of what was restored.
+func RestoreDB(dbFile, dbBkFile, deployment string, at time.Time, logger log15.Logger) (string, error) {
+	bkPath, fs, err := mountDBBackup(dbFile, dbBkFile, deployment, logger)
+	if err != nil {
+		return "", err
+	}
+	if fs != nil {
+		defer func() {
+			if erru := fs.Unmount(); erru != nil {
+				logger.Warn("failed to unmount database backup location", "err", erru)
+			}
+		}()
+	}
+	return restoreDBFromIncremental(dbFile, bkPath, at)
+}
@@ -0,0 +1,188 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for replicating a boltdb database to standby
+// servers. A standby gets a copy of the whole database the first time it asks,
+// and after that only the changes committed since its last request, in the
+// same form as the records of the change journal used for incremental backups
+// (see dbIncremental.go).
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// dbReplicationFeedLimit is the most bytes of changes we keep for standbys; a
+// standby that falls further behind than this gets a copy of the whole database
+// again. It is a variable only for testing purposes.
+var dbReplicationFeedLimit = 64 * 1024 * 1024
+
+// replicationFeed is a dbChangeSink that keeps the changes of recently
+// committed transactions in memory, for sending to standbys.
+type replicationFeed struct {
+	batches map[uint64][]byte // journal records of the changes, by txid
+	first   uint64            // the lowest txid we could have changes for
+	size    int
+	mutex   sync.Mutex
+}
+
+// newReplicationFeed returns a replicationFeed that will keep the changes of
+// transactions after the one with the given id.
+func newReplicationFeed(txid uint64) *replicationFeed {
+	return &replicationFeed{batches: make(map[uint64][]byte), first: txid + 1}
+}
+
+// append implements dbChangeSink, keeping the given changes until we have more
+// than dbReplicationFeedLimit bytes of them, after which the oldest are
+// dropped.
+func (f *replicationFeed) append(txid uint64, changes []*dbChange) {
+	var b bytes.Buffer
+	for _, c := range changes {
+		b.Write(c.journalRecord())
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if txid < f.first {
+		return
+	}
+	f.batches[txid] = append(f.batches[txid], b.Bytes()...)
+	f.size += b.Len()
+	for f.size > dbReplicationFeedLimit && len(f.batches) > 1 {
+		f.size -= len(f.batches[f.first])
+		delete(f.batches, f.first)
+		f.first++
+	}
+}
+
+// since returns the changes of the transactions after the one with the given
+// id, up to (at most) the one with id upTo, along with the id of the last
+// transaction included. Since transactions are passed to us after their
+// commit, the latest ones may not be included yet. Returns false if we don't
+// have all the changes since txid, in which case the standby needs a copy of
+// the whole database.
+func (f *replicationFeed) since(txid, upTo uint64) ([]byte, uint64, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if txid+1 < f.first {
+		return nil, txid, false
+	}
+	var b bytes.Buffer
+	for txid < upTo {
+		batch, ok := f.batches[txid+1]
+		if !ok {
+			break
+		}
+		b.Write(batch)
+		txid++
+	}
+	return b.Bytes(), txid, true
+}
+
+// replicationFeed returns our replicationFeed, creating it the first time a
+// standby asks for one. It is created in a write transaction of its own, so
+// that no other is in progress and it gets the changes of every transaction
+// that commits after that one.
+func (bb *boltBackend) replicationFeed() (*replicationFeed, error) {
+	bb.feedMutex.Lock()
+	defer bb.feedMutex.Unlock()
+	if bb.feed != nil {
+		return bb.feed, nil
+	}
+	err := bb.bolt.Update(func(tx *bolt.Tx) error {
+		bb.feed = newReplicationFeed(uint64(tx.ID()))
+		return nil
+	})
+	return bb.feed, err
+}
+
+// replicate writes to w what a standby with a copy of the database as of the
+// transaction with the given id needs to bring it up to date: nothing if it is
+// already up to date, the changes made since then if we have them all, or
+// otherwise a consistent view of the whole database. (We only have changes for
+// copies made since the first standby asked us for one, so a copy made from a
+// previous incarnation of the database always gets replaced.) Returns the id
+// of the last transaction the standby will then have seen, and whether w got
+// the whole database.
+func (bb *boltBackend) replicate(w io.Writer, txid int) (int, bool, error) {
+	feed, err := bb.replicationFeed()
+	if err != nil {
+		return txid, false, err
+	}
+
+	current := txid
+	var whole bool
+	err = bb.bolt.View(func(tx *bolt.Tx) error {
+		current = tx.ID()
+		if current == txid {
+			return nil
+		}
+		if txid > 0 && txid < current {
+			changes, upTo, ok := feed.since(uint64(txid), uint64(current))
+			if ok {
+				current = int(upTo)
+				_, errw := w.Write(changes)
+				return errw
+			}
+		}
+		whole = true
+		_, txErr := tx.WriteTo(w)
+		return txErr
+	})
+	return current, whole, err
+}
+
+// applyDBChanges applies changes sent by a replicationFeed to our existing copy
+// of the database at the given path, in a single transaction.
+func applyDBChanges(path string, changes []byte) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no copy of the database to apply changes to (replicate from a txid of 0 to get one): %s", err)
+	}
+
+	b, err := bolt.Open(path, dbFilePermission, nil)
+	if err != nil {
+		return err
+	}
+	err = b.Update(func(tx *bolt.Tx) error {
+		r := bytes.NewReader(changes)
+		for r.Len() > 0 {
+			c, errr := readDBChange(r)
+			if errr != nil {
+				return errr
+			}
+			if errr = c.apply(tx); errr != nil {
+				return errr
+			}
+		}
+		return nil
+	})
+	if errc := b.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
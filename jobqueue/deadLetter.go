@@ -0,0 +1,324 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for analysing buried ("dead letter") jobs, which
+// have failed more times than their Retries allowed, and for optionally
+// exporting their details for offline debugging.
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// failureSignatureLines is the number of non-blank lines at the end of a
+// buried job's STDERR that are used to cluster it with similar failures.
+const failureSignatureLines = 3
+
+// failureShingleWords is the number of consecutive words in each of the
+// shingles we hash when comparing failure signatures, and
+// failureSimilarityThreshold is the minimum fraction of shingles two
+// signatures must share for their clusters to be merged.
+const (
+	failureShingleWords        = 3
+	failureSimilarityThreshold = 0.7
+)
+
+// these are used to normalise STDERR lines, so that failures that differ only
+// in things like file names, ids and numbers cluster together
+var (
+	failureSigPath = regexp.MustCompile(`(?:/[^\s/:'"]+){2,}/?`)
+	failureSigHex  = regexp.MustCompile(`\b(?:0x)?[0-9a-fA-F]{8,}\b`)
+	failureSigNum  = regexp.MustCompile(`\d+`)
+
+	// failureTruncation matches the line prefixSuffixSaver puts between the
+	// head and tail of long STDERR
+	failureTruncation = regexp.MustCompile(`(?m)^\.\.\. omitting \d+ bytes \.\.\.$`)
+)
+
+// FailureCluster describes a set of buried jobs that failed in the same way:
+// with the same FailReason and exit code, and with similar STDERR.
+type FailureCluster struct {
+	// Signature is the normalised form of the last few lines of STDERR that
+	// the jobs in this cluster share, with paths replaced by <path>, long hex
+	// strings by <hex> and numbers by N.
+	Signature string
+
+	FailReason string
+	Exitcode   int
+
+	// Count is the number of jobs in the cluster.
+	Count int
+
+	// Summary is a one line description of the cluster, eg. "8214 jobs failed
+	// with: No space left on device".
+	Summary string
+
+	// Keys are the keys of the jobs in the cluster, which you can use to eg.
+	// Kick() them all. (Not populated by GetFailureSummaries().)
+	Keys []string
+
+	// RepGroups are the sorted, unique RepGroups of the jobs in the cluster.
+	RepGroups []string
+
+	// ExampleCmd and ExampleStdErr are the Cmd and end of the STDERR of one of
+	// the jobs in the cluster.
+	ExampleCmd    string
+	ExampleStdErr string
+}
+
+// failureSignature returns the last failureSignatureLines non-blank lines of
+// the given STDERR, along with a normalised form of them. If the STDERR was
+// truncated, only its tail is considered, and the first line of that is
+// ignored (since it will usually have been cut part way through) unless there
+// is nothing else.
+func failureSignature(stderr string) (tail, signature string) {
+	if locs := failureTruncation.FindAllStringIndex(stderr, -1); len(locs) > 0 {
+		stderr = stderr[locs[len(locs)-1][1]:]
+		stderr = strings.TrimLeft(stderr, "\n")
+		if nl := strings.Index(stderr, "\n"); nl >= 0 && strings.TrimSpace(stderr[nl:]) != "" {
+			stderr = stderr[nl+1:]
+		}
+	}
+
+	var lines []string
+	all := strings.Split(stderr, "\n")
+	for i := len(all) - 1; i >= 0 && len(lines) < failureSignatureLines; i-- {
+		line := strings.TrimSpace(all[i])
+		if line == "" {
+			continue
+		}
+		lines = append([]string{line}, lines...)
+	}
+	tail = strings.Join(lines, "\n")
+
+	signature = failureSigPath.ReplaceAllString(tail, "<path>")
+	signature = failureSigHex.ReplaceAllString(signature, "<hex>")
+	signature = failureSigNum.ReplaceAllString(signature, "N")
+	return tail, signature
+}
+
+// failureShingles returns the hashes of every run of failureShingleWords
+// words in the given signature (or of the whole signature if it has fewer
+// words than that).
+func failureShingles(signature string) map[uint64]bool {
+	words := strings.Fields(signature)
+	n := failureShingleWords
+	if len(words) < n {
+		n = len(words)
+	}
+	shingles := make(map[uint64]bool)
+	for i := 0; i+n <= len(words); i++ {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(strings.Join(words[i:i+n], " ")))
+		shingles[h.Sum64()] = true
+		if n == 0 {
+			// a blank signature has a single, empty, shingle
+			break
+		}
+	}
+	return shingles
+}
+
+// shingleSimilarity returns the Jaccard similarity of the given sets of
+// shingles: 1 if they're identical, 0 if they share nothing.
+func shingleSimilarity(a, b map[uint64]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	shared := 0
+	for h := range a {
+		if b[h] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// failureSummary returns a one line summary of the given cluster, using the
+// last line of its ExampleStdErr, or its FailReason if it had no STDERR.
+func failureSummary(cluster *FailureCluster) string {
+	message := cluster.FailReason
+	if cluster.ExampleStdErr != "" {
+		lines := strings.Split(cluster.ExampleStdErr, "\n")
+		message = lines[len(lines)-1]
+	}
+	noun := "jobs"
+	if cluster.Count == 1 {
+		noun = "job"
+	}
+	return fmt.Sprintf("%d %s failed with: %s", cluster.Count, noun, message)
+}
+
+// clusterFailures groups the given buried jobs (which should have their
+// StdErrC populated) in to FailureClusters, sorted largest first. Jobs are
+// first grouped by exact signature, then groups with the same FailReason and
+// exit code whose signatures are similar enough (going by their shingles) are
+// merged in to the largest of them.
+func clusterFailures(jobs []*Job) []*FailureCluster {
+	clusters := make(map[string]*FailureCluster)
+	repGroups := make(map[string]map[string]bool)
+	for _, job := range jobs {
+		stderr, err := job.StdErr()
+		if err != nil {
+			stderr = ""
+		}
+		tail, signature := failureSignature(stderr)
+
+		job.RLock()
+		id := job.FailReason + "\x00" + strconv.Itoa(job.Exitcode) + "\x00" + signature
+		cluster, exists := clusters[id]
+		if !exists {
+			cluster = &FailureCluster{
+				Signature:     signature,
+				FailReason:    job.FailReason,
+				Exitcode:      job.Exitcode,
+				ExampleCmd:    job.Cmd,
+				ExampleStdErr: tail,
+			}
+			clusters[id] = cluster
+			repGroups[id] = make(map[string]bool)
+		}
+		cluster.Count++
+		cluster.Keys = append(cluster.Keys, job.Key())
+		repGroups[id][job.RepGroup] = true
+		job.RUnlock()
+	}
+
+	ids := make([]string, 0, len(clusters))
+	for id := range clusters {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return clusterBefore(clusters[ids[i]], clusters[ids[j]])
+	})
+
+	var merged []*FailureCluster
+	var mergedShingles []map[uint64]bool
+	var mergedRGs []map[string]bool
+	for _, id := range ids {
+		cluster := clusters[id]
+		shingles := failureShingles(cluster.Signature)
+		into := -1
+		for i, m := range merged {
+			if m.FailReason == cluster.FailReason && m.Exitcode == cluster.Exitcode &&
+				shingleSimilarity(mergedShingles[i], shingles) >= failureSimilarityThreshold {
+				into = i
+				break
+			}
+		}
+		if into == -1 {
+			merged = append(merged, cluster)
+			mergedShingles = append(mergedShingles, shingles)
+			mergedRGs = append(mergedRGs, repGroups[id])
+			continue
+		}
+		merged[into].Count += cluster.Count
+		merged[into].Keys = append(merged[into].Keys, cluster.Keys...)
+		for rg := range repGroups[id] {
+			mergedRGs[into][rg] = true
+		}
+	}
+
+	for i, cluster := range merged {
+		for rg := range mergedRGs[i] {
+			cluster.RepGroups = append(cluster.RepGroups, rg)
+		}
+		sort.Strings(cluster.RepGroups)
+		cluster.Summary = failureSummary(cluster)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return clusterBefore(merged[i], merged[j])
+	})
+	return merged
+}
+
+// clusterBefore is used to sort FailureClusters largest first, then by
+// Signature.
+func clusterBefore(a, b *FailureCluster) bool {
+	if a.Count == b.Count {
+		return a.Signature < b.Signature
+	}
+	return a.Count > b.Count
+}
+
+// failureClusters gets the buried jobs in the given RepGroup (or all buried
+// jobs if repGroup is blank; search is as for getJobsByRepGroup()) that are in
+// the given namespace, and clusters them.
+func (s *Server) failureClusters(repGroup string, search bool, namespace string) ([]*FailureCluster, string, string) {
+	var jobs []*Job
+	if repGroup == "" {
+		jobs = s.getJobsCurrent(0, JobStateBuried, nil, true, false)
+	} else {
+		var srerr, qerr string
+		jobs, srerr, qerr = s.getJobsByRepGroup(repGroup, search, 0, JobStateBuried, nil, true, false)
+		if srerr != "" {
+			return nil, srerr, qerr
+		}
+	}
+	return clusterFailures(jobsInNamespace(jobs, namespace)), "", ""
+}
+
+// failureSummaries is like failureClusters(), but doesn't include the Keys of
+// the jobs in each cluster, which could be very many.
+func (s *Server) failureSummaries(repGroup string, search bool, namespace string) ([]*FailureCluster, string, string) {
+	clusters, srerr, qerr := s.failureClusters(repGroup, search, namespace)
+	for _, cluster := range clusters {
+		cluster.Keys = nil
+	}
+	return clusters, srerr, qerr
+}
+
+// exportBuriedJob writes the details of the given job, which just got buried
+// with the given end state, to a JSON file named after its key in the given
+// directory (our buriedExportDir), so that its inputs and logs can be debugged
+// offline.
+func (s *Server) exportBuriedJob(dir, key string, endState *JobEndState) {
+	item, err := s.q.Get(key)
+	if err != nil {
+		s.Warn("could not find buried job to export", "key", key, "err", err)
+		return
+	}
+	job := s.itemToJob(item, false, true)
+	job.StdOutC = endState.Stdout
+	job.StdErrC = endState.Stderr
+
+	status, err := job.ToStatus()
+	if err == nil {
+		var encoded []byte
+		encoded, err = json.MarshalIndent(status, "", "  ")
+		if err == nil {
+			err = os.MkdirAll(dir, os.ModePerm)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, key+".json"), encoded, 0600)
+		}
+	}
+	if err != nil {
+		s.Warn("failed to export buried job", "key", key, "err", err)
+	}
+}
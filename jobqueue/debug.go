@@ -0,0 +1,179 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for recreating the environment a job runs in, so
+// that users can interactively debug why it failed.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DebugSession is a recreation of the environment that a Job's Cmd runs in,
+// made by Client.DebugJob(). Call Cleanup() when you're done with it.
+type DebugSession struct {
+	// Job is the job being debugged, as it was when the session was created.
+	Job *Job
+
+	// Dir is the working directory the Cmd would run in: the Cwd if
+	// CwdMatters, otherwise a newly created unique directory within it, with
+	// any mounts and Inputs made available.
+	Dir string
+
+	// Env is the environment the Cmd would run with (minus any EnvSecrets),
+	// with WR_DEBUG_JOB set to the job's key, and WR_DEBUG_CMD to the command
+	// line (or Steps) that would be run.
+	Env []string
+
+	// Cmd is the command line that would be run. For jobs with Steps, these
+	// are the Steps that have not yet completed, one per line.
+	Cmd string
+
+	tmpDir string
+}
+
+// DebugJob gets the job with the given key, along with its environment, from
+// the server, then recreates the working directory it would be run from on this
+// host (including any mounts and Inputs), and works out the environment it
+// would be run with, as Execute() would. It returns a DebugSession describing
+// this, that you could use to give the user a shell to investigate why the job
+// failed.
+//
+// Jobs that are currently running can't be debugged. Jobs that need secrets
+// can be debugged, but the secrets are not made available.
+//
+// Writable mounts are mounted as normal, so be careful what you write to them;
+// anything written to a cached writable mount is not uploaded when you
+// Cleanup().
+func (c *Client) DebugJob(key string) (*DebugSession, error) {
+	return c.DebugJobContext(context.Background(), key)
+}
+
+// DebugJobContext is like DebugJob(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) DebugJobContext(ctx context.Context, key string) (*DebugSession, error) {
+	job, err := c.GetByEssenceContext(ctx, &JobEssence{JobKey: key}, false, true)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, Error{"DebugJob", key, ErrMissingJob}
+	}
+	if job.State == JobStateRunning || job.State == JobStateReserved {
+		return nil, Error{"DebugJob", key, ErrDebugRunning}
+	}
+
+	d := &DebugSession{Job: job}
+	job.ActualCwd = ""
+
+	cwd := job.retryCwd()
+	if fi, errf := os.Stat(cwd); errf != nil || !fi.Mode().IsDir() {
+		if err = os.MkdirAll(cwd, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("working directory [%s] could not be created: %w", cwd, err)
+		}
+	}
+	d.Dir = cwd
+	if !job.CwdMatters {
+		actualCwd, tmpDir, errm := mkHashedDir(cwd, job.Key())
+		if errm != nil {
+			return nil, fmt.Errorf("could not create working directory: %w", errm)
+		}
+		d.Dir, d.tmpDir = actualCwd, tmpDir
+		job.ActualCwd = actualCwd
+	}
+
+	if _, _, err = job.Mount(); err != nil {
+		return nil, d.cleanupAfter(fmt.Errorf("failed to mount remote file system(s): %w", err))
+	}
+
+	if len(job.Inputs) > 0 {
+		if _, err = c.inputCache().stage(job.Inputs, d.Dir); err != nil {
+			return nil, d.cleanupAfter(fmt.Errorf("failed to stage inputs: %w", err))
+		}
+	}
+
+	env, err := job.Env()
+	if err != nil {
+		return nil, d.cleanupAfter(fmt.Errorf("failed to extract environment variables: %w", err))
+	}
+	if d.tmpDir != "" {
+		env = envOverride(env, []string{"TMPDIR=" + d.tmpDir})
+		if job.ChangeHome {
+			env = envOverride(env, []string{"HOME=" + d.Dir})
+		}
+	}
+
+	if len(job.Steps) > 0 {
+		d.Cmd = strings.Join(job.Steps[job.firstStep():], "\n")
+	} else {
+		d.Cmd = job.retryCmd()
+	}
+	d.Env = envOverride(env, []string{"WR_DEBUG_JOB=" + job.Key(), "WR_DEBUG_CMD=" + d.Cmd})
+
+	return d, nil
+}
+
+// ShellArgs returns the arguments to exec to get an interactive shell of the
+// given type (eg. "bash") in this session, which will have loaded any of the
+// job's EnvModules first. You should run it from our Dir with our Env.
+func (d *DebugSession) ShellArgs(shell string) []string {
+	if load := d.Job.moduleLoadCmd(); load != "" {
+		return []string{shell, "-c", load + "exec " + shellQuote(shell) + " -i"}
+	}
+	return []string{shell, "-i"}
+}
+
+// Cleanup unmounts anything that was mounted for this session, without
+// uploading anything, and deletes the unique working directory that was created
+// (if the job's Cwd doesn't matter).
+func (d *DebugSession) Cleanup() error {
+	_, err := d.Job.Unmount(true)
+	if err != nil {
+		err = fmt.Errorf("failed to unmount: %w", err)
+	}
+
+	if d.tmpDir == "" {
+		return err
+	}
+
+	workSpace := filepath.Dir(d.Dir)
+	if errr := os.RemoveAll(workSpace); errr != nil {
+		if err == nil {
+			return errr
+		}
+		return fmt.Errorf("%v (and removing the working directory failed: %w)", err, errr)
+	}
+	if errr := rmEmptyDirs(workSpace, d.Job.retryCwd()); errr != nil && err == nil {
+		err = errr
+	}
+	return err
+}
+
+// cleanupAfter calls Cleanup(), returning the given error, amended with any
+// error from cleaning up.
+func (d *DebugSession) cleanupAfter(err error) error {
+	if errc := d.Cleanup(); errc != nil {
+		return fmt.Errorf("%v (and cleaning up failed: %w)", err, errc)
+	}
+	return err
+}
@@ -0,0 +1,251 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for describing the dependencies between current
+// jobs as a graph, so that the status webpage can show which upstream failures
+// are blocking downstream jobs.
+
+import (
+	"sort"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// DepGraph is a directed acyclic graph of the dependencies between jobs, where
+// the nodes are either whole RepGroups or individual jobs.
+type DepGraph struct {
+	// RepGroup is set when the nodes are the jobs of (and those connected to)
+	// this RepGroup, and is blank when the nodes are RepGroups.
+	RepGroup string `json:",omitempty"`
+	Nodes    []*DepGraphNode
+	Edges    []*DepGraphEdge
+}
+
+// DepGraphNode is a RepGroup or job in a DepGraph.
+type DepGraphNode struct {
+	// ID is the RepGroup name, or the job's key.
+	ID       string
+	RepGroup string
+	Cmd      string `json:",omitempty"` // only for job nodes
+
+	// Counts is the number of jobs in each state (with reserved merged in to
+	// running), which for a job node is 1 for the job's state. Complete jobs
+	// are only counted if another job in the graph depends on them.
+	Counts map[JobState]int
+}
+
+// DepGraphEdge is a dependency between two nodes in a DepGraph.
+type DepGraphEdge struct {
+	// From is the ID of the upstream node that To depends on.
+	From string
+	To   string
+
+	// Jobs is the number of dependencies of jobs in To on jobs in From.
+	Jobs int
+
+	// Blocked is the number of those dependencies where the job in To is
+	// dependent and the job in From is buried, so will not complete without
+	// intervention.
+	Blocked int
+}
+
+// depGraphJob is what we note about each job when making a DepGraph.
+type depGraphJob struct {
+	key      string
+	repGroup string
+	cmd      string
+	state    JobState
+	deps     []string
+}
+
+// depGraph makes a DepGraph of the dependencies of the current jobs (only
+// those of the given owner, if not blank). With a blank repGroup the nodes are
+// RepGroups, otherwise they are the current jobs in that RepGroup along with
+// the jobs they directly depend on and that directly depend on them.
+func (s *Server) depGraph(repGroup, owner string) (*DepGraph, error) {
+	jobs := make(map[string]*depGraphJob)
+	s.q.Each(func(item *queue.Item) bool {
+		job := item.Data().(*Job)
+		job.RLock()
+		if owner != "" && job.User != owner {
+			job.RUnlock()
+			return true
+		}
+		dgj := &depGraphJob{
+			key:      item.Key,
+			repGroup: job.RepGroup,
+			cmd:      job.Cmd,
+			state:    s.itemStateToJobState(item.State(), job.Lost),
+			deps:     item.Dependencies(),
+		}
+		job.RUnlock()
+		if dgj.state == JobStateReserved {
+			dgj.state = JobStateRunning
+		}
+		jobs[item.Key] = dgj
+		return true
+	})
+
+	// resolved dependencies are usually on jobs that have since completed and
+	// left the queue
+	var completeKeys []string
+	seen := make(map[string]bool)
+	for _, dgj := range jobs {
+		for _, dep := range dgj.deps {
+			if _, current := jobs[dep]; !current && !seen[dep] {
+				completeKeys = append(completeKeys, dep)
+				seen[dep] = true
+			}
+		}
+	}
+	if len(completeKeys) > 0 {
+		complete, err := s.db.retrieveCompleteJobsByKeys(completeKeys)
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range jobsOwnedBy(complete, owner) {
+			key := job.Key()
+			jobs[key] = &depGraphJob{key: key, repGroup: job.RepGroup, cmd: job.Cmd, state: JobStateComplete}
+		}
+	}
+
+	if repGroup == "" {
+		return repGroupDepGraph(jobs), nil
+	}
+	return jobDepGraph(repGroup, jobs), nil
+}
+
+// repGroupDepGraph makes a DepGraph where the nodes are the RepGroups of the
+// given jobs.
+func repGroupDepGraph(jobs map[string]*depGraphJob) *DepGraph {
+	nodes := make(map[string]*DepGraphNode)
+	edges := make(map[[2]string]*DepGraphEdge)
+	addNode := func(dgj *depGraphJob) {
+		node, exists := nodes[dgj.repGroup]
+		if !exists {
+			node = &DepGraphNode{ID: dgj.repGroup, RepGroup: dgj.repGroup, Counts: make(map[JobState]int)}
+			nodes[dgj.repGroup] = node
+		}
+		node.Counts[dgj.state]++
+	}
+
+	counted := make(map[string]bool)
+	for _, dgj := range jobs {
+		if dgj.state == JobStateComplete {
+			continue
+		}
+		addNode(dgj)
+		for _, dep := range dgj.deps {
+			up, known := jobs[dep]
+			if !known {
+				continue
+			}
+			if up.state == JobStateComplete && !counted[up.key] {
+				addNode(up)
+				counted[up.key] = true
+			}
+			if up.repGroup == dgj.repGroup {
+				continue
+			}
+			addEdge(edges, up, dgj, up.repGroup, dgj.repGroup)
+		}
+	}
+
+	return newDepGraph("", nodes, edges)
+}
+
+// jobDepGraph makes a DepGraph where the nodes are the current jobs in the
+// given RepGroup and the jobs they are directly connected to.
+func jobDepGraph(repGroup string, jobs map[string]*depGraphJob) *DepGraph {
+	nodes := make(map[string]*DepGraphNode)
+	edges := make(map[[2]string]*DepGraphEdge)
+	addNode := func(dgj *depGraphJob) {
+		if _, exists := nodes[dgj.key]; exists {
+			return
+		}
+		nodes[dgj.key] = &DepGraphNode{
+			ID:       dgj.key,
+			RepGroup: dgj.repGroup,
+			Cmd:      dgj.cmd,
+			Counts:   map[JobState]int{dgj.state: 1},
+		}
+	}
+
+	for _, dgj := range jobs {
+		if dgj.state == JobStateComplete {
+			continue
+		}
+		if dgj.repGroup == repGroup {
+			addNode(dgj)
+		}
+		for _, dep := range dgj.deps {
+			up, known := jobs[dep]
+			if !known || (dgj.repGroup != repGroup && up.repGroup != repGroup) {
+				continue
+			}
+			addNode(dgj)
+			addNode(up)
+			addEdge(edges, up, dgj, up.key, dgj.key)
+		}
+	}
+
+	return newDepGraph(repGroup, nodes, edges)
+}
+
+// addEdge records the dependency of job down on job up in the edge between the
+// given node IDs.
+func addEdge(edges map[[2]string]*DepGraphEdge, up, down *depGraphJob, from, to string) {
+	id := [2]string{from, to}
+	edge, exists := edges[id]
+	if !exists {
+		edge = &DepGraphEdge{From: from, To: to}
+		edges[id] = edge
+	}
+	edge.Jobs++
+	if up.state == JobStateBuried && down.state == JobStateDependent {
+		edge.Blocked++
+	}
+}
+
+// newDepGraph makes a DepGraph from the given nodes and edges, sorting them by
+// ID so that the graph is stable.
+func newDepGraph(repGroup string, nodes map[string]*DepGraphNode, edges map[[2]string]*DepGraphEdge) *DepGraph {
+	dg := &DepGraph{
+		RepGroup: repGroup,
+		Nodes:    make([]*DepGraphNode, 0, len(nodes)),
+		Edges:    make([]*DepGraphEdge, 0, len(edges)),
+	}
+	for _, node := range nodes {
+		dg.Nodes = append(dg.Nodes, node)
+	}
+	for _, edge := range edges {
+		dg.Edges = append(dg.Edges, edge)
+	}
+	sort.Slice(dg.Nodes, func(i, j int) bool {
+		return dg.Nodes[i].ID < dg.Nodes[j].ID
+	})
+	sort.Slice(dg.Edges, func(i, j int) bool {
+		if dg.Edges[i].From == dg.Edges[j].From {
+			return dg.Edges[i].To < dg.Edges[j].To
+		}
+		return dg.Edges[i].From < dg.Edges[j].From
+	})
+	return dg
+}
@@ -101,6 +101,12 @@ func (d *Dependency) incompleteJobKeys(db *db) ([]string, error) {
 	}
 	if d.Essence != nil {
 		jobKey := d.Essence.Key()
+		if d.Essence.JobKey != "" {
+			// JobKey might be a Job.Name
+			if nameKey := db.jobKeyForName(namespaced(d.Essence.Namespace, d.Essence.JobKey)); nameKey != "" {
+				jobKey = nameKey
+			}
+		}
 		live, err := db.checkIfLive(jobKey)
 		if err != nil {
 			return []string{}, err
@@ -0,0 +1,163 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains an in-memory index of the DepGroups of incomplete jobs.
+
+import (
+	"sort"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+// depIndexEntry records the DepGroups a job is in, and the DepGroups it depends
+// on, so that the job can be removed from a depIndex without searching.
+type depIndexEntry struct {
+	groups  []string
+	waitsOn []string
+}
+
+// depIndex indexes the live (incomplete) jobs in the database by the DepGroups
+// they are in and the DepGroups they depend on. Without it, resolving the
+// DepGroup dependencies of each of n newly added jobs meant searching the
+// database, which for large DAGs was O(n²); with it the cost of a lookup is
+// proportional to the number of jobs affected.
+type depIndex struct {
+	members map[string]map[string]bool // DepGroup -> keys of jobs in it
+	waiting map[string]map[string]bool // DepGroup -> keys of jobs depending on it
+	entries map[string]*depIndexEntry  // job key -> its DepGroup details
+	nWait   int                        // number of jobs depending on a DepGroup
+	lookups uint64
+	mutex   sync.RWMutex
+}
+
+// newDepIndex creates a new, empty, depIndex.
+func newDepIndex() *depIndex {
+	return &depIndex{
+		members: make(map[string]map[string]bool),
+		waiting: make(map[string]map[string]bool),
+		entries: make(map[string]*depIndexEntry),
+	}
+}
+
+// add indexes a job with the given key, DepGroups and dependency DepGroups,
+// replacing any existing entry for that key.
+func (di *depIndex) add(key string, groups []string, waitsOn []string) {
+	di.mutex.Lock()
+	defer di.mutex.Unlock()
+	di.removeEntry(key)
+
+	entry := &depIndexEntry{}
+	for _, group := range groups {
+		if group == "" {
+			continue
+		}
+		if _, exists := di.members[group]; !exists {
+			di.members[group] = make(map[string]bool)
+		}
+		di.members[group][key] = true
+		entry.groups = append(entry.groups, group)
+	}
+	for _, group := range waitsOn {
+		if _, exists := di.waiting[group]; !exists {
+			di.waiting[group] = make(map[string]bool)
+		}
+		di.waiting[group][key] = true
+		entry.waitsOn = append(entry.waitsOn, group)
+	}
+	if len(entry.waitsOn) > 0 {
+		di.nWait++
+	}
+	if len(entry.groups) > 0 || len(entry.waitsOn) > 0 {
+		di.entries[key] = entry
+	}
+}
+
+// addJob calls add() with the given job's Key(), DepGroups and
+// Dependencies.DepGroups().
+func (di *depIndex) addJob(job *Job) {
+	job.RLock()
+	groups := job.DepGroups
+	waitsOn := job.Dependencies.DepGroups()
+	job.RUnlock()
+	di.add(job.Key(), groups, waitsOn)
+}
+
+// remove unindexes the job with the given key, eg. because it completed.
+func (di *depIndex) remove(key string) {
+	di.mutex.Lock()
+	defer di.mutex.Unlock()
+	di.removeEntry(key)
+}
+
+// removeEntry does the work of remove(). You must hold the lock when calling
+// this.
+func (di *depIndex) removeEntry(key string) {
+	entry, exists := di.entries[key]
+	if !exists {
+		return
+	}
+	for _, group := range entry.groups {
+		delete(di.members[group], key)
+		if len(di.members[group]) == 0 {
+			delete(di.members, group)
+		}
+	}
+	for _, group := range entry.waitsOn {
+		delete(di.waiting[group], key)
+		if len(di.waiting[group]) == 0 {
+			delete(di.waiting, group)
+		}
+	}
+	if len(entry.waitsOn) > 0 {
+		di.nWait--
+	}
+	delete(di.entries, key)
+}
+
+// incompleteKeys returns the sorted keys of the indexed jobs that are in the
+// given DepGroup.
+func (di *depIndex) incompleteKeys(group string) []string {
+	di.mutex.Lock()
+	defer di.mutex.Unlock()
+	di.lookups++
+	return sortedKeys(di.members[group])
+}
+
+// stats tells you how many DepGroups have incomplete jobs in them, how many
+// incomplete jobs are waiting on DepGroups, and how many lookups have been
+// done.
+func (di *depIndex) stats() (groups int, waiting int, lookups uint64) {
+	di.mutex.RLock()
+	defer di.mutex.RUnlock()
+	return len(di.members), di.nWait, di.lookups
+}
+
+// sortedKeys returns the keys of the given map in sorted order.
+func sortedKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
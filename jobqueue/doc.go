@@ -63,6 +63,14 @@ Server
     })
     err = server.Block()
 
+For integration testing code that uses a Client, you can instead start a
+self-contained server in your own process, which uses free local ports and a
+temporary directory for its files:
+
+    es, err := jobqueue.ServeEmbedded(jobqueue.EmbeddedConfig{})
+    defer es.Shutdown()
+    jq, err := es.Connect(10 * time.Second)
+
 Client
 
 An example client, one for adding commands to the job queue:
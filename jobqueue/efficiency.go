@@ -0,0 +1,185 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for summarising how efficiently the jobs in a
+// RepGroup used the resources they reserved.
+
+import (
+	"sort"
+	"time"
+)
+
+// Quantiles summarise a distribution of values.
+type Quantiles struct {
+	Min    float64
+	Q1     float64
+	Median float64
+	Q3     float64
+	Max    float64
+}
+
+// newQuantiles returns the Quantiles of the given values, which get sorted. It
+// returns nil if there are no values.
+func newQuantiles(values []float64) *Quantiles {
+	n := len(values)
+	if n == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+	at := func(p float64) float64 {
+		return values[int(p*float64(n-1)+0.5)]
+	}
+	return &Quantiles{
+		Min:    values[0],
+		Q1:     at(0.25),
+		Median: at(0.5),
+		Q3:     at(0.75),
+		Max:    values[n-1],
+	}
+}
+
+// RepGroupEfficiency summarises how efficiently the complete jobs in a RepGroup
+// used the resources they reserved, so that whole pipeline stages can be
+// monitored.
+type RepGroupEfficiency struct {
+	RepGroup string
+
+	// Jobs is the number of complete jobs the other values are based on.
+	Jobs int
+
+	// CPUTime and WallTime are the totals over all Jobs.
+	CPUTime  time.Duration
+	WallTime time.Duration
+
+	// CPUEfficiency is the mean over all Jobs of each job's CPU time divided
+	// by its walltime multiplied by the cores it reserved (or 1, if it
+	// reserved none). 1 means jobs kept their cores fully busy.
+	CPUEfficiency float64
+
+	// RAMRequested and RAMPeak are the total MB of memory that Jobs reserved
+	// and actually used at their peak.
+	RAMRequested int
+	RAMPeak      int
+
+	// RAMUsage is the distribution of each job's peak RAM as a fraction of
+	// the RAM it reserved, for those jobs that reserved some.
+	RAMUsage *Quantiles
+}
+
+// repGroupEfficiencies summarises the given jobs per RepGroup, considering only
+// those that are complete. The given repGroups are always included in the
+// results, even if they had no complete jobs. The results are sorted by
+// RepGroup.
+func repGroupEfficiencies(jobs []*Job, repGroups ...string) []*RepGroupEfficiency {
+	effs := make(map[string]*RepGroupEfficiency)
+	for _, rg := range repGroups {
+		effs[rg] = &RepGroupEfficiency{RepGroup: rg}
+	}
+	cpuEffs := make(map[string][]float64)
+	ramUsages := make(map[string][]float64)
+	for _, job := range jobs {
+		job.RLock()
+		if job.State != JobStateComplete {
+			job.RUnlock()
+			continue
+		}
+
+		rg := job.RepGroup
+		eff, exists := effs[rg]
+		if !exists {
+			eff = &RepGroupEfficiency{RepGroup: rg}
+			effs[rg] = eff
+		}
+		eff.Jobs++
+
+		wall := job.WallTime()
+		eff.CPUTime += job.CPUtime
+		eff.WallTime += wall
+		if wall > 0 {
+			cores := job.Requirements.Cores
+			if cores <= 0 {
+				cores = 1
+			}
+			cpuEffs[rg] = append(cpuEffs[rg], job.CPUtime.Seconds()/(wall.Seconds()*cores))
+		}
+
+		eff.RAMRequested += job.Requirements.RAM
+		eff.RAMPeak += job.PeakRAM
+		if job.Requirements.RAM > 0 {
+			ramUsages[rg] = append(ramUsages[rg], float64(job.PeakRAM)/float64(job.Requirements.RAM))
+		}
+		job.RUnlock()
+	}
+
+	sorted := make([]*RepGroupEfficiency, 0, len(effs))
+	for rg, eff := range effs {
+		if n := len(cpuEffs[rg]); n > 0 {
+			var total float64
+			for _, e := range cpuEffs[rg] {
+				total += e
+			}
+			eff.CPUEfficiency = total / float64(n)
+		}
+		eff.RAMUsage = newQuantiles(ramUsages[rg])
+		sorted = append(sorted, eff)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].RepGroup < sorted[j].RepGroup
+	})
+	return sorted
+}
+
+// repGroupEfficiency gets the complete jobs in the given RepGroups (search is
+// as for getJobsByRepGroup()) that are in the given namespace (and belong to
+// the given owner, if not blank), and summarises their efficiency per
+// RepGroup. If no RepGroups are given, the RepGroups of all current jobs (of
+// the owner) are used.
+func (s *Server) repGroupEfficiency(repGroups []string, search bool, namespace, owner string) ([]*RepGroupEfficiency, string, string) {
+	if len(repGroups) == 0 {
+		seen := make(map[string]bool)
+		for _, job := range jobsOwnedBy(jobsInNamespace(s.getJobsCurrent(0, "", nil, false, false), namespace), owner) {
+			if !seen[job.RepGroup] {
+				seen[job.RepGroup] = true
+				repGroups = append(repGroups, job.RepGroup)
+			}
+		}
+	} else {
+		repGroups = namespacedSlice(namespace, repGroups, true)
+	}
+
+	var jobs []*Job
+	for _, rg := range repGroups {
+		theseJobs, srerr, qerr := s.getJobsByRepGroup(rg, search, 0, JobStateComplete, nil, false, false)
+		if srerr != "" {
+			return nil, srerr, qerr
+		}
+		jobs = append(jobs, theseJobs...)
+	}
+
+	var named []string
+	if !search {
+		named = repGroups
+	}
+	effs := repGroupEfficiencies(jobsOwnedBy(jobsInNamespace(jobs, namespace), owner), named...)
+	for _, eff := range effs {
+		eff.RepGroup = unnamespaced(namespace, eff.RepGroup)
+	}
+	return effs, "", ""
+}
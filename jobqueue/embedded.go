@@ -0,0 +1,164 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for running a complete jobqueue server inside
+// your own process, so that you can test your code against it without needing
+// to start the wr executable.
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/inconshreveable/log15"
+)
+
+// EmbeddedConfig is supplied to ServeEmbedded() to configure your embedded
+// server. All fields are optional.
+type EmbeddedConfig struct {
+	// Shell is the shell the local scheduler uses to run runners, defaulting
+	// to bash.
+	Shell string
+
+	// RunnerCmd is as per ServerConfig.RunnerCmd. If left blank, no runners
+	// will be spawned, and you should Reserve() and Execute() jobs yourself.
+	RunnerCmd string
+
+	// Logger is as per ServerConfig.Logger.
+	Logger log15.Logger
+}
+
+// EmbeddedServer is a Server running in your own process, along with the
+// details you need to connect to it.
+type EmbeddedServer struct {
+	*Server
+	Addr       string // localhost:port that clients can connect to
+	CAFile     string
+	CertDomain string
+	Token      []byte
+	dir        string
+}
+
+// ServeEmbedded starts a complete Server inside your process, using the local
+// scheduler. It listens on free ports on localhost, and keeps its database,
+// token and TLS certificates in a new temporary directory, so it won't
+// interfere with any other wr manager you are running, and you can start as
+// many as you like (one after the other or concurrently).
+//
+// This is intended for integration testing code that uses a Client. Call
+// Connect() on the returned EmbeddedServer to get a Client, and Shutdown()
+// when you're done with it.
+func ServeEmbedded(config EmbeddedConfig) (*EmbeddedServer, error) {
+	dir, err := ioutil.TempDir("", "wr_embedded")
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := serveEmbedded(config, dir)
+	if err != nil {
+		errr := os.RemoveAll(dir)
+		if errr != nil && config.Logger != nil {
+			config.Logger.Warn("failed to remove embedded server directory", "dir", dir, "err", errr)
+		}
+	}
+	return es, err
+}
+
+// serveEmbedded does the work of ServeEmbedded() using the given directory.
+func serveEmbedded(config EmbeddedConfig, dir string) (*EmbeddedServer, error) {
+	shell := config.Shell
+	if shell == "" {
+		shell = "bash"
+	}
+
+	port, err := freeLocalPort()
+	if err != nil {
+		return nil, err
+	}
+	webPort, err := freeLocalPort()
+	if err != nil {
+		return nil, err
+	}
+
+	uploadDir := filepath.Join(dir, "uploads")
+	err = os.Mkdir(uploadDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	es := &EmbeddedServer{
+		Addr:       "localhost:" + port,
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		CertDomain: localhost,
+		dir:        dir,
+	}
+	server, _, token, err := Serve(ServerConfig{
+		Port:            port,
+		WebPort:         webPort,
+		SchedulerName:   "local",
+		SchedulerConfig: &jqs.ConfigLocal{Shell: shell},
+		RunnerCmd:       config.RunnerCmd,
+		DBFile:          filepath.Join(dir, "db"),
+		DBFileBackup:    filepath.Join(dir, "db_bk"),
+		TokenFile:       filepath.Join(dir, "client.token"),
+		CAFile:          es.CAFile,
+		CertFile:        filepath.Join(dir, "cert.pem"),
+		KeyFile:         filepath.Join(dir, "key.pem"),
+		CertDomain:      es.CertDomain,
+		Deployment:      "development",
+		UploadDir:       uploadDir,
+		Logger:          config.Logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	es.Server = server
+	es.Token = token
+	return es, nil
+}
+
+// Connect returns a Client connected to this embedded server. See the
+// package-level Connect() for the meaning of timeout.
+func (es *EmbeddedServer) Connect(timeout time.Duration) (*Client, error) {
+	return Connect(es.Addr, es.CAFile, es.CertDomain, es.Token, timeout)
+}
+
+// Shutdown stops the server, waiting until it is fully down, then deletes its
+// temporary directory. Any Clients you got from Connect() should be
+// Disconnect()ed first.
+func (es *EmbeddedServer) Shutdown() error {
+	es.Stop(true)
+	return os.RemoveAll(es.dir)
+}
+
+// freeLocalPort asks the OS for a currently unused TCP port.
+func freeLocalPort() (string, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	err = l.Close()
+	return strconv.Itoa(port), err
+}
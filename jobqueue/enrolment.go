@@ -0,0 +1,582 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for enrolling hosts: a new host presents a
+// one-time token to get a client certificate and a token of its own (and
+// everything else it needs to connect to the server) over an encrypted channel,
+// and is recorded in an inventory, so that servers can insist that clients
+// connect from enrolled hosts. Revoking a host's enrolment stops both its
+// certificate and its token from being accepted.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+const (
+	// EnrolCertFile is the name of the file that Enrol() stores a host's
+	// client certificate in, in the same directory as the CA file. Connect()
+	// presents the certificate in this file (and the key in EnrolKeyFile) to
+	// the server if it exists.
+	EnrolCertFile = "enrolled.pem"
+
+	// EnrolKeyFile is the name of the file that Enrol() stores the key of a
+	// host's client certificate in.
+	EnrolKeyFile = "enrolled.key"
+
+	// enrolTokenSecretBytes is the number of random bytes in the secret part
+	// of an enrolment token.
+	enrolTokenSecretBytes = 32
+
+	// enrolTokenSeparator separates the secret part of an enrolment token from
+	// the fingerprint of the server's certificate.
+	enrolTokenSeparator = "."
+
+	// enrolSelfHost is the name the server enrols itself under, for the
+	// runners it spawns.
+	enrolSelfHost = "wr-manager"
+)
+
+var (
+	errEnrolBadToken    = errors.New("enrolment token is invalid, expired or already used")
+	errEnrolNotEnrolled = errors.New("client is not on an enrolled host")
+	errEnrolDisabled    = errors.New("enrolment is not enabled on this server")
+)
+
+// EnrolledHost describes a host that has enrolled with the server, as recorded
+// in its inventory.
+type EnrolledHost struct {
+	Name     string    // the name the host enrolled with
+	Serial   string    // the serial number of its client certificate, in hex
+	IP       string    // the address it enrolled from
+	Enrolled time.Time // when it enrolled
+	Revoked  bool      // true if its certificate and token are no longer accepted
+	TokenSHA string    // hex sha256 of the token it was given (blank in inventories)
+}
+
+// EnrolmentReply is what the server gives a host that successfully enrols:
+// everything it needs to connect to the server as a client.
+type EnrolmentReply struct {
+	Cert       []byte `json:"cert"`        // PEM encoded client certificate
+	Key        []byte `json:"key"`         // PEM encoded key of Cert
+	CA         []byte `json:"ca"`          // PEM encoded CA certificate to verify the server with
+	Token      []byte `json:"token"`       // the token for this host to authenticate with
+	Port       string `json:"port"`        // the port the server listens to clients on
+	CertDomain string `json:"cert_domain"` // the domain the server's certificate is valid for
+}
+
+// enrolRequest is what a host sends to enrol.
+type enrolRequest struct {
+	Token string `json:"token"`
+	Host  string `json:"host"`
+}
+
+// enroller issues enrolment tokens and client certificates, and keeps the
+// inventory of enrolled hosts.
+type enroller struct {
+	sync.RWMutex
+	caFile      string
+	caKeyFile   string
+	fingerprint string               // of the server's certificate
+	tokens      map[string]time.Time // sha256 of token secrets to expiry
+	hosts       map[string]*EnrolledHost
+	hostTokens  map[string]string // sha256 of host tokens to certificate serial
+}
+
+// newEnroller creates an enroller that signs client certificates with the CA
+// in the given files, creating them if necessary, and returns it along with a
+// pool containing the CA, for verifying client certificates. certFile is the
+// server's own certificate, whose fingerprint is given out with enrolment
+// tokens so that enrolling hosts can be sure they're talking to us.
+func newEnroller(caFile, caKeyFile, certFile, certDomain string) (*enroller, *x509.CertPool, error) {
+	if internal.CheckCerts(caFile, caKeyFile) != nil {
+		if err := internal.GenerateCA(caFile, caKeyFile, certDomain); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	caCert, err := ioutil.ReadFile(caFile) // #nosec
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, nil, fmt.Errorf("no certificate found in enrolment CA file [%s]", caFile)
+	}
+
+	fingerprint, err := internal.CertFingerprint(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &enroller{
+		caFile:      caFile,
+		caKeyFile:   caKeyFile,
+		fingerprint: fingerprint,
+		tokens:      make(map[string]time.Time),
+		hosts:       make(map[string]*EnrolledHost),
+		hostTokens:  make(map[string]string),
+	}, pool, nil
+}
+
+// hashEnrolSecret returns the hex encoded sha256 of the given secret.
+func hashEnrolSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitEnrolToken splits an enrolment token in to its secret and server
+// certificate fingerprint parts.
+func splitEnrolToken(token string) (secret, fingerprint string, err error) {
+	parts := strings.Split(token, enrolTokenSeparator)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errEnrolBadToken
+	}
+	return parts[0], parts[1], nil
+}
+
+// newToken creates a one-time enrolment token that expires after the given
+// duration.
+func (e *enroller) newToken(ttl time.Duration) (string, error) {
+	b := make([]byte, enrolTokenSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+
+	e.Lock()
+	defer e.Unlock()
+	now := time.Now()
+	for hash, expiry := range e.tokens {
+		if now.After(expiry) {
+			delete(e.tokens, hash)
+		}
+	}
+	e.tokens[hashEnrolSecret(secret)] = now.Add(ttl)
+
+	return secret + enrolTokenSeparator + e.fingerprint, nil
+}
+
+// useToken checks the given enrolment token is valid, and makes it unusable
+// from now on.
+func (e *enroller) useToken(token string) error {
+	secret, _, err := splitEnrolToken(token)
+	if err != nil {
+		return err
+	}
+	hash := hashEnrolSecret(secret)
+
+	e.Lock()
+	defer e.Unlock()
+	for known, expiry := range e.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(hash)) != 1 {
+			continue
+		}
+		delete(e.tokens, known)
+		if time.Now().After(expiry) {
+			return errEnrolBadToken
+		}
+		return nil
+	}
+	return errEnrolBadToken
+}
+
+// hostFor returns the name of the enrolled host that was given the certificate
+// with the given serial, if it hasn't been revoked.
+func (e *enroller) hostFor(serial string) string {
+	e.RLock()
+	defer e.RUnlock()
+	if h, exists := e.hosts[serial]; exists && !h.Revoked {
+		return h.Name
+	}
+	return ""
+}
+
+// serialForToken returns the certificate serial of the enrolled host that was
+// given the given token, if it hasn't been revoked.
+func (e *enroller) serialForToken(token []byte) string {
+	hash := hashEnrolSecret(string(token))
+	e.RLock()
+	defer e.RUnlock()
+	serial, exists := e.hostTokens[hash]
+	if !exists {
+		return ""
+	}
+	if h, exists := e.hosts[serial]; !exists || h.Revoked {
+		return ""
+	}
+	return serial
+}
+
+// addHost adds the given host to our inventory. You must hold the lock when
+// calling this.
+func (e *enroller) addHost(h *EnrolledHost) {
+	e.hosts[h.Serial] = h
+	if h.TokenSHA != "" {
+		e.hostTokens[h.TokenSHA] = h.Serial
+	}
+}
+
+// inventory returns copies of all the enrolled hosts, oldest first.
+func (e *enroller) inventory() []*EnrolledHost {
+	e.RLock()
+	hosts := make([]*EnrolledHost, 0, len(e.hosts))
+	for _, h := range e.hosts {
+		c := *h
+		c.TokenSHA = ""
+		hosts = append(hosts, &c)
+	}
+	e.RUnlock()
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Enrolled.Equal(hosts[j].Enrolled) {
+			return hosts[i].Serial < hosts[j].Serial
+		}
+		return hosts[i].Enrolled.Before(hosts[j].Enrolled)
+	})
+	return hosts
+}
+
+// hostEnrolment is what a host gets when it enrols.
+type hostEnrolment struct {
+	host    *EnrolledHost
+	certPEM []byte
+	keyPEM  []byte
+	token   []byte
+}
+
+// enrolHost issues a client certificate and token to the named host, and
+// records it in our inventory.
+func (s *Server) enrolHost(name, ip string) (*hostEnrolment, error) {
+	if name == "" {
+		return nil, errors.New("a host name is required")
+	}
+	certPEM, keyPEM, serial, err := internal.SignClientCert(s.enrol.caFile, s.enrol.caKeyFile, name)
+	if err != nil {
+		return nil, err
+	}
+	token, err := generateToken("")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &EnrolledHost{Name: name, Serial: serial, IP: ip, Enrolled: time.Now(), TokenSHA: hashEnrolSecret(string(token))}
+	if err = s.db.storeEnrolledHost(h); err != nil {
+		return nil, err
+	}
+	s.enrol.Lock()
+	s.enrol.addHost(h)
+	s.enrol.Unlock()
+	s.Info("enrolled host", "host", name, "ip", ip, "serial", serial)
+
+	return &hostEnrolment{host: h, certPEM: certPEM, keyPEM: keyPEM, token: token}, nil
+}
+
+// enrolSelf makes sure there's a client certificate for the server's own host
+// in the given directory, as used by local clients and copied to the runners
+// that cloud schedulers spawn, so that those don't need to enrol themselves.
+func (s *Server) enrolSelf(dir string) error {
+	certFile := filepath.Join(dir, EnrolCertFile)
+	keyFile := filepath.Join(dir, EnrolKeyFile)
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if parsed, errp := x509.ParseCertificate(cert.Certificate[0]); errp == nil {
+			if s.enrol.hostFor(parsed.SerialNumber.Text(16)) != "" {
+				return nil
+			}
+		}
+	}
+
+	he, err := s.enrolHost(enrolSelfHost, "")
+	if err != nil {
+		return err
+	}
+	return writeEnrolment(certFile, he.certPEM, keyFile, he.keyPEM)
+}
+
+// loadEnrolledHosts fills our inventory from the database.
+func (s *Server) loadEnrolledHosts() error {
+	hosts, err := s.db.retrieveEnrolledHosts()
+	if err != nil {
+		return err
+	}
+	s.enrol.Lock()
+	defer s.enrol.Unlock()
+	for _, h := range hosts {
+		s.enrol.addHost(h)
+	}
+	return nil
+}
+
+// revokeEnrolment revokes the certificates of enrolled hosts with the given
+// name or certificate serial, returning how many were revoked.
+func (s *Server) revokeEnrolment(nameOrSerial string) (int, error) {
+	s.enrol.Lock()
+	var revoke []*EnrolledHost
+	for _, h := range s.enrol.hosts {
+		if !h.Revoked && (h.Name == nameOrSerial || h.Serial == nameOrSerial) {
+			revoke = append(revoke, h)
+		}
+	}
+	for _, h := range revoke {
+		h.Revoked = true
+	}
+	s.enrol.Unlock()
+
+	for _, h := range revoke {
+		s.enrol.RLock()
+		c := *h
+		s.enrol.RUnlock()
+		if err := s.db.storeEnrolledHost(&c); err != nil {
+			return 0, err
+		}
+		s.Info("revoked host enrolment", "host", c.Name, "serial", c.Serial)
+	}
+	return len(revoke), nil
+}
+
+// RequireEnrolledClients is an Authenticator that only allows AuthKindClient
+// requests that presented the unrevoked client certificate of an enrolled host
+// (see Enrol()). Other kinds of request are allowed. It is typically combined
+// with the default: AllOf(RequireToken, RequireEnrolledClients).
+var RequireEnrolledClients Authenticator = AuthenticatorFunc(func(req *AuthRequest) error {
+	if req.Kind == AuthKindClient && req.EnrolledHost == "" {
+		return errEnrolNotEnrolled
+	}
+	return nil
+})
+
+// Enrol enrols the host it is called on with the server whose web interface is
+// at the given address (host:port), using a one-time token created with
+// Client.CreateEnrolmentToken(). The token includes the fingerprint of the
+// server's certificate, so the connection is encrypted and the server's
+// identity confirmed without needing to trust anything else first.
+//
+// The host is recorded in the server's inventory under the given name, and the
+// CA certificate and a token for this host to Connect() with are written to the
+// given files, along with a client certificate and key written to
+// EnrolCertFile and EnrolKeyFile in the same directory as caFile, which
+// Connect() will then present to the server. The token only works for client
+// connections that present that certificate (and for the REST API and web
+// interface), and stops working if the host's enrolment is revoked.
+//
+// (Hosts enrolled by older versions of wr were given the server's own token
+// instead. To stop them using it, delete the server's token file and restart
+// it, so that it generates a new one, then enrol those hosts again.)
+func Enrol(webAddr, enrolToken, name, caFile, tokenFile string) (*EnrolmentReply, error) {
+	_, fingerprint, err := splitEnrolToken(enrolToken)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		// we verify the server by its certificate's fingerprint instead of a
+		// CA, since we don't have one yet
+		InsecureSkipVerify: true, // #nosec
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(fingerprint)) != 1 {
+				return errors.New("server certificate does not match the enrolment token")
+			}
+			return nil
+		},
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 1 * time.Minute}
+
+	body, err := json.Marshal(&enrolRequest{Token: enrolToken, Host: name})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post("https://"+webAddr+restEnrolEndpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // #nosec nothing useful to do if closing fails
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("enrolment failed: %s", strings.TrimSpace(string(content)))
+	}
+
+	reply := &EnrolmentReply{}
+	if err = json.Unmarshal(content, reply); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(caFile)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(caFile, reply.CA, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(tokenFile), 0700); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(tokenFile, reply.Token, 0600); err != nil {
+		return nil, err
+	}
+	err = writeEnrolment(filepath.Join(dir, EnrolCertFile), reply.Cert, filepath.Join(dir, EnrolKeyFile), reply.Key)
+	return reply, err
+}
+
+// writeEnrolment writes a client certificate and its key to the given files.
+func writeEnrolment(certFile string, certPEM []byte, keyFile string, keyPEM []byte) error {
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, certPEM, 0644)
+}
+
+// enrolledClientCert returns the client certificate that Enrol() stored next to
+// the given CA file, if any.
+func enrolledClientCert(caFile string) (tls.Certificate, bool) {
+	dir := filepath.Dir(caFile)
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, EnrolCertFile), filepath.Join(dir, EnrolKeyFile))
+	return cert, err == nil
+}
+
+// restEnrol lets a host enrol by POSTing a JSON object with a one-time
+// enrolment token and its name, eg. {"token": "...", "host": "node1"}. It
+// does not need the server's token, and replies with an EnrolmentReply.
+func restEnrol(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue server enrol", false)
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST is supported", http.StatusBadRequest)
+			return
+		}
+		if s.enrol == nil {
+			http.Error(w, errEnrolDisabled.Error(), http.StatusNotFound)
+			return
+		}
+
+		var er enrolRequest
+		if err := json.NewDecoder(r.Body).Decode(&er); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if er.Host == "" {
+			http.Error(w, "host is required", http.StatusBadRequest)
+			return
+		}
+		if err := s.enrol.useToken(er.Token); err != nil {
+			s.Warn("rejected enrolment", "host", er.Host, "ip", r.RemoteAddr, "err", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		ip := ""
+		if addr := addrIP(r.RemoteAddr); addr != nil {
+			ip = addr.String()
+		}
+		he, err := s.enrolHost(er.Host, ip)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ca, err := ioutil.ReadFile(s.caFile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(&EnrolmentReply{
+			Cert:       he.certPEM,
+			Key:        he.keyPEM,
+			CA:         ca,
+			Token:      he.token,
+			Port:       s.ServerInfo.Port,
+			CertDomain: s.ServerInfo.Host,
+		})
+		if err != nil {
+			s.Warn("restEnrol failed to encode EnrolmentReply", "err", err)
+		}
+	}
+}
+
+// restEnrolled lets you GET the inventory of enrolled hosts, or DELETE (revoke)
+// the enrolment of the host with the name or certificate serial that suffixes
+// the url.
+func restEnrolled(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue server enrolled", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+		if s.enrol == nil {
+			http.Error(w, errEnrolDisabled.Error(), http.StatusNotFound)
+			return
+		}
+
+		var result interface{}
+		switch r.Method {
+		case http.MethodGet:
+			result = s.enrol.inventory()
+		case http.MethodDelete:
+			if len(r.URL.Path) <= len(restEnrolledEndpoint) {
+				http.Error(w, "a host name or serial is required", http.StatusBadRequest)
+				return
+			}
+			revoked, err := s.revokeEnrolment(r.URL.Path[len(restEnrolledEndpoint):])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result = revoked
+		default:
+			http.Error(w, "Only GET and DELETE are supported", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		err := json.NewEncoder(w).Encode(result)
+		if err != nil {
+			s.Warn("restEnrolled failed to encode result", "err", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for deciding which environment variables jobs
+// will run with.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvCaptureMode describes how much of the environment of the process adding
+// jobs should be captured for those jobs to run with.
+type EnvCaptureMode string
+
+// EnvCaptureFull etc. are the EnvCaptureModes you can use with
+// ParseEnvCaptureMode() and CaptureEnv().
+const (
+	// EnvCaptureFull captures every environment variable, so that jobs run
+	// as if started by the adding process.
+	EnvCaptureFull EnvCaptureMode = "full"
+
+	// EnvCaptureMinimal captures only an explicit list of variables, which
+	// are set on top of the runner's own environment (see EnvAddDefaults()).
+	EnvCaptureMinimal EnvCaptureMode = "minimal"
+
+	// EnvCaptureNone captures nothing, so that jobs run in the runner's own
+	// environment.
+	EnvCaptureNone EnvCaptureMode = "none"
+
+	// EnvCaptureModule captures nothing, but has the runner `module load` the
+	// Job.EnvModules in to its own environment before running Cmd.
+	EnvCaptureModule EnvCaptureMode = "module"
+)
+
+// ParseEnvCaptureMode converts the given string to an EnvCaptureMode. Blank
+// means EnvCaptureFull.
+func ParseEnvCaptureMode(mode string) (EnvCaptureMode, error) {
+	switch EnvCaptureMode(mode) {
+	case "":
+		return EnvCaptureFull, nil
+	case EnvCaptureFull, EnvCaptureMinimal, EnvCaptureNone, EnvCaptureModule:
+		return EnvCaptureMode(mode), nil
+	}
+	return "", fmt.Errorf("environment capture mode must be one of %s, %s, %s or %s, not [%s]", EnvCaptureFull, EnvCaptureMinimal, EnvCaptureNone, EnvCaptureModule, mode)
+}
+
+// CaptureEnv returns the current environment variables ("key=value" strings)
+// that the given mode captures. For EnvCaptureFull that is all of them, and
+// for EnvCaptureMinimal only those named in vars that are set. For the other
+// modes it returns nil.
+func CaptureEnv(mode EnvCaptureMode, vars []string) []string {
+	switch mode {
+	case EnvCaptureFull:
+		return os.Environ()
+	case EnvCaptureMinimal:
+		var env []string
+		for _, name := range vars {
+			if val, set := os.LookupEnv(name); set {
+				env = append(env, name+"="+val)
+			}
+		}
+		return env
+	}
+	return nil
+}
+
+// EnvAddDefaults is like EnvAddOverride(), except that the given env vars do
+// not replace any that the job already overrides. This is how you apply the
+// output of CaptureEnv(EnvCaptureMinimal, ...) to a job, instead of supplying
+// it as the envVars of Client.Add().
+func (j *Job) EnvAddDefaults(env []string) error {
+	current, err := j.envCurrentOverrides()
+	if err != nil {
+		return err
+	}
+
+	defaults := make([]string, len(env))
+	copy(defaults, env)
+	j.EnvOverride, err = compressEnv(envOverride(defaults, current))
+
+	return err
+}
+
+// moduleLoadCmd returns a shell command that loads the job's EnvModules,
+// initialising the `module` command from $MODULESHOME if the shell doesn't
+// already have it, and exits if that fails. Returns blank if there are no
+// EnvModules.
+func (j *Job) moduleLoadCmd() string {
+	j.RLock()
+	defer j.RUnlock()
+	if len(j.EnvModules) == 0 {
+		return ""
+	}
+
+	modules := make([]string, len(j.EnvModules))
+	for i, module := range j.EnvModules {
+		modules[i] = shellQuote(module)
+	}
+	return `if ! type module > /dev/null 2>&1 && [ -f "$MODULESHOME/init/sh" ]; then . "$MODULESHOME/init/sh"; fi; ` +
+		"module load " + strings.Join(modules, " ") + " || exit 1\n"
+}
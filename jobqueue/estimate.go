@@ -0,0 +1,184 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for estimating how long jobs would take to run,
+// and what they would cost, before they are added.
+
+import (
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// Estimate describes the predicted resource usage of some jobs, as returned by
+// Client.Estimate().
+type Estimate struct {
+	// Jobs is the number of jobs the estimate is for.
+	Jobs int
+
+	// CoreHours is the total time the jobs are expected to run for, multiplied
+	// by the cores they need.
+	CoreHours float64
+
+	// Completion is how long it would take for all the jobs to complete if
+	// they had the scheduler's current hosts to themselves. It is 0 if
+	// CapacityKnown is false.
+	Completion time.Duration
+
+	// CapacityKnown is false if the scheduler doesn't tell us about its hosts
+	// (eg. LSF), or has none (eg. a cloud scheduler with no servers currently
+	// up), in which case Completion can't be estimated.
+	CapacityKnown bool
+
+	// Unschedulable is the number of jobs that could not run on the
+	// scheduler's current hosts, eg. because they need more memory than any of
+	// them has. These are excluded from Completion.
+	Unschedulable int
+
+	// Cost is CoreHours multiplied by the server's configured CostPerCoreHour.
+	Cost float64
+}
+
+// estimate does the server side of Client.Estimate(). The given jobs should
+// already be namespaced. The string return value is one of our Err* constants.
+func (s *Server) estimate(jobs []*Job) (*Estimate, string, error) {
+	reqGroupRecs := make(map[string]*scheduler.Requirements)
+	repGroupRecs := make(map[string]*RepGroupRecommendation)
+	limits := make(map[string]int)
+	for _, job := range jobs {
+		job.setCmdFromSteps()
+		job.Lock()
+		err := s.handleUserSpecifiedJobLimitGroups(job, limits)
+		job.Unlock()
+		if err != nil {
+			return nil, ErrBadLimitGroup, err
+		}
+		if job.Requirements == nil {
+			job.Requirements = &scheduler.Requirements{}
+		}
+
+		rec, cached := reqGroupRecs[job.ReqGroup]
+		if !cached && job.ReqGroup != "" {
+			rec = s.learnedReqGroupRequirements(job.ReqGroup)
+			reqGroupRecs[job.ReqGroup] = rec
+		}
+		if job.Override != 2 {
+			rec = s.mergeRepGroupRecommendation(job.RepGroup, rec, repGroupRecs)
+		}
+		if rec != nil {
+			job.Requirements.RAM = overriddenRequirement(job.Override, job.Requirements.RAM, rec.RAM)
+			job.Requirements.Time = time.Duration(overriddenRequirement(job.Override, int(job.Requirements.Time), int(rec.Time)))
+		}
+	}
+
+	est := &Estimate{Jobs: len(jobs)}
+	for _, job := range jobs {
+		est.CoreHours += job.Requirements.Cores * job.Requirements.Time.Hours()
+	}
+	s.tmutex.RLock()
+	est.Cost = est.CoreHours * s.costPerCoreHour
+	s.tmutex.RUnlock()
+
+	config := SimulationConfig{}
+	for _, host := range s.scheduler.Hosts() {
+		config.Hosts++
+		if host.Cores > config.HostCores {
+			config.HostCores = host.Cores
+		}
+		if host.RAM > config.HostRAM {
+			config.HostRAM = host.RAM
+		}
+	}
+	if config.Hosts == 0 || config.HostCores <= 0 || config.HostRAM <= 0 {
+		return est, "", nil
+	}
+
+	// limits specified on the jobs would be set when they were added, else
+	// the current limits apply
+	config.Limits = limits
+	for _, job := range jobs {
+		for _, group := range job.LimitGroups {
+			name, _, err := splitLimitGroupUsage(group)
+			if err != nil {
+				continue
+			}
+			if _, specified := limits[name]; specified {
+				continue
+			}
+			if limit := s.limiter.GetLimit(name); limit >= 0 {
+				limits[name] = limit
+			}
+		}
+	}
+	for name, limit := range limits {
+		if limit < 0 {
+			delete(limits, name)
+		}
+	}
+
+	result, err := Simulate(jobs, config)
+	if err != nil {
+		return nil, ErrInternalError, err
+	}
+	est.CapacityKnown = true
+	est.Completion = result.Makespan
+	est.Unschedulable = result.Unschedulable
+	return est, "", nil
+}
+
+// learnedReqGroupRequirements returns the RAM and time requirements that we
+// have learned from previous jobs in the given ReqGroup, or nil if we haven't
+// learned anything.
+func (s *Server) learnedReqGroupRequirements(reqGroup string) *scheduler.Requirements {
+	recm, errm := s.db.recommendedReqGroupMemory(reqGroup)
+	recs, errs := s.db.recommendedReqGroupTime(reqGroup)
+	if errm != nil || errs != nil || (recm <= 0 && recs <= 0) {
+		return nil
+	}
+	req := &scheduler.Requirements{}
+	if recm > 0 {
+		req.RAM = recm
+	}
+	if recs > 0 {
+		req.Time = time.Duration(recs) * time.Second
+	}
+	return req
+}
+
+// overriddenRequirement returns the requirement a job with the given Override
+// would end up with, given what the user specified and what we recommend, in
+// the same way the server applies recommendations to queued jobs.
+func overriddenRequirement(override uint8, specified, recommended int) int {
+	if recommended <= 0 || specified <= 0 {
+		if recommended > 0 {
+			return recommended
+		}
+		return specified
+	}
+	switch override {
+	case 0:
+		return recommended
+	case 1:
+		if recommended > specified {
+			return recommended
+		}
+	}
+	return specified
+}
@@ -0,0 +1,267 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for exporting the resources consumed by complete
+// jobs, grouped by user, RepGroup and ReqGroup, for accounting and reporting.
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ExportByUser groups exported complete jobs by the user that added them.
+	ExportByUser = "user"
+
+	// ExportByRepGroup groups exported complete jobs by their RepGroup.
+	ExportByRepGroup = "repgroup"
+
+	// ExportByReqGroup groups exported complete jobs by their ReqGroup.
+	ExportByReqGroup = "reqgroup"
+
+	// ExportFormatCSV is the WriteExport() format for comma separated values,
+	// with a header line.
+	ExportFormatCSV = "csv"
+
+	// ExportFormatJSON is the WriteExport() format for an array of JSON
+	// objects.
+	ExportFormatJSON = "json"
+)
+
+// ExportRecord holds the resources consumed by a group of complete jobs that
+// share the same values for the properties they were grouped by (those not
+// grouped by are blank).
+type ExportRecord struct {
+	User          string
+	RepGroup      string
+	ReqGroup      string
+	Jobs          int     // the number of complete jobs in the group
+	CPUHours      float64 // the total CPU time (user + system) of the jobs
+	WallHours     float64 // the total time the jobs took to run
+	PeakRAM       int     // the most RAM (MB) used by any of the jobs
+	CoreHours     float64 // cores reserved multiplied by WallHours
+	InstanceHours float64 // the WallHours of the jobs that ran on cloud servers
+}
+
+// key returns a string that is the same for all jobs that should be accounted
+// in this record.
+func (e *ExportRecord) key() string {
+	return e.User + "\x00" + e.RepGroup + "\x00" + e.ReqGroup
+}
+
+// add accounts the given complete job in this record. You must hold the job's
+// read lock.
+func (e *ExportRecord) add(job *Job) {
+	e.Jobs++
+	wall := job.EndTime.Sub(job.StartTime).Hours()
+	e.CPUHours += job.CPUtime.Hours()
+	e.WallHours += wall
+	if job.PeakRAM > e.PeakRAM {
+		e.PeakRAM = job.PeakRAM
+	}
+	if job.Requirements != nil {
+		e.CoreHours += job.Requirements.Cores * wall
+	}
+	if job.HostID != "" {
+		e.InstanceHours += wall
+	}
+}
+
+// validExportBy checks that the given properties to group by are all ones we
+// know about.
+func validExportBy(by []string) error {
+	for _, prop := range by {
+		switch prop {
+		case ExportByUser, ExportByRepGroup, ExportByReqGroup:
+		default:
+			return fmt.Errorf("can't group by [%s]; must be one of %s, %s or %s", prop, ExportByUser, ExportByRepGroup, ExportByReqGroup)
+		}
+	}
+	return nil
+}
+
+// exportUsage walks the complete jobs in our database, grouping those that
+// completed from from to to (a zero to means now) by the given properties (all
+// of them if none are given), and returns an ExportRecord for each group,
+// sorted by User, RepGroup and ReqGroup. If namespace is not blank, only its
+// jobs are considered, and their RepGroups are unqualified.
+func (s *Server) exportUsage(from, to time.Time, by []string, namespace string) ([]*ExportRecord, string, error) {
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if to.Before(from) {
+		return nil, ErrBadRequest, fmt.Errorf("end time %s is before start time %s", to, from)
+	}
+	if err := validExportBy(by); err != nil {
+		return nil, ErrBadRequest, err
+	}
+	if len(by) == 0 {
+		by = []string{ExportByUser, ExportByRepGroup, ExportByReqGroup}
+	}
+	wanted := make(map[string]bool)
+	for _, prop := range by {
+		wanted[prop] = true
+	}
+
+	records := make(map[string]*ExportRecord)
+	err := s.db.walkCompleteJobs(func(job *Job) {
+		if job.StartTime.IsZero() || job.EndTime.Before(from) || job.EndTime.After(to) {
+			return
+		}
+		if namespace != "" && job.Namespace != namespace {
+			return
+		}
+
+		group := &ExportRecord{}
+		if wanted[ExportByUser] {
+			group.User = job.User
+		}
+		if wanted[ExportByRepGroup] {
+			group.RepGroup = unnamespaced(namespace, job.RepGroup)
+		}
+		if wanted[ExportByReqGroup] {
+			group.ReqGroup = job.ReqGroup
+		}
+		key := group.key()
+		record, exists := records[key]
+		if !exists {
+			record = group
+			records[key] = record
+		}
+		record.add(job)
+	})
+	if err != nil {
+		return nil, ErrDBError, err
+	}
+
+	sorted := make([]*ExportRecord, 0, len(records))
+	for _, record := range records {
+		sorted = append(sorted, record)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].key() < sorted[j].key()
+	})
+	return sorted, "", nil
+}
+
+// WriteExport writes the given records to w in the given format (ExportFormatCSV
+// or ExportFormatJSON), a record at a time.
+func WriteExport(w io.Writer, format string, records []*ExportRecord) error {
+	switch format {
+	case ExportFormatCSV:
+		return writeExportCSV(w, records)
+	case ExportFormatJSON:
+		return writeExportJSON(w, records)
+	}
+	return fmt.Errorf("unknown export format [%s]; must be %s or %s", format, ExportFormatCSV, ExportFormatJSON)
+}
+
+// writeExportCSV is the ExportFormatCSV implementation of WriteExport().
+func writeExportCSV(w io.Writer, records []*ExportRecord) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"user", "repgroup", "reqgroup", "jobs", "cpu_hours", "wall_hours", "peak_ram_mb", "core_hours", "instance_hours"})
+	if err != nil {
+		return err
+	}
+	hours := func(h float64) string {
+		return strconv.FormatFloat(h, 'f', 4, 64)
+	}
+	for _, record := range records {
+		err = cw.Write([]string{
+			record.User,
+			record.RepGroup,
+			record.ReqGroup,
+			strconv.Itoa(record.Jobs),
+			hours(record.CPUHours),
+			hours(record.WallHours),
+			strconv.Itoa(record.PeakRAM),
+			hours(record.CoreHours),
+			hours(record.InstanceHours),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeExportJSON is the ExportFormatJSON implementation of WriteExport().
+func writeExportJSON(w io.Writer, records []*ExportRecord) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i, record := range records {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+// ParseExportBy splits the given comma separated list of properties to group
+// exported jobs by, checking they are valid.
+func ParseExportBy(by string) ([]string, error) {
+	if by == "" {
+		return nil, nil
+	}
+	props := strings.Split(by, ",")
+	for i, prop := range props {
+		props[i] = strings.ToLower(strings.TrimSpace(prop))
+	}
+	return props, validExportBy(props)
+}
+
+// GetExport gets the resources consumed by the jobs that completed from from
+// to to (a zero to means now), grouped by the given properties (any of
+// ExportByUser, ExportByRepGroup and ExportByReqGroup; all of them if none are
+// given). Pass the result to WriteExport() to get a CSV or JSON report.
+//
+// Unlike GetUsage(), which accounts every run of every job, this only
+// considers the final successful run of complete jobs, but can tell you their
+// actual CPU time and peak memory usage.
+func (c *Client) GetExport(from, to time.Time, by []string) ([]*ExportRecord, error) {
+	return c.GetExportContext(context.Background(), from, to, by)
+}
+
+// GetExportContext is like GetExport(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetExportContext(ctx context.Context, from, to time.Time, by []string) ([]*ExportRecord, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getexport", From: from, To: to, ExportBy: by})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Export, err
+}
@@ -0,0 +1,175 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets users map the exit codes and STDERR of
+// failed jobs to their own FailReasons and retry policies, per RepGroup.
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// FailRule describes how to treat failed jobs whose exit code and STDERR match
+// it. Supply these to Client.SetRepGroupFailRules().
+type FailRule struct {
+	// Exitcode is the exit code a failed job must have to match this rule. The
+	// default of 0 matches any exit code.
+	Exitcode int
+
+	// StdErr is a regular expression that must match somewhere in a failed
+	// job's STDERR for it to match this rule. The default of blank matches any
+	// STDERR.
+	StdErr string
+
+	// FailReason replaces the FailReason of matching jobs, eg. "OOM" instead of
+	// the generic "command exited non-zero", so that failures of your own tools
+	// are grouped meaningfully. The default of blank keeps the original
+	// FailReason.
+	FailReason string
+
+	// Bury makes matching jobs get buried immediately, instead of being retried
+	// until they have failed more times than their Retries allow. Use this for
+	// failures you know are permanent.
+	Bury bool
+
+	// Uncounted makes the failure of matching jobs not count against their
+	// Retries, for failures you know are temporary. Ignored if Bury is true.
+	Uncounted bool
+
+	// RAMMultiplier, if greater than 1, makes matching jobs be retried with
+	// their RAM requirement multiplied by this amount, eg. 2 to retry with
+	// twice the RAM after your tool reports that it ran out of memory.
+	RAMMultiplier float64
+
+	stdErrRE *regexp.Regexp
+}
+
+// compile validates the rule and compiles its StdErr regular expression.
+func (r *FailRule) compile() error {
+	if r.RAMMultiplier < 0 {
+		return fmt.Errorf("RAMMultiplier %v can't be negative", r.RAMMultiplier)
+	}
+	if r.StdErr == "" {
+		r.stdErrRE = nil
+		return nil
+	}
+	re, err := regexp.Compile(r.StdErr)
+	if err != nil {
+		return err
+	}
+	r.stdErrRE = re
+	return nil
+}
+
+// matches tells you if a job that failed with the given exit code and STDERR
+// matches this rule.
+func (r *FailRule) matches(exitcode int, stderr string) bool {
+	if r.Exitcode != 0 && r.Exitcode != exitcode {
+		return false
+	}
+	return r.stdErrRE == nil || r.stdErrRE.MatchString(stderr)
+}
+
+// retryRAM returns the RAM (in MB) a job that previously had the given RAM
+// should be retried with according to this rule, or 0 if the rule doesn't
+// change RAM.
+func (r *FailRule) retryRAM(ram int) int {
+	if r.RAMMultiplier <= 1 || ram <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(ram) * r.RAMMultiplier))
+}
+
+// setRepGroupFailRules sets the FailRules of the given RepGroup, or removes
+// them if rules is empty.
+func (s *Server) setRepGroupFailRules(repGroup string, rules []*FailRule) (srerr string, qerr error) {
+	for _, rule := range rules {
+		if rule == nil {
+			return ErrBadFailRule, fmt.Errorf("nil rule")
+		}
+		if err := rule.compile(); err != nil {
+			return ErrBadFailRule, err
+		}
+	}
+
+	if err := s.db.storeRepGroupFailRules(repGroup, rules); err != nil {
+		return ErrDBError, err
+	}
+
+	s.frmutex.Lock()
+	defer s.frmutex.Unlock()
+	if len(rules) == 0 {
+		delete(s.rgFailRules, repGroup)
+		return "", nil
+	}
+	s.rgFailRules[repGroup] = rules
+	return "", nil
+}
+
+// matchFailRule returns the first of the FailRules of the given job's RepGroup
+// that matches how the job ended, or nil if none do (or the job didn't fail).
+// The job must not be locked.
+func (s *Server) matchFailRule(job *Job, endState *JobEndState, failReason string) *FailRule {
+	if endState == nil || !endState.Exited {
+		return nil
+	}
+	switch failReason {
+	case "", FailReasonPreempt, FailReasonExclude:
+		return nil
+	}
+
+	job.RLock()
+	repGroup := job.RepGroup
+	job.RUnlock()
+
+	s.frmutex.RLock()
+	rules := s.rgFailRules[repGroup]
+	s.frmutex.RUnlock()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var stderr string
+	var gotStdErr bool
+	for _, rule := range rules {
+		if rule.stdErrRE != nil && !gotStdErr {
+			stderr = failedStdErr(endState.Stderr)
+			gotStdErr = true
+		}
+		if rule.matches(endState.Exitcode, stderr) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// failedStdErr returns the STDERR of a failed job given the Stderr of its
+// JobEndState, which will be compressed if it was released.
+func failedStdErr(stderr []byte) string {
+	if len(stderr) == 0 {
+		return ""
+	}
+	decompressed, err := decompress(stderr)
+	if err != nil {
+		return string(stderr)
+	}
+	return string(decompressed)
+}
@@ -0,0 +1,217 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that shares capacity fairly between the users
+// (or RepGroups) that have jobs ready to run.
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// FairShare* are the modes of ServerConfig.FairShare.
+const (
+	// FairShareOff treats all jobs equally, regardless of who added them.
+	FairShareOff = ""
+
+	// FairShareUser shares capacity between the users that added jobs.
+	FairShareUser = "user"
+
+	// FairShareRepGroup shares capacity between RepGroups.
+	FairShareRepGroup = "repgroup"
+)
+
+// fairShareOffAlias can be used in place of FairShareOff, for clarity on the
+// command line and in the web interface.
+const fairShareOffAlias = "off"
+
+// ParseFairShare checks that the given fair share mode is one of the
+// FairShare* constants, returning it. "off" is also accepted, as
+// FairShareOff.
+func ParseFairShare(mode string) (string, error) {
+	switch mode {
+	case FairShareOff, FairShareUser, FairShareRepGroup:
+		return mode, nil
+	case fairShareOffAlias:
+		return FairShareOff, nil
+	}
+	return "", fmt.Errorf("fair share mode [%s] is not one of '%s', '%s' or '%s'", mode, fairShareOffAlias, FairShareUser, FairShareRepGroup)
+}
+
+// noteFairShareTransition is subscribed to all our queue's changes, and keeps
+// count of how many jobs of each user and RepGroup are ready and running.
+func (s *Server) noteFairShareTransition(from, to queue.SubQueue, data []interface{}) {
+	if from != queue.SubQueueReady && from != queue.SubQueueRun && to != queue.SubQueueReady && to != queue.SubQueueRun {
+		return
+	}
+
+	s.fsmutex.Lock()
+	defer s.fsmutex.Unlock()
+	for _, inter := range data {
+		job, ok := inter.(*Job)
+		if !ok {
+			continue
+		}
+		job.RLock()
+		user, repGroup := job.User, job.RepGroup
+		job.RUnlock()
+
+		noteUsageTransition(s.userUsage, user, from, to)
+		noteUsageTransition(s.rgUsage, repGroup, from, to)
+	}
+}
+
+// noteUsageTransition adjusts the usage of the given group in the given map
+// for one of its jobs moving between the given sub-queues.
+func noteUsageTransition(usages map[string]*namespaceUsage, group string, from, to queue.SubQueue) {
+	usage, exists := usages[group]
+	if !exists {
+		usage = &namespaceUsage{}
+		usages[group] = usage
+	}
+
+	switch from {
+	case queue.SubQueueReady:
+		usage.ready--
+	case queue.SubQueueRun:
+		usage.running--
+	}
+	switch to {
+	case queue.SubQueueReady:
+		usage.ready++
+	case queue.SubQueueRun:
+		usage.running++
+	}
+
+	if usage.ready <= 0 && usage.running <= 0 {
+		delete(usages, group)
+	}
+}
+
+// jobFairGroup is our queue.FairGroup, which puts the ready jobs of each
+// namespace, user and RepGroup in their own fair group. Since all the jobs of a
+// fair group then get the same answer from fairShareMatch() and
+// namespaceShareMatch(), those can be used as a queue.Filter.
+func jobFairGroup(item *queue.Item) string {
+	job, ok := item.Data().(*Job)
+	if !ok {
+		return ""
+	}
+	job.RLock()
+	defer job.RUnlock()
+	return job.Namespace + "\x00" + job.User + "\x00" + job.RepGroup
+}
+
+// fairShareMatch returns a queue.Match that doesn't match the jobs of users
+// (or RepGroups, depending on our fairShare mode) that have more jobs running
+// than some other user that has jobs ready to run. This has runners round-robin
+// between users. Returns nil if fair sharing is off.
+func (s *Server) fairShareMatch() queue.Match {
+	s.tmutex.RLock()
+	mode := s.fairShare
+	s.tmutex.RUnlock()
+	if mode != FairShareUser && mode != FairShareRepGroup {
+		return nil
+	}
+
+	return func(item *queue.Item) bool {
+		job, ok := item.Data().(*Job)
+		if !ok {
+			return true
+		}
+		job.RLock()
+		group, usages := job.User, s.userUsage
+		if mode == FairShareRepGroup {
+			group, usages = job.RepGroup, s.rgUsage
+		}
+		job.RUnlock()
+
+		s.fsmutex.RLock()
+		defer s.fsmutex.RUnlock()
+		return !overFairShare(group, usages)
+	}
+}
+
+// overFairShare tells you if the given group has more jobs running than some
+// other group that has jobs ready to run.
+func overFairShare(group string, usages map[string]*namespaceUsage) bool {
+	var running int
+	if u, exists := usages[group]; exists {
+		running = u.running
+	}
+	for other, u := range usages {
+		if other != group && u.ready > 0 && u.running < running {
+			return true
+		}
+	}
+	return false
+}
+
+// setFairShare changes our fair share mode, which must be valid, until the
+// next Reload().
+func (s *Server) setFairShare(mode string) {
+	s.tmutex.Lock()
+	defer s.tmutex.Unlock()
+	s.fairShare = mode
+}
+
+// getFairShare returns our current fair share mode.
+func (s *Server) getFairShare() string {
+	s.tmutex.RLock()
+	defer s.tmutex.RUnlock()
+	return s.fairShare
+}
+
+// SetFairShare changes how the server shares capacity between the users (or
+// RepGroups) with jobs ready to run, overriding its ServerConfig.FairShare
+// until it is next reloaded or restarted. mode is one of the FairShare*
+// constants, or "off".
+func (c *Client) SetFairShare(mode string) error {
+	return c.SetFairShareContext(context.Background(), mode)
+}
+
+// SetFairShareContext is like SetFairShare(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) SetFairShareContext(ctx context.Context, mode string) error {
+	mode, err := ParseFairShare(mode)
+	if err != nil {
+		return err
+	}
+	_, err = c.requestContext(ctx, &clientRequest{Method: "setfairshare", FairShare: mode})
+	return err
+}
+
+// GetFairShare returns the server's current fair share mode, one of the
+// FairShare* constants.
+func (c *Client) GetFairShare() (string, error) {
+	return c.GetFairShareContext(context.Background())
+}
+
+// GetFairShareContext is like GetFairShare(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetFairShareContext(ctx context.Context) (string, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getfairshare"})
+	if err != nil {
+		return "", err
+	}
+	return resp.FairShare, err
+}
@@ -0,0 +1,269 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for handing over to a new server process (eg.
+// one running an upgraded wr) without losing running jobs: we pass our
+// listening sockets to the new process, which loads our database once we have
+// closed it, re-adopts the jobs that are still running, and only then starts
+// serving on the sockets. Runners never see the port close, so just carry on
+// with the new server once it answers.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// handoverFDsEnv is the environment variable we use to tell a new server
+	// which file descriptors are the listening sockets for which ports, as a
+	// comma separated list of port=fd.
+	handoverFDsEnv = "WR_HANDOVER_FDS"
+
+	// handoverReadyEnv is the environment variable we use to tell a new server
+	// the file descriptor of the pipe it should write handoverReadyMsg to once
+	// it is serving.
+	handoverReadyEnv = "WR_HANDOVER_READY"
+	handoverReadyMsg = "ready"
+)
+
+// ServerHandoverTimeout is how long a server that is handing over waits for the
+// new server to be ready before giving up on it. It is a variable only for
+// testing purposes.
+var ServerHandoverTimeout = 10 * time.Minute
+
+// handoverProcess holds the details of the new server we're handing over to.
+type handoverProcess struct {
+	cmd   *exec.Cmd
+	ready *os.File
+}
+
+// IsHandover tells you if this process was started by a server that is handing
+// over to it (see ServerConfig.Handover), so will take over that server's
+// sockets when you call Serve().
+func IsHandover() bool {
+	return os.Getenv(handoverFDsEnv) != ""
+}
+
+// handoverListeners returns the listeners that a server handing over to us
+// passed us, keyed on their port, along with the pipe we should tell it we're
+// ready on. The environment variables that describe them are unset, so that
+// any processes we start don't think they're meant for them.
+func handoverListeners() (map[string]net.Listener, *os.File, error) {
+	spec := os.Getenv(handoverFDsEnv)
+	readySpec := os.Getenv(handoverReadyEnv)
+	for _, key := range []string{handoverFDsEnv, handoverReadyEnv} {
+		if err := os.Unsetenv(key); err != nil {
+			return nil, nil, err
+		}
+	}
+	if spec == "" {
+		return nil, nil, nil
+	}
+
+	listeners := make(map[string]net.Listener)
+	for _, portFD := range strings.Split(spec, ",") {
+		parts := strings.Split(portFD, "=")
+		if len(parts) != 2 {
+			return listeners, nil, fmt.Errorf("handover socket %q is not in port=fd form", portFD)
+		}
+		fd, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return listeners, nil, fmt.Errorf("handover socket %q is not in port=fd form", portFD)
+		}
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "handover socket "+parts[0])
+		l, errl := net.FileListener(f)
+		errc := f.Close()
+		if errl != nil {
+			return listeners, nil, fmt.Errorf("handover socket %s is not usable: %w", portFD, errl)
+		}
+		if errc != nil {
+			return listeners, nil, errc
+		}
+		listeners[parts[0]] = l
+	}
+
+	var ready *os.File
+	if readySpec != "" {
+		fd, err := strconv.Atoi(readySpec)
+		if err != nil {
+			return listeners, nil, fmt.Errorf("handover ready pipe %q is not a file descriptor", readySpec)
+		}
+		syscall.CloseOnExec(fd)
+		ready = os.NewFile(uintptr(fd), "handover ready pipe")
+	}
+	return listeners, ready, nil
+}
+
+// openHandoverListeners opens TCP listeners on those of the given ports that
+// aren't already in the given map, adding them to it.
+func openHandoverListeners(listeners map[string]net.Listener, ports ...string) error {
+	for _, port := range ports {
+		if port == "" {
+			continue
+		}
+		if _, exists := listeners[port]; exists {
+			continue
+		}
+		l, err := net.Listen("tcp", "0.0.0.0:"+port)
+		if err != nil {
+			return err
+		}
+		listeners[port] = l
+	}
+	return nil
+}
+
+// signalHandoverReady tells the server that handed over to us, via the given
+// pipe, that we're now serving.
+func (s *Server) signalHandoverReady(ready *os.File) {
+	if _, err := ready.Write([]byte(handoverReadyMsg)); err != nil {
+		s.Warn("failed to tell the old server that we're ready", "err", err)
+	}
+	if err := ready.Close(); err != nil {
+		s.Warn("failed to close the handover pipe", "err", err)
+	}
+	s.Info("took over from the old server")
+}
+
+// Handover starts a new server using our ServerConfig.Handover, passing it our
+// sockets, and then shuts us down without stopping our runners, so that the
+// new server can take over. It returns an error if we weren't configured to be
+// able to hand over, or the new server couldn't be started; otherwise we will
+// shut down in the background.
+func (s *Server) Handover() error {
+	if s.config.Handover == nil {
+		return fmt.Errorf("no ServerConfig.Handover was configured")
+	}
+
+	s.ssmutex.Lock()
+	defer s.ssmutex.Unlock()
+	if !s.up {
+		return Error{"Handover", "", ErrNoServer}
+	}
+	if s.handover != nil {
+		return fmt.Errorf("already handing over")
+	}
+
+	ports := make([]string, 0, len(s.listeners))
+	files := make([]*os.File, 0, len(s.listeners)+1)
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close() // #nosec we don't care about failing to close our copies
+		}
+	}
+	for port, l := range s.listeners {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			closeFiles()
+			return err
+		}
+		ports = append(ports, port)
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("we have no sockets that can be handed over")
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		closeFiles()
+		return err
+	}
+
+	// ExtraFiles become file descriptors 3 onwards in the new process
+	portFDs := make([]string, len(ports))
+	for i, port := range ports {
+		portFDs[i] = fmt.Sprintf("%s=%d", port, i+3)
+	}
+	cmd := s.config.Handover()
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env,
+		handoverFDsEnv+"="+strings.Join(portFDs, ","),
+		handoverReadyEnv+"="+strconv.Itoa(len(files)+3))
+	cmd.ExtraFiles = append(files, readyW)
+
+	err = cmd.Start()
+	closeFiles()
+	errc := readyW.Close()
+	if err != nil {
+		readyR.Close() // #nosec the start error is more useful
+		return err
+	}
+	if errc != nil {
+		s.Warn("failed to close our copy of the handover pipe", "err", errc)
+	}
+
+	s.Info("handing over to a new server", "pid", cmd.Process.Pid)
+	s.handover = &handoverProcess{cmd: cmd, ready: readyR}
+
+	// the new server will wait for our database to be closed, which we do in
+	// our shutdown
+	go s.shutdown(ErrClosedHandover, false, true)
+	return nil
+}
+
+// awaitHandover waits until the new server we're handing over to says it is
+// ready, or exits, or ServerHandoverTimeout passes, logging which.
+func (s *Server) awaitHandover(h *handoverProcess) {
+	defer h.ready.Close() // #nosec we don't care about failing to close the pipe
+
+	ctx, cancel := context.WithTimeout(context.Background(), ServerHandoverTimeout)
+	defer cancel()
+
+	readyCh := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, len(handoverReadyMsg))
+		_, err := io.ReadFull(h.ready, buf)
+		readyCh <- err == nil && string(buf) == handoverReadyMsg
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- h.cmd.Wait()
+	}()
+
+	pid := h.cmd.Process.Pid
+	select {
+	case ok := <-readyCh:
+		if ok {
+			s.Info("handed over to the new server", "pid", pid)
+			return
+		}
+		s.Error("the new server failed to start; start a manager again to take over the running jobs", "pid", pid)
+	case err := <-exited:
+		s.Error("the new server exited before it was ready; start a manager again to take over the running jobs", "pid", pid, "err", err)
+	case <-ctx.Done():
+		s.Error("the new server did not become ready in time; check on it, or start a manager again to take over the running jobs", "pid", pid)
+	}
+}
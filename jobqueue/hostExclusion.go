@@ -0,0 +1,95 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions that let hosts be excluded from running
+// jobs.
+
+import (
+	"sort"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// preemptExclude is used in place of a PreemptionPolicy Mode to tell a client
+// running a job on an excluded host to requeue it.
+const preemptExclude = "exclude"
+
+// excludeHosts does the server side of Client.ExcludeHosts() and
+// Client.IncludeHosts(). On exclusion, jobs running on those hosts are marked
+// so that their clients requeue them when they next touch.
+func (s *Server) excludeHosts(hosts []string, exclude bool) (srerr string, qerr error) {
+	if err := s.db.storeExcludedHosts(hosts, exclude); err != nil {
+		return ErrDBError, err
+	}
+
+	s.exmutex.Lock()
+	excluded := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		if exclude {
+			s.excludedHosts[host] = true
+			excluded[host] = true
+		} else {
+			delete(s.excludedHosts, host)
+		}
+	}
+	s.exmutex.Unlock()
+
+	s.scheduler.ExcludeHosts(s.getExcludedHosts()...)
+
+	if !exclude {
+		return "", nil
+	}
+
+	s.q.Each(func(item *queue.Item) bool {
+		if item.State() != queue.ItemStateRun {
+			return true
+		}
+		job := item.Data().(*Job)
+		job.Lock()
+		if excluded[job.Host] && job.preempt != PreemptRequeue {
+			job.preempt = preemptExclude
+			job.preemptedBy = ""
+			s.Info("requeuing job on excluded host", "job", item.Key, "host", job.Host)
+		}
+		job.Unlock()
+		return true
+	})
+	return "", nil
+}
+
+// hostExcluded tells you if the given host has been excluded.
+func (s *Server) hostExcluded(host string) bool {
+	s.exmutex.RLock()
+	defer s.exmutex.RUnlock()
+	return s.excludedHosts[host]
+}
+
+// getExcludedHosts returns the sorted names of the hosts that have been
+// excluded.
+func (s *Server) getExcludedHosts() []string {
+	s.exmutex.RLock()
+	hosts := make([]string, 0, len(s.excludedHosts))
+	for host := range s.excludedHosts {
+		hosts = append(hosts, host)
+	}
+	s.exmutex.RUnlock()
+	sort.Strings(hosts)
+	return hosts
+}
@@ -0,0 +1,118 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets users decide, per RepGroup, what
+// happens to jobs that were running on a host that failed.
+
+import (
+	"fmt"
+	"time"
+)
+
+// HostFailureMode is the Mode of a HostFailurePolicy.
+type HostFailureMode string
+
+// HostFailureMode* constants are the possible Modes of a HostFailurePolicy.
+const (
+	// HostFailureRetry treats the jobs as having failed: they are retried
+	// after the usual delay, and this counts against their Retries. This is
+	// the behaviour of RepGroups without a policy.
+	HostFailureRetry HostFailureMode = "retry"
+
+	// HostFailureRequeue requeues the jobs immediately, without this counting
+	// against their Retries.
+	HostFailureRequeue HostFailureMode = "requeue"
+
+	// HostFailureDelay requeues the jobs after the policy's Delay, without
+	// this counting against their Retries.
+	HostFailureDelay HostFailureMode = "delay"
+
+	// HostFailureHold buries the jobs, so that they aren't run again until you
+	// have confirmed it is safe to do so by retrying (kicking) them.
+	HostFailureHold HostFailureMode = "hold"
+)
+
+// HostFailurePolicy describes what should happen to jobs that were running on
+// a host that failed. Supply these to Client.SetRepGroupHostFailurePolicy().
+type HostFailurePolicy struct {
+	Mode HostFailureMode
+
+	// Delay is how long jobs are held in the delayed state before being
+	// requeued, when Mode is HostFailureDelay.
+	Delay time.Duration
+}
+
+// validate checks the policy has a known Mode and a sensible Delay.
+func (p *HostFailurePolicy) validate() error {
+	switch p.Mode {
+	case HostFailureRetry, HostFailureRequeue, HostFailureHold:
+		if p.Delay != 0 {
+			return fmt.Errorf("Delay is only valid with Mode %s", HostFailureDelay)
+		}
+	case HostFailureDelay:
+		if p.Delay <= 0 {
+			return fmt.Errorf("Mode %s needs a positive Delay", HostFailureDelay)
+		}
+	default:
+		return fmt.Errorf("unknown Mode %q", p.Mode)
+	}
+	return nil
+}
+
+// counts tells you if a host failure should count against the Retries of jobs
+// subject to this policy. A nil policy counts.
+func (p *HostFailurePolicy) counts() bool {
+	return p == nil || p.Mode == HostFailureRetry
+}
+
+// setRepGroupHostFailurePolicy sets the HostFailurePolicy of the given
+// RepGroup, or removes it if policy is nil.
+func (s *Server) setRepGroupHostFailurePolicy(repGroup string, policy *HostFailurePolicy) (srerr string, qerr error) {
+	if policy != nil {
+		if err := policy.validate(); err != nil {
+			return ErrBadHostFailure, err
+		}
+	}
+
+	if err := s.db.storeRepGroupHostFailurePolicy(repGroup, policy); err != nil {
+		return ErrDBError, err
+	}
+
+	s.hfmutex.Lock()
+	defer s.hfmutex.Unlock()
+	if policy == nil {
+		delete(s.rgHostFailure, repGroup)
+		return "", nil
+	}
+	s.rgHostFailure[repGroup] = policy
+	return "", nil
+}
+
+// hostFailurePolicy returns the HostFailurePolicy of the given job's RepGroup,
+// or nil if it doesn't have one. The job must not be locked.
+func (s *Server) hostFailurePolicy(job *Job) *HostFailurePolicy {
+	job.RLock()
+	repGroup := job.RepGroup
+	job.RUnlock()
+
+	s.hfmutex.RLock()
+	defer s.hfmutex.RUnlock()
+	return s.rgHostFailure[repGroup]
+}
@@ -0,0 +1,117 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that caps the number of jobs that can run at once
+// on each host.
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// HostJobLimit caps the number of jobs that can run at once on hosts with names
+// matching Pattern, regardless of how many cores those hosts have.
+type HostJobLimit struct {
+	// Pattern is a glob (as understood by filepath.Match()) that host names are
+	// matched against.
+	Pattern string
+
+	// Max is the maximum number of jobs that can run at once on each matching
+	// host. 0 means no limit.
+	Max int
+}
+
+// ParseHostJobLimits parses a comma separated list of pattern=max pairs, eg.
+// "nfs-*=4,node1=2", in to HostJobLimits suitable for supplying to
+// ServerConfig.
+func ParseHostJobLimits(spec string) ([]*HostJobLimit, error) {
+	var limits []*HostJobLimit
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		pos := strings.LastIndex(pair, "=")
+		if pos < 1 {
+			return nil, fmt.Errorf("host job limit [%s] is not of the form pattern=max", pair)
+		}
+		max, err := strconv.Atoi(pair[pos+1:])
+		if err != nil {
+			return nil, fmt.Errorf("host job limit [%s] does not end in an integer", pair)
+		}
+		limits = append(limits, &HostJobLimit{Pattern: pair[:pos], Max: max})
+	}
+	return limits, nil
+}
+
+// validateHostJobLimits checks that the given limits have valid patterns and
+// non-negative maximums.
+func validateHostJobLimits(limits []*HostJobLimit) error {
+	for _, limit := range limits {
+		if _, err := filepath.Match(limit.Pattern, ""); err != nil {
+			return fmt.Errorf("host job limit pattern [%s] is not valid: %w", limit.Pattern, err)
+		}
+		if limit.Max < 0 {
+			return fmt.Errorf("host job limit for [%s] can't be negative", limit.Pattern)
+		}
+	}
+	return nil
+}
+
+// hostJobLimit returns the maximum number of jobs that can run at once on the
+// given host: that of the first HostJobLimit whose Pattern matches it, or else
+// our MaxJobsPerHost. 0 means no limit.
+func (s *Server) hostJobLimit(host string) int {
+	s.tmutex.RLock()
+	defer s.tmutex.RUnlock()
+	for _, limit := range s.hostJobLimits {
+		if matched, _ := filepath.Match(limit.Pattern, host); matched {
+			return limit.Max
+		}
+	}
+	return s.maxJobsPerHost
+}
+
+// hostFull tells you if the given host is already running as many jobs as its
+// hostJobLimit() allows. A blank host (a new host) is never full.
+func (s *Server) hostFull(host string) bool {
+	if host == "" {
+		return false
+	}
+	limit := s.hostJobLimit(host)
+	if limit == 0 {
+		return false
+	}
+	s.afmutex.RLock()
+	defer s.afmutex.RUnlock()
+	return s.hostJobs[host] >= limit
+}
+
+// hostCheck is our scheduler.HostCheckCallBack, which stops the scheduler
+// running runners on hosts that are full, or that don't satisfy a job's
+// affinity constraints.
+func (s *Server) hostCheck(host string, req *scheduler.Requirements) bool {
+	return !s.hostFull(host) && s.affinityHostCheck(host, req)
+}
@@ -0,0 +1,178 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for describing what each host is currently
+// doing, for 'wr top'.
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// HostJob describes a job running on a host, as part of a HostUsage.
+type HostJob struct {
+	Key      string
+	Name     string
+	Cmd      string
+	RepGroup string
+	Started  time.Time
+	Cores    float64
+	RAM      int // MB
+}
+
+// HostUsage describes a host that is running jobs, or that the job scheduler
+// could run jobs on, as returned by Client.GetHostUsage().
+type HostUsage struct {
+	Host string
+	Jobs []*HostJob
+
+	// Running is the number of Jobs, and Cores and RAM (MB) the sum of their
+	// requirements.
+	Running int
+	Cores   float64
+	RAM     int
+
+	// MaxCores and MaxRAM (MB) are the capacity of the host, if the job
+	// scheduler knows it; otherwise they are 0.
+	MaxCores float64
+	MaxRAM   int
+
+	// Flavor is the cloud flavor of the host, if applicable.
+	Flavor string
+
+	// Load is the 1 minute load average of the host, and RAMUsed the
+	// percentage of its memory in use, as last reported by a runner on it at
+	// the time Reported. Reported is zero if no runner has reported yet.
+	Load     float64
+	RAMUsed  float64
+	Reported time.Time
+}
+
+// hostLoad is what runners last told us about their host.
+type hostLoad struct {
+	load     float64
+	ramUsed  float64
+	reported time.Time
+}
+
+// recordHostLoad stores the load and memory use of the given host, as reported
+// by a runner touching its job.
+func (s *Server) recordHostLoad(host string, load, ramUsed float64) {
+	if host == "" || (load == 0 && ramUsed == 0) {
+		return
+	}
+	s.hlmutex.Lock()
+	defer s.hlmutex.Unlock()
+	s.hostLoads[host] = &hostLoad{load: load, ramUsed: ramUsed, reported: time.Now()}
+}
+
+// getHostUsage returns a HostUsage for every host currently running jobs, and
+// every other host the job scheduler knows about, sorted by host name. Loads
+// recorded for hosts that are no longer running jobs are forgotten.
+func (s *Server) getHostUsage() []*HostUsage {
+	usages := make(map[string]*HostUsage)
+	s.q.Each(func(item *queue.Item) bool {
+		if item.State() != queue.ItemStateRun {
+			return true
+		}
+		job := item.Data().(*Job)
+		job.RLock()
+		defer job.RUnlock()
+		if job.StartTime.IsZero() || job.Host == "" {
+			return true
+		}
+
+		usage, exists := usages[job.Host]
+		if !exists {
+			usage = &HostUsage{Host: job.Host}
+			usages[job.Host] = usage
+		}
+		hj := &HostJob{Key: item.Key, Name: job.Name, Cmd: job.Cmd, RepGroup: job.RepGroup, Started: job.StartTime}
+		if job.Requirements != nil {
+			hj.Cores = job.Requirements.Cores
+			hj.RAM = job.Requirements.RAM
+		}
+		usage.Jobs = append(usage.Jobs, hj)
+		usage.Running++
+		usage.Cores += hj.Cores
+		usage.RAM += hj.RAM
+		return true
+	})
+
+	if s.scheduler != nil {
+		for _, host := range s.scheduler.Hosts() {
+			usage, exists := usages[host.Name]
+			if !exists {
+				usage = &HostUsage{Host: host.Name}
+				usages[host.Name] = usage
+			}
+			usage.MaxCores = host.Cores
+			usage.MaxRAM = host.RAM
+			usage.Flavor = host.Flavor
+		}
+	}
+
+	s.hlmutex.Lock()
+	for host, hl := range s.hostLoads {
+		usage, exists := usages[host]
+		if !exists || len(usage.Jobs) == 0 {
+			delete(s.hostLoads, host)
+			continue
+		}
+		usage.Load = hl.load
+		usage.RAMUsed = hl.ramUsed
+		usage.Reported = hl.reported
+	}
+	s.hlmutex.Unlock()
+
+	hus := make([]*HostUsage, 0, len(usages))
+	for _, usage := range usages {
+		sort.Slice(usage.Jobs, func(i, j int) bool {
+			return usage.Jobs[i].Started.Before(usage.Jobs[j].Started)
+		})
+		hus = append(hus, usage)
+	}
+	sort.Slice(hus, func(i, j int) bool {
+		return hus[i].Host < hus[j].Host
+	})
+	return hus
+}
+
+// GetHostUsage returns details of every host currently running jobs (and
+// every other host the job scheduler knows about, such as idle cloud servers),
+// sorted by host name: the jobs running on it, the resources they requested,
+// and the host's load and memory use as recently reported by its runners.
+// This is what 'wr top' displays.
+func (c *Client) GetHostUsage() ([]*HostUsage, error) {
+	return c.GetHostUsageContext(context.Background())
+}
+
+// GetHostUsageContext is like GetHostUsage(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetHostUsageContext(ctx context.Context) ([]*HostUsage, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "gethostusage"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.HostUsage, err
+}
@@ -0,0 +1,112 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the implementation of the HTTPPost behaviour.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HTTPPostSpec describes where an HTTPPost Behaviour should POST to, and what.
+type HTTPPostSpec struct {
+	// URL is where the JSON payload is POSTed to.
+	URL string `json:"url"`
+
+	// Payload, if set, is the JSON that gets POSTed as is. Otherwise a
+	// BehaviourPost describing the Job is POSTed.
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// String converts the spec to the string form needed for the Arg of an
+// HTTPPost Behaviour.
+func (h *HTTPPostSpec) String() string {
+	return specString(h)
+}
+
+// httpPostSpecFromArg converts the Arg of an HTTPPost Behaviour back to an
+// HTTPPostSpec.
+func httpPostSpecFromArg(arg interface{}) (*HTTPPostSpec, error) {
+	spec := &HTTPPostSpec{}
+	if err := jsonSpecArg(arg, spec); err != nil {
+		return nil, err
+	}
+	if spec.URL == "" {
+		return nil, fmt.Errorf("arg %s has no url", arg)
+	}
+	return spec, nil
+}
+
+// BehaviourPost is what gets POSTed by an HTTPPost Behaviour that doesn't have
+// its own Payload. Artifacts are those recorded by earlier RecordOutputs,
+// Checksum and ArchiveOutputs Behaviours.
+type BehaviourPost struct {
+	RepGroup   string      `json:"rep_grp"`
+	Key        string      `json:"key"`
+	Cmd        string      `json:"cmd"`
+	Host       string      `json:"host,omitempty"`
+	Exitcode   int         `json:"exitcode"`
+	FailReason string      `json:"fail_reason"`
+	Artifacts  []*Artifact `json:"artifacts,omitempty"`
+	Time       time.Time   `json:"time"`
+}
+
+// httpPost POSTs the payload described by our HTTPPostSpec Arg.
+func (b *Behaviour) httpPost(j *Job) error {
+	spec, err := httpPostSpecFromArg(b.Arg)
+	if err != nil {
+		return err
+	}
+
+	body := []byte(spec.Payload)
+	if len(body) == 0 {
+		key := j.Key()
+		j.RLock()
+		bp := &BehaviourPost{
+			RepGroup:   j.RepGroup,
+			Key:        key,
+			Cmd:        j.Cmd,
+			Host:       j.Host,
+			Exitcode:   j.Exitcode,
+			FailReason: j.FailReason,
+			Artifacts:  j.behaviourArtifacts,
+			Time:       time.Now(),
+		}
+		body, err = json.Marshal(bp)
+		j.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	client := &http.Client{Timeout: ClientBehaviourPostTimeout}
+	resp, err := client.Post(spec.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close() // #nosec nothing useful to do if closing fails
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("http_post behaviour was not accepted: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for staging the Inputs of jobs: runners download
+// them from object stores in to a cache directory shared by all the runners on
+// a host, so that jobs that use the same large files (eg. reference genomes)
+// only download them once per host.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// inputCacheDefaultDirName is the name of the directory in the system
+	// temp directory that we cache Inputs in, if Client.SetInputCache() wasn't
+	// used to say otherwise.
+	inputCacheDefaultDirName = "wr_input_cache"
+
+	inputCacheLockSuffix = ".lock"
+	inputCacheMD5Suffix  = ".md5"
+	inputCacheTmpSuffix  = ".tmp"
+)
+
+// Input describes a file in an object store that a job's Cmd reads, which the
+// runner should make available before running Cmd.
+type Input struct {
+	// Backend and Profile say which object store Source is in, and how to
+	// access it, exactly as for a MountTarget.
+	Backend string `json:",omitempty"`
+	Profile string `json:",omitempty"`
+
+	// Source (required) is the name of the bucket followed by the path of the
+	// file within it, eg. "mybucket/refs/hs38.fa".
+	Source string
+
+	// Dest is where the file should appear, relative to the directory Cmd runs
+	// in unless absolute. Defaults to the basename of Source. Since it may be a
+	// hard link to the cached file, Cmd must not alter it.
+	Dest string `json:",omitempty"`
+
+	// MD5 is the optional hex encoded MD5 checksum of the file. If supplied,
+	// the downloaded file must match it, and a cached copy is only used if it
+	// was downloaded with the same checksum.
+	MD5 string `json:",omitempty"`
+}
+
+// validate checks the Input has a valid Backend and Source.
+func (in *Input) validate() error {
+	if !validMountBackend(in.Backend) {
+		return fmt.Errorf("input [%s] has unknown Backend [%s]", in.Source, in.Backend)
+	}
+	parts := strings.SplitN(in.Source, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.HasSuffix(in.Source, "/") {
+		return fmt.Errorf("input [%s] is not of the form bucket/path/to/file", in.Source)
+	}
+	if in.MD5 != "" {
+		if b, err := hex.DecodeString(in.MD5); err != nil || len(b) != 16 {
+			return fmt.Errorf("input [%s] has an invalid MD5 [%s]", in.Source, in.MD5)
+		}
+	}
+	return nil
+}
+
+// dest returns the path the Input should appear at, given the directory Cmd
+// runs in.
+func (in *Input) dest(cwd string) string {
+	dest := in.Dest
+	if dest == "" {
+		dest = path.Base(in.Source)
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(cwd, dest)
+	}
+	return dest
+}
+
+// cacheName returns the name of the file the Input is cached as.
+func (in *Input) cacheName() string {
+	sum := sha256.Sum256([]byte(in.Backend + "\x00" + in.Profile + "\x00" + in.Source))
+	return hex.EncodeToString(sum[:])
+}
+
+// download gets the Input from its object store, writing it to the given local
+// path.
+func (in *Input) download(local string) error {
+	parts := strings.SplitN(in.Source, "/", 2)
+	accessor, err := MountTarget{Backend: in.Backend, Profile: in.Profile, Path: parts[0]}.Accessor()
+	if err != nil {
+		return err
+	}
+	return accessor.DownloadFile(parts[1], local)
+}
+
+// InputCacheStats describes how well a job's Inputs were served by the cache
+// of the host it ran on.
+type InputCacheStats struct {
+	Hits      int   // number of Inputs that were already cached
+	Misses    int   // number of Inputs that had to be downloaded
+	HitBytes  int64 // total size of the Inputs that were already cached
+	MissBytes int64 // total size of the Inputs that had to be downloaded
+}
+
+// inputCache is a directory of downloaded Inputs, shared by the runners on a
+// host, with the least recently used files being deleted when its total size
+// exceeds maxSize.
+type inputCache struct {
+	dir     string
+	maxSize int64 // bytes; 0 means unlimited
+}
+
+// stage makes each of the given Inputs available at its destination relative
+// to the given cwd, downloading those not already in the cache. Files are
+// hard-linked from the cache where possible (so that they survive being
+// evicted from it), otherwise copied.
+func (ic *inputCache) stage(inputs []*Input, cwd string) (*InputCacheStats, error) {
+	if err := os.MkdirAll(ic.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	stats := &InputCacheStats{}
+	keep := make(map[string]bool)
+	for _, in := range inputs {
+		cached, hit, size, err := ic.get(in)
+		if err != nil {
+			return stats, err
+		}
+		keep[filepath.Base(cached)] = true
+		if hit {
+			stats.Hits++
+			stats.HitBytes += size
+		} else {
+			stats.Misses++
+			stats.MissBytes += size
+		}
+
+		if err = linkOrCopy(cached, in.dest(cwd)); err != nil {
+			return stats, fmt.Errorf("could not stage input [%s]: %w", in.Source, err)
+		}
+	}
+
+	return stats, ic.evict(keep)
+}
+
+// get returns the path to the cached copy of the given Input, downloading it
+// first if necessary. Also returns true if it was already cached, and its
+// size.
+func (ic *inputCache) get(in *Input) (cached string, hit bool, size int64, err error) {
+	cached = filepath.Join(ic.dir, in.cacheName())
+	unlock, err := lockFile(cached+inputCacheLockSuffix, true)
+	if err != nil {
+		return cached, false, 0, err
+	}
+	defer func() {
+		if erru := unlock(); erru != nil && err == nil {
+			err = erru
+		}
+	}()
+
+	info, errs := os.Stat(cached)
+	if errs == nil {
+		sum, errr := ioutil.ReadFile(cached + inputCacheMD5Suffix)
+		if errr == nil && (in.MD5 == "" || strings.EqualFold(string(sum), in.MD5)) {
+			now := time.Now()
+			if err = os.Chtimes(cached, now, now); err != nil {
+				return cached, false, 0, err
+			}
+			return cached, true, info.Size(), nil
+		}
+	}
+
+	tmp := cached + inputCacheTmpSuffix
+	defer func() {
+		if errr := os.Remove(tmp); errr != nil && !os.IsNotExist(errr) && err == nil {
+			err = errr
+		}
+	}()
+	if err = in.download(tmp); err != nil {
+		return cached, false, 0, fmt.Errorf("could not download input [%s]: %w", in.Source, err)
+	}
+	sum, err := fileMD5(tmp)
+	if err != nil {
+		return cached, false, 0, err
+	}
+	if in.MD5 != "" && !strings.EqualFold(sum, in.MD5) {
+		return cached, false, 0, fmt.Errorf("input [%s] has MD5 %s, not the expected %s", in.Source, sum, in.MD5)
+	}
+	if err = ioutil.WriteFile(cached+inputCacheMD5Suffix, []byte(sum), 0600); err != nil {
+		return cached, false, 0, err
+	}
+	if err = os.Rename(tmp, cached); err != nil {
+		return cached, false, 0, err
+	}
+	info, err = os.Stat(cached)
+	if err != nil {
+		return cached, false, 0, err
+	}
+	return cached, false, info.Size(), nil
+}
+
+// evict deletes the least recently used cached files until the total size of
+// the cache is no more than maxSize. Files named in keep, or currently being
+// used by another runner, are not deleted.
+func (ic *inputCache) evict(keep map[string]bool) error {
+	if ic.maxSize <= 0 {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(ic.dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, inputCacheLockSuffix) ||
+			strings.HasSuffix(name, inputCacheMD5Suffix) || strings.HasSuffix(name, inputCacheTmpSuffix) {
+			continue
+		}
+		files = append(files, entry)
+		total += entry.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, file := range files {
+		if total <= ic.maxSize {
+			break
+		}
+		if keep[file.Name()] {
+			continue
+		}
+		cached := filepath.Join(ic.dir, file.Name())
+		unlock, errl := lockFile(cached+inputCacheLockSuffix, false)
+		if errl != nil {
+			continue
+		}
+		err = os.Remove(cached)
+		if err == nil {
+			err = os.Remove(cached + inputCacheMD5Suffix)
+		}
+		if erru := unlock(); erru != nil && err == nil {
+			err = erru
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= file.Size()
+	}
+	return nil
+}
+
+// lockFile takes an exclusive lock on the given file (creating it if
+// necessary), waiting for it if wait is true, otherwise returning an error if
+// it is already locked. Call the returned function to release the lock.
+func lockFile(path string, wait bool) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err = syscall.Flock(int(f.Fd()), how); err != nil {
+		errc := f.Close()
+		if errc != nil {
+			err = fmt.Errorf("%w (and closing the lock file failed: %s)", err, errc)
+		}
+		return nil, err
+	}
+	return f.Close, nil // (closing releases the lock)
+}
+
+// linkOrCopy makes the file at source also appear at dest, replacing anything
+// already there, by hard linking if possible, otherwise by copying.
+func linkOrCopy(source, dest string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	if err = os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(source, dest) == nil {
+		return nil
+	}
+
+	in, err := os.Open(source) // #nosec
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errc := in.Close(); errc != nil && err == nil {
+			err = errc
+		}
+	}()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600) // #nosec
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errc := out.Close(); errc != nil && err == nil {
+			err = errc
+		}
+	}()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// SetInputCache sets the directory that Execute() caches the Inputs of jobs
+// in, and the maximum total size in bytes of the files kept there (0 means
+// unlimited). The directory should be shared by all the runners on a host. The
+// default is a directory in the system temp directory, with no size limit.
+func (c *Client) SetInputCache(dir string, maxSize int64) {
+	c.inputCacheDir = dir
+	c.inputCacheSize = maxSize
+}
+
+// inputCache returns the inputCache configured with SetInputCache().
+func (c *Client) inputCache() *inputCache {
+	dir := c.inputCacheDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), inputCacheDefaultDirName)
+	}
+	return &inputCache{dir: dir, maxSize: c.inputCacheSize}
+}
@@ -21,6 +21,7 @@ package jobqueue
 // This file contains the job related code.
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
@@ -45,11 +46,12 @@ import (
 type JobState string
 
 // JobState* constants represent all the possible job states. The fake "new" and
-// "deleted" states are for the benefit of the web interface (jstateCount).
+// "deleted" states are for the benefit of the web interface (JobStateCount).
 // "lost" is also a "fake" state indicating the job was running and we lost
 // contact with it; it may be dead. "unknown" is an error case that shouldn't
 // happen. "deletable" is a meta state that can be used when filtering jobs to
-// mean !(running|complete).
+// mean !(running|complete). "trashed" jobs have been removed, but can still be
+// restored (see ServerConfig.TrashPeriod).
 const (
 	JobStateNew       JobState = "new"
 	JobStateDelayed   JobState = "delayed"
@@ -62,6 +64,7 @@ const (
 	JobStateComplete  JobState = "complete"
 	JobStateDeleted   JobState = "deleted"
 	JobStateDeletable JobState = "deletable"
+	JobStateTrashed   JobState = "trashed"
 	JobStateUnknown   JobState = "unknown"
 )
 
@@ -73,6 +76,10 @@ const jobSchedLimitGroupSeparator = "~"
 // group names.
 const jobLimitGroupSeparator = ","
 
+// jobLimitGroupUsageSeparator is the separator between a limit group name and
+// the number of that group's tokens a job uses.
+const jobLimitGroupUsageSeparator = "*"
+
 // subqueueToJobState converts queue.SubQueue entries to JobStates.
 var subqueueToJobState = map[queue.SubQueue]JobState{
 	queue.SubQueueNew:       JobStateNew,
@@ -102,6 +109,16 @@ type Job struct {
 	// Cmd is the actual command line that will be run via the shell.
 	Cmd string
 
+	// Steps optionally makes this a multi-step job: an ordered list of command
+	// lines that are run one after the other via the shell, in the same working
+	// directory and environment, stopping at the first that fails. Leave Cmd
+	// blank when supplying Steps; it gets set to the Steps joined with " && ".
+	// What happened when each step ran is recorded in StepResults, and if the
+	// job is retried it resumes from the step that failed (so earlier steps
+	// should leave their outputs somewhere that survives, eg. by using
+	// CwdMatters).
+	Steps []string `codec:",omitempty"`
+
 	// Cwd determines the command working directory, the directory we cd to
 	// before running Cmd. When CwdMatters, Cwd is used exactly, otherwise a
 	// unique sub-directory of Cwd is used as the command working directory.
@@ -134,7 +151,10 @@ type Job struct {
 	// Requirements describes the resources this Cmd needs to run, such as RAM,
 	// Disk and time. These may be determined for you by the system (depending
 	// on Override) based on past experience of running jobs with the same
-	// ReqGroup.
+	// ReqGroup. If Disk is greater than 0, Cmd will be killed if it uses more
+	// than ClientPercentDiskKill percent of that much disk space in its actual
+	// working directory (unless that is 0), failing with FailReasonDiskUse. The
+	// most disk it used is recorded as PeakDisk either way.
 	Requirements *scheduler.Requirements
 
 	// RequirementsOrig is like Requirements, but only has the original RAM,
@@ -154,12 +174,68 @@ type Job struct {
 	// Retries is the number of times to retry running a Cmd if it fails.
 	Retries uint8
 
+	// RAMRetryMult, if greater than 1, makes this job be retried with its RAM
+	// requirement multiplied by this amount whenever it runs out of memory,
+	// without that counting against its Retries, until RAMRetryMax is reached.
+	// The default of 0 uses the server's configured multiplier; set it to 1 to
+	// turn this off for the job.
+	RAMRetryMult float64 `codec:",omitempty"`
+
+	// RAMRetryMax is the RAM (in MB) beyond which RAMRetryMult will not take
+	// the job's RAM requirement. The default of 0 uses the server's configured
+	// maximum, if any.
+	RAMRetryMax int `codec:",omitempty"`
+
+	// LostPolicy, if set, says when this job should automatically be confirmed
+	// dead if it is lost, instead of ServerConfig.LostJobPolicy.
+	LostPolicy *LostJobPolicy `codec:",omitempty"`
+
+	// RetryPolicy, if set, says how long this job should wait before being
+	// retried, and limits its retries by FailReason and exit code.
+	RetryPolicy *RetryPolicy `codec:",omitempty"`
+
+	// Policy is the name of a Policy (see Client.SetPolicy()) to assign to
+	// this job's RepGroup when it is added, replacing any the RepGroup already
+	// had. A Policy's settings take precedence over the job's own Retries,
+	// RAMRetryMult and RAMRetryMax.
+	Policy string `codec:",omitempty"`
+
 	// LimitGroups are names of limit groups that this job belongs to. If any
 	// of these groups are defined (elsewhere) to have a limit, then if as many
 	// other jobs as the limit are currently running, this job will not start
 	// running. It's a way of not running too many of a type of job at once.
+	// A group name can be suffixed with *n to say that this job uses n of
+	// the group's limit, treating the limit as a pool of consumable tokens
+	// (eg. "gatk_licence*2" for a job that needs 2 of your licences).
 	LimitGroups []string
 
+	// RunWindow optionally restricts the times at which this job can start
+	// running, eg. "weekdays 18:00-08:00; weekends" to only run outside of
+	// office hours. Outside of the window the job stays in the delayed state.
+	// See Client.SetRepGroupRunWindow() for the format; a job's own RunWindow
+	// takes precedence over any window set for its RepGroup.
+	RunWindow string `codec:",omitempty"`
+
+	// FitRunWindow makes RunWindow (or the RepGroup's run window) bound the
+	// whole execution of this job, not just its start: the job will only start
+	// if its Requirements.Time says it would finish before the window closes.
+	FitRunWindow bool `codec:",omitempty"`
+
+	// Schedule optionally makes this a recurring job: a cron expression (eg.
+	// "0 2 * * *" for 2am every night) that says when the server should add a
+	// new instance of it to the queue. Adding a job with a Schedule doesn't
+	// queue it right away, but stores it as the definition of the recurring
+	// job; see Client.GetSchedules() for the format and how to pause or cancel
+	// it. The instances have the same Schedule.
+	Schedule string `codec:",omitempty"`
+
+	// NotifyComplete and NotifyFailure are where the server sends a summary of
+	// this job's RepGroup once all of its jobs have finished: the former if
+	// they all completed, the latter if some got buried. See
+	// ServerConfig.NotifyComplete for the format of the targets.
+	NotifyComplete []string `codec:",omitempty"`
+	NotifyFailure  []string `codec:",omitempty"`
+
 	// DepGroups are the dependency groups this job belongs to that other jobs
 	// can refer to in their Dependencies.
 	DepGroups []string
@@ -168,6 +244,115 @@ type Job struct {
 	// starts.
 	Dependencies Dependencies
 
+	// SameHostAs optionally names a DepGroup. This job will then only run on
+	// the host that the most recently completed job in that DepGroup ran on (eg.
+	// to make use of files it left in local scratch space). This is only
+	// honoured by the openstack scheduler (the local scheduler only has 1 host
+	// anyway), while that host still exists, and for DepGroup jobs that
+	// completed since the manager last started.
+	SameHostAs string `codec:",omitempty"`
+
+	// AvoidRepGroup optionally names a RepGroup. This job will then never run
+	// on the same host at the same time as any job in that RepGroup.
+	AvoidRepGroup string `codec:",omitempty"`
+
+	// AvoidHosts are hosts this job will not be run on. They are added to when
+	// a TriageRule retries the job on a different host.
+	AvoidHosts []string `codec:",omitempty"`
+
+	// Outputs optionally lists the files this job creates, as paths or glob
+	// patterns, relative to the directory Cmd runs in unless absolute. After
+	// Cmd exits successfully, the size and MD5 checksum of every matching file
+	// is recorded in Artifacts. Files created within a writable mount (see
+	// MountConfigs) get uploaded when the mount is unmounted, and their
+	// Artifacts say where to. Cmd can also register outputs it only discovers
+	// while running, by writing their paths (or glob patterns) one per line to
+	// the file named by the $WR_OUTPUTS_FILE environment variable.
+	Outputs []string `codec:",omitempty"`
+
+	// VerifyOutputs makes it safe to rerun a pipeline that added this job
+	// before: if the job is added again after it completed (eg. with `wr add
+	// --rerun`), the runner first checks the files recorded in the Artifacts
+	// of its previous run, and if they all still exist with the same size and
+	// MD5 checksum, Cmd is not run again (and no Behaviours are triggered);
+	// the job just completes with those Artifacts.
+	VerifyOutputs bool `codec:",omitempty"`
+
+	// ExpectedOutputs optionally lists files that must exist and be non-empty
+	// after Cmd exits 0, as paths or glob patterns (each of which must match
+	// at least one such file), relative to the directory Cmd runs in unless
+	// absolute. This catches tools that exit 0 without writing their results:
+	// if any are missing, the job fails with a FailReason of
+	// FailReasonMissing, as if Cmd had exited non-zero.
+	ExpectedOutputs []string `codec:",omitempty"`
+
+	// Inputs optionally lists files in object stores that Cmd reads. Before
+	// running Cmd, the runner downloads them in to a cache shared by the
+	// runners on its host (see Client.SetInputCache()), and makes them
+	// available at their Dest, so that jobs using the same large files only
+	// download them once per host. How well the cache served them is recorded
+	// in InputStats.
+	Inputs []*Input `codec:",omitempty"`
+
+	// IdempotencyKey is an optional token of your choosing that makes adding
+	// this job idempotent: once a job with a given IdempotencyKey has been
+	// added, adding any job with the same IdempotencyKey again is ignored
+	// (counted as already existing), even if the original has since completed
+	// or been deleted. This lets you safely retry an Add() that failed with a
+	// network error, without risking duplicate or resurrected jobs. (It is
+	// omitted from encodings when blank, so it costs nothing when unused.)
+	IdempotencyKey string `codec:",omitempty"`
+
+	// Name is an optional human-readable name for the job (eg.
+	// "align-sample42-lane3") that can be used instead of its key everywhere a
+	// key is accepted: Client methods that take keys (or JobEssences with a
+	// JobKey), the command line, the web interface and REST API, and
+	// dependencies (see NewNameDependency()). Names may only contain letters,
+	// numbers, underscores, dots, colons, at signs, pluses and dashes, and
+	// must be unique: adding a job with a Name that was given to a different
+	// job before (even one that has since completed or been deleted) fails.
+	Name string `codec:",omitempty"`
+
+	// ArrayIndex is the index, starting from 1, of this job within the array
+	// job (see Client.AddArray()) or manifest (see Client.AddFromManifest())
+	// it was expanded from, or 0 if it was added individually. You do not
+	// set this yourself.
+	ArrayIndex int `codec:",omitempty"`
+
+	// Metadata is an optional small JSON object of your choosing (eg. the
+	// sample being processed and the version of the pipeline doing it) that
+	// is stored with the job, so that its provenance lives with it. It is
+	// shown in the web interface, and jobs can be filtered by the values of
+	// its fields (see MetadataMatches()). It must be no larger than
+	// ServerMaxJobMetadataSize.
+	Metadata json.RawMessage `codec:",omitempty"`
+
+	// Tags are optional key=value pairs (eg. sample=42, stage=align) that let
+	// you group and find jobs by something other than their RepGroup: jobs
+	// can be retrieved by their tags (see Client.GetByTags()), and the web
+	// interface can group and filter jobs by them. Keys may only contain
+	// letters, numbers, underscores, dots, colons, at signs, pluses and
+	// dashes, and values can't contain commas. There can be no more than
+	// ServerMaxJobTags of them.
+	Tags map[string]string `codec:",omitempty"`
+
+	// EnvModules are environment modules (eg. "samtools/1.9") that will be
+	// `module load`ed before Cmd is run. This is useful when jobs are added
+	// with EnvCaptureModule, so run in the runner's own environment, but need
+	// particular software made available.
+	EnvModules []string `codec:",omitempty"`
+
+	// Namespace is the namespace the job was added in, set by the server based
+	// on the namespace of the Client that added it (see Client.SetNamespace()).
+	// Jobs in different namespaces are completely separate, even if they have
+	// the same Cmd. You can't set this yourself.
+	Namespace string `codec:",omitempty"`
+
+	// User is the user that added the job, set by the server based on the
+	// Client that added it. It is used to share capacity fairly between users
+	// (see ServerConfig.FairShare). You don't normally set this yourself.
+	User string `codec:",omitempty"`
+
 	// Behaviours describe what should happen after Cmd is executed, depending
 	// on its success.
 	Behaviours Behaviours
@@ -212,6 +397,50 @@ type Job struct {
 	// monitoring of multiple docker containers run by a single Cmd.
 	MonitorDocker string
 
+	// ContainerImage, if set, makes the Cmd run inside a container created
+	// from this image (eg. "ubuntu:20.04" for docker, or a path to a .sif file
+	// or a URI like "docker://ubuntu:20.04" for singularity), using the given
+	// shell. The image is pulled before the Cmd is started if it isn't already
+	// present; if that fails the job is buried with FailReasonContainer. The
+	// working directory, any mounts described by MountConfigs and the files wr
+	// itself makes available to the Cmd are bind-mounted in at the same paths.
+	//
+	// With docker, the container is limited to the RAM and Cores of the job's
+	// Requirements, and its resource usage is monitored as if MonitorDocker had
+	// been set (unless you set that yourself). Only environment variables in
+	// the job's env overrides, those of its EnvSecrets and those wr sets itself
+	// are passed through. The container runs as the current user. With
+	// singularity, the container sees the job's whole environment and is
+	// monitored and limited like any other Cmd.
+	//
+	// Requires that ContainerRuntime is installed on the machine where the job
+	// will run.
+	ContainerImage string
+
+	// ContainerRuntime is the program used to run ContainerImage:
+	// ContainerRuntimeDocker (the default) or ContainerRuntimeSingularity.
+	ContainerRuntime string
+
+	// EnvSecrets are "ENV_VAR=secret_name" pairs: each environment variable is
+	// set, in the environment the Cmd runs in (only), to the value of the named
+	// secret stored with Client.SetSecret(). Secret values are never stored
+	// with the job or shown with it, and are redacted from the Cmd's STDOUT
+	// and STDERR. All the secrets must exist when the job is added; if one has
+	// been deleted by the time the job runs, it is buried with
+	// FailReasonSecret.
+	EnvSecrets []string `codec:",omitempty"`
+
+	// Network is the network bandwidth, in megabits per second, that the Cmd
+	// is expected to use.
+	Network int
+
+	// NetworkCap, when Network is also set, makes the runner try to cap the
+	// outgoing bandwidth of the Cmd to Network, so that a few transfer-heavy
+	// jobs can't starve other jobs running on the same host. This requires the
+	// runner to be able to use tc and create net_cls cgroups (eg. by running
+	// as root); if it can't, the Cmd runs uncapped and a warning is logged.
+	NetworkCap bool
+
 	// The remaining properties are used to record information about what
 	// happened when Cmd was executed, or otherwise provide its current state.
 	// It is meaningless to set these yourself.
@@ -223,6 +452,24 @@ type Job struct {
 	PeakRAM int
 	// peak disk (MB) used.
 	PeakDisk int64
+	// InputStats describes how many of Inputs were already cached on the
+	// host, the last time the job ran.
+	InputStats *InputCacheStats `codec:",omitempty"`
+	// the files matching Outputs (or registered by Cmd or a RecordOutputs
+	// Behaviour), recorded after the Cmd exited successfully, along with any
+	// registered later with Client.RegisterArtifacts().
+	Artifacts []*Artifact `codec:",omitempty"`
+	// for multi-step jobs, what happened when each of the Steps that has been
+	// tried was run, in order.
+	StepResults []*JobStep `codec:",omitempty"`
+	// for VerifyOutputs jobs that were added again after they completed, the
+	// Artifacts of the previous run.
+	PriorArtifacts []*Artifact `codec:",omitempty"`
+	// the total number of times Behaviours were tried when they were
+	// triggered by the Cmd exiting, which is more than the number of
+	// Behaviours that triggered if some of them failed and were retried
+	// (without the Cmd being run again). This is separate to Attempts.
+	BehaviourTries int `codec:",omitempty"`
 	// true if the Cmd was run and exited.
 	Exited bool
 	// if the job ran and exited, its exit code is recorded here, but check
@@ -230,9 +477,17 @@ type Job struct {
 	Exitcode int
 	// true if the job was running but we've lost contact with it
 	Lost bool
+	// if the job was Lost, what we could find out from its host at the time.
+	LostReport *LostReport `codec:",omitempty"`
+	// if the job is Lost, one of the LostReason* strings, saying whether its
+	// host could still be reached.
+	LostReason string `codec:",omitempty"`
 	// if the job failed to complete successfully, this will hold one of the
 	// FailReason* strings. Also set if Lost == true.
 	FailReason string
+	// if the job is pending (dependent, delayed or ready), the reasons it
+	// hasn't started running yet.
+	PendingReasons []string `codec:",omitempty"`
 	// pid of the running or ran process.
 	Pid int
 	// host the process is running or did run on.
@@ -245,6 +500,8 @@ type Job struct {
 	StartTime time.Time
 	// time the cmd stopped running.
 	EndTime time.Time
+	// time the job was removed, if it is in the trash.
+	Trashed time.Time
 	// CPU time used.
 	CPUtime time.Duration
 	// to read, call job.StdErr() instead; if the job ran, its (truncated)
@@ -262,6 +519,14 @@ type Job struct {
 	// if set (using output of CompressEnv()), they will be returned in the
 	// results of job.Env().
 	EnvOverride []byte
+	// if set (using Client.KickWithOverrides()), changes how the job is run
+	// on the attempts after it was last retried. Env are also returned in the
+	// results of job.Env().
+	RetryOverrides *RetryOverrides `codec:",omitempty"`
+	// only populated when the job was Reserve()d, for the runner to give the
+	// Cmd: the compressed environment variables of EnvSecrets, set to the
+	// values of their secrets. Execute() clears it.
+	SecretEnvC []byte `codec:",omitempty"`
 	// job's state in the queue: 'delayed', 'ready', 'reserved', 'running',
 	// 'buried', 'complete' or 'dependent'.
 	State JobState
@@ -269,6 +534,11 @@ type Job struct {
 	Attempts uint32
 	// remaining number of Release()s allowed before being buried instead.
 	UntilBuried uint8
+	// when the job has a RetryPolicy, the number of times it has failed with
+	// each FailReason since it was added or last kicked.
+	FailureCounts map[string]int `codec:",omitempty"`
+	// the number of times each TriageRule has retried the job.
+	TriageRetries map[string]int `codec:",omitempty"`
 	// we note which client reserved this job, for validating if that client has
 	// permission to do other stuff to this Job; the server only ever sets this
 	// on Reserve(), so clients can't cheat by changing this on their end.
@@ -301,13 +571,40 @@ type Job struct {
 	// later; this is purely client side.
 	mountedFS []*muxfys.MuxFys
 
+	// behaviourArtifacts are the Artifacts recorded by RecordOutputs
+	// Behaviours during Execute(); this is purely client side.
+	behaviourArtifacts []*Artifact
+
 	// killCalled is set for running jobs if Kill() is called on them.
 	killCalled bool
 
+	// preempt is set to a PreemptionPolicy Mode for running jobs that have
+	// been preempted by the job with key preemptedBy.
+	preempt     string
+	preemptedBy string
+
 	// incrementedLimitGroups notes that we have incremented limit groups for
 	// this job, so they should be decremented when the job finishes running.
 	incrementedLimitGroups []string
 
+	// retryRAM is the minimum RAM (in MB) the job must be retried with, set
+	// when a FailRule with a RAMMultiplier matched its failure; this is purely
+	// server side.
+	retryRAM int
+
+	// tailOut and tailErr hold the most recent STDOUT and STDERR of a running
+	// job, as shipped by the runner, and tailWatched is when someone last
+	// asked for them; this is purely server side. Client side, tailShip
+	// holds the output that the runner is yet to ship.
+	tailOut     *tailBuffer
+	tailErr     *tailBuffer
+	tailWatched time.Time
+	tailShip    *tailShipper
+
+	// cmdKey is the key the server stored Cmd under, if it was long enough to
+	// be worth sharing between jobs; this is purely server side.
+	cmdKey string
+
 	sync.RWMutex
 }
 
@@ -343,6 +640,9 @@ func (j *Job) Env() ([]string, error) {
 			if len(overrideEs) > 0 {
 				env = envOverride(env, overrideEs)
 			}
+			if j.RetryOverrides != nil && len(j.RetryOverrides.Env) > 0 {
+				env = envOverride(env, j.RetryOverrides.Env)
+			}
 			return env, err
 		}
 		return nil, nil
@@ -368,6 +668,9 @@ func (j *Job) Env() ([]string, error) {
 	if len(overrideEs) > 0 {
 		env = envOverride(env, overrideEs)
 	}
+	if j.RetryOverrides != nil && len(j.RetryOverrides.Env) > 0 {
+		env = envOverride(env, j.RetryOverrides.Env)
+	}
 
 	return env, err
 }
@@ -428,7 +731,7 @@ func (j *Job) Getenv(key string) string {
 // job.Cmd's STDOUT when it ran. If the Cmd hasn't run yet, or if it output
 // nothing to STDOUT, you will get an empty string. Note that StdOutC is only
 // populated if you got the Job from GetByCmd(_, true), and if the Job's Cmd ran
-// but failed.
+// but failed (or completed, if its RepGroup's Policy has KeepOutput).
 func (j *Job) StdOut() (string, error) {
 	if len(j.StdOutC) == 0 {
 		return "", nil
@@ -444,7 +747,7 @@ func (j *Job) StdOut() (string, error) {
 // job.Cmd's STDERR when it ran. If the Cmd hasn't run yet, or if it output
 // nothing to STDERR, you will get an empty string. Note that StdErrC is only
 // populated if you got the Job from GetByCmd(_, true), and if the Job's Cmd ran
-// but failed.
+// but failed (or completed, if its RepGroup's Policy has KeepOutput).
 func (j *Job) StdErr() (string, error) {
 	if len(j.StdErrC) == 0 {
 		return "", nil
@@ -463,6 +766,16 @@ func (j *Job) TriggerBehaviours(success bool) error {
 	return j.Behaviours.Trigger(success, j)
 }
 
+// takeBehaviourArtifacts returns the Artifacts recorded by our RecordOutputs
+// Behaviours, forgetting them.
+func (j *Job) takeBehaviourArtifacts() []*Artifact {
+	j.Lock()
+	defer j.Unlock()
+	artifacts := j.behaviourArtifacts
+	j.behaviourArtifacts = nil
+	return artifacts
+}
+
 // Mount uses the Job's MountConfigs to mount the remote file systems at the
 // desired mount points. If a mount point is unspecified, mounts in the sub
 // folder Cwd/mnt if CwdMatters (and unspecified CacheBase becomes Cwd),
@@ -496,15 +809,7 @@ func (j *Job) Mount(onCwd ...bool) ([]string, []string, error) {
 	for _, mc := range j.MountConfigs {
 		var rcs []*muxfys.RemoteConfig
 		for _, mt := range mc.Targets {
-			accessorConfig, err := muxfys.S3ConfigFromEnvironment(mt.Profile, mt.Path)
-			if err != nil {
-				_, erru := j.Unmount()
-				if erru != nil {
-					err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
-				}
-				return uniqueCacheDirs, uniqueMountedDirs, err
-			}
-			accessor, err := muxfys.NewS3Accessor(accessorConfig)
+			accessor, err := mt.Accessor()
 			if err != nil {
 				_, erru := j.Unmount()
 				if erru != nil {
@@ -712,6 +1017,13 @@ func (j *Job) updateAfterExit(jes *JobEndState, lim *limiter.Limiter) {
 	j.Exitcode = jes.Exitcode
 	j.PeakRAM = jes.PeakRAM
 	j.PeakDisk = jes.PeakDisk
+	j.InputStats = jes.InputStats
+	j.Artifacts = jes.Artifacts
+	j.PriorArtifacts = nil
+	if len(j.Steps) > 0 {
+		j.StepResults = jes.StepResults
+	}
+	j.BehaviourTries = jes.BehaviourTries
 	j.CPUtime = jes.CPUtime
 	j.EndTime = jes.EndTime
 	if jes.Cwd != "" {
@@ -734,10 +1046,21 @@ func (j *Job) decrementLimitGroups(lim *limiter.Limiter) {
 
 // Key calculates a unique key to describe the job.
 func (j *Job) Key() string {
+	var key string
 	if j.CwdMatters {
-		return byteKey([]byte(fmt.Sprintf("%s.%s.%s", j.Cwd, j.Cmd, j.MountConfigs.Key())))
+		key = byteKey([]byte(fmt.Sprintf("%s.%s.%s", j.Cwd, j.Cmd, j.MountConfigs.Key())))
+	} else {
+		key = byteKey([]byte(fmt.Sprintf("%s.%s", j.Cmd, j.MountConfigs.Key())))
 	}
-	return byteKey([]byte(fmt.Sprintf("%s.%s", j.Cmd, j.MountConfigs.Key())))
+	return namespacedKey(j.Namespace, key)
+}
+
+// getNamespace provides a thread-safe way of getting the Namespace property of
+// a Job.
+func (j *Job) getNamespace() string {
+	j.RLock()
+	defer j.RUnlock()
+	return j.Namespace
 }
 
 // getScheduledRunner provides a thread-safe way of getting the scheduledRunner
@@ -792,6 +1115,14 @@ func (j *Job) getSchedulerGroup() string {
 	return j.schedulerGroup
 }
 
+// getRetryRAM provides a thread-safe way of getting the retryRAM property of a
+// Job.
+func (j *Job) getRetryRAM() int {
+	j.RLock()
+	defer j.RUnlock()
+	return j.retryRAM
+}
+
 // setSchedulerGroup provides a thread-safe way of setting the schedulerGroup
 // property of a Job.
 func (j *Job) setSchedulerGroup(newval string) {
@@ -800,6 +1131,14 @@ func (j *Job) setSchedulerGroup(newval string) {
 	j.schedulerGroup = newval
 }
 
+// getAttempts provides a thread-safe way of getting the Attempts property of a
+// Job.
+func (j *Job) getAttempts() uint32 {
+	j.RLock()
+	defer j.RUnlock()
+	return j.Attempts
+}
+
 // ToStatus converts a job to a simplified JStatus, useful for output as JSON.
 func (j *Job) ToStatus() (JStatus, error) {
 	stderr, err := j.StdErr()
@@ -832,8 +1171,18 @@ func (j *Job) ToStatus() (JStatus, error) {
 	for key, val := range j.Requirements.Other {
 		ot = append(ot, key+":"+val)
 	}
+	var metadata json.RawMessage
+	if len(j.Metadata) > 0 {
+		// (an empty but non-nil RawMessage can't be encoded to JSON)
+		metadata = j.Metadata
+	}
 	return JStatus{
 		Key:           j.Key(),
+		Name:          j.Name,
+		ArrayIndex:    j.ArrayIndex,
+		User:          j.User,
+		Metadata:      metadata,
+		Tags:          j.Tags,
 		RepGroup:      j.RepGroup,
 		LimitGroups:   j.LimitGroups,
 		DepGroups:     j.DepGroups,
@@ -844,8 +1193,12 @@ func (j *Job) ToStatus() (JStatus, error) {
 		Cwd:           cwdLeaf,
 		HomeChanged:   j.ChangeHome,
 		Behaviours:    j.Behaviours.String(),
+		RetriedWith:   j.RetryOverrides.String(),
 		Mounts:        j.MountConfigs.String(),
 		MonitorDocker: j.MonitorDocker,
+		Container:     j.containerDescription(),
+		Network:       j.Network,
+		NetworkCap:    j.NetworkCap,
 		ExpectedRAM:   j.Requirements.RAM,
 		ExpectedTime:  j.Requirements.Time.Seconds(),
 		RequestedDisk: j.Requirements.Disk,
@@ -853,6 +1206,7 @@ func (j *Job) ToStatus() (JStatus, error) {
 		Cores:         j.Requirements.Cores,
 		PeakRAM:       j.PeakRAM,
 		PeakDisk:      j.PeakDisk,
+		InputStats:    j.InputStats,
 		Exited:        j.Exited,
 		Exitcode:      j.Exitcode,
 		FailReason:    j.FailReason,
@@ -869,6 +1223,14 @@ func (j *Job) ToStatus() (JStatus, error) {
 		StdErr:        stderr,
 		StdOut:        stdout,
 		Env:           env,
+		Outputs:       j.Outputs,
+		Expected:      j.ExpectedOutputs,
+		Artifacts:     j.Artifacts,
+		Steps:         j.Steps,
+		StepResults:   j.StepResults,
+		LostReport:    j.LostReport,
+		LostReason:    j.LostReason,
+		Pending:       j.PendingReasons,
 	}, nil
 }
 
@@ -889,6 +1251,10 @@ type JobEssence struct {
 
 	// Mounts should only be set if the Job was created with Mounts
 	MountConfigs MountConfigs
+
+	// Namespace should only be set if the Job was added in a namespace. Clients
+	// that have had SetNamespace() called fill this in for you.
+	Namespace string `codec:",omitempty"`
 }
 
 // Key returns the same value that key() on the matching Job would give you.
@@ -897,10 +1263,13 @@ func (j *JobEssence) Key() string {
 		return j.JobKey
 	}
 
+	var key string
 	if j.Cwd != "" {
-		return byteKey([]byte(fmt.Sprintf("%s.%s.%s", j.Cwd, j.Cmd, j.MountConfigs.Key())))
+		key = byteKey([]byte(fmt.Sprintf("%s.%s.%s", j.Cwd, j.Cmd, j.MountConfigs.Key())))
+	} else {
+		key = byteKey([]byte(fmt.Sprintf("%s.%s", j.Cmd, j.MountConfigs.Key())))
 	}
-	return byteKey([]byte(fmt.Sprintf("%s.%s", j.Cmd, j.MountConfigs.Key())))
+	return namespacedKey(j.Namespace, key)
 }
 
 // Stringify returns a nice printable form of a JobEssence.
@@ -933,6 +1302,8 @@ type JobModifier struct {
 	ReqGroup         string
 	BsubMode         string
 	MonitorDocker    string
+	ContainerImage   string
+	ContainerRuntime string
 	Requirements     *scheduler.Requirements
 	CwdMatters       bool
 	CwdMattersSet    bool
@@ -953,6 +1324,9 @@ type JobModifier struct {
 	MountConfigsSet  bool
 	BsubModeSet      bool
 	MonitorDockerSet bool
+	ContainerSet     bool
+	RetryPolicy      *RetryPolicy
+	RetryPolicySet   bool
 }
 
 // NewJobModifer is a convenience for making a new JobModifer, that you can call
@@ -1078,6 +1452,22 @@ func (j *JobModifier) SetMonitorDocker(new string) {
 	j.MonitorDockerSet = true
 }
 
+// SetContainer notes that you want to modify the ContainerImage and
+// ContainerRuntime of Jobs. Supply a blank image to stop Jobs running in a
+// container.
+func (j *JobModifier) SetContainer(image, runtime string) {
+	j.ContainerImage = image
+	j.ContainerRuntime = runtime
+	j.ContainerSet = true
+}
+
+// SetRetryPolicy notes that you want to modify the RetryPolicy of Jobs. Supply
+// nil to remove their RetryPolicy.
+func (j *JobModifier) SetRetryPolicy(policy *RetryPolicy) {
+	j.RetryPolicy = policy
+	j.RetryPolicySet = true
+}
+
 // Modify takes existing jobs and modifies them all by setting the new values
 // that you have previously set using the Set*() methods. Other values are left
 // alone. Note that this could result in a Job's Key() changing.
@@ -1132,6 +1522,9 @@ func (j *JobModifier) Modify(jobs []*Job, server *Server) (map[string]string, er
 
 		if j.Cmd != "" {
 			job.Cmd = j.Cmd
+			job.cmdKey = "" // (so it gets stored with the job instead)
+			job.Steps = nil
+			job.StepResults = nil
 		}
 		if j.Cwd != "" {
 			job.Cwd = j.Cwd
@@ -1212,6 +1605,13 @@ func (j *JobModifier) Modify(jobs []*Job, server *Server) (map[string]string, er
 		if j.MonitorDockerSet {
 			job.MonitorDocker = j.MonitorDocker
 		}
+		if j.ContainerSet {
+			job.ContainerImage = j.ContainerImage
+			job.ContainerRuntime = j.ContainerRuntime
+		}
+		if j.RetryPolicySet {
+			job.RetryPolicy = j.RetryPolicy
+		}
 		keys[job.Key()] = before
 		job.Unlock()
 	}
@@ -0,0 +1,85 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for keeping a history of what happened to each
+// job, so that you can work out why a job that moved between states many
+// times ended up the way it did.
+
+import (
+	"context"
+	"time"
+)
+
+// JobEvent* constants are the Events of JobEvents.
+const (
+	JobEventAdded     = "added"     // the job was added to the queue
+	JobEventReserved  = "reserved"  // a runner on Host reserved the job
+	JobEventStarted   = "started"   // the job's Cmd started running on Host
+	JobEventLost      = "lost"      // we stopped hearing from the job's runner
+	JobEventDead      = "dead"      // the lost job was confirmed dead for Reason
+	JobEventReleased  = "released"  // the job failed for Reason and will be retried
+	JobEventBuried    = "buried"    // the job failed for Reason and won't be retried
+	JobEventKicked    = "kicked"    // the buried job was retried, by User if known
+	JobEventCompleted = "completed" // the job's Cmd ran successfully
+	JobEventTrashed   = "trashed"   // the job was removed, but can be restored
+)
+
+// JobEvent records something that happened to a job. Get a job's events with
+// Job.Events() or Client.GetJobEvents().
+type JobEvent struct {
+	Time   time.Time
+	Event  string
+	Host   string `codec:",omitempty"`
+	Reason string `codec:",omitempty"`
+	User   string `codec:",omitempty"`
+}
+
+// recordJobEvent stores the given event in the history of the jobs with the
+// given keys, setting the event's Time to now if unset.
+func (s *Server) recordJobEvent(event *JobEvent, keys ...string) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	s.db.storeJobEvent(keys, event)
+}
+
+// GetJobEvents gets the history of the job with the given key (or name),
+// oldest event first. Events are kept for as long as the job is, including
+// after it completes, but are forgotten if the job is removed.
+func (c *Client) GetJobEvents(key string) ([]*JobEvent, error) {
+	return c.GetJobEventsContext(context.Background(), key)
+}
+
+// GetJobEventsContext is like GetJobEvents(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetJobEventsContext(ctx context.Context, key string) ([]*JobEvent, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getjobevents", Keys: []string{key}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.JobEvents, err
+}
+
+// Events gets the history of this job from the server the given client is
+// connected to, oldest event first. See Client.GetJobEvents().
+func (j *Job) Events(c *Client) ([]*JobEvent, error) {
+	return c.GetJobEvents(j.Key())
+}
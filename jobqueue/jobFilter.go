@@ -0,0 +1,185 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for narrowing down and paging through the jobs
+// that get* requests return.
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JobFilter narrows down the jobs you get from GetByRepGroupFiltered() and
+// GetIncompleteFiltered(), and lets you page through them. Jobs must pass all
+// the criteria that are set.
+type JobFilter struct {
+	// Offset skips this many jobs before those returned. When the jobs are
+	// limited to a certain number per State+Exitcode+FailReason group, the
+	// offset applies within each group, so you can page through a group by
+	// increasing Offset by the limit each time. Jobs are ordered by their
+	// Key(), so pages are stable.
+	Offset int
+
+	// Host, if set, only keeps jobs that ran (or are running) on that host.
+	Host string
+
+	// MinExitcode and MaxExitcode, if set, only keep jobs that exited with a
+	// code in that (inclusive) range.
+	MinExitcode *int
+	MaxExitcode *int
+
+	// Cmd, if set, only keeps jobs with a command line containing it.
+	Cmd string
+
+	// After and Before, if set, only keep jobs that ended (or, if they haven't
+	// ended, started) in that window.
+	After  time.Time
+	Before time.Time
+
+	// Tags, if set, only keeps jobs that have all of these tags with these
+	// values (see Job.Tags).
+	Tags map[string]string
+
+	// User, if set, only keeps jobs that were added by this user (see
+	// Job.User).
+	User string
+}
+
+// IsEmpty tells you if none of our criteria (or Offset) are set.
+func (f *JobFilter) IsEmpty() bool {
+	return f.Offset == 0 && f.Host == "" && f.MinExitcode == nil && f.MaxExitcode == nil &&
+		f.Cmd == "" && f.After.IsZero() && f.Before.IsZero() && len(f.Tags) == 0 && f.User == ""
+}
+
+// matches tells you if the given job passes all our criteria.
+func (f *JobFilter) matches(job *Job) bool {
+	job.RLock()
+	defer job.RUnlock()
+
+	if f.Host != "" && job.Host != f.Host {
+		return false
+	}
+
+	if f.User != "" && job.User != f.User {
+		return false
+	}
+
+	if f.MinExitcode != nil || f.MaxExitcode != nil {
+		if !job.Exited {
+			return false
+		}
+		if f.MinExitcode != nil && job.Exitcode < *f.MinExitcode {
+			return false
+		}
+		if f.MaxExitcode != nil && job.Exitcode > *f.MaxExitcode {
+			return false
+		}
+	}
+
+	if f.Cmd != "" && !strings.Contains(job.Cmd, f.Cmd) {
+		return false
+	}
+
+	if !tagsMatch(job.Tags, f.Tags) {
+		return false
+	}
+
+	if !f.After.IsZero() || !f.Before.IsZero() {
+		t := job.EndTime
+		if t.IsZero() {
+			t = job.StartTime
+		}
+		if t.IsZero() || (!f.After.IsZero() && t.Before(f.After)) || (!f.Before.IsZero() && !t.Before(f.Before)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// page returns the jobs (which must be sorted) at our Offset, up to limit of
+// them if limit is greater than 0.
+func (f *JobFilter) page(jobs []*Job, limit int) []*Job {
+	if f != nil && f.Offset > 0 {
+		if f.Offset >= len(jobs) {
+			return nil
+		}
+		jobs = jobs[f.Offset:]
+	}
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs
+}
+
+// sortJobsByKey sorts the given jobs by their Key(), so that pages of them are
+// stable.
+func sortJobsByKey(jobs []*Job) {
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Key() < jobs[j].Key()
+	})
+}
+
+// GetByRepGroupFiltered is like GetByRepGroup(), but only returns the jobs
+// that pass the given filter, starting from its Offset. Use it to page through
+// jobs, such as the thousands that might have failed the same way:
+//
+//	filter := &JobFilter{}
+//	for {
+//	    jobs, err := client.GetByRepGroupFiltered(rg, false, 100, JobStateBuried, filter, false, false)
+//	    // ... deal with the jobs, stopping if there are fewer than 100
+//	    filter.Offset += 100
+//	}
+//
+// (Similar on the last job of each group is the number of jobs in that group
+// that were not returned, including those before the Offset.)
+func (c *Client) GetByRepGroupFiltered(repgroup string, subStr bool, limit int, state JobState, filter *JobFilter, getStd bool, getEnv bool) ([]*Job, error) {
+	return c.GetByRepGroupFilteredContext(context.Background(), repgroup, subStr, limit, state, filter, getStd, getEnv)
+}
+
+// GetByRepGroupFilteredContext is like GetByRepGroupFiltered(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) GetByRepGroupFilteredContext(ctx context.Context, repgroup string, subStr bool, limit int, state JobState, filter *JobFilter, getStd bool, getEnv bool) ([]*Job, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getbr", Job: &Job{RepGroup: repgroup}, Search: subStr, Limit: limit, State: state, Filter: filter, GetStd: getStd, GetEnv: getEnv})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, err
+}
+
+// GetIncompleteFiltered is like GetIncomplete(), but only returns the jobs
+// that pass the given filter, as per GetByRepGroupFiltered().
+func (c *Client) GetIncompleteFiltered(limit int, state JobState, filter *JobFilter, getStd bool, getEnv bool) ([]*Job, error) {
+	return c.GetIncompleteFilteredContext(context.Background(), limit, state, filter, getStd, getEnv)
+}
+
+// GetIncompleteFilteredContext is like GetIncompleteFiltered(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) GetIncompleteFilteredContext(ctx context.Context, limit int, state JobState, filter *JobFilter, getStd bool, getEnv bool) ([]*Job, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getin", Limit: limit, State: state, Filter: filter, GetStd: getStd, GetEnv: getEnv})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, err
+}
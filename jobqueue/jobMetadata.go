@@ -0,0 +1,125 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for dealing with the arbitrary metadata users can
+// attach to jobs.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// restMetadataPrefix is the prefix of REST query parameters that filter jobs
+// by their Metadata, eg. ?meta.sample=42
+const restMetadataPrefix = "meta."
+
+// validateJobMetadata checks that the given Job.Metadata is a JSON object no
+// larger than ServerMaxJobMetadataSize.
+func validateJobMetadata(metadata json.RawMessage) error {
+	if len(metadata) > ServerMaxJobMetadataSize {
+		return fmt.Errorf("job metadata is %d bytes, more than the maximum of %d", len(metadata), ServerMaxJobMetadataSize)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(metadata, &obj); err != nil || obj == nil {
+		return fmt.Errorf("job metadata must be a JSON object")
+	}
+	return nil
+}
+
+// MetadataValue returns the value of the given field of this job's Metadata as
+// a string: JSON strings are returned unquoted, and anything else as it would
+// be written in JSON (eg. 42, true, null or [1,2]). The field can be a dot
+// separated path to look inside nested objects, eg. "sample.id". The bool is
+// false if the field doesn't exist.
+func (j *Job) MetadataValue(field string) (string, bool) {
+	j.RLock()
+	metadata := j.Metadata
+	j.RUnlock()
+	return metadataValue(metadata, field)
+}
+
+// metadataValue is the implementation of Job.MetadataValue().
+func metadataValue(metadata json.RawMessage, field string) (string, bool) {
+	if len(metadata) == 0 {
+		return "", false
+	}
+	raw := metadata
+	for _, part := range strings.Split(field, ".") {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return "", false
+		}
+		var exists bool
+		raw, exists = obj[part]
+		if !exists {
+			return "", false
+		}
+	}
+
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return str, true
+	}
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, raw); err != nil {
+		return "", false
+	}
+	return compacted.String(), true
+}
+
+// MetadataMatches tells you if this job's Metadata has all the given values.
+// The keys of filters are fields and the values are what those fields must
+// have, as per MetadataValue().
+func (j *Job) MetadataMatches(filters map[string]string) bool {
+	for field, want := range filters {
+		if val, exists := j.MetadataValue(field); !exists || val != want {
+			return false
+		}
+	}
+	return true
+}
+
+// jobsMatchingMetadata returns the subset of the given jobs that
+// MetadataMatches() the given filters.
+func jobsMatchingMetadata(jobs []*Job, filters map[string]string) []*Job {
+	var matching []*Job
+	for _, job := range jobs {
+		if job.MetadataMatches(filters) {
+			matching = append(matching, job)
+		}
+	}
+	return matching
+}
+
+// restMetadataFilters extracts the Metadata filters from REST query parameters
+// like meta.sample=42, returning them in the form MetadataMatches() takes.
+func restMetadataFilters(form url.Values) map[string]string {
+	filters := make(map[string]string)
+	for param, vals := range form {
+		if !strings.HasPrefix(param, restMetadataPrefix) || len(vals) == 0 {
+			continue
+		}
+		filters[strings.TrimPrefix(param, restMetadataPrefix)] = vals[0]
+	}
+	return filters
+}
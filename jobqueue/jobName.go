@@ -0,0 +1,137 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets jobs be given human-readable names
+// that can be used in place of their keys.
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// validJobName matches the Job.Names we allow: they can't contain commas
+// (which separate lists of keys), slashes (which separate namespaces) or
+// whitespace.
+var validJobName = regexp.MustCompile(`^[\w.:@+-]+$`)
+
+// looksLikeKey matches strings that could be Job keys.
+var looksLikeKey = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// NewNameDependency makes it a little easier to make a new *Dependency on the
+// job with the given Name, for use in NewDependencies().
+func NewNameDependency(name string) *Dependency {
+	return &Dependency{
+		Essence: &JobEssence{JobKey: name},
+	}
+}
+
+// validateJobName checks that the given Job.Name (without any namespace
+// qualification) is one we allow.
+func validateJobName(name string) error {
+	if !validJobName.MatchString(name) {
+		return fmt.Errorf("job name [%s] may only contain letters, numbers, underscores, dots, colons, at signs, pluses and dashes", name)
+	}
+	if looksLikeKey.MatchString(name) {
+		return fmt.Errorf("job name [%s] looks like a job key", name)
+	}
+	return nil
+}
+
+// claimJobNames records the Names of the given jobs as referring to their keys.
+// It fails, claiming nothing, if any name was already claimed by a different
+// job (by an earlier call, or an earlier job in the slice). Returns the names
+// that were newly claimed, for use with releaseJobNames().
+func (db *db) claimJobNames(jobs []*Job) (claimed []string, err error) {
+	err = db.backend.Update(func(tx dbTx) error {
+		claimed = nil
+		b := tx.Bucket(bucketJobNames)
+		for _, job := range jobs {
+			job.RLock()
+			name := job.Name
+			job.RUnlock()
+			if name == "" {
+				continue
+			}
+
+			key := job.Key()
+			existing := b.Get([]byte(name))
+			if existing != nil {
+				if string(existing) != key {
+					return Error{"Add", name, ErrJobNameTaken}
+				}
+				continue
+			}
+
+			errp := b.Put([]byte(name), []byte(key))
+			if errp != nil {
+				return errp
+			}
+			claimed = append(claimed, name)
+		}
+		return nil
+	})
+	if err != nil {
+		claimed = nil
+	}
+	return claimed, err
+}
+
+// releaseJobNames undoes claimJobNames() for the given names, for when the
+// claiming jobs failed to be added after all.
+func (db *db) releaseJobNames(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	return db.backend.Update(func(tx dbTx) error {
+		b := tx.Bucket(bucketJobNames)
+		for _, name := range names {
+			errd := b.Delete([]byte(name))
+			if errd != nil {
+				return errd
+			}
+		}
+		return nil
+	})
+}
+
+// jobKeyForName returns the key of the job that was added with the given
+// (namespace qualified) Name, or blank if there wasn't one.
+func (db *db) jobKeyForName(name string) string {
+	if name == "" || looksLikeKey.MatchString(name) {
+		return ""
+	}
+	return string(db.retrieve(bucketJobNames, name))
+}
+
+// resolveJobNames returns the given keys, with any that are actually the Names
+// of jobs (in the given namespace) replaced with those jobs' keys.
+func (s *Server) resolveJobNames(keys []string, namespace string) []string {
+	if keys == nil {
+		return nil
+	}
+	resolved := make([]string, len(keys))
+	for i, key := range keys {
+		resolved[i] = key
+		if jobKey := s.db.jobKeyForName(namespaced(namespace, key)); jobKey != "" {
+			resolved[i] = jobKey
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,228 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for dealing with the key=value tags users can
+// attach to jobs, so that jobs can be grouped by something other than their
+// RepGroup.
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// tagGroupPrefix is the prefix of the pseudo-RepGroups we tell the status
+// webpage about, which hold the jobs that have a particular tag, eg.
+// "+tag+sample=42".
+const tagGroupPrefix = "+tag+"
+
+// validTagKey matches the Job.Tags keys we allow: like Job.Names, they can't
+// contain commas (which separate tags) or equals signs (which separate keys
+// from values).
+var validTagKey = regexp.MustCompile(`^[\w.:@+-]+$`)
+
+// TagFacets are the number of jobs (current and complete) that have each value
+// of each tag key.
+type TagFacets map[string]map[string]int
+
+// ParseTags parses tags specified like "sample=X,stage=align" in to the form
+// Job.Tags takes.
+func ParseTags(spec string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(spec, ",") {
+		if tag == "" {
+			continue
+		}
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("tag [%s] is not in key=value form", tag)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	if err := validateJobTags(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// validateJobTags checks that the given Job.Tags have keys we allow and
+// non-blank values without commas, and that there are no more than
+// ServerMaxJobTags of them.
+func validateJobTags(tags map[string]string) error {
+	if len(tags) > ServerMaxJobTags {
+		return fmt.Errorf("job has %d tags, more than the maximum of %d", len(tags), ServerMaxJobTags)
+	}
+	for key, val := range tags {
+		if !validTagKey.MatchString(key) {
+			return fmt.Errorf("tag key [%s] may only contain letters, numbers, underscores, dots, colons, at signs, pluses and dashes", key)
+		}
+		if val == "" || strings.ContainsAny(val, ",\n") {
+			return fmt.Errorf("tag [%s] must have a value that doesn't contain commas", key)
+		}
+	}
+	return nil
+}
+
+// TagsMatch tells you if this job has all the given tags with the given
+// values.
+func (j *Job) TagsMatch(tags map[string]string) bool {
+	j.RLock()
+	defer j.RUnlock()
+	return tagsMatch(j.Tags, tags)
+}
+
+// tagsMatch is the implementation of Job.TagsMatch().
+func tagsMatch(have, want map[string]string) bool {
+	for key, val := range want {
+		if have[key] != val {
+			return false
+		}
+	}
+	return true
+}
+
+// tagGroup returns the name of the pseudo-RepGroup for jobs with the given tag.
+func tagGroup(key, val string) string {
+	return tagGroupPrefix + key + "=" + val
+}
+
+// parseTagGroup returns the tag of the given pseudo-RepGroup. The bool is false
+// if the group isn't a tagGroup().
+func parseTagGroup(group string) (string, string, bool) {
+	if !strings.HasPrefix(group, tagGroupPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(group, tagGroupPrefix), "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// tagGroups returns the tagGroup()s of the given Job.Tags, sorted.
+func tagGroups(tags map[string]string) []string {
+	groups := make([]string, 0, len(tags))
+	for key, val := range tags {
+		groups = append(groups, tagGroup(key, val))
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// tagGroups returns the tagGroup()s of this job's Tags, sorted.
+func (j *Job) tagGroups() []string {
+	j.RLock()
+	defer j.RUnlock()
+	return tagGroups(j.Tags)
+}
+
+// tagLookup is how a tag is stored in our db's tag index.
+func tagLookup(key, val string) string {
+	return key + "=" + val
+}
+
+// GetByTags gets multiple Jobs (current and complete) that have all of the
+// given tags. The other arguments are as per GetByRepGroupFiltered(), with
+// filter being optional.
+func (c *Client) GetByTags(tags map[string]string, limit int, state JobState, filter *JobFilter, getStd bool, getEnv bool) ([]*Job, error) {
+	return c.GetByTagsContext(context.Background(), tags, limit, state, filter, getStd, getEnv)
+}
+
+// GetByTagsContext is like GetByTags(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetByTagsContext(ctx context.Context, tags map[string]string, limit int, state JobState, filter *JobFilter, getStd bool, getEnv bool) ([]*Job, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getbt", Job: &Job{Tags: tags}, Limit: limit, State: state, Filter: filter, GetStd: getStd, GetEnv: getEnv})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, err
+}
+
+// getJobsByTags gets the jobs (current and, if state is blank or complete,
+// complete) that have all the given tags, limiting them as per limitJobs().
+func (s *Server) getJobsByTags(tags map[string]string, limit int, state JobState, filter *JobFilter, getStd bool, getEnv bool) (jobs []*Job, srerr string, qerr string) {
+	if len(tags) == 0 {
+		return nil, ErrBadRequest, "no tags supplied"
+	}
+
+	s.q.Each(func(item *queue.Item) bool {
+		sjob := item.Data().(*Job)
+		sjob.RLock()
+		matched := tagsMatch(sjob.Tags, tags)
+		sjob.RUnlock()
+		if matched {
+			jobs = append(jobs, s.itemToJob(item, false, false))
+		}
+		return true
+	})
+
+	if state == "" || state == JobStateComplete {
+		complete, err := s.db.retrieveCompleteJobsByTags(tags)
+		if err != nil {
+			return nil, ErrDBError, err.Error()
+		}
+		jobs = append(jobs, complete...)
+	}
+
+	if limit > 0 || state != "" || filter != nil || getStd || getEnv {
+		jobs = s.limitJobs(jobs, limit, state, filter, getStd, getEnv)
+	}
+	return jobs, srerr, qerr
+}
+
+// getTagFacets counts the jobs (current and complete) with each value of each
+// tag key.
+func (s *Server) getTagFacets() (TagFacets, error) {
+	facets := make(TagFacets)
+	add := func(key, val string, count int) {
+		vals, exists := facets[key]
+		if !exists {
+			vals = make(map[string]int)
+			facets[key] = vals
+		}
+		vals[val] += count
+	}
+
+	s.q.Each(func(item *queue.Item) bool {
+		sjob := item.Data().(*Job)
+		sjob.RLock()
+		for key, val := range sjob.Tags {
+			add(key, val, 1)
+		}
+		sjob.RUnlock()
+		return true
+	})
+
+	counts, err := s.db.retrieveCompleteTagCounts()
+	if err != nil {
+		return nil, err
+	}
+	for lookup, count := range counts {
+		parts := strings.SplitN(lookup, "=", 2)
+		if len(parts) == 2 {
+			add(parts[0], parts[1], count)
+		}
+	}
+	return facets, nil
+}
@@ -0,0 +1,121 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for checking Jobs are valid without needing a
+// server.
+
+import "fmt"
+
+// Validate checks the parts of this Job that the server would otherwise only
+// check when the Job is added: that it has a Cmd, and that its Name, Metadata,
+// Tags, LimitGroups, RunWindow, Schedule, notification targets, Requirements,
+// MountConfigs, ContainerRuntime, Inputs, EnvSecrets, LostPolicy and
+// RetryPolicy are acceptable. It doesn't need a server, so it lets pipeline
+// generators check their Jobs offline before submitting them; see also the
+// jobqueue/validate package.
+func (j *Job) Validate() error {
+	j.RLock()
+	defer j.RUnlock()
+
+	if j.Cmd == "" {
+		return fmt.Errorf("job has no Cmd")
+	}
+
+	if j.Name != "" {
+		if err := validateJobName(unnamespaced(j.Namespace, j.Name)); err != nil {
+			return err
+		}
+	}
+
+	if len(j.Metadata) > 0 {
+		if err := validateJobMetadata(j.Metadata); err != nil {
+			return err
+		}
+	}
+
+	if len(j.Tags) > 0 {
+		if err := validateJobTags(j.Tags); err != nil {
+			return err
+		}
+	}
+
+	for _, group := range j.LimitGroups {
+		name, _, _, err := splitSuffixedLimitGroup(group)
+		if err != nil {
+			return fmt.Errorf("limit group [%s] has a bad limit: %s", group, err)
+		}
+		if _, _, err = splitLimitGroupUsage(name); err != nil {
+			return fmt.Errorf("limit group [%s] has a bad usage: %s", group, err)
+		}
+	}
+
+	if j.RunWindow != "" {
+		if _, err := parseRunWindow(j.RunWindow); err != nil {
+			return err
+		}
+	}
+
+	if j.Schedule != "" {
+		if _, err := parseCronSchedule(j.Schedule); err != nil {
+			return err
+		}
+	}
+
+	if err := validateNotifyTargets(j.NotifyComplete); err != nil {
+		return err
+	}
+	if err := validateNotifyTargets(j.NotifyFailure); err != nil {
+		return err
+	}
+
+	if req := j.Requirements; req != nil {
+		if req.RAM < 0 || req.Time < 0 || req.Cores < 0 || req.Disk < 0 {
+			return fmt.Errorf("job requirements can't be negative")
+		}
+	}
+
+	if err := j.MountConfigs.Validate(); err != nil {
+		return fmt.Errorf("job mounts are invalid: %s", err)
+	}
+
+	if !validContainerRuntime(j.ContainerRuntime) {
+		return fmt.Errorf("container runtime [%s] is not supported", j.ContainerRuntime)
+	}
+
+	for _, in := range j.Inputs {
+		if err := in.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, envSecret := range j.EnvSecrets {
+		if _, _, err := parseEnvSecret(envSecret); err != nil {
+			return err
+		}
+	}
+
+	if j.LostPolicy != nil {
+		if err := j.LostPolicy.validate(); err != nil {
+			return err
+		}
+	}
+
+	return j.RetryPolicy.validate()
+}
@@ -0,0 +1,33 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package jobqueuepb holds the gRPC service definition of the wr manager, along
+with the Go code generated from it. Clients in other languages can generate
+their own code from jobqueue.proto.
+
+The service is served by a jobqueue.Server when ServerConfig.GRPCPort is set.
+Every call must supply the manager's token as "authorization" metadata in the
+form "Bearer <token>", over TLS using the manager's certificate.
+
+After changing jobqueue.proto, regenerate the Go code with protoc and
+protoc-gen-go v1.3.x.
+*/
+package jobqueuepb
+
+//go:generate protoc --go_out=plugins=grpc:. jobqueue.proto
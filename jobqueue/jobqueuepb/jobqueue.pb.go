@@ -0,0 +1,888 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: jobqueue.proto
+
+package jobqueuepb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// Job describes a command to run. Fields after tags are only filled in for
+// jobs returned by GetJobs.
+type Job struct {
+	Cmd         string   `protobuf:"bytes,1,opt,name=cmd,proto3" json:"cmd,omitempty"`
+	Cwd         string   `protobuf:"bytes,2,opt,name=cwd,proto3" json:"cwd,omitempty"`
+	CwdMatters  bool     `protobuf:"varint,3,opt,name=cwd_matters,json=cwdMatters,proto3" json:"cwd_matters,omitempty"`
+	RepGroup    string   `protobuf:"bytes,4,opt,name=rep_group,json=repGroup,proto3" json:"rep_group,omitempty"`
+	ReqGroup    string   `protobuf:"bytes,5,opt,name=req_group,json=reqGroup,proto3" json:"req_group,omitempty"`
+	LimitGroups []string `protobuf:"bytes,6,rep,name=limit_groups,json=limitGroups,proto3" json:"limit_groups,omitempty"`
+	DepGroups   []string `protobuf:"bytes,7,rep,name=dep_groups,json=depGroups,proto3" json:"dep_groups,omitempty"`
+	Deps        []string `protobuf:"bytes,8,rep,name=deps,proto3" json:"deps,omitempty"`
+	// memory in MB, eg. 1024
+	Memory int32 `protobuf:"varint,9,opt,name=memory,proto3" json:"memory,omitempty"`
+	// time in seconds
+	Time int64   `protobuf:"varint,10,opt,name=time,proto3" json:"time,omitempty"`
+	Cpus float64 `protobuf:"fixed64,11,opt,name=cpus,proto3" json:"cpus,omitempty"`
+	// disk in GB
+	Disk     int32 `protobuf:"varint,12,opt,name=disk,proto3" json:"disk,omitempty"`
+	Override int32 `protobuf:"varint,13,opt,name=override,proto3" json:"override,omitempty"`
+	Priority int32 `protobuf:"varint,14,opt,name=priority,proto3" json:"priority,omitempty"`
+	Retries  int32 `protobuf:"varint,15,opt,name=retries,proto3" json:"retries,omitempty"`
+	// env vars in the form "key=value"
+	Env        []string          `protobuf:"bytes,16,rep,name=env,proto3" json:"env,omitempty"`
+	Tags       map[string]string `protobuf:"bytes,17,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Key        string            `protobuf:"bytes,18,opt,name=key,proto3" json:"key,omitempty"`
+	State      string            `protobuf:"bytes,19,opt,name=state,proto3" json:"state,omitempty"`
+	Exitcode   int32             `protobuf:"varint,20,opt,name=exitcode,proto3" json:"exitcode,omitempty"`
+	FailReason string            `protobuf:"bytes,21,opt,name=fail_reason,json=failReason,proto3" json:"fail_reason,omitempty"`
+	Host       string            `protobuf:"bytes,22,opt,name=host,proto3" json:"host,omitempty"`
+	// unix times in seconds, 0 if not yet started or ended
+	StartTime int64 `protobuf:"varint,23,opt,name=start_time,json=startTime,proto3" json:"start_time,omitempty"`
+	EndTime   int64 `protobuf:"varint,24,opt,name=end_time,json=endTime,proto3" json:"end_time,omitempty"`
+	Attempts  int32 `protobuf:"varint,25,opt,name=attempts,proto3" json:"attempts,omitempty"`
+	// peak memory used in MB
+	PeakRam              int32    `protobuf:"varint,26,opt,name=peak_ram,json=peakRam,proto3" json:"peak_ram,omitempty"`
+	Stdout               string   `protobuf:"bytes,27,opt,name=stdout,proto3" json:"stdout,omitempty"`
+	Stderr               string   `protobuf:"bytes,28,opt,name=stderr,proto3" json:"stderr,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Job) Reset()         { *m = Job{} }
+func (m *Job) String() string { return proto.CompactTextString(m) }
+func (*Job) ProtoMessage()    {}
+func (*Job) Descriptor() ([]byte, []int) {
+	return fileDescriptor_91545a11ba4fffbe, []int{0}
+}
+
+func (m *Job) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Job.Unmarshal(m, b)
+}
+func (m *Job) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Job.Marshal(b, m, deterministic)
+}
+func (m *Job) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Job.Merge(m, src)
+}
+func (m *Job) XXX_Size() int {
+	return xxx_messageInfo_Job.Size(m)
+}
+func (m *Job) XXX_DiscardUnknown() {
+	xxx_messageInfo_Job.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Job proto.InternalMessageInfo
+
+func (m *Job) GetCmd() string {
+	if m != nil {
+		return m.Cmd
+	}
+	return ""
+}
+
+func (m *Job) GetCwd() string {
+	if m != nil {
+		return m.Cwd
+	}
+	return ""
+}
+
+func (m *Job) GetCwdMatters() bool {
+	if m != nil {
+		return m.CwdMatters
+	}
+	return false
+}
+
+func (m *Job) GetRepGroup() string {
+	if m != nil {
+		return m.RepGroup
+	}
+	return ""
+}
+
+func (m *Job) GetReqGroup() string {
+	if m != nil {
+		return m.ReqGroup
+	}
+	return ""
+}
+
+func (m *Job) GetLimitGroups() []string {
+	if m != nil {
+		return m.LimitGroups
+	}
+	return nil
+}
+
+func (m *Job) GetDepGroups() []string {
+	if m != nil {
+		return m.DepGroups
+	}
+	return nil
+}
+
+func (m *Job) GetDeps() []string {
+	if m != nil {
+		return m.Deps
+	}
+	return nil
+}
+
+func (m *Job) GetMemory() int32 {
+	if m != nil {
+		return m.Memory
+	}
+	return 0
+}
+
+func (m *Job) GetTime() int64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
+}
+
+func (m *Job) GetCpus() float64 {
+	if m != nil {
+		return m.Cpus
+	}
+	return 0
+}
+
+func (m *Job) GetDisk() int32 {
+	if m != nil {
+		return m.Disk
+	}
+	return 0
+}
+
+func (m *Job) GetOverride() int32 {
+	if m != nil {
+		return m.Override
+	}
+	return 0
+}
+
+func (m *Job) GetPriority() int32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *Job) GetRetries() int32 {
+	if m != nil {
+		return m.Retries
+	}
+	return 0
+}
+
+func (m *Job) GetEnv() []string {
+	if m != nil {
+		return m.Env
+	}
+	return nil
+}
+
+func (m *Job) GetTags() map[string]string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *Job) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *Job) GetState() string {
+	if m != nil {
+		return m.State
+	}
+	return ""
+}
+
+func (m *Job) GetExitcode() int32 {
+	if m != nil {
+		return m.Exitcode
+	}
+	return 0
+}
+
+func (m *Job) GetFailReason() string {
+	if m != nil {
+		return m.FailReason
+	}
+	return ""
+}
+
+func (m *Job) GetHost() string {
+	if m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+func (m *Job) GetStartTime() int64 {
+	if m != nil {
+		return m.StartTime
+	}
+	return 0
+}
+
+func (m *Job) GetEndTime() int64 {
+	if m != nil {
+		return m.EndTime
+	}
+	return 0
+}
+
+func (m *Job) GetAttempts() int32 {
+	if m != nil {
+		return m.Attempts
+	}
+	return 0
+}
+
+func (m *Job) GetPeakRam() int32 {
+	if m != nil {
+		return m.PeakRam
+	}
+	return 0
+}
+
+func (m *Job) GetStdout() string {
+	if m != nil {
+		return m.Stdout
+	}
+	return ""
+}
+
+func (m *Job) GetStderr() string {
+	if m != nil {
+		return m.Stderr
+	}
+	return ""
+}
+
+type AddJobsRequest struct {
+	Jobs []*Job `protobuf:"bytes,1,rep,name=jobs,proto3" json:"jobs,omitempty"`
+	// if true, jobs that have already completed are not added again
+	IgnoreComplete       bool     `protobuf:"varint,2,opt,name=ignore_complete,json=ignoreComplete,proto3" json:"ignore_complete,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AddJobsRequest) Reset()         { *m = AddJobsRequest{} }
+func (m *AddJobsRequest) String() string { return proto.CompactTextString(m) }
+func (*AddJobsRequest) ProtoMessage()    {}
+func (*AddJobsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_91545a11ba4fffbe, []int{1}
+}
+
+func (m *AddJobsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AddJobsRequest.Unmarshal(m, b)
+}
+func (m *AddJobsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AddJobsRequest.Marshal(b, m, deterministic)
+}
+func (m *AddJobsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AddJobsRequest.Merge(m, src)
+}
+func (m *AddJobsRequest) XXX_Size() int {
+	return xxx_messageInfo_AddJobsRequest.Size(m)
+}
+func (m *AddJobsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_AddJobsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AddJobsRequest proto.InternalMessageInfo
+
+func (m *AddJobsRequest) GetJobs() []*Job {
+	if m != nil {
+		return m.Jobs
+	}
+	return nil
+}
+
+func (m *AddJobsRequest) GetIgnoreComplete() bool {
+	if m != nil {
+		return m.IgnoreComplete
+	}
+	return false
+}
+
+type AddJobsResponse struct {
+	Added   int32 `protobuf:"varint,1,opt,name=added,proto3" json:"added,omitempty"`
+	Existed int32 `protobuf:"varint,2,opt,name=existed,proto3" json:"existed,omitempty"`
+	// the keys of the jobs, in the same order as the request
+	Keys                 []string `protobuf:"bytes,3,rep,name=keys,proto3" json:"keys,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AddJobsResponse) Reset()         { *m = AddJobsResponse{} }
+func (m *AddJobsResponse) String() string { return proto.CompactTextString(m) }
+func (*AddJobsResponse) ProtoMessage()    {}
+func (*AddJobsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_91545a11ba4fffbe, []int{2}
+}
+
+func (m *AddJobsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AddJobsResponse.Unmarshal(m, b)
+}
+func (m *AddJobsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AddJobsResponse.Marshal(b, m, deterministic)
+}
+func (m *AddJobsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AddJobsResponse.Merge(m, src)
+}
+func (m *AddJobsResponse) XXX_Size() int {
+	return xxx_messageInfo_AddJobsResponse.Size(m)
+}
+func (m *AddJobsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_AddJobsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AddJobsResponse proto.InternalMessageInfo
+
+func (m *AddJobsResponse) GetAdded() int32 {
+	if m != nil {
+		return m.Added
+	}
+	return 0
+}
+
+func (m *AddJobsResponse) GetExisted() int32 {
+	if m != nil {
+		return m.Existed
+	}
+	return 0
+}
+
+func (m *AddJobsResponse) GetKeys() []string {
+	if m != nil {
+		return m.Keys
+	}
+	return nil
+}
+
+type GetJobsRequest struct {
+	Keys     []string `protobuf:"bytes,1,rep,name=keys,proto3" json:"keys,omitempty"`
+	RepGroup string   `protobuf:"bytes,2,opt,name=rep_group,json=repGroup,proto3" json:"rep_group,omitempty"`
+	// treat rep_group as a substring to search for
+	Search bool              `protobuf:"varint,3,opt,name=search,proto3" json:"search,omitempty"`
+	Tags   map[string]string `protobuf:"bytes,4,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// limit the jobs returned to those in this state, eg. "complete"
+	State string `protobuf:"bytes,5,opt,name=state,proto3" json:"state,omitempty"`
+	// limit the number of jobs returned that have the same exit code and fail
+	// reason
+	Limit int32 `protobuf:"varint,6,opt,name=limit,proto3" json:"limit,omitempty"`
+	// get the stdout and stderr of the jobs
+	Std                  bool     `protobuf:"varint,7,opt,name=std,proto3" json:"std,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetJobsRequest) Reset()         { *m = GetJobsRequest{} }
+func (m *GetJobsRequest) String() string { return proto.CompactTextString(m) }
+func (*GetJobsRequest) ProtoMessage()    {}
+func (*GetJobsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_91545a11ba4fffbe, []int{3}
+}
+
+func (m *GetJobsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetJobsRequest.Unmarshal(m, b)
+}
+func (m *GetJobsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetJobsRequest.Marshal(b, m, deterministic)
+}
+func (m *GetJobsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetJobsRequest.Merge(m, src)
+}
+func (m *GetJobsRequest) XXX_Size() int {
+	return xxx_messageInfo_GetJobsRequest.Size(m)
+}
+func (m *GetJobsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetJobsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetJobsRequest proto.InternalMessageInfo
+
+func (m *GetJobsRequest) GetKeys() []string {
+	if m != nil {
+		return m.Keys
+	}
+	return nil
+}
+
+func (m *GetJobsRequest) GetRepGroup() string {
+	if m != nil {
+		return m.RepGroup
+	}
+	return ""
+}
+
+func (m *GetJobsRequest) GetSearch() bool {
+	if m != nil {
+		return m.Search
+	}
+	return false
+}
+
+func (m *GetJobsRequest) GetTags() map[string]string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *GetJobsRequest) GetState() string {
+	if m != nil {
+		return m.State
+	}
+	return ""
+}
+
+func (m *GetJobsRequest) GetLimit() int32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+func (m *GetJobsRequest) GetStd() bool {
+	if m != nil {
+		return m.Std
+	}
+	return false
+}
+
+type GetJobsResponse struct {
+	Jobs                 []*Job   `protobuf:"bytes,1,rep,name=jobs,proto3" json:"jobs,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetJobsResponse) Reset()         { *m = GetJobsResponse{} }
+func (m *GetJobsResponse) String() string { return proto.CompactTextString(m) }
+func (*GetJobsResponse) ProtoMessage()    {}
+func (*GetJobsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_91545a11ba4fffbe, []int{4}
+}
+
+func (m *GetJobsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetJobsResponse.Unmarshal(m, b)
+}
+func (m *GetJobsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetJobsResponse.Marshal(b, m, deterministic)
+}
+func (m *GetJobsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetJobsResponse.Merge(m, src)
+}
+func (m *GetJobsResponse) XXX_Size() int {
+	return xxx_messageInfo_GetJobsResponse.Size(m)
+}
+func (m *GetJobsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetJobsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetJobsResponse proto.InternalMessageInfo
+
+func (m *GetJobsResponse) GetJobs() []*Job {
+	if m != nil {
+		return m.Jobs
+	}
+	return nil
+}
+
+type WatchJobsRequest struct {
+	// only stream changes of jobs in this RepGroup
+	RepGroup             string   `protobuf:"bytes,1,opt,name=rep_group,json=repGroup,proto3" json:"rep_group,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchJobsRequest) Reset()         { *m = WatchJobsRequest{} }
+func (m *WatchJobsRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchJobsRequest) ProtoMessage()    {}
+func (*WatchJobsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_91545a11ba4fffbe, []int{5}
+}
+
+func (m *WatchJobsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchJobsRequest.Unmarshal(m, b)
+}
+func (m *WatchJobsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchJobsRequest.Marshal(b, m, deterministic)
+}
+func (m *WatchJobsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchJobsRequest.Merge(m, src)
+}
+func (m *WatchJobsRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchJobsRequest.Size(m)
+}
+func (m *WatchJobsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchJobsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchJobsRequest proto.InternalMessageInfo
+
+func (m *WatchJobsRequest) GetRepGroup() string {
+	if m != nil {
+		return m.RepGroup
+	}
+	return ""
+}
+
+// JobStateChange says that count jobs in a RepGroup (or "+all+" for all jobs)
+// changed from one state to another.
+type JobStateChange struct {
+	RepGroup             string   `protobuf:"bytes,1,opt,name=rep_group,json=repGroup,proto3" json:"rep_group,omitempty"`
+	From                 string   `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
+	To                   string   `protobuf:"bytes,3,opt,name=to,proto3" json:"to,omitempty"`
+	Count                int32    `protobuf:"varint,4,opt,name=count,proto3" json:"count,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *JobStateChange) Reset()         { *m = JobStateChange{} }
+func (m *JobStateChange) String() string { return proto.CompactTextString(m) }
+func (*JobStateChange) ProtoMessage()    {}
+func (*JobStateChange) Descriptor() ([]byte, []int) {
+	return fileDescriptor_91545a11ba4fffbe, []int{6}
+}
+
+func (m *JobStateChange) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_JobStateChange.Unmarshal(m, b)
+}
+func (m *JobStateChange) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_JobStateChange.Marshal(b, m, deterministic)
+}
+func (m *JobStateChange) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_JobStateChange.Merge(m, src)
+}
+func (m *JobStateChange) XXX_Size() int {
+	return xxx_messageInfo_JobStateChange.Size(m)
+}
+func (m *JobStateChange) XXX_DiscardUnknown() {
+	xxx_messageInfo_JobStateChange.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_JobStateChange proto.InternalMessageInfo
+
+func (m *JobStateChange) GetRepGroup() string {
+	if m != nil {
+		return m.RepGroup
+	}
+	return ""
+}
+
+func (m *JobStateChange) GetFrom() string {
+	if m != nil {
+		return m.From
+	}
+	return ""
+}
+
+func (m *JobStateChange) GetTo() string {
+	if m != nil {
+		return m.To
+	}
+	return ""
+}
+
+func (m *JobStateChange) GetCount() int32 {
+	if m != nil {
+		return m.Count
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*Job)(nil), "jobqueuepb.Job")
+	proto.RegisterMapType((map[string]string)(nil), "jobqueuepb.Job.TagsEntry")
+	proto.RegisterType((*AddJobsRequest)(nil), "jobqueuepb.AddJobsRequest")
+	proto.RegisterType((*AddJobsResponse)(nil), "jobqueuepb.AddJobsResponse")
+	proto.RegisterType((*GetJobsRequest)(nil), "jobqueuepb.GetJobsRequest")
+	proto.RegisterMapType((map[string]string)(nil), "jobqueuepb.GetJobsRequest.TagsEntry")
+	proto.RegisterType((*GetJobsResponse)(nil), "jobqueuepb.GetJobsResponse")
+	proto.RegisterType((*WatchJobsRequest)(nil), "jobqueuepb.WatchJobsRequest")
+	proto.RegisterType((*JobStateChange)(nil), "jobqueuepb.JobStateChange")
+}
+
+func init() {
+	proto.RegisterFile("jobqueue.proto", fileDescriptor_91545a11ba4fffbe)
+}
+
+var fileDescriptor_91545a11ba4fffbe = []byte{
+	// 795 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x55, 0xdf, 0x6f, 0x23, 0x35,
+	0x10, 0xd6, 0xe6, 0xf7, 0x4e, 0x4b, 0x52, 0x4c, 0x39, 0xdc, 0xed, 0x21, 0x42, 0x40, 0x22, 0x2f,
+	0x14, 0x74, 0x48, 0x70, 0xe2, 0x8d, 0x9e, 0x50, 0xa5, 0x4a, 0xf7, 0x62, 0x0e, 0x21, 0xf1, 0x40,
+	0xe4, 0xac, 0xe7, 0xd2, 0xbd, 0x74, 0xd7, 0x5b, 0xdb, 0x69, 0x2f, 0xff, 0x02, 0xcf, 0xfc, 0x75,
+	0xfc, 0x35, 0xc8, 0x63, 0x6f, 0x2e, 0x1b, 0x2a, 0x84, 0xee, 0x6d, 0xbe, 0xef, 0x1b, 0x4f, 0xc6,
+	0xdf, 0x8c, 0xb3, 0x30, 0x7e, 0xa3, 0x97, 0x77, 0x1b, 0xdc, 0xe0, 0x45, 0x6d, 0xb4, 0xd3, 0x0c,
+	0x1a, 0x5c, 0x2f, 0x67, 0x7f, 0x0d, 0xa0, 0x7b, 0xad, 0x97, 0xec, 0x04, 0xba, 0x79, 0xa9, 0x78,
+	0x32, 0x4d, 0xe6, 0xa9, 0xf0, 0x21, 0x31, 0x0f, 0x8a, 0x77, 0x22, 0xf3, 0xa0, 0xd8, 0x67, 0x70,
+	0x94, 0x3f, 0xa8, 0x45, 0x29, 0x9d, 0x43, 0x63, 0x79, 0x77, 0x9a, 0xcc, 0x47, 0x02, 0xf2, 0x07,
+	0xf5, 0x32, 0x30, 0xec, 0x1c, 0x52, 0x83, 0xf5, 0x62, 0x65, 0xf4, 0xa6, 0xe6, 0x3d, 0x3a, 0x38,
+	0x32, 0x58, 0x5f, 0x79, 0x1c, 0xc4, 0xbb, 0x28, 0xf6, 0x1b, 0xf1, 0x2e, 0x88, 0x9f, 0xc3, 0xf1,
+	0x6d, 0x51, 0x16, 0x2e, 0xc8, 0x96, 0x0f, 0xa6, 0xdd, 0x79, 0x2a, 0x8e, 0x88, 0xa3, 0x0c, 0xcb,
+	0x3e, 0x05, 0x50, 0x4d, 0x71, 0xcb, 0x87, 0x94, 0x90, 0xaa, 0x58, 0xdd, 0x32, 0x06, 0x3d, 0x85,
+	0xb5, 0xe5, 0x23, 0x12, 0x28, 0x66, 0x4f, 0x60, 0x50, 0x62, 0xa9, 0xcd, 0x96, 0xa7, 0xd3, 0x64,
+	0xde, 0x17, 0x11, 0xf9, 0x5c, 0x57, 0x94, 0xc8, 0x61, 0x9a, 0xcc, 0xbb, 0x82, 0x62, 0xcf, 0xe5,
+	0xf5, 0xc6, 0xf2, 0xa3, 0x69, 0x32, 0x4f, 0x04, 0xc5, 0x54, 0xb3, 0xb0, 0x6b, 0x7e, 0x4c, 0xa7,
+	0x29, 0x66, 0x19, 0x8c, 0xf4, 0x3d, 0x1a, 0x53, 0x28, 0xe4, 0x1f, 0x10, 0xbf, 0xc3, 0x5e, 0xab,
+	0x4d, 0xa1, 0x4d, 0xe1, 0xb6, 0x7c, 0x1c, 0xb4, 0x06, 0x33, 0x0e, 0x43, 0x83, 0xce, 0x14, 0x68,
+	0xf9, 0x84, 0xa4, 0x06, 0x7a, 0xa3, 0xb1, 0xba, 0xe7, 0x27, 0xd4, 0xb8, 0x0f, 0xd9, 0xd7, 0xd0,
+	0x73, 0x72, 0x65, 0xf9, 0x87, 0xd3, 0xee, 0xfc, 0xe8, 0xd9, 0xd9, 0xc5, 0xbb, 0x79, 0x5d, 0x5c,
+	0xeb, 0xe5, 0xc5, 0x2b, 0xb9, 0xb2, 0x3f, 0x57, 0xce, 0x6c, 0x05, 0xa5, 0xf9, 0x02, 0x6b, 0xdc,
+	0x72, 0x16, 0x26, 0xb5, 0xc6, 0x2d, 0x3b, 0x85, 0xbe, 0x75, 0xd2, 0x21, 0xff, 0x88, 0xb8, 0x00,
+	0x7c, 0x7b, 0xf8, 0xb6, 0x70, 0xb9, 0x56, 0xc8, 0x4f, 0x43, 0x7b, 0x0d, 0xf6, 0xb3, 0x7d, 0x2d,
+	0x8b, 0xdb, 0x85, 0x41, 0x69, 0x75, 0xc5, 0x3f, 0xa6, 0x73, 0xe0, 0x29, 0x41, 0x8c, 0xf7, 0xe2,
+	0x46, 0x5b, 0xc7, 0x9f, 0x90, 0x42, 0xb1, 0x1f, 0x89, 0x75, 0xd2, 0xb8, 0x05, 0xb9, 0xf9, 0x09,
+	0xb9, 0x99, 0x12, 0xf3, 0xca, 0x5b, 0x7a, 0x06, 0x23, 0xac, 0x54, 0x10, 0x39, 0x89, 0x43, 0xac,
+	0x14, 0x49, 0x19, 0x8c, 0xfc, 0xce, 0x94, 0xb5, 0xb3, 0xfc, 0x2c, 0xb4, 0xd2, 0x60, 0x7f, 0xac,
+	0x46, 0xb9, 0x5e, 0x18, 0x59, 0xf2, 0x2c, 0x58, 0xe5, 0xb1, 0x90, 0xa5, 0x1f, 0xa8, 0x75, 0x4a,
+	0x6f, 0x1c, 0x3f, 0xa7, 0x36, 0x22, 0x8a, 0x3c, 0x1a, 0xc3, 0x9f, 0xee, 0x78, 0x34, 0x26, 0xfb,
+	0x01, 0xd2, 0x9d, 0x59, 0x8d, 0x4d, 0x49, 0xcb, 0xa6, 0x7b, 0x79, 0xbb, 0xc1, 0xb8, 0xe4, 0x01,
+	0xfc, 0xd8, 0x79, 0x9e, 0xcc, 0xfe, 0x80, 0xf1, 0x4f, 0x4a, 0x5d, 0xeb, 0xa5, 0x15, 0x78, 0xb7,
+	0x41, 0xeb, 0xd8, 0x17, 0xd0, 0x7b, 0xa3, 0x97, 0x96, 0x27, 0x34, 0x93, 0xc9, 0xc1, 0x4c, 0x04,
+	0x89, 0xec, 0x2b, 0x98, 0x14, 0xab, 0x4a, 0x1b, 0x5c, 0xe4, 0xba, 0xac, 0x6f, 0xd1, 0x85, 0xd2,
+	0x23, 0x31, 0x0e, 0xf4, 0x8b, 0xc8, 0xce, 0x7e, 0x85, 0xc9, 0xae, 0xbe, 0xad, 0x75, 0x65, 0xd1,
+	0x37, 0x23, 0x95, 0xc2, 0xf0, 0x06, 0xfb, 0x22, 0x00, 0xbf, 0x36, 0xf8, 0xb6, 0xb0, 0x0e, 0xc3,
+	0x4b, 0xec, 0x8b, 0x06, 0xfa, 0x81, 0xac, 0x71, 0xeb, 0x9f, 0x21, 0x2d, 0xbc, 0x8f, 0x67, 0x7f,
+	0x76, 0x60, 0x7c, 0x85, 0x6e, 0xbf, 0xef, 0x26, 0x2d, 0x79, 0x97, 0xd6, 0x7e, 0xa7, 0x9d, 0x83,
+	0x77, 0xea, 0xbd, 0x44, 0x69, 0xf2, 0x9b, 0xf8, 0xc0, 0x23, 0x62, 0xcf, 0xe3, 0x52, 0xf6, 0xc8,
+	0x80, 0x2f, 0xf7, 0x0d, 0x68, 0xff, 0xe4, 0xbf, 0xf6, 0x73, 0xb7, 0x8d, 0xfd, 0xfd, 0x6d, 0x3c,
+	0x85, 0x3e, 0x3d, 0x6f, 0x3e, 0x08, 0xf7, 0x25, 0xe0, 0x87, 0x64, 0x9d, 0xe2, 0x43, 0xfa, 0x69,
+	0x1f, 0xbe, 0xff, 0x0c, 0xbf, 0x87, 0xc9, 0xae, 0xb1, 0xe8, 0xf1, 0xff, 0x19, 0xe2, 0xec, 0x1b,
+	0x38, 0xf9, 0x4d, 0xba, 0xfc, 0x66, 0xdf, 0xc5, 0x96, 0x63, 0x49, 0xdb, 0xb1, 0xd9, 0x0a, 0xc6,
+	0xd7, 0x7a, 0xf9, 0x8b, 0xbf, 0xd5, 0x8b, 0x1b, 0x59, 0xad, 0xf0, 0x3f, 0xd3, 0xfd, 0x44, 0x5e,
+	0x1b, 0x5d, 0xc6, 0x86, 0x29, 0x66, 0x63, 0xe8, 0x38, 0x4d, 0x86, 0xa7, 0xa2, 0xe3, 0xb4, 0xbf,
+	0x55, 0xae, 0x37, 0x95, 0xa3, 0x7f, 0xd1, 0xbe, 0x08, 0xe0, 0xd9, 0xdf, 0x09, 0x0c, 0x5f, 0xca,
+	0x4a, 0xae, 0xd0, 0xb0, 0x4b, 0x18, 0xc6, 0x0d, 0x62, 0xd9, 0xfe, 0x3d, 0xda, 0x6b, 0x9b, 0x9d,
+	0x3f, 0xaa, 0x45, 0x3b, 0x2e, 0x61, 0x18, 0x1d, 0x6a, 0xd7, 0x68, 0xcf, 0x33, 0x3b, 0x7f, 0x54,
+	0x8b, 0x35, 0xae, 0x20, 0xdd, 0xb9, 0xc5, 0x9e, 0xee, 0x67, 0x1e, 0x9a, 0x98, 0x65, 0x07, 0x7e,
+	0xef, 0x39, 0xf6, 0x6d, 0x72, 0x79, 0xfc, 0xfb, 0xde, 0x77, 0x69, 0x39, 0xa0, 0x4f, 0xd5, 0x77,
+	0xff, 0x0c, 0x00, 0x9f, 0x6c, 0xb8, 0x2d, 0xbc, 0x06, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// ManagerClient is the client API for Manager service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ManagerClient interface {
+	// AddJobs adds jobs to the queue. Jobs that are already in the queue are
+	// not added again.
+	AddJobs(ctx context.Context, in *AddJobsRequest, opts ...grpc.CallOption) (*AddJobsResponse, error)
+	// GetJobs gets jobs (current and complete) by key, RepGroup or tags, or
+	// all incomplete jobs if none of those are specified.
+	GetJobs(ctx context.Context, in *GetJobsRequest, opts ...grpc.CallOption) (*GetJobsResponse, error)
+	// WatchJobs streams the changes in state of jobs, as they happen.
+	WatchJobs(ctx context.Context, in *WatchJobsRequest, opts ...grpc.CallOption) (Manager_WatchJobsClient, error)
+}
+
+type managerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewManagerClient(cc grpc.ClientConnInterface) ManagerClient {
+	return &managerClient{cc}
+}
+
+func (c *managerClient) AddJobs(ctx context.Context, in *AddJobsRequest, opts ...grpc.CallOption) (*AddJobsResponse, error) {
+	out := new(AddJobsResponse)
+	err := c.cc.Invoke(ctx, "/jobqueuepb.Manager/AddJobs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) GetJobs(ctx context.Context, in *GetJobsRequest, opts ...grpc.CallOption) (*GetJobsResponse, error) {
+	out := new(GetJobsResponse)
+	err := c.cc.Invoke(ctx, "/jobqueuepb.Manager/GetJobs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) WatchJobs(ctx context.Context, in *WatchJobsRequest, opts ...grpc.CallOption) (Manager_WatchJobsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Manager_serviceDesc.Streams[0], "/jobqueuepb.Manager/WatchJobs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &managerWatchJobsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Manager_WatchJobsClient interface {
+	Recv() (*JobStateChange, error)
+	grpc.ClientStream
+}
+
+type managerWatchJobsClient struct {
+	grpc.ClientStream
+}
+
+func (x *managerWatchJobsClient) Recv() (*JobStateChange, error) {
+	m := new(JobStateChange)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ManagerServer is the server API for Manager service.
+type ManagerServer interface {
+	// AddJobs adds jobs to the queue. Jobs that are already in the queue are
+	// not added again.
+	AddJobs(context.Context, *AddJobsRequest) (*AddJobsResponse, error)
+	// GetJobs gets jobs (current and complete) by key, RepGroup or tags, or
+	// all incomplete jobs if none of those are specified.
+	GetJobs(context.Context, *GetJobsRequest) (*GetJobsResponse, error)
+	// WatchJobs streams the changes in state of jobs, as they happen.
+	WatchJobs(*WatchJobsRequest, Manager_WatchJobsServer) error
+}
+
+// UnimplementedManagerServer can be embedded to have forward compatible implementations.
+type UnimplementedManagerServer struct {
+}
+
+func (*UnimplementedManagerServer) AddJobs(ctx context.Context, req *AddJobsRequest) (*AddJobsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddJobs not implemented")
+}
+func (*UnimplementedManagerServer) GetJobs(ctx context.Context, req *GetJobsRequest) (*GetJobsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetJobs not implemented")
+}
+func (*UnimplementedManagerServer) WatchJobs(req *WatchJobsRequest, srv Manager_WatchJobsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchJobs not implemented")
+}
+
+func RegisterManagerServer(s *grpc.Server, srv ManagerServer) {
+	s.RegisterService(&_Manager_serviceDesc, srv)
+}
+
+func _Manager_AddJobs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddJobsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).AddJobs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/jobqueuepb.Manager/AddJobs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).AddJobs(ctx, req.(*AddJobsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_GetJobs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetJobsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).GetJobs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/jobqueuepb.Manager/GetJobs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).GetJobs(ctx, req.(*GetJobsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_WatchJobs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchJobsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ManagerServer).WatchJobs(m, &managerWatchJobsServer{stream})
+}
+
+type Manager_WatchJobsServer interface {
+	Send(*JobStateChange) error
+	grpc.ServerStream
+}
+
+type managerWatchJobsServer struct {
+	grpc.ServerStream
+}
+
+func (x *managerWatchJobsServer) Send(m *JobStateChange) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Manager_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "jobqueuepb.Manager",
+	HandlerType: (*ManagerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddJobs",
+			Handler:    _Manager_AddJobs_Handler,
+		},
+		{
+			MethodName: "GetJobs",
+			Handler:    _Manager_GetJobs_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchJobs",
+			Handler:       _Manager_WatchJobs_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "jobqueue.proto",
+}
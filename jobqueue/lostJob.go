@@ -0,0 +1,280 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for automatically confirming that lost jobs are
+// dead, instead of waiting for a user to do so.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// ServerLostJobCheckInterval is how often we ask the cloud provider if the
+// server a lost job was running on is gone, for jobs subject to a
+// LostJobPolicy with CloudGone set.
+var ServerLostJobCheckInterval = 1 * time.Minute
+
+// LostJobPolicy describes how quickly jobs are considered lost (because we
+// stopped hearing from their runner, eg. because the host they were running on
+// died or the network had problems), and when lost jobs should automatically be
+// confirmed dead, as if a user had killed them. They are then treated as having
+// failed: retried up to their Retries, subject to their RepGroup's
+// HostFailurePolicy. Supply one as ServerConfig.LostJobPolicy to apply to all
+// jobs, or as Job.LostPolicy to override that for a job; a Job.LostPolicy that
+// only sets Heartbeat and/or Threshold still gets the rest from the
+// ServerConfig one. The decision is recorded in the job's events (see
+// Client.GetJobEvents()).
+type LostJobPolicy struct {
+	// After, if greater than 0, is how long a job can be lost before it is
+	// confirmed dead.
+	After time.Duration
+
+	// CloudGone confirms lost jobs dead as soon as the cloud provider reports
+	// that the server they were running on no longer exists or isn't working.
+	// Has no effect for jobs that weren't running on a cloud server.
+	CloudGone bool
+
+	// Heartbeat, if greater than 0, is how often the runner of a job tells us
+	// it is still running, instead of ClientTouchInterval.
+	Heartbeat time.Duration
+
+	// Threshold, if greater than 0, is how long we go without hearing from the
+	// runner of a job before we consider the job lost, instead of
+	// ServerItemTTR. It must be longer than the Heartbeat; making it several
+	// times longer lets jobs ride out short network problems.
+	Threshold time.Duration
+}
+
+// validate checks the policy makes sense.
+func (p *LostJobPolicy) validate() error {
+	if p.After < 0 {
+		return fmt.Errorf("LostJobPolicy After can't be negative")
+	}
+	if p.Heartbeat < 0 || p.Threshold < 0 {
+		return fmt.Errorf("LostJobPolicy Heartbeat and Threshold can't be negative")
+	}
+	if p.Heartbeat > 0 && p.Threshold > 0 && p.Threshold <= p.Heartbeat {
+		return fmt.Errorf("LostJobPolicy Threshold must be longer than its Heartbeat")
+	}
+	return nil
+}
+
+// active tells you if this policy would ever confirm a job dead. A nil policy
+// is not active.
+func (p *LostJobPolicy) active() bool {
+	return p != nil && (p.After > 0 || p.CloudGone)
+}
+
+// lostJobPolicy returns the given job's LostPolicy if it has one that says
+// when to confirm it dead, otherwise our own. The job must not be locked.
+func (s *Server) lostJobPolicy(job *Job) *LostJobPolicy {
+	job.RLock()
+	policy := job.LostPolicy
+	job.RUnlock()
+	if policy != nil && (policy.After != 0 || policy.CloudGone) {
+		return policy
+	}
+
+	s.tmutex.RLock()
+	defer s.tmutex.RUnlock()
+	return s.lostPolicy
+}
+
+// lostTiming returns how often the runner of the given job should touch it,
+// and how long we should go without a touch before considering it lost, going
+// by its own LostPolicy, then our own, then the defaults. The job must not be
+// locked.
+func (s *Server) lostTiming(job *Job) (heartbeat, threshold time.Duration) {
+	job.RLock()
+	if policy := job.LostPolicy; policy != nil {
+		heartbeat, threshold = policy.Heartbeat, policy.Threshold
+	}
+	job.RUnlock()
+
+	if heartbeat <= 0 || threshold <= 0 {
+		s.tmutex.RLock()
+		if policy := s.lostPolicy; policy != nil {
+			if heartbeat <= 0 {
+				heartbeat = policy.Heartbeat
+			}
+			if threshold <= 0 {
+				threshold = policy.Threshold
+			}
+		}
+		s.tmutex.RUnlock()
+	}
+
+	if heartbeat <= 0 {
+		heartbeat = ClientTouchInterval
+	}
+	if threshold <= 0 {
+		threshold = ServerItemTTR
+	}
+	return heartbeat, threshold
+}
+
+// lostThreshold returns the threshold part of lostTiming(), for use as the
+// ttr of the given job's queue item. The job must not be locked.
+func (s *Server) lostThreshold(job *Job) time.Duration {
+	_, threshold := s.lostTiming(job)
+	return threshold
+}
+
+// withHeartbeat sets the Heartbeat of the given job's LostPolicy to ours if it
+// doesn't have its own, so that its runner knows how often to touch it. If
+// neither has one, the runner uses its own ClientTouchInterval. The job should
+// be a copy made for a client, and must not be locked.
+func (s *Server) withHeartbeat(job *Job) {
+	s.tmutex.RLock()
+	var heartbeat time.Duration
+	if s.lostPolicy != nil {
+		heartbeat = s.lostPolicy.Heartbeat
+	}
+	s.tmutex.RUnlock()
+
+	job.Lock()
+	defer job.Unlock()
+	if heartbeat <= 0 || (job.LostPolicy != nil && job.LostPolicy.Heartbeat > 0) {
+		return
+	}
+	policy := &LostJobPolicy{}
+	if job.LostPolicy != nil {
+		*policy = *job.LostPolicy
+	}
+	policy.Heartbeat = heartbeat
+	job.LostPolicy = policy
+}
+
+// watchLostJob starts confirming the given job dead according to its
+// LostJobPolicy, for when it has just been lost. The job must not be locked.
+func (s *Server) watchLostJob(job *Job) {
+	policy := s.lostJobPolicy(job)
+	if !policy.active() {
+		return
+	}
+
+	job.RLock()
+	key := job.Key()
+	hostID := job.HostID
+	started := job.StartTime
+	job.RUnlock()
+
+	stop := make(chan struct{})
+	s.ljmutex.Lock()
+	if existing, exists := s.lostJobWatchers[key]; exists {
+		close(existing)
+	}
+	s.lostJobWatchers[key] = stop
+	s.ljmutex.Unlock()
+
+	go func() {
+		defer internal.LogPanic(s.Logger, "watchLostJob", false)
+		defer func() {
+			s.ljmutex.Lock()
+			if s.lostJobWatchers[key] == stop {
+				delete(s.lostJobWatchers, key)
+			}
+			s.ljmutex.Unlock()
+		}()
+
+		var afterC <-chan time.Time
+		if policy.After > 0 {
+			timer := time.NewTimer(policy.After)
+			defer timer.Stop()
+			afterC = timer.C
+		}
+
+		var checkC <-chan time.Time
+		if policy.CloudGone && hostID != "" {
+			if s.scheduler.HostGone(hostID) {
+				s.confirmLostJobDead(key, started, "cloud server gone")
+				return
+			}
+			ticker := time.NewTicker(ServerLostJobCheckInterval)
+			defer ticker.Stop()
+			checkC = ticker.C
+		}
+
+		if afterC == nil && checkC == nil {
+			return
+		}
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-afterC:
+				s.confirmLostJobDead(key, started, fmt.Sprintf("lost for %s", policy.After))
+				return
+			case <-checkC:
+				if s.scheduler.HostGone(hostID) {
+					s.confirmLostJobDead(key, started, "cloud server gone")
+					return
+				}
+			}
+		}
+	}()
+}
+
+// stopWatchingLostJob stops any watching started by watchLostJob() for the job
+// with the given key, for when it is no longer lost.
+func (s *Server) stopWatchingLostJob(key string) {
+	s.ljmutex.Lock()
+	defer s.ljmutex.Unlock()
+	if stop, exists := s.lostJobWatchers[key]; exists {
+		close(stop)
+		delete(s.lostJobWatchers, key)
+	}
+}
+
+// confirmLostJobDead kills the job with the given key, if it is still lost
+// from the run that started at the given time, recording the given reason for
+// doing so in its events.
+func (s *Server) confirmLostJobDead(key string, started time.Time, reason string) {
+	s.ssmutex.RLock()
+	up := s.up
+	s.ssmutex.RUnlock()
+	if !up {
+		return
+	}
+
+	item, err := s.q.Get(key)
+	if err != nil || item.Stats().State != queue.ItemStateRun {
+		return
+	}
+	job := item.Data().(*Job)
+	job.RLock()
+	stillLost := job.Lost && !job.killCalled && job.StartTime.Equal(started)
+	host := job.Host
+	job.RUnlock()
+	if !stillLost {
+		return
+	}
+
+	s.recordJobEvent(&JobEvent{Event: JobEventDead, Host: host, Reason: reason}, key)
+	if _, err = s.killJob(key); err != nil {
+		s.Warn("failed to confirm lost job dead", "job", key, "reason", reason, "err", err)
+		return
+	}
+	s.Warn("confirmed lost job dead due to policy", "job", key, "reason", reason)
+}
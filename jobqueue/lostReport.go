@@ -0,0 +1,154 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for collecting information from the hosts of
+// jobs we lose contact with, for post-mortem investigation.
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// ServerLostReportTimeout is how long we spend trying to collect a LostReport
+// from the host of a job we lost contact with.
+var ServerLostReportTimeout = 1 * time.Minute
+
+// lostReportLines is the maximum number of lines of each log we collect.
+const lostReportLines = 50
+
+// LostReason* constants are the possible values of Job.LostReason, saying what
+// we found out about a job's host after we lost contact with its runner.
+const (
+	LostReasonNoContact   = "lost contact with its runner"
+	LostReasonHostUp      = "lost contact with its runner, but its host is reachable"
+	LostReasonCloudUp     = "lost contact with its runner and host, but the cloud provider says its host is up"
+	LostReasonHostGone    = "lost contact with its runner, and the cloud provider says its host is gone"
+	LostReasonUnreachable = "lost contact with its runner and its host"
+)
+
+// LostReport holds information collected from the host of a Job at the moment
+// we lost contact with it, to help you work out what went wrong.
+type LostReport struct {
+	// Collected is when the information was collected.
+	Collected time.Time
+
+	// Host is the host the information was collected from.
+	Host string
+
+	// Process is the `ps` line of the Job's Cmd, blank if it was no longer
+	// running.
+	Process string
+
+	// RunnerLog is the end of the syslog entries of `wr runner`, which are
+	// only present if it was run with --debug.
+	RunnerLog string
+
+	// Dmesg is the end of the kernel's message buffer, which will show if
+	// eg. the OOM killer was involved.
+	Dmesg string
+
+	// Cwd is a listing of the Job's working directory, showing any output
+	// files it had written so far.
+	Cwd string
+
+	// Err describes any problem collecting the above, eg. because the host
+	// was not reachable.
+	Err string
+}
+
+// collectLostReport tries to collect a LostReport from the host of the given
+// job, which we just lost contact with, and attaches it to the job along with
+// a LostReason. The job must not be locked.
+func (s *Server) collectLostReport(job *Job) {
+	job.RLock()
+	host := job.Host
+	hostID := job.HostID
+	pid := job.Pid
+	cwd := job.ActualCwd
+	if cwd == "" {
+		cwd = job.Cwd
+	}
+	job.RUnlock()
+	if host == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ServerLostReportTimeout)
+	defer cancel()
+
+	report := &LostReport{Host: host}
+	gone := hostID != "" && s.scheduler.HostGone(hostID)
+	if gone {
+		report.Err = "the cloud provider says the host is gone"
+	}
+	run := func(cmd string) string {
+		if gone {
+			return ""
+		}
+		out, err := s.scheduler.RunCmdOnHost(ctx, host, cmd)
+		if err != nil && report.Err == "" {
+			report.Err = err.Error()
+		}
+		return out
+	}
+
+	report.Process = run(fmt.Sprintf("ps -o pid,stat,etime,rss,args -p %d --no-headers 2>/dev/null || true", pid))
+	if report.Err == "" {
+		report.RunnerLog = run(fmt.Sprintf("(journalctl -q --no-pager -t wrrunner -n %d 2>/dev/null || grep -h wrrunner /var/log/syslog /var/log/messages 2>/dev/null | tail -n %d) || true", lostReportLines, lostReportLines))
+		report.Dmesg = run(fmt.Sprintf("(dmesg -T 2>/dev/null || dmesg 2>&1) | tail -n %d", lostReportLines))
+		report.Cwd = run(fmt.Sprintf("ls -la %s 2>&1 | head -n %d", shellQuote(cwd), lostReportLines))
+	}
+	report.Collected = time.Now()
+
+	var reason string
+	switch {
+	case gone:
+		reason = LostReasonHostGone
+	case report.Err == "":
+		reason = LostReasonHostUp
+	case hostID != "":
+		reason = LostReasonCloudUp
+	default:
+		reason = LostReasonUnreachable
+	}
+
+	job.Lock()
+	defer job.Unlock()
+	if !job.Lost {
+		// it came back to life while we were collecting
+		return
+	}
+	job.LostReport = report
+	job.LostReason = reason
+	if report.Err != "" {
+		s.Warn("failed to collect details of lost job", "cmd", job.Cmd, "host", host, "err", report.Err)
+	}
+}
+
+// startCollectingLostReport calls collectLostReport() in the background.
+func (s *Server) startCollectingLostReport(job *Job) {
+	go func() {
+		defer internal.LogPanic(s.Logger, "collectLostReport", false)
+		s.collectLostReport(job)
+	}()
+}
@@ -0,0 +1,210 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for draining the server ahead of a period of
+// maintenance, holding back jobs that would still be running when the
+// maintenance starts, and resuming normal operation once it is over.
+
+import (
+	"context"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// MaintenanceDrain is the details of a drain for maintenance requested with
+// Client.DrainServerUntil(), that we send to the status webpage. When the drain
+// ends or is cancelled it is sent again with Ended true.
+type MaintenanceDrain struct {
+	Start int64 // seconds since Unix epoch
+	Until int64
+	Ended bool
+}
+
+// DrainUntil makes the server stop starting jobs that are not expected (going
+// by their Requirements.Time) to complete before start, and stop starting any
+// jobs at all from start until until, when normal operation automatically
+// resumes. Unlike Drain(), the server keeps running throughout. Calling it
+// again replaces the previous maintenance window, and Resume() cancels it.
+func (s *Server) DrainUntil(start, until time.Time) error {
+	now := time.Now()
+	if start.Before(now) {
+		start = now
+	}
+	if !until.After(start) {
+		return Error{"DrainUntil", "", ErrBadMaintenance}
+	}
+
+	s.ssmutex.Lock()
+	defer s.ssmutex.Unlock()
+	if !s.up {
+		return Error{"DrainUntil", "", ErrNoServer}
+	}
+	if s.drain && s.ServerInfo.Mode == ServerModeDrain {
+		return Error{"DrainUntil", "", ErrBeingDrained}
+	}
+
+	s.mtmutex.Lock()
+	s.maintStart, s.maintUntil = start, until
+	if s.maintTimer != nil {
+		s.maintTimer.Stop()
+	}
+	s.maintTimer = time.AfterFunc(until.Sub(now), func() {
+		s.maintenanceOver(until)
+	})
+	s.mtmutex.Unlock()
+
+	if !s.drain {
+		s.ServerInfo.Mode = ServerModeMaintain
+	}
+	s.maintCaster.Send(&MaintenanceDrain{Start: start.Unix(), Until: until.Unix()})
+
+	// jobs that were ready may no longer be startable, so the number of
+	// runners we want may have changed
+	s.q.TriggerReadyAddedCallback()
+	return nil
+}
+
+// maintenanceOver is called by the timer set in DrainUntil() to resume normal
+// operation once the maintenance window that ends at the given time is over.
+func (s *Server) maintenanceOver(until time.Time) {
+	s.ssmutex.Lock()
+	defer s.ssmutex.Unlock()
+	if !s.up {
+		return
+	}
+
+	s.mtmutex.RLock()
+	current := s.maintUntil.Equal(until)
+	s.mtmutex.RUnlock()
+	if !current || !s.endMaintenance() {
+		return
+	}
+
+	s.Info("maintenance drain over; resuming normal operation")
+	s.q.TriggerReadyAddedCallback()
+}
+
+// endMaintenance clears any maintenance window set by DrainUntil(), returning
+// true if there was one. You must hold the ssmutex lock before calling this.
+func (s *Server) endMaintenance() bool {
+	s.mtmutex.Lock()
+	start, until := s.maintStart, s.maintUntil
+	if until.IsZero() {
+		s.mtmutex.Unlock()
+		return false
+	}
+	s.maintStart, s.maintUntil = time.Time{}, time.Time{}
+	if s.maintTimer != nil {
+		s.maintTimer.Stop()
+		s.maintTimer = nil
+	}
+	s.mtmutex.Unlock()
+
+	if s.ServerInfo.Mode == ServerModeMaintain {
+		s.ServerInfo.Mode = ServerModeNormal
+	}
+	s.maintCaster.Send(&MaintenanceDrain{Start: start.Unix(), Until: until.Unix(), Ended: true})
+	return true
+}
+
+// maintaining tells you if a maintenance window set by DrainUntil() has yet to
+// end.
+func (s *Server) maintaining() bool {
+	s.mtmutex.RLock()
+	defer s.mtmutex.RUnlock()
+	return !s.maintUntil.IsZero()
+}
+
+// maintenanceDetails returns the details of the current maintenance window, or
+// nil if there isn't one.
+func (s *Server) maintenanceDetails() *MaintenanceDrain {
+	s.mtmutex.RLock()
+	defer s.mtmutex.RUnlock()
+	if s.maintUntil.IsZero() {
+		return nil
+	}
+	return &MaintenanceDrain{Start: s.maintStart.Unix(), Until: s.maintUntil.Unix()}
+}
+
+// maintenanceWait tells you how long the given job must wait before it can
+// start, given any maintenance window: jobs expected to still be running when
+// the maintenance starts, and all jobs during the maintenance, must wait until
+// it is over. Returns 0 if the job can start now.
+func (s *Server) maintenanceWait(job *Job) time.Duration {
+	s.mtmutex.RLock()
+	start, until := s.maintStart, s.maintUntil
+	s.mtmutex.RUnlock()
+	now := time.Now()
+	if until.IsZero() || !now.Before(until) {
+		return 0
+	}
+
+	if now.Before(start) {
+		job.RLock()
+		expected := job.Requirements.Time
+		job.RUnlock()
+		if !now.Add(expected).After(start) {
+			return 0
+		}
+	}
+	return until.Sub(now)
+}
+
+// maintenanceHold is our queue.Hold for holding back jobs that can't start
+// because of a maintenance window; see maintenanceWait(). Like runWindowHold(),
+// jobs are held for no longer than ServerRunWindowRecheck before being checked
+// again, so that changes to the window take effect in good time.
+func (s *Server) maintenanceHold(item *queue.Item) time.Duration {
+	job, ok := item.Data().(*Job)
+	if !ok {
+		return 0
+	}
+	until := s.maintenanceWait(job)
+	if until > ServerRunWindowRecheck {
+		until = ServerRunWindowRecheck
+	}
+	return until
+}
+
+// DrainServerUntil tells the server to drain ahead of a period of maintenance
+// that runs from start until until. Jobs that are not expected (going by
+// their Requirements.Time) to complete before start will not be started, and
+// from start no jobs will be started at all. Once until is reached, normal
+// operation resumes automatically. A zero start means the maintenance starts
+// now. Calling ResumeServer() cancels the maintenance early.
+//
+// You get back a count of currently running jobs and an estimated time until
+// completion for the last of those. An invalid window results in an Error with
+// Err ErrBadMaintenance.
+func (c *Client) DrainServerUntil(start, until time.Time) (running int, etc time.Duration, err error) {
+	return c.DrainServerUntilContext(context.Background(), start, until)
+}
+
+// DrainServerUntilContext is like DrainServerUntil(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) DrainServerUntilContext(ctx context.Context, start, until time.Time) (running int, etc time.Duration, err error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "drainuntil", From: start, To: until})
+	if err != nil {
+		return running, etc, err
+	}
+	return resp.SStats.Running, resp.SStats.ETC, err
+}
@@ -0,0 +1,297 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for expanding a template job in to many jobs,
+// one per row of a manifest or per index of an array, on the server (or for a
+// manifest, on the client if it needs the jobs itself).
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/ugorji/go/codec"
+)
+
+// arrayIndexPlaceholder is the name of the placeholder that is replaced with
+// the index of each job expanded from a template, as {{.Index}}.
+const arrayIndexPlaceholder = ".Index"
+
+// These are the names of manifest columns that, as well as being usable as
+// placeholders, override the requirements or RepGroup of the job made from each
+// row, taking values in the same format as the `wr add` options of the same
+// name. Blank values leave the template's setting alone.
+const (
+	manifestColumnMemory   = "memory"
+	manifestColumnTime     = "time"
+	manifestColumnCPUs     = "cpus"
+	manifestColumnDisk     = "disk"
+	manifestColumnRepGroup = "rep_grp"
+)
+
+// manifestPlaceholderRegex matches the {{column}} placeholders in the fields of
+// a template job.
+var manifestPlaceholderRegex = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
+
+// templatedFields returns pointers to the fields of the job that may contain
+// manifest placeholders: Cmd, Steps, Cwd, RepGroup, Name and DepGroups.
+func (j *Job) templatedFields() []*string {
+	fields := []*string{&j.Cmd, &j.Cwd, &j.RepGroup, &j.Name}
+	for i := range j.Steps {
+		fields = append(fields, &j.Steps[i])
+	}
+	for i := range j.DepGroups {
+		fields = append(fields, &j.DepGroups[i])
+	}
+	return fields
+}
+
+// manifestDelimiter returns the delimiter of the given manifest: tab if its
+// first line contains a tab, otherwise comma.
+func manifestDelimiter(manifest []byte) rune {
+	firstLine := manifest
+	if i := bytes.IndexByte(manifest, '\n'); i >= 0 {
+		firstLine = manifest[:i]
+	}
+	if bytes.IndexByte(firstLine, '\t') >= 0 {
+		return '\t'
+	}
+	return ','
+}
+
+// ExpandManifest does what the server does for Client.AddFromManifest(),
+// returning a copy of the template job per data row of the manifest, with the
+// {{column}} placeholders in its templatedFields() replaced with that row's
+// values, and {{.Index}} with the row number. Any memory, time, cpus, disk and
+// rep_grp columns override those properties of each job.
+//
+// Use this instead of AddFromManifest() when you need the individual jobs
+// yourself, eg. to Add() them with a RerunMode or to wait on them.
+func ExpandManifest(template *Job, manifest []byte) ([]*Job, error) {
+	return expandManifest(new(codec.BincHandle), template, manifest)
+}
+
+// expandManifest is the implementation of ExpandManifest(), using the given
+// codec handle to copy the template.
+func expandManifest(ch codec.Handle, template *Job, manifest []byte) ([]*Job, error) {
+	if template == nil {
+		return nil, fmt.Errorf("no template job")
+	}
+
+	r := csv.NewReader(bytes.NewReader(manifest))
+	r.Comma = manifestDelimiter(manifest)
+	if r.Comma == '\t' {
+		r.LazyQuotes = true
+	} else {
+		// (not for TSV, where the tab delimiter is itself leading space, and
+		// blank cells would be lost)
+		r.TrimLeadingSpace = true
+	}
+
+	header, err := r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("manifest is empty")
+		}
+		return nil, fmt.Errorf("manifest header could not be parsed: %s", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("manifest column %d has no name", i+1)
+		}
+		if _, exists := columns[name]; exists {
+			return nil, fmt.Errorf("manifest column %s is duplicated", name)
+		}
+		columns[name] = i
+	}
+
+	for _, field := range template.templatedFields() {
+		for _, match := range manifestPlaceholderRegex.FindAllStringSubmatch(*field, -1) {
+			if _, exists := columns[match[1]]; !exists && match[1] != arrayIndexPlaceholder {
+				return nil, fmt.Errorf("template placeholder {{%s}} is not a manifest column", match[1])
+			}
+		}
+	}
+
+	var rows [][]string
+	for {
+		row, errr := r.Read()
+		if errr == io.EOF {
+			break
+		}
+		if errr != nil {
+			return nil, fmt.Errorf("manifest row could not be parsed: %s", errr)
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("manifest has no rows")
+	}
+
+	jobs, err := expandTemplate(ch, template, len(rows), func(index int, name string) string {
+		return rows[index-1][columns[name]]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, job := range jobs {
+		if err = job.applyManifestOverrides(rows[i], columns); err != nil {
+			return nil, fmt.Errorf("manifest row %d: %s", i+1, err)
+		}
+	}
+	return jobs, nil
+}
+
+// applyManifestOverrides sets our requirements and RepGroup from the values of
+// the given manifest row in any manifestColumn* columns.
+func (j *Job) applyManifestOverrides(row []string, columns map[string]int) error {
+	value := func(name string) string {
+		if i, exists := columns[name]; exists {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	if v := value(manifestColumnRepGroup); v != "" {
+		j.RepGroup = v
+	}
+
+	if value(manifestColumnMemory) == "" && value(manifestColumnTime) == "" && value(manifestColumnCPUs) == "" && value(manifestColumnDisk) == "" {
+		return nil
+	}
+	if j.Requirements == nil {
+		return fmt.Errorf("template job has no Requirements to override")
+	}
+
+	if v := value(manifestColumnMemory); v != "" {
+		mb, err := bytefmt.ToMegabytes(v)
+		if err != nil {
+			return fmt.Errorf("memory value (%s) was not specified correctly: %s", v, err)
+		}
+		j.Requirements.RAM = int(mb)
+	}
+	if v := value(manifestColumnTime); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("time value (%s) was not specified correctly", v)
+		}
+		j.Requirements.Time = d
+	}
+	if v := value(manifestColumnCPUs); v != "" {
+		cpus, err := strconv.ParseFloat(v, 64)
+		if err != nil || cpus < 0 {
+			return fmt.Errorf("cpus value (%s) was not specified correctly", v)
+		}
+		j.Requirements.Cores = cpus
+		j.Requirements.CoresSet = true
+	}
+	if v := value(manifestColumnDisk); v != "" {
+		disk, err := strconv.Atoi(v)
+		if err != nil || disk < 0 {
+			return fmt.Errorf("disk value (%s) was not specified correctly", v)
+		}
+		j.Requirements.Disk = disk
+		j.Requirements.DiskSet = true
+	}
+	return nil
+}
+
+// expandArray does the server side of Client.AddArray(), returning a copy of
+// the template job per index from 1 to size, with the {{.Index}} placeholders
+// in its templatedFields() replaced with that index.
+func (s *Server) expandArray(template *Job, size int) ([]*Job, error) {
+	if template == nil {
+		return nil, fmt.Errorf("no template job")
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("array size must be at least 1")
+	}
+
+	for _, field := range template.templatedFields() {
+		for _, match := range manifestPlaceholderRegex.FindAllStringSubmatch(*field, -1) {
+			if match[1] != arrayIndexPlaceholder {
+				return nil, fmt.Errorf("template placeholder {{%s}} is not {{%s}}", match[1], arrayIndexPlaceholder)
+			}
+		}
+	}
+
+	// the jobs must differ in the things that make up their keys
+	indexed := manifestPlaceholderRegex.MatchString(template.Cmd) || (template.CwdMatters && manifestPlaceholderRegex.MatchString(template.Cwd))
+	for _, step := range template.Steps {
+		if manifestPlaceholderRegex.MatchString(step) {
+			indexed = true
+		}
+	}
+	if !indexed && size > 1 {
+		return nil, fmt.Errorf("template Cmd has no {{%s}} placeholder, so its jobs would all be the same", arrayIndexPlaceholder)
+	}
+
+	return expandTemplate(s.ch, template, size, nil)
+}
+
+// expandTemplate returns count deep copies of the template job, with their
+// ArrayIndex set to their index, starting from 1, and the placeholders in
+// their templatedFields() replaced: {{.Index}} by their index, and any others
+// by the return value of column(index, placeholder name). The given codec
+// handle is used to deep copy the template.
+func expandTemplate(ch codec.Handle, template *Job, count int, column func(index int, name string) string) ([]*Job, error) {
+	// we deep copy the template for each job by decoding its encoding
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, ch)
+	err := enc.Encode(template)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, 0, count)
+	for index := 1; index <= count; index++ {
+		job := &Job{}
+		dec := codec.NewDecoderBytes(encoded, ch)
+		err = dec.Decode(job)
+		if err != nil {
+			return nil, err
+		}
+		job.ArrayIndex = index
+
+		for _, field := range job.templatedFields() {
+			*field = manifestPlaceholderRegex.ReplaceAllStringFunc(*field, func(placeholder string) string {
+				name := manifestPlaceholderRegex.FindStringSubmatch(placeholder)[1]
+				if name == arrayIndexPlaceholder {
+					return strconv.Itoa(index)
+				}
+				return column(index, name)
+			})
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
@@ -23,12 +23,14 @@ package jobqueue
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"sort"
 )
 
 // MountConfig struct is used for setting in a Job to specify that a remote file
 // system or object store should be fuse mounted prior to running the Job's Cmd.
-// Currently only supports S3-like object stores.
+// Supports S3-like object stores, Google Cloud Storage and Azure Blob storage
+// (see MountTarget.Backend).
 type MountConfig struct {
 	// Mount is the local directory on which to mount your Target(s). It can be
 	// (in) any directory you're able to write to. If the directory doesn't
@@ -66,6 +68,14 @@ type MountConfig struct {
 // MountTarget struct is used for setting in a MountConfig to define what you
 // want to access at your Mount.
 type MountTarget struct {
+	// Backend is the kind of object store Path is in: "s3" (the default if not
+	// supplied), "gcs" for Google Cloud Storage or "azure" for Azure Blob
+	// storage. The details of how Profile and Path are used for the latter two
+	// are given in the documentation for MountBackendGCS and
+	// MountBackendAzure; the rest of this documentation describes the S3
+	// case.
+	Backend string `json:",omitempty"`
+
 	// Profile is the S3 configuration profile name to use. If not supplied, the
 	// value of the $AWS_DEFAULT_PROFILE or $AWS_PROFILE environment variables
 	// is used, and if those are unset it defaults to "default".
@@ -136,6 +146,42 @@ type MountTarget struct {
 // MountConfigs is a slice of MountConfig.
 type MountConfigs []MountConfig
 
+// Validate checks that the MountConfigs make sense without trying to mount
+// anything: each must have Targets, each of those must have a Path and a known
+// Backend and only one can Write, and no two MountConfigs can share a Mount.
+func (mcs MountConfigs) Validate() error {
+	mounts := make(map[string]bool)
+	for i, mc := range mcs {
+		if len(mc.Targets) == 0 {
+			return fmt.Errorf("mount %d has no Targets", i+1)
+		}
+		if mc.Retries < 0 {
+			return fmt.Errorf("mount %d has negative Retries", i+1)
+		}
+		if mounts[mc.Mount] {
+			return fmt.Errorf("mount %d uses the same Mount [%s] as an earlier one", i+1, mc.Mount)
+		}
+		mounts[mc.Mount] = true
+
+		var writers int
+		for j, mt := range mc.Targets {
+			if mt.Path == "" {
+				return fmt.Errorf("target %d of mount %d has no Path", j+1, i+1)
+			}
+			if !validMountBackend(mt.Backend) {
+				return fmt.Errorf("target %d of mount %d has unknown Backend [%s]", j+1, i+1, mt.Backend)
+			}
+			if mt.Write {
+				writers++
+			}
+		}
+		if writers > 1 {
+			return fmt.Errorf("mount %d has %d writeable Targets, but only 1 is allowed", i+1, writers)
+		}
+	}
+	return nil
+}
+
 // String provides a JSON representation of the MountConfigs.
 func (mcs MountConfigs) String() string {
 	if len(mcs) == 0 {
@@ -151,8 +197,8 @@ func (mcs MountConfigs) String() string {
 
 // Key returns a string representation of the most critical parts of the config
 // that would make it different from other MountConfigs in practical terms of
-// what files are accessible from where: only Mount, Target.Profile and
-// Target.Path are considered. The order of Targets (but not of MountConfig) is
+// what files are accessible from where: only Mount, Target.Backend,
+// Target.Profile and Target.Path are considered. The order of Targets (but not of MountConfig) is
 // considered as well.
 func (mcs MountConfigs) Key() string {
 	if len(mcs) == 0 {
@@ -177,6 +223,10 @@ func (mcs MountConfigs) Key() string {
 		key.WriteString(":")
 
 		for _, t := range mc.Targets {
+			if t.Backend != "" && t.Backend != MountBackendS3 {
+				key.WriteString(t.Backend)
+				key.WriteString("+")
+			}
 			profile := t.Profile
 			if profile == "" {
 				profile = "default"
@@ -0,0 +1,656 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains an implementation of muxfys.RemoteAccessor for Azure Blob
+// storage, talking to its REST API directly.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/muxfys/v4"
+)
+
+const (
+	azureAPIVersion       = "2019-12-12"
+	azureBlobDomain       = "core.windows.net"
+	azureCopyPollInterval = 500 * time.Millisecond
+	azureListMax          = 5000
+)
+
+// azureBlockSize is the size of the blocks that large uploads are split in to.
+// (Azure allows 50000 blocks per blob, so this gives us a max of ~800GB.)
+var azureBlockSize = 16 * 1024 * 1024
+
+// azureConfig holds the details needed to access a container in Azure Blob
+// storage.
+type azureConfig struct {
+	// Endpoint is the blob service URL, eg.
+	// https://myaccount.blob.core.windows.net
+	Endpoint string
+
+	// Account is the storage account name.
+	Account string
+
+	// Key is the base64 encoded account key, and SAS is a shared access
+	// signature token; at most one of these is used, and public containers
+	// need neither.
+	Key string
+	SAS string
+
+	// Path is the container name, optionally followed by a sub-path.
+	Path string
+}
+
+// azureConfigFromEnvironment makes an azureConfig for accessing the given
+// container path with the given account, as per the MountBackendAzure docs.
+func azureConfigFromEnvironment(account, path string) (*azureConfig, error) {
+	if path == "" {
+		return nil, fmt.Errorf("azureConfigFromEnvironment requires a path")
+	}
+	c := &azureConfig{Path: path}
+
+	protocol, suffix := "https", azureBlobDomain
+	if cs := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); cs != "" {
+		for _, pair := range strings.Split(cs, ";") {
+			pos := strings.Index(pair, "=")
+			if pos < 1 {
+				continue
+			}
+			val := pair[pos+1:]
+			switch pair[:pos] {
+			case "DefaultEndpointsProtocol":
+				protocol = val
+			case "EndpointSuffix":
+				suffix = val
+			case "AccountName":
+				c.Account = val
+			case "AccountKey":
+				c.Key = val
+			case "SharedAccessSignature":
+				c.SAS = val
+			case "BlobEndpoint":
+				c.Endpoint = strings.TrimSuffix(val, "/")
+			}
+		}
+	}
+
+	if env := os.Getenv("AZURE_STORAGE_ACCOUNT"); env != "" {
+		c.Account = env
+	}
+	if env := os.Getenv("AZURE_STORAGE_KEY"); env != "" {
+		c.Key = env
+	}
+	if env := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); env != "" {
+		c.SAS = env
+	}
+	if account != "" {
+		c.Account = account
+	}
+
+	if c.Account == "" {
+		return nil, fmt.Errorf("no Azure storage account was specified")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, c.Account, suffix)
+	}
+	return c, nil
+}
+
+// azureError is returned by azureAccessor methods when Azure responds to a
+// request with an error.
+type azureError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+// Error implements the error interface.
+func (e *azureError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("azure error %d (%s): %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("azure error %d (%s)", e.StatusCode, e.Code)
+}
+
+// azureListResult is used to parse the response to a List Blobs request.
+type azureListResult struct {
+	Blobs struct {
+		Blob []struct {
+			Name       string
+			Properties struct {
+				LastModified  string `xml:"Last-Modified"`
+				ContentLength int64  `xml:"Content-Length"`
+				ContentMD5    string `xml:"Content-MD5"`
+			}
+		}
+		BlobPrefix []struct {
+			Name string
+		}
+	}
+	NextMarker string
+}
+
+// azureAccessor implements muxfys.RemoteAccessor for Azure Blob storage.
+type azureAccessor struct {
+	client    *http.Client
+	endpoint  *url.URL
+	account   string
+	key       []byte
+	sas       url.Values
+	container string
+	basePath  string
+	target    string
+}
+
+// newAzureAccessor creates an azureAccessor for the given config, and checks
+// that the container can be accessed.
+func newAzureAccessor(config *azureConfig) (*azureAccessor, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(strings.Trim(config.Path, "/"), "/")
+	a := &azureAccessor{
+		client:    &http.Client{},
+		endpoint:  endpoint,
+		account:   config.Account,
+		container: parts[0],
+		basePath:  path.Join(parts[1:]...),
+		target:    config.Endpoint + "/" + strings.Trim(config.Path, "/"),
+	}
+	if a.container == "" {
+		return nil, fmt.Errorf("no container could be determined from [%s]", config.Path)
+	}
+
+	switch {
+	case config.Key != "":
+		a.key, err = base64.StdEncoding.DecodeString(config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("the Azure storage account key is not valid base64: %s", err)
+		}
+	case config.SAS != "":
+		a.sas, err = url.ParseQuery(strings.TrimPrefix(config.SAS, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("the Azure SAS token is not valid: %s", err)
+		}
+	}
+
+	// test that we can actually access the container (credentials are ok?)
+	_, _, err = a.list(a.basePath, "", 1)
+	if err != nil {
+		err = fmt.Errorf("could not access Azure: %s", err)
+	}
+	return a, err
+}
+
+// url returns the URL of our container, or of the given blob in it if name is
+// not blank, with the given query.
+func (a *azureAccessor) url(name string, query url.Values) *url.URL {
+	u := *a.endpoint
+	u.Path = strings.TrimSuffix(a.endpoint.Path, "/") + "/" + a.container
+	u.RawPath = strings.TrimSuffix(a.endpoint.EscapedPath(), "/") + "/" + url.PathEscape(a.container)
+	if name != "" {
+		segments := strings.Split(name, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		u.Path += "/" + name
+		u.RawPath += "/" + strings.Join(segments, "/")
+	}
+
+	if query == nil {
+		query = url.Values{}
+	}
+	for key, vals := range a.sas {
+		query[key] = vals
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do carries out a request, signing it with our key if we have one. Responses
+// with a status code of 300 or more are turned in to an *azureError.
+func (a *azureAccessor) do(method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, vals := range header {
+		req.Header[key] = vals
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	if a.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+a.account+":"+a.signature(req))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	aerr := &azureError{StatusCode: resp.StatusCode, Code: resp.Header.Get("x-ms-error-code")}
+	data, _ := ioutil.ReadAll(resp.Body) // #nosec since we only want any error details
+	_ = resp.Body.Close()
+	var details struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), &details) == nil {
+		if aerr.Code == "" {
+			aerr.Code = details.Code
+		}
+		aerr.Message = details.Message
+	}
+	return nil, aerr
+}
+
+// signature calculates the Shared Key signature of the given request. See
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (a *azureAccessor) signature(req *http.Request) string {
+	var length string
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for key := range req.Header {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonicalHeaders strings.Builder
+	for _, key := range msHeaders {
+		canonicalHeaders.WriteString(key + ":" + strings.TrimSpace(req.Header.Get(key)) + "\n")
+	}
+
+	canonicalResource := "/" + a.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for key := range query {
+		params = append(params, key)
+	}
+	sort.Strings(params)
+	for _, key := range params {
+		vals := query[key]
+		sort.Strings(vals)
+		canonicalResource += "\n" + strings.ToLower(key) + ":" + strings.Join(vals, ",")
+	}
+
+	h := req.Header
+	toSign := strings.Join([]string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		length,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", // Date, which we supply as x-ms-date instead
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+		canonicalHeaders.String() + canonicalResource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(toSign)) // #nosec since hash writes never fail
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// list returns (up to max, if max is greater than 0) the blobs and virtual
+// directories directly within the given prefix, starting from the given
+// marker, along with the marker to get the next page of results.
+func (a *azureAccessor) list(prefix, marker string, max int) ([]muxfys.RemoteAttr, string, error) {
+	query := url.Values{
+		"restype":   {"container"},
+		"comp":      {"list"},
+		"delimiter": {"/"},
+	}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+	if max > 0 {
+		query.Set("maxresults", strconv.Itoa(max))
+	}
+
+	resp, err := a.do(http.MethodGet, a.url("", query), nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	errc := resp.Body.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	if errc != nil {
+		return nil, "", errc
+	}
+
+	var result azureListResult
+	err = xml.Unmarshal(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), &result)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ras := make([]muxfys.RemoteAttr, 0, len(result.Blobs.Blob)+len(result.Blobs.BlobPrefix))
+	for _, bp := range result.Blobs.BlobPrefix {
+		ras = append(ras, muxfys.RemoteAttr{Name: bp.Name})
+	}
+	for _, b := range result.Blobs.Blob {
+		ra := muxfys.RemoteAttr{
+			Name: b.Name,
+			Size: b.Properties.ContentLength,
+		}
+		if mtime, errp := time.Parse(http.TimeFormat, b.Properties.LastModified); errp == nil {
+			ra.MTime = mtime
+		}
+		if md5, errd := base64.StdEncoding.DecodeString(b.Properties.ContentMD5); errd == nil {
+			ra.MD5 = hex.EncodeToString(md5)
+		}
+		ras = append(ras, ra)
+	}
+	return ras, result.NextMarker, nil
+}
+
+// putBlob uploads data as a single block blob.
+func (a *azureAccessor) putBlob(data []byte, dest, contentType string) error {
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := a.do(http.MethodPut, a.url(dest, nil), header, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// upload uploads everything read from r to dest, in blocks if there's more than
+// one block's worth.
+func (a *azureAccessor) upload(r io.Reader, dest, contentType string) error {
+	buf := make([]byte, azureBlockSize)
+	var ids []string
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if i == 0 && err != nil {
+			return a.putBlob(buf[:n], dest, contentType)
+		}
+		if n == 0 {
+			break
+		}
+
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", i)))
+		resp, errp := a.do(http.MethodPut, a.url(dest, url.Values{"comp": {"block"}, "blockid": {id}}), nil, buf[:n])
+		if errp != nil {
+			return errp
+		}
+		if errp = resp.Body.Close(); errp != nil {
+			return errp
+		}
+		ids = append(ids, id)
+
+		if err != nil {
+			break
+		}
+	}
+
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range ids {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("x-ms-blob-content-type", contentType)
+	}
+	resp, err := a.do(http.MethodPut, a.url(dest, url.Values{"comp": {"blocklist"}}), header, list.Bytes())
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DownloadFile implements RemoteAccessor by getting the blob and writing it to
+// dest via a temporary file.
+func (a *azureAccessor) DownloadFile(source, dest string) (err error) {
+	resp, err := a.do(http.MethodGet, a.url(source, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errc := resp.Body.Close()
+		if err == nil {
+			err = errc
+		}
+	}()
+
+	err = os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return err
+	}
+	part := dest + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, resp.Body)
+	errc := f.Close()
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = fmt.Errorf("downloaded %d of %d bytes of %s", n, resp.ContentLength, source)
+	}
+	if err == nil {
+		err = errc
+	}
+	if err != nil {
+		_ = os.Remove(part)
+		return err
+	}
+	return os.Rename(part, dest)
+}
+
+// UploadFile implements RemoteAccessor by uploading the file's contents.
+func (a *azureAccessor) UploadFile(source, dest, contentType string) (err error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errc := f.Close()
+		if err == nil {
+			err = errc
+		}
+	}()
+	return a.upload(f, dest, contentType)
+}
+
+// UploadData implements RemoteAccessor by uploading data in blocks.
+func (a *azureAccessor) UploadData(data io.Reader, dest string) error {
+	return a.upload(data, dest, "")
+}
+
+// ListEntries implements RemoteAccessor by listing all the pages of blobs and
+// virtual directories directly within dir.
+func (a *azureAccessor) ListEntries(dir string) ([]muxfys.RemoteAttr, error) {
+	var all []muxfys.RemoteAttr
+	var marker string
+	for {
+		ras, next, err := a.list(dir, marker, azureListMax)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, ras...)
+		if next == "" {
+			return all, nil
+		}
+		marker = next
+	}
+}
+
+// OpenFile implements RemoteAccessor by getting the blob from the given
+// offset.
+func (a *azureAccessor) OpenFile(path string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("x-ms-range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := a.do(http.MethodGet, a.url(path, nil), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Seek implements RemoteAccessor by closing rc and opening the blob again at
+// the new offset.
+func (a *azureAccessor) Seek(path string, rc io.ReadCloser, offset int64) (io.ReadCloser, error) {
+	err := rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return a.OpenFile(path, offset)
+}
+
+// CopyFile implements RemoteAccessor by doing a server-side Copy Blob, waiting
+// for it to complete.
+func (a *azureAccessor) CopyFile(source, dest string) error {
+	header := http.Header{}
+	header.Set("x-ms-copy-source", a.url(source, nil).String())
+	resp, err := a.do(http.MethodPut, a.url(dest, nil), header, nil)
+	if err != nil {
+		return err
+	}
+	status := resp.Header.Get("x-ms-copy-status")
+	description := resp.Header.Get("x-ms-copy-status-description")
+	err = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	for {
+		switch status {
+		case "failed", "aborted":
+			return fmt.Errorf("copy of %s to %s %s: %s", source, dest, status, description)
+		case "pending":
+		default:
+			return nil
+		}
+
+		<-time.After(azureCopyPollInterval)
+		resp, err = a.do(http.MethodHead, a.url(dest, nil), nil, nil)
+		if err != nil {
+			return err
+		}
+		status = resp.Header.Get("x-ms-copy-status")
+		description = resp.Header.Get("x-ms-copy-status-description")
+		err = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DeleteFile implements RemoteAccessor by deleting the blob.
+func (a *azureAccessor) DeleteFile(path string) error {
+	resp, err := a.do(http.MethodDelete, a.url(path, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DeleteIncompleteUpload implements RemoteAccessor by deleting the blob if it
+// got created. (Uncommitted blocks are garbage collected by Azure after a
+// week.)
+func (a *azureAccessor) DeleteIncompleteUpload(path string) error {
+	err := a.DeleteFile(path)
+	if a.ErrorIsNotExists(err) {
+		return nil
+	}
+	return err
+}
+
+// ErrorIsNotExists implements RemoteAccessor by looking for the BlobNotFound
+// error code.
+func (a *azureAccessor) ErrorIsNotExists(err error) bool {
+	aerr, ok := err.(*azureError)
+	return ok && (aerr.Code == "BlobNotFound" || (aerr.Code == "" && aerr.StatusCode == http.StatusNotFound))
+}
+
+// ErrorIsNoQuota implements RemoteAccessor. Azure Blob storage has no
+// per-user quotas, so this always returns false.
+func (a *azureAccessor) ErrorIsNoQuota(err error) bool {
+	return false
+}
+
+// Target implements RemoteAccessor by returning the URL of the container and
+// path we were configured with.
+func (a *azureAccessor) Target() string {
+	return a.target
+}
+
+// RemotePath implements RemoteAccessor by using the initially configured base
+// path.
+func (a *azureAccessor) RemotePath(relPath string) string {
+	return filepath.Join(a.basePath, relPath)
+}
+
+// LocalPath implements RemoteAccessor by including the endpoint and container
+// in the return value.
+func (a *azureAccessor) LocalPath(baseDir, remotePath string) string {
+	return filepath.Join(baseDir, a.endpoint.Host, a.endpoint.Path, a.container, remotePath)
+}
@@ -0,0 +1,153 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for choosing which kind of object store a
+// MountTarget accesses, and for configuring access to the non-S3 ones.
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/VertebrateResequencing/muxfys/v4"
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/go-ini/ini"
+)
+
+const (
+	// MountBackendS3 is the default MountTarget.Backend, for accessing S3-like
+	// object stores. See MountTarget for how it is configured.
+	MountBackendS3 = "s3"
+
+	// MountBackendGCS is the MountTarget.Backend for accessing Google Cloud
+	// Storage, via its S3-compatible XML API. Path is the name of your GCS
+	// bucket, optionally followed by sub-directory names. Access requires an
+	// HMAC key (see https://cloud.google.com/storage/docs/authentication/hmackeys),
+	// which is taken from the gs_access_key_id and gs_secret_access_key options
+	// of the Profile section (default "Credentials") of gsutil's config file,
+	// found at $BOTO_CONFIG, or ~/.boto if that is unset. The gs_host option
+	// of that section can be used to specify a domain other than
+	// storage.googleapis.com. If set, the environment variables
+	// $GS_ACCESS_KEY_ID and $GS_SECRET_ACCESS_KEY override the config file.
+	// With no key, only public buckets can be read.
+	MountBackendGCS = "gcs"
+
+	// MountBackendAzure is the MountTarget.Backend for accessing Azure Blob
+	// storage. Path is the name of your container, optionally followed by
+	// sub-directory names. Profile is the name of your storage account; if not
+	// supplied, $AZURE_STORAGE_ACCOUNT is used. Access is authorised with the
+	// account's key from $AZURE_STORAGE_KEY, or if that is unset a SAS token
+	// from $AZURE_STORAGE_SAS_TOKEN. Alternatively, all of these can be given
+	// by $AZURE_STORAGE_CONNECTION_STRING, which can also specify a non-
+	// standard BlobEndpoint (eg. for the Azurite emulator). With neither key
+	// nor token, only public containers can be read.
+	MountBackendAzure = "azure"
+
+	gcsDefaultDomain  = "storage.googleapis.com"
+	gcsDefaultProfile = "Credentials"
+)
+
+// validMountBackend tells you if the given MountTarget.Backend is one we
+// support.
+func validMountBackend(backend string) bool {
+	switch backend {
+	case "", MountBackendS3, MountBackendGCS, MountBackendAzure:
+		return true
+	}
+	return false
+}
+
+// Accessor returns a muxfys.RemoteAccessor that can access the object store
+// this MountTarget describes, with credentials taken from the environment as
+// per the documentation of its Backend.
+func (mt MountTarget) Accessor() (muxfys.RemoteAccessor, error) {
+	switch mt.Backend {
+	case "", MountBackendS3:
+		accessorConfig, err := muxfys.S3ConfigFromEnvironment(mt.Profile, mt.Path)
+		if err != nil {
+			return nil, err
+		}
+		return muxfys.NewS3Accessor(accessorConfig)
+	case MountBackendGCS:
+		accessorConfig, err := gcsConfigFromEnvironment(mt.Profile, mt.Path)
+		if err != nil {
+			return nil, err
+		}
+		return muxfys.NewS3Accessor(accessorConfig)
+	case MountBackendAzure:
+		config, err := azureConfigFromEnvironment(mt.Profile, mt.Path)
+		if err != nil {
+			return nil, err
+		}
+		return newAzureAccessor(config)
+	}
+	return nil, fmt.Errorf("unknown mount Backend [%s]", mt.Backend)
+}
+
+// gcsConfigFromEnvironment makes a muxfys.S3Config for accessing the given
+// bucket path in Google Cloud Storage, as per the MountBackendGCS docs.
+func gcsConfigFromEnvironment(profile, path string) (*muxfys.S3Config, error) {
+	if path == "" {
+		return nil, fmt.Errorf("gcsConfigFromEnvironment requires a path")
+	}
+	profileSpecified := profile != ""
+	if !profileSpecified {
+		profile = gcsDefaultProfile
+	}
+
+	botoConfig := os.Getenv("BOTO_CONFIG")
+	if botoConfig == "" {
+		botoConfig = "~/.boto"
+	}
+	cfg, err := ini.LooseLoad(internal.TildaToHome(botoConfig))
+	if err != nil {
+		return nil, fmt.Errorf("gcsConfigFromEnvironment() loading of %s failed: %s", botoConfig, err)
+	}
+
+	domain := gcsDefaultDomain
+	var key, secret string
+	section, err := cfg.GetSection(profile)
+	if err == nil {
+		domain = section.Key("gs_host").MustString(domain)
+		key = section.Key("gs_access_key_id").String()
+		secret = section.Key("gs_secret_access_key").String()
+	} else if profileSpecified {
+		return nil, fmt.Errorf("gcsConfigFromEnvironment could not find section %s in %s", profile, botoConfig)
+	}
+
+	if env := os.Getenv("GS_ACCESS_KEY_ID"); env != "" {
+		key = env
+	}
+	if env := os.Getenv("GS_SECRET_ACCESS_KEY"); env != "" {
+		secret = env
+	}
+
+	u := &url.URL{
+		Scheme: "https",
+		Host:   domain,
+		Path:   path,
+	}
+
+	return &muxfys.S3Config{
+		Target:    u.String(),
+		AccessKey: key,
+		SecretKey: secret,
+	}, nil
+}
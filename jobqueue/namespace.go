@@ -0,0 +1,321 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets several teams share one manager by
+// partitioning their jobs in to separate namespaces.
+//
+// Clients that have called SetNamespace() send their namespace with every
+// request. The server qualifies the RepGroups, DepGroups, LimitGroups and
+// IdempotencyKeys of the request by prefixing them with the namespace, so that
+// everything the server keys on those names (limits, run windows, resource
+// recommendations, dependencies, affinities and so on) is naturally kept
+// separate. Job keys incorporate the namespace, so the same command added in 2
+// namespaces results in 2 different jobs. Responses have jobs from other
+// namespaces removed and the prefixes stripped again, so a namespaced client
+// sees the names it used. Clients without a namespace see everything, with
+// names of namespaced jobs shown in their qualified form.
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// namespaceSeparator separates a namespace from the name it qualifies.
+const namespaceSeparator = "/"
+
+// validNamespace matches the namespace names we allow, which are used in
+// scheduler groups and so must be safe to appear in shell commands.
+var validNamespace = regexp.MustCompile(`^[\w.-]+$`)
+
+// namespaced returns the given name qualified by the given namespace. Names
+// that are already qualified and blank namespaces result in an unchanged name.
+func namespaced(namespace, name string) string {
+	if namespace == "" || strings.HasPrefix(name, namespace+namespaceSeparator) {
+		return name
+	}
+	return namespace + namespaceSeparator + name
+}
+
+// unnamespaced is the reverse of namespaced().
+func unnamespaced(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, namespace+namespaceSeparator)
+}
+
+// namespacedSlice applies namespaced() or unnamespaced() to each of the given
+// names, returning a new slice.
+func namespacedSlice(namespace string, names []string, qualify bool) []string {
+	if names == nil {
+		return nil
+	}
+	fn := unnamespaced
+	if qualify {
+		fn = namespaced
+	}
+	qualified := make([]string, len(names))
+	for i, name := range names {
+		qualified[i] = fn(namespace, name)
+	}
+	return qualified
+}
+
+// namespacedKey converts a job key in to the key of the same job in the given
+// namespace.
+func namespacedKey(namespace, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return byteKey([]byte(namespace + namespaceSeparator + key))
+}
+
+// namespaced returns new Dependencies with their DepGroups qualified (or
+// unqualified if qualify is false) by the given namespace, and with
+// Essence-based dependencies (including those on job Names) referring to jobs
+// in that namespace.
+func (d Dependencies) namespaced(namespace string, qualify bool) Dependencies {
+	if d == nil {
+		return nil
+	}
+	deps := make(Dependencies, len(d))
+	for i, dep := range d {
+		newDep := &Dependency{Essence: dep.Essence}
+		if dep.DepGroup != "" {
+			if qualify {
+				newDep.DepGroup = namespaced(namespace, dep.DepGroup)
+			} else {
+				newDep.DepGroup = unnamespaced(namespace, dep.DepGroup)
+			}
+		}
+		if qualify && dep.Essence != nil && dep.Essence.Namespace == "" {
+			essence := *dep.Essence
+			essence.Namespace = namespace
+			newDep.Essence = &essence
+		}
+		deps[i] = newDep
+	}
+	return deps
+}
+
+// setNamespace puts a Job that a client wants to add in to the given namespace,
+// qualifying all the names it has. You should do this before the Job is added
+// to the queue, since it changes the Job's Key().
+func (j *Job) setNamespace(namespace string) {
+	j.Lock()
+	defer j.Unlock()
+	j.Namespace = namespace
+	j.RepGroup = namespaced(namespace, j.RepGroup)
+	j.LimitGroups = namespacedSlice(namespace, j.LimitGroups, true)
+	j.DepGroups = namespacedSlice(namespace, j.DepGroups, true)
+	j.Dependencies = j.Dependencies.namespaced(namespace, true)
+	if j.SameHostAs != "" {
+		j.SameHostAs = namespaced(namespace, j.SameHostAs)
+	}
+	if j.AvoidRepGroup != "" {
+		j.AvoidRepGroup = namespaced(namespace, j.AvoidRepGroup)
+	}
+	if j.IdempotencyKey != "" {
+		j.IdempotencyKey = namespaced(namespace, j.IdempotencyKey)
+	}
+	if j.Name != "" {
+		j.Name = namespaced(namespace, j.Name)
+	}
+}
+
+// stripNamespace unqualifies the names of a Job that is about to be returned
+// to a client in the given namespace. Only call this on copies of our real
+// Jobs, such as those made by itemToJob().
+func (j *Job) stripNamespace(namespace string) {
+	j.RepGroup = unnamespaced(namespace, j.RepGroup)
+	j.LimitGroups = namespacedSlice(namespace, j.LimitGroups, false)
+	j.DepGroups = namespacedSlice(namespace, j.DepGroups, false)
+	j.Dependencies = j.Dependencies.namespaced(namespace, false)
+	j.SameHostAs = unnamespaced(namespace, j.SameHostAs)
+	j.AvoidRepGroup = unnamespaced(namespace, j.AvoidRepGroup)
+	j.IdempotencyKey = unnamespaced(namespace, j.IdempotencyKey)
+	j.Name = unnamespaced(namespace, j.Name)
+}
+
+// namespaceRequest qualifies the names in a request from a client in a
+// namespace. Jobs being added are handled separately with setNamespace(), once
+// they have been decompressed.
+func (s *Server) namespaceRequest(cr *clientRequest) {
+	ns := cr.Namespace
+	if cr.Job != nil {
+		if cr.Job.Namespace == "" {
+			cr.Job.Namespace = ns
+		}
+		if cr.Job.RepGroup != "" {
+			cr.Job.RepGroup = namespaced(ns, cr.Job.RepGroup)
+		}
+	}
+	cr.RepGroups = namespacedSlice(ns, cr.RepGroups, true)
+	if cr.LimitGroup != "" {
+		cr.LimitGroup = namespaced(ns, cr.LimitGroup)
+	}
+	if cr.Secret != nil && cr.Secret.Name != "" {
+		cr.Secret.Name = namespaced(ns, cr.Secret.Name)
+	}
+	if cr.Modifier != nil {
+		cr.Modifier.LimitGroups = namespacedSlice(ns, cr.Modifier.LimitGroups, true)
+		cr.Modifier.DepGroups = namespacedSlice(ns, cr.Modifier.DepGroups, true)
+		cr.Modifier.Dependencies = cr.Modifier.Dependencies.namespaced(ns, true)
+	}
+
+	switch cr.Method {
+	case "jmod", "jkick", "jdel", "jdelbg", "jkill":
+		cr.Keys = s.keysInNamespace(cr.Keys, ns)
+	}
+}
+
+// keysInNamespace filters out the keys of jobs in the queue that belong to
+// some other namespace, so that clients can't act on other namespaces' jobs.
+func (s *Server) keysInNamespace(keys []string, namespace string) []string {
+	if keys == nil {
+		return nil
+	}
+	filtered := make([]string, 0, len(keys))
+	for _, key := range keys {
+		item, err := s.q.Get(key)
+		if err == nil && item != nil {
+			if job, ok := item.Data().(*Job); ok && job.getNamespace() != namespace {
+				continue
+			}
+		}
+		filtered = append(filtered, key)
+	}
+	return filtered
+}
+
+// jobsInNamespace returns the subset of the given jobs that are in the given
+// namespace.
+func jobsInNamespace(jobs []*Job, namespace string) []*Job {
+	filtered := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.getNamespace() == namespace {
+			filtered = append(filtered, job)
+		}
+	}
+	return filtered
+}
+
+// namespaceResponse removes anything from a response that belongs to some
+// namespace other than the given one, and unqualifies the names of what
+// remains.
+func (s *Server) namespaceResponse(sr *serverResponse, namespace string) {
+	if sr.Job != nil {
+		sr.Job.stripNamespace(namespace)
+	}
+
+	if sr.Jobs != nil {
+		sr.Jobs = jobsInNamespace(sr.Jobs, namespace)
+		for _, job := range sr.Jobs {
+			job.stripNamespace(namespace)
+		}
+	}
+
+	for _, rgs := range sr.RGStates {
+		rgs.RepGroup = unnamespaced(namespace, rgs.RepGroup)
+	}
+
+	for _, cluster := range sr.Clusters {
+		cluster.RepGroups = namespacedSlice(namespace, cluster.RepGroups, false)
+	}
+
+	if sr.Schedules != nil {
+		sr.Schedules = schedulesInNamespace(sr.Schedules, namespace)
+	}
+
+	if sr.Workflows != nil {
+		sr.Workflows = workflowsInNamespace(sr.Workflows, namespace)
+	}
+
+	if sr.Usage != nil {
+		sr.Usage = usageInNamespace(sr.Usage, namespace)
+	}
+
+	if sr.RGRec != nil {
+		rec := *sr.RGRec
+		rec.RepGroup = unnamespaced(namespace, rec.RepGroup)
+		sr.RGRec = &rec
+	}
+
+	if sr.StateCounts != nil {
+		prefix := namespace + namespaceSeparator
+		counts := make([]*JobStateCount, 0, len(sr.StateCounts))
+		for _, count := range sr.StateCounts {
+			switch {
+			case count.RepGroup == "+all+":
+				counts = append(counts, count)
+			case strings.HasPrefix(count.RepGroup, prefix):
+				counts = append(counts, &JobStateCount{
+					RepGroup:  unnamespaced(namespace, count.RepGroup),
+					FromState: count.FromState,
+					ToState:   count.ToState,
+					Count:     count.Count,
+				})
+			}
+		}
+		sr.StateCounts = counts
+	}
+}
+
+// namespaceMatch returns a queue.Match that only matches items of jobs in the
+// given namespace, or nil if namespace is blank.
+func namespaceMatch(namespace string) queue.Match {
+	if namespace == "" {
+		return nil
+	}
+	return func(item *queue.Item) bool {
+		job, ok := item.Data().(*Job)
+		if !ok {
+			return true
+		}
+		return job.getNamespace() == namespace
+	}
+}
+
+// matchAll returns a queue.Match that only matches items that all the given
+// non-nil matches match, or nil if they are all nil.
+func matchAll(matches ...queue.Match) queue.Match {
+	var ms []queue.Match
+	for _, m := range matches {
+		if m != nil {
+			ms = append(ms, m)
+		}
+	}
+	switch len(ms) {
+	case 0:
+		return nil
+	case 1:
+		return ms[0]
+	}
+	return func(item *queue.Item) bool {
+		for _, m := range ms {
+			if !m(item) {
+				return false
+			}
+		}
+		return true
+	}
+}
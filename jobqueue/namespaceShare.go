@@ -0,0 +1,170 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that apportions capacity between namespaces
+// according to their relative weights.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// namespaceUsage counts the jobs of a namespace that are ready to run and
+// running.
+type namespaceUsage struct {
+	ready   int
+	running int
+}
+
+// ParseNamespaceWeights parses a comma separated list of namespace=weight
+// pairs, eg. "prod=80,dev=20", in to NamespaceWeights suitable for supplying
+// to ServerConfig.
+func ParseNamespaceWeights(spec string) (map[string]int, error) {
+	var weights map[string]int
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		pos := strings.LastIndex(pair, "=")
+		if pos < 1 {
+			return nil, fmt.Errorf("namespace weight [%s] is not of the form namespace=weight", pair)
+		}
+		weight, err := strconv.Atoi(pair[pos+1:])
+		if err != nil {
+			return nil, fmt.Errorf("namespace weight [%s] does not end in an integer", pair)
+		}
+		if weights == nil {
+			weights = make(map[string]int)
+		}
+		weights[pair[:pos]] = weight
+	}
+	return weights, nil
+}
+
+// validateNamespaceWeights checks that the given weights are for valid
+// namespaces and are positive.
+func validateNamespaceWeights(weights map[string]int) error {
+	for namespace, weight := range weights {
+		if !validNamespace.MatchString(namespace) {
+			return fmt.Errorf("namespace weight has an invalid namespace [%s]", namespace)
+		}
+		if weight < 1 {
+			return fmt.Errorf("namespace weight for [%s] must be at least 1", namespace)
+		}
+	}
+	return nil
+}
+
+// noteNamespaceTransition is subscribed to all our queue's changes, and keeps
+// count of how many jobs of each namespace are ready and running.
+func (s *Server) noteNamespaceTransition(from, to queue.SubQueue, data []interface{}) {
+	if from != queue.SubQueueReady && from != queue.SubQueueRun && to != queue.SubQueueReady && to != queue.SubQueueRun {
+		return
+	}
+
+	s.nsmutex.Lock()
+	defer s.nsmutex.Unlock()
+	for _, inter := range data {
+		job, ok := inter.(*Job)
+		if !ok {
+			continue
+		}
+		namespace := job.getNamespace()
+		usage, exists := s.nsUsage[namespace]
+		if !exists {
+			usage = &namespaceUsage{}
+			s.nsUsage[namespace] = usage
+		}
+
+		switch from {
+		case queue.SubQueueReady:
+			usage.ready--
+		case queue.SubQueueRun:
+			usage.running--
+		}
+		switch to {
+		case queue.SubQueueReady:
+			usage.ready++
+		case queue.SubQueueRun:
+			usage.running++
+		}
+
+		if usage.ready <= 0 && usage.running <= 0 {
+			delete(s.nsUsage, namespace)
+		}
+	}
+}
+
+// namespaceShareMatch returns a queue.Match that doesn't match jobs in
+// namespaces that are getting more than their share of capacity (according to
+// our namespaceWeights) while another weighted namespace has jobs ready to
+// run. Returns nil if we have no namespaceWeights.
+func (s *Server) namespaceShareMatch() queue.Match {
+	s.tmutex.RLock()
+	weights := s.namespaceWeights
+	s.tmutex.RUnlock()
+	if len(weights) == 0 {
+		return nil
+	}
+
+	return func(item *queue.Item) bool {
+		job, ok := item.Data().(*Job)
+		if !ok {
+			return true
+		}
+		s.nsmutex.RLock()
+		defer s.nsmutex.RUnlock()
+		return !overShare(job.getNamespace(), weights, s.nsUsage)
+	}
+}
+
+// overShare tells you if the given namespace is using more than its share of
+// capacity compared to some other weighted namespace that has jobs ready to
+// run: that is, if that other namespace has fewer running jobs per unit of
+// weight. Namespaces without a weight are never over their share.
+func overShare(namespace string, weights map[string]int, usage map[string]*namespaceUsage) bool {
+	weight, weighted := weights[namespace]
+	if !weighted {
+		return false
+	}
+	var running int
+	if u, exists := usage[namespace]; exists {
+		running = u.running
+	}
+
+	for other, otherWeight := range weights {
+		if other == namespace {
+			continue
+		}
+		u, exists := usage[other]
+		if !exists || u.ready <= 0 {
+			continue
+		}
+		if u.running*weight < running*otherWeight {
+			return true
+		}
+	}
+	return false
+}
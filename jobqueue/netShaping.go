@@ -0,0 +1,404 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for capping the network bandwidth of running
+// Cmds, for jobs with NetworkCap set.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// netShapeMajor is the handle of the htb qdisc we add to the default
+	// network interface when it only has the kernel's default root qdisc, and
+	// so the major part of our net_cls classids.
+	netShapeMajor = 0x10
+
+	// netShapeMaxMinor is the largest tc class minor number.
+	netShapeMaxMinor = 0xffff
+
+	// netShapePrefix prefixes the names of the net_cls cgroups we create.
+	netShapePrefix = "wr_"
+)
+
+// netClsRoot is where the net_cls cgroup hierarchy is mounted. It is a
+// variable only for testing purposes.
+var netClsRoot = "/sys/fs/cgroup/net_cls"
+
+// netShapeStateFile is where we record, for every process on this host, how we
+// have set up tc, so that we can restore things once nothing is capped. It is
+// a variable only for testing purposes.
+var netShapeStateFile = "/run/wr_net_shaping.json"
+
+// tcOutput runs tc with the given args, returning its combined output. It is a
+// variable only for testing purposes.
+var tcOutput = func(args ...string) ([]byte, error) {
+	return exec.Command("tc", args...).CombinedOutput() // #nosec
+}
+
+// netShapeIface is our record of how we've set up tc on a network interface.
+type netShapeIface struct {
+	// Major is the handle of the htb qdisc our classes are under.
+	Major int
+
+	// OwnRoot is true if we added that qdisc in place of the kernel's default
+	// root qdisc, in which case we delete it again when we're done, which
+	// restores the default.
+	OwnRoot bool
+
+	// OwnFilter is true if we added the cgroup filter to an htb qdisc that was
+	// already there, in which case we delete it again when we're done.
+	OwnFilter bool
+
+	// Minors are the class minor numbers we've allocated, keyed on the pid of
+	// the process whose bandwidth they cap.
+	Minors map[int]int
+}
+
+// netShaper caps the outgoing bandwidth of a process (and the children it
+// starts after being capped) by putting it in its own net_cls cgroup, whose
+// traffic is classified by tc in to an htb class with the desired rate.
+type netShaper struct {
+	iface     string
+	pid       int
+	major     int
+	minor     int
+	cgroupDir string
+}
+
+// shapeNetwork caps the outgoing bandwidth of the process with the given pid
+// to the given number of megabits per second. This requires the ability to run
+// tc and to create cgroups (eg. running as root), with the net_cls cgroup
+// hierarchy mounted at netClsRoot. Incoming traffic is not capped.
+//
+// If the default network interface has an htb root qdisc, our class is added
+// under it. If it only has the kernel's default root qdisc, it is replaced with
+// an htb one until nothing is capped any more. Any other root qdisc is left
+// alone and an error returned.
+//
+// Call remove() on the returned netShaper after the process exits.
+func shapeNetwork(pid, mbps int) (*netShaper, error) {
+	if mbps < 1 {
+		return nil, fmt.Errorf("bandwidth must be at least 1 megabit/s")
+	}
+
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	iface, err := defaultNetInterface(f)
+	errc := f.Close()
+	if err == nil {
+		err = errc
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	n := &netShaper{
+		iface:     iface,
+		pid:       pid,
+		cgroupDir: filepath.Join(netClsRoot, netShapePrefix+strconv.Itoa(pid)),
+	}
+
+	err = updateNetShapeState(func(state map[string]*netShapeIface) error {
+		is, errs := setUpNetShaping(iface, state[iface])
+		if errs != nil {
+			return errs
+		}
+		state[iface] = is
+		reclaimNetShapeMinors(iface, is)
+
+		n.major = is.Major
+		n.minor, errs = allocateNetShapeMinor(iface, is)
+		if errs != nil && len(is.Minors) == 0 {
+			delete(state, iface)
+			if errt := teardownNetShaping(iface, is); errt != nil {
+				errs = fmt.Errorf("%w (and restoring qdiscs failed: %s)", errs, errt)
+			}
+		}
+		if errs != nil {
+			return errs
+		}
+		is.Minors[pid] = n.minor
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = runTC("class", "replace", "dev", iface, "parent", fmt.Sprintf("%x:", n.major), "classid", n.classID(), "htb", "rate", fmt.Sprintf("%dmbit", mbps))
+	if err == nil {
+		err = os.MkdirAll(n.cgroupDir, 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(n.cgroupDir, "net_cls.classid"), []byte(netClsClassID(n.major, n.minor)), 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(n.cgroupDir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+	}
+	if err != nil {
+		if errr := n.remove(); errr != nil {
+			err = fmt.Errorf("%w (and cleaning up failed: %s)", err, errr)
+		}
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// classID returns our tc classid, eg. 10:1a2b.
+func (n *netShaper) classID() string {
+	return fmt.Sprintf("%x:%x", n.major, n.minor)
+}
+
+// remove deletes our tc class and cgroup, returning our class minor number to
+// the pool. If nothing else is capped, the interface's qdiscs are restored to
+// how they were before we started. The process we capped should have exited
+// first.
+func (n *netShaper) remove() error {
+	errt := runTC("class", "del", "dev", n.iface, "classid", n.classID())
+	errc := os.Remove(n.cgroupDir)
+	if errc != nil && os.IsNotExist(errc) {
+		errc = nil
+	}
+
+	erru := updateNetShapeState(func(state map[string]*netShapeIface) error {
+		is := state[n.iface]
+		if is == nil {
+			return nil
+		}
+		if is.Minors[n.pid] == n.minor {
+			delete(is.Minors, n.pid)
+		}
+		reclaimNetShapeMinors(n.iface, is)
+		if len(is.Minors) == 0 {
+			delete(state, n.iface)
+			return teardownNetShaping(n.iface, is)
+		}
+		return nil
+	})
+
+	if errt != nil {
+		return errt
+	}
+	if errc != nil {
+		return errc
+	}
+	return erru
+}
+
+// updateNetShapeState calls the given function with the contents of
+// netShapeStateFile, keyed on network interface, then stores any changes it
+// made. Only one process on the host can do this at a time. If the function
+// returns an error, that is returned and the changes are still stored.
+func updateNetShapeState(fn func(map[string]*netShapeIface) error) (err error) {
+	unlock, err := lockFile(netShapeStateFile+".lock", true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if erru := unlock(); erru != nil && err == nil {
+			err = erru
+		}
+	}()
+
+	state := make(map[string]*netShapeIface)
+	var content []byte
+	content, err = ioutil.ReadFile(netShapeStateFile)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(content, &state); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	errf := fn(state)
+
+	content, err = json.Marshal(state)
+	if err == nil {
+		err = ioutil.WriteFile(netShapeStateFile, content, 0600)
+	}
+	if errf != nil {
+		return errf
+	}
+	return err
+}
+
+// setUpNetShaping makes sure the given interface has an htb root qdisc with a
+// cgroup filter, returning our updated record of it (which is nil if we
+// haven't set it up before).
+func setUpNetShaping(iface string, is *netShapeIface) (*netShapeIface, error) {
+	out, err := tcOutput("qdisc", "show", "dev", iface)
+	if err != nil {
+		return nil, fmt.Errorf("tc qdisc show dev %s failed: %w (%s)", iface, err, strings.TrimSpace(string(out)))
+	}
+	kind, handle := rootQdisc(string(out))
+
+	switch {
+	case kind == "htb" && is != nil:
+		return is, nil
+	case kind == "htb":
+		major, errp := strconv.ParseInt(strings.TrimSuffix(handle, ":"), 16, 32)
+		if errp != nil {
+			return nil, fmt.Errorf("could not parse the handle of the root qdisc of %s: %w", iface, errp)
+		}
+		is = &netShapeIface{Major: int(major), Minors: make(map[int]int)}
+	case handle == "0:" || handle == "":
+		// the kernel's default, which deleting our own root qdisc will restore
+		is = &netShapeIface{Major: netShapeMajor, OwnRoot: true, Minors: make(map[int]int)}
+		err = runTC("qdisc", "add", "dev", iface, "root", "handle", fmt.Sprintf("%x:", netShapeMajor), "htb")
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s has a %s root qdisc, which we won't replace to cap bandwidth", iface, kind)
+	}
+
+	major := fmt.Sprintf("%x:", is.Major)
+	out, err = tcOutput("filter", "show", "dev", iface, "parent", major)
+	if err == nil && strings.Contains(string(out), "cgroup") {
+		return is, nil
+	}
+	err = runTC("filter", "add", "dev", iface, "parent", major, "protocol", "ip", "prio", "10", "handle", "1:", "cgroup")
+	if err != nil {
+		if errt := teardownNetShaping(iface, is); errt != nil {
+			err = fmt.Errorf("%w (and restoring qdiscs failed: %s)", err, errt)
+		}
+		return nil, err
+	}
+	is.OwnFilter = !is.OwnRoot
+	return is, nil
+}
+
+// teardownNetShaping undoes what setUpNetShaping() did to the given interface.
+func teardownNetShaping(iface string, is *netShapeIface) error {
+	major := fmt.Sprintf("%x:", is.Major)
+	switch {
+	case is.OwnRoot:
+		return runTC("qdisc", "del", "dev", iface, "root")
+	case is.OwnFilter:
+		return runTC("filter", "del", "dev", iface, "parent", major, "protocol", "ip", "prio", "10", "handle", "1:", "cgroup")
+	}
+	return nil
+}
+
+// rootQdisc returns the kind and handle of the root qdisc in the given output
+// of tc qdisc show.
+func rootQdisc(out string) (kind, handle string) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 3 && fields[0] == "qdisc" && fields[3] == "root" {
+			return fields[1], fields[2]
+		}
+	}
+	return "", ""
+}
+
+// reclaimNetShapeMinors returns to the pool the class minor numbers of
+// processes that have exited without remove() being called, deleting their
+// classes and cgroups if they still exist.
+func reclaimNetShapeMinors(iface string, is *netShapeIface) {
+	for pid, minor := range is.Minors {
+		if syscall.Kill(pid, 0) != syscall.ESRCH {
+			continue
+		}
+		stale := &netShaper{iface: iface, major: is.Major, minor: minor}
+		runTC("class", "del", "dev", iface, "classid", stale.classID())        // #nosec nothing useful to do if it was already gone
+		os.Remove(filepath.Join(netClsRoot, netShapePrefix+strconv.Itoa(pid))) // #nosec nothing useful to do if it was already gone
+		delete(is.Minors, pid)
+	}
+}
+
+// allocateNetShapeMinor returns the lowest class minor number that neither we
+// nor anything else is using for a class under our htb qdisc.
+func allocateNetShapeMinor(iface string, is *netShapeIface) (int, error) {
+	used := make(map[int]bool)
+	for _, minor := range is.Minors {
+		used[minor] = true
+	}
+
+	out, err := tcOutput("class", "show", "dev", iface)
+	if err != nil {
+		return 0, fmt.Errorf("tc class show dev %s failed: %w (%s)", iface, err, strings.TrimSpace(string(out)))
+	}
+	prefix := fmt.Sprintf("%x:", is.Major)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "class" || !strings.HasPrefix(fields[2], prefix) {
+			continue
+		}
+		minor, errp := strconv.ParseInt(strings.TrimPrefix(fields[2], prefix), 16, 32)
+		if errp == nil {
+			used[int(minor)] = true
+		}
+	}
+
+	for minor := 1; minor <= netShapeMaxMinor; minor++ {
+		if !used[minor] {
+			return minor, nil
+		}
+	}
+	return 0, fmt.Errorf("all tc classes of %s are in use", iface)
+}
+
+// netClsClassID returns the value to write to a net_cls.classid file so that
+// traffic is classified in to the tc class with the given major and minor
+// numbers.
+func netClsClassID(major, minor int) string {
+	return fmt.Sprintf("0x%04x%04x", major, minor)
+}
+
+// defaultNetInterface returns the name of the interface of the default route
+// in the given /proc/net/route content.
+func defaultNetInterface(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no default network route found")
+}
+
+// runTC runs tc with the given args.
+func runTC(args ...string) error {
+	out, err := tcOutput(args...)
+	if err != nil {
+		return fmt.Errorf("tc %s failed: %w (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for telling people, by webhook, Slack or email,
+// when all the jobs of a RepGroup have finished.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// NotifyEvent* constants are the Events of RepGroupSummaries.
+const (
+	// NotifyEventComplete is sent to NotifyComplete targets when all the jobs
+	// of a RepGroup completed.
+	NotifyEventComplete = "complete"
+
+	// NotifyEventFailure is sent to NotifyFailure targets when all the jobs of
+	// a RepGroup finished, but some of them got buried.
+	NotifyEventFailure = "failure"
+)
+
+const (
+	notifySlackPrefix = "slack:"
+	notifyMailPrefix  = "mailto:"
+)
+
+// NotifyTimeout is how long we wait for notification webhooks and mail servers
+// to respond. It is a variable only for testing purposes.
+var NotifyTimeout = 10 * time.Second
+
+// RepGroupSummary describes the jobs of a RepGroup once they have all
+// finished. It is what is POSTed as JSON to http(s) notification targets (see
+// ServerConfig.NotifyComplete).
+type RepGroupSummary struct {
+	Event    string
+	RepGroup string
+	Time     time.Time
+
+	// Total is the number of jobs in the RepGroup, and States counts them by
+	// JobState (which will only be complete and buried).
+	Total  int
+	States map[JobState]int
+
+	// FailReasons counts the buried jobs by their FailReason.
+	FailReasons map[string]int
+}
+
+// String returns a human readable description of the summary, as used for
+// Slack and email notifications.
+func (rs *RepGroupSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "All %d commands in wr RepGroup %q have finished: %d complete, %d buried.",
+		rs.Total, rs.RepGroup, rs.States[JobStateComplete], rs.States[JobStateBuried])
+
+	reasons := make([]string, 0, len(rs.FailReasons))
+	for reason := range rs.FailReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	if len(reasons) > 0 {
+		b.WriteString("\nFailure reasons:")
+	}
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "\n  %d x %s", rs.FailReasons[reason], reason)
+	}
+	return b.String()
+}
+
+// validateNotifyTargets checks that each of the given notification targets is
+// an http(s) URL, "slack:" followed by one, or "mailto:" followed by an email
+// address. Blank targets are ignored.
+func validateNotifyTargets(targets []string) error {
+	for _, target := range targets {
+		switch {
+		case target == "":
+			continue
+		case strings.HasPrefix(target, notifyMailPrefix):
+			if _, err := mail.ParseAddress(strings.TrimPrefix(target, notifyMailPrefix)); err != nil {
+				return fmt.Errorf("notification target %q is not a valid email address: %s", target, err)
+			}
+		default:
+			if err := validateNotifyURL(strings.TrimPrefix(target, notifySlackPrefix)); err != nil {
+				return fmt.Errorf("notification target %q is not an http(s) URL, slack:URL or mailto:address", target)
+			}
+		}
+	}
+	return nil
+}
+
+// validateNotifyURL checks that the given string is an absolute http(s) URL.
+func validateNotifyURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("not an http(s) URL")
+	}
+	return nil
+}
+
+// noteNotifyTransition is subscribed to all of our queue's changes by
+// createQueue(). When jobs complete or get buried, it checks if their
+// RepGroups have any incomplete jobs left, and if not sends out a
+// RepGroupSummary to their notification targets. Each RepGroup is only
+// notified about once, until one of its jobs becomes incomplete again (eg.
+// because more were added, or a buried one was kicked).
+func (s *Server) noteNotifyTransition(from, to queue.SubQueue, data []interface{}) {
+	// (jobs that are buried when we start up, being recovered from the
+	// database, have already been notified about)
+	finishing := from == queue.SubQueueRun && (to == queue.SubQueueBury || to == queue.SubQueueRemoved)
+
+	s.tmutex.RLock()
+	global := len(s.notifyComplete) > 0 || len(s.notifyFailure) > 0
+	s.tmutex.RUnlock()
+
+	candidates := make(map[string]bool)
+	for _, inter := range data {
+		job, ok := inter.(*Job)
+		if !ok {
+			continue
+		}
+		job.RLock()
+		rg := job.RepGroup
+		wanted := global || len(job.NotifyComplete) > 0 || len(job.NotifyFailure) > 0
+		job.RUnlock()
+
+		if !finishing {
+			if from == queue.SubQueueBury && to == queue.SubQueueRemoved {
+				continue
+			}
+			s.nfmutex.Lock()
+			delete(s.rgNotified, rg)
+			s.nfmutex.Unlock()
+			continue
+		}
+		if wanted {
+			candidates[rg] = true
+		}
+	}
+
+	for rg := range candidates {
+		if !s.repGroupFinished(rg) {
+			continue
+		}
+
+		s.nfmutex.Lock()
+		notified := s.rgNotified[rg]
+		s.rgNotified[rg] = true
+		s.nfmutex.Unlock()
+		if notified {
+			continue
+		}
+
+		s.notifyRepGroup(rg)
+	}
+}
+
+// repGroupFinished tells you if all the jobs in the queue with the given
+// RepGroup are buried (or there are none left because they all completed).
+func (s *Server) repGroupFinished(rg string) bool {
+	s.rpl.RLock()
+	defer s.rpl.RUnlock()
+	for key := range s.rpl.lookup[rg] {
+		item, err := s.q.Get(key)
+		if err != nil {
+			continue
+		}
+		if item.Stats().State != queue.ItemStateBury {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyRepGroup summarises the jobs of the given finished RepGroup and sends
+// the summary to the notification targets of its jobs and our config.
+func (s *Server) notifyRepGroup(rg string) {
+	jobs, _, qerr := s.getJobsInRepGroups([]string{rg}, "")
+	if qerr != "" {
+		s.Warn("failed to get jobs to summarise for notification", "repgroup", rg, "err", qerr)
+		return
+	}
+	if len(jobs) == 0 {
+		return
+	}
+
+	summary := &RepGroupSummary{
+		Event:       NotifyEventComplete,
+		RepGroup:    rg,
+		Time:        time.Now(),
+		Total:       len(jobs),
+		States:      make(map[JobState]int),
+		FailReasons: make(map[string]int),
+	}
+
+	var onComplete, onFailure []string
+	for _, job := range jobs {
+		job.RLock()
+		summary.States[job.State]++
+		if job.State == JobStateBuried {
+			summary.FailReasons[job.FailReason]++
+		}
+		for _, target := range job.NotifyComplete {
+			onComplete = appendIfMissing(onComplete, target)
+		}
+		for _, target := range job.NotifyFailure {
+			onFailure = appendIfMissing(onFailure, target)
+		}
+		job.RUnlock()
+	}
+
+	s.tmutex.RLock()
+	for _, target := range s.notifyComplete {
+		onComplete = appendIfMissing(onComplete, target)
+	}
+	for _, target := range s.notifyFailure {
+		onFailure = appendIfMissing(onFailure, target)
+	}
+	smtpServer, smtpFrom := s.smtpServer, s.smtpFrom
+	s.tmutex.RUnlock()
+
+	targets := onComplete
+	if summary.States[JobStateBuried] > 0 {
+		summary.Event = NotifyEventFailure
+		targets = onFailure
+	}
+
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+		go func(target string) {
+			defer internal.LogPanic(s.Logger, "repgroup notification", false)
+			err := sendNotification(target, summary, smtpServer, smtpFrom)
+			if err != nil {
+				s.Warn("repgroup notification failed", "repgroup", rg, "target", target, "err", err)
+			}
+		}(target)
+	}
+}
+
+// sendNotification sends the given summary to the given target, using the
+// given mail server and from address for mailto: targets.
+func sendNotification(target string, summary *RepGroupSummary, smtpServer, smtpFrom string) error {
+	switch {
+	case strings.HasPrefix(target, notifyMailPrefix):
+		subject := fmt.Sprintf("wr: RepGroup %s %s", summary.RepGroup, summary.Event)
+		return sendNotificationMail(smtpServer, smtpFrom, strings.TrimPrefix(target, notifyMailPrefix), subject, summary.String())
+	case strings.HasPrefix(target, notifySlackPrefix):
+		body, err := json.Marshal(struct {
+			Text string `json:"text"`
+		}{Text: summary.String()})
+		if err != nil {
+			return err
+		}
+		return postNotification(strings.TrimPrefix(target, notifySlackPrefix), body)
+	default:
+		body, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		return postNotification(target, body)
+	}
+}
+
+// postNotification POSTs the given JSON to the given URL.
+func postNotification(target string, body []byte) error {
+	client := &http.Client{Timeout: NotifyTimeout}
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close() // #nosec nothing useful to do if closing fails
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification was not accepted: %s", resp.Status)
+	}
+	return nil
+}
+
+// sendNotificationMail sends an email through the given mail server, which
+// must not need authentication.
+func sendNotificationMail(server, from, to, subject, body string) error {
+	if server == "" {
+		return fmt.Errorf("no SMTP server has been configured")
+	}
+	if from == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+		from = "wr@" + host
+	}
+
+	conn, err := net.DialTimeout("tcp", server, NotifyTimeout)
+	if err != nil {
+		return err
+	}
+	err = conn.SetDeadline(time.Now().Add(NotifyTimeout))
+	if err != nil {
+		conn.Close() // #nosec nothing useful to do if closing fails
+		return err
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		conn.Close() // #nosec nothing useful to do if closing fails
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close() // #nosec nothing useful to do if closing fails
+		return err
+	}
+	defer c.Close() // #nosec nothing useful to do if closing fails
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		from, to, subject, strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err = w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,198 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that explains why pending jobs haven't started
+// running yet.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// pendingMaxListed is the maximum number of things (like unfinished
+// dependencies) we list individually in a pending reason.
+const pendingMaxListed = 3
+
+// pendingReasons returns the reasons that the given job, which is in the given
+// state and is the data of the given item, hasn't started running yet. Returns
+// nil if the job isn't pending.
+func (s *Server) pendingReasons(item *queue.Item, job *Job, state JobState) []string {
+	switch state {
+	case JobStateDependent:
+		return s.dependentReasons(item, job)
+	case JobStateDelayed:
+		return s.delayedReasons(item, job)
+	case JobStateReady:
+		return s.readyReasons(job)
+	}
+	return nil
+}
+
+// dependentReasons lists the unfinished jobs that the given dependent job is
+// waiting on.
+func (s *Server) dependentReasons(item *queue.Item, job *Job) []string {
+	keys := item.UnresolvedDependencies()
+	if len(keys) == 0 {
+		job.RLock()
+		deps := job.Dependencies.Stringify()
+		job.RUnlock()
+		return []string{fmt.Sprintf("waiting for its dependencies to complete: %s", strings.Join(deps, ", "))}
+	}
+
+	var listed []string
+	for _, key := range keys {
+		if len(listed) == pendingMaxListed {
+			break
+		}
+		depItem, err := s.q.Get(key)
+		if err != nil || depItem == nil {
+			continue
+		}
+		depJob, ok := depItem.Data().(*Job)
+		if !ok {
+			continue
+		}
+		depJob.RLock()
+		cmd, lost := depJob.Cmd, depJob.Lost
+		depJob.RUnlock()
+		listed = append(listed, fmt.Sprintf("[%s] (%s)", cmd, s.itemStateToJobState(depItem.State(), lost)))
+	}
+
+	reason := fmt.Sprintf("waiting for %d dependencies to complete", len(keys))
+	if len(listed) > 0 {
+		reason += ": " + strings.Join(listed, ", ")
+		if others := len(keys) - len(listed); others > 0 {
+			reason += fmt.Sprintf(" and %d others", others)
+		}
+	}
+	return []string{reason}
+}
+
+// delayedReasons explains why the given job is in the delayed state: it is
+// outside of its run window (or wouldn't finish before it closes), it would
+// overrun a maintenance window, it would start too soon after too many other
+// jobs, or it is waiting to be retried.
+func (s *Server) delayedReasons(item *queue.Item, job *Job) []string {
+	job.RLock()
+	spec, repGroup := job.RunWindow, job.RepGroup
+	fit, expected := job.FitRunWindow, job.Requirements.Time
+	job.RUnlock()
+	if spec == "" {
+		s.rwmutex.RLock()
+		spec = s.rgRunWindows[repGroup]
+		s.rwmutex.RUnlock()
+	}
+	if spec != "" {
+		if rw, err := s.runWindow(spec); err == nil {
+			now := time.Now()
+			if until := rw.untilOpen(now); until > 0 {
+				return []string{fmt.Sprintf("outside of its run window [%s], which opens in %s", spec, until.Round(time.Minute))}
+			}
+			if until := rw.untilNextFit(now, fit, expected); until > 0 {
+				return []string{fmt.Sprintf("its expected time of %s would overrun its run window [%s], which next opens in %s", expected, spec, until.Round(time.Minute))}
+			}
+		}
+	}
+
+	if wait := s.maintenanceWait(job); wait > 0 {
+		if md := s.maintenanceDetails(); md != nil {
+			return []string{fmt.Sprintf("the server is draining for maintenance from %s; it can start in %s", time.Unix(md.Start, 0).Format(time.Stamp), wait.Round(time.Minute))}
+		}
+	}
+
+	if wait := s.startRateWait(repGroup); wait > 0 {
+		return []string{fmt.Sprintf("too many jobs have started recently; it can start in %s", wait.Round(time.Second))}
+	}
+
+	return []string{fmt.Sprintf("delayed following a temporary problem; it will be ready again at %s", item.ReadyAt().Format(time.Stamp))}
+}
+
+// readyReasons explains why the given ready job hasn't been picked up by a
+// runner.
+func (s *Server) readyReasons(job *Job) []string {
+	reasons := s.notSchedulingReasons()
+
+	job.RLock()
+	namespace := job.Namespace
+	limitGroups := job.LimitGroups
+	sameHostAs, avoid := job.SameHostAs, job.AvoidRepGroup
+	job.RUnlock()
+
+	for _, group := range limitGroups {
+		if s.limiter.GetRemainingCapacity(limitGroupTokens([]string{group})) != 0 {
+			continue
+		}
+		name, _, err := splitLimitGroupUsage(group)
+		if err != nil {
+			continue
+		}
+		reasons = append(reasons, fmt.Sprintf("limit group [%s] is at its limit of %d", unnamespaced(namespace, name), s.limiter.GetLimit(name)))
+	}
+
+	if sameHostAs != "" {
+		if host := s.sameHost(sameHostAs); host != "" {
+			reasons = append(reasons, fmt.Sprintf("it must run on host %s, where DepGroup [%s] ran", host, unnamespaced(namespace, sameHostAs)))
+		}
+	}
+	if avoid != "" && s.repGroupRunning(avoid) {
+		reasons = append(reasons, fmt.Sprintf("it can't run on hosts running jobs in RepGroup [%s]", unnamespaced(namespace, avoid)))
+	}
+
+	if job.getScheduledRunner() {
+		reasons = append(reasons, fmt.Sprintf("a runner has been requested from the %s scheduler, but has not started yet", s.scheduler.Name))
+		reasons = append(reasons, s.recentSchedulerIssues()...)
+	} else if len(reasons) == 0 {
+		reasons = append(reasons, "waiting for a runner to be requested from the scheduler")
+	}
+	return reasons
+}
+
+// repGroupRunning tells you if any jobs in the given RepGroup are running.
+func (s *Server) repGroupRunning(repGroup string) bool {
+	s.afmutex.RLock()
+	defer s.afmutex.RUnlock()
+	for hrg := range s.hostRepGroups {
+		if hrg.repGroup == repGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// recentSchedulerIssues describes the most severe, most recent problems the
+// scheduler told us about, such as being out of quota or having no suitable
+// flavor, which may be why requested runners haven't started.
+func (s *Server) recentSchedulerIssues() []string {
+	var reasons []string
+	for _, si := range s.schedulerIssues() {
+		if len(reasons) == pendingMaxListed {
+			break
+		}
+		if si.Severity == scheduler.MessageInfo {
+			continue
+		}
+		reasons = append(reasons, "the scheduler reported: "+si.Msg)
+	}
+	return reasons
+}
@@ -0,0 +1,269 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for declarative pipelines: a manifest describes
+// all the jobs a pipeline should have, and applying it adds the missing ones
+// and optionally removes those no longer wanted.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/queue"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// pipelineSeparator separates a pipeline's name from the rest of the RepGroups
+// of its jobs.
+const pipelineSeparator = "."
+
+// PipelineManifest describes the desired jobs of a pipeline, as read from a
+// YAML file by ParsePipelineManifest().
+type PipelineManifest struct {
+	// Name identifies the pipeline. Its jobs are those with a RepGroup of
+	// Name, or that starts with Name followed by a dot.
+	Name string `yaml:"pipeline"`
+
+	// Defaults are job options (as understood by JobViaJSON) applied to every
+	// job that doesn't specify them itself.
+	Defaults map[string]interface{} `yaml:"defaults"`
+
+	// Jobs are the options (as understood by JobViaJSON) of each desired job.
+	Jobs []map[string]interface{} `yaml:"jobs"`
+}
+
+// PipelineDiff describes the difference between the jobs a pipeline manifest
+// wants and the jobs of that pipeline already in the queue, as found by
+// Client.ApplyPipeline(). The slices hold job keys.
+type PipelineDiff struct {
+	// Added are the desired jobs that were not in the queue (and, unless
+	// rerunning, had not already completed), which were added.
+	Added []string
+
+	// Existing are the desired jobs that were already in the queue or
+	// complete, which were left alone.
+	Existing []string
+
+	// Orphaned are the incomplete jobs of the pipeline that are no longer
+	// desired.
+	Orphaned []string
+
+	// Removed are those Orphaned jobs that were removed because pruning was
+	// requested. Running orphans, and those that other jobs depend on, are
+	// never removed. (In a DryRun, these are the Orphaned jobs that aren't
+	// running.)
+	Removed []string
+
+	// DryRun is true if nothing was actually added or removed.
+	DryRun bool
+}
+
+// ParsePipelineManifest reads a YAML pipeline manifest, eg.
+//
+//	pipeline: nightly
+//	defaults:
+//	  cwd: /data/nightly
+//	  memory: 1G
+//	jobs:
+//	  - cmd: fetch.sh
+//	    rep_grp: nightly.fetch
+//	    dep_grps: [fetched]
+//	  - cmd: process.sh
+//	    rep_grp: nightly.process
+//	    deps: [fetched]
+//
+// and converts its jobs using the given defaults (the manifest's own defaults
+// take precedence over these). Jobs without a rep_grp get the pipeline's name
+// as their RepGroup; all other RepGroups must start with the pipeline's name
+// and a dot.
+func ParsePipelineManifest(r io.Reader, jd *JobDefaults) (string, []*Job, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var manifest PipelineManifest
+	err = yaml.UnmarshalStrict(content, &manifest)
+	if err != nil {
+		return "", nil, fmt.Errorf("pipeline manifest could not be parsed: %s", err)
+	}
+	if manifest.Name == "" {
+		return "", nil, fmt.Errorf("pipeline manifest has no pipeline name")
+	}
+	if len(manifest.Jobs) == 0 {
+		return "", nil, fmt.Errorf("pipeline manifest has no jobs")
+	}
+
+	if jd == nil {
+		jd = &JobDefaults{}
+	}
+	pjd := *jd
+	pjd.RepGrp = manifest.Name
+
+	jobs := make([]*Job, 0, len(manifest.Jobs))
+	for i, options := range manifest.Jobs {
+		for name, val := range manifest.Defaults {
+			if _, exists := options[name]; !exists {
+				options[name] = val
+			}
+		}
+
+		var encoded []byte
+		encoded, err = json.Marshal(yamlToJSONable(options))
+		if err == nil {
+			var jvj JobViaJSON
+			err = json.Unmarshal(encoded, &jvj)
+			if err == nil {
+				var job *Job
+				job, err = jvj.Convert(&pjd)
+				if err == nil {
+					jobs = append(jobs, job)
+				}
+			}
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("pipeline job %d had a problem: %s", i+1, err)
+		}
+
+		if !inPipeline(manifest.Name, jobs[i].RepGroup) {
+			return "", nil, fmt.Errorf("pipeline job %d has rep_grp %s, which is not in pipeline %s", i+1, jobs[i].RepGroup, manifest.Name)
+		}
+	}
+
+	return manifest.Name, jobs, nil
+}
+
+// yamlToJSONable converts the map[interface{}]interface{}s that yaml decodes
+// nested objects to in to map[string]interface{}s that json can encode.
+func yamlToJSONable(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, nested := range v {
+			m[fmt.Sprintf("%v", key)] = yamlToJSONable(nested)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, nested := range v {
+			m[key] = yamlToJSONable(nested)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, nested := range v {
+			s[i] = yamlToJSONable(nested)
+		}
+		return s
+	default:
+		return val
+	}
+}
+
+// inPipeline tells you if the given RepGroup belongs to the given pipeline.
+func inPipeline(pipeline, repGroup string) bool {
+	return repGroup == pipeline || strings.HasPrefix(repGroup, pipeline+pipelineSeparator)
+}
+
+// applyPipeline does the server side of Client.ApplyPipeline(). The jobs should
+// already be in the namespace, if any.
+func (s *Server) applyPipeline(pipeline, namespace string, jobs []*Job, envkey string, ignoreComplete, prune, dryRun bool) (*PipelineDiff, string, error) {
+	pipeline = namespaced(namespace, pipeline)
+	diff := &PipelineDiff{DryRun: dryRun}
+
+	// admit first, so that the diff reflects any changes the hook makes
+	if err := s.admitJobs(jobs); err != nil {
+		return nil, ErrJobRejected, err
+	}
+
+	desired := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		job.RLock()
+		rg := job.RepGroup
+		job.RUnlock()
+		if !inPipeline(pipeline, rg) {
+			return nil, ErrBadRequest, fmt.Errorf("job %s has RepGroup %s, which is not in pipeline %s", job.Key(), unnamespaced(namespace, rg), unnamespaced(namespace, pipeline))
+		}
+
+		key := job.Key()
+		if desired[key] {
+			continue
+		}
+		desired[key] = true
+
+		exists := false
+		if item, err := s.q.Get(key); err == nil && item != nil {
+			exists = true
+		} else if ignoreComplete {
+			added, errc := s.db.checkIfAdded(key)
+			if errc != nil {
+				return nil, ErrDBError, errc
+			}
+			exists = added
+		}
+		if exists {
+			diff.Existing = append(diff.Existing, key)
+		} else {
+			diff.Added = append(diff.Added, key)
+		}
+	}
+
+	var removable []string
+	s.q.Each(func(item *queue.Item) bool {
+		if desired[item.Key] {
+			return true
+		}
+		job := item.Data().(*Job)
+		job.RLock()
+		rg := job.RepGroup
+		job.RUnlock()
+		if inPipeline(pipeline, rg) {
+			diff.Orphaned = append(diff.Orphaned, item.Key)
+			if item.State() != queue.ItemStateRun {
+				removable = append(removable, item.Key)
+			}
+		}
+		return true
+	})
+	sort.Strings(diff.Orphaned)
+
+	if dryRun {
+		if prune {
+			diff.Removed = removable
+		}
+		return diff, "", nil
+	}
+
+	_, _, _, srerr, err := s.createAdmittedJobs(jobs, envkey, ignoreComplete)
+	if err != nil {
+		return nil, srerr, err
+	}
+
+	if prune && len(removable) > 0 {
+		diff.Removed = s.deleteJobs(removable)
+		sort.Strings(diff.Removed)
+	}
+
+	return diff, "", nil
+}
@@ -0,0 +1,347 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for named policies, which let users manage how
+// the jobs of their RepGroups are retried and reported on in one place,
+// instead of with flags on every job.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// PolicyEvent* constants are the Events of PolicyNotifications.
+const (
+	// PolicyEventBuried is sent when a job is buried.
+	PolicyEventBuried = "buried"
+
+	// PolicyEventComplete is sent when the last incomplete job of a RepGroup
+	// completes.
+	PolicyEventComplete = "complete"
+)
+
+// PolicyNotifyTimeout is how long we wait for a Policy's Notify URLs to
+// respond. It is a variable only for testing purposes.
+var PolicyNotifyTimeout = 10 * time.Second
+
+// Policy describes how the jobs of the RepGroups it is assigned to should be
+// treated. Create or change them with Client.SetPolicy(), and assign them to
+// RepGroups with Client.SetRepGroupPolicy() or by setting the Policy of jobs
+// you Add(). Because they are looked up when they're needed, changes to a
+// Policy apply to jobs that have already been added.
+type Policy struct {
+	// Name identifies the policy.
+	Name string
+
+	// Retries, if RetriesSet, replaces the Retries of the jobs. Failures the
+	// jobs have already had count against the new value.
+	Retries    uint8
+	RetriesSet bool
+
+	// Backoff, if set, is how long jobs wait after they first fail before
+	// being retried, instead of the usual delay. It doubles for each
+	// subsequent failure, up to BackoffMax (if set).
+	Backoff    time.Duration
+	BackoffMax time.Duration
+
+	// RAMRetryMult and RAMRetryMax, if set, replace those of the jobs.
+	RAMRetryMult float64
+	RAMRetryMax  int
+
+	// Notify are http(s) URLs that are POSTed a JSON PolicyNotification when
+	// one of the jobs is buried, and when the last incomplete job of a
+	// RepGroup completes.
+	Notify []string `codec:",omitempty"`
+
+	// KeepOutput keeps the STDOUT and STDERR of jobs that complete
+	// successfully, which is normally only kept for failed jobs.
+	KeepOutput bool
+}
+
+// PolicyNotification is what gets POSTed to a Policy's Notify URLs.
+type PolicyNotification struct {
+	Event      string    `json:"event"`
+	Policy     string    `json:"policy"`
+	RepGroup   string    `json:"rep_grp"`
+	Key        string    `json:"key,omitempty"`
+	Cmd        string    `json:"cmd,omitempty"`
+	FailReason string    `json:"fail_reason,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// validate checks the policy has a name and sensible values.
+func (p *Policy) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("a Name is required")
+	}
+	if p.Backoff < 0 || p.BackoffMax < 0 {
+		return fmt.Errorf("Backoff and BackoffMax can't be negative")
+	}
+	if p.RAMRetryMult < 0 || p.RAMRetryMax < 0 {
+		return fmt.Errorf("RAMRetryMult and RAMRetryMax can't be negative")
+	}
+	for _, notify := range p.Notify {
+		u, err := url.Parse(notify)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Notify URL [%s] is not a valid http(s) URL", notify)
+		}
+	}
+	return nil
+}
+
+// applyRetries makes the given job's Retries be ours, if RetriesSet,
+// adjusting its UntilBuried to account for the failures it has already had.
+// A job that is yet to be buried is always given at least one more try. You
+// must hold the job's lock.
+func (p *Policy) applyRetries(job *Job) {
+	if p == nil || !p.RetriesSet || job.Retries == p.Retries {
+		return
+	}
+	failures := int(job.Retries) + 1 - int(job.UntilBuried)
+	if failures < 0 {
+		failures = 0
+	}
+	left := int(p.Retries) + 1 - failures
+	switch {
+	case left > math.MaxUint8:
+		left = math.MaxUint8
+	case left < 1 && job.UntilBuried > 0:
+		left = 1
+	case left < 0:
+		left = 0
+	}
+	job.Retries = p.Retries
+	job.UntilBuried = uint8(left)
+}
+
+// backoff returns how long the given job, which just failed, should wait
+// before being retried, or 0 to use the usual delay. You must hold the job's
+// read lock.
+func (p *Policy) backoff(job *Job) time.Duration {
+	if p == nil || p.Backoff <= 0 {
+		return 0
+	}
+	failures := int(job.Retries) + 1 - int(job.UntilBuried)
+	delay := p.Backoff
+	for i := 0; i < failures; i++ {
+		if delay > math.MaxInt64/2 {
+			break
+		}
+		delay *= 2
+		if p.BackoffMax > 0 && delay >= p.BackoffMax {
+			break
+		}
+	}
+	if p.BackoffMax > 0 && delay > p.BackoffMax {
+		delay = p.BackoffMax
+	}
+	return delay
+}
+
+// setPolicy creates or replaces the given Policy.
+func (s *Server) setPolicy(policy *Policy) (srerr string, qerr error) {
+	if policy == nil {
+		return ErrBadPolicy, fmt.Errorf("no policy supplied")
+	}
+	if err := policy.validate(); err != nil {
+		return ErrBadPolicy, err
+	}
+
+	s.pomutex.Lock()
+	defer s.pomutex.Unlock()
+	if err := s.db.storePolicy(policy); err != nil {
+		return ErrDBError, err
+	}
+	s.policies[policy.Name] = policy
+	return "", nil
+}
+
+// deletePolicy forgets the named Policy, unassigning it from any RepGroups.
+func (s *Server) deletePolicy(name string) (srerr string, qerr error) {
+	s.pomutex.Lock()
+	defer s.pomutex.Unlock()
+	if _, exists := s.policies[name]; !exists {
+		return ErrUnknownPolicy, fmt.Errorf("policy [%s] does not exist", name)
+	}
+
+	var repGroups []string
+	for rg, pname := range s.rgPolicies {
+		if pname == name {
+			repGroups = append(repGroups, rg)
+		}
+	}
+	if err := s.db.deletePolicy(name, repGroups); err != nil {
+		return ErrDBError, err
+	}
+	delete(s.policies, name)
+	for _, rg := range repGroups {
+		delete(s.rgPolicies, rg)
+	}
+	return "", nil
+}
+
+// setRepGroupPolicy assigns the named Policy to the given RepGroup, or
+// unassigns any if name is blank.
+func (s *Server) setRepGroupPolicy(repGroup, name string) (srerr string, qerr error) {
+	s.pomutex.Lock()
+	defer s.pomutex.Unlock()
+	return s.setRepGroupPolicyLocked(repGroup, name)
+}
+
+// setRepGroupPolicyLocked is like setRepGroupPolicy(), but you must hold the
+// pomutex.
+func (s *Server) setRepGroupPolicyLocked(repGroup, name string) (srerr string, qerr error) {
+	if name != "" {
+		if _, exists := s.policies[name]; !exists {
+			return ErrUnknownPolicy, fmt.Errorf("policy [%s] does not exist", name)
+		}
+	}
+	if s.rgPolicies[repGroup] == name {
+		return "", nil
+	}
+
+	if err := s.db.storeRepGroupPolicy(repGroup, name); err != nil {
+		return ErrDBError, err
+	}
+	if name == "" {
+		delete(s.rgPolicies, repGroup)
+		return "", nil
+	}
+	s.rgPolicies[repGroup] = name
+	return "", nil
+}
+
+// assignJobPolicies assigns the Policy of each of the given jobs that has one
+// to its RepGroup. Nothing is assigned if any of the policies don't exist.
+func (s *Server) assignJobPolicies(jobs []*Job) (srerr string, qerr error) {
+	assign := make(map[string]string)
+	for _, job := range jobs {
+		job.RLock()
+		if job.Policy != "" {
+			assign[job.RepGroup] = job.Policy
+		}
+		job.RUnlock()
+	}
+	if len(assign) == 0 {
+		return "", nil
+	}
+
+	s.pomutex.Lock()
+	defer s.pomutex.Unlock()
+	for _, name := range assign {
+		if _, exists := s.policies[name]; !exists {
+			return ErrUnknownPolicy, fmt.Errorf("policy [%s] does not exist", name)
+		}
+	}
+	for rg, name := range assign {
+		if srerr, qerr = s.setRepGroupPolicyLocked(rg, name); srerr != "" {
+			return srerr, qerr
+		}
+	}
+	return "", nil
+}
+
+// getPolicies returns all our policies, and the names of the policies assigned
+// to RepGroups, keyed on RepGroup.
+func (s *Server) getPolicies() ([]*Policy, map[string]string) {
+	s.pomutex.RLock()
+	defer s.pomutex.RUnlock()
+	policies := make([]*Policy, 0, len(s.policies))
+	for _, policy := range s.policies {
+		policies = append(policies, policy)
+	}
+	assigned := make(map[string]string, len(s.rgPolicies))
+	for rg, name := range s.rgPolicies {
+		assigned[rg] = name
+	}
+	return policies, assigned
+}
+
+// repGroupPolicy returns the Policy assigned to the given RepGroup, or nil if
+// it doesn't have one.
+func (s *Server) repGroupPolicy(repGroup string) *Policy {
+	s.pomutex.RLock()
+	defer s.pomutex.RUnlock()
+	name, assigned := s.rgPolicies[repGroup]
+	if !assigned {
+		return nil
+	}
+	return s.policies[name]
+}
+
+// jobPolicy returns the Policy assigned to the given job's RepGroup, or nil if
+// it doesn't have one. The job must not be locked.
+func (s *Server) jobPolicy(job *Job) *Policy {
+	job.RLock()
+	repGroup := job.RepGroup
+	job.RUnlock()
+	return s.repGroupPolicy(repGroup)
+}
+
+// notifyPolicy POSTs a PolicyNotification of the given event to the Notify
+// URLs of the given policy, in the background. job can be nil for events that
+// aren't about a particular job.
+func (s *Server) notifyPolicy(policy *Policy, event, repGroup string, job *Job) {
+	if policy == nil || len(policy.Notify) == 0 {
+		return
+	}
+
+	pn := &PolicyNotification{
+		Event:    event,
+		Policy:   policy.Name,
+		RepGroup: repGroup,
+		Time:     time.Now(),
+	}
+	if job != nil {
+		job.RLock()
+		pn.Key = job.Key()
+		pn.Cmd = job.Cmd
+		pn.FailReason = job.FailReason
+		job.RUnlock()
+	}
+	body, err := json.Marshal(pn)
+	if err != nil {
+		s.Warn("failed to encode policy notification", "err", err)
+		return
+	}
+
+	client := &http.Client{Timeout: PolicyNotifyTimeout}
+	for _, notify := range policy.Notify {
+		go func(notify string) {
+			defer internal.LogPanic(s.Logger, "policy notification", false)
+			resp, errp := client.Post(notify, "application/json", bytes.NewReader(body))
+			if errp != nil {
+				s.Warn("policy notification failed", "policy", policy.Name, "url", notify, "err", errp)
+				return
+			}
+			resp.Body.Close() // #nosec nothing useful to do if closing fails
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				s.Warn("policy notification was not accepted", "policy", policy.Name, "url", notify, "status", resp.Status)
+			}
+		}(notify)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the implementation of the optional preemption of low
+// priority running jobs in favour of high priority ready jobs.
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// Preempt* constants are the possible PreemptionPolicy Modes.
+const (
+	// PreemptSuspend stops (SIGSTOP) the Cmd of a preempted job and all its
+	// child processes, so they stop competing for CPU and I/O, and continues
+	// them (SIGCONT) once the job they were preempted for is no longer ready or
+	// running. Suspended jobs keep their memory and their runner's reservation
+	// in the job scheduler, so this does not free up capacity for new runners.
+	PreemptSuspend = "suspend"
+
+	// PreemptRequeue sends SIGTERM to the Cmd of a preempted job and all its
+	// child processes, giving the Cmd a chance to checkpoint, then kills it
+	// after the PreemptionPolicy Grace period. The job is then released back
+	// to the queue (without using up one of its Retries), failing with
+	// FailReasonPreempt, and its runner exits, freeing up its capacity.
+	PreemptRequeue = "requeue"
+)
+
+// PreemptionPolicy describes if and how running jobs can be preempted by
+// higher priority ready jobs when there is no capacity to run them. It is
+// supplied to Serve() via ServerConfig.Preemption.
+//
+// Capacity is considered exhausted when a ready job has not been reserved
+// within Wait; it will then preempt the lowest priority running job (the most
+// recently started one, if there are several) whose Priority is more than
+// MinPriorityGap lower than its own. Each waiting job only preempts 1 running
+// job at a time.
+type PreemptionPolicy struct {
+	// Mode is one of the Preempt* constants.
+	Mode string
+
+	// Wait is how long a job must have been ready for before it can preempt
+	// a running job.
+	Wait time.Duration
+
+	// Grace is how long a Cmd has to checkpoint and exit after being sent
+	// SIGTERM in PreemptRequeue mode, before it is killed.
+	Grace time.Duration
+
+	// MinPriorityGap is how much higher a ready job's Priority must be than
+	// a running job's Priority for it to be able to preempt it. The default
+	// of 0 means any higher Priority will do.
+	MinPriorityGap uint8
+}
+
+// validate checks that the policy's Mode is one we know about.
+func (p *PreemptionPolicy) validate() error {
+	switch p.Mode {
+	case PreemptSuspend, PreemptRequeue:
+		return nil
+	}
+	return fmt.Errorf("unknown preemption mode [%s]", p.Mode)
+}
+
+// preemptionChecker calls preemptJobs() every ServerPreemptionCheckInterval,
+// until the server stops. It does nothing while the server is paused or
+// draining, since then the ready jobs wouldn't start anyway.
+func (s *Server) preemptionChecker() {
+	defer internal.LogPanic(s.Logger, "jobqueue preemption checker", true)
+
+	ticker := time.NewTicker(ServerPreemptionCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ssmutex.RLock()
+		up, drain := s.up, s.drain
+		s.ssmutex.RUnlock()
+		if !up {
+			return
+		}
+		if !drain {
+			s.preemptJobs()
+		}
+	}
+}
+
+// preemptJob describes a ready or running job under consideration by
+// preemptJobs().
+type preemptJob struct {
+	key      string
+	job      *Job
+	priority uint8
+	started  time.Time
+}
+
+// preemptionPolicy returns our current PreemptionPolicy, which is nil if
+// preemption is turned off.
+func (s *Server) preemptionPolicy() *PreemptionPolicy {
+	s.tmutex.RLock()
+	defer s.tmutex.RUnlock()
+	return s.preemption
+}
+
+// preemptJobs preempts the lowest priority running jobs for each higher
+// priority job that has been ready for longer than our preemption policy's
+// Wait, and resumes suspended jobs that no longer need to be. It does nothing
+// if preemption is turned off. It must only be called by one go routine at a
+// time.
+func (s *Server) preemptJobs() {
+	policy := s.preemptionPolicy()
+	if policy == nil {
+		return
+	}
+
+	now := time.Now()
+	ready := make(map[string]bool)
+	var waiting, running []*preemptJob
+	s.q.Each(func(item *queue.Item) bool {
+		switch item.State() {
+		case queue.ItemStateReady:
+			ready[item.Key] = true
+			seen, existed := s.preemptSeen[item.Key]
+			if !existed {
+				seen = now
+				s.preemptSeen[item.Key] = seen
+			}
+			if now.Sub(seen) >= policy.Wait {
+				waiting = append(waiting, &preemptJob{key: item.Key, job: item.Data().(*Job)})
+			}
+		case queue.ItemStateRun:
+			running = append(running, &preemptJob{key: item.Key, job: item.Data().(*Job)})
+		}
+		return true
+	})
+
+	for key := range s.preemptSeen {
+		if !ready[key] {
+			delete(s.preemptSeen, key)
+		}
+	}
+
+	for _, pj := range waiting {
+		pj.job.RLock()
+		pj.priority = pj.job.Priority
+		pj.job.RUnlock()
+	}
+
+	// resume suspended jobs whose preemptor is no longer ready or running, and
+	// collect the jobs that we could preempt, noting which waiting jobs have
+	// already preempted something
+	var candidates []*preemptJob
+	preempting := make(map[string]bool)
+	for _, pj := range running {
+		pj.job.RLock()
+		preempt, by := pj.job.preempt, pj.job.preemptedBy
+		started := !pj.job.StartTime.IsZero() && !pj.job.Lost && !pj.job.killCalled
+		pj.priority = pj.job.Priority
+		pj.started = pj.job.StartTime
+		pj.job.RUnlock()
+
+		if preempt == "" {
+			if started {
+				candidates = append(candidates, pj)
+			}
+			continue
+		}
+
+		if preempt == PreemptSuspend && !s.jobReadyOrRunning(by) {
+			pj.job.Lock()
+			pj.job.preempt = ""
+			pj.job.preemptedBy = ""
+			pj.job.Unlock()
+			s.Info("resuming preempted job", "job", pj.key)
+			continue
+		}
+		preempting[by] = true
+	}
+
+	sort.Slice(waiting, func(i, j int) bool {
+		return waiting[i].priority > waiting[j].priority
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].priority == candidates[j].priority {
+			return candidates[i].started.After(candidates[j].started)
+		}
+		return candidates[i].priority < candidates[j].priority
+	})
+
+	for _, pj := range waiting {
+		if len(candidates) == 0 {
+			break
+		}
+		if preempting[pj.key] {
+			continue
+		}
+
+		victim := candidates[0]
+		if int(victim.priority)+int(policy.MinPriorityGap) >= int(pj.priority) {
+			// since we go through waiting jobs from highest priority, no
+			// other waiting job could preempt anything either
+			break
+		}
+		candidates = candidates[1:]
+
+		victim.job.Lock()
+		victim.job.preempt = policy.Mode
+		victim.job.preemptedBy = pj.key
+		victim.job.Unlock()
+
+		// this job must now wait again before it can preempt anything else
+		s.preemptSeen[pj.key] = now.Add(policy.Grace)
+		s.Info("preempting running job", "mode", policy.Mode, "job", victim.key, "for", pj.key)
+	}
+}
+
+// resumeSuspendedJobs resumes all jobs suspended by preemption, for when
+// preemption gets turned off.
+func (s *Server) resumeSuspendedJobs() {
+	s.q.Each(func(item *queue.Item) bool {
+		if item.State() != queue.ItemStateRun {
+			return true
+		}
+		job := item.Data().(*Job)
+		job.Lock()
+		if job.preempt == PreemptSuspend {
+			job.preempt = ""
+			job.preemptedBy = ""
+			s.Info("resuming preempted job", "job", item.Key)
+		}
+		job.Unlock()
+		return true
+	})
+}
+
+// jobReadyOrRunning tells you if the job with the given key is in the ready or
+// run sub-queue.
+func (s *Server) jobReadyOrRunning(key string) bool {
+	item, err := s.q.Get(key)
+	if err != nil {
+		return false
+	}
+	state := item.State()
+	return state == queue.ItemStateReady || state == queue.ItemStateRun
+}
@@ -0,0 +1,302 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for tracking how quickly the jobs of each
+// RepGroup complete, so we can tell the status webpage and 'wr status' when
+// the rest are expected to finish.
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// RepGroupProgress describes how quickly the jobs of a RepGroup have been
+// completing, and when its remaining jobs are expected to finish, as returned
+// by Client.GetRepGroupProgress().
+type RepGroupProgress struct {
+	RepGroup string
+
+	// Remaining is the number of the RepGroup's incomplete jobs that are
+	// expected to complete without intervention: all of them except the
+	// Buried ones. Running is how many of those are currently running.
+	Remaining int
+	Running   int
+	Buried    int
+
+	// Completed is the number of the RepGroup's jobs that have completed
+	// since the server started.
+	Completed int
+
+	// Throughput is the number of jobs per hour that completed during the
+	// last ServerProgressWindow (or since the first of them started running,
+	// if that was more recent).
+	Throughput float64
+
+	// RuntimeMean, RuntimeMedian and RuntimeP90 describe the distribution of
+	// the walltimes of the last ServerProgressSamples jobs to complete.
+	RuntimeMean   time.Duration
+	RuntimeMedian time.Duration
+	RuntimeP90    time.Duration
+
+	// ETA is when the Remaining jobs are expected to have completed if they
+	// continue to complete at the current Throughput. It is the zero time if
+	// nothing remains or there is no Throughput to estimate from.
+	ETA time.Time
+}
+
+// progressTracker records the recent completions of a RepGroup's jobs.
+type progressTracker struct {
+	completed  int
+	firstStart time.Time
+	ends       []time.Time     // within ServerProgressWindow, oldest first
+	runtimes   []time.Duration // a ring of ServerProgressSamples
+	next       int
+}
+
+// record notes that a job that started and ended at the given times has
+// completed.
+func (pt *progressTracker) record(start, end time.Time) {
+	pt.completed++
+	if pt.firstStart.IsZero() || start.Before(pt.firstStart) {
+		pt.firstStart = start
+	}
+	pt.ends = append(pt.ends, end)
+
+	runtime := end.Sub(start)
+	if len(pt.runtimes) < ServerProgressSamples {
+		pt.runtimes = append(pt.runtimes, runtime)
+		return
+	}
+	pt.runtimes[pt.next] = runtime
+	pt.next = (pt.next + 1) % len(pt.runtimes)
+}
+
+// prune forgets the completions that are older than ServerProgressWindow.
+func (pt *progressTracker) prune(now time.Time) {
+	since := now.Add(-ServerProgressWindow)
+	i := sort.Search(len(pt.ends), func(i int) bool {
+		return !pt.ends[i].Before(since)
+	})
+	pt.ends = pt.ends[i:]
+}
+
+// throughput returns the jobs per hour that have recently completed. pt
+// should have been prune()d.
+func (pt *progressTracker) throughput(now time.Time) float64 {
+	if len(pt.ends) == 0 {
+		return 0
+	}
+	since := now.Add(-ServerProgressWindow)
+	if pt.firstStart.After(since) {
+		since = pt.firstStart
+	}
+	elapsed := now.Sub(since)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(len(pt.ends)) / elapsed.Hours()
+}
+
+// fill sets the Completed, Throughput and Runtime* properties of the given
+// RepGroupProgress.
+func (pt *progressTracker) fill(rgp *RepGroupProgress, now time.Time) {
+	pt.prune(now)
+	rgp.Completed = pt.completed
+	rgp.Throughput = pt.throughput(now)
+
+	n := len(pt.runtimes)
+	if n == 0 {
+		return
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, pt.runtimes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	rgp.RuntimeMean = total / time.Duration(n)
+	rgp.RuntimeMedian = sorted[n/2]
+	rgp.RuntimeP90 = sorted[(n*9)/10]
+}
+
+// recordCompletions notes that the given jobs (some of which may not actually
+// be complete) have just left the queue.
+func (s *Server) recordCompletions(jobs []*Job) {
+	s.pgmutex.Lock()
+	defer s.pgmutex.Unlock()
+	for _, job := range jobs {
+		job.RLock()
+		complete := job.State == JobStateComplete && !job.StartTime.IsZero()
+		rg, start, end := job.RepGroup, job.StartTime, job.EndTime
+		job.RUnlock()
+		if !complete {
+			continue
+		}
+		if end.IsZero() {
+			end = time.Now()
+		}
+
+		pt, exists := s.progress[rg]
+		if !exists {
+			pt = &progressTracker{}
+			s.progress[rg] = pt
+		}
+		pt.record(start, end)
+	}
+}
+
+// repGroupProgress returns the progress of each of the given RepGroups, or of
+// every RepGroup with incomplete or recently completed jobs if none are given.
+func (s *Server) repGroupProgress(repGroups []string) []*RepGroupProgress {
+	if len(repGroups) == 0 {
+		seen := make(map[string]bool)
+		s.rpl.RLock()
+		for rg := range s.rpl.lookup {
+			seen[rg] = true
+		}
+		s.rpl.RUnlock()
+		s.pgmutex.Lock()
+		for rg := range s.progress {
+			seen[rg] = true
+		}
+		s.pgmutex.Unlock()
+		for rg := range seen {
+			repGroups = append(repGroups, rg)
+		}
+		sort.Strings(repGroups)
+	}
+
+	now := time.Now()
+	progress := make([]*RepGroupProgress, 0, len(repGroups))
+	for _, rg := range repGroups {
+		rgp := &RepGroupProgress{RepGroup: rg}
+
+		s.rpl.RLock()
+		for key := range s.rpl.lookup[rg] {
+			item, err := s.q.Get(key)
+			if err != nil || item == nil {
+				continue
+			}
+			sjob := item.Data().(*Job)
+			sjob.RLock()
+			state := s.itemStateToJobState(item.State(), sjob.Lost)
+			if state == JobStateReserved && !sjob.StartTime.IsZero() {
+				state = JobStateRunning
+			}
+			sjob.RUnlock()
+			switch state {
+			case JobStateBuried:
+				rgp.Buried++
+			case JobStateComplete, JobStateDeleted:
+			default:
+				rgp.Remaining++
+				if state == JobStateRunning {
+					rgp.Running++
+				}
+			}
+		}
+		s.rpl.RUnlock()
+
+		s.pgmutex.Lock()
+		if pt, exists := s.progress[rg]; exists {
+			pt.fill(rgp, now)
+		}
+		s.pgmutex.Unlock()
+
+		if rgp.Remaining > 0 && rgp.Throughput > 0 {
+			rgp.ETA = now.Add(time.Duration(float64(rgp.Remaining) / rgp.Throughput * float64(time.Hour)))
+		}
+		progress = append(progress, rgp)
+	}
+	return progress
+}
+
+// forgetFinishedProgress stops tracking the progress of RepGroups that have
+// no incomplete jobs and no completions within ServerProgressWindow.
+func (s *Server) forgetFinishedProgress() {
+	now := time.Now()
+	s.pgmutex.Lock()
+	defer s.pgmutex.Unlock()
+	for rg, pt := range s.progress {
+		pt.prune(now)
+		if len(pt.ends) > 0 {
+			continue
+		}
+		s.rpl.RLock()
+		live := len(s.rpl.lookup[rg])
+		s.rpl.RUnlock()
+		if live == 0 {
+			delete(s.progress, rg)
+		}
+	}
+}
+
+// progressBroadcaster periodically sends the repGroupProgress() of every
+// active RepGroup to the status webpages that are connected, every
+// ServerProgressInterval, until we stop.
+func (s *Server) progressBroadcaster() {
+	defer internal.LogPanic(s.Logger, "jobqueue progress broadcaster", true)
+
+	ticker := time.NewTicker(ServerProgressInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ssmutex.RLock()
+		up := s.up
+		s.ssmutex.RUnlock()
+		if !up {
+			return
+		}
+
+		s.forgetFinishedProgress()
+
+		s.wsmutex.Lock()
+		watched := len(s.wsconns) > 0
+		s.wsmutex.Unlock()
+		if !watched {
+			continue
+		}
+
+		s.progressCaster.Send(&jstatusProgress{Progress: s.repGroupProgress(nil)})
+	}
+}
+
+// GetRepGroupProgress tells you how quickly the jobs of each of the given
+// RepGroups have been completing, and when their remaining jobs are expected
+// to finish. If no RepGroups are given, you get the progress of every RepGroup
+// with incomplete or recently completed jobs, sorted by RepGroup. This is what
+// 'wr status -o s' displays ETAs from.
+func (c *Client) GetRepGroupProgress(repGroups []string) ([]*RepGroupProgress, error) {
+	return c.GetRepGroupProgressContext(context.Background(), repGroups)
+}
+
+// GetRepGroupProgressContext is like GetRepGroupProgress(), but stops waiting
+// for the server and returns ctx.Err() if ctx is cancelled or reaches its
+// deadline first.
+func (c *Client) GetRepGroupProgressContext(ctx context.Context, repGroups []string) ([]*RepGroupProgress, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getprogress", RepGroups: repGroups})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Progress, err
+}
@@ -0,0 +1,220 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for exposing the state of the queue, scheduler
+// and cloud servers in the Prometheus text format, so that operators can graph
+// them.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// schedLatency keeps track of how long our calls to the scheduler's
+// Schedule() take.
+type schedLatency struct {
+	sync.Mutex
+	calls  uint64
+	errors uint64
+	total  time.Duration
+}
+
+// observe records a Schedule() call that took the given time.
+func (l *schedLatency) observe(took time.Duration, err error) {
+	l.Lock()
+	defer l.Unlock()
+	l.calls++
+	l.total += took
+	if err != nil {
+		l.errors++
+	}
+}
+
+// snapshot returns the number of calls, failed calls and their total time.
+func (l *schedLatency) snapshot() (uint64, uint64, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	return l.calls, l.errors, l.total
+}
+
+// schedule calls our scheduler's Schedule(), recording how long it took.
+func (s *Server) schedule(cmd string, req *scheduler.Requirements, priority uint8, count int) error {
+	start := time.Now()
+	err := s.scheduler.Schedule(cmd, req, priority, count)
+	s.schedLatency.observe(time.Since(start), err)
+	return err
+}
+
+// repGroupStateCounts returns the number of incomplete jobs in each state
+// (with reserved merged in to running, as on the status webpage), keyed on
+// RepGroup.
+func (s *Server) repGroupStateCounts() map[string]map[JobState]int {
+	counts := make(map[string]map[JobState]int)
+	s.q.Each(func(item *queue.Item) bool {
+		sjob := item.Data().(*Job)
+		sjob.RLock()
+		repGroup, lost := sjob.RepGroup, sjob.Lost
+		sjob.RUnlock()
+
+		state := s.itemStateToJobState(item.State(), lost)
+		if state == JobStateReserved {
+			state = JobStateRunning
+		}
+		if counts[repGroup] == nil {
+			counts[repGroup] = make(map[JobState]int)
+		}
+		counts[repGroup][state]++
+		return true
+	})
+	return counts
+}
+
+// writePrometheusServer writes metrics on the queue, scheduler and cloud
+// servers to w in the Prometheus text exposition format.
+func (s *Server) writePrometheusServer(w io.Writer) error {
+	pw := &prometheusWriter{w: w}
+
+	stats := s.q.Stats()
+	pw.header("wr_queue_jobs", "gauge", "Number of incomplete jobs in the queue, by queue state.")
+	for _, sc := range []struct {
+		state string
+		count int
+	}{
+		{"delayed", stats.Delayed},
+		{"ready", stats.Ready},
+		{"running", stats.Running},
+		{"buried", stats.Buried},
+		{"dependent", stats.Dependant},
+	} {
+		pw.sample("wr_queue_jobs", strconv.Itoa(sc.count), "state", sc.state)
+	}
+
+	pw.header("wr_buried_jobs", "gauge", "Number of jobs that are currently buried.")
+	pw.sample("wr_buried_jobs", strconv.Itoa(stats.Buried))
+
+	ops := s.q.OpMetrics()
+	var buries uint64
+	if bs, ok := ops.Ops[queue.OpBury]; ok {
+		buries = bs.Items
+	}
+	pw.header("wr_jobs_buried_total", "counter", "Number of times jobs have been buried since the manager started.")
+	pw.sample("wr_jobs_buried_total", strconv.FormatUint(buries, 10))
+
+	counts := s.repGroupStateCounts()
+	repGroups := make([]string, 0, len(counts))
+	for rg := range counts {
+		repGroups = append(repGroups, rg)
+	}
+	sort.Strings(repGroups)
+	pw.header("wr_repgroup_state_jobs", "gauge", "Number of the RepGroup's incomplete jobs in each state.")
+	for _, rg := range repGroups {
+		states := make([]string, 0, len(counts[rg]))
+		for state := range counts[rg] {
+			states = append(states, string(state))
+		}
+		sort.Strings(states)
+		for _, state := range states {
+			pw.sample("wr_repgroup_state_jobs", strconv.Itoa(counts[rg][JobState(state)]), "repgroup", rg, "state", state)
+		}
+	}
+
+	calls, failed, total := s.schedLatency.snapshot()
+	pw.header("wr_scheduler_request_seconds", "summary", "Time taken by requests to the job scheduler to change how many runners are scheduled.")
+	pw.sample("wr_scheduler_request_seconds_sum", prometheusFloat(total.Seconds()))
+	pw.sample("wr_scheduler_request_seconds_count", strconv.FormatUint(calls, 10))
+	pw.header("wr_scheduler_request_errors_total", "counter", "Number of requests to the job scheduler that failed.")
+	pw.sample("wr_scheduler_request_errors_total", strconv.FormatUint(failed, 10))
+
+	if s.scheduler != nil {
+		var hosts, servers int
+		for _, host := range s.scheduler.Hosts() {
+			hosts++
+			if host.ID != "" {
+				servers++
+			}
+		}
+		pw.header("wr_scheduler_hosts", "gauge", "Number of hosts the job scheduler can currently run commands on.")
+		pw.sample("wr_scheduler_hosts", strconv.Itoa(hosts))
+		pw.header("wr_cloud_servers", "gauge", "Number of cloud servers currently spawned by the manager.")
+		pw.sample("wr_cloud_servers", strconv.Itoa(servers))
+	}
+
+	var bad int
+	for _, bs := range s.getBadServers() {
+		if bs.IsBad {
+			bad++
+		}
+	}
+	pw.header("wr_bad_servers", "gauge", "Number of cloud servers that are currently considered bad.")
+	pw.sample("wr_bad_servers", strconv.Itoa(bad))
+
+	backlogs := s.webSocketBacklogs()
+	pw.header("wr_websocket_backlog", "gauge", "Number of messages waiting to be sent to a status webpage.")
+	for _, b := range backlogs {
+		pw.sample("wr_websocket_backlog", strconv.Itoa(b.Queued), "client", b.Client, "caster", b.Caster)
+	}
+	pw.header("wr_websocket_dropped_total", "counter", "Number of messages not sent to a status webpage because it had too big a backlog.")
+	for _, b := range backlogs {
+		pw.sample("wr_websocket_dropped_total", strconv.FormatUint(b.Dropped, 10), "client", b.Client, "caster", b.Caster)
+	}
+
+	return pw.err
+}
+
+// prometheusWriter writes metrics in the Prometheus text exposition format,
+// remembering the first error so that callers only need to check once.
+type prometheusWriter struct {
+	w   io.Writer
+	err error
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func (pw *prometheusWriter) header(name, kind, help string) {
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = fmt.Fprintf(pw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value of a metric, with the given label name and value
+// pairs.
+func (pw *prometheusWriter) sample(name, value string, labels ...string) {
+	if pw.err != nil {
+		return
+	}
+	var ls string
+	for i := 0; i+1 < len(labels); i += 2 {
+		if ls != "" {
+			ls += ","
+		}
+		ls += fmt.Sprintf("%s=\"%s\"", labels[i], prometheusLabelEscaper.Replace(labels[i+1]))
+	}
+	if ls != "" {
+		ls = "{" + ls + "}"
+	}
+	_, pw.err = fmt.Fprintf(pw.w, "%s%s %s\n", name, ls, value)
+}
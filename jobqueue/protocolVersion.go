@@ -0,0 +1,94 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for negotiating the version of the protocol
+// spoken between clients (including the status webpage) and the server.
+//
+// During Connect(), clients tell the server the newest ProtocolVersion they
+// speak, and the server replies with the range of versions it can serve. The
+// client then uses the newest version they both speak for all its requests.
+// Clients and servers from before versioning was added don't send a version,
+// which we treat as version 1. That way a manager can be upgraded while older
+// clients are still running, and clients are told clearly when they are too
+// old or too new, instead of failing to decode messages.
+
+import "fmt"
+
+const (
+	// ProtocolVersion is the newest version of the client/server and
+	// websocket protocols that we speak. Increase this when making a change
+	// that older clients or servers won't understand.
+	ProtocolVersion = 2
+
+	// ProtocolMinVersion is the oldest version of the protocol we still speak.
+	// It should normally be the previous major version, so that mixed-version
+	// deployments keep working during a rolling upgrade.
+	ProtocolMinVersion = 1
+
+	// protocolVersionLegacy is the version we assume for peers that predate
+	// protocol versioning and so don't send one.
+	protocolVersionLegacy = 1
+)
+
+// protocolVersionOf returns the given version, treating the 0 sent by peers
+// that predate protocol versioning as protocolVersionLegacy.
+func protocolVersionOf(version int) int {
+	if version == 0 {
+		return protocolVersionLegacy
+	}
+	return version
+}
+
+// protocolVersionSupported tells you if we can speak the given version of the
+// protocol (as sent by a peer, so 0 means protocolVersionLegacy).
+func protocolVersionSupported(version int) bool {
+	version = protocolVersionOf(version)
+	return version >= ProtocolMinVersion && version <= ProtocolVersion
+}
+
+// protocolVersionError returns a message explaining that a peer speaking the
+// given version of the protocol can't be served.
+func protocolVersionError(version int) string {
+	version = protocolVersionOf(version)
+	advice := "upgrade the client"
+	if version > ProtocolVersion {
+		advice = "upgrade the manager"
+	}
+	return fmt.Sprintf("protocol version %d is not supported by this manager, which speaks versions %d to %d; %s",
+		version, ProtocolMinVersion, ProtocolVersion, advice)
+}
+
+// negotiateProtocolVersion works out the version of the protocol a client
+// should speak with a server that said it speaks versions serverMin to
+// serverMax (0 for servers that predate protocol versioning). Returns an error
+// if there is no version we both speak.
+func negotiateProtocolVersion(serverMin, serverMax int) (int, error) {
+	serverMax = protocolVersionOf(serverMax)
+	serverMin = protocolVersionOf(serverMin)
+	version := ProtocolVersion
+	if serverMax < version {
+		version = serverMax
+	}
+	if version < ProtocolMinVersion || version < serverMin {
+		return 0, fmt.Errorf("server speaks protocol versions %d to %d, but this client speaks versions %d to %d",
+			serverMin, serverMax, ProtocolMinVersion, ProtocolVersion)
+	}
+	return version, nil
+}
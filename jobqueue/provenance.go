@@ -0,0 +1,231 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for exporting the provenance of jobs as an
+// RO-Crate (https://w3id.org/ro/crate), so that analyses run with wr can be
+// published with machine-readable provenance.
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+const (
+	roCrateContext = "https://w3id.org/ro/crate/1.1/context"
+	roCrateSpec    = "https://w3id.org/ro/crate/1.1"
+	roCrateMeta    = "ro-crate-metadata.json"
+)
+
+// roEntity is a JSON-LD entity in the @graph of an RO-Crate.
+type roEntity map[string]interface{}
+
+// roRef returns a JSON-LD reference to the entity with the given @id.
+func roRef(id string) roEntity {
+	return roEntity{"@id": id}
+}
+
+// ProvenanceCrate returns the contents of an ro-crate-metadata.json file that
+// describes how the given jobs (eg. those of a RepGroup, from
+// Client.GetByRepGroup()) were run, titled with the given name. Jobs that
+// have not yet run are left out.
+//
+// Each job that ran is a CreateAction with its command line, host, start and
+// end times and whether it completed or failed. The files it created (its
+// Artifacts, if it declared Outputs) are its results, and the Artifacts of the
+// jobs it depended on are its inputs. The software it used is described by
+// its cloud OS image, docker container and environment modules, where
+// specified.
+func ProvenanceCrate(name string, jobs []*Job) ([]byte, error) {
+	entities := make(map[string]roEntity)
+	add := func(e roEntity) {
+		id := e["@id"].(string)
+		if _, exists := entities[id]; !exists {
+			entities[id] = e
+		}
+	}
+
+	// so we can find the outputs of the jobs each job depended on
+	byKey := make(map[string]*Job, len(jobs))
+	byDepGroup := make(map[string][]*Job)
+	for _, job := range jobs {
+		byKey[job.Key()] = job
+		for _, dg := range job.DepGroups {
+			byDepGroup[dg] = append(byDepGroup[dg], job)
+		}
+	}
+
+	var actions, files []roEntity
+	for _, job := range jobs {
+		if job.StartTime.IsZero() {
+			continue
+		}
+		key := job.Key()
+
+		var software []roEntity
+		for _, sw := range jobSoftware(job) {
+			add(roEntity{"@id": "#software-" + sw, "@type": "SoftwareApplication", "name": sw})
+			software = append(software, roRef("#software-"+sw))
+		}
+		instrument := roEntity{"@id": "#cmd-" + key, "@type": "SoftwareApplication", "name": job.Cmd}
+		if len(software) > 0 {
+			instrument["softwareRequirements"] = software
+		}
+		add(instrument)
+
+		action := roEntity{
+			"@id":          "#job-" + key,
+			"@type":        "CreateAction",
+			"identifier":   key,
+			"name":         job.Cmd,
+			"instrument":   roRef("#cmd-" + key),
+			"startTime":    job.StartTime.UTC().Format(time.RFC3339),
+			"actionStatus": "http://schema.org/CompletedActionStatus",
+		}
+		if job.Name != "" {
+			action["alternateName"] = job.Name
+		}
+		if !job.EndTime.IsZero() {
+			action["endTime"] = job.EndTime.UTC().Format(time.RFC3339)
+		}
+		if job.State != JobStateComplete {
+			action["actionStatus"] = "http://schema.org/FailedActionStatus"
+			if job.FailReason != "" {
+				action["error"] = job.FailReason
+			}
+		}
+		if job.Host != "" {
+			add(roEntity{"@id": "#host-" + job.Host, "@type": "Place", "name": job.Host})
+			action["location"] = roRef("#host-" + job.Host)
+		}
+
+		var results []roEntity
+		for _, a := range job.Artifacts {
+			file := artifactEntity(job.Host, a)
+			if _, exists := entities[file["@id"].(string)]; !exists {
+				files = append(files, roRef(file["@id"].(string)))
+			}
+			add(file)
+			results = append(results, roRef(file["@id"].(string)))
+		}
+		if len(results) > 0 {
+			action["result"] = results
+		}
+
+		var inputs []roEntity
+		seen := make(map[string]bool)
+		for _, parent := range jobParents(job, byKey, byDepGroup) {
+			if parent == job {
+				continue
+			}
+			for _, a := range parent.Artifacts {
+				id := artifactEntity(parent.Host, a)["@id"].(string)
+				if !seen[id] {
+					seen[id] = true
+					inputs = append(inputs, roRef(id))
+				}
+			}
+		}
+		if len(inputs) > 0 {
+			action["object"] = inputs
+		}
+
+		add(action)
+		actions = append(actions, roRef("#job-"+key))
+	}
+
+	root := roEntity{
+		"@id":           "./",
+		"@type":         "Dataset",
+		"name":          name,
+		"datePublished": time.Now().UTC().Format(time.RFC3339),
+		"mentions":      actions,
+	}
+	if len(files) > 0 {
+		root["hasPart"] = files
+	}
+
+	graph := []roEntity{
+		{"@id": roCrateMeta, "@type": "CreativeWork", "conformsTo": roRef(roCrateSpec), "about": roRef("./")},
+		root,
+	}
+	ids := make([]string, 0, len(entities))
+	for id := range entities {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		graph = append(graph, entities[id])
+	}
+
+	return json.MarshalIndent(map[string]interface{}{"@context": roCrateContext, "@graph": graph}, "", "  ")
+}
+
+// jobSoftware returns the names of the OS image, container image, docker
+// container and environment modules the given job used.
+func jobSoftware(job *Job) []string {
+	var software []string
+	if job.Requirements != nil {
+		if image := job.Requirements.Other["cloud_os"]; image != "" {
+			software = append(software, image)
+		}
+	}
+	if job.ContainerImage != "" {
+		software = append(software, job.ContainerImage)
+	}
+	if job.MonitorDocker != "" && job.MonitorDocker != "?" {
+		software = append(software, job.MonitorDocker)
+	}
+	return append(software, job.EnvModules...)
+}
+
+// artifactEntity returns a File entity for the given Artifact of a job that
+// ran on the given host.
+func artifactEntity(host string, a *Artifact) roEntity {
+	file := roEntity{
+		"@id":         "file://" + host + a.Path,
+		"@type":       "File",
+		"name":        a.Path,
+		"contentSize": a.Size,
+	}
+	if a.MD5 != "" {
+		file["identifier"] = "md5:" + a.MD5
+	}
+	if a.Remote != "" {
+		file["sameAs"] = a.Remote
+	}
+	return file
+}
+
+// jobParents returns those of the given jobs that the given job depended on.
+func jobParents(job *Job, byKey map[string]*Job, byDepGroup map[string][]*Job) []*Job {
+	var parents []*Job
+	for _, dep := range job.Dependencies {
+		switch {
+		case dep.DepGroup != "":
+			parents = append(parents, byDepGroup[dep.DepGroup]...)
+		case dep.Essence != nil:
+			if parent, exists := byKey[dep.Essence.Key()]; exists {
+				parents = append(parents, parent)
+			}
+		}
+	}
+	return parents
+}
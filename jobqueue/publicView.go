@@ -0,0 +1,170 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the read-only public view of the status
+// webpage, which anyone can use to watch the progress of jobs without being
+// given the manager's token.
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/gorilla/websocket"
+)
+
+// statusViewTag is the tag in status.html that tells its javascript which view
+// of the page to show; we rewrite it to statusPublicViewTag in the public view.
+const (
+	statusViewTag       = `<meta name="wr-view" content="full">`
+	statusPublicViewTag = `<meta name="wr-view" content="public">`
+)
+
+// webInterfacePublicStatic is like webInterfaceStatic(), but needs no
+// authorization and serves the public view of the status page.
+func webInterfacePublicStatic(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path == "/" || path == "/status" {
+			path = "/status.html"
+		}
+
+		doc, err := _escFSByte(false, path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if path == "/status.html" {
+			doc = []byte(strings.Replace(string(doc), statusViewTag, statusPublicViewTag, 1))
+		}
+
+		switch {
+		case strings.HasPrefix(path, "/js"):
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		case strings.HasPrefix(path, "/css"):
+			w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		case strings.HasSuffix(path, ".html"):
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+
+		_, err = w.Write(doc)
+		if err != nil {
+			s.Error("public web interface static document write failed", "err", err)
+		}
+	}
+}
+
+// webInterfacePublicStatusWS is like webInterfaceStatusWS(), but needs no
+// authorization, only answers "current" requests, and only sends job state
+// counts, so that users of the public view can't see job details or affect
+// anything.
+func webInterfacePublicStatusWS(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := webSocket(w, r, s.webConfig().checkOrigin)
+		if !ok {
+			s.Error("Failed to set up public websocket", "Host", r.Host)
+			return
+		}
+
+		writeMutex := &sync.Mutex{}
+		storedName := s.storeWebSocketConnection(conn)
+		stopper := make(chan bool)
+
+		errd := conn.SetReadDeadline(time.Now().Add(ServerWebSocketPongWait))
+		if errd != nil {
+			s.Warn("public websocket read deadline could not be set", "err", errd)
+		}
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(ServerWebSocketPongWait))
+		})
+
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
+			defer internal.LogPanic(s.Logger, "jobqueue public websocket client handling", true)
+
+			defer func() {
+				s.closeWebSocketConnection(connStorageName)
+				close(stop)
+			}()
+
+			for {
+				req := jstatusReq{}
+				errr := conn.ReadJSON(&req)
+				if errr != nil {
+					break
+				}
+				errr = conn.SetReadDeadline(time.Now().Add(ServerWebSocketPongWait))
+				if errr != nil {
+					break
+				}
+
+				if !protocolVersionSupported(req.ProtocolVersion) {
+					writeMutex.Lock()
+					err := wsWriteJSON(conn, &jstatusProtocolError{ProtocolError: protocolVersionError(req.ProtocolVersion) + "; try reloading the page"})
+					writeMutex.Unlock()
+					if err != nil {
+						s.Warn("public status webpage protocol error failed to send JSON to client", "err", err)
+					}
+					continue
+				}
+
+				if req.Request != "current" {
+					continue
+				}
+
+				writeMutex.Lock()
+				err := s.sendCurrentStateCounts(conn, nil, "")
+				writeMutex.Unlock()
+				if err != nil {
+					break
+				}
+			}
+		}(conn, storedName, stopper)
+
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
+			defer internal.LogPanic(s.Logger, "jobqueue public websocket pinging", true)
+
+			ticker := time.NewTicker(ServerWebSocketPongWait * 9 / 10)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(ServerWebSocketWriteWait))
+					if err != nil {
+						s.closeWebSocketConnection(connStorageName)
+						return
+					}
+				}
+			}
+		}(conn, storedName, stopper)
+
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
+			defer internal.LogPanic(s.Logger, "jobqueue public websocket status updating", true)
+
+			q := s.relayCaster(s.statusCaster, connStorageName, "public", stop)
+			s.writeQueued(conn, writeMutex, connStorageName, "public", q, stop)
+		}(conn, storedName, stopper)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for configuring named queues, so that the jobs
+// of unrelated projects can be administered independently.
+//
+// A named queue is simply a namespace (see namespace.go): adding jobs with a
+// client that has called SetNamespace("projectX") (eg. `wr add --queue
+// projectX`) puts them in the "projectX" queue. A queue can optionally be given
+// a QueueConfig, which limits how many of its jobs can run at once, and
+// supplies default scheduler options for its jobs.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// queueLimitGroup is the limit group (qualified by the queue's namespace) that
+// jobs added to a configured queue are put in, to implement its Limit.
+const queueLimitGroup = "wr_queue"
+
+// QueueConfig holds the settings of a named queue.
+type QueueConfig struct {
+	// Name is the name of the queue, which is the namespace its jobs are added
+	// in.
+	Name string
+
+	// Limit, if greater than 0, is the most jobs of the queue that can run at
+	// once. Changes to the Limit take effect immediately for all jobs that
+	// were added to the queue since it was first configured.
+	Limit int
+
+	// SchedulerOptions are key=value pairs (eg. "cloud_flavor=m1.large") that
+	// are added to the Requirements.Other of jobs added to the queue that
+	// don't already specify a value for that key.
+	SchedulerOptions []string `codec:",omitempty"`
+}
+
+// validate checks the QueueConfig has a valid Name and sensible values.
+func (qc *QueueConfig) validate() error {
+	if !validNamespace.MatchString(qc.Name) {
+		return fmt.Errorf("queue name [%s] may only contain letters, numbers, underscores, dots and dashes", qc.Name)
+	}
+	if qc.Limit < 0 {
+		return fmt.Errorf("Limit can't be negative")
+	}
+	for _, option := range qc.SchedulerOptions {
+		if pos := strings.Index(option, "="); pos < 1 {
+			return fmt.Errorf("scheduler option [%s] is not of the form key=value", option)
+		}
+	}
+	return nil
+}
+
+// apply puts the given job, which is about to be added to our queue, in our
+// limit group, and gives it our SchedulerOptions. You must hold the job's lock.
+func (qc *QueueConfig) apply(job *Job) {
+	job.LimitGroups = append(job.LimitGroups, namespaced(qc.Name, queueLimitGroup))
+
+	if len(qc.SchedulerOptions) == 0 || job.Requirements == nil {
+		return
+	}
+	req := job.Requirements.Clone()
+	for _, option := range qc.SchedulerOptions {
+		pos := strings.Index(option, "=")
+		key, val := option[:pos], option[pos+1:]
+		if _, exists := req.Other[key]; exists {
+			continue
+		}
+		if req.Other == nil {
+			req.Other = make(map[string]string)
+		}
+		req.Other[key] = val
+		req.OtherSet = true
+	}
+	job.Requirements = req
+}
+
+// QueueInfo describes a named queue: its QueueConfig (if it has been
+// configured) and how many of its jobs are currently ready to run and running.
+type QueueInfo struct {
+	Name             string
+	Configured       bool
+	Limit            int
+	SchedulerOptions []string `codec:",omitempty"`
+	Ready            int
+	Running          int
+}
+
+// setQueueConfig creates or replaces the given QueueConfig, setting the limit
+// of its limit group.
+func (s *Server) setQueueConfig(qc *QueueConfig) (srerr string, qerr error) {
+	if qc == nil {
+		return ErrBadQueue, fmt.Errorf("no queue configuration supplied")
+	}
+	if err := qc.validate(); err != nil {
+		return ErrBadQueue, err
+	}
+
+	s.qcmutex.Lock()
+	defer s.qcmutex.Unlock()
+	if err := s.db.storeQueueConfig(qc); err != nil {
+		return ErrDBError, err
+	}
+	s.queueConfigs[qc.Name] = qc
+
+	limit := qc.Limit
+	if limit == 0 {
+		limit = -1
+	}
+	if err := s.storeLimitGroups(map[string]int{namespaced(qc.Name, queueLimitGroup): limit}); err != nil {
+		return ErrDBError, err
+	}
+	s.q.TriggerReadyAddedCallback()
+	return "", nil
+}
+
+// deleteQueueConfig forgets the QueueConfig of the named queue, removing the
+// limit of its limit group. The queue's jobs are unaffected.
+func (s *Server) deleteQueueConfig(name string) (srerr string, qerr error) {
+	s.qcmutex.Lock()
+	defer s.qcmutex.Unlock()
+	if _, exists := s.queueConfigs[name]; !exists {
+		return ErrUnknownQueue, fmt.Errorf("queue [%s] has not been configured", name)
+	}
+	if err := s.db.deleteQueueConfig(name); err != nil {
+		return ErrDBError, err
+	}
+	delete(s.queueConfigs, name)
+
+	if err := s.storeLimitGroups(map[string]int{namespaced(name, queueLimitGroup): -1}); err != nil {
+		return ErrDBError, err
+	}
+	s.q.TriggerReadyAddedCallback()
+	return "", nil
+}
+
+// applyQueueConfig applies the QueueConfig of the given job's queue to it, if
+// its queue has been configured. You must hold the job's lock.
+func (s *Server) applyQueueConfig(job *Job) {
+	if job.Namespace == "" {
+		return
+	}
+	s.qcmutex.RLock()
+	qc, exists := s.queueConfigs[job.Namespace]
+	s.qcmutex.RUnlock()
+	if exists {
+		qc.apply(job)
+	}
+}
+
+// getQueues returns details of every configured queue and every queue that
+// has jobs ready to run or running, sorted by Name. If namespace is not blank,
+// only that queue is returned.
+func (s *Server) getQueues(namespace string) []*QueueInfo {
+	infos := make(map[string]*QueueInfo)
+	info := func(name string) *QueueInfo {
+		qi, exists := infos[name]
+		if !exists {
+			qi = &QueueInfo{Name: name}
+			infos[name] = qi
+		}
+		return qi
+	}
+
+	s.qcmutex.RLock()
+	for name, qc := range s.queueConfigs {
+		qi := info(name)
+		qi.Configured = true
+		qi.Limit = qc.Limit
+		qi.SchedulerOptions = qc.SchedulerOptions
+	}
+	s.qcmutex.RUnlock()
+
+	s.nsmutex.RLock()
+	for name, usage := range s.nsUsage {
+		if name == "" || (usage.ready == 0 && usage.running == 0) {
+			continue
+		}
+		qi := info(name)
+		qi.Ready = usage.ready
+		qi.Running = usage.running
+	}
+	s.nsmutex.RUnlock()
+
+	queues := make([]*QueueInfo, 0, len(infos))
+	for name, qi := range infos {
+		if namespace != "" && name != namespace {
+			continue
+		}
+		queues = append(queues, qi)
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].Name < queues[j].Name
+	})
+	return queues
+}
@@ -0,0 +1,74 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that retries jobs that ran out of memory with
+// more RAM, instead of letting them get buried.
+
+import "math"
+
+// ramRetryRAM returns the RAM (in MB) that the given job, which just ran out of
+// memory, should be retried with according to its RepGroup's Policy, its own
+// or our RAM retry policy, or 0 if the policy doesn't apply, or the job can't
+// be given any more RAM.
+func (s *Server) ramRetryRAM(job *Job, endState *JobEndState) int {
+	policy := s.jobPolicy(job)
+	job.RLock()
+	mult, max := job.RAMRetryMult, job.RAMRetryMax
+	ram := job.Requirements.RAM
+	if job.retryRAM > ram {
+		ram = job.retryRAM
+	}
+	if job.PeakRAM > ram {
+		ram = job.PeakRAM
+	}
+	job.RUnlock()
+	if policy != nil {
+		if policy.RAMRetryMult != 0 {
+			mult = policy.RAMRetryMult
+		}
+		if policy.RAMRetryMax != 0 {
+			max = policy.RAMRetryMax
+		}
+	}
+	if endState != nil && endState.PeakRAM > ram {
+		ram = endState.PeakRAM
+	}
+
+	s.tmutex.RLock()
+	if mult == 0 {
+		mult = s.ramRetryMult
+	}
+	if max == 0 {
+		max = s.ramRetryMax
+	}
+	s.tmutex.RUnlock()
+	if mult <= 1 || ram <= 0 {
+		return 0
+	}
+
+	newRAM := int(math.Ceil(float64(ram) * mult))
+	if max > 0 && newRAM > max {
+		if ram >= max {
+			return 0
+		}
+		newRAM = max
+	}
+	return newRAM
+}
@@ -0,0 +1,346 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for changing a running Server's configuration.
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
+
+	"github.com/inconshreveable/log15"
+)
+
+// ReloadReport describes the outcome of reloading a Server's configuration
+// (see ServerConfig.Reload). The names are those of ServerConfig fields.
+type ReloadReport struct {
+	// Changed are the settings whose new values are now in effect.
+	Changed []string
+
+	// RestartRequired are the settings whose new values will only take
+	// effect after the server is restarted.
+	RestartRequired []string
+}
+
+// restartOnlySettings returns the values of the ServerConfig fields that can't
+// be changed without restarting the Server, keyed on field name.
+func restartOnlySettings(config ServerConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"Port":               config.Port,
+		"WebPort":            config.WebPort,
+		"PublicPort":         config.PublicPort,
+		"GRPCPort":           config.GRPCPort,
+		"SchedulerName":      config.SchedulerName,
+		"SchedulerConfig":    config.SchedulerConfig,
+		"RunnerCmd":          config.RunnerCmd,
+		"DBFile":             config.DBFile,
+		"DBFileBackup":       config.DBFileBackup,
+		"DBSnapshotInterval": config.DBSnapshotInterval,
+		"DBURL":              config.DBURL,
+		"TokenFile":          config.TokenFile,
+		"CAFile":             config.CAFile,
+		"CertFile":           config.CertFile,
+		"KeyFile":            config.KeyFile,
+		"CertDomain":         config.CertDomain,
+		"DomainMatchesIP":    config.DomainMatchesIP,
+		"Deployment":         config.Deployment,
+		"CIDR":               config.CIDR,
+		"UploadDir":          config.UploadDir,
+		"StorageZones":       config.StorageZones,
+		"EnrolCAFile":        config.EnrolCAFile,
+		"EnrolCAKeyFile":     config.EnrolCAKeyFile,
+		"SecretKeyFile":      config.SecretKeyFile,
+		"WebSocketSendLimit": config.WebSocketSendLimit,
+		"WebSocketOverflow":  config.WebSocketOverflow,
+		"StandbyOf":          config.StandbyOf,
+		"TakeoverCmd":        config.TakeoverCmd,
+		"ServiceAddr":        config.ServiceAddr,
+		"Admins":             config.Admins,
+	}
+}
+
+// reloadableSettings returns the values of the ServerConfig fields that
+// Reload() can change while the Server is running, keyed on field name.
+func reloadableSettings(config ServerConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"AutoConfirmDead":     config.AutoConfirmDead,
+		"BadServerPolicy":     config.BadServerPolicy,
+		"LostJobPolicy":       config.LostJobPolicy,
+		"Preemption":          config.Preemption,
+		"MaxJobsPerHost":      config.MaxJobsPerHost,
+		"HostJobLimits":       config.HostJobLimits,
+		"MaxStartsPerMinute":  config.MaxStartsPerMinute,
+		"RAMRetryMultiplier":  config.RAMRetryMultiplier,
+		"RAMRetryMax":         config.RAMRetryMax,
+		"TimeRetryMultiplier": config.TimeRetryMultiplier,
+		"BuriedExportDir":     config.BuriedExportDir,
+		"CostPerCoreHour":     config.CostPerCoreHour,
+		"RunnerReuse":         config.RunnerReuse,
+		"Backfill":            config.Backfill,
+		"ReservationTimeout":  config.ReservationTimeout,
+		"TrashPeriod":         config.TrashPeriod,
+		"NotifyComplete":      config.NotifyComplete,
+		"NotifyFailure":       config.NotifyFailure,
+		"SMTPServer":          config.SMTPServer,
+		"SMTPFrom":            config.SMTPFrom,
+		"DefaultBehaviours":   config.DefaultBehaviours,
+		"NamespaceWeights":    config.NamespaceWeights,
+		"FairShare":           config.FairShare,
+		"WebPrefix":           config.WebPrefix,
+		"WebCORSOrigins":      config.WebCORSOrigins,
+		"TrustedProxies":      config.TrustedProxies,
+		"LogLevel":            config.LogLevel,
+	}
+}
+
+// changedSettings returns the names of the settings whose values differ, in a
+// consistent order.
+func changedSettings(old, new map[string]interface{}) []string {
+	var changed []string
+	for name, val := range old {
+		if !reflect.DeepEqual(val, new[name]) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// validateReloadable checks the settings of the given config that Reload() can
+// change, returning the webConfig they describe.
+func validateReloadable(config ServerConfig) (*webConfig, error) {
+	if config.Preemption != nil {
+		if err := config.Preemption.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.BadServerPolicy != nil {
+		if err := config.BadServerPolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.LostJobPolicy != nil {
+		if err := config.LostJobPolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxJobsPerHost < 0 {
+		return nil, fmt.Errorf("MaxJobsPerHost can't be negative")
+	}
+	if config.MaxStartsPerMinute < 0 {
+		return nil, fmt.Errorf("MaxStartsPerMinute can't be negative")
+	}
+	if config.RAMRetryMultiplier < 0 || config.RAMRetryMax < 0 {
+		return nil, fmt.Errorf("RAMRetryMultiplier and RAMRetryMax can't be negative")
+	}
+	if config.TimeRetryMultiplier < 0 {
+		return nil, fmt.Errorf("TimeRetryMultiplier can't be negative")
+	}
+	if config.CostPerCoreHour < 0 {
+		return nil, fmt.Errorf("CostPerCoreHour can't be negative")
+	}
+	if config.RunnerReuse < 0 || config.RunnerReuse > 1 {
+		return nil, fmt.Errorf("RunnerReuse must be between 0 and 1")
+	}
+	if config.ReservationTimeout < 0 {
+		return nil, fmt.Errorf("ReservationTimeout can't be negative")
+	}
+	if config.TrashPeriod < 0 {
+		return nil, fmt.Errorf("TrashPeriod can't be negative")
+	}
+	if err := validateNotifyTargets(config.NotifyComplete); err != nil {
+		return nil, fmt.Errorf("NotifyComplete is not valid: %s", err)
+	}
+	if err := validateNotifyTargets(config.NotifyFailure); err != nil {
+		return nil, fmt.Errorf("NotifyFailure is not valid: %s", err)
+	}
+	if err := config.DefaultBehaviours.validateDefaults(); err != nil {
+		return nil, err
+	}
+	if err := validateNamespaceWeights(config.NamespaceWeights); err != nil {
+		return nil, err
+	}
+	if _, err := ParseFairShare(config.FairShare); err != nil {
+		return nil, err
+	}
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		return nil, err
+	}
+	if err := validateHostJobLimits(config.HostJobLimits); err != nil {
+		return nil, err
+	}
+	web, err := newWebConfig(config.WebPrefix, config.WebCORSOrigins, config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("TrustedProxies is not valid: %s", err)
+	}
+	return web, nil
+}
+
+// Reload gets a new configuration from our ServerConfig.Reload and puts the
+// settings that can be changed while we're running in to effect. Settings that
+// can only be changed by restarting are left alone, but reported. If the new
+// configuration isn't valid, nothing is changed and an error is returned.
+//
+// This is called when we receive a SIGHUP, or when a client calls
+// Client.ReloadServerConfig().
+func (s *Server) Reload() (*ReloadReport, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	if s.config.Reload == nil {
+		return nil, fmt.Errorf("this server was not configured to be reloadable")
+	}
+
+	if _, errn := systemdNotify("RELOADING=1"); errn != nil {
+		s.Warn("failed to notify systemd that we're reloading", "err", errn)
+	}
+	defer func() {
+		if _, errn := systemdNotify("READY=1"); errn != nil {
+			s.Warn("failed to notify systemd that we've reloaded", "err", errn)
+		}
+	}()
+
+	config, err := s.config.Reload()
+	if err != nil {
+		return nil, err
+	}
+	web, err := validateReloadable(config)
+	if err != nil {
+		return nil, err
+	}
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReloadReport{
+		Changed:         changedSettings(reloadableSettings(s.config), reloadableSettings(config)),
+		RestartRequired: changedSettings(restartOnlySettings(s.config), restartOnlySettings(config)),
+	}
+
+	s.tmutex.Lock()
+	resume := s.preemption != nil && config.Preemption == nil
+	s.autoConfirmDead = config.AutoConfirmDead
+	s.bsPolicy = config.BadServerPolicy
+	s.lostPolicy = config.LostJobPolicy
+	s.preemption = config.Preemption
+	s.maxJobsPerHost = config.MaxJobsPerHost
+	s.hostJobLimits = config.HostJobLimits
+	s.ramRetryMult = config.RAMRetryMultiplier
+	s.ramRetryMax = config.RAMRetryMax
+	s.timeRetryMult = config.TimeRetryMultiplier
+	s.buriedExportDir = config.BuriedExportDir
+	s.costPerCoreHour = config.CostPerCoreHour
+	s.runnerReuse = config.RunnerReuse
+	s.backfill = config.Backfill
+	s.reservationTimeout = config.ReservationTimeout
+	s.trashPeriod = config.TrashPeriod
+	s.notifyComplete = config.NotifyComplete
+	s.notifyFailure = config.NotifyFailure
+	s.smtpServer = config.SMTPServer
+	s.smtpFrom = config.SMTPFrom
+	s.defaultBehaviours = config.DefaultBehaviours
+	s.namespaceWeights = config.NamespaceWeights
+	s.fairShare = config.FairShare
+	s.web = web
+	s.tmutex.Unlock()
+
+	s.srmutex.Lock()
+	s.globalStartRate.max = config.MaxStartsPerMinute
+	s.srmutex.Unlock()
+
+	s.logLevel.set(level)
+
+	if resume {
+		s.resumeSuspendedJobs()
+	}
+
+	// keep the settings we couldn't change as they were, so that they're
+	// reported again until we're restarted
+	reloaded := s.config
+	reloaded.AutoConfirmDead = config.AutoConfirmDead
+	reloaded.BadServerPolicy = config.BadServerPolicy
+	reloaded.LostJobPolicy = config.LostJobPolicy
+	reloaded.Preemption = config.Preemption
+	reloaded.MaxJobsPerHost = config.MaxJobsPerHost
+	reloaded.HostJobLimits = config.HostJobLimits
+	reloaded.MaxStartsPerMinute = config.MaxStartsPerMinute
+	reloaded.RAMRetryMultiplier = config.RAMRetryMultiplier
+	reloaded.RAMRetryMax = config.RAMRetryMax
+	reloaded.TimeRetryMultiplier = config.TimeRetryMultiplier
+	reloaded.BuriedExportDir = config.BuriedExportDir
+	reloaded.CostPerCoreHour = config.CostPerCoreHour
+	reloaded.RunnerReuse = config.RunnerReuse
+	reloaded.Backfill = config.Backfill
+	reloaded.ReservationTimeout = config.ReservationTimeout
+	reloaded.TrashPeriod = config.TrashPeriod
+	reloaded.NotifyComplete = config.NotifyComplete
+	reloaded.NotifyFailure = config.NotifyFailure
+	reloaded.SMTPServer = config.SMTPServer
+	reloaded.SMTPFrom = config.SMTPFrom
+	reloaded.DefaultBehaviours = config.DefaultBehaviours
+	reloaded.NamespaceWeights = config.NamespaceWeights
+	reloaded.FairShare = config.FairShare
+	reloaded.WebPrefix = config.WebPrefix
+	reloaded.WebCORSOrigins = config.WebCORSOrigins
+	reloaded.TrustedProxies = config.TrustedProxies
+	reloaded.LogLevel = config.LogLevel
+	s.config = reloaded
+
+	s.Info("reloaded configuration", "changed", report.Changed, "restartRequired", report.RestartRequired)
+	return report, nil
+}
+
+// logLevelFilter passes on log records at or above a level that can be changed
+// at any time.
+type logLevelFilter struct {
+	level int32 // a log15.Lvl, or -1 to pass on everything
+}
+
+// parseLogLevel converts a ServerConfig.LogLevel to a log15.Lvl, with blank
+// meaning -1.
+func parseLogLevel(level string) (log15.Lvl, error) {
+	if level == "" {
+		return -1, nil
+	}
+	lvl, err := log15.LvlFromString(level)
+	if err != nil {
+		return -1, fmt.Errorf("LogLevel is not valid: %s", err)
+	}
+	return lvl, nil
+}
+
+// set changes the level at or above which we pass on records.
+func (f *logLevelFilter) set(level log15.Lvl) {
+	atomic.StoreInt32(&f.level, int32(level))
+}
+
+// handler returns a log15.Handler that passes records at or above our level
+// to whatever handler the given logger has at the time.
+func (f *logLevelFilter) handler(logger log15.Logger) log15.Handler {
+	return log15.FuncHandler(func(r *log15.Record) error {
+		level := atomic.LoadInt32(&f.level)
+		if level >= 0 && r.Lvl > log15.Lvl(level) {
+			return nil
+		}
+		return logger.GetHandler().Log(r)
+	})
+}
@@ -0,0 +1,220 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for archiving the complete jobs of a RepGroup to
+// a portable file, and restoring such files for read-only viewing.
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/ugorji/go/codec"
+)
+
+// repGroupArchiveVersion is the version of the RepGroupArchive format we
+// create; we refuse to restore archives from the future.
+const repGroupArchiveVersion = 1
+
+// RepGroupArchive is the content of a RepGroup archive file, made by
+// Client.ArchiveRepGroup(). It holds the complete jobs of the RepGroup, as
+// they were when they completed, including their resource usage stats and
+// (in StdOutC and StdErrC, for use with Job.StdOut() and StdErr()) any
+// STDOUT and STDERR the manager kept, along with their histories.
+type RepGroupArchive struct {
+	Version  int
+	RepGroup string
+	Created  time.Time
+	Jobs     []*Job
+	Events   [][]*JobEvent // Events[i] is the history of Jobs[i]
+}
+
+// encode returns the compressed encoding of the archive, the content of an
+// archive file.
+func (a *RepGroupArchive) encode() ([]byte, error) {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, new(codec.BincHandle))
+	err := enc.Encode(a)
+	if err != nil {
+		return nil, err
+	}
+	return compress(encoded)
+}
+
+// DecodeRepGroupArchive parses the content of an archive file made by
+// Client.ArchiveRepGroup(), so you can look at it without a manager.
+func DecodeRepGroupArchive(data []byte) (*RepGroupArchive, error) {
+	encoded, err := decompressUnlimited(data)
+	if err != nil {
+		return nil, fmt.Errorf("not a RepGroup archive: %w", err)
+	}
+	a := &RepGroupArchive{}
+	dec := codec.NewDecoderBytes(encoded, new(codec.BincHandle))
+	err = dec.Decode(a)
+	if err != nil {
+		return nil, fmt.Errorf("not a RepGroup archive: %w", err)
+	}
+	if a.RepGroup == "" {
+		return nil, fmt.Errorf("not a RepGroup archive: no RepGroup")
+	}
+	if a.Version > repGroupArchiveVersion {
+		return nil, fmt.Errorf("RepGroup archive version %d is newer than this version of wr supports", a.Version)
+	}
+	return a, nil
+}
+
+// archiveRepGroup does the server side of Client.ArchiveRepGroup(), returning
+// the archive file content, and the keys of the archived jobs.
+func (s *Server) archiveRepGroup(repGroup string) ([]byte, []string, error) {
+	incomplete := false
+	s.q.Each(func(item *queue.Item) bool {
+		job := item.Data().(*Job)
+		job.RLock()
+		defer job.RUnlock()
+		if job.RepGroup == repGroup {
+			incomplete = true
+			return false
+		}
+		return true
+	})
+	if incomplete {
+		return nil, nil, fmt.Errorf("RepGroup %s has incomplete jobs", repGroup)
+	}
+
+	jobs, err := s.db.retrieveCompleteJobsByRepGroup(repGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, nil, fmt.Errorf("RepGroup %s has no complete jobs", repGroup)
+	}
+
+	a := &RepGroupArchive{
+		Version:  repGroupArchiveVersion,
+		RepGroup: repGroup,
+		Created:  time.Now(),
+		Jobs:     jobs,
+		Events:   make([][]*JobEvent, len(jobs)),
+	}
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		key := job.Key()
+		keys[i] = key
+		if stdo, stde := s.db.retrieveJobStd(key); stdo != nil || stde != nil {
+			job.StdOutC, job.StdErrC = stdo, stde
+		}
+		events, errr := s.db.retrieveJobEvents(key)
+		if errr != nil {
+			return nil, nil, errr
+		}
+		a.Events[i] = events
+	}
+
+	data, err := a.encode()
+	return data, keys, err
+}
+
+// ArchiveRepGroup returns the content of a portable archive file holding the
+// complete jobs of the given RepGroup: their details, resource usage stats,
+// STDOUT and STDERR (where kept) and histories. The RepGroup must not have any
+// incomplete jobs.
+//
+// If remove is true, the archived jobs are then removed from the manager's
+// database, so long-term records of finished projects can be kept without
+// bloating it. (What was learned about their resource usage is kept, so
+// recommendations for future jobs are unaffected.)
+//
+// Use DecodeRepGroupArchive() to read the archive yourself, or
+// RestoreRepGroup() to let this or another manager show it again.
+func (c *Client) ArchiveRepGroup(repGroup string, remove bool) ([]byte, error) {
+	return c.ArchiveRepGroupContext(context.Background(), repGroup, remove)
+}
+
+// ArchiveRepGroupContext is like ArchiveRepGroup(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) ArchiveRepGroupContext(ctx context.Context, repGroup string, remove bool) ([]byte, error) {
+	cr := &clientRequest{Method: "archiverg", Job: &Job{RepGroup: repGroup}, Prune: remove}
+	cr.failoverSafe = !remove
+	resp, err := c.requestContext(ctx, cr)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Archive, err
+}
+
+// RestoreRepGroup stores the given archive file content, made by
+// ArchiveRepGroup() on this or another manager, so that it can be viewed with
+// GetRestoredRepGroup(). Restored jobs are read-only: they are not put back in
+// the queue or treated as complete when you add the same commands again.
+// Restoring an archive of a RepGroup that was previously restored replaces
+// it. Returns the name of the RepGroup.
+func (c *Client) RestoreRepGroup(archive []byte) (string, error) {
+	return c.RestoreRepGroupContext(context.Background(), archive)
+}
+
+// RestoreRepGroupContext is like RestoreRepGroup(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) RestoreRepGroupContext(ctx context.Context, archive []byte) (string, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "restorerg", File: archive})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.RepGroups) != 1 {
+		return "", fmt.Errorf("manager did not report the restored RepGroup")
+	}
+	return resp.RepGroups[0], err
+}
+
+// GetRestoredRepGroups returns the names of the RepGroups that have been
+// restored with RestoreRepGroup().
+func (c *Client) GetRestoredRepGroups() ([]string, error) {
+	return c.GetRestoredRepGroupsContext(context.Background())
+}
+
+// GetRestoredRepGroupsContext is like GetRestoredRepGroups(), but stops
+// waiting for the server and returns ctx.Err() if ctx is cancelled or reaches
+// its deadline first.
+func (c *Client) GetRestoredRepGroupsContext(ctx context.Context) ([]string, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getrestored"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.RepGroups, err
+}
+
+// GetRestoredRepGroup returns the archive of the given RepGroup that was
+// restored with RestoreRepGroup(), or nil if there isn't one.
+func (c *Client) GetRestoredRepGroup(repGroup string) (*RepGroupArchive, error) {
+	return c.GetRestoredRepGroupContext(context.Background(), repGroup)
+}
+
+// GetRestoredRepGroupContext is like GetRestoredRepGroup(), but stops waiting
+// for the server and returns ctx.Err() if ctx is cancelled or reaches its
+// deadline first.
+func (c *Client) GetRestoredRepGroupContext(ctx context.Context, repGroup string) (*RepGroupArchive, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getrestored", Job: &Job{RepGroup: repGroup}})
+	if err != nil || resp.Archive == nil {
+		return nil, err
+	}
+	return DecodeRepGroupArchive(resp.Archive)
+}
@@ -0,0 +1,146 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for getting the jobs of all the RepGroups that
+// match a glob or regular expression, so that related RepGroups can be dealt
+// with in a single request.
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RepGroupMatch describes how the RepGroup given to
+// Client.GetByRepGroupMatching() is matched against the RepGroups of jobs.
+type RepGroupMatch string
+
+// RepGroupMatch* constants are the ways you can match RepGroups.
+const (
+	// RepGroupMatchGlob treats the RepGroup as a glob pattern, as understood
+	// by filepath.Match(), that must match whole RepGroups.
+	RepGroupMatchGlob RepGroupMatch = "glob"
+
+	// RepGroupMatchRegex treats the RepGroup as a regular expression, as
+	// understood by regexp.Compile(), that matches any RepGroup it is found
+	// in (anchor it with ^ and $ to match whole RepGroups).
+	RepGroupMatchRegex RepGroupMatch = "regex"
+)
+
+// repGroupMatcher returns a function that tells you if a RepGroup matches the
+// given pattern, or an error if the pattern or type of match is invalid.
+func repGroupMatcher(pattern string, match RepGroupMatch) (func(string) bool, error) {
+	switch match {
+	case RepGroupMatchGlob:
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid RepGroup glob [%s]: %s", pattern, err)
+		}
+		return func(rg string) bool {
+			matched, _ := filepath.Match(pattern, rg)
+			return matched
+		}, nil
+	case RepGroupMatchRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RepGroup regex [%s]: %s", pattern, err)
+		}
+		return re.MatchString, nil
+	}
+	return nil, fmt.Errorf("invalid RepGroup match type [%s]", match)
+}
+
+// matchingRepGroups returns the RepGroups of the jobs in the queue (and, if
+// complete is true, of all jobs that have ever been added) that match the
+// given pattern. If namespace is set, only RepGroups in that namespace are
+// considered, and the pattern is matched against their unqualified names.
+// If the pattern is invalid or the RepGroups couldn't be retrieved, returns
+// ErrBadRequest or ErrDBError respectively, along with the error.
+func (s *Server) matchingRepGroups(pattern string, match RepGroupMatch, namespace string, complete bool) ([]string, string, error) {
+	matches, err := repGroupMatcher(pattern, match)
+	if err != nil {
+		return nil, ErrBadRequest, err
+	}
+
+	candidates := make(map[string]bool)
+	s.rpl.RLock()
+	for rg, keys := range s.rpl.lookup {
+		if len(keys) > 0 {
+			candidates[rg] = true
+		}
+	}
+	s.rpl.RUnlock()
+
+	if complete {
+		rgs, errr := s.db.retrieveRepGroups()
+		if errr != nil {
+			return nil, ErrDBError, errr
+		}
+		for _, rg := range rgs {
+			candidates[rg] = true
+		}
+	}
+
+	var prefix string
+	if namespace != "" {
+		prefix = namespace + namespaceSeparator
+	}
+
+	var matching []string
+	for rg := range candidates {
+		if prefix != "" && !strings.HasPrefix(rg, prefix) {
+			continue
+		}
+		if matches(unnamespaced(namespace, rg)) {
+			matching = append(matching, rg)
+		}
+	}
+	sort.Strings(matching)
+	return matching, "", nil
+}
+
+// getJobsByRepGroupMatch gets jobs (current and complete) in all the RepGroups
+// that match the given pattern, as per matchingRepGroups(). Jobs that are in
+// more than one of those RepGroups are only returned once.
+func (s *Server) getJobsByRepGroupMatch(pattern string, match RepGroupMatch, namespace string, limit int, state JobState, filter *JobFilter, getStd bool, getEnv bool) ([]*Job, string, string) {
+	rgs, srerr, err := s.matchingRepGroups(pattern, match, namespace, state == "" || state == JobStateComplete)
+	if err != nil {
+		return nil, srerr, err.Error()
+	}
+
+	found, srerr, qerr := s.getJobsInRepGroups(rgs, state)
+
+	seen := make(map[string]bool, len(found))
+	jobs := make([]*Job, 0, len(found))
+	for _, job := range found {
+		key := job.Key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		jobs = append(jobs, job)
+	}
+
+	if limit > 0 || state != "" || filter != nil || getStd || getEnv {
+		jobs = s.limitJobs(jobs, limit, state, filter, getStd, getEnv)
+	}
+	return jobs, srerr, qerr
+}
@@ -0,0 +1,130 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for deciding whether jobs that are added again
+// after they previously completed should be run again.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// RerunMode describes what happens when you add jobs that were previously added
+// and have since completed.
+type RerunMode string
+
+// RerunMode* constants are the possible RerunModes.
+const (
+	// RerunSkip skips previously completed jobs, counting them as existing.
+	RerunSkip RerunMode = "skip"
+
+	// RerunForce runs previously completed jobs again.
+	RerunForce RerunMode = "force"
+
+	// RerunIfChanged runs previously completed jobs again only if their Cmd,
+	// mounts or environment differ from when they completed, otherwise skipping
+	// them.
+	RerunIfChanged RerunMode = "if-changed"
+)
+
+// ParseRerunMode converts the given string to a RerunMode. Blank means
+// RerunSkip.
+func ParseRerunMode(mode string) (RerunMode, error) {
+	switch RerunMode(mode) {
+	case "":
+		return RerunSkip, nil
+	case RerunSkip, RerunForce, RerunIfChanged:
+		return RerunMode(mode), nil
+	}
+	return "", fmt.Errorf("rerun mode must be one of %s, %s or %s, not [%s]", RerunSkip, RerunForce, RerunIfChanged, mode)
+}
+
+// rerunModeFromIgnoreComplete converts the ignoreComplete argument of our
+// older Add*() methods to a RerunMode.
+func rerunModeFromIgnoreComplete(ignoreComplete bool) RerunMode {
+	if ignoreComplete {
+		return RerunSkip
+	}
+	return RerunForce
+}
+
+// rerunHash returns a checksum of the parts of a job that, if changed, mean it
+// should be run again in RerunIfChanged mode: its Cmd, mounts and environment
+// (as given by the supplied key of its stored environment variables, along
+// with any overrides).
+func (j *Job) rerunHash(envkey string) (string, error) {
+	j.RLock()
+	defer j.RUnlock()
+	overrides, err := j.envCurrentOverrides()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, part := range []string{j.Cmd, j.MountConfigs.Key(), envkey, strings.Join(overrides, "\x00")} {
+		if _, err = h.Write([]byte(part + "\x01")); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// skipUnchangedCompleteJobs returns the given jobs that should be added in
+// RerunIfChanged mode (to then be created with ignoreComplete false), along
+// with the number that were not, because they previously completed with the
+// same rerunHash. The given envkey is that of the environment the jobs will be
+// added with.
+func (s *Server) skipUnchangedCompleteJobs(jobs []*Job, envkey string) ([]*Job, int, error) {
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		keys[i] = job.Key()
+	}
+	complete, err := s.db.retrieveCompleteJobsByKeys(keys)
+	if err != nil || len(complete) == 0 {
+		return jobs, 0, err
+	}
+
+	completeHashes := make(map[string]string, len(complete))
+	for _, job := range complete {
+		hash, errh := job.rerunHash(job.EnvKey)
+		if errh != nil {
+			return nil, 0, errh
+		}
+		completeHashes[job.Key()] = hash
+	}
+
+	var changed []*Job
+	var skipped int
+	for i, job := range jobs {
+		if completeHash, found := completeHashes[keys[i]]; found {
+			hash, errh := job.rerunHash(envkey)
+			if errh != nil {
+				return nil, 0, errh
+			}
+			if hash == completeHash {
+				skipped++
+				continue
+			}
+		}
+		changed = append(changed, job)
+	}
+	return changed, skipped, nil
+}
@@ -0,0 +1,153 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for releasing jobs that runners reserve but fail
+// to start running in time.
+
+import (
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/gofrs/uuid"
+)
+
+// ReservationTimeout describes the jobs that runners on a host reserved but
+// failed to start running within ServerConfig.ReservationTimeout.
+type ReservationTimeout struct {
+	Host    string    // hostname of the runners, or "" if they didn't say
+	Count   int       // the number of jobs that weren't started in time
+	Last    time.Time // when the most recent of those jobs was released
+	LastKey string    // the key of the most recent of those jobs
+}
+
+// startReservationTimer arranges for the job with the given key, just reserved
+// by the given client on the given host, to be released if it isn't started
+// within our reservationTimeout.
+func (s *Server) startReservationTimer(key string, clientID uuid.UUID, host string) {
+	s.tmutex.RLock()
+	timeout := s.reservationTimeout
+	s.tmutex.RUnlock()
+
+	s.rtmutex.Lock()
+	defer s.rtmutex.Unlock()
+	if timer, exists := s.reservationTimers[key]; exists {
+		timer.Stop()
+		delete(s.reservationTimers, key)
+	}
+	if timeout <= 0 {
+		return
+	}
+
+	s.reservationTimers[key] = time.AfterFunc(timeout, func() {
+		defer internal.LogPanic(s.Logger, "reservation timeout", true)
+		s.rtmutex.Lock()
+		delete(s.reservationTimers, key)
+		s.rtmutex.Unlock()
+		s.reservationExpired(key, clientID, host)
+	})
+}
+
+// stopReservationTimer stops any timer started by startReservationTimer() for
+// the job with the given key, for when it has been started.
+func (s *Server) stopReservationTimer(key string) {
+	s.rtmutex.Lock()
+	defer s.rtmutex.Unlock()
+	if timer, exists := s.reservationTimers[key]; exists {
+		timer.Stop()
+		delete(s.reservationTimers, key)
+	}
+}
+
+// reservationExpired releases the job with the given key back to the ready
+// queue, if it is still reserved by the given client and has not been started,
+// and records the incident against the given host.
+func (s *Server) reservationExpired(key string, clientID uuid.UUID, host string) {
+	s.ssmutex.RLock()
+	up := s.up
+	s.ssmutex.RUnlock()
+	if !up {
+		return
+	}
+
+	item, err := s.q.Get(key)
+	if err != nil || item.Stats().State != queue.ItemStateRun {
+		return
+	}
+	job := item.Data().(*Job)
+
+	// forget who reserved the job, so that the runner can't start it after
+	// we've released it, even if it still gets round to trying
+	job.Lock()
+	if job.ReservedBy != clientID || !job.StartTime.IsZero() {
+		job.Unlock()
+		return
+	}
+	job.ReservedBy = uuid.Nil
+	job.Unlock()
+
+	// go straight back to ready instead of waiting out the usual release
+	// delay, since there was nothing wrong with the job itself
+	if err = s.q.SetDelay(key, 0); err == nil {
+		err = s.q.Release(key)
+	}
+	if err != nil {
+		s.Warn("failed to release job not started in time", "job", key, "err", err)
+		return
+	}
+
+	job.decrementLimitGroups(s.limiter)
+	job.Lock()
+	job.State = JobStateReady
+	job.FailReason = FailReasonNoStart
+	job.Unlock()
+	s.decrementGroupCount(job.getSchedulerGroup())
+	s.db.updateJobAfterChange(job)
+
+	s.rtmutex.Lock()
+	rt, exists := s.reservationIssues[host]
+	if !exists {
+		rt = &ReservationTimeout{Host: host}
+		s.reservationIssues[host] = rt
+	}
+	rt.Count++
+	rt.Last = time.Now()
+	rt.LastKey = key
+	s.rtmutex.Unlock()
+
+	s.Warn("released job that was reserved but not started in time", "job", key, "host", host)
+}
+
+// getReservationTimeouts returns copies of the incidents recorded by
+// reservationExpired(), sorted by host.
+func (s *Server) getReservationTimeouts() []*ReservationTimeout {
+	s.rtmutex.Lock()
+	rts := make([]*ReservationTimeout, 0, len(s.reservationIssues))
+	for _, rt := range s.reservationIssues {
+		c := *rt
+		rts = append(rts, &c)
+	}
+	s.rtmutex.Unlock()
+	sort.Slice(rts, func(i, j int) bool {
+		return rts[i].Host < rts[j].Host
+	})
+	return rts
+}
@@ -0,0 +1,170 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for reserving a job from any one of multiple
+// scheduler groups, for clients that can run jobs from more than one.
+
+import (
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// reqsFitCapacity tells you if a job with the given Requirements could run
+// within the given capacity. A capacity Time or Disk of 0 means unlimited.
+// Other requirements of the job must be present in the capacity's Other.
+func reqsFitCapacity(capacity, job *scheduler.Requirements) bool {
+	if job.RAM > capacity.RAM || job.Cores > capacity.Cores {
+		return false
+	}
+	if capacity.Time > 0 && job.Time > capacity.Time {
+		return false
+	}
+	if capacity.Disk > 0 && job.Disk > capacity.Disk {
+		return false
+	}
+	for key, val := range job.Other {
+		if capacity.Other[key] != val {
+			return false
+		}
+	}
+	return true
+}
+
+// capacityMatch returns a queue.Match that only matches jobs whose
+// Requirements fit within the given capacity, or nil if capacity is nil.
+func capacityMatch(capacity *scheduler.Requirements) queue.Match {
+	if capacity == nil {
+		return nil
+	}
+	return func(item *queue.Item) bool {
+		job, ok := item.Data().(*Job)
+		if !ok {
+			return true
+		}
+		job.RLock()
+		defer job.RUnlock()
+		return job.Requirements == nil || reqsFitCapacity(capacity, job.Requirements)
+	}
+}
+
+// sortGroupsByFit sorts the given scheduler groups so that those with the
+// largest Requirements come first, so that a client that could run any of them
+// makes the best use of its resources. You must hold the sgcmutex lock.
+func (s *Server) sortGroupsByFit(groups []string) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		ri, rj := s.sgtr[groups[i]], s.sgtr[groups[j]]
+		if ri == nil || rj == nil {
+			return ri != nil
+		}
+		if ri.RAM != rj.RAM {
+			return ri.RAM > rj.RAM
+		}
+		if ri.Cores != rj.Cores {
+			return ri.Cores > rj.Cores
+		}
+		return groups[i] < groups[j]
+	})
+}
+
+// capacityGroups returns the scheduler groups with jobs that need running whose
+// Requirements fit within the given capacity, best fitting first. If we're not
+// scheduling runners, all jobs are in the same group, which is returned.
+func (s *Server) capacityGroups(capacity *scheduler.Requirements) []string {
+	s.racmutex.RLock()
+	rc := s.rc
+	s.racmutex.RUnlock()
+	if rc == "" {
+		return []string{""}
+	}
+
+	s.sgcmutex.Lock()
+	defer s.sgcmutex.Unlock()
+	var groups []string
+	for group, count := range s.sgroupcounts {
+		req, known := s.sgtr[group]
+		if count <= 0 || !known || !reqsFitCapacity(capacity, req) {
+			continue
+		}
+		groups = append(groups, group)
+	}
+	s.sortGroupsByFit(groups)
+	return groups
+}
+
+// reserveGroups works out which scheduler groups the given reserve request can
+// get a job from, in order of preference: the request's SchedulerGroups in the
+// order given, then any groups that fit in its Capacity.
+func (s *Server) reserveGroups(cr *clientRequest) []string {
+	groups := make([]string, 0, len(cr.SchedulerGroups))
+	seen := make(map[string]bool)
+	add := func(group string) {
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+	for _, group := range cr.SchedulerGroups {
+		add(group)
+	}
+	if cr.Capacity != nil {
+		for _, group := range s.capacityGroups(cr.Capacity) {
+			add(group)
+		}
+	}
+	return groups
+}
+
+// reserveFromGroupsWithLimits is like reserveWithLimits(), but reserves a job
+// from any of the given scheduler groups, preferring those earlier in the
+// slice, waiting up to the given time for a job in any of them to become
+// ready. Groups whose limit groups are currently at their limit are skipped.
+func (s *Server) reserveFromGroupsWithLimits(groups []string, wait time.Duration, filter queue.Filter, match queue.Match) (*queue.Item, error) {
+	available := make([]string, 0, len(groups))
+	incremented := make(map[string][]string)
+	for _, group := range groups {
+		limitGroups := limitGroupTokens(s.schedGroupToLimitGroups(group))
+		if len(limitGroups) > 0 {
+			if !s.limiter.Increment(limitGroups, 0) {
+				continue
+			}
+			incremented[group] = limitGroups
+		}
+		available = append(available, group)
+	}
+
+	item, err := s.q.ReserveFiltered(available, wait, filter, match)
+
+	var reservedGroup string
+	if item != nil {
+		reservedGroup = item.ReserveGroup
+	}
+	for group, limitGroups := range incremented {
+		if item != nil && group == reservedGroup {
+			item.Data().(*Job).noteIncrementedLimitGroups(limitGroups)
+			continue
+		}
+		s.limiter.Decrement(limitGroups)
+	}
+
+	return item, err
+}
@@ -0,0 +1,134 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for summarising the utilisation of the hosts
+// running jobs, for the status webpage's resources panel and 'wr status
+// --hosts'.
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// FlavorCount is the number of hosts of a particular cloud flavor, as part of
+// a ResourceUsage.
+type FlavorCount struct {
+	Flavor string
+	Hosts  int
+}
+
+// ResourceUsage summarises the utilisation of the hosts that are running jobs
+// or that the job scheduler knows about, as returned by Client.GetResources().
+type ResourceUsage struct {
+	Time time.Time
+
+	// Hosts are as per Client.GetHostUsage(), but without their Jobs.
+	Hosts []*HostUsage
+
+	// Running is the number of jobs running on the Hosts, and Cores and RAM
+	// (MB) the sum of their requirements.
+	Running int
+	Cores   float64
+	RAM     int
+
+	// MaxCores and MaxRAM (MB) are the sum of the capacity of the Hosts that
+	// the job scheduler knows the capacity of.
+	MaxCores float64
+	MaxRAM   int
+
+	// Flavors are the number of Hosts of each cloud flavor, sorted by flavor
+	// name. Hosts of unknown flavor are not counted.
+	Flavors []*FlavorCount
+}
+
+// resourceUsage summarises getHostUsage().
+func (s *Server) resourceUsage() *ResourceUsage {
+	ru := &ResourceUsage{Time: time.Now()}
+	flavors := make(map[string]int)
+	for _, hu := range s.getHostUsage() {
+		hu.Jobs = nil
+		ru.Hosts = append(ru.Hosts, hu)
+		ru.Running += hu.Running
+		ru.Cores += hu.Cores
+		ru.RAM += hu.RAM
+		ru.MaxCores += hu.MaxCores
+		ru.MaxRAM += hu.MaxRAM
+		if hu.Flavor != "" {
+			flavors[hu.Flavor]++
+		}
+	}
+
+	for flavor, count := range flavors {
+		ru.Flavors = append(ru.Flavors, &FlavorCount{Flavor: flavor, Hosts: count})
+	}
+	sort.Slice(ru.Flavors, func(i, j int) bool {
+		return ru.Flavors[i].Flavor < ru.Flavors[j].Flavor
+	})
+	return ru
+}
+
+// resourceBroadcaster periodically sends a resourceUsage() to the status
+// webpages that are connected, every ServerResourcesInterval, until we stop.
+func (s *Server) resourceBroadcaster() {
+	defer internal.LogPanic(s.Logger, "jobqueue resource broadcaster", true)
+
+	ticker := time.NewTicker(ServerResourcesInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ssmutex.RLock()
+		up := s.up
+		s.ssmutex.RUnlock()
+		if !up {
+			return
+		}
+
+		s.wsmutex.Lock()
+		watched := len(s.wsconns) > 0
+		s.wsmutex.Unlock()
+		if !watched {
+			continue
+		}
+
+		s.resourceCaster.Send(s.resourceUsage())
+	}
+}
+
+// GetResources returns a summary of the utilisation of the hosts that are
+// running jobs or that the job scheduler knows about (such as idle cloud
+// servers): how many jobs each is running, the cores and RAM those jobs
+// requested versus the host's capacity, the host's load and memory use as
+// recently reported by its runners, and how many hosts there are of each cloud
+// flavor. This is what 'wr status --hosts' displays.
+func (c *Client) GetResources() (*ResourceUsage, error) {
+	return c.GetResourcesContext(context.Background())
+}
+
+// GetResourcesContext is like GetResources(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetResourcesContext(ctx context.Context) (*ResourceUsage, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getresources"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Resources, err
+}
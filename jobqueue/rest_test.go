@@ -23,6 +23,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -30,12 +31,15 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/cloud"
 	"github.com/VertebrateResequencing/wr/internal"
 	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/gorilla/websocket"
 	"github.com/inconshreveable/log15"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -58,9 +62,14 @@ func TestREST(t *testing.T) {
 	// load our config to know where our development manager port is supposed to
 	// be; we'll use that to test jobqueue
 	config := internal.ConfigLoad("development", true, testLogger)
+	publicPort, errt := freeLocalPort()
+	if errt != nil {
+		log.Fatalf("could not get a free port: %s\n", errt)
+	}
 	serverConfig := ServerConfig{
 		Port:            config.ManagerPort,
 		WebPort:         config.ManagerWeb,
+		PublicPort:      publicPort,
 		SchedulerName:   "local",
 		SchedulerConfig: &jqs.ConfigLocal{Shell: config.RunnerExecShell},
 		UploadDir:       uploadsDir,
@@ -79,6 +88,13 @@ func TestREST(t *testing.T) {
 	uploadEndPoint := baseURL + "/rest/v1/upload"
 	warningsEndPoint := baseURL + "/rest/v1/warnings/"
 	serversEndPoint := baseURL + "/rest/v1/servers/"
+	artifactsEndPoint := baseURL + "/rest/v1/artifacts/"
+	metricsEndPoint := baseURL + "/rest/v1/metrics/"
+	efficiencyEndPoint := baseURL + "/rest/v1/efficiency/"
+	prometheusEndPoint := baseURL + "/rest/v1/metrics/prometheus"
+	rootMetricsEndPoint := baseURL + "/metrics"
+	utilisationEndPoint := baseURL + "/rest/v1/utilisation/"
+	exportEndPoint := baseURL + "/rest/v1/export/"
 
 	setDomainIP(config.ManagerCertDomain)
 
@@ -131,6 +147,430 @@ func TestREST(t *testing.T) {
 			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
 		})
 
+		Convey("A custom Authenticator can allow or deny requests", func() {
+			defer func() {
+				server.auth = RequireToken
+			}()
+			server.auth = AnyOf(RequireToken, AuthenticatorFunc(func(req *AuthRequest) error {
+				if req.Kind == AuthKindREST && req.HTTP.Header.Get("X-Remote-User") == "alice" {
+					return nil
+				}
+				return errors.New("unknown user")
+			}))
+
+			req, err := http.NewRequest(http.MethodGet, jobsEndPoint, nil)
+			So(err, ShouldBeNil)
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+			req.Header.Add("X-Remote-User", "alice")
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+
+			allowed, err := AllowCIDRs("192.0.2.0/24")
+			So(err, ShouldBeNil)
+			server.auth = AllOf(RequireToken, allowed)
+			req, err = http.NewRequest(http.MethodGet, jobsEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusForbidden)
+
+			_, err = AllowCIDRs("foo")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The web server can be used behind a reverse proxy and from other origins", func() {
+			defer func(orig *webConfig) {
+				server.web = orig
+				server.auth = RequireToken
+			}(server.web)
+			web, err := newWebConfig("wr/", []string{"https://dash.example.org"}, []string{"127.0.0.0/8", "::1/128"})
+			So(err, ShouldBeNil)
+			So(web.prefix, ShouldEqual, "/wr")
+			server.web = web
+
+			_, err = newWebConfig("", nil, []string{"foo"})
+			So(err, ShouldNotBeNil)
+
+			req, err := http.NewRequest(http.MethodGet, baseURL+"/wr/rest/v1/jobs", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+
+			req, err = http.NewRequest(http.MethodGet, baseURL+"/wr/status?token="+string(token), nil)
+			So(err, ShouldBeNil)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			body, err := ioutil.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldContainSubstring, `<base href="/wr/">`)
+
+			req, err = http.NewRequest(http.MethodOptions, baseURL+"/wr/rest/v1/jobs", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Origin", "https://dash.example.org")
+			req.Header.Add("Access-Control-Request-Method", http.MethodGet)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusNoContent)
+			So(response.Header.Get("Access-Control-Allow-Origin"), ShouldEqual, "https://dash.example.org")
+			So(response.Header.Get("Access-Control-Allow-Headers"), ShouldContainSubstring, "Authorization")
+
+			req, err = http.NewRequest(http.MethodGet, jobsEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			req.Header.Add("Origin", "https://evil.example.org")
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			So(response.Header.Get("Access-Control-Allow-Origin"), ShouldBeBlank)
+
+			allowed, err := AllowCIDRs("192.0.2.0/24")
+			So(err, ShouldBeNil)
+			server.auth = AllOf(RequireToken, allowed)
+			req, err = http.NewRequest(http.MethodGet, jobsEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusForbidden)
+
+			req.Header.Add("X-Forwarded-For", "192.0.2.7, 127.0.0.1")
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+
+			server.web, err = newWebConfig("", nil, nil)
+			So(err, ShouldBeNil)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("The status websocket pings clients and drops ones that don't respond", func() {
+			defer func(orig time.Duration) {
+				ServerWebSocketPongWait = orig
+			}(ServerWebSocketPongWait)
+			ServerWebSocketPongWait = 500 * time.Millisecond
+
+			dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+			wsURL := "wss://" + config.ManagerCertDomain + ":" + config.ManagerWeb + "/status_ws?token=" + string(token)
+
+			alive, _, err := dialer.Dial(wsURL, nil)
+			So(err, ShouldBeNil)
+			defer alive.Close()
+			pinged := make(chan bool, 10)
+			alive.SetPingHandler(func(data string) error {
+				pinged <- true
+				return alive.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			})
+			go func() {
+				for {
+					if _, _, errr := alive.ReadMessage(); errr != nil {
+						return
+					}
+				}
+			}()
+
+			dead, _, err := dialer.Dial(wsURL, nil)
+			So(err, ShouldBeNil)
+			defer dead.Close()
+			<-time.After(100 * time.Millisecond)
+			So(server.GetServerStats().WebSocketConns, ShouldEqual, 2)
+
+			<-time.After(1500 * time.Millisecond)
+			So(len(pinged), ShouldBeGreaterThan, 0)
+			So(server.GetServerStats().WebSocketConns, ShouldEqual, 1)
+		})
+
+		Convey("The public status view needs no token and only gives state counts", func() {
+			publicURL := "https://" + config.ManagerCertDomain + ":" + publicPort
+
+			response, err := client.Get(publicURL + "/")
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			page, err := ioutil.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			So(string(page), ShouldContainSubstring, statusPublicViewTag)
+
+			response, err = client.Get(publicURL + restJobsEndpoint)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+			inserts, _, err := jq.Add([]*Job{{Cmd: "echo public", Cwd: "/tmp", ReqGroup: "public", Requirements: &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}, RepGroup: "public"}}, os.Environ(), true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 1)
+
+			dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+			ws, _, err := dialer.Dial("wss://"+config.ManagerCertDomain+":"+publicPort+"/status_ws", nil)
+			So(err, ShouldBeNil)
+			defer ws.Close()
+
+			err = ws.WriteJSON(&jstatusReq{Request: "details", RepGroup: "public", State: JobStateReady, ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			err = ws.WriteJSON(&jstatusReq{Request: "remove", RepGroup: "public", ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			err = ws.WriteJSON(&jstatusReq{Request: "current", ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+
+			counts := make(map[string]int)
+			for i := 0; i < 2; i++ {
+				var jsc map[string]interface{}
+				err = ws.ReadJSON(&jsc)
+				So(err, ShouldBeNil)
+				So(jsc, ShouldNotContainKey, "Cmd")
+				So(jsc["ToState"], ShouldEqual, string(JobStateReady))
+				counts[jsc["RepGroup"].(string)] = int(jsc["Count"].(float64))
+			}
+			So(counts, ShouldResemble, map[string]int{"+all+": 1, "public": 1})
+
+			<-time.After(250 * time.Millisecond)
+			job, err := jq.GetByEssence(&JobEssence{Cmd: "echo public"}, false, false)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+		})
+
+		Convey("The status webpage can view and change limit groups", func() {
+			dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+			ws, _, err := dialer.Dial("wss://"+config.ManagerCertDomain+":"+config.ManagerWeb+"/status_ws?token="+string(token), nil)
+			So(err, ShouldBeNil)
+			defer ws.Close()
+
+			// (other messages, such as job state changes, can arrive first)
+			readLimitGroups := func() *jstatusLimitGroups {
+				for {
+					_, data, errr := ws.ReadMessage()
+					if errr != nil {
+						return nil
+					}
+					if !strings.Contains(string(data), `"LimitGroups"`) {
+						continue
+					}
+					jslg := &jstatusLimitGroups{}
+					if errr = json.Unmarshal(data, jslg); errr != nil {
+						return nil
+					}
+					return jslg
+				}
+			}
+
+			err = ws.WriteJSON(&jstatusReq{Request: "limitGroups", LimitGroup: "wslim", Limit: 3, ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			jslg := readLimitGroups()
+			So(jslg, ShouldNotBeNil)
+			So(len(jslg.LimitGroups), ShouldEqual, 1)
+			So(jslg.LimitGroups[0].Name, ShouldEqual, "wslim")
+			So(jslg.LimitGroups[0].Limit, ShouldEqual, 3)
+			So(jslg.LimitGroups[0].Current, ShouldEqual, 0)
+
+			l, _, err := server.getSetLimitGroup("wslim")
+			So(err, ShouldBeNil)
+			So(l, ShouldEqual, 3)
+
+			err = ws.WriteJSON(&jstatusReq{Request: "limitGroups", LimitGroup: "wslim", Limit: -1, ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			jslg = readLimitGroups()
+			So(jslg, ShouldNotBeNil)
+			So(jslg.LimitGroups, ShouldBeEmpty)
+		})
+
+		Convey("The status webpage can get the dependency graph", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+			reqs := &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}
+			inserts, _, err := jq.Add([]*Job{
+				{Cmd: "echo dgup", Cwd: "/tmp", ReqGroup: "dg", Requirements: reqs, RepGroup: "dgup", DepGroups: []string{"dgup"}},
+				{Cmd: "echo dgdown1", Cwd: "/tmp", ReqGroup: "dg", Requirements: reqs, RepGroup: "dgdown", Dependencies: Dependencies{NewDepGroupDependency("dgup")}},
+				{Cmd: "echo dgdown2", Cwd: "/tmp", ReqGroup: "dg", Requirements: reqs, RepGroup: "dgdown", Dependencies: Dependencies{NewDepGroupDependency("dgup")}},
+			}, os.Environ(), true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 3)
+
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Cmd, ShouldEqual, "echo dgup")
+			err = jq.Bury(job, nil, "test bury")
+			So(err, ShouldBeNil)
+			upKey := job.Key()
+
+			dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+			ws, _, err := dialer.Dial("wss://"+config.ManagerCertDomain+":"+config.ManagerWeb+"/status_ws?token="+string(token), nil)
+			So(err, ShouldBeNil)
+			defer ws.Close()
+
+			readDepGraph := func() *DepGraph {
+				for {
+					_, data, errr := ws.ReadMessage()
+					if errr != nil {
+						return nil
+					}
+					if !strings.Contains(string(data), `"DepGraph"`) {
+						continue
+					}
+					jsdg := &jstatusDepGraph{}
+					if errr = json.Unmarshal(data, jsdg); errr != nil {
+						return nil
+					}
+					return jsdg.DepGraph
+				}
+			}
+
+			err = ws.WriteJSON(&jstatusReq{Request: "depgraph", ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			dg := readDepGraph()
+			So(dg, ShouldNotBeNil)
+			So(dg.RepGroup, ShouldBeBlank)
+			nodes := make(map[string]*DepGraphNode)
+			for _, node := range dg.Nodes {
+				nodes[node.ID] = node
+			}
+			So(nodes["dgup"], ShouldNotBeNil)
+			So(nodes["dgup"].Counts, ShouldResemble, map[JobState]int{JobStateBuried: 1})
+			So(nodes["dgdown"], ShouldNotBeNil)
+			So(nodes["dgdown"].Counts, ShouldResemble, map[JobState]int{JobStateDependent: 2})
+			So(dg.Edges, ShouldContain, &DepGraphEdge{From: "dgup", To: "dgdown", Jobs: 2, Blocked: 2})
+
+			err = ws.WriteJSON(&jstatusReq{Request: "depgraph", RepGroup: "dgdown", ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			dg = readDepGraph()
+			So(dg, ShouldNotBeNil)
+			So(dg.RepGroup, ShouldEqual, "dgdown")
+			So(len(dg.Nodes), ShouldEqual, 3)
+			So(len(dg.Edges), ShouldEqual, 2)
+			for _, edge := range dg.Edges {
+				So(edge.From, ShouldEqual, upKey)
+				So(edge.Blocked, ShouldEqual, 1)
+			}
+
+			deleted, err := jq.Delete([]*JobEssence{{Cmd: "echo dgdown1"}, {Cmd: "echo dgdown2"}, {Cmd: "echo dgup"}})
+			So(err, ShouldBeNil)
+			So(deleted, ShouldEqual, 3)
+		})
+
+		Convey("The status webpage can modify and retry jobs", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+			inserts, _, err := jq.Add([]*Job{
+				{Cmd: "echo wsmod1", Cwd: "/tmp", ReqGroup: "wsmod", Requirements: &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}, RepGroup: "wsmod"},
+				{Cmd: "echo wsmod2", Cwd: "/tmp", ReqGroup: "wsmod", Requirements: &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}, RepGroup: "wsmod"},
+			}, os.Environ(), true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 2)
+
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			buriedCmd := job.Cmd
+			err = jq.Bury(job, nil, "test bury")
+			So(err, ShouldBeNil)
+
+			dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+			ws, _, err := dialer.Dial("wss://"+config.ManagerCertDomain+":"+config.ManagerWeb+"/status_ws?token="+string(token), nil)
+			So(err, ShouldBeNil)
+			defer ws.Close()
+
+			readModified := func() *jstatusModified {
+				for {
+					_, data, errr := ws.ReadMessage()
+					if errr != nil {
+						return nil
+					}
+					if !strings.Contains(string(data), `"Modified"`) {
+						continue
+					}
+					jsm := &jstatusModified{}
+					if errr = json.Unmarshal(data, jsm); errr != nil {
+						return nil
+					}
+					return jsm
+				}
+			}
+
+			ram := 20
+			pri := 3
+			err = ws.WriteJSON(&jstatusReq{Request: "modify", RepGroup: "wsmod", Modify: &jstatusModify{RAM: &ram, Priority: &pri}, ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			jsm := readModified()
+			So(jsm, ShouldNotBeNil)
+			So(jsm.ModifyError, ShouldBeBlank)
+			So(jsm.Modified, ShouldEqual, 1) // the buried job has a different FailReason
+			So(jsm.Retried, ShouldEqual, 0)
+
+			got, err := jq.GetByRepGroup("wsmod", false, 0, "", false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 2)
+			for _, j := range got {
+				if j.Cmd == buriedCmd {
+					So(j.Requirements.RAM, ShouldEqual, 10)
+				} else {
+					So(j.Requirements.RAM, ShouldEqual, 20)
+					So(j.Priority, ShouldEqual, 3)
+				}
+			}
+
+			ram = 30
+			err = ws.WriteJSON(&jstatusReq{Request: "modify", RepGroup: "wsmod", State: JobStateBuried, Exitcode: -1, FailReason: "test bury", Modify: &jstatusModify{RAM: &ram, Retry: true}, ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			jsm = readModified()
+			So(jsm, ShouldNotBeNil)
+			So(jsm.ModifyError, ShouldBeBlank)
+			So(jsm.Modified, ShouldEqual, 1)
+			So(jsm.Retried, ShouldEqual, 1)
+
+			got, err = jq.GetByRepGroup("wsmod", false, 0, "", false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 2)
+			for _, j := range got {
+				So(j.State, ShouldEqual, JobStateReady)
+				if j.Cmd == buriedCmd {
+					So(j.Requirements.RAM, ShouldEqual, 30)
+				} else {
+					So(j.Requirements.RAM, ShouldEqual, 20)
+				}
+			}
+
+			ram = -1
+			err = ws.WriteJSON(&jstatusReq{Request: "modify", RepGroup: "wsmod", Modify: &jstatusModify{RAM: &ram}, ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			jsm = readModified()
+			So(jsm, ShouldNotBeNil)
+			So(jsm.ModifyError, ShouldNotBeBlank)
+			So(jsm.Modified, ShouldEqual, 0)
+		})
+
+		Convey("The status webpage can get the utilisation of the hosts", func() {
+			dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+			ws, _, err := dialer.Dial("wss://"+config.ManagerCertDomain+":"+config.ManagerWeb+"/status_ws?token="+string(token), nil)
+			So(err, ShouldBeNil)
+			defer ws.Close()
+
+			err = ws.WriteJSON(&jstatusReq{Request: "resources", ProtocolVersion: ProtocolVersion})
+			So(err, ShouldBeNil)
+			var ru *ResourceUsage
+			for ru == nil {
+				_, data, errr := ws.ReadMessage()
+				So(errr, ShouldBeNil)
+				if strings.Contains(string(data), `"Flavors"`) {
+					ru = &ResourceUsage{}
+					So(json.Unmarshal(data, ru), ShouldBeNil)
+				}
+			}
+			So(ru.Running, ShouldEqual, 0)
+			So(ru.Time.IsZero(), ShouldBeFalse)
+		})
+
 		Convey("Initial GET queries return nothing", func() {
 			req, err := http.NewRequest(http.MethodGet, jobsEndPoint, nil)
 			So(err, ShouldBeNil)
@@ -187,6 +627,144 @@ func TestREST(t *testing.T) {
 			So(jstati[2].ExpectedTime, ShouldEqual, 120)
 			So(jstati[2].Cores, ShouldEqual, 2)
 
+			Convey("You can GET metrics on the server's queue operations", func() {
+				req, err := http.NewRequest(http.MethodGet, metricsEndPoint, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+				responseData, err := ioutil.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+
+				var metrics ServerMetrics
+				err = json.Unmarshal(responseData, &metrics)
+				So(err, ShouldBeNil)
+				So(metrics.Stats, ShouldNotBeNil)
+				So(metrics.Stats.Ready, ShouldEqual, 3)
+				So(metrics.QueueOps, ShouldNotBeNil)
+				So(metrics.QueueOps.Ops[queue.OpAdd], ShouldNotBeNil)
+				So(metrics.QueueOps.Ops[queue.OpAdd].Items, ShouldBeGreaterThanOrEqualTo, 3)
+				So(len(metrics.QueueOps.Ops[queue.OpAdd].Histogram), ShouldEqual, len(queue.OpLatencyBuckets)+1)
+				So(metrics.QueueOps.ItemRate(queue.OpAdd), ShouldBeGreaterThan, 0)
+			})
+
+			Convey("You can GET the history of queue depths and utilisation", func() {
+				err := server.db.storeUtilisation(server.utilisationSnapshot())
+				So(err, ShouldBeNil)
+
+				getSnaps := func(url string) ([]*UtilisationSnapshot, int) {
+					req, errr := http.NewRequest(http.MethodGet, url, nil)
+					So(errr, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, errr := client.Do(req)
+					So(errr, ShouldBeNil)
+					if response.StatusCode != http.StatusOK {
+						return nil, response.StatusCode
+					}
+					responseData, errr := ioutil.ReadAll(response.Body)
+					So(errr, ShouldBeNil)
+					var snaps []*UtilisationSnapshot
+					errr = json.Unmarshal(responseData, &snaps)
+					So(errr, ShouldBeNil)
+					return snaps, response.StatusCode
+				}
+
+				snaps, status := getSnaps(utilisationEndPoint)
+				So(status, ShouldEqual, http.StatusOK)
+				So(len(snaps), ShouldEqual, 1)
+				So(snaps[0].Ready, ShouldEqual, 3)
+				So(snaps[0].Running, ShouldEqual, 0)
+
+				snaps, status = getSnaps(utilisationEndPoint + "?to=" + time.Now().Add(-1*time.Hour).Format(time.RFC3339))
+				So(status, ShouldEqual, http.StatusOK)
+				So(len(snaps), ShouldEqual, 0)
+
+				_, status = getSnaps(utilisationEndPoint + "?from=yesterday")
+				So(status, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("You can GET an export of the resources used by complete jobs", func() {
+				getExport := func(url string) (string, string, int) {
+					req, errr := http.NewRequest(http.MethodGet, url, nil)
+					So(errr, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, errr := client.Do(req)
+					So(errr, ShouldBeNil)
+					responseData, errr := ioutil.ReadAll(response.Body)
+					So(errr, ShouldBeNil)
+					return string(responseData), response.Header.Get("Content-Type"), response.StatusCode
+				}
+
+				body, contentType, status := getExport(exportEndPoint)
+				So(status, ShouldEqual, http.StatusOK)
+				So(contentType, ShouldStartWith, "text/csv")
+				So(body, ShouldStartWith, "user,repgroup,reqgroup,jobs,cpu_hours,wall_hours,peak_ram_mb,core_hours,instance_hours\n")
+
+				body, contentType, status = getExport(exportEndPoint + "?format=json&by=user&from=" + time.Now().Add(-1*time.Hour).Format(time.RFC3339))
+				So(status, ShouldEqual, http.StatusOK)
+				So(contentType, ShouldStartWith, "application/json")
+				var records []*ExportRecord
+				err := json.Unmarshal([]byte(body), &records)
+				So(err, ShouldBeNil)
+
+				_, _, status = getExport(exportEndPoint + "?format=xml")
+				So(status, ShouldEqual, http.StatusBadRequest)
+				_, _, status = getExport(exportEndPoint + "?by=host")
+				So(status, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("You can GET SLO metrics on each RepGroup in the Prometheus format", func() {
+				<-time.After(50 * time.Millisecond)
+				req, err := http.NewRequest(http.MethodGet, prometheusEndPoint, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+				So(response.Header.Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+				responseData, err := ioutil.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+
+				body := string(responseData)
+				So(body, ShouldContainSubstring, "# TYPE wr_repgroup_oldest_pending_seconds gauge\n")
+				So(body, ShouldContainSubstring, "wr_repgroup_jobs{repgroup=\"rp1\"} 2\n")
+				So(body, ShouldContainSubstring, "wr_repgroup_pending_jobs{repgroup=\"rp1\"} 2\n")
+				So(body, ShouldContainSubstring, "wr_repgroup_pending_jobs{repgroup=\"rp2\"} 1\n")
+				So(body, ShouldContainSubstring, "wr_repgroup_failure_ratio{repgroup=\"rp2\"} 0\n")
+				So(body, ShouldContainSubstring, "wr_repgroup_seconds_since_last_completion{repgroup=\"rp2\"} ")
+				So(body, ShouldNotContainSubstring, "wr_repgroup_last_completion_timestamp_seconds{")
+
+				req, err = http.NewRequest(http.MethodGet, prometheusEndPoint, nil)
+				So(err, ShouldBeNil)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("You can GET queue, RepGroup state and scheduler metrics from /metrics", func() {
+				<-time.After(50 * time.Millisecond)
+				req, err := http.NewRequest(http.MethodGet, rootMetricsEndPoint, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+				responseData, err := ioutil.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+
+				body := string(responseData)
+				So(body, ShouldContainSubstring, "wr_repgroup_jobs{repgroup=\"rp1\"} 2\n")
+				So(body, ShouldContainSubstring, "wr_queue_jobs{state=\"ready\"} 3\n")
+				So(body, ShouldContainSubstring, "wr_queue_jobs{state=\"buried\"} 0\n")
+				So(body, ShouldContainSubstring, "wr_buried_jobs 0\n")
+				So(body, ShouldContainSubstring, "wr_repgroup_state_jobs{repgroup=\"rp1\",state=\"ready\"} 2\n")
+				So(body, ShouldContainSubstring, "wr_repgroup_state_jobs{repgroup=\"rp2\",state=\"ready\"} 1\n")
+				So(body, ShouldContainSubstring, "# TYPE wr_scheduler_request_seconds summary\n")
+				So(body, ShouldContainSubstring, "wr_scheduler_request_seconds_count ")
+				So(body, ShouldContainSubstring, "wr_cloud_servers 0\n")
+			})
+
 			Convey("You can GET the current status of all jobs", func() {
 				req, err := http.NewRequest(http.MethodGet, jobsEndPoint, nil)
 				So(err, ShouldBeNil)
@@ -457,6 +1035,29 @@ func TestREST(t *testing.T) {
 						So(jstati3[0].StdOut, ShouldEqual, "")
 					})
 
+					Convey("You can PUT buried jobs to retry them", func() {
+						req, err := http.NewRequest(http.MethodPut, jobsEndPoint+"/rp1", nil)
+						So(err, ShouldBeNil)
+						req.Header.Add("Authorization", bearer)
+						response, err := client.Do(req)
+						So(err, ShouldBeNil)
+						responseData, err := ioutil.ReadAll(response.Body)
+						So(err, ShouldBeNil)
+						So(response.StatusCode, ShouldEqual, http.StatusOK)
+
+						var jstati []JStatus
+						err = json.Unmarshal(responseData, &jstati)
+						So(err, ShouldBeNil)
+						So(len(jstati), ShouldEqual, 1)
+						So(jstati[0].Key, ShouldEqual, "db1e7d99becace3306c1c2470331c78e")
+						So(jstati[0].State, ShouldEqual, JobStateReady)
+
+						got, err := jq.GetByEssence(&JobEssence{JobKey: "db1e7d99becace3306c1c2470331c78e"}, false, false)
+						So(err, ShouldBeNil)
+						So(got.State, ShouldEqual, JobStateReady)
+						So(got.UntilBuried, ShouldEqual, 1)
+					})
+
 					Convey("You can GET all jobs by state and RepGroup", func() {
 						req, err := http.NewRequest(http.MethodGet, jobsEndPoint+"/rp1?state=ready", nil)
 						So(err, ShouldBeNil)
@@ -472,6 +1073,55 @@ func TestREST(t *testing.T) {
 						So(len(jstati), ShouldEqual, 1)
 						So(jstati[0].Key, ShouldEqual, "de6d167c58701e55f5b9f9e1e91d7807")
 					})
+
+					Convey("You can GET efficiency summaries of RepGroups", func() {
+						getEffs := func(url string) []*RepGroupEfficiency {
+							req, errr := http.NewRequest(http.MethodGet, url, nil)
+							So(errr, ShouldBeNil)
+							req.Header.Add("Authorization", bearer)
+							response, errr := client.Do(req)
+							So(errr, ShouldBeNil)
+							So(response.StatusCode, ShouldEqual, http.StatusOK)
+							responseData, errr := ioutil.ReadAll(response.Body)
+							So(errr, ShouldBeNil)
+
+							var effs []*RepGroupEfficiency
+							errr = json.Unmarshal(responseData, &effs)
+							So(errr, ShouldBeNil)
+							return effs
+						}
+
+						effs := getEffs(efficiencyEndPoint)
+						So(len(effs), ShouldEqual, 2)
+						So(effs[0].RepGroup, ShouldEqual, "rp1")
+						So(effs[0].Jobs, ShouldEqual, 0)
+						So(effs[1].RepGroup, ShouldEqual, "rp2")
+						So(effs[0].RAMUsage, ShouldBeNil)
+
+						for i := 0; i < 2; i++ {
+							job, errr := jq.Reserve(50 * time.Millisecond)
+							So(errr, ShouldBeNil)
+							So(job, ShouldNotBeNil)
+							if job.RepGroup == "rp1" {
+								errr = jq.Execute(job, config.RunnerExecShell)
+								So(errr, ShouldBeNil)
+							}
+						}
+
+						effs = getEffs(efficiencyEndPoint + "rp1")
+						So(len(effs), ShouldEqual, 1)
+						So(effs[0].RepGroup, ShouldEqual, "rp1")
+						So(effs[0].Jobs, ShouldEqual, 1)
+						So(effs[0].WallTime, ShouldBeGreaterThan, 0)
+						So(effs[0].RAMRequested, ShouldEqual, 1000)
+						So(effs[0].RAMPeak, ShouldBeGreaterThan, 0)
+						So(effs[0].RAMUsage, ShouldNotBeNil)
+						So(effs[0].RAMUsage.Median, ShouldEqual, float64(effs[0].RAMPeak)/1000)
+
+						effs = getEffs(efficiencyEndPoint + "rp?search=true")
+						So(len(effs), ShouldEqual, 1)
+						So(effs[0].Jobs, ShouldEqual, 1)
+					})
 				})
 			})
 		})
@@ -520,6 +1170,98 @@ func TestREST(t *testing.T) {
 			})
 		})
 
+		Convey("You can POST jobs with names and name_deps, and GET them by name", func() {
+			inputJobs := []*JobViaJSON{
+				{Cmd: "echo named", RepGrp: "named", Name: "sample42"},
+				{Cmd: "echo named dep", RepGrp: "named", NameDeps: []string{"sample42"}},
+			}
+			jsonValue, err := json.Marshal(inputJobs)
+			So(err, ShouldBeNil)
+
+			req, err := http.NewRequest(http.MethodPost, jobsEndPoint+"/", bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			req.Header.Add("Content-Type", "application/json")
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err := ioutil.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var jstati []JStatus
+			err = json.Unmarshal(responseData, &jstati)
+			So(err, ShouldBeNil)
+			So(len(jstati), ShouldEqual, 2)
+
+			req, err = http.NewRequest(http.MethodGet, jobsEndPoint+"/sample42", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err = ioutil.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			jstati = nil
+			err = json.Unmarshal(responseData, &jstati)
+			So(err, ShouldBeNil)
+			So(len(jstati), ShouldEqual, 1)
+			So(jstati[0].Name, ShouldEqual, "sample42")
+			So(jstati[0].State, ShouldEqual, "ready")
+
+			req, err = http.NewRequest(http.MethodGet, jobsEndPoint+"/named?state=dependent", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err = ioutil.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			jstati = nil
+			err = json.Unmarshal(responseData, &jstati)
+			So(err, ShouldBeNil)
+			So(len(jstati), ShouldEqual, 1)
+			So(jstati[0].Cmd, ShouldEqual, "echo named dep")
+		})
+
+		Convey("You can POST jobs with metadata, and GET them filtered by it", func() {
+			inputJobs := []*JobViaJSON{
+				{Cmd: "echo meta 1", RepGrp: "meta", Metadata: json.RawMessage(`{"sample":"s1","run":{"lane":1}}`)},
+				{Cmd: "echo meta 2", RepGrp: "meta", Metadata: json.RawMessage(`{"sample":"s2","run":{"lane":1}}`)},
+				{Cmd: "echo meta 3", RepGrp: "meta"},
+			}
+			jsonValue, err := json.Marshal(inputJobs)
+			So(err, ShouldBeNil)
+
+			req, err := http.NewRequest(http.MethodPost, jobsEndPoint+"/", bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			req.Header.Add("Content-Type", "application/json")
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusCreated)
+
+			get := func(query string) []JStatus {
+				req, err := http.NewRequest(http.MethodGet, jobsEndPoint+"/meta?"+query, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				responseData, err := ioutil.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+				var jstati []JStatus
+				err = json.Unmarshal(responseData, &jstati)
+				So(err, ShouldBeNil)
+				return jstati
+			}
+
+			So(len(get("")), ShouldEqual, 3)
+
+			jstati := get("meta.sample=s2")
+			So(len(jstati), ShouldEqual, 1)
+			So(jstati[0].Cmd, ShouldEqual, "echo meta 2")
+			So(string(jstati[0].Metadata), ShouldEqual, `{"sample":"s2","run":{"lane":1}}`)
+
+			So(len(get("meta.run.lane=1")), ShouldEqual, 2)
+			So(len(get("meta.run.lane=1&meta.sample=s1")), ShouldEqual, 1)
+			So(len(get("meta.sample=s3")), ShouldEqual, 0)
+		})
+
 		Convey("You must supply certain properties when adding jobs", func() {
 			inputJobs := []*JobViaJSON{{RepGrp: "foo"}}
 			jsonValue, err := json.Marshal(inputJobs)
@@ -684,20 +1426,20 @@ func TestREST(t *testing.T) {
 			responseData, err := ioutil.ReadAll(response.Body)
 			So(err, ShouldBeNil)
 
-			var sis []*schedulerIssue
+			var sis []*SchedulerIssue
 			err = json.Unmarshal(responseData, &sis)
 			So(err, ShouldBeNil)
 			So(len(sis), ShouldEqual, 0)
 
 			Convey("After adding some warnings, you can retrieve them, which also dismisses them", func() {
 				server.simutex.Lock()
-				server.schedIssues["msg1"] = &schedulerIssue{
+				server.schedIssues["msg1"] = &SchedulerIssue{
 					Msg:       "msg1",
 					FirstDate: time.Now().Unix(),
 					LastDate:  time.Now().Unix(),
 					Count:     1,
 				}
-				server.schedIssues["msg2"] = &schedulerIssue{
+				server.schedIssues["msg2"] = &SchedulerIssue{
 					Msg:       "msg2",
 					FirstDate: time.Now().Unix(),
 					LastDate:  time.Now().Unix(),
@@ -714,7 +1456,7 @@ func TestREST(t *testing.T) {
 				responseData, err := ioutil.ReadAll(response.Body)
 				So(err, ShouldBeNil)
 
-				var sis []*schedulerIssue
+				var sis []*SchedulerIssue
 				err = json.Unmarshal(responseData, &sis)
 				So(err, ShouldBeNil)
 				So(len(sis), ShouldEqual, 2)
@@ -723,6 +1465,73 @@ func TestREST(t *testing.T) {
 				So(len(server.schedIssues), ShouldEqual, 0)
 				server.simutex.RUnlock()
 			})
+
+			Convey("Warnings come most severe first, and can be filtered on severity or acknowledged per user", func() {
+				getWarnings := func(query string) []*SchedulerIssue {
+					req, err := http.NewRequest(http.MethodGet, warningsEndPoint+query, nil)
+					So(err, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err := client.Do(req)
+					So(err, ShouldBeNil)
+					responseData, err := ioutil.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+					var sis []*SchedulerIssue
+					err = json.Unmarshal(responseData, &sis)
+					So(err, ShouldBeNil)
+					return sis
+				}
+
+				server.schedulerIssueReported("quota", jqs.MessageWarning)
+				server.schedulerIssueReported("flavor", jqs.MessageError)
+				server.schedulerIssueReported("quota", jqs.MessageWarning)
+				server.schedulerIssueReported("fyi", jqs.MessageInfo)
+
+				sis := getWarnings("?user=alice")
+				So(len(sis), ShouldEqual, 3)
+				So(sis[0].Msg, ShouldEqual, "flavor")
+				So(sis[0].Severity, ShouldEqual, jqs.MessageError)
+				So(sis[1].Msg, ShouldEqual, "quota")
+				So(sis[1].Count, ShouldEqual, 2)
+				So(len(sis[1].Counts), ShouldEqual, 1)
+				So(sis[1].Counts[0].Count, ShouldEqual, 2)
+				So(sis[2].Msg, ShouldEqual, "fyi")
+
+				So(len(getWarnings("?user=alice")), ShouldEqual, 0)
+				sis = getWarnings("?user=bob&severity=error")
+				So(len(sis), ShouldEqual, 1)
+				So(sis[0].Msg, ShouldEqual, "flavor")
+				So(len(getWarnings("?user=bob")), ShouldEqual, 2)
+
+				<-time.After(1 * time.Second)
+				server.schedulerIssueReported("quota", jqs.MessageWarning)
+				sis = getWarnings("?user=alice")
+				So(len(sis), ShouldEqual, 1)
+				So(sis[0].Msg, ShouldEqual, "quota")
+				So(sis[0].Count, ShouldEqual, 3)
+				So(sis[0].Acks, ShouldContainKey, "bob")
+
+				server.simutex.RLock()
+				So(len(server.schedIssues), ShouldEqual, 3)
+				server.simutex.RUnlock()
+
+				origExpiry := ServerSchedIssueInfoExpiry
+				ServerSchedIssueInfoExpiry = 1 * time.Millisecond
+				<-time.After(1 * time.Second)
+				server.expireSchedulerIssues()
+				ServerSchedIssueInfoExpiry = origExpiry
+				server.simutex.RLock()
+				So(len(server.schedIssues), ShouldEqual, 2)
+				server.simutex.RUnlock()
+
+				sis = getWarnings("?severity=error")
+				So(len(sis), ShouldEqual, 1)
+				server.simutex.RLock()
+				So(len(server.schedIssues), ShouldEqual, 1)
+				server.simutex.RUnlock()
+
+				server.dismissSchedulerIssues()
+				So(len(getWarnings("")), ShouldEqual, 0)
+			})
 		})
 
 		Convey("Initial GET queries on the warnings and servers endpoints return nothing", func() {
@@ -783,6 +1592,173 @@ func TestREST(t *testing.T) {
 				So(len(server.badServers), ShouldEqual, 0)
 				server.bsmutex.RUnlock()
 			})
+
+			Convey("Bad servers are dealt with according to the BadServerPolicy", func() {
+				So((&BadServerPolicy{Action: "ignore"}).validate(), ShouldNotBeNil)
+				So((&BadServerPolicy{Action: BadServerReboot, Probes: -1}).validate(), ShouldNotBeNil)
+				So((&BadServerPolicy{Action: BadServerReboot, Probes: 3, RebootWait: 1 * time.Minute}).validate(), ShouldBeNil)
+
+				setPolicy := func(policy *BadServerPolicy) {
+					server.tmutex.Lock()
+					server.bsPolicy = policy
+					server.tmutex.Unlock()
+				}
+				defer setPolicy(nil)
+
+				getServers := func() []*BadServer {
+					req, err := http.NewRequest(http.MethodGet, serversEndPoint, nil)
+					So(err, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err := client.Do(req)
+					So(err, ShouldBeNil)
+					responseData, err := ioutil.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+					var servers []*BadServer
+					err = json.Unmarshal(responseData, &servers)
+					So(err, ShouldBeNil)
+					return servers
+				}
+
+				quarantined := &cloud.Server{ID: "serverid2", Name: "quarantined"}
+				quarantined.GoneBad()
+				setPolicy(&BadServerPolicy{Action: BadServerQuarantine})
+				server.badServerReported(quarantined)
+				So(quarantined.PermanentProblem(), ShouldNotBeBlank)
+				So(quarantined.NotBad(), ShouldBeFalse)
+				So(quarantined.Destroyed(), ShouldBeFalse)
+				servers := getServers()
+				So(len(servers), ShouldEqual, 1)
+				So(servers[0].Name, ShouldEqual, "quarantined")
+				So(servers[0].Action, ShouldEqual, badServerQuarantined)
+
+				broken := &cloud.Server{ID: "serverid3", Name: "broken"}
+				broken.GoneBad("cmd failed")
+				unresponsive := &cloud.Server{ID: "serverid4", Name: "unresponsive"}
+				unresponsive.GoneBad()
+				setPolicy(&BadServerPolicy{Action: BadServerDestroy})
+				server.badServerReported(broken)
+				server.badServerReported(unresponsive)
+				So(broken.Destroyed(), ShouldBeTrue)
+				So(unresponsive.Destroyed(), ShouldBeFalse)
+				servers = getServers()
+				So(len(servers), ShouldEqual, 2)
+
+				broken = &cloud.Server{ID: "serverid5", Name: "broken"}
+				broken.GoneBad("cmd failed")
+				setPolicy(&BadServerPolicy{Action: BadServerReboot})
+				server.badServerReported(broken)
+				So(broken.Destroyed(), ShouldBeTrue)
+				So(len(getServers()), ShouldEqual, 2)
+
+				So(unresponsive.NotBad(), ShouldBeTrue)
+				server.badServerReported(unresponsive)
+				servers = getServers()
+				So(len(servers), ShouldEqual, 1)
+				So(servers[0].Name, ShouldEqual, "quarantined")
+
+				server.bsmutex.Lock()
+				delete(server.badServers, quarantined.ID)
+				delete(server.badServerActions, quarantined.ID)
+				server.bsmutex.Unlock()
+			})
+
+			Convey("Servers being scaled down are tracked and reported", func() {
+				flavor := &cloud.Flavor{Name: "large", Cores: 16}
+				draining := &cloud.Server{ID: "serverid6", Name: "draining", IP: "192.168.0.6", Flavor: flavor}
+				So(draining.Drain(), ShouldBeTrue)
+				server.drainingServerReported(draining)
+				ds := server.getDrainingServers()
+				So(len(ds), ShouldEqual, 1)
+				So(ds[0].Name, ShouldEqual, "draining")
+				So(ds[0].Flavor, ShouldEqual, "large")
+				So(ds[0].Draining, ShouldBeTrue)
+				So(server.getSchedulerStatus().DrainingServers, ShouldResemble, ds)
+
+				So(draining.Undrain(), ShouldBeTrue)
+				server.drainingServerReported(draining)
+				So(server.getDrainingServers(), ShouldBeEmpty)
+
+				So(draining.Drain(), ShouldBeTrue)
+				server.drainingServerReported(draining)
+				So(len(server.getDrainingServers()), ShouldEqual, 1)
+				err := draining.Destroy()
+				So(err, ShouldNotBeNil) // because the fake server has no provider
+				So(draining.Undrain(), ShouldBeFalse)
+				server.drainingServerReported(draining)
+				So(server.getDrainingServers(), ShouldBeEmpty)
+				So(drainingServerDetails(draining).Destroyed, ShouldBeTrue)
+			})
+		})
+
+		Convey("You can POST a job with outputs, and once executed GET and download its artifacts", func() {
+			outDir, err := ioutil.TempDir("", "wr_jobqueue_test_artifacts_")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(outDir)
+
+			inputJobs := []*JobViaJSON{{Cmd: "echo -n artifact > out.txt", Cwd: outDir, CwdMatters: true, RepGrp: "art", Outputs: []string{"out.txt"}}}
+			jsonValue, err := json.Marshal(inputJobs)
+			So(err, ShouldBeNil)
+			req, err := http.NewRequest(http.MethodPost, jobsEndPoint+"/", bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			req.Header.Add("Content-Type", "application/json")
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err := ioutil.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var jstati []JStatus
+			err = json.Unmarshal(responseData, &jstati)
+			So(err, ShouldBeNil)
+			So(len(jstati), ShouldEqual, 1)
+			So(jstati[0].Outputs, ShouldResemble, []string{"out.txt"})
+			key := jstati[0].Key
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer func() {
+				err = jq.Disconnect()
+				if err != nil {
+					fmt.Printf("jq.Disconnect failed: %s\n", err)
+				}
+			}()
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			err = jq.Execute(job, config.RunnerExecShell)
+			So(err, ShouldBeNil)
+
+			req, err = http.NewRequest(http.MethodGet, artifactsEndPoint+key, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err = ioutil.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var artifacts []*Artifact
+			err = json.Unmarshal(responseData, &artifacts)
+			So(err, ShouldBeNil)
+			So(len(artifacts), ShouldEqual, 1)
+			outPath := filepath.Join(outDir, "out.txt")
+			So(artifacts[0].Path, ShouldEqual, outPath)
+			So(artifacts[0].Size, ShouldEqual, 8)
+			So(artifacts[0].MD5, ShouldEqual, "8e5b948a454515dbabfc7eb718daa52f")
+
+			req, err = http.NewRequest(http.MethodGet, artifactsEndPoint+key+"?path="+url.QueryEscape(outPath), nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err = ioutil.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			So(string(responseData), ShouldEqual, "artifact")
+
+			req, err = http.NewRequest(http.MethodGet, artifactsEndPoint+key+"?path="+url.QueryEscape("/etc/passwd"), nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusNotFound)
 		})
 
 		Reset(func() {
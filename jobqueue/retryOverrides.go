@@ -0,0 +1,119 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for retrying buried jobs with changes to how
+// they are run, without having to remove and re-add them.
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// RetryOverrides describe changes to how a buried job is run when it is
+// retried with Client.KickWithOverrides(). They apply to every attempt made
+// after that retry, but don't change the job itself (its Key(), Cmd, Cwd and
+// EnvOverride stay the same), and are removed by any later plain Kick().
+type RetryOverrides struct {
+	// Env are "key=value" environment variables that are set on top of the
+	// job's normal environment, including any EnvOverride.
+	Env []string `codec:",omitempty"`
+
+	// Cwd, if set, is an absolute path used instead of the job's Cwd. As with
+	// Cwd, if the job doesn't have CwdMatters, a unique directory is created
+	// within it to run in.
+	Cwd string `codec:",omitempty"`
+
+	// Args, if set, are appended (after a space) to the job's Cmd. They are
+	// ignored for jobs with Steps.
+	Args string `codec:",omitempty"`
+}
+
+// validate checks that the overrides make sense.
+func (ro *RetryOverrides) validate() error {
+	for _, envvar := range ro.Env {
+		if strings.Index(envvar, "=") < 1 {
+			return fmt.Errorf("retry environment variable [%s] is not in key=value form", envvar)
+		}
+	}
+	if ro.Cwd != "" && !filepath.IsAbs(ro.Cwd) {
+		return fmt.Errorf("retry cwd [%s] is not an absolute path", ro.Cwd)
+	}
+	return nil
+}
+
+// isEmpty tells you if the overrides wouldn't change anything.
+func (ro *RetryOverrides) isEmpty() bool {
+	return ro == nil || (len(ro.Env) == 0 && ro.Cwd == "" && ro.Args == "")
+}
+
+// String describes the overrides for display to users.
+func (ro *RetryOverrides) String() string {
+	if ro.isEmpty() {
+		return ""
+	}
+	var parts []string
+	if len(ro.Env) > 0 {
+		parts = append(parts, "env: "+strings.Join(ro.Env, ","))
+	}
+	if ro.Cwd != "" {
+		parts = append(parts, "cwd: "+ro.Cwd)
+	}
+	if ro.Args != "" {
+		parts = append(parts, "args: "+ro.Args)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// retryCwd returns the directory the runner should base the job's working
+// directory on: any RetryOverrides Cwd, otherwise Cwd.
+func (j *Job) retryCwd() string {
+	j.RLock()
+	defer j.RUnlock()
+	return j.baseCwd()
+}
+
+// baseCwd is like retryCwd(), but you must hold the read lock.
+func (j *Job) baseCwd() string {
+	if j.RetryOverrides != nil && j.RetryOverrides.Cwd != "" {
+		return j.RetryOverrides.Cwd
+	}
+	return j.Cwd
+}
+
+// ranIn returns the directory Cmd ran in: ActualCwd if set, otherwise
+// baseCwd(). You must hold the read lock.
+func (j *Job) ranIn() string {
+	if j.ActualCwd != "" {
+		return j.ActualCwd
+	}
+	return j.baseCwd()
+}
+
+// retryCmd returns the command line the runner should run: Cmd with any
+// RetryOverrides Args appended.
+func (j *Job) retryCmd() string {
+	j.RLock()
+	defer j.RUnlock()
+	if j.RetryOverrides != nil && j.RetryOverrides.Args != "" && len(j.Steps) == 0 {
+		return j.Cmd + " " + j.RetryOverrides.Args
+	}
+	return j.Cmd
+}
@@ -0,0 +1,188 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for jobs' own policies on how they are retried
+// after failing.
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes how a job should be retried after it fails, beyond
+// the simple count of its Retries. Supply one as Job.RetryPolicy; it overrides
+// the backoff of any Policy assigned to the job's RepGroup.
+type RetryPolicy struct {
+	// Backoff, if set, is how long the job waits after it first fails before
+	// it can be retried. The wait doubles with each subsequent failure, up to
+	// BackoffMax (if set).
+	Backoff    time.Duration `json:"backoff,omitempty"`
+	BackoffMax time.Duration `json:"backoff_max,omitempty"`
+
+	// Jitter, between 0 and 1, randomly lengthens or shortens each wait by up
+	// to this fraction of it, so that many jobs that fail at the same time
+	// (eg. because a shared resource was unavailable) don't all retry at the
+	// same time.
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// MaxRetries sets the maximum number of times the job is retried after
+	// failing with particular FailReasons (after any FailRules have been
+	// applied), eg. {FailReasonLost: 10, FailReasonExit: 2}. Failures with
+	// these FailReasons are counted against these limits instead of against
+	// the job's Retries.
+	MaxRetries map[string]int `json:"max_retries,omitempty"`
+
+	// NoRetryExitcodes are the exit codes that mean the job's failure is
+	// permanent: if its Cmd exits with one of them, it is buried immediately.
+	NoRetryExitcodes []int `json:"no_retry_exitcodes,omitempty"`
+}
+
+// NewRetryPolicy makes a valid RetryPolicy from the given values, where backoff
+// and backoffMax are durations with a unit suffix (eg. "30s"), or blank for 0.
+func NewRetryPolicy(backoff, backoffMax string, jitter float64, maxRetries map[string]int, noRetryExitcodes []int) (*RetryPolicy, error) {
+	p := &RetryPolicy{Jitter: jitter, MaxRetries: maxRetries, NoRetryExitcodes: noRetryExitcodes}
+	var err error
+	if backoff != "" {
+		if p.Backoff, err = time.ParseDuration(backoff); err != nil {
+			return nil, fmt.Errorf("retry backoff (%s) was not specified correctly: %s", backoff, err)
+		}
+	}
+	if backoffMax != "" {
+		if p.BackoffMax, err = time.ParseDuration(backoffMax); err != nil {
+			return nil, fmt.Errorf("retry backoff max (%s) was not specified correctly: %s", backoffMax, err)
+		}
+	}
+	return p, p.validate()
+}
+
+// ParseExitcodes converts a comma separated list of exit codes, as supplied for
+// RetryPolicy.NoRetryExitcodes, to a slice of them. Blank returns nil.
+func ParseExitcodes(codes string) ([]int, error) {
+	if codes == "" {
+		return nil, nil
+	}
+	parts := strings.Split(codes, ",")
+	exitcodes := make([]int, len(parts))
+	for i, part := range parts {
+		code, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("exit code [%s] is not a number", part)
+		}
+		exitcodes[i] = code
+	}
+	return exitcodes, nil
+}
+
+// validate checks the policy makes sense. A nil policy is valid.
+func (p *RetryPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.Backoff < 0 || p.BackoffMax < 0 {
+		return fmt.Errorf("RetryPolicy Backoff and BackoffMax can't be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("RetryPolicy Jitter must be between 0 and 1, not %v", p.Jitter)
+	}
+	for reason, max := range p.MaxRetries {
+		if reason == "" {
+			return fmt.Errorf("RetryPolicy MaxRetries must be keyed on FailReasons")
+		}
+		if max < 0 || max > math.MaxUint8 {
+			return fmt.Errorf("RetryPolicy MaxRetries for [%s] must be between 0 and %d, not %d", reason, math.MaxUint8, max)
+		}
+	}
+	return nil
+}
+
+// noRetry tells you if the given end state of a job means it should not be
+// retried.
+func (p *RetryPolicy) noRetry(endState *JobEndState) bool {
+	if endState == nil || !endState.Exited {
+		return false
+	}
+	for _, code := range p.NoRetryExitcodes {
+		if endState.Exitcode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// judge tells you what to do with the given job, which just failed with the
+// given failReason and end state: if it should be buried, and if its failure
+// is limited by MaxRetries instead of the job's Retries. You must hold the
+// job's read lock.
+func (p *RetryPolicy) judge(job *Job, failReason string, endState *JobEndState) (bury, limited bool) {
+	if p.noRetry(endState) {
+		return true, false
+	}
+	max, limited := p.MaxRetries[failReason]
+	if !limited {
+		return false, false
+	}
+	return job.FailureCounts[failReason] >= max, true
+}
+
+// backoff returns how long the given job, which just failed, should wait
+// before being retried, or 0 if the policy doesn't say. You must hold the
+// job's read lock.
+func (p *RetryPolicy) backoff(job *Job) time.Duration {
+	if p.Backoff <= 0 {
+		return 0
+	}
+	var failures int
+	for _, count := range job.FailureCounts {
+		failures += count
+	}
+	delay := p.Backoff
+	for i := 0; i < failures; i++ {
+		if delay > math.MaxInt64/2 {
+			break
+		}
+		delay *= 2
+		if p.BackoffMax > 0 && delay >= p.BackoffMax {
+			break
+		}
+	}
+	if p.BackoffMax > 0 && delay > p.BackoffMax {
+		delay = p.BackoffMax
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay)) // #nosec not for security
+	}
+	return delay
+}
+
+// copyFailureCounts returns a copy of the given Job.FailureCounts.
+func copyFailureCounts(counts map[string]int) map[string]int {
+	if counts == nil {
+		return nil
+	}
+	cp := make(map[string]int, len(counts))
+	for reason, count := range counts {
+		cp[reason] = count
+	}
+	return cp
+}
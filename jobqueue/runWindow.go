@@ -0,0 +1,388 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the parsing and interpretation of the time-of-day and
+// day-of-week windows that jobs and RepGroups can be restricted to run in, and
+// the server's use of them to hold back ready jobs.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// runWindowDays maps the day names that can be used in a run window to the
+// days they represent.
+var runWindowDays = map[string]time.Weekday{
+	"sun":       time.Sunday,
+	"sunday":    time.Sunday,
+	"mon":       time.Monday,
+	"monday":    time.Monday,
+	"tue":       time.Tuesday,
+	"tuesday":   time.Tuesday,
+	"wed":       time.Wednesday,
+	"wednesday": time.Wednesday,
+	"thu":       time.Thursday,
+	"thursday":  time.Thursday,
+	"fri":       time.Friday,
+	"friday":    time.Friday,
+	"sat":       time.Saturday,
+	"saturday":  time.Saturday,
+}
+
+// runWindowNeverCloses is what runWindow.untilClosed() returns for windows
+// that are open all the time.
+const runWindowNeverCloses = time.Duration(math.MaxInt64)
+
+// runWindowPeriod is a single period of a runWindow: a time range that applies
+// on certain days. end can be less than or equal to start, in which case the
+// period finishes on the day after it started.
+type runWindowPeriod struct {
+	days           [7]bool
+	startH, startM int
+	endH, endM     int
+}
+
+// runWindow is a parsed run window spec, made up of alternative periods.
+type runWindow []*runWindowPeriod
+
+// parseRunWindow parses a run window spec, which is made up of one or more
+// periods separated by semi-colons. Each period has days and/or a time range,
+// separated by a space, eg. "weekdays 18:00-08:00; weekends".
+//
+// Days are a comma separated list of day names (like "mon" or "monday") and
+// ranges of them (like "mon-fri"), or the words "weekdays" or "weekends". If no
+// days are given, the period applies every day.
+//
+// The time range is in the form HH:MM-HH:MM, in the server's local time zone.
+// If the end is not after the start, the range continues in to the next day,
+// so "fri 18:00-08:00" includes the early hours of Saturday. If no time range
+// is given, the period lasts all day.
+func parseRunWindow(spec string) (runWindow, error) {
+	var rw runWindow
+	for _, pspec := range strings.Split(spec, ";") {
+		fields := strings.Fields(strings.ToLower(pspec))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("run window period [%s] has too many parts", pspec)
+		}
+
+		p := &runWindowPeriod{endH: 24}
+		var gotDays, gotTimes bool
+		for _, field := range fields {
+			var err error
+			if strings.Contains(field, ":") {
+				if gotTimes {
+					return nil, fmt.Errorf("run window period [%s] has more than one time range", pspec)
+				}
+				err = p.parseTimes(field)
+				gotTimes = true
+			} else {
+				if gotDays {
+					return nil, fmt.Errorf("run window period [%s] has more than one set of days", pspec)
+				}
+				err = p.parseDays(field)
+				gotDays = true
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !gotDays {
+			for i := range p.days {
+				p.days[i] = true
+			}
+		}
+
+		rw = append(rw, p)
+	}
+
+	if len(rw) == 0 {
+		return nil, fmt.Errorf("run window [%s] has no periods", spec)
+	}
+	return rw, nil
+}
+
+// parseDays sets our days from a comma separated list of days and day ranges.
+func (p *runWindowPeriod) parseDays(spec string) error {
+	for _, dspec := range strings.Split(spec, ",") {
+		switch dspec {
+		case "weekdays":
+			for d := time.Monday; d <= time.Friday; d++ {
+				p.days[d] = true
+			}
+			continue
+		case "weekends":
+			p.days[time.Saturday] = true
+			p.days[time.Sunday] = true
+			continue
+		}
+
+		parts := strings.Split(dspec, "-")
+		if len(parts) > 2 {
+			return fmt.Errorf("run window days [%s] are not valid", dspec)
+		}
+		var days []time.Weekday
+		for _, part := range parts {
+			day, known := runWindowDays[part]
+			if !known {
+				return fmt.Errorf("run window day [%s] is not known", part)
+			}
+			days = append(days, day)
+		}
+		if len(days) == 1 {
+			p.days[days[0]] = true
+			continue
+		}
+
+		// ranges can wrap around the end of the week, eg. fri-mon
+		for d := days[0]; ; d = (d + 1) % 7 {
+			p.days[d] = true
+			if d == days[1] {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimes sets our start and end from a time range of the form HH:MM-HH:MM.
+func (p *runWindowPeriod) parseTimes(spec string) error {
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return fmt.Errorf("run window time range [%s] is not of the form HH:MM-HH:MM", spec)
+	}
+	var err error
+	p.startH, p.startM, err = parseRunWindowTime(parts[0], 23)
+	if err != nil {
+		return err
+	}
+	p.endH, p.endM, err = parseRunWindowTime(parts[1], 24)
+	return err
+}
+
+// parseRunWindowTime parses a time of the form HH:MM, allowing hours up to the
+// given maximum (with no minutes past that maximum).
+func parseRunWindowTime(spec string, maxH int) (int, int, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("run window time [%s] is not of the form HH:MM", spec)
+	}
+	h, errh := strconv.Atoi(parts[0])
+	m, errm := strconv.Atoi(parts[1])
+	if errh != nil || errm != nil || h < 0 || h > maxH || m < 0 || m > 59 || (h == maxH && m > 0) {
+		return 0, 0, fmt.Errorf("run window time [%s] is not valid", spec)
+	}
+	return h, m, nil
+}
+
+// untilOpen tells you how long it will be after the given time before the
+// window is next open. Returns 0 if it is open at that time.
+func (rw runWindow) untilOpen(t time.Time) time.Duration {
+	var until time.Duration
+	for i, p := range rw {
+		pu := p.untilOpen(t)
+		if pu == 0 {
+			return 0
+		}
+		if i == 0 || pu < until {
+			until = pu
+		}
+	}
+	return until
+}
+
+// untilOpen tells you how long it will be after the given time before the
+// period next starts. Returns 0 if it is in progress at that time.
+func (p *runWindowPeriod) untilOpen(t time.Time) time.Duration {
+	y, mo, d := t.Date()
+	loc := t.Location()
+	endDay := 0
+	if p.endH*60+p.endM <= p.startH*60+p.startM {
+		endDay = 1
+	}
+
+	// we start from the day before in case we're in a period that started
+	// yesterday, and the latest a period could next start is in a week
+	for offset := -1; offset <= 7; offset++ {
+		day := time.Date(y, mo, d+offset, 0, 0, 0, 0, loc)
+		if !p.days[day.Weekday()] {
+			continue
+		}
+		start := time.Date(y, mo, d+offset, p.startH, p.startM, 0, 0, loc)
+		end := time.Date(y, mo, d+offset+endDay, p.endH, p.endM, 0, 0, loc)
+		if !t.Before(start) && t.Before(end) {
+			return 0
+		}
+		if start.After(t) {
+			return start.Sub(t)
+		}
+	}
+
+	// we can't get here since parseRunWindow() always sets at least 1 day
+	return 0
+}
+
+// untilClosed tells you how long it will be after the given time before the
+// window next closes, following on through periods that start as others end.
+// Returns 0 if it is closed at that time, or runWindowNeverCloses if it is
+// always open.
+func (rw runWindow) untilClosed(t time.Time) time.Duration {
+	at := t
+	for at.Sub(t) <= 7*24*time.Hour {
+		var end time.Time
+		for _, p := range rw {
+			if pend := p.openUntil(at); pend.After(end) {
+				end = pend
+			}
+		}
+		if end.IsZero() {
+			return at.Sub(t)
+		}
+		at = end
+	}
+	return runWindowNeverCloses
+}
+
+// untilNextFit is like untilOpen(), but if fit is true and the window would
+// close less than expected after the given time, tells you how long it will
+// be until the window next opens after that.
+func (rw runWindow) untilNextFit(t time.Time, fit bool, expected time.Duration) time.Duration {
+	until := rw.untilOpen(t)
+	if until > 0 || !fit || expected <= 0 {
+		return until
+	}
+	open := rw.untilClosed(t)
+	if open >= expected {
+		return 0
+	}
+	return open + rw.untilOpen(t.Add(open))
+}
+
+// openUntil tells you when the period in progress at the given time finishes.
+// Returns the zero time if it is not in progress at that time.
+func (p *runWindowPeriod) openUntil(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	loc := t.Location()
+	endDay := 0
+	if p.endH*60+p.endM <= p.startH*60+p.startM {
+		endDay = 1
+	}
+
+	for offset := -1; offset <= 0; offset++ {
+		day := time.Date(y, mo, d+offset, 0, 0, 0, 0, loc)
+		if !p.days[day.Weekday()] {
+			continue
+		}
+		start := time.Date(y, mo, d+offset, p.startH, p.startM, 0, 0, loc)
+		end := time.Date(y, mo, d+offset+endDay, p.endH, p.endM, 0, 0, loc)
+		if !t.Before(start) && t.Before(end) {
+			return end
+		}
+	}
+	return time.Time{}
+}
+
+// runWindow returns the parsed form of the given run window spec, caching it
+// for future calls.
+func (s *Server) runWindow(spec string) (runWindow, error) {
+	s.rwmutex.RLock()
+	rw, cached := s.runWindows[spec]
+	s.rwmutex.RUnlock()
+	if cached {
+		return rw, nil
+	}
+
+	rw, err := parseRunWindow(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	s.rwmutex.Lock()
+	s.runWindows[spec] = rw
+	s.rwmutex.Unlock()
+	return rw, nil
+}
+
+// setRepGroupRunWindow stores the run window for a RepGroup, or removes it if
+// spec is blank.
+func (s *Server) setRepGroupRunWindow(repGroup, spec string) (srerr string, qerr error) {
+	if spec != "" {
+		if _, err := s.runWindow(spec); err != nil {
+			return ErrBadRunWindow, err
+		}
+	}
+
+	if err := s.db.storeRepGroupRunWindow(repGroup, spec); err != nil {
+		return ErrDBError, err
+	}
+
+	s.rwmutex.Lock()
+	if spec == "" {
+		delete(s.rgRunWindows, repGroup)
+	} else {
+		s.rgRunWindows[repGroup] = spec
+	}
+	s.rwmutex.Unlock()
+	return "", nil
+}
+
+// runWindowHold is our queue.Hold, which holds back jobs that are outside of
+// their own or their RepGroup's run window until the window opens. Jobs with
+// FitRunWindow set are also held if their Requirements.Time would take them
+// past the window closing. So that changes to RepGroup run windows take effect
+// in good time, jobs are held for no longer than ServerRunWindowRecheck before
+// being checked again.
+func (s *Server) runWindowHold(item *queue.Item) time.Duration {
+	job, ok := item.Data().(*Job)
+	if !ok {
+		return 0
+	}
+	job.RLock()
+	spec, repGroup := job.RunWindow, job.RepGroup
+	fit, expected := job.FitRunWindow, job.Requirements.Time
+	job.RUnlock()
+
+	if spec == "" {
+		s.rwmutex.RLock()
+		spec = s.rgRunWindows[repGroup]
+		s.rwmutex.RUnlock()
+		if spec == "" {
+			return 0
+		}
+	}
+
+	rw, err := s.runWindow(spec)
+	if err != nil {
+		return 0
+	}
+
+	until := rw.untilNextFit(time.Now(), fit, expected)
+	if until > ServerRunWindowRecheck {
+		until = ServerRunWindowRecheck
+	}
+	return until
+}
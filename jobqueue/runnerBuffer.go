@@ -0,0 +1,91 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets runners ride out short network
+// problems, by buffering the state updates they couldn't send to the server
+// and replaying them once they can.
+
+import (
+	"errors"
+	"sync"
+)
+
+// bufferedUpdate sends a state update to the server, being told if this is a
+// replay of an update that couldn't be sent earlier.
+type bufferedUpdate func(replayed bool) error
+
+// updateBuffer holds the state updates of a running job that could not be sent
+// to the server because we lost contact with it, so they can be replayed in
+// order once contact is regained.
+type updateBuffer struct {
+	pending []bufferedUpdate
+	mu      sync.Mutex
+}
+
+// send sends the given update, unless earlier updates are still waiting to be
+// replayed, in which case it waits its turn. If the server can't be contacted,
+// the update is buffered for replay() and buffered will be true. Other errors
+// from the server are returned.
+func (b *updateBuffer) send(update bufferedUpdate) (buffered bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) == 0 {
+		err = update(false)
+		if err == nil || !lostContact(err) {
+			return false, err
+		}
+	}
+	b.pending = append(b.pending, update)
+	return true, nil
+}
+
+// replay sends any buffered updates in order. It stops and returns an error if
+// the server still can't be contacted. Updates the server rejects are dropped,
+// and the first such error is returned after the rest have been replayed.
+func (b *updateBuffer) replay() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var rejected error
+	for len(b.pending) > 0 {
+		err := b.pending[0](true)
+		if err != nil && lostContact(err) {
+			return err
+		}
+		if err != nil && rejected == nil {
+			rejected = err
+		}
+		b.pending = b.pending[1:]
+	}
+	return rejected
+}
+
+// buffering tells you if there are updates waiting to be replayed.
+func (b *updateBuffer) buffering() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending) > 0
+}
+
+// lostContact tells you if the given error from a request to the server was
+// because we couldn't contact it, as opposed to it rejecting the request.
+func lostContact(err error) bool {
+	var jqerr Error
+	return !errors.As(err, &jqerr)
+}
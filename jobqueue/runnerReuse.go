@@ -0,0 +1,109 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets idle runners reserve jobs from
+// scheduler groups other than their own.
+
+import (
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// reqsFitRunner tells you if a job with the given Requirements could be run by
+// a runner that was scheduled for the given runner Requirements, without being
+// so much smaller than what the runner has that more than the given tolerance
+// (a fraction of the runner's RAM and cores) would go to waste.
+func reqsFitRunner(runner, job *scheduler.Requirements, tolerance float64) bool {
+	if job.RAM > runner.RAM || job.Cores > runner.Cores || job.Disk > runner.Disk || job.Time > runner.Time {
+		return false
+	}
+
+	if float64(job.RAM) < float64(runner.RAM)*(1-tolerance) || job.Cores < runner.Cores*(1-tolerance) {
+		return false
+	}
+
+	// other requirements (like the cloud image to use) can't be compared, so
+	// must be the same
+	if len(job.Other) != len(runner.Other) {
+		return false
+	}
+	for key, val := range job.Other {
+		if runner.Other[key] != val {
+			return false
+		}
+	}
+	return true
+}
+
+// reuseGroups returns the scheduler groups with jobs that need running whose
+// Requirements fit within those of the given runner's scheduler group (leaving
+// no more than the given fraction of its resources unused), best fitting first.
+func (s *Server) reuseGroups(runnerGroup string, reuse float64) []string {
+	s.sgcmutex.Lock()
+	defer s.sgcmutex.Unlock()
+	runnerReq, known := s.sgtr[runnerGroup]
+	if !known {
+		return nil
+	}
+
+	var groups []string
+	for group, count := range s.sgroupcounts {
+		if group == runnerGroup || count <= 0 {
+			continue
+		}
+		req, known := s.sgtr[group]
+		if !known || !reqsFitRunner(runnerReq, req, reuse) {
+			continue
+		}
+		groups = append(groups, group)
+	}
+
+	s.sortGroupsByFit(groups)
+	return groups
+}
+
+// reserveForIdleRunner is used when a runner for the given scheduler group
+// found nothing to reserve in its own group. If runner reuse has been
+// configured, it tries to reserve a ready job from another group that fits in
+// to what the runner was scheduled for, so the runner can run it instead of
+// exiting while another runner is spawned. Returns a nil item if there was
+// nothing suitable.
+func (s *Server) reserveForIdleRunner(runnerGroup string, match queue.Match) (*queue.Item, error) {
+	s.tmutex.RLock()
+	reuse := s.runnerReuse
+	s.tmutex.RUnlock()
+	if reuse <= 0 {
+		return nil, nil
+	}
+
+	groups := s.reuseGroups(runnerGroup, reuse)
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	item, err := s.reserveFromGroupsWithLimits(groups, 0, nil, match)
+	if err != nil {
+		if qerr, ok := err.(queue.Error); ok && qerr.Err == queue.ErrNothingReady {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s.Debug("idle runner reused", "runner", runnerGroup, "group", item.ReserveGroup)
+	return item, nil
+}
@@ -0,0 +1,113 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets runners spawned by an older (or newer)
+// version of the server replace themselves with the server's version, so that
+// upgrading the server doesn't require all the runners to be torn down.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+)
+
+// runnerPlatform returns the platform we were built for, in the form sent by
+// runners to say what executable they need.
+func runnerPlatform() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// SetRunnerVersion tells the server that this Client is a runner of the given
+// version (normally ServerVersion). If the server was configured with a
+// RunnerUpdateExe and is a different version, subsequent Reserve*() calls will
+// then return an Error with Err ErrRunnerUpdate instead of a Job, and you
+// should call GetRunnerExe() to get the server's version of the runner
+// executable and replace yourself with it.
+//
+// Clients that don't call this are never asked to update.
+func (c *Client) SetRunnerVersion(version string) {
+	c.version = version
+}
+
+// GetRunnerExe gets a copy of the server's runner executable, built for our
+// platform, for use after a Reserve*() call returned ErrRunnerUpdate.
+func (c *Client) GetRunnerExe() ([]byte, error) {
+	return c.GetRunnerExeContext(context.Background())
+}
+
+// GetRunnerExeContext is like GetRunnerExe(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) GetRunnerExeContext(ctx context.Context) ([]byte, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getrunnerexe", RunnerPlatform: runnerPlatform()})
+	if err != nil {
+		return nil, err
+	}
+	return decompressUnlimited(resp.Exe)
+}
+
+// runnerNeedsUpdate tells you if the given reserve request came from a runner
+// of a different version to us that we can supply an executable for.
+func (s *Server) runnerNeedsUpdate(cr *clientRequest) bool {
+	return s.runnerUpdateExe != "" && cr.RunnerVersion != "" && s.ServerVersions.Version != "" &&
+		cr.RunnerVersion != s.ServerVersions.Version
+}
+
+// runnerExe returns our compressed runner executable built for the given
+// platform, as sent by runnerPlatform(). Executables are cached after the first
+// request for a given platform, since we expect many runners to ask for them
+// in a short space of time.
+func (s *Server) runnerExe(platform string) ([]byte, error) {
+	if s.runnerUpdateExe == "" {
+		return nil, fmt.Errorf("runner updates are not enabled")
+	}
+
+	s.rumutex.Lock()
+	defer s.rumutex.Unlock()
+	if exe, cached := s.runnerExes[platform]; cached {
+		return exe, nil
+	}
+
+	osArch := strings.Split(platform, "/")
+	if len(osArch) != 2 || osArch[0] == "" || osArch[1] == "" {
+		return nil, fmt.Errorf("invalid platform [%s]", platform)
+	}
+
+	path, err := cloud.ExeForPlatform(s.runnerUpdateExe, osArch[0], osArch[1], s.runnerUpdateExeDir, s.runnerUpdateExeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(path) // #nosec the path is from our own config
+	if err != nil {
+		return nil, err
+	}
+
+	exe, err := compress(content)
+	if err != nil {
+		return nil, err
+	}
+	s.runnerExes[platform] = exe
+	return exe, nil
+}
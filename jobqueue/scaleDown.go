@@ -0,0 +1,135 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for helping a cloud scheduler decide which
+// servers to scale down, and for telling the status webpage about the servers
+// it drains.
+
+import (
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// predictedDemand is our scheduler's DemandCallBack. It finds the dependent
+// jobs whose unresolved dependencies are all running and expected (going by
+// their Requirements.Time) to finish within the given horizon, and returns
+// how many of them there are for each set of scheduler requirements.
+func (s *Server) predictedDemand(horizon time.Duration) []*scheduler.Demand {
+	cutoff := time.Now().Add(horizon)
+	soon := make(map[string]bool)
+	var dependents []*queue.Item
+	s.q.Each(func(item *queue.Item) bool {
+		switch item.State() {
+		case queue.ItemStateRun:
+			job := item.Data().(*Job)
+			job.RLock()
+			soon[item.Key] = !job.StartTime.IsZero() && job.Requirements.Time > 0 && job.StartTime.Add(job.Requirements.Time).Before(cutoff)
+			job.RUnlock()
+		case queue.ItemStateDependent:
+			dependents = append(dependents, item)
+		}
+		return true
+	})
+
+	demands := make(map[string]*scheduler.Demand)
+	var order []string
+	for _, item := range dependents {
+		imminent := true
+		for _, dep := range item.UnresolvedDependencies() {
+			if !soon[dep] {
+				imminent = false
+				break
+			}
+		}
+		if !imminent {
+			continue
+		}
+
+		job := item.Data().(*Job)
+		job.RLock()
+		req := reqForScheduler(job.Requirements)
+		job.RUnlock()
+		req = s.localityReq(job, job.affinityReq(req))
+
+		group := job.generateSchedulerGroup(req)
+		if d, exists := demands[group]; exists {
+			d.Count++
+			continue
+		}
+		demands[group] = &scheduler.Demand{Req: req, Count: 1}
+		order = append(order, group)
+	}
+
+	result := make([]*scheduler.Demand, len(order))
+	for i, group := range order {
+		result[i] = demands[group]
+	}
+	return result
+}
+
+// drainingServerReported is our scheduler's DrainCallBack. It keeps track of
+// the servers being drained, and tells the status webpage about them.
+func (s *Server) drainingServerReported(server *cloud.Server) {
+	s.bsmutex.Lock()
+	if server.Draining() && !server.Destroyed() {
+		s.drainingServers[server.ID] = server
+	} else {
+		delete(s.drainingServers, server.ID)
+	}
+	s.bsmutex.Unlock()
+
+	ds := drainingServerDetails(server)
+	if ds.Destroyed {
+		s.Info("server scaled down", "server", ds.ID, "flavor", ds.Flavor)
+	}
+
+	s.drainCaster.Send(ds)
+}
+
+// drainingServerDetails converts the given cloud.Server in to a DrainingServer.
+func drainingServerDetails(server *cloud.Server) *DrainingServer {
+	ds := &DrainingServer{
+		ID:        server.ID,
+		Name:      server.Name,
+		IP:        server.IP,
+		Date:      time.Now().Unix(),
+		Draining:  server.Draining() && !server.Destroyed(),
+		Destroyed: server.Destroyed(),
+	}
+	if server.Flavor != nil {
+		ds.Flavor = server.Flavor.Name
+	}
+	return ds
+}
+
+// getDrainingServers converts the slice of cloud.Server objects being drained
+// in to a slice of DrainingServer structs.
+func (s *Server) getDrainingServers() []*DrainingServer {
+	s.bsmutex.RLock()
+	defer s.bsmutex.RUnlock()
+	ds := make([]*DrainingServer, 0, len(s.drainingServers))
+	for _, server := range s.drainingServers {
+		ds = append(ds, drainingServerDetails(server))
+	}
+	return ds
+}
@@ -0,0 +1,264 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for keeping track of the messages our scheduler
+// sends us, which are displayed on the status webpage.
+
+import (
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// SchedulerIssueCount is the number of times a SchedulerIssue was reported
+// during the ServerSchedIssueCountPeriod starting at Start.
+type SchedulerIssueCount struct {
+	Start int64 // seconds since Unix epoch
+	Count int
+}
+
+// occurred records that the issue was reported again at the given time, with
+// the given severity.
+func (si *SchedulerIssue) occurred(now time.Time, severity scheduler.MessageSeverity) {
+	si.Severity = severity
+	si.LastDate = now.Unix()
+	si.Count++
+
+	start := now.Truncate(ServerSchedIssueCountPeriod).Unix()
+	if n := len(si.Counts); n > 0 && si.Counts[n-1].Start == start {
+		si.Counts[n-1].Count++
+		return
+	}
+	si.Counts = append(si.Counts, &SchedulerIssueCount{Start: start, Count: 1})
+	if len(si.Counts) > ServerSchedIssueCountPeriods {
+		si.Counts = si.Counts[len(si.Counts)-ServerSchedIssueCountPeriods:]
+	}
+}
+
+// AcknowledgedBy tells you if the given user has acknowledged this issue since
+// it was last reported.
+func (si *SchedulerIssue) AcknowledgedBy(user string) bool {
+	acked, exists := si.Acks[user]
+	return exists && acked >= si.LastDate
+}
+
+// expired tells you if this issue hasn't been reported for longer than the
+// expiry time of its severity.
+func (si *SchedulerIssue) expired(now time.Time) bool {
+	expiry := schedIssueExpiry(si.Severity)
+	if expiry <= 0 {
+		return false
+	}
+	return now.Sub(time.Unix(si.LastDate, 0)) > expiry
+}
+
+// clone returns a copy of this issue that can be sent elsewhere without racing
+// on future changes to the original.
+func (si *SchedulerIssue) clone() *SchedulerIssue {
+	c := *si
+	c.Counts = make([]*SchedulerIssueCount, len(si.Counts))
+	for i, count := range si.Counts {
+		cc := *count
+		c.Counts[i] = &cc
+	}
+	if si.Acks != nil {
+		c.Acks = make(map[string]int64, len(si.Acks))
+		for user, acked := range si.Acks {
+			c.Acks[user] = acked
+		}
+	}
+	return &c
+}
+
+// schedIssueExpiry returns the ServerSchedIssue*Expiry for the given severity.
+// Issues with no severity are treated as warnings.
+func schedIssueExpiry(severity scheduler.MessageSeverity) time.Duration {
+	switch severity {
+	case scheduler.MessageInfo:
+		return ServerSchedIssueInfoExpiry
+	case scheduler.MessageError:
+		return ServerSchedIssueErrorExpiry
+	default:
+		return ServerSchedIssueWarningExpiry
+	}
+}
+
+// schedIssueSeverityRank returns a number that is higher for more severe
+// severities.
+func schedIssueSeverityRank(severity scheduler.MessageSeverity) int {
+	switch severity {
+	case scheduler.MessageInfo:
+		return 0
+	case scheduler.MessageError:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// sortSchedulerIssues sorts the given issues so that the most severe come
+// first, and within a severity the most recently reported come first.
+func sortSchedulerIssues(issues []*SchedulerIssue) {
+	sort.Slice(issues, func(i, j int) bool {
+		ri, rj := schedIssueSeverityRank(issues[i].Severity), schedIssueSeverityRank(issues[j].Severity)
+		if ri != rj {
+			return ri > rj
+		}
+		return issues[i].LastDate > issues[j].LastDate
+	})
+}
+
+// schedulerIssueReported is our scheduler's MessageCallBack. It records the
+// given message and tells the status webpage about it.
+func (s *Server) schedulerIssueReported(msg string, severity scheduler.MessageSeverity) {
+	s.simutex.Lock()
+	si, existed := s.schedIssues[msg]
+	if !existed {
+		si = &SchedulerIssue{
+			Msg:       msg,
+			FirstDate: time.Now().Unix(),
+		}
+		s.schedIssues[msg] = si
+	}
+	si.occurred(time.Now(), severity)
+	c := si.clone()
+	s.simutex.Unlock()
+	s.schedCaster.Send(c)
+}
+
+// schedulerIssues returns copies of our current scheduler issues, sorted with
+// sortSchedulerIssues(). Expired issues are removed first.
+func (s *Server) schedulerIssues() []*SchedulerIssue {
+	s.expireSchedulerIssues()
+	s.simutex.RLock()
+	issues := make([]*SchedulerIssue, 0, len(s.schedIssues))
+	for _, si := range s.schedIssues {
+		issues = append(issues, si.clone())
+	}
+	s.simutex.RUnlock()
+	sortSchedulerIssues(issues)
+	return issues
+}
+
+// dismissSchedulerIssues removes the scheduler issues with the given messages,
+// or all of them if none are supplied, for all users, and tells the status
+// webpage they're gone.
+func (s *Server) dismissSchedulerIssues(msgs ...string) {
+	s.simutex.Lock()
+	var dismissed []*SchedulerIssue
+	if len(msgs) == 0 {
+		for _, si := range s.schedIssues {
+			dismissed = append(dismissed, si)
+		}
+		s.schedIssues = make(map[string]*SchedulerIssue)
+	} else {
+		for _, msg := range msgs {
+			if si, exists := s.schedIssues[msg]; exists {
+				dismissed = append(dismissed, si)
+				delete(s.schedIssues, msg)
+			}
+		}
+	}
+	s.simutex.Unlock()
+	s.sendDismissedSchedulerIssues(dismissed)
+}
+
+// acknowledgeSchedulerIssues records that the given user has acknowledged the
+// scheduler issues with the given messages, or all of them if none are
+// supplied. They will be considered unacknowledged by that user again if they
+// are reported again. The status webpage is told about the change.
+func (s *Server) acknowledgeSchedulerIssues(user string, msgs ...string) {
+	if user == "" {
+		return
+	}
+	now := time.Now().Unix()
+	var acked []*SchedulerIssue
+	ack := func(si *SchedulerIssue) {
+		if si.Acks == nil {
+			si.Acks = make(map[string]int64)
+		}
+		si.Acks[user] = now
+		acked = append(acked, si.clone())
+	}
+
+	s.simutex.Lock()
+	if len(msgs) == 0 {
+		for _, si := range s.schedIssues {
+			ack(si)
+		}
+	} else {
+		for _, msg := range msgs {
+			if si, exists := s.schedIssues[msg]; exists {
+				ack(si)
+			}
+		}
+	}
+	s.simutex.Unlock()
+
+	for _, si := range acked {
+		s.schedCaster.Send(si)
+	}
+}
+
+// expireSchedulerIssues removes the scheduler issues that haven't been
+// reported for longer than the expiry time of their severity, and tells the
+// status webpage they're gone.
+func (s *Server) expireSchedulerIssues() {
+	now := time.Now()
+	s.simutex.Lock()
+	var expired []*SchedulerIssue
+	for msg, si := range s.schedIssues {
+		if si.expired(now) {
+			expired = append(expired, si)
+			delete(s.schedIssues, msg)
+		}
+	}
+	s.simutex.Unlock()
+	s.sendDismissedSchedulerIssues(expired)
+}
+
+// sendDismissedSchedulerIssues tells the status webpage that the given issues,
+// which must have been removed from s.schedIssues, should no longer be shown.
+func (s *Server) sendDismissedSchedulerIssues(issues []*SchedulerIssue) {
+	for _, si := range issues {
+		c := si.clone()
+		c.Dismissed = true
+		s.schedCaster.Send(c)
+	}
+}
+
+// schedIssueExpirer periodically calls expireSchedulerIssues() until we stop.
+func (s *Server) schedIssueExpirer() {
+	defer internal.LogPanic(s.Logger, "jobqueue scheduler issue expirer", true)
+
+	ticker := time.NewTicker(ServerSchedIssueExpiryCheck)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ssmutex.RLock()
+		up := s.up
+		s.ssmutex.RUnlock()
+		if !up {
+			return
+		}
+		s.expireSchedulerIssues()
+	}
+}
@@ -0,0 +1,544 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for recurring jobs: jobs with a cron-style
+// Schedule are stored as definitions, and the server adds a new instance of
+// each to the queue whenever its schedule triggers.
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/ugorji/go/codec"
+)
+
+// cronScheduleMaxYears is how far in to the future we look for the next time
+// a cron schedule triggers, before deciding it never will (eg. for "0 0 31 2
+// *").
+const cronScheduleMaxYears = 5
+
+// cronAliases maps the short-hand cron expressions we understand to their
+// equivalent full expressions.
+var cronAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronMonths maps the month names that can be used in a cron expression to
+// their numbers.
+var cronMonths = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// cronSchedule is a parsed cron expression.
+type cronSchedule struct {
+	minutes []bool
+	hours   []bool
+	doms    []bool
+	months  []bool
+	dows    []bool
+	domAny  bool
+	dowAny  bool
+}
+
+// parseCronSchedule parses a standard 5 field cron expression: minute (0-59),
+// hour (0-23), day of month (1-31), month (1-12 or jan-dec) and day of week
+// (0-7 or sun-sat, where 0 and 7 are Sunday), separated by spaces, eg. "30 2 *
+// * mon-fri" for 2:30am every weekday.
+//
+// Each field is * (every value), a value, a range of values (like 1-5), or a
+// comma separated list of these, and * and ranges can have a step (like */15
+// for every 15 minutes). As with cron, if both day of month and day of week
+// are restricted (don't start with *), a day matching either triggers. The aliases @hourly,
+// @daily (or @midnight), @weekly, @monthly and @yearly (or @annually) are
+// also understood. Times are in the server's local time zone.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	expr := strings.ToLower(strings.TrimSpace(spec))
+	if alias, exists := cronAliases[expr]; exists {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule [%s] does not have 5 fields", spec)
+	}
+
+	dayNames := make(map[string]int, len(runWindowDays))
+	for name, day := range runWindowDays {
+		dayNames[name] = int(day)
+	}
+
+	c := &cronSchedule{domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*")}
+	var err error
+	if c.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.doms, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	if c.dows, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, err
+	}
+	if c.dows[7] {
+		c.dows[0] = true
+	}
+	return c, nil
+}
+
+// parseCronField parses one field of a cron expression, which can have values
+// from min to max, or the given names for them. The returned slice says which
+// values are included, indexed by value.
+func parseCronField(field string, min, max int, names map[string]int) ([]bool, error) {
+	values := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("schedule step [%s] is not valid", part)
+			}
+			rng = part[:i]
+		}
+
+		var start, end int
+		switch {
+		case rng == "*":
+			start, end = min, max
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if start, err = parseCronValue(bounds[0], min, max, names); err != nil {
+				return nil, err
+			}
+			if end, err = parseCronValue(bounds[1], min, max, names); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, fmt.Errorf("schedule range [%s] ends before it starts", rng)
+			}
+		default:
+			var err error
+			if start, err = parseCronValue(rng, min, max, names); err != nil {
+				return nil, err
+			}
+			end = start
+			if step > 1 {
+				end = max
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// parseCronValue parses a single value of a cron field, which must be a number
+// from min to max or one of the given names.
+func parseCronValue(value string, min, max int, names map[string]int) (int, error) {
+	if v, known := names[value]; known {
+		return v, nil
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("schedule value [%s] is not valid", value)
+	}
+	return v, nil
+}
+
+// next returns the first time after the given one that the schedule triggers,
+// or a zero time if it won't trigger in the next cronScheduleMaxYears.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.AddDate(cronScheduleMaxYears, 0, 0)
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case !c.months[t.Month()]:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !c.hours[t.Hour()]:
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case !c.minutes[t.Minute()]:
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+
+		// guard against daylight saving changes taking us backwards
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// dayMatches tells you if the given time is on a day our schedule triggers on.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := c.doms[t.Day()], c.dows[t.Weekday()]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Schedule is a recurring job, created by adding a Job with a Schedule. See
+// Client.GetSchedules().
+type Schedule struct {
+	// Key is the Key() of Job, which is also the key of its instances.
+	Key string
+
+	// Job is the definition of the job, which is copied to make each
+	// instance.
+	Job *Job
+
+	// Next is when the next instance will be added, if not Paused.
+	Next time.Time
+
+	// Last is when the last instance was added.
+	Last time.Time
+
+	// Created is when the recurring job was first added.
+	Created time.Time
+
+	// Runs is the number of instances that have been added.
+	Runs int
+
+	// Skipped is the number of times the schedule triggered while the
+	// previous instance was still in the queue (eg. still running), so no
+	// new instance was added.
+	Skipped int
+
+	// Paused schedules don't add any instances until they are resumed.
+	Paused bool
+}
+
+// addSchedules stores the given jobs (which must have a Schedule and have
+// been through our AdmissionHook) as recurring job definitions, replacing any
+// existing definition with the same key. Returns the number of new and
+// replaced definitions, and one of our Err* constants on failure.
+func (s *Server) addSchedules(jobs []*Job, envkey string) (added, replaced int, srerr string, qerr error) {
+	s.schedmutex.Lock()
+	defer s.schedmutex.Unlock()
+
+	existing, err := s.db.retrieveSchedules()
+	if err != nil {
+		return added, replaced, ErrDBError, err
+	}
+	byKey := make(map[string]*Schedule, len(existing))
+	for _, sched := range existing {
+		byKey[sched.Key] = sched
+	}
+
+	now := time.Now()
+	for _, job := range jobs {
+		cron, err := parseCronSchedule(job.Schedule)
+		if err != nil {
+			return added, replaced, ErrBadSchedule, err
+		}
+		if err = job.Validate(); err != nil {
+			return added, replaced, ErrBadRequest, err
+		}
+
+		job.Lock()
+		job.EnvKey = envkey
+		job.State = ""
+		job.Unlock()
+
+		key := job.Key()
+		sched, exists := byKey[key]
+		if exists {
+			sched.Job = job
+			replaced++
+		} else {
+			sched = &Schedule{Key: key, Job: job, Created: now}
+			byKey[key] = sched
+			added++
+		}
+		if !sched.Paused {
+			sched.Next = cron.next(now)
+		}
+
+		err = s.db.storeSchedule(sched)
+		if err != nil {
+			return added, replaced, ErrDBError, err
+		}
+		s.Debug("stored recurring job", "key", key, "schedule", job.Schedule, "next", sched.Next)
+	}
+	return added, replaced, "", nil
+}
+
+// getSchedules does the server side of Client.GetSchedules().
+func (s *Server) getSchedules() ([]*Schedule, error) {
+	return s.db.retrieveSchedules()
+}
+
+// schedulesInNamespace returns those of the given schedules whose jobs are in
+// the given namespace, with their jobs' namespace stripped.
+func schedulesInNamespace(scheds []*Schedule, namespace string) []*Schedule {
+	filtered := make([]*Schedule, 0, len(scheds))
+	for _, sched := range scheds {
+		if sched.Job == nil || sched.Job.Namespace != namespace {
+			continue
+		}
+		sched.Job.stripNamespace(namespace)
+		filtered = append(filtered, sched)
+	}
+	return filtered
+}
+
+// changeSchedule does the server side of Client.PauseSchedule(),
+// ResumeSchedule() and CancelSchedule(), depending on the given method. The
+// schedule must be in the given namespace, if any. Returns one of our Err*
+// constants on failure.
+func (s *Server) changeSchedule(method, key, namespace string) (string, error) {
+	s.schedmutex.Lock()
+	defer s.schedmutex.Unlock()
+
+	scheds, err := s.db.retrieveSchedules()
+	if err != nil {
+		return ErrDBError, err
+	}
+	var sched *Schedule
+	for _, candidate := range scheds {
+		if candidate.Key == key && (namespace == "" || candidate.Job.Namespace == namespace) {
+			sched = candidate
+			break
+		}
+	}
+	if sched == nil {
+		return ErrNoSchedule, fmt.Errorf("no recurring job with key %s", key)
+	}
+
+	switch method {
+	case "cancelschedule":
+		s.Debug("cancelled recurring job", "key", key)
+		err = s.db.deleteSchedule(key)
+		if err != nil {
+			return ErrDBError, err
+		}
+		return "", nil
+	case "pauseschedule":
+		sched.Paused = true
+		sched.Next = time.Time{}
+	case "resumeschedule":
+		if !sched.Paused {
+			return "", nil
+		}
+		cron, errp := parseCronSchedule(sched.Job.Schedule)
+		if errp != nil {
+			return ErrBadSchedule, errp
+		}
+		sched.Paused = false
+		sched.Next = cron.next(time.Now())
+	}
+
+	err = s.db.storeSchedule(sched)
+	if err != nil {
+		return ErrDBError, err
+	}
+	return "", nil
+}
+
+// scheduleRunner periodically does runSchedules(), until we stop.
+func (s *Server) scheduleRunner() {
+	defer internal.LogPanic(s.Logger, "jobqueue schedule runner", true)
+
+	ticker := time.NewTicker(ServerScheduleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ssmutex.RLock()
+		up := s.up
+		s.ssmutex.RUnlock()
+		if !up {
+			return
+		}
+
+		if err := s.runSchedules(time.Now()); err != nil {
+			s.Warn("failed to run recurring jobs", "err", err)
+		}
+	}
+}
+
+// runSchedules adds an instance of every unpaused recurring job whose Next
+// time is not after the given time. If the server was down when a schedule
+// triggered (perhaps more than once), a single instance is added to catch up.
+// Then the schedule's Next time is set to its next trigger after now.
+func (s *Server) runSchedules(now time.Time) error {
+	s.schedmutex.Lock()
+	defer s.schedmutex.Unlock()
+
+	scheds, err := s.db.retrieveSchedules()
+	if err != nil {
+		return err
+	}
+
+	for _, sched := range scheds {
+		if sched.Paused || sched.Next.IsZero() || sched.Next.After(now) || sched.Job == nil {
+			continue
+		}
+
+		instance, errc := s.copyJob(sched.Job)
+		if errc != nil {
+			return errc
+		}
+		added, dups, alreadyComplete, _, errc := s.createAdmittedJobs([]*Job{instance}, sched.Job.EnvKey, false)
+		switch {
+		case errc != nil:
+			s.Warn("failed to add an instance of a recurring job", "key", sched.Key, "err", errc)
+		case added > 0 || alreadyComplete > 0:
+			sched.Runs++
+			sched.Last = now
+		case dups > 0:
+			sched.Skipped++
+			s.Debug("skipped an instance of a recurring job, since the last is still incomplete", "key", sched.Key)
+		}
+
+		cron, errp := parseCronSchedule(sched.Job.Schedule)
+		if errp != nil {
+			// can't happen, since we parsed it when it was added
+			s.Warn("recurring job has a bad schedule", "key", sched.Key, "err", errp)
+			sched.Paused = true
+			sched.Next = time.Time{}
+		} else {
+			sched.Next = cron.next(now)
+		}
+
+		if err = s.db.storeSchedule(sched); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyJob returns a deep copy of the given job, made by decoding its encoding.
+func (s *Server) copyJob(job *Job) (*Job, error) {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, s.ch)
+	if err := enc.Encode(job); err != nil {
+		return nil, err
+	}
+	cp := &Job{}
+	dec := codec.NewDecoderBytes(encoded, s.ch)
+	err := dec.Decode(cp)
+	return cp, err
+}
+
+// GetSchedules gets the recurring jobs that have been added, ie. the Jobs you
+// added that had a Schedule.
+//
+// A Job's Schedule is a standard 5 field cron expression: minute (0-59), hour
+// (0-23), day of month (1-31), month (1-12 or jan-dec) and day of week (0-7 or
+// sun-sat, where 0 and 7 are Sunday), eg. "30 2 * * mon-fri" for 2:30am every
+// weekday. Fields can be *, values, ranges (like 1-5), comma separated lists
+// of these, and * and ranges can have a step (like */15). The aliases @hourly,
+// @daily, @weekly, @monthly and @yearly can also be used. Times are in the
+// server's local time zone. An invalid Schedule results in an Error with Err
+// ErrBadSchedule when you Add() the Job.
+//
+// Rather than being queued, Jobs with a Schedule are stored, and at every
+// trigger the server adds an instance of the Job to the queue (with the same
+// key and RepGroup as the definition, so they are grouped together). If the
+// previous instance is still in the queue at the time, no new one is added.
+// Adding a Job with the same key as an existing recurring job replaces its
+// definition.
+func (c *Client) GetSchedules() ([]*Schedule, error) {
+	return c.GetSchedulesContext(context.Background())
+}
+
+// GetSchedulesContext is like GetSchedules(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetSchedulesContext(ctx context.Context) ([]*Schedule, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getschedules"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Schedules, err
+}
+
+// PauseSchedule stops the recurring job with the given key (see GetSchedules())
+// from adding any more instances, until you ResumeSchedule(). Instances that
+// were already added are not affected.
+func (c *Client) PauseSchedule(key string) error {
+	return c.PauseScheduleContext(context.Background(), key)
+}
+
+// PauseScheduleContext is like PauseSchedule(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) PauseScheduleContext(ctx context.Context, key string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "pauseschedule", Keys: []string{key}})
+	return err
+}
+
+// ResumeSchedule undoes PauseSchedule(). The next instance is added at the
+// next trigger after now; triggers missed while paused are not caught up.
+func (c *Client) ResumeSchedule(key string) error {
+	return c.ResumeScheduleContext(context.Background(), key)
+}
+
+// ResumeScheduleContext is like ResumeSchedule(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) ResumeScheduleContext(ctx context.Context, key string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "resumeschedule", Keys: []string{key}})
+	return err
+}
+
+// CancelSchedule permanently deletes the recurring job with the given key (see
+// GetSchedules()), so that no more instances are added. Instances that were
+// already added are not affected; remove them as normal if desired.
+func (c *Client) CancelSchedule(key string) error {
+	return c.CancelScheduleContext(context.Background(), key)
+}
+
+// CancelScheduleContext is like CancelSchedule(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) CancelScheduleContext(ctx context.Context, key string) error {
+	_, err := c.requestContext(ctx, &clientRequest{Method: "cancelschedule", Keys: []string{key}})
+	return err
+}
@@ -19,6 +19,7 @@
 package scheduler
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -43,8 +44,8 @@ import (
 // k8s is the implementer of scheduleri. It is a wrapper to implement scheduleri
 // by sending requests to the controller
 
-// maxQueueTime(), reserveTimeout(), hostToID(), busy(), schedule() are
-// inherited from local
+// maxQueueTime(), reserveTimeout(), hostToID(), hostGone(), busy(), schedule()
+// are inherited from local
 type k8s struct {
 	local
 	config          *ConfigKubernetes
@@ -331,6 +332,26 @@ func (s *k8s) reqCheck(req *Requirements) error {
 	return resp.Error
 }
 
+// hosts returns nil, since the cluster's nodes are managed by kubernetes, not
+// us.
+func (s *k8s) hosts() []*Host {
+	return nil
+}
+
+// runCmdOnHost always returns an error, since the cluster's nodes are managed
+// by kubernetes, not us.
+func (s *k8s) runCmdOnHost(ctx context.Context, host, cmd string) (string, error) {
+	return "", Error{"kubernetes", "runCmdOnHost", ErrNoHostAccess}
+}
+
+// excludeHosts does nothing, since Kubernetes decides which nodes our pods run
+// on.
+func (s *k8s) excludeHosts(hosts map[string]bool) {}
+
+// setHostCheckCallBack does nothing, since Kubernetes decides which nodes our
+// pods run on.
+func (s *k8s) setHostCheckCallBack(cb HostCheckCallBack) {}
+
 // setMessageCallBack sets the given callback function.
 func (s *k8s) setMessageCallBack(cb MessageCallBack) {
 	s.Debug("setMessageCallBack called")
@@ -348,7 +369,7 @@ func (s *k8s) setBadServerCallBack(cb BadServerCallBack) {
 }
 
 // The controller is passed a callback channel. notifyMessage receives on the
-// channel. If anything is received call s.msgCB(msg).
+// channel. If anything is received call s.msgCB(msg) with a warning severity.
 func (s *k8s) notifyCallBack(callBackChan chan string, badCallBackChan chan *cloud.Server) {
 	s.Debug("notifyCallBack handler started")
 	for {
@@ -356,7 +377,7 @@ func (s *k8s) notifyCallBack(callBackChan chan string, badCallBackChan chan *clo
 		case msg := <-callBackChan:
 			s.Debug("Callback notification", "msg", msg)
 			if s.msgCB != nil {
-				go s.msgCB(msg)
+				go s.msgCB(msg, MessageWarning)
 			}
 		case badServer := <-badCallBackChan:
 			s.Debug("Bad server callback notification", "name", badServer.Name, "problem", badServer.PermanentProblem())
@@ -462,7 +483,7 @@ func (s *k8s) runCmd(cmd string, req *Requirements, reservedCh chan bool, call s
 
 	if err != nil {
 		s.Error("error spawning runner pod", "err", err)
-		s.msgCB(fmt.Sprintf("unable to spawn a runner with requirements %s: %s", req.Stringify(), err))
+		s.msgCB(fmt.Sprintf("unable to spawn a runner with requirements %s: %s", req.Stringify(), err), MessageError)
 		reservedCh <- false
 		return err
 	}
@@ -23,6 +23,7 @@ package scheduler
 // may not be very efficient with the machine's resources.
 
 import (
+	"context"
 	"math"
 	"os"
 	"os/exec"
@@ -124,9 +125,12 @@ type local struct {
 	runCmdFunc        cmdRunner
 	stopAuto          chan bool
 	recoveredPids     map[int]bool
+	excluded          map[string]bool
+	hostCheckCB       HostCheckCallBack
 	stopPidMonitoring chan struct{}
 	cleanMutex        sync.RWMutex
 	rcMutex           sync.RWMutex
+	exMutex           sync.RWMutex // to protect excluded and hostCheckCB
 	resourceMutex     sync.RWMutex
 	runMutex          sync.RWMutex
 	mutex             sync.Mutex
@@ -159,6 +163,12 @@ type ConfigLocal struct {
 	// The unit is in MB, and defaults to all available memory. Specifying more
 	// than this uses the default amount. Values below 1 are treated as default.
 	MaxRAM int
+
+	// Packing is the strategy used to order cmds of equal priority. There is
+	// only 1 host, so only PackingBestFit has any effect here, running cmds
+	// that need the most memory first; otherwise cmds needing the largest share
+	// of either memory or cores are run first.
+	Packing PackingStrategy
 }
 
 // jobs are what we store in our queue.
@@ -269,7 +279,7 @@ func (s *local) schedule(cmd string, req *Requirements, priority uint8, count in
 	percentMemNeeded := (float64(req.RAM) / float64(maxMem)) * float64(100)
 	percentCPUNeeded := (req.Cores / float64(maxCPU)) * float64(100)
 	percentMachineNeeded := percentMemNeeded
-	if percentCPUNeeded > percentMachineNeeded {
+	if percentCPUNeeded > percentMachineNeeded && s.config.Packing != PackingBestFit {
 		percentMachineNeeded = percentCPUNeeded
 	}
 	size := uint8(math.Round(priorityScaler * percentMachineNeeded))
@@ -700,8 +710,13 @@ func (s *local) processQueue(reason string) error {
 }
 
 // canCount tells you how many jobs with the given RAM and core requirements it
-// is possible to run, given remaining resources.
+// is possible to run, given remaining resources. Nothing can run if the local
+// machine has been excluded, or the host check callback rejects it.
 func (s *local) canCount(cmd string, req *Requirements, call string) int {
+	if !s.hostUsable(localHostName(), req) {
+		return 0
+	}
+
 	s.resourceMutex.RLock()
 	defer s.resourceMutex.RUnlock()
 
@@ -911,6 +926,78 @@ func (s *local) hostToID(host string) string {
 	return ""
 }
 
+// hostGone always returns false, since we're not in the cloud.
+func (s *local) hostGone(id string) bool {
+	return false
+}
+
+// hosts returns details of the local machine, limited to the cores and memory
+// we've been configured to use. If the local machine has been excluded, returns
+// nothing.
+func (s *local) hosts() []*Host {
+	name := localHostName()
+	if s.isExcluded(name) {
+		return []*Host{}
+	}
+	return []*Host{{Name: name, Cores: float64(s.maxCores), RAM: s.maxRAM}}
+}
+
+// runCmdOnHost runs the given cmd using our configured shell, as long as the
+// given host is the local machine.
+func (s *local) runCmdOnHost(ctx context.Context, host, cmd string) (string, error) {
+	if host != localHostName() {
+		return "", Error{"local", "runCmdOnHost", ErrNoHostAccess}
+	}
+	ec := exec.CommandContext(ctx, s.config.Shell, "-c", cmd) // #nosec
+	out, err := ec.Output()
+	return string(out), err
+}
+
+// excludeHosts stores the given host names, so that isExcluded() can be used
+// to avoid running cmds on them.
+func (s *local) excludeHosts(hosts map[string]bool) {
+	s.exMutex.Lock()
+	defer s.exMutex.Unlock()
+	s.excluded = hosts
+}
+
+// isExcluded tells you if the given host was passed to excludeHosts().
+func (s *local) isExcluded(host string) bool {
+	s.exMutex.RLock()
+	defer s.exMutex.RUnlock()
+	return s.excluded[host]
+}
+
+// setHostCheckCallBack stores the given callback, so that hostUsable() can
+// consult it.
+func (s *local) setHostCheckCallBack(cb HostCheckCallBack) {
+	s.exMutex.Lock()
+	defer s.exMutex.Unlock()
+	s.hostCheckCB = cb
+}
+
+// hostUsable tells you if a cmd with the given requirements can run on the
+// given host, considering excluded hosts and any host check callback. A blank
+// host means a host that doesn't exist yet.
+func (s *local) hostUsable(host string, req *Requirements) bool {
+	s.exMutex.RLock()
+	defer s.exMutex.RUnlock()
+	if s.excluded[host] {
+		return false
+	}
+	return s.hostCheckCB == nil || s.hostCheckCB(host, req)
+}
+
+// localHostName returns the name of the local machine, or "localhost" if that
+// can't be determined.
+func localHostName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "localhost"
+	}
+	return name
+}
+
 // setMessageCallBack does nothing at the moment, since we don't generate any
 // messages for the user.
 func (s *local) setMessageCallBack(cb MessageCallBack) {}
@@ -918,6 +1005,12 @@ func (s *local) setMessageCallBack(cb MessageCallBack) {}
 // setBadServerCallBack does nothing, since we're not a cloud-based scheduler.
 func (s *local) setBadServerCallBack(cb BadServerCallBack) {}
 
+// setDemandCallBack does nothing, since we're not a cloud-based scheduler.
+func (s *local) setDemandCallBack(cb DemandCallBack) {}
+
+// setDrainCallBack does nothing, since we're not a cloud-based scheduler.
+func (s *local) setDrainCallBack(cb DrainCallBack) {}
+
 // cleanup destroys our internal queue.
 func (s *local) cleanup() {
 	s.mutex.Lock()
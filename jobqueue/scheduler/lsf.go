@@ -23,6 +23,7 @@ package scheduler
 
 import (
 	"bufio"
+	"context"
 	"encoding/csv"
 	"fmt"
 	"math"
@@ -35,6 +36,7 @@ import (
 
 	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/inconshreveable/log15"
+	sync "github.com/sasha-s/go-deadlock"
 )
 
 // lsf is our implementer of scheduleri
@@ -50,6 +52,8 @@ type lsf struct {
 	bsubExe            string
 	bjobsExe           string
 	bkillExe           string
+	excluded           []string
+	exMutex            sync.RWMutex
 	log15.Logger
 }
 
@@ -541,7 +545,13 @@ func (s *lsf) generateBsubArgs(queue string, req *Requirements, cmd string, need
 	var bsubArgs []string
 	megabytes := req.RAM
 	m := float32(megabytes) * s.memLimitMultiplier
-	bsubArgs = append(bsubArgs, "-q", queue, "-M", fmt.Sprintf("%0.0f", m), "-R", fmt.Sprintf("'select[mem>%d] rusage[mem=%d] span[hosts=1]'", megabytes, megabytes))
+	var notHosts string
+	s.exMutex.RLock()
+	for _, host := range s.excluded {
+		notHosts += " && hname!=" + host
+	}
+	s.exMutex.RUnlock()
+	bsubArgs = append(bsubArgs, "-q", queue, "-M", fmt.Sprintf("%0.0f", m), "-R", fmt.Sprintf("'select[mem>%d%s] rusage[mem=%d] span[hosts=1]'", megabytes, notHosts, megabytes))
 
 	if val, ok := req.Other["scheduler_misc"]; ok {
 		if strings.Contains(val, `'`) {
@@ -750,6 +760,39 @@ func (s *lsf) hostToID(host string) string {
 	return ""
 }
 
+// hostGone always returns false, since we're not in the cloud.
+func (s *lsf) hostGone(id string) bool {
+	return false
+}
+
+// runCmdOnHost always returns an error, since LSF manages its own hosts.
+func (s *lsf) runCmdOnHost(ctx context.Context, host, cmd string) (string, error) {
+	return "", Error{"lsf", "runCmdOnHost", ErrNoHostAccess}
+}
+
+// hosts always returns nil, since LSF manages its own hosts.
+func (s *lsf) hosts() []*Host {
+	return nil
+}
+
+// excludeHosts stores the given host names, so that future bsubs will ask LSF
+// not to run on them. Since LSF manages its own hosts and their capacity, this
+// has no effect on jobs already submitted.
+func (s *lsf) excludeHosts(hosts map[string]bool) {
+	excluded := make([]string, 0, len(hosts))
+	for host := range hosts {
+		excluded = append(excluded, host)
+	}
+	sort.Strings(excluded)
+	s.exMutex.Lock()
+	defer s.exMutex.Unlock()
+	s.excluded = excluded
+}
+
+// setHostCheckCallBack does nothing, since LSF decides which hosts our cmds
+// run on.
+func (s *lsf) setHostCheckCallBack(cb HostCheckCallBack) {}
+
 // setMessageCallBack does nothing at the moment, since we don't generate any
 // messages for the user.
 func (s *lsf) setMessageCallBack(cb MessageCallBack) {}
@@ -757,6 +800,12 @@ func (s *lsf) setMessageCallBack(cb MessageCallBack) {}
 // setBadServerCallBack does nothing, since we're not a cloud-based scheduler.
 func (s *lsf) setBadServerCallBack(cb BadServerCallBack) {}
 
+// setDemandCallBack does nothing, since we're not a cloud-based scheduler.
+func (s *lsf) setDemandCallBack(cb DemandCallBack) {}
+
+// setDrainCallBack does nothing, since we're not a cloud-based scheduler.
+func (s *lsf) setDrainCallBack(cb DrainCallBack) {}
+
 // cleanup bkills any remaining jobs we created
 func (s *lsf) cleanup() {
 	toKill := []string{"-b"}
@@ -19,7 +19,8 @@
 package scheduler
 
 // This file contains a scheduleri implementation for 'openstack': running jobs
-// on servers spawned on demand.
+// on servers spawned on demand. The same implementation is used for 'gcp' and
+// 'aws'.
 
 import (
 	"context"
@@ -75,8 +76,11 @@ type opst struct {
 	spawnedServers    map[string]*cloud.Server
 	msgCB             MessageCallBack
 	badServerCB       BadServerCallBack
+	demandCB          DemandCallBack
+	drainCB           DrainCallBack
 	recoveredServers  map[string]bool
 	stopRSMonitoring  chan struct{}
+	stopScaleDown     chan struct{}
 	ffCache           *cache.Cache
 	dfCache           *cache.Cache
 	serversMutex      sync.RWMutex
@@ -93,6 +97,11 @@ type opst struct {
 // OpenStack scheduler. All are required with no usable defaults, unless
 // otherwise noted. This struct implements the CloudConfig interface.
 type ConfigOpenStack struct {
+	// Provider is the name of the cloud provider (see cloud.New()) to spawn
+	// servers with. It defaults to "openstack"; the scheduler works the same
+	// way with "gcp" and "aws".
+	Provider string
+
 	// ResourceName is the resource name prefix used to name any resources (such
 	// as keys, security groups and servers) that need to be created.
 	ResourceName string
@@ -231,6 +240,34 @@ type ConfigOpenStack struct {
 	// executed like `(umask Umask && cmd)`, which may present cross-platform
 	// compatibility issues. (But should work on most linux-like systems.)
 	Umask int
+
+	// RunnerExeDir is a directory containing copies of the exe of the cmd you
+	// schedule that were built for other Operating Systems and architectures,
+	// named like [exe]-[goos]-[goarch] (eg. wr-linux-arm64). When a spawned
+	// server turns out to be a different platform to us (eg. because it has an
+	// arm64 flavor), the matching copy will be uploaded to it instead of our
+	// own exe. Defaults to the directory our exe is in.
+	RunnerExeDir string
+
+	// RunnerExeURL is a URL to download a copy of the exe of the cmd you
+	// schedule from, for when there isn't one for a spawned server's platform
+	// in RunnerExeDir. {os} and {arch} in the URL are replaced with the GOOS
+	// and GOARCH of the server. Downloads are saved to RunnerExeDir. The
+	// default of blank means spawning fails if no matching exe is found.
+	RunnerExeURL string
+
+	// Packing is the strategy used to pick which of the existing servers with
+	// space for a cmd it will run on. The default PackingAny picks any of them.
+	// PackingFill is recommended when servers are large compared to your cmds,
+	// since it lets the servers you don't need become idle and be destroyed
+	// after ServerKeepTime.
+	Packing PackingStrategy
+
+	// ScaleDown, if set, has servers that aren't needed for the demand we
+	// predict drained and destroyed without waiting for ServerKeepTime. The
+	// default of nil only destroys servers after they've been idle for
+	// ServerKeepTime.
+	ScaleDown *ScaleDownPolicy
 }
 
 // AddConfigFile takes a value as per the ConfigFiles property, and appends it
@@ -263,11 +300,14 @@ func (s *opst) initialize(config interface{}, logger log15.Logger) error {
 		s.config.OSDisk = 1
 	}
 
-	s.Logger = logger.New("scheduler", "openstack")
+	if s.config.Provider == "" {
+		s.config.Provider = "openstack"
+	}
 
-	// create a cloud provider for openstack, that we'll use to interact with
-	// openstack
-	provider, err := cloud.New("openstack", s.config.ResourceName, s.config.SavePath, logger)
+	s.Logger = logger.New("scheduler", s.config.Provider)
+
+	// create a cloud provider, that we'll use to interact with the cloud
+	provider, err := cloud.New(s.config.Provider, s.config.ResourceName, s.config.SavePath, logger)
 	if err != nil {
 		return err
 	}
@@ -362,12 +402,13 @@ func (s *opst) initialize(config interface{}, logger log15.Logger) error {
 
 	// pass through our shell config and logger to our local embed, as well as
 	// creating its stopAuto channel
-	s.local.config = &ConfigLocal{Shell: s.config.Shell}
+	s.local.config = &ConfigLocal{Shell: s.config.Shell, Packing: s.config.Packing}
 	s.local.Logger = s.Logger
 	s.local.stopAuto = make(chan bool)
 
 	s.recoveredServers = make(map[string]bool)
 	s.stopRSMonitoring = make(chan struct{})
+	s.stopScaleDown = make(chan struct{})
 	s.spawnCanceller = make(map[string]map[string]chan struct{})
 
 	if s.config.FlavorSets != "" {
@@ -381,6 +422,10 @@ func (s *opst) initialize(config interface{}, logger log15.Logger) error {
 	s.ffCache = cache.New(flavorFailedCacheExpiry, flavorFailedCacheCleanup)
 	s.dfCache = cache.New(flavorDeterminedCacheExpiry, flavorDeterminedCacheCleanup)
 
+	if s.config.ScaleDown != nil {
+		go s.scaleDownPeriodically()
+	}
+
 	return err
 }
 
@@ -393,7 +438,7 @@ func (s *opst) reqCheck(req *Requirements) error {
 	// check if possible vs quota
 	if reqForSpawn.RAM > s.quotaMaxRAM || int(math.Ceil(reqForSpawn.Cores)) > s.quotaMaxCores || reqForSpawn.Disk > s.quotaMaxVolume {
 		s.Warn("Requested resources are greater than max quota", "quotaCores", s.quotaMaxCores, "requiredCores", reqForSpawn.Cores, "quotaRAM", s.quotaMaxRAM, "requiredRAM", reqForSpawn.RAM, "quotaDisk", s.quotaMaxVolume, "requiredDisk", reqForSpawn.Disk)
-		s.notifyMessage(fmt.Sprintf("OpenStack: not enough quota for the job needing %f cores, %d RAM and %d Disk", reqForSpawn.Cores, reqForSpawn.RAM, reqForSpawn.Disk))
+		s.notifyMessage(fmt.Sprintf("OpenStack: not enough quota for the job needing %f cores, %d RAM and %d Disk", reqForSpawn.Cores, reqForSpawn.RAM, reqForSpawn.Disk), MessageError)
 		return Error{"openstack", "schedule", ErrImpossible}
 	}
 
@@ -407,7 +452,7 @@ func (s *opst) reqCheck(req *Requirements) error {
 		// enough to run their job
 		if requestedFlavor.Cores < int(math.Ceil(reqForSpawn.Cores)) || requestedFlavor.RAM < reqForSpawn.RAM {
 			s.Warn("Requested flavor is too small for the job", "flavor", requestedFlavor.Name, "flavorCores", requestedFlavor.Cores, "requiredCores", reqForSpawn.Cores, "flavorRAM", requestedFlavor.RAM, "requiredRAM", reqForSpawn.RAM)
-			s.notifyMessage(fmt.Sprintf("OpenStack: requested flavor %s is too small for the job needing %f cores and %d RAM", requestedFlavor.Name, reqForSpawn.Cores, reqForSpawn.RAM))
+			s.notifyMessage(fmt.Sprintf("OpenStack: requested flavor %s is too small for the job needing %f cores and %d RAM", requestedFlavor.Name, reqForSpawn.Cores, reqForSpawn.RAM), MessageError)
 			return Error{"openstack", "schedule", ErrImpossible}
 		}
 	} else {
@@ -588,7 +633,7 @@ func (s *opst) canCount(cmd string, req *Requirements, call string) int {
 	var canCount int
 	s.serversMutex.RLock()
 	for _, server := range s.servers {
-		if !server.IsBad() && server.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor, needsSharedDisk) {
+		if !server.IsBad() && !server.Draining() && s.hostUsable(server.Name, req) && server.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor, needsSharedDisk) {
 			space := server.HasSpaceFor(req.Cores, req.RAM, req.Disk)
 			canCount += space
 		}
@@ -601,9 +646,35 @@ func (s *opst) canCount(cmd string, req *Requirements, call string) int {
 // spawnMultiple is our cantFunc which is run when canCount() returns less than
 // desired number of jobs.
 //
+// If we have a ScaleDown policy, servers we were draining that could run the
+// cmd are used before any new ones are spawned.
+//
 // If there is enough quota to spawn new servers, and we are not already in the
 // middle of spawning too many servers, we spawn instances in the background.
 func (s *opst) spawnMultiple(desired int, cmd string, req *Requirements, call string) {
+	// rather than spawn new servers, use any we were draining
+	if s.config.ScaleDown != nil {
+		if undrained := s.undrainFor(desired, req); undrained > 0 {
+			go func() {
+				defer internal.LogPanic(s.Logger, "spawnMultiple", false)
+
+				errp := s.processQueue("undrain")
+				if errp != nil {
+					s.Error("processQueue recall failed", "err", errp)
+				}
+			}()
+			desired -= undrained
+			if desired <= 0 {
+				return
+			}
+		}
+	}
+
+	if !s.hostUsable("", req) {
+		s.Debug("spawnMultiple not spawning, since new servers can't be used")
+		return
+	}
+
 	s.spawnMutex.Lock()
 	defer s.spawnMutex.Unlock()
 	var spawningTotal int
@@ -711,7 +782,7 @@ func (s *opst) checkQuota(req *Requirements, requestedFlavor *cloud.Flavor, call
 		remainingInstances = quota.MaxInstances - quota.UsedInstances - s.reservedInstances
 		if remainingInstances < 1 {
 			s.Debug("lack of instance quota", "remaining", remainingInstances, "max", quota.MaxInstances, "used", quota.UsedInstances, "reserved", s.reservedInstances)
-			s.notifyMessage("OpenStack: Not enough instance quota to create another server")
+			s.notifyMessage("OpenStack: Not enough instance quota to create another server", MessageWarning)
 		}
 	}
 	if remainingInstances > 0 && s.quotaMaxInstances > -1 && s.quotaMaxInstances < quota.MaxInstances {
@@ -733,7 +804,7 @@ func (s *opst) checkQuota(req *Requirements, requestedFlavor *cloud.Flavor, call
 		remainingRAM = quota.MaxRAM - quota.UsedRAM - s.reservedRAM
 		if remainingRAM < flavor.RAM {
 			s.Debug("lack of ram quota", "remaining", remainingRAM, "max", quota.MaxRAM, "used", quota.UsedRAM, "reserved", s.reservedRAM)
-			s.notifyMessage(fmt.Sprintf("OpenStack: Not enough RAM quota to create another server (need %d, have %d)", flavor.RAM, remainingRAM))
+			s.notifyMessage(fmt.Sprintf("OpenStack: Not enough RAM quota to create another server (need %d, have %d)", flavor.RAM, remainingRAM), MessageWarning)
 		}
 	}
 	remainingCores := unquotadVal
@@ -741,7 +812,7 @@ func (s *opst) checkQuota(req *Requirements, requestedFlavor *cloud.Flavor, call
 		remainingCores = quota.MaxCores - quota.UsedCores - s.reservedCores
 		if remainingCores < flavor.Cores {
 			s.Debug("lack of cores quota", "remaining", remainingCores, "max", quota.MaxCores, "used", quota.UsedCores, "reserved", s.reservedCores)
-			s.notifyMessage(fmt.Sprintf("OpenStack: Not enough cores quota to create another server (need %d, have %d)", flavor.Cores, remainingCores))
+			s.notifyMessage(fmt.Sprintf("OpenStack: Not enough cores quota to create another server (need %d, have %d)", flavor.Cores, remainingCores), MessageWarning)
 		}
 	}
 	remainingVolume := unquotadVal
@@ -750,7 +821,7 @@ func (s *opst) checkQuota(req *Requirements, requestedFlavor *cloud.Flavor, call
 		remainingVolume = quota.MaxVolume - quota.UsedVolume - s.reservedVolume
 		if remainingVolume < req.Disk {
 			s.Debug("lack of volume quota", "remaining", remainingVolume, "max", quota.MaxVolume, "used", quota.UsedVolume, "reserved", s.reservedVolume)
-			s.notifyMessage(fmt.Sprintf("OpenStack: Not enough volume quota to create another server (need %d, have %d)", flavor.Disk, remainingVolume))
+			s.notifyMessage(fmt.Sprintf("OpenStack: Not enough volume quota to create another server (need %d, have %d)", flavor.Disk, remainingVolume), MessageWarning)
 		}
 	}
 	if remainingInstances < 1 || remainingRAM < flavor.RAM || remainingCores < flavor.Cores || remainingVolume < req.Disk {
@@ -884,9 +955,9 @@ func (s *opst) spawn(req *Requirements, flavor *cloud.Flavor, requestedOS string
 
 	// spawn
 	failMsg := "server failed spawn"
-	logger.Debug("will spawn new server", "flavor", flavor.Name, "cmd", cmd)
+	logger.Debug("will spawn new server", "flavor", flavor.Name, "zone", req.Other[ReqZone], "cmd", cmd)
 	tSpawn := time.Now()
-	server, err := s.provider.Spawn(requestedOS, osUser, flavor.ID, req.Disk, s.config.ServerKeepTime, false, usingQuotaCB)
+	server, err := s.provider.SpawnInZone(req.Other[ReqZone], requestedOS, osUser, flavor.ID, req.Disk, s.config.ServerKeepTime, false, usingQuotaCB)
 	serverID := "failed"
 	if server != nil {
 		serverID = server.ID
@@ -921,19 +992,52 @@ func (s *opst) spawn(req *Requirements, flavor *cloud.Flavor, requestedOS string
 			exe := strings.Split(cmd, " ")[0]
 			var exePath, stdout string
 			if exePath, err = exec.LookPath(exe); err == nil {
+				// the server might not be the same platform as us, in which
+				// case we need to upload a copy of exe built for it
+				sourceExe := exePath
 				err = s.actOnServerIfNeeded(server, cmd, func(ctx context.Context) error {
-					var errRun error
-					stdout, _, errRun = server.RunCmd(ctx, "file "+exePath, false)
-					return errRun
+					goos, goarch, errp := server.Platform(ctx)
+					if errp != nil {
+						return errp
+					}
+					sourceExe, errp = cloud.ExeForPlatform(exePath, goos, goarch, s.config.RunnerExeDir, s.config.RunnerExeURL)
+					return errp
 				})
-				if stdout != "" {
-					if strings.Contains(stdout, "No such file") {
-						// *** NB this will fail if exePath is in a dir we can't
-						// create on the remote server, eg. if it is in our home
-						// dir, but the remote server has a different user, or
-						// presumably if it is somewhere requiring root
-						// permission
-						err = s.actOnServerIfNeeded(server, cmd, func(ctx context.Context) error { return server.UploadFile(ctx, exePath, exePath) })
+				if err != nil {
+					if err.Error() != serverNotNeededErrStr {
+						err = fmt.Errorf("could not find a suitable exe to upload: %s", err)
+					}
+				} else {
+					err = s.actOnServerIfNeeded(server, cmd, func(ctx context.Context) error {
+						var errRun error
+						stdout, _, errRun = server.RunCmd(ctx, "file "+exePath, false)
+						return errRun
+					})
+					if stdout != "" {
+						if strings.Contains(stdout, "No such file") {
+							// *** NB this will fail if exePath is in a dir we
+							// can't create on the remote server, eg. if it is in
+							// our home dir, but the remote server has a different
+							// user, or presumably if it is somewhere requiring
+							// root permission
+							err = s.actOnServerIfNeeded(server, cmd, func(ctx context.Context) error { return server.UploadFile(ctx, sourceExe, exePath) })
+							if err == nil {
+								err = s.actOnServerIfNeeded(server, cmd, func(ctx context.Context) error {
+									_, _, errRun := server.RunCmd(ctx, "chmod u+x "+exePath, false)
+									return errRun
+								})
+							} else if err.Error() != serverNotNeededErrStr {
+								err = fmt.Errorf("could not upload exe [%s]: %s (try putting the exe in /tmp?)", exePath, err)
+							}
+						} else if err != nil && err.Error() != serverNotNeededErrStr {
+							err = fmt.Errorf("could not check exe with [file %s]: %s [%s]", exePath, stdout, err)
+						}
+					} else {
+						// checking for exePath with the file command failed
+						// for some reason, and without any stdout... but let's
+						// just try the upload anyway, assuming the exe isn't
+						// there
+						err = s.actOnServerIfNeeded(server, cmd, func(ctx context.Context) error { return server.UploadFile(ctx, sourceExe, exePath) })
 						if err == nil {
 							err = s.actOnServerIfNeeded(server, cmd, func(ctx context.Context) error {
 								_, _, errRun := server.RunCmd(ctx, "chmod u+x "+exePath, false)
@@ -942,21 +1046,6 @@ func (s *opst) spawn(req *Requirements, flavor *cloud.Flavor, requestedOS string
 						} else if err.Error() != serverNotNeededErrStr {
 							err = fmt.Errorf("could not upload exe [%s]: %s (try putting the exe in /tmp?)", exePath, err)
 						}
-					} else if err != nil && err.Error() != serverNotNeededErrStr {
-						err = fmt.Errorf("could not check exe with [file %s]: %s [%s]", exePath, stdout, err)
-					}
-				} else {
-					// checking for exePath with the file command failed for
-					// some reason, and without any stdout... but let's just
-					// try the upload anyway, assuming the exe isn't there
-					err = s.actOnServerIfNeeded(server, cmd, func(ctx context.Context) error { return server.UploadFile(ctx, exePath, exePath) })
-					if err == nil {
-						err = s.actOnServerIfNeeded(server, cmd, func(ctx context.Context) error {
-							_, _, errRun := server.RunCmd(ctx, "chmod u+x "+exePath, false)
-							return errRun
-						})
-					} else if err.Error() != serverNotNeededErrStr {
-						err = fmt.Errorf("could not upload exe [%s]: %s (try putting the exe in /tmp?)", exePath, err)
 					}
 				}
 			} else {
@@ -991,7 +1080,7 @@ func (s *opst) spawn(req *Requirements, flavor *cloud.Flavor, requestedOS string
 			s.Warn("server failed to spawn due to lack of hardware", "flavor", flavor.Name)
 		}
 		if err.Error() != serverNotNeededErrStr {
-			s.notifyMessage(fmt.Sprintf("OpenStack: Failed to create a usable server: %s", err))
+			s.notifyMessage(fmt.Sprintf("OpenStack: Failed to create a usable server: %s", err), MessageWarning)
 		}
 		return
 	}
@@ -1083,12 +1172,25 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool, call
 	}
 
 	// look through space on existing servers to see if we can run cmd on one
-	// of them
+	// of them, trying them in the order preferred by our packing strategy,
+	// but those in any zone the cmd prefers first
 	s.serversMutex.RLock()
-	var server *cloud.Server
+	var candidates []*cloud.Server
+	sids := make(map[*cloud.Server]string)
 	for sid, thisServer := range s.servers {
-		if !thisServer.IsBad() && thisServer.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor, needsSharedDisk) && thisServer.Allocate(req.Cores, req.RAM, req.Disk) {
+		if !thisServer.IsBad() && !thisServer.Draining() && s.hostUsable(thisServer.Name, req) && thisServer.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor, needsSharedDisk) {
+			candidates = append(candidates, thisServer)
+			sids[thisServer] = sid
+		}
+	}
+	s.config.Packing.orderServers(candidates, req)
+	preferZone(candidates, req)
+
+	var server *cloud.Server
+	for _, thisServer := range candidates {
+		if thisServer.Allocate(req.Cores, req.RAM, req.Disk) {
 			server = thisServer
+			sid := sids[server]
 
 			// *** reservedCh is buffered and sending on it should never
 			// block, but somehow we have gotten stuck here before; make
@@ -1227,11 +1329,25 @@ func (s *opst) stateUpdate() {
 						s.notifyBadServer(server)
 						s.Debug("server became good", "server", server.ID)
 					}
+				} else if !alive {
+					if server.PermanentProblem() == "" && server.Preempted() {
+						server.GoneBad(cloud.PreemptedProblem)
+					}
+
+					// tell them again, so that they can act on the number
+					// of FailedProbes()
+					s.notifyBadServer(server)
 				}
 			} else if !alive {
-				server.GoneBad()
+				// a preempted server will never work again, so treat that
+				// as a permanent problem
+				if server.Preempted() {
+					server.GoneBad(cloud.PreemptedProblem)
+				} else {
+					server.GoneBad()
+				}
 				s.notifyBadServer(server)
-				s.Debug("server went bad", "server", server.ID)
+				s.Debug("server went bad", "server", server.ID, "problem", server.PermanentProblem())
 			}
 		}
 
@@ -1246,7 +1362,7 @@ func (s *opst) stateUpdate() {
 func (s *opst) postProcess() {
 	s.serversMutex.Lock()
 	for _, server := range s.servers {
-		if server.Name != localhostName && !server.Used() {
+		if server.Name != localhostName && !server.Used() && !server.Draining() {
 			s.Debug("placing unused server on deathrow", "server", server.ID)
 			server.Allocate(0, 1, 1)
 			server.Release(0, 1, 1)
@@ -1358,6 +1474,49 @@ func (s *opst) hostToID(host string) string {
 	return server.ID
 }
 
+// hostGone asks the provider if the server with the given id is still working.
+// Errors talking to the provider are not taken to mean that it's gone.
+func (s *opst) hostGone(id string) bool {
+	if id == "" {
+		return false
+	}
+	working, err := s.provider.CheckServer(id)
+	return err == nil && !working
+}
+
+// runCmdOnHost runs the given cmd over ssh on the server with the given host
+// name, if we spawned or recovered it, or else locally if the host is the one
+// we're running on.
+func (s *opst) runCmdOnHost(ctx context.Context, host, cmd string) (string, error) {
+	server := s.provider.GetServerByName(host)
+	if server == nil {
+		return s.local.runCmdOnHost(ctx, host, cmd)
+	}
+	stdout, _, err := server.RunCmd(ctx, cmd, false)
+	return stdout, err
+}
+
+// hosts returns details of the servers we have spawned or recovered, including
+// the head node we're running on, but excluding any excluded servers.
+func (s *opst) hosts() []*Host {
+	s.serversMutex.RLock()
+	defer s.serversMutex.RUnlock()
+	hosts := make([]*Host, 0, len(s.servers))
+	for _, server := range s.servers {
+		if s.isExcluded(server.Name) {
+			continue
+		}
+		host := &Host{ID: server.ID, Name: server.Name, Disk: server.Disk}
+		if server.Flavor != nil {
+			host.Flavor = server.Flavor.Name
+			host.Cores = float64(server.Flavor.Cores)
+			host.RAM = server.Flavor.RAM
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
 // setMessageCallBack sets the given callback.
 func (s *opst) setMessageCallBack(cb MessageCallBack) {
 	s.cbmutex.Lock()
@@ -1365,13 +1524,13 @@ func (s *opst) setMessageCallBack(cb MessageCallBack) {
 	s.msgCB = cb
 }
 
-// notifyMessage calls the message callback with the given message in a
-// goroutine, if that callback has been set.
-func (s *opst) notifyMessage(msg string) {
+// notifyMessage calls the message callback with the given message and severity
+// in a goroutine, if that callback has been set.
+func (s *opst) notifyMessage(msg string, severity MessageSeverity) {
 	s.cbmutex.RLock()
 	defer s.cbmutex.RUnlock()
 	if s.msgCB != nil {
-		go s.msgCB(msg)
+		go s.msgCB(msg, severity)
 	}
 }
 
@@ -1382,6 +1541,30 @@ func (s *opst) setBadServerCallBack(cb BadServerCallBack) {
 	s.badServerCB = cb
 }
 
+// setDemandCallBack sets the given callback.
+func (s *opst) setDemandCallBack(cb DemandCallBack) {
+	s.cbmutex.Lock()
+	defer s.cbmutex.Unlock()
+	s.demandCB = cb
+}
+
+// setDrainCallBack sets the given callback.
+func (s *opst) setDrainCallBack(cb DrainCallBack) {
+	s.cbmutex.Lock()
+	defer s.cbmutex.Unlock()
+	s.drainCB = cb
+}
+
+// notifyDrain calls the drain callback with the given server in a goroutine,
+// if that callback has been set.
+func (s *opst) notifyDrain(server *cloud.Server) {
+	s.cbmutex.RLock()
+	defer s.cbmutex.RUnlock()
+	if s.drainCB != nil {
+		go s.drainCB(server)
+	}
+}
+
 // notifyBadServer calls the bad server callback with the given server in a
 // goroutine, if that callback has been set.
 func (s *opst) notifyBadServer(server *cloud.Server) {
@@ -1426,6 +1609,7 @@ func (s *opst) cleanup() {
 	// bring down all our servers
 	s.serversMutex.Lock()
 	close(s.stopRSMonitoring)
+	close(s.stopScaleDown)
 	for id, server := range s.spawnedServers {
 		s.servers[id] = server
 		delete(s.spawnedServers, id)
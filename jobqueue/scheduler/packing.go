@@ -0,0 +1,152 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains the code for choosing which host a cmd should run on when
+// more than one of them has space for it.
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+)
+
+// PackingStrategy describes how cmds are packed on to the hosts that have
+// space for them.
+type PackingStrategy string
+
+// Packing* are the available PackingStrategys.
+//
+// PackingAny (the default) runs a cmd on any host with space for it, in no
+// particular order.
+//
+// PackingBestFit runs a cmd on the host that would have the least memory left
+// over afterwards, so that hosts with lots of free memory are saved for cmds
+// that need it. For the local scheduler, it also makes cmds of equal priority
+// get run in order of the memory they need, largest first, instead of by their
+// largest share of either memory or cores.
+//
+// PackingSpread runs a cmd on the least loaded host (by the larger of the
+// proportions of its cores and memory in use), spreading load evenly.
+//
+// PackingFill runs a cmd on the most loaded host that still has space for it,
+// filling one host before using the next, so that unused hosts can become idle
+// and be scaled down.
+const (
+	PackingAny     PackingStrategy = ""
+	PackingBestFit PackingStrategy = "bestfit"
+	PackingSpread  PackingStrategy = "spread"
+	PackingFill    PackingStrategy = "fill"
+)
+
+// ParsePackingStrategy converts the given string to a PackingStrategy,
+// returning an error if it isn't one of the Packing* values. "any" is also
+// accepted for PackingAny.
+func ParsePackingStrategy(strategy string) (PackingStrategy, error) {
+	switch p := PackingStrategy(strategy); p {
+	case PackingAny, PackingBestFit, PackingSpread, PackingFill:
+		return p, nil
+	case "any":
+		return PackingAny, nil
+	}
+	return PackingAny, fmt.Errorf("unknown packing strategy '%s'", strategy)
+}
+
+// hostLoad describes the capacity and current usage of a host.
+type hostLoad struct {
+	cores     float64
+	usedCores float64
+	ram       int
+	usedRAM   int
+}
+
+// load returns the larger of the proportions of cores and memory in use.
+func (h hostLoad) load() float64 {
+	var coreLoad, ramLoad float64
+	if h.cores > 0 {
+		coreLoad = h.usedCores / h.cores
+	}
+	if h.ram > 0 {
+		ramLoad = float64(h.usedRAM) / float64(h.ram)
+	}
+	if coreLoad > ramLoad {
+		return coreLoad
+	}
+	return ramLoad
+}
+
+// score returns how suitable the host is for a cmd needing the given memory
+// under this strategy; lower is better.
+func (p PackingStrategy) score(h hostLoad, ramMB int) float64 {
+	switch p {
+	case PackingBestFit:
+		return float64(h.ram - h.usedRAM - ramMB)
+	case PackingSpread:
+		return h.load()
+	case PackingFill:
+		return -h.load()
+	}
+	return 0
+}
+
+// ReqZone is the key of the Requirements.Other value that names the
+// availability zone a cmd would prefer to run in, eg. because that is where
+// its input data is. Cloud schedulers try existing servers in that zone first,
+// and spawn new servers for it in that zone.
+const ReqZone = "cloud_zone"
+
+// preferZone stably moves those of the given servers that are in the zone
+// requested by req's Other[ReqZone] (if any) to the front.
+func preferZone(servers []*cloud.Server, req *Requirements) {
+	zone := req.Other[ReqZone]
+	if zone == "" || len(servers) < 2 {
+		return
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].Zone == zone && servers[j].Zone != zone
+	})
+}
+
+// orderServers sorts the given servers so that the one most suitable for a cmd
+// with the given Requirements under this strategy comes first. With PackingAny
+// the order is left untouched.
+func (p PackingStrategy) orderServers(servers []*cloud.Server, req *Requirements) {
+	if p == PackingAny || len(servers) < 2 {
+		return
+	}
+
+	scores := make(map[*cloud.Server]float64, len(servers))
+	for _, server := range servers {
+		usedCores, usedRAM, _ := server.Usage()
+		scores[server] = p.score(hostLoad{
+			cores:     float64(server.Flavor.Cores),
+			usedCores: usedCores,
+			ram:       server.Flavor.RAM,
+			usedRAM:   usedRAM,
+		}, req.RAM)
+	}
+
+	sort.SliceStable(servers, func(i, j int) bool {
+		if scores[servers[i]] == scores[servers[j]] {
+			return servers[i].Name < servers[j].Name
+		}
+		return scores[servers[i]] < scores[servers[j]]
+	})
+}
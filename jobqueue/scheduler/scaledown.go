@@ -0,0 +1,410 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains the code for scaling down cloud servers based on the
+// demand we predict for them.
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// ScaleDownPolicy describes how a cloud scheduler should decide which of its
+// servers to get rid of, beyond destroying servers that have been idle for
+// ServerKeepTime. Periodically, the cmds still waiting to run and the Demand
+// reported by the DemandCallBack are packed on to existing servers; servers
+// that aren't needed for any of it are drained (no new cmds are run on them)
+// and destroyed once they are idle, those with the largest flavors first, so
+// that the most quota is freed up.
+type ScaleDownPolicy struct {
+	// Interval is how often to consider scaling down. The default of 0 is
+	// treated as the scheduler's StateUpdateFrequency.
+	Interval time.Duration
+
+	// Horizon is how far in to the future the DemandCallBack should predict
+	// demand. The default of 0 is treated as 10 minutes.
+	Horizon time.Duration
+
+	// KeepIdle is the number of idle servers that aren't needed to keep
+	// anyway (the ones with the smallest flavors), so that new cmds can start
+	// quickly.
+	KeepIdle int
+
+	// MaxDestroys is the maximum number of servers to destroy each Interval.
+	// The default of 0 means unlimited.
+	MaxDestroys int
+}
+
+// interval returns our Interval, or the given default if not set.
+func (p *ScaleDownPolicy) interval(def time.Duration) time.Duration {
+	if p.Interval > 0 {
+		return p.Interval
+	}
+	return def
+}
+
+// horizon returns our Horizon with the default applied.
+func (p *ScaleDownPolicy) horizon() time.Duration {
+	if p.Horizon > 0 {
+		return p.Horizon
+	}
+	return 10 * time.Minute
+}
+
+// serverDemand is a number of cmds with the given resource requirements that
+// could run on servers that match().
+type serverDemand struct {
+	cores float64
+	ram   int
+	disk  int
+	count int
+	match func(server *cloud.Server) bool
+}
+
+// scaleDownSim tracks the space left on a server while we pretend to run
+// serverDemands on it.
+type scaleDownSim struct {
+	server    *cloud.Server
+	freeCores float64
+	freeRAM   int
+	freeDisk  int
+	idle      bool
+	draining  bool
+}
+
+// fit returns how many of the given demand could run on the server.
+func (sim *scaleDownSim) fit(d *serverDemand) int {
+	n := d.count
+	if d.cores > 0 {
+		n = minInt(n, int(math.Floor(sim.freeCores/d.cores)))
+	}
+	if d.ram > 0 {
+		n = minInt(n, sim.freeRAM/d.ram)
+	}
+	if d.disk > 0 {
+		n = minInt(n, sim.freeDisk/d.disk)
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// take uses up space on the server for n of the given demand.
+func (sim *scaleDownSim) take(d *serverDemand, n int) {
+	sim.freeCores = internal.FloatSubtract(sim.freeCores, d.cores*float64(n))
+	sim.freeRAM -= d.ram * n
+	sim.freeDisk -= d.disk * n
+}
+
+// scaleDownPlan is what planScaleDown() decides should happen to servers.
+type scaleDownPlan struct {
+	undrain []*cloud.Server // draining servers that are needed again
+	drain   []*cloud.Server // busy servers that aren't needed
+	destroy []*cloud.Server // idle servers that aren't needed
+}
+
+// planScaleDown packs the given demands on to the given servers, and works out
+// which of the servers aren't needed. Servers already running something are
+// used first, followed by idle ones with the smallest flavors, so that the
+// servers freed up are the largest.
+func planScaleDown(servers []*cloud.Server, demands []*serverDemand, policy *ScaleDownPolicy) *scaleDownPlan {
+	sims := make([]*scaleDownSim, len(servers))
+	for i, server := range servers {
+		cores, ram, disk := server.Usage()
+		sims[i] = &scaleDownSim{
+			server:    server,
+			freeCores: internal.FloatSubtract(float64(server.Flavor.Cores), cores),
+			freeRAM:   server.Flavor.RAM - ram,
+			freeDisk:  server.Disk - disk,
+			idle:      server.Idle(),
+			draining:  server.Draining(),
+		}
+	}
+
+	placement := make([]*scaleDownSim, len(sims))
+	copy(placement, sims)
+	sort.SliceStable(placement, func(i, j int) bool {
+		a, b := placement[i], placement[j]
+		if a.idle != b.idle {
+			return !a.idle
+		}
+		if a.draining != b.draining {
+			return !a.draining
+		}
+		return flavorLess(a.server.Flavor, b.server.Flavor)
+	})
+
+	sort.SliceStable(demands, func(i, j int) bool {
+		if demands[i].cores != demands[j].cores {
+			return demands[i].cores > demands[j].cores
+		}
+		return demands[i].ram > demands[j].ram
+	})
+
+	needed := make(map[*cloud.Server]bool)
+	for _, d := range demands {
+		for _, sim := range placement {
+			if d.count <= 0 {
+				break
+			}
+			if !d.match(sim.server) {
+				continue
+			}
+			n := sim.fit(d)
+			if n <= 0 {
+				continue
+			}
+			sim.take(d, n)
+			d.count -= n
+			needed[sim.server] = true
+		}
+	}
+
+	// the servers we don't need are considered largest first, keeping the
+	// smallest idle ones if desired
+	var unneeded []*scaleDownSim
+	for _, sim := range sims {
+		if !needed[sim.server] {
+			unneeded = append(unneeded, sim)
+		}
+	}
+	sort.SliceStable(unneeded, func(i, j int) bool {
+		return flavorLess(unneeded[j].server.Flavor, unneeded[i].server.Flavor)
+	})
+	keep := policy.KeepIdle
+	for i := len(unneeded) - 1; i >= 0 && keep > 0; i-- {
+		if unneeded[i].idle {
+			needed[unneeded[i].server] = true
+			keep--
+		}
+	}
+
+	plan := &scaleDownPlan{}
+	destroys := 0
+	for _, sim := range unneeded {
+		switch {
+		case needed[sim.server]:
+			continue
+		case sim.idle && (policy.MaxDestroys <= 0 || destroys < policy.MaxDestroys):
+			plan.destroy = append(plan.destroy, sim.server)
+			destroys++
+		case !sim.idle && !sim.draining:
+			plan.drain = append(plan.drain, sim.server)
+		}
+	}
+	for _, sim := range sims {
+		if sim.draining && needed[sim.server] {
+			plan.undrain = append(plan.undrain, sim.server)
+		}
+	}
+	return plan
+}
+
+// flavorLess says if flavor a frees up less quota than flavor b when a server
+// of that flavor is destroyed.
+func flavorLess(a, b *cloud.Flavor) bool {
+	if a.Cores != b.Cores {
+		return a.Cores < b.Cores
+	}
+	if a.RAM != b.RAM {
+		return a.RAM < b.RAM
+	}
+	return a.Disk < b.Disk
+}
+
+// minInt returns the smaller of the given ints.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// scaleDownPeriodically calls scaleDown() every ScaleDown.Interval, until
+// cleanup() is called.
+func (s *opst) scaleDownPeriodically() {
+	defer internal.LogPanic(s.Logger, "scaleDownPeriodically", true)
+
+	ticker := time.NewTicker(s.config.ScaleDown.interval(s.stateUpdateFreq))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.scaleDown()
+		case <-s.stopScaleDown:
+			return
+		}
+	}
+}
+
+// scaleDown drains, destroys and undrains servers as decided by
+// planScaleDown(), given the cmds we've yet to run and the demand predicted by
+// our DemandCallBack.
+func (s *opst) scaleDown() {
+	if s.cleanedUp() {
+		return
+	}
+
+	demands := s.queuedDemand()
+	s.cbmutex.RLock()
+	demandCB := s.demandCB
+	s.cbmutex.RUnlock()
+	if demandCB != nil {
+		for _, d := range demandCB(s.config.ScaleDown.horizon()) {
+			if sd := s.serverDemand(d.Req, d.Count); sd != nil {
+				demands = append(demands, sd)
+			}
+		}
+	}
+
+	s.serversMutex.RLock()
+	servers := make([]*cloud.Server, 0, len(s.servers))
+	for _, server := range s.servers {
+		if server.Name == localhostName || server.IsBad() || server.Destroyed() {
+			continue
+		}
+		servers = append(servers, server)
+	}
+	s.serversMutex.RUnlock()
+
+	plan := planScaleDown(servers, demands, s.config.ScaleDown)
+
+	for _, server := range plan.undrain {
+		if server.Undrain() {
+			s.Debug("server undrained since it is needed again", "server", server.ID)
+			s.notifyDrain(server)
+		}
+	}
+
+	for _, server := range plan.drain {
+		if server.Drain() {
+			s.Debug("server draining since it isn't needed", "server", server.ID, "flavor", server.Flavor.Name)
+			s.notifyDrain(server)
+		}
+	}
+
+	for _, server := range plan.destroy {
+		// draining first means nothing can be allocated on the server while
+		// we destroy it
+		drained := server.Drain()
+		if !server.Idle() {
+			if drained {
+				s.notifyDrain(server)
+			}
+			continue
+		}
+		err := server.Destroy()
+		if err != nil {
+			s.Warn("scale down server destruction failed", "server", server.ID, "err", err)
+			continue
+		}
+		s.Debug("server destroyed since it isn't needed", "server", server.ID, "flavor", server.Flavor.Name)
+		s.notifyDrain(server)
+	}
+}
+
+// queuedDemand returns serverDemands for the cmds in our queue that we've not
+// yet started running.
+func (s *opst) queuedDemand() []*serverDemand {
+	var demands []*serverDemand
+	for _, item := range s.queue.AllItems() {
+		j, ok := item.Data().(*job)
+		if !ok {
+			continue
+		}
+		j.RLock()
+		req, count := j.req, j.count
+		j.RUnlock()
+
+		s.runMutex.RLock()
+		count -= s.running[item.Key]
+		s.runMutex.RUnlock()
+
+		if sd := s.serverDemand(req, count); sd != nil {
+			demands = append(demands, sd)
+		}
+	}
+	return demands
+}
+
+// serverDemand converts the given count of cmds with the given requirements in
+// to a serverDemand. Returns nil if count isn't positive or the requirements
+// are unusable.
+func (s *opst) serverDemand(req *Requirements, count int) *serverDemand {
+	if count <= 0 || req == nil {
+		return nil
+	}
+	requestedOS, requestedScript, requestedConfigFiles, requestedFlavor, needsSharedDisk, err := s.serverReqs(req)
+	if err != nil {
+		s.Warn("Failed to determine server requirements", "err", err)
+		return nil
+	}
+	return &serverDemand{
+		cores: req.Cores,
+		ram:   req.RAM,
+		disk:  req.Disk,
+		count: count,
+		match: func(server *cloud.Server) bool {
+			return s.hostUsable(server.Name, req) && server.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor, needsSharedDisk)
+		},
+	}
+}
+
+// undrainFor undrains draining servers that have space for the given cmd, up
+// to desired many of them, returning how many of the cmd they could run.
+func (s *opst) undrainFor(desired int, req *Requirements) int {
+	sd := s.serverDemand(req, desired)
+	if sd == nil {
+		return 0
+	}
+
+	var draining []*cloud.Server
+	s.serversMutex.RLock()
+	for _, server := range s.servers {
+		if server.Draining() && !server.IsBad() && !server.Destroyed() && sd.match(server) {
+			draining = append(draining, server)
+		}
+	}
+	s.serversMutex.RUnlock()
+
+	var undrained int
+	for _, server := range draining {
+		if undrained >= desired {
+			break
+		}
+		if !server.Undrain() {
+			continue
+		}
+		space := server.HasSpaceFor(req.Cores, req.RAM, req.Disk)
+		if space <= 0 {
+			server.Drain()
+			continue
+		}
+		undrained += space
+		s.Debug("server undrained for a cmd", "server", server.ID)
+		s.notifyDrain(server)
+	}
+	return undrained
+}
@@ -40,6 +40,7 @@ must add a case for it to New() and rebuild.
 package scheduler
 
 import (
+	"context"
 	"crypto/md5" // #nosec - not used for cryptographic purposes here
 	"fmt"
 	"sort"
@@ -66,6 +67,7 @@ var (
 	ErrBadScheduler = "unknown scheduler name"
 	ErrImpossible   = "scheduler cannot accept the job, since its resource requirements are too high"
 	ErrBadFlavor    = "unknown server flavor"
+	ErrNoHostAccess = "cannot run commands on that host"
 )
 
 // Error records an error and the operation and scheduler that caused it.
@@ -148,20 +150,62 @@ type CmdStatus struct {
 	Other   [][2]int // ditto, for jobs in some strange state
 }
 
+// MessageSeverity describes how important a message given to a MessageCallBack
+// is.
+type MessageSeverity string
+
+// MessageSeverity* are the severities a MessageCallBack's message can have.
+// MessageInfo is for things users might like to know about, MessageWarning for
+// conditions that delay jobs but that might resolve themselves (like running
+// out of quota), and MessageError for conditions that will stop jobs from ever
+// running without user intervention.
+const (
+	MessageInfo    MessageSeverity = "info"
+	MessageWarning MessageSeverity = "warning"
+	MessageError   MessageSeverity = "error"
+)
+
 // MessageCallBack functions receive a message that would be good to display to
 // end users, so they understand current error conditions related to the
-// scheduler.
-type MessageCallBack func(msg string)
+// scheduler, along with how severe the condition is.
+type MessageCallBack func(msg string, severity MessageSeverity)
 
 // BadServerCallBack functions receive a server when a cloud scheduler discovers
 // that a server it spawned no longer seems functional. It's possible that this
 // was due to a temporary networking issue, in which case the callback will be
 // called again with the same server when it is working fine again: check
-// server.IsBad(). If it's bad, you'd probably call server.Destroy() after
-// confirming the server is definitely unusable (eg. ask the end user to
-// manually check).
+// server.IsBad(). It may also be called again each time a bad server is found
+// to still not be working, so you can check server.FailedProbes(). If it's bad,
+// you'd probably call server.Destroy() after confirming the server is
+// definitely unusable (eg. ask the end user to manually check).
 type BadServerCallBack func(server *cloud.Server)
 
+// Demand describes a number of cmds with the given requirements that are
+// expected to need running soon.
+type Demand struct {
+	Req   *Requirements
+	Count int
+}
+
+// DemandCallBack functions are asked by cloud schedulers with a ScaleDownPolicy
+// for the cmds that aren't scheduled yet, but that are expected to need running
+// within the given horizon (eg. because the things they depend on will soon
+// finish), so that the servers that could run them aren't destroyed.
+type DemandCallBack func(horizon time.Duration) []*Demand
+
+// DrainCallBack functions receive a server when a cloud scheduler with a
+// ScaleDownPolicy starts draining it (it will not be used to run any more
+// cmds), stops draining it because it is needed again, or destroys it: check
+// server.Draining() and server.Destroyed().
+type DrainCallBack func(server *cloud.Server)
+
+// HostCheckCallBack functions are asked if a cmd with the given requirements
+// may run on the host with the given name right now (host is blank when asking
+// about a new server a cloud scheduler could spawn). They let you honour
+// constraints the scheduler knows nothing about, such as which other cmds are
+// running on the host. They must be fast, and must not call Scheduler methods.
+type HostCheckCallBack func(host string, req *Requirements) bool
+
 // RecoveredHostDetails lets you describe a host for supplying to Recover(). Not
 // all fields are relevant for all schedulers. Some might use none, so a nil
 // RecoveredHostDetails might be valid. Cloud schedulers need all fields
@@ -172,6 +216,17 @@ type RecoveredHostDetails struct {
 	TTD      time.Duration // frequency to check if the host is idle, and if so destroy it
 }
 
+// Host describes a machine that a job scheduler currently knows it can run
+// cmds on, as returned by Hosts().
+type Host struct {
+	ID     string // cloud server id, if applicable
+	Name   string
+	Flavor string // cloud flavor name, if applicable
+	Cores  float64
+	RAM    int // MB
+	Disk   int // GB; 0 if unknown
+}
+
 // scheduleri interface must be satisfied to add support for a particular job
 // scheduler.
 type scheduleri interface {
@@ -182,8 +237,15 @@ type scheduleri interface {
 	reserveTimeout(req *Requirements) int                                    // achieve the aims of ReserveTimeout()
 	maxQueueTime(req *Requirements) time.Duration                            // achieve the aims of MaxQueueTime(), return 0 for infinite queue time
 	hostToID(host string) string                                             // achieve the aims of HostToID()
+	hostGone(id string) bool                                                 // achieve the aims of HostGone()
+	hosts() []*Host                                                          // achieve the aims of Hosts()
+	runCmdOnHost(ctx context.Context, host, cmd string) (string, error)      // achieve the aims of RunCmdOnHost()
+	excludeHosts(hosts map[string]bool)                                      // achieve the aims of ExcludeHosts()
 	setMessageCallBack(MessageCallBack)                                      // achieve the aims of SetMessageCallBack()
 	setBadServerCallBack(BadServerCallBack)                                  // achieve the aims of SetBadServerCallBack()
+	setHostCheckCallBack(HostCheckCallBack)                                  // achieve the aims of SetHostCheckCallBack()
+	setDemandCallBack(DemandCallBack)                                        // achieve the aims of SetDemandCallBack()
+	setDrainCallBack(DrainCallBack)                                          // achieve the aims of SetDrainCallBack()
 	cleanup()                                                                // do any clean up once you've finished using the job scheduler
 }
 
@@ -215,9 +277,10 @@ type Scheduler struct {
 }
 
 // New creates a new Scheduler to interact with the given job scheduler.
-// Possible names so far are "lsf", "local", "openstack" and "kubernetes". You
-// must also provide a config struct appropriate for your chosen scheduler, eg.
-// for the local scheduler you will provide a ConfigLocal.
+// Possible names so far are "lsf", "local", "openstack", "gcp", "aws" and
+// "kubernetes". You must also provide a config struct appropriate for your
+// chosen scheduler, eg. for the local scheduler you will provide a ConfigLocal.
+// ("gcp" and "aws" take a ConfigOpenStack, with Provider set to their name.)
 //
 // Providing a logger allows for debug messages to be logged somewhere, along
 // with any "harmless" or unreturnable errors. If not supplied, we use a default
@@ -229,7 +292,7 @@ func New(name string, config interface{}, logger ...log15.Logger) (*Scheduler, e
 		s = &Scheduler{impl: new(lsf)}
 	case "local":
 		s = &Scheduler{impl: new(local)}
-	case "openstack":
+	case "openstack", "gcp", "aws":
 		s = &Scheduler{impl: new(opst)}
 	case "kubernetes":
 		s = &Scheduler{impl: new(k8s)}
@@ -267,6 +330,29 @@ func (s *Scheduler) SetBadServerCallBack(cb BadServerCallBack) {
 	s.impl.setBadServerCallBack(cb)
 }
 
+// SetHostCheckCallBack sets the function that will be asked if cmds may run on
+// a particular host, in addition to the scheduler's own checks of capacity and
+// excluded hosts. Only honoured by schedulers that decide which host a cmd runs
+// on (local and openstack).
+func (s *Scheduler) SetHostCheckCallBack(cb HostCheckCallBack) {
+	s.impl.setHostCheckCallBack(cb)
+}
+
+// SetDemandCallBack sets the function that will be asked about cmds that will
+// need running soon, so that servers able to run them aren't scaled down. Only
+// relevant for cloud schedulers configured with a ScaleDownPolicy.
+func (s *Scheduler) SetDemandCallBack(cb DemandCallBack) {
+	s.impl.setDemandCallBack(cb)
+}
+
+// SetDrainCallBack sets the function that will be called when a cloud
+// scheduler starts or stops draining one of its servers, or destroys a server
+// it drained. Only relevant for cloud schedulers configured with a
+// ScaleDownPolicy.
+func (s *Scheduler) SetDrainCallBack(cb DrainCallBack) {
+	s.impl.setDrainCallBack(cb)
+}
+
 // Schedule gets your cmd scheduled in the job scheduler. You give it a command
 // that you would like `count` identical instances of running via your job
 // scheduler. If you already had `count` many scheduled, it will do nothing. If
@@ -369,6 +455,44 @@ func (s *Scheduler) HostToID(host string) string {
 	return s.impl.hostToID(host)
 }
 
+// HostGone tells you if the cloud provider reports that the server with the
+// given id (as returned by HostToID()) no longer exists or isn't working. For
+// schedulers that are not cloud based, this always returns false.
+func (s *Scheduler) HostGone(id string) bool {
+	return s.impl.hostGone(id)
+}
+
+// Hosts tells you about the machines the job scheduler currently knows it can
+// run cmds on, along with their capacity. For schedulers that do not manage
+// their own hosts (eg. LSF), this returns nil.
+func (s *Scheduler) Hosts() []*Host {
+	return s.impl.hosts()
+}
+
+// RunCmdOnHost runs the given shell command on the host with the given name,
+// returning its STDOUT, eg. so you can find out what happened on a host where
+// a cmd stopped responding. Only hosts we have direct access to are
+// supported: the local machine, and, for cloud schedulers, servers we have
+// spawned. Other hosts (and all hosts of schedulers like LSF that manage their
+// own) result in an Error with Err ErrNoHostAccess.
+func (s *Scheduler) RunCmdOnHost(ctx context.Context, host, cmd string) (string, error) {
+	return s.impl.runCmdOnHost(ctx, host, cmd)
+}
+
+// ExcludeHosts tells the job scheduler not to run cmds on the hosts with the
+// given names from now on, replacing any previous exclusions; pass nothing to
+// stop excluding hosts. The capacity of excluded hosts is not counted when
+// working out how many cmds can run, and they are not returned by Hosts(). Cmds
+// already running on them are not affected. This has no effect for the
+// kubernetes scheduler.
+func (s *Scheduler) ExcludeHosts(hosts ...string) {
+	excluded := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		excluded[host] = true
+	}
+	s.impl.excludeHosts(excluded)
+}
+
 // Cleanup means you've finished using a scheduler and it can delete any
 // remaining jobs in its system and clean up any other used resources.
 func (s *Scheduler) Cleanup() {
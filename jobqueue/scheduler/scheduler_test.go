@@ -36,6 +36,7 @@ import (
 
 	sync "github.com/sasha-s/go-deadlock"
 
+	"github.com/VertebrateResequencing/wr/cloud"
 	"github.com/inconshreveable/log15"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -54,7 +55,7 @@ func TestLocal(t *testing.T) {
 
 	var overhead time.Duration
 	Convey("You can get a new local scheduler", t, func() {
-		s, err := New("local", &ConfigLocal{"bash", 1 * time.Second, 0, 0}, testLogger)
+		s, err := New("local", &ConfigLocal{"bash", 1 * time.Second, 0, 0, PackingAny}, testLogger)
 		So(err, ShouldBeNil)
 		So(s, ShouldNotBeNil)
 
@@ -73,6 +74,47 @@ func TestLocal(t *testing.T) {
 			So(s.Busy(), ShouldBeFalse)
 		})
 
+		Convey("Hosts() describes the local machine", func() {
+			hosts := s.Hosts()
+			So(len(hosts), ShouldEqual, 1)
+			So(hosts[0].Name, ShouldNotBeBlank)
+			So(hosts[0].Cores, ShouldEqual, maxCPU)
+			So(hosts[0].RAM, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("ExcludeHosts() stops the local machine being used", func() {
+			name := s.Hosts()[0].Name
+			So(s.impl.(*local).canCount("foo", possibleReq, ""), ShouldBeGreaterThan, 0)
+
+			s.ExcludeHosts("other", name)
+			So(s.Hosts(), ShouldBeEmpty)
+			So(s.impl.(*local).canCount("foo", possibleReq, ""), ShouldEqual, 0)
+
+			s.ExcludeHosts("other")
+			So(len(s.Hosts()), ShouldEqual, 1)
+			So(s.impl.(*local).canCount("foo", possibleReq, ""), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("SetHostCheckCallBack() lets you stop the local machine being used", func() {
+			name := s.Hosts()[0].Name
+			var askedHost string
+			var askedReq *Requirements
+			allow := false
+			s.SetHostCheckCallBack(func(host string, req *Requirements) bool {
+				askedHost = host
+				askedReq = req
+				return allow
+			})
+			defer s.SetHostCheckCallBack(nil)
+
+			So(s.impl.(*local).canCount("foo", possibleReq, ""), ShouldEqual, 0)
+			So(askedHost, ShouldEqual, name)
+			So(askedReq, ShouldEqual, possibleReq)
+
+			allow = true
+			So(s.impl.(*local).canCount("foo", possibleReq, ""), ShouldBeGreaterThan, 0)
+		})
+
 		Convey("Requirements.Stringify() works", func() {
 			So(possibleReq.Stringify(), ShouldEqual, "1:0:1:20")
 			testReq := &Requirements{RAM: 300, Time: 2 * time.Hour, Cores: 2}
@@ -386,7 +428,7 @@ func TestLocal(t *testing.T) {
 
 	if maxCPU > 1 {
 		Convey("You can get a new local scheduler that uses less than all CPUs", t, func() {
-			s, err := New("local", &ConfigLocal{"bash", 1 * time.Second, 1, 0}, testLogger)
+			s, err := New("local", &ConfigLocal{"bash", 1 * time.Second, 1, 0, PackingAny}, testLogger)
 			So(err, ShouldBeNil)
 			So(s, ShouldNotBeNil)
 
@@ -422,6 +464,96 @@ func TestLocal(t *testing.T) {
 	}
 }
 
+func TestPacking(t *testing.T) {
+	Convey("You can parse packing strategies", t, func() {
+		for _, str := range []string{"", "any", "bestfit", "spread", "fill"} {
+			_, err := ParsePackingStrategy(str)
+			So(err, ShouldBeNil)
+		}
+		p, err := ParsePackingStrategy("any")
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, PackingAny)
+		_, err = ParsePackingStrategy("foo")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Packing strategies prefer the right hosts", t, func() {
+		empty := hostLoad{cores: 16, ram: 64000}
+		half := hostLoad{cores: 16, usedCores: 8, ram: 64000, usedRAM: 1000}
+		small := hostLoad{cores: 2, ram: 4000}
+		ram := 2000
+
+		So(PackingAny.score(empty, ram), ShouldEqual, PackingAny.score(half, ram))
+
+		So(PackingBestFit.score(small, ram), ShouldBeLessThan, PackingBestFit.score(half, ram))
+		So(PackingBestFit.score(half, ram), ShouldBeLessThan, PackingBestFit.score(empty, ram))
+
+		So(PackingSpread.score(empty, ram), ShouldBeLessThan, PackingSpread.score(half, ram))
+		So(PackingSpread.score(empty, ram), ShouldEqual, PackingSpread.score(small, ram))
+
+		So(PackingFill.score(half, ram), ShouldBeLessThan, PackingFill.score(empty, ram))
+		So(half.load(), ShouldEqual, 0.5)
+	})
+
+	Convey("Servers in a requested zone are preferred", t, func() {
+		a := &cloud.Server{Name: "a", Zone: "nova-a"}
+		b := &cloud.Server{Name: "b", Zone: "nova-b"}
+		c := &cloud.Server{Name: "c"}
+		d := &cloud.Server{Name: "d", Zone: "nova-b"}
+
+		servers := []*cloud.Server{a, b, c, d}
+		preferZone(servers, &Requirements{})
+		So(servers, ShouldResemble, []*cloud.Server{a, b, c, d})
+
+		preferZone(servers, &Requirements{Other: map[string]string{ReqZone: "nova-b"}})
+		So(servers, ShouldResemble, []*cloud.Server{b, d, a, c})
+
+		preferZone(servers, &Requirements{Other: map[string]string{ReqZone: "nova-c"}})
+		So(servers, ShouldResemble, []*cloud.Server{b, d, a, c})
+	})
+
+	Convey("Scale down plans keep the servers needed for demand and destroy the largest others first", t, func() {
+		small := &cloud.Flavor{Name: "small", Cores: 2, RAM: 4000, Disk: 10}
+		medium := &cloud.Flavor{Name: "medium", Cores: 8, RAM: 16000, Disk: 10}
+		large := &cloud.Flavor{Name: "large", Cores: 16, RAM: 64000, Disk: 10}
+		s1 := &cloud.Server{ID: "s1", Flavor: small, Disk: 10}
+		s2 := &cloud.Server{ID: "s2", Flavor: small, Disk: 10}
+		m1 := &cloud.Server{ID: "m1", Flavor: medium, Disk: 10}
+		l1 := &cloud.Server{ID: "l1", Flavor: large, Disk: 10}
+		servers := []*cloud.Server{l1, s1, m1, s2}
+		anyServer := func(server *cloud.Server) bool { return true }
+
+		plan := planScaleDown(servers, nil, &ScaleDownPolicy{})
+		So(plan.destroy, ShouldResemble, []*cloud.Server{l1, m1, s1, s2})
+		So(plan.drain, ShouldBeEmpty)
+		So(plan.undrain, ShouldBeEmpty)
+
+		demands := []*serverDemand{{cores: 1, ram: 1000, count: 3, match: anyServer}}
+		plan = planScaleDown(servers, demands, &ScaleDownPolicy{})
+		So(plan.destroy, ShouldResemble, []*cloud.Server{l1, m1})
+
+		demands = []*serverDemand{{cores: 4, ram: 1000, count: 1, match: anyServer}}
+		plan = planScaleDown(servers, demands, &ScaleDownPolicy{KeepIdle: 1, MaxDestroys: 1})
+		So(plan.destroy, ShouldResemble, []*cloud.Server{l1})
+
+		onlyLarge := func(server *cloud.Server) bool { return server.Flavor == large }
+		demands = []*serverDemand{{cores: 1, ram: 1000, count: 1, match: onlyLarge}}
+		plan = planScaleDown(servers, demands, &ScaleDownPolicy{})
+		So(plan.destroy, ShouldResemble, []*cloud.Server{m1, s1, s2})
+
+		So(l1.Drain(), ShouldBeTrue)
+		So(l1.Drain(), ShouldBeFalse)
+		So(l1.Draining(), ShouldBeTrue)
+		So(l1.Allocate(1, 1000, 0), ShouldBeFalse)
+		demands = []*serverDemand{{cores: 1, ram: 1000, count: 1, match: onlyLarge}}
+		plan = planScaleDown(servers, demands, &ScaleDownPolicy{})
+		So(plan.undrain, ShouldResemble, []*cloud.Server{l1})
+		So(l1.Undrain(), ShouldBeTrue)
+		So(l1.Undrain(), ShouldBeFalse)
+		So(l1.Draining(), ShouldBeFalse)
+	})
+}
+
 func TestLSF(t *testing.T) {
 	// check if LSF seems to be installed
 	_, err := exec.LookPath("lsadmin")
@@ -525,6 +657,13 @@ func TestLSF(t *testing.T) {
 			So(bsubArgs, ShouldResemble, []string{"-q", "yesterday", "-M", "100", "-R", "'select[mem>100] rusage[mem=100] span[hosts=1]'", "-J", "random3", "-o", "/dev/null", "-e", "/dev/null", "mycmd"})
 		})
 
+		Convey("generateBsubArgs() avoids excluded hosts", func() {
+			s.ExcludeHosts("hostB", "hostA")
+			defer s.ExcludeHosts()
+			bsubArgs := s.impl.(*lsf).generateBsubArgs("yesterday", possibleReq, "mycmd", 1)
+			So(bsubArgs[5], ShouldEqual, "'select[mem>100 && hname!=hostA && hname!=hostB] rusage[mem=100] span[hosts=1]'")
+		})
+
 		Convey("Busy() starts off false", func() {
 			So(s.Busy(), ShouldBeFalse)
 		})
@@ -0,0 +1,474 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for storing secrets (like database passwords) in
+// the server, encrypted, and injecting them in to the environment of the Cmds
+// of jobs that reference them in their EnvSecrets.
+//
+// Secret values are only ever sent to the runner that has reserved a job, in
+// the job's SecretEnvC, and are never stored with the job or shown by
+// anything that displays jobs; runners also redact them from the output of
+// Cmds.
+//
+// Secrets belong to the user that set them, and only that user's jobs can use
+// them. Only they (or an admin) can replace or delete them.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// secretKeyLength is the length of the AES-256 key we encrypt secrets
+	// with.
+	secretKeyLength = 32
+
+	// secretRedacted is what the values of secrets are replaced with in the
+	// output of Cmds.
+	secretRedacted = "<redacted>"
+)
+
+// validEnvName matches valid environment variable names.
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Secret is a named secret value, such as a password, that the server stores
+// encrypted. Jobs use them by referring to their Name in their EnvSecrets.
+type Secret struct {
+	// Name may only contain letters, numbers, underscores, dots and dashes.
+	Name string
+
+	// Value is never returned by the server.
+	Value string
+}
+
+// validate checks the Secret has a valid Name.
+func (sec *Secret) validate() error {
+	if !validNamespace.MatchString(sec.Name) {
+		return fmt.Errorf("secret name [%s] may only contain letters, numbers, underscores, dots and dashes", sec.Name)
+	}
+	return nil
+}
+
+// parseEnvSecret splits a Job.EnvSecrets entry in to the name of the
+// environment variable and the name of the secret it should be set to.
+func parseEnvSecret(envSecret string) (envName, secretName string, err error) {
+	parts := strings.SplitN(envSecret, "=", 2)
+	if len(parts) != 2 || !validEnvName.MatchString(parts[0]) || !validNamespace.MatchString(parts[1]) {
+		return "", "", fmt.Errorf("env secret [%s] is not of the form ENV_VAR=secret_name", envSecret)
+	}
+	return parts[0], parts[1], nil
+}
+
+// loadSecretKey reads the key we encrypt secrets with from the given file,
+// first creating the file with a new random key if it doesn't exist.
+func loadSecretKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = make([]byte, secretKeyLength)
+		if _, err = io.ReadFull(crand.Reader, key); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != secretKeyLength {
+		return nil, fmt.Errorf("secret key file %s does not contain a %d byte key", path, secretKeyLength)
+	}
+	return key, nil
+}
+
+// secretCipher returns the AEAD we encrypt secrets with.
+func secretCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret encrypts the given secret's Value with the given key, binding
+// it to the secret's Name. The nonce is prefixed to the returned ciphertext.
+func encryptSecret(key []byte, sec *Secret) ([]byte, error) {
+	aead, err := secretCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(crand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(sec.Value), []byte(sec.Name)), nil
+}
+
+// decryptSecret is the reverse of encryptSecret().
+func decryptSecret(key []byte, name string, encrypted []byte) (string, error) {
+	aead, err := secretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	if len(encrypted) < aead.NonceSize() {
+		return "", fmt.Errorf("stored secret [%s] is corrupt", name)
+	}
+	nonce, ciphertext := encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("stored secret [%s] could not be decrypted: %w", name, err)
+	}
+	return string(value), nil
+}
+
+// secretUsableBy tells you if the jobs of the given user can use a secret that
+// belongs to the given owner. Secrets stored before we recorded owners have no
+// owner, and can be used by anyone.
+func secretUsableBy(owner, user string) bool {
+	return owner == "" || owner == user
+}
+
+// setSecret encrypts and stores the given secret, owned by the given user,
+// replacing any with the same Name, as long as the requester owns that one or
+// is an admin.
+func (s *Server) setSecret(sec *Secret, r *requester, user string) (srerr string, qerr error) {
+	if sec == nil {
+		return ErrBadRequest, fmt.Errorf("no secret supplied")
+	}
+	if err := sec.validate(); err != nil {
+		return ErrBadRequest, err
+	}
+	if s.secretKey == nil {
+		return ErrNoSecretKey, fmt.Errorf("the server was not configured with a SecretKeyFile")
+	}
+	if srerr, qerr = s.checkSecretOwner(sec.Name, r, user, false); srerr != "" {
+		return srerr, qerr
+	}
+
+	encrypted, err := encryptSecret(s.secretKey, sec)
+	if err != nil {
+		return ErrInternalError, err
+	}
+	if err = s.db.storeSecret(sec.Name, user, encrypted); err != nil {
+		return ErrDBError, err
+	}
+	return "", nil
+}
+
+// deleteSecret forgets the named secret, as long as the requester owns it or
+// is an admin. Jobs that reference it will fail to start.
+func (s *Server) deleteSecret(name string, r *requester, user string) (srerr string, qerr error) {
+	if srerr, qerr = s.checkSecretOwner(name, r, user, true); srerr != "" {
+		return srerr, qerr
+	}
+	existed, err := s.db.deleteSecret(name)
+	if err != nil {
+		return ErrDBError, err
+	}
+	if !existed {
+		return ErrUnknownSecret, fmt.Errorf("secret [%s] does not exist", name)
+	}
+	return "", nil
+}
+
+// checkSecretOwner returns ErrPermissionDenied if the named secret exists and
+// belongs to someone other than the given user, unless the requester is an
+// admin. If mustExist, it returns ErrUnknownSecret if it doesn't exist.
+func (s *Server) checkSecretOwner(name string, r *requester, user string, mustExist bool) (srerr string, qerr error) {
+	_, owner, err := s.db.retrieveSecret(name)
+	if err != nil {
+		if mustExist {
+			return ErrUnknownSecret, err
+		}
+		return "", nil
+	}
+	if r.admin || owner == "" || owner == user {
+		return "", nil
+	}
+	return ErrPermissionDenied, fmt.Errorf("secret [%s] belongs to another user", name)
+}
+
+// secretNames returns the sorted names of the stored secrets that the given
+// user can use, or of all of them if user is blank. If namespace is not blank,
+// only those in that namespace are returned, unqualified.
+func (s *Server) secretNames(namespace, user string) ([]string, error) {
+	names, err := s.db.retrieveSecretNames(user)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		return names, nil
+	}
+
+	prefix := namespace + namespaceSeparator
+	filtered := make([]string, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			filtered = append(filtered, unnamespaced(namespace, name))
+		}
+	}
+	sort.Strings(filtered)
+	return filtered, nil
+}
+
+// checkJobSecrets makes sure that all the secrets referenced by the given jobs'
+// EnvSecrets exist, and that the jobs' Users can use them.
+func (s *Server) checkJobSecrets(jobs []*Job) (srerr string, qerr error) {
+	type userSecret struct {
+		user string
+		name string
+	}
+	checked := make(map[userSecret]bool)
+	for _, job := range jobs {
+		job.RLock()
+		envSecrets, namespace, user := job.EnvSecrets, job.Namespace, job.User
+		job.RUnlock()
+		for _, envSecret := range envSecrets {
+			_, name, err := parseEnvSecret(envSecret)
+			if err != nil {
+				return ErrUnknownSecret, err
+			}
+			us := userSecret{user, namespaced(namespace, name)}
+			if checked[us] {
+				continue
+			}
+			_, owner, err := s.db.retrieveSecret(us.name)
+			if err != nil {
+				return ErrUnknownSecret, err
+			}
+			if !secretUsableBy(owner, user) {
+				return ErrPermissionDenied, fmt.Errorf("secret [%s] belongs to another user", us.name)
+			}
+			checked[us] = true
+		}
+	}
+	return "", nil
+}
+
+// jobSecretEnv returns the compressed env (as per CompressEnv()) of the
+// environment variables of the given job's EnvSecrets, set to the decrypted
+// values of the secrets they refer to. Secrets that the job's User can't use
+// are not supplied.
+func (s *Server) jobSecretEnv(job *Job) ([]byte, error) {
+	job.RLock()
+	envSecrets, namespace, user := job.EnvSecrets, job.Namespace, job.User
+	job.RUnlock()
+	if len(envSecrets) == 0 {
+		return nil, nil
+	}
+	if s.secretKey == nil {
+		return nil, fmt.Errorf("the server was not configured with a SecretKeyFile")
+	}
+
+	env := make([]string, 0, len(envSecrets))
+	for _, envSecret := range envSecrets {
+		envName, name, err := parseEnvSecret(envSecret)
+		if err != nil {
+			return nil, err
+		}
+		name = namespaced(namespace, name)
+		encrypted, owner, err := s.db.retrieveSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		if !secretUsableBy(owner, user) {
+			return nil, fmt.Errorf("secret [%s] belongs to another user", name)
+		}
+		value, err := decryptSecret(s.secretKey, name, encrypted)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, envName+"="+value)
+	}
+	return compressEnv(env)
+}
+
+// secretEnv decompresses the environment variables sent to us in SecretEnvC by
+// the server when we reserved the job, checking that one was sent for each of
+// our EnvSecrets. Their values are also returned, for redaction. SecretEnvC is
+// then cleared, so that they aren't sent back to the server.
+func (j *Job) secretEnv() (env []string, values [][]byte, err error) {
+	j.Lock()
+	defer j.Unlock()
+	if len(j.EnvSecrets) == 0 {
+		return nil, nil, nil
+	}
+	if len(j.SecretEnvC) == 0 {
+		return nil, nil, fmt.Errorf("the server did not supply the job's secrets")
+	}
+
+	decompressed, err := decompress(j.SecretEnvC)
+	j.SecretEnvC = nil
+	if err != nil {
+		return nil, nil, err
+	}
+	es := &envStr{}
+	dec := codec.NewDecoderBytes(decompressed, new(codec.BincHandle))
+	if err = dec.Decode(es); err != nil {
+		return nil, nil, err
+	}
+	env = es.Environ
+
+	set := make(map[string]bool)
+	for _, envvar := range env {
+		pair := strings.SplitN(envvar, "=", 2)
+		set[pair[0]] = true
+		if len(pair) == 2 && pair[1] != "" {
+			values = append(values, []byte(pair[1]))
+		}
+	}
+	for _, envSecret := range j.EnvSecrets {
+		envName, _, errp := parseEnvSecret(envSecret)
+		if errp != nil {
+			return nil, nil, errp
+		}
+		if !set[envName] {
+			return nil, nil, fmt.Errorf("the server did not supply the secret for %s", envName)
+		}
+	}
+	return env, values, nil
+}
+
+// redactWriter is an io.WriteCloser that replaces any secret values in what is
+// written to it before passing it on. Since a secret could be split across
+// Write()s, it holds back the end of each one in case it is the start of a
+// secret, so you must Close() it to write out the remainder.
+type redactWriter struct {
+	w       io.Writer
+	secrets [][]byte
+	keep    int
+	held    []byte
+}
+
+// newRedactWriter returns w as is if there are no secrets, otherwise a
+// redactWriter that writes to w.
+func newRedactWriter(w io.Writer, secrets [][]byte) io.Writer {
+	if len(secrets) == 0 {
+		return w
+	}
+	keep := 0
+	for _, secret := range secrets {
+		if len(secret)-1 > keep {
+			keep = len(secret) - 1
+		}
+	}
+	return &redactWriter{w: w, secrets: secrets, keep: keep}
+}
+
+// Write implements io.Writer, returning the length of p on success even though
+// a different amount may have been written to our underlying writer.
+func (r *redactWriter) Write(p []byte) (int, error) {
+	redacted := append(r.held, p...)
+	for _, secret := range r.secrets {
+		redacted = bytes.ReplaceAll(redacted, secret, []byte(secretRedacted))
+	}
+
+	// the last keep bytes could be the start of a secret that we'll only see
+	// the rest of in the next Write()
+	cut := len(redacted) - r.keep
+	if cut < 0 {
+		cut = 0
+	}
+	r.held = append([]byte(nil), redacted[cut:]...)
+
+	if _, err := r.w.Write(redacted[:cut]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements io.Closer, writing out anything held back by Write(). It
+// does not close our underlying writer.
+func (r *redactWriter) Close() error {
+	held := r.held
+	r.held = nil
+	if len(held) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(held)
+	return err
+}
+
+// SetSecret encrypts and stores the given secret value in the server under
+// the given name (which may only contain letters, numbers, underscores, dots
+// and dashes), replacing any existing secret with that name. Jobs can then
+// have the value set in an environment variable of their Cmd by including
+// "ENV_VAR=name" in their EnvSecrets. The value can't be retrieved.
+//
+// The secret belongs to you: only your jobs can use it, and only you (or an
+// admin) can replace or delete it; trying to replace someone else's gets you an
+// Error with Err ErrPermissionDenied.
+//
+// If the server was not configured with a SecretKeyFile, you get an Error with
+// Err ErrNoSecretKey.
+func (c *Client) SetSecret(name, value string) error {
+	return c.SetSecretContext(context.Background(), name, value)
+}
+
+// SetSecretContext is like SetSecret(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) SetSecretContext(ctx context.Context, name, value string) error {
+	user, _ := internal.Username() // #nosec only used when the server can't identify us
+	_, err := c.requestContext(ctx, &clientRequest{Method: "setsecret", Secret: &Secret{Name: name, Value: value}, User: user})
+	return err
+}
+
+// DeleteSecret forgets the named secret. Incomplete jobs that reference it
+// will be buried when they try to run. If it didn't exist, you get an Error
+// with Err ErrUnknownSecret, and if it belongs to someone else (and you're not
+// an admin), ErrPermissionDenied.
+func (c *Client) DeleteSecret(name string) error {
+	return c.DeleteSecretContext(context.Background(), name)
+}
+
+// DeleteSecretContext is like DeleteSecret(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) DeleteSecretContext(ctx context.Context, name string) error {
+	user, _ := internal.Username() // #nosec only used when the server can't identify us
+	_, err := c.requestContext(ctx, &clientRequest{Method: "delsecret", Secret: &Secret{Name: name}, User: user})
+	return err
+}
+
+// GetSecrets returns the sorted names of the secrets stored with SetSecret()
+// that your jobs can use, or of all of them if you're an admin.
+func (c *Client) GetSecrets() ([]string, error) {
+	return c.GetSecretsContext(context.Background())
+}
+
+// GetSecretsContext is like GetSecrets(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetSecretsContext(ctx context.Context) ([]string, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getsecrets"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.SecretNames, err
+}
@@ -0,0 +1,229 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for giving each websocket client a bounded queue
+// of the messages broadcast to it, so that one slow client can't build up an
+// unbounded backlog in the manager.
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/gorilla/websocket"
+	"github.com/grafov/bcast"
+)
+
+// WebSocketOverflow* are the policies that can be used for
+// ServerConfig.WebSocketOverflow.
+const (
+	// WebSocketOverflowDrop drops the oldest queued messages to make room for
+	// new ones.
+	WebSocketOverflowDrop = "drop"
+
+	// WebSocketOverflowDisconnect disconnects the client.
+	WebSocketOverflowDisconnect = "disconnect"
+)
+
+// sendQueue is a bounded queue of the messages waiting to be sent to a
+// websocket client.
+type sendQueue struct {
+	sync.Mutex
+	items      []interface{}
+	limit      int
+	disconnect bool
+	dropped    uint64
+	overflowed bool
+	ready      chan bool // has an item when there are items to take()
+	overflow   chan bool // closed if we overflowed with disconnect set
+}
+
+// newSendQueue creates a sendQueue that holds up to limit messages. When full,
+// the oldest message is dropped to make room, unless disconnect is true, in
+// which case the overflow channel is closed instead.
+func newSendQueue(limit int, disconnect bool) *sendQueue {
+	if limit < 1 {
+		limit = 1
+	}
+	return &sendQueue{
+		limit:      limit,
+		disconnect: disconnect,
+		ready:      make(chan bool, 1),
+		overflow:   make(chan bool),
+	}
+}
+
+// push adds a message to the queue. Returns false if the queue overflowed and
+// the client should be disconnected, in which case the message is not added.
+func (q *sendQueue) push(msg interface{}) bool {
+	q.Lock()
+	if q.overflowed {
+		q.Unlock()
+		return false
+	}
+	if len(q.items) >= q.limit {
+		if q.disconnect {
+			q.overflowed = true
+			q.Unlock()
+			close(q.overflow)
+			return false
+		}
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.dropped++
+	}
+	q.items = append(q.items, msg)
+	q.Unlock()
+
+	select {
+	case q.ready <- true:
+	default:
+	}
+	return true
+}
+
+// take removes and returns all the queued messages, oldest first.
+func (q *sendQueue) take() []interface{} {
+	q.Lock()
+	defer q.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// backlog returns the number of messages currently queued, and how many have
+// been dropped.
+func (q *sendQueue) backlog() (int, uint64) {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items), q.dropped
+}
+
+// sendQueueID identifies the sendQueue of one of a websocket client's caster
+// receivers.
+type sendQueueID struct {
+	client string
+	caster string
+}
+
+// WebSocketBacklog describes the backlog of messages waiting to be sent to one
+// of the caster receivers of a websocket client.
+type WebSocketBacklog struct {
+	Client  string // unique id of the client's connection
+	Caster  string // which kind of messages are being queued
+	Queued  int    // how many messages are waiting to be sent
+	Dropped uint64 // how many messages were dropped because too many queued
+}
+
+// relayCaster joins the given caster, relaying the messages it receives in to
+// a new sendQueue for the websocket client with the given unique id (as
+// returned by storeWebSocketConnection()), until stop is closed or the queue
+// overflows. Because messages are taken off the receiver as soon as they
+// arrive, a client that is slow to read them can't hold up the caster.
+func (s *Server) relayCaster(caster *bcast.Group, client, name string, stop chan bool) *sendQueue {
+	return s.relayCasterFiltered(caster, client, name, stop, nil)
+}
+
+// relayCasterFiltered is like relayCaster(), but only queues the messages that
+// the given filter func returns true for, queuing the message it returns in
+// their place. A nil filter queues every message as is.
+func (s *Server) relayCasterFiltered(caster *bcast.Group, client, name string, stop chan bool, filter func(msg interface{}) (interface{}, bool)) *sendQueue {
+	q := newSendQueue(s.wsSendLimit, s.wsDisconnect)
+
+	id := sendQueueID{client: client, caster: name}
+	s.sqmutex.Lock()
+	s.sendQueues[id] = q
+	s.sqmutex.Unlock()
+
+	receiver := caster.Join()
+	go func() {
+		defer internal.LogPanic(s.Logger, "jobqueue websocket "+name+" relay", true)
+		defer func() {
+			receiver.Close()
+			s.sqmutex.Lock()
+			delete(s.sendQueues, id)
+			s.sqmutex.Unlock()
+		}()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case msg := <-receiver.In:
+				if filter != nil {
+					var keep bool
+					if msg, keep = filter(msg); !keep {
+						continue
+					}
+				}
+				if !q.push(msg) {
+					s.Warn("websocket client is too slow to keep up; disconnecting", "client", client, "caster", name, "limit", s.wsSendLimit)
+					return
+				}
+			}
+		}
+	}()
+	return q
+}
+
+// webSocketBacklogs returns the backlogs of all our current websocket clients,
+// sorted by client and caster.
+func (s *Server) webSocketBacklogs() []*WebSocketBacklog {
+	s.sqmutex.RLock()
+	defer s.sqmutex.RUnlock()
+	backlogs := make([]*WebSocketBacklog, 0, len(s.sendQueues))
+	for id, q := range s.sendQueues {
+		queued, dropped := q.backlog()
+		backlogs = append(backlogs, &WebSocketBacklog{Client: id.client, Caster: id.caster, Queued: queued, Dropped: dropped})
+	}
+	sort.Slice(backlogs, func(i, j int) bool {
+		if backlogs[i].Client != backlogs[j].Client {
+			return backlogs[i].Client < backlogs[j].Client
+		}
+		return backlogs[i].Caster < backlogs[j].Caster
+	})
+	return backlogs
+}
+
+// writeQueued writes the messages relayed in to the given sendQueue to the
+// given websocket client as they arrive, until stop is closed. If a write
+// fails or the queue overflows, the client's connection is closed.
+func (s *Server) writeQueued(conn *websocket.Conn, writeMutex sync.Locker, client, name string, q *sendQueue, stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-q.overflow:
+			s.closeWebSocketConnection(client)
+			return
+		case <-q.ready:
+			for _, msg := range q.take() {
+				writeMutex.Lock()
+				err := wsWriteJSON(conn, msg)
+				writeMutex.Unlock()
+				if err != nil {
+					s.Warn("websocket "+name+" updater failed to send JSON to client", "err", err)
+					s.closeWebSocketConnection(client)
+					return
+				}
+			}
+		}
+	}
+}
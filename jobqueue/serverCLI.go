@@ -36,9 +36,13 @@ import (
 // clientRequest, does the requested work, then responds back to the client with
 // a serverResponse
 func (s *Server) handleRequest(m *mangos.Message) error {
-	dec := codec.NewDecoderBytes(m.Body, s.ch)
+	body, accept, errd := unframeWire(m.Body, true)
+	if errd != nil {
+		return errd
+	}
+	dec := codec.NewDecoderBytes(body, s.ch)
 	cr := &clientRequest{}
-	errd := dec.Decode(cr)
+	errd = dec.Decode(cr)
 	if errd != nil {
 		return errd
 	}
@@ -52,16 +56,47 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 	drain := s.drain
 	s.ssmutex.RUnlock()
 
+	// check that the client making the request is allowed to, which by
+	// default means it has the expected token
+	var autherr error
+	var identified bool
+	rq := &requester{}
+	if cr.Method != "ping" {
+		areq := clientAuthRequest(cr, m)
+		autherr = s.authenticate(areq)
+		rq = s.requesterOf(areq)
+		if autherr == nil && areq.User != "" {
+			// users the Authenticator identified can't claim to be anyone
+			// else
+			cr.User = areq.User
+			identified = true
+		}
+	}
+
 	switch {
-	// check that the client making the request has the expected token
-	case (len(cr.Token) != tokenLength || !tokenMatches(cr.Token, s.token)) && cr.Method != "ping":
+	case autherr != nil:
 		srerr = ErrPermissionDenied
-		qerr = "Client presented the wrong token"
+		qerr = "Client was not authorised: " + autherr.Error()
 	case s.q == nil || (!up && !drain):
 		// the server just got shutdown
 		srerr = ErrClosedStop
 		qerr = "The server has been stopped"
+	case cr.Namespace != "" && !validNamespace.MatchString(cr.Namespace):
+		srerr = ErrBadNamespace
+		qerr = "Client presented an invalid namespace"
+	case !protocolVersionSupported(cr.ProtocolVersion) && !(cr.Method == "ping" && protocolVersionOf(cr.ProtocolVersion) > ProtocolVersion):
+		// (newer clients can ping us to find out they should speak an older
+		// version)
+		srerr = ErrProtocolVersion
+		qerr = protocolVersionError(cr.ProtocolVersion)
 	default:
+		// clients can refer to jobs by their Names instead of their keys
+		cr.Keys = s.resolveJobNames(cr.Keys, cr.Namespace)
+
+		if cr.Namespace != "" {
+			s.namespaceRequest(cr)
+		}
+
 		switch cr.Method {
 		case "ping":
 			// avoid a later race condition when we try to encode ServerInfo by
@@ -70,7 +105,12 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			si := &ServerInfo{}
 			*si = *s.ServerInfo
 			s.ssmutex.RUnlock()
-			sr = &serverResponse{SInfo: si}
+			sr = &serverResponse{
+				SInfo:       si,
+				Compression: chooseWireCompression(cr.Compressions),
+				Protocol:    ProtocolVersion,
+				ProtocolMin: ProtocolMinVersion,
+			}
 		case "backup":
 			s.Debug("backup requested")
 			// make an io.Writer that writes to a byte slice, so we can return
@@ -83,6 +123,30 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			} else {
 				sr = &serverResponse{DB: b.Bytes()}
 			}
+		case "replicate":
+			// like backup, but only what changed since the standby's copy
+			var b bytes.Buffer
+			txid, whole, err := s.replicateDB(&b, cr.DBTxID)
+			switch {
+			case err != nil:
+				srerr = ErrInternalError
+				qerr = err.Error()
+			case whole:
+				sr = &serverResponse{DBTxID: txid, DB: b.Bytes()}
+			default:
+				sr = &serverResponse{DBTxID: txid, DBChanges: b.Bytes()}
+			}
+		case "fence":
+			// a server of our database tells us its epoch, superseding us if
+			// it took over from us
+			if !rq.admin {
+				srerr = ErrPermissionDenied
+				break
+			}
+			if s.db.epochs.supersededBy(cr.Epoch) {
+				s.Warn("a server with a later epoch has taken over from us", "epoch", cr.Epoch)
+			}
+			sr = &serverResponse{Epoch: s.db.epochs.current()}
 		case "pause":
 			s.Debug("pause requested")
 			paused, err := s.Pause()
@@ -131,6 +195,37 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			} else {
 				sr = &serverResponse{SStats: s.GetServerStats()}
 			}
+		case "drainuntil":
+			s.Info("drain for maintenance requested", "start", cr.From, "until", cr.To)
+			err := s.DrainUntil(cr.From, cr.To)
+			if err != nil {
+				if jqerr, ok := err.(Error); ok {
+					srerr = jqerr.Err
+				} else {
+					srerr = ErrInternalError
+				}
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{SStats: s.GetServerStats()}
+			}
+		case "reload":
+			s.Info("configuration reload requested")
+			report, err := s.Reload()
+			if err != nil {
+				s.Error("reloading configuration failed", "err", err)
+				srerr = ErrReloadFailed
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Reload: report}
+			}
+		case "handover":
+			s.Info("handover requested")
+			err := s.Handover()
+			if err != nil {
+				s.Error("handing over failed", "err", err)
+				srerr = ErrNoHandover
+				qerr = err.Error()
+			}
 		case "shutdown":
 			s.Debug("shutdown requested")
 			go s.Stop(true) // server stop can't complete while this client request is pending
@@ -154,20 +249,105 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					}
 				}
 			}
-		case "add":
+		case "add", "addmanifest", "addarray":
 			// add jobs to the queue, and along side keep the environment variables
 			// they're supposed to execute under.
+			// Jobs may come as a compressed batch, or as a template job to be
+			// expanded with the rows of a compressed manifest or in to an array.
+			if cr.Method == "addarray" {
+				var err error
+				cr.Jobs, err = s.expandArray(cr.Job, cr.ArraySize)
+				if err != nil {
+					srerr = ErrBadRequest
+					qerr = err.Error()
+				}
+			}
+			if cr.Method == "addmanifest" {
+				if cr.File == nil {
+					srerr = ErrBadRequest
+				} else {
+					manifest, err := decompress(cr.File)
+					if err == nil {
+						cr.Jobs, err = expandManifest(s.ch, cr.Job, manifest)
+					}
+					if err != nil {
+						srerr = ErrBadRequest
+						qerr = err.Error()
+					}
+				}
+			}
+			if cr.JobsC != nil {
+				jobs, err := s.decompressJobs(cr.JobsC)
+				if err != nil {
+					srerr = ErrBadRequest
+					qerr = err.Error()
+				} else {
+					cr.Jobs = jobs
+				}
+			}
+
 			if cr.Env == nil || cr.Jobs == nil {
 				srerr = ErrBadRequest
-			} else {
+			} else if srerr == "" {
+				for _, job := range cr.Jobs {
+					job.setCmdFromSteps()
+					if cr.Namespace != "" {
+						job.setNamespace(cr.Namespace)
+					}
+					if job.User == "" || identified {
+						job.User = cr.User
+					}
+				}
+
 				// Store Env
 				envkey, err := s.db.storeEnv(cr.Env)
 				if err != nil {
 					srerr = ErrDBError
 					qerr = err.Error()
 				} else if srerr == "" {
+					// jobs with a Schedule are stored as recurring jobs
+					// instead of being queued
+					var scheduled, unscheduled []*Job
+					for _, job := range cr.Jobs {
+						if job.Schedule != "" {
+							scheduled = append(scheduled, job)
+						} else {
+							unscheduled = append(unscheduled, job)
+						}
+					}
+					var schedAdded, schedReplaced int
+					var thisSrerr string
+					if len(scheduled) > 0 {
+						err = s.admitJobs(scheduled)
+						if err != nil {
+							thisSrerr = ErrJobRejected
+						} else {
+							schedAdded, schedReplaced, thisSrerr, err = s.addSchedules(scheduled, envkey)
+						}
+					}
+
+					// in if-changed mode, skip the jobs that previously
+					// completed unchanged, and re-run the rest
+					ignoreComplete := cr.IgnoreComplete
+					var unchanged int
+					if err == nil && len(unscheduled) > 0 && cr.Rerun != "" {
+						ignoreComplete = cr.Rerun == RerunSkip
+						if cr.Rerun == RerunIfChanged {
+							unscheduled, unchanged, err = s.skipUnchangedCompleteJobs(unscheduled, envkey)
+							if err != nil {
+								thisSrerr = ErrDBError
+							}
+						}
+					}
+
 					// create the jobs server-side
-					added, dups, alreadyComplete, thisSrerr, err := s.createJobs(cr.Jobs, envkey, cr.IgnoreComplete)
+					var added, dups, alreadyComplete int
+					if err == nil && len(unscheduled) > 0 {
+						added, dups, alreadyComplete, thisSrerr, err = s.createJobs(unscheduled, envkey, ignoreComplete)
+					}
+					alreadyComplete += unchanged
+					added += schedAdded
+					dups += schedReplaced
 					if err != nil {
 						srerr = thisSrerr
 						qerr = err.Error()
@@ -179,17 +359,141 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 							for _, job := range jobs {
 								ids = append(ids, job.Key())
 							}
-							sr = &serverResponse{Added: added, Existed: dups + alreadyComplete, AddedIDs: ids}
+							sr = &serverResponse{Added: added, Existed: dups + alreadyComplete, Skipped: alreadyComplete, AddedIDs: ids}
+						} else {
+							sr = &serverResponse{Added: added, Existed: dups + alreadyComplete, Skipped: alreadyComplete}
+						}
+					}
+				}
+			}
+		case "apply":
+			// add the missing jobs of a pipeline, and optionally remove its
+			// undesired ones
+			if cr.Job == nil || cr.Job.RepGroup == "" || cr.JobsC == nil || cr.Env == nil {
+				srerr = ErrBadRequest
+			} else {
+				jobs, err := s.decompressJobs(cr.JobsC)
+				if err != nil {
+					srerr = ErrBadRequest
+					qerr = err.Error()
+				} else {
+					for _, job := range jobs {
+						job.setCmdFromSteps()
+						if cr.Namespace != "" {
+							job.setNamespace(cr.Namespace)
+						}
+						if job.User == "" || identified {
+							job.User = cr.User
+						}
+					}
+
+					var envkey string
+					if !cr.DryRun {
+						envkey, err = s.db.storeEnv(cr.Env)
+					}
+					if err != nil {
+						srerr = ErrDBError
+						qerr = err.Error()
+					} else {
+						var diff *PipelineDiff
+						diff, srerr, err = s.applyPipeline(cr.Job.RepGroup, cr.Namespace, jobs, envkey, cr.IgnoreComplete, cr.Prune, cr.DryRun)
+						if err != nil {
+							qerr = err.Error()
 						} else {
-							sr = &serverResponse{Added: added, Existed: dups + alreadyComplete}
+							s.Debug("applied pipeline", "pipeline", cr.Job.RepGroup, "added", len(diff.Added), "removed", len(diff.Removed), "dry", cr.DryRun)
+							sr = &serverResponse{Pipeline: diff}
 						}
 					}
 				}
 			}
+		case "addworkflow":
+			// add the jobs of a workflow in one go, and remember it
+			if cr.Workflow == nil || cr.JobsC == nil || cr.Env == nil {
+				srerr = ErrBadRequest
+			} else {
+				jobs, err := s.decompressJobs(cr.JobsC)
+				if err != nil {
+					srerr = ErrBadRequest
+					qerr = err.Error()
+				} else {
+					for _, job := range jobs {
+						job.setCmdFromSteps()
+						if cr.Namespace != "" {
+							job.setNamespace(cr.Namespace)
+						}
+						if job.User == "" || identified {
+							job.User = cr.User
+						}
+					}
+					cr.Workflow.User = cr.User
+
+					envkey, err := s.db.storeEnv(cr.Env)
+					if err != nil {
+						srerr = ErrDBError
+						qerr = err.Error()
+					} else {
+						added, existed, thisSrerr, err := s.addWorkflow(cr.Workflow, cr.Namespace, jobs, envkey, cr.IgnoreComplete)
+						if err != nil {
+							srerr = thisSrerr
+							qerr = err.Error()
+						} else {
+							sr = &serverResponse{Added: added, Existed: existed}
+						}
+					}
+				}
+			}
+		case "getworkflows":
+			// get workflows and the states of their steps
+			name := ""
+			if cr.Workflow != nil && cr.Workflow.Name != "" {
+				name = namespaced(cr.Namespace, cr.Workflow.Name)
+			}
+			wfs, thisSrerr, err := s.getWorkflows(name)
+			if err != nil {
+				srerr = thisSrerr
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Workflows: wfs}
+			}
+		case "estimate":
+			// predict the resource usage of jobs without adding them
+			if cr.JobsC != nil {
+				jobs, err := s.decompressJobs(cr.JobsC)
+				if err != nil {
+					srerr = ErrBadRequest
+					qerr = err.Error()
+				} else {
+					cr.Jobs = jobs
+				}
+			}
+
+			if cr.Jobs == nil {
+				srerr = ErrBadRequest
+			} else if srerr == "" {
+				if cr.Namespace != "" {
+					for _, job := range cr.Jobs {
+						job.setNamespace(cr.Namespace)
+					}
+				}
+				est, thisSrerr, err := s.estimate(cr.Jobs)
+				if err != nil {
+					srerr = thisSrerr
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Estimate: est}
+				}
+			}
 		case "reserve":
 			// return the next ready job
 			if cr.ClientID.String() == "00000000-0000-0000-0000-000000000000" {
 				srerr = ErrBadRequest
+			} else if cr.Capacity != nil && (cr.Capacity.RAM <= 0 || cr.Capacity.Cores <= 0) {
+				srerr = ErrBadRequest
+			} else if s.runnerNeedsUpdate(cr) {
+				// rather than give out-of-date runners a job, have them
+				// replace themselves with our version
+				s.Debug("asked runner to update", "host", cr.Host, "version", cr.RunnerVersion)
+				srerr = ErrRunnerUpdate
 			} else if !drain {
 				// first just try to Reserve normally
 				var item *queue.Item
@@ -207,8 +511,10 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					<-wch
 				}
 
-				skip := false
-				if cr.SchedulerGroup != "" {
+				// runners on excluded or full hosts get nothing, so that they
+				// exit
+				skip := cr.Host != "" && (s.hostExcluded(cr.Host) || s.hostFull(cr.Host))
+				if !skip && cr.SchedulerGroup != "" {
 					// if this is the first job that the client is trying to
 					// reserve, and if we don't actually want any more clients
 					// working on this schedulerGroup, we'll just act as if
@@ -223,7 +529,44 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 				}
 
 				if !skip {
-					item, err = s.reserveWithLimits(cr.SchedulerGroup, cr.Timeout)
+					match := matchAll(s.affinityMatch(cr.Host), namespaceMatch(cr.Namespace), capacityMatch(cr.Capacity))
+					reserve := func(filter queue.Filter, wait time.Duration) (*queue.Item, error) {
+						if len(cr.SchedulerGroups) > 0 || cr.Capacity != nil {
+							return s.reserveFromGroupsWithLimits(s.reserveGroups(cr), wait, filter, match)
+						}
+						return s.reserveWithLimits(cr.SchedulerGroup, wait, filter, match)
+					}
+
+					// prefer the jobs of namespaces that are under their
+					// share, and within that of the users or RepGroups with
+					// the fewest jobs running, but otherwise take what we can
+					// get. These matches give the same answer for all the
+					// jobs in a fair group, so skip whole groups at once
+					shareMatch := s.namespaceShareMatch()
+					if fairMatch := s.fairShareMatch(); fairMatch != nil {
+						item, err = reserve(queue.Filter(matchAll(shareMatch, fairMatch)), 0)
+					}
+					if item == nil && shareMatch != nil {
+						item, err = reserve(queue.Filter(shareMatch), 0)
+					}
+					if item == nil {
+						item, err = reserve(nil, cr.Timeout)
+					}
+
+					// an idle runner could run a job from another group
+					// instead of exiting
+					if item == nil && cr.SchedulerGroup != "" {
+						if qerr, ok := err.(queue.Error); ok && qerr.Err == queue.ErrNothingReady {
+							if ritem, rerr := s.reserveForIdleRunner(cr.SchedulerGroup, match); ritem != nil || rerr != nil {
+								item, err = ritem, rerr
+							}
+							if item == nil && err != nil {
+								if bitem, berr := s.reserveBackfill(cr.SchedulerGroup, match); bitem != nil || berr != nil {
+									item, err = bitem, berr
+								}
+							}
+						}
+					}
 
 					if err != nil {
 						if qerr, ok := err.(queue.Error); ok {
@@ -252,10 +595,16 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					sjob.EndTime = tnil
 					sjob.PeakRAM = 0
 					sjob.PeakDisk = 0
+					sjob.InputStats = nil
+					sjob.LostReport = nil
+					sjob.LostReason = ""
 					sjob.Exitcode = -1
 					sgroup := sjob.schedulerGroup
 					sjob.Unlock()
 
+					s.startRateReserved(item.Key)
+					s.startReservationTimer(item.Key, cr.ClientID, cr.Host)
+
 					errd := s.q.SetDelay(item.Key, ClientReleaseDelay)
 					if errd != nil {
 						s.Warn("reserve queue SetDelay failed", "err", errd)
@@ -264,7 +613,16 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					// make a copy of the job with some extra stuff filled in (that
 					// we don't want taking up memory here) for the client
 					job := s.itemToJob(item, false, true)
+					secretEnvC, errs := s.jobSecretEnv(job)
+					if errs != nil {
+						// the runner will bury the job when it finds its
+						// secrets missing
+						s.Warn("could not supply the secrets of a reserved job", "job", item.Key, "err", errs)
+					}
+					job.SecretEnvC = secretEnvC
+					s.withHeartbeat(job)
 					sr = &serverResponse{Job: job}
+					s.recordJobEvent(&JobEvent{Event: JobEventReserved, Host: cr.Host}, item.Key)
 					s.Debug("reserved job", "cmd", job.Cmd, "schedGrp", sgroup)
 				}
 			} // else we'll return nothing, as if there were no jobs in the queue
@@ -278,6 +636,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					srerr = ErrBadRequest
 					job.Unlock()
 				} else {
+					s.stopReservationTimer(job.Key())
 					job.Host = cr.Job.Host
 					if job.Host != "" {
 						job.HostID = s.scheduler.HostToID(job.Host)
@@ -285,14 +644,31 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					job.HostIP = cr.Job.HostIP
 					job.Pid = cr.Job.Pid
 					job.StartTime = time.Now()
+					if cr.Replayed && !cr.Job.StartTime.IsZero() && cr.Job.StartTime.Before(job.StartTime) {
+						// the runner lost contact with us when it started the
+						// job, and is only now able to tell us about it
+						job.StartTime = cr.Job.StartTime
+						s.Info("runner regained contact and replayed the start of its job", "cmd", job.Cmd, "host", job.Host)
+					}
 					var tend time.Time
 					job.EndTime = tend
 					job.Attempts++
 					job.killCalled = false
+					job.preempt = ""
+					job.preemptedBy = ""
+					job.tailOut, job.tailErr = nil, nil
+					if s.hostExcluded(job.Host) {
+						// the host was excluded after we were reserved
+						job.preempt = preemptExclude
+					}
 					job.Lost = false
+					job.LostReason = ""
 					job.State = JobStateRunning
+					event := &JobEvent{Event: JobEventStarted, Host: job.Host, Time: job.StartTime}
 
 					job.Unlock()
+					s.affinityJobStarted(job)
+					s.recordJobEvent(event, job.Key())
 
 					// we'll save-to-disk that we started running this job, so
 					// recovery is possible after a crash
@@ -308,6 +684,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 				job.RLock()
 				killCalled := job.killCalled
 				lost := job.Lost
+				preempt := job.preempt
 				job.RUnlock()
 
 				if !killCalled {
@@ -319,7 +696,11 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 				}
 
 				if !killCalled {
-					// else, update the job's ttr
+					// else, update the job's ttr, and note how busy its host is
+					job.RLock()
+					host := job.Host
+					job.RUnlock()
+					s.recordHostLoad(host, cr.Load, cr.RAMUsed)
 					err := s.q.Touch(item.Key)
 					if err != nil {
 						srerr = ErrInternalError
@@ -327,16 +708,47 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					} else if lost {
 						job.Lock()
 						job.Lost = false
+						job.LostReason = ""
 						job.EndTime = time.Time{}
 						job.Unlock()
+						s.stopWatchingLostJob(item.Key)
 
 						// since our changed callback won't be called, send out
 						// this transition from lost to running state
-						s.statusCaster.Send(&jstateCount{"+all+", JobStateLost, JobStateRunning, 1})
-						s.statusCaster.Send(&jstateCount{job.RepGroup, JobStateLost, JobStateRunning, 1})
+						foundCount := newStateCounter()
+						job.RLock()
+						foundCount.add(job.User, job.RepGroup, tagGroups(job.Tags))
+						job.RUnlock()
+						s.sendStateCounts(foundCount, JobStateLost, JobStateRunning)
+					}
+				}
+				sr = &serverResponse{KillCalled: killCalled, Tailing: s.recordTail(job, cr)}
+				if preempt != "" {
+					sr.Preempt = preempt
+					if preempt == preemptExclude {
+						sr.Grace = ServerExcludedHostGrace
+					} else if policy := s.preemptionPolicy(); policy != nil {
+						sr.Grace = policy.Grace
 					}
 				}
-				sr = &serverResponse{KillCalled: killCalled}
+			}
+		case "jtail":
+			// store the latest output of a running job
+			var job *Job
+			_, job, srerr = s.getij(cr, true)
+			if srerr == "" {
+				sr = &serverResponse{Tailing: s.recordTail(job, cr)}
+			}
+		case "gettail":
+			// get the latest output of a running job
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				var tail *JobTail
+				tail, srerr = s.getTail(cr.Keys[0], cr.StdOutOffset, cr.StdErrOffset)
+				if srerr == "" {
+					sr = &serverResponse{Tail: tail}
+				}
 			}
 		case "jarchive":
 			// remove the job from the queue, rpl and live bucket and add to
@@ -365,6 +777,12 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					job.FailReason = ""
 					sgroup := job.schedulerGroup
 					rgroup := job.RepGroup
+					host := job.Host
+					policy := s.repGroupPolicy(rgroup)
+					if policy != nil && policy.KeepOutput {
+						job.StdOutC = cr.Job.StdOutC
+						job.StdErrC = cr.Job.StdErrC
+					}
 					job.Unlock()
 					err := s.db.archiveJob(key, job)
 					if err != nil {
@@ -377,10 +795,16 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 							qerr = err.Error()
 						} else {
 							s.rpl.Lock()
+							var finished bool
 							if m, exists := s.rpl.lookup[rgroup]; exists {
 								delete(m, key)
+								finished = len(m) == 0
 							}
 							s.rpl.Unlock()
+							if finished {
+								s.notifyPolicy(policy, PolicyEventComplete, rgroup, nil)
+							}
+							s.recordJobEvent(&JobEvent{Event: JobEventCompleted, Host: host}, key)
 							s.Debug("completed job", "cmd", job.Cmd, "schedGrp", sgroup)
 							go func(group string) {
 								defer internal.LogPanic(s.Logger, "jarchive", true)
@@ -425,36 +849,20 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			// move the jobs from the bury queue to the ready queue; unlike the
 			// other j* methods, client doesn't have to be the Reserve() owner
 			// of these jobs, and we don't want the "in run queue" test
+			var overrides *RetryOverrides
+			var verr error
+			if !cr.RetryOverrides.isEmpty() {
+				overrides = cr.RetryOverrides
+				verr = overrides.validate()
+			}
 			if cr.Keys == nil {
 				srerr = ErrBadRequest
+			} else if verr != nil {
+				srerr = ErrBadRequest
+				qerr = verr.Error()
 			} else {
-				kicked := 0
-				for _, jobkey := range cr.Keys {
-					item, err := s.q.Get(jobkey)
-					if err != nil || item.Stats().State != queue.ItemStateBury {
-						continue
-					}
-					s.rpmutex.Lock()
-					s.racPending = true
-					s.rpmutex.Unlock()
-					err = s.q.Kick(jobkey)
-					if err == nil {
-						job := item.Data().(*Job)
-						job.Lock()
-						job.UntilBuried = job.Retries + 1
-						s.Debug("unburied job", "cmd", job.Cmd, "schedGrp", job.schedulerGroup)
-						job.State = JobStateReady
-						job.Unlock()
-						kicked++
-
-						s.db.updateJobAfterChange(job)
-					} else {
-						s.rpmutex.Lock()
-						s.racPending = false
-						s.rpmutex.Unlock()
-					}
-				}
-				sr = &serverResponse{Existed: kicked}
+				kicked := s.kickJobs(cr.Keys, overrides, cr.User)
+				sr = &serverResponse{Existed: len(kicked)}
 			}
 		case "jdel":
 			// remove the jobs from the bury/delay/dependent/ready queue and the
@@ -466,158 +874,115 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 				s.Debug("deleted jobs", "count", len(deleted))
 				sr = &serverResponse{Existed: len(deleted)}
 			}
-		case "jmod":
-			// modify jobs in the bury/delay/dependent/ready queue and the
-			// live bucket
-			if cr.Keys == nil || cr.Modifier == nil {
+		case "jdelbg":
+			// remove the jobs in the background, returning straight away
+			if cr.Keys == nil {
+				srerr = ErrBadRequest
+			} else {
+				br, errb := s.startBulkRemoval(cr.Keys)
+				if errb != nil {
+					srerr = ErrDBError
+					qerr = errb.Error()
+				} else {
+					sr = &serverResponse{Removals: []*BulkRemoval{br}}
+				}
+			}
+		case "getschedules":
+			// get the recurring jobs
+			scheds, err := s.getSchedules()
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Schedules: scheds}
+			}
+		case "pauseschedule", "resumeschedule", "cancelschedule":
+			// change a recurring job
+			if len(cr.Keys) != 1 {
 				srerr = ErrBadRequest
 			} else {
-				// to avoid race conditions with jobs that are currently
-				// pending, but become running in the middle of us trying to
-				// modify them, we first pause the server, and resume it
-				// afterwards
-				paused, err := s.Pause()
+				thisSrerr, err := s.changeSchedule(cr.Method, cr.Keys[0], cr.Namespace)
 				if err != nil {
-					if jqerr, ok := err.(Error); ok {
-						srerr = jqerr.Err
-					} else {
-						srerr = ErrInternalError
-					}
+					srerr = thisSrerr
 					qerr = err.Error()
-				} else if paused {
-					s.Debug("modify requested, paused server")
 				} else {
-					s.Debug("modify requested")
-				}
-
-				if err == nil {
-					var toModifyJobs []*Job
-					toModifyKeys := make(map[string]*Job)
-					for _, jobkey := range cr.Keys {
-						item, err := s.q.Get(jobkey)
-						if err != nil || item == nil {
-							continue
-						}
-						iState := item.Stats().State
-						if iState == queue.ItemStateRun {
-							continue
-						}
-						toModifyJobs = append(toModifyJobs, item.Data().(*Job))
-						toModifyKeys[jobkey] = item.Data().(*Job)
-					}
-
-					modified, err := cr.Modifier.Modify(toModifyJobs, s)
-					if err != nil {
-						if jqerr, ok := err.(Error); ok {
-							srerr = jqerr.Err
-						} else {
-							srerr = ErrInternalError
-						}
-						qerr = err.Error()
-					}
-
-					if err == nil && len(modified) > 0 {
-						var toModify []*Job
-						for _, old := range modified {
-							job := toModifyKeys[old]
-							if job != nil {
-								toModify = append(toModify, job)
-							}
-						}
-
-						// additional handling of changed limit groups
-						if cr.Modifier.LimitGroupsSet {
-							limitGroups := make(map[string]int)
-							for _, job := range toModify {
-								err := s.handleUserSpecifiedJobLimitGroups(job, limitGroups)
-								if err != nil {
-									s.Error("failed to modify limit group", "err", err)
-								}
-							}
-							err := s.storeLimitGroups(limitGroups)
-							if err != nil {
-								s.Error("failed to store limit groups", "err", err)
-							}
-						}
-
-						// update changed keys in the queue and in our rpl lookup
-						keyToRP := make(map[string]string)
-						for _, job := range toModify {
-							keyToRP[job.Key()] = job.RepGroup
-						}
-						s.rpl.Lock()
-						for new, old := range modified {
-							if old == new {
-								continue
-							}
-							errc := s.q.ChangeKey(old, new)
-							if errc != nil {
-								s.Error("failed to change a job key in the queue", "err", errc)
-							}
-
-							rp := keyToRP[new]
-							if _, exists := s.rpl.lookup[rp]; !exists {
-								s.rpl.lookup[rp] = make(map[string]bool)
-							}
-							delete(s.rpl.lookup[rp], old)
-							s.rpl.lookup[rp][new] = true
-						}
-						s.rpl.Unlock()
-
-						// update db live bucket and dep lookups
-						if len(toModify) > 0 {
-							oldKeys := make([]string, len(toModify))
-							for i, job := range toModify {
-								oldKeys[i] = modified[job.Key()]
-							}
-							errm := s.db.modifyLiveJobs(oldKeys, toModify)
-							if errm != nil {
-								s.Error("job modification in database failed", "err", errm)
-							} else if cr.Modifier.DependenciesSet || cr.Modifier.PrioritySet {
-								// if we're changing the jobs these jobs are
-								// dependant upon or their priority, that must be
-								// reflected in the queue as well
-								for _, job := range toModify {
-									deps, err := job.Dependencies.incompleteJobKeys(s.db)
-									if err != nil {
-										s.Error("failed to get job dependencies", "err", err)
-									}
-									err = s.q.Update(job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, ServerItemTTR, deps)
-									if err != nil {
-										s.Error("failed to modify a job in the queue", "err", err)
-									}
-								}
-							}
-						}
-					}
-
-					sr = &serverResponse{Modified: modified}
-
-					// now resume the server again
-					resumed, err := s.Resume()
-					if err != nil {
-						s.Error(err.Error())
-					} else if resumed {
-						s.Debug("modify completed, resumed server", "count", len(modified))
-					} else {
-						s.Debug("modify completed", "count", len(modified))
-					}
+					sr = &serverResponse{}
 				}
 			}
-		case "jkill":
-			// set the killCalled property on the jobs, to change the subsequent
-			// behaviour of jtouch; as per jkick, client doesn't have to be the
-			// Reserve() owner of these jobs, though we do want the "in run
-			// queue" test
+		case "gettrashed":
+			// get the removed jobs that can still be restored
+			repGroup := ""
+			if cr.Job != nil {
+				repGroup = cr.Job.RepGroup
+			}
+			jobs, err := s.getTrashed(repGroup)
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Jobs: jobs}
+			}
+		case "untrash":
+			// put removed jobs back in the queue
 			if cr.Keys == nil {
 				srerr = ErrBadRequest
 			} else {
-				killable := 0
-				for _, jobkey := range cr.Keys {
-					k, err := s.killJob(jobkey)
-					if err != nil {
-						continue
-					}
+				restored, thisSrerr, err := s.restoreTrashed(cr.Keys, cr.Namespace)
+				if err != nil {
+					srerr = thisSrerr
+					qerr = err.Error()
+				} else {
+					s.Debug("restored trashed jobs", "count", restored)
+					sr = &serverResponse{Added: restored}
+				}
+			}
+		case "getrunnerexe":
+			exe, err := s.runnerExe(cr.RunnerPlatform)
+			if err != nil {
+				srerr = ErrInternalError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Exe: exe}
+			}
+		case "getbulkrm":
+			sr = &serverResponse{Removals: s.getBulkRemovals()}
+		case "cancelbulkrm":
+			if cr.BulkRemovalID == "" {
+				srerr = ErrBadRequest
+			} else {
+				errc := s.cancelBulkRemoval(cr.BulkRemovalID)
+				if errc != nil {
+					srerr = ErrNoBulkRemoval
+					qerr = errc.Error()
+				}
+			}
+		case "jmod":
+			// modify jobs in the bury/delay/dependent/ready queue and the
+			// live bucket
+			if cr.Keys == nil || cr.Modifier == nil {
+				srerr = ErrBadRequest
+			} else if err := cr.Modifier.RetryPolicy.validate(); err != nil {
+				srerr = ErrBadRequest
+				qerr = err.Error()
+			} else {
+				modified, conflicts, thisSrerr, thisQerr := s.modifyJobs(cr.Keys, cr.Attempts, cr.Modifier)
+				srerr, qerr = thisSrerr, thisQerr
+				sr = &serverResponse{Modified: modified, Conflicts: conflicts}
+			}
+		case "jkill":
+			// set the killCalled property on the jobs, to change the subsequent
+			// behaviour of jtouch; as per jkick, client doesn't have to be the
+			// Reserve() owner of these jobs, though we do want the "in run
+			// queue" test
+			if cr.Keys == nil {
+				srerr = ErrBadRequest
+			} else {
+				killable := 0
+				for _, jobkey := range cr.Keys {
+					k, err := s.killJob(jobkey)
+					if err != nil {
+						continue
+					}
 					if k {
 						killable++
 					}
@@ -636,23 +1001,472 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					sr = &serverResponse{Jobs: jobs}
 				}
 			}
+		case "regartifacts":
+			// add to the Artifacts of a complete job
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				var artifacts []*Artifact
+				artifacts, srerr, qerr = s.registerArtifacts(cr.Keys[0], cr.Artifacts)
+				if srerr == "" {
+					sr = &serverResponse{Artifacts: artifacts}
+				}
+			}
+		case "getartifact":
+			// get the content of one of a job's Artifacts
+			if len(cr.Keys) != 1 || cr.Path == "" {
+				srerr = ErrBadRequest
+			} else {
+				var file []byte
+				file, srerr, qerr = s.readArtifact(cr.Keys[0], cr.Path)
+				if srerr == "" {
+					sr = &serverResponse{File: file}
+				}
+			}
 		case "getbr":
 			// get jobs by their RepGroup
 			if cr.Job == nil || cr.Job.RepGroup == "" {
 				srerr = ErrBadRequest
 			} else {
 				var jobs []*Job
-				jobs, srerr, qerr = s.getJobsByRepGroup(cr.Job.RepGroup, cr.Search, cr.Limit, cr.State, cr.GetStd, cr.GetEnv)
+				if cr.RepGroupMatch != "" {
+					// patterns are matched against unqualified RepGroups
+					pattern := unnamespaced(cr.Namespace, cr.Job.RepGroup)
+					jobs, srerr, qerr = s.getJobsByRepGroupMatch(pattern, cr.RepGroupMatch, cr.Namespace, cr.Limit, cr.State, cr.Filter, cr.GetStd, cr.GetEnv)
+				} else {
+					jobs, srerr, qerr = s.getJobsByRepGroup(cr.Job.RepGroup, cr.Search, cr.Limit, cr.State, cr.Filter, cr.GetStd, cr.GetEnv)
+				}
+				if len(jobs) > 0 {
+					sr = &serverResponse{Jobs: jobs}
+				}
+			}
+		case "getbt":
+			// get jobs by their Tags
+			if cr.Job == nil || len(cr.Job.Tags) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				var jobs []*Job
+				jobs, srerr, qerr = s.getJobsByTags(cr.Job.Tags, cr.Limit, cr.State, cr.Filter, cr.GetStd, cr.GetEnv)
+				if len(jobs) > 0 {
+					sr = &serverResponse{Jobs: jobs}
+				}
+			}
+		case "getrgrec":
+			// get the resource recommendation learned for a RepGroup
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				rec, err := s.repGroupRecommendation(cr.Job.RepGroup)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{RGRec: rec}
+				}
+			}
+		case "rgauto":
+			// turn on or off the automatic application of a RepGroup's
+			// resource recommendation
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				err := s.db.storeRepGroupAutoApply(cr.Job.RepGroup, cr.AutoApply)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					s.q.TriggerReadyAddedCallback()
+				}
+			}
+		case "rgwin":
+			// set or remove the run window of a RepGroup
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				var err error
+				srerr, err = s.setRepGroupRunWindow(cr.Job.RepGroup, cr.Job.RunWindow)
+				if err != nil {
+					qerr = err.Error()
+				} else {
+					s.q.TriggerReadyAddedCallback()
+				}
+			}
+		case "exhosts", "inhosts":
+			// exclude hosts from running jobs, or include them again
+			if len(cr.Hosts) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				var err error
+				srerr, err = s.excludeHosts(cr.Hosts, cr.Method == "exhosts")
+				if err != nil {
+					qerr = err.Error()
+				} else {
+					s.q.TriggerReadyAddedCallback()
+				}
+			}
+		case "gethosts":
+			// get the names of the excluded hosts
+			sr = &serverResponse{Hosts: s.getExcludedHosts()}
+		case "getrestimeouts":
+			// get the hosts whose runners failed to start jobs in time
+			sr = &serverResponse{ResTimeouts: s.getReservationTimeouts()}
+		case "archiverg":
+			// archive the complete jobs of a RepGroup, optionally removing
+			// them from the database
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				archive, keys, err := s.archiveRepGroup(cr.Job.RepGroup)
+				if err == nil && cr.Prune {
+					err = s.db.deleteCompleteRepGroup(cr.Job.RepGroup, keys)
+					if err == nil {
+						s.Debug("archived and removed RepGroup", "rg", cr.Job.RepGroup, "jobs", len(keys))
+					}
+				}
+				if err != nil {
+					srerr = ErrBadRequest
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Archive: archive}
+				}
+			}
+		case "restorerg":
+			// store a RepGroup archive for read-only viewing
+			a, err := DecodeRepGroupArchive(cr.File)
+			if err == nil {
+				err = s.db.storeRestoredRepGroup(a.RepGroup, cr.File)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{RepGroups: []string{a.RepGroup}}
+				}
+			} else {
+				srerr = ErrBadRequest
+				qerr = err.Error()
+			}
+		case "getrestored":
+			// list the restored RepGroup archives, or get one of them
+			if cr.Job != nil && cr.Job.RepGroup != "" {
+				sr = &serverResponse{Archive: s.db.retrieveRestoredRepGroup(cr.Job.RepGroup)}
+			} else {
+				rgs, err := s.db.retrieveRestoredRepGroups()
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{RepGroups: rgs}
+				}
+			}
+		case "gethostusage":
+			// get what each host is running and how busy it is
+			sr = &serverResponse{HostUsage: s.getHostUsage()}
+		case "getresources":
+			// get a summary of the utilisation of the hosts
+			sr = &serverResponse{Resources: s.resourceUsage()}
+		case "setfairshare":
+			// change how capacity is shared between users or RepGroups
+			if mode, err := ParseFairShare(cr.FairShare); err != nil {
+				srerr = ErrBadRequest
+				qerr = err.Error()
+			} else {
+				s.setFairShare(mode)
+				s.Debug("changed fair share mode", "mode", mode)
+			}
+		case "getfairshare":
+			// get how capacity is shared between users or RepGroups
+			sr = &serverResponse{FairShare: s.getFairShare()}
+		case "rgrate":
+			// set or remove the start rate limit of a RepGroup
+			if cr.Job == nil || cr.Job.RepGroup == "" || cr.Limit < 0 {
+				srerr = ErrBadRequest
+			} else {
+				var err error
+				srerr, err = s.setRepGroupStartRate(cr.Job.RepGroup, cr.Limit)
+				if err != nil {
+					qerr = err.Error()
+				} else {
+					s.q.TriggerReadyAddedCallback()
+				}
+			}
+		case "rgfail":
+			// set or remove the FailRules of a RepGroup
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				var err error
+				srerr, err = s.setRepGroupFailRules(cr.Job.RepGroup, cr.FailRules)
+				if err != nil {
+					qerr = err.Error()
+				}
+			}
+		case "rghostfail":
+			// set or remove the HostFailurePolicy of a RepGroup
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				var err error
+				srerr, err = s.setRepGroupHostFailurePolicy(cr.Job.RepGroup, cr.HostFailurePolicy)
+				if err != nil {
+					qerr = err.Error()
+				}
+			}
+		case "getfails":
+			// cluster the buried jobs, optionally only those in a RepGroup
+			repGroup := ""
+			if cr.Job != nil {
+				repGroup = cr.Job.RepGroup
+			}
+			var clusters []*FailureCluster
+			clusters, srerr, qerr = s.failureClusters(repGroup, cr.Search, cr.Namespace)
+			if srerr == "" {
+				sr = &serverResponse{Clusters: clusters}
+			}
+		case "getfailsum":
+			// as getfails, but without the keys of the clustered jobs
+			repGroup := ""
+			if cr.Job != nil {
+				repGroup = cr.Job.RepGroup
+			}
+			var clusters []*FailureCluster
+			clusters, srerr, qerr = s.failureSummaries(repGroup, cr.Search, cr.Namespace)
+			if srerr == "" {
+				sr = &serverResponse{Clusters: clusters}
+			}
+		case "enroltoken":
+			// create a one-time token for a host to enrol with
+			if s.enrol == nil {
+				srerr = ErrBadRequest
+				qerr = errEnrolDisabled.Error()
+			} else if cr.Timeout <= 0 {
+				srerr = ErrBadRequest
+			} else {
+				token, err := s.enrol.newToken(cr.Timeout)
+				if err != nil {
+					srerr = ErrInternalError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{EnrolToken: token}
+				}
+			}
+		case "getenrolled":
+			// get the inventory of enrolled hosts
+			if s.enrol == nil {
+				srerr = ErrBadRequest
+				qerr = errEnrolDisabled.Error()
+			} else {
+				sr = &serverResponse{Enrolled: s.enrol.inventory()}
+			}
+		case "revokeenrol":
+			// stop accepting the client certificates of an enrolled host
+			if s.enrol == nil {
+				srerr = ErrBadRequest
+				qerr = errEnrolDisabled.Error()
+			} else if cr.Host == "" {
+				srerr = ErrBadRequest
+			} else {
+				revoked, err := s.revokeEnrolment(cr.Host)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Existed: revoked}
+				}
+			}
+		case "getutil":
+			// get the recorded history of queue depths and utilisation
+			snaps, thisSrerr, err := s.getUtilisation(cr.From, cr.To, cr.Step)
+			if err != nil {
+				srerr = thisSrerr
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Utilisation: snaps}
+			}
+		case "getusage":
+			// get the monthly rollups of the resources each user and RepGroup
+			// consumed
+			records, thisSrerr, err := s.getUsage(cr.From, cr.To)
+			if err != nil {
+				srerr = thisSrerr
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Usage: records}
+			}
+		case "getexport":
+			// get the resources consumed by complete jobs, grouped as desired
+			records, thisSrerr, err := s.exportUsage(cr.From, cr.To, cr.ExportBy, cr.Namespace)
+			if err != nil {
+				srerr = thisSrerr
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Export: records}
+			}
+		case "setpolicy":
+			// create or replace a Policy
+			var err error
+			srerr, err = s.setPolicy(cr.Policy)
+			if err != nil {
+				qerr = err.Error()
+			}
+		case "delpolicy":
+			// forget a Policy
+			if cr.Policy == nil || cr.Policy.Name == "" {
+				srerr = ErrBadRequest
+			} else {
+				var err error
+				srerr, err = s.deletePolicy(cr.Policy.Name)
+				if err != nil {
+					qerr = err.Error()
+				}
+			}
+		case "rgpolicy":
+			// assign a Policy to a RepGroup, or unassign it
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				var err error
+				srerr, err = s.setRepGroupPolicy(cr.Job.RepGroup, cr.Job.Policy)
+				if err != nil {
+					qerr = err.Error()
+				}
+			}
+		case "getpolicies":
+			// get all the Policies and the RepGroups they're assigned to
+			policies, assigned := s.getPolicies()
+			sr = &serverResponse{Policies: policies, RGPolicies: assigned}
+		case "setqueue":
+			// create or replace the config of a named queue
+			var err error
+			srerr, err = s.setQueueConfig(cr.Queue)
+			if err != nil {
+				qerr = err.Error()
+			}
+		case "delqueue":
+			// forget the config of a named queue
+			if cr.Queue == nil || cr.Queue.Name == "" {
+				srerr = ErrBadRequest
+			} else {
+				var err error
+				srerr, err = s.deleteQueueConfig(cr.Queue.Name)
+				if err != nil {
+					qerr = err.Error()
+				}
+			}
+		case "getqueues":
+			// get details of the named queues
+			sr = &serverResponse{Queues: s.getQueues(cr.Namespace)}
+		case "getprogress":
+			// get the throughput and ETA of RepGroups
+			sr = &serverResponse{Progress: s.repGroupProgress(cr.RepGroups)}
+		case "settriage":
+			// replace the rules for triaging buried jobs
+			var err error
+			srerr, err = s.setTriageRules(cr.TriageRules)
+			if err != nil {
+				qerr = err.Error()
+			}
+		case "gettriage":
+			// get the rules for triaging buried jobs and their hit counts
+			sr = &serverResponse{TriageRules: s.getTriageRules()}
+		case "setsecret":
+			// encrypt and store a secret
+			var err error
+			srerr, err = s.setSecret(cr.Secret, rq, cr.User)
+			if err != nil {
+				qerr = err.Error()
+			}
+		case "delsecret":
+			// forget a secret
+			if cr.Secret == nil || cr.Secret.Name == "" {
+				srerr = ErrBadRequest
+			} else {
+				var err error
+				srerr, err = s.deleteSecret(cr.Secret.Name, rq, cr.User)
+				if err != nil {
+					qerr = err.Error()
+				}
+			}
+		case "getsecrets":
+			// get the names of the stored secrets the user can use
+			names, err := s.secretNames(cr.Namespace, rq.owner(""))
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{SecretNames: names}
+			}
+		case "getjobevents":
+			// get the history of a job
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				events, err := s.db.retrieveJobEvents(cr.Keys[0])
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{JobEvents: events}
+				}
+			}
+		case "getrgs":
+			// count the jobs in each RepGroup per state
+			if len(cr.RepGroups) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				var counts map[string]map[JobState]int
+				counts, srerr, qerr = s.getRepGroupStates(cr.RepGroups)
+				if srerr == "" {
+					rgss := make([]*repGroupState, 0, len(counts))
+					for rg, states := range counts {
+						if len(states) == 0 {
+							rgss = append(rgss, &repGroupState{RepGroup: rg})
+						}
+						for state, count := range states {
+							rgss = append(rgss, &repGroupState{rg, state, count})
+						}
+					}
+					sr = &serverResponse{RGStates: rgss}
+				}
+			}
+		case "waitjobs":
+			// wait for jobs with the given keys or RepGroup to finish
+			if len(cr.Keys) == 0 && (cr.Job == nil || cr.Job.RepGroup == "") {
+				srerr = ErrBadRequest
+			} else {
+				repgroup := ""
+				if cr.Job != nil {
+					repgroup = cr.Job.RepGroup
+				}
+				var jobs []*Job
+				jobs, srerr, qerr = s.waitForJobs(cr.Keys, repgroup, cr.Timeout)
 				if len(jobs) > 0 {
 					sr = &serverResponse{Jobs: jobs}
 				}
 			}
+		case "subscribe":
+			// start buffering job state count changes for this client
+			repgroup := ""
+			if cr.Job != nil {
+				repgroup = cr.Job.RepGroup
+			}
+			s.subscribeStatus(cr.ClientID.String(), repgroup)
+		case "substatus":
+			// wait for and return this client's job state count changes
+			var counts []*JobStateCount
+			counts, srerr = s.statusUpdates(cr.ClientID.String(), cr.Timeout)
+			if len(counts) > 0 {
+				sr = &serverResponse{StateCounts: counts}
+			}
+		case "unsubscribe":
+			s.unsubscribeStatus(cr.ClientID.String())
 		case "getin":
 			// get all jobs in the jobqueue
-			jobs := s.getJobsCurrent(cr.Limit, cr.State, cr.GetStd, cr.GetEnv)
+			jobs := s.getJobsCurrent(cr.Limit, cr.State, cr.Filter, cr.GetStd, cr.GetEnv)
 			if len(jobs) > 0 {
 				sr = &serverResponse{Jobs: jobs}
 			}
+		case "getsched":
+			sr = &serverResponse{SchedStatus: s.getSchedulerStatus()}
 		case "getbcs":
 			servers := s.getBadServers()
 			if cr.ConfirmDeadCloudServers {
@@ -669,6 +1483,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					}
 					server := s.badServers[badServer.ID]
 					delete(s.badServers, badServer.ID)
+					delete(s.badServerActions, badServer.ID)
 					if server != nil && server.IsBad() {
 						errd := server.Destroy()
 						if errd != nil {
@@ -727,7 +1542,11 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 	// on error, just send the error back to client and return a more detailed
 	// error for logging
 	if srerr != "" {
-		errr := s.reply(m, &serverResponse{Err: srerr})
+		sr = &serverResponse{Err: srerr}
+		if srerr == ErrJobRejected {
+			sr.Reason = qerr
+		}
+		errr := s.reply(m, sr, accept)
 		if errr != nil {
 			s.Warn("reply to client failed", "err", errr)
 		}
@@ -744,10 +1563,12 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 	// some commands don't return anything to the client
 	if sr == nil {
 		sr = &serverResponse{}
+	} else if cr.Namespace != "" {
+		s.namespaceResponse(sr, cr.Namespace)
 	}
 
 	// send reply to client
-	return s.reply(m, sr) // *** log failure to reply?
+	return s.reply(m, sr, accept) // *** log failure to reply?
 }
 
 // for the many j* methods in handleRequest, we do this common stuff to get
@@ -771,6 +1592,19 @@ func (s *Server) getij(cr *clientRequest, checkRunning bool) (*queue.Item, *Job,
 	return item, job, ""
 }
 
+// decompressJobs decompresses and decodes the output of
+// Client.compressJobs().
+func (s *Server) decompressJobs(jobsc []byte) ([]*Job, error) {
+	decompressed, err := decompress(jobsc)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	dec := codec.NewDecoderBytes(decompressed, s.ch)
+	err = dec.Decode(&jobs)
+	return jobs, err
+}
+
 func (s *Server) itemStateToJobState(itemState queue.ItemState, lost bool) JobState {
 	state := itemsStateToJobState[itemState]
 	if state == "" {
@@ -797,48 +1631,87 @@ func (s *Server) itemToJob(item *queue.Item, getStd bool, getEnv bool) *Job {
 	req := &scheduler.Requirements{}
 	*req = *sjob.Requirements // copy reqs since server changes these, avoiding a race condition
 	job := &Job{
-		RepGroup:      sjob.RepGroup,
-		ReqGroup:      sjob.ReqGroup,
-		LimitGroups:   sjob.LimitGroups,
-		DepGroups:     sjob.DepGroups,
-		Cmd:           sjob.Cmd,
-		Cwd:           sjob.Cwd,
-		CwdMatters:    sjob.CwdMatters,
-		ChangeHome:    sjob.ChangeHome,
-		ActualCwd:     sjob.ActualCwd,
-		Requirements:  req,
-		Priority:      sjob.Priority,
-		Retries:       sjob.Retries,
-		PeakRAM:       sjob.PeakRAM,
-		PeakDisk:      sjob.PeakDisk,
-		Exited:        sjob.Exited,
-		Exitcode:      sjob.Exitcode,
-		FailReason:    sjob.FailReason,
-		StartTime:     sjob.StartTime,
-		EndTime:       sjob.EndTime,
-		Pid:           sjob.Pid,
-		Host:          sjob.Host,
-		HostID:        sjob.HostID,
-		HostIP:        sjob.HostIP,
-		CPUtime:       sjob.CPUtime,
-		State:         state,
-		Attempts:      sjob.Attempts,
-		UntilBuried:   sjob.UntilBuried,
-		ReservedBy:    sjob.ReservedBy,
-		EnvKey:        sjob.EnvKey,
-		EnvOverride:   sjob.EnvOverride,
-		Dependencies:  sjob.Dependencies,
-		Behaviours:    sjob.Behaviours,
-		MountConfigs:  sjob.MountConfigs,
-		MonitorDocker: sjob.MonitorDocker,
-		BsubMode:      sjob.BsubMode,
-		BsubID:        sjob.BsubID,
+		RepGroup:         sjob.RepGroup,
+		ReqGroup:         sjob.ReqGroup,
+		LimitGroups:      sjob.LimitGroups,
+		DepGroups:        sjob.DepGroups,
+		Cmd:              sjob.Cmd,
+		Steps:            sjob.Steps,
+		Cwd:              sjob.Cwd,
+		CwdMatters:       sjob.CwdMatters,
+		ChangeHome:       sjob.ChangeHome,
+		ActualCwd:        sjob.ActualCwd,
+		Requirements:     req,
+		Priority:         sjob.Priority,
+		Retries:          sjob.Retries,
+		PeakRAM:          sjob.PeakRAM,
+		PeakDisk:         sjob.PeakDisk,
+		InputStats:       sjob.InputStats,
+		Outputs:          sjob.Outputs,
+		Inputs:           sjob.Inputs,
+		VerifyOutputs:    sjob.VerifyOutputs,
+		ExpectedOutputs:  sjob.ExpectedOutputs,
+		RetryOverrides:   sjob.RetryOverrides,
+		Artifacts:        sjob.Artifacts,
+		PriorArtifacts:   sjob.PriorArtifacts,
+		StepResults:      sjob.StepResults,
+		BehaviourTries:   sjob.BehaviourTries,
+		Exited:           sjob.Exited,
+		Exitcode:         sjob.Exitcode,
+		LostReport:       sjob.LostReport,
+		LostReason:       sjob.LostReason,
+		FailReason:       sjob.FailReason,
+		StartTime:        sjob.StartTime,
+		EndTime:          sjob.EndTime,
+		Pid:              sjob.Pid,
+		Host:             sjob.Host,
+		HostID:           sjob.HostID,
+		HostIP:           sjob.HostIP,
+		CPUtime:          sjob.CPUtime,
+		State:            state,
+		Attempts:         sjob.Attempts,
+		UntilBuried:      sjob.UntilBuried,
+		FailureCounts:    copyFailureCounts(sjob.FailureCounts),
+		TriageRetries:    copyFailureCounts(sjob.TriageRetries),
+		ReservedBy:       sjob.ReservedBy,
+		EnvKey:           sjob.EnvKey,
+		EnvOverride:      sjob.EnvOverride,
+		Dependencies:     sjob.Dependencies,
+		Behaviours:       sjob.Behaviours,
+		MountConfigs:     sjob.MountConfigs,
+		MonitorDocker:    sjob.MonitorDocker,
+		LostPolicy:       sjob.LostPolicy,
+		RetryPolicy:      sjob.RetryPolicy,
+		ContainerImage:   sjob.ContainerImage,
+		EnvSecrets:       sjob.EnvSecrets,
+		ContainerRuntime: sjob.ContainerRuntime,
+		Network:          sjob.Network,
+		NetworkCap:       sjob.NetworkCap,
+		BsubMode:         sjob.BsubMode,
+		BsubID:           sjob.BsubID,
+		IdempotencyKey:   sjob.IdempotencyKey,
+		Name:             sjob.Name,
+		ArrayIndex:       sjob.ArrayIndex,
+		Metadata:         sjob.Metadata,
+		Tags:             sjob.Tags,
+		EnvModules:       sjob.EnvModules,
+		RunWindow:        sjob.RunWindow,
+		FitRunWindow:     sjob.FitRunWindow,
+		Schedule:         sjob.Schedule,
+		NotifyComplete:   sjob.NotifyComplete,
+		NotifyFailure:    sjob.NotifyFailure,
+		SameHostAs:       sjob.SameHostAs,
+		AvoidRepGroup:    sjob.AvoidRepGroup,
+		AvoidHosts:       sjob.AvoidHosts,
+		Namespace:        sjob.Namespace,
+		User:             sjob.User,
 	}
 
 	if state == JobStateReserved && !sjob.StartTime.IsZero() {
 		job.State = JobStateRunning
 	}
 	sjob.RUnlock()
+	job.PendingReasons = s.pendingReasons(item, sjob, state)
 	s.jobPopulateStdEnv(job, getStd, getEnv)
 	return job
 }
@@ -857,17 +1730,169 @@ func (s *Server) jobPopulateStdEnv(job *Job, getStd bool, getEnv bool) {
 	}
 }
 
+// modifyJobs does the server side of Client.Modify() and ModifyJobs(),
+// applying the modifier to those of the jobs with the given keys that are not
+// running. If attempts is not nil, it holds the Attempts of each job when the
+// client read it, and no jobs are modified if any of them has since started
+// running or been removed; their keys are returned as conflicts. The srerr
+// return value is one of our Err* constants.
+func (s *Server) modifyJobs(keys []string, attempts []uint32, modifier *JobModifier) (modified map[string]string, conflicts []string, srerr string, qerr string) {
+	// to avoid race conditions with jobs that are currently pending, but
+	// become running in the middle of us trying to modify them, we first pause
+	// the server, and resume it afterwards
+	paused, err := s.Pause()
+	if err != nil {
+		if jqerr, ok := err.(Error); ok {
+			srerr = jqerr.Err
+		} else {
+			srerr = ErrInternalError
+		}
+		return nil, nil, srerr, err.Error()
+	}
+	if paused {
+		s.Debug("modify requested, paused server")
+	} else {
+		s.Debug("modify requested")
+	}
+
+	var toModifyJobs []*Job
+	toModifyKeys := make(map[string]*Job)
+	for i, jobkey := range keys {
+		item, err := s.q.Get(jobkey)
+		if err != nil || item == nil {
+			if attempts != nil {
+				conflicts = append(conflicts, jobkey)
+			}
+			continue
+		}
+		iState := item.Stats().State
+		job := item.Data().(*Job)
+		if attempts != nil && (iState == queue.ItemStateRun || i >= len(attempts) || job.getAttempts() != attempts[i]) {
+			conflicts = append(conflicts, jobkey)
+			continue
+		}
+		if iState == queue.ItemStateRun {
+			continue
+		}
+		toModifyJobs = append(toModifyJobs, job)
+		toModifyKeys[jobkey] = job
+	}
+
+	// if the caller wanted conflict detection, we don't modify any jobs if
+	// some of them started running since they were read
+	if len(conflicts) > 0 {
+		toModifyJobs = nil
+	}
+
+	modified, err = modifier.Modify(toModifyJobs, s)
+	if err != nil {
+		if jqerr, ok := err.(Error); ok {
+			srerr = jqerr.Err
+		} else {
+			srerr = ErrInternalError
+		}
+		qerr = err.Error()
+	}
+
+	if err == nil && len(modified) > 0 {
+		var toModify []*Job
+		for _, old := range modified {
+			job := toModifyKeys[old]
+			if job != nil {
+				toModify = append(toModify, job)
+			}
+		}
+
+		// additional handling of changed limit groups
+		if modifier.LimitGroupsSet {
+			limitGroups := make(map[string]int)
+			for _, job := range toModify {
+				err := s.handleUserSpecifiedJobLimitGroups(job, limitGroups)
+				if err != nil {
+					s.Error("failed to modify limit group", "err", err)
+				}
+			}
+			err := s.storeLimitGroups(limitGroups)
+			if err != nil {
+				s.Error("failed to store limit groups", "err", err)
+			}
+		}
+
+		// update changed keys in the queue and in our rpl lookup
+		keyToRP := make(map[string]string)
+		for _, job := range toModify {
+			keyToRP[job.Key()] = job.RepGroup
+		}
+		s.rpl.Lock()
+		for new, old := range modified {
+			if old == new {
+				continue
+			}
+			errc := s.q.ChangeKey(old, new)
+			if errc != nil {
+				s.Error("failed to change a job key in the queue", "err", errc)
+			}
+
+			rp := keyToRP[new]
+			if _, exists := s.rpl.lookup[rp]; !exists {
+				s.rpl.lookup[rp] = make(map[string]bool)
+			}
+			delete(s.rpl.lookup[rp], old)
+			s.rpl.lookup[rp][new] = true
+		}
+		s.rpl.Unlock()
+
+		// update db live bucket and dep lookups
+		if len(toModify) > 0 {
+			oldKeys := make([]string, len(toModify))
+			for i, job := range toModify {
+				oldKeys[i] = modified[job.Key()]
+			}
+			errm := s.db.modifyLiveJobs(oldKeys, toModify)
+			if errm != nil {
+				s.Error("job modification in database failed", "err", errm)
+			} else if modifier.DependenciesSet || modifier.PrioritySet {
+				// if we're changing the jobs these jobs are dependant upon or
+				// their priority, that must be reflected in the queue as well
+				for _, job := range toModify {
+					deps, err := job.Dependencies.incompleteJobKeys(s.db)
+					if err != nil {
+						s.Error("failed to get job dependencies", "err", err)
+					}
+					err = s.q.Update(job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, s.lostThreshold(job), deps)
+					if err != nil {
+						s.Error("failed to modify a job in the queue", "err", err)
+					}
+				}
+			}
+		}
+	}
+
+	// now resume the server again
+	resumed, err := s.Resume()
+	if err != nil {
+		s.Error(err.Error())
+	} else if resumed {
+		s.Debug("modify completed, resumed server", "count", len(modified))
+	} else {
+		s.Debug("modify completed", "count", len(modified))
+	}
+
+	return modified, conflicts, srerr, qerr
+}
+
 // reserveWithLimits reserves the next item in the queue (optionally limited to
-// the given scheduler group). If (and only if!) a scheduler group was supplied,
+// the given scheduler group, to fair groups accepted by filter, and to items
+// accepted by match). If (and only if!) a scheduler group was supplied,
 // and it is suffixed with limit groups, those limit groups will be incremented.
 // On success we reserve and return as normal. On failure, we act as if the
 // queue was empty.
-func (s *Server) reserveWithLimits(group string, wait time.Duration) (*queue.Item, error) {
+func (s *Server) reserveWithLimits(group string, wait time.Duration, filter queue.Filter, match queue.Match) (*queue.Item, error) {
 	var item *queue.Item
 	var err error
 	var limitGroups []string
 	if group != "" {
-		limitGroups = s.schedGroupToLimitGroups(group)
+		limitGroups = limitGroupTokens(s.schedGroupToLimitGroups(group))
 		if len(limitGroups) > 0 {
 			// it is better to call Increment before Reserve and possibly use up
 			// the limit for up to wait period if there's no item in the queue,
@@ -881,7 +1906,7 @@ func (s *Server) reserveWithLimits(group string, wait time.Duration) (*queue.Ite
 		}
 	}
 
-	item, err = s.q.Reserve(group, wait)
+	item, err = s.q.ReserveFiltered([]string{group}, wait, filter, match)
 
 	if len(limitGroups) > 0 {
 		if item == nil {
@@ -905,14 +1930,37 @@ func (s *Server) schedGroupToLimitGroups(group string) []string {
 	return nil
 }
 
-// reply to a client
-func (s *Server) reply(m *mangos.Message, sr *serverResponse) error {
+// limitGroupTokens takes limit groups that may be suffixed with a usage (like
+// name*usage) and returns the group names, each repeated as many times as its
+// usage, suitable for passing to our limiter.
+func limitGroupTokens(groups []string) []string {
+	tokens := make([]string, 0, len(groups))
+	for _, group := range groups {
+		name, usage, err := splitLimitGroupUsage(group)
+		if err != nil {
+			tokens = append(tokens, group)
+			continue
+		}
+		for i := 0; i < usage; i++ {
+			tokens = append(tokens, name)
+		}
+	}
+	return tokens
+}
+
+// reply to a client, compressing the reply with the given algorithm (which the
+// client said it accepts) if it is large.
+func (s *Server) reply(m *mangos.Message, sr *serverResponse, compression string) error {
 	var encoded []byte
 	enc := codec.NewEncoderBytes(&encoded, s.ch)
 	err := enc.Encode(sr)
 	if err != nil {
 		return err
 	}
+	encoded, err = frameWire(encoded, compression)
+	if err != nil {
+		return err
+	}
 	m.Body = encoded
 	err = s.sock.SendMsg(m)
 	return err
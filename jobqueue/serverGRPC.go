@@ -0,0 +1,322 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the gRPC interface to the server (see
+// jobqueuepb/jobqueue.proto), which lets clients written in other languages
+// add and get jobs and watch their states change.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/jobqueuepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcManager implements jobqueuepb.ManagerServer using a Server's internals.
+type grpcManager struct {
+	s *Server
+}
+
+// newGRPCServer creates a gRPC server that serves the jobqueuepb.Manager
+// service over TLS using the given certificate and key, authenticating every
+// call with our Authenticator.
+func (s *Server) newGRPCServer(certFile, keyFile string) (*grpc.Server, error) {
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	gs := grpc.NewServer(
+		grpc.Creds(creds),
+		grpc.UnaryInterceptor(s.grpcUnaryAuth),
+		grpc.StreamInterceptor(s.grpcStreamAuth),
+	)
+	jobqueuepb.RegisterManagerServer(gs, &grpcManager{s: s})
+	return gs, nil
+}
+
+// grpcUnaryAuth is a grpc.UnaryServerInterceptor that authenticates calls
+// before handling them.
+func (s *Server) grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.grpcAuthenticate(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// grpcStreamAuth is a grpc.StreamServerInterceptor that authenticates calls
+// before handling them.
+func (s *Server) grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.grpcAuthenticate(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// grpcAuthenticate checks the token in the "authorization" metadata of the
+// given call context against our Authenticator.
+func (s *Server) grpcAuthenticate(ctx context.Context, method string) error {
+	req := &AuthRequest{Kind: AuthKindGRPC, Method: method}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, val := range md.Get("authorization") {
+			if strings.HasPrefix(val, bearerSchema) {
+				req.Token = []byte(val[len(bearerSchema):])
+				break
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		req.RemoteIP = addrIP(p.Addr.String())
+	}
+
+	err := s.authenticate(req)
+	switch {
+	case err == nil:
+		return nil
+	case err == errAuthNoToken || err == errAuthInvalidToken:
+		return status.Error(codes.Unauthenticated, err.Error())
+	default:
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+}
+
+// grpcError converts the errors returned by our internal methods in to a gRPC
+// status error.
+func grpcError(srerr string, qerr string) error {
+	code := codes.Internal
+	switch srerr {
+	case ErrBadRequest, ErrBadLimitGroup, ErrBadRunWindow, ErrBadFailRule, ErrBadNamespace, ErrBadJobName, ErrBadJobMetadata, ErrBadJobTags, ErrBadPolicy, ErrBadSchedule, ErrBadNotify:
+		code = codes.InvalidArgument
+	case ErrJobRejected, ErrPermissionDenied:
+		code = codes.PermissionDenied
+	case ErrJobNameTaken:
+		code = codes.AlreadyExists
+	case ErrQueueClosed, ErrBeingDrained:
+		code = codes.Unavailable
+	}
+	if qerr == "" {
+		qerr = srerr
+	}
+	return status.Error(code, qerr)
+}
+
+// AddJobs implements jobqueuepb.ManagerServer, adding the jobs the same way
+// the REST API does.
+func (g *grpcManager) AddJobs(ctx context.Context, req *jobqueuepb.AddJobsRequest) (*jobqueuepb.AddJobsResponse, error) {
+	jd := &JobDefaults{RepGrp: "manually_added"}
+	inputJobs := make([]*Job, 0, len(req.Jobs))
+	for _, pj := range req.Jobs {
+		job, err := pbJobToJVJ(pj).Convert(jd)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("there was a problem interpreting your job: %s", err))
+		}
+		inputJobs = append(inputJobs, job)
+	}
+
+	envkey, err := g.s.db.storeEnv([]byte{})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	added, dups, _, srerr, err := g.s.createJobs(inputJobs, envkey, req.IgnoreComplete)
+	if err != nil {
+		return nil, grpcError(srerr, err.Error())
+	}
+
+	resp := &jobqueuepb.AddJobsResponse{Added: int32(added), Existed: int32(dups), Keys: make([]string, len(inputJobs))}
+	for i, job := range inputJobs {
+		resp.Keys[i] = job.Key()
+	}
+	return resp, nil
+}
+
+// GetJobs implements jobqueuepb.ManagerServer, getting the jobs the same way
+// Client.GetByRepGroup() and similar do.
+func (g *grpcManager) GetJobs(ctx context.Context, req *jobqueuepb.GetJobsRequest) (*jobqueuepb.GetJobsResponse, error) {
+	var jobs []*Job
+	var srerr, qerr string
+	state := JobState(req.State)
+	switch {
+	case len(req.Keys) > 0:
+		jobs, srerr, qerr = g.s.getJobsByKeys(req.Keys, req.Std, false)
+	case req.RepGroup != "":
+		jobs, srerr, qerr = g.s.getJobsByRepGroup(req.RepGroup, req.Search, int(req.Limit), state, nil, req.Std, false)
+	case len(req.Tags) > 0:
+		jobs, srerr, qerr = g.s.getJobsByTags(req.Tags, int(req.Limit), state, nil, req.Std, false)
+	default:
+		jobs = g.s.getJobsCurrent(int(req.Limit), state, nil, req.Std, false)
+	}
+	if srerr != "" {
+		return nil, grpcError(srerr, qerr)
+	}
+
+	resp := &jobqueuepb.GetJobsResponse{Jobs: make([]*jobqueuepb.Job, len(jobs))}
+	for i, job := range jobs {
+		resp.Jobs[i] = jobToPBJob(job)
+	}
+	return resp, nil
+}
+
+// WatchJobs implements jobqueuepb.ManagerServer, streaming the JobStateCounts
+// that the status webpage gets, starting with the counts of the current jobs
+// as if they were all new. Like websocket clients, watchers get a bounded
+// queue of changes, so a slow one can't build up a backlog in the server.
+func (g *grpcManager) WatchJobs(req *jobqueuepb.WatchJobsRequest, stream jobqueuepb.Manager_WatchJobsServer) error {
+	s := g.s
+	client := "grpc"
+	if p, ok := peer.FromContext(stream.Context()); ok && p.Addr != nil {
+		client += ":" + p.Addr.String()
+	}
+	client += fmt.Sprintf(":%d", time.Now().UnixNano())
+
+	stop := make(chan bool)
+	defer close(stop)
+	q := s.relayCaster(s.statusCaster, client, "status", stop)
+
+	send := func(jsc *JobStateCount) error {
+		if req.RepGroup != "" && jsc.RepGroup != req.RepGroup {
+			return nil
+		}
+		return stream.Send(&jobqueuepb.JobStateChange{
+			RepGroup: jsc.RepGroup,
+			From:     string(jsc.FromState),
+			To:       string(jsc.ToState),
+			Count:    int32(jsc.Count),
+		})
+	}
+
+	for _, jsc := range s.currentStateCounts(req.RepGroup, "gRPC job watcher") {
+		if err := send(jsc); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-q.overflow:
+			return status.Error(codes.ResourceExhausted, "too slow to keep up with job state changes")
+		case <-q.ready:
+			for _, msg := range q.take() {
+				jsc, ok := msg.(*JobStateCount)
+				if !ok {
+					continue
+				}
+				if err := send(jsc); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// pbJobToJVJ converts a jobqueuepb.Job in to a JobViaJSON, so that it can be
+// Convert()ed in to a Job with defaults applied.
+func pbJobToJVJ(pj *jobqueuepb.Job) *JobViaJSON {
+	jvj := &JobViaJSON{
+		Cmd:        pj.Cmd,
+		Cwd:        pj.Cwd,
+		CwdMatters: pj.CwdMatters,
+		RepGrp:     pj.RepGroup,
+		ReqGrp:     pj.ReqGroup,
+		LimitGrps:  pj.LimitGroups,
+		DepGrps:    pj.DepGroups,
+		Deps:       pj.Deps,
+		Env:        pj.Env,
+		Tags:       pj.Tags,
+	}
+	if pj.Memory > 0 {
+		jvj.Memory = fmt.Sprintf("%dM", pj.Memory)
+	}
+	if pj.Time > 0 {
+		jvj.Time = (time.Duration(pj.Time) * time.Second).String()
+	}
+	if pj.Cpus > 0 {
+		cpus := pj.Cpus
+		jvj.CPUs = &cpus
+	}
+	if pj.Disk > 0 {
+		disk := int(pj.Disk)
+		jvj.Disk = &disk
+	}
+	if pj.Override > 0 {
+		override := int(pj.Override)
+		jvj.Override = &override
+	}
+	if pj.Priority > 0 {
+		priority := int(pj.Priority)
+		jvj.Priority = &priority
+	}
+	if pj.Retries > 0 {
+		retries := int(pj.Retries)
+		jvj.Retries = &retries
+	}
+	return jvj
+}
+
+// jobToPBJob converts a Job in to a jobqueuepb.Job.
+func jobToPBJob(job *Job) *jobqueuepb.Job {
+	job.RLock()
+	defer job.RUnlock()
+	pj := &jobqueuepb.Job{
+		Cmd:         job.Cmd,
+		Cwd:         job.Cwd,
+		CwdMatters:  job.CwdMatters,
+		RepGroup:    job.RepGroup,
+		ReqGroup:    job.ReqGroup,
+		LimitGroups: job.LimitGroups,
+		DepGroups:   job.DepGroups,
+		Deps:        job.Dependencies.DepGroups(),
+		Override:    int32(job.Override),
+		Priority:    int32(job.Priority),
+		Retries:     int32(job.Retries),
+		Tags:        job.Tags,
+		Key:         job.Key(),
+		State:       string(job.State),
+		Exitcode:    int32(job.Exitcode),
+		FailReason:  job.FailReason,
+		Host:        job.Host,
+		Attempts:    int32(job.Attempts),
+		PeakRam:     int32(job.PeakRAM),
+	}
+	if job.Requirements != nil {
+		pj.Memory = int32(job.Requirements.RAM)
+		pj.Time = int64(job.Requirements.Time / time.Second)
+		pj.Cpus = job.Requirements.Cores
+		pj.Disk = int32(job.Requirements.Disk)
+	}
+	if !job.StartTime.IsZero() {
+		pj.StartTime = job.StartTime.Unix()
+	}
+	if !job.EndTime.IsZero() {
+		pj.EndTime = job.EndTime.Unix()
+	}
+	pj.Stdout, _ = job.StdOut()
+	pj.Stderr, _ = job.StdErr()
+	return pj
+}
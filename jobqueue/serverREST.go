@@ -28,6 +28,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -36,6 +37,7 @@ import (
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/VertebrateResequencing/wr/internal"
 	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/queue"
 	"github.com/ugorji/go/codec"
 )
 
@@ -47,6 +49,17 @@ const (
 	restBadServersEndpoint = "/rest/v" + restAPIVersion + "/servers/"
 	restFileUploadEndpoint = "/rest/v" + restAPIVersion + "/upload/"
 	restInfoEndpoint       = "/rest/v" + restAPIVersion + "/info/"
+	restExcludedEndpoint   = "/rest/v" + restAPIVersion + "/excluded/"
+	restArtifactsEndpoint  = "/rest/v" + restAPIVersion + "/artifacts/"
+	restMetricsEndpoint    = "/rest/v" + restAPIVersion + "/metrics/"
+	restEfficiencyEndpoint = "/rest/v" + restAPIVersion + "/efficiency/"
+	restUtilEndpoint       = "/rest/v" + restAPIVersion + "/utilisation/"
+	restUsageEndpoint      = "/rest/v" + restAPIVersion + "/usage/"
+	restExportEndpoint     = "/rest/v" + restAPIVersion + "/export/"
+	restEnrolEndpoint      = "/rest/v" + restAPIVersion + "/enrol/"
+	restEnrolledEndpoint   = "/rest/v" + restAPIVersion + "/enrolled/"
+	restPrometheusEndpoint = restMetricsEndpoint + "prometheus"
+	prometheusEndpoint     = "/metrics"
 	restFormTrue           = "true"
 	bearerSchema           = "Bearer "
 )
@@ -59,11 +72,24 @@ type JobViaJSON struct {
 	DepGrps      []string          `json:"dep_grps"`
 	Deps         []string          `json:"deps"`
 	CmdDeps      Dependencies      `json:"cmd_deps"`
+	NameDeps     []string          `json:"name_deps"`
 	OnFailure    BehavioursViaJSON `json:"on_failure"`
 	OnSuccess    BehavioursViaJSON `json:"on_success"`
 	OnExit       BehavioursViaJSON `json:"on_exit"`
 	Env          []string          `json:"env"`
+	Outputs      []string          `json:"outputs"`
+	ExpectedOuts []string          `json:"expected_outputs"`
+	Inputs       []*Input          `json:"inputs"`
+	NotifyOK     []string          `json:"notify_complete"`
+	NotifyFail   []string          `json:"notify_failure"`
+	EnvModules   []string          `json:"env_modules"`
+	EnvSecrets   []string          `json:"env_secrets"`
 	Cmd          string            `json:"cmd"`
+	Name         string            `json:"name"`
+	Schedule     string            `json:"schedule"`
+	Metadata     json.RawMessage   `json:"metadata"`
+	Tags         map[string]string `json:"tags"`
+	Steps        []string          `json:"steps"`
 	Cwd          string            `json:"cwd"`
 	ReqGrp       string            `json:"req_grp"`
 	// Memory is a number and unit suffix, eg. 1G for 1 Gigabyte.
@@ -71,7 +97,10 @@ type JobViaJSON struct {
 	// Time is a duration with a unit suffix, eg. 1h for 1 hour.
 	Time             string   `json:"time"`
 	RepGrp           string   `json:"rep_grp"`
+	Policy           string   `json:"policy"`
 	MonitorDocker    string   `json:"monitor_docker"`
+	Container        string   `json:"container"`
+	ContainerRuntime string   `json:"container_runtime"`
 	CloudOS          string   `json:"cloud_os"`
 	CloudUser        string   `json:"cloud_username"`
 	CloudScript      string   `json:"cloud_script"`
@@ -81,27 +110,59 @@ type JobViaJSON struct {
 	SchedulerMisc    string   `json:"misc"`
 	BsubMode         string   `json:"bsub_mode"`
 	CPUs             *float64 `json:"cpus"`
+	// RAMRetryMax is a number and unit suffix, eg. 64G for 64 Gigabytes.
+	RAMRetryMax  string   `json:"ram_retry_max"`
+	RAMRetryMult *float64 `json:"ram_retry_mult"`
+	// LostAfter is a duration with a unit suffix, eg. 30m for 30 minutes.
+	LostAfter     string `json:"lost_after"`
+	LostCloudGone bool   `json:"lost_cloud_gone"`
+	// Heartbeat and LostThreshold are also durations with a unit suffix.
+	Heartbeat     string `json:"heartbeat"`
+	LostThreshold string `json:"lost_threshold"`
+	// RetryBackoff and RetryBackoffMax are durations with a unit suffix, eg.
+	// 30s for 30 seconds. These and the other Retry* options make a
+	// RetryPolicy.
+	RetryBackoff     string         `json:"retry_backoff"`
+	RetryBackoffMax  string         `json:"retry_backoff_max"`
+	RetryJitter      *float64       `json:"retry_jitter"`
+	RetryMax         map[string]int `json:"retry_max"`
+	NoRetryExitcodes []int          `json:"no_retry_exitcodes"`
+	// OnExitCode and OnFailReason hold BehavioursViaJSON keyed on the exit
+	// code or FailReason* string that should trigger them.
+	OnExitCode   ExitCodeBehavioursViaJSON   `json:"on_exit_code"`
+	OnFailReason FailReasonBehavioursViaJSON `json:"on_failreason"`
 	// Disk is the number of Gigabytes the cmd will use.
-	Disk        *int `json:"disk"`
-	Override    *int `json:"override"`
-	Priority    *int `json:"priority"`
-	Retries     *int `json:"retries"`
-	CloudOSRam  *int `json:"cloud_ram"`
-	RTimeout    *int `json:"reserve_timeout"`
+	Disk       *int `json:"disk"`
+	Override   *int `json:"override"`
+	Priority   *int `json:"priority"`
+	Retries    *int `json:"retries"`
+	CloudOSRam *int `json:"cloud_ram"`
+	RTimeout   *int `json:"reserve_timeout"`
+	// Network is the number of megabits per second the cmd will use.
+	Network     *int `json:"network"`
 	CwdMatters  bool `json:"cwd_matters"`
 	ChangeHome  bool `json:"change_home"`
 	CloudShared bool `json:"cloud_shared"`
+	VerifyOuts  bool `json:"verify_outputs"`
+	NetworkCap  bool `json:"network_cap"`
 }
 
 // JobDefaults is supplied to JobViaJSON.Convert() to provide default values for
 // the conversion.
 type JobDefaults struct {
-	LimitGroups   []string
-	DepGroups     []string
+	LimitGroups []string
+	DepGroups   []string
+	EnvModules  []string
+	// Tags are given to every cmd, in addition to any tags of their own.
+	Tags map[string]string
+	// EnvSecrets are ENV_VAR=secret_name pairs, as per Job.EnvSecrets.
+	EnvSecrets    []string
 	Deps          Dependencies
 	OnFailure     Behaviours
 	OnSuccess     Behaviours
 	OnExit        Behaviours
+	OnExitCode    Behaviours
+	OnFailReason  Behaviours
 	MountConfigs  MountConfigs
 	compressedEnv []byte
 	RepGrp        string
@@ -111,9 +172,13 @@ type JobDefaults struct {
 	// Env is a comma separated list of key=val pairs.
 	Env           string
 	MonitorDocker string
-	CloudOS       string
-	CloudUser     string
-	CloudFlavor   string
+	// Container is the image to run the cmd in, using ContainerRuntime (docker
+	// by default).
+	Container        string
+	ContainerRuntime string
+	CloudOS          string
+	CloudUser        string
+	CloudFlavor      string
 	// CloudScript is the local path to a script.
 	CloudScript string
 	// CloudConfigFiles is the config files to copy in cloud.Server.CopyOver() format
@@ -121,7 +186,16 @@ type JobDefaults struct {
 	SchedulerQueue   string
 	SchedulerMisc    string
 	BsubMode         string
-	osRAM            string
+	Policy           string
+	NotifyComplete   []string
+	NotifyFailure    []string
+	// LostPolicy is the Job.LostPolicy of cmds that don't specify lost_after,
+	// lost_cloud_gone, heartbeat or lost_threshold.
+	LostPolicy *LostJobPolicy
+	// RetryPolicy is the Job.RetryPolicy of cmds that don't specify any of the
+	// retry_* options or no_retry_exitcodes.
+	RetryPolicy *RetryPolicy
+	osRAM       string
 	// CPUs is the number of CPU cores each cmd will use.
 	CPUs   float64 // Memory is the number of Megabytes each cmd will use. Defaults to 1000.
 	Memory int
@@ -136,12 +210,15 @@ type JobDefaults struct {
 	// to 1000.
 	CloudOSRam int
 	RTimeout   int
+	// Network is the number of megabits per second cmds will use.
+	Network    int
 	CwdMatters bool
 	ChangeHome bool
 	// DiskSet is used to distinguish between Disk not being provided, and
 	// being provided with a value of 0 or more.
 	DiskSet     bool
 	CloudShared bool
+	NetworkCap  bool
 }
 
 // DefaultCwd returns the Cwd value, defaulting to /tmp.
@@ -208,7 +285,7 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 	var cpus float64
 	var dur time.Duration
 	var envOverride []byte
-	var limitGroups, depGroups []string
+	var limitGroups, depGroups, envModules []string
 	var deps Dependencies
 	var behaviours Behaviours
 	var mounts MountConfigs
@@ -221,6 +298,12 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 	}
 
 	cmd = jvj.Cmd
+	if len(jvj.Steps) > 0 {
+		if cmd != "" {
+			return nil, fmt.Errorf("cmd and steps can't both be specified")
+		}
+		cmd = strings.Join(jvj.Steps, stepsCmdJoin)
+	}
 	if cmd == "" {
 		return nil, fmt.Errorf("cmd was not specified")
 	}
@@ -268,6 +351,65 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		mb = int(thismb)
 	}
 
+	var ramRetryMax int
+	if jvj.RAMRetryMax != "" {
+		thismb, err := bytefmt.ToMegabytes(jvj.RAMRetryMax)
+		if err != nil {
+			return nil, fmt.Errorf("ram_retry_max value (%s) was not specified correctly: %s", jvj.RAMRetryMax, err)
+		}
+		ramRetryMax = int(thismb)
+	}
+
+	var ramRetryMult float64
+	if jvj.RAMRetryMult != nil {
+		ramRetryMult = *jvj.RAMRetryMult
+		if ramRetryMult < 0 {
+			return nil, fmt.Errorf("ram_retry_mult value (%v) can't be negative", ramRetryMult)
+		}
+	}
+
+	lostPolicy := jd.LostPolicy
+	if jvj.LostAfter != "" || jvj.LostCloudGone || jvj.Heartbeat != "" || jvj.LostThreshold != "" {
+		lostPolicy = &LostJobPolicy{CloudGone: jvj.LostCloudGone}
+		if jvj.LostAfter != "" {
+			after, err := time.ParseDuration(jvj.LostAfter)
+			if err != nil {
+				return nil, fmt.Errorf("lost_after value (%s) was not specified correctly: %s", jvj.LostAfter, err)
+			}
+			lostPolicy.After = after
+		}
+		if jvj.Heartbeat != "" {
+			heartbeat, err := time.ParseDuration(jvj.Heartbeat)
+			if err != nil {
+				return nil, fmt.Errorf("heartbeat value (%s) was not specified correctly: %s", jvj.Heartbeat, err)
+			}
+			lostPolicy.Heartbeat = heartbeat
+		}
+		if jvj.LostThreshold != "" {
+			threshold, err := time.ParseDuration(jvj.LostThreshold)
+			if err != nil {
+				return nil, fmt.Errorf("lost_threshold value (%s) was not specified correctly: %s", jvj.LostThreshold, err)
+			}
+			lostPolicy.Threshold = threshold
+		}
+		if err := lostPolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	retryPolicy := jd.RetryPolicy
+	if jvj.RetryBackoff != "" || jvj.RetryBackoffMax != "" || jvj.RetryJitter != nil || len(jvj.RetryMax) > 0 || len(jvj.NoRetryExitcodes) > 0 {
+		var jitter float64
+		if jvj.RetryJitter != nil {
+			jitter = *jvj.RetryJitter
+		}
+		var err error
+		retryPolicy, err = NewRetryPolicy(jvj.RetryBackoff, jvj.RetryBackoffMax, jitter, jvj.RetryMax, jvj.NoRetryExitcodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if jvj.Time == "" {
 		dur = jd.DefaultTime()
 	} else {
@@ -319,13 +461,24 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		limitGroups = jvj.LimitGrps
 	}
 
+	if len(jvj.EnvModules) == 0 {
+		envModules = jd.EnvModules
+	} else {
+		envModules = jvj.EnvModules
+	}
+
+	envSecrets := jvj.EnvSecrets
+	if len(envSecrets) == 0 {
+		envSecrets = jd.EnvSecrets
+	}
+
 	if len(jvj.DepGrps) == 0 {
 		depGroups = jd.DepGroups
 	} else {
 		depGroups = jvj.DepGrps
 	}
 
-	if len(jvj.Deps) == 0 && len(jvj.CmdDeps) == 0 {
+	if len(jvj.Deps) == 0 && len(jvj.CmdDeps) == 0 && len(jvj.NameDeps) == 0 {
 		deps = jd.Deps
 	} else {
 		if len(jvj.CmdDeps) > 0 {
@@ -336,6 +489,9 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 				deps = append(deps, NewDepGroupDependency(depgroup))
 			}
 		}
+		for _, name := range jvj.NameDeps {
+			deps = append(deps, NewNameDependency(name))
+		}
 	}
 
 	if len(jvj.Env) > 0 {
@@ -362,6 +518,16 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 	} else if len(jd.OnSuccess) > 0 {
 		behaviours = append(behaviours, jd.OnSuccess...)
 	}
+	if len(jvj.OnExitCode) > 0 {
+		behaviours = append(behaviours, jvj.OnExitCode.Behaviours()...)
+	} else if len(jd.OnExitCode) > 0 {
+		behaviours = append(behaviours, jd.OnExitCode...)
+	}
+	if len(jvj.OnFailReason) > 0 {
+		behaviours = append(behaviours, jvj.OnFailReason.Behaviours()...)
+	} else if len(jd.OnFailReason) > 0 {
+		behaviours = append(behaviours, jd.OnFailReason...)
+	}
 	if len(jvj.OnExit) > 0 {
 		behaviours = append(behaviours, jvj.OnExit.Behaviours(OnExit)...)
 	} else if len(jd.OnExit) > 0 {
@@ -385,6 +551,22 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		monitorDocker = jvj.MonitorDocker
 	}
 
+	container, containerRuntime := jvj.Container, jvj.ContainerRuntime
+	if container == "" {
+		container = jd.Container
+		if containerRuntime == "" {
+			containerRuntime = jd.ContainerRuntime
+		}
+	}
+
+	network := jd.Network
+	if jvj.Network != nil {
+		network = *jvj.Network
+	}
+	if network < 0 {
+		return nil, fmt.Errorf("network can't be negative")
+	}
+
 	// scheduler-specific options
 	other := make(map[string]string)
 	if jvj.CloudOS != "" {
@@ -455,36 +637,96 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		other["rtimeout"] = strconv.Itoa(jd.RTimeout)
 	}
 
+	policy := jvj.Policy
+	if policy == "" {
+		policy = jd.Policy
+	}
+
+	notifyComplete := jvj.NotifyOK
+	if len(notifyComplete) == 0 {
+		notifyComplete = jd.NotifyComplete
+	}
+	notifyFailure := jvj.NotifyFail
+	if len(notifyFailure) == 0 {
+		notifyFailure = jd.NotifyFailure
+	}
+
+	var metadata json.RawMessage
+	if len(jvj.Metadata) > 0 && string(jvj.Metadata) != "null" {
+		metadata = jvj.Metadata
+	}
+
+	var tags map[string]string
+	if len(jd.Tags) > 0 || len(jvj.Tags) > 0 {
+		tags = make(map[string]string, len(jd.Tags)+len(jvj.Tags))
+		for key, val := range jd.Tags {
+			tags[key] = val
+		}
+		for key, val := range jvj.Tags {
+			tags[key] = val
+		}
+	}
+
 	return &Job{
-		RepGroup:      repg,
-		Cmd:           cmd,
-		Cwd:           cwd,
-		CwdMatters:    cwdMatters,
-		ChangeHome:    changeHome,
-		ReqGroup:      rg,
-		Requirements:  &jqs.Requirements{RAM: mb, Time: dur, Cores: cpus, Disk: disk, DiskSet: diskSet, Other: other},
-		Override:      uint8(override),
-		Priority:      uint8(priority),
-		Retries:       uint8(retries),
-		LimitGroups:   limitGroups,
-		DepGroups:     depGroups,
-		Dependencies:  deps,
-		EnvOverride:   envOverride,
-		Behaviours:    behaviours,
-		MountConfigs:  mounts,
-		MonitorDocker: monitorDocker,
-		BsubMode:      bsubMode,
+		RepGroup:         repg,
+		Cmd:              cmd,
+		Name:             jvj.Name,
+		Schedule:         jvj.Schedule,
+		Metadata:         metadata,
+		Tags:             tags,
+		Steps:            jvj.Steps,
+		Cwd:              cwd,
+		CwdMatters:       cwdMatters,
+		ChangeHome:       changeHome,
+		ReqGroup:         rg,
+		Requirements:     &jqs.Requirements{RAM: mb, Time: dur, Cores: cpus, Disk: disk, DiskSet: diskSet, Other: other},
+		Override:         uint8(override),
+		Priority:         uint8(priority),
+		Retries:          uint8(retries),
+		RAMRetryMult:     ramRetryMult,
+		RAMRetryMax:      ramRetryMax,
+		LostPolicy:       lostPolicy,
+		RetryPolicy:      retryPolicy,
+		Policy:           policy,
+		NotifyComplete:   notifyComplete,
+		NotifyFailure:    notifyFailure,
+		LimitGroups:      limitGroups,
+		DepGroups:        depGroups,
+		Dependencies:     deps,
+		EnvOverride:      envOverride,
+		Behaviours:       behaviours,
+		MountConfigs:     mounts,
+		MonitorDocker:    monitorDocker,
+		ContainerImage:   container,
+		ContainerRuntime: containerRuntime,
+		Network:          network,
+		NetworkCap:       jvj.NetworkCap || jd.NetworkCap,
+		EnvModules:       envModules,
+		EnvSecrets:       envSecrets,
+		BsubMode:         bsubMode,
+		Outputs:          jvj.Outputs,
+		VerifyOutputs:    jvj.VerifyOuts,
+		ExpectedOutputs:  jvj.ExpectedOuts,
+		Inputs:           jvj.Inputs,
 	}, nil
 }
 
 // httpAuthorized checks for parameter 'token' and for Authorization header for
-// Bearer token; if not supplied, or the token is wrong, writes out an error to
-// w, otherwise returns true.
+// Bearer token, and checks the request with our Authenticator; if it is not
+// allowed (by default, because the token was not supplied or is wrong), writes
+// out an error to w, otherwise returns true.
 func (s *Server) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := s.httpRequester(w, r)
+	return ok
+}
+
+// httpRequester is like httpAuthorized(), but also returns who made the
+// request, if it is allowed.
+func (s *Server) httpRequester(w http.ResponseWriter, r *http.Request) (*requester, bool) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("form parsing error: %s", err), http.StatusBadRequest)
-		return false
+		return nil, false
 	}
 
 	// try token parameter
@@ -492,24 +734,28 @@ func (s *Server) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
 	if token == "" {
 		// try auth header
 		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return false
-		}
-
-		if !strings.HasPrefix(authHeader, bearerSchema) {
-			http.Error(w, "Authorization requires Bearer scheme", http.StatusUnauthorized)
-			return false
+		if strings.HasPrefix(authHeader, bearerSchema) {
+			token = authHeader[len(bearerSchema):]
 		}
-
-		token = authHeader[len(bearerSchema):]
 	}
 
-	if !tokenMatches([]byte(token), s.token) {
+	areq := httpAuthRequest(r, token)
+	err = s.authenticate(areq)
+	switch {
+	case err == errAuthNoToken && r.Header.Get("Authorization") == "":
+		http.Error(w, "Authorization header required", http.StatusUnauthorized)
+		return nil, false
+	case err == errAuthNoToken:
+		http.Error(w, "Authorization requires Bearer scheme", http.StatusUnauthorized)
+		return nil, false
+	case err == errAuthInvalidToken:
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return false
+		return nil, false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
 	}
-	return true
+	return s.requesterOf(areq), true
 }
 
 // restJobs lets you do CRUD on jobs in the queue.
@@ -523,6 +769,11 @@ func restJobs(s *Server) http.HandlerFunc {
 		}
 
 		// carry out a different action based on the HTTP Verb
+		if namespace := r.Form.Get("namespace"); namespace != "" && !validNamespace.MatchString(namespace) {
+			http.Error(w, ErrBadNamespace, http.StatusBadRequest)
+			return
+		}
+
 		var jobs []*Job
 		var status int
 		var err error
@@ -531,10 +782,12 @@ func restJobs(s *Server) http.HandlerFunc {
 			jobs, status, err = restJobsStatus(r, s)
 		case http.MethodPost:
 			jobs, status, err = restJobsAdd(r, s)
+		case http.MethodPut:
+			jobs, status, err = restJobsRetry(r, s)
 		case http.MethodDelete:
 			jobs, status, err = restJobsCancel(r, s)
 		default:
-			http.Error(w, "So far only GET, POST and DELETE are supported", http.StatusBadRequest)
+			http.Error(w, "So far only GET, POST, PUT and DELETE are supported", http.StatusBadRequest)
 			return
 		}
 
@@ -543,6 +796,12 @@ func restJobs(s *Server) http.HandlerFunc {
 			return
 		}
 
+		if namespace := r.Form.Get("namespace"); namespace != "" {
+			for _, job := range jobs {
+				job.stripNamespace(namespace)
+			}
+		}
+
 		// convert jobs to jstatus
 		jstati := make([]JStatus, len(jobs))
 		for i, job := range jobs {
@@ -567,20 +826,29 @@ func restJobs(s *Server) http.HandlerFunc {
 
 // restJobsStatus gets the status of the requested jobs in the queue. The
 // request url can be suffixed with comma separated job keys or RepGroups.
-// Possible query parameters are search, std, env (which can take a "true"
-// value), limit (a number) and state (one of
+// Possible query parameters are search (which can take a "true" value to treat
+// RepGroups as substrings, or "glob" or "regex" to treat them as patterns, as
+// per RepGroupMatch*), std, env (which can take a "true" value), limit (a number), state (one of
 // delayed|ready|reserved|running|lost|buried|dependent|complete|deletable),
-// where deletable == !(running|complete). Returns the Jobs, a http.Status*
-// value and error.
+// where deletable == !(running|complete), namespace (to only consider jobs
+// in that namespace, see Client.SetNamespace()), and any number of
+// meta.[field] parameters (to only return jobs whose Metadata has those
+// values, see Job.MetadataMatches(); note that limit is applied first).
+// Returns the Jobs, a http.Status* value and error.
 func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
 	// handle possible ?query parameters
 	var search, getStd, getEnv bool
+	var match RepGroupMatch
 	var limit int
 	var state JobState
 	var err error
+	namespace := r.Form.Get("namespace")
 
-	if r.Form.Get("search") == restFormTrue {
+	switch r.Form.Get("search") {
+	case restFormTrue:
 		search = true
+	case string(RepGroupMatchGlob), string(RepGroupMatchRegex):
+		match = RepGroupMatch(r.Form.Get("search"))
 	}
 	if r.Form.Get("std") == restFormTrue {
 		getStd = true
@@ -617,10 +885,10 @@ func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
 		}
 	}
 
+	var jobs []*Job
 	if len(r.URL.Path) > len(restJobsEndpoint) {
 		// get the requested jobs
 		ids := r.URL.Path[len(restJobsEndpoint):]
-		var jobs []*Job
 		for _, id := range strings.Split(ids, ",") {
 			if len(id) == 32 {
 				// id might be a Job.key()
@@ -631,20 +899,45 @@ func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
 				}
 			}
 
-			// id might be a Job.RepGroup
-			theseJobs, _, qerr := s.getJobsByRepGroup(id, search, limit, state, getStd, getEnv)
+			// id might be a Job.Name
+			if key := s.db.jobKeyForName(namespaced(namespace, id)); key != "" {
+				theseJobs, _, qerr := s.getJobsByKeys([]string{key}, getStd, getEnv)
+				if qerr == "" && len(theseJobs) > 0 {
+					jobs = append(jobs, theseJobs...)
+					continue
+				}
+			}
+
+			// id might be a Job.RepGroup, or a pattern matching RepGroups
+			var theseJobs []*Job
+			var srerr, qerr string
+			if match != "" {
+				theseJobs, srerr, qerr = s.getJobsByRepGroupMatch(id, match, namespace, limit, state, nil, getStd, getEnv)
+			} else {
+				theseJobs, srerr, qerr = s.getJobsByRepGroup(namespaced(namespace, id), search, limit, state, nil, getStd, getEnv)
+			}
 			if qerr != "" {
+				if srerr == ErrBadRequest {
+					return nil, http.StatusBadRequest, fmt.Errorf(qerr)
+				}
 				return nil, http.StatusInternalServerError, fmt.Errorf(qerr)
 			}
 			if len(theseJobs) > 0 {
 				jobs = append(jobs, theseJobs...)
 			}
 		}
-		return jobs, http.StatusOK, err
+	} else {
+		// get all current jobs
+		jobs = s.getJobsCurrent(limit, state, nil, getStd, getEnv)
 	}
 
-	// get all current jobs
-	return s.getJobsCurrent(limit, state, getStd, getEnv), http.StatusOK, err
+	if namespace != "" {
+		jobs = jobsInNamespace(jobs, namespace)
+	}
+	if filters := restMetadataFilters(r.Form); len(filters) > 0 {
+		jobs = jobsMatchingMetadata(jobs, filters)
+	}
+	return jobs, http.StatusOK, err
 }
 
 // restJobsAdd creates and adds jobs to the queue and returns them on success.
@@ -652,38 +945,54 @@ func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
 //
 // It optionally takes parameters to use as defaults for the job properties,
 // which correspond to the json properties of a JobViaJSON (except for cmd and
-// cmd_deps). For dep_grps, deps and env, which normally take []string, provide
-// a comma-separated list. mounts, on_failure, on_success and on_exit values
-// should be supplied as url query escaped JSON strings.
+// cmd_deps). For dep_grps, deps, env, env_modules and env_secrets, which
+// normally take []string, provide a comma-separated list, and for tags provide
+// a comma-separated list of key=value pairs. mounts, on_failure, on_success,
+// on_exit, on_exit_code and on_failreason values should be supplied as url
+// query escaped JSON strings. A namespace parameter
+// adds the jobs in that namespace (see Client.SetNamespace()).
 //
 // The returned int is a http.Status* variable.
 func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 	// handle possible ?query parameters
 	_, diskSet := r.Form["disk"]
 	jd := &JobDefaults{
-		Cwd:           r.Form.Get("cwd"),
-		RepGrp:        r.Form.Get("rep_grp"),
-		LimitGroups:   urlStringToSlice(r.Form.Get("limit_grps")),
-		ReqGrp:        r.Form.Get("req_grp"),
-		CPUs:          urlStringToFloat(r.Form.Get("cpus")),
-		Disk:          urlStringToInt(r.Form.Get("disk")),
-		DiskSet:       diskSet,
-		Override:      urlStringToInt(r.Form.Get("override")),
-		Priority:      urlStringToInt(r.Form.Get("priority")),
-		Retries:       urlStringToInt(r.Form.Get("retries")),
-		DepGroups:     urlStringToSlice(r.Form.Get("dep_grps")),
-		Env:           r.Form.Get("env"),
-		MonitorDocker: r.Form.Get("monitor_docker"),
-		CloudOS:       r.Form.Get("cloud_os"),
-		CloudUser:     r.Form.Get("cloud_username"),
-		CloudScript:   r.Form.Get("cloud_script"),
-		CloudFlavor:   r.Form.Get("cloud_flavor"),
-		CloudOSRam:    urlStringToInt(r.Form.Get("cloud_ram")),
-		BsubMode:      r.Form.Get("bsub_mode"),
+		Cwd:              r.Form.Get("cwd"),
+		RepGrp:           r.Form.Get("rep_grp"),
+		LimitGroups:      urlStringToSlice(r.Form.Get("limit_grps")),
+		ReqGrp:           r.Form.Get("req_grp"),
+		CPUs:             urlStringToFloat(r.Form.Get("cpus")),
+		Disk:             urlStringToInt(r.Form.Get("disk")),
+		DiskSet:          diskSet,
+		Override:         urlStringToInt(r.Form.Get("override")),
+		Priority:         urlStringToInt(r.Form.Get("priority")),
+		Retries:          urlStringToInt(r.Form.Get("retries")),
+		DepGroups:        urlStringToSlice(r.Form.Get("dep_grps")),
+		Env:              r.Form.Get("env"),
+		EnvModules:       urlStringToSlice(r.Form.Get("env_modules")),
+		EnvSecrets:       urlStringToSlice(r.Form.Get("env_secrets")),
+		MonitorDocker:    r.Form.Get("monitor_docker"),
+		Container:        r.Form.Get("container"),
+		ContainerRuntime: r.Form.Get("container_runtime"),
+		CloudOS:          r.Form.Get("cloud_os"),
+		CloudUser:        r.Form.Get("cloud_username"),
+		CloudScript:      r.Form.Get("cloud_script"),
+		CloudFlavor:      r.Form.Get("cloud_flavor"),
+		CloudOSRam:       urlStringToInt(r.Form.Get("cloud_ram")),
+		BsubMode:         r.Form.Get("bsub_mode"),
+		Network:          urlStringToInt(r.Form.Get("network")),
+		Policy:           r.Form.Get("policy"),
 	}
 	if jd.RepGrp == "" {
 		jd.RepGrp = "manually_added"
 	}
+	if r.Form.Get("tags") != "" {
+		var err error
+		jd.Tags, err = ParseTags(r.Form.Get("tags"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
 	if r.Form.Get("cwd_matters") == restFormTrue {
 		jd.CwdMatters = true
 	}
@@ -693,6 +1002,9 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 	if r.Form.Get("cloud_shared") == restFormTrue {
 		jd.CloudShared = true
 	}
+	if r.Form.Get("network_cap") == restFormTrue {
+		jd.NetworkCap = true
+	}
 	if r.Form.Get("memory") != "" {
 		mb, err := bytefmt.ToMegabytes(r.Form.Get("memory"))
 		if err != nil {
@@ -707,6 +1019,38 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 			return nil, http.StatusBadRequest, err
 		}
 	}
+	if r.Form.Get("lost_after") != "" || r.Form.Get("lost_cloud_gone") == restFormTrue || r.Form.Get("heartbeat") != "" || r.Form.Get("lost_threshold") != "" {
+		jd.LostPolicy = &LostJobPolicy{CloudGone: r.Form.Get("lost_cloud_gone") == restFormTrue}
+		if r.Form.Get("lost_after") != "" {
+			var err error
+			jd.LostPolicy.After, err = time.ParseDuration(r.Form.Get("lost_after"))
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+		}
+		if r.Form.Get("heartbeat") != "" {
+			var err error
+			jd.LostPolicy.Heartbeat, err = time.ParseDuration(r.Form.Get("heartbeat"))
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+		}
+		if r.Form.Get("lost_threshold") != "" {
+			var err error
+			jd.LostPolicy.Threshold, err = time.ParseDuration(r.Form.Get("lost_threshold"))
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+		}
+		if err := jd.LostPolicy.validate(); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	retryPolicy, err := restFormRetryPolicy(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	jd.RetryPolicy = retryPolicy
 	var rerun bool
 	if r.Form.Get("rerun") == restFormTrue {
 		rerun = true
@@ -747,6 +1091,22 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 			jd.OnExit = bvj.Behaviours(OnExit)
 		}
 	}
+	if r.Form.Get("on_exit_code") != "" {
+		var ecbvj ExitCodeBehavioursViaJSON
+		err := urlStringToStruct(r.Form.Get("on_exit_code"), &ecbvj)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		jd.OnExitCode = ecbvj.Behaviours()
+	}
+	if r.Form.Get("on_failreason") != "" {
+		var frbvj FailReasonBehavioursViaJSON
+		err := urlStringToStruct(r.Form.Get("on_failreason"), &frbvj)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		jd.OnFailReason = frbvj.Behaviours()
+	}
 	if r.Form.Get("mounts") != "" {
 		var mcs MountConfigs
 		err := urlStringToStruct(r.Form.Get("mounts"), &mcs)
@@ -760,7 +1120,7 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 
 	// decode the posted JSON
 	var jvjs []*JobViaJSON
-	err := json.NewDecoder(r.Body).Decode(&jvjs)
+	err = json.NewDecoder(r.Body).Decode(&jvjs)
 	if err != nil {
 		return nil, http.StatusBadRequest, err
 	}
@@ -780,8 +1140,17 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 		return nil, http.StatusInternalServerError, err
 	}
 
-	_, _, _, _, err = s.createJobs(inputJobs, envkey, !rerun)
+	if namespace := r.Form.Get("namespace"); namespace != "" {
+		for _, job := range inputJobs {
+			job.setNamespace(namespace)
+		}
+	}
+
+	_, _, _, srerr, err := s.createJobs(inputJobs, envkey, !rerun)
 	if err != nil {
+		if srerr == ErrJobRejected {
+			return nil, http.StatusForbidden, err
+		}
 		return nil, http.StatusInternalServerError, err
 	}
 
@@ -850,8 +1219,43 @@ func restJobsCancel(r *http.Request, s *Server) ([]*Job, int, error) {
 	return handled, returnStatus, nil
 }
 
-// restWarnings lets you read warnings from the scheduler, and auto-"dismisses"
-// (deletes) them.
+// restJobsRetry retries buried jobs. You identify the jobs to retry in the
+// same way as for restJobsStatus(), except that state is always buried.
+// Returns the retried Jobs, a http.Status* value and error.
+func restJobsRetry(r *http.Request, s *Server) ([]*Job, int, error) {
+	r.Form.Set("state", string(JobStateBuried))
+	jobs, status, err := restJobsStatus(r, s)
+	if err != nil || status != http.StatusOK {
+		return nil, status, err
+	}
+
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		keys[i] = job.Key()
+	}
+	kicked := make(map[string]bool, len(jobs))
+	for _, key := range s.kickJobs(keys, nil, "") {
+		kicked[key] = true
+	}
+
+	var handled []*Job
+	for _, job := range jobs {
+		if kicked[job.Key()] {
+			job.State = JobStateReady
+			job.UntilBuried = job.Retries + 1
+			handled = append(handled, job)
+		}
+	}
+	return handled, http.StatusOK, nil
+}
+
+// restWarnings lets you read warnings from the scheduler, most severe first.
+// By default this auto-"dismisses" (deletes) them. The optional 'severity'
+// parameter limits the warnings to those of the given severity ("info",
+// "warning" or "error"). If the optional 'user' parameter is supplied, only
+// warnings that user hasn't acknowledged since they were last reported are
+// returned, and instead of being deleted they are acknowledged on behalf of
+// that user.
 func restWarnings(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer internal.LogPanic(s.Logger, "jobqueue web server restWarnings", false)
@@ -862,21 +1266,32 @@ func restWarnings(s *Server) http.HandlerFunc {
 		}
 
 		// carry out a different action based on the HTTP Verb
-		sis := []*schedulerIssue{}
+		sis := []*SchedulerIssue{}
 		switch r.Method {
 		case http.MethodGet:
-			s.simutex.Lock()
-			for key, si := range s.schedIssues {
+			severity := r.Form.Get("severity")
+			user := r.Form.Get("user")
+			var msgs []string
+			for _, si := range s.schedulerIssues() {
+				if (severity != "" && string(si.Severity) != severity) || (user != "" && si.AcknowledgedBy(user)) {
+					continue
+				}
 				sis = append(sis, si)
-				delete(s.schedIssues, key)
+				msgs = append(msgs, si.Msg)
+			}
+			if len(msgs) > 0 {
+				if user != "" {
+					s.acknowledgeSchedulerIssues(user, msgs...)
+				} else {
+					s.dismissSchedulerIssues(msgs...)
+				}
 			}
-			s.simutex.Unlock()
 		default:
 			http.Error(w, "Only GET is supported", http.StatusBadRequest)
 			return
 		}
 
-		// return schedulerIssues as JSON
+		// return SchedulerIssues as JSON
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
 		encoder := json.NewEncoder(w)
@@ -925,6 +1340,7 @@ func restBadServers(s *Server) http.HandlerFunc {
 			s.bsmutex.Lock()
 			server := s.badServers[serverID]
 			delete(s.badServers, serverID)
+			delete(s.badServerActions, serverID)
 			s.bsmutex.Unlock()
 			if server == nil {
 				http.Error(w, "Server was not known to be bad", http.StatusNotFound)
@@ -946,6 +1362,120 @@ func restBadServers(s *Server) http.HandlerFunc {
 	}
 }
 
+// restExcluded lets you GET the names of the hosts that have been excluded from
+// running jobs, PUT more host names to exclude them, or DELETE host names to
+// stop excluding them. For PUT and DELETE, supply the names as one or more
+// "host" parameters.
+func restExcluded(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restExcluded", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodDelete:
+			hosts := r.Form["host"]
+			if len(hosts) == 0 {
+				http.Error(w, "host parameter is required", http.StatusBadRequest)
+				return
+			}
+			_, err := s.excludeHosts(hosts, r.Method == http.MethodPut)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Hosts could not be stored: %s", err), http.StatusInternalServerError)
+				return
+			}
+			s.q.TriggerReadyAddedCallback()
+		default:
+			http.Error(w, "Only GET, PUT and DELETE are supported", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(s.getExcludedHosts())
+		if err != nil {
+			s.Warn("restExcluded failed to encode hosts", "err", err)
+		}
+	}
+}
+
+// restArtifacts lets you GET the Artifacts recorded for the job with the key
+// given after the endpoint. If a "path" parameter is supplied that is the Path
+// of one of those Artifacts, the file itself is downloaded instead, as long as
+// it is readable from the machine the server is running on.
+func restArtifacts(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restArtifacts", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		key := strings.TrimSuffix(r.URL.Path[len(restArtifactsEndpoint):], "/")
+		if key == "" {
+			http.Error(w, "a job key is required", http.StatusBadRequest)
+			return
+		}
+		path := r.Form.Get("path")
+		artifacts, artifact, found := s.jobArtifact(s.resolveJobNames([]string{key}, "")[0], path)
+		if !found {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+
+		if path == "" {
+			if artifacts == nil {
+				artifacts = []*Artifact{}
+			}
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusOK)
+			encoder := json.NewEncoder(w)
+			encoder.SetEscapeHTML(false)
+			err := encoder.Encode(artifacts)
+			if err != nil {
+				s.Warn("restArtifacts failed to encode artifacts", "err", err)
+			}
+			return
+		}
+
+		if artifact == nil {
+			http.Error(w, "not an artifact of this job", http.StatusNotFound)
+			return
+		}
+
+		f, err := os.Open(artifact.Path) // #nosec only recorded artifacts can be opened
+		if err != nil {
+			msg := "artifact is not available from the manager's host"
+			if artifact.Remote != "" {
+				msg += "; it was uploaded to " + artifact.Remote
+			}
+			http.Error(w, msg, http.StatusNotFound)
+			return
+		}
+		defer internal.LogClose(s.Logger, f, "artifact", "path", artifact.Path)
+
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, "artifact could not be read", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(artifact.Path)))
+		http.ServeContent(w, r, filepath.Base(artifact.Path), info.ModTime(), f)
+	}
+}
+
 // restFileUpload lets you upload files from a client to the server. The only
 // method supported is PUT.
 func restFileUpload(s *Server) http.HandlerFunc {
@@ -1007,6 +1537,313 @@ func restInfo(s *Server) http.HandlerFunc {
 	}
 }
 
+// restEfficiency lets you GET a RepGroupEfficiency summary of the complete jobs
+// in each RepGroup. The request url can be suffixed with comma separated
+// RepGroups, otherwise the RepGroups of all current jobs are summarised.
+// Possible query parameters are search (which can take a "true" value to treat
+// the RepGroups as substrings) and namespace (to only consider jobs in that
+// namespace, see Client.SetNamespace()).
+func restEfficiency(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue server efficiency", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		var rgs []string
+		if len(r.URL.Path) > len(restEfficiencyEndpoint) {
+			rgs = strings.Split(r.URL.Path[len(restEfficiencyEndpoint):], ",")
+		}
+
+		effs, srerr, qerr := s.repGroupEfficiency(rgs, r.Form.Get("search") == restFormTrue, r.Form.Get("namespace"), "")
+		if srerr != "" {
+			status := http.StatusInternalServerError
+			if srerr == ErrBadRequest {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, qerr, status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(effs)
+		if err != nil {
+			s.Warn("restEfficiency failed to encode RepGroupEfficiencies", "err", err)
+		}
+	}
+}
+
+// restUtilisation lets you get the recorded history of queue depths, running
+// jobs and provisioned capacity (see Client.GetUtilisation()), eg. to chart
+// utilisation over time. Possible query parameters are from and to (RFC 3339
+// times, defaulting to 24 hours ago and now) and step (a duration like "1h",
+// to get only the last snapshot in each step-long period).
+func restUtilisation(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue server utilisation", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		to := time.Now()
+		from := to.Add(-24 * time.Hour)
+		var step time.Duration
+		var err error
+		if val := r.Form.Get("from"); val != "" {
+			from, err = time.Parse(time.RFC3339, val)
+		}
+		if val := r.Form.Get("to"); err == nil && val != "" {
+			to, err = time.Parse(time.RFC3339, val)
+		}
+		if val := r.Form.Get("step"); err == nil && val != "" {
+			step, err = time.ParseDuration(val)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		snaps, srerr, err := s.getUtilisation(from, to, step)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if srerr == ErrBadRequest {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err = encoder.Encode(snaps)
+		if err != nil {
+			s.Warn("restUtilisation failed to encode UtilisationSnapshots", "err", err)
+		}
+	}
+}
+
+// restUsage lets you get the monthly rollups of the resources consumed by each
+// user and RepGroup (see Client.GetUsage()), eg. for chargeback. Possible query
+// parameters are from and to (RFC 3339 times, defaulting to the start of the
+// current month and now), and namespace (to only get the RepGroups of that
+// namespace).
+func restUsage(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue server usage", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		to := time.Now()
+		from := time.Date(to.Year(), to.Month(), 1, 0, 0, 0, 0, time.UTC)
+		var err error
+		if val := r.Form.Get("from"); val != "" {
+			from, err = time.Parse(time.RFC3339, val)
+		}
+		if val := r.Form.Get("to"); err == nil && val != "" {
+			to, err = time.Parse(time.RFC3339, val)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		records, srerr, err := s.getUsage(from, to)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if srerr == ErrBadRequest {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if namespace := r.Form.Get("namespace"); namespace != "" {
+			records = usageInNamespace(records, namespace)
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err = encoder.Encode(records)
+		if err != nil {
+			s.Warn("restUsage failed to encode UsageRecords", "err", err)
+		}
+	}
+}
+
+// restExport lets you download the resources consumed by complete jobs, grouped
+// by user, RepGroup and ReqGroup (see Client.GetExport()), eg. for accounting
+// reports. Possible query parameters are format ("csv", the default, or
+// "json"), from and to (RFC 3339 times that the jobs must have completed
+// between, defaulting to the start of the current month and now), by (a comma
+// separated list of any of "user", "repgroup" and "reqgroup" to group by,
+// defaulting to all of them) and namespace (to only consider jobs in that
+// namespace).
+func restExport(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue server export", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		format := ExportFormatCSV
+		if val := r.Form.Get("format"); val != "" {
+			format = val
+		}
+		contentType := "text/csv; charset=UTF-8"
+		switch format {
+		case ExportFormatCSV:
+		case ExportFormatJSON:
+			contentType = "application/json; charset=UTF-8"
+		default:
+			http.Error(w, "format must be csv or json", http.StatusBadRequest)
+			return
+		}
+
+		to := time.Now()
+		from := time.Date(to.Year(), to.Month(), 1, 0, 0, 0, 0, time.UTC)
+		var by []string
+		var err error
+		if val := r.Form.Get("from"); val != "" {
+			from, err = time.Parse(time.RFC3339, val)
+		}
+		if val := r.Form.Get("to"); err == nil && val != "" {
+			to, err = time.Parse(time.RFC3339, val)
+		}
+		if err == nil {
+			by, err = ParseExportBy(r.Form.Get("by"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		records, srerr, err := s.exportUsage(from, to, by, r.Form.Get("namespace"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if srerr == ErrBadRequest {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		err = WriteExport(w, format, records)
+		if err != nil {
+			s.Warn("restExport failed to write ExportRecords", "err", err)
+		}
+	}
+}
+
+// ServerMetrics is what the REST metrics endpoint returns: the server's
+// current ServerStats, along with metrics on how often its queue's operations
+// have been called and how long they took, and the backlogs of messages
+// waiting to be sent to status webpages.
+type ServerMetrics struct {
+	Stats      *ServerStats
+	QueueOps   *queue.OpMetrics
+	WebSockets []*WebSocketBacklog
+}
+
+// restMetrics lets you get metrics on the server's activity.
+func restMetrics(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue server metrics", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		metrics := &ServerMetrics{
+			Stats:      s.GetServerStats(),
+			QueueOps:   s.q.OpMetrics(),
+			WebSockets: s.webSocketBacklogs(),
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(metrics)
+		if err != nil {
+			s.Warn("restMetrics failed to encode ServerMetrics", "err", err)
+		}
+	}
+}
+
+// restPrometheus lets you get SLO-style metrics on every RepGroup, along with
+// metrics on the queue, scheduler and cloud servers, in the Prometheus text
+// exposition format, for scraping by Prometheus (configured to supply the
+// server token as a bearer token). It is served at both /metrics and
+// restPrometheusEndpoint.
+func restPrometheus(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue server prometheus metrics", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		err := writePrometheusSLOs(w, s.GetRepGroupSLOs(), s.slo.window)
+		if err == nil {
+			err = s.writePrometheusServer(w)
+		}
+		if err != nil {
+			s.Warn("restPrometheus failed to write metrics", "err", err)
+		}
+	}
+}
+
 // restVersion lets you get info on the version of the server and the supported
 // API version (we only support 1 API version at a time). This is the only
 // end point that doesn't need authentication.
@@ -1082,6 +1919,36 @@ func urlStringToStruct(value string, v interface{}) error {
 	return json.Unmarshal([]byte(jsonString), v)
 }
 
+// restFormRetryPolicy makes a RetryPolicy from the retry_* and
+// no_retry_exitcodes form values of the given request, returning nil if there
+// are none.
+func restFormRetryPolicy(r *http.Request) (*RetryPolicy, error) {
+	backoff, backoffMax := r.Form.Get("retry_backoff"), r.Form.Get("retry_backoff_max")
+	jitterStr, codesStr := r.Form.Get("retry_jitter"), r.Form.Get("no_retry_exitcodes")
+	maxStr := r.Form.Get("retry_max")
+	if backoff == "" && backoffMax == "" && jitterStr == "" && codesStr == "" && maxStr == "" {
+		return nil, nil
+	}
+
+	var jitter float64
+	if jitterStr != "" {
+		var err error
+		jitter, err = strconv.ParseFloat(jitterStr, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	codes, err := ParseExitcodes(codesStr)
+	if err != nil {
+		return nil, err
+	}
+	var maxRetries map[string]int
+	if err = urlStringToStruct(maxStr, &maxRetries); err != nil {
+		return nil, err
+	}
+	return NewRetryPolicy(backoff, backoffMax, jitter, maxRetries, codes)
+}
+
 // compressEnv is a slower (?) version of Client.CompressEnv since we have to
 // make a new codec each time
 func compressEnv(envars []string) ([]byte, error) {
@@ -21,12 +21,17 @@ package jobqueue
 // This file contains the web interface code of the server.
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	sync "github.com/sasha-s/go-deadlock"
 
 	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/limiter"
 	"github.com/VertebrateResequencing/wr/queue"
 	"github.com/gorilla/websocket"
 )
@@ -34,16 +39,52 @@ import (
 // jstatusReq is what the status webpage sends us to ask for info about jobs.
 type jstatusReq struct {
 	// possible Requests are:
-	// current = get count info for every job in every RepGroup in the cmds
-	//           queue.
-	// details = get example job details for jobs in the RepGroup, grouped by
-	//           having the same Status, Exitcode and FailReason.
+	// current = get count info for every job in every RepGroup in every
+	//           queue, and the TagFacets of all jobs; with GroupBy, instead
+	//           only get count info for the jobs in each tag group (a
+	//           pseudo-RepGroup like "+tag+sample=42") of the GroupBy tag
+	//           key. Only jobs with all the given Tags (and of the Owner, if
+	//           given) are counted, and live count updates are limited to the
+	//           Owner's jobs from then on. Also says who the viewer is.
+	// queues = get details of the named queues (see QueueInfo).
+	// resources = get a summary of the utilisation of the hosts (see
+	//             ResourceUsage); one is also sent periodically without asking.
+	// details = get example job details for jobs in the RepGroup (which can
+	//           be a tag group), grouped by having the same Status, Exitcode
+	//           and FailReason; Limit (default 1) of them per group, from
+	//           Offset within each group, that pass the Host, MinExitcode,
+	//           MaxExitcode, Cmd, After, Before and Tags filters.
 	// retry = retry buried jobs.
 	// remove = remove non-running jobs.
 	// kill = kill running jobs or confirm lost jobs are dead.
-	// confirmBadServer = confirm that the server with ID ServerID is bad.
-	// dismissMsg = dismiss the given Msg.
-	// dismissMsgs = dismiss all scheduler messages.
+	// modify = change the resource requirements, retries, priority or env of
+	//          non-running jobs as per Modify, then retry them if they were
+	//          buried and Modify.Retry is true.
+	// confirmBadServer = confirm that the server with ID ServerID is bad (admins
+	//                    only).
+	// dismissMsg = dismiss the given Msg for all users (admins only).
+	// dismissMsgs = dismiss all scheduler messages for all users (admins only).
+	// ackMsg = acknowledge the given Msg on behalf of User.
+	// ackMsgs = acknowledge all scheduler messages on behalf of User.
+	// efficiency = get the RepGroupEfficiency of the complete jobs in RepGroup,
+	//              or of every RepGroup with current jobs if RepGroup is blank.
+	// history = get the JobEvents of the job with the given Key.
+	// outputs = get the Artifacts of the complete job with the given Key, or of
+	//           the complete jobs in RepGroup.
+	// limitGroups = change the limit of LimitGroup to Limit (if given; -1 makes
+	//               it unlimited), and get the limit and current usage of every
+	//               limit group that has a limit.
+	// progress = get the RepGroupProgress of every active RepGroup; these are
+	//            also sent every ServerProgressInterval.
+	// triage = get the TriageRules and how many buried jobs each has been
+	//          applied to.
+	// fairShare = change the fair share mode to FairShare (if given), and get
+	//             the current mode.
+	// tail = follow the output of the running job with the given Key, being
+	//        sent new output as it arrives until it stops running, or until
+	//        another tail request (which can have a blank Key to just stop).
+	// depgraph = get the DepGraph of the dependencies between RepGroups, or
+	//            between the jobs of (and connected to) RepGroup if given.
 	Request string
 
 	// sending Key means "give me detailed info about this single job", and
@@ -52,14 +93,401 @@ type jstatusReq struct {
 
 	// sending RepGroup means "send me limited info about the jobs with this
 	// RepGroup", and modifies retry, remove and kill to work on all jobs with
-	// the given RepGroup, ExitCode and FailReason
+	// the given RepGroup, ExitCode and FailReason. It can also be a tag group,
+	// meaning the jobs with that tag.
 	RepGroup string
 
+	// Tags limits current and details to jobs with all of these tags.
+	Tags map[string]string
+
+	// Owner limits current, details, retry, remove, kill and modify to the
+	// jobs added by this user. Viewers who aren't admins are always limited to
+	// their own jobs, whatever they send.
+	Owner string
+
+	// GroupBy is the tag key that current should group jobs by.
+	GroupBy string
+
+	// sending Queue means RepGroup and any job Name given as the Key are in
+	// that named queue, instead of being fully qualified.
+	Queue string
+
 	State      JobState // A Job.State to limit RepGroup by in details mode
 	Exitcode   int
 	FailReason string
-	ServerID   string // required argument for confirmBadServer
-	Msg        string // required argument for dismissMsg
+	ServerID   string         // required argument for confirmBadServer
+	Msg        string         // required argument for dismissMsg and ackMsg
+	User       string         // required argument for ackMsg and ackMsgs
+	FairShare  string         // optional argument for fairShare: user, repgroup or off
+	LimitGroup string         // optional argument for limitGroups, which uses Limit as its new limit
+	Modify     *jstatusModify // required argument for modify
+
+	// optional arguments for details, as per JobFilter
+	Limit       int
+	Offset      int
+	Host        string
+	MinExitcode *int
+	MaxExitcode *int
+	Cmd         string
+	After       time.Time
+	Before      time.Time
+
+	// ProtocolVersion is the version of the protocol the webpage speaks; old
+	// pages don't send it, which means protocolVersionLegacy.
+	ProtocolVersion int
+}
+
+// jobFilter returns a JobFilter made from our details arguments, or nil if
+// none were given.
+func (req jstatusReq) jobFilter() *JobFilter {
+	f := &JobFilter{
+		Offset:      req.Offset,
+		Host:        req.Host,
+		MinExitcode: req.MinExitcode,
+		MaxExitcode: req.MaxExitcode,
+		Cmd:         req.Cmd,
+		After:       req.After,
+		Before:      req.Before,
+		Tags:        req.Tags,
+		User:        req.Owner,
+	}
+	if f.IsEmpty() {
+		return nil
+	}
+	return f
+}
+
+// jstatusModify holds the changes the status webpage wants to make in a modify
+// request. Only the non-nil (or for Time and Env, non-blank) ones are made.
+type jstatusModify struct {
+	RAM      *int   // MB
+	Time     string // a duration like "2h"
+	Cores    *float64
+	Disk     *int // GB
+	Override *int
+	Priority *int
+	Retries  *int
+	Env      string // comma separated key=value pairs
+	Retry    bool
+}
+
+// jobModifier converts our changes in to a JobModifier.
+func (m *jstatusModify) jobModifier() (*JobModifier, error) {
+	jm := NewJobModifer()
+
+	req := &scheduler.Requirements{}
+	var setReq bool
+	if m.RAM != nil {
+		if *m.RAM < 1 {
+			return nil, fmt.Errorf("RAM must be positive")
+		}
+		req.RAM = *m.RAM
+		setReq = true
+	}
+	if m.Time != "" {
+		t, err := time.ParseDuration(m.Time)
+		if err != nil {
+			return nil, err
+		}
+		if t <= 0 {
+			return nil, fmt.Errorf("Time must be positive")
+		}
+		req.Time = t
+		setReq = true
+	}
+	if m.Cores != nil {
+		if *m.Cores < 0 {
+			return nil, fmt.Errorf("Cores can't be negative")
+		}
+		req.Cores = *m.Cores
+		req.CoresSet = true
+		setReq = true
+	}
+	if m.Disk != nil {
+		if *m.Disk < 0 {
+			return nil, fmt.Errorf("Disk can't be negative")
+		}
+		req.Disk = *m.Disk
+		req.DiskSet = true
+		setReq = true
+	}
+	if setReq {
+		jm.SetRequirements(req)
+	}
+
+	if m.Override != nil {
+		if *m.Override < 0 || *m.Override > 2 {
+			return nil, fmt.Errorf("Override must be 0, 1 or 2")
+		}
+		jm.SetOverride(uint8(*m.Override))
+	}
+	if m.Priority != nil {
+		if *m.Priority < 0 || *m.Priority > 255 {
+			return nil, fmt.Errorf("Priority must be in the range 0-255")
+		}
+		jm.SetPriority(uint8(*m.Priority))
+	}
+	if m.Retries != nil {
+		if *m.Retries < 0 || *m.Retries > 255 {
+			return nil, fmt.Errorf("Retries must be in the range 0-255")
+		}
+		jm.SetRetries(uint8(*m.Retries))
+	}
+	if m.Env != "" {
+		if err := jm.SetEnvOverride(m.Env); err != nil {
+			return nil, err
+		}
+	}
+	return jm, nil
+}
+
+// jstatusModified is what we send the status webpage in response to a modify
+// request.
+type jstatusModified struct {
+	Modified    int
+	Retried     int
+	ModifyError string `json:",omitempty"`
+}
+
+// modifyReqJobs carries out a modify request, returning the result to send
+// back to the status webpage.
+func (s *Server) modifyReqJobs(req jstatusReq) *jstatusModified {
+	if req.Modify == nil {
+		return &jstatusModified{ModifyError: "no modifications supplied"}
+	}
+	jm, err := req.Modify.jobModifier()
+	if err != nil {
+		return &jstatusModified{ModifyError: err.Error()}
+	}
+
+	jobs := s.reqToJobs(req, []queue.ItemState{queue.ItemStateBury, queue.ItemStateDelay, queue.ItemStateDependent, queue.ItemStateReady})
+	if len(jobs) == 0 {
+		return &jstatusModified{}
+	}
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		keys[i] = job.Key()
+	}
+
+	modified, _, srerr, qerr := s.modifyJobs(keys, nil, jm)
+	if srerr != "" {
+		return &jstatusModified{ModifyError: qerr}
+	}
+	result := &jstatusModified{Modified: len(modified)}
+
+	if req.Modify.Retry {
+		newKeys := make([]string, 0, len(modified))
+		for newKey := range modified {
+			newKeys = append(newKeys, newKey)
+		}
+		result.Retried = len(s.kickJobs(newKeys, nil, req.User))
+	}
+	return result
+}
+
+// jstatusViewer is what we send the status webpage in response to a current
+// request, so it knows who is viewing it and whether they can see everyone's
+// jobs.
+type jstatusViewer struct {
+	Viewer      string
+	ViewerAdmin bool
+}
+
+// jstatusProtocolError is what we send the status webpage if it makes a
+// request using a protocol version we don't speak.
+type jstatusProtocolError struct {
+	ProtocolError string
+}
+
+// jstatusHistory is what we send the status webpage in response to a history
+// request.
+type jstatusHistory struct {
+	Key    string
+	Events []*JobEvent
+}
+
+// jstatusQueues is what we send the status webpage in response to a queues
+// request.
+type jstatusQueues struct {
+	Queues []*QueueInfo
+}
+
+// jstatusTagFacets is what we send the status webpage in response to a current
+// request, so it knows the tags that jobs have.
+type jstatusTagFacets struct {
+	TagFacets TagFacets
+}
+
+// jstatusDepGraph is what we send the status webpage in response to a depgraph
+// request.
+type jstatusDepGraph struct {
+	DepGraph *DepGraph
+}
+
+// jstatusLimitGroups is what we send the status webpage in response to a
+// limitGroups request.
+type jstatusLimitGroups struct {
+	LimitGroups []*limiter.Usage
+}
+
+// jstatusTriage is what we send the status webpage in response to a triage
+// request.
+type jstatusTriage struct {
+	TriageRules []*TriageRuleInfo
+}
+
+// jstatusProgress is what we send the status webpage in response to a progress
+// request, and periodically.
+type jstatusProgress struct {
+	Progress []*RepGroupProgress
+}
+
+// jstatusOutputs is what we send the status webpage in response to an outputs
+// request.
+type jstatusOutputs struct {
+	OutputsKey      string `json:",omitempty"`
+	OutputsRepGroup string `json:",omitempty"`
+	Jobs            []*jstatusJobOutputs
+}
+
+// jstatusJobOutputs holds the Artifacts of one job in a jstatusOutputs.
+type jstatusJobOutputs struct {
+	Key       string
+	Cmd       string
+	Artifacts []*Artifact
+}
+
+// sendOutputs sends the given websocket the Artifacts of the complete job with
+// the given key, or of all the complete jobs in the given RepGroup, ignoring
+// jobs not added by owner, if supplied.
+func (s *Server) sendOutputs(conn *websocket.Conn, writeMutex *sync.Mutex, key, repGroup, owner string) error {
+	var jobs []*Job
+	var qerr string
+	if key != "" {
+		key = s.resolveJobNames([]string{key}, "")[0]
+		jobs, _, qerr = s.getJobsByKeys([]string{key}, false, false)
+	} else {
+		jobs, _, qerr = s.getJobsByRepGroup(repGroup, false, 0, JobStateComplete, nil, false, false)
+	}
+	if qerr != "" {
+		s.Warn("status webpage failed to get job outputs", "err", qerr)
+	}
+
+	jo := &jstatusOutputs{OutputsKey: key, OutputsRepGroup: repGroup, Jobs: []*jstatusJobOutputs{}}
+	for _, job := range jobs {
+		job.RLock()
+		if job.State == JobStateComplete && (owner == "" || job.User == owner) {
+			jo.Jobs = append(jo.Jobs, &jstatusJobOutputs{Key: job.Key(), Cmd: job.Cmd, Artifacts: job.Artifacts})
+		}
+		job.RUnlock()
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	return wsWriteJSON(conn, jo)
+}
+
+// jstatusTail is what we send the status webpage in response to a tail
+// request: the output of the job since the last jstatusTail.
+type jstatusTail struct {
+	TailKey string
+	StdOut  string
+	StdErr  string
+	Running bool
+}
+
+// wsTail sends the given websocket new output of the job with the given key
+// every ServerTailInterval, until it stops running or either of the given
+// channels are closed.
+func (s *Server) wsTail(conn *websocket.Conn, writeMutex *sync.Mutex, key string, stop, tailStop chan bool) {
+	defer internal.LogPanic(s.Logger, "jobqueue websocket tail", false)
+
+	ticker := time.NewTicker(ServerTailInterval)
+	defer ticker.Stop()
+	var outOffset, errOffset int64
+	for {
+		tail, srerr := s.getTail(key, outOffset, errOffset)
+		if srerr != "" {
+			tail = &JobTail{}
+		}
+		outOffset, errOffset = tail.StdOutOffset, tail.StdErrOffset
+
+		if len(tail.StdOut) > 0 || len(tail.StdErr) > 0 || !tail.Running {
+			writeMutex.Lock()
+			err := wsWriteJSON(conn, &jstatusTail{TailKey: key, StdOut: string(tail.StdOut), StdErr: string(tail.StdErr), Running: tail.Running})
+			writeMutex.Unlock()
+			if err != nil || !tail.Running {
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-tailStop:
+			return
+		}
+	}
+}
+
+// sendSchedules sends the given websocket details of all our recurring jobs.
+func (s *Server) sendSchedules(conn *websocket.Conn, writeMutex *sync.Mutex) error {
+	scheds, err := s.getSchedules()
+	if err != nil {
+		s.Warn("status webpage failed to get recurring jobs", "err", err)
+		return err
+	}
+
+	js := &jstatusSchedules{Schedules: make([]*jstatusSchedule, 0, len(scheds))}
+	for _, sched := range scheds {
+		jsched := &jstatusSchedule{
+			Key:      sched.Key,
+			Schedule: sched.Job.Schedule,
+			RepGroup: sched.Job.RepGroup,
+			Cmd:      sched.Job.Cmd,
+			Runs:     sched.Runs,
+			Skipped:  sched.Skipped,
+			Paused:   sched.Paused,
+		}
+		if !sched.Next.IsZero() {
+			jsched.Next = sched.Next.Unix()
+		}
+		if !sched.Last.IsZero() {
+			jsched.Last = sched.Last.Unix()
+		}
+		js.Schedules = append(js.Schedules, jsched)
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	return wsWriteJSON(conn, js)
+}
+
+// jstatusFairShare is what we send the status webpage in response to a
+// fairShare request.
+type jstatusFairShare struct {
+	FairShare string
+}
+
+// jstatusSchedules is what we send the status webpage in response to a
+// schedules request, or any request that changes a schedule.
+type jstatusSchedules struct {
+	Schedules []*jstatusSchedule
+}
+
+// jstatusSchedule is the info about a recurring job that we send the status
+// webpage.
+type jstatusSchedule struct {
+	Key      string
+	Schedule string
+	RepGroup string
+	Cmd      string
+	Next     int64 // seconds since Unix epoch
+	Last     int64 // seconds since Unix epoch
+	Runs     int
+	Skipped  int
+	Paused   bool
 }
 
 // JStatus is the job info we send to the status webpage (only real difference
@@ -70,15 +498,31 @@ type JStatus struct {
 	Dependencies  []string
 	OtherRequests []string
 	Env           []string
+	Outputs       []string
+	Expected      []string // ExpectedOutputs
+	Artifacts     []*Artifact
+	Steps         []string
+	StepResults   []*JobStep
+	LostReport    *LostReport
+	LostReason    string
+	Pending       []string // reasons a pending job hasn't started yet
 	Key           string
+	Name          string
+	User          string
+	Metadata      json.RawMessage
+	Tags          map[string]string
 	RepGroup      string
 	Cmd           string
 	State         JobState
 	Cwd           string
 	CwdBase       string
 	Behaviours    string
+	RetriedWith   string // RetryOverrides, described
 	Mounts        string
 	MonitorDocker string
+	Container     string
+	Network       int // Network is in megabits per second.
+	NetworkCap    bool
 	FailReason    string
 	Host          string
 	HostID        string
@@ -91,8 +535,10 @@ type JStatus struct {
 	Cores         float64
 	PeakRAM       int
 	PeakDisk      int64 // MBs
+	InputStats    *InputCacheStats
 	Exitcode      int
 	Pid           int
+	ArrayIndex    int
 	Walltime      float64
 	CPUtime       float64
 	Started       int64
@@ -130,6 +576,9 @@ func webInterfaceStatic(s *Server) http.HandlerFunc {
 			http.NotFound(w, r)
 			return
 		}
+		if path == "/status.html" {
+			doc = s.webConfig().statusPage(doc)
+		}
 
 		switch {
 		case strings.HasPrefix(path, "/js"):
@@ -161,10 +610,11 @@ func webInterfaceStatic(s *Server) http.HandlerFunc {
 }
 
 // webSocket upgrades a http connection to a websocket
-func webSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, bool) {
+func webSocket(w http.ResponseWriter, r *http.Request, checkOrigin func(r *http.Request) bool) (*websocket.Conn, bool) {
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		CheckOrigin:     checkOrigin,
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -178,12 +628,12 @@ func webSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, bool) {
 // webpage
 func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ok := s.httpAuthorized(w, r)
+		who, ok := s.httpRequester(w, r)
 		if !ok {
 			return
 		}
 
-		conn, ok := webSocket(w, r)
+		conn, ok := webSocket(w, r, s.webConfig().checkOrigin)
 		if !ok {
 			s.Error("Failed to set up websocket", "Host", r.Host)
 			return
@@ -191,6 +641,16 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 
 		writeMutex := &sync.Mutex{}
 
+		// the live state counts we push are limited to the jobs of the owner
+		// of the most recent current request
+		var ownerMutex sync.RWMutex
+		var owner string
+		getOwner := func() string {
+			ownerMutex.RLock()
+			defer ownerMutex.RUnlock()
+			return owner
+		}
+
 		// when the server shuts down it will close our conn, ending the main
 		// goroutine
 		storedName := s.storeWebSocketConnection(conn)
@@ -198,6 +658,17 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 		// when the main goroutine closes we will end all the others
 		stopper := make(chan bool)
 
+		// if the browser goes away without closing the connection, we'd only
+		// find out when a write failed, so we ping it regularly and give up if
+		// we don't hear back (pongs or requests) in time
+		errd := conn.SetReadDeadline(time.Now().Add(ServerWebSocketPongWait))
+		if errd != nil {
+			s.Warn("websocket read deadline could not be set", "err", errd)
+		}
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(ServerWebSocketPongWait))
+		})
+
 		// go routine to read client requests and respond to them
 		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
 			// log panics and die
@@ -210,46 +681,83 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 				close(stop)
 			}()
 
+			// the page can follow the output of one running job at a time
+			var tailStop chan bool
+
 			for {
 				req := jstatusReq{}
 				errr := conn.ReadJSON(&req)
 				if errr != nil {
-					// browser was refreshed or server shutdown
+					// browser was refreshed, went away or server shutdown
+					break
+				}
+				errr = conn.SetReadDeadline(time.Now().Add(ServerWebSocketPongWait))
+				if errr != nil {
 					break
 				}
 
+				req.Owner = who.owner(req.Owner)
+				req.User = who.name(req.User)
+
+				if req.Queue != "" {
+					if req.RepGroup != "" {
+						req.RepGroup = namespaced(req.Queue, req.RepGroup)
+					}
+					if req.Key != "" {
+						req.Key = s.resolveJobNames([]string{req.Key}, req.Queue)[0]
+					}
+				}
+
 				switch {
+				case !protocolVersionSupported(req.ProtocolVersion):
+					writeMutex.Lock()
+					err := wsWriteJSON(conn, &jstatusProtocolError{ProtocolError: protocolVersionError(req.ProtocolVersion) + "; try reloading the page"})
+					writeMutex.Unlock()
+					if err != nil {
+						s.Warn("status webpage protocol error failed to send JSON to client", "err", err)
+					}
 				case req.Request != "":
 					switch req.Request {
 					case "current":
+						ownerMutex.Lock()
+						owner = req.Owner
+						ownerMutex.Unlock()
+
+						writeMutex.Lock()
+						err := wsWriteJSON(conn, &jstatusViewer{Viewer: who.user, ViewerAdmin: who.admin})
+						writeMutex.Unlock()
+						if err != nil {
+							break
+						}
+
+						if req.GroupBy != "" {
+							// get the jobs in each group of the tag key
+							writeMutex.Lock()
+							err = s.sendTagGroupStateCounts(conn, req.GroupBy, req.Tags, req.Owner)
+							writeMutex.Unlock()
+							if err != nil {
+								s.Warn("status webpage tag group counts failed", "err", err)
+							}
+							break
+						}
+
 						// get all current jobs
-						jobs := s.getJobsCurrent(0, "", false, false)
 						writeMutex.Lock()
-						err := webInterfaceStatusSendGroupStateCount(conn, "+all+", jobs)
+						err = s.sendCurrentStateCounts(conn, req.Tags, req.Owner)
 						if err != nil {
 							writeMutex.Unlock()
 							break
 						}
 
-						// for each different RepGroup amongst these jobs,
-						// send the job state counts
-						repGroups := make(map[string][]*Job)
-						for _, job := range jobs {
-							repGroups[job.RepGroup] = append(repGroups[job.RepGroup], job)
+						// also send the tags the jobs have, so they can be
+						// grouped and filtered by them
+						facets, err := s.getTagFacets()
+						if err == nil {
+							err = wsWriteJSON(conn, &jstatusTagFacets{TagFacets: facets})
 						}
-						failed := false
-						for repGroup, jobs := range repGroups {
-							complete, _, qerr := s.getCompleteJobsByRepGroup(repGroup)
-							if qerr != "" {
-								failed = true
-								break
-							}
-							jobs = append(jobs, complete...)
-							err := webInterfaceStatusSendGroupStateCount(conn, repGroup, jobs)
-							if err != nil {
-								failed = true
-								break
-							}
+						if err != nil {
+							writeMutex.Unlock()
+							break
 						}
 
 						// also send details of dead servers
@@ -257,22 +765,52 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 							s.badServerCaster.Send(bs)
 						}
 
+						// and of servers being scaled down
+						for _, ds := range s.getDrainingServers() {
+							s.drainCaster.Send(ds)
+						}
+
 						// and of scheduler messages
-						s.simutex.RLock()
-						for _, si := range s.schedIssues {
+						for _, si := range s.schedulerIssues() {
 							s.schedCaster.Send(si)
 						}
-						s.simutex.RUnlock()
 
+						// and of any drain for maintenance
+						if md := s.maintenanceDetails(); md != nil {
+							s.maintCaster.Send(md)
+						}
+
+						writeMutex.Unlock()
+					case "resources":
+						writeMutex.Lock()
+						err := wsWriteJSON(conn, s.resourceUsage())
 						writeMutex.Unlock()
-						if failed {
+						if err != nil {
+							break
+						}
+					case "queues":
+						writeMutex.Lock()
+						err := wsWriteJSON(conn, &jstatusQueues{Queues: s.getQueues("")})
+						writeMutex.Unlock()
+						if err != nil {
 							break
 						}
 					case "details":
-						// *** probably want to take the count as a req option,
-						// so user can request to see more than just 1 job per
-						// State+Exitcode+FailReason
-						jobs, _, errstr := s.getJobsByRepGroup(req.RepGroup, false, 1, req.State, true, true)
+						limit := req.Limit
+						if limit <= 0 {
+							limit = 1
+						}
+						var jobs []*Job
+						var errstr string
+						if key, val, isTagGroup := parseTagGroup(req.RepGroup); isTagGroup {
+							tags := map[string]string{key: val}
+							for k, v := range req.Tags {
+								tags[k] = v
+							}
+							jobs, errstr, _ = s.getJobsByTags(tags, limit, req.State, req.jobFilter(), true, true)
+						} else {
+							jobs, errstr, _ = s.getJobsByRepGroup(req.RepGroup, false, limit, req.State, req.jobFilter(), true, true)
+						}
 						if errstr == "" && len(jobs) > 0 {
 							writeMutex.Lock()
 							failed := false
@@ -283,7 +821,7 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 									break
 								}
 								status.RepGroup = req.RepGroup // since we want to return the group the user asked for, not the most recent group the job was made for
-								err = conn.WriteJSON(status)
+								err = wsWriteJSON(conn, status)
 								if err != nil {
 									failed = true
 									break
@@ -302,39 +840,36 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 								continue
 							}
 							job.UntilBuried = job.Retries + 1
+							job.FailureCounts = nil
+							s.recordJobEvent(&JobEvent{Event: JobEventKicked, User: req.User}, job.Key())
+						}
+					case "modify":
+						result := s.modifyReqJobs(req)
+						writeMutex.Lock()
+						err := wsWriteJSON(conn, result)
+						writeMutex.Unlock()
+						if err != nil {
+							break
 						}
 					case "remove":
-						jobs := s.reqToJobs(req, []queue.ItemState{queue.ItemStateBury, queue.ItemStateDelay, queue.ItemStateDependent, queue.ItemStateReady})
-						var toDelete []string
-						for _, job := range jobs {
-							key := job.Key()
-
-							// we can't allow the removal of jobs that have
-							// dependencies, as *queue would regard that as
-							// satisfying the dependency and downstream jobs
-							// would start
-							hasDeps, err := s.q.HasDependents(key)
-							if err != nil || hasDeps {
-								continue
+						// removing a large RepGroup can take a long time, so
+						// we do it in the background instead of blocking
+						// this websocket
+						go func(req jstatusReq) {
+							defer internal.LogPanic(s.Logger, "jobqueue websocket remove", false)
+							jobs := s.reqToJobs(req, []queue.ItemState{queue.ItemStateBury, queue.ItemStateDelay, queue.ItemStateDependent, queue.ItemStateReady})
+							if len(jobs) == 0 {
+								return
 							}
-
-							err = s.q.Remove(key)
-							if err != nil {
-								s.Warn("failed to remove job", "cmd", job.Cmd, "err", err)
-								continue
+							keys := make([]string, len(jobs))
+							for i, job := range jobs {
+								keys[i] = job.Key()
 							}
-							s.db.deleteLiveJob(key)
-							s.Debug("removed job", "cmd", job.Cmd)
-							toDelete = append(toDelete, key)
-							if job.State == JobStateReady {
-								s.decrementGroupCount(job.schedulerGroup)
+							_, err := s.startBulkRemoval(keys)
+							if err != nil {
+								s.Warn("web interface remove failed", "err", err)
 							}
-						}
-						s.rpl.Lock()
-						for _, key := range toDelete {
-							delete(s.rpl.lookup[req.RepGroup], key)
-						}
-						s.rpl.Unlock()
+						}(req)
 					case "kill":
 						jobs := s.reqToJobs(req, []queue.ItemState{queue.ItemStateRun})
 						for _, job := range jobs {
@@ -344,10 +879,11 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 							}
 						}
 					case "confirmBadServer":
-						if req.ServerID != "" {
+						if req.ServerID != "" && who.admin {
 							s.bsmutex.Lock()
 							server := s.badServers[req.ServerID]
 							delete(s.badServers, req.ServerID)
+							delete(s.badServerActions, req.ServerID)
 							s.bsmutex.Unlock()
 							if server != nil && server.IsBad() {
 								err := server.Destroy()
@@ -357,27 +893,164 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 							}
 						}
 					case "dismissMsg":
-						if req.Msg != "" {
-							s.simutex.Lock()
-							delete(s.schedIssues, req.Msg)
-							s.simutex.Unlock()
+						if req.Msg != "" && who.admin {
+							s.dismissSchedulerIssues(req.Msg)
 						}
 					case "dismissMsgs":
-						s.simutex.Lock()
-						s.schedIssues = make(map[string]*schedulerIssue)
-						s.simutex.Unlock()
+						if who.admin {
+							s.dismissSchedulerIssues()
+						}
+					case "ackMsg":
+						if req.Msg != "" {
+							s.acknowledgeSchedulerIssues(req.User, req.Msg)
+						}
+					case "ackMsgs":
+						s.acknowledgeSchedulerIssues(req.User)
+					case "history":
+						if req.Key == "" {
+							break
+						}
+						keys := s.resolveJobNames([]string{req.Key}, "")
+						if !s.canSeeKey(who, keys[0]) {
+							break
+						}
+						events, err := s.db.retrieveJobEvents(keys[0])
+						if err != nil {
+							s.Warn("status webpage failed to get job history", "err", err)
+							break
+						}
+						writeMutex.Lock()
+						err = wsWriteJSON(conn, &jstatusHistory{Key: keys[0], Events: events})
+						writeMutex.Unlock()
+						if err != nil {
+							break
+						}
+					case "outputs":
+						if req.Key == "" && req.RepGroup == "" {
+							break
+						}
+						err := s.sendOutputs(conn, writeMutex, req.Key, req.RepGroup, req.Owner)
+						if err != nil {
+							break
+						}
+					case "tail":
+						if tailStop != nil {
+							close(tailStop)
+							tailStop = nil
+						}
+						if req.Key == "" {
+							break
+						}
+						keys := s.resolveJobNames([]string{req.Key}, "")
+						if !s.canSeeKey(who, keys[0]) {
+							break
+						}
+						tailStop = make(chan bool)
+						go s.wsTail(conn, writeMutex, keys[0], stop, tailStop)
+					case "schedules", "pauseSchedule", "resumeSchedule", "cancelSchedule":
+						if req.Request != "schedules" && req.Key != "" && who.admin {
+							_, err := s.changeSchedule(strings.ToLower(req.Request), req.Key, "")
+							if err != nil {
+								s.Warn("status webpage failed to change a recurring job", "err", err)
+							}
+						}
+						err := s.sendSchedules(conn, writeMutex)
+						if err != nil {
+							break
+						}
+					case "fairShare":
+						if req.FairShare != "" && who.admin {
+							mode, err := ParseFairShare(req.FairShare)
+							if err != nil {
+								s.Warn("status webpage sent a bad fair share mode", "err", err)
+								break
+							}
+							s.setFairShare(mode)
+						}
+						writeMutex.Lock()
+						err := wsWriteJSON(conn, &jstatusFairShare{FairShare: s.getFairShare()})
+						writeMutex.Unlock()
+						if err != nil {
+							break
+						}
+					case "limitGroups":
+						if req.LimitGroup != "" && who.admin {
+							_, _, err := s.getSetLimitGroup(fmt.Sprintf("%s:%d", req.LimitGroup, req.Limit))
+							if err != nil {
+								s.Warn("status webpage failed to set a limit", "err", err)
+							}
+						}
+						usage, err := s.limitGroupUsage()
+						if err != nil {
+							s.Warn("status webpage failed to get limit groups", "err", err)
+							break
+						}
+						writeMutex.Lock()
+						err = wsWriteJSON(conn, &jstatusLimitGroups{LimitGroups: usage})
+						writeMutex.Unlock()
+						if err != nil {
+							break
+						}
+					case "progress":
+						if !who.admin {
+							// progress is per RepGroup, which can have the
+							// jobs of many users
+							break
+						}
+						writeMutex.Lock()
+						err := wsWriteJSON(conn, &jstatusProgress{Progress: s.repGroupProgress(nil)})
+						writeMutex.Unlock()
+						if err != nil {
+							break
+						}
+					case "triage":
+						writeMutex.Lock()
+						err := wsWriteJSON(conn, &jstatusTriage{TriageRules: s.getTriageRules()})
+						writeMutex.Unlock()
+						if err != nil {
+							break
+						}
+					case "depgraph":
+						dg, err := s.depGraph(req.RepGroup, req.Owner)
+						if err != nil {
+							s.Warn("status webpage failed to get the dependency graph", "err", err)
+							break
+						}
+						writeMutex.Lock()
+						err = wsWriteJSON(conn, &jstatusDepGraph{DepGraph: dg})
+						writeMutex.Unlock()
+						if err != nil {
+							break
+						}
+					case "efficiency":
+						var rgs []string
+						if req.RepGroup != "" {
+							rgs = []string{req.RepGroup}
+						}
+						effs, errstr, _ := s.repGroupEfficiency(rgs, false, "", req.Owner)
+						if errstr != "" {
+							break
+						}
+						writeMutex.Lock()
+						for _, eff := range effs {
+							err := wsWriteJSON(conn, eff)
+							if err != nil {
+								break
+							}
+						}
+						writeMutex.Unlock()
 					default:
 						continue
 					}
 				case req.Key != "":
-					jobs, _, errstr := s.getJobsByKeys([]string{req.Key}, true, true)
-					if errstr == "" && len(jobs) == 1 {
+					jobs, _, errstr := s.getJobsByKeys(s.resolveJobNames([]string{req.Key}, ""), true, true)
+					if errstr == "" && len(jobs) == 1 && who.canSee(jobs[0]) {
 						status, err := jobs[0].ToStatus()
 						if err != nil {
 							break
 						}
 						writeMutex.Lock()
-						err = conn.WriteJSON(status)
+						err = wsWriteJSON(conn, status)
 						writeMutex.Unlock()
 						if err != nil {
 							break
@@ -387,78 +1060,88 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 			}
 		}(conn, storedName, stopper)
 
-		// go routines to push changes to the client
-		go func(conn *websocket.Conn, stop chan bool) {
-			// log panics and die
-			defer internal.LogPanic(s.Logger, "jobqueue websocket status updating", true)
+		// go routine to ping the client
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
+			defer internal.LogPanic(s.Logger, "jobqueue websocket pinging", true)
 
-			statusReceiver := s.statusCaster.Join()
-			defer statusReceiver.Close()
+			ticker := time.NewTicker(ServerWebSocketPongWait * 9 / 10)
+			defer ticker.Stop()
 
 			for {
 				select {
 				case <-stop:
 					return
-				case status := <-statusReceiver.In:
-					writeMutex.Lock()
-					err := conn.WriteJSON(status)
-					writeMutex.Unlock()
+				case <-ticker.C:
+					err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(ServerWebSocketWriteWait))
 					if err != nil {
-						s.Warn("status updater failed to send JSON to client", "err", err)
+						s.closeWebSocketConnection(connStorageName)
 						return
 					}
 				}
 			}
-		}(conn, stopper)
+		}(conn, storedName, stopper)
+
+		// go routines to push changes to the client. If they fail to write,
+		// they close the connection, which ends the client request handling
+		// goroutine and so all the others, so every caster receiver gets
+		// closed
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
+			// log panics and die
+			defer internal.LogPanic(s.Logger, "jobqueue websocket status updating", true)
+
+			q := s.relayCasterFiltered(s.userStatusCaster, connStorageName, "status", stop, ownedStateCounts(getOwner))
+			s.writeQueued(conn, writeMutex, connStorageName, "status", q, stop)
+		}(conn, storedName, stopper)
 
-		go func(conn *websocket.Conn, stop chan bool) {
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
 			defer internal.LogPanic(s.Logger, "jobqueue websocket bad server updating", true)
 
-			badserverReceiver := s.badServerCaster.Join()
-			defer badserverReceiver.Close()
+			q := s.relayCaster(s.badServerCaster, connStorageName, "badservers", stop)
+			s.writeQueued(conn, writeMutex, connStorageName, "badservers", q, stop)
+		}(conn, storedName, stopper)
 
-			for {
-				select {
-				case <-stop:
-					return
-				case server := <-badserverReceiver.In:
-					writeMutex.Lock()
-					err := conn.WriteJSON(server)
-					writeMutex.Unlock()
-					if err != nil {
-						s.Warn("bad server caster failed to send JSON to client", "err", err)
-						return
-					}
-				}
-			}
-		}(conn, stopper)
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
+			defer internal.LogPanic(s.Logger, "jobqueue websocket draining server updating", true)
 
-		go func(conn *websocket.Conn, stop chan bool) {
+			q := s.relayCaster(s.drainCaster, connStorageName, "drainingservers", stop)
+			s.writeQueued(conn, writeMutex, connStorageName, "drainingservers", q, stop)
+		}(conn, storedName, stopper)
+
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
 			defer internal.LogPanic(s.Logger, "jobqueue websocket scheduler issue updating", true)
 
-			schedIssueReceiver := s.schedCaster.Join()
-			defer schedIssueReceiver.Close()
+			q := s.relayCaster(s.schedCaster, connStorageName, "schedissues", stop)
+			s.writeQueued(conn, writeMutex, connStorageName, "schedissues", q, stop)
+		}(conn, storedName, stopper)
 
-			for {
-				select {
-				case <-stop:
-					return
-				case si := <-schedIssueReceiver.In:
-					writeMutex.Lock()
-					err := conn.WriteJSON(si)
-					writeMutex.Unlock()
-					if err != nil {
-						s.Warn("scheduler issues caster failed to send JSON to client", "err", err)
-						return
-					}
-				}
-			}
-		}(conn, stopper)
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
+			defer internal.LogPanic(s.Logger, "jobqueue websocket resource updating", true)
+
+			q := s.relayCaster(s.resourceCaster, connStorageName, "resources", stop)
+			s.writeQueued(conn, writeMutex, connStorageName, "resources", q, stop)
+		}(conn, storedName, stopper)
+
+		if who.admin {
+			// (progress is per RepGroup, which can have the jobs of many users)
+			go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
+				defer internal.LogPanic(s.Logger, "jobqueue websocket progress updating", true)
+
+				q := s.relayCaster(s.progressCaster, connStorageName, "progress", stop)
+				s.writeQueued(conn, writeMutex, connStorageName, "progress", q, stop)
+			}(conn, storedName, stopper)
+		}
+
+		go func(conn *websocket.Conn, connStorageName string, stop chan bool) {
+			defer internal.LogPanic(s.Logger, "jobqueue websocket maintenance updating", true)
+
+			q := s.relayCaster(s.maintCaster, connStorageName, "maintenance", stop)
+			s.writeQueued(conn, writeMutex, connStorageName, "maintenance", q, stop)
+		}(conn, storedName, stopper)
 	}
 }
 
 // reqToJobs takes a request from the status webpage and returns the requested
-// jobs.
+// jobs, limited to those of req.Owner if set.
 func (s *Server) reqToJobs(req jstatusReq, allowedItemStates []queue.ItemState) []*Job {
 	allowed := make(map[queue.ItemState]bool)
 	for _, is := range allowedItemStates {
@@ -466,7 +1149,31 @@ func (s *Server) reqToJobs(req jstatusReq, allowedItemStates []queue.ItemState)
 	}
 
 	var jobs []*Job
-	if req.RepGroup != "" {
+	consider := func(item *queue.Item) {
+		stats := item.Stats()
+		if allowed[stats.State] {
+			job := item.Data().(*Job)
+			job.Lock()
+			job.State = s.itemStateToJobState(stats.State, job.Lost)
+			if job.Exitcode == req.Exitcode && job.FailReason == req.FailReason && (req.Owner == "" || job.User == req.Owner) {
+				jobs = append(jobs, job)
+			}
+			job.Unlock()
+		}
+	}
+
+	if tagKey, tagVal, isTagGroup := parseTagGroup(req.RepGroup); isTagGroup {
+		s.q.Each(func(item *queue.Item) bool {
+			job := item.Data().(*Job)
+			job.RLock()
+			val, exists := job.Tags[tagKey]
+			job.RUnlock()
+			if exists && val == tagVal {
+				consider(item)
+			}
+			return true
+		})
+	} else if req.RepGroup != "" {
 		s.rpl.RLock()
 		defer s.rpl.RUnlock()
 		for key := range s.rpl.lookup[req.RepGroup] {
@@ -474,19 +1181,10 @@ func (s *Server) reqToJobs(req jstatusReq, allowedItemStates []queue.ItemState)
 			if item == nil || err != nil {
 				continue
 			}
-			stats := item.Stats()
-			if allowed[stats.State] {
-				job := item.Data().(*Job)
-				job.Lock()
-				job.State = s.itemStateToJobState(stats.State, job.Lost)
-				if job.Exitcode == req.Exitcode && job.FailReason == req.FailReason {
-					jobs = append(jobs, job)
-				}
-				job.Unlock()
-			}
+			consider(item)
 		}
 	} else if req.Key != "" {
-		item, err := s.q.Get(req.Key)
+		item, err := s.q.Get(s.resolveJobNames([]string{req.Key}, "")[0])
 		if item == nil || err != nil {
 			return nil
 		}
@@ -495,16 +1193,126 @@ func (s *Server) reqToJobs(req jstatusReq, allowedItemStates []queue.ItemState)
 			job := item.Data().(*Job)
 			job.Lock()
 			job.State = s.itemStateToJobState(stats.State, job.Lost)
+			mine := req.Owner == "" || job.User == req.Owner
 			job.Unlock()
-			jobs = append(jobs, job)
+			if mine {
+				jobs = append(jobs, job)
+			}
 		}
 	}
 	return jobs
 }
 
+// wsWriteJSON writes v as JSON to the given websocket, giving up if that
+// takes longer than ServerWebSocketWriteWait. You must hold the connection's
+// write lock.
+func wsWriteJSON(conn *websocket.Conn, v interface{}) error {
+	err := conn.SetWriteDeadline(time.Now().Add(ServerWebSocketWriteWait))
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(v)
+}
+
+// sendCurrentStateCounts sends the state counts of all current jobs, and of the
+// current and complete jobs in each of their RepGroups, to the status webpage
+// websocket. If tags are supplied, only jobs with all of them are counted, and
+// if owner is supplied, only the jobs added by that user. You must hold the
+// connection's write lock.
+func (s *Server) sendCurrentStateCounts(conn *websocket.Conn, tags map[string]string, owner string) error {
+	var filter *JobFilter
+	if len(tags) > 0 || owner != "" {
+		filter = &JobFilter{Tags: tags, User: owner}
+	}
+	jobs := s.getJobsCurrent(0, "", filter, false, false)
+	err := webInterfaceStatusSendGroupStateCount(conn, "+all+", jobs)
+	if err != nil {
+		return err
+	}
+
+	// for each different RepGroup amongst these jobs, send the job state
+	// counts
+	repGroups := make(map[string][]*Job)
+	for _, job := range jobs {
+		repGroups[job.RepGroup] = append(repGroups[job.RepGroup], job)
+	}
+	for repGroup, jobs := range repGroups {
+		complete, _, qerr := s.getCompleteJobsByRepGroup(repGroup)
+		if qerr != "" {
+			return Error{"current", repGroup, qerr}
+		}
+		for _, job := range complete {
+			if filter == nil || filter.matches(job) {
+				jobs = append(jobs, job)
+			}
+		}
+		err = webInterfaceStatusSendGroupStateCount(conn, repGroup, jobs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendTagGroupStateCounts sends the state counts of the current and complete
+// jobs with each value of the given tag key, as tag groups, to the status
+// webpage websocket. If tags are supplied, only jobs with all of them are
+// counted, and if owner is supplied, only the jobs added by that user. You must
+// hold the connection's write lock.
+func (s *Server) sendTagGroupStateCounts(conn *websocket.Conn, key string, tags map[string]string, owner string) error {
+	facets, err := s.getTagFacets()
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string][]*Job)
+	for _, job := range s.getJobsCurrent(0, "", &JobFilter{Tags: tags, User: owner}, false, false) {
+		if val, exists := job.Tags[key]; exists {
+			groups[val] = append(groups[val], job)
+		}
+	}
+
+	for val := range facets[key] {
+		want := map[string]string{key: val}
+		for k, v := range tags {
+			want[k] = v
+		}
+		complete, err := s.db.retrieveCompleteJobsByTags(want)
+		if err != nil {
+			return err
+		}
+		jobs := groups[val]
+		for _, job := range complete {
+			if owner == "" || job.User == owner {
+				jobs = append(jobs, job)
+			}
+		}
+		if len(jobs) == 0 {
+			continue
+		}
+		err = webInterfaceStatusSendGroupStateCount(conn, tagGroup(key, val), jobs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // webInterfaceStatusSendGroupStateCount sends the per-repgroup state counts
 // to the status webpage websocket
 func webInterfaceStatusSendGroupStateCount(conn *websocket.Conn, repGroup string, jobs []*Job) error {
+	for _, jsc := range jobsToStateCounts(repGroup, jobs) {
+		err := wsWriteJSON(conn, jsc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobsToStateCounts counts the given jobs per state, representing them as jobs
+// in the given repGroup moving from JobStateNew to those states.
+func jobsToStateCounts(repGroup string, jobs []*Job) []*JobStateCount {
 	stateCounts := make(map[JobState]int)
 	for _, job := range jobs {
 		var state JobState
@@ -519,11 +1327,9 @@ func webInterfaceStatusSendGroupStateCount(conn *websocket.Conn, repGroup string
 
 		stateCounts[state]++
 	}
+	counts := make([]*JobStateCount, 0, len(stateCounts))
 	for to, count := range stateCounts {
-		err := conn.WriteJSON(&jstateCount{repGroup, JobStateNew, to, count})
-		if err != nil {
-			return err
-		}
+		counts = append(counts, &JobStateCount{repGroup, JobStateNew, to, count})
 	}
-	return nil
+	return counts
 }
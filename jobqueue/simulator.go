@@ -0,0 +1,428 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for simulating how a workload would get
+// scheduled given some hypothetical capacity and limits, so that changes can
+// be evaluated before being applied for real.
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SimulationConfig describes the hypothetical capacity, limits and costs that
+// Simulate() replays a workload against.
+type SimulationConfig struct {
+	// Hosts is the maximum number of hosts that can be running jobs at once.
+	// The default of 0 means unlimited.
+	Hosts int
+
+	// HostCores is the number of cores each host has. Required.
+	HostCores float64
+
+	// HostRAM is the RAM (in MB) each host has. Required.
+	HostRAM int
+
+	// HostStartup is how long a new host takes before it can start running
+	// jobs, eg. the time it takes to spawn a cloud server.
+	HostStartup time.Duration
+
+	// CostPerHostHour is the monetary cost of having a host up for an hour.
+	CostPerHostHour float64
+
+	// Limits are the limits of limit groups (see Job.LimitGroups). Groups that
+	// aren't in here are treated as unlimited.
+	Limits map[string]int
+}
+
+// SimulationResult describes the predicted outcome of a Simulate().
+type SimulationResult struct {
+	// Jobs is the number of jobs that were simulated to completion.
+	Jobs int
+
+	// Unschedulable is the number of jobs that could never run, because they
+	// need more resources than a host has, are in a limit group with a limit
+	// of 0, or depend on jobs that can't run.
+	Unschedulable int
+
+	// Makespan is how long it would take from starting to run the workload
+	// until the last job finishes.
+	Makespan time.Duration
+
+	// PeakHosts is the largest number of hosts that were up at once.
+	PeakHosts int
+
+	// HostHours is the total time hosts were up, from being started until the
+	// last job they ran finished.
+	HostHours float64
+
+	// CoreHours is the total time jobs ran for, multiplied by their cores.
+	CoreHours float64
+
+	// Cost is HostHours multiplied by the configured CostPerHostHour.
+	Cost float64
+}
+
+// simJob is a job being simulated.
+type simJob struct {
+	index      int
+	priority   uint8
+	cores      float64
+	ram        int
+	runtime    time.Duration
+	limits     map[string]int
+	shape      string
+	dependents []*simJob
+	waitingOn  int
+	host       *simHost
+	end        time.Duration
+}
+
+// simHost is a host being simulated.
+type simHost struct {
+	cores   float64
+	ram     int
+	running int
+	readyAt time.Duration
+	started time.Duration
+	lastEnd time.Duration
+	up      bool
+}
+
+// simReady is a priority queue of ready simJobs of the same shape, highest
+// priority first, and in the order they were given for equal priorities.
+type simReady []*simJob
+
+func (q simReady) Len() int { return len(q) }
+func (q simReady) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].index < q[j].index
+}
+func (q simReady) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simReady) Push(x interface{}) { *q = append(*q, x.(*simJob)) }
+func (q *simReady) Pop() interface{} {
+	old := *q
+	n := len(old)
+	sj := old[n-1]
+	*q = old[:n-1]
+	return sj
+}
+
+// simRunning is a priority queue of running simJobs, soonest to end first.
+type simRunning []*simJob
+
+func (q simRunning) Len() int            { return len(q) }
+func (q simRunning) Less(i, j int) bool  { return q[i].end < q[j].end }
+func (q simRunning) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simRunning) Push(x interface{}) { *q = append(*q, x.(*simJob)) }
+func (q *simRunning) Pop() interface{} {
+	old := *q
+	n := len(old)
+	sj := old[n-1]
+	*q = old[:n-1]
+	return sj
+}
+
+// simulation holds the state of a Simulate() run.
+type simulation struct {
+	config    SimulationConfig
+	ready     map[string]*simReady
+	running   simRunning
+	hosts     []*simHost
+	upHosts   int
+	limitUsed map[string]int
+	result    *SimulationResult
+}
+
+// Simulate predicts how long the given jobs would take to run, and how much
+// that would cost, given the hypothetical capacity and limits in the config.
+//
+// Jobs are run in priority order as soon as their dependencies (on other jobs
+// in the given set; dependencies on other jobs are treated as satisfied) have
+// completed and there is space for them on a host and within their limit
+// groups, starting new hosts as needed. Complete jobs (eg. from
+// Client.GetByRepGroup()) are taken to run for as long as they did when they
+// actually ran, while other jobs are taken to run for their expected
+// Requirements.Time.
+func Simulate(jobs []*Job, config SimulationConfig) (*SimulationResult, error) {
+	if config.HostCores <= 0 || config.HostRAM <= 0 {
+		return nil, fmt.Errorf("hosts must have some cores and RAM")
+	}
+	if config.Hosts < 0 {
+		return nil, fmt.Errorf("the number of hosts can't be negative")
+	}
+
+	sim := &simulation{
+		config:    config,
+		ready:     make(map[string]*simReady),
+		limitUsed: make(map[string]int),
+		result:    &SimulationResult{},
+	}
+
+	sjs := sim.prepare(jobs)
+	for _, sj := range sjs {
+		if sj.waitingOn == 0 {
+			sim.makeReady(sj)
+		}
+	}
+
+	var now time.Duration
+	for {
+		sim.schedule(now)
+		sim.shutdownIdleHosts()
+		if sim.running.Len() == 0 {
+			break
+		}
+
+		// advance to the next time a job ends, completing all the jobs that
+		// end then
+		now = sim.running[0].end
+		for sim.running.Len() > 0 && sim.running[0].end == now {
+			sim.complete(heap.Pop(&sim.running).(*simJob))
+		}
+	}
+
+	sim.result.Makespan = now
+	sim.result.Unschedulable = len(sjs) - sim.result.Jobs
+	sim.result.Cost = sim.result.HostHours * config.CostPerHostHour
+	return sim.result, nil
+}
+
+// prepare converts the given jobs to simJobs, linking up their dependencies.
+func (sim *simulation) prepare(jobs []*Job) []*simJob {
+	sjs := make([]*simJob, len(jobs))
+	byKey := make(map[string]*simJob, len(jobs))
+	byDepGroup := make(map[string][]*simJob)
+	for i, job := range jobs {
+		job.RLock()
+		sj := &simJob{
+			index:    i,
+			priority: job.Priority,
+			limits:   make(map[string]int),
+		}
+		if job.Requirements != nil {
+			sj.cores = job.Requirements.Cores
+			sj.ram = job.Requirements.RAM
+			sj.runtime = job.Requirements.Time
+		}
+		if job.State == JobStateComplete && !job.StartTime.IsZero() && job.EndTime.After(job.StartTime) {
+			sj.runtime = job.EndTime.Sub(job.StartTime)
+		}
+		for _, group := range job.LimitGroups {
+			name, usage, err := splitLimitGroupUsage(group)
+			if err != nil {
+				name, usage = group, 1
+			}
+			sj.limits[name] += usage
+		}
+		sj.shape = simShape(sj)
+		for _, dg := range job.DepGroups {
+			byDepGroup[dg] = append(byDepGroup[dg], sj)
+		}
+		job.RUnlock()
+		byKey[job.Key()] = sj
+		sjs[i] = sj
+	}
+
+	for i, job := range jobs {
+		sj := sjs[i]
+		job.RLock()
+		deps := job.Dependencies
+		job.RUnlock()
+		parents := make(map[*simJob]bool)
+		for _, dep := range deps {
+			switch {
+			case dep.DepGroup != "":
+				for _, parent := range byDepGroup[dep.DepGroup] {
+					parents[parent] = true
+				}
+			case dep.Essence != nil:
+				if parent, found := byKey[dep.Essence.Key()]; found {
+					parents[parent] = true
+				}
+			}
+		}
+		delete(parents, sj)
+		for parent := range parents {
+			parent.dependents = append(parent.dependents, sj)
+			sj.waitingOn++
+		}
+	}
+	return sjs
+}
+
+// simShape describes the resources a simJob needs, such that jobs of the same
+// shape either all fit or all don't fit in the same space.
+func simShape(sj *simJob) string {
+	limits := make([]string, 0, len(sj.limits))
+	for name, usage := range sj.limits {
+		limits = append(limits, fmt.Sprintf("%s*%d", name, usage))
+	}
+	sort.Strings(limits)
+	return fmt.Sprintf("%g:%d:%s", sj.cores, sj.ram, strings.Join(limits, ","))
+}
+
+// makeReady notes that the given simJob has no incomplete dependencies.
+func (sim *simulation) makeReady(sj *simJob) {
+	q, exists := sim.ready[sj.shape]
+	if !exists {
+		q = &simReady{}
+		sim.ready[sj.shape] = q
+	}
+	heap.Push(q, sj)
+}
+
+// schedule starts as many ready simJobs as possible at the given time, highest
+// priority first. When the highest priority job of a shape can't start, no
+// other job of that shape is tried.
+func (sim *simulation) schedule(now time.Duration) {
+	shapes := make([]string, 0, len(sim.ready))
+	for shape, q := range sim.ready {
+		if q.Len() > 0 {
+			shapes = append(shapes, shape)
+		}
+	}
+	sort.Slice(shapes, func(i, j int) bool {
+		return simReady{(*sim.ready[shapes[i]])[0], (*sim.ready[shapes[j]])[0]}.Less(0, 1)
+	})
+
+	for _, shape := range shapes {
+		q := sim.ready[shape]
+		for q.Len() > 0 {
+			if !sim.start((*q)[0], now) {
+				break
+			}
+			heap.Pop(q)
+		}
+	}
+}
+
+// start starts the given simJob at the given time if there's space for it
+// within its limit groups and on an existing or new host, returning true if it
+// was started.
+func (sim *simulation) start(sj *simJob, now time.Duration) bool {
+	for name, usage := range sj.limits {
+		if limit, limited := sim.config.Limits[name]; limited && sim.limitUsed[name]+usage > limit {
+			return false
+		}
+	}
+
+	var host *simHost
+	for _, h := range sim.hosts {
+		if h.up && h.cores >= sj.cores && h.ram >= sj.ram {
+			host = h
+			break
+		}
+	}
+	if host == nil {
+		if sj.cores > sim.config.HostCores || sj.ram > sim.config.HostRAM {
+			return false
+		}
+		if sim.config.Hosts > 0 && sim.upHosts >= sim.config.Hosts {
+			return false
+		}
+		host = sim.spawn(now)
+	}
+
+	host.cores -= sj.cores
+	host.ram -= sj.ram
+	host.running++
+	for name, usage := range sj.limits {
+		sim.limitUsed[name] += usage
+	}
+
+	start := now
+	if host.readyAt > start {
+		start = host.readyAt
+	}
+	sj.host = host
+	sj.end = start + sj.runtime
+	if sj.end > host.lastEnd {
+		host.lastEnd = sj.end
+	}
+	sim.result.CoreHours += sj.cores * sj.runtime.Hours()
+	heap.Push(&sim.running, sj)
+	return true
+}
+
+// spawn starts a new host at the given time, reusing one that is no longer up
+// if possible.
+func (sim *simulation) spawn(now time.Duration) *simHost {
+	var host *simHost
+	for _, h := range sim.hosts {
+		if !h.up {
+			host = h
+			break
+		}
+	}
+	if host == nil {
+		host = &simHost{}
+		sim.hosts = append(sim.hosts, host)
+	}
+	host.cores = sim.config.HostCores
+	host.ram = sim.config.HostRAM
+	host.started = now
+	host.readyAt = now + sim.config.HostStartup
+	host.lastEnd = host.readyAt
+	host.up = true
+	sim.upHosts++
+	if sim.upHosts > sim.result.PeakHosts {
+		sim.result.PeakHosts = sim.upHosts
+	}
+	return host
+}
+
+// complete frees up the resources of the given simJob, which ended, and makes
+// ready the jobs that were only waiting on it.
+func (sim *simulation) complete(sj *simJob) {
+	sim.result.Jobs++
+	host := sj.host
+	host.cores += sj.cores
+	host.ram += sj.ram
+	host.running--
+	for name, usage := range sj.limits {
+		sim.limitUsed[name] -= usage
+	}
+
+	for _, dependent := range sj.dependents {
+		dependent.waitingOn--
+		if dependent.waitingOn == 0 {
+			sim.makeReady(dependent)
+		}
+	}
+}
+
+// shutdownIdleHosts shuts down the hosts that have nothing running on them,
+// noting how long they were up for.
+func (sim *simulation) shutdownIdleHosts() {
+	for _, host := range sim.hosts {
+		if !host.up || host.running > 0 {
+			continue
+		}
+		sim.result.HostHours += (host.lastEnd - host.started).Hours()
+		host.up = false
+		sim.upHosts--
+	}
+}
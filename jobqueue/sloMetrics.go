@@ -0,0 +1,327 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for keeping SLO-style metrics on each RepGroup,
+// and for exposing them in the Prometheus text format, so that alerting rules
+// like "pipeline X has stalled for 2 hours" can be simple.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+// sloBuckets is the number of buckets the SLO window is divided in to; the
+// oldest bucket is dropped in its entirety as the window moves on.
+const sloBuckets = 60
+
+// RepGroupSLO holds SLO-style metrics for a RepGroup, as returned by
+// Server.GetRepGroupSLOs().
+type RepGroupSLO struct {
+	RepGroup string
+
+	// Jobs is the number of the RepGroup's jobs that are in the queue, ie. that
+	// have not completed or been deleted.
+	Jobs int
+
+	// Pending is the number of the RepGroup's jobs that are ready to run or
+	// are waiting for a delay (eg. after a failure) before being ready to run;
+	// jobs waiting on dependencies are not pending.
+	Pending int
+
+	// OldestPending is how long the longest pending job has been pending.
+	OldestPending time.Duration
+
+	// Successes and Failures are the number of runs of the RepGroup's jobs
+	// that completed and that ended without completion (failed, or were lost
+	// and confirmed dead), during the last ServerSLOWindow.
+	Successes uint64
+	Failures  uint64
+
+	// FailureRatio is Failures / (Successes + Failures), or 0 if there were
+	// no runs.
+	FailureRatio float64
+
+	// LastCompletion is when a job in the RepGroup last completed; it is the
+	// zero time if none have completed since the server started.
+	LastCompletion time.Time
+
+	// SinceLastCompletion is how long ago LastCompletion was, or how long ago
+	// the server first saw a job of the RepGroup if none have completed.
+	SinceLastCompletion time.Duration
+}
+
+// sloBucket counts the runs that ended during one slot of time.
+type sloBucket struct {
+	slot      int64
+	successes uint64
+	failures  uint64
+}
+
+// repGroupSLO is what an sloTracker keeps for each RepGroup.
+type repGroupSLO struct {
+	firstSeen      time.Time
+	lastCompletion time.Time
+	jobs           int
+	pending        map[string]time.Time // job keys to when they became pending
+	buckets        [sloBuckets]sloBucket
+}
+
+// record counts a run that ended in the given slot.
+func (g *repGroupSLO) record(slot int64, failed bool) {
+	b := &g.buckets[slot%sloBuckets]
+	if b.slot != slot {
+		*b = sloBucket{slot: slot}
+	}
+	if failed {
+		b.failures++
+	} else {
+		b.successes++
+	}
+}
+
+// counts returns the number of runs that ended in the window ending with the
+// given slot.
+func (g *repGroupSLO) counts(slot int64) (successes, failures uint64) {
+	for _, b := range g.buckets {
+		if b.slot > slot-sloBuckets && b.slot <= slot {
+			successes += b.successes
+			failures += b.failures
+		}
+	}
+	return successes, failures
+}
+
+// sloTracker keeps a repGroupSLO for every RepGroup that has jobs in the queue
+// or that had runs end within its window.
+type sloTracker struct {
+	window time.Duration
+	width  time.Duration
+	groups map[string]*repGroupSLO
+	mutex  sync.Mutex
+}
+
+// newSLOTracker creates an sloTracker that counts runs over the given window.
+func newSLOTracker(window time.Duration) *sloTracker {
+	width := window / sloBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &sloTracker{
+		window: window,
+		width:  width,
+		groups: make(map[string]*repGroupSLO),
+	}
+}
+
+// slot returns the slot of time the given time falls in.
+func (t *sloTracker) slot(when time.Time) int64 {
+	return when.UnixNano() / int64(t.width)
+}
+
+// isPendingSubQueue tells you if jobs in the given sub-queue are waiting to
+// run.
+func isPendingSubQueue(sq queue.SubQueue) bool {
+	return sq == queue.SubQueueReady || sq == queue.SubQueueDelay
+}
+
+// noteTransition is a queue.ChangedCallback, subscribed to all changes in our
+// queue, that keeps each RepGroup's metrics up to date.
+func (t *sloTracker) noteTransition(from, to queue.SubQueue, data []interface{}) {
+	now := time.Now()
+	slot := t.slot(now)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, inter := range data {
+		job, ok := inter.(*Job)
+		if !ok {
+			continue
+		}
+		job.RLock()
+		rg := job.RepGroup
+		state := job.State
+		job.RUnlock()
+
+		g, exists := t.groups[rg]
+		if !exists {
+			g = &repGroupSLO{firstSeen: now, pending: make(map[string]time.Time)}
+			t.groups[rg] = g
+		}
+
+		if from == queue.SubQueueNew {
+			g.jobs++
+		}
+		if to == queue.SubQueueRemoved {
+			g.jobs--
+		}
+
+		wasPending, isPending := isPendingSubQueue(from), isPendingSubQueue(to)
+		if isPending && !wasPending {
+			g.pending[job.Key()] = now
+		} else if wasPending && !isPending {
+			delete(g.pending, job.Key())
+		}
+
+		switch {
+		case to == queue.SubQueueRemoved && state == JobStateComplete:
+			g.record(slot, false)
+			g.lastCompletion = now
+		case from == queue.SubQueueRun && to != queue.SubQueueRemoved:
+			g.record(slot, true)
+		}
+
+		if g.jobs <= 0 {
+			if s, f := g.counts(slot); s == 0 && f == 0 {
+				delete(t.groups, rg)
+			}
+		}
+	}
+}
+
+// snapshot returns the current metrics of every RepGroup, sorted by RepGroup.
+// RepGroups with no jobs in the queue and no runs within the window are
+// forgotten about.
+func (t *sloTracker) snapshot() []*RepGroupSLO {
+	now := time.Now()
+	slot := t.slot(now)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	slos := make([]*RepGroupSLO, 0, len(t.groups))
+	for rg, g := range t.groups {
+		successes, failures := g.counts(slot)
+		if g.jobs <= 0 && successes == 0 && failures == 0 {
+			delete(t.groups, rg)
+			continue
+		}
+
+		slo := &RepGroupSLO{
+			RepGroup:       rg,
+			Jobs:           g.jobs,
+			Pending:        len(g.pending),
+			Successes:      successes,
+			Failures:       failures,
+			LastCompletion: g.lastCompletion,
+		}
+
+		for _, since := range g.pending {
+			if age := now.Sub(since); age > slo.OldestPending {
+				slo.OldestPending = age
+			}
+		}
+
+		if runs := successes + failures; runs > 0 {
+			slo.FailureRatio = float64(failures) / float64(runs)
+		}
+
+		if g.lastCompletion.IsZero() {
+			slo.SinceLastCompletion = now.Sub(g.firstSeen)
+		} else {
+			slo.SinceLastCompletion = now.Sub(g.lastCompletion)
+		}
+
+		slos = append(slos, slo)
+	}
+
+	sort.Slice(slos, func(i, j int) bool {
+		return slos[i].RepGroup < slos[j].RepGroup
+	})
+	return slos
+}
+
+// GetRepGroupSLOs returns SLO-style metrics on every RepGroup that currently
+// has jobs in the queue, or that had runs end during the last
+// ServerSLOWindow.
+func (s *Server) GetRepGroupSLOs() []*RepGroupSLO {
+	return s.slo.snapshot()
+}
+
+// prometheusLabelEscaper escapes label values for the Prometheus text format.
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusFloat formats a value for the Prometheus text format.
+func prometheusFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writePrometheusSLOs writes the given RepGroupSLOs to w in the Prometheus
+// text exposition format. Every RepGroup's metrics are labelled with
+// repgroup="<RepGroup>", and nothing else, so that the same series continue to
+// be reported for a RepGroup for as long as it has jobs.
+func writePrometheusSLOs(w io.Writer, slos []*RepGroupSLO, window time.Duration) error {
+	type metric struct {
+		name, help string
+		value      func(slo *RepGroupSLO) (string, bool)
+	}
+	metrics := []metric{
+		{"wr_repgroup_jobs", "Number of the RepGroup's jobs that have not completed or been deleted.",
+			func(slo *RepGroupSLO) (string, bool) { return strconv.Itoa(slo.Jobs), true }},
+		{"wr_repgroup_pending_jobs", "Number of the RepGroup's jobs that are waiting to run.",
+			func(slo *RepGroupSLO) (string, bool) { return strconv.Itoa(slo.Pending), true }},
+		{"wr_repgroup_oldest_pending_seconds", "How long the RepGroup's longest waiting job has been waiting to run.",
+			func(slo *RepGroupSLO) (string, bool) { return prometheusFloat(slo.OldestPending.Seconds()), true }},
+		{"wr_repgroup_window_successes", "Number of the RepGroup's job runs that completed during the SLO window.",
+			func(slo *RepGroupSLO) (string, bool) { return strconv.FormatUint(slo.Successes, 10), true }},
+		{"wr_repgroup_window_failures", "Number of the RepGroup's job runs that did not complete during the SLO window.",
+			func(slo *RepGroupSLO) (string, bool) { return strconv.FormatUint(slo.Failures, 10), true }},
+		{"wr_repgroup_failure_ratio", "Fraction of the RepGroup's job runs that did not complete during the SLO window.",
+			func(slo *RepGroupSLO) (string, bool) { return prometheusFloat(slo.FailureRatio), true }},
+		{"wr_repgroup_last_completion_timestamp_seconds", "Unix time that a job in the RepGroup last completed.",
+			func(slo *RepGroupSLO) (string, bool) {
+				if slo.LastCompletion.IsZero() {
+					return "", false
+				}
+				return prometheusFloat(float64(slo.LastCompletion.UnixNano()) / float64(time.Second)), true
+			}},
+		{"wr_repgroup_seconds_since_last_completion", "Seconds since a job in the RepGroup last completed, or since the RepGroup was first seen if none have.",
+			func(slo *RepGroupSLO) (string, bool) { return prometheusFloat(slo.SinceLastCompletion.Seconds()), true }},
+	}
+
+	_, err := fmt.Fprintf(w, "# HELP wr_slo_window_seconds Length of the rolling window that SLO counts are made over.\n"+
+		"# TYPE wr_slo_window_seconds gauge\nwr_slo_window_seconds %s\n", prometheusFloat(window.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	for _, m := range metrics {
+		_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		if err != nil {
+			return err
+		}
+		for _, slo := range slos {
+			value, ok := m.value(slo)
+			if !ok {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "%s{repgroup=\"%s\"} %s\n", m.name, prometheusLabelEscaper.Replace(slo.RepGroup), value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
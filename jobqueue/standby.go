@@ -0,0 +1,323 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for running a server as the standby of another
+// (the primary): we replicate the primary's database and check that it is
+// alive, and only once it has stopped responding do we go on to serve, on our
+// own ports, using the replicated database. Runners of the primary reconnect
+// to us if they were told to use a service address that now leads to us (see
+// ServerConfig.ServiceAddr).
+//
+// When we take over we increment the database's epoch (see dbEpoch.go), and
+// keep telling our old primary's address about it, so that a primary that
+// only seemed to have failed stops once it can be reached again.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/inconshreveable/log15"
+)
+
+// these global variables are primarily exported for testing purposes; you
+// probably shouldn't change them
+var (
+	ServerStandbyCheckInterval = 5 * time.Second
+	ServerStandbySyncInterval  = 5 * time.Second
+	ServerStandbyFailures      = 3
+)
+
+// standby holds the state of a server that is waiting to take over from its
+// primary.
+type standby struct {
+	config  ServerConfig
+	token   []byte
+	logger  log15.Logger
+	jq      *Client
+	txid    int
+	synced  time.Time
+	fails   int
+	timeout time.Duration
+}
+
+// standbyUntilPrimaryFails is used by Serve() when config.StandbyOf is set. It
+// blocks, replicating the primary's database to config.DBFile, until the
+// primary has failed ServerStandbyFailures health checks in a row, having
+// replicated its database at least once.
+func standbyUntilPrimaryFails(config ServerConfig, token []byte, logger log15.Logger) error {
+	if config.DBFile == "" && config.DBURL == "" {
+		return fmt.Errorf("a standby needs a DBFile to replicate to")
+	}
+	sb := &standby{
+		config:  config,
+		token:   token,
+		logger:  logger,
+		timeout: ServerStandbyCheckInterval,
+	}
+	defer sb.disconnect()
+
+	logger.Info("standing by", "primary", config.StandbyOf)
+	ticker := time.NewTicker(ServerStandbyCheckInterval)
+	defer ticker.Stop()
+	for {
+		if sb.check() {
+			return nil
+		}
+		<-ticker.C
+	}
+}
+
+// check health-checks the primary, replicating its database if it's time to.
+// Returns true if we should now take over.
+func (sb *standby) check() bool {
+	err := sb.ping()
+	if err == nil {
+		sb.fails = 0
+		if time.Since(sb.synced) >= ServerStandbySyncInterval {
+			err = sb.sync()
+			if err != nil {
+				sb.logger.Warn("standby failed to replicate the primary's database", "primary", sb.config.StandbyOf, "err", err)
+			}
+		}
+		return false
+	}
+
+	sb.disconnect()
+	sb.fails++
+	if sb.synced.IsZero() {
+		sb.logger.Warn("standby can't reach a primary it has never replicated; won't take over", "primary", sb.config.StandbyOf, "err", err)
+		return false
+	}
+	sb.logger.Warn("standby failed to reach the primary", "primary", sb.config.StandbyOf, "failures", sb.fails, "err", err)
+	return sb.fails >= ServerStandbyFailures
+}
+
+// ping connects to the primary if necessary, and checks that it responds.
+func (sb *standby) ping() error {
+	if sb.jq == nil {
+		jq, err := Connect(sb.config.StandbyOf, sb.config.CAFile, standbyCertDomain(sb.config), sb.token, sb.timeout)
+		if err != nil {
+			return err
+		}
+		sb.jq = jq
+	}
+	_, err := sb.jq.Ping(sb.timeout)
+	return err
+}
+
+// sync replicates the primary's database to our DBFile, if it has changed
+// since we last did so.
+func (sb *standby) sync() error {
+	if sb.config.DBURL != "" {
+		// we share our primary's external database, so have nothing to copy
+		sb.synced = time.Now()
+		return nil
+	}
+
+	txid, err := sb.jq.ReplicateDB(sb.config.DBFile, sb.txid)
+	if err != nil {
+		return err
+	}
+	if txid != sb.txid {
+		sb.logger.Debug("standby replicated the primary's database", "primary", sb.config.StandbyOf, "txid", txid)
+	}
+	sb.txid = txid
+	sb.synced = time.Now()
+	return nil
+}
+
+// disconnect disconnects from the primary, if connected.
+func (sb *standby) disconnect() {
+	if sb.jq == nil {
+		return
+	}
+	err := sb.jq.Disconnect()
+	if err != nil {
+		sb.logger.Debug("standby disconnection from the primary failed", "err", err)
+	}
+	sb.jq = nil
+}
+
+// standbyCertDomain returns the domain the primary's certificate should be
+// valid for, which is the same as ours.
+func standbyCertDomain(config ServerConfig) string {
+	if config.CertDomain == "" {
+		return localhost
+	}
+	return config.CertDomain
+}
+
+// runTakeoverCmd runs the given TakeoverCmd in the background, now that we
+// have taken over from our primary.
+func (s *Server) runTakeoverCmd(takeoverCmd string) {
+	go func() {
+		defer internal.LogPanic(s.Logger, "takeover command", false)
+		cmd := exec.Command("/bin/bash", "-c", takeoverCmd) // #nosec the command comes from the server's own config
+		cmd.Env = append(os.Environ(), "WR_MANAGER_ADDR="+s.ServerInfo.Addr)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			s.Error("takeover command failed", "cmd", takeoverCmd, "err", err, "output", strings.TrimSpace(string(out)))
+			return
+		}
+		s.Info("takeover command ran", "cmd", takeoverCmd)
+	}()
+}
+
+// fenceOldPrimary is run by a standby that has taken over from its primary,
+// with the epoch it took over with. Every ServerStandbyCheckInterval until we
+// stop, it tries to tell the server at our old primary's address our epoch, so
+// that if the primary comes back (eg. after a network partition) it stops
+// instead of carrying on as if it were still the primary.
+func (s *Server) fenceOldPrimary(config ServerConfig, token []byte, epoch uint64) {
+	defer internal.LogPanic(s.Logger, "fencing old primary", false)
+	ticker := time.NewTicker(ServerStandbyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.fence(config, token, epoch)
+		case <-s.stopClientHandling:
+			return
+		}
+	}
+}
+
+// fence tells the server at our old primary's address our epoch, if it is up.
+// If that server turns out to have a later epoch than us (it took over from us
+// in turn), we are fenced instead.
+func (s *Server) fence(config ServerConfig, token []byte, epoch uint64) {
+	jq, err := Connect(config.StandbyOf, config.CAFile, standbyCertDomain(config), token, ServerStandbyCheckInterval)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if errd := jq.Disconnect(); errd != nil {
+			s.Debug("disconnection from the old primary failed", "err", errd)
+		}
+	}()
+
+	theirs, err := jq.Fence(epoch)
+	if err != nil {
+		s.Warn("failed to fence the old primary", "primary", config.StandbyOf, "err", err)
+		return
+	}
+	switch {
+	case theirs < epoch:
+		s.Warn("fenced the old primary, which had come back", "primary", config.StandbyOf, "epoch", theirs)
+	case theirs > epoch:
+		s.db.epochs.supersededBy(theirs)
+	}
+}
+
+// stepDownWhenFenced shuts us down if a standby with a later epoch takes over
+// from us. Our runners and scheduled jobs are left alone, for the standby to
+// take over.
+func (s *Server) stepDownWhenFenced() {
+	defer internal.LogPanic(s.Logger, "stepping down", false)
+	select {
+	case <-s.db.epochs.fenced:
+		s.Error("a standby has taken over from us; stopping", "epoch", s.db.epochs.current())
+		s.shutdown(ErrClosedFenced, false, true)
+	case <-s.stopClientHandling:
+	}
+}
+
+// runnerServerAddr returns the address we tell runners to connect to.
+func (s *Server) runnerServerAddr() string {
+	if s.serviceAddr != "" {
+		return s.serviceAddr
+	}
+	return s.ServerInfo.Addr
+}
+
+// replicateDB writes to the given writer what a standby with a copy of our
+// database as of the transaction with the given id needs to bring it up to
+// date. Returns the id of the last transaction written, and whether that was
+// the whole database instead of changes.
+func (s *Server) replicateDB(w io.Writer, txid int) (int, bool, error) {
+	return s.db.replicate(w, txid)
+}
+
+// ReplicateDB is used by a standby server to copy the server's database to the
+// given path. Supply a txid of 0 to get a copy of the whole database; supply
+// the id returned by your previous call to instead have just the changes made
+// since then applied to the copy at path (unless the server no longer has them
+// all, in which case the whole database is copied again). If the database
+// hasn't changed, nothing is done. Returns the id of the last transaction your
+// copy has seen; supply it to your next call.
+func (c *Client) ReplicateDB(path string, txid int) (int, error) {
+	return c.ReplicateDBContext(context.Background(), path, txid)
+}
+
+// ReplicateDBContext is like ReplicateDB(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) ReplicateDBContext(ctx context.Context, path string, txid int) (int, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "replicate", DBTxID: txid})
+	if err != nil {
+		return txid, err
+	}
+	if resp.DBTxID == txid {
+		return txid, nil
+	}
+	if len(resp.DB) == 0 {
+		if err = applyDBChanges(path, resp.DBChanges); err != nil {
+			return txid, err
+		}
+		return resp.DBTxID, nil
+	}
+
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, resp.DB, dbFilePermission)
+	if err != nil {
+		if rerr := os.Remove(tmpPath); rerr != nil {
+			err = fmt.Errorf("%s\n%s", err.Error(), rerr.Error())
+		}
+		return txid, err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return txid, err
+	}
+	return resp.DBTxID, nil
+}
+
+// Fence is used by a standby server that took over from the server you're
+// connected to, to tell it its epoch. If that is later than the server's own,
+// the server stops writing to its database and shuts down, leaving its runners
+// to reconnect to the standby. Returns the server's epoch.
+func (c *Client) Fence(epoch uint64) (uint64, error) {
+	return c.FenceContext(context.Background(), epoch)
+}
+
+// FenceContext is like Fence(), but stops waiting for the server and returns
+// ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) FenceContext(ctx context.Context, epoch uint64) (uint64, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "fence", Epoch: epoch})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Epoch, nil
+}
@@ -0,0 +1,158 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that limits how many jobs can start running per
+// minute, overall and per RepGroup.
+
+import (
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// startRate records the times at which jobs were allowed to start, for
+// limiting the rate of starts to max per ServerStartRateWindow.
+type startRate struct {
+	max    int
+	starts []time.Time
+}
+
+// wait tells you how long after now it will be before another job can start,
+// first forgetting about starts that are no longer in the window. Returns 0 if
+// a job can start now.
+func (r *startRate) wait(now time.Time) time.Duration {
+	cutoff := now.Add(-ServerStartRateWindow)
+	i := 0
+	for i < len(r.starts) && !r.starts[i].After(cutoff) {
+		i++
+	}
+	r.starts = r.starts[i:]
+
+	if r.max <= 0 || len(r.starts) < r.max {
+		return 0
+	}
+	return r.starts[len(r.starts)-r.max].Sub(cutoff)
+}
+
+// setRepGroupStartRate sets the maximum number of jobs with the given RepGroup
+// that can start running per minute, or removes the limit if max is 0.
+func (s *Server) setRepGroupStartRate(repGroup string, max int) (srerr string, qerr error) {
+	if err := s.db.storeRepGroupStartRate(repGroup, max); err != nil {
+		return ErrDBError, err
+	}
+
+	s.srmutex.Lock()
+	defer s.srmutex.Unlock()
+	if max <= 0 {
+		delete(s.rgStartRates, repGroup)
+		return "", nil
+	}
+	if r, exists := s.rgStartRates[repGroup]; exists {
+		r.max = max
+	} else {
+		s.rgStartRates[repGroup] = &startRate{max: max}
+	}
+	return "", nil
+}
+
+// startRateHold is used by our queue.Hold, hold(), to hold back jobs that can't
+// start yet because too many jobs (or too many jobs in their RepGroup) have
+// recently started. Jobs that are allowed to start are counted as starting
+// now, and stay allowed until reserved, or the window passes.
+func (s *Server) startRateHold(item *queue.Item) time.Duration {
+	job, ok := item.Data().(*Job)
+	if !ok {
+		return 0
+	}
+	job.RLock()
+	repGroup := job.RepGroup
+	job.RUnlock()
+
+	s.srmutex.Lock()
+	defer s.srmutex.Unlock()
+	rgRate := s.rgStartRates[repGroup]
+	if s.globalStartRate.max <= 0 && rgRate == nil {
+		return 0
+	}
+
+	now := time.Now()
+	for key, granted := range s.startGrants {
+		if now.Sub(granted) >= ServerStartRateWindow {
+			delete(s.startGrants, key)
+		}
+	}
+	if _, granted := s.startGrants[item.Key]; granted {
+		return 0
+	}
+
+	wait := s.globalStartRate.wait(now)
+	if rgRate != nil {
+		if rgWait := rgRate.wait(now); rgWait > wait {
+			wait = rgWait
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	s.globalStartRate.starts = append(s.globalStartRate.starts, now)
+	if rgRate != nil {
+		rgRate.starts = append(rgRate.starts, now)
+	}
+	s.startGrants[item.Key] = now
+	return 0
+}
+
+// startRateWait tells you how long it will be before a job with the given
+// RepGroup could start, considering start rate limits, without counting it as
+// starting.
+func (s *Server) startRateWait(repGroup string) time.Duration {
+	s.srmutex.Lock()
+	defer s.srmutex.Unlock()
+	now := time.Now()
+	wait := s.globalStartRate.wait(now)
+	if rgRate := s.rgStartRates[repGroup]; rgRate != nil {
+		if rgWait := rgRate.wait(now); rgWait > wait {
+			wait = rgWait
+		}
+	}
+	return wait
+}
+
+// startRateReserved notes that the job with the given key was reserved, so that
+// it will count as starting again if it has to be run again.
+func (s *Server) startRateReserved(key string) {
+	s.srmutex.Lock()
+	defer s.srmutex.Unlock()
+	delete(s.startGrants, key)
+}
+
+// hold is our queue.Hold, which holds back jobs that are outside of their run
+// window, that would overrun a maintenance window, or that would start too soon
+// after too many other jobs.
+func (s *Server) hold(item *queue.Item) time.Duration {
+	if until := s.runWindowHold(item); until > 0 {
+		return until
+	}
+	if until := s.maintenanceHold(item); until > 0 {
+		return until
+	}
+	return s.startRateHold(item)
+}
@@ -3687,154 +3687,308 @@ Efph6ArjfwMAAP//4MqlMHMTAAA=
 	"/status.html": {
 		name:    "status.html",
 		local:   "static/status.html",
-		size:    66335,
-		modtime: 1550137006,
+		size:    119448,
+		modtime: 1792259876,
 		compressed: `
-H4sIAAAAAAAC/+x9a3cbN7Lgd/+KCvfekLRJSkomu7mSqRxbcma8sSdeOzOz9+jozAXZRRJWN8AB0KS5
-uf7vewD0k+wHutWUlZz4gyWRQKFeKBQKQNXzr65/vvrlP9+9gpUK/Msnz/UP8AlbTnvIepdPAACer5B4
-9lfzZ4CKwHxFhEQ17YVqMf6+l/laUeXj5T/ewwdFVCifn9gPnqQtvhqP4eP/CVHsYMEFbIigPJQQKupT
-tRsBYR4wRA89mO1gxrmSSpD15KOE8TgzkpwLulYgxXzaO/koTz7+S8McfzP5ZvKnSUDZ5KPsXT4/sc32
-EXgZgzU4rAVKZIooypkZX6qdT9kyP6ChfKXUeoz/Culm2vu/47+9GF/xYE0UnfnYgzlnCpma9l6/mqK3
-xN5+b0YCnPY2FLdrLlSmw5Z6ajX1cEPnODZ/jIAyqijxx3JOfJyeZYH5lN2BQH/a05iiXCGqHqwELqa9
-k7mUJwnbxt9Ovp38L8OPuZS9Cv4Vdali4U+Mz+94qAwHcYNMwYow75Bv+wPdRR3H307+NDl1G8fKSnEI
-yB3CLFSKM2lEpVaULSVsubiDb8ZbsoMZqi0ig3gc0yyhzgE3y4WzybeTb2qx+8ADBL4AHgrgWwZLZCiI
-Dyv01yhgEbK51qoa3d2K8enkdHK2N5S7vBMAqZCfn6Qz9/mMe7ss6h7dAPWmPUY2PZj7RErz+4wIsD/G
-Hi5I6KseCO6j+ZIuzQTJ6FACKoKg1ZlQhmKvzX67aAiNX2Fby6M1YXsdZoIwr5e1LrpRwVgnHt3soZn/
-KPrzkCHSAO7VUbTXHoXgQvbAI4qMZ5R5096CCyTz1TlkWtSwhfgoFJj/xx5hS60/xEOgrIxH6+yICj+p
-c/g3/YlWonUTvhQTNyOeRLHBMtIy33dNWabzmjD0wfw/3hLBKFuW9CrsadSsuo/+98EQUtkkmfR3HOji
-HN4JPvMxgOkUer3cBK+EEMboeVwp9HKsVZz7iq7P4VcwC+c59F8vtI2TQCV8DKUCAgqDNRdE7PT6wXCu
-6IaqHVApQxzZxgFKSZYIW+r7sORAjGHcAVUS/cWkD597lwFdrhTMEDwk3vOT8NKN+JM77kRrllNfPQyr
-flmhQNgSCQTW0Yih1AuSYYrV1Qm8VpYvjBvyQ4meXlpEyICrFQr4yGdyAq/ZBqXSVg+BKggIC4nv74Au
-YMdD8OkdjmCGejbAiiplx0H4r580cKr+K1qnLLepBMbB50b5Q0lmPnbH84KJXT0n9HpQMyH+SgI8j8zw
-gZXRX5qVStvf5zNRDer1dSmg19cNwLwrB/POHcz9pvAbLpXx28hclaJzTRROFNc/BsMEs3pZW4UBtVvj
-tGf/SJaimWIwUyy2n+vQ98dCT+HcrJj7dH53Dv8mOFeTOWcLKoJrJJ41b73L16ovQaBRZDvv7TAOLHOZ
-+Pec9HEPZHMeMoUCvVIeR23d5V4yAJDfohwjG9Oh+CpsSMlXru5ERieidUkOhhMf2VKt4BLOCtFy4mHk
-Djgx0aMyoFK+jTDoXV7bD+CF7xezsZRtdRSdFlN0b4dI+2TxeMUeWfJtg8XA2bW6j3tlXKz5Cr3QRwGv
-tavi5gJkWH2lp+xgWKoyZf9uFlRIBQL1prt6wv+oWxbP+lt3fJ0sZfWS3XrZTvdOB8S9lctm1vK9A8fe
-EMuwwbCNobyndDUVMZKlGBrACU6gaICyY1f3uLYqMVWO1r7GGezEzmfZc7h5NFGKKKp1Dmenp/9+kfBj
-i74P+r+xDEDx9TggYllo97KgbKNzOAUSKn5RZiVX3x10uIA18bSFOofT3uVrNufB2keF+QjDjHhL7B0q
-D2ULX8tqorgifjp9Tlbf1e9cM9RlIWttz8M1an/qarQFXwqUspcndTzjSvHgvBJOGazxjAjI/jGWStC1
-nvp6e4n57+KlIooNxd/NiMjRadDT+7NIDxKaPfTJ7t1cz/Zn0P93sz9qZCvykNCz/HM3G8WGYh9qajOi
-D558Mev/hcS0RuYhUx2JKoLWubAiuFlxRR/9xgRG2YK3lpZA4nUzqQykjqVkYKYS0vKhbPno5dNeGiHr
-RhYh03O4a2lYqKk8og9+Y/PF7pxay8jnshvTpgF1LCENMhWPnwk6PUIZ3VMOs1B0Y7hmoaCdOwMWaCoL
-+/eDSeG4YZmnT5+aMPgOFVDtFwfI1B51WR0QfAvWz6xx25PzM3/8SY6/K/PXF1wEOR0JZwFV5yDwXyFK
-9R7XfxY8XDt6xpStQzVe1vQ4OF3MdBsTz+Oxt674cqkVOjppiD5NjgSnPbMdt6cP094rplAAYUC150EX
-FAUoDsSXHCSiORqwZ4HAF0B8H+Y8CAjzJBDPQw+2VK1ArYjKQJj0LtM/XHbVzw0x0U5Ua3Ky79KsNsgL
-7ufm5Yb4IWqW1/K6knMzxXruW+X9YGh82mwRt2rQu8wNtvR36xWdcwbJb+O1T3bjORVzP3Mc4bhLrmZm
-5bzTvGxz7Kz/He6YM6ZMcqHIzMdY8V3CiivRaG9eeEZdMKz+bBDfXxj4IzGEX0GgCgUDf0I9uAShf/wA
-Z3AO4zP4PKzZw9eGA6pin43iAG6xgDLLnzH2TjEC19BAg/CAW1Sg68hAp9tOMBEtYi5GFTgGRFAyNqYn
-oGzaO819Qj5Ne2enp5Xuw2EQYQRxEG1NBDI1kSu+fY9rY5+u7RZ+BEQpocH00/EY3/ZzAF08kP2p2y4U
-UeGBtI5CNI9f1juCvzHVKApc1KhH1KVSQXJg2ylJuyBIpZrcI/7xeFWFsgU/tp4chkwqdeS9bl6hHxlw
-bXSjTdilQi9aRlwelUYcW/57QZpq6dsQSZX8Y3CtpN8q0FMl/7YxnsdrE6KT8iNrxUFYqFIt3nBZtWak
-wNooRYvAUoVG3COm9GV14mHkfhCGqpT7SxMGqpB8Cq6N5FuFsipk3zKK9RjkfrTtAyrck3fV3iBp3XJz
-gKrjzYEGmNscoHr8m4NwPkcpjz2V4zN+9+l8FfWo0IE80DZaEEPoTg1iiKkexJ98EUVwi2U/qeNVEpfy
-UBHqy/oYemFUxV5sKw+G5K7fSGmEnrsL1z83D00QplPoR7vvPvz3f+c+jbZa/VHcWe9ccj2NJ55+vxY0
-IGKXb2J9s7SRNX25NtZk742vV/G0VzS9ct1ihXA8V7nH/T6nqFvB/azAmLGqqFlZNJBvUCx8vh1/Ojfx
-wF6TCRUQ3798TsvCgFdb7yWRmbByabNEw+bc5+IclgJ3mXAg1b+awdzoc7O3+7blLQ+Zks1sSjeczHMz
-MHiUXsazaLbnThsOHXOlS65lwh3uNsSXrvPEa0Kwpy5fKIXBWsnnJ55q0tM7lEEMSkvB85y10j8SZa8+
-rXGu0IP3L952QF0M7v2Lt5Ng9vrVlb2Q+pgI/YUG2CGlGtxE8etQmAeaR6M3Y23e2/NZ9K6pvGvuzDTh
-XMy9ZEjQYzZjX8TCMhueoyZ1pf780p2NLVjpapZa6doVF9iFrTBwjq9PbzmjiotrPr9DAV9Nod8/vkZF
-g4IdtVONytGTWe0eizplWP8jof57JJKzI3M8M+ah49to7KwQ3wncmAQSmo5QYAsxNuVeOUVfdUFRJIwF
-F1+CpiIjkKpI72F0uLESv/pE9cpwdJOhx4E597CVtShawqnS4I7H1yJO6RG1rp62UA+/nVJ/UN7PoWrO
-tdjONu50OEE1Aq0mZeHVp0wEq+wVj1zx7QflTfRXA5OXYQR9i0d/2Lv82lcXusnXS3Xh+mCq07lexKav
-umCUpoxxhpqyhyep2UxqPpvuOw9eCfFl58ErIR7FPHglxOOeB/dl1O97HrRCrtWq+w7JXfPoQOmiq8G1
-jA7cb+3VA7faMN/L5BjutdszV7JQg2zLw8esbR8UEQq9jpQtgpZ7HH1EbWvl1DKvM3INrMdM7D+I76vG
-8bdSemNwreNvD0T21bu/dUh1BO2xE/0XLlVHFP8lujvzCCmE1+86JNJmUnqY9dCMd613og2Sgt17PbQ8
-u+5wNbR0/J7WwHe0qwXhnX1O8RiDRl/FYaOvv4ZBEpLsCTSJ4rxe7qS9F9+nzH9q7tQN/3BKHtM6XRRo
-toJqGZM91rrfffS5azLf0A3GpNoMPw9P7B+Owh+Owh+Owh+OwuNwFNIVJbpSbT9sHCts6QW0ix63ihw/
-sjDv41SNNzSgyr6ZPr74M4M9Yh3IYPl7lfp1/E7++DJPhnrEEk9w/B3L29zynlN8GJEnoz1uqSdo/q4E
-3/heJ9s0vmnX9Hp1c/G8Ypv7SaXpnb/m+Xy3D3Bj5y88QLhaEbbsLHqiQUYQH6vH+hJXZEN5KB7AXKVj
-PWJjlSL5e12jflYrFNFNZvkQ17ElD8UczeVpKkzisMesAIY9vxHZO4Bt91BlwbkyD6mRiAX91OIJ4wca
-UJ802+o+K3sMFAFLb9zb8itxXrTW9xvtTv1+Nx1NNjZJAgSM73zCoISO7C1OQ8jQ1BwT6UXehb3Ie7wA
-zr2ugKcxjTjnUDP7cZxyF+8x4Bs0eZt6l/YPt9RuHfPEJlJ5PBx5h8z7ogxJMw49JjVZf1kliU8HHwFH
-fqK+byvEfBFWND+Cil6P/rKiEj7yGZD1GomQpkDRCGahsvW75jz0PVOwLESTWjNTCc0UPwMZzldgyn8x
-VFsu7ihbxrb3AujCJOHUI1AJZK5sPa8FZTgCGhUFE7hBoaJ6YCZZmTSUkVDxgCg6N322K2QGWFxmjEpY
-0E/oTeLXrE4FNo6sCNdIvN7llf0Drp3LPXWsEHGgvPHb5JQBNsdolvaGbps7gx0Nzo+E+u0sTiOcomQB
-DkgpYZZJJXbN0fmCL6rrUkbUDddBEmRiUpxCwD1SkGtiP2mqaXYOvx4MuaGSznw8j+C91e3+bj8bHTT2
-KPH58krKc+gbiGMZ9A+b2RKp5/CrwUD/9MkM/dwYfzFt4DN8Puw/495O92KmmF8/0+sl93a/YLD2icL+
-KAJvv7+Osm4UwLMbiGKIP5rv6mDmQH428ZMDQUXlcdMkxicrFfg9U/+qhISi1LO5dEp6QgyG5gg5mjLF
-BumFQFPeUYbRL1vCzHJQ4vtbfDLlhVZYnqwlV4goSf8cJX7GbOboXmlWvzhLcwSm96TOEGP92ziTdXpF
-vMxep2R83eAqu9UxOx29xKJemucklFiK/CL3jtCi/8OTdtM+dzzrQGKLceq/3NeuaSPtenBVASIwW/zx
-h4YkF7k0pXy4015oufyslzRQtmSr9rxmCMTmuI2rqmpC54EnQSq+BvyE81BRtrwAslAoQI+gHbQtoQpC
-pqgf+3dSqyIPMEpzNixNMdJOxMKs+vXEmXbEB75IJRhNtQ3uBTuipK2aHm5cy8ByRVIfmdJuKqF+C0IO
-q4k3MbF5m16T7D/x03r1c3buWO2tKycpCKh6YejK3U9QIsThCOIceVbGkzlZU0V8+v/Q1AN8g0qhsInE
-gPh+v+eQY/7IiC+ILxtiflaLdyOrG0twOv2yImzGifuzwGknEZczMNRE1fwi17F3eUXYHCv25oW+azyL
-D91XqTweqhMUojsXViqvqf/qL0cQebLKa+LKxmO5+LFx1zlnCpkynX8O1TpUul+Jb3nIMp8GVC3tDQ6D
-cwcs85fNOdaETX1zrwbsRYu+k7uPbFPu6/vLvxMhGzDNi1Ildscy79gsS64o7Lrjm9eCb+nlkc5Yh+uH
-4h3FTtiG64Z8m6Vn2F1xbYarI3MtPWfugGczXDXkmfUpu2KXgXZkhplzWSg8Te6Ag4aChjxEtumMgzFy
-x+PfK7ahgjPNMPg7EZTM/E7mK7JNJd+cdxNFo5RtJIpqExk3r2xHUbzzjbpUlbpu4GOtxP4n0TE6NWjq
-X4vosRu1r+d8vbuAb07P/uf4m9Oz7+HPyPTG9D1KJGK+sheIM+cGeyhZ+Omn+1pbwPqPZEPsp3to3fEJ
-X2v/WU48XKD429ojCiVMzTboIk/kyQlsKG4D7qFvjrA9Ktc+2cUnImH+eD4uFGXC/qH8O8XtW911MCya
-HkSARH+hR15ReZgbQ385UfwOGUxhieodESRAheLl7q8kwEHPfNcblvQk2oZQtozKrU0N5TOJYqNnxwsh
-yG5Q1tf2QSG4aNZxRjzzblA0HDAu2d+sVxzc2e9V2iFKpRznu4Yp9PvVTaMDnNp2P78o+X5LfP8XGqDV
-M+HWSvOB4RZqyCcKrT88hW+/O714UsalgG/wJfE+GMnANNXTAfWKVLNAnBGUtBaa/byst/4XlUmzDSev
-r/UmmXrFOWA+F9D4uZKeqCx8jppALivJibXskJj5Cr3XUoboQlDSePJWLjVVgVzen6y41iZMS1BIkm+f
-72n76XCCnxQyb/ArJDpxvq8jn4ejMrBx9u6OAduU310DjTILdgzWpBDvGGaUq7xzcdkKbUdTgyPAjotC
-HUEZjgA1KldzBHU4Bg+47/3TVErsn8Nplc78c86DdahQtzu0ShfVVummb8e4tWttBMpLTWiZ4aQLGOxB
-ymNz67SG5ACkJN+W2N3im8Pa5TL9YApFOKHXvzVx4oMvYwtZ+LW1c8VfRdaq8Etjcwq/iSzHbdHSHzPV
-EnIJp1X80xQHoa/o2qdm6T87PYUTy4TybGwnJ7BFkHPimytG//G9uWi04dQDArNwCZTBjHMllSDrpLZJ
-FbiZ3kVtV3S+ii8YydBXGo5aIZjLLOOAS6UbVsFZ+HR+h8IcEIUK+ALwE5UK2RxHgBtzH4mHy5XGn+EG
-K4FZDnLtE52dnlby0PDCgymsUcyRqQ/6bzG4GWSY+7RCp4YjqGma0bC6xom+1TZMta+uaayLde1SzRze
-juA/vh9eVPJN8JB5Wca9Nx+IgWXoCL6pAFDETm1AbwcR2JvT2ybdM+tbCuKsAYhkGUu7f9Oku12t0s7f
-NugcL0pp7z816B2vPWnv78p6l9jOchOsN7Dl9iSy4CUtPjuufeV7m/gN6hRubmu2iW84vzObvl/LVruD
-EtDN9qN0ybjAaIAnBRZHooJwbWzeFmeSz+/wsOycNu5byjy+nfwDZx9MI5hOp6AFt6AMq/dsmb37ZB3K
-1aD3nzwUMBN8K1GAx1GaavcyXK+5UJCMIYtCCZ8BfYlV423jzWoCaNDbSnl+ctKDZ+DzuUmVMllxqRgJ
-EJ5B7zz3jcHiGfROLOb/3MofTGRj2osXRvNnibpGOEw442sTKan1SLK9pFa9//3h579OpNKrCl3sBr/G
-pRDOoTcPhTB3vD8Py6ZLHVpzn8v8NrUWsUMRXnHG0HZX3OhPQBhZooAVkTBDZKaU4Ve9YdWq/vTpU70w
-2ivEa+775t6SEjtz0xfHKLX2U2lv18yTMSeTSYmpqCY9KNijV+6wP0quRWgEsiZC4gAnHlFkWNpDTxbd
-a7Ii8ucteyf4GoXaDfo/Ch6Y4E1/WDViPDFNmIeFwQyFtDdT5vZxY2VPsYSpQfqmH5uM/m1lD7MoRuGn
-yoaaMGGiC71nxPef9eqosMY2CWzl7HV14t1ojieeet5e7nNWLIdtUEks9U3BGDdieXvrhGSjgX91uszb
-p3qPLpYjt9bHicI8WFTmQaI0DxS1eYgozsNEdYq0DNXxh0nq4h2fnLKgVdP5cC8oFYEod02+V//y4JK7
-/t2Xk1EBz/YgMlVA74OHOTnZBxC52I5AHKJfLaJhjk5e0bLTOlBW6AAkQBvEzEp2YCms2vCZ45awKry2
-h3kSWct+ng+qpd9k42mZT3OhtPTzTBQt/TANU+yNaa3q/ueJGSyNuLWOwHUTkWsRoWsC6zCYtx+xawKt
-VXCvTbCvCbC9uKBr8K99MLBwBhyE10rmQ0W78uhf4VypaFUa8yuaR5WYJ7OqolV2jtXGDlvHEhupRDxl
-zBtWC1NvV7XqN4OjiH2EEasTEAWE7WDNKVMN56KiAY7A40B8Hzyc23tgGnpor6o0mkJUSHURxXsE2te/
-VMbvX1borxvBs/ySPECgTCrC5ij1xEyn6qiR3QkVUAWBNhFlQYYydbjDnYn6pb7laM9LHGX8vVHiuY1S
-H2yUelOjrF80yns4t+56uuACBho7ClM4vQAKz+H7C6DPnjVZIw6Wf03rDb29NW9F4gguvW0KM+enJDAz
-8JoV6Pn8pPuWx2fg898vAx39tEJPsDqK3yyq32GUvzrqb6OjMT0O3C+JPR0EqSY+sqVawRjOHJDSlix6
-9ckXwEMBvgE9Sp4fguRCARceChdoQSiVMdo2CGnTP2wxeoa7wiC+iFgTn4yjm1wovUBKroEQX3LQjDML
-IAPKEqvpAmxvp+bG8oODlUaSq9FrbS4WggcjULyyodxSNV8NbMA2DRA7mYE5kZgJ/jnNEo1U8V7IbZbN
-BJK7C2fUkoBhW+QSB/QI6EVhxnaoRT7vMdCKA5MtEYsd7SOgZoOZ7fCyrv0RkIqjn+3QircTnSFWYxnS
-y0fmZHb/KGP/5GYIX3+dPcm92W9wWwzhF54YkjoAN3s9buEyPkG64qGeey7G6OQEorNm4833Fe+DEoRJ
-qihno2Q1UivKltIFHBEYb7LNKmVOBs1iYeYekLl56oqe9tCc8FNuK4M7o8Z7jKpXoj3xuwwynbqHc+yG
-oSEZ7uGln2cfca4m2s2spmIYeytNkHclwDVCeL8Wzqd7uSU8M+/ciG6ziOt/it9nGW9gZNsv54VoNlzQ
-WyHaZGEvQLLR0t4OwUZLfBGKzRb5Vkg2WOwLMGyy3LdCr9GyX4Bgs4W/FYrpUeaTRiGCpUmH5H7HooLK
-NMR5cYTQSAsTEp0hfzGGJJHhL8iPz/dxIEsP4Ey4BH6AMziH04taJ1R7wi681FtZhtvIcdY/BkMYt/F7
-YiiXDXwCM17U0SGY4rxoJ2GIABUNUGZ8VQlzwoAIQTexA+oKzvipF7DFvu+Dj1F+TM4QlhzUSvBwuRpp
-P9YVYEDEnZZq4lojrAVuKA+zGLtCM9kxTSIxTTFl4BOFwtn7+wqabFyazNNKd6/kdmz7mVrrgxfTlo3O
-dEbczQHsW3jWeFfRWPVb4dUOrSfu8/x0eH/b2dZ0OlhMxV3ErvhAcXOYn99DX7REPHMVsvBWqeON0ub3
-QpNpkrwnhq+/BnsBtOjpsmOUQNuwUEbXhE0qKfSAMyC5g37XPT2BNRGKzkM/c4v1AojnGbOpJERYOq1z
-26ikZsKquMam6xJne0UzJpeAeui+KJm7vvHImjVxxmOTQY+Eio9dQVEWHdY635aZ4ZKw6Pq8LUJ74dyX
-8e3Bu/cUjiMgy8JsgdP7X1zKnA8lIn4GgwHjW+PMGKKHcAJnp6enjnh+dmxX+JjenjUwvh02XX33IDVe
-iPb6wxSihx0S1WumtNj8dgyOtYAIQXZvovBPCfk2OtTsaLLoHDYzVqsT2VIB3dDb5qqbqEaDvcWokc51
-6wA/0FTrbj59dgvgJguWnWaazKMtv6/fOb3moKovAalJqkSMcZ0RL0pEMQIugDB7lYyyZR2stKfNWkql
-sbwLyvCJ2wL1Wr4knluMcj/phjNHncOnBQlBYjSv+7fDI8ntrVy2FJxJthH6KCB6TGTkFx2F14FTPLoz
-ZXaFW+yL9EAjzeRTe7ZsYXh6Q058ibXtM8lscmlH6lb3IpubpCyJjDg8e0ZdAwlSw4kB3FDXAxMapzWx
-eqFl5xxgl3TyhkhlDHlk8KI/65QrA8E48YO8Q+/UNxWUEiG6nzEeN4Zk/YkIN2fZJUlm3N8xaUmdZ6Xm
-eB/e5IY1Mop7p5+4wkjEvP8c4EALHAFawRdDi5Vi1NUalswyY3Az2YBaL2SO7yU/Fz4TJnMV12kxmzcR
-F7QjyYWispfOpuH7NC9W4lIsuAhe+WZ7UqaDc84k93Hi8+WgF4HSOyGBa7BP6pIXuTEag+Gw8g1ozfva
-vs3/1h9BjPL5Pvzyl7cnJ/D06VNzTWqHCmiwtuShF189j97IjpJHz6sic1/yVntfCGb3LKO85ODRxQIF
-Mpt0ztyBLc2DYfNfGPNeJ0C54tt4i39tTxmzQow7Vz8AX/GtaWV2xkmfUXrwWfTO+8IFoeg8sVOU4jPK
-lki9N6t5dwjZ88i2yESxgy7RMb6glpkNKtP5Ciib+6GHMj3bbIXtGy67FKU5hGzJuJfmfLBDZKIDx5bo
-XEUHeR0ilJwNNkQphVaEzMi+XK9NvpRs0qr8j6R1w7BHqwyG2X9RUMRU5EzCIoWYXDxpEXMpyt1Yv4Tn
-+Ta4aZgvJbp+bqQ0oV5ZHNdcGIuLhB0knqzivMlawNeglaRqF5MgEQEupwSapcks6lKVLrOYsTWNbXSj
-eaaaQxIywrh44kqHEU19c0PGPqMv7uUZxa9js65RhoSRLS13HilPoZP0uYlfo7hJdZsppFCWGjZXFOEg
-BG0rUVxUd46qHLimbU3rGzj3WPHtB5VbULSfNoKPfFaTPSeLoelUlXgmwWzwkc9udOvbmuZZ5g1M5ZWO
-BGceUdjL9cU8yddmaCa4qE5CsyTCK77NIJWVRZ0U7HC62SQDoYqzeeI6Zex1/GahJAHwPdjqtWTrdSY/
-lTNTvZSpSf8qlnpHZWlSVqEsrfL6HmyNyiy04WtapaIJa+2AMW8TGJXszVPYKX/TAgwlabrzJSCacTcu
-yNCYuylWTXgbDTe40cxNQVTa2T36OuWtqdVQTORBqYhmjE3rNDRmrS0g0YCryVhGZ033yPeoVNoDCjtl
-LbJNMYl7FSSasTUu4tCYqa/YpglLo3EMQ1+xTRUb9+jphImcmdeH+uOolqstrSWjaFgRqMjJ1P3yN0JK
-Sgoc1HRtJonDeq2u/ly+fmpZRNy22o8Zl4SJLXccG9/hzrGlSLx1p+bSevFObW2BzwaNr7jnCjutSurY
-wTwHOmjrHNr4yGe/8Bd7Us1OtVEkzVEkqMqpl1OP6K+B/VE1DfPdoqp50XDO3e5wZ6b8T7hz75TEt3XP
-eIPn3t1ojelrwwTOHWOtsEbK6NM9Os+512DsVMUMgB+TP91B2HKLhm4aUJ8IeAZnDQJq2fqJWX0jvl+m
-XyafjVkYM6a1NOJTAah2818Z2koCA+X6XnMctnfCUqKPNUDioEOZStZ0j5XmvFK9aoD8mDFV1WpWAag8
-n2vdVYovKcOf9DJUYoNaEfukXOclWo0PaQehZfdgagdBySYBSedgZIkDVOrwlJsgUxn7PSqxa+JdHi6Y
-dpXsCw2pn/wydEM/im/1LR7R8ctVVIbZFUid+1rHgoBvUM/mjvigwfXT3xpzQvcy1uULseIa14+JE+lx
-75dgxjtk3mPixruoLvmXUQyf7B6XatirCQ/LjJ+o342puKO+349/NuSAQSI+539Y+q+ReJ3SH8FtyoIr
-2y2h3iSP0Mh1xwanuIdFQ9p7uSS+pUsleEi8Wk4eVMOrKWnnenAXDZFcr+2PwP7y+vo8Uwyv1CcrvKKb
-9Bu25VZUfx0lkPhOaEnw3DY8rK83kPS+vIlhy2V/BG/l8hyi26Yu3Igwii6ouoca8gTJY1Ek+zVUJNeA
-b25rkc/7weZC6CaIrlQcFBe92C9wStZrf/eSmgVLDuQmGMG/Dfr/w5aV6A/zZXPSiq/2rxn3dpdPnpvi
-tZdP/n8AAAD//6Z48fgfAwEA
+H4sIAAAAAAACA+y9bXcbN5Iw+t2/osy7G5IxScmeZO4MZSrHsZ2JN1asle3MfY6vzi7IBklY3Q0G
+QIvmJP7vzykA/Ub2C7pJykrO5EMskkChUChUFQpVhacPX7x5/u7/XL6EpQr88wdP8R/wSbiYdGjY
+OX8AAPB0SYln/tQfA6oIzJZESKomnUjNh3/rZH5WTPn0/J9X8FYRFcmnJ+aLB2mLh8MhqCWFgIRk
+QQUIuhZMUQlqySSslzQEpoBJmPFwzhaRoB6smVoCgfdXr2El6Jx9guEwM+iUSApLQeeTzklne6yP
+/x1RsYE5F3BLBOORhEgxn6nNAEjoQUipRz2YbmDKuZJKkNXoo8wPIGeCrRRIMZt0PsqTj78iyOGT
+0ZPRN6OAhaOPsnP+9MS02h7/+xiqRmElqKShIorxUA8v1cZn4SI/nibyUqnVkP4asdtJ5/8bvn82
+fM6DFVFs6tMOEkfRUE06r15OqLegne3eIQnopHPL6HrFhcp0WDNPLScevWUzOtQfBsBCphjxh3JG
+fDp5XAJsLYYILwNrHvl+trHPwhsQ1J90cFpULilVHbsyMylPEgoP/zL6y+j/1bSbSdkpJ3VRjypq
+/xTy2Q2PlCY2vaWhgiUJvV0Sb41zY/sN/zL6ZnTqNozGCxSHgNxQmEZK8VDqRVVLFi4krLm4gSfD
+NdnAlKo1pSHE4+hmyeTqUTM0eDz6y+hJLXJveUCBz4FHAvg6hAUNqSA+LKm/ogLmUThD9qvm8bUY
+no5OR4+3RnJe6qR/ur5PT1JZ8nTKvU0WcY/dAvMmnZDcdmDmEyn131MiwPwz9OicRL7qgOA+1T+y
+hd5HnRStBJSFgJxKWEjFVpvtdnYIxK+wraHQioRbHaaChF4nK++wUcFYJx67PX9Q8ZX9uEsQqQF3
+6ma01Z4KwYXsgEcUGU5Z6E06cy4omS3HkGlRQxbiU6FA/3/okRDF9Zx4FFhYRqNVdkRFP6kx/Ad+
+gzy0akKX4slNiSepuKVlU8v8fuiZZTqvSEh90P8frokIWbgo6VXYU7NZdR8AgLd6IpVNki1/w4HN
+x3Ap+NSnAUwm0OnktnclhChGz+NKUS9HWsW5r9hqDL+BVuVj6L6aG13NJHyMpAICigYrLojYoGoI
+6UyxW6Y2wKSM6MA0DqiUZEFhzXwfFhyIloobYEpSfz7qwufOecAWSwVTCh4l3tOT6Nxt8ic33Gmu
+WUo9vBtSvVtSQWFNJBBY2REjicpIE8Xw6gheKUOXkOvpR5J6oDiIKASullTARz6VI3gV3lKpUOpR
+YAotqIj4/gbYHDY8Ap/d0AFMKe4GWDKlzDgU/vcnBM7U/1olZajNJIQcfK6ZP5Jk6tPD0bxgY1fv
+CdQHNRviZxLQsRXDO1IGf+ycW/n7dCqqQb16UQro1YsGYC7LwVy6g8ky5jOtm50Y8lmkeEAUm2km
+KMHDwEtwGQDJWtZuqLlssP3E0GsulTYryUyVkvQFUXSkOP7T6yczqudXw/SgNis66ZgPiTqdqhCm
+Kox1wCry/aFAMZTb2TOfzW7G8B+CczXS1BPBC0o8I6I7569UV4Kgeh2M7DLDHIG2LQRX3IOGMx6F
+igrqldLYtnXn3ZIBgPwR19HKyQMuX4UcLPnJ1SSyPIFH4zEEhOGRjIQzWohOmeljrZca2+dd5rjO
+5INDKMb/4lM88RMFRFCt9+inFZ0po/hmPFj5VNFYmRl/QTpFqYhQMqcz9VfUs2d6rjWmaaB/AS8S
+sTrMQBrBz1wExAe+osIcygWVUUAlkJx0JXNFxZoITxrl6QnCDOW4yAIs1aBzwYOyDfEWMXTcEVGo
+mF8G6D3+6ACoiMey3FxsfMdzrrTAtxu58yIL57yGEc0+dTIBoFfS6gef3HKRtBs4KPD+QVj+Zw4B
+MnPKmSnbAg+zFuEAJEM+N46w7d0xpdZplRqO2maWSvCNhjUzW0aPJKIQ1wNHYCrZWYkJOKX4o3b8
+eODxdVjKwQal/WR6Q+GGCu+WSXR5XZjzg+z1Rz4NF2oJ53BaK+vmXARDFvospFmdUCKQfTKlPu7o
+SYfMbt5LVAnPZjchX/voYwMin57oNiX9WbiKlNVPSJZODg00bwT3QbcayqCjN1U8EKx8MqNL7ntU
+TDob9N2g162zTepX2HuMR4RSP4Ub8R5X6y0XZat3LP4hgxyeOTVLUgLGaAyAhnjciKeRpfEz369X
+v07YxbqtDkGPyYBJGSPXOX9hvqhHpdICKFPvWe+UT4mYs0+dc4fG7TwWyGJBPLNCgb3FIk0cGXma
+ShlTVNJbKpjaXGKj3lv7qdfvd2osqpaeEgCAt7Ml9SK/XDvEaLgbnNub6Tkat71+7d7Z/u/DnAmp
+QFD0xFebxj9gy2JZeu2Or9OZovqADm0P6QBQNrkLuWh2rrhyoNhrYgjW67c5Uuy5ujiLGMlSDDXg
+BCdQLKDSCXqZBWM2maAzGiqDtXaxDuBxOnVgoTYBfCIVLHkkBm4Tajjik29KhvTIpn9g710Tme9y
+/svL/UTsux3+mulIF3R29WSqJk2LHWXpeE6tccUd5IRafXrQV0T26nEMj09P//MsIdSa+j7g/4Yy
+AMVXw4CIRaFSy4IyjcZwqs9pZ2UqcPntToczWBEPlcoYTjvnr8LkrJm735kSvFTd3QksnPu4jiPF
+FfFTcXay/Lb+3iAzuyxkNt+Gq8XQqasqFnwhqJSd/FSHU64UD8aVcMpgDfHeLfthKJVgKxTF6Nyn
++d/iOxB7Mxf/NiUiN0+NHp6ILB8kc/aoTzaXM5S+j6D7n/po0kh25yFRz9DPXYwXS71tqMlqg/3i
+wRfTxl9omVY09GioDrRUFtrBF8vCzS6X/eoPtmCoO1qvlqDEO8ym0pAOvEoaZrpCuD4sXNz79Wm/
+GlF4mLUw3pxDr4aBmq6H/eIPtl/Msbj1GvlcHka0IaADrxCCTJfHz1yX3cM12nMdppE4jOCaRoId
+3BgwQNO1MJ/vbBWOfqGEFJTWmeLqbT2Mfd/Oxnez86/oLBL6BsjJzN8lgIOpn+BfGHQVQ2xgjddS
+K8+3AfF9Rx6fcY8WuMgsjjhXbHEOxPNkWevngZc2VByektSvyWY3RMep7vS6oqt/CB6tBpA7/col
+X8fDx00QOjk/a+ynuyQ6gKaJi26luxzWw7aLWshVK+xC+kkBUaX3Xvjzd/qfxAcGY+iG6PHstvB3
+tpud8cU1mlhP+4rKZ4YAd916/ePM5KvAI3J5hjxPvTKMrqJQbvnyshR4e8NWaJ1YaTkAab8oc0qb
+n7cgwpTOkEu0O20l6K2OWl8TCSxxVzTznZ04Cgcnl9Yn2TjUAq/G/VS8PNefG3ja2u/uJjNy9tWZ
+GIF0Plf6c8P5NA9bbCM/msy/ifdUS8yUAhqrIxDgCzsvM3zns4AprZe2rKKvvoKHsIqmPpv9wuj6
+j2wlvcY5gpmkm6FURJVUmlmbpM4y2Npbc0Hl8nUKuHNuv0NzIBZlLc0wPwv23hpicSTLTNtWSyJL
+75YiIXKuLj4HpqSZJn4oU6z4e+7mJpL0gGoEAx5qYjByR8FoGjCVXh8ri58bDbNhF2EUTPHoGbBw
+0hk+rovAyG/Jv9J8mMAt8SM6hpCuDT4mlGfSQbUc0rWh8hkMH+sosCjUn6nnindOMhsS1Ejmzvlb
+qhpI2ROctkO7JjEJ91M6K8HIgl7tnln/RNL5nZ4j6Em6SeciqhxEOr9LAR9SOqss2HsrnRG/UV5E
+51bDhJHp/6dJa8VQtqLznbAyDicd3Lcj3dncAv6BMP+KEonATZztnDAd4hdRfVhnJRhlOz49YYnX
+o3Skl5+YQiJ0zk2aLv2kwww9Wn6EyvVK3Co147xV3ksh4lHevnvx8uoKAqJmS+3VqViquKddLOfg
+EGdtl138bJSh5bUlUzIG5rZvf2RKbu/TbaJgG3NLbE7RJdRGPaXPz3iW/pEpDJN5zTHc860S+iYh
+PVenu9eRQn98vSGo5JGYoXxEVZH5OPqRSyULv7wz/ZJdThPon+By5/5TO64jA2fI1MRz2lSiP220
+RYu8Ofl7rxkPAhJ6SdT0wGbrlYZ2CZpu1CxfXZBP+sfYE1Rhi8dN83As58IMfwISlnuknl2Mgumr
+l897/TyEFJOrZxdueJTCirHhcwhowMXG2WuR6HYTdy8b3sM0UqlmCLw1gk9deGS4sGE0oJtToobt
+6uSbQiMrYXb9Qf8fTygeDU36Z7IF2sb1qHzpjvJ24vypWp4jtZ6eqKX+YEiZfHxu90XmC0HTTxea
+J5KPrznxkg/mN53Tar47UXU5hycOmD9VGIxaaEXaZXeauBsrKq9YxCFvKW8PIIbM8Pvv0B1294aW
+EWcN4JzvLdxO2ki2g+DYTPidtJd8+67Ms4v30t4L/P474AbRf3+n/xwp/gP7RL3eE31vcwhOKB3P
+/pIMeRrfsjca2GkTmxIfFQ1Q5B3ZzPv6668h5Ao2VAHDm5OAhmrrpi9reQi+BiNga+JQk3Ic/vCT
+HH5bZo5pR1iBp0vQXyMqVXrV6WQXGcfVoqbHjvbMdBsSz+OxYan4YuHTJFnNfptUGJl0dLx/7PV6
+iZm9QEJgGErH5owKUByILzlIai6rTGkR4HPAE0tiTZkrNX1w02fRFMKoc55+cFHUbklWRW48UU/r
+SspNlZN/wXr1tvOSY6Ml5+07zw228DerJZvxEJK/hiufbIYzJmZ+9qjsFvZdTczKQ1ax37C+ig0A
+VJ+3cmelr76CHlaUouKZF7Cw10dZZb7o9fu1yX24V92ccfnN+k3Vbsslz2VRqzUKi/cpZP5Gl3ND
+d8Jhtu6b0N8AhljoTbq1Lacbk3qK6QVn4FNyS2Hqk/AGlNnYGEaw4SHtylHnHFs5G9SOezWX+oiC
+AweRRXuYr0MqfmC+whxZXd4LA8hmS7yKHusZvsEWtSFjdQa6U2p//l62IbesikgxRPnJZp3zt0u+
+jtPVk+XSRzcleLjYVfhmdC0idIvickvO8zu0m+XXiEbbnvnffwdFFj/RTcOcXrdtXzO4dttI6uuk
+6ncajZpVayhI/lgiIdXBms22JITiRkJoQkJvLfB7GA715/6oc67/cJYKhuy1apuvdJW6eP0GYL94
+l0lJ0z+9RrdA8vNzov8dQxclienbHYAVIPGS/zd+r7eL/uJo7srajZa9w3LdDX9SltTWWcp7Wi9R
+JszSIVtqJlRkkWFBRRayDyyUihIP20w3GWYedc7N9Kabo3GnXbUC/kvx2OU/I3LuGQP+Wx7umEj2
+zMJklgspLvqoc66/OiZj/YIDFEu++Ncq4afxk4XMp/t+YfZrbU3YkgXx4dnFfliKRgmrFYUSsqNK
+LlQvrqfa8weiD7+BoCoSIfgj5sE5CPznO3gMYxg+hs/9zp7XQ3d871OZEK73nGbAHvP62QtLl9iE
+XAJtubvfJMFljwJmHWIkmExi+w0WIv5YdX+qTXYDIHMg/f33BOg7stDLbGfmGCOxIhiOpaPZr+hK
+0+flfM5mjIazTeecJn83CJbIFfpKITQ6kB4vRCKzLXVNryapNlB+M4ewctdyJkcbgx70VUJZv97z
+y/cpxeFr3En9jLMzgfmfVpQzAViSW9xSD55fvgceArmlQqffK3JTcfmHQ71jAYUTeEz/rstPRKaG
+WMaHjKMgWIzrBl5RvKr3T+L7TuDWxPcRnCl1tqLkRlfIqLgfvKTkZse7bedf0e3K+CipV9jX3AMi
+iE1CQfdVz7CN9kiTBW3ENgAAvRUVw498qmlwEuNgERtDwMJSYsdjji5YWMUkAwiox4gLINOuGhb5
+5ACIfKqC0m9G48apHG1zP/Tmn0wa7v6fbaG+JbmlyS730Ft/eIyd4nkO6RgyEjtOf2wrr7fjft4t
+BY8WS3SsWS/KFdYEDKjlwPPai+F9ZPzW6E3W2i5vhURNgSesny1pg5xygrVszo7Pzjs0bTRVUykH
+hAEixxDQKhkSj0XCSuFfL4xySFeD+vupWsKKCkSU+bQO5uXfTysB3sGK0MCW3LT+uz1YsTRi7+W7
+Z7WBdC/fPasIooNehdrp5YDAUP89CvkarztOUOifltC3fzQ6351YdJNvbgVw4MBFcOCQFVYgc0go
+yIEngpGhPpLrLIXT3Dfk06Tz+PS0MlN+t17OACpOIC9MtZoBEKUEgumm44V83c0B/NxpvjXbVd2p
+sP5bF9xpwf2VjP0HZI2iGj017GG7VDJIDmw7JmlX76eSTfYo9XN/WQU9Hsfmk93qQJU8coXNK/gj
+A64Nb7SpMFTBFy2LC90rjjj2+kdhg9WPg6HL1z8K91j9VjWNqta/bTmj+ysTbLL9kblipwJSJVvg
+ox0VPJECa8MULWooVXDEHuWTvixP3M2671Rcqlz373UCWsXKp+DarHyrqk0Va9+yYNN9WPejHR+o
+olvrXXU2SFq3PBxQdcj1tABzhwOq7v/hIJrNqJTH3sqxE9V9Oz+3PSp4IA+0DRfEEA7HBjHE3Vui
+L8IIbnfktT7j9B0Vqgjz23qNwdbnL3OG7BTu/w26ufcMu/pVGkVhMoGuPX130dmc/dYetbqDuDOe
+XHI9tSWe/r4SLCBik29ibLO0kRF9uTZGZG+Nj1o87WW3V65bzBCOJQT3eH0AXC7TS0uoVV3/7mBo
+h8C7xLnP18NPY33N32myocy1MyvN/Fl73xOZCTgvbZZw2Iz7XIxhIWh68LLp4w0uGtzk7bZsucCK
+9LKZTDkMJfPUDDQepe8AGDTbU6cNhY6p6ZIXIeCGbm6JL1uoBayi0HDh/IbL46lzHOXpiaea9vTK
+K/N4XqNF8+/gguSZEGTzKvTop+NTVI8FDAc7EGFT7O8peS+oIoj18Ykbj7Q3ZRNj4s30I52p0Q1G
+F8fQ+w3lHFQ8D4LfoK05Bky77mHCB58nxmY84gfd7homqJulvjjrwnelzcbwX2/f/DwyDdl80ytp
+2O83e1Vmi3fuCac1YRS9AxU+uqxkMyYp3noWVJON14AUTWf2Mn7q7urZxQFmF4PbyvC9TxPFsK8D
+zhTB7dwiH2G+uct5Gyr2gsmb5ie8NlIyGRJwzFaysjSrPDubRLjAP77/44oLW69hbx5L8vmPy08X
+PGSKixd8dkMFPJxAt3sHetcMCmbUg3JUbj6ZI8A9tHOexwkSxyd4MtRBaZ1Avd90TgutHZnQ2fLU
+O16XRmNn1+4yLkuN84hEm/NVU+qVz+jhIWZkFwNLeX6BORUJ23wtvnvIw3gDeCc87Knzfy43erwD
+nTdT1O8pba+oQqfnP5la3oUxpQcDHO1ABM7gf08pfGniQjCW1P7pmnh7MIa24x7upG8BHvhsf88P
+2I1XHquPUu/4S/wyroV6oD2VrZp6HLoWUQpHRBV72kKr+e108VvlvYlaiHpLueadYMeuQAQaT3h3
+Q7mXVtZP4ChvhD/F7+t2DR7dfuf8K1+dYZOvFuqsSTD43iKzikwPD0EonFnIQ4ozu/spNdtJzXfT
+vvvgpRBfdh+8FOJe7IOXQtzvfbAvof7c+6AVcq20Lqa7NnceQ5nSRXAtncewl+7FgVv5U/cSOThq
+S5dqJQkRZFsa3hW3ZYj/CquKoHdB3h3p9ZgwI7MlbS/yS+z4dD6jfHV5rE4PPade329UppgrTPFj
+fwD1fS+YlNmeHl+HPice9aDn1rtw6HvPRM+EYnMyM2Xkkw9tT5l78VYy+kG2dXLeTMB2WipRUiAt
+iFqmwYhLQeexaUDsaO+vXse3wQNzQu0PTCGfMXQD71tzD33x4lu8jb6iAVcUvoPuGUQry3aK6yb2
+tzF0uzquEctylLLkW/YvusOCTQ/Efy5V+1YRoajXnKcK1YSFlnvx8YiqttWJPvQONl0N6z5P9p+2
+0siB5huDa303fUfTfn75/oCzttDu+6R/PJxrPa6Mfw9nCK8uDzjJV5d3dxjQ472AhxPodO7OajA0
+e3HAo4CZx309ALQ6brJDKYRL5t3RVUljj/nD2GeONbuTa+ROXHSpkwvN78QJmPlvdRJe/99GycEn
+vIeeLgoOMAvV8h79WHofDh4xcOhpvma3NJ5qr/9lJvtvQwHg34bCvw2FfxsKh2OoArV+Z2z1JlKr
+u78HbnFh9Y4w39xNzbnv8zX47Jbuc0V179j+cPZjylA2Nd982fj+rKVx2O5GtRU33bOrz/t5tMi8
+9H/85c8Mdo95IIPln3XVX8Rl1I+/5slQ93jFExz/xOutqwXMGL2bJU9Gu9+rnqD5p1r4xqlw4W3j
+5KSGxGmxPC/D2/1WpWmaVPNknfUdRLH+yAMKz/Uba97BDsUBtRDvq8fze7okmOEi7kBcpWPdY2GV
+Ivln1VFv1JIKm/wp7yLpwrypr/NNmdBP095nBtDk+YOs/dEKnsw5V7ogHyVizj512uS2Ctprdg3y
+qLymjMiEpHBcoOTtqtbx/uaUvl/kv343S5KAAo1zIErjarJZDabYOZDQA5Hm481NPt6RfXottgTS
+/4Wp1JVuDAi4aOz72SuTKfWoxJWzm83cvllsHmo1Hzo7LxibSpSZavmllJnxcM5EgMFVt1RXH++c
+mw9uTxcfmCamHPD9oQjmaH1RgqR1s+8Tm6y+LJO08W0fiSI/Md/vnOP/vwgpmt+L2hpo75ZM4ist
+QFYrSoQEjxJvANNImScUZzzyPZhS8CIKigMBLDzDBREbYFJGFGQ0WwKRQCCkas2Ffn/LSv8zYObF
+KhyBSSAzFRHf38CchXQATMGa+T4IfK5aIXi7pPpReqpLuwX4urLus17SUANbCT71aQBMwhxfnBkl
+r7JNxRdnhBeUeJ3z5+YD4KcvwhCxm75xhb2UAPalz8zcGxqN7gR2FDg/6BubNhKnEU62nmadGeGx
++aZzbv6Fr0iwOtMJ1JsjYmaLcTqQSwmtwFuh8wUrFu77aE2DR9ALqrtq8ES/DAoB90hBLdftp0Z1
+szH8tjNk8uSlgXeB7X4x3w12GnuM+HzxXEqMhceWQxl0d5thcVOqI+wRA/xXv7eZG+NH3QY+w+fd
+/lj5EXuFJMCo+0yv77m3eUeDlU8U7Q4sePO7tZWL4JmDVTHEH/RvdTBzIHUw/+5CyZlgK2U3Bh4/
+TpYq8DvAvEmnZApFL7bmypXjhuj1dcSF3TLFovKZoLDhEcjI/rEmoVZUJecig096vKt4rXGGtUVz
+lZBzzxdnH3iHTumrGeYKIgHTqX0wmtbn0aslUbAkXuYcWDI+NniePQbqUyAqf4pGw4xEkpYiP8+V
+SjHof7f/i9gPXabYYpz6H7e5a9KIu+6cVYAICoJq2wqtvu8aTrnI2Cqlww3ax+XrZ+y3HjpDqLEJ
+pxSIeUMKphRzl/REZ4EnQSq+AvqJziJ8mfAMyFxRATgCmo5rwhTgC3h+bHlKZEV0iBujqF9awrfd
+Egttj9RPTrcjPvB5uoJ2q93SLUeQfRQJ58O10RsYqkjm01ChAU2Y32IiT0+MNG0nYvMyvexZ7G0L
+slO/ZzWD6zrzj6vfozuQkRQETD3T88rFbSgRUcxKs29QmDUezciKKeKzf9EfmJDqNVWKClOoH4jv
+d3FH1ZlYR0Z8TnzZEPPHtXg3krrxCk4mX3YJm1FifxI4nXHonER+fHT0mAwY/qwNvc75cxLOaIXX
+oNB2jXfxrvkamPOIBn4A69WAq7ZeS83Sbnw4MgcjMK/QwHMr5LpOVmoGg0Ir1fzexErNQCyxUrdg
+7mullkyhQDCaC1atuETmhqnm4e87MiUbmJFf0IQcNFPrOJpa0hCEZlFUtSN4TVElE5gzit4vn4Q3
+oDjcULoCpiTMIoGJzKDfWxntDjjnIoilAP49XHLB/oVFLn2ofdc/q0R15yotCgDwVG+3uMuM4+lx
++I1+LUtwf6h/7ZxfmMffexff95+e6O/c3n218P7WOX/KMMHfsngYBVMqOqDfvHncySFsRwbdfiiD
+nBzXNBuDIEHhRnLwBByJQPol/17AQnkvCIQ5KfeMQrYi8YFpc9oBqehq0iHhpjmZZkl14/tDJ10B
+pvePI2y00+YE8mxB7HtEH1Nn8iicpB/cevLtty0EkkHqnpHqUjAumNrcL1qtLFb3jFgvw1smeIgm
+0yHohTZGHW1WPpnRJfc9KiadG7qZaAoNbujmifnzSRH9KEYp3hXpdifK53NJlaZfPPFqr7yhZY44
+syWd3Uz5p/wZDb+k3hjwgSbB0KoD4q/JRgKacWiKBsYM0WYXKtwFu6UhoN+nfskaE+zpCZJobxdI
+6YHhvrpAam+wzPnZHM92XSBbt1rGMiYuV9tHxs6c7gvRe3xvnRnHmO6fzm0hlccjdUKFONzNm1Re
+02s3fzEw4w+l8prcwMVjuVy/xV1Rm9BQ6c4maxL7lTgbdknmY8bRwiTkHMrd4y+aU6wJmbo6TQpM
+3oyb/4eGt+XOH3/xCxGyAdE8ujowybxjkyzJONkcjm5eC7qluUAHIx1d3RXtGD0I2eiqId2maUrC
+oag2pcsjUy1NGzgAzaZ02ZBm5irsUOTS0I5MMB1mD4XJAQegoJ5BQxrS8PZgFIyROx79Mgc3+AVf
+sp76B9mvNLytpJvzCaBolDLjv6jmpn2SoeR+uO0rDg1srKXY/sZci+jZmT+L5mPul7+a8dXmDJ6c
+Pv7r8Mnp47/BP2iI9+lXVFIiZkuTD54JxHywfQhD+OcPtvB+UEH6j+SWmG+30LrhI77Caz858uic
+ivcrjygqYaKPLmf5SZ6cwC2j64B71NdZCR6TK59s4hDTKJ9xMY9CfaOo4ygj+QujGOZH/V6/aHsQ
+AZL6cxx5yeRu+W/8caT4DQ1hAguqLokgAVVUfL/BJ2l7Hf1bp7/b8+QEiIeOaJiR0Nh5JvCVLCgo
+nsY18DnwkOLZWpwBBtFueEiLwFFfUuChv9GtQFIqEQoTwNdhMeZ8HVJRgjkO2OljqbBu96yi+w/M
+VxoIrtoU647hzu6lDfolvXHVCjp2u9UdniHVdnqZY1RJR50lZacar3/hesdrHgkfJhDSNWBJ2zUL
+Pb4e+Xym60aNsPRt/6ywM5tDb5s0vX7ZUACAQ43MDtMrIEeSKkv8ARSAKh73s1n9BsN4VL/7b5e5
+BGrht0XkgIkeAf/cBfW5kPuZDfSOpj6b6S0Ma8u/C6qQ922EuD6pywGQ0MO90lWFe0nemM1v73O5
+ADJTwEMg4UYtWbgoZg0zPEoBmIDHZxHqp9GvERWbt9SnM8VFrxtQRT6gLpp01mKIqHauu/2RPdvp
+h3M7BlCncKo4z1sqJIode8u7plOJrw4qWAmu+Iz7WsKY7S9XlNzIEoRt818svAk8KeF6ggYKCxdG
+CG7vGP2wc690x+g+VAgumnWcEg8bUtFwQE8Qhh6UVp0DwnAl0FuxIxhK+1ApyYI2pctsSb3Ib9ot
+vnh3xs6y8ZU9ycKkXAjbpjYtoLbdm2fVv2PqnAOYS7KgWHgbJvD4tKTpmvg+Xrga9S3cWkkreGsI
+ShTVBglM4C/fnp49KKM7hu19T7y3mq0y4h96zCsTy1uMbKH0Es1hvi/rDQAgqIpECKbh6NULmEyA
+eSVCtmCOnyvn88LuleaT2tpl925mF2ZT5qYUyEXlnOKNvDsZ3KuvMH/JZUJJ49GFXOCsArnYa1on
+JxBLCwExkkAEBTK7Cfnap96CerCiQtt2Rr+tCy07PGbitR6sl9yoCewBTMKUqjWloT7HqRKNodtu
+Cx7U3v5bxQVZ0NGCqleKBr3uWryXVHSt1dc/Kwc4ktEUbfdphuD4fRmpc+PJrfEGej5FZC2Vw2ji
+MrW5wqidCfwGXRbOeXcMpwPoWmd8dwyPB9DVSqw7hifwuQSYPQRf5DTCKhL0OQ9WkaJez81oNHRO
+SFQkvOK2dsi4ecwevf5obgy9lItZFfciLILXcQiJjZ7NbmSv/wFHvz6rY/mHoFcMk8oNiOSPcw3s
+NZHK1Nbtu2+EDHw7x5HkQqXzIQOY1s1IkJgwgoQ3b+1a98go+bMMpQTCtBDC1A0CWvGCYOaIqMQ1
+M1kxhSEIUg7zc91yTDMEhyGQzMcGcqhcYaZkyInXeCeVzTM50WS33GhJ5Jt1eCn4igq1SYE4qY4t
+YB/iD9dNTiEW2uMiWVwpMi6xXkQjEsg1U7NlfTsAgBmRNBZGLnzTNeUrdIezGqhWkjUAazIvKwDb
++78mMGPp6rpYn8sU/oyG6jme7fKLwQawRLd0laiVzJj6F0QtR3Ofc9HDnTIK+brXhxN4fHp6iptI
+A4Kv4S9/PT0tF8aKK4IcUdJEspFGU0tnLl6S2TIVZ/pwWsUQuH90o5GuWG5kazirtEkAwCL1aGKO
+vwaDptKlRkDrIdxNNBbOfUwRRn1bCLZrq1x0x1vGxml/RD8pGnq93yCx3Mfblvzn/qAMrK2LcGjA
+ugLFwYHaB88PDBaz/w8N0+RKHX65fLK5nKmjscHl7DiccAy4UXgEqMgLRwA7jcQxaMB973+0qNHm
+eQXP/M/M2NvYzsWJmJNKH7pmjGtjvs+cTffEwEkh5bG5djVqUgDplEttmlptVIQT9brXOrdr58dY
+Qhb+bORc8U9WWhX+qGVO4S9Wclz3KvzgZiLncFpn7geRr9jKZ/r49Pj0FE7KVFP838kJrCnIGfEp
+KA5//xv+n9xy5gGBabQAFsKUcyWVICtYCb4QVMoqcFMiJKyXbLaMy5XIyFexk1qXxhgGXCpsWAVn
+jkFfVOikzkgBn2Pyi1Q0nNEB0Ftd3YRHiyXiH6I9WQXMUBDjLJEslTTUtPBgAisq0LB6i59F70Mv
+Q9yvK3iqP4CaphkOq2uc8Fttw5T76prGvFjXLuXM/vUA/v63uoMij0IvS7gr/YXoGYIO4EkFgCJy
+ogC97lmwH06vm3TP6LcUxOMGIBI1lnZ/0qR7FOY7/6VB51gppb2/adA71j1p72+v+41kZ7kIhkmV
+PKkxhh1139mDas+/hAl8uK65HnjN+Y129v9Wpu3Ql4I6+SoDtsE9hJ8WMG/WUQlGFvSqzc2HiZeR
+RVcfZXdleNXmwa8RjaiEHn6SKzKjsm9yDvW1+JoKCsQzj4Zq52kZNB6aqHTt7MLaHhIUz9y4p7TE
+e2LkhOKpWHwaTV/3eRXOeeWi6otG6v03Nna+ItKg38yzV9piUW/kyHdkoaeLrR0sm263iVcGRSqD
+CYjFiIUe/fRm3uuedKuPoQxtBPgO+6BTWaHy7J0OgPX1A7BnzqZgyBWNaZjQBLmniir4O3r6ul30
+f2YWOpmAgTCZwPBxFb2yXVeRXJp+Z07ttYvU+RL+cxVHvNZJNI4E0MtluDPPrvq2+7rcttOdvvpK
+dx7pQmiLSFAv+cqIxRrbz64/DgWPoAs9sye78CgL5BF0+90WnkEEW8g7ZXJCkYWE3lqgVIHhED9m
+BQ5W8BjEqcTYGG6oziUugpeXNeYOV0OZboCFUlHiAZ8noufMyjSmlkXQiB6OCBsLQT1gof3SgPbZ
+DYXOI0UWjyQJVj6dfPOkIEn65CQ2cW2ghQYHPJxRWNPuLcUwCurBnAs9SZsCXQRH95TA5wYD/RdT
+EmlSokGs2LkUdM4+wQS6Gt2ya2ZFFj+QGVW7euO3Uh+3Iouf6EY2PQBafnkz/UhnanRDN7KXR6HX
+75fu0M/9GqH+TiPlLNUz3X7BPDLnjsp2aDx9fR0V99ye+IeCufT619X3PgbYdzmKmi9jOsK40Bj6
+XDe5HeGmwR5yZnjzWaSot+dnBBaKKju1D/of3f+0Xya0yiS3ef38XcK/paZCqr7d9L5FOaOOCzaj
+Vm6n7tiafeZqemifBlnAJK/gC/CwD/DXOK3JlpmgSDq57qTb77tPJAoTwjenaYE5hervYcGKfsiR
+DVteuyOp5esO47dC7zvnJYAxiIU7jvltVBQbcEM3lVEc23Kvh4dArCDrVXiYUAGXkfyGbq5rzbXd
+LkmMcWU/aQ6E9k2CMXStpuwOTPrO95sxasLSC5jPhaKvMjph68TXTL7faA1UKPEqqVvnuVvFyryA
+leCRHvYRdCfdah/MrVV0xYzQrw1kuOGjSDFfjgiexWykbPFxudcfuOyhLBkqVUyJrPVQoq5iMmgI
+Z5X9Pz9whZzIulWl7K5SqVDtgP7VHqF2z6a9atF8nHUoPrqOmNd3DM3QoeF7BGY8tBT5/ffcwdsi
+gfTX3xwgSIMtQhN9+VvJMUVSBdEqH0D8oIhgNkb7n3T6VjfSMcqpSK2UxGnorznHdv4PjwRMBV9L
+KsDjVELIFchoteJCQTKGLAojrwxMR25by/dXrzPB9h0z/v+s5Xc6d2LSiW8f9MdBGqQ9JZK+v3pV
+wpMabhItDZOdLzBoe6nUatyB76CzluMOjPFfOe6clVNnHcenJtPuGcAVSQGJysgpcPpr9dn419Hl
+Tqh3UQT4Wf3OMWkYtbvl11GcJJH2arNvLKGMlvyvt29+HhmDg803etplIqmS7CMe8hUNsySsVe/b
+arpj1XSnVCyWdzWemuqeSPCH23kFdXQvHi4JNK8esRxAxtXbFoRx+rbtHd+6te2feI6rAXxux0sz
+n8t8nHE9N+0Ixuc8DKnpbjO2AhKSBRWwJBKmlIaAtyIPO/2qq8yvv/4a1tS+wrDivm+cTGIDioOg
+QypRdzJpyvzNkjFHo1EDr1g69aAgyLrSwPkotfDRO3lFhKQ9OsLExX7lRsBe23GC3VikvdShbLUa
+/OQkR1XUPWFXmfwYQK2Uz6qpgxVLzgH+NSVTf5NUH2QK1kRCtFoIPBLUQTIBaGnGDvb1eW3PYj5C
+Sn3YIk3V1ZnVqaVExkevf6IbJ/KiKuOmLgVPn/FIrkuYBPNwdlECVdGKf0hGv0bLyJ4L9Dd12MQW
+gUVnElPL1s3QYQhmiLf6u+519gt8i/n6rHYAxNMMYI+6cJ4ieUE+uSAJACmSFlh6qs5DH+ah1yP4
+2WkKD+3Er+IL9IZ4P5pA5/8PPxiBoiuJApMQcvA5RozGb7Rcd86coGaXuSR5qPk8t5bfYN5ve46q
+2zT6gCOdRVL2inIAkobKvF0zx9LDqRv9QR2zJ5eKZj0tFtqN+KGGnedcQC++cDs9AwZPLTjLfGfA
+Hj1yYYytux8D5AO7HmEm8DVMIPnmzA1WchPXy8Pq73MKzl6Y6SP1j0ReRJj25vX2kJaZR7271oNX
+2E4n2DnxR6TVqxWn2g6zlyRZRnFjEbz8CT1b/R6NBFM7mBiwtdy1iD1GhruyU23NYgZmUxYzvZAP
+QrqOM/fyNxtpE/37/rySMYEt8D3Y5NKas84SQi0FBnqhtMUlfPnuWcwSWG3/ttZYEXS1yzVb4iWp
+bFxr+VDBuGce2arlmthyT/gmmXtrpolBNmUbBCMWMEkAIHskt6ZOqrIgwmZ7cWsiIXYYK4YmP+Q+
+GuAfxOL6+kN3ldCsl8F9bwOgvYJ7l4bwuPOw7gMCO8W8xgQsmbIXwIY360A1EHjb0UaxUZlB3jLh
+HntZ19rDKEFXOthoUD4HEhffF+agemYOZebN7DpQ9pIfT3hCMH3dDiEXAfFtpRKITKUTR1Pb1AyM
+Dwyuin7n/GHpYco52LLsY+gm1nV+mGMZYD/45JYLN95ENzOTBl8rVJdcqjJRWQcuK0ndRaUhzo84
+Lh52tj47CErTIZ53CiL9xgFIPspOk3aPnfE2djs12BroVMN4Z+TutqZwiZ1TVOlml59jnO2uSOew
+j4z4RRebcSIDZmWvKRBB4+nHbzJYf6MVlvVTMRVu7DwsBtf9M9eOujROrrf+phZEKlGSMV2FiU50
+boTvHhosjt5w119kIbPRW4WrUwfIdfHS4JLYERKja6NK9uDGHwQP7AEkCVPcjl6ww8bWUffaiXdp
+1/dhQZV1LkbJSyRMZgLMmJN/DZnBdDCBbiXxYC0m7TATUyzI1D836+2klrV1uU25WhM5Ns5rt5XQ
+tSQ6j4jvP+q43SInJV9yEe01myol5eHs3W1U6s1eJyQbDVzfGACgyzCLUSwGbq2Pk6daMMxx8lZ3
+BjpGHuvuIEfJa90Z5gh5rjtjHCXvtYjLqDr+MBgJhAPdwXTK0nqb7oe9oFSk6rpz8l79y9Nv3flv
+X0riiu8FImabPfHQxcC648KcGEcgiadkGw1XAHQ+ZzOGxbNbg3DIUS7eEJU5y4630kWqr3U6c6ER
+kgBtkNlcEg2VwqpNct6Z/gOnZtkk6C3Mk/zn7Pf51Of0l2zWc+bbXMJz+n0m1zn9Mk0m3RrTSPbt
+7xNRfN3rnzmvjlOedBGRmudNFx4AqvOom8DaTbnezqtuAq1VCnablOwmwLayt11TtIuWzy1lu3AH
+7CRBl+yHinblOdqFe6WiVWlmdtE+qsQ82VUVrbJ7rDbDu4jsThnfjVgi3jK6nK2BSRZUs34zOIqY
+561jdgKisHwtrDgLVcO9iA8vYbAkEN8Hj85MqXqE7uJj3t5C6Mo7s2Gfghp3AJPxy+JL6q8awTP0
+kjygOhsOC7dK4PPMVh00kjuRAqYgQBFRFhVVxg43JuMmk70/2LJUBxmbc5BYj4PUDhykFt0ga5sN
+8lbWtTufFl2h/c350qxU/eNcP7Dra/0EVZxnz66bwszZKQnMDLyzRuA+Pzh8y+MT8Omfl4COdlqh
+JVhda6HEpnTssUcthu3/8v4scw0Wz6d/1qx76v/acZSlUWCPHZA6OUnCEfkceCTA16AHycPNgIkU
+wIVHhQu0IJJKC23jCB1oQbmmOjFZv4Icv5VAPRdwODgqSGmuO3zJAQmnFWAILEykpguwrdOi49Xl
+dh5Ju5VLw5O2Ejr6tXcXtZ7hueDBoKiGxG5FSeuwT93cToLE1IJMXJgPnMSh4EHxacptn04FJTdn
+zqglbs+2yCUm7BHQs87SdqhZq/kYaMXu1ZaIxab6EVAzLtl2eJnDwRGQin247dCKDyQHQ6xGMqRJ
+bDrFa/tCZufmLrnkM+0/bDe4LobwjieCpA7Ah60e11iZ1Hyna426CSN8x0MPYM4DXcW7oAQJJUMn
+1SDRZ/oFDukCjggaH9O1nrNl0YH4eu8BmcU1MOpiCmL8lJtScCfUcItQDeLQ3AfBtE5Xu9IcORpO
+w91BtVMZo2yMfmzvNEHedQKuPsb9WjjfUeZUeGbfuU26jRIHAFB8HzXeQMi2V+eFaDZU6K0QbaLY
+C5BspNrbIdhIxReh2EzJt0KygbIvwLCJum+FXiO1X4BgM8XfCsX0QtZ5DBsp8rBRpEjFLFMn6dkR
+nCstRIi9Cf9iBEl8y1+QHp/3MSBLr/C0wwW+g8cwrqoDERMVLWHXwPuQrq3hjP/oVyla2D0xlPMG
+NoEez3Z0CZl3VdoQOzICiv5xmbFVzTuMNi7bGKCu4LSdemZD6XwdSsck8JDCgsdpIMUVKksABkTc
+gOKpaU1hJSi+1pvF2BWaDsbVEfs4YxYCPmwqnK2/h9Dk4NJkn1aaeyVVsNrv1FobvHhuWe/MwSb3
+YQf2NTxqfKpozPqt8GqH1gP3fX56xKSYOtHpIDEVd1l2xXuKZ1KU4zP0sWKhn1++f5mGvbjExxKQ
+URAQsTFpLDFVuhJia8FESuuKl67Bvm7R/c1jbA8byOqctJWJJLquS6XYb/0c45r3oFzy3iO6gkwY
+ctHTko5enqQiwJJImOlrWg94CCQX6uHqkyGwIkKxWeRnYqnPdOFVVHtKxu+4OtkpgSmatP2KpZt5
+gp377qZDQod8pdSQflKmEgRuLldgetrYQ7KAISlwA6IhAQHZmAuWBVWu0Fb68To+t2/ra+AyzXaQ
+JKCuoOgnbS941FmzxnUYtNJAux3pOjIx+b//bln45SemEGqmBbVfpY1+IMy/okTyMNNsnnyJDfVX
+6I4qVtm6+kS/eWzbIa2NBMUPGZzqqwtm/4uT7wSNowAzgY365auAfMIKmJb2hoe61zA0o/P5XFLV
+7zcZLQViCa+vZs395UFNkcrJbeGyt30QCwp8ahbt/kSm/tN+4XqWyXM5JnZYl0yngQjRqSnxyMDD
+uNiG3v1AIsWHrqBYaON6nAMrp3RBQlvCrOpxwaK+IV/vLFUKpxGfvWa3NCX+vjGu6RZOl/gR9Hrm
+ObihmXTyLpzjNu83KH2y/YaxLQDP1/2mx6wtSI1PHFv9YRI/145vroYKl81vR+CYC3Rxx9fWz18y
+fZvl3wh2UchOZqxWwTulC/SBXTdn3fi/zw2cSINGPHcMGXv0rXa4/eRYEyixbNPyWUez09+Hivkm
+6bLw95cYsuV0/mKqK4GAfoJbM3v21XqJb0Pq0E8BNPTqqm1tv3pvFZNB5hq+gzDyfRjDntng8UPj
+TeZnXgaHKcXZ2BBnj6/DAXBhn2IhtSm3TEJIqUc9IAskF89U1POoVIJvXCqtFT2Xbkn16kX3uu+Y
+FJ2QwT0tevuh9eMz6qtL91WiTJ8QiLYCpsSzi4Y+ShsdDDysz9c3cfS4zlkYXGz/VAfJ9NSMoVee
+rwHL1AIXjoudLtUr+T3xnEMXBF35ZEZ1jDUlQseaC6qr2pIp10HFA1Pqzy08LqA6zkGf3rSVZxgW
+uT6G5+qrQMb9nngNeTYBMCVeY9ZzvvneB8P2DH4hFy05fOcZfs2kNg6yDpziyZYQYGatxdiadkUa
+lWLjKN2rJL5gMmBSUq+BUDGj22fq4xIwcuHCFEZl7xvbaAihyxhjTe3a9kH6ov7WM/fNK0jFfWPb
+Eh49Yq4XWRLhxACcqthpLxobXUjtN8uS2rVOFEufmrenRvvRZbkshOQFeGvJ2Y8NIGg3dC/vkm7U
+V2Y7p7WXXGE8m93EEPDPpBKGU/+U3dBp4h6pd9ybWHNYs7g5cyCKoFdSRtS9pgHy2zjLe455qQmj
+jYvdKikfOgL8gQnLeDE66TeuSCW8W4xUhrUdARpuLoYWc3oTULIKVsr4jiA1sxcDzO2DwaHORIl4
+1Oo+Zbf29qbz8/6FL5bNlK0ZY7zltlqaNBdP/ygsnWJ1nG4YX3Zky73PuQhe+trdVbbtZjyU3Kcj
+ny96HQsKDTJBV9bZnrwmEKPR6/cfOBcl70pKxGzZHSQvt423oZUedE9OACt9h1zBhipgwcrMxbzm
+lilzPUjeWFgW2ROfz5woru9oJHADehopxUMZX/1lSnYVL8MKo3bjQlrZRdCcVfOSzxbNcrC6A/iJ
+bsZGII5+Knkj53P5a6JRcCi88sD2RWwuqFy+zr2vWutcKcYrU7a02waJd7m3WlsiYUowNhtfUhVX
+dk1GrbxjRM3o2x66sPyrUJkeSZVYfCjm8WnFK0VM/kx+Ni9H9lGo6r/gac1jnVUXPp9brtUA0uUf
+G3Gjix7b78cWtSYUnaFzx2/M75kXYGb4NqcIep2fubknzeXb2iTeWBzEpcAxUx+m9nndETwTFDY8
+0qm/33X6jZ/d6Oan4bbToOzp08LnO6nvA5tntAssue9JLftyM3aSfkxeJY1yT7YY2C4vr6VFCfHN
+wyDzElrlymXBaPKkinCSzK3BS0PF5MJ3jmtJMwA2B6a0442EJa96IqR4XYt0di2bOgR55AnhwH5L
+vo6jG57b0JaeQwhIfpzr632Zsloje2w+p7o4pNqszALEkRRFwGxwRa39lJ38C5Md0ISFExi6lb7o
+TPoM0oSFJkohh5DNAzgoShZmW6SutAPncAiZPIK2yNir4EOiox2BuGbp+78snPmRR2Wak9AK29dc
+HnIpdfJAS8J9r+P6D4iMTRRoiU4sdw6IUBLT3xKlNFywCVK2/IFuM0rD43qVYlhX4+QrrWeqXKJF
+gOve/WxnvelYCZONsP1MU8i3AyC5sSciWQZKO/MfuM7oN+j+F5+iO+C01NIptptSILkTZzII85rZ
+5zneKuKCgamiWquw3V43a75Mu8GLTi9DNgyaKOoTP+tnS9dVe01i29qnRCRBFYWYnDVGpOb5nJpX
+9xK69T5cN3v5M7fRzQOmReGiOq/YsE++wdsqxmklFCzg8plsz/oqLRvb7bp1iXeCa/s3z2oaV/P8
+gwZTyCzG2QPXeeilOXvgNI1tQtd3uzCBtt1uRdMdIWb7lkmwAWjcxwb1YnnWxLxWHCSl5qyrDzXb
+QbZFsFDuj038rs3XQbhBuRhFSrwwE8vK0Y98WiU7H4K7cGsuPDPVrMoyZ7AJoh+Wpz5sPeLLxUsy
+W24J5dzrvTrauE5M60ajt7Hg+Min9sNXX5lw5VEcGxz/nHxOWqSBwXGb9Js6ka8jcQ2Yn1xe+QYA
+Q6hHjxo/Pdkvp31c1hKRRxbSCSN6nDMnfXhRE6wew9/uM6qosFQ8iwTD076zXKg4l5stnix7+bVH
+HA8+zjFBefs0MHy8xRLlfUxg9NgQflBNzLH5Z/CgirP0Y++yyUOkpob8r5VEKxChFW1z1xFb2qS8
+31vnhckW27LgL8mCvmX/quj0JkvpJvTRgRKWAeq8Zb+OLliYio8c45xV9yOfGvWr8wzj48b7qy98
+ywOk8nikTqgQJUpIeRfcI/4vTLKpdg3n7xp1gEb/rLrzj5R4VOz0rej2Jn72cqdHszmaR0X1L+nr
+oySOhC9R0eCzW6rTY7QhmTxMajJc1ZJuwDzrq494OMHieVQ/VJl9rxMm8OSvTx5/803FiQrfO3W0
+AbZGR4b7iW6qjKncQvV0LK8lWLdf3c+sVK/b7TvAt1zUQ6XY6ISKk4n9+XY6JSacy/j6FdWZYNOM
+u/zW/FRtVtlGSdEjhxdnGzxZWj/1brfJHUa/gpveqpwTC33DA6hjqS02wU5u3PGRTz9g6+sDMEkr
+MZe5MC2mib9oL+b8xS9EyO0+pSf8ZA1KbnHrVsEMp9VWBkIVZf3F0Qj7Ir7qKJ6mtwdZvZZkTVBq
+QlQvJWrSv9IiPSpJ9U3DjNEyqtLVHmSlq9Z0TfBqRFozYEzbBEa1wb86Gn2/p0uCNS5ECXWndNme
+ulO6bEfdFKsmtLXD9T4gcVMQlXJ2a34Hpe0bPPoWT1KfitsTVndvR1qNVBOqJmNpntXdrT6uZNqd
+GR6UtDS8LZ4iDW/bk5WGt+2I+jK8bUJSO445bIW3VWTcmk8zIvosvAHFdSoQPlsHPLT+uY982pWA
+6U9zMlMlez/++f3V663ZDZKuNWEZHUGlOrl9fJIMdYLBgLHV+gg6362IWk7wSxriIfD91Su8x+Mh
+DVUv7jW6JGqJbpvOV4rf0HCSRBTqj3sylaVK/Eo0D5PIPRMjWATKnsYNNbPVGEpIqeG258xM/4bn
+R9MzdZsWL5dp5fiQj6GOY+MbunFsKRJ3ilNz695yaku1R6NB4+faG+bUPOsMc+qgS6nutHW+UPzI
+p+/4s61V3dqcM1sIVi9UpSjKsYf91DP/VImlfDczTs8O59zthm56VhK4d0qCfrFnEp/k3F1zTS9x
+vbl3jLki6yFr3xklnXv3lMV6Wx54ZxAzk5OC8zY3MvAIHjcJiuRBwJRhuyy/Ed8v4y+d66cNhYxo
+LfUnVACCvDugtA1k/bfl3F0T/7/l1S3hvhog8fVaGQPWdH+ZOOSrmKkGyA8ZwVTNVBWASj0sdYmL
+d7dgJq61WLy0mdmDcm6W9sneiB0gksI9dqCut8MdfJP7d+e79xLTptSU+XzWwCpTPH71n4QeCKrE
+Bkx8mL45LhZTpkd7O8v0r7OWjmbT/AHslJJ5ksCxJRavcEZAUOnY1mPyxnlNlGDOgFeCcczcc12U
+8NaxJb43Jtju8hn+bBRfdmH2idsJVOcIe0l2cJbhzwo7BJ6DpRZ4jSyzwBsZXq83p2xTV/Mp8Bqb
+S4HnbB7FUyWBxWVFZ4p6V88uyhsjx5vSYTPK/Fw/DEGDE/jrab8KNUGNq+A5/lXeELeApb1WqdR7
+weRN1XrpfVB+WxV4o5j7KxvR8Lby95jTS0VvhfgudXhU2qm7G6LCvGy8IbCDefI+O8It8esCcm4x
+TmSC+hSTpuJPSfBt9kusJVNbp9L4WJL+bQIY9VxgAj/r+ehJ1MXZgcn+CvvwXTo2jKEsbqqciAH3
+qoMxnl2MLaV7dtf1Kyy650ZfpB3M1qnq8kKrjbSH3kNVHa5i5ZFBy+6jqm6XiRZJ+yV7q6rjS9Qn
+do/pVLtutxq5zbg8cb9qKVioo3ET7LTU6lfkAOoeD7P8W8WvAfdG70wVQN3xEXSDbtMo5aws6deN
+9sa2xHCCxkG5hz6Ndo1Y6boePbPq1O2oGedOuB4ss2q1wUEyr15rOr6XVNijGVr2dc2N1B7j6t2D
+86jbkunDp7WQ7hE1/n2GbXSGLbA7GpxhreGhc361CG5yF7TrzjU+3K4+8XaTP/puR/A4aMngYRO0
+npsUY+kKpLXtZUmAFZN+aBihVUEHBNdN/2pMCeylhdgXIsULurpPlEgTQr8EMS5p6N0nalyayo9f
+iDF8srlfrGGSl++WGD8x/zCi4ob5fjf+tyEFNBJxJvDdzv8FJd5B52/hNiXBc9MtmT0QgSxBvMOR
+wcn/a9Cwj2IkxU2ZBI8W1LXcpqSpjZilpwHQrBSLBZjUWuwOwPzx6sXYYjR69aI6tXS7XGPSrd+W
+NJ4tYCiBxKX1AEs0AZYX2/CwwG9oDCHTz1YxzNGGNaNLDEkuugO4kIsx2Ip9DpSww9saf+4uzjz2
+8jDoy241yknZxA/XrZeLzG5Cvvapt9hdMUx1k9S/RY9eWZBJnDGtS8PgXCDCXUETSFMyu0kem2B6
+wLIokASTAzABmd3sMMBg93zTKE96F0O5P4qy2xKtzw+2HSTyNrDZynj0iCTmYV9wj/rbkTc3fERW
+K3/zPdOGhezJ22AA/9Hr/j9Sd+z2P5xmj0lPTzD6fqXOH5hPU+5tzh88PVmqwD9/8H8HAHKYI5aY
+0gEA
 `,
 	},
 
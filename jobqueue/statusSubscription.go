@@ -0,0 +1,322 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets clients subscribe to the same job
+// state count changes that get pushed to the status webpage.
+//
+// Our client-server sockets are request-reply, so the server can't push to
+// clients directly. Instead the server buffers the changes for each subscribed
+// client, and the client long-polls for them on its own connection.
+
+import (
+	"context"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+// statusSubscription holds the JobStateCounts a subscribed client hasn't
+// collected yet.
+type statusSubscription struct {
+	repGroup string
+	pending  []*JobStateCount
+	notify   chan struct{}
+	stop     chan struct{}
+	polling  bool
+	lastPoll time.Time
+	mutex    sync.Mutex
+}
+
+// add appends the given count to our pending ones, waking up any poll that is
+// waiting for it.
+func (sub *statusSubscription) add(jscs ...*JobStateCount) {
+	sub.mutex.Lock()
+	sub.pending = append(sub.pending, jscs...)
+	sub.mutex.Unlock()
+	select {
+	case sub.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and forgets our pending counts.
+func (sub *statusSubscription) take() []*JobStateCount {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	pending := sub.pending
+	sub.pending = nil
+	return pending
+}
+
+// expired tells you if the client hasn't polled us for longer than
+// ServerStatusSubscriptionExpiry, eg. because it died without unsubscribing.
+func (sub *statusSubscription) expired() bool {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return !sub.polling && time.Since(sub.lastPoll) > ServerStatusSubscriptionExpiry
+}
+
+// setPolling records if the client is currently polling us.
+func (sub *statusSubscription) setPolling(polling bool) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	sub.polling = polling
+	sub.lastPoll = time.Now()
+}
+
+// subscribeStatus starts buffering the JobStateCounts for the given RepGroup
+// (or all of them if blank) for the client with the given id, starting with
+// the counts of the current jobs, replacing any existing subscription the
+// client had.
+func (s *Server) subscribeStatus(id string, repGroup string) {
+	s.unsubscribeStatus(id)
+
+	sub := &statusSubscription{
+		repGroup: repGroup,
+		notify:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		lastPoll: time.Now(),
+	}
+	s.statusSubsMutex.Lock()
+	s.statusSubs[id] = sub
+	s.statusSubsMutex.Unlock()
+
+	receiver := s.statusCaster.Join()
+	go func() {
+		defer internal.LogPanic(s.Logger, "jobqueue status subscription", true)
+		defer receiver.Close()
+
+		ticker := time.NewTicker(ServerStatusSubscriptionExpiry / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sub.stop:
+				return
+			case <-ticker.C:
+				if sub.expired() {
+					s.Debug("status subscription expired", "client", id)
+					s.unsubscribeStatus(id)
+					return
+				}
+			case val := <-receiver.In:
+				if jsc, ok := val.(*JobStateCount); ok && (repGroup == "" || jsc.RepGroup == repGroup) {
+					sub.add(jsc)
+				}
+			}
+		}
+	}()
+
+	// like the status webpage, start with the current counts, as if all
+	// current jobs were new
+	counts := s.currentStateCounts(repGroup, "status subscription")
+
+	sub.mutex.Lock()
+	sub.pending = append(counts, sub.pending...)
+	sub.mutex.Unlock()
+}
+
+// currentStateCounts returns JobStateCounts for the jobs in the given RepGroup
+// (or all current jobs, per RepGroup and for "+all+", if blank), as if they
+// were all new. who is used to describe the caller in any warnings logged.
+func (s *Server) currentStateCounts(repGroup string, who string) []*JobStateCount {
+	var counts []*JobStateCount
+	if repGroup != "" {
+		jobs, _, qerr := s.getJobsByRepGroup(repGroup, false, 0, "", nil, false, false)
+		if qerr != "" {
+			s.Warn(who+" failed to get jobs", "repgroup", repGroup, "err", qerr)
+		}
+		counts = jobsToStateCounts(repGroup, jobs)
+	} else {
+		jobs := s.getJobsCurrent(0, "", nil, false, false)
+		counts = jobsToStateCounts("+all+", jobs)
+
+		repGroups := make(map[string][]*Job)
+		for _, job := range jobs {
+			repGroups[job.RepGroup] = append(repGroups[job.RepGroup], job)
+		}
+		for rg, jobs := range repGroups {
+			complete, _, qerr := s.getCompleteJobsByRepGroup(rg)
+			if qerr != "" {
+				s.Warn(who+" failed to get complete jobs", "repgroup", rg, "err", qerr)
+			}
+			counts = append(counts, jobsToStateCounts(rg, append(jobs, complete...))...)
+		}
+	}
+	return counts
+}
+
+// statusUpdates waits up to the given time for there to be JobStateCounts
+// for the client with the given id, and returns them. Returns ErrBadRequest
+// if the client isn't subscribed.
+func (s *Server) statusUpdates(id string, wait time.Duration) ([]*JobStateCount, string) {
+	s.statusSubsMutex.Lock()
+	sub := s.statusSubs[id]
+	s.statusSubsMutex.Unlock()
+	if sub == nil {
+		return nil, ErrBadRequest
+	}
+
+	sub.setPolling(true)
+	defer sub.setPolling(false)
+
+	limit := time.After(wait)
+	for {
+		if counts := sub.take(); len(counts) > 0 {
+			return counts, ""
+		}
+		select {
+		case <-sub.notify:
+		case <-sub.stop:
+			return nil, ""
+		case <-limit:
+			return nil, ""
+		}
+	}
+}
+
+// unsubscribeStatus stops buffering JobStateCounts for the client with the
+// given id.
+func (s *Server) unsubscribeStatus(id string) {
+	s.statusSubsMutex.Lock()
+	defer s.statusSubsMutex.Unlock()
+	if sub, exists := s.statusSubs[id]; exists {
+		close(sub.stop)
+		delete(s.statusSubs, id)
+	}
+}
+
+// unsubscribeAllStatus stops all status subscriptions, for use during
+// shutdown.
+func (s *Server) unsubscribeAllStatus() {
+	s.statusSubsMutex.Lock()
+	defer s.statusSubsMutex.Unlock()
+	for id, sub := range s.statusSubs {
+		close(sub.stop)
+		delete(s.statusSubs, id)
+	}
+}
+
+// Subscribe lets you mirror what the status webpage sees: the returned channel
+// receives a JobStateCount every time some jobs change state. You first
+// receive the counts of jobs already in each state, as if they had all just
+// moved from JobStateNew.
+//
+// If repGroupFilter is blank you get the changes for every RepGroup, as well
+// as the changes to the special "+all+" RepGroup that represents all current
+// jobs. Otherwise you only get the changes to jobs in that RepGroup.
+//
+// The subscription uses its own connection to the server, so doesn't block
+// your other requests. The channel gets closed when you Disconnect(), or if
+// the connection to the server fails. You must keep receiving from it until
+// then.
+func (c *Client) Subscribe(repGroupFilter string) (<-chan *JobStateCount, error) {
+	return c.SubscribeContext(context.Background(), repGroupFilter)
+}
+
+// SubscribeContext is like Subscribe(), but the subscription also ends (and the
+// channel is closed) when ctx is cancelled or reaches its deadline.
+func (c *Client) SubscribeContext(ctx context.Context, repGroupFilter string) (<-chan *JobStateCount, error) {
+	sc, err := Connect(c.args[0], c.args[1], c.args[2], c.token, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	_, err = sc.requestContext(ctx, &clientRequest{Method: "subscribe", Job: &Job{RepGroup: repGroupFilter}})
+	if err != nil {
+		errd := sc.Disconnect()
+		if errd != nil {
+			c.Warn("failed to disconnect after subscribing failed", "err", errd)
+		}
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	id := c.addSubscription(cancel)
+	ch := make(chan *JobStateCount)
+	go func() {
+		defer func() {
+			c.removeSubscription(id)
+			cancel()
+
+			// (if ctx was cancelled while we were polling, this will wait for
+			// the poll to finish before unsubscribing)
+			_, erru := sc.request(&clientRequest{Method: "unsubscribe"})
+			if erru != nil {
+				c.Debug("failed to unsubscribe", "err", erru)
+			}
+			errd := sc.Disconnect()
+			if errd != nil {
+				c.Debug("failed to disconnect subscription", "err", errd)
+			}
+		}()
+		defer close(ch)
+
+		for {
+			// the server gives up waiting after our Timeout, which we keep
+			// well below the time we're prepared to wait for any response
+			resp, errr := sc.requestContext(ctx, &clientRequest{Method: "substatus", Timeout: sc.timeout / 2})
+			if errr != nil {
+				if ctx.Err() == nil {
+					c.Warn("status subscription failed", "err", errr)
+				}
+				return
+			}
+			for _, jsc := range resp.StateCounts {
+				select {
+				case ch <- jsc:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// addSubscription remembers the given cancel function so that Disconnect()
+// can end the subscription. Returns an id to pass to removeSubscription().
+func (c *Client) addSubscription(cancel context.CancelFunc) uint64 {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	if c.subs == nil {
+		c.subs = make(map[uint64]context.CancelFunc)
+	}
+	c.subsID++
+	c.subs[c.subsID] = cancel
+	return c.subsID
+}
+
+// removeSubscription forgets a cancel function added with addSubscription().
+func (c *Client) removeSubscription(id uint64) {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	delete(c.subs, id)
+}
+
+// cancelSubscriptions ends all our Subscribe()s.
+func (c *Client) cancelSubscriptions() {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	for id, cancel := range c.subs {
+		cancel()
+		delete(c.subs, id)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for running multi-step jobs, which have an
+// ordered list of Steps instead of a single Cmd.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stepsCmdJoin is what we join a multi-step Job's Steps with to form its Cmd.
+const stepsCmdJoin = " && "
+
+// JobStep records what happened when one of a multi-step Job's Steps was run.
+type JobStep struct {
+	// StartTime is when the step started running.
+	StartTime time.Time
+
+	// EndTime is when the step stopped running; it is zero if the step didn't
+	// get to exit by itself (eg. because the Job was killed).
+	EndTime time.Time
+
+	// Exitcode is the exit code of the step, if Exited.
+	Exitcode int
+
+	// Exited is true if the step ran and exited.
+	Exited bool
+}
+
+// Done tells you if the step ran to successful completion, in which case it
+// will not be run again if its Job is retried.
+func (s *JobStep) Done() bool {
+	return s.Exited && s.Exitcode == 0
+}
+
+// WallTime returns the time the step took to run, or 0 if it didn't exit.
+func (s *JobStep) WallTime() time.Duration {
+	if s.StartTime.IsZero() || s.EndTime.IsZero() {
+		return 0
+	}
+	return s.EndTime.Sub(s.StartTime)
+}
+
+// setCmdFromSteps sets the Cmd of a multi-step Job to the equivalent of its
+// Steps, so that it is described and uniquely keyed by them.
+func (j *Job) setCmdFromSteps() {
+	j.Lock()
+	defer j.Unlock()
+	if len(j.Steps) > 0 {
+		j.Cmd = strings.Join(j.Steps, stepsCmdJoin)
+	}
+}
+
+// firstStep returns the index of the first of our Steps that has not yet been
+// run to successful completion.
+func (j *Job) firstStep() int {
+	j.RLock()
+	defer j.RUnlock()
+	for i, result := range j.StepResults {
+		if i >= len(j.Steps) || !result.Done() {
+			return i
+		}
+	}
+	return len(j.StepResults)
+}
+
+// stepsScript returns a shell script that runs our Steps in order, starting
+// from the given one and stopping at the first that fails, all in the same
+// working directory and environment. When each step starts and exits, that is
+// recorded in the given status file, for parseStepResults() to read.
+func (j *Job) stepsScript(from int, statusFile string) string {
+	j.RLock()
+	defer j.RUnlock()
+	status := shellQuote(statusFile)
+	var script strings.Builder
+	for i := from; i < len(j.Steps); i++ {
+		step := j.Steps[i]
+		if strings.Contains(step, " | ") {
+			step = "set -o pipefail; " + step
+		}
+		fmt.Fprintf(&script, "printf '%d %%s' \"$(date +%%s%%N)\" >> %s\n", i, status)
+		fmt.Fprintf(&script, "(\n%s\n)\n", step)
+		fmt.Fprintf(&script, "wr_step_exit=$?\n")
+		fmt.Fprintf(&script, "printf ' %%s %%d\\n' \"$(date +%%s%%N)\" $wr_step_exit >> %s\n", status)
+		fmt.Fprintf(&script, "if [ $wr_step_exit -ne 0 ]; then exit $wr_step_exit; fi\n")
+	}
+	return script.String()
+}
+
+// parseStepResults reads the status file written by the script from
+// stepsScript(), returning our StepResults for the steps prior to the given
+// one followed by the results of the steps that the script started.
+func (j *Job) parseStepResults(from int, statusFile string) ([]*JobStep, error) {
+	j.RLock()
+	results := make([]*JobStep, 0, len(j.Steps))
+	results = append(results, j.StepResults[:from]...)
+	j.RUnlock()
+
+	content, err := ioutil.ReadFile(statusFile)
+	if err != nil {
+		return results, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		result := &JobStep{StartTime: nanoTime(fields[1])}
+		if len(fields) == 4 {
+			result.EndTime = nanoTime(fields[2])
+			result.Exitcode, err = strconv.Atoi(fields[3])
+			if err != nil {
+				return results, fmt.Errorf("bad exit code in steps status file: %w", err)
+			}
+			result.Exited = true
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// nanoTime converts the output of `date +%s%N` to a time, returning the zero
+// time if it couldn't be parsed.
+func nanoTime(nanos string) time.Time {
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// shellQuote single quotes the given string for safe use in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,100 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for preferring to run jobs that mount object
+// stores in the cloud availability zone closest to those stores.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// defaultS3Profile is the S3 profile used by MountTargets that don't specify
+// one.
+const defaultS3Profile = "default"
+
+// ParseStorageZones parses a comma separated list of profile=zone pairs, eg.
+// "default=nova-a,archive=nova-b", in to StorageZones suitable for supplying
+// to ServerConfig.
+func ParseStorageZones(spec string) (map[string]string, error) {
+	var zones map[string]string
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		pos := strings.LastIndex(pair, "=")
+		if pos < 1 || pos == len(pair)-1 {
+			return nil, fmt.Errorf("storage zone [%s] is not of the form profile=zone", pair)
+		}
+		if zones == nil {
+			zones = make(map[string]string)
+		}
+		zones[strings.TrimSpace(pair[:pos])] = strings.TrimSpace(pair[pos+1:])
+	}
+	return zones, nil
+}
+
+// storageZone returns the zone that the given StorageZones say is closest to
+// the object stores the job mounts, going by the S3 profile of the first of
+// its MountTargets that has a zone. Returns blank if none do.
+func (j *Job) storageZone(zones map[string]string) string {
+	if len(zones) == 0 {
+		return ""
+	}
+	j.RLock()
+	defer j.RUnlock()
+	for _, mc := range j.MountConfigs {
+		for _, target := range mc.Targets {
+			profile := target.Profile
+			if profile == "" {
+				profile = defaultS3Profile
+			}
+			if zone, exists := zones[profile]; exists {
+				return zone
+			}
+		}
+	}
+	return ""
+}
+
+// localityReq returns the given req, or if the job mounts an object store that
+// our storageZones associate with an availability zone, a clone of it with
+// that zone added to Other, so that cloud schedulers prefer to run the job
+// there. A zone the job's Requirements already asked for is left alone.
+func (s *Server) localityReq(job *Job, req *scheduler.Requirements) *scheduler.Requirements {
+	if _, exists := req.Other[scheduler.ReqZone]; exists {
+		return req
+	}
+	zone := job.storageZone(s.storageZones)
+	if zone == "" {
+		return req
+	}
+
+	req = req.Clone()
+	if req.Other == nil {
+		req.Other = make(map[string]string)
+	}
+	req.Other[scheduler.ReqZone] = zone
+	return req
+}
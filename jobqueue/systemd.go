@@ -0,0 +1,250 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for integrating with systemd when the server is
+// run as a service: telling systemd when we are ready and when we are
+// stopping, pinging its watchdog, and serving on sockets that systemd opened
+// for us (socket activation). We speak the simple sd_notify and sd_listen_fds
+// protocols directly, and do nothing if we weren't started by systemd.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"nanomsg.org/go-mangos"
+)
+
+// systemdListenFDsStart is the first file descriptor that systemd passes
+// activated sockets as.
+const systemdListenFDsStart = 3
+
+// systemdScheme is the scheme of our mangos transport for activated sockets.
+const systemdScheme = "systemd+tls"
+
+// systemdNotify sends the given state (eg. "READY=1") to systemd, if we were
+// started by systemd as a Type=notify service. Returns false if we weren't.
+func systemdNotify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	if addr[0] == '@' {
+		// abstract socket
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	_, err = conn.Write([]byte(state))
+	errc := conn.Close()
+	if err == nil {
+		err = errc
+	}
+	return err == nil, err
+}
+
+// systemdWatchdogInterval returns how often we should ping systemd's watchdog,
+// which is half its timeout, or 0 if the watchdog isn't enabled for us.
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// systemdListeners returns the TCP listeners that systemd passed to us via
+// socket activation, keyed on their port. The environment variables that
+// describe them are unset, so that any processes we start don't think the
+// sockets are meant for them.
+func systemdListeners() (map[string]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if erru := os.Unsetenv(key); erru != nil {
+			return nil, erru
+		}
+	}
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	listeners := make(map[string]net.Listener)
+	for fd := systemdListenFDsStart; fd < systemdListenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("systemd socket %d", fd))
+		l, errl := net.FileListener(f)
+		errc := f.Close()
+		if errl != nil {
+			return listeners, fmt.Errorf("systemd socket %d is not usable: %w", fd, errl)
+		}
+		if errc != nil {
+			return listeners, errc
+		}
+		_, port, errs := net.SplitHostPort(l.Addr().String())
+		if errs != nil {
+			return listeners, errs
+		}
+		listeners[port] = l
+	}
+	return listeners, nil
+}
+
+// closeUnusedListeners closes the given listeners other than those on the
+// given ports.
+func closeUnusedListeners(listeners map[string]net.Listener, ports ...string) {
+	used := make(map[string]bool)
+	for _, port := range ports {
+		used[port] = true
+	}
+	for port, l := range listeners {
+		if !used[port] {
+			l.Close() // #nosec we don't care about failing to close an unused socket
+		}
+	}
+}
+
+// startSystemdNotifications tells systemd we're ready, and then pings its
+// watchdog (if enabled) until stop is closed.
+func (s *Server) startSystemdNotifications(stop chan struct{}) {
+	notified, err := systemdNotify("READY=1\nSTATUS=Accepting commands")
+	if err != nil {
+		s.Warn("failed to notify systemd that we're ready", "err", err)
+	}
+	interval := systemdWatchdogInterval()
+	if !notified || interval == 0 {
+		return
+	}
+
+	go func() {
+		defer internal.LogPanic(s.Logger, "systemd watchdog", false)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, errn := systemdNotify("WATCHDOG=1"); errn != nil {
+					s.Warn("failed to ping systemd watchdog", "err", errn)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// systemdTransport is a mangos Transport that accepts TLS connections on a
+// listener that systemd gave us, instead of listening itself.
+type systemdTransport struct {
+	listener net.Listener
+}
+
+// Scheme implements mangos.Transport.
+func (t *systemdTransport) Scheme() string {
+	return systemdScheme
+}
+
+// NewDialer implements mangos.Transport, but we can't dial.
+func (t *systemdTransport) NewDialer(addr string, sock mangos.Socket) (mangos.PipeDialer, error) {
+	return nil, mangos.ErrBadTran
+}
+
+// NewListener implements mangos.Transport.
+func (t *systemdTransport) NewListener(addr string, sock mangos.Socket) (mangos.PipeListener, error) {
+	return &systemdPipeListener{listener: t.listener, sock: sock, opts: make(map[string]interface{})}, nil
+}
+
+// systemdPipeListener is the mangos.PipeListener of a systemdTransport.
+type systemdPipeListener struct {
+	listener net.Listener
+	sock     mangos.Socket
+	opts     map[string]interface{}
+	config   *tls.Config
+}
+
+// Listen implements mangos.PipeListener; the listener is already listening, so
+// this just checks we have been given a TLS config.
+func (l *systemdPipeListener) Listen() error {
+	config, ok := l.opts[mangos.OptionTLSConfig].(*tls.Config)
+	if !ok || config == nil {
+		return mangos.ErrTLSNoConfig
+	}
+	if len(config.Certificates) == 0 {
+		return mangos.ErrTLSNoCert
+	}
+	l.config = config
+	return nil
+}
+
+// Accept implements mangos.PipeListener.
+func (l *systemdPipeListener) Accept() (mangos.Pipe, error) {
+	nconn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Server(nconn, l.config)
+	if err = conn.Handshake(); err != nil {
+		conn.Close() // #nosec the handshake error is more useful
+		return nil, err
+	}
+	return mangos.NewConnPipe(conn, l.sock, mangos.PropTLSConnState, conn.ConnectionState())
+}
+
+// Close implements mangos.PipeListener.
+func (l *systemdPipeListener) Close() error {
+	return l.listener.Close()
+}
+
+// SetOption implements mangos.PipeListener.
+func (l *systemdPipeListener) SetOption(name string, value interface{}) error {
+	if name != mangos.OptionTLSConfig {
+		return mangos.ErrBadOption
+	}
+	l.opts[name] = value
+	return nil
+}
+
+// GetOption implements mangos.PipeListener.
+func (l *systemdPipeListener) GetOption(name string) (interface{}, error) {
+	value, ok := l.opts[name]
+	if !ok {
+		return nil, mangos.ErrBadOption
+	}
+	return value, nil
+}
+
+// Address implements mangos.PipeListener.
+func (l *systemdPipeListener) Address() string {
+	return systemdScheme + "://" + l.listener.Addr().String()
+}
@@ -0,0 +1,240 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets you watch the output of running jobs
+// live: runners ship the latest output of the jobs they're running to the
+// server, which keeps the tail of it for clients to get.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// JobTail is the latest output of a running job, as got by Client.GetTail().
+type JobTail struct {
+	// StdOut and StdErr are the output since the offsets you asked for, or as
+	// much of it as the server still has.
+	StdOut []byte
+	StdErr []byte
+
+	// StdOutOffset and StdErrOffset are the offsets to ask for next time, to
+	// only get newer output.
+	StdOutOffset int64
+	StdErrOffset int64
+
+	// Running is false once the job has stopped running, after which there
+	// won't be any more output.
+	Running bool
+}
+
+// tailBuffer is an io.Writer that keeps the most recent max bytes written to
+// it, along with the total number of bytes ever written, so that readers can
+// ask for just the output after some offset.
+type tailBuffer struct {
+	buf   []byte
+	total int64
+	max   int
+	mu    sync.Mutex
+}
+
+// newTailBuffer returns a tailBuffer that keeps up to max bytes.
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+// Write implements io.Writer, never failing.
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.append(p)
+	return len(p), nil
+}
+
+// append adds p to our buf, forgetting the oldest bytes if we then have more
+// than max. You must hold the lock.
+func (t *tailBuffer) append(p []byte) {
+	t.buf = append(t.buf, p...)
+	t.total += int64(len(p))
+	if len(t.buf) > t.max {
+		t.buf = append([]byte(nil), t.buf[len(t.buf)-t.max:]...)
+	}
+}
+
+// appendAt adds the given chunk of output that ends at the given offset,
+// ignoring any part of it we already have. If output between what we have and
+// the chunk was never received, we forget what we have, so that readers don't
+// see it run together with the chunk.
+func (t *tailBuffer) appendAt(p []byte, end int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	start := end - int64(len(p))
+	switch {
+	case start < t.total:
+		skip := t.total - start
+		if skip >= int64(len(p)) {
+			return
+		}
+		p = p[skip:]
+	case start > t.total:
+		t.buf = nil
+		t.total = start
+	}
+	t.append(p)
+}
+
+// since returns a copy of the output after the given offset (or as much of it
+// as we still have), and the offset it ends at. An offset beyond what we have
+// (eg. from a previous run of a job) is treated as 0.
+func (t *tailBuffer) since(offset int64) ([]byte, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if offset > t.total {
+		offset = 0
+	}
+	n := t.total - offset
+	if n <= 0 {
+		return nil, t.total
+	}
+	if n > int64(len(t.buf)) {
+		n = int64(len(t.buf))
+	}
+	out := make([]byte, n)
+	copy(out, t.buf[int64(len(t.buf))-n:])
+	return out, t.total
+}
+
+// tailShipper collects the output of a job the runner is running, so that it
+// can be shipped to the server in chunks.
+type tailShipper struct {
+	out     *tailBuffer
+	err     *tailBuffer
+	sentOut int64
+	sentErr int64
+	mu      sync.Mutex
+}
+
+// newTailShipper returns a tailShipper that keeps up to ClientTailMax bytes of
+// unshipped output.
+func newTailShipper() *tailShipper {
+	return &tailShipper{out: newTailBuffer(ClientTailMax), err: newTailBuffer(ClientTailMax)}
+}
+
+// pending adds the output that hasn't been shipped yet, and the offsets it
+// ends at, to the given request, treating it as shipped. Does nothing if ts is
+// nil.
+func (ts *tailShipper) pending(cr *clientRequest) {
+	if ts == nil {
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	cr.StdOutTail, ts.sentOut = ts.out.since(ts.sentOut)
+	cr.StdErrTail, ts.sentErr = ts.err.since(ts.sentErr)
+	cr.StdOutOffset, cr.StdErrOffset = ts.sentOut, ts.sentErr
+}
+
+// recordTail stores the output shipped with a request about the given running
+// job. Returns true if someone has recently asked for that job's output.
+func (s *Server) recordTail(job *Job, cr *clientRequest) bool {
+	job.Lock()
+	defer job.Unlock()
+	if len(cr.StdOutTail) > 0 {
+		if job.tailOut == nil {
+			job.tailOut = newTailBuffer(ServerTailMax)
+		}
+		job.tailOut.appendAt(cr.StdOutTail, cr.StdOutOffset)
+	}
+	if len(cr.StdErrTail) > 0 {
+		if job.tailErr == nil {
+			job.tailErr = newTailBuffer(ServerTailMax)
+		}
+		job.tailErr.appendAt(cr.StdErrTail, cr.StdErrOffset)
+	}
+	return !job.tailWatched.IsZero() && time.Since(job.tailWatched) < ServerTailWatchExpiry
+}
+
+// getTail does the server side of Client.GetTail(), returning the output of
+// the job with the given key after the given offsets.
+func (s *Server) getTail(key string, outOffset, errOffset int64) (*JobTail, string) {
+	item, err := s.q.Get(key)
+	if err != nil || item == nil {
+		return nil, ErrBadJob
+	}
+	job := item.Data().(*Job)
+	tail := &JobTail{
+		StdOutOffset: outOffset,
+		StdErrOffset: errOffset,
+		Running:      item.Stats().State == queue.ItemStateRun,
+	}
+
+	job.Lock()
+	job.tailWatched = time.Now()
+	tailOut, tailErr := job.tailOut, job.tailErr
+	job.Unlock()
+
+	if tailOut != nil {
+		tail.StdOut, tail.StdOutOffset = tailOut.since(outOffset)
+	}
+	if tailErr != nil {
+		tail.StdErr, tail.StdErrOffset = tailErr.since(errOffset)
+	}
+	return tail, ""
+}
+
+// GetTail gets the latest STDOUT and STDERR of the running job with the given
+// key (or Name), after the given offsets. Supply 0 offsets at first, and then
+// the offsets in the returned JobTail to get only newer output. Call it
+// repeatedly (eg. every second) to watch a job's output live, until
+// JobTail.Running is false.
+//
+// Runners ship the output of the jobs they run when they touch them, and every
+// ClientTailInterval while someone is calling GetTail(), so output appears
+// after a short delay. The server only keeps the last ServerTailMax bytes of
+// each, and output is filtered like the final STDOUT and STDERR are (eg. to
+// mostly eliminate progress bars).
+func (c *Client) GetTail(key string, outOffset, errOffset int64) (*JobTail, error) {
+	return c.GetTailContext(context.Background(), key, outOffset, errOffset)
+}
+
+// GetTailContext is like GetTail(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetTailContext(ctx context.Context, key string, outOffset, errOffset int64) (*JobTail, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "gettail", Keys: []string{key}, StdOutOffset: outOffset, StdErrOffset: errOffset})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tail, err
+}
+
+// shipTail sends the server the output of the given job that we're running
+// which we haven't shipped yet, returning the server's response, which says if
+// anyone still wants it.
+func (c *Client) shipTail(ctx context.Context, job *Job) (*serverResponse, error) {
+	c.teMutex.Lock()
+	defer c.teMutex.Unlock()
+	job.RLock()
+	defer job.RUnlock()
+	cr := &clientRequest{Method: "jtail", Job: job}
+	job.tailShip.pending(cr)
+	return c.requestContext(ctx, cr)
+}
@@ -0,0 +1,172 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for letting many users share a server: working
+// out who is making a request, and limiting ordinary users to seeing and
+// acting on their own jobs, while admins can see and act on everyone's.
+
+// requester describes who made a request, as worked out by our Authenticator.
+type requester struct {
+	user  string
+	admin bool
+}
+
+// requesterOf returns who made the given (authenticated) request. Requests
+// that our Authenticator didn't identify a User for (such as all requests when
+// using the default RequireToken), or that presented the server's token, are
+// treated as being from an admin, since there is no one to limit them to.
+func (s *Server) requesterOf(req *AuthRequest) *requester {
+	return &requester{
+		user:  req.User,
+		admin: req.Admin || req.TokenValid || req.User == "" || s.admins[req.User],
+	}
+}
+
+// owner returns the user whose jobs we should be limited to, given that we
+// asked to see those of the given user (which can be blank to mean
+// everyone's). Admins can see anyone's, while everyone else only gets to see
+// their own.
+func (r *requester) owner(asked string) string {
+	if r.admin {
+		return asked
+	}
+	return r.user
+}
+
+// canSee tells you if we are allowed to see and act on the given job.
+func (r *requester) canSee(job *Job) bool {
+	if r.admin {
+		return true
+	}
+	job.RLock()
+	defer job.RUnlock()
+	return job.User == r.user
+}
+
+// jobsOwnedBy returns the given jobs that belong to the given user, or all of
+// them if user is blank.
+func jobsOwnedBy(jobs []*Job, user string) []*Job {
+	if user == "" {
+		return jobs
+	}
+	filtered := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		job.RLock()
+		mine := job.User == user
+		job.RUnlock()
+		if mine {
+			filtered = append(filtered, job)
+		}
+	}
+	return filtered
+}
+
+// name returns the name of our user, or the given default if we don't know it
+// (eg. because the request didn't identify them).
+func (r *requester) name(def string) string {
+	if r.user != "" {
+		return r.user
+	}
+	return def
+}
+
+// userStateCount is a JobStateCount for the jobs of a particular user, which
+// we broadcast so that status webpages can be sent just the counts of the jobs
+// they are allowed to see.
+type userStateCount struct {
+	user  string
+	count *JobStateCount
+}
+
+// userGroup is a user and one of their RepGroups (or tag groups, or "+all+").
+type userGroup struct {
+	user  string
+	group string
+}
+
+// stateCounter counts the jobs that are moving between 2 states, per RepGroup
+// (and tag group), and per user and group, so that we can broadcast the counts.
+type stateCounter struct {
+	total  int
+	groups map[string]int
+	users  map[userGroup]int
+}
+
+// newStateCounter creates a new, empty, stateCounter.
+func newStateCounter() *stateCounter {
+	return &stateCounter{
+		groups: make(map[string]int),
+		users:  make(map[userGroup]int),
+	}
+}
+
+// add counts a job of the given user in the given RepGroup and tag groups.
+func (c *stateCounter) add(user, repGroup string, tagGroups []string) {
+	c.total++
+	c.users[userGroup{user, "+all+"}]++
+	for _, group := range append([]string{repGroup}, tagGroups...) {
+		c.groups[group]++
+		c.users[userGroup{user, group}]++
+	}
+}
+
+// sendStateCounts broadcasts the counts of the given stateCounter as jobs
+// moving between the given states, both in total per group (on statusCaster)
+// and per user and group (on userStatusCaster).
+func (s *Server) sendStateCounts(c *stateCounter, from, to JobState) {
+	s.statusCaster.Send(&JobStateCount{"+all+", from, to, c.total})
+	for group, count := range c.groups {
+		s.statusCaster.Send(&JobStateCount{group, from, to, count})
+	}
+
+	for ug, count := range c.users {
+		s.userStatusCaster.Send(&userStateCount{user: ug.user, count: &JobStateCount{ug.group, from, to, count}})
+	}
+}
+
+// ownedStateCounts returns a filter for relayCasterFiltered() that passes on
+// the JobStateCounts of the userStateCounts broadcast by sendStateCounts(),
+// keeping only those of the user that owner() returns at the time, or all of
+// them if it returns blank.
+func ownedStateCounts(owner func() string) func(msg interface{}) (interface{}, bool) {
+	return func(msg interface{}) (interface{}, bool) {
+		usc, ok := msg.(*userStateCount)
+		if !ok {
+			return nil, false
+		}
+		if o := owner(); o != "" && usc.user != o {
+			return nil, false
+		}
+		return usc.count, true
+	}
+}
+
+// canSeeKey is like requester.canSee(), but for the job with the given key.
+// Jobs we don't know about can't be seen by ordinary users.
+func (s *Server) canSeeKey(r *requester, key string) bool {
+	if r.admin {
+		return true
+	}
+	jobs, _, qerr := s.getJobsByKeys([]string{key}, false, false)
+	if qerr != "" || len(jobs) != 1 {
+		return false
+	}
+	return r.canSee(jobs[0])
+}
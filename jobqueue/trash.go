@@ -0,0 +1,190 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets removed jobs be restored for a while,
+// before they are permanently deleted.
+
+import (
+	"context"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// getTrashed does the server side of Client.GetTrashed(), returning the
+// trashed jobs of the given RepGroup, or all of them if repGroup is blank.
+func (s *Server) getTrashed(repGroup string) ([]*Job, error) {
+	jobs, err := s.db.retrieveTrashedJobs()
+	if err != nil || repGroup == "" {
+		return jobs, err
+	}
+	filtered := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.RepGroup == repGroup {
+			filtered = append(filtered, job)
+		}
+	}
+	return filtered, err
+}
+
+// restoreTrashed does the server side of Client.RestoreTrashed(), putting the
+// trashed jobs with the given keys that are in the given namespace back in the
+// queue. Returns the number of jobs restored, and one of our Err* constants
+// on failure.
+func (s *Server) restoreTrashed(keys []string, namespace string) (int, string, error) {
+	jobs, err := s.db.retrieveTrashedJobs(keys...)
+	if err != nil {
+		return 0, ErrDBError, err
+	}
+
+	// jobs were already admitted when first added, and we add them back as
+	// they were, except that their idempotency keys must be reclaimable
+	byEnv := make(map[string][]*Job)
+	var envKeys []string
+	var idemKeys []string
+	for _, job := range jobs {
+		if namespace != "" && job.Namespace != namespace {
+			continue
+		}
+		job.Trashed = time.Time{}
+		job.State = ""
+		if job.IdempotencyKey != "" {
+			idemKeys = append(idemKeys, job.IdempotencyKey)
+		}
+		if _, exists := byEnv[job.EnvKey]; !exists {
+			envKeys = append(envKeys, job.EnvKey)
+		}
+		byEnv[job.EnvKey] = append(byEnv[job.EnvKey], job)
+	}
+	err = s.db.releaseIdempotencyKeys(idemKeys)
+	if err != nil {
+		return 0, ErrDBError, err
+	}
+
+	restored := 0
+	for _, envKey := range envKeys {
+		envJobs := byEnv[envKey]
+		added, _, _, srerr, qerr := s.createAdmittedJobs(envJobs, envKey, true)
+		if qerr != nil {
+			return restored, srerr, qerr
+		}
+		restored += added
+
+		restoredKeys := make([]string, len(envJobs))
+		for i, job := range envJobs {
+			restoredKeys[i] = job.Key()
+		}
+		err = s.db.deleteTrashedJobs(restoredKeys, false)
+		if err != nil {
+			return restored, ErrDBError, err
+		}
+	}
+	return restored, "", nil
+}
+
+// trashPurger periodically deletes the trashed jobs that have been in the
+// trash for longer than our trashPeriod, until we stop.
+func (s *Server) trashPurger() {
+	defer internal.LogPanic(s.Logger, "jobqueue trash purger", true)
+
+	ticker := time.NewTicker(ServerTrashPurgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ssmutex.RLock()
+		up := s.up
+		s.ssmutex.RUnlock()
+		if !up {
+			return
+		}
+
+		if err := s.purgeTrash(); err != nil {
+			s.Warn("failed to purge the trash", "err", err)
+		}
+	}
+}
+
+// purgeTrash permanently deletes the trashed jobs that have been in the trash
+// for longer than our trashPeriod. (If trashing has since been turned off, the
+// jobs still in the trash are kept until they're restored or it is turned back
+// on.)
+func (s *Server) purgeTrash() error {
+	s.tmutex.RLock()
+	period := s.trashPeriod
+	s.tmutex.RUnlock()
+	if period <= 0 {
+		return nil
+	}
+
+	jobs, err := s.db.retrieveTrashedJobs()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-period)
+	var expired []string
+	for _, job := range jobs {
+		if job.Trashed.Before(cutoff) {
+			expired = append(expired, job.Key())
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	s.Debug("purging trashed jobs", "count", len(expired))
+	return s.db.deleteTrashedJobs(expired, true)
+}
+
+// GetTrashed gets the jobs that were removed (with Delete() or any other
+// means) but have not yet been permanently deleted, because the server has a
+// TrashPeriod. Supply a RepGroup to only get its trashed jobs. The jobs have a
+// State of JobStateTrashed, and their Trashed time says when they were
+// removed.
+func (c *Client) GetTrashed(repGroup string) ([]*Job, error) {
+	return c.GetTrashedContext(context.Background(), repGroup)
+}
+
+// GetTrashedContext is like GetTrashed(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetTrashedContext(ctx context.Context, repGroup string) ([]*Job, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "gettrashed", Job: &Job{RepGroup: repGroup}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, err
+}
+
+// RestoreTrashed undoes the removal of the given trashed jobs (see
+// GetTrashed()), adding them back to the queue as they were when removed.
+// (Jobs that were buried when removed become ready to run again.) Returns the
+// number of jobs restored.
+func (c *Client) RestoreTrashed(jes []*JobEssence) (int, error) {
+	return c.RestoreTrashedContext(context.Background(), jes)
+}
+
+// RestoreTrashedContext is like RestoreTrashed(), but stops waiting for the
+// server and returns ctx.Err() if ctx is cancelled or reaches its deadline
+// first.
+func (c *Client) RestoreTrashedContext(ctx context.Context, jes []*JobEssence) (int, error) {
+	keys := c.jesToKeys(jes)
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "untrash", Keys: keys})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Added, err
+}
@@ -0,0 +1,423 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for triaging buried jobs: rules that match
+// buried jobs by how they failed, and automatically retry them differently,
+// mark them as permanently failed, or tell a webhook about them.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TriageAction* constants are the possible Actions of a TriageRule.
+const (
+	// TriageActionRetryRAM retries the job with its RAM requirement
+	// multiplied by the rule's RAMMultiplier.
+	TriageActionRetryRAM = "retry_ram"
+
+	// TriageActionRetryHost retries the job on a different host to the one it
+	// was buried on. This is only useful when jobs can run on more than one
+	// host.
+	TriageActionRetryHost = "retry_host"
+
+	// TriageActionFail leaves the job buried, but changes its FailReason to
+	// the rule's FailReasonSet (FailReasonPermanent by default), so that you
+	// can tell it doesn't need looking at.
+	TriageActionFail = "fail"
+
+	// TriageActionWebhook leaves the job buried, and just POSTs a
+	// TriageNotification to the rule's Webhook.
+	TriageActionWebhook = "webhook"
+)
+
+// defaultTriageRAMMultiplier is the RAMMultiplier of TriageActionRetryRAM
+// rules that don't specify one.
+const defaultTriageRAMMultiplier = 2
+
+// TriageNotifyTimeout is how long we wait for a TriageRule's Webhook to
+// respond. It is a variable only for testing purposes.
+var TriageNotifyTimeout = 10 * time.Second
+
+// TriageRule describes what should happen to jobs that get buried in a
+// particular way. Supply these to Client.SetTriageRules(), or parse them from
+// YAML with ParseTriageRules(). The first rule that matches a newly buried job
+// is applied to it.
+type TriageRule struct {
+	// Name identifies the rule.
+	Name string `yaml:"name"`
+
+	// FailReason is the FailReason a buried job must have to match this rule,
+	// eg. FailReasonRAM. The default of blank matches any FailReason.
+	FailReason string `yaml:"fail_reason"`
+
+	// Exitcode is the exit code a buried job must have to match this rule. The
+	// default of 0 matches any exit code.
+	Exitcode int `yaml:"exitcode"`
+
+	// StdErr is a regular expression that must match somewhere in a buried
+	// job's STDERR for it to match this rule. The default of blank matches any
+	// STDERR.
+	StdErr string `yaml:"stderr"`
+
+	// Action is one of the TriageAction* constants.
+	Action string `yaml:"action"`
+
+	// RAMMultiplier is what TriageActionRetryRAM multiplies the RAM
+	// requirement of jobs by. It defaults to 2.
+	RAMMultiplier float64 `yaml:"ram_multiplier"`
+
+	// MaxRetries is the most times a retry action of this rule will retry the
+	// same job; after that the rule no longer matches it. It defaults to 1.
+	MaxRetries int `yaml:"max_retries"`
+
+	// FailReasonSet is the FailReason TriageActionFail gives jobs. It defaults
+	// to FailReasonPermanent.
+	FailReasonSet string `yaml:"set_fail_reason"`
+
+	// Webhook is an http(s) URL that is POSTed a JSON TriageNotification when
+	// the rule is applied. It is required for TriageActionWebhook, and
+	// optional for the other actions.
+	Webhook string `yaml:"webhook"`
+
+	stdErrRE *regexp.Regexp
+}
+
+// TriageRuleInfo describes one of the server's TriageRules, and how many
+// buried jobs it has been applied to since the server started.
+type TriageRuleInfo struct {
+	Rule    *TriageRule
+	Hits    int
+	LastHit time.Time
+}
+
+// TriageNotification is what gets POSTed to a TriageRule's Webhook.
+type TriageNotification struct {
+	Rule       string    `json:"rule"`
+	Action     string    `json:"action"`
+	RepGroup   string    `json:"rep_grp"`
+	Key        string    `json:"key"`
+	Cmd        string    `json:"cmd"`
+	Host       string    `json:"host,omitempty"`
+	Exitcode   int       `json:"exitcode"`
+	FailReason string    `json:"fail_reason"`
+	Time       time.Time `json:"time"`
+}
+
+// triageHit records how often a TriageRule has been applied.
+type triageHit struct {
+	hits int
+	last time.Time
+}
+
+// ParseTriageRules parses a YAML list of rules, like:
+//
+//   - name: oom
+//     stderr: "(?i)out of memory"
+//     action: retry_ram
+//     ram_multiplier: 1.5
+//   - name: bad input
+//     exitcode: 3
+//     action: fail
+//     webhook: https://example.com/hook
+//
+// The keys of each rule are the yaml tags of the TriageRule properties.
+func ParseTriageRules(r io.Reader) ([]*TriageRule, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*TriageRule
+	if err = yaml.UnmarshalStrict(content, &rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if err = rule.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// compile validates the rule and compiles its StdErr regular expression.
+func (r *TriageRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("a Name is required")
+	}
+	switch r.Action {
+	case TriageActionRetryRAM:
+		if r.RAMMultiplier != 0 && r.RAMMultiplier <= 1 {
+			return fmt.Errorf("rule [%s] RAMMultiplier %v must be greater than 1", r.Name, r.RAMMultiplier)
+		}
+	case TriageActionRetryHost, TriageActionFail:
+	case TriageActionWebhook:
+		if r.Webhook == "" {
+			return fmt.Errorf("rule [%s] needs a Webhook", r.Name)
+		}
+	default:
+		return fmt.Errorf("rule [%s] has unknown Action [%s]", r.Name, r.Action)
+	}
+	if r.MaxRetries < 0 {
+		return fmt.Errorf("rule [%s] MaxRetries can't be negative", r.Name)
+	}
+	if r.Webhook != "" {
+		u, err := url.Parse(r.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("rule [%s] Webhook [%s] is not a valid http(s) URL", r.Name, r.Webhook)
+		}
+	}
+
+	r.stdErrRE = nil
+	if r.StdErr != "" {
+		re, err := regexp.Compile(r.StdErr)
+		if err != nil {
+			return fmt.Errorf("rule [%s] StdErr: %s", r.Name, err)
+		}
+		r.stdErrRE = re
+	}
+	return nil
+}
+
+// retries tells you if our Action retries jobs.
+func (r *TriageRule) retries() bool {
+	return r.Action == TriageActionRetryRAM || r.Action == TriageActionRetryHost
+}
+
+// maxRetries returns our MaxRetries with the default applied.
+func (r *TriageRule) maxRetries() int {
+	if r.MaxRetries > 0 {
+		return r.MaxRetries
+	}
+	return 1
+}
+
+// matches tells you if a job that was buried with the given FailReason, exit
+// code and STDERR, and that has already been retried by this rule the given
+// number of times, matches this rule.
+func (r *TriageRule) matches(failReason string, exitcode int, stderr string, retried int) bool {
+	if r.FailReason != "" && r.FailReason != failReason {
+		return false
+	}
+	if r.Exitcode != 0 && r.Exitcode != exitcode {
+		return false
+	}
+	if r.retries() && retried >= r.maxRetries() {
+		return false
+	}
+	return r.stdErrRE == nil || r.stdErrRE.MatchString(stderr)
+}
+
+// retryRAM returns the RAM (in MB) a job that previously had the given RAM
+// should be retried with according to this rule.
+func (r *TriageRule) retryRAM(ram int) int {
+	mult := r.RAMMultiplier
+	if mult == 0 {
+		mult = defaultTriageRAMMultiplier
+	}
+	return int(math.Ceil(float64(ram) * mult))
+}
+
+// setTriageRules replaces our TriageRules with the given ones, forgetting the
+// hit counts of rules that no longer exist.
+func (s *Server) setTriageRules(rules []*TriageRule) (srerr string, qerr error) {
+	names := make(map[string]bool)
+	for _, rule := range rules {
+		if rule == nil {
+			return ErrBadTriageRule, fmt.Errorf("nil rule")
+		}
+		if err := rule.compile(); err != nil {
+			return ErrBadTriageRule, err
+		}
+		if names[rule.Name] {
+			return ErrBadTriageRule, fmt.Errorf("rule name [%s] used more than once", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	s.trmutex.Lock()
+	defer s.trmutex.Unlock()
+	if err := s.db.storeTriageRules(rules); err != nil {
+		return ErrDBError, err
+	}
+	s.triageRules = rules
+	for name := range s.triageHits {
+		if !names[name] {
+			delete(s.triageHits, name)
+		}
+	}
+	return "", nil
+}
+
+// getTriageRules returns our TriageRules, in the order they're checked, along
+// with their hit counts.
+func (s *Server) getTriageRules() []*TriageRuleInfo {
+	s.trmutex.RLock()
+	defer s.trmutex.RUnlock()
+	infos := make([]*TriageRuleInfo, len(s.triageRules))
+	for i, rule := range s.triageRules {
+		info := &TriageRuleInfo{Rule: rule}
+		if hit, exists := s.triageHits[rule.Name]; exists {
+			info.Hits = hit.hits
+			info.LastHit = hit.last
+		}
+		infos[i] = info
+	}
+	return infos
+}
+
+// matchTriageRule returns the first of our TriageRules that matches the given
+// just-buried job, which ended with the given exit code and (possibly
+// compressed) STDERR, counting a hit for it. Returns nil if none match. The job
+// must not be locked.
+func (s *Server) matchTriageRule(job *Job, exitcode int, stderrC []byte) *TriageRule {
+	s.trmutex.RLock()
+	rules := s.triageRules
+	s.trmutex.RUnlock()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	job.RLock()
+	failReason := job.FailReason
+	retried := make(map[string]int, len(job.TriageRetries))
+	for name, count := range job.TriageRetries {
+		retried[name] = count
+	}
+	job.RUnlock()
+
+	var stderr string
+	var gotStdErr bool
+	for _, rule := range rules {
+		if rule.stdErrRE != nil && !gotStdErr {
+			stderr = failedStdErr(stderrC)
+			gotStdErr = true
+		}
+		if rule.matches(failReason, exitcode, stderr, retried[rule.Name]) {
+			s.trmutex.Lock()
+			hit, exists := s.triageHits[rule.Name]
+			if !exists {
+				hit = &triageHit{}
+				s.triageHits[rule.Name] = hit
+			}
+			hit.hits++
+			hit.last = time.Now()
+			s.trmutex.Unlock()
+			return rule
+		}
+	}
+	return nil
+}
+
+// triageBuriedJob applies the first of our TriageRules that matches the given
+// job, which has just been buried after exiting with the given exit code and
+// (possibly compressed) STDERR. The job must not be locked.
+func (s *Server) triageBuriedJob(job *Job, exitcode int, stderrC []byte) {
+	rule := s.matchTriageRule(job, exitcode, stderrC)
+	if rule == nil {
+		return
+	}
+
+	key := job.Key()
+	job.Lock()
+	host := job.Host
+	switch rule.Action {
+	case TriageActionRetryRAM, TriageActionRetryHost:
+		if job.TriageRetries == nil {
+			job.TriageRetries = make(map[string]int)
+		}
+		job.TriageRetries[rule.Name]++
+		if rule.Action == TriageActionRetryRAM && job.Requirements != nil {
+			ram := job.Requirements.RAM
+			if job.retryRAM > ram {
+				ram = job.retryRAM
+			}
+			job.retryRAM = rule.retryRAM(ram)
+			job.Requirements.RAM = job.retryRAM
+		} else if rule.Action == TriageActionRetryHost && host != "" && !hostIn(host, job.AvoidHosts) {
+			job.AvoidHosts = append(job.AvoidHosts, host)
+		}
+	case TriageActionFail:
+		job.FailReason = rule.FailReasonSet
+		if job.FailReason == "" {
+			job.FailReason = FailReasonPermanent
+		}
+	}
+	job.Unlock()
+	s.Debug("triage rule applied to buried job", "rule", rule.Name, "action", rule.Action, "key", key)
+
+	switch rule.Action {
+	case TriageActionRetryRAM, TriageActionRetryHost:
+		s.kickJobs([]string{key}, nil, "triage rule "+rule.Name)
+	default:
+		s.db.updateJobAfterChange(job)
+	}
+
+	if rule.Webhook != "" {
+		s.notifyTriage(rule, job, exitcode)
+	}
+}
+
+// notifyTriage POSTs a TriageNotification about the given job to the given
+// rule's Webhook, in the background.
+func (s *Server) notifyTriage(rule *TriageRule, job *Job, exitcode int) {
+	job.RLock()
+	tn := &TriageNotification{
+		Rule:       rule.Name,
+		Action:     rule.Action,
+		RepGroup:   job.RepGroup,
+		Key:        job.Key(),
+		Cmd:        job.Cmd,
+		Host:       job.Host,
+		Exitcode:   exitcode,
+		FailReason: job.FailReason,
+		Time:       time.Now(),
+	}
+	job.RUnlock()
+	body, err := json.Marshal(tn)
+	if err != nil {
+		s.Warn("failed to encode triage notification", "err", err)
+		return
+	}
+
+	go func() {
+		defer internal.LogPanic(s.Logger, "triage notification", false)
+		client := &http.Client{Timeout: TriageNotifyTimeout}
+		resp, errp := client.Post(rule.Webhook, "application/json", bytes.NewReader(body))
+		if errp != nil {
+			s.Warn("triage notification failed", "rule", rule.Name, "url", rule.Webhook, "err", errp)
+			return
+		}
+		resp.Body.Close() // #nosec nothing useful to do if closing fails
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			s.Warn("triage notification was not accepted", "rule", rule.Name, "url", rule.Webhook, "status", resp.Status)
+		}
+	}()
+}
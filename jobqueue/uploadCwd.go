@@ -0,0 +1,197 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the implementation of the UploadCwd behaviour.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// uploadCwdDefaultMaxMB is the MaxMB of UploadCwdSpecs that don't specify one.
+const uploadCwdDefaultMaxMB = 100
+
+// uploadCwdSkippedFile is the name of the file UploadCwd Behaviours create to
+// list the files they skipped due to MaxMB.
+const uploadCwdSkippedFile = ".wr_upload_skipped"
+
+// UploadCwdSpec describes what an UploadCwd Behaviour should upload, and where.
+type UploadCwdSpec struct {
+	// Dest is the directory the files should be copied to, typically within a
+	// writable mount of the Job. Relative paths are relative to the Job's
+	// actual cwd. Files will be placed in a sub-directory named after the
+	// Job's key, so that multiple Jobs can share the same Dest.
+	Dest string `json:"dest"`
+
+	// MaxMB is the maximum total size of the files that will be copied; files
+	// that would take the total over this are skipped (and listed in a file
+	// named .wr_upload_skipped). Defaults to 100.
+	MaxMB int `json:"max_mb,omitempty"`
+
+	// Include are glob patterns (as per filepath.Match) that files must match
+	// (by name or by path relative to the actual cwd) to be copied. If none
+	// are supplied, all files are copied.
+	Include []string `json:"include,omitempty"`
+
+	// Exclude are glob patterns that stop matching files from being copied.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// String converts the spec to the string form needed for the Arg of an
+// UploadCwd Behaviour.
+func (u *UploadCwdSpec) String() string {
+	b, err := json.Marshal(u)
+	if err != nil {
+		panic(fmt.Sprintf("Encoding an UploadCwdSpec failed: %s", err))
+	}
+	return string(b)
+}
+
+// uploadCwdSpecFromArg converts the Arg of an UploadCwd Behaviour back to an
+// UploadCwdSpec.
+func uploadCwdSpecFromArg(arg interface{}) (*UploadCwdSpec, error) {
+	str, wasStr := arg.(string)
+	if !wasStr {
+		return nil, fmt.Errorf("arg %s is type %T, not string", arg, arg)
+	}
+	spec := &UploadCwdSpec{}
+	if err := json.Unmarshal([]byte(str), spec); err != nil {
+		return nil, fmt.Errorf("arg %s is not an UploadCwdSpec: %w", str, err)
+	}
+	if spec.Dest == "" {
+		return nil, fmt.Errorf("arg %s has no dest", str)
+	}
+	return spec, nil
+}
+
+// matches tells you if a file with the given path relative to the actual cwd
+// should be uploaded according to our Include and Exclude patterns.
+func (u *UploadCwdSpec) matches(rel string) bool {
+	match := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if m, _ := filepath.Match(pattern, rel); m {
+				return true
+			}
+			if m, _ := filepath.Match(pattern, filepath.Base(rel)); m {
+				return true
+			}
+		}
+		return false
+	}
+	if match(u.Exclude) {
+		return false
+	}
+	return len(u.Include) == 0 || match(u.Include)
+}
+
+// uploadCwd copies the files in the Job's actual cwd that match the
+// UploadCwdSpec in our Arg to its Dest, skipping any mounted directories.
+func (b *Behaviour) uploadCwd(j *Job) error {
+	spec, err := uploadCwdSpecFromArg(b.Arg)
+	if err != nil {
+		return err
+	}
+
+	cwd := j.ActualCwd
+	if cwd == "" {
+		cwd = j.Cwd
+	}
+
+	dest := spec.Dest
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(cwd, dest)
+	}
+
+	// we don't want to upload the dest to itself, or read through any other
+	// mounts
+	skipDirs := map[string]bool{dest: true}
+	for _, mc := range j.MountConfigs {
+		if mc.Mount == "" {
+			continue
+		}
+		mount := mc.Mount
+		if !filepath.IsAbs(mount) {
+			mount = filepath.Join(cwd, mount)
+		}
+		skipDirs[mount] = true
+	}
+
+	maxBytes := int64(spec.MaxMB)
+	if maxBytes <= 0 {
+		maxBytes = uploadCwdDefaultMaxMB
+	}
+	maxBytes *= 1024 * 1024
+
+	dest = filepath.Join(dest, j.Key())
+	var total int64
+	var skipped []string
+	err = filepath.Walk(cwd, func(path string, info os.FileInfo, errw error) error {
+		if errw != nil {
+			return errw
+		}
+		if info.IsDir() {
+			if skipDirs[path] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, errr := filepath.Rel(cwd, path)
+		if errr != nil {
+			return errr
+		}
+		if !spec.matches(rel) {
+			return nil
+		}
+		if total+info.Size() > maxBytes {
+			skipped = append(skipped, rel)
+			return nil
+		}
+		total += info.Size()
+
+		target := filepath.Join(dest, rel)
+		if errm := os.MkdirAll(filepath.Dir(target), os.ModePerm); errm != nil {
+			return errm
+		}
+		return copyFile(path, target)
+	})
+	if err != nil {
+		return fmt.Errorf("upload_cwd behaviour failed: %w", err)
+	}
+
+	if len(skipped) == 0 {
+		return nil
+	}
+
+	// note what we didn't upload, so the user knows they exist
+	if err = os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+	note := fmt.Sprintf("files skipped because they would take the upload over %dMB:\n%s\n",
+		maxBytes/1024/1024, strings.Join(skipped, "\n"))
+	return ioutil.WriteFile(filepath.Join(dest, uploadCwdSkippedFile), []byte(note), 0600)
+}
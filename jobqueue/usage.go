@@ -0,0 +1,234 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for accounting the resources consumed by each
+// user and RepGroup, for chargeback and quota discussions.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// usageMonthFormat is the format of UsageRecord.Month.
+const usageMonthFormat = "2006-01"
+
+// UsageRecord is the monthly rollup of the resources consumed by the jobs of a
+// single user or RepGroup. Every run of a job counts, including those that
+// failed, since they consumed resources too.
+type UsageRecord struct {
+	Month     string  // the calendar month (UTC) in the form 2006-01
+	User      string  // the user the record is for, if it is a per-user record
+	RepGroup  string  // the RepGroup the record is for, if it is a per-RepGroup record
+	Runs      int     // the number of job runs that ended
+	CoreHours float64 // cores reserved multiplied by hours run
+	RAMHours  float64 // RAM (GB) reserved multiplied by hours run
+	Cost      float64 // CoreHours at the ServerConfig.CostPerCoreHour of the time
+}
+
+// key returns the database key for this record, which sorts by Month.
+func (u *UsageRecord) key() string {
+	if u.User != "" {
+		return u.Month + "\x00u\x00" + u.User
+	}
+	return u.Month + "\x00r\x00" + u.RepGroup
+}
+
+// add adds the consumption in the given record to ours.
+func (u *UsageRecord) add(other *UsageRecord) {
+	u.Runs += other.Runs
+	u.CoreHours += other.CoreHours
+	u.RAMHours += other.RAMHours
+	u.Cost += other.Cost
+}
+
+// noteUsage is subscribed to all our queue's changes, and accounts the
+// resources consumed by each job that stops running, for its user and
+// RepGroup. The records are held in memory until flushUsage().
+func (s *Server) noteUsage(from, to queue.SubQueue, data []interface{}) {
+	if from != queue.SubQueueRun || to == queue.SubQueueRun {
+		return
+	}
+
+	s.tmutex.RLock()
+	costPerCoreHour := s.costPerCoreHour
+	s.tmutex.RUnlock()
+
+	now := time.Now()
+	month := now.UTC().Format(usageMonthFormat)
+	var records []*UsageRecord
+	for _, inter := range data {
+		job, ok := inter.(*Job)
+		if !ok {
+			continue
+		}
+		job.RLock()
+		if job.StartTime.IsZero() || job.Requirements == nil {
+			job.RUnlock()
+			continue
+		}
+		end := job.EndTime
+		if end.Before(job.StartTime) {
+			end = now
+		}
+		hours := end.Sub(job.StartTime).Hours()
+		consumed := UsageRecord{
+			Month:     month,
+			Runs:      1,
+			CoreHours: job.Requirements.Cores * hours,
+			RAMHours:  float64(job.Requirements.RAM) / 1024 * hours,
+		}
+		consumed.Cost = consumed.CoreHours * costPerCoreHour
+		user, repGroup := job.User, job.RepGroup
+		job.RUnlock()
+
+		if user != "" {
+			byUser := consumed
+			byUser.User = user
+			records = append(records, &byUser)
+		}
+		byRepGroup := consumed
+		byRepGroup.RepGroup = repGroup
+		records = append(records, &byRepGroup)
+	}
+
+	if len(records) == 0 {
+		return
+	}
+
+	s.umutex.Lock()
+	defer s.umutex.Unlock()
+	if s.pendingUsage == nil {
+		s.pendingUsage = make(map[string]*UsageRecord)
+	}
+	for _, record := range records {
+		key := record.key()
+		if pending, exists := s.pendingUsage[key]; exists {
+			pending.add(record)
+		} else {
+			s.pendingUsage[key] = record
+		}
+	}
+}
+
+// flushUsage adds the usage accounted by noteUsage() since the last flush to
+// the monthly rollups in our database.
+func (s *Server) flushUsage() error {
+	s.umutex.Lock()
+	defer s.umutex.Unlock()
+	if len(s.pendingUsage) == 0 {
+		return nil
+	}
+
+	records := make([]*UsageRecord, 0, len(s.pendingUsage))
+	for _, record := range s.pendingUsage {
+		records = append(records, record)
+	}
+	err := s.db.addUsage(records)
+	if err != nil {
+		return err
+	}
+	s.pendingUsage = nil
+	return nil
+}
+
+// usageRecorder periodically does flushUsage(), until we stop.
+func (s *Server) usageRecorder() {
+	defer internal.LogPanic(s.Logger, "jobqueue usage recorder", true)
+
+	ticker := time.NewTicker(ServerUsageFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ssmutex.RLock()
+		up := s.up
+		s.ssmutex.RUnlock()
+		if !up {
+			return
+		}
+
+		if err := s.flushUsage(); err != nil {
+			s.Warn("failed to store usage", "err", err)
+		}
+	}
+}
+
+// getUsage returns the monthly usage records for the months from the one
+// containing from to the one containing to (a zero to means now), ordered by
+// month.
+func (s *Server) getUsage(from, to time.Time) ([]*UsageRecord, string, error) {
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if to.Before(from) {
+		return nil, ErrBadRequest, fmt.Errorf("end time %s is before start time %s", to, from)
+	}
+
+	if err := s.flushUsage(); err != nil {
+		return nil, ErrDBError, err
+	}
+	records, err := s.db.retrieveUsage(from.UTC().Format(usageMonthFormat), to.UTC().Format(usageMonthFormat))
+	if err != nil {
+		return nil, ErrDBError, err
+	}
+	return records, "", nil
+}
+
+// usageInNamespace returns the per-RepGroup records of the given records that
+// are for RepGroups in the given namespace, with their RepGroups unqualified.
+// (Users are not namespaced, so per-user records are not returned.)
+func usageInNamespace(records []*UsageRecord, namespace string) []*UsageRecord {
+	prefix := namespace + namespaceSeparator
+	filtered := make([]*UsageRecord, 0, len(records))
+	for _, record := range records {
+		if record.RepGroup == "" || !strings.HasPrefix(record.RepGroup, prefix) {
+			continue
+		}
+		r := *record
+		r.RepGroup = unnamespaced(namespace, r.RepGroup)
+		filtered = append(filtered, &r)
+	}
+	return filtered
+}
+
+// GetUsage gets the monthly rollups of the resources consumed by the jobs of
+// each user and each RepGroup, for the months from the one containing from to
+// the one containing to (a zero to means now). Each UsageRecord has either
+// User or RepGroup set, and they are ordered by Month.
+//
+// Usage is accounted every time a job stops running, based on the cores and
+// RAM it reserved and how long it ran for. Cost is only calculated if the
+// server has a CostPerCoreHour.
+func (c *Client) GetUsage(from, to time.Time) ([]*UsageRecord, error) {
+	return c.GetUsageContext(context.Background(), from, to)
+}
+
+// GetUsageContext is like GetUsage(), but stops waiting for the server and
+// returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetUsageContext(ctx context.Context, from, to time.Time) ([]*UsageRecord, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getusage", From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Usage, err
+}
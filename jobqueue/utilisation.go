@@ -0,0 +1,168 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for recording the history of queue depths and
+// resource utilisation, for capacity planning.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// UtilisationSnapshot records the state of the queue and the capacity
+// provisioned to run its jobs at a moment in time.
+type UtilisationSnapshot struct {
+	Time      time.Time
+	Delayed   int // jobs waiting following a possibly transient error
+	Ready     int // jobs ready to begin running
+	Running   int // jobs currently running
+	Buried    int // jobs that failed and won't be retried
+	Dependent int // jobs waiting on other jobs to complete
+	Pending   int // runners we want the job scheduler to run
+
+	// CoresUsed and RAMUsed (MB) are the sum of the requirements of the
+	// Running jobs.
+	CoresUsed float64
+	RAMUsed   int
+
+	// Hosts, Cores and RAM (MB) describe the machines the job scheduler knows
+	// about, ie. the provisioned capacity. They are 0 for schedulers that
+	// manage their own hosts (like LSF).
+	Hosts int
+	Cores float64
+	RAM   int
+}
+
+// utilisationKey returns the database key for a snapshot taken at the given
+// time, which sorts in time order. Times before 1970 are treated as 1970.
+func utilisationKey(t time.Time) []byte {
+	secs := t.Unix()
+	if secs < 0 {
+		secs = 0
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(secs))
+	return key
+}
+
+// downsampleUtilisation returns the last snapshot in each step-long period of
+// the given time-ordered snapshots. A step of 0 returns them all.
+func downsampleUtilisation(snaps []*UtilisationSnapshot, step time.Duration) []*UtilisationSnapshot {
+	if step <= 0 || len(snaps) == 0 {
+		return snaps
+	}
+	var sampled []*UtilisationSnapshot
+	var period time.Time
+	for _, snap := range snaps {
+		p := snap.Time.Truncate(step)
+		if len(sampled) > 0 && p.Equal(period) {
+			sampled[len(sampled)-1] = snap
+			continue
+		}
+		period = p
+		sampled = append(sampled, snap)
+	}
+	return sampled
+}
+
+// utilisationSnapshot captures the current state of the queue and provisioned
+// capacity.
+func (s *Server) utilisationSnapshot() *UtilisationSnapshot {
+	stats := s.q.Stats()
+	snap := &UtilisationSnapshot{
+		Time:      time.Now(),
+		Delayed:   stats.Delayed,
+		Ready:     stats.Ready,
+		Running:   stats.Running,
+		Buried:    stats.Buried,
+		Dependent: stats.Dependant,
+	}
+
+	for _, inter := range s.q.GetRunningData() {
+		job := inter.(*Job)
+		job.RLock()
+		if job.Requirements != nil {
+			snap.CoresUsed += job.Requirements.Cores
+			snap.RAMUsed += job.Requirements.RAM
+		}
+		job.RUnlock()
+	}
+
+	s.sgcmutex.Lock()
+	for _, count := range s.sgroupcounts {
+		snap.Pending += count
+	}
+	s.sgcmutex.Unlock()
+
+	for _, host := range s.scheduler.Hosts() {
+		snap.Hosts++
+		snap.Cores += host.Cores
+		snap.RAM += host.RAM
+	}
+
+	return snap
+}
+
+// utilisationRecorder periodically stores a utilisationSnapshot() and forgets
+// those older than ServerUtilisationRetention, until we stop.
+func (s *Server) utilisationRecorder() {
+	defer internal.LogPanic(s.Logger, "jobqueue utilisation recorder", true)
+
+	ticker := time.NewTicker(ServerUtilisationInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ssmutex.RLock()
+		up := s.up
+		s.ssmutex.RUnlock()
+		if !up {
+			return
+		}
+
+		snap := s.utilisationSnapshot()
+		if err := s.db.storeUtilisation(snap); err != nil {
+			s.Warn("failed to store utilisation snapshot", "err", err)
+		}
+		if err := s.db.pruneUtilisation(snap.Time.Add(-ServerUtilisationRetention)); err != nil {
+			s.Warn("failed to prune utilisation snapshots", "err", err)
+		}
+	}
+}
+
+// getUtilisation returns the stored snapshots taken between from and to
+// (inclusive; a zero to means now), downsampled to one per step.
+func (s *Server) getUtilisation(from, to time.Time, step time.Duration) ([]*UtilisationSnapshot, string, error) {
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if to.Before(from) {
+		return nil, ErrBadRequest, fmt.Errorf("end time %s is before start time %s", to, from)
+	}
+	if step < 0 {
+		return nil, ErrBadRequest, fmt.Errorf("step %s is negative", step)
+	}
+	snaps, err := s.db.retrieveUtilisation(from, to)
+	if err != nil {
+		return nil, ErrDBError, err
+	}
+	return downsampleUtilisation(snaps, step), "", nil
+}
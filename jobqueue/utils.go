@@ -35,6 +35,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
@@ -132,12 +134,41 @@ func copyFile(source string, dest string) error {
 // stdout, stderr and environment variables over the network, and for storing
 // of same on disk.
 func compress(data []byte) ([]byte, error) {
+	return compressLevel(data, zlib.BestCompression)
+}
+
+// compressFast is like compress(), but favours speed over size.
+func compressFast(data []byte) ([]byte, error) {
+	return compressLevel(data, zlib.BestSpeed)
+}
+
+// zlibWriters are pools of the zlib writers compressLevel() uses, by
+// compression level, since making a new one allocates a lot of memory, and we
+// compress every job we store.
+var zlibWriters = map[int]*sync.Pool{
+	zlib.BestSpeed:       {},
+	zlib.BestCompression: {},
+}
+
+// compressLevel uses zlib to compress stuff at the given compression level.
+func compressLevel(data []byte, level int) ([]byte, error) {
 	var compressed bytes.Buffer
-	w, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
-	if err != nil {
-		return nil, err
+	pool := zlibWriters[level]
+	var w *zlib.Writer
+	if pool != nil {
+		if pw, ok := pool.Get().(*zlib.Writer); ok {
+			w = pw
+			w.Reset(&compressed)
+		}
+	}
+	if w == nil {
+		var err error
+		w, err = zlib.NewWriterLevel(&compressed, level)
+		if err != nil {
+			return nil, err
+		}
 	}
-	_, err = w.Write(data)
+	_, err := w.Write(data)
 	if err != nil {
 		return nil, err
 	}
@@ -145,21 +176,45 @@ func compress(data []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if pool != nil {
+		pool.Put(w)
+	}
 	return compressed.Bytes(), nil
 }
 
-// decompress uses zlib to decompress stuff compressed by compress().
+// decompress uses zlib to decompress stuff compressed by compress(). Since what
+// we decompress typically came from a client request, we refuse to expand it to
+// more than wireMaxDecodedSize bytes.
 func decompress(compressed []byte) ([]byte, error) {
+	return decompressLimit(compressed, wireMaxDecodedSize)
+}
+
+// decompressUnlimited is like decompress(), but without the limit, for the
+// potentially larger things we get from the server or from files.
+func decompressUnlimited(compressed []byte) ([]byte, error) {
+	return decompressLimit(compressed, 0)
+}
+
+// decompressLimit is like decompress(), returning an error if the result would
+// be more than limit bytes. A limit of 0 means no limit.
+func decompressLimit(compressed []byte, limit int64) ([]byte, error) {
 	b := bytes.NewReader(compressed)
 	r, err := zlib.NewReader(b)
 	if err != nil {
 		return nil, err
 	}
+	var src io.Reader = r
+	if limit > 0 {
+		src = io.LimitReader(r, limit+1)
+	}
 	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(r)
+	_, err = buf.ReadFrom(src)
 	if err != nil {
 		return nil, err
 	}
+	if limit > 0 && int64(buf.Len()) > limit {
+		return nil, fmt.Errorf("data would decompress to more than the limit of %d bytes", limit)
+	}
 	return buf.Bytes(), err
 }
 
@@ -291,6 +346,27 @@ func getChildProcesses(pid int32) ([]*process.Process, error) {
 	return children, nil
 }
 
+// signalProcessTree sends the given signal to the process with the given pid
+// and all its child processes.
+func signalProcessTree(pid int, sig syscall.Signal) error {
+	children, err := getChildProcesses(int32(pid))
+
+	p, errf := os.FindProcess(pid)
+	if errf == nil {
+		errf = p.Signal(sig)
+	}
+	if errf != nil {
+		err = errf
+	}
+
+	for _, child := range children {
+		if errs := child.SendSignal(sig); errs != nil {
+			err = errs
+		}
+	}
+	return err
+}
+
 // this prefixSuffixSaver-related code is taken from os/exec, since they are not
 // exported. prefixSuffixSaver is an io.Writer which retains the first N bytes
 // and the last N bytes written to it. The Bytes() methods reconstructs it with
@@ -358,7 +434,9 @@ func minInt(a, b int) int {
 // terminated lines (to mostly eliminate progress bars), intended for use with
 // stdout/err streaming input, outputting to a prefixSuffixSaver. Because you
 // must finish reading from the input before continuing, it returns a channel
-// that you should wait to receive an error from (nil if everything workd).
+// that you should wait to receive an error from (nil if everything workd). If
+// out is an io.Closer (eg. a redactWriter), it is closed once all the input has
+// been read.
 func stdFilter(std io.Reader, out io.Writer) chan error {
 	reader := bufio.NewReader(std)
 	done := make(chan error)
@@ -397,6 +475,11 @@ func stdFilter(std io.Reader, out io.Writer) chan error {
 				break
 			}
 		}
+		if closer, ok := out.(io.Closer); ok {
+			if errc := closer.Close(); errc != nil {
+				merr = multierror.Append(merr, errc)
+			}
+		}
 		done <- merr.ErrorOrNil()
 	}()
 	return done
@@ -0,0 +1,437 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package validate lets you check job specifications offline, before submitting
+them to wr's manager, using the same rules that `wr add`, the REST API and the
+manager use, so that pipeline generators can find their mistakes up front.
+
+It is stricter than those, in that JSON with unknown keys (typically typos,
+which would otherwise be silently ignored) is considered invalid, as are
+behaviours that don't specify exactly one action. It also checks that the
+dependencies between the given specifications make sense: that no job depends
+on itself, directly or via a cycle, and that job names are unique.
+
+Specifications are supplied in the same format as `wr add` input: one per line,
+being either a cmd, a cmd and JSON object separated by a tab, or a JSON object
+with a "cmd" (or "steps") key. See `wr add -h` for the keys.
+
+	import "github.com/VertebrateResequencing/wr/jobqueue/validate"
+	jobs, problems := validate.Reader(reader, &jobqueue.JobDefaults{})
+	for _, p := range problems {
+	    fmt.Println(p)
+	}
+	// if problems was empty, jobs are ready to be jobqueue.Client.Add()ed
+
+There are also functions to validate individual parts of a specification, such
+as Memory(), Time(), MountsJSON() and BehavioursJSON().
+*/
+package validate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+)
+
+// MaxLineSize is the longest line Reader() can read.
+var MaxLineSize = 1024 * 1024 * 1024
+
+// Problem describes something wrong with a job specification.
+type Problem struct {
+	// Line is the line number of the specification, starting from 1.
+	Line int
+
+	// Err describes what is wrong.
+	Err error
+}
+
+// Error implements the error interface.
+func (p *Problem) Error() string {
+	return fmt.Sprintf("line %d: %s", p.Line, p.Err)
+}
+
+// Problems are the Problems found with a set of job specifications. It
+// implements the error interface, for when you only need to know if there were
+// any.
+type Problems []*Problem
+
+// Error implements the error interface.
+func (ps Problems) Error() string {
+	msgs := make([]string, len(ps))
+	for i, p := range ps {
+		msgs[i] = p.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Memory checks that a memory value (a number and unit suffix, eg. 1G) is
+// valid, returning it in Megabytes.
+func Memory(value string) (int, error) {
+	mb, err := bytefmt.ToMegabytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("memory value (%s) was not specified correctly: %s", value, err)
+	}
+	return int(mb), nil
+}
+
+// Time checks that a time value (a duration with a unit suffix, eg. 1h) is
+// valid and not negative.
+func Time(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("time value (%s) was not specified correctly: %s", value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("time value (%s) can't be negative", value)
+	}
+	return d, nil
+}
+
+// MountsJSON checks that the given JSON (in the format of `wr add
+// --mount_json`) describes valid MountConfigs, and returns them.
+func MountsJSON(data []byte) (jobqueue.MountConfigs, error) {
+	var mcs jobqueue.MountConfigs
+	if err := strictUnmarshal(data, &mcs); err != nil {
+		return nil, fmt.Errorf("bad mount JSON: %s", err)
+	}
+	if err := mcs.Validate(); err != nil {
+		return nil, err
+	}
+	return mcs, nil
+}
+
+// BehavioursJSON checks that the given JSON (in the format of `wr add
+// --on_failure`) describes valid Behaviours, and returns them.
+func BehavioursJSON(data []byte) (jobqueue.BehavioursViaJSON, error) {
+	var bjs jobqueue.BehavioursViaJSON
+	if err := strictUnmarshal(data, &bjs); err != nil {
+		return nil, fmt.Errorf("bad behaviour JSON: %s", err)
+	}
+	if err := Behaviours(bjs); err != nil {
+		return nil, err
+	}
+	return bjs, nil
+}
+
+// Behaviours checks that each of the given BehaviourViaJSON specifies exactly
+// one action, with acceptable Retries and upload_cwd, archive, checksum and
+// http_post options.
+func Behaviours(bjs jobqueue.BehavioursViaJSON) error {
+	for i, bj := range bjs {
+		var actions int
+		for _, set := range []bool{bj.Run != "", len(bj.CopyToManager) > 0, bj.UploadCwd != nil, len(bj.RecordOutputs) > 0, bj.Archive != nil, bj.Checksum != nil, bj.HTTPPost != nil, bj.Cleanup, bj.CleanupAll, bj.Nothing} {
+			if set {
+				actions++
+			}
+		}
+		if actions != 1 {
+			return fmt.Errorf("behaviour %d specifies %d actions instead of 1", i+1, actions)
+		}
+
+		if bj.Retries < 0 || bj.Retries > 255 {
+			return fmt.Errorf("behaviour %d retries (%d) is not in the range 0..255", i+1, bj.Retries)
+		}
+
+		if u := bj.UploadCwd; u != nil {
+			if u.Dest == "" {
+				return fmt.Errorf("behaviour %d upload_cwd has no dest", i+1)
+			}
+			if u.MaxMB < 0 {
+				return fmt.Errorf("behaviour %d upload_cwd max_mb can't be negative", i+1)
+			}
+			for _, pattern := range append(append([]string{}, u.Include...), u.Exclude...) {
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return fmt.Errorf("behaviour %d upload_cwd pattern [%s] is not valid: %s", i+1, pattern, err)
+				}
+			}
+		}
+
+		if a := bj.Archive; a != nil {
+			if a.Dest == "" {
+				return fmt.Errorf("behaviour %d archive has no dest", i+1)
+			}
+			switch a.Backend {
+			case "", jobqueue.MountBackendS3, jobqueue.MountBackendGCS, jobqueue.MountBackendAzure:
+			default:
+				return fmt.Errorf("behaviour %d archive backend [%s] is not known", i+1, a.Backend)
+			}
+		}
+
+		if c := bj.Checksum; c != nil {
+			if len(c.Files) == 0 {
+				return fmt.Errorf("behaviour %d checksum has no files", i+1)
+			}
+			switch c.Algorithm {
+			case "", jobqueue.ChecksumMD5, jobqueue.ChecksumSHA256:
+			default:
+				return fmt.Errorf("behaviour %d checksum algorithm [%s] is not known", i+1, c.Algorithm)
+			}
+		}
+
+		if h := bj.HTTPPost; h != nil {
+			u, err := url.Parse(h.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("behaviour %d http_post url [%s] is not a valid http(s) URL", i+1, h.URL)
+			}
+		}
+	}
+	return nil
+}
+
+// JSON checks that the given JSON object (as would be on a line of `wr add`
+// input) describes a valid job, and returns it converted to a Job, using the
+// given defaults for anything it doesn't specify.
+func JSON(data []byte, jd *jobqueue.JobDefaults) (*jobqueue.Job, error) {
+	var jvj jobqueue.JobViaJSON
+	if err := strictUnmarshal(data, &jvj); err != nil {
+		return nil, fmt.Errorf("bad JSON: %s", err)
+	}
+	return JobViaJSON(&jvj, jd)
+}
+
+// JobViaJSON checks that the given JobViaJSON is valid, and returns it
+// converted to a Job, using the given defaults for anything it doesn't
+// specify.
+func JobViaJSON(jvj *jobqueue.JobViaJSON, jd *jobqueue.JobDefaults) (*jobqueue.Job, error) {
+	if jvj.CPUs != nil && *jvj.CPUs < 0 {
+		return nil, fmt.Errorf("cpus can't be negative")
+	}
+	if jvj.Disk != nil && *jvj.Disk < 0 {
+		return nil, fmt.Errorf("disk can't be negative")
+	}
+	if jvj.Time != "" {
+		if _, err := Time(jvj.Time); err != nil {
+			return nil, err
+		}
+	}
+	all := []jobqueue.BehavioursViaJSON{jvj.OnFailure, jvj.OnSuccess, jvj.OnExit}
+	for _, bjs := range jvj.OnExitCode {
+		all = append(all, bjs)
+	}
+	for _, bjs := range jvj.OnFailReason {
+		all = append(all, bjs)
+	}
+	for _, bjs := range all {
+		if err := Behaviours(bjs); err != nil {
+			return nil, err
+		}
+	}
+
+	job, err := jvj.Convert(jd)
+	if err != nil {
+		return nil, err
+	}
+	if err = job.Validate(); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Dependencies checks that the dependencies between the given Jobs make sense:
+// that none depends on itself, directly or via a cycle of other Jobs, and that
+// no two Jobs have the same Name. Dependencies on Jobs not in the given set
+// can't be checked offline, and are assumed to be fine. It returns a Problem
+// for each bad Job, with Line being the Job's index in the slice plus 1.
+func Dependencies(jobs []*jobqueue.Job) Problems {
+	var problems Problems
+	byKey := make(map[string]int)
+	byName := make(map[string]int)
+	byDepGroup := make(map[string][]int)
+	for i, job := range jobs {
+		byKey[job.Key()] = i
+		if job.Name != "" {
+			if first, exists := byName[job.Name]; exists {
+				problems = append(problems, &Problem{Line: i + 1, Err: fmt.Errorf("job name [%s] was already used on line %d", job.Name, first+1)})
+			} else {
+				byName[job.Name] = i
+			}
+		}
+		for _, dg := range job.DepGroups {
+			byDepGroup[dg] = append(byDepGroup[dg], i)
+		}
+	}
+
+	// work out which jobs in the set each job depends on
+	edges := make([][]int, len(jobs))
+	for i, job := range jobs {
+		for _, dep := range job.Dependencies {
+			switch {
+			case dep.DepGroup != "":
+				edges[i] = append(edges[i], byDepGroup[dep.DepGroup]...)
+			case dep.Essence != nil:
+				if dep.Essence.JobKey != "" {
+					if j, exists := byName[dep.Essence.JobKey]; exists {
+						edges[i] = append(edges[i], j)
+						continue
+					}
+				}
+				if j, exists := byKey[dep.Essence.Key()]; exists {
+					edges[i] = append(edges[i], j)
+				}
+			}
+		}
+	}
+
+	// find the jobs that are in a cycle with a depth-first search, noting the
+	// first job in each cycle found
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(jobs))
+	inCycle := make([]bool, len(jobs))
+	var visit func(i int, path []int)
+	visit = func(i int, path []int) {
+		state[i] = visiting
+		path = append(path, i)
+		for _, j := range edges[i] {
+			switch state[j] {
+			case visiting:
+				for k := len(path) - 1; k >= 0; k-- {
+					inCycle[path[k]] = true
+					if path[k] == j {
+						break
+					}
+				}
+			case unvisited:
+				visit(j, path)
+			}
+		}
+		state[i] = done
+	}
+	for i := range jobs {
+		if state[i] == unvisited {
+			visit(i, nil)
+		}
+	}
+
+	for i := range jobs {
+		if !inCycle[i] {
+			continue
+		}
+		err := fmt.Errorf("job depends on itself via a cycle of dependencies")
+		for _, j := range edges[i] {
+			if j == i {
+				err = fmt.Errorf("job depends on itself")
+				break
+			}
+		}
+		problems = append(problems, &Problem{Line: i + 1, Err: err})
+	}
+
+	return problems
+}
+
+// Reader reads job specifications in `wr add` format from the given reader and
+// checks they're valid, individually and in their dependencies on each other.
+// It returns the valid ones converted to Jobs (using the given defaults for
+// anything they don't specify), and any Problems, sorted by Line.
+func Reader(r io.Reader, jd *jobqueue.JobDefaults) ([]*jobqueue.Job, Problems) {
+	var jobs []*jobqueue.Job
+	var lines []int
+	var problems Problems
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MaxLineSize)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		job, err := line(scanner.Text(), jd)
+		if err != nil {
+			problems = append(problems, &Problem{Line: lineNum, Err: err})
+			continue
+		}
+		if job == nil {
+			continue
+		}
+		jobs = append(jobs, job)
+		lines = append(lines, lineNum)
+	}
+	if err := scanner.Err(); err != nil {
+		problems = append(problems, &Problem{Line: lineNum + 1, Err: fmt.Errorf("failed to read: %s", err)})
+	}
+
+	for _, p := range Dependencies(jobs) {
+		p.Line = lines[p.Line-1]
+		problems = append(problems, p)
+	}
+	sortProblems(problems)
+
+	return jobs, problems
+}
+
+// line parses and checks a single line of `wr add` input, returning a nil Job
+// for blank lines.
+func line(text string, jd *jobqueue.JobDefaults) (*jobqueue.Job, error) {
+	cols := strings.Split(text, "\t")
+	if cols[0] == "" {
+		return nil, nil
+	}
+	if len(cols) > 2 {
+		return nil, fmt.Errorf("too many columns")
+	}
+
+	if len(cols) == 2 {
+		var jvj jobqueue.JobViaJSON
+		if err := strictUnmarshal([]byte(cols[1]), &jvj); err != nil {
+			return nil, fmt.Errorf("bad JSON: %s", err)
+		}
+		jvj.Cmd = cols[0]
+		return JobViaJSON(&jvj, jd)
+	}
+
+	if strings.HasPrefix(cols[0], "{") {
+		return JSON([]byte(cols[0]), jd)
+	}
+
+	return JobViaJSON(&jobqueue.JobViaJSON{Cmd: cols[0]}, jd)
+}
+
+// sortProblems sorts Problems by Line, keeping the order of Problems on the
+// same Line.
+func sortProblems(problems Problems) {
+	for i := 1; i < len(problems); i++ {
+		for j := i; j > 0 && problems[j].Line < problems[j-1].Line; j-- {
+			problems[j], problems[j-1] = problems[j-1], problems[j]
+		}
+	}
+}
+
+// strictUnmarshal is like json.Unmarshal, but fails on unknown keys and
+// trailing data.
+func strictUnmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after the JSON")
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package validate
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidate(t *testing.T) {
+	jd := &jobqueue.JobDefaults{}
+
+	Convey("Parts of job specifications can be validated", t, func() {
+		mb, err := Memory("2G")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 2048)
+		_, err = Memory("lots")
+		So(err, ShouldNotBeNil)
+
+		d, err := Time("90m")
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, 90*time.Minute)
+		_, err = Time("1 hour")
+		So(err, ShouldNotBeNil)
+		_, err = Time("-1h")
+		So(err, ShouldNotBeNil)
+
+		mcs, err := MountsJSON([]byte(`[{"Mount":"in","Targets":[{"Path":"bucket/a"},{"Path":"bucket/b","Write":true}]}]`))
+		So(err, ShouldBeNil)
+		So(len(mcs), ShouldEqual, 1)
+		So(len(mcs[0].Targets), ShouldEqual, 2)
+		_, err = MountsJSON([]byte(`[{"Targets":[{"Pth":"bucket"}]}]`))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unknown field")
+		_, err = MountsJSON([]byte(`[{"Targets":[]}]`))
+		So(err, ShouldNotBeNil)
+		_, err = MountsJSON([]byte(`[{"Targets":[{"Path":""}]}]`))
+		So(err, ShouldNotBeNil)
+		_, err = MountsJSON([]byte(`[{"Targets":[{"Path":"a","Write":true},{"Path":"b","Write":true}]}]`))
+		So(err, ShouldNotBeNil)
+		_, err = MountsJSON([]byte(`[{"Targets":[{"Path":"a"}]},{"Targets":[{"Path":"b"}]}]`))
+		So(err, ShouldNotBeNil)
+
+		bjs, err := BehavioursJSON([]byte(`[{"run":"echo hi","retries":3},{"cleanup":true}]`))
+		So(err, ShouldBeNil)
+		So(len(bjs), ShouldEqual, 2)
+		_, err = BehavioursJSON([]byte(`[{"clean":true}]`))
+		So(err, ShouldNotBeNil)
+		_, err = BehavioursJSON([]byte(`[{"retries":3}]`))
+		So(err, ShouldNotBeNil)
+		_, err = BehavioursJSON([]byte(`[{"run":"echo hi","cleanup":true}]`))
+		So(err, ShouldNotBeNil)
+		_, err = BehavioursJSON([]byte(`[{"run":"echo hi","retries":256}]`))
+		So(err, ShouldNotBeNil)
+		_, err = BehavioursJSON([]byte(`[{"upload_cwd":{"dest":"out","include":["["]}}]`))
+		So(err, ShouldNotBeNil)
+		_, err = BehavioursJSON([]byte(`[{"upload_cwd":{"include":["*.log"]}}]`))
+		So(err, ShouldNotBeNil)
+		bjs, err = BehavioursJSON([]byte(`[{"record_outputs":["*.bam"]},{"checksum":{"files":["*.bam"],"algorithm":"sha256"}},{"archive":{"dest":"bucket/results"}},{"http_post":{"url":"https://example.com/done"}}]`))
+		So(err, ShouldBeNil)
+		So(len(bjs), ShouldEqual, 4)
+		for _, bad := range []string{
+			`[{"archive":{"files":["*.bam"]}}]`,
+			`[{"archive":{"dest":"bucket","backend":"ftp"}}]`,
+			`[{"checksum":{"algorithm":"md5"}}]`,
+			`[{"checksum":{"files":["*.bam"],"algorithm":"crc"}}]`,
+			`[{"http_post":{"url":"example.com"}}]`,
+			`[{"http_post":{"url":"ftp://example.com"}}]`,
+		} {
+			_, err = BehavioursJSON([]byte(bad))
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Job specifications can be validated and converted", t, func() {
+		job, err := JSON([]byte(`{"cmd":"echo a","memory":"1G","time":"1h","name":"a","limit_grps":["l:5","m*2"]}`), jd)
+		So(err, ShouldBeNil)
+		So(job.Cmd, ShouldEqual, "echo a")
+		So(job.Requirements.RAM, ShouldEqual, 1024)
+		So(job.Name, ShouldEqual, "a")
+
+		for _, bad := range []string{
+			`{"cmd":"echo a","memroy":"1G"}`,
+			`{"cmd":"echo a"} {}`,
+			`{"memory":"1G"}`,
+			`{"cmd":"echo a","memory":"1Q"}`,
+			`{"cmd":"echo a","time":"-1h"}`,
+			`{"cmd":"echo a","cpus":-1}`,
+			`{"cmd":"echo a","disk":-1}`,
+			`{"cmd":"echo a","priority":256}`,
+			`{"cmd":"echo a","name":"has space"}`,
+			`{"cmd":"echo a","metadata":[1]}`,
+			`{"cmd":"echo a","limit_grps":["l:x"]}`,
+			`{"cmd":"echo a","limit_grps":["l*0"]}`,
+			`{"cmd":"echo a","on_failure":[{}]}`,
+			`{"cmd":"echo a","on_exit_code":{"3":[{}]}}`,
+			`{"cmd":"echo a","on_failreason":{"ran out of time":[{"checksum":{}}]}}`,
+			`{"cmd":"echo a","mounts":[{"Targets":[]}]}`,
+		} {
+			_, err = JSON([]byte(bad), jd)
+			So(err, ShouldNotBeNil)
+		}
+
+		So((&jobqueue.Job{Cmd: "echo a", RunWindow: "sometimes"}).Validate(), ShouldNotBeNil)
+	})
+
+	Convey("Dependencies between jobs are checked for cycles and duplicate names", t, func() {
+		input := strings.Join([]string{
+			`{"cmd":"echo 1","dep_grps":["a"]}`,
+			`echo 2	{"dep_grps":["b"],"deps":["a"],"name":"two"}`,
+			``,
+			`{"cmd":"echo 3","dep_grps":["c"],"deps":["d"]}`,
+			`{"cmd":"echo 4","dep_grps":["d"],"deps":["c"]}`,
+			`{"cmd":"echo 5","dep_grps":["e"],"deps":["e"]}`,
+			`{"cmd":"echo 6","name":"two"}`,
+			`{"cmd":"echo 7","name_deps":["two","elsewhere"],"cmd_deps":[{"Essence":{"Cmd":"echo 1"}}]}`,
+			`echo 8	{"bad":true}	{}`,
+			`echo 9`,
+		}, "\n")
+		jobs, problems := Reader(strings.NewReader(input), jd)
+		So(len(jobs), ShouldEqual, 8)
+		So(len(problems), ShouldEqual, 5)
+		So(problems[0].Line, ShouldEqual, 4)
+		So(problems[0].Err.Error(), ShouldContainSubstring, "via a cycle")
+		So(problems[1].Line, ShouldEqual, 5)
+		So(problems[2].Line, ShouldEqual, 6)
+		So(problems[2].Err.Error(), ShouldEqual, "job depends on itself")
+		So(problems[3].Line, ShouldEqual, 7)
+		So(problems[3].Err.Error(), ShouldContainSubstring, "already used on line 2")
+		So(problems[4].Line, ShouldEqual, 9)
+		So(problems[4].Err.Error(), ShouldEqual, "too many columns")
+		So(problems.Error(), ShouldStartWith, "line 4: ")
+
+		_, problems = Reader(strings.NewReader("echo 1\necho 2\n"), jd)
+		So(problems, ShouldBeEmpty)
+	})
+}
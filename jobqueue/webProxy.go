@@ -0,0 +1,207 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets the web server run behind reverse
+// proxies, under a URL prefix, and be used from other origins (CORS).
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// corsAllowedMethods and corsAllowedHeaders are what we tell browsers other
+// origins may use when calling our REST API.
+const (
+	corsAllowedMethods = "GET, POST, DELETE, OPTIONS"
+	corsAllowedHeaders = "Authorization, Content-Type"
+)
+
+// statusBaseTag is the <base> tag in status.html, which we rewrite to include
+// any configured URL prefix, so that its relative links work.
+const statusBaseTag = `<base href="/">`
+
+// webConfig holds our settings for being proxied and CORS.
+type webConfig struct {
+	prefix         string
+	corsOrigins    map[string]bool
+	corsAnyOrigin  bool
+	trustedProxies []*net.IPNet
+}
+
+// newWebConfig validates and normalises the given settings. The prefix is made
+// to start with a single / and not end with one (the empty string meaning no
+// prefix), blank values are ignored, and trustedProxies must be CIDRs.
+func newWebConfig(prefix string, corsOrigins, trustedProxies []string) (*webConfig, error) {
+	wc := &webConfig{corsOrigins: make(map[string]bool)}
+
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		wc.prefix = "/" + prefix
+	}
+
+	for _, origin := range corsOrigins {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		switch origin {
+		case "":
+			continue
+		case "*":
+			wc.corsAnyOrigin = true
+		default:
+			wc.corsOrigins[origin] = true
+		}
+	}
+
+	for _, cidr := range trustedProxies {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		wc.trustedProxies = append(wc.trustedProxies, ipnet)
+	}
+
+	return wc, nil
+}
+
+// trusted tells you if the given IP address is one of our trusted proxies.
+func (wc *webConfig) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range wc.trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// originAllowed tells you if a browser on a page from the given origin may
+// use our REST API and status websocket.
+func (wc *webConfig) originAllowed(origin string) bool {
+	return wc.corsAnyOrigin || wc.corsOrigins[origin]
+}
+
+// webConfig returns our current webConfig.
+func (s *Server) webConfig() *webConfig {
+	s.tmutex.RLock()
+	defer s.tmutex.RUnlock()
+	return s.web
+}
+
+// webHandler wraps the given handler so that requests are first altered to
+// undo the effects of any trusted reverse proxy they came through, have our URL
+// prefix removed, and get CORS headers.
+func (s *Server) webHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wc := s.webConfig()
+		wc.unproxy(r)
+
+		if wc.prefix != "" {
+			if r.URL.Path == wc.prefix {
+				http.Redirect(w, r, wc.prefix+"/", http.StatusMovedPermanently)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, wc.prefix+"/") {
+				r.URL.Path = strings.TrimPrefix(r.URL.Path, wc.prefix)
+				r.URL.RawPath = ""
+			}
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" && wc.originAllowed(origin) {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				// preflight requests don't include credentials, so we answer
+				// them without authorization
+				h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unproxy alters requests that came via one of our trusted proxies so that
+// RemoteAddr, Host and TLS-ness are what the proxy received from the real
+// client, as described by its X-Forwarded-* headers.
+func (wc *webConfig) unproxy(r *http.Request) {
+	if !wc.trusted(addrIP(r.RemoteAddr)) {
+		return
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		// the client is the right-most address that isn't one of our proxies
+		ips := strings.Split(xff, ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(ips[i]))
+			if ip == nil {
+				break
+			}
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+			if !wc.trusted(ip) {
+				break
+			}
+		}
+	}
+
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		r.Host = strings.TrimSpace(strings.Split(host, ",")[0])
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		r.URL.Scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+}
+
+// checkOrigin is a websocket.Upgrader CheckOrigin function that accepts
+// connections from pages we served (taking proxies in to account) and from
+// allowed CORS origins.
+func (wc *webConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if wc.originAllowed(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// statusPage returns the given status.html content with its base tag set to
+// our prefix.
+func (wc *webConfig) statusPage(doc []byte) []byte {
+	if wc.prefix == "" {
+		return doc
+	}
+	return []byte(strings.Replace(string(doc), statusBaseTag, `<base href="`+wc.prefix+`/">`, 1))
+}
@@ -0,0 +1,187 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for compressing the messages sent between
+// clients and the server.
+//
+// During Connect(), clients tell the server which compression algorithms they
+// support, and the server picks one. Afterwards, client requests are framed
+// with a header that says which algorithm the client wants responses in, and
+// which algorithm (if any) compressed the request body. Unframed messages are
+// plain binc encodings, which never start with a nil byte, so clients and
+// servers that don't know about compression still work with those that do.
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+// WireCompression* are the names of the algorithms that can be used to
+// compress messages between clients and the server.
+const (
+	WireCompressionZstd   = "zstd"
+	WireCompressionSnappy = "snappy"
+)
+
+// ClientWireCompression lists the compression algorithms, in order of
+// preference, that Connect() offers the server. The first one the server also
+// supports will be used for messages that are big enough to benefit. Set this
+// to nil before calling Connect() to disable compression.
+var ClientWireCompression = []string{WireCompressionZstd, WireCompressionSnappy}
+
+// wireCompressionMinSize is the size in bytes below which we don't bother
+// compressing a message.
+var wireCompressionMinSize = 1024
+
+// wireMaxDecodedSize is the largest request a client will send, and the most
+// bytes we'll let a compressed request, or the compressed jobs, environment
+// variables or files within it, expand to, so that a small malicious message
+// can't make us allocate lots of memory (we decompress before checking the
+// sender's token). A batch of ClientAddBatchSize jobs is far smaller than this.
+const wireMaxDecodedSize = 64 * 1024 * 1024
+
+const wireFrameMarker = 0x00
+
+var (
+	wireAlgorithmIDs = map[string]byte{
+		WireCompressionZstd:   'z',
+		WireCompressionSnappy: 's',
+	}
+	zstdEncoder     *zstd.Encoder
+	zstdDecoder     *zstd.Decoder // for requests, limited to wireMaxDecodedSize
+	zstdRespDecoder *zstd.Decoder // for responses, which can be much larger
+	zstdErr         error
+	zstdInitOnce    sync.Once
+	wireAlgorithmNo byte // the id used when no compression was done
+)
+
+// initZstd creates the zstd encoder and decoder we use for all messages, which
+// are safe for concurrent use.
+func initZstd() error {
+	zstdInitOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(wireMaxDecodedSize))
+		if zstdErr != nil {
+			return
+		}
+		zstdRespDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// chooseWireCompression returns the first of the given algorithms that we
+// support, or a blank string if none are.
+func chooseWireCompression(algorithms []string) string {
+	for _, algorithm := range algorithms {
+		if _, supported := wireAlgorithmIDs[algorithm]; supported {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+// frameWire frames the given encoded message, compressing it with the
+// algorithm (which must have been returned by chooseWireCompression()) if it
+// is large enough, and noting that we accept responses compressed with that
+// algorithm. If algorithm is blank, encoded is returned as-is.
+func frameWire(encoded []byte, algorithm string) ([]byte, error) {
+	if algorithm == "" {
+		return encoded, nil
+	}
+	id := wireAlgorithmIDs[algorithm]
+
+	used := wireAlgorithmNo
+	body := encoded
+	if len(encoded) >= wireCompressionMinSize {
+		var err error
+		switch id {
+		case 'z':
+			if err = initZstd(); err == nil {
+				body = zstdEncoder.EncodeAll(encoded, make([]byte, 0, len(encoded)/2))
+			}
+		case 's':
+			body = snappy.Encode(nil, encoded)
+		}
+		if err != nil {
+			return nil, err
+		}
+		used = id
+	}
+
+	framed := make([]byte, 0, len(body)+3)
+	framed = append(framed, wireFrameMarker, id, used)
+	return append(framed, body...), nil
+}
+
+// unframeWire reverses frameWire(), returning the encoded message and the
+// algorithm the sender accepts responses in. Unframed messages are returned
+// as-is, with a blank algorithm. If limit is true, as it should be for requests
+// from clients, compressed messages that would decompress to more than
+// wireMaxDecodedSize bytes are rejected before allocating for them.
+func unframeWire(msg []byte, limit bool) ([]byte, string, error) {
+	if len(msg) == 0 || msg[0] != wireFrameMarker {
+		return msg, "", nil
+	}
+	if len(msg) < 3 {
+		return nil, "", fmt.Errorf("truncated message frame")
+	}
+
+	accept := ""
+	for algorithm, id := range wireAlgorithmIDs {
+		if id == msg[1] {
+			accept = algorithm
+			break
+		}
+	}
+
+	body := msg[3:]
+	switch msg[2] {
+	case wireAlgorithmNo:
+		return body, accept, nil
+	case 'z':
+		if err := initZstd(); err != nil {
+			return nil, accept, err
+		}
+		decoder := zstdRespDecoder
+		if limit {
+			decoder = zstdDecoder
+		}
+		decoded, err := decoder.DecodeAll(body, nil)
+		return decoded, accept, err
+	case 's':
+		size, err := snappy.DecodedLen(body)
+		if err != nil {
+			return nil, accept, err
+		}
+		if limit && size > wireMaxDecodedSize {
+			return nil, accept, fmt.Errorf("message would decompress to %d bytes, more than the limit of %d", size, wireMaxDecodedSize)
+		}
+		decoded, err := snappy.Decode(nil, body)
+		return decoded, accept, err
+	default:
+		return nil, accept, fmt.Errorf("unknown message compression [%d]", msg[2])
+	}
+}
@@ -0,0 +1,488 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for workflows: a YAML file describes the steps
+// of a DAG, which are turned in to jobs with the right dependencies between
+// them, and the workflow is remembered so its progress can be followed.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// workflowStepOptions are the options of a workflow step that are about the
+// workflow itself, rather than being job options understood by JobViaJSON.
+var workflowStepOptions = []string{"name", "inputs", "after"}
+
+// WorkflowDefinition describes the steps of a workflow, as read from a YAML
+// file by ParseWorkflow().
+type WorkflowDefinition struct {
+	// Name identifies the workflow.
+	Name string `yaml:"workflow"`
+
+	// Defaults are job options (as understood by JobViaJSON) applied to every
+	// step that doesn't specify them itself.
+	Defaults map[string]interface{} `yaml:"defaults"`
+
+	// Steps are the options of each step: a unique "name", optional "inputs"
+	// (files the step reads) and "after" (names of steps it must run after),
+	// and job options as understood by JobViaJSON.
+	Steps []map[string]interface{} `yaml:"steps"`
+}
+
+// Workflow is a DAG of jobs added with Client.AddWorkflow(), as remembered by
+// the server.
+type Workflow struct {
+	Name  string
+	User  string
+	Added time.Time
+	Steps []*WorkflowStep
+}
+
+// WorkflowStep is one step of a Workflow.
+type WorkflowStep struct {
+	// Name is the step's name, unique within its workflow.
+	Name string
+
+	// Key is the key of the step's job.
+	Key string
+
+	// RepGroup is the RepGroup of the step's job.
+	RepGroup string
+
+	// After are the names of the steps this step depends on, either because
+	// they were explicitly listed, or because they output this step's inputs.
+	After []string
+
+	// State is the current state of the step's job, as of when you got the
+	// Workflow from the server. It is JobStateUnknown if the job has been
+	// removed.
+	State JobState
+}
+
+// Complete tells you if all the steps of the workflow are complete.
+func (w *Workflow) Complete() bool {
+	for _, step := range w.Steps {
+		if step.State != JobStateComplete {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseWorkflow reads a YAML workflow definition, eg.
+//
+//	workflow: qc
+//	defaults:
+//	  cwd: /data/qc
+//	  memory: 1G
+//	steps:
+//	  - name: fetch
+//	    cmd: fetch.sh
+//	    outputs: [raw.fq]
+//	  - name: align
+//	    cmd: align.sh raw.fq
+//	    inputs: [raw.fq]
+//	    memory: 8G
+//	  - name: report
+//	    cmd: report.sh
+//	    after: [align]
+//
+// and converts its steps in to jobs using the given defaults (the definition's
+// own defaults take precedence over these).
+//
+// A step depends on the steps named in its "after", and on the steps whose
+// "outputs" (paths or glob patterns, relative to their cwd unless absolute)
+// match any of its "inputs" (relative to its own cwd). Each step's job gets a
+// DepGroup of the workflow's name, a dot and the step's name, and Dependencies
+// on the DepGroups of the steps it depends on. Jobs without a rep_grp get that
+// same name as their RepGroup. The steps must form a DAG.
+//
+// The returned Workflow describes the steps, but their Keys are only filled in
+// by the server.
+func ParseWorkflow(r io.Reader, jd *JobDefaults) (*Workflow, []*Job, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var def WorkflowDefinition
+	err = yaml.UnmarshalStrict(content, &def)
+	if err != nil {
+		return nil, nil, fmt.Errorf("workflow could not be parsed: %s", err)
+	}
+	if def.Name == "" {
+		return nil, nil, fmt.Errorf("workflow has no name")
+	}
+	if len(def.Steps) == 0 {
+		return nil, nil, fmt.Errorf("workflow has no steps")
+	}
+
+	if jd == nil {
+		jd = &JobDefaults{}
+	}
+
+	wf := &Workflow{Name: def.Name}
+	jobs := make([]*Job, 0, len(def.Steps))
+	inputs := make([][]string, 0, len(def.Steps))
+	stepIndex := make(map[string]int, len(def.Steps))
+	keys := make(map[string]string, len(def.Steps))
+	for i, options := range def.Steps {
+		step, stepInputs, errs := workflowStep(options)
+		if errs != nil {
+			return nil, nil, fmt.Errorf("workflow step %d had a problem: %s", i+1, errs)
+		}
+		if _, exists := stepIndex[step.Name]; exists {
+			return nil, nil, fmt.Errorf("workflow step name %s is used more than once", step.Name)
+		}
+		stepIndex[step.Name] = i
+
+		for name, val := range def.Defaults {
+			if _, exists := options[name]; !exists {
+				options[name] = val
+			}
+		}
+
+		sjd := *jd
+		sjd.RepGrp = def.Name + pipelineSeparator + step.Name
+		var job *Job
+		var encoded []byte
+		encoded, err = json.Marshal(yamlToJSONable(options))
+		if err == nil {
+			var jvj JobViaJSON
+			err = json.Unmarshal(encoded, &jvj)
+			if err == nil {
+				job, err = jvj.Convert(&sjd)
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("workflow step %s had a problem: %s", step.Name, err)
+		}
+
+		if other, exists := keys[job.Key()]; exists {
+			return nil, nil, fmt.Errorf("workflow steps %s and %s have the same command", other, step.Name)
+		}
+		keys[job.Key()] = step.Name
+
+		job.DepGroups = append(job.DepGroups, sjd.RepGrp)
+		step.RepGroup = job.RepGroup
+		wf.Steps = append(wf.Steps, step)
+		jobs = append(jobs, job)
+		inputs = append(inputs, stepInputs)
+	}
+
+	for i, step := range wf.Steps {
+		for _, name := range step.After {
+			if _, exists := stepIndex[name]; !exists {
+				return nil, nil, fmt.Errorf("workflow step %s is after unknown step %s", step.Name, name)
+			}
+		}
+		for _, input := range inputs[i] {
+			input = workflowPath(jobs[i].Cwd, input)
+			for j, upstream := range jobs {
+				if j != i && workflowOutputsMatch(upstream, input) {
+					step.After = appendIfMissing(step.After, wf.Steps[j].Name)
+				}
+			}
+		}
+	}
+
+	if cycle := wf.cycle(stepIndex); cycle != "" {
+		return nil, nil, fmt.Errorf("workflow steps depend on each other in a cycle: %s", cycle)
+	}
+
+	for i, step := range wf.Steps {
+		for _, name := range step.After {
+			jobs[i].Dependencies = append(jobs[i].Dependencies, NewDepGroupDependency(def.Name+pipelineSeparator+name))
+		}
+	}
+
+	return wf, jobs, nil
+}
+
+// workflowStep extracts the workflow-specific options from the given step
+// options, returning a WorkflowStep with its Name and explicit After, and the
+// step's inputs.
+func workflowStep(options map[string]interface{}) (*WorkflowStep, []string, error) {
+	name, ok := options["name"].(string)
+	if !ok || name == "" {
+		return nil, nil, fmt.Errorf("it has no name")
+	}
+	if strings.ContainsAny(name, pipelineSeparator+" ") {
+		return nil, nil, fmt.Errorf("its name %s contains a dot or space", name)
+	}
+
+	inputs, err := workflowStringList(options["inputs"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("its inputs %s", err)
+	}
+	after, err := workflowStringList(options["after"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("its after %s", err)
+	}
+
+	for _, option := range workflowStepOptions {
+		delete(options, option)
+	}
+	return &WorkflowStep{Name: name, After: after}, inputs, nil
+}
+
+// workflowStringList converts a YAML list of strings (or nil) to a []string.
+func workflowStringList(val interface{}) ([]string, error) {
+	if val == nil {
+		return nil, nil
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("are not a list")
+	}
+	strs := make([]string, len(list))
+	for i, v := range list {
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("are not all strings")
+		}
+		strs[i] = str
+	}
+	return strs, nil
+}
+
+// workflowPath returns the given path, made absolute relative to cwd if it
+// wasn't already.
+func workflowPath(cwd, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(cwd, path)
+}
+
+// workflowOutputsMatch tells you if any of the Outputs of the given job match
+// the given absolute path.
+func workflowOutputsMatch(job *Job, path string) bool {
+	for _, output := range job.Outputs {
+		output = workflowPath(job.Cwd, output)
+		if output == path {
+			return true
+		}
+		if matched, err := filepath.Match(output, path); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// appendIfMissing appends str to strs if it isn't already in there.
+func appendIfMissing(strs []string, str string) []string {
+	for _, s := range strs {
+		if s == str {
+			return strs
+		}
+	}
+	return append(strs, str)
+}
+
+// cycle returns a description of a dependency cycle amongst our steps (eg. "a
+// -> b -> a"), or a blank string if there isn't one. stepIndex maps step names
+// to their index in Steps.
+func (w *Workflow) cycle(stepIndex map[string]int) string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(w.Steps))
+	var path []string
+
+	var visit func(i int) string
+	visit = func(i int) string {
+		switch marks[i] {
+		case visiting:
+			start := 0
+			for j, name := range path {
+				if name == w.Steps[i].Name {
+					start = j
+				}
+			}
+			return strings.Join(append(path[start:], w.Steps[i].Name), " -> ")
+		case visited:
+			return ""
+		}
+		marks[i] = visiting
+		path = append(path, w.Steps[i].Name)
+		for _, name := range w.Steps[i].After {
+			if cycle := visit(stepIndex[name]); cycle != "" {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		marks[i] = visited
+		return ""
+	}
+
+	for i := range w.Steps {
+		if cycle := visit(i); cycle != "" {
+			return cycle
+		}
+	}
+	return ""
+}
+
+// addWorkflow does the server side of Client.AddWorkflow(). The jobs should
+// already be in the namespace, if any, and correspond to the workflow's Steps.
+// Returns the number of jobs added and that already existed, and one of our
+// Err* constants on failure.
+func (s *Server) addWorkflow(wf *Workflow, namespace string, jobs []*Job, envkey string, ignoreComplete bool) (added, existed int, srerr string, qerr error) {
+	if wf == nil || wf.Name == "" || len(wf.Steps) != len(jobs) {
+		return 0, 0, ErrBadRequest, fmt.Errorf("workflow steps don't match its jobs")
+	}
+
+	// all the jobs are added together, so either they all get added or none
+	// do
+	added, dups, alreadyComplete, srerr, qerr := s.createJobs(jobs, envkey, ignoreComplete)
+	if qerr != nil {
+		return 0, 0, srerr, qerr
+	}
+
+	wf.Name = namespaced(namespace, wf.Name)
+	wf.Added = time.Now()
+	for i, step := range wf.Steps {
+		step.Key = jobs[i].Key()
+		step.RepGroup = jobs[i].RepGroup
+		step.State = ""
+	}
+	err := s.db.storeWorkflow(wf)
+	if err != nil {
+		return added, dups + alreadyComplete, ErrDBError, err
+	}
+	s.Debug("added workflow", "workflow", wf.Name, "steps", len(wf.Steps), "new", added)
+	return added, dups + alreadyComplete, "", nil
+}
+
+// getWorkflows does the server side of Client.GetWorkflows(), returning the
+// workflow with the given (namespaced) name, or all of them if name is blank,
+// with the current States of their steps.
+func (s *Server) getWorkflows(name string) ([]*Workflow, string, error) {
+	wfs, err := s.db.retrieveWorkflows()
+	if err != nil {
+		return nil, ErrDBError, err
+	}
+
+	var wanted []*Workflow
+	for _, wf := range wfs {
+		if name != "" && wf.Name != name {
+			continue
+		}
+
+		keys := make([]string, len(wf.Steps))
+		for i, step := range wf.Steps {
+			keys[i] = step.Key
+		}
+		jobs, srerr, qerr := s.getJobsByKeys(keys, false, false)
+		if srerr != "" {
+			return nil, srerr, fmt.Errorf("%s", qerr)
+		}
+		states := make(map[string]JobState, len(jobs))
+		for _, job := range jobs {
+			states[job.Key()] = job.State
+		}
+		for _, step := range wf.Steps {
+			step.State = JobStateUnknown
+			if state, exists := states[step.Key]; exists {
+				step.State = state
+			}
+		}
+		wanted = append(wanted, wf)
+	}
+	return wanted, "", nil
+}
+
+// workflowsInNamespace returns those of the given workflows that are in the
+// given namespace, with their names and RepGroups unqualified.
+func workflowsInNamespace(wfs []*Workflow, namespace string) []*Workflow {
+	prefix := namespace + namespaceSeparator
+	filtered := make([]*Workflow, 0, len(wfs))
+	for _, wf := range wfs {
+		if !strings.HasPrefix(wf.Name, prefix) {
+			continue
+		}
+		wf.Name = unnamespaced(namespace, wf.Name)
+		for _, step := range wf.Steps {
+			step.RepGroup = unnamespaced(namespace, step.RepGroup)
+		}
+		filtered = append(filtered, wf)
+	}
+	return filtered
+}
+
+// AddWorkflow adds the jobs of a workflow, as parsed by ParseWorkflow(), in a
+// single request, so that either all of them are added or none are. The server
+// remembers the workflow, so you can follow its progress with GetWorkflows().
+// Adding a workflow with the same name as one added before replaces it (steps
+// that are still in the queue or, unless ignoreComplete is false, complete are
+// not added again). Returns the number of jobs added and that already existed.
+func (c *Client) AddWorkflow(wf *Workflow, jobs []*Job, envVars []string, ignoreComplete bool) (added, existed int, err error) {
+	return c.AddWorkflowContext(context.Background(), wf, jobs, envVars, ignoreComplete)
+}
+
+// AddWorkflowContext is like AddWorkflow(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) AddWorkflowContext(ctx context.Context, wf *Workflow, jobs []*Job, envVars []string, ignoreComplete bool) (added, existed int, err error) {
+	compressedEnv, err := c.CompressEnv(envVars)
+	if err != nil {
+		return 0, 0, err
+	}
+	jobsc, err := c.compressJobs(jobs)
+	if err != nil {
+		return 0, 0, err
+	}
+	user, _ := internal.Username() // #nosec only used to share capacity fairly between users
+	cr := &clientRequest{Method: "addworkflow", Workflow: wf, JobsC: jobsc, Env: compressedEnv, IgnoreComplete: ignoreComplete, User: user}
+	resp, err := c.requestContext(ctx, cr)
+	if err != nil {
+		return 0, 0, err
+	}
+	return resp.Added, resp.Existed, err
+}
+
+// GetWorkflows gets the workflow with the given name that was added with
+// AddWorkflow(), or all of them if name is blank, with the current States of
+// their steps.
+func (c *Client) GetWorkflows(name string) ([]*Workflow, error) {
+	return c.GetWorkflowsContext(context.Background(), name)
+}
+
+// GetWorkflowsContext is like GetWorkflows(), but stops waiting for the server
+// and returns ctx.Err() if ctx is cancelled or reaches its deadline first.
+func (c *Client) GetWorkflowsContext(ctx context.Context, name string) ([]*Workflow, error) {
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "getworkflows", Workflow: &Workflow{Name: name}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Workflows, err
+}
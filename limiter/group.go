@@ -41,14 +41,14 @@ func (g *group) setLimit(limit uint) {
 	g.limit = limit
 }
 
-// canIncrement tells you if the current count of this group is less than the
-// limit.
-func (g *group) canIncrement() bool {
-	return g.current < g.limit
+// canIncrementBy tells you if the current count of this group could be
+// increased by n without going over the limit.
+func (g *group) canIncrementBy(n uint) bool {
+	return g.current+n <= g.limit
 }
 
 // increment increases the current count of this group. You must call
-// canIncrement() first to make sure you won't go over the limit (and hold a
+// canIncrementBy() first to make sure you won't go over the limit (and hold a
 // lock over the 2 calls to avoid a race condition).
 func (g *group) increment() {
 	g.current++
@@ -22,6 +22,7 @@ package limiter
 // package, the Limiter.
 
 import (
+	"sort"
 	"time"
 
 	sync "github.com/sasha-s/go-deadlock"
@@ -35,6 +36,13 @@ import (
 // memory.)
 type SetLimitCallback func(name string) int
 
+// Usage describes how much of a group's limit is currently in use.
+type Usage struct {
+	Name    string
+	Current uint
+	Limit   uint
+}
+
 // Limiter struct is used to limit usage of groups.
 type Limiter struct {
 	cb     SetLimitCallback
@@ -75,6 +83,23 @@ func (l *Limiter) GetLimit(name string) int {
 	return int(group.limit)
 }
 
+// GetUsage tells you the current count and limit of every group currently in
+// memory, sorted by group name. (Groups that have been forgotten about because
+// they were unused are not included.)
+func (l *Limiter) GetUsage() []*Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := make([]*Usage, 0, len(l.groups))
+	for _, group := range l.groups {
+		usage = append(usage, &Usage{Name: group.name, Current: group.current, Limit: group.limit})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Name < usage[j].Name
+	})
+	return usage
+}
+
 // RemoveLimit removes the given group from memory. If your callback also begins
 // returning -1 for this group, the group effectively becomes unlimited.
 func (l *Limiter) RemoveLimit(name string) {
@@ -95,6 +120,10 @@ func (l *Limiter) RemoveLimit(name string) {
 // If possible, the group counts are actually incremented and this returns
 // true. If not possible, no group counts are altered and this returns false.
 //
+// A group name can be supplied more than once, in which case its count will be
+// incremented by the number of times it was supplied, treating the group as a
+// pool of consumable tokens of which you wish to use more than one.
+//
 // If an optional wait duration is supplied, will wait for up to the given wait
 // period for an increment of every group to be possible.
 func (l *Limiter) Increment(groups []string, wait ...time.Duration) bool {
@@ -138,10 +167,10 @@ func (l *Limiter) Increment(groups []string, wait ...time.Duration) bool {
 // hold the mu.lock before calling this, and until after calling
 // incrementGroups() if this returns true.
 func (l *Limiter) checkGroups(groups []string) bool {
-	for _, name := range groups {
+	for name, n := range countGroups(groups) {
 		group := l.vivifyGroup(name)
 		if group != nil {
-			if !group.canIncrement() {
+			if !group.canIncrementBy(n) {
 				return false
 			}
 		}
@@ -149,6 +178,16 @@ func (l *Limiter) checkGroups(groups []string) bool {
 	return true
 }
 
+// countGroups returns a map of group name to the number of times that name
+// appears in the given groups.
+func countGroups(groups []string) map[string]uint {
+	counts := make(map[string]uint, len(groups))
+	for _, name := range groups {
+		counts[name]++
+	}
+	return counts
+}
+
 // incrementGroups increments all the groups without checking them. You must
 // hold the mu.lock before calling this (and check first).
 func (l *Limiter) incrementGroups(groups []string) {
@@ -186,7 +225,8 @@ func (l *Limiter) registerGroupNotifications(groups []string, ch chan bool) {
 	}
 }
 
-// Decrement decrements the count of every supplied group.
+// Decrement decrements the count of every supplied group. As with Increment(),
+// a group supplied more than once is decremented that many times.
 //
 // To save memory, if a group reaches a count of 0, it is forgotten.
 //
@@ -229,10 +269,10 @@ func (l *Limiter) GetRemainingCapacity(groups []string) int {
 	defer l.mu.Unlock()
 
 	lowest := -1
-	for _, name := range groups {
+	for name, n := range countGroups(groups) {
 		group := l.vivifyGroup(name)
 		if group != nil {
-			capacity := group.capacity()
+			capacity := group.capacity() / int(n)
 			if lowest == -1 || capacity < lowest {
 				lowest = capacity
 			}
@@ -188,6 +188,52 @@ func TestLimiter(t *testing.T) {
 			So(l.Increment(two), ShouldBeFalse)
 		})
 
+		Convey("Groups supplied multiple times consume multiple tokens", func() {
+			groups := []string{"l1", "l1", "l2"}
+			So(l.GetRemainingCapacity(groups), ShouldEqual, 1)
+			So(l.Increment(groups), ShouldBeTrue)
+			So(l.GetRemainingCapacity(groups), ShouldEqual, 0)
+			So(l.GetRemainingCapacity([]string{"l1"}), ShouldEqual, 1)
+
+			So(l.Increment(groups), ShouldBeFalse)
+			So(l.Increment([]string{"l1", "l1"}), ShouldBeFalse)
+			So(l.Increment([]string{"l1"}), ShouldBeTrue)
+			So(l.Increment([]string{"l1"}), ShouldBeFalse)
+
+			usage := l.GetUsage()
+			So(len(usage), ShouldEqual, 2)
+			So(*usage[0], ShouldResemble, Usage{Name: "l1", Current: 3, Limit: 3})
+
+			l.Decrement(groups)
+			usage = l.GetUsage()
+			So(len(usage), ShouldEqual, 1)
+			So(*usage[0], ShouldResemble, Usage{Name: "l1", Current: 1, Limit: 3})
+			So(l.Increment([]string{"l1", "l1"}), ShouldBeTrue)
+			So(l.Increment([]string{"l1"}), ShouldBeFalse)
+
+			l.SetLimit("l1", 5)
+			So(l.GetRemainingCapacity(groups), ShouldEqual, 1)
+			So(l.Increment(groups), ShouldBeTrue)
+		})
+
+		Convey("You can GetUsage() of groups in memory", func() {
+			So(l.GetUsage(), ShouldBeEmpty)
+			So(l.Increment([]string{"l1", "l2"}), ShouldBeTrue)
+			So(l.Increment([]string{"l2"}), ShouldBeTrue)
+			l.SetLimit("l4", 50)
+
+			usage := l.GetUsage()
+			So(len(usage), ShouldEqual, 3)
+			So(*usage[0], ShouldResemble, Usage{Name: "l1", Current: 1, Limit: 3})
+			So(*usage[1], ShouldResemble, Usage{Name: "l2", Current: 2, Limit: 2})
+			So(*usage[2], ShouldResemble, Usage{Name: "l4", Current: 0, Limit: 50})
+
+			l.Decrement([]string{"l1"})
+			usage = l.GetUsage()
+			So(len(usage), ShouldEqual, 2)
+			So(usage[0].Name, ShouldEqual, "l2")
+		})
+
 		Convey("You can have limits of 0 and also RemoveLimit()s", func() {
 			l.SetLimit("l2", 0)
 			So(l.Increment([]string{"l2"}), ShouldBeFalse)
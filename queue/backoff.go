@@ -0,0 +1,107 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// This file contains the functions that can be used to decide how long items
+// are delayed for when they are released back to the queue.
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff is used to decide how long an item should spend in the delay
+// sub-queue when it is Release()d, or when its ttr expires and the
+// TTRCallback moves it to the delay sub-queue. It is given the item before it
+// is moved, so item.Stats() tells you how many times it has already been
+// released and timed out. Returning 0 puts a Release()d item straight back on
+// the ready sub-queue.
+//
+// Like ReadyOrder, implementations must be fast and must not call any Queue
+// methods. Different items can be Release()d concurrently, so implementations
+// must also be safe for concurrent use.
+type Backoff func(item *Item) time.Duration
+
+// ItemDelayBackoff is the default Backoff, which always uses the delay the item
+// was added with.
+func ItemDelayBackoff(item *Item) time.Duration {
+	return item.Stats().Delay
+}
+
+// ConstantBackoff returns a Backoff that always delays items by the given
+// duration, regardless of the delay they were added with.
+func ConstantBackoff(delay time.Duration) Backoff {
+	return func(item *Item) time.Duration {
+		return delay
+	}
+}
+
+// ExponentialBackoff returns a Backoff that delays items by initial the first
+// time they are released or time out, then multiplies that by factor for every
+// subsequent release or time out, never delaying by more than max.
+func ExponentialBackoff(initial, max time.Duration, factor float64) Backoff {
+	return func(item *Item) time.Duration {
+		stats := item.Stats()
+		attempts := float64(stats.Releases + stats.Timeouts)
+		delay := float64(initial) * math.Pow(factor, attempts)
+		if delay > float64(max) || math.IsInf(delay, 0) || math.IsNaN(delay) {
+			return max
+		}
+		return time.Duration(delay)
+	}
+}
+
+// JitteredBackoff returns a Backoff that randomly alters the delays returned by
+// the given Backoff by up to the given fraction either way, so that many items
+// that fail together don't all become ready again at the same time. Eg. a
+// fraction of 0.1 turns a 10s delay in to something between 9s and 11s.
+func JitteredBackoff(backoff Backoff, fraction float64) Backoff {
+	return func(item *Item) time.Duration {
+		delay := float64(backoff(item))
+		jitter := delay * fraction * (2*rand.Float64() - 1) // #nosec
+		if delay+jitter < 0 {
+			return 0
+		}
+		return time.Duration(delay + jitter)
+	}
+}
+
+// CappedBackoff returns a Backoff that never delays items by more than max,
+// whatever the given Backoff returns.
+func CappedBackoff(backoff Backoff, max time.Duration) Backoff {
+	return func(item *Item) time.Duration {
+		if delay := backoff(item); delay < max {
+			return delay
+		}
+		return max
+	}
+}
+
+// SetBackoff sets the function that decides how long items are delayed for
+// when they are released back to the queue. If you don't set this (or set it
+// to nil), the default is ItemDelayBackoff.
+func (queue *Queue) SetBackoff(backoff Backoff) {
+	if backoff == nil {
+		backoff = ItemDelayBackoff
+	}
+	queue.lock()
+	defer queue.unlock()
+	queue.backoff = backoff
+}
@@ -22,10 +22,13 @@ package queue
 // removing items
 
 import (
+	"sync/atomic"
+
 	sync "github.com/sasha-s/go-deadlock"
 )
 
 type buryQueue struct {
+	size  int64 // accessed atomically, so len() needs no lock; first for alignment
 	mutex sync.RWMutex
 	items []*Item
 }
@@ -39,6 +42,7 @@ func (q *buryQueue) push(item *Item) {
 	defer q.mutex.Unlock()
 	item.queueIndexes[3] = len(q.items)
 	q.items = append(q.items, item)
+	atomic.AddInt64(&q.size, 1)
 }
 
 func (q *buryQueue) pop() *Item {
@@ -51,6 +55,7 @@ func (q *buryQueue) pop() *Item {
 	item := q.items[lasti]
 	item.queueIndexes[3] = -1
 	q.items = q.items[:lasti]
+	atomic.AddInt64(&q.size, -1)
 	return item
 }
 
@@ -72,16 +77,16 @@ func (q *buryQueue) remove(item *Item) {
 	}
 
 	item.queueIndexes[3] = -1
+	atomic.AddInt64(&q.size, -1)
 }
 
 func (q *buryQueue) len() int {
-	q.mutex.RLock()
-	defer q.mutex.RUnlock()
-	return len(q.items)
+	return int(atomic.LoadInt64(&q.size))
 }
 
 func (q *buryQueue) empty() {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	q.items = nil
+	atomic.StoreInt64(&q.size, 0)
 }
@@ -26,10 +26,13 @@ package queue
 // duplication...
 
 import (
+	"sync/atomic"
+
 	sync "github.com/sasha-s/go-deadlock"
 )
 
 type depQueue struct {
+	size  int64 // accessed atomically, so len() needs no lock; first for alignment
 	mutex sync.RWMutex
 	items []*Item
 }
@@ -43,6 +46,7 @@ func (q *depQueue) push(item *Item) {
 	defer q.mutex.Unlock()
 	item.queueIndexes[4] = len(q.items)
 	q.items = append(q.items, item)
+	atomic.AddInt64(&q.size, 1)
 }
 
 func (q *depQueue) pop() *Item {
@@ -55,6 +59,7 @@ func (q *depQueue) pop() *Item {
 	item := q.items[lasti]
 	item.queueIndexes[4] = -1
 	q.items = q.items[:lasti]
+	atomic.AddInt64(&q.size, -1)
 	return item
 }
 
@@ -76,16 +81,16 @@ func (q *depQueue) remove(item *Item) {
 	}
 
 	item.queueIndexes[4] = -1
+	atomic.AddInt64(&q.size, -1)
 }
 
 func (q *depQueue) len() int {
-	q.mutex.RLock()
-	defer q.mutex.RUnlock()
-	return len(q.items)
+	return int(atomic.LoadInt64(&q.size))
 }
 
 func (q *depQueue) empty() {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	q.items = nil
+	atomic.StoreInt64(&q.size, 0)
 }
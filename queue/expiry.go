@@ -0,0 +1,131 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// This file contains the code for giving up on items that haven't been
+// Reserve()d within some time limit.
+
+import "time"
+
+// ExpiryCallback is used as a callback when an item expires. It receives the
+// item's data.
+type ExpiryCallback func(data interface{})
+
+// SetExpiryCallback sets a callback that will be called when an item expires
+// (see SetExpiry()). The callback will be initiated in a go routine.
+func (queue *Queue) SetExpiryCallback(callback ExpiryCallback) {
+	queue.lock()
+	defer queue.unlock()
+	queue.expiryCb = callback
+}
+
+// SetExpiry is a thread-safe way to say that if the item with the given key
+// hasn't been Reserve()d within the given duration from now, it should be
+// given up on: it is moved to the bury sub-queue (from the delay, ready or
+// dependent sub-queue) and any ExpiryCallback is called.
+//
+// Items that have ever been Reserve()d never expire. An expiry of 0 cancels
+// any previously set expiry.
+func (queue *Queue) SetExpiry(key string, expiry time.Duration) error {
+	queue.lock()
+	defer queue.unlock()
+	if queue.isClosed() {
+		return Error{queue.Name, "SetExpiry", key, ErrQueueClosed}
+	}
+
+	item, exists := queue.items.get(key)
+	if !exists {
+		return Error{queue.Name, "SetExpiry", key, ErrNotFound}
+	}
+
+	var expiresAt time.Time
+	if expiry > 0 {
+		expiresAt = time.Now().Add(expiry)
+	}
+	queue.setItemExpiry(item, expiresAt)
+	return nil
+}
+
+// setItemExpiry (re)sets the time the given item expires at, starting a timer
+// that will call expire() at that time. A zero time cancels expiry.
+func (queue *Queue) setItemExpiry(item *Item, expiresAt time.Time) {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	if item.expiryTimer != nil {
+		item.expiryTimer.Stop()
+		item.expiryTimer = nil
+	}
+	item.expiresAt = expiresAt
+	if expiresAt.IsZero() {
+		return
+	}
+	item.expiryTimer = time.AfterFunc(time.Until(expiresAt), func() {
+		queue.expire(item)
+	})
+}
+
+// expire buries the given item if it is still in the queue and still hasn't
+// been reserved by its expiry time.
+func (queue *Queue) expire(item *Item) {
+	queue.lock()
+	if queue.isClosed() {
+		queue.unlock()
+		return
+	}
+
+	// check it's actually still in the queue, and wasn't replaced by a new
+	// item with the same key
+	if current, exists := queue.items.get(item.Key); !exists || current != item {
+		queue.unlock()
+		return
+	}
+
+	item.mutex.RLock()
+	expiresAt, reserves, state := item.expiresAt, item.reserves, item.state
+	item.mutex.RUnlock()
+	if expiresAt.IsZero() || time.Now().Before(expiresAt) || reserves > 0 {
+		queue.unlock()
+		return
+	}
+
+	var from SubQueue
+	switch state {
+	case ItemStateDelay:
+		queue.delayQueue.remove(item)
+		from = SubQueueDelay
+	case ItemStateReady:
+		queue.readyQueue.remove(item)
+		from = SubQueueReady
+	case ItemStateDependent:
+		queue.depQueue.remove(item)
+		from = SubQueueDependent
+	default:
+		queue.unlock()
+		return
+	}
+	queue.buryQueue.push(item)
+	item.switchExpiredBury()
+	cb := queue.expiryCb
+	queue.unlock()
+
+	queue.changed(from, SubQueueBury, []*Item{item})
+	if cb != nil {
+		go cb(item.Data())
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// This file contains the functions that can be used to split the ready items
+// of each ReserveGroup in to fair groups, so that reserving can efficiently
+// skip over the items of groups that shouldn't get any more right now.
+
+// FairGroup is used to decide which fair group an item in the ready sub-queue
+// belongs to, for example the user that owns it. Items are still reserved in
+// ReadyOrder regardless of their fair group, but ReserveFiltered() can skip
+// whole fair groups at a time.
+//
+// Like ReadyOrder, implementations must be fast and must not call any Queue
+// methods. An item's fair group is worked out when it becomes ready and when
+// it is Update()d.
+type FairGroup func(item *Item) string
+
+// Filter is used by ReserveFiltered() to decide if the items of a fair group
+// can be reserved right now. It is given the next item of each fair group, in
+// ReadyOrder, and should return true if that fair group is suitable for the
+// caller. It should give the same answer for every item of a fair group. Like
+// ReadyOrder, implementations must be fast and must not call any Queue
+// methods.
+type Filter func(item *Item) bool
+
+// SetFairGroup sets the function that decides which fair group each ready item
+// belongs to. Items already in the ready sub-queue are regrouped. If you don't
+// set this (or set it to nil), all items are in the same fair group.
+func (queue *Queue) SetFairGroup(fairGroup FairGroup) {
+	queue.lock()
+	defer queue.unlock()
+	queue.readyQueue.setFairGroup(fairGroup)
+}
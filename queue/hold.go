@@ -0,0 +1,169 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// This file contains the functions that can be used to hold items back from
+// being reserved, even though they are ready, or to only reserve certain
+// ready items.
+
+import "time"
+
+// Hold is used to decide if an item in the ready sub-queue can be Reserve()d
+// right now. It should return 0 if it can, otherwise how long the item should
+// be held back for. Held items are moved to the delay sub-queue for that long,
+// after which they become ready again (and are checked again if Reserve()d).
+//
+// Like ReadyOrder, implementations must be fast and must not call any Queue
+// methods. Since concurrent Reserve()s can check different items at the same
+// time, implementations must also be safe for concurrent use.
+type Hold func(item *Item) time.Duration
+
+// Match is used by ReserveMatching() to decide if a ready item is suitable for
+// the caller. It should return true if it is. Like ReadyOrder, implementations
+// must be fast and must not call any Queue methods, and like Hold, they may be
+// called concurrently.
+type Match func(item *Item) bool
+
+// SetHold sets the function that decides if ready items can be reserved right
+// now. Items are checked when Reserve() would return them, and before the
+// ReadyAddedCallback is called, so that callback doesn't see held items. If you
+// don't set this (or set it to nil), no items are held.
+func (queue *Queue) SetHold(hold Hold) {
+	queue.lock()
+	defer queue.unlock()
+	queue.hold = hold
+}
+
+// holdItem checks if the given item, which must have just been removed from the
+// ready sub-queue, should be held, and if so puts it in the delay sub-queue and
+// returns true. You must hold the queue lock (at least from lockShared()) when
+// calling this, and afterwards pass held items to heldItemsMoved() once you have
+// released the lock.
+func (queue *Queue) holdItem(item *Item) bool {
+	if queue.hold == nil {
+		return false
+	}
+	delay := queue.hold(item)
+	if delay <= 0 {
+		return false
+	}
+	queue.items.lockItem(item.Key)
+	queue.delayHeldItem(item, delay)
+	queue.items.unlockItem(item.Key)
+	return true
+}
+
+// delayHeldItem puts an item that was removed from the ready sub-queue in to
+// the delay sub-queue for the given delay. You must hold the queue lock when
+// calling this.
+func (queue *Queue) delayHeldItem(item *Item, delay time.Duration) {
+	item.restartAfter(delay)
+	queue.delayQueue.push(item)
+	item.switchReadyDelay()
+}
+
+// popReady pops the next item from the ready sub-queue for the given
+// reserveGroup that is in a fair group accepted by filter (if not nil), that
+// isn't held and that is accepted by match (if not nil), returning it along
+// with any items that got held along the way, and whether any items were
+// skipped because filter or match didn't accept them (these remain in the ready
+// sub-queue). You must hold the queue lock (at least from lockShared()) when
+// calling this.
+func (queue *Queue) popReady(reserveGroup string, filter Filter, match Match) (*Item, []*Item, bool) {
+	var held, unmatched []*Item
+	var filtered bool
+	defer func() {
+		for _, item := range unmatched {
+			queue.readyQueue.restore(item)
+		}
+	}()
+	for {
+		item, skipped := queue.readyQueue.popFiltered(reserveGroup, filter)
+		filtered = filtered || skipped
+		switch {
+		case item == nil:
+			return nil, held, filtered || len(unmatched) > 0
+		case queue.holdItem(item):
+			held = append(held, item)
+		case match != nil && !match(item):
+			unmatched = append(unmatched, item)
+		default:
+			return item, held, filtered || len(unmatched) > 0
+		}
+	}
+}
+
+// popReadyFromGroups is like popReady(), but tries each of the given reserve
+// groups in turn until one has an item.
+func (queue *Queue) popReadyFromGroups(reserveGroups []string, filter Filter, match Match) (*Item, []*Item, bool) {
+	var held []*Item
+	var skipped bool
+	for _, group := range reserveGroups {
+		item, moreHeld, groupSkipped := queue.popReady(group, filter, match)
+		held = append(held, moreHeld...)
+		skipped = skipped || groupSkipped
+		if item != nil {
+			return item, held, skipped
+		}
+	}
+	return nil, held, skipped
+}
+
+// readyItemsNotHeld returns the items in the ready sub-queue, after first
+// holding (and excluding) those that should be held. You must not hold the
+// queue lock when calling this.
+func (queue *Queue) readyItemsNotHeld() []*Item {
+	queue.mutex.RLock()
+	if queue.hold == nil {
+		defer queue.mutex.RUnlock()
+		return queue.readyQueue.allItems()
+	}
+	queue.mutex.RUnlock()
+
+	queue.lock()
+	var ready, held []*Item
+	for _, item := range queue.readyQueue.allItems() {
+		delay := time.Duration(0)
+		if queue.hold != nil {
+			delay = queue.hold(item)
+		}
+		if delay <= 0 {
+			ready = append(ready, item)
+			continue
+		}
+		queue.readyQueue.remove(item)
+		queue.delayHeldItem(item, delay)
+		held = append(held, item)
+	}
+	queue.unlock()
+	queue.heldItemsMoved(held)
+	return ready
+}
+
+// heldItemsMoved does the notifications for items that were held. You must not
+// hold the queue lock when calling this.
+func (queue *Queue) heldItemsMoved(held []*Item) {
+	if len(held) == 0 {
+		return
+	}
+	for _, item := range held {
+		queue.delayNotificationTrigger(item)
+	}
+	queue.changed(SubQueueReady, SubQueueDelay, held)
+}
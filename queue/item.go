@@ -67,9 +67,13 @@ type Item struct {
 	creation      time.Time
 	dependencies  []string
 	remainingDeps map[string]bool
+	depsNeeded    int // 0 means all dependencies are needed
 	mutex         sync.RWMutex
 	queueIndexes  [5]int
+	fairGroup     string // only used by the ready subQueue
 	iid           uint64
+	expiresAt     time.Time
+	expiryTimer   *time.Timer
 }
 
 // ItemStats holds information about the Item's state. Remaining is the time
@@ -180,6 +184,39 @@ func (item *Item) ReadyAt() time.Time {
 	return item.readyAt
 }
 
+// Priority is a thread-safe way of getting just the priority of an item, when
+// you don't need all of the other information from Stats().
+func (item *Item) Priority() uint8 {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return item.priority
+}
+
+// Size is a thread-safe way of getting just the size of an item, when you
+// don't need all of the other information from Stats().
+func (item *Item) Size() uint8 {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return item.size
+}
+
+// Created is a thread-safe way of getting just the time an item was created,
+// when you don't need all of the other information from Stats().
+func (item *Item) Created() time.Time {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return item.creation
+}
+
+// ExpiresAt is a thread-safe way of getting the time after which the item will
+// be buried if it still hasn't been Reserve()d. It is the zero time if the
+// item doesn't expire.
+func (item *Item) ExpiresAt() time.Time {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return item.expiresAt
+}
+
 // Dependencies returns the keys of the other items we are dependent upon. Note,
 // do not add these back during a queue.Update(), or you could end up adding
 // back dependencies that already got resolved, leaving you in a permanent
@@ -202,6 +239,15 @@ func (item *Item) UnresolvedDependencies() []string {
 	return deps
 }
 
+// DependencyCount returns the number of this item's Dependencies() that must
+// be resolved before it is no longer dependent, as set with
+// queue.SetDependencyCount(). 0 means all of them are needed.
+func (item *Item) DependencyCount() int {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return item.depsNeeded
+}
+
 // ChangedKey updates this item by changing its Key if old matches it, or by
 // updating the key in any dependencies of this item.
 func (item *Item) ChangedKey(old, new string) {
@@ -233,6 +279,7 @@ func (item *Item) setDependencies(deps []string) {
 	item.mutex.Lock()
 	defer item.mutex.Unlock()
 	item.dependencies = deps
+	item.depsNeeded = 0
 	item.remainingDeps = make(map[string]bool)
 	for _, key := range item.dependencies {
 		item.remainingDeps[key] = true
@@ -248,11 +295,36 @@ func (item *Item) resolveDependency(key string) bool {
 	defer item.mutex.Unlock()
 	delete(item.remainingDeps, key)
 	if item.state == ItemStateDependent {
-		return len(item.remainingDeps) == 0
+		return item.depsResolved()
+	}
+	return false
+}
+
+// setDependencyCount sets the number of dependencies that must be resolved,
+// returning true if the item is in the dependency sub queue and enough have
+// now been resolved.
+func (item *Item) setDependencyCount(n int) bool {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	if n < 0 || n >= len(item.dependencies) {
+		n = 0
+	}
+	item.depsNeeded = n
+	if item.state == ItemStateDependent {
+		return item.depsResolved()
 	}
 	return false
 }
 
+// depsResolved tells you if enough of this item's dependencies have been
+// resolved. You must hold the item's mutex when calling this.
+func (item *Item) depsResolved() bool {
+	if item.depsNeeded > 0 {
+		return len(item.dependencies)-len(item.remainingDeps) >= item.depsNeeded
+	}
+	return len(item.remainingDeps) == 0
+}
+
 // restart is a thread-safe way to reset the readyAt time, for when the item
 // is put back in to the delay queue
 func (item *Item) restart() {
@@ -261,6 +333,14 @@ func (item *Item) restart() {
 	item.readyAt = time.Now().Add(item.delay)
 }
 
+// restartAfter is like restart(), but uses the given delay instead of the
+// item's own.
+func (item *Item) restartAfter(delay time.Duration) {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	item.readyAt = time.Now().Add(delay)
+}
+
 // touch is a thread-safe way to (re)set the item's release time, to allow it
 // more time on the run sub-queue.
 func (item *Item) touch() {
@@ -329,6 +409,15 @@ func (item *Item) switchReadyRun() {
 	item.state = ItemStateRun
 }
 
+// update after we've switched from the ready to the delay sub-queue, because
+// the item was held
+func (item *Item) switchReadyDelay() {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	item.queueIndexes[1] = -1
+	item.state = ItemStateDelay
+}
+
 // update after we've switched from the ready to the dependent sub-queue
 func (item *Item) switchReadyDependent() {
 	item.mutex.Lock()
@@ -414,4 +503,22 @@ func (item *Item) removalCleanup() {
 	item.queueIndexes[3] = -1
 	item.queueIndexes[4] = -1
 	item.state = ItemStateRemoved
+	if item.expiryTimer != nil {
+		item.expiryTimer.Stop()
+		item.expiryTimer = nil
+	}
+}
+
+// update after we've switched from the delay, ready or dependent sub-queue to
+// the bury sub-queue because we expired
+func (item *Item) switchExpiredBury() {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	item.queueIndexes[0] = -1
+	item.queueIndexes[1] = -1
+	item.queueIndexes[4] = -1
+	item.readyAt = time.Time{}
+	item.expiryTimer = nil
+	item.buries++
+	item.state = ItemStateBury
 }
@@ -0,0 +1,156 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// item_shards is a map of item keys to items, split across a number of
+// separately locked shards, so that looking up items (which happens on every
+// Get(), Touch() etc.) doesn't contend on a single lock when there are
+// thousands of concurrent clients. Each shard also has a lock for serialising
+// changes to the state of its items, so that changes to items in different
+// shards can happen concurrently.
+
+import (
+	"sync/atomic"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+const numItemShards = 32
+
+type itemShard struct {
+	mutex  sync.RWMutex
+	items  map[string]*Item
+	change sync.Mutex
+}
+
+type itemShards struct {
+	count  int64 // accessed atomically; first for alignment
+	shards [numItemShards]*itemShard
+}
+
+func newItemShards() *itemShards {
+	s := &itemShards{}
+	for i := range s.shards {
+		s.shards[i] = &itemShard{items: make(map[string]*Item)}
+	}
+	return s
+}
+
+// shard returns the shard that the given key belongs in, based on an FNV-1a
+// hash of the key.
+func (s *itemShards) shard(key string) *itemShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return s.shards[hash%numItemShards]
+}
+
+// lockItem locks the shard that the given key belongs in against other changes
+// to the state of its items, until you call unlockItem() with the same key.
+func (s *itemShards) lockItem(key string) {
+	s.shard(key).change.Lock()
+}
+
+// unlockItem undoes a previous lockItem() for the given key.
+func (s *itemShards) unlockItem(key string) {
+	s.shard(key).change.Unlock()
+}
+
+// get returns the item with the given key, and whether it existed.
+func (s *itemShards) get(key string) (*Item, bool) {
+	shard := s.shard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	item, exists := shard.items[key]
+	return item, exists
+}
+
+// set stores the item under the given key.
+func (s *itemShards) set(key string, item *Item) {
+	shard := s.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if _, exists := shard.items[key]; !exists {
+		atomic.AddInt64(&s.count, 1)
+	}
+	shard.items[key] = item
+}
+
+// delete removes the item with the given key.
+func (s *itemShards) delete(key string) {
+	shard := s.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if _, exists := shard.items[key]; exists {
+		atomic.AddInt64(&s.count, -1)
+		delete(shard.items, key)
+	}
+}
+
+// len tells you how many items are stored, without taking any locks.
+func (s *itemShards) len() int {
+	return int(atomic.LoadInt64(&s.count))
+}
+
+// all returns all the stored items.
+func (s *itemShards) all() []*Item {
+	items := make([]*Item, 0, s.len())
+	for _, shard := range s.shards {
+		shard.mutex.RLock()
+		for _, item := range shard.items {
+			items = append(items, item)
+		}
+		shard.mutex.RUnlock()
+	}
+	return items
+}
+
+// each calls the given function on every stored item, one shard at a time,
+// stopping early if the function returns false. Only a single shard's worth of
+// items is copied at once, and no lock is held while the function is called,
+// so the function may safely alter the shards.
+func (s *itemShards) each(fn func(*Item) bool) {
+	var items []*Item
+	for _, shard := range s.shards {
+		shard.mutex.RLock()
+		items = items[:0]
+		for _, item := range shard.items {
+			items = append(items, item)
+		}
+		shard.mutex.RUnlock()
+
+		for _, item := range items {
+			if !fn(item) {
+				return
+			}
+		}
+	}
+}
+
+// empty removes all items.
+func (s *itemShards) empty() {
+	for _, shard := range s.shards {
+		shard.mutex.Lock()
+		shard.items = make(map[string]*Item)
+		shard.mutex.Unlock()
+	}
+	atomic.StoreInt64(&s.count, 0)
+}
@@ -0,0 +1,101 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestItemShards(t *testing.T) {
+	Convey("Once 100 items have been set", t, func() {
+		shards := newItemShards()
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			shards.set(key, newItem(key, "", "data", 0, 0*time.Second, 0*time.Second))
+		}
+
+		So(shards.len(), ShouldEqual, 100)
+		So(len(shards.all()), ShouldEqual, 100)
+
+		Convey("They are spread across shards", func() {
+			used := 0
+			for _, shard := range shards.shards {
+				if len(shard.items) > 0 {
+					used++
+				}
+			}
+			So(used, ShouldBeGreaterThan, 1)
+		})
+
+		Convey("You can get them back", func() {
+			item, exists := shards.get("key_42")
+			So(exists, ShouldBeTrue)
+			So(item.Key, ShouldEqual, "key_42")
+
+			item, exists = shards.get("key_100")
+			So(exists, ShouldBeFalse)
+			So(item, ShouldBeNil)
+		})
+
+		Convey("Setting an existing key doesn't change the count", func() {
+			shards.set("key_1", newItem("key_1", "", "data2", 0, 0*time.Second, 0*time.Second))
+			So(shards.len(), ShouldEqual, 100)
+			item, _ := shards.get("key_1")
+			So(item.Data(), ShouldEqual, "data2")
+		})
+
+		Convey("Deleting works", func() {
+			shards.delete("key_1")
+			So(shards.len(), ShouldEqual, 99)
+			_, exists := shards.get("key_1")
+			So(exists, ShouldBeFalse)
+
+			shards.delete("key_1")
+			So(shards.len(), ShouldEqual, 99)
+		})
+
+		Convey("Emptying works", func() {
+			shards.empty()
+			So(shards.len(), ShouldEqual, 0)
+			So(len(shards.all()), ShouldEqual, 0)
+		})
+
+		Convey("Concurrent access is safe", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						key := fmt.Sprintf("key_%d_%d", i, j)
+						shards.set(key, newItem(key, "", "data", 0, 0*time.Second, 0*time.Second))
+						shards.get(fmt.Sprintf("key_%d", j))
+					}
+				}(i)
+			}
+			wg.Wait()
+			So(shards.len(), ShouldEqual, 1100)
+		})
+	})
+}
@@ -0,0 +1,257 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// This file contains the code for keeping metrics on how often the queue's
+// operations are called and how long they take.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op is the name of a kind of Queue operation that metrics are kept for.
+type Op string
+
+// Op* are the kinds of operation that metrics are kept for.
+const (
+	OpAdd     Op = "add"     // Add(), AddWithSize() and BulkAdd()
+	OpReserve Op = "reserve" // Reserve(), ReserveMatching() and ReserveFromGroups()
+	OpTouch   Op = "touch"   // Touch()
+	OpRelease Op = "release" // Release()
+	OpBury    Op = "bury"    // Bury()
+	OpKick    Op = "kick"    // Kick() and BulkKick()
+	OpRemove  Op = "remove"  // Remove() and BulkRemove()
+)
+
+// Ops lists every Op, in the order they're typically used in.
+var Ops = []Op{OpAdd, OpReserve, OpTouch, OpRelease, OpBury, OpKick, OpRemove}
+
+// OpLatencyBuckets are the upper bounds of the latency histogram kept for each
+// Op; there is an additional final bucket for latencies longer than the last of
+// these. Changes only affect queues made with New() afterwards.
+var OpLatencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// OpCallback is used as a callback when an operation completes. It receives
+// the kind of operation, the number of items it affected, how long it took and
+// the error it returned, if any.
+type OpCallback func(op Op, items int, latency time.Duration, err error)
+
+// OpStats holds the metrics for one Op.
+type OpStats struct {
+	// Calls is the number of times the Op was called.
+	Calls uint64
+
+	// Items is the number of items successfully affected. This can be more
+	// than Calls due to the Bulk*() methods, or fewer due to errors and
+	// Reserve()s that didn't get an item.
+	Items uint64
+
+	// Errors is the number of calls that returned an error. Reserve()s that
+	// returned ErrNothingReady are not counted as errors.
+	Errors uint64
+
+	// Latency is the total time taken by all calls. For OpReserve this
+	// includes time spent waiting for an item.
+	Latency time.Duration
+
+	// Histogram counts calls by their latency: Histogram[i] is the number of
+	// calls that took no longer than Buckets[i], with the final element
+	// counting calls that took longer than all of them.
+	Histogram []uint64
+	Buckets   []time.Duration
+}
+
+// MeanLatency returns the average time a call took.
+func (s *OpStats) MeanLatency() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Latency / time.Duration(s.Calls)
+}
+
+// OpMetrics is a snapshot of the metrics for all Ops, as returned by
+// Queue.OpMetrics().
+type OpMetrics struct {
+	Since time.Time // when metrics started to be kept
+	Taken time.Time // when this snapshot was taken
+	Ops   map[Op]*OpStats
+}
+
+// Rate returns the number of calls of the given Op per second between Since
+// and Taken.
+func (m *OpMetrics) Rate(op Op) float64 {
+	s, ok := m.Ops[op]
+	elapsed := m.Taken.Sub(m.Since).Seconds()
+	if !ok || elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Calls) / elapsed
+}
+
+// ItemRate is like Rate(), but returns the number of items affected per
+// second, which will differ from Rate() when using the Bulk*() methods.
+func (m *OpMetrics) ItemRate(op Op) float64 {
+	s, ok := m.Ops[op]
+	elapsed := m.Taken.Sub(m.Since).Seconds()
+	if !ok || elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Items) / elapsed
+}
+
+// Sub returns the metrics for the period between an earlier snapshot and this
+// one, so that you can get rates over a recent window of time instead of the
+// lifetime of the queue.
+func (m *OpMetrics) Sub(earlier *OpMetrics) *OpMetrics {
+	diff := &OpMetrics{Since: earlier.Taken, Taken: m.Taken, Ops: make(map[Op]*OpStats, len(m.Ops))}
+	for op, s := range m.Ops {
+		d := &OpStats{
+			Calls:     s.Calls,
+			Items:     s.Items,
+			Errors:    s.Errors,
+			Latency:   s.Latency,
+			Histogram: make([]uint64, len(s.Histogram)),
+			Buckets:   s.Buckets,
+		}
+		copy(d.Histogram, s.Histogram)
+		if e, ok := earlier.Ops[op]; ok {
+			d.Calls -= e.Calls
+			d.Items -= e.Items
+			d.Errors -= e.Errors
+			d.Latency -= e.Latency
+			for i := range d.Histogram {
+				if i < len(e.Histogram) {
+					d.Histogram[i] -= e.Histogram[i]
+				}
+			}
+		}
+		diff.Ops[op] = d
+	}
+	return diff
+}
+
+// opCounters holds the live counts for an Op, which are updated atomically.
+type opCounters struct {
+	calls     uint64
+	items     uint64
+	errors    uint64
+	latency   int64
+	histogram []uint64
+}
+
+// opMetrics holds the opCounters of every Op. The map is never altered after
+// creation, so needs no lock.
+type opMetrics struct {
+	since    time.Time
+	buckets  []time.Duration
+	counters map[Op]*opCounters
+	cb       OpCallback
+	cbMutex  sync.RWMutex
+}
+
+// newOpMetrics creates an opMetrics using the current OpLatencyBuckets.
+func newOpMetrics() *opMetrics {
+	buckets := make([]time.Duration, len(OpLatencyBuckets))
+	copy(buckets, OpLatencyBuckets)
+	m := &opMetrics{
+		since:    time.Now(),
+		buckets:  buckets,
+		counters: make(map[Op]*opCounters, len(Ops)),
+	}
+	for _, op := range Ops {
+		m.counters[op] = &opCounters{histogram: make([]uint64, len(buckets)+1)}
+	}
+	return m
+}
+
+// SetOpCallback sets a callback that will be called every time one of the
+// operations listed under Ops completes. The callback is called synchronously,
+// so should be quick; nil stops callbacks.
+func (queue *Queue) SetOpCallback(callback OpCallback) {
+	queue.opMetrics.cbMutex.Lock()
+	defer queue.opMetrics.cbMutex.Unlock()
+	queue.opMetrics.cb = callback
+}
+
+// OpMetrics returns a snapshot of the metrics kept on the queue's operations
+// since it was created.
+func (queue *Queue) OpMetrics() *OpMetrics {
+	m := queue.opMetrics
+	snapshot := &OpMetrics{Since: m.since, Taken: time.Now(), Ops: make(map[Op]*OpStats, len(m.counters))}
+	for op, c := range m.counters {
+		s := &OpStats{
+			Calls:     atomic.LoadUint64(&c.calls),
+			Items:     atomic.LoadUint64(&c.items),
+			Errors:    atomic.LoadUint64(&c.errors),
+			Latency:   time.Duration(atomic.LoadInt64(&c.latency)),
+			Histogram: make([]uint64, len(c.histogram)),
+			Buckets:   m.buckets,
+		}
+		for i := range c.histogram {
+			s.Histogram[i] = atomic.LoadUint64(&c.histogram[i])
+		}
+		snapshot.Ops[op] = s
+	}
+	return snapshot
+}
+
+// recordOp records that an operation started at the given time has just
+// completed, affecting the given number of items if err is nil, and calls any
+// OpCallback.
+func (queue *Queue) recordOp(op Op, start time.Time, items int, err error) {
+	latency := time.Since(start)
+	m := queue.opMetrics
+	c := m.counters[op]
+	atomic.AddUint64(&c.calls, 1)
+	atomic.AddInt64(&c.latency, int64(latency))
+
+	if err != nil {
+		items = 0
+		if qerr, ok := err.(Error); !ok || qerr.Err != ErrNothingReady {
+			atomic.AddUint64(&c.errors, 1)
+		}
+	}
+	atomic.AddUint64(&c.items, uint64(items))
+
+	bucket := len(m.buckets)
+	for i, bound := range m.buckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddUint64(&c.histogram[bucket], 1)
+
+	m.cbMutex.RLock()
+	cb := m.cb
+	m.cbMutex.RUnlock()
+	if cb != nil {
+		cb(op, items, latency, err)
+	}
+}
@@ -31,11 +31,15 @@ sub-queues:
 Items start in the delay queue. After the item's delay time, they automatically
 move to the ready queue. From there you can Reserve() an item to get the highest
 priority (or for those with equal priority, the oldest - fifo) one which
-switches it from the ready queue to the run queue. Items can also have
-dependencies, in which case they start in the dependency queue and only move to
-the ready queue (bypassing the delay queue) once all its dependencies have been
-Remove()d from the queue. Items can also belong to a reservation group, in which
-case you can Reserve() an item in a desired group.
+switches it from the ready queue to the run queue. (You can change that order
+using SetReadyOrder(), and hold items back from being reserved, eg. outside of
+certain times, using SetHold(), or only reserve items that suit you using
+ReserveMatching().) Items can also have dependencies, in which
+case they start in the dependency queue and only move to the ready queue
+(bypassing the delay queue) once all its dependencies have been Remove()d from
+the queue (or just some of them; see SetDependencyCount()). Items can also
+belong to a reservation group, in which case you can Reserve() an item in a
+desired group.
 
 In the run queue the item starts a time-to-release (ttr) countdown; when that
 runs out the item is placed back on the ready queue. This is to handle a
@@ -47,7 +51,21 @@ with the item successfully), Touch() it to give yourself more time to handle the
 item, or you Bury() the item (the item can't be dealt with until the user takes
 some action). When you know you have a transient problem preventing you from
 handling the item right now, you can manually Release() the item back to the
-delay queue.
+delay queue. How long it stays there can be decided with SetBackoff().
+
+If you want to give up on items that don't get Reserve()d in time, use
+SetExpiry(); such items are moved to the bury queue when they expire, and you
+can be told about it with SetExpiryCallback().
+
+To be told whenever items move between sub-queues, use SetChangedCallback(),
+or for multiple independent listeners, Subscribe() or SubscribeChannel().
+
+You can temporarily stop Reserve() from returning any items with Pause(),
+while still adding and inspecting items, until you call Resume().
+
+To see how often operations like Add() and Reserve() are called and how long
+they take, get a snapshot with OpMetrics(), or be told about each call with
+SetOpCallback().
 
     import "github.com/VertebrateResequencing/wr/queue"
     q = queue.New("myQueue")
@@ -86,6 +104,8 @@ package queue
 
 import (
 	"errors"
+	"runtime"
+	"sync/atomic"
 	"time"
 
 	sync "github.com/sasha-s/go-deadlock"
@@ -118,6 +138,7 @@ var (
 	ErrNotReady      = errors.New("not ready")
 	ErrNotRunning    = errors.New("not running")
 	ErrNotBuried     = errors.New("not buried")
+	ErrQueuePaused   = errors.New("queue paused")
 )
 
 // Error records an error and the operation, item and queue that caused it.
@@ -159,10 +180,12 @@ var defaultTTRCallback = func(data interface{}) SubQueue {
 // automatically depending on their delay or ttr expiring, or manually by
 // calling certain methods.
 type Queue struct {
+	changeSeq              uint64 // accessed atomically; incremented after every change
+	changing               int64  // accessed atomically; number of changes in progress
 	delayTime              time.Time
 	ttrTime                time.Time
 	Name                   string
-	items                  map[string]*Item
+	items                  *itemShards
 	dependants             map[string]map[string]*Item
 	delayQueue             *subQueue
 	readyQueue             *subQueue
@@ -178,11 +201,19 @@ type Queue struct {
 	readyAddedCb           ReadyAddedCallback
 	changedCb              ChangedCallback
 	ttrCb                  TTRCallback
+	expiryCb               ExpiryCallback
+	backoff                Backoff
+	hold                   Hold
+	subscriptions          map[uint64]*subscription
+	subscriptionsMutex     sync.RWMutex
+	subscriptionID         uint64 // accessed atomically
 	mutex                  sync.RWMutex
 	readyAddedCbMutex      sync.Mutex
-	closed                 bool
+	closed                 uint32 // accessed atomically, see isClosed()
+	paused                 uint32 // accessed atomically, see IsPaused()
 	readyAddedCbRunning    bool
 	readyAddedCbRecall     bool
+	opMetrics              *opMetrics
 	log15.Logger
 }
 
@@ -196,7 +227,7 @@ type Stats struct {
 	Dependant int
 }
 
-// ItemDef makes it possible to supply a slice of Add() args to AddMany().
+// ItemDef makes it possible to supply a slice of Add() args to BulkAdd().
 type ItemDef struct {
 	Key          string
 	ReserveGroup string
@@ -219,7 +250,7 @@ func New(name string, logger ...log15.Logger) *Queue {
 	}
 	queue := &Queue{
 		Name:                   name,
-		items:                  make(map[string]*Item),
+		items:                  newItemShards(),
 		dependants:             make(map[string]map[string]*Item),
 		delayQueue:             newSubQueue(0, l),
 		readyQueue:             newSubQueue(1, l),
@@ -235,6 +266,9 @@ func New(name string, logger ...log15.Logger) *Queue {
 		delayClose:             make(chan bool, 1),
 		delayTime:              time.Now(),
 		ttrCb:                  defaultTTRCallback,
+		backoff:                ItemDelayBackoff,
+		subscriptions:          make(map[uint64]*subscription),
+		opMetrics:              newOpMetrics(),
 		Logger:                 l,
 	}
 	go queue.startDelayProcessing()
@@ -280,14 +314,10 @@ func (queue *Queue) readyAdded() {
 		queue.readyAddedCbMutex.Unlock()
 
 		go func() {
-			queue.mutex.RLock()
 			var data []interface{}
-			for _, il := range queue.readyQueue.groupedItems {
-				for _, item := range il {
-					data = append(data, item.Data())
-				}
+			for _, item := range queue.readyItemsNotHeld() {
+				data = append(data, item.Data())
 			}
-			queue.mutex.RUnlock()
 			queue.Debug("new ready items, triggering callback")
 			queue.readyAddedCb(queue.Name, data)
 
@@ -313,15 +343,26 @@ func (queue *Queue) SetChangedCallback(callback ChangedCallback) {
 }
 
 // changed checks if a changedCallback has been set, and if so calls it in a go
-// routine.
+// routine. It also tells any matching subscribers about the change.
 func (queue *Queue) changed(from, to SubQueue, items []*Item) {
+	subs := queue.subscribersFor(from, to)
+	if queue.changedCb == nil && len(subs) == 0 {
+		return
+	}
+
+	var data []interface{}
+	for _, item := range items {
+		data = append(data, item.Data())
+	}
 	if queue.changedCb != nil {
-		var data []interface{}
-		for _, item := range items {
-			data = append(data, item.Data())
-		}
 		go queue.changedCb(from, to, data)
 	}
+	if len(subs) > 0 {
+		t := &Transition{From: from, To: to, Data: data}
+		for _, sub := range subs {
+			sub.deliver(t)
+		}
+	}
 }
 
 // SetTTRCallback sets a callback that will be called when an item in the run
@@ -329,41 +370,178 @@ func (queue *Queue) changed(from, to SubQueue, items []*Item) {
 // return the sub-queue the item should be moved to. If you don't set this, the
 // default will be to move all items to the ready sub-queue.
 func (queue *Queue) SetTTRCallback(callback TTRCallback) {
-	queue.mutex.Lock()
-	defer queue.mutex.Unlock()
+	queue.lock()
+	defer queue.unlock()
 	queue.ttrCb = callback
 }
 
+// SetReadyOrder sets the function that decides the order in which items in
+// the ready sub-queue get Reserve()d. Items already in the ready sub-queue are
+// reordered. If you don't set this, the default is OrderPriority.
+func (queue *Queue) SetReadyOrder(order ReadyOrder) {
+	queue.lock()
+	defer queue.unlock()
+	if order == nil {
+		order = OrderPriority
+	}
+	queue.readyQueue.setOrder(order)
+}
+
 // Destroy shuts down a queue, destroying any contents. You can't do anything
 // useful with it after that.
 func (queue *Queue) Destroy() error {
-	queue.mutex.Lock()
-	defer queue.mutex.Unlock()
+	queue.lock()
+	defer queue.unlock()
 
-	if queue.closed {
+	if queue.isClosed() {
 		return Error{queue.Name, "Destroy", "", ErrQueueClosed}
 	}
 
 	queue.ttrClose <- true
 	queue.delayClose <- true
-	queue.items = nil
+	queue.items.empty()
 	queue.delayQueue.empty()
 	queue.readyQueue.empty()
 	queue.runQueue.empty()
 	queue.buryQueue.empty()
 	queue.depQueue.empty()
-	queue.closed = true
+	atomic.StoreUint32(&queue.closed, 1)
+	queue.unsubscribeAll()
 	return nil
 }
 
+// Pause stops Reserve() from returning any items until Resume() is called.
+// Everything else continues to work as normal: you can still add items,
+// inspect the queue, and items will still move between sub-queues as their
+// delays and ttrs expire.
+func (queue *Queue) Pause() error {
+	queue.lock()
+	defer queue.unlock()
+	if queue.isClosed() {
+		return Error{queue.Name, "Pause", "", ErrQueueClosed}
+	}
+	atomic.StoreUint32(&queue.paused, 1)
+	return nil
+}
+
+// Resume undoes a previous Pause(), letting Reserve() return items again. Any
+// Reserve() calls that were waiting for items are woken if there are now items
+// ready for them, and if there are any ready items the ReadyAddedCallback is
+// called.
+func (queue *Queue) Resume() error {
+	queue.lock()
+	if queue.isClosed() {
+		queue.unlock()
+		return Error{queue.Name, "Resume", "", ErrQueueClosed}
+	}
+	if !atomic.CompareAndSwapUint32(&queue.paused, 1, 0) {
+		queue.unlock()
+		return nil
+	}
+	queue.readyQueue.notifyReady()
+	ready := queue.readyQueue.len() > 0
+	queue.unlock()
+
+	if ready {
+		queue.readyAdded()
+	}
+	return nil
+}
+
+// IsPaused tells you if Pause() has been called without a subsequent
+// Resume().
+func (queue *Queue) IsPaused() bool {
+	return atomic.LoadUint32(&queue.paused) == 1
+}
+
+// isClosed tells you if Destroy() has been called, without needing the mutex
+// lock.
+func (queue *Queue) isClosed() bool {
+	return atomic.LoadUint32(&queue.closed) == 1
+}
+
+// statsMaxSpins is how many times Stats() will look for a moment when no
+// changes are in progress, before giving up and stopping changes while it
+// counts.
+const statsMaxSpins = 100
+
+// lock takes the write lock on the queue, for changes that involve more than
+// one item or the queue as a whole, marking the start of a change to its
+// contents for the benefit of Stats().
+func (queue *Queue) lock() {
+	queue.mutex.Lock()
+	atomic.AddInt64(&queue.changing, 1)
+}
+
+// unlock marks the end of a change to the queue's contents and releases the
+// write lock.
+func (queue *Queue) unlock() {
+	atomic.AddUint64(&queue.changeSeq, 1)
+	atomic.AddInt64(&queue.changing, -1)
+	queue.mutex.Unlock()
+}
+
+// lockShared takes the read lock on the queue, for changes to the state of
+// individual items, which must be made while also holding the item lock for
+// that item's key (see itemShards.lockItem()). Such changes to items in
+// different shards can happen concurrently. It marks the start of a change to
+// the queue's contents for the benefit of Stats().
+func (queue *Queue) lockShared() {
+	queue.mutex.RLock()
+	atomic.AddInt64(&queue.changing, 1)
+}
+
+// unlockShared marks the end of a change to the queue's contents and releases
+// the read lock.
+func (queue *Queue) unlockShared() {
+	atomic.AddUint64(&queue.changeSeq, 1)
+	atomic.AddInt64(&queue.changing, -1)
+	queue.mutex.RUnlock()
+}
+
+// lockKey is lockShared() followed by locking the item lock for the given key.
+func (queue *Queue) lockKey(key string) {
+	queue.lockShared()
+	queue.items.lockItem(key)
+}
+
+// unlockKey undoes a previous lockKey() for the given key.
+func (queue *Queue) unlockKey(key string) {
+	queue.items.unlockItem(key)
+	queue.unlockShared()
+}
+
 // Stats returns information about the number of items in the queue and each
-// sub-queue.
+// sub-queue. It normally takes no locks, so is cheap to call frequently even
+// while many other goroutines are Reserve()ing and Touch()ing items. The counts
+// are consistent with each other: if a change to the queue is in progress, we
+// wait for it to complete. If the queue is so busy that there's never a moment
+// without a change in progress, we stop changes from happening while we count.
 func (queue *Queue) Stats() *Stats {
-	queue.mutex.RLock()
-	defer queue.mutex.RUnlock()
+	for i := 0; i < statsMaxSpins; i++ {
+		seq := atomic.LoadUint64(&queue.changeSeq)
+		if atomic.LoadInt64(&queue.changing) > 0 {
+			runtime.Gosched()
+			continue
+		}
 
+		stats := queue.counts()
+
+		if atomic.LoadInt64(&queue.changing) == 0 && atomic.LoadUint64(&queue.changeSeq) == seq {
+			return stats
+		}
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.counts()
+}
+
+// counts returns the current number of items in the queue and each sub-queue,
+// for Stats().
+func (queue *Queue) counts() *Stats {
 	return &Stats{
-		Items:     len(queue.items),
+		Items:     queue.items.len(),
 		Delayed:   queue.delayQueue.len(),
 		Ready:     queue.readyQueue.len(),
 		Running:   queue.runQueue.len(),
@@ -400,11 +578,13 @@ func (queue *Queue) Stats() *Stats {
 //
 // Add() returns an item, which may have already existed (in which case, nothing
 // was actually added or changed).
-func (queue *Queue) Add(key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration, startQueue SubQueue, deps ...[]string) (*Item, error) {
-	queue.mutex.Lock()
-	item, err := queue.newItemForAdd(key, reserveGroup, data, priority, 0, delay, ttr)
+func (queue *Queue) Add(key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration, startQueue SubQueue, deps ...[]string) (item *Item, err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpAdd, start, 1, err) }()
+	queue.lock()
+	item, err = queue.newItemForAdd(key, reserveGroup, data, priority, 0, delay, ttr)
 	if err != nil {
-		queue.mutex.Unlock()
+		queue.unlock()
 		return item, err
 	}
 	queue.handleItemForAdd(item, startQueue, delay, deps...)
@@ -414,18 +594,18 @@ func (queue *Queue) Add(key string, reserveGroup string, data interface{}, prior
 // newItemForAdd prepares a new item for Add() and AddWithSize() methods. You
 // must hold the mutex lock before calling this.
 func (queue *Queue) newItemForAdd(key string, reserveGroup string, data interface{}, priority uint8, size uint8, delay time.Duration, ttr time.Duration) (*Item, error) {
-	if queue.closed {
+	if queue.isClosed() {
 		return nil, Error{queue.Name, "Add", key, ErrQueueClosed}
 	}
 
-	item, existed := queue.items[key]
+	item, existed := queue.items.get(key)
 	if existed {
 		return item, Error{queue.Name, "Add", key, ErrAlreadyExists}
 	}
 
 	item = newItem(key, reserveGroup, data, priority, delay, ttr)
 	item.size = size
-	queue.items[key] = item
+	queue.items.set(key, item)
 	return item, nil
 }
 
@@ -435,7 +615,7 @@ func (queue *Queue) handleItemForAdd(item *Item, startQueue SubQueue, delay time
 	// check dependencies
 	if len(deps) == 1 && len(deps[0]) > 0 {
 		queue.setItemDependencies(item, deps[0])
-		queue.mutex.Unlock()
+		queue.unlock()
 		queue.changed(SubQueueNew, SubQueueDependent, []*Item{item})
 		return
 	}
@@ -446,26 +626,26 @@ func (queue *Queue) handleItemForAdd(item *Item, startQueue SubQueue, delay time
 		item.touch()
 		queue.runQueue.push(item)
 		item.switchReadyRun()
-		queue.mutex.Unlock()
+		queue.unlock()
 		queue.ttrNotificationTrigger(item)
 		queue.changed(SubQueueNew, SubQueueRun, []*Item{item})
 	case SubQueueBury:
 		item.switchDelayReady()
 		queue.buryQueue.push(item)
 		item.switchRunBury()
-		queue.mutex.Unlock()
+		queue.unlock()
 		queue.changed(SubQueueNew, SubQueueBury, []*Item{item})
 	default:
 		if delay.Nanoseconds() == 0 {
 			// put it directly on the ready queue
 			item.switchDelayReady()
 			queue.readyQueue.push(item)
-			queue.mutex.Unlock()
+			queue.unlock()
 			queue.changed(SubQueueNew, SubQueueReady, []*Item{item})
 			queue.readyAdded()
 		} else {
 			queue.delayQueue.push(item)
-			queue.mutex.Unlock()
+			queue.unlock()
 			queue.changed(SubQueueNew, SubQueueDelay, []*Item{item})
 			queue.delayNotificationTrigger(item)
 		}
@@ -476,11 +656,13 @@ func (queue *Queue) handleItemForAdd(item *Item, startQueue SubQueue, delay time
 // Size alters the way priority is handled. For items with the same priority,
 // the next to be Reserve()d will be the item with the highest size. If they
 // also have the same size, then they will be Reserve()d in fifo order.
-func (queue *Queue) AddWithSize(key string, reserveGroup string, data interface{}, priority uint8, size uint8, delay time.Duration, ttr time.Duration, startQueue SubQueue, deps ...[]string) (*Item, error) {
-	queue.mutex.Lock()
-	item, err := queue.newItemForAdd(key, reserveGroup, data, priority, size, delay, ttr)
+func (queue *Queue) AddWithSize(key string, reserveGroup string, data interface{}, priority uint8, size uint8, delay time.Duration, ttr time.Duration, startQueue SubQueue, deps ...[]string) (item *Item, err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpAdd, start, 1, err) }()
+	queue.lock()
+	item, err = queue.newItemForAdd(key, reserveGroup, data, priority, size, delay, ttr)
 	if err != nil {
-		queue.mutex.Unlock()
+		queue.unlock()
 		return item, err
 	}
 	queue.handleItemForAdd(item, startQueue, delay, deps...)
@@ -512,26 +694,83 @@ func (queue *Queue) setQueueDeps(item *Item) {
 }
 
 // itemHasDeps returns true if the item has unresolved dependencies according
-// to the queue's lookup of parent items to their dependent children.
+// to the queue's lookup of parent items to their dependent children, taking
+// in to account any DependencyCount().
 func (queue *Queue) itemHasDeps(item *Item) bool {
-	for _, dep := range item.Dependencies() {
-		if _, exists := queue.items[dep]; exists {
-			return true
+	deps := item.Dependencies()
+	needed := item.DependencyCount()
+	present := 0
+	for _, dep := range deps {
+		if _, exists := queue.items.get(dep); exists {
+			if needed == 0 {
+				return true
+			}
+			present++
 		}
 	}
-	return false
+	return needed > 0 && len(deps)-present < needed
 }
 
-// AddMany is like Add(), except that you supply a slice of *ItemDef, and it
+// SetDependencyCount is a thread-safe way to say that the item with the given
+// key only needs n of its dependencies to be Remove()d from the queue before
+// it becomes ready, instead of all of them. This lets you have an item depend
+// on, say, any 3 of a group of 10 other items completing.
+//
+// n of 0 (or greater than or equal to the number of dependencies) means all
+// dependencies are needed, as normal. The count applies to the dependencies
+// the item has right now, so if you later change its dependencies with
+// Update(), the count is reset to 0 and you must set it again.
+//
+// If the item is in the dependent sub-queue and enough of its dependencies
+// have already been resolved, it is moved to the ready sub-queue.
+func (queue *Queue) SetDependencyCount(key string, n int) error {
+	queue.lock()
+
+	if queue.isClosed() {
+		queue.unlock()
+		return Error{queue.Name, "SetDependencyCount", key, ErrQueueClosed}
+	}
+
+	item, exists := queue.items.get(key)
+	if !exists {
+		queue.unlock()
+		return Error{queue.Name, "SetDependencyCount", key, ErrNotFound}
+	}
+
+	if !item.setDependencyCount(n) {
+		queue.unlock()
+		return nil
+	}
+
+	queue.depQueue.remove(item)
+	item.switchDependentReady()
+	queue.readyQueue.push(item)
+	queue.unlock()
+	queue.changed(SubQueueDependent, SubQueueReady, []*Item{item})
+	queue.readyAdded()
+	return nil
+}
+
+// AddMany is the old name for BulkAdd(), retained for compatibility.
+func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
+	return queue.BulkAdd(items)
+}
+
+// BulkAdd is like Add(), except that you supply a slice of *ItemDef, and it
 // returns the number that were actually added and the number of items that were
 // not added because they were duplicates of items already in the queue. If an
 // error occurs, nothing will have been added.
-func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
-	queue.mutex.Lock()
+//
+// This is much faster than calling Add() for each item, since the queue is
+// only locked once, and callbacks are only triggered once.
+func (queue *Queue) BulkAdd(items []*ItemDef) (added, dups int, err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpAdd, start, added, err) }()
+	queue.lock()
 
-	if queue.closed {
-		queue.mutex.Unlock()
-		return 0, 0, Error{queue.Name, "AddMany", "", ErrQueueClosed}
+	if queue.isClosed() {
+		queue.unlock()
+		return 0, 0, Error{queue.Name, "BulkAdd", "", ErrQueueClosed}
 	}
 
 	deferredDelayTrigger := false
@@ -542,14 +781,14 @@ func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
 	var addedRunItems []*Item
 	var addedBuryItems []*Item
 	for _, def := range items {
-		_, existed := queue.items[def.Key]
+		_, existed := queue.items.get(def.Key)
 		if existed {
 			dups++
 			continue
 		}
 
 		item := newItem(def.Key, def.ReserveGroup, def.Data, def.Priority, def.Delay, def.TTR)
-		queue.items[def.Key] = item
+		queue.items.set(def.Key, item)
 
 		if len(def.Dependencies) > 0 {
 			queue.setItemDependencies(item, def.Dependencies)
@@ -592,7 +831,7 @@ func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
 		added++
 	}
 
-	queue.mutex.Unlock()
+	queue.unlock()
 	if len(addedReadyItems) > 0 {
 		queue.changed(SubQueueNew, SubQueueReady, addedReadyItems)
 		queue.readyAdded()
@@ -615,14 +854,11 @@ func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
 
 // Get is a thread-safe way to get an item by the key you used to Add() it.
 func (queue *Queue) Get(key string) (*Item, error) {
-	queue.mutex.RLock()
-	defer queue.mutex.RUnlock()
-
-	if queue.closed {
+	if queue.isClosed() {
 		return nil, Error{queue.Name, "Get", key, ErrQueueClosed}
 	}
 
-	item, exists := queue.items[key]
+	item, exists := queue.items.get(key)
 	if !exists {
 		return nil, Error{queue.Name, "Get", key, ErrNotFound}
 	}
@@ -644,13 +880,17 @@ func (queue *Queue) GetRunningData() []interface{} {
 // AllItems returns the items in the queue. NB: You should NOT do anything
 // to these items - use for read-only purposes.
 func (queue *Queue) AllItems() []*Item {
-	queue.mutex.RLock()
-	defer queue.mutex.RUnlock()
-	items := make([]*Item, 0, len(queue.items))
-	for _, item := range queue.items {
-		items = append(items, item)
-	}
-	return items
+	return queue.items.all()
+}
+
+// Each calls the given function on every item in the queue, in no particular
+// order, until the function returns false. It is like looping over AllItems(),
+// but without making a slice of every item first or holding any lock for
+// long, so is much lighter on huge queues. The function may call other Queue
+// methods, but items added or removed during the walk may or may not be
+// visited. As with AllItems(), use the items for read-only purposes.
+func (queue *Queue) Each(fn func(item *Item) bool) {
+	queue.items.each(fn)
 }
 
 // Update is a thread-safe way to change the data, ReserveGroup, priority, delay,
@@ -661,16 +901,16 @@ func (queue *Queue) AllItems() []*Item {
 // item.UnresolvedDependencies()), and then calling item.Stats() to get
 // stats.Priority, stats.Delay and stats.TTR.
 func (queue *Queue) Update(key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration, deps ...[]string) error {
-	queue.mutex.Lock()
+	queue.lock()
 
-	if queue.closed {
-		queue.mutex.Unlock()
+	if queue.isClosed() {
+		queue.unlock()
 		return Error{queue.Name, "Update", key, ErrQueueClosed}
 	}
 
-	item, exists := queue.items[key]
+	item, exists := queue.items.get(key)
 	if !exists {
-		queue.mutex.Unlock()
+		queue.unlock()
 		return Error{queue.Name, "Update", key, ErrNotFound}
 	}
 
@@ -698,7 +938,7 @@ func (queue *Queue) Update(key string, reserveGroup string, data interface{}, pr
 		if len(toRemove) > 0 || newDeps > 0 {
 			// remove any invalid dependencies from our lookup
 			for _, dep := range toRemove {
-				if _, exists := queue.items[dep]; exists {
+				if _, exists := queue.items.get(dep); exists {
 					delete(queue.dependants[dep], key)
 					if len(queue.dependants[dep]) == 0 {
 						delete(queue.dependants, dep)
@@ -783,11 +1023,11 @@ func (queue *Queue) Update(key string, reserveGroup string, data interface{}, pr
 	}
 
 	if addedReady {
-		queue.mutex.Unlock()
+		queue.unlock()
 		queue.readyAdded()
 		queue.changed(SubQueueDependent, SubQueueReady, []*Item{item})
 	} else {
-		queue.mutex.Unlock()
+		queue.unlock()
 	}
 
 	if changedFrom != "" {
@@ -802,24 +1042,24 @@ func (queue *Queue) Update(key string, reserveGroup string, data interface{}, pr
 // continue to work). If an item already exists in the queue with the new key,
 // this will fail.
 func (queue *Queue) ChangeKey(old, new string) error {
-	queue.mutex.Lock()
-	defer queue.mutex.Unlock()
+	queue.lock()
+	defer queue.unlock()
 
-	if queue.closed {
+	if queue.isClosed() {
 		return Error{queue.Name, "ChangeKey", old, ErrQueueClosed}
 	}
 
-	if _, exists := queue.items[new]; exists {
+	if _, exists := queue.items.get(new); exists {
 		return Error{queue.Name, "ChangeKey", new, ErrAlreadyExists}
 	}
 
-	item, exists := queue.items[old]
+	item, exists := queue.items.get(old)
 	if !exists {
 		return Error{queue.Name, "ChangeKey", old, ErrNotFound}
 	}
 
-	delete(queue.items, old)
-	queue.items[new] = item
+	queue.items.delete(old)
+	queue.items.set(new, item)
 
 	if val, exists := queue.dependants[old]; exists {
 		delete(queue.dependants, old)
@@ -833,7 +1073,7 @@ func (queue *Queue) ChangeKey(old, new string) error {
 		}
 	}
 
-	for _, item := range queue.items {
+	for _, item := range queue.items.all() {
 		item.ChangedKey(old, new)
 	}
 
@@ -842,15 +1082,15 @@ func (queue *Queue) ChangeKey(old, new string) error {
 
 // SetDelay is a thread-safe way to change the delay of an item.
 func (queue *Queue) SetDelay(key string, delay time.Duration) error {
-	queue.mutex.Lock()
-	if queue.closed {
-		queue.mutex.Unlock()
+	queue.lock()
+	if queue.isClosed() {
+		queue.unlock()
 		return Error{queue.Name, "SetDelay", key, ErrQueueClosed}
 	}
 
-	item, exists := queue.items[key]
+	item, exists := queue.items.get(key)
 	if !exists {
-		queue.mutex.Unlock()
+		queue.unlock()
 		return Error{queue.Name, "SetDelay", key, ErrNotFound}
 	}
 
@@ -861,27 +1101,27 @@ func (queue *Queue) SetDelay(key string, delay time.Duration) error {
 			item.mutex.Unlock()
 			item.restart()
 			queue.delayQueue.update(item)
-			queue.mutex.Unlock()
+			queue.unlock()
 			queue.delayNotificationTrigger(item)
 			return nil
 		}
 	}
 	item.mutex.Unlock()
-	queue.mutex.Unlock()
+	queue.unlock()
 	return nil
 }
 
 // SetReserveGroup is a thread-safe way to change the ReserveGroup of an item.
 func (queue *Queue) SetReserveGroup(key string, newGroup string) error {
-	queue.mutex.Lock()
-	if queue.closed {
-		queue.mutex.Unlock()
+	queue.lock()
+	if queue.isClosed() {
+		queue.unlock()
 		return Error{queue.Name, "SetReserveGroup", key, ErrQueueClosed}
 	}
 
-	item, exists := queue.items[key]
+	item, exists := queue.items.get(key)
 	if !exists {
-		queue.mutex.Unlock()
+		queue.unlock()
 		return Error{queue.Name, "SetReserveGroup", key, ErrNotFound}
 	}
 
@@ -898,7 +1138,7 @@ func (queue *Queue) SetReserveGroup(key string, newGroup string) error {
 	} else {
 		item.mutex.Unlock()
 	}
-	queue.mutex.Unlock()
+	queue.unlock()
 	return nil
 }
 
@@ -916,6 +1156,9 @@ func (queue *Queue) SetReserveGroup(key string, newGroup string) error {
 // this time there is still nothing in the ready sub-queue, no item and a
 // ErrNothingReady error is returned.
 //
+// While the queue is Pause()d, we wait for up to the wait time for the queue to
+// be Resume()d, returning an ErrQueuePaused error if it isn't.
+//
 // You need to Remove() the item when you're done with it. If you're still doing
 // something and ttr is approaching, Touch() it, otherwise it will be assumed
 // you died and the item will be released back to the ready sub-queue
@@ -924,71 +1167,161 @@ func (queue *Queue) SetReserveGroup(key string, newGroup string) error {
 // able to later, you can manually call Release(), which moves it to the delay
 // sub-queue.
 func (queue *Queue) Reserve(reserveGroup string, wait time.Duration) (*Item, error) {
-	queue.mutex.Lock()
+	return queue.ReserveMatching(reserveGroup, wait, nil)
+}
+
+// ReserveMatching is like Reserve(), but you only get an item that the given
+// match function accepts. Items it doesn't accept remain in the ready sub-queue
+// for other callers to Reserve(). If match is nil, this is the same as
+// Reserve().
+func (queue *Queue) ReserveMatching(reserveGroup string, wait time.Duration, match Match) (*Item, error) {
+	return queue.ReserveFromGroups([]string{reserveGroup}, wait, match)
+}
 
-	if queue.closed {
-		queue.mutex.Unlock()
+// ReserveFromGroups is like ReserveMatching(), but you get an item from any of
+// the given reserve groups, preferring groups earlier in the slice. While
+// waiting, an item being pushed to any of the groups will be considered.
+func (queue *Queue) ReserveFromGroups(reserveGroups []string, wait time.Duration, match Match) (*Item, error) {
+	return queue.ReserveFiltered(reserveGroups, wait, nil, match)
+}
+
+// ReserveFiltered is like ReserveFromGroups(), but you only get an item from a
+// fair group (see SetFairGroup()) that the given filter accepts. Fair groups it
+// doesn't accept are skipped without considering their other items, so unlike
+// a Match that rejects many items, the cost of a Filter only depends on how
+// many fair groups it rejects. If filter is nil, this is the same as
+// ReserveFromGroups().
+func (queue *Queue) ReserveFiltered(reserveGroups []string, wait time.Duration, filter Filter, match Match) (item *Item, err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpReserve, start, 1, err) }()
+	queue.lockShared()
+
+	if queue.isClosed() {
+		queue.unlockShared()
 		return nil, Error{queue.Name, "Reserve", "", ErrQueueClosed}
 	}
 
+	if len(reserveGroups) == 0 {
+		queue.unlockShared()
+		return nil, Error{queue.Name, "Reserve", "", ErrNothingReady}
+	}
+
+	deadline := time.Now().Add(wait)
+	if err := queue.waitWhilePaused(reserveGroups[0], deadline); err != nil {
+		return nil, err
+	}
+	wait = time.Until(deadline)
+
 	// pop an item from the ready queue and add it to the run queue
-	item := queue.readyQueue.pop(reserveGroup)
-	if item == nil {
-		if wait > 0 {
-			ch := make(chan bool, 1)
-			queue.readyQueue.notifyPush(reserveGroup, ch, wait)
-			queue.mutex.Unlock()
-
-			// wait until something is pushed to the ready queue or we hit the
-			// timeout
-			tryAgain := <-ch
-			if tryAgain {
-				queue.mutex.Lock()
-				item = queue.readyQueue.pop(reserveGroup)
-				if item == nil {
-					queue.mutex.Unlock()
-				}
-			}
-		} else {
-			queue.mutex.Unlock()
+	item, held, _ := queue.popReadyFromGroups(reserveGroups, filter, match)
+	defer func() {
+		queue.heldItemsMoved(held)
+	}()
+	for item == nil {
+		if wait <= 0 {
+			queue.unlockShared()
+			return item, Error{queue.Name, "Reserve", "", ErrNothingReady}
 		}
 
-		if item == nil {
+		// each group will send on ch exactly once, so it is buffered to never
+		// block them
+		ch := make(chan bool, len(reserveGroups))
+		for _, group := range reserveGroups {
+			queue.readyQueue.notifyPush(group, ch, wait)
+		}
+		queue.unlockShared()
+
+		// held items must get their delays started before we wait, since they
+		// might be what we end up waiting for
+		queue.heldItemsMoved(held)
+		held = nil
+
+		// wait until something is pushed to the ready queue or we hit the
+		// timeout
+		tryAgain := <-ch
+		if !tryAgain {
 			return item, Error{queue.Name, "Reserve", "", ErrNothingReady}
 		}
+
+		queue.lockShared()
+		if err := queue.waitWhilePaused(reserveGroups[0], deadline); err != nil {
+			return nil, err
+		}
+		var moreHeld []*Item
+		var skipped bool
+		item, moreHeld, skipped = queue.popReadyFromGroups(reserveGroups, filter, match)
+		held = append(held, moreHeld...)
+
+		// if what got pushed was held or not a match, we keep waiting for the
+		// remainder of our wait; otherwise another Reserve() got it first and
+		// we give up
+		wait = 0
+		if len(moreHeld) > 0 || skipped {
+			wait = time.Until(deadline)
+		}
 	}
 
+	queue.items.lockItem(item.Key)
 	item.touch()
 	queue.runQueue.push(item)
 	item.switchReadyRun()
+	queue.items.unlockItem(item.Key)
 
-	queue.mutex.Unlock()
+	queue.unlockShared()
 	queue.ttrNotificationTrigger(item)
 	queue.changed(SubQueueReady, SubQueueRun, []*Item{item})
 
 	return item, nil
 }
 
+// waitWhilePaused waits until the queue is not paused, or until the deadline
+// passes. You must hold the queue lock from lockShared() when calling this; it
+// is still held if no error is returned, otherwise it is released.
+func (queue *Queue) waitWhilePaused(reserveGroup string, deadline time.Time) error {
+	for queue.IsPaused() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			queue.unlockShared()
+			return Error{queue.Name, "Reserve", "", ErrQueuePaused}
+		}
+
+		// we get woken when items are pushed to the ready queue, or by Resume()
+		ch := make(chan bool, 1)
+		queue.readyQueue.notifyPush(reserveGroup, ch, remaining)
+		queue.unlockShared()
+		<-ch
+		queue.lockShared()
+
+		if queue.isClosed() {
+			queue.unlockShared()
+			return Error{queue.Name, "Reserve", "", ErrQueueClosed}
+		}
+	}
+	return nil
+}
+
 // Touch is a thread-safe way to extend the amount of time a Reserve()d item
 // is allowed to run.
-func (queue *Queue) Touch(key string) error {
-	queue.mutex.Lock()
+func (queue *Queue) Touch(key string) (err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpTouch, start, 1, err) }()
+	queue.lockKey(key)
 
-	if queue.closed {
-		queue.mutex.Unlock()
+	if queue.isClosed() {
+		queue.unlockKey(key)
 		return Error{queue.Name, "Touch", key, ErrQueueClosed}
 	}
 
 	// check it's actually still in the queue first
-	item, ok := queue.items[key]
+	item, ok := queue.items.get(key)
 	if !ok {
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		return Error{queue.Name, "Touch", key, ErrNotFound}
 	}
 
 	// and it must be in the run queue
 	if ok = item.state == ItemStateRun; !ok {
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		return Error{queue.Name, "Touch", key, ErrNotRunning}
 	}
 
@@ -996,7 +1329,7 @@ func (queue *Queue) Touch(key string) error {
 	item.touch()
 	queue.runQueue.update(item)
 
-	queue.mutex.Unlock()
+	queue.unlockKey(key)
 	queue.ttrNotificationTrigger(item)
 
 	return nil
@@ -1004,41 +1337,46 @@ func (queue *Queue) Touch(key string) error {
 
 // Release is a thread-safe way to switch an item in the run sub-queue to the
 // delay sub-queue, for when the item should be dealt with later, not now.
-func (queue *Queue) Release(key string) error {
-	queue.mutex.Lock()
-
-	if queue.closed {
-		queue.mutex.Unlock()
+// How long it stays in the delay sub-queue is decided by the Backoff set with
+// SetBackoff(), which by default is the item's own delay.
+func (queue *Queue) Release(key string) (err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpRelease, start, 1, err) }()
+	queue.lockKey(key)
+
+	if queue.isClosed() {
+		queue.unlockKey(key)
 		return Error{queue.Name, "Release", key, ErrQueueClosed}
 	}
 
 	// check it's actually still in the queue first
-	item, ok := queue.items[key]
+	item, ok := queue.items.get(key)
 	if !ok {
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		return Error{queue.Name, "Release", key, ErrNotFound}
 	}
 
 	// and it must be in the run queue
 	if ok = item.state == ItemStateRun; !ok {
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		return Error{queue.Name, "Release", key, ErrNotRunning}
 	}
 
 	// switch from run to delay queue (unless there is no delay, in which case
 	// straight to ready)
 	queue.runQueue.remove(item)
-	if item.delay.Nanoseconds() == 0 {
+	delay := queue.backoff(item)
+	if delay <= 0 {
 		item.switchRunReady()
 		queue.readyQueue.push(item)
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		queue.changed(SubQueueRun, SubQueueReady, []*Item{item})
 		queue.readyAdded()
 	} else {
-		item.restart()
+		item.restartAfter(delay)
 		queue.delayQueue.push(item)
 		item.switchRunDelay()
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		queue.delayNotificationTrigger(item)
 		queue.changed(SubQueueRun, SubQueueDelay, []*Item{item})
 	}
@@ -1049,24 +1387,26 @@ func (queue *Queue) Release(key string) error {
 // Bury is a thread-safe way to switch an item in the run sub-queue to the
 // bury sub-queue, for when the item can't be dealt with ever, at least until
 // the user takes some action and changes something.
-func (queue *Queue) Bury(key string) error {
-	queue.mutex.Lock()
+func (queue *Queue) Bury(key string) (err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpBury, start, 1, err) }()
+	queue.lockKey(key)
 
-	if queue.closed {
-		queue.mutex.Unlock()
+	if queue.isClosed() {
+		queue.unlockKey(key)
 		return Error{queue.Name, "Bury", key, ErrQueueClosed}
 	}
 
 	// check it's actually still in the queue first
-	item, ok := queue.items[key]
+	item, ok := queue.items.get(key)
 	if !ok {
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		return Error{queue.Name, "Bury", key, ErrNotFound}
 	}
 
 	// and it must be in the run queue
 	if ok = item.state == ItemStateRun; !ok {
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		return Error{queue.Name, "Bury", key, ErrNotRunning}
 	}
 
@@ -1074,7 +1414,7 @@ func (queue *Queue) Bury(key string) error {
 	queue.runQueue.remove(item)
 	queue.buryQueue.push(item)
 	item.switchRunBury()
-	queue.mutex.Unlock()
+	queue.unlockKey(key)
 	queue.changed(SubQueueRun, SubQueueBury, []*Item{item})
 
 	return nil
@@ -1082,62 +1422,170 @@ func (queue *Queue) Bury(key string) error {
 
 // Kick is a thread-safe way to switch an item in the bury sub-queue to the
 // ready sub-queue, for when a previously buried item can now be handled.
-func (queue *Queue) Kick(key string) error {
-	queue.mutex.Lock()
+func (queue *Queue) Kick(key string) (err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpKick, start, 1, err) }()
+	queue.lockKey(key)
 
-	if queue.closed {
-		queue.mutex.Unlock()
+	if queue.isClosed() {
+		queue.unlockKey(key)
 		return Error{queue.Name, "Kick", key, ErrQueueClosed}
 	}
 
 	// check it's actually still in the queue first
-	item, ok := queue.items[key]
+	item, ok := queue.items.get(key)
 	if !ok {
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		return Error{queue.Name, "Kick", key, ErrNotFound}
 	}
 
 	// and it must be in the bury queue
 	if ok = item.state == ItemStateBury; !ok {
-		queue.mutex.Unlock()
+		queue.unlockKey(key)
 		return Error{queue.Name, "Kick", key, ErrNotBuried}
 	}
 
-	// switch from bury to ready or dependent queue
+	to := queue.kickItem(item)
+	queue.unlockKey(key)
+	queue.changed(SubQueueBury, to, []*Item{item})
+	if to == SubQueueReady {
+		queue.readyAdded()
+	}
+	return nil
+}
+
+// kickItem switches a buried item to the ready or dependent sub-queue,
+// returning which one. You must hold the queue lock, or the lock from lockKey()
+// for the item's key, when calling this.
+func (queue *Queue) kickItem(item *Item) SubQueue {
 	queue.buryQueue.remove(item)
 	if queue.itemHasDeps(item) {
 		queue.depQueue.push(item)
 		item.switchBuryDependent()
-		queue.mutex.Unlock()
-		queue.changed(SubQueueBury, SubQueueDependent, []*Item{item})
-	} else {
-		queue.readyQueue.push(item)
-		item.switchBuryReady()
-		queue.mutex.Unlock()
-		queue.changed(SubQueueBury, SubQueueReady, []*Item{item})
+		return SubQueueDependent
+	}
+	queue.readyQueue.push(item)
+	item.switchBuryReady()
+	return SubQueueReady
+}
+
+// BulkKick is like Kick(), except that you supply a slice of keys. Keys that
+// are not in the queue, or whose items are not buried, are ignored. It returns
+// the items that were kicked.
+//
+// This is much faster than calling Kick() for each item, since the queue is
+// only locked once, and callbacks are only triggered once.
+func (queue *Queue) BulkKick(keys []string) (kicked []*Item, err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpKick, start, len(kicked), err) }()
+	queue.lock()
+
+	if queue.isClosed() {
+		queue.unlock()
+		return nil, Error{queue.Name, "BulkKick", "", ErrQueueClosed}
+	}
+
+	var readyItems, depItems []*Item
+	for _, key := range keys {
+		item, ok := queue.items.get(key)
+		if !ok || item.state != ItemStateBury {
+			continue
+		}
+
+		if queue.kickItem(item) == SubQueueReady {
+			readyItems = append(readyItems, item)
+		} else {
+			depItems = append(depItems, item)
+		}
+		kicked = append(kicked, item)
+	}
+
+	queue.unlock()
+	if len(depItems) > 0 {
+		queue.changed(SubQueueBury, SubQueueDependent, depItems)
+	}
+	if len(readyItems) > 0 {
+		queue.changed(SubQueueBury, SubQueueReady, readyItems)
 		queue.readyAdded()
 	}
-	return nil
+	return kicked, nil
 }
 
 // Remove is a thread-safe way to remove an item from the queue.
-func (queue *Queue) Remove(key string) error {
-	queue.mutex.Lock()
+func (queue *Queue) Remove(key string) (err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpRemove, start, 1, err) }()
+	queue.lockKey(key)
 
-	if queue.closed {
-		queue.mutex.Unlock()
+	if queue.isClosed() {
+		queue.unlockKey(key)
 		return Error{queue.Name, "Remove", key, ErrQueueClosed}
 	}
 
 	// check it's actually still in the queue first
-	item, existed := queue.items[key]
+	item, existed := queue.items.get(key)
+	if !existed {
+		queue.unlockKey(key)
+		return Error{queue.Name, "Remove", key, ErrNotFound}
+	}
+
+	// removing an item involved in dependencies changes other items, and a ready
+	// item could be being Reserve()d, so those need the whole queue locked
+	if item.state == ItemStateReady || len(item.dependencies) > 0 || queue.hasDependants(key) {
+		queue.unlockKey(key)
+		return queue.removeExclusive(key)
+	}
+
+	from, _ := queue.removeItem(item)
+	queue.changed(from, SubQueueRemoved, []*Item{item})
+	queue.unlockKey(key)
+
+	return nil
+}
+
+// hasDependants tells you if any items depend on the item with the given key.
+// You must hold the queue lock (at least from lockShared()) when calling this.
+func (queue *Queue) hasDependants(key string) bool {
+	_, has := queue.dependants[key]
+	return has
+}
+
+// removeExclusive does the work of Remove() while holding the queue lock.
+func (queue *Queue) removeExclusive(key string) error {
+	queue.lock()
+
+	if queue.isClosed() {
+		queue.unlock()
+		return Error{queue.Name, "Remove", key, ErrQueueClosed}
+	}
+
+	item, existed := queue.items.get(key)
 	if !existed {
-		queue.mutex.Unlock()
+		queue.unlock()
 		return Error{queue.Name, "Remove", key, ErrNotFound}
 	}
 
+	from, addedReadyItems := queue.removeItem(item)
+	queue.changed(from, SubQueueRemoved, []*Item{item})
+
+	queue.unlock()
+	if len(addedReadyItems) > 0 {
+		queue.changed(SubQueueDependent, SubQueueReady, addedReadyItems)
+		queue.readyAdded()
+	}
+
+	return nil
+}
+
+// removeItem removes the given item from the queue and its current sub-queue,
+// returning that sub-queue, and any items that became ready because they were
+// only dependent on this item. You must hold the queue lock when calling this,
+// or if the item is not ready and not involved in any dependencies, the lock
+// from lockKey() for its key.
+func (queue *Queue) removeItem(item *Item) (SubQueue, []*Item) {
+	key := item.Key
+
 	// transfer any dependants to the ready queue
-	addedReady := false
 	var addedReadyItems []*Item
 	if deps, exists := queue.dependants[key]; exists {
 		for _, dep := range deps {
@@ -1149,7 +1597,6 @@ func (queue *Queue) Remove(key string) error {
 				dep.switchDependentReady()
 				queue.readyQueue.push(dep)
 				addedReadyItems = append(addedReadyItems, dep)
-				addedReady = true
 			}
 		}
 		delete(queue.dependants, key)
@@ -1167,35 +1614,81 @@ func (queue *Queue) Remove(key string) error {
 	}
 
 	// remove from the queue
-	delete(queue.items, key)
+	queue.items.delete(key)
 
 	// remove from the current sub-queue
+	var from SubQueue
 	switch item.state {
 	case ItemStateDelay:
 		queue.delayQueue.remove(item)
-		queue.changed(SubQueueDelay, SubQueueRemoved, []*Item{item})
+		from = SubQueueDelay
 	case ItemStateReady:
 		queue.readyQueue.remove(item)
-		queue.changed(SubQueueReady, SubQueueRemoved, []*Item{item})
+		from = SubQueueReady
 	case ItemStateRun:
 		queue.runQueue.remove(item)
-		queue.changed(SubQueueRun, SubQueueRemoved, []*Item{item})
+		from = SubQueueRun
 	case ItemStateBury:
 		queue.buryQueue.remove(item)
-		queue.changed(SubQueueBury, SubQueueRemoved, []*Item{item})
+		from = SubQueueBury
 	case ItemStateDependent:
 		queue.depQueue.remove(item)
-		queue.changed(SubQueueDependent, SubQueueRemoved, []*Item{item})
+		from = SubQueueDependent
 	}
 	item.removalCleanup()
 
-	queue.mutex.Unlock()
-	if addedReady {
+	return from, addedReadyItems
+}
+
+// BulkRemove is like Remove(), except that you supply a slice of keys. Keys
+// that are not in the queue are ignored. It returns the items that were
+// removed.
+//
+// This is much faster than calling Remove() for each item, since the queue is
+// only locked once, and callbacks are only triggered once.
+func (queue *Queue) BulkRemove(keys []string) (removed []*Item, err error) {
+	start := time.Now()
+	defer func() { queue.recordOp(OpRemove, start, len(removed), err) }()
+	queue.lock()
+
+	if queue.isClosed() {
+		queue.unlock()
+		return nil, Error{queue.Name, "BulkRemove", "", ErrQueueClosed}
+	}
+
+	var addedReadyItems []*Item
+	removedFrom := make(map[SubQueue][]*Item)
+	for _, key := range keys {
+		item, existed := queue.items.get(key)
+		if !existed {
+			continue
+		}
+
+		from, readied := queue.removeItem(item)
+		removedFrom[from] = append(removedFrom[from], item)
+		addedReadyItems = append(addedReadyItems, readied...)
+		removed = append(removed, item)
+	}
+	for from, items := range removedFrom {
+		queue.changed(from, SubQueueRemoved, items)
+	}
+
+	// items made ready by an earlier removal could have been removed as well
+	readyItems := addedReadyItems[:0]
+	for _, item := range addedReadyItems {
+		if item.State() == ItemStateReady {
+			readyItems = append(readyItems, item)
+		}
+	}
+	addedReadyItems = readyItems
+
+	queue.unlock()
+	if len(addedReadyItems) > 0 {
 		queue.changed(SubQueueDependent, SubQueueReady, addedReadyItems)
 		queue.readyAdded()
 	}
 
-	return nil
+	return removed, nil
 }
 
 // HasDependents tells you if the item with the given key has any other items
@@ -1203,21 +1696,20 @@ func (queue *Queue) Remove(key string) error {
 // you're removing it because it was undesired as opposed to complete, as
 // Remove() always triggers dependent items to become ready.
 func (queue *Queue) HasDependents(key string) (bool, error) {
-	queue.mutex.Lock()
-	defer queue.mutex.Unlock()
+	queue.lock()
+	defer queue.unlock()
 
-	if queue.closed {
+	if queue.isClosed() {
 		return false, Error{queue.Name, "Remove", key, ErrQueueClosed}
 	}
 
-	_, has := queue.dependants[key]
-	return has, nil
+	return queue.hasDependants(key), nil
 }
 
 func (queue *Queue) startDelayProcessing() {
 	sendStarted := true
 	for {
-		queue.mutex.Lock()
+		queue.lock()
 		var sleepTime time.Duration
 		if queue.delayQueue.len() > 0 {
 			sleepTime = time.Until(queue.delayQueue.firstItem().ReadyAt())
@@ -1226,14 +1718,14 @@ func (queue *Queue) startDelayProcessing() {
 		}
 
 		queue.delayTime = time.Now().Add(sleepTime)
-		queue.mutex.Unlock()
+		queue.unlock()
 		if sendStarted {
 			queue.startedDelayProcessing <- true
 		}
 
 		select {
 		case <-time.After(time.Until(queue.delayTime)):
-			queue.mutex.Lock()
+			queue.lock()
 			len := queue.delayQueue.len()
 			addedReady := false
 			var items []*Item
@@ -1252,7 +1744,7 @@ func (queue *Queue) startDelayProcessing() {
 				items = append(items, item)
 				addedReady = true
 			}
-			queue.mutex.Unlock()
+			queue.unlock()
 			if addedReady {
 				queue.changed(SubQueueDelay, SubQueueReady, items)
 				queue.readyAdded()
@@ -1282,7 +1774,7 @@ func (queue *Queue) startTTRProcessing() {
 	sendStarted := true
 	for {
 		var sleepTime time.Duration
-		queue.mutex.Lock()
+		queue.lock()
 		if queue.runQueue.len() > 0 {
 			sleepTime = time.Until(queue.runQueue.firstItem().ReleaseAt())
 		} else {
@@ -1290,14 +1782,14 @@ func (queue *Queue) startTTRProcessing() {
 		}
 
 		queue.ttrTime = time.Now().Add(sleepTime)
-		queue.mutex.Unlock()
+		queue.unlock()
 		if sendStarted {
 			queue.startedTTRProcessing <- true
 		}
 
 		select {
 		case <-time.After(time.Until(queue.ttrTime)):
-			queue.mutex.Lock()
+			queue.lock()
 			length := queue.runQueue.len()
 			var delayedItems, buriedItems, readyItems []*Item
 			for i := 0; i < length; i++ {
@@ -1319,7 +1811,7 @@ func (queue *Queue) startTTRProcessing() {
 					queue.runQueue.remove(item)
 					switch moveTo {
 					case SubQueueDelay:
-						item.restart()
+						item.restartAfter(queue.backoff(item))
 						queue.delayQueue.push(item)
 						item.switchRunDelay(true)
 						delayedItems = append(delayedItems, item)
@@ -1335,7 +1827,7 @@ func (queue *Queue) startTTRProcessing() {
 				}
 			}
 
-			queue.mutex.Unlock()
+			queue.unlock()
 			if len(delayedItems) > 0 {
 				for _, item := range delayedItems {
 					queue.delayNotificationTrigger(item)
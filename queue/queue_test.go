@@ -19,9 +19,11 @@
 package queue
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -227,6 +229,30 @@ func TestQueue(t *testing.T) {
 			So(len(items), ShouldEqual, 10)
 		})
 
+		Convey("You can walk over all items, stopping early if you like", func() {
+			seen := make(map[string]bool)
+			queue.Each(func(item *Item) bool {
+				seen[item.Key] = true
+				return true
+			})
+			So(len(seen), ShouldEqual, 10)
+			So(seen["key_0"], ShouldBeTrue)
+
+			visits := 0
+			queue.Each(func(item *Item) bool {
+				visits++
+				return visits < 3
+			})
+			So(visits, ShouldEqual, 3)
+
+			queue.Each(func(item *Item) bool {
+				errr := queue.Remove(item.Key)
+				So(errr, ShouldBeNil)
+				return true
+			})
+			So(queue.Stats().Items, ShouldEqual, 0)
+		})
+
 		Convey("When nothing is running, GetRunningData returns nothing", func() {
 			data := queue.GetRunningData()
 			So(len(data), ShouldEqual, 0)
@@ -957,6 +983,148 @@ func TestQueue(t *testing.T) {
 		So(item.Key, ShouldEqual, "key_large")
 	})
 
+	Convey("Metrics are kept on the queue's operations", t, func() {
+		queue := New("metrics queue")
+		defer func() {
+			errd := queue.Destroy()
+			So(errd, ShouldBeNil)
+		}()
+
+		var cbMutex sync.Mutex
+		cbOps := make(map[Op]int)
+		queue.SetOpCallback(func(op Op, items int, latency time.Duration, err error) {
+			cbMutex.Lock()
+			defer cbMutex.Unlock()
+			cbOps[op] += items
+		})
+
+		_, err := queue.Add("key1", "", "data", 0, 0*time.Millisecond, 1*time.Second, "")
+		So(err, ShouldBeNil)
+		added, _, err := queue.BulkAdd([]*ItemDef{
+			{Key: "key2", Data: "data", TTR: 1 * time.Second},
+			{Key: "key3", Data: "data", TTR: 1 * time.Second},
+		})
+		So(err, ShouldBeNil)
+		So(added, ShouldEqual, 2)
+
+		for i := 0; i < 3; i++ {
+			_, err = queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+		}
+		_, err = queue.Reserve("", 0)
+		So(err, ShouldNotBeNil)
+
+		So(queue.Touch("key1"), ShouldBeNil)
+		So(queue.Bury("key1"), ShouldBeNil)
+		So(queue.Kick("key1"), ShouldBeNil)
+		So(queue.Kick("key1"), ShouldNotBeNil)
+		So(queue.Release("key2"), ShouldBeNil)
+		removed, err := queue.BulkRemove([]string{"key1", "key2", "key3"})
+		So(err, ShouldBeNil)
+		So(len(removed), ShouldEqual, 3)
+
+		m := queue.OpMetrics()
+		So(m.Taken, ShouldHappenAfter, m.Since)
+		So(m.Ops[OpAdd].Calls, ShouldEqual, 2)
+		So(m.Ops[OpAdd].Items, ShouldEqual, 3)
+		So(m.Ops[OpReserve].Calls, ShouldEqual, 4)
+		So(m.Ops[OpReserve].Items, ShouldEqual, 3)
+		So(m.Ops[OpReserve].Errors, ShouldEqual, 0)
+		So(m.Ops[OpTouch].Calls, ShouldEqual, 1)
+		So(m.Ops[OpBury].Items, ShouldEqual, 1)
+		So(m.Ops[OpKick].Calls, ShouldEqual, 2)
+		So(m.Ops[OpKick].Items, ShouldEqual, 1)
+		So(m.Ops[OpKick].Errors, ShouldEqual, 1)
+		So(m.Ops[OpRelease].Items, ShouldEqual, 1)
+		So(m.Ops[OpRemove].Calls, ShouldEqual, 1)
+		So(m.Ops[OpRemove].Items, ShouldEqual, 3)
+
+		var histTotal uint64
+		for _, n := range m.Ops[OpReserve].Histogram {
+			histTotal += n
+		}
+		So(histTotal, ShouldEqual, 4)
+		So(len(m.Ops[OpReserve].Histogram), ShouldEqual, len(m.Ops[OpReserve].Buckets)+1)
+		So(m.Ops[OpReserve].MeanLatency(), ShouldBeGreaterThan, 0)
+		So(m.Rate(OpReserve), ShouldBeGreaterThan, 0)
+		So(m.ItemRate(OpAdd), ShouldBeGreaterThan, m.Rate(OpAdd))
+
+		cbMutex.Lock()
+		So(cbOps[OpAdd], ShouldEqual, 3)
+		So(cbOps[OpReserve], ShouldEqual, 3)
+		So(cbOps[OpRemove], ShouldEqual, 3)
+		cbMutex.Unlock()
+
+		Convey("You can get metrics for a recent window", func() {
+			_, err = queue.Add("key4", "", "data", 0, 0*time.Millisecond, 1*time.Second, "")
+			So(err, ShouldBeNil)
+			recent := queue.OpMetrics().Sub(m)
+			So(recent.Since, ShouldEqual, m.Taken)
+			So(recent.Ops[OpAdd].Calls, ShouldEqual, 1)
+			So(recent.Ops[OpAdd].Items, ShouldEqual, 1)
+			So(recent.Ops[OpReserve].Calls, ShouldEqual, 0)
+		})
+	})
+
+	Convey("You can change the order in which ready items are reserved", t, func() {
+		queue := New("order queue")
+		defer func() {
+			errd := queue.Destroy()
+			So(errd, ShouldBeNil)
+		}()
+
+		deadlines := make(map[string]time.Time)
+		now := time.Now()
+		for i, p := range []uint8{0, 2, 1} {
+			key := fmt.Sprintf("key_%d", i)
+			_, err := queue.Add(key, "", key, p, 0*time.Millisecond, 1*time.Minute, "")
+			So(err, ShouldBeNil)
+			deadlines[key] = now.Add(time.Duration(3-i) * time.Minute)
+		}
+
+		reserveAll := func() []string {
+			var keys []string
+			for {
+				item, err := queue.Reserve("", 0)
+				if err != nil {
+					break
+				}
+				keys = append(keys, item.Key)
+			}
+			return keys
+		}
+
+		Convey("By default, by priority", func() {
+			So(reserveAll(), ShouldResemble, []string{"key_1", "key_2", "key_0"})
+		})
+
+		Convey("Fifo", func() {
+			queue.SetReadyOrder(OrderFIFO)
+			So(reserveAll(), ShouldResemble, []string{"key_0", "key_1", "key_2"})
+		})
+
+		Convey("By deadline", func() {
+			queue.SetReadyOrder(OrderDeadline(func(data interface{}) time.Time {
+				return deadlines[data.(string)]
+			}))
+			So(reserveAll(), ShouldResemble, []string{"key_2", "key_1", "key_0"})
+		})
+
+		Convey("By a custom order", func() {
+			queue.SetReadyOrder(func(a, b *Item) bool {
+				return a.Priority() < b.Priority()
+			})
+			So(reserveAll(), ShouldResemble, []string{"key_0", "key_2", "key_1"})
+
+			queue.SetReadyOrder(nil)
+			_, err := queue.Add("key_3", "", "key_3", 3, 0*time.Millisecond, 100*time.Millisecond, "")
+			So(err, ShouldBeNil)
+			item, err := queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_3")
+		})
+	})
+
 	Convey("Once a thousand items with no delay have been added to the queue", t, func() {
 		queue := New("1000 queue")
 		defer qdestroy(queue)
@@ -1249,6 +1417,767 @@ func TestQueue(t *testing.T) {
 		So(stats.Buried, ShouldEqual, 10)
 	})
 
+	Convey("You can kick and remove many items in one go", t, func() {
+		queue := New("bulk queue")
+		defer qdestroy(queue)
+
+		var readyAddedCalls int32
+		queue.SetReadyAddedCallback(func(queuename string, allitemdata []interface{}) {
+			atomic.AddInt32(&readyAddedCalls, 1)
+		})
+
+		var itemdefs []*ItemDef
+		var buriedKeys, readyKeys []string
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("bury_%d", i)
+			itemdefs = append(itemdefs, &ItemDef{Key: key, Data: "data", TTR: 30 * time.Second, StartQueue: SubQueueBury})
+			buriedKeys = append(buriedKeys, key)
+			key = fmt.Sprintf("ready_%d", i)
+			itemdefs = append(itemdefs, &ItemDef{Key: key, Data: "data", TTR: 30 * time.Second})
+			readyKeys = append(readyKeys, key)
+		}
+		itemdefs = append(itemdefs, &ItemDef{Key: "child", Data: "data", TTR: 30 * time.Second, Dependencies: []string{"ready_0", "bury_0"}})
+		added, _, err := queue.BulkAdd(itemdefs)
+		So(err, ShouldBeNil)
+		So(added, ShouldEqual, 21)
+		<-time.After(50 * time.Millisecond)
+		atomic.StoreInt32(&readyAddedCalls, 0)
+
+		kicked, err := queue.BulkKick(append(buriedKeys, "ready_0", "missing"))
+		So(err, ShouldBeNil)
+		So(len(kicked), ShouldEqual, 10)
+		stats := queue.Stats()
+		So(stats.Ready, ShouldEqual, 20)
+		So(stats.Buried, ShouldEqual, 0)
+		<-time.After(50 * time.Millisecond)
+		So(atomic.LoadInt32(&readyAddedCalls), ShouldEqual, 1)
+
+		removed, err := queue.BulkRemove(append(readyKeys, "bury_0", "missing"))
+		So(err, ShouldBeNil)
+		So(len(removed), ShouldEqual, 11)
+		stats = queue.Stats()
+		So(stats.Items, ShouldEqual, 10)
+		So(stats.Ready, ShouldEqual, 10)
+		child, err := queue.Get("child")
+		So(err, ShouldBeNil)
+		So(child.State(), ShouldEqual, ItemStateReady)
+
+		removed, err = queue.BulkRemove(append(buriedKeys, "child"))
+		So(err, ShouldBeNil)
+		So(len(removed), ShouldEqual, 10)
+		So(queue.Stats().Items, ShouldEqual, 0)
+
+		err = queue.Destroy()
+		So(err, ShouldBeNil)
+		_, err = queue.BulkKick(buriedKeys)
+		So(err, ShouldNotBeNil)
+		_, err = queue.BulkRemove(buriedKeys)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("You can snapshot a queue and restore it to another queue", t, func() {
+		queue := New("snapshot queue")
+		defer qdestroy(queue)
+
+		_, err := queue.Add("delay", "", "d", 0, 1*time.Minute, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Add("ready", "group", "r", 1, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Add("run", "", "u", 0, 0*time.Second, 500*time.Millisecond, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Reserve("", 0)
+		So(err, ShouldBeNil)
+		_, err = queue.Add("bury", "", "b", 0, 0*time.Second, 30*time.Second, SubQueueBury)
+		So(err, ShouldBeNil)
+		_, err = queue.Add("dep", "", "p", 0, 0*time.Second, 30*time.Second, "", []string{"ready", "bury"})
+		So(err, ShouldBeNil)
+
+		encode := func(data interface{}) ([]byte, error) {
+			return []byte(data.(string)), nil
+		}
+		decode := func(encoded []byte) (interface{}, error) {
+			return string(encoded), nil
+		}
+
+		var b bytes.Buffer
+		err = queue.Snapshot(&b, encode)
+		So(err, ShouldBeNil)
+		snapshot := b.Bytes()
+
+		restoredQueue := New("restored queue")
+		defer qdestroy(restoredQueue)
+		n, err := restoredQueue.Restore(bytes.NewReader(snapshot), decode)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 5)
+
+		So(restoredQueue.Stats(), ShouldResemble, queue.Stats())
+		for _, key := range []string{"delay", "ready", "run", "bury", "dep"} {
+			orig, errg := queue.Get(key)
+			So(errg, ShouldBeNil)
+			restored, errg := restoredQueue.Get(key)
+			So(errg, ShouldBeNil)
+			So(restored.Data(), ShouldEqual, orig.Data())
+			So(restored.ReserveGroup, ShouldEqual, orig.ReserveGroup)
+			origStats, restoredStats := orig.Stats(), restored.Stats()
+			So(restoredStats.State, ShouldEqual, origStats.State)
+			So(restoredStats.Reserves, ShouldEqual, origStats.Reserves)
+			So(restoredStats.Buries, ShouldEqual, origStats.Buries)
+			So(restoredStats.Priority, ShouldEqual, origStats.Priority)
+			So(restored.Created(), ShouldEqual, orig.Created())
+			So(restored.ReadyAt(), ShouldEqual, orig.ReadyAt())
+			So(restored.ReleaseAt(), ShouldEqual, orig.ReleaseAt())
+		}
+
+		Convey("Restored items carry on where they left off", func() {
+			item, err := restoredQueue.Reserve("group", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "ready")
+
+			<-time.After(600 * time.Millisecond)
+			item, err = restoredQueue.Get("run")
+			So(err, ShouldBeNil)
+			So(item.State(), ShouldEqual, ItemStateReady)
+
+			err = restoredQueue.Remove("ready")
+			So(err, ShouldBeNil)
+			err = restoredQueue.Remove("bury")
+			So(err, ShouldBeNil)
+			item, err = restoredQueue.Get("dep")
+			So(err, ShouldBeNil)
+			So(item.State(), ShouldEqual, ItemStateReady)
+		})
+
+		Convey("Existing items are not restored again", func() {
+			n, err = restoredQueue.Restore(bytes.NewReader(snapshot), decode)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+		})
+
+		Convey("Bad snapshots are rejected", func() {
+			_, err = restoredQueue.Restore(bytes.NewReader([]byte("foo")), decode)
+			So(err, ShouldNotBeNil)
+
+			_, err = restoredQueue.Restore(bytes.NewReader(snapshot), func(encoded []byte) (interface{}, error) {
+				return nil, fmt.Errorf("bad data")
+			})
+			So(err, ShouldNotBeNil)
+
+			err = queue.Snapshot(&b, func(data interface{}) ([]byte, error) {
+				return nil, fmt.Errorf("bad data")
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Items that aren't reserved in time can expire", t, func() {
+		queue := New("expiry queue")
+		defer qdestroy(queue)
+
+		expired := make(chan interface{}, 10)
+		queue.SetExpiryCallback(func(data interface{}) {
+			expired <- data
+		})
+
+		_, err := queue.Add("ready", "", "r", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Add("delay", "", "d", 0, 1*time.Minute, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Add("reserved", "", "res", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Add("cancelled", "", "c", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+
+		for _, key := range []string{"ready", "delay", "reserved", "cancelled"} {
+			err = queue.SetExpiry(key, 100*time.Millisecond)
+			So(err, ShouldBeNil)
+		}
+		item, err := queue.Get("ready")
+		So(err, ShouldBeNil)
+		So(item.ExpiresAt().IsZero(), ShouldBeFalse)
+
+		err = queue.SetExpiry("cancelled", 0)
+		So(err, ShouldBeNil)
+		So(queue.SetExpiry("missing", time.Second), ShouldNotBeNil)
+
+		item, err = queue.Reserve("", 0)
+		So(err, ShouldBeNil)
+		// (the ready items all have the same priority, so are fifo)
+		So(item.Key, ShouldEqual, "ready")
+		err = queue.Release("ready")
+		So(err, ShouldBeNil)
+		err = queue.SetReserveGroup("ready", "other")
+		So(err, ShouldBeNil)
+		item, err = queue.Reserve("", 0)
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldEqual, "reserved")
+		err = queue.SetReserveGroup("cancelled", "other")
+		So(err, ShouldBeNil)
+
+		<-time.After(200 * time.Millisecond)
+
+		Convey("Only un-reserved items with an expiry get buried", func() {
+			var datas []string
+			for len(datas) < 1 {
+				select {
+				case data := <-expired:
+					datas = append(datas, data.(string))
+				case <-time.After(1 * time.Second):
+					datas = append(datas, "timeout")
+				}
+			}
+			So(datas, ShouldResemble, []string{"d"})
+
+			stats := queue.Stats()
+			So(stats.Delayed, ShouldEqual, 0)
+			So(stats.Buried, ShouldEqual, 1)
+			So(stats.Running, ShouldEqual, 1)
+			So(stats.Ready, ShouldEqual, 2)
+
+			item, err = queue.Get("delay")
+			So(err, ShouldBeNil)
+			So(item.State(), ShouldEqual, ItemStateBury)
+			So(item.Stats().Buries, ShouldEqual, 1)
+
+			err = queue.Kick("delay")
+			So(err, ShouldBeNil)
+			item, err = queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "delay")
+		})
+
+		Convey("Removed items don't expire", func() {
+			err = queue.SetExpiry("cancelled", 50*time.Millisecond)
+			So(err, ShouldBeNil)
+			err = queue.Remove("cancelled")
+			So(err, ShouldBeNil)
+			<-time.After(100 * time.Millisecond)
+			So(len(expired), ShouldEqual, 1)
+		})
+	})
+
+	Convey("You can pause and resume reserving from a queue", t, func() {
+		queue := New("pause queue")
+		defer qdestroy(queue)
+
+		readyAdded := make(chan int, 10)
+		queue.SetReadyAddedCallback(func(queuename string, allitemdata []interface{}) {
+			readyAdded <- len(allitemdata)
+		})
+
+		_, err := queue.Add("key_1", "", "1", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		So(<-readyAdded, ShouldEqual, 1)
+		So(queue.IsPaused(), ShouldBeFalse)
+
+		err = queue.Pause()
+		So(err, ShouldBeNil)
+		So(queue.IsPaused(), ShouldBeTrue)
+
+		_, err = queue.Reserve("", 0)
+		So(err, ShouldNotBeNil)
+		qerr, ok := err.(Error)
+		So(ok, ShouldBeTrue)
+		So(qerr.Err, ShouldEqual, ErrQueuePaused)
+
+		Convey("Adding and inspecting still works while paused", func() {
+			_, err = queue.Add("key_2", "", "2", 0, 0*time.Second, 30*time.Second, "")
+			So(err, ShouldBeNil)
+			So(<-readyAdded, ShouldEqual, 2)
+
+			item, err := queue.Get("key_2")
+			So(err, ShouldBeNil)
+			So(item.State(), ShouldEqual, ItemStateReady)
+			So(queue.Stats().Ready, ShouldEqual, 2)
+
+			before := time.Now()
+			_, err = queue.Reserve("", 50*time.Millisecond)
+			So(err, ShouldNotBeNil)
+			So(time.Since(before), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+			qerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(qerr.Err, ShouldEqual, ErrQueuePaused)
+
+			err = queue.Resume()
+			So(err, ShouldBeNil)
+			So(queue.IsPaused(), ShouldBeFalse)
+			So(<-readyAdded, ShouldEqual, 2)
+
+			item, err = queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_1")
+		})
+
+		Convey("Resuming wakes up waiting reserves", func() {
+			_, err = queue.Add("key_2", "group", "2", 0, 0*time.Second, 30*time.Second, "")
+			So(err, ShouldBeNil)
+			So(<-readyAdded, ShouldEqual, 2)
+
+			done := make(chan *Item, 1)
+			go func() {
+				item, errr := queue.Reserve("group", 5*time.Second)
+				if errr != nil {
+					done <- nil
+					return
+				}
+				done <- item
+			}()
+			<-time.After(50 * time.Millisecond)
+			err = queue.Resume()
+			So(err, ShouldBeNil)
+
+			item := <-done
+			So(item, ShouldNotBeNil)
+			So(item.Key, ShouldEqual, "key_2")
+
+			go func() {
+				item, errr := queue.Reserve("other", 5*time.Second)
+				if errr != nil {
+					done <- nil
+					return
+				}
+				done <- item
+			}()
+			<-time.After(50 * time.Millisecond)
+			err = queue.Pause()
+			So(err, ShouldBeNil)
+			_, err = queue.Add("key_3", "other", "3", 0, 0*time.Second, 30*time.Second, "")
+			So(err, ShouldBeNil)
+			<-time.After(50 * time.Millisecond)
+			So(len(done), ShouldEqual, 0)
+			err = queue.Resume()
+			So(err, ShouldBeNil)
+
+			item = <-done
+			So(item, ShouldNotBeNil)
+			So(item.Key, ShouldEqual, "key_3")
+		})
+
+		Convey("Pausing and resuming a destroyed queue fails", func() {
+			err = queue.Destroy()
+			So(err, ShouldBeNil)
+			So(queue.Pause(), ShouldNotBeNil)
+			So(queue.Resume(), ShouldNotBeNil)
+		})
+	})
+
+	Convey("You can subscribe to items changing sub-queues", t, func() {
+		queue := New("subscription queue")
+		defer qdestroy(queue)
+
+		var mutex sync.Mutex
+		var all []string
+		allID := queue.Subscribe("", "", func(from, to SubQueue, data []interface{}) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, d := range data {
+				all = append(all, string(from)+">"+string(to)+":"+d.(string))
+			}
+		})
+		runID, runCh := queue.SubscribeChannel(SubQueueReady, SubQueueRun)
+		So(runID, ShouldNotEqual, allID)
+		_, buryCh := queue.SubscribeChannel("", SubQueueBury)
+
+		_, err := queue.Add("key_1", "", "1", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Add("key_2", "", "2", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+
+		item, err := queue.Reserve("", 0)
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldEqual, "key_1")
+		err = queue.Bury("key_1")
+		So(err, ShouldBeNil)
+		_, err = queue.Reserve("", 0)
+		So(err, ShouldBeNil)
+		err = queue.Remove("key_2")
+		So(err, ShouldBeNil)
+
+		receive := func(ch <-chan *Transition) *Transition {
+			select {
+			case t := <-ch:
+				return t
+			case <-time.After(1 * time.Second):
+				return nil
+			}
+		}
+
+		t1 := receive(runCh)
+		So(t1, ShouldNotBeNil)
+		So(t1.From, ShouldEqual, SubQueueReady)
+		So(t1.To, ShouldEqual, SubQueueRun)
+		So(t1.Data, ShouldResemble, []interface{}{"1"})
+		t2 := receive(runCh)
+		So(t2, ShouldNotBeNil)
+		So(t2.Data, ShouldResemble, []interface{}{"2"})
+
+		t3 := receive(buryCh)
+		So(t3, ShouldNotBeNil)
+		So(t3.From, ShouldEqual, SubQueueRun)
+		So(t3.Data, ShouldResemble, []interface{}{"1"})
+
+		expected := []string{"new>ready:1", "new>ready:2", "ready>run:1", "run>bury:1", "ready>run:2", "run>removed:2"}
+		var got []string
+		for i := 0; i < 100; i++ {
+			mutex.Lock()
+			got = append([]string(nil), all...)
+			mutex.Unlock()
+			if len(got) >= len(expected) {
+				break
+			}
+			<-time.After(10 * time.Millisecond)
+		}
+		So(got, ShouldResemble, expected)
+
+		Convey("Unsubscribing closes channels and stops callbacks", func() {
+			queue.Unsubscribe(runID)
+			_, ok := <-runCh
+			So(ok, ShouldBeFalse)
+
+			queue.Unsubscribe(allID)
+			queue.Unsubscribe(allID)
+			err = queue.Kick("key_1")
+			So(err, ShouldBeNil)
+			<-time.After(50 * time.Millisecond)
+			mutex.Lock()
+			So(len(all), ShouldEqual, len(expected))
+			mutex.Unlock()
+		})
+
+		Convey("Destroying the queue closes channels", func() {
+			err = queue.Destroy()
+			So(err, ShouldBeNil)
+			_, ok := <-buryCh
+			So(ok, ShouldBeFalse)
+			_, ok = <-runCh
+			So(ok, ShouldBeFalse)
+
+			_, ch := queue.SubscribeChannel("", "")
+			_, ok = <-ch
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("You can choose how long released items are delayed for", t, func() {
+		queue := New("backoff queue")
+		defer qdestroy(queue)
+
+		_, err := queue.Add("key_1", "", "1", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+
+		reserveAndRelease := func() *ItemStats {
+			item, errr := queue.Reserve("", 0)
+			So(errr, ShouldBeNil)
+			So(item, ShouldNotBeNil)
+			errr = queue.Release(item.Key)
+			So(errr, ShouldBeNil)
+			return item.Stats()
+		}
+
+		Convey("By default the item's delay is used", func() {
+			stats := reserveAndRelease()
+			So(stats.State, ShouldEqual, ItemStateReady)
+		})
+
+		Convey("Exponential backoffs increase with each release, up to a max", func() {
+			queue.SetBackoff(ExponentialBackoff(1*time.Minute, 5*time.Minute, 2))
+			stats := reserveAndRelease()
+			So(stats.State, ShouldEqual, ItemStateDelay)
+			So(stats.Remaining, ShouldBeBetween, 59*time.Second, 1*time.Minute)
+
+			item, err := queue.Get("key_1")
+			So(err, ShouldBeNil)
+			So(ExponentialBackoff(1*time.Minute, 5*time.Minute, 2)(item), ShouldEqual, 2*time.Minute)
+			So(ExponentialBackoff(3*time.Minute, 5*time.Minute, 2)(item), ShouldEqual, 5*time.Minute)
+			So(CappedBackoff(ConstantBackoff(1*time.Hour), 1*time.Second)(item), ShouldEqual, 1*time.Second)
+			So(ItemDelayBackoff(item), ShouldEqual, 0)
+
+			for i := 0; i < 10; i++ {
+				d := JitteredBackoff(ConstantBackoff(10*time.Second), 0.1)(item)
+				So(d, ShouldBeBetweenOrEqual, 9*time.Second, 11*time.Second)
+			}
+		})
+
+		Convey("Backoffs can put items straight back on the ready queue", func() {
+			queue.SetBackoff(ConstantBackoff(0))
+			stats := reserveAndRelease()
+			So(stats.State, ShouldEqual, ItemStateReady)
+
+			queue.SetBackoff(nil)
+			stats = reserveAndRelease()
+			So(stats.State, ShouldEqual, ItemStateReady)
+		})
+
+		Convey("Backoffs are used when items time out to the delay queue", func() {
+			queue.SetTTRCallback(func(data interface{}) SubQueue {
+				return SubQueueDelay
+			})
+			queue.SetBackoff(ConstantBackoff(1 * time.Minute))
+			_, err = queue.Add("key_2", "", "2", 0, 0*time.Second, 10*time.Millisecond, "")
+			So(err, ShouldBeNil)
+			item, err := queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			item2, err := queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item2.Key, ShouldNotEqual, item.Key)
+			err = queue.Touch("key_1")
+			So(err, ShouldBeNil)
+
+			<-time.After(100 * time.Millisecond)
+			item, err = queue.Get("key_2")
+			So(err, ShouldBeNil)
+			stats := item.Stats()
+			So(stats.State, ShouldEqual, ItemStateDelay)
+			So(stats.Timeouts, ShouldEqual, 1)
+			So(stats.Remaining, ShouldBeGreaterThan, 50*time.Second)
+		})
+	})
+
+	Convey("You can hold ready items back from being reserved", t, func() {
+		queue := New("hold queue")
+		defer qdestroy(queue)
+
+		var holdMutex sync.Mutex
+		holding := map[string]time.Duration{"key_1": 200 * time.Millisecond}
+		queue.SetHold(func(item *Item) time.Duration {
+			holdMutex.Lock()
+			defer holdMutex.Unlock()
+			return holding[item.Key]
+		})
+
+		_, err := queue.Add("key_1", "", "1", 1, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Add("key_2", "", "2", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+
+		Convey("Reserve() skips held items, which become ready again later", func() {
+			item, err := queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_2")
+
+			held, err := queue.Get("key_1")
+			So(err, ShouldBeNil)
+			So(held.Stats().State, ShouldEqual, ItemStateDelay)
+			_, err = queue.Reserve("", 0)
+			So(err, ShouldNotBeNil)
+
+			holdMutex.Lock()
+			delete(holding, "key_1")
+			holdMutex.Unlock()
+			item, err = queue.Reserve("", 1*time.Second)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_1")
+		})
+
+		Convey("Reserve() keeps waiting if items pushed while it waits are held", func() {
+			holdMutex.Lock()
+			holding["key_1"] = 50 * time.Millisecond
+			holdMutex.Unlock()
+
+			item, err := queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_2")
+
+			go func() {
+				<-time.After(175 * time.Millisecond)
+				holdMutex.Lock()
+				delete(holding, "key_1")
+				holdMutex.Unlock()
+			}()
+
+			t := time.Now()
+			item, err = queue.Reserve("", 1*time.Second)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_1")
+			So(time.Since(t), ShouldBeGreaterThan, 150*time.Millisecond)
+		})
+
+		Convey("The ReadyAddedCallback doesn't see held items", func() {
+			var readyMutex sync.Mutex
+			var readyData []interface{}
+			queue.SetReadyAddedCallback(func(queuename string, allitemdata []interface{}) {
+				readyMutex.Lock()
+				defer readyMutex.Unlock()
+				readyData = allitemdata
+			})
+			queue.TriggerReadyAddedCallback()
+			<-time.After(50 * time.Millisecond)
+
+			readyMutex.Lock()
+			So(readyData, ShouldResemble, []interface{}{"2"})
+			readyMutex.Unlock()
+			stats := queue.Stats()
+			So(stats.Ready, ShouldEqual, 1)
+			So(stats.Delayed, ShouldEqual, 1)
+
+			queue.SetHold(nil)
+			<-time.After(300 * time.Millisecond)
+			stats = queue.Stats()
+			So(stats.Ready, ShouldEqual, 2)
+		})
+	})
+
+	Convey("You can reserve only the ready items that match", t, func() {
+		queue := New("match queue")
+		defer qdestroy(queue)
+
+		_, err := queue.Add("key_1", "", "1", 1, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Add("key_2", "", "2", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+
+		onlyKey := func(key string) Match {
+			return func(item *Item) bool {
+				return item.Key == key
+			}
+		}
+
+		item, err := queue.ReserveMatching("", 0, onlyKey("key_2"))
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldEqual, "key_2")
+
+		_, err = queue.ReserveMatching("", 0, onlyKey("key_3"))
+		So(err, ShouldNotBeNil)
+		stats := queue.Stats()
+		So(stats.Ready, ShouldEqual, 1)
+		So(stats.Running, ShouldEqual, 1)
+
+		Convey("ReserveMatching() keeps waiting if items pushed while it waits don't match", func() {
+			go func() {
+				<-time.After(50 * time.Millisecond)
+				_, erra := queue.Add("key_4", "", "4", 0, 0*time.Second, 30*time.Second, "")
+				if erra != nil {
+					return
+				}
+				<-time.After(100 * time.Millisecond)
+				_, erra = queue.Add("key_3", "", "3", 0, 0*time.Second, 30*time.Second, "")
+				if erra != nil {
+					return
+				}
+			}()
+
+			t := time.Now()
+			item, err := queue.ReserveMatching("", 1*time.Second, onlyKey("key_3"))
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_3")
+			So(time.Since(t), ShouldBeGreaterThan, 125*time.Millisecond)
+
+			item, err = queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_1")
+			item, err = queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_4")
+		})
+	})
+
+	Convey("You can reserve from multiple reserve groups at once", t, func() {
+		queue := New("groups queue")
+		defer qdestroy(queue)
+
+		_, err := queue.Add("key_a", "a", "a", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+		_, err = queue.Add("key_b", "b", "b", 1, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+
+		item, err := queue.ReserveFromGroups([]string{"c", "a", "b"}, 0, nil)
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldEqual, "key_a")
+		item, err = queue.ReserveFromGroups([]string{"c", "a", "b"}, 0, nil)
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldEqual, "key_b")
+		_, err = queue.ReserveFromGroups([]string{"c", "a", "b"}, 0, nil)
+		So(err, ShouldNotBeNil)
+		_, err = queue.ReserveFromGroups(nil, 0, nil)
+		So(err, ShouldNotBeNil)
+
+		Convey("ReserveFromGroups() wakes up when an item is pushed to any group", func() {
+			go func() {
+				<-time.After(50 * time.Millisecond)
+				_, erra := queue.Add("key_d", "d", "d", 0, 0*time.Second, 30*time.Second, "")
+				if erra != nil {
+					return
+				}
+				<-time.After(50 * time.Millisecond)
+				_, erra = queue.Add("key_c", "c", "c", 0, 0*time.Second, 30*time.Second, "")
+				if erra != nil {
+					return
+				}
+			}()
+
+			t := time.Now()
+			item, err := queue.ReserveFromGroups([]string{"a", "b", "c"}, 1*time.Second, nil)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_c")
+			So(time.Since(t), ShouldBeLessThan, 500*time.Millisecond)
+
+			t = time.Now()
+			_, err = queue.ReserveFromGroups([]string{"a", "b", "c"}, 50*time.Millisecond, nil)
+			So(err, ShouldNotBeNil)
+			So(time.Since(t), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+
+			item, err = queue.Reserve("d", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "key_d")
+		})
+	})
+
+	Convey("You can reserve only from the fair groups that pass a filter", t, func() {
+		queue := New("fair queue")
+		defer qdestroy(queue)
+
+		queue.SetFairGroup(func(item *Item) string {
+			return item.Data().(string)
+		})
+
+		for i := 0; i < 5; i++ {
+			_, err := queue.Add(fmt.Sprintf("alice_%d", i), "", "alice", 1, 0*time.Second, 30*time.Second, "")
+			So(err, ShouldBeNil)
+		}
+		_, err := queue.Add("bob_0", "", "bob", 0, 0*time.Second, 30*time.Second, "")
+		So(err, ShouldBeNil)
+
+		var asked []string
+		notAlice := func(item *Item) bool {
+			asked = append(asked, item.Key)
+			return item.Data().(string) != "alice"
+		}
+
+		item, err := queue.ReserveFiltered([]string{""}, 0, notAlice, nil)
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldEqual, "bob_0")
+		So(asked, ShouldResemble, []string{"alice_0", "bob_0"})
+
+		_, err = queue.ReserveFiltered([]string{""}, 0, notAlice, nil)
+		So(err, ShouldNotBeNil)
+
+		item, err = queue.ReserveFiltered([]string{""}, 0, nil, func(item *Item) bool {
+			return item.Key == "alice_3"
+		})
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldEqual, "alice_3")
+
+		item, err = queue.Reserve("", 0)
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldEqual, "alice_0")
+
+		Convey("Changing how items are grouped regroups the ready items", func() {
+			queue.SetFairGroup(func(item *Item) string {
+				return item.Key
+			})
+			asked = nil
+			_, err = queue.ReserveFiltered([]string{""}, 0, notAlice, nil)
+			So(err, ShouldNotBeNil)
+			So(asked, ShouldResemble, []string{"alice_1", "alice_2", "alice_4"})
+
+			queue.SetFairGroup(nil)
+			stats := queue.Stats()
+			So(stats.Ready, ShouldEqual, 3)
+			item, err = queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "alice_1")
+		})
+	})
+
 	Convey("Once some items with dependencies have been added to the queue", t, func() {
 		// https://i-msdn.sec.s-msft.com/dynimg/IC332764.gif
 		queue := New("dep queue")
@@ -1475,6 +2404,76 @@ func TestQueue(t *testing.T) {
 		})
 	})
 
+	Convey("Items can depend on just some of their dependencies", t, func() {
+		queue := New("counted deps queue")
+		defer qdestroy(queue)
+
+		parents := []string{"p1", "p2", "p3", "p4"}
+		for _, key := range parents {
+			_, err := queue.Add(key, "", key, 0, 0*time.Second, 30*time.Second, "")
+			So(err, ShouldBeNil)
+		}
+		child, err := queue.Add("child", "", "child", 0, 0*time.Second, 30*time.Second, "", parents)
+		So(err, ShouldBeNil)
+		So(child.DependencyCount(), ShouldEqual, 0)
+
+		err = queue.SetDependencyCount("child", 2)
+		So(err, ShouldBeNil)
+		So(child.DependencyCount(), ShouldEqual, 2)
+		So(child.State(), ShouldEqual, ItemStateDependent)
+		So(queue.SetDependencyCount("missing", 2), ShouldNotBeNil)
+
+		Convey("It becomes ready once enough parents are removed", func() {
+			err = queue.Remove("p1")
+			So(err, ShouldBeNil)
+			So(child.State(), ShouldEqual, ItemStateDependent)
+			err = queue.Remove("p3")
+			So(err, ShouldBeNil)
+			So(child.State(), ShouldEqual, ItemStateReady)
+			So(len(child.UnresolvedDependencies()), ShouldEqual, 2)
+
+			err = queue.Remove("p2")
+			So(err, ShouldBeNil)
+			So(child.State(), ShouldEqual, ItemStateReady)
+
+			Convey("Kicking considers the count", func() {
+				_, err = queue.Reserve("", 0)
+				So(err, ShouldBeNil)
+				_, err = queue.Reserve("", 0)
+				So(err, ShouldBeNil)
+				err = queue.Bury("child")
+				So(err, ShouldBeNil)
+				err = queue.Kick("child")
+				So(err, ShouldBeNil)
+				So(child.State(), ShouldEqual, ItemStateReady)
+			})
+		})
+
+		Convey("Lowering the count can make it ready straight away", func() {
+			err = queue.Remove("p4")
+			So(err, ShouldBeNil)
+			So(child.State(), ShouldEqual, ItemStateDependent)
+			err = queue.SetDependencyCount("child", 1)
+			So(err, ShouldBeNil)
+			So(child.State(), ShouldEqual, ItemStateReady)
+		})
+
+		Convey("A count of all or more is the same as no count", func() {
+			err = queue.SetDependencyCount("child", 10)
+			So(err, ShouldBeNil)
+			So(child.DependencyCount(), ShouldEqual, 0)
+		})
+
+		Convey("Updating dependencies resets the count", func() {
+			err = queue.Update("child", "", "child", 0, 0*time.Second, 30*time.Second, []string{"p1", "p2"})
+			So(err, ShouldBeNil)
+			So(child.DependencyCount(), ShouldEqual, 0)
+			err = queue.Remove("p1")
+			So(err, ShouldBeNil)
+			So(child.State(), ShouldEqual, ItemStateDependent)
+		})
+	})
+
 	Convey("Once some items with dependencies have been added to the queue en-masse", t, func() {
 		// same setup as in previous test
 		queue := New("dep many queue")
@@ -1724,6 +2723,116 @@ func TestQueue(t *testing.T) {
 		So(<-rmErrCh, ShouldBeNil)
 		So(<-rCh3, ShouldBeTrue)
 	})
+
+	Convey("Many clients can change different items at once, and Stats() stays consistent", t, func() {
+		queue := New("concurrent queue")
+		defer qdestroy(queue)
+
+		numItems := 500
+		for i := 0; i < numItems; i++ {
+			_, err := queue.Add(fmt.Sprintf("key_%d", i), "", i, 0, 0*time.Second, 30*time.Second, "")
+			So(err, ShouldBeNil)
+		}
+
+		var inconsistent, failed int64
+		stop := make(chan bool)
+		statsDone := make(chan bool)
+		go func() {
+			defer close(statsDone)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				stats := queue.Stats()
+				if stats.Delayed+stats.Ready+stats.Running+stats.Buried+stats.Dependant != stats.Items {
+					atomic.AddInt64(&inconsistent, 1)
+				}
+			}
+		}()
+
+		// each item gets reserved, touched and released, then reserved again
+		// and either buried or removed
+		var wg sync.WaitGroup
+		for w := 0; w < 20; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					item, err := queue.Reserve("", 100*time.Millisecond)
+					if err != nil {
+						return
+					}
+					if err = queue.Touch(item.Key); err != nil {
+						atomic.AddInt64(&failed, 1)
+					}
+					switch {
+					case item.Stats().Reserves == 1:
+						err = queue.Release(item.Key)
+					case item.Data().(int)%2 == 0:
+						err = queue.Remove(item.Key)
+					default:
+						err = queue.Bury(item.Key)
+					}
+					if err != nil {
+						atomic.AddInt64(&failed, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		stats := queue.Stats()
+		So(stats.Items, ShouldEqual, numItems/2)
+		So(stats.Buried, ShouldEqual, numItems/2)
+		So(stats.Ready+stats.Running+stats.Delayed, ShouldEqual, 0)
+
+		// now kick and remove all the buried items at once
+		for w := 0; w < 10; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 1 + w*2; i < numItems; i += 20 {
+					key := fmt.Sprintf("key_%d", i)
+					if err := queue.Kick(key); err != nil {
+						atomic.AddInt64(&failed, 1)
+					}
+					if err := queue.Remove(key); err != nil {
+						atomic.AddInt64(&failed, 1)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(stop)
+		<-statsDone
+
+		So(atomic.LoadInt64(&failed), ShouldEqual, 0)
+		So(atomic.LoadInt64(&inconsistent), ShouldEqual, 0)
+		So(queue.Stats().Items, ShouldEqual, 0)
+
+		Convey("Stats() doesn't wait forever if a change always seems to be in progress", func() {
+			_, err := queue.Add("key", "", "data", 0, 0*time.Second, 30*time.Second, "")
+			So(err, ShouldBeNil)
+
+			atomic.AddInt64(&queue.changing, 1)
+			defer atomic.AddInt64(&queue.changing, -1)
+
+			got := make(chan *Stats, 1)
+			go func() {
+				got <- queue.Stats()
+			}()
+
+			select {
+			case stats := <-got:
+				So(stats.Items, ShouldEqual, 1)
+				So(stats.Ready, ShouldEqual, 1)
+			case <-time.After(5 * time.Second):
+				So("Stats() returned", ShouldEqual, "Stats() did not return")
+			}
+		})
+	})
 }
 
 func depTestFunc(queue *Queue, changed bool) {
@@ -0,0 +1,72 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// This file contains the functions that can be used to decide the order in
+// which ready items are reserved.
+
+import "time"
+
+// ReadyOrder is used to decide the order in which items in the ready sub-queue
+// get Reserve()d. It is given 2 items with the same ReserveGroup, and should
+// return true if item a should be reserved before item b.
+//
+// Implementations must be fast, since they are called many times while adding
+// and reserving items, and must not call any Queue methods. They can use the
+// Item's thread-safe getter methods, such as Priority() and Data().
+type ReadyOrder func(a, b *Item) bool
+
+// OrderPriority is the default ReadyOrder. Items with a higher priority are
+// reserved first; for those with equal priority, items with a greater size are
+// reserved first; the remainder are reserved in the order they were created
+// (fifo).
+func OrderPriority(a, b *Item) bool {
+	if a.priority == b.priority {
+		if a.size == b.size {
+			return a.creation.Before(b.creation)
+		}
+		return a.size > b.size
+	}
+	return a.priority > b.priority
+}
+
+// OrderFIFO is a ReadyOrder that ignores priority and size, always reserving
+// the items in the order they were created.
+func OrderFIFO(a, b *Item) bool {
+	return a.creation.Before(b.creation)
+}
+
+// OrderDeadline returns a ReadyOrder that reserves the item with the earliest
+// deadline first, where the given function extracts the deadline from an
+// item's Data(). Items with a zero deadline are reserved after those with a
+// deadline, and items with equal deadlines are ordered as per OrderPriority.
+func OrderDeadline(deadline func(data interface{}) time.Time) ReadyOrder {
+	return func(a, b *Item) bool {
+		da, db := deadline(a.Data()), deadline(b.Data())
+		switch {
+		case da.Equal(db):
+			return OrderPriority(a, b)
+		case da.IsZero():
+			return false
+		case db.IsZero():
+			return true
+		}
+		return da.Before(db)
+	}
+}
@@ -20,6 +20,7 @@ package queue
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -117,6 +118,23 @@ func TestReadyQueue(t *testing.T) {
 		})
 	})
 
+	Convey("Items in the queue can be reordered", t, func() {
+		queue := newSubQueue(1)
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			queue.push(newItem(key, "", "data", uint8(i), 0*time.Second, 0*time.Second))
+			queue.push(newItem(key+"g", "group", "data", uint8(i), 0*time.Second, 0*time.Second))
+		}
+
+		So(queue.pop().Key, ShouldEqual, "key_4")
+		queue.setOrder(OrderFIFO)
+		So(queue.pop().Key, ShouldEqual, "key_0")
+		So(queue.pop("group").Key, ShouldEqual, "key_0g")
+
+		queue.push(newItem("key_5", "", "data", 9, 0*time.Second, 0*time.Second))
+		So(queue.pop().Key, ShouldEqual, "key_1")
+	})
+
 	Convey("Once 10 items of equal priority and 2 different ReserveGroups have been pushed to the queue", t, func() {
 		queue := newSubQueue(1)
 		items := make(map[string]*Item)
@@ -132,6 +150,7 @@ func TestReadyQueue(t *testing.T) {
 		}
 
 		So(queue.len(), ShouldEqual, 10)
+		So(len(queue.groups), ShouldEqual, 2)
 
 		Convey("Pop on an unspecified group does nothing", func() {
 			item := queue.pop()
@@ -150,6 +169,7 @@ func TestReadyQueue(t *testing.T) {
 			So(queue.len("group1"), ShouldEqual, 0)
 			item := queue.pop("group1")
 			So(item, ShouldBeNil)
+			So(len(queue.groups), ShouldEqual, 1)
 
 			So(queue.len("group2"), ShouldEqual, 5)
 			for i := 0; i < 5; i++ {
@@ -182,6 +202,9 @@ func TestReadyQueue(t *testing.T) {
 			exampleItem := items["key_0"]
 			exampleItem.ReserveGroup = "group2"
 			queue.update(exampleItem, "group1")
+			So(queue.len("group1"), ShouldEqual, 4)
+			So(queue.len("group2"), ShouldEqual, 6)
+			So(queue.len(), ShouldEqual, 10)
 			newItem := queue.pop("group2")
 			So(newItem.Key, ShouldEqual, "key_0")
 		})
@@ -189,18 +212,106 @@ func TestReadyQueue(t *testing.T) {
 		Convey("Removing all items works", func() {
 			queue.empty()
 			So(queue.len(), ShouldEqual, 0)
+			So(len(queue.groups), ShouldEqual, 0)
+		})
+
+		Convey("You can get all the items", func() {
+			So(len(queue.allItems()), ShouldEqual, 10)
 		})
 	})
+
+	Convey("Items in different fair groups are still popped in order", t, func() {
+		queue := newSubQueue(1)
+		queue.setFairGroup(func(item *Item) string {
+			return item.Data().(string)
+		})
+		for i := 0; i < 6; i++ {
+			group := "odd"
+			if i%2 == 0 {
+				group = "even"
+			}
+			queue.push(newItem(fmt.Sprintf("key_%d", i), "", group, 0, 0*time.Second, 0*time.Second))
+		}
+		So(queue.len(), ShouldEqual, 6)
+		So(len(queue.groups[""].fair), ShouldEqual, 2)
+
+		item, skipped := queue.popFiltered("", nil)
+		So(item.Key, ShouldEqual, "key_0")
+		So(skipped, ShouldBeFalse)
+
+		only := func(group string) Filter {
+			return func(item *Item) bool {
+				return item.Data().(string) == group
+			}
+		}
+		item, skipped = queue.popFiltered("", only("even"))
+		So(item.Key, ShouldEqual, "key_2")
+		So(skipped, ShouldBeTrue)
+
+		So(queue.pop().Key, ShouldEqual, "key_1")
+		So(queue.pop().Key, ShouldEqual, "key_3")
+		queue.remove(queue.groups[""].fair["odd"].items[0])
+		So(len(queue.groups[""].fair), ShouldEqual, 1)
+
+		item, skipped = queue.popFiltered("", only("odd"))
+		So(item, ShouldBeNil)
+		So(skipped, ShouldBeTrue)
+		So(queue.pop().Key, ShouldEqual, "key_4")
+		So(queue.len(), ShouldEqual, 0)
+		So(len(queue.groups), ShouldEqual, 0)
+	})
 }
 
-// func BenchmarkReadyQueue(b *testing.B) {
-//     readyQueue := newReadyQueue()
-//     b.ResetTimer()
-//     k := 1
-//     for i := 0; i < b.N; i++ {
-//         k++
-//         p := uint8(rand.Intn(255))
-//         item := newItem(fmt.Sprintf("%d.%d", k, p), "data", p, 0*time.Second, 0*time.Second)
-//         readyQueue.push(item)
-//     }
-// }
+// benchmarkReadyItems pushes n items spread over the given number of fair
+// groups to a new ready subQueue.
+func benchmarkReadyItems(n, fairGroups int) *subQueue {
+	queue := newSubQueue(1)
+	queue.setFairGroup(func(item *Item) string {
+		return item.Data().(string)
+	})
+	for i := 0; i < n; i++ {
+		queue.push(newItem(fmt.Sprintf("key_%d", i), "", fmt.Sprintf("group_%d", i%fairGroups), uint8(rand.Intn(255)), 0*time.Second, 0*time.Second))
+	}
+	return queue
+}
+
+func BenchmarkReadyQueuePush(b *testing.B) {
+	queue := newSubQueue(1)
+	items := make([]*Item, b.N)
+	for i := range items {
+		items[i] = newItem(fmt.Sprintf("key_%d", i), "", "data", uint8(rand.Intn(255)), 0*time.Second, 0*time.Second)
+	}
+	b.ResetTimer()
+	for _, item := range items {
+		queue.push(item)
+	}
+}
+
+func BenchmarkReadyQueuePop(b *testing.B) {
+	queue := benchmarkReadyItems(b.N, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queue.pop()
+	}
+}
+
+// BenchmarkReadyQueuePopFiltered pops with a filter that rejects a big fair
+// group that is always next, which costs the same however many items that
+// group has.
+func BenchmarkReadyQueuePopFiltered(b *testing.B) {
+	queue := benchmarkReadyItems(100000, 1)
+	for i := 0; i < b.N; i++ {
+		item := newItem(fmt.Sprintf("small_%d", i), "", "small", 0, 0*time.Second, 0*time.Second)
+		item.creation = item.creation.Add(1 * time.Hour)
+		queue.push(item)
+	}
+	notBig := func(item *Item) bool {
+		return item.Data().(string) != "group_0"
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if item, _ := queue.popFiltered("", notBig); item == nil {
+			b.Fatal("nothing popped")
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// This file contains the code for checkpointing the contents of a queue and
+// restoring them later.
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+)
+
+// snapshotVersion is the version of the snapshot format written by
+// Snapshot(). Restore() refuses to read other versions.
+const snapshotVersion = 1
+
+// SnapshotEncoder is used by Snapshot() to convert an item's Data() to bytes.
+type SnapshotEncoder func(data interface{}) ([]byte, error)
+
+// SnapshotDecoder is used by Restore() to convert the bytes made by a
+// SnapshotEncoder back in to an item's Data().
+type SnapshotDecoder func(encoded []byte) (interface{}, error)
+
+// snapshotHeader is written at the start of a snapshot.
+type snapshotHeader struct {
+	Version int
+	Name    string
+	Items   int
+}
+
+// itemSnapshot holds everything about an Item that we need to restore it.
+type itemSnapshot struct {
+	Key           string
+	ReserveGroup  string
+	Data          []byte
+	State         ItemState
+	Reserves      uint32
+	Timeouts      uint32
+	Releases      uint32
+	Buries        uint32
+	Kicks         uint32
+	Priority      uint8
+	Size          uint8
+	Delay         time.Duration
+	TTR           time.Duration
+	ReadyAt       time.Time
+	ReleaseAt     time.Time
+	Creation      time.Time
+	ExpiresAt     time.Time
+	Dependencies  []string
+	RemainingDeps []string
+	DepsNeeded    int
+}
+
+// snapshot returns an itemSnapshot of this item.
+func (item *Item) snapshot(encode SnapshotEncoder) (*itemSnapshot, error) {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	data, err := encode(item.data)
+	if err != nil {
+		return nil, err
+	}
+	is := &itemSnapshot{
+		Key:          item.Key,
+		ReserveGroup: item.ReserveGroup,
+		Data:         data,
+		State:        item.state,
+		Reserves:     item.reserves,
+		Timeouts:     item.timeouts,
+		Releases:     item.releases,
+		Buries:       item.buries,
+		Kicks:        item.kicks,
+		Priority:     item.priority,
+		Size:         item.size,
+		Delay:        item.delay,
+		TTR:          item.ttr,
+		ReadyAt:      item.readyAt,
+		ReleaseAt:    item.releaseAt,
+		Creation:     item.creation,
+		ExpiresAt:    item.expiresAt,
+		Dependencies: item.dependencies,
+		DepsNeeded:   item.depsNeeded,
+	}
+	for dep := range item.remainingDeps {
+		is.RemainingDeps = append(is.RemainingDeps, dep)
+	}
+	return is, nil
+}
+
+// Snapshot writes the current state of every item in the queue to the given
+// writer, using the given encoder to convert each item's Data() to bytes. The
+// queue is locked while this happens, so that the snapshot is consistent.
+//
+// You can later pass what was written to Restore() on a new queue to get back
+// the same items in the same sub-queues.
+func (queue *Queue) Snapshot(w io.Writer, encode SnapshotEncoder) error {
+	queue.lock()
+	defer queue.unlock()
+
+	if queue.isClosed() {
+		return Error{queue.Name, "Snapshot", "", ErrQueueClosed}
+	}
+
+	items := queue.items.all()
+	enc := gob.NewEncoder(w)
+	err := enc.Encode(&snapshotHeader{Version: snapshotVersion, Name: queue.Name, Items: len(items)})
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		is, err := item.snapshot(encode)
+		if err != nil {
+			return Error{queue.Name, "Snapshot", item.Key, err}
+		}
+		err = enc.Encode(is)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore reads a snapshot written by Snapshot() from the given reader, using
+// the given decoder to convert bytes back to item Data(), and adds the items
+// to this queue in the same sub-queues they were in when the snapshot was
+// taken. Items that were running or delayed keep their original release or
+// ready times, so will be released or become ready as if they had been in this
+// queue all along.
+//
+// Items with keys that already exist in this queue are not restored. Returns
+// the number of items that were restored.
+func (queue *Queue) Restore(r io.Reader, decode SnapshotDecoder) (int, error) {
+	dec := gob.NewDecoder(r)
+	header := &snapshotHeader{}
+	err := dec.Decode(header)
+	if err != nil {
+		return 0, err
+	}
+	if header.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported queue snapshot version %d", header.Version)
+	}
+
+	// decode everything before touching the queue, so that a bad snapshot
+	// doesn't leave us partially restored
+	snapshots := make([]*itemSnapshot, 0, header.Items)
+	datas := make([]interface{}, 0, header.Items)
+	for i := 0; i < header.Items; i++ {
+		is := &itemSnapshot{}
+		err = dec.Decode(is)
+		if err != nil {
+			return 0, err
+		}
+		data, err := decode(is.Data)
+		if err != nil {
+			return 0, Error{queue.Name, "Restore", is.Key, err}
+		}
+		snapshots = append(snapshots, is)
+		datas = append(datas, data)
+	}
+
+	queue.lock()
+	if queue.isClosed() {
+		queue.unlock()
+		return 0, Error{queue.Name, "Restore", "", ErrQueueClosed}
+	}
+
+	restored := make(map[SubQueue][]*Item)
+	for i, is := range snapshots {
+		if _, existed := queue.items.get(is.Key); existed {
+			continue
+		}
+		item := queue.restoreItem(is, datas[i])
+		restored[subQueueForState(is.State)] = append(restored[subQueueForState(is.State)], item)
+	}
+	queue.unlock()
+
+	n := 0
+	for sq, items := range restored {
+		n += len(items)
+		queue.changed(SubQueueNew, sq, items)
+	}
+	if len(restored[SubQueueReady]) > 0 {
+		queue.readyAdded()
+	}
+	if len(restored[SubQueueDelay]) > 0 {
+		queue.delayNotification <- true
+		<-queue.startedDelayProcessing
+	}
+	if len(restored[SubQueueRun]) > 0 {
+		queue.ttrNotification <- true
+		<-queue.startedTTRProcessing
+	}
+	return n, nil
+}
+
+// restoreItem creates an item from the given snapshot and data and adds it to
+// the appropriate sub-queue. You must hold the queue lock when calling this.
+func (queue *Queue) restoreItem(is *itemSnapshot, data interface{}) *Item {
+	item := newItem(is.Key, is.ReserveGroup, data, is.Priority, is.Delay, is.TTR)
+	item.size = is.Size
+	item.creation = is.Creation
+	item.dependencies = is.Dependencies
+	item.depsNeeded = is.DepsNeeded
+	item.remainingDeps = make(map[string]bool)
+	for _, dep := range is.RemainingDeps {
+		item.remainingDeps[dep] = true
+		if _, exists := queue.dependants[dep]; !exists {
+			queue.dependants[dep] = make(map[string]*Item)
+		}
+		queue.dependants[dep][item.Key] = item
+	}
+	queue.items.set(item.Key, item)
+
+	switch is.State {
+	case ItemStateDelay:
+		item.readyAt = is.ReadyAt
+		queue.delayQueue.push(item)
+	case ItemStateRun:
+		item.switchDelayReady()
+		item.releaseAt = is.ReleaseAt
+		queue.runQueue.push(item)
+		item.switchReadyRun()
+	case ItemStateBury:
+		item.switchDelayReady()
+		queue.buryQueue.push(item)
+		item.switchRunBury()
+	case ItemStateDependent:
+		item.switchDelayDependent()
+		queue.depQueue.push(item)
+	default:
+		item.switchDelayReady()
+		queue.readyQueue.push(item)
+	}
+
+	// the switches above alter the counts, so restore them afterwards
+	item.mutex.Lock()
+	item.reserves = is.Reserves
+	item.timeouts = is.Timeouts
+	item.releases = is.Releases
+	item.buries = is.Buries
+	item.kicks = is.Kicks
+	item.mutex.Unlock()
+
+	if !is.ExpiresAt.IsZero() {
+		queue.setItemExpiry(item, is.ExpiresAt)
+	}
+
+	return item
+}
+
+// subQueueForState returns the SubQueue that items in the given state are in.
+func subQueueForState(state ItemState) SubQueue {
+	switch state {
+	case ItemStateDelay:
+		return SubQueueDelay
+	case ItemStateRun:
+		return SubQueueRun
+	case ItemStateBury:
+		return SubQueueBury
+	case ItemStateDependent:
+		return SubQueueDependent
+	}
+	return SubQueueReady
+}
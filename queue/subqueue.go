@@ -23,6 +23,7 @@ package queue
 
 import (
 	"container/heap"
+	"sync/atomic"
 	"time"
 
 	sync "github.com/sasha-s/go-deadlock"
@@ -32,11 +33,13 @@ import (
 )
 
 type subQueue struct {
+	size                     int64 // accessed atomically; first for alignment
 	mutex                    sync.RWMutex
 	items                    []*Item
-	groupedItems             map[string][]*Item
+	groups                   map[string]*readyGroup
+	order                    ReadyOrder
+	fairGroup                FairGroup
 	sqIndex                  int
-	reserveGroup             string
 	pushNotificationChannels map[string]map[string]chan bool
 	log15.Logger
 }
@@ -44,6 +47,12 @@ type subQueue struct {
 // create a new subQueue that can hold *Items in "priority" order. sqIndex is
 // one of 0 (priority is based on the item's delay), 1 (priority is based on the
 // item's priority or creation) or 2 (priority is based on the item's ttr).
+//
+// For sqIndex 1, items are held in a separate heap per ReserveGroup, so that
+// getting the next item in a group doesn't depend on how many items there are
+// in other groups. Within a ReserveGroup, items are further split in to a heap
+// per fair group (see FairGroup), so that popFiltered() can skip over whole
+// fair groups at a time.
 func newSubQueue(sqIndex int, logger ...log15.Logger) *subQueue {
 	var l log15.Logger
 	if len(logger) == 1 {
@@ -58,7 +67,8 @@ func newSubQueue(sqIndex int, logger ...log15.Logger) *subQueue {
 		Logger:                   l,
 	}
 	if sqIndex == 1 {
-		queue.groupedItems = make(map[string][]*Item)
+		queue.groups = make(map[string]*readyGroup)
+		queue.order = OrderPriority
 	}
 	heap.Init(queue)
 	return queue
@@ -117,74 +127,145 @@ func (q *subQueue) triggerNotify(reserveGroup string) {
 	}
 }
 
+// notifyReady sends true on the channels registered with notifyPush() for
+// every ReserveGroup that currently has items in this queue. It is only useful
+// for a queue with sqIndex 1.
+func (q *subQueue) notifyReady() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for name := range q.groups {
+		q.triggerNotify(name)
+	}
+}
+
 // push adds an item to the queue
 func (q *subQueue) push(item *Item) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	if q.sqIndex == 1 {
-		q.reserveGroup = item.ReserveGroup
+		defer q.triggerNotify(item.ReserveGroup)
+		q.pushGrouped(item)
+		return
+	}
+	defer q.triggerNotify("")
+	heap.Push(q, item)
+}
+
+// restore is like push(), but doesn't notify anyone; for putting back items
+// that were pop()ed but then not used.
+func (q *subQueue) restore(item *Item) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.sqIndex == 1 {
+		q.pushGrouped(item)
+		return
 	}
-	defer q.triggerNotify(q.reserveGroup)
 	heap.Push(q, item)
 }
 
+// pushGrouped adds an item to the heap for its ReserveGroup, creating the heap
+// if necessary. You must hold the mutex lock before calling this.
+func (q *subQueue) pushGrouped(item *Item) {
+	group, existed := q.groups[item.ReserveGroup]
+	if !existed {
+		group = newReadyGroup(q.order)
+		q.groups[item.ReserveGroup] = group
+	}
+	item.fairGroup = ""
+	if q.fairGroup != nil {
+		item.fairGroup = q.fairGroup(item)
+	}
+	group.push(item)
+	atomic.AddInt64(&q.size, 1)
+}
+
+// removeGrouped removes an item from the heap for the given ReserveGroup,
+// deleting the heap if it becomes empty. You must hold the mutex lock before
+// calling this.
+func (q *subQueue) removeGrouped(item *Item, reserveGroup string) {
+	group, existed := q.groups[reserveGroup]
+	if !existed {
+		return
+	}
+	group.remove(item)
+	atomic.AddInt64(&q.size, -1)
+	if group.len() == 0 {
+		delete(q.groups, reserveGroup)
+	}
+}
+
 // pop removes the next item from the queue according to its "priority"
 func (q *subQueue) pop(reserveGroup ...string) *Item {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	var itemList []*Item
 	if q.sqIndex == 1 {
-		var group string
+		var name string
 		if len(reserveGroup) == 1 {
-			group = reserveGroup[0]
-		}
-		var existed bool
-		if itemList, existed = q.groupedItems[group]; !existed {
-			return nil
+			name = reserveGroup[0]
 		}
-		q.reserveGroup = group
-	} else {
-		itemList = q.items
+		item, _ := q.popGrouped(name, nil)
+		return item
 	}
-	if len(itemList) == 0 {
+	if len(q.items) == 0 {
 		return nil
 	}
 	return heap.Pop(q).(*Item)
 }
 
+// popFiltered is like pop(), but only for a queue with sqIndex 1, returning the
+// next item of the first fair group (in the order of their next items) that
+// filter (if not nil) accepts the next item of. Also tells you if any fair
+// groups were skipped because filter didn't accept them.
+func (q *subQueue) popFiltered(reserveGroup string, filter Filter) (*Item, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.popGrouped(reserveGroup, filter)
+}
+
+// popGrouped does the work of popFiltered(). You must hold the mutex lock
+// before calling this.
+func (q *subQueue) popGrouped(reserveGroup string, filter Filter) (*Item, bool) {
+	group, existed := q.groups[reserveGroup]
+	if !existed {
+		return nil, false
+	}
+	item, skipped := group.pop(filter)
+	if item == nil {
+		return nil, skipped
+	}
+	atomic.AddInt64(&q.size, -1)
+	if group.len() == 0 {
+		delete(q.groups, reserveGroup)
+	}
+	return item, skipped
+}
+
 // remove removes a given item from the queue
 func (q *subQueue) remove(item *Item) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	if q.sqIndex == 1 {
-		q.reserveGroup = item.ReserveGroup
+		q.removeGrouped(item, item.ReserveGroup)
+		return
 	}
 	heap.Remove(q, item.queueIndexes[q.sqIndex])
 }
 
-// len tells you how many items are in the queue
+// len tells you how many items are in the queue. Without a reserveGroup, no
+// lock is needed.
 func (q *subQueue) len(reserveGroup ...string) int {
+	if len(reserveGroup) == 0 {
+		return int(atomic.LoadInt64(&q.size))
+	}
 	q.mutex.RLock()
 	defer q.mutex.RUnlock()
-	var itemList []*Item
 	if q.sqIndex == 1 {
-		if len(reserveGroup) == 1 {
-			group := reserveGroup[0]
-			var existed bool
-			if itemList, existed = q.groupedItems[group]; !existed {
-				return 0
-			}
-		} else {
-			num := 0
-			for _, il := range q.groupedItems {
-				num += len(il)
-			}
-			return num
+		if group, existed := q.groups[reserveGroup[0]]; existed {
+			return group.len()
 		}
-	} else {
-		itemList = q.items
+		return 0
 	}
-	return len(itemList)
+	return len(q.items)
 }
 
 // firstItem is useful in testing to get the first item in the queue in a
@@ -201,136 +282,379 @@ func (q *subQueue) firstItem() *Item {
 func (q *subQueue) update(item *Item, oldGroup ...string) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	if q.sqIndex == 1 && len(oldGroup) == 1 && oldGroup[0] != item.ReserveGroup {
-		q.reserveGroup = oldGroup[0]
-		heap.Remove(q, item.queueIndexes[q.sqIndex])
-		q.reserveGroup = item.ReserveGroup
-		defer q.triggerNotify(q.reserveGroup)
-		heap.Push(q, item)
+	if q.sqIndex == 1 {
+		if len(oldGroup) == 1 && oldGroup[0] != item.ReserveGroup {
+			q.removeGrouped(item, oldGroup[0])
+			defer q.triggerNotify(item.ReserveGroup)
+			q.pushGrouped(item)
+			return
+		}
+		if q.fairGroup != nil && q.fairGroup(item) != item.fairGroup {
+			q.removeGrouped(item, item.ReserveGroup)
+			q.pushGrouped(item)
+			return
+		}
+		if group, existed := q.groups[item.ReserveGroup]; existed {
+			group.fix(item)
+		}
 		return
 	}
 	heap.Fix(q, item.queueIndexes[q.sqIndex])
 }
 
+// setOrder changes the order in which items are popped from a queue with
+// sqIndex 1, reordering any items already in it.
+func (q *subQueue) setOrder(order ReadyOrder) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.order = order
+	for _, group := range q.groups {
+		group.setOrder(order)
+	}
+}
+
+// setFairGroup changes how a queue with sqIndex 1 splits the items of each
+// ReserveGroup in to fair groups, regrouping any items already in it.
+func (q *subQueue) setFairGroup(fairGroup FairGroup) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.fairGroup = fairGroup
+	groups := q.groups
+	q.groups = make(map[string]*readyGroup)
+	atomic.StoreInt64(&q.size, 0)
+	for _, group := range groups {
+		for _, fh := range group.heads {
+			for _, item := range fh.items {
+				q.pushGrouped(item)
+			}
+		}
+	}
+}
+
 // empty clears out a queue, setting it back to its new state
 func (q *subQueue) empty() {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	if q.sqIndex == 1 {
-		q.groupedItems = make(map[string][]*Item)
+		q.groups = make(map[string]*readyGroup)
 	} else {
 		q.items = nil
 	}
+	atomic.StoreInt64(&q.size, 0)
+}
+
+// allItems returns all the items in the queue, in no particular order.
+func (q *subQueue) allItems() []*Item {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	if q.sqIndex != 1 {
+		return append([]*Item(nil), q.items...)
+	}
+	items := make([]*Item, 0, atomic.LoadInt64(&q.size))
+	for _, group := range q.groups {
+		for _, fh := range group.heads {
+			items = append(items, fh.items...)
+		}
+	}
+	return items
 }
 
 // the following functions are required for the heap implementation, and though
 // they are exported they are not supposed to be used directly - use the above
-// methods instead
+// methods instead. For sqIndex 1 they are not used, except for Len(), which
+// returns the total number of items in all groups.
 
 func (q *subQueue) Len() int {
-	var itemList []*Item
 	if q.sqIndex == 1 {
-		var existed bool
-		if itemList, existed = q.groupedItems[q.reserveGroup]; !existed {
-			return 0
-		}
-	} else {
-		itemList = q.items
+		return int(atomic.LoadInt64(&q.size))
 	}
-	return len(itemList)
+	return len(q.items)
 }
 
 func (q *subQueue) Less(i, j int) bool {
-	switch q.sqIndex {
-	case 0:
+	if q.sqIndex == 0 {
 		return q.items[i].readyAt.Before(q.items[j].readyAt)
-	case 1:
-		if itemList, existed := q.groupedItems[q.reserveGroup]; existed {
-			if itemList[i].priority == itemList[j].priority {
-				if itemList[i].size == itemList[j].size {
-					return itemList[i].creation.Before(itemList[j].creation)
-				}
-				return itemList[i].size > itemList[j].size
-			}
-			return itemList[i].priority > itemList[j].priority
-		}
-		return false
 	}
-	// case 2, outside the switch, because we need to return
 	return q.items[i].releaseAt.Before(q.items[j].releaseAt)
 }
 
 func (q *subQueue) Swap(i, j int) {
-	var itemList []*Item
-	if q.sqIndex == 1 {
-		var existed bool
-		if itemList, existed = q.groupedItems[q.reserveGroup]; !existed {
+	swapItems(q.items, i, j, q.sqIndex)
+}
+
+func (q *subQueue) Push(x interface{}) {
+	q.items = pushItem(q.items, x.(*Item), q.sqIndex)
+	atomic.AddInt64(&q.size, 1)
+}
+
+func (q *subQueue) Pop() interface{} {
+	var item *Item
+	q.items, item = popItem(q.items, q.sqIndex)
+	atomic.AddInt64(&q.size, -1)
+	return item
+}
+
+// readyGroup holds the ready items that have a particular ReserveGroup, as a
+// heap of items per fair group, kept in the given order, along with a heap of
+// those fair groups ordered by their next item. That way the next item overall
+// is the next item of the first fair group, and whole fair groups can be
+// skipped without looking at their other items. The readyGroup implements
+// heap.Interface for its heap of fair groups; use the subQueue methods instead
+// of calling these directly.
+type readyGroup struct {
+	fair  map[string]*fairHeap
+	heads []*fairHeap
+	order ReadyOrder
+	size  int
+}
+
+// newReadyGroup creates a new, empty, readyGroup.
+func newReadyGroup(order ReadyOrder) *readyGroup {
+	return &readyGroup{fair: make(map[string]*fairHeap), order: order}
+}
+
+// len tells you how many items are in all the fair groups.
+func (g *readyGroup) len() int {
+	return g.size
+}
+
+// push adds an item to the heap of its fair group, creating it if necessary.
+func (g *readyGroup) push(item *Item) {
+	fh, existed := g.fair[item.fairGroup]
+	if !existed {
+		fh = &fairHeap{name: item.fairGroup, order: g.order}
+		g.fair[item.fairGroup] = fh
+		heap.Push(fh, item)
+		heap.Push(g, fh)
+	} else {
+		heap.Push(fh, item)
+		heap.Fix(g, fh.index)
+	}
+	g.size++
+}
+
+// pop removes and returns the next item of the first fair group that filter
+// (if not nil) accepts the next item of, also telling you if any fair groups
+// were skipped.
+func (g *readyGroup) pop(filter Filter) (*Item, bool) {
+	if len(g.heads) == 0 {
+		return nil, false
+	}
+	fh := g.heads[0]
+	var skipped bool
+	if filter != nil {
+		fh = nil
+		g.eachFairGroup(func(candidate *fairHeap) bool {
+			if filter(candidate.items[0]) {
+				fh = candidate
+				return false
+			}
+			skipped = true
+			return true
+		})
+		if fh == nil {
+			return nil, skipped
+		}
+	}
+
+	item := heap.Pop(fh).(*Item)
+	g.size--
+	g.fixFairGroup(fh)
+	return item, skipped
+}
+
+// remove removes the given item, which must be in one of our fair groups.
+func (g *readyGroup) remove(item *Item) {
+	fh, existed := g.fair[item.fairGroup]
+	if !existed {
+		return
+	}
+	heap.Remove(fh, item.queueIndexes[1])
+	g.size--
+	g.fixFairGroup(fh)
+}
+
+// fix corrects the position of an item whose "priority" characteristic(s)
+// changed.
+func (g *readyGroup) fix(item *Item) {
+	fh, existed := g.fair[item.fairGroup]
+	if !existed {
+		return
+	}
+	heap.Fix(fh, item.queueIndexes[1])
+	heap.Fix(g, fh.index)
+}
+
+// fixFairGroup corrects the position of the given fair group after its items
+// changed, deleting it if it has become empty.
+func (g *readyGroup) fixFairGroup(fh *fairHeap) {
+	if fh.Len() == 0 {
+		heap.Remove(g, fh.index)
+		delete(g.fair, fh.name)
+		return
+	}
+	heap.Fix(g, fh.index)
+}
+
+// setOrder changes the order of our items, reordering them.
+func (g *readyGroup) setOrder(order ReadyOrder) {
+	g.order = order
+	for _, fh := range g.heads {
+		fh.order = order
+		heap.Init(fh)
+	}
+	heap.Init(g)
+}
+
+// eachFairGroup calls fn with each of our fair groups in the order of their
+// next items, until fn returns false. Since the fair groups are in a heap, this
+// only has to consider the children of the fair groups already visited, so
+// visiting the first k costs O(k log k), however many fair groups there are.
+func (g *readyGroup) eachFairGroup(fn func(fh *fairHeap) bool) {
+	if len(g.heads) == 0 {
+		return
+	}
+	cursor := &fairCursor{group: g, indexes: []int{0}}
+	for cursor.Len() > 0 {
+		i := heap.Pop(cursor).(int)
+		if !fn(g.heads[i]) {
 			return
 		}
-	} else {
-		itemList = q.items
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(g.heads) {
+				heap.Push(cursor, child)
+			}
+		}
 	}
+}
+
+func (g *readyGroup) Len() int {
+	return len(g.heads)
+}
+
+func (g *readyGroup) Less(i, j int) bool {
+	return g.order(g.heads[i].items[0], g.heads[j].items[0])
+}
+
+func (g *readyGroup) Swap(i, j int) {
+	g.heads[i], g.heads[j] = g.heads[j], g.heads[i]
+	g.heads[i].index = i
+	g.heads[j].index = j
+}
+
+func (g *readyGroup) Push(x interface{}) {
+	fh := x.(*fairHeap)
+	fh.index = len(g.heads)
+	g.heads = append(g.heads, fh)
+}
+
+func (g *readyGroup) Pop() interface{} {
+	lasti := len(g.heads) - 1
+	fh := g.heads[lasti]
+	fh.index = -1
+	g.heads = g.heads[:lasti]
+	return fh
+}
 
-	itemList[i], itemList[j] = itemList[j], itemList[i]
+// fairHeap is the heap of items in one fair group of a readyGroup, kept in the
+// given order. It implements heap.Interface; use the readyGroup methods instead
+// of calling these directly.
+type fairHeap struct {
+	name  string
+	items []*Item
+	order ReadyOrder
+	index int // where we are in our readyGroup's heads
+}
+
+func (h *fairHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *fairHeap) Less(i, j int) bool {
+	return h.order(h.items[i], h.items[j])
+}
+
+func (h *fairHeap) Swap(i, j int) {
+	swapItems(h.items, i, j, 1)
+}
+
+func (h *fairHeap) Push(x interface{}) {
+	h.items = pushItem(h.items, x.(*Item), 1)
+}
+
+func (h *fairHeap) Pop() interface{} {
+	var item *Item
+	h.items, item = popItem(h.items, 1)
+	return item
+}
+
+// fairCursor is used by readyGroup.eachFairGroup() to visit the fair groups in
+// order without changing the readyGroup's heap. It is a heap of indexes in to
+// that heap.
+type fairCursor struct {
+	group   *readyGroup
+	indexes []int
+}
+
+func (c *fairCursor) Len() int {
+	return len(c.indexes)
+}
+
+func (c *fairCursor) Less(i, j int) bool {
+	return c.group.Less(c.indexes[i], c.indexes[j])
+}
+
+func (c *fairCursor) Swap(i, j int) {
+	c.indexes[i], c.indexes[j] = c.indexes[j], c.indexes[i]
+}
+
+func (c *fairCursor) Push(x interface{}) {
+	c.indexes = append(c.indexes, x.(int))
+}
+
+func (c *fairCursor) Pop() interface{} {
+	lasti := len(c.indexes) - 1
+	i := c.indexes[lasti]
+	c.indexes = c.indexes[:lasti]
+	return i
+}
+
+// swapItems swaps the items at the given indexes of a heap, updating their
+// record of where they are in it.
+func swapItems(items []*Item, i, j int, sqIndex int) {
+	items[i], items[j] = items[j], items[i]
 	lockFirst := i
 	lockSecond := j
-	if itemList[i].iid > itemList[j].iid {
+	if items[i].iid > items[j].iid {
 		lockFirst = j
 		lockSecond = i
 	}
-	itemList[lockFirst].mutex.Lock()
-	defer itemList[lockFirst].mutex.Unlock()
+	items[lockFirst].mutex.Lock()
+	defer items[lockFirst].mutex.Unlock()
 	if i != j {
-		itemList[lockSecond].mutex.Lock()
-		defer itemList[lockSecond].mutex.Unlock()
+		items[lockSecond].mutex.Lock()
+		defer items[lockSecond].mutex.Unlock()
 	}
 
-	itemList[i].queueIndexes[q.sqIndex] = i
-	itemList[j].queueIndexes[q.sqIndex] = j
+	items[i].queueIndexes[sqIndex] = i
+	items[j].queueIndexes[sqIndex] = j
 }
 
-func (q *subQueue) Push(x interface{}) {
-	item := x.(*Item)
-	var itemList []*Item
-	if q.sqIndex == 1 {
-		var existed bool
-		if itemList, existed = q.groupedItems[q.reserveGroup]; !existed {
-			q.groupedItems[q.reserveGroup] = itemList
-		}
-	} else {
-		itemList = q.items
-	}
+// pushItem appends an item to a heap, noting where it is.
+func pushItem(items []*Item, item *Item, sqIndex int) []*Item {
 	item.mutex.Lock()
-	item.queueIndexes[q.sqIndex] = len(itemList)
+	item.queueIndexes[sqIndex] = len(items)
 	item.mutex.Unlock()
-	itemList = append(itemList, item)
-	if q.sqIndex == 1 {
-		q.groupedItems[q.reserveGroup] = itemList
-	} else {
-		q.items = itemList
-	}
+	return append(items, item)
 }
 
-func (q *subQueue) Pop() interface{} {
-	var itemList []*Item
-	if q.sqIndex == 1 {
-		var existed bool
-		if itemList, existed = q.groupedItems[q.reserveGroup]; !existed {
-			return nil
-		}
-	} else {
-		itemList = q.items
-	}
-	lasti := len(itemList) - 1
-	item := itemList[lasti]
+// popItem removes the last item from a heap, noting that it is no longer in
+// it.
+func popItem(items []*Item, sqIndex int) ([]*Item, *Item) {
+	lasti := len(items) - 1
+	item := items[lasti]
 	item.mutex.Lock()
-	item.queueIndexes[q.sqIndex] = -1
+	item.queueIndexes[sqIndex] = -1
 	item.mutex.Unlock()
-	itemList = itemList[:lasti]
-	if q.sqIndex == 1 {
-		q.groupedItems[q.reserveGroup] = itemList
-	} else {
-		q.items = itemList
-	}
-	return item
+	return items[:lasti], item
 }
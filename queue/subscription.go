@@ -0,0 +1,199 @@
+// Copyright © 2020 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// This file contains the code for subscribing to items changing sub-queues.
+
+import (
+	"sync/atomic"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+// Transition describes some items moving from one sub-queue to another. For
+// new items in the queue, From will be SubQueueNew, and for items leaving the
+// queue, To will be SubQueueRemoved. Data holds the item.Data() of every item
+// that moved; it is shared between subscribers, so must not be altered.
+type Transition struct {
+	From SubQueue
+	To   SubQueue
+	Data []interface{}
+}
+
+// subscription holds the details of a single Subscribe() or
+// SubscribeChannel() call, and delivers Transitions to the subscriber in the
+// order they happened, without ever making the queue wait on the subscriber.
+type subscription struct {
+	from     SubQueue
+	to       SubQueue
+	callback ChangedCallback
+	ch       chan *Transition
+	pending  []*Transition
+	wake     chan bool
+	stop     chan bool
+	mutex    sync.Mutex
+}
+
+// newSubscription creates a subscription and starts delivering to it. Only one
+// of callback and ch should be supplied.
+func newSubscription(from, to SubQueue, callback ChangedCallback, ch chan *Transition) *subscription {
+	sub := &subscription{
+		from:     from,
+		to:       to,
+		callback: callback,
+		ch:       ch,
+		wake:     make(chan bool, 1),
+		stop:     make(chan bool),
+	}
+	go sub.deliverPending()
+	return sub
+}
+
+// matches tells you if this subscription is interested in items moving from
+// one sub-queue to another. A blank from or to matches any sub-queue.
+func (sub *subscription) matches(from, to SubQueue) bool {
+	return (sub.from == "" || sub.from == from) && (sub.to == "" || sub.to == to)
+}
+
+// deliver queues up the given Transition for delivery.
+func (sub *subscription) deliver(t *Transition) {
+	sub.mutex.Lock()
+	sub.pending = append(sub.pending, t)
+	sub.mutex.Unlock()
+	select {
+	case sub.wake <- true:
+	default:
+	}
+}
+
+// deliverPending is run in a goroutine by newSubscription(), and calls the
+// callback or sends on the channel for each Transition given to deliver(),
+// until close() is called.
+func (sub *subscription) deliverPending() {
+	for {
+		select {
+		case <-sub.wake:
+		case <-sub.stop:
+			sub.closeChannel()
+			return
+		}
+
+		sub.mutex.Lock()
+		pending := sub.pending
+		sub.pending = nil
+		sub.mutex.Unlock()
+
+		for _, t := range pending {
+			if sub.callback != nil {
+				sub.callback(t.From, t.To, t.Data)
+				continue
+			}
+			select {
+			case sub.ch <- t:
+			case <-sub.stop:
+				sub.closeChannel()
+				return
+			}
+		}
+	}
+}
+
+// closeChannel closes our channel, if any.
+func (sub *subscription) closeChannel() {
+	if sub.ch != nil {
+		close(sub.ch)
+	}
+}
+
+// close stops any further deliveries.
+func (sub *subscription) close() {
+	close(sub.stop)
+}
+
+// Subscribe arranges for the given callback to be called every time items move
+// from the given sub-queue to the given other sub-queue. A blank from or to
+// matches any sub-queue, so Subscribe("", "", cb) is told about every change,
+// like the callback set with SetChangedCallback().
+//
+// Unlike SetChangedCallback(), you can have as many subscriptions as you like,
+// and each subscriber is called in the order the changes happened, one call at
+// a time. Calls happen in a goroutine, so slow subscribers won't slow down the
+// queue, but changes will build up in memory until they are dealt with.
+//
+// Returns an id you can supply to Unsubscribe().
+func (queue *Queue) Subscribe(from, to SubQueue, callback ChangedCallback) uint64 {
+	return queue.addSubscription(newSubscription(from, to, callback, nil))
+}
+
+// SubscribeChannel is like Subscribe(), but instead of calling a callback, the
+// changes are sent on the returned channel. You must keep receiving from the
+// channel until you Unsubscribe() (or the queue is Destroy()ed), at which
+// point it will be closed.
+func (queue *Queue) SubscribeChannel(from, to SubQueue) (uint64, <-chan *Transition) {
+	ch := make(chan *Transition)
+	return queue.addSubscription(newSubscription(from, to, nil, ch)), ch
+}
+
+// addSubscription stores the given subscription, returning its id.
+func (queue *Queue) addSubscription(sub *subscription) uint64 {
+	id := atomic.AddUint64(&queue.subscriptionID, 1)
+	queue.subscriptionsMutex.Lock()
+	defer queue.subscriptionsMutex.Unlock()
+	if queue.isClosed() {
+		sub.close()
+		return id
+	}
+	queue.subscriptions[id] = sub
+	return id
+}
+
+// Unsubscribe stops the subscription with the given id, as returned by
+// Subscribe() or SubscribeChannel(), from being told about any more changes.
+// Unknown ids are ignored.
+func (queue *Queue) Unsubscribe(id uint64) {
+	queue.subscriptionsMutex.Lock()
+	defer queue.subscriptionsMutex.Unlock()
+	if sub, exists := queue.subscriptions[id]; exists {
+		sub.close()
+		delete(queue.subscriptions, id)
+	}
+}
+
+// unsubscribeAll stops all subscriptions.
+func (queue *Queue) unsubscribeAll() {
+	queue.subscriptionsMutex.Lock()
+	defer queue.subscriptionsMutex.Unlock()
+	for id, sub := range queue.subscriptions {
+		sub.close()
+		delete(queue.subscriptions, id)
+	}
+}
+
+// subscribersFor returns the subscriptions that match the given change.
+func (queue *Queue) subscribersFor(from, to SubQueue) []*subscription {
+	queue.subscriptionsMutex.RLock()
+	defer queue.subscriptionsMutex.RUnlock()
+	var subs []*subscription
+	for _, sub := range queue.subscriptions {
+		if sub.matches(from, to) {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}